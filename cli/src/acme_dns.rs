@@ -0,0 +1,880 @@
+//! Certificates tenement orders itself over ACME DNS-01 and HTTP-01
+//!
+//! rustls-acme answers TLS-ALPN-01 challenges, which can't prove control of a
+//! wildcard name. For `[settings.tls] wildcard_domains` tenement orders one
+//! certificate itself (RFC 8555): it publishes the `_acme-challenge` TXT records
+//! through the configured [`DnsSolver`], waits for them to propagate, and keeps
+//! the certificate and its key in the ACME cache directory. [`WildcardResolver`]
+//! hands that certificate to clients asking for a name under a wildcard and leaves
+//! every other name to rustls-acme.
+//!
+//! With `challenge = "http-01"` the main certificate is ordered the same way,
+//! answered by the HTTP listener from [`Http01Tokens`] instead of rustls-acme.
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use chrono::{DateTime, Utc};
+use ring::rand::SystemRandom;
+use ring::signature::{EcdsaKeyPair, KeyPair, ECDSA_P256_SHA256_FIXED_SIGNING};
+use rustls::pki_types::{CertificateDer, PrivateKeyDer, PrivatePkcs8KeyDer};
+use rustls::server::{ClientHello, ResolvesServerCert};
+use rustls::sign::CertifiedKey;
+use serde::Deserialize;
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, RwLock};
+use std::time::Duration;
+
+use crate::dns_providers::{DnsSolver, TxtRecord};
+
+pub const LETS_ENCRYPT: &str = "https://acme-v02.api.letsencrypt.org/directory";
+pub const LETS_ENCRYPT_STAGING: &str = "https://acme-staging-v02.api.letsencrypt.org/directory";
+
+/// Renew once a certificate has fewer days than this left
+const RENEW_DAYS: i64 = 30;
+
+/// How often to check whether the certificate is due, and to retry after a failure
+const CHECK_INTERVAL: Duration = Duration::from_secs(12 * 3600);
+const RETRY_INTERVAL: Duration = Duration::from_secs(3600);
+
+/// Wait between polls of a pending authorization or order, and the most polls
+const POLL_INTERVAL: Duration = Duration::from_secs(3);
+const POLL_ATTEMPTS: u32 = 40;
+
+fn b64(bytes: impl AsRef<[u8]>) -> String {
+    base64::engine::general_purpose::URL_SAFE_NO_PAD.encode(bytes)
+}
+
+/// Whether `host` is a name directly under one of the `wildcards` ("*.apps.example.com"
+/// covers "blog.apps.example.com" but not "apps.example.com" or "a.b.apps.example.com")
+pub fn covers(wildcards: &[String], host: &str) -> bool {
+    let host = host.trim_end_matches('.');
+    let Some((label, parent)) = host.split_once('.') else {
+        return false;
+    };
+    !label.is_empty()
+        && wildcards.iter().any(|wildcard| {
+            wildcard
+                .strip_prefix("*.")
+                .is_some_and(|w| w.eq_ignore_ascii_case(parent))
+        })
+}
+
+// ===================
+// Account key and JWS
+// ===================
+
+/// The ACME account's P-256 key, signing requests as ES256 JWS
+pub struct AccountKey {
+    pair: EcdsaKeyPair,
+    rng: SystemRandom,
+}
+
+impl AccountKey {
+    /// Key saved at `path` (PKCS#8 DER), created on first use
+    pub fn load_or_create(path: &Path) -> Result<Self> {
+        let rng = SystemRandom::new();
+        let pkcs8 = match std::fs::read(path) {
+            Ok(bytes) => bytes,
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => {
+                let document = EcdsaKeyPair::generate_pkcs8(&ECDSA_P256_SHA256_FIXED_SIGNING, &rng)
+                    .map_err(|_| anyhow::anyhow!("Failed to generate an ACME account key"))?;
+                write_private(path, document.as_ref())?;
+                document.as_ref().to_vec()
+            }
+            Err(e) => return Err(e).with_context(|| format!("Failed to read {}", path.display())),
+        };
+        let pair = EcdsaKeyPair::from_pkcs8(&ECDSA_P256_SHA256_FIXED_SIGNING, &pkcs8, &rng)
+            .map_err(|_| anyhow::anyhow!("{} is not a P-256 key", path.display()))?;
+        Ok(Self { pair, rng })
+    }
+
+    /// The public key as a JWK, members in the order RFC 7638 thumbprints use
+    fn jwk(&self) -> String {
+        // Uncompressed point: 0x04, then x and y
+        let point = self.pair.public_key().as_ref();
+        format!(
+            r#"{{"crv":"P-256","kty":"EC","x":"{}","y":"{}"}}"#,
+            b64(&point[1..33]),
+            b64(&point[33..65])
+        )
+    }
+
+    /// RFC 7638 thumbprint, the second half of every key authorization
+    pub fn thumbprint(&self) -> String {
+        b64(ring::digest::digest(
+            &ring::digest::SHA256,
+            self.jwk().as_bytes(),
+        ))
+    }
+
+    /// Flattened JWS of `payload` (`None` for POST-as-GET) to `url`, naming the key
+    /// by account URL once there is one and by JWK before
+    fn sign(
+        &self,
+        url: &str,
+        nonce: &str,
+        kid: Option<&str>,
+        payload: Option<&serde_json::Value>,
+    ) -> Result<serde_json::Value> {
+        let mut protected = serde_json::json!({ "alg": "ES256", "nonce": nonce, "url": url });
+        match kid {
+            Some(kid) => protected["kid"] = kid.into(),
+            None => protected["jwk"] = serde_json::from_str(&self.jwk())?,
+        }
+        let protected = b64(protected.to_string());
+        let payload = payload.map(|p| b64(p.to_string())).unwrap_or_default();
+        let signature = self
+            .pair
+            .sign(&self.rng, format!("{}.{}", protected, payload).as_bytes())
+            .map_err(|_| anyhow::anyhow!("Failed to sign an ACME request"))?;
+        Ok(serde_json::json!({
+            "protected": protected,
+            "payload": payload,
+            "signature": b64(signature),
+        }))
+    }
+}
+
+/// Name of the TXT record answering the challenge for `identifier`
+pub fn challenge_name(identifier: &str) -> String {
+    format!("_acme-challenge.{}", identifier.trim_start_matches("*."))
+}
+
+/// Key authorization for a challenge `token`: the HTTP-01 response body
+fn key_authorization(token: &str, thumbprint: &str) -> String {
+    format!("{}.{}", token, thumbprint)
+}
+
+/// Value of the TXT record for a challenge `token`
+pub fn txt_value(token: &str, thumbprint: &str) -> String {
+    let key_authorization = key_authorization(token, thumbprint);
+    b64(ring::digest::digest(
+        &ring::digest::SHA256,
+        key_authorization.as_bytes(),
+    ))
+}
+
+/// Path prefix the CA fetches HTTP-01 answers under
+pub const HTTP01_PATH: &str = "/.well-known/acme-challenge/";
+
+/// Key authorizations of the HTTP-01 challenges in flight, by token
+#[derive(Debug, Default)]
+pub struct Http01Tokens {
+    answers: RwLock<HashMap<String, String>>,
+}
+
+impl Http01Tokens {
+    /// The response body for a GET of `HTTP01_PATH` + `token`
+    pub fn answer(&self, token: &str) -> Option<String> {
+        self.answers.read().unwrap().get(token).cloned()
+    }
+
+    pub(crate) fn insert(&self, token: &str, thumbprint: &str) {
+        let answer = key_authorization(token, thumbprint);
+        let mut answers = self.answers.write().unwrap();
+        answers.insert(token.to_string(), answer);
+    }
+
+    fn remove(&self, token: &str) {
+        self.answers.write().unwrap().remove(token);
+    }
+}
+
+/// How an [`Issuer`] proves control of its names
+pub enum Solver {
+    /// TXT records published through a DNS API, waiting `propagation` before
+    /// asking for validation
+    Dns {
+        dns: DnsSolver,
+        propagation: Duration,
+    },
+    /// Answers served by the HTTP listener
+    Http(Arc<Http01Tokens>),
+}
+
+impl Solver {
+    /// The ACME challenge type, also naming its files in the cache directory
+    fn kind(&self) -> &'static str {
+        match self {
+            Solver::Dns { .. } => "dns-01",
+            Solver::Http(_) => "http-01",
+        }
+    }
+
+    /// For log lines
+    fn label(&self) -> &'static str {
+        match self {
+            Solver::Dns { .. } => "DNS-01",
+            Solver::Http(_) => "HTTP-01",
+        }
+    }
+
+    /// Put up the answers to `challenges` as (identifier, token)
+    async fn present(&self, challenges: &[(String, String)], thumbprint: &str) -> Result<()> {
+        match self {
+            Solver::Dns { dns, propagation } => {
+                dns.publish(&txt_records(challenges, thumbprint)).await?;
+                tokio::time::sleep(*propagation).await;
+            }
+            Solver::Http(tokens) => {
+                for (_, token) in challenges {
+                    tokens.insert(token, thumbprint);
+                }
+            }
+        }
+        Ok(())
+    }
+
+    /// Take the answers down again once the CA has checked them
+    async fn clean_up(&self, challenges: &[(String, String)], thumbprint: &str) {
+        match self {
+            Solver::Dns { dns, .. } => {
+                if let Err(e) = dns.remove(&txt_records(challenges, thumbprint)).await {
+                    tracing::warn!("DNS-01: failed to remove challenge records: {:#}", e);
+                }
+            }
+            Solver::Http(tokens) => {
+                for (_, token) in challenges {
+                    tokens.remove(token);
+                }
+            }
+        }
+    }
+}
+
+fn txt_records(challenges: &[(String, String)], thumbprint: &str) -> Vec<TxtRecord> {
+    challenges
+        .iter()
+        .map(|(identifier, token)| TxtRecord {
+            name: challenge_name(identifier),
+            value: txt_value(token, thumbprint),
+        })
+        .collect()
+}
+
+// ===================
+// ACME client
+// ===================
+
+#[derive(Debug, Deserialize)]
+#[serde(rename_all = "camelCase")]
+struct Directory {
+    new_nonce: String,
+    new_account: String,
+    new_order: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct Order {
+    status: String,
+    #[serde(default)]
+    authorizations: Vec<String>,
+    finalize: String,
+    #[serde(default)]
+    certificate: Option<String>,
+    /// Why the order is invalid, as an RFC 7807 problem document
+    #[serde(default)]
+    error: Option<serde_json::Value>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Authorization {
+    status: String,
+    identifier: Identifier,
+    #[serde(default)]
+    challenges: Vec<Challenge>,
+}
+
+#[derive(Debug, Deserialize)]
+struct Identifier {
+    value: String,
+}
+
+#[derive(Debug, Deserialize)]
+struct Challenge {
+    #[serde(rename = "type")]
+    kind: String,
+    url: String,
+    #[serde(default)]
+    token: String,
+}
+
+struct Client {
+    http: reqwest::Client,
+    directory: Directory,
+    key: AccountKey,
+    kid: Option<String>,
+    nonce: Option<String>,
+}
+
+impl Client {
+    async fn new(directory_url: &str, key: AccountKey) -> Result<Self> {
+        let http = reqwest::Client::builder()
+            .timeout(Duration::from_secs(30))
+            .build()?;
+        let directory = http
+            .get(directory_url)
+            .send()
+            .await?
+            .error_for_status()?
+            .json()
+            .await
+            .with_context(|| format!("Bad ACME directory at {}", directory_url))?;
+        Ok(Self {
+            http,
+            directory,
+            key,
+            kid: None,
+            nonce: None,
+        })
+    }
+
+    async fn nonce(&mut self) -> Result<String> {
+        if let Some(nonce) = self.nonce.take() {
+            return Ok(nonce);
+        }
+        let response = self.http.head(&self.directory.new_nonce).send().await?;
+        replay_nonce(&response).context("ACME server sent no nonce")
+    }
+
+    /// Signed POST of `payload` (POST-as-GET for `None`), retried once on a stale nonce
+    async fn post(
+        &mut self,
+        url: &str,
+        payload: Option<&serde_json::Value>,
+    ) -> Result<reqwest::Response> {
+        for attempt in 0..2 {
+            let nonce = self.nonce().await?;
+            let body = self.key.sign(url, &nonce, self.kid.as_deref(), payload)?;
+            let response = self
+                .http
+                .post(url)
+                .header(reqwest::header::CONTENT_TYPE, "application/jose+json")
+                .body(body.to_string())
+                .send()
+                .await?;
+            self.nonce = replay_nonce(&response);
+            if response.status().is_success() {
+                return Ok(response);
+            }
+            let status = response.status();
+            let problem: serde_json::Value = response.json().await.unwrap_or_default();
+            if problem["type"] == "urn:ietf:params:acme:error:badNonce" && attempt == 0 {
+                continue;
+            }
+            anyhow::bail!(
+                "ACME request to {} failed ({}): {}",
+                url,
+                status,
+                problem["detail"]
+            );
+        }
+        unreachable!("the second attempt returns")
+    }
+
+    async fn post_json<T: serde::de::DeserializeOwned>(
+        &mut self,
+        url: &str,
+        payload: Option<&serde_json::Value>,
+    ) -> Result<T> {
+        Ok(self.post(url, payload).await?.json().await?)
+    }
+
+    /// Find or create the account for the key, agreeing to the terms of service
+    async fn account(&mut self, email: &str) -> Result<()> {
+        let payload = serde_json::json!({
+            "termsOfServiceAgreed": true,
+            "contact": [format!("mailto:{}", email)],
+        });
+        let url = self.directory.new_account.clone();
+        let response = self.post(&url, Some(&payload)).await?;
+        self.kid = Some(location(&response).context("ACME account has no URL")?);
+        Ok(())
+    }
+
+    async fn authorization(&mut self, url: &str) -> Result<Authorization> {
+        for _ in 0..POLL_ATTEMPTS {
+            let authorization: Authorization = self.post_json(url, None).await?;
+            match authorization.status.as_str() {
+                "pending" => tokio::time::sleep(POLL_INTERVAL).await,
+                "valid" => return Ok(authorization),
+                status => anyhow::bail!(
+                    "DNS-01 challenge for {} is {}",
+                    authorization.identifier.value,
+                    status
+                ),
+            }
+        }
+        anyhow::bail!("DNS-01 challenge at {} is still pending", url)
+    }
+
+    /// Poll a finalized order until it's valid. It may still be "ready" or
+    /// "processing" meanwhile; "invalid" means the CA won't issue.
+    async fn valid_order(&mut self, url: &str) -> Result<Order> {
+        let mut status = String::new();
+        for _ in 0..POLL_ATTEMPTS {
+            let order: Order = self.post_json(url, None).await?;
+            match order.status.as_str() {
+                "valid" => return Ok(order),
+                "invalid" => {
+                    let detail = order.error.as_ref().and_then(|e| e.get("detail"));
+                    let detail = detail.and_then(|d| d.as_str()).unwrap_or("no reason given");
+                    anyhow::bail!("ACME order {} is invalid: {}", url, detail);
+                }
+                _ => status = order.status,
+            }
+            tokio::time::sleep(POLL_INTERVAL).await;
+        }
+        anyhow::bail!("ACME order {} is still {}", url, status)
+    }
+}
+
+fn replay_nonce(response: &reqwest::Response) -> Option<String> {
+    let nonce = response.headers().get("replay-nonce")?;
+    Some(nonce.to_str().ok()?.to_string())
+}
+
+fn location(response: &reqwest::Response) -> Option<String> {
+    let location = response.headers().get(reqwest::header::LOCATION)?;
+    Some(location.to_str().ok()?.to_string())
+}
+
+/// A certificate chain and its key, both PEM
+struct Issued {
+    chain_pem: String,
+    key_pem: String,
+}
+
+/// Order a certificate for the issuer's names, answering every challenge through its solver
+async fn issue(issuer: &Issuer) -> Result<Issued> {
+    let key = AccountKey::load_or_create(&issuer.cache_dir.join("dns01-account.key"))?;
+    let thumbprint = key.thumbprint();
+    let mut client = Client::new(&issuer.directory, key).await?;
+    client.account(&issuer.email).await?;
+
+    let identifiers: Vec<serde_json::Value> = issuer
+        .names
+        .iter()
+        .map(|name| serde_json::json!({ "type": "dns", "value": name }))
+        .collect();
+    let payload = serde_json::json!({ "identifiers": identifiers });
+    let new_order = client.directory.new_order.clone();
+    let response = client.post(&new_order, Some(&payload)).await?;
+    let order_url = location(&response).context("ACME order has no URL")?;
+    let order: Order = response.json().await?;
+
+    let kind = issuer.solver.kind();
+    let mut pending = Vec::new();
+    let mut challenges = Vec::new();
+    for url in &order.authorizations {
+        let authorization: Authorization = client.post_json(url, None).await?;
+        if authorization.status == "valid" {
+            continue;
+        }
+        let identifier = authorization.identifier.value;
+        let challenge = authorization
+            .challenges
+            .into_iter()
+            .find(|c| c.kind == kind)
+            .with_context(|| format!("ACME offers no {} challenge for {}", kind, identifier))?;
+        challenges.push((identifier, challenge.token));
+        pending.push((url.clone(), challenge.url));
+    }
+
+    if !challenges.is_empty() {
+        issuer.solver.present(&challenges, &thumbprint).await?;
+        let answered = async {
+            for (_, challenge) in &pending {
+                client
+                    .post_json::<serde_json::Value>(challenge, Some(&serde_json::json!({})))
+                    .await?;
+            }
+            for (authorization, _) in &pending {
+                client.authorization(authorization).await?;
+            }
+            Ok::<_, anyhow::Error>(())
+        }
+        .await;
+        issuer.solver.clean_up(&challenges, &thumbprint).await;
+        answered?;
+    }
+
+    let cert_key = rcgen::KeyPair::generate()?;
+    let csr = rcgen::CertificateParams::new(issuer.names.clone())?.serialize_request(&cert_key)?;
+    let payload = serde_json::json!({ "csr": b64(csr.der()) });
+    client.post(&order.finalize, Some(&payload)).await?;
+    let order = client.valid_order(&order_url).await?;
+    let certificate = order
+        .certificate
+        .with_context(|| format!("ACME order {} is valid without a certificate", order_url))?;
+    let chain_pem = client.post(&certificate, None).await?.text().await?;
+    Ok(Issued {
+        chain_pem,
+        key_pem: cert_key.serialize_pem(),
+    })
+}
+
+// ===================
+// Certificates on disk
+// ===================
+
+/// Blocks of `label` (e.g. "CERTIFICATE") in a PEM file, decoded
+fn pem_blocks(pem: &str, label: &str) -> Vec<Vec<u8>> {
+    let begin = format!("-----BEGIN {}-----", label);
+    let end = format!("-----END {}-----", label);
+    let mut blocks = Vec::new();
+    let mut rest = pem;
+    while let Some(start) = rest.find(&begin) {
+        let body = &rest[start + begin.len()..];
+        let Some(stop) = body.find(&end) else {
+            break;
+        };
+        let base64: String = body[..stop].split_whitespace().collect();
+        if let Ok(der) = base64::engine::general_purpose::STANDARD.decode(base64) {
+            blocks.push(der);
+        }
+        rest = &body[stop + end.len()..];
+    }
+    blocks
+}
+
+/// One DER element: its tag, its contents, and what follows it
+fn der_element(input: &[u8]) -> Option<(u8, &[u8], &[u8])> {
+    let (&tag, input) = input.split_first()?;
+    let (&first, mut input) = input.split_first()?;
+    let len = if first < 0x80 {
+        first as usize
+    } else {
+        let count = (first & 0x7f) as usize;
+        if count == 0 || count > 4 || input.len() < count {
+            return None;
+        }
+        let len = input[..count]
+            .iter()
+            .fold(0, |len, &b| (len << 8) | b as usize);
+        input = &input[count..];
+        len
+    };
+    (input.len() >= len).then(|| (tag, &input[..len], &input[len..]))
+}
+
+/// When an X.509 certificate (DER) expires
+pub fn not_after(der: &[u8]) -> Option<DateTime<Utc>> {
+    let (_, certificate, _) = der_element(der)?;
+    let (_, tbs, _) = der_element(certificate)?;
+    let (tag, _, rest) = der_element(tbs)?;
+    // An explicit version comes first; without one, that was the serial number
+    let mut rest = if tag == 0xa0 {
+        der_element(rest)?.2
+    } else {
+        rest
+    };
+    // Past the signature algorithm and the issuer
+    for _ in 0..2 {
+        rest = der_element(rest)?.2;
+    }
+    let (_, validity, _) = der_element(rest)?;
+    let (_, _, validity) = der_element(validity)?;
+    let (tag, time, _) = der_element(validity)?;
+    let time = std::str::from_utf8(time).ok()?;
+    let time = match tag {
+        // UTCTime: two-digit years, 1950 to 2049
+        0x17 if time.len() >= 2 => {
+            let century = if &time[..2] < "50" { "20" } else { "19" };
+            format!("{}{}", century, time)
+        }
+        0x18 => time.to_string(),
+        _ => return None,
+    };
+    let time = chrono::NaiveDateTime::parse_from_str(&time, "%Y%m%d%H%M%SZ").ok()?;
+    Some(time.and_utc())
+}
+
+/// A certificate ready to serve, and when it expires
+struct Loaded {
+    key: Arc<CertifiedKey>,
+    not_after: DateTime<Utc>,
+}
+
+fn certified_key(chain_pem: &str, key_pem: &str) -> Result<Loaded> {
+    let chain: Vec<CertificateDer<'static>> = pem_blocks(chain_pem, "CERTIFICATE")
+        .into_iter()
+        .map(CertificateDer::from)
+        .collect();
+    let not_after = chain
+        .first()
+        .and_then(|leaf| not_after(leaf))
+        .context("Certificate has no readable expiry")?;
+    let key = pem_blocks(key_pem, "PRIVATE KEY")
+        .pop()
+        .context("No PKCS#8 private key")?;
+    let key = PrivateKeyDer::Pkcs8(PrivatePkcs8KeyDer::from(key));
+    let key = rustls::crypto::aws_lc_rs::sign::any_supported_type(&key)?;
+    Ok(Loaded {
+        key: Arc::new(CertifiedKey::new(chain, key)),
+        not_after,
+    })
+}
+
+fn write_private(path: &Path, contents: &[u8]) -> Result<()> {
+    let temp = path.with_extension("tmp");
+    std::fs::write(&temp, contents)?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(&temp, std::fs::Permissions::from_mode(0o600))?;
+    }
+    std::fs::rename(&temp, path).with_context(|| format!("Failed to write {}", path.display()))
+}
+
+// ===================
+// Issuer and resolver
+// ===================
+
+/// Keeps the certificate for `names` current
+pub struct Issuer {
+    /// ACME directory URL
+    pub directory: String,
+    pub email: String,
+    pub cache_dir: PathBuf,
+    pub names: Vec<String>,
+    pub solver: Solver,
+}
+
+impl Issuer {
+    /// Certificate and key files, named for `names` so a changed list orders anew
+    fn paths(&self) -> (PathBuf, PathBuf) {
+        let names = self.names.join(",");
+        let digest = ring::digest::digest(&ring::digest::SHA256, names.as_bytes());
+        let stem: String = digest.as_ref()[..8]
+            .iter()
+            .map(|b| format!("{:02x}", b))
+            .collect();
+        let dir = &self.cache_dir;
+        let prefix = self.solver.kind().replace('-', "");
+        (
+            dir.join(format!("{}-{}.crt", prefix, stem)),
+            dir.join(format!("{}-{}.key", prefix, stem)),
+        )
+    }
+
+    fn load(&self) -> Option<Loaded> {
+        let (cert, key) = self.paths();
+        let chain_pem = std::fs::read_to_string(cert).ok()?;
+        let key_pem = std::fs::read_to_string(key).ok()?;
+        match certified_key(&chain_pem, &key_pem) {
+            Ok(loaded) => Some(loaded),
+            Err(e) => {
+                let label = self.solver.label();
+                tracing::warn!("{}: ignoring the cached certificate: {:#}", label, e);
+                None
+            }
+        }
+    }
+
+    async fn renew(&self) -> Result<Loaded> {
+        let issued = issue(self).await?;
+        let loaded = certified_key(&issued.chain_pem, &issued.key_pem)?;
+        let (cert, key) = self.paths();
+        write_private(&key, issued.key_pem.as_bytes())?;
+        write_private(&cert, issued.chain_pem.as_bytes())?;
+        Ok(loaded)
+    }
+
+    /// Serve the cached certificate through `cert`, order a new one when it's
+    /// missing or within 30 days of expiry, then keep checking. `renewed` runs after
+    /// each newly issued certificate is in place.
+    pub async fn run(self, cert: Arc<IssuedCert>, renewed: impl Fn(&[String])) {
+        let label = self.solver.label();
+        let mut not_after = None;
+        if let Some(loaded) = self.load() {
+            cert.set(loaded.key);
+            not_after = Some(loaded.not_after);
+        }
+        loop {
+            let renew_at = not_after.map(|t| t - chrono::Duration::days(RENEW_DAYS));
+            let due = !renew_at.is_some_and(|t| t > Utc::now());
+            if !due {
+                tokio::time::sleep(CHECK_INTERVAL).await;
+                continue;
+            }
+            let names = self.names.join(", ");
+            tracing::info!("{}: ordering a certificate for {}", label, names);
+            match self.renew().await {
+                Ok(loaded) => {
+                    cert.set(loaded.key);
+                    not_after = Some(loaded.not_after);
+                    tracing::info!("{}: certificate valid until {}", label, loaded.not_after);
+                    renewed(&self.names);
+                }
+                Err(e) => {
+                    tracing::error!("{} certificate for {} failed: {:#}", label, names, e);
+                    tokio::time::sleep(RETRY_INTERVAL).await;
+                }
+            }
+        }
+    }
+}
+
+/// The latest certificate an [`Issuer`] put in place, served whatever name
+/// the client asks for
+#[derive(Debug, Default)]
+pub struct IssuedCert {
+    cert: RwLock<Option<Arc<CertifiedKey>>>,
+}
+
+impl IssuedCert {
+    fn set(&self, cert: Arc<CertifiedKey>) {
+        *self.cert.write().unwrap() = Some(cert);
+    }
+
+    fn get(&self) -> Option<Arc<CertifiedKey>> {
+        self.cert.read().unwrap().clone()
+    }
+}
+
+impl ResolvesServerCert for IssuedCert {
+    fn resolve(&self, _client_hello: ClientHello<'_>) -> Option<Arc<CertifiedKey>> {
+        self.get()
+    }
+}
+
+/// Serves the DNS-01 certificate for names under its wildcards, and asks
+/// `fallback` (rustls-acme, or the HTTP-01 certificate) for every other name
+#[derive(Debug)]
+pub struct WildcardResolver {
+    wildcards: Vec<String>,
+    cert: Arc<IssuedCert>,
+    fallback: Arc<dyn ResolvesServerCert>,
+}
+
+impl WildcardResolver {
+    pub fn new(
+        wildcards: Vec<String>,
+        cert: Arc<IssuedCert>,
+        fallback: Arc<dyn ResolvesServerCert>,
+    ) -> Self {
+        Self {
+            wildcards,
+            cert,
+            fallback,
+        }
+    }
+
+    /// The certificate for `server_name`, if it falls under a wildcard
+    fn wildcard_cert(&self, server_name: Option<&str>) -> Option<Arc<CertifiedKey>> {
+        if !covers(&self.wildcards, server_name?) {
+            return None;
+        }
+        self.cert.get()
+    }
+}
+
+impl ResolvesServerCert for WildcardResolver {
+    fn resolve(&self, client_hello: ClientHello<'_>) -> Option<Arc<CertifiedKey>> {
+        self.wildcard_cert(client_hello.server_name())
+            .or_else(|| self.fallback.resolve(client_hello))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_covers_one_label_under_wildcard() {
+        let wildcards = vec!["*.apps.example.com".to_string()];
+        assert!(covers(&wildcards, "blog.apps.example.com"));
+        assert!(covers(&wildcards, "Blog.APPS.example.com."));
+        assert!(!covers(&wildcards, "apps.example.com"));
+        assert!(!covers(&wildcards, "a.blog.apps.example.com"));
+        assert!(!covers(&wildcards, "blog.example.com"));
+        assert!(!covers(&[], "blog.apps.example.com"));
+    }
+
+    #[test]
+    fn test_challenge_record() {
+        assert_eq!(
+            challenge_name("*.apps.example.com"),
+            "_acme-challenge.apps.example.com"
+        );
+        assert_eq!(challenge_name("example.com"), "_acme-challenge.example.com");
+        let value = txt_value(
+            "evaGxfADs6pSRb2LAv9IZf17Dt3juxGJ-PCt92wr-oA",
+            "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs",
+        );
+        assert_eq!(value, "ZTRx1Ckl1-tM05o5zaizTTA0yUy5AGereMgSNWC6Ll8");
+    }
+
+    #[tokio::test]
+    async fn test_http01_answers_while_presented() {
+        let tokens = Arc::new(Http01Tokens::default());
+        let solver = Solver::Http(tokens.clone());
+        let challenges = vec![("example.com".to_string(), "tok".to_string())];
+        assert_eq!(solver.kind(), "http-01");
+
+        solver.present(&challenges, "thumb").await.unwrap();
+        assert_eq!(tokens.answer("tok").as_deref(), Some("tok.thumb"));
+        assert_eq!(tokens.answer("other"), None);
+        solver.clean_up(&challenges, "thumb").await;
+        assert_eq!(tokens.answer("tok"), None);
+    }
+
+    #[test]
+    fn test_account_key_signs_jws() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("account.key");
+        let key = AccountKey::load_or_create(&path).unwrap();
+        // Saved and loaded back as the same key
+        let thumbprint = AccountKey::load_or_create(&path).unwrap().thumbprint();
+        assert_eq!(key.thumbprint(), thumbprint);
+        assert!(key.jwk().starts_with(r#"{"crv":"P-256","kty":"EC","x":""#));
+
+        let payload = serde_json::json!({ "termsOfServiceAgreed": true });
+        let url = "https://acme.test/new-acct";
+        let jws = key.sign(url, "nonce", None, Some(&payload)).unwrap();
+        let protected = jws["protected"].as_str().unwrap();
+        let header = base64::engine::general_purpose::URL_SAFE_NO_PAD
+            .decode(protected)
+            .unwrap();
+        let header: serde_json::Value = serde_json::from_slice(&header).unwrap();
+        assert_eq!(header["alg"], "ES256");
+        assert_eq!(header["url"], url);
+        assert_eq!(header["jwk"]["kty"], "EC");
+
+        let message = format!("{}.{}", protected, jws["payload"].as_str().unwrap());
+        let signature = base64::engine::general_purpose::URL_SAFE_NO_PAD
+            .decode(jws["signature"].as_str().unwrap())
+            .unwrap();
+        let public_key = ring::signature::UnparsedPublicKey::new(
+            &ring::signature::ECDSA_P256_SHA256_FIXED,
+            key.pair.public_key().as_ref(),
+        );
+        public_key.verify(message.as_bytes(), &signature).unwrap();
+
+        // POST-as-GET has an empty payload, and an account names itself by URL
+        let jws = key
+            .sign(url, "nonce", Some("https://acme.test/acct/1"), None)
+            .unwrap();
+        assert_eq!(jws["payload"], "");
+    }
+
+    #[test]
+    fn test_certified_key_reads_expiry() {
+        let key = rcgen::KeyPair::generate().unwrap();
+        let mut params = rcgen::CertificateParams::new(vec!["*.apps.example.com".into()]).unwrap();
+        params.not_after = rcgen::date_time_ymd(2031, 3, 4);
+        let cert = params.self_signed(&key).unwrap();
+
+        let expected = "2031-03-04T00:00:00Z".parse::<DateTime<Utc>>().unwrap();
+        assert_eq!(not_after(cert.der()), Some(expected));
+        let loaded = certified_key(&cert.pem(), &key.serialize_pem()).unwrap();
+        assert_eq!(loaded.not_after, expected);
+        assert_eq!(loaded.key.cert.len(), 1);
+
+        assert!(not_after(b"\x30\x03\x02\x01\x01").is_none());
+        assert!(certified_key("", &key.serialize_pem()).is_err());
+    }
+}
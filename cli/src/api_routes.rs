@@ -1,16 +1,23 @@
 //! Server-side API routes for instance mutation (spawn, stop, restart, etc.)
 //!
 //! These endpoints are called by the CLI client (see client.rs).
-//! All routes are under /api/* and protected by Bearer token auth.
+//! All routes are under /api/* and protected by Bearer token auth, except on
+//! the local admin socket, where the socket's file permissions stand in for it.
 
 use axum::{
-    extract::{Path, State},
-    http::StatusCode,
+    body::Bytes,
+    extract::{Path, Query, State},
+    http::{header, HeaderMap, StatusCode},
+    response::{IntoResponse, Response},
     Json,
 };
 use serde::{Deserialize, Serialize};
 
+use crate::previews::{self, Preview};
 use crate::server::AppState;
+use crate::webhooks::{self, Webhook};
+use tenement::events::EventKind;
+use tenement::fault::{FaultConfig, ServiceFault};
 
 // ===================
 // Request/Response types
@@ -48,6 +55,33 @@ pub struct DeployRequest {
     pub weight: u8,
     #[serde(default = "default_timeout")]
     pub timeout: u64,
+    /// Running version to replace: traffic moves over once the new one is
+    /// healthy, then this one is drained and stopped
+    #[serde(default)]
+    pub replace: Option<String>,
+    /// Seconds to let the replaced version's connections finish
+    #[serde(default = "default_drain_timeout")]
+    pub drain_timeout: u64,
+    /// Build the version runs from, recorded with the release and given to
+    /// the instance as `TENEMENT_ARTIFACT`. A URL (`s3://`, `https://`,
+    /// `file://`) is fetched and unpacked into the version's release dir.
+    #[serde(default)]
+    pub artifact: Option<String>,
+    /// SHA-256 a fetched artifact must match (`sha256:<hex>`); without it the
+    /// artifact's `<url>.sha256` is used
+    #[serde(default)]
+    pub checksum: Option<String>,
+    /// Given to the instance as `APP_VERSION` (a `git push` deploy's commit)
+    #[serde(default)]
+    pub app_version: Option<String>,
+    /// OCI image the version runs, in place of the service's `image`
+    /// (container runtimes only)
+    #[serde(default)]
+    pub image: Option<String>,
+    /// Commit the version was built from, given to the instance as
+    /// `TENEMENT_GIT_SHA`
+    #[serde(default)]
+    pub git_sha: Option<String>,
 }
 
 fn default_weight() -> u8 {
@@ -56,6 +90,9 @@ fn default_weight() -> u8 {
 fn default_timeout() -> u64 {
     30
 }
+fn default_drain_timeout() -> u64 {
+    30
+}
 
 #[derive(Debug, Serialize, Deserialize)]
 pub struct DeployResponse {
@@ -63,6 +100,72 @@ pub struct DeployResponse {
     pub socket: String,
     pub weight: u8,
     pub status: String,
+    /// How the replaced version was taken over, for `replace` deploys
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub strategy: Option<String>,
+    /// Release number the deploy was recorded as
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub release: Option<u32>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct RollbackRequest {
+    pub process: String,
+    /// Release to go back to; defaults to the newest one running another version
+    #[serde(default)]
+    pub release: Option<u32>,
+    #[serde(default = "default_timeout")]
+    pub timeout: u64,
+    #[serde(default = "default_drain_timeout")]
+    pub drain_timeout: u64,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct RollbackResponse {
+    pub instance: String,
+    /// Release rolled back to
+    pub rolled_back_to: u32,
+    /// New release recording the rollback
+    pub release: u32,
+    /// How the running version was taken over; None when nothing was running
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub strategy: Option<String>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct GitDeployRequest {
+    /// Commit (or branch) of the service's repository to deploy
+    pub revision: String,
+    #[serde(default = "default_timeout")]
+    pub timeout: u64,
+    #[serde(default = "default_drain_timeout")]
+    pub drain_timeout: u64,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct GitDeployResponse {
+    /// Full commit SHA, given to the instance as `APP_VERSION`
+    pub sha: String,
+    /// Output of the service's `git.build` command
+    pub build_output: String,
+    #[serde(flatten)]
+    pub deploy: DeployResponse,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct GitServiceQuery {
+    pub service: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+pub struct DeploysQuery {
+    /// Most recent entries to return
+    #[serde(default = "default_deploys_limit")]
+    pub limit: usize,
+}
+
+fn default_deploys_limit() -> usize {
+    50
 }
 
 #[derive(Debug, Serialize, Deserialize)]
@@ -80,6 +183,240 @@ pub struct RouteResponse {
     pub to_weight: u8,
 }
 
+#[derive(Debug, Serialize, Deserialize)]
+pub struct MaintenanceRequest {
+    pub enabled: bool,
+    /// Retry-After, in seconds, of the 503s served meanwhile
+    #[serde(default = "default_maintenance_retry_after")]
+    pub retry_after: u64,
+}
+
+fn default_maintenance_retry_after() -> u64 {
+    300
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct MaintenanceResponse {
+    pub process: String,
+    pub enabled: bool,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub retry_after: Option<u64>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct DrainRequest {
+    /// Seconds to let connections finish and instances exit before killing them
+    #[serde(default = "default_drain_timeout")]
+    pub timeout: u64,
+}
+
+fn default_drain_timeout() -> u64 {
+    30
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct DrainResponse {
+    pub process: String,
+    /// Instances that finished and exited on their own
+    pub stopped: Vec<String>,
+    /// Instances killed at the timeout
+    pub force_killed: Vec<String>,
+    /// Connections the kill cut off
+    pub cut_connections: u32,
+}
+
+/// A stack's services and how their instances are doing
+#[derive(Debug, Serialize, Deserialize)]
+pub struct StackStatus {
+    pub stack: String,
+    /// In rollout order
+    pub services: Vec<StackServiceStatus>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct StackServiceStatus {
+    pub service: String,
+    pub instances: usize,
+    pub healthy: usize,
+    /// Past their health check's failure threshold
+    pub down: usize,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct StackDeployRequest {
+    /// Version each of the stack's services deploys
+    pub version: String,
+    #[serde(default = "default_weight")]
+    pub weight: u8,
+    #[serde(default = "default_timeout")]
+    pub timeout: u64,
+    /// Running version each service replaces, as with a single deploy
+    #[serde(default)]
+    pub replace: Option<String>,
+    #[serde(default = "default_drain_timeout")]
+    pub drain_timeout: u64,
+}
+
+/// How far a stack operation got. Steps run in the stack's rollout order and
+/// stop at the first failure.
+#[derive(Debug, Serialize, Deserialize)]
+pub struct StackResponse {
+    pub stack: String,
+    /// Instances restarted, or instances deployed, in order
+    pub completed: Vec<String>,
+    /// The step that failed and stopped the rest
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub failed: Option<StackFailure>,
+    /// Steps never attempted because of the failure
+    #[serde(default)]
+    pub skipped: Vec<String>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct StackFailure {
+    pub target: String,
+    pub error: String,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct FaultsRequest {
+    pub enabled: bool,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct FaultsResponse {
+    /// Whether faults are being injected
+    pub enabled: bool,
+    /// Services with fault settings, from their `[fault]` block or the API
+    pub services: Vec<ServiceFault>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct WebhookRequest {
+    pub url: String,
+    /// Event kinds to send (all if empty)
+    #[serde(default)]
+    pub events: Vec<EventKind>,
+    /// Key for the `X-Tenement-Signature` HMAC
+    #[serde(default)]
+    pub secret: Option<String>,
+}
+
+/// A registered webhook, without its secret
+#[derive(Debug, Serialize, Deserialize)]
+pub struct WebhookInfo {
+    pub id: String,
+    pub url: String,
+    pub events: Vec<EventKind>,
+    /// Whether deliveries carry a signature
+    pub signed: bool,
+    pub created_at: String,
+}
+
+impl From<Webhook> for WebhookInfo {
+    fn from(webhook: Webhook) -> Self {
+        Self {
+            id: webhook.id,
+            url: webhook.url,
+            events: webhook.events,
+            signed: webhook.signed,
+            created_at: webhook.created_at,
+        }
+    }
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct PreviewRequest {
+    pub process: String,
+    /// Subdomain label and instance ID (default: from the revision, e.g.
+    /// "feature/login" -> "feature-login")
+    #[serde(default)]
+    pub name: Option<String>,
+    /// Branch or commit of the service's git repository to build
+    #[serde(default)]
+    pub revision: Option<String>,
+    /// Artifact URL to unpack instead (`s3://`, `https://`, `file://`)
+    #[serde(default)]
+    pub artifact: Option<String>,
+    /// SHA-256 the artifact must match (`sha256:<hex>`)
+    #[serde(default)]
+    pub checksum: Option<String>,
+    /// Seconds until it's torn down (default: the service's `preview.ttl`)
+    #[serde(default)]
+    pub ttl: Option<u64>,
+    #[serde(default = "default_timeout")]
+    pub timeout: u64,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct PreviewResponse {
+    #[serde(flatten)]
+    pub preview: Preview,
+    /// Output of the service's `git.build` command (git previews)
+    #[serde(default)]
+    pub build_output: String,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct ClusterResponse {
+    /// The node answering
+    pub node: String,
+    pub mode: tenement::config::ClusterMode,
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub leader: Option<String>,
+    pub members: Vec<tenement::cluster::MemberStatus>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct AuthReloadResponse {
+    /// Tokens loaded from `settings.admin_tokens_file`
+    pub tokens: usize,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct ReloadResponse {
+    /// Services added, removed and changed in tenement.toml
+    pub added: Vec<String>,
+    pub removed: Vec<String>,
+    pub changed: Vec<String>,
+    /// Instances started, stopped and restarted to match
+    pub started: Vec<String>,
+    pub stopped: Vec<String>,
+    pub restarted: Vec<String>,
+    /// Instances that failed to start or weren't healthy after a restart
+    pub failed: Vec<String>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct ReloadPlanRequest {
+    /// tenement.toml as it would be reloaded
+    pub config: String,
+    /// The `[overlay.<env>]` to apply, as TENEMENT_ENV would pick
+    #[serde(default)]
+    pub environment: Option<String>,
+}
+
+#[derive(Debug, Serialize, Deserialize)]
+pub struct UpgradeResponse {
+    /// PID of the supervisor that took over
+    pub pid: u32,
+}
+
+impl From<tenement::ReloadReport> for ReloadResponse {
+    fn from(report: tenement::ReloadReport) -> Self {
+        let names = |ids: Vec<tenement::InstanceId>| ids.iter().map(|id| id.to_string()).collect();
+        Self {
+            added: report.diff.added,
+            removed: report.diff.removed,
+            changed: report.diff.changed,
+            started: names(report.started),
+            stopped: names(report.stopped),
+            restarted: names(report.restarted),
+            failed: names(report.failed),
+        }
+    }
+}
+
 #[derive(Debug, Serialize, Deserialize)]
 pub struct ApiError {
     pub error: String,
@@ -95,8 +432,8 @@ impl ApiError {
 // Route builder
 // ===================
 
-// Routes are wired in server.rs create_router() directly
-// to avoid Axum path parameter conflicts with merged routers.
+// Routes are wired in server.rs api_routes(), which both the public
+// router and the admin socket router use.
 
 // ===================
 // Handlers
@@ -143,6 +480,193 @@ pub async fn post_spawn(
     }))
 }
 
+/// Inspect an instance: GET /api/instances/{process:id}
+pub async fn get_instance(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(id): Path<String>,
+) -> Result<Json<tenement::instance::InstanceInfo>, (StatusCode, Json<ApiError>)> {
+    let (process, instance_id) = parse_instance_id(&id)?;
+    check_tenant_access(&auth, &instance_id)?;
+
+    state
+        .hypervisor
+        .get(&process, &instance_id)
+        .await
+        .map(Json)
+        .ok_or_else(|| {
+            (
+                StatusCode::NOT_FOUND,
+                Json(ApiError::new(format!("Instance not found: {}", id))),
+            )
+        })
+}
+
+/// The environment an instance was started with, or for one that isn't
+/// running the one it would start with, sensitive values masked:
+/// GET /api/instances/{process:id}/env
+pub async fn get_instance_env(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(id): Path<String>,
+) -> Result<Json<std::collections::BTreeMap<String, String>>, (StatusCode, Json<ApiError>)> {
+    let (process, instance_id) = parse_instance_id(&id)?;
+    check_tenant_access(&auth, &instance_id)?;
+
+    if let Some(env) = state.hypervisor.env(&process, &instance_id).await {
+        return Ok(Json(env));
+    }
+    if state.hypervisor.config().get_service(&process).is_none() {
+        return Err((
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!("Service not found: {}", process))),
+        ));
+    }
+    state
+        .hypervisor
+        .resolved_env(&process, &instance_id)
+        .map(Json)
+        .map_err(|e| {
+            (
+                StatusCode::UNPROCESSABLE_ENTITY,
+                Json(ApiError::new(format!("{:#}", e))),
+            )
+        })
+}
+
+/// Run a command inside an instance: POST /api/instances/{process:id}/exec
+/// with `Upgrade: tenement-exec` and an `ExecRequest` body. Served on the
+/// admin socket only; after the upgrade the connection carries exec frames.
+#[cfg(unix)]
+pub async fn exec_instance(
+    State(state): State<AppState>,
+    Path(id): Path<String>,
+    mut req: axum::extract::Request,
+) -> Result<Response, (StatusCode, Json<ApiError>)> {
+    use tenement::exec::{ExecRequest, Session, EXEC_PROTOCOL};
+
+    let (process, instance_id) = parse_instance_id(&id)?;
+    let bad_request = |message: String| (StatusCode::BAD_REQUEST, Json(ApiError::new(message)));
+    if !upgrades_to(req.headers(), EXEC_PROTOCOL) {
+        return Err(bad_request(format!(
+            "Exec needs `Upgrade: {}`",
+            EXEC_PROTOCOL
+        )));
+    }
+    let upgrade = hyper::upgrade::on(&mut req);
+    let body = axum::body::to_bytes(req.into_body(), 64 * 1024)
+        .await
+        .map_err(|e| bad_request(format!("Failed to read exec request: {}", e)))?;
+    let request: ExecRequest = serde_json::from_slice(&body)
+        .map_err(|e| bad_request(format!("Invalid exec request: {}", e)))?;
+    if request.command.is_empty() {
+        return Err(bad_request("No command given to run".to_string()));
+    }
+    if state.hypervisor.get(&process, &instance_id).await.is_none() {
+        return Err((
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!("Instance not found: {}", id))),
+        ));
+    }
+    let target = state
+        .hypervisor
+        .exec_target(&process, &instance_id)
+        .await
+        .map_err(|e| bad_request(format!("{:#}", e)))?;
+    let session = Session::spawn(&target, &request).map_err(|e| {
+        (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            Json(ApiError::new(format!("{:#}", e))),
+        )
+    })?;
+
+    tracing::info!(
+        app = process.as_str(),
+        event = "exec",
+        "Exec in {}: {}",
+        id,
+        request.command.join(" ")
+    );
+    tokio::spawn(async move {
+        match upgrade.await {
+            Ok(upgraded) => {
+                let stream = hyper_util::rt::TokioIo::new(upgraded);
+                if let Err(e) = session.run(stream).await {
+                    tracing::debug!("Exec in {} ended: {:#}", id, e);
+                }
+            }
+            // Dropping the session kills the command
+            Err(e) => tracing::warn!("Exec upgrade for {} failed: {}", id, e),
+        }
+    });
+    Ok(switching_protocols(EXEC_PROTOCOL))
+}
+
+/// Follow one instance's stdout and stderr: GET
+/// /api/instances/{process:id}/attach with `Upgrade: tenement-attach`. Served
+/// on the admin socket only.
+pub async fn attach_instance(
+    State(state): State<AppState>,
+    Path(id): Path<String>,
+    mut req: axum::extract::Request,
+) -> Result<Response, (StatusCode, Json<ApiError>)> {
+    use tenement::exec::ATTACH_PROTOCOL;
+
+    let (process, instance_id) = parse_instance_id(&id)?;
+    if !upgrades_to(req.headers(), ATTACH_PROTOCOL) {
+        return Err((
+            StatusCode::BAD_REQUEST,
+            Json(ApiError::new(format!(
+                "Attach needs `Upgrade: {}`",
+                ATTACH_PROTOCOL
+            ))),
+        ));
+    }
+    if state.hypervisor.get(&process, &instance_id).await.is_none() {
+        return Err((
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!("Instance not found: {}", id))),
+        ));
+    }
+    let upgrade = hyper::upgrade::on(&mut req);
+    let hypervisor = state.hypervisor.clone();
+    tokio::spawn(async move {
+        match upgrade.await {
+            Ok(upgraded) => {
+                let stream = hyper_util::rt::TokioIo::new(upgraded);
+                let attached = tenement::exec::attach(hypervisor, &process, &instance_id, stream);
+                if let Err(e) = attached.await {
+                    tracing::debug!("Attach to {} ended: {:#}", id, e);
+                }
+            }
+            Err(e) => tracing::warn!("Attach upgrade for {} failed: {}", id, e),
+        }
+    });
+    Ok(switching_protocols(ATTACH_PROTOCOL))
+}
+
+/// Whether a request asks to upgrade the connection to `protocol`
+fn upgrades_to(headers: &HeaderMap, protocol: &str) -> bool {
+    let upgrade = headers
+        .get_all(header::CONNECTION)
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(','))
+        .any(|token| token.trim().eq_ignore_ascii_case("upgrade"));
+    upgrade
+        && headers
+            .get(header::UPGRADE)
+            .is_some_and(|value| value.as_bytes().eq_ignore_ascii_case(protocol.as_bytes()))
+}
+
+fn switching_protocols(protocol: &'static str) -> Response {
+    (
+        StatusCode::SWITCHING_PROTOCOLS,
+        [(header::CONNECTION, "upgrade"), (header::UPGRADE, protocol)],
+    )
+        .into_response()
+}
+
 /// Stop an instance: DELETE /api/instances/{process:id}
 pub async fn delete_instance(
     State(state): State<AppState>,
@@ -247,6 +771,9 @@ pub async fn get_health_check(
 }
 
 /// Deploy: POST /api/deploy (admin only)
+///
+/// An artifact URL is fetched, verified and unpacked before the version starts,
+/// and the version runs in the dir it was unpacked into.
 pub async fn post_deploy(
     State(state): State<AppState>,
     axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
@@ -258,72 +785,685 @@ pub async fn post_deploy(
             Json(ApiError::new("Deploy requires admin token")),
         ));
     }
-    let socket = state
+    if req.image.is_some() {
+        let config = state.hypervisor.config();
+        if config
+            .get_service(&req.process)
+            .is_some_and(|svc| svc.image.is_none())
+        {
+            return Err((
+                StatusCode::BAD_REQUEST,
+                Json(ApiError::new(format!(
+                    "{} doesn't run a container image; `image` needs a container service",
+                    req.process
+                ))),
+            ));
+        }
+    }
+    let task = {
+        let state = state.clone();
+        async move {
+            let workdir = fetch_artifact(&state, &req).await?;
+            deploy(&state, &req, workdir, None).await
+        }
+    };
+    run_deploy(&state, task).await.map(Json)
+}
+
+/// Run a deploy-like `task` in a task the hypervisor tracks and wait for it, so
+/// a client that goes away doesn't stop it halfway (with a canary's traffic split)
+async fn run_deploy<T, F>(state: &AppState, task: F) -> Result<T, (StatusCode, Json<ApiError>)>
+where
+    T: Send + 'static,
+    F: std::future::Future<Output = Result<T, (StatusCode, Json<ApiError>)>> + Send + 'static,
+{
+    let error = |status: StatusCode, msg: String| (status, Json(ApiError::new(msg)));
+    let handle = state
+        .hypervisor
+        .spawn_deploy(task)
+        .map_err(|e| error(StatusCode::SERVICE_UNAVAILABLE, format!("{:#}", e)))?;
+    handle.await.unwrap_or_else(|e| {
+        let msg = format!("Deploy task failed: {}", e);
+        Err(error(StatusCode::INTERNAL_SERVER_ERROR, msg))
+    })
+}
+
+/// Fetch `req.artifact` into the version's release dir, if it's a URL;
+/// returns the dir. A plain path is recorded as given.
+async fn fetch_artifact(
+    state: &AppState,
+    req: &DeployRequest,
+) -> Result<Option<std::path::PathBuf>, (StatusCode, Json<ApiError>)> {
+    let error = |status: StatusCode, msg: String| (status, Json(ApiError::new(msg)));
+    let Some(url) = &req.artifact else {
+        return Ok(None);
+    };
+    let fetchers = tenement::artifact::Fetchers::default();
+    if fetchers.get(url).is_none() {
+        return match tenement::artifact::scheme(url) {
+            Some(scheme) => Err(error(
+                StatusCode::BAD_REQUEST,
+                format!("No fetcher for {}:// artifacts", scheme),
+            )),
+            None => Ok(None),
+        };
+    }
+    let config = state.hypervisor.config();
+    if config.get_service(&req.process).is_none() {
+        return Err(error(
+            StatusCode::NOT_FOUND,
+            format!("Unknown process: {}", req.process),
+        ));
+    }
+    // The version names its release dir
+    if req.version.is_empty() || req.version.contains(['/', '\\']) || req.version.starts_with('.') {
+        return Err(error(
+            StatusCode::BAD_REQUEST,
+            format!("Invalid version {:?}", req.version),
+        ));
+    }
+    // Unpacking replaces the release dir a running version works in
+    if state
         .hypervisor
-        .deploy_and_wait_healthy(&req.process, &req.version, req.weight, req.timeout)
+        .get(&req.process, &req.version)
+        .await
+        .is_some()
+    {
+        return Err(error(
+            StatusCode::CONFLICT,
+            format!("{}:{} is already running", req.process, req.version),
+        ));
+    }
+
+    let dir =
+        tenement::artifact::release_dir(&config.settings.data_dir, &req.process, &req.version);
+    let fetched = fetchers
+        .fetch_into(url, req.checksum.as_deref(), &dir)
         .await
         .map_err(|e| {
-            tracing::error!("Deploy failed for {}:{}: {}", req.process, req.version, e);
-            (
-                StatusCode::INTERNAL_SERVER_ERROR,
-                Json(ApiError::new(e.to_string())),
-            )
+            tracing::error!(
+                "Fetching artifact for {}:{} failed: {:#}",
+                req.process,
+                req.version,
+                e
+            );
+            error(StatusCode::BAD_REQUEST, format!("{:#}", e))
         })?;
+    tracing::info!(
+        "Fetched {} (sha256 {}) into {}",
+        url,
+        fetched.sha256,
+        fetched.dir.display()
+    );
+    Ok(Some(fetched.dir))
+}
+
+/// Deploy `req.version` and record it as the service's next release. With a
+/// `workdir` (a release dir) the version runs there, and with a `start`
+/// (command and args detected from its source) it runs that.
+pub(crate) async fn deploy(
+    state: &AppState,
+    req: &DeployRequest,
+    workdir: Option<std::path::PathBuf>,
+    start: Option<(String, Vec<String>)>,
+) -> Result<DeployResponse, (StatusCode, Json<ApiError>)> {
+    let workdir = workdir.map(|dir| dir.display().to_string());
+    let (command, args) = start.clone().unzip();
+    let pin = tenement::hypervisor::ReleasePin {
+        command,
+        args,
+        artifact: req.artifact.clone(),
+        app_version: req.app_version.clone(),
+        workdir: workdir.clone(),
+        image: req.image.clone(),
+        git_sha: req.git_sha.clone(),
+        release: next_release(state, &req.process).await,
+        ..Default::default()
+    };
+    let previous = state
+        .hypervisor
+        .pin_release(&req.process, &req.version, pin)
+        .await;
+    let result = match &req.replace {
+        Some(old) => {
+            let drain = std::time::Duration::from_secs(req.drain_timeout);
+            state
+                .hypervisor
+                .deploy_replace(&req.process, old, &req.version, req.timeout, drain)
+                .await
+        }
+        None => {
+            state
+                .hypervisor
+                .deploy_and_wait_healthy(&req.process, &req.version, req.weight, req.timeout)
+                .await
+        }
+    };
+    let socket = match result {
+        Ok(socket) => socket,
+        Err(e) => {
+            tracing::error!("Deploy failed for {}:{}: {:#}", req.process, req.version, e);
+            state
+                .hypervisor
+                .restore_pin(&req.process, &req.version, previous)
+                .await;
+            return Err((
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(ApiError::new(format!("{:#}", e))),
+            ));
+        }
+    };
+
+    // A replacement takes all traffic
+    let strategy = match &req.replace {
+        Some(_) => state
+            .hypervisor
+            .config()
+            .get_service(&req.process)
+            .map(|svc| svc.deploy.strategy.to_string()),
+        None => None,
+    };
+    let (weight, mut details) = match (&req.replace, &strategy) {
+        (Some(old), Some(strategy)) => (
+            100,
+            format!(
+                "replaced={} strategy={} drain={}s",
+                old, strategy, req.drain_timeout
+            ),
+        ),
+        _ => (req.weight, format!("weight={}", req.weight)),
+    };
+
+    let config = state.hypervisor.config();
+    let release = match config.get_service(&req.process) {
+        Some(svc) => {
+            let mut definition = release_definition(svc, req, workdir);
+            if let Some((command, args)) = start {
+                definition.command = command;
+                definition.args = args;
+            }
+            match state
+                .releases
+                .record(&req.process, &req.version, &definition, "deploy")
+                .await
+            {
+                Ok(release) => Some(release.number),
+                Err(e) => {
+                    tracing::error!("Recording release failed: {:#}", e);
+                    None
+                }
+            }
+        }
+        None => None,
+    };
+    if let Some(number) = release {
+        details.push_str(&format!(" release=#{}", number));
+    }
 
     // Audit log
     if let Err(e) = state
         .deploy_log
-        .log(
-            "deploy",
-            &req.process,
-            &req.version,
-            Some(&format!("weight={}", req.weight)),
-            true,
-        )
+        .log("deploy", &req.process, &req.version, Some(&details), true)
         .await
     {
         tracing::error!("Audit log failed: {}", e);
     }
 
-    Ok(Json(DeployResponse {
+    Ok(DeployResponse {
         instance: format!("{}:{}", req.process, req.version),
         socket: socket.display().to_string(),
-        weight: req.weight,
+        weight,
         status: "healthy".to_string(),
-    }))
+        strategy,
+        release,
+    })
 }
 
-/// Route swap: POST /api/route (admin only)
-pub async fn post_route(
+/// A service's releases, newest first, env redacted: GET /api/releases/:process (admin only)
+pub async fn get_releases(
     State(state): State<AppState>,
     axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
-    Json(req): Json<RouteRequest>,
-) -> Result<Json<RouteResponse>, (StatusCode, Json<ApiError>)> {
+    Path(process): Path<String>,
+) -> Result<Json<Vec<tenement::Release>>, (StatusCode, Json<ApiError>)> {
     if auth.tenant_id.is_some() {
         return Err((
             StatusCode::FORBIDDEN,
-            Json(ApiError::new("Route swap requires admin token")),
+            Json(ApiError::new("Releases require admin token")),
         ));
     }
-    state
-        .hypervisor
-        .route_swap(&req.process, &req.from, &req.to)
-        .await
-        .map_err(|e| {
-            tracing::error!(
-                "Route swap failed for {} {} -> {}: {}",
-                req.process,
-                req.from,
-                req.to,
-                e
-            );
-            (
-                StatusCode::INTERNAL_SERVER_ERROR,
-                Json(ApiError::new(e.to_string())),
-            )
-        })?;
+    let config = state.hypervisor.config();
+    let svc = config.get_service(&process).ok_or_else(|| {
+        (
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!("Unknown process: {}", process))),
+        )
+    })?;
+    let mut releases = state.releases.list(&process).await.map_err(|e| {
+        (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            Json(ApiError::new(format!("{:#}", e))),
+        )
+    })?;
 
-    // Audit log
+    let redactor = svc.redactor();
+    for release in &mut releases {
+        let env = std::mem::take(&mut release.definition.env)
+            .into_iter()
+            .collect();
+        release.definition.env = redactor.redact_env(&env);
+    }
+    Ok(Json(releases))
+}
+
+/// The deploy audit log, newest first: GET /api/deploys?limit=N (admin only)
+pub async fn get_deploys(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Query(query): Query<DeploysQuery>,
+) -> Result<Json<Vec<tenement::DeployLogEntry>>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Deploy log requires admin token")),
+        ));
+    }
+    let entries = state.deploy_log.recent(query.limit).await.map_err(|e| {
+        (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            Json(ApiError::new(format!("{:#}", e))),
+        )
+    })?;
+    Ok(Json(entries))
+}
+
+/// Query the audit log, newest first: GET /api/audit?actor=&action=&process=
+/// &since=&failed=&limit= (admin only)
+pub async fn get_audit(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Query(query): Query<tenement::AuditQuery>,
+) -> Result<Json<Vec<tenement::DeployLogEntry>>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Audit log requires admin token")),
+        ));
+    }
+    if let Some(since) = &query.since {
+        if chrono::DateTime::parse_from_rfc3339(since).is_err() {
+            return Err((
+                StatusCode::BAD_REQUEST,
+                Json(ApiError::new(format!("Invalid since time {:?}", since))),
+            ));
+        }
+    }
+    let entries = state.deploy_log.query(&query).await.map_err(|e| {
+        (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            Json(ApiError::new(format!("{:#}", e))),
+        )
+    })?;
+    Ok(Json(entries))
+}
+
+/// Roll back to an earlier release: POST /api/rollback (admin only)
+///
+/// The release's version comes back with the command, args and env it was
+/// deployed with, through the same zero-downtime path as a `replace` deploy,
+/// and the rollback is recorded as a new release.
+pub async fn post_rollback(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Json(req): Json<RollbackRequest>,
+) -> Result<Json<RollbackResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Rollback requires admin token")),
+        ));
+    }
+    let task = rollback(state.clone(), req);
+    run_deploy(&state, task).await.map(Json)
+}
+
+async fn rollback(
+    state: AppState,
+    req: RollbackRequest,
+) -> Result<RollbackResponse, (StatusCode, Json<ApiError>)> {
+    let error = |status: StatusCode, msg: String| (status, Json(ApiError::new(msg)));
+    let releases = state
+        .releases
+        .list(&req.process)
+        .await
+        .map_err(|e| error(StatusCode::INTERNAL_SERVER_ERROR, format!("{:#}", e)))?;
+    let current = releases.first().ok_or_else(|| {
+        error(
+            StatusCode::NOT_FOUND,
+            format!("No releases of {}", req.process),
+        )
+    })?;
+    let target = match req.release {
+        Some(number) => releases
+            .iter()
+            .find(|r| r.number == number)
+            .ok_or_else(|| {
+                error(
+                    StatusCode::NOT_FOUND,
+                    format!("Release #{} of {} not found", number, req.process),
+                )
+            })?,
+        None => releases
+            .iter()
+            .find(|r| r.version != current.version)
+            .ok_or_else(|| {
+                error(
+                    StatusCode::BAD_REQUEST,
+                    format!("{} has no earlier release to roll back to", req.process),
+                )
+            })?,
+    };
+    if target.version == current.version {
+        return Err(error(
+            StatusCode::BAD_REQUEST,
+            format!(
+                "Release #{} is {}:{}, which is already the current release",
+                target.number, req.process, target.version
+            ),
+        ));
+    }
+
+    let definition = &target.definition;
+    let pin = tenement::hypervisor::ReleasePin {
+        command: Some(definition.command.clone()),
+        args: Some(definition.args.clone()),
+        env: Some(definition.env.clone().into_iter().collect()),
+        artifact: definition.artifact.clone(),
+        app_version: definition.app_version.clone(),
+        workdir: definition.workdir.clone(),
+        image: definition.image.clone(),
+        preview: false,
+        git_sha: definition.git_sha.clone(),
+        release: next_release(&state, &req.process).await,
+    };
+    let previous = state
+        .hypervisor
+        .pin_release(&req.process, &target.version, pin)
+        .await;
+
+    // With the current version gone there is nothing to take over from
+    let running = state
+        .hypervisor
+        .get(&req.process, &current.version)
+        .await
+        .is_some();
+    let (result, strategy) = if running {
+        let drain = std::time::Duration::from_secs(req.drain_timeout);
+        let strategy = state
+            .hypervisor
+            .config()
+            .get_service(&req.process)
+            .map(|svc| svc.deploy.strategy.to_string());
+        let result = state
+            .hypervisor
+            .deploy_replace(
+                &req.process,
+                &current.version,
+                &target.version,
+                req.timeout,
+                drain,
+            )
+            .await;
+        (result, strategy)
+    } else {
+        let result = state
+            .hypervisor
+            .deploy_and_wait_healthy(&req.process, &target.version, 100, req.timeout)
+            .await;
+        (result, None)
+    };
+    if let Err(e) = result {
+        tracing::error!(
+            "Rollback of {} to #{} failed: {:#}",
+            req.process,
+            target.number,
+            e
+        );
+        state
+            .hypervisor
+            .restore_pin(&req.process, &target.version, previous)
+            .await;
+        return Err(error(StatusCode::INTERNAL_SERVER_ERROR, format!("{:#}", e)));
+    }
+
+    let description = format!("rollback to #{}", target.number);
+    let release = state
+        .releases
+        .record(&req.process, &target.version, definition, &description)
+        .await
+        .map_err(|e| error(StatusCode::INTERNAL_SERVER_ERROR, format!("{:#}", e)))?;
+
+    // Audit log
+    let details = format!(
+        "release=#{} from={} to=#{}",
+        release.number, current.version, target.number
+    );
+    if let Err(e) = state
+        .deploy_log
+        .log(
+            "rollback",
+            &req.process,
+            &target.version,
+            Some(&details),
+            true,
+        )
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+
+    Ok(RollbackResponse {
+        instance: format!("{}:{}", req.process, target.version),
+        rolled_back_to: target.number,
+        release: release.number,
+        strategy,
+    })
+}
+
+/// Deploy a commit of a service's git repository: POST /api/git/:process/deploy
+/// (admin only). Called by the repository's post-receive hook after a push.
+///
+/// The commit is checked out into its own release dir and built there, then
+/// takes over from the current release the way a `replace` deploy does.
+pub async fn post_git_deploy(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(process): Path<String>,
+    Json(req): Json<GitDeployRequest>,
+) -> Result<Json<GitDeployResponse>, (StatusCode, Json<ApiError>)> {
+    use tenement::git_deploy;
+
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Git deploy requires admin token")),
+        ));
+    }
+    let error = |status: StatusCode, msg: String| (status, Json(ApiError::new(msg)));
+    let config = state.hypervisor.config();
+    let git = git_config(&config, &process)?;
+    let data_dir = &config.settings.data_dir;
+    let sha = git_deploy::resolve_commit(&git_deploy::repo_path(data_dir, &process), &req.revision)
+        .await
+        .map_err(|e| error(StatusCode::BAD_REQUEST, format!("{:#}", e)))?;
+    let version = git_deploy::short_sha(&sha).to_string();
+    // Its release dir is the running instance's working directory
+    if state.hypervisor.get(&process, &version).await.is_some() {
+        return Err(error(
+            StatusCode::CONFLICT,
+            format!("{}:{} is already running", process, version),
+        ));
+    }
+
+    let prepared = git_deploy::prepare_release(data_dir, &process, git, &sha)
+        .await
+        .map_err(|e| {
+            tracing::error!("Git deploy of {} at {} failed: {:#}", process, version, e);
+            error(StatusCode::INTERNAL_SERVER_ERROR, format!("{:#}", e))
+        })?;
+    let start = detected_start(&config, &process, prepared.plan.as_ref())
+        .map_err(|e| error(StatusCode::BAD_REQUEST, format!("{:#}", e)))?;
+
+    let releases = state
+        .releases
+        .list(&process)
+        .await
+        .map_err(|e| error(StatusCode::INTERNAL_SERVER_ERROR, format!("{:#}", e)))?;
+    // Take over from the current release, if it's still running
+    let mut replace = releases.into_iter().next().map(|current| current.version);
+    if let Some(current) = &replace {
+        if state.hypervisor.get(&process, current).await.is_none() {
+            replace = None;
+        }
+    }
+    let deploy_req = DeployRequest {
+        process: process.clone(),
+        version,
+        weight: default_weight(),
+        timeout: req.timeout,
+        replace,
+        drain_timeout: req.drain_timeout,
+        artifact: Some(prepared.dir.display().to_string()),
+        checksum: None,
+        app_version: Some(prepared.sha.clone()),
+        image: None,
+        git_sha: Some(prepared.sha.clone()),
+    };
+    let deploy = deploy(&state, &deploy_req, Some(prepared.dir.clone()), start).await?;
+    Ok(Json(GitDeployResponse {
+        sha: prepared.sha,
+        build_output: prepared.build_output,
+        deploy,
+    }))
+}
+
+/// Smart HTTP ref advertisement, the first step of a push:
+/// GET /git/:repo/info/refs?service=git-receive-pack (admin only)
+pub async fn get_git_info_refs(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(repo): Path<String>,
+    Query(query): Query<GitServiceQuery>,
+) -> Result<Response, (StatusCode, Json<ApiError>)> {
+    let repo = git_repo(&state, &auth, &repo).await?;
+    // Fetches would serve the source to anyone with a token; only pushes deploy
+    if query.service.as_deref() != Some("git-receive-pack") {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Only git push is supported")),
+        ));
+    }
+    let body = tenement::git_deploy::advertise_refs(&repo)
+        .await
+        .map_err(|e| {
+            (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(ApiError::new(format!("{:#}", e))),
+            )
+        })?;
+    Ok((
+        [
+            (
+                header::CONTENT_TYPE,
+                "application/x-git-receive-pack-advertisement",
+            ),
+            (header::CACHE_CONTROL, "no-cache"),
+        ],
+        body,
+    )
+        .into_response())
+}
+
+/// Smart HTTP push: POST /git/:repo/git-receive-pack (admin only). Answers
+/// once the post-receive hook, and so the deploy, has finished.
+pub async fn post_git_receive_pack(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(repo): Path<String>,
+    headers: HeaderMap,
+    body: Bytes,
+) -> Result<Response, (StatusCode, Json<ApiError>)> {
+    let repo = git_repo(&state, &auth, &repo).await?;
+    let gzipped = headers
+        .get(header::CONTENT_ENCODING)
+        .is_some_and(|encoding| encoding == "gzip");
+    let request = if gzipped {
+        use std::io::Read;
+        let mut request = Vec::new();
+        flate2::read::GzDecoder::new(&body[..])
+            .read_to_end(&mut request)
+            .map_err(|e| {
+                (
+                    StatusCode::BAD_REQUEST,
+                    Json(ApiError::new(format!("Invalid gzip body: {}", e))),
+                )
+            })?;
+        request
+    } else {
+        body.to_vec()
+    };
+    let result = tenement::git_deploy::receive_pack(&repo, &request)
+        .await
+        .map_err(|e| {
+            tracing::error!("git receive-pack into {} failed: {:#}", repo.display(), e);
+            (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(ApiError::new(format!("{:#}", e))),
+            )
+        })?;
+    Ok((
+        [
+            (
+                header::CONTENT_TYPE,
+                "application/x-git-receive-pack-result",
+            ),
+            (header::CACHE_CONTROL, "no-cache"),
+        ],
+        result,
+    )
+        .into_response())
+}
+
+/// Route swap: POST /api/route (admin only)
+pub async fn post_route(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Json(req): Json<RouteRequest>,
+) -> Result<Json<RouteResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Route swap requires admin token")),
+        ));
+    }
+    state
+        .hypervisor
+        .route_swap(&req.process, &req.from, &req.to)
+        .await
+        .map_err(|e| {
+            tracing::error!(
+                "Route swap failed for {} {} -> {}: {}",
+                req.process,
+                req.from,
+                req.to,
+                e
+            );
+            (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(ApiError::new(e.to_string())),
+            )
+        })?;
+
+    // Audit log
     if let Err(e) = state
         .deploy_log
         .log(
@@ -346,9 +1486,1017 @@ pub async fn post_route(
     }))
 }
 
-// ===================
-// Helpers
-// ===================
+/// Maintenance mode on or off: PUT /api/maintenance/{process} (admin only)
+pub async fn put_maintenance(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(process): Path<String>,
+    Json(req): Json<MaintenanceRequest>,
+) -> Result<Json<MaintenanceResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Maintenance mode requires admin token")),
+        ));
+    }
+    let retry_after = req.enabled.then_some(req.retry_after);
+    state
+        .hypervisor
+        .set_maintenance(&process, retry_after)
+        .map_err(|e| (StatusCode::NOT_FOUND, Json(ApiError::new(e.to_string()))))?;
+    if let Err(e) = crate::server::save_maintenance(&state).await {
+        tracing::error!("Failed to save maintenance mode: {}", e);
+    }
+
+    // Audit log
+    let action = if req.enabled { "on" } else { "off" };
+    if let Err(e) = state
+        .deploy_log
+        .log("maintenance", &process, "", Some(action), true)
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+
+    Ok(Json(MaintenanceResponse {
+        process,
+        enabled: req.enabled,
+        retry_after,
+    }))
+}
+
+/// Stop a service for maintenance without cutting requests off:
+/// POST /api/drain/{process} (admin only)
+pub async fn post_drain(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(process): Path<String>,
+    Json(req): Json<DrainRequest>,
+) -> Result<Json<DrainResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Draining requires admin token")),
+        ));
+    }
+    let report = state
+        .hypervisor
+        .drain_app(&process, std::time::Duration::from_secs(req.timeout))
+        .await
+        .map_err(|e| {
+            let status = match state.hypervisor.has_process(&process) {
+                true => StatusCode::INTERNAL_SERVER_ERROR,
+                false => StatusCode::NOT_FOUND,
+            };
+            (status, Json(ApiError::new(format!("{:#}", e))))
+        })?;
+
+    // Audit log
+    let details = format!(
+        "{} stopped, {} force-killed",
+        report.stopped.len(),
+        report.force_killed.len()
+    );
+    if let Err(e) = state
+        .deploy_log
+        .log("drain", &process, "", Some(&details), true)
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+
+    let names = |ids: Vec<tenement::InstanceId>| ids.iter().map(|id| id.to_string()).collect();
+    Ok(Json(DrainResponse {
+        process,
+        stopped: names(report.stopped),
+        force_killed: names(report.force_killed),
+        cut_connections: report.cut_connections,
+    }))
+}
+
+/// Each stack's services and their instances' health: GET /api/stacks (admin only)
+pub async fn get_stacks(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+) -> Result<Json<Vec<StackStatus>>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Stacks require admin token")),
+        ));
+    }
+    let instances = state.hypervisor.list().await;
+    let stacks = state
+        .hypervisor
+        .config()
+        .stacks()
+        .into_iter()
+        .map(|(stack, services)| StackStatus {
+            stack,
+            services: services
+                .into_iter()
+                .map(|service| {
+                    let own: Vec<_> = instances
+                        .iter()
+                        .filter(|info| info.id.process == service)
+                        .collect();
+                    StackServiceStatus {
+                        instances: own.len(),
+                        healthy: own
+                            .iter()
+                            .filter(|info| info.health == tenement::instance::HealthStatus::Healthy)
+                            .count(),
+                        down: own.iter().filter(|info| info.health.is_down()).count(),
+                        service,
+                    }
+                })
+                .collect(),
+        })
+        .collect();
+    Ok(Json(stacks))
+}
+
+/// Restart every running instance of a stack, one at a time in rollout
+/// order, each healthy and ready before the next goes, stopping at the first
+/// that fails: POST /api/stacks/{stack}/restart (admin only)
+pub async fn post_stack_restart(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(stack): Path<String>,
+) -> Result<Json<StackResponse>, (StatusCode, Json<ApiError>)> {
+    let services = stack_services(&state, &auth, &stack)?;
+    let task = {
+        let state = state.clone();
+        async move { Ok(Json(restart_stack(&state, stack, services).await)) }
+    };
+    run_deploy(&state, task).await
+}
+
+async fn restart_stack(state: &AppState, stack: String, services: Vec<String>) -> StackResponse {
+    let mut ids: Vec<tenement::InstanceId> = state
+        .hypervisor
+        .list()
+        .await
+        .into_iter()
+        .map(|info| info.id)
+        .filter(|id| services.contains(&id.process))
+        .collect();
+    let rank = |id: &tenement::InstanceId| services.iter().position(|s| *s == id.process);
+    ids.sort_by(|a, b| rank(a).cmp(&rank(b)).then_with(|| a.id.cmp(&b.id)));
+
+    let mut response = StackResponse {
+        stack: stack.clone(),
+        completed: Vec::new(),
+        failed: None,
+        skipped: Vec::new(),
+    };
+    for id in ids {
+        if response.failed.is_some() {
+            response.skipped.push(id.to_string());
+            continue;
+        }
+        let timeout = state
+            .hypervisor
+            .config()
+            .get_service(&id.process)
+            .map_or(10, |svc| svc.startup_timeout);
+        let timeout = std::time::Duration::from_secs(timeout);
+        let restarted = state
+            .hypervisor
+            .restart_serving(&id.process, &id.id, timeout);
+        match restarted.await {
+            Ok(()) => response.completed.push(id.to_string()),
+            Err(e) => {
+                tracing::error!("Stack {} restart stopped at {}: {}", stack, id, e);
+                response.failed = Some(StackFailure {
+                    target: id.to_string(),
+                    error: format!("{:#}", e),
+                });
+            }
+        }
+    }
+    audit_stack(state, "stack-restart", &response).await;
+    response
+}
+
+/// Deploy a version of every service in a stack, one service at a time in
+/// rollout order, stopping at the first that fails:
+/// POST /api/stacks/{stack}/deploy (admin only)
+pub async fn post_stack_deploy(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(stack): Path<String>,
+    Json(req): Json<StackDeployRequest>,
+) -> Result<Json<StackResponse>, (StatusCode, Json<ApiError>)> {
+    let services = stack_services(&state, &auth, &stack)?;
+    let task = {
+        let state = state.clone();
+        async move { Ok(Json(deploy_stack(&state, stack, services, &req).await)) }
+    };
+    run_deploy(&state, task).await
+}
+
+async fn deploy_stack(
+    state: &AppState,
+    stack: String,
+    services: Vec<String>,
+    req: &StackDeployRequest,
+) -> StackResponse {
+    let mut response = StackResponse {
+        stack: stack.clone(),
+        completed: Vec::new(),
+        failed: None,
+        skipped: Vec::new(),
+    };
+    for process in services {
+        let target = format!("{}:{}", process, req.version);
+        if response.failed.is_some() {
+            response.skipped.push(target);
+            continue;
+        }
+        let deploy = DeployRequest {
+            process,
+            version: req.version.clone(),
+            weight: req.weight,
+            timeout: req.timeout,
+            replace: req.replace.clone(),
+            drain_timeout: req.drain_timeout,
+            artifact: None,
+            checksum: None,
+            app_version: None,
+            image: None,
+            git_sha: None,
+        };
+        // Already in a deploy task of its own, with no artifact to fetch
+        match deploy(state, &deploy, None, None).await {
+            Ok(deployed) => response.completed.push(deployed.instance),
+            Err((_, Json(e))) => {
+                tracing::error!("Stack {} deploy stopped at {}: {}", stack, target, e.error);
+                response.failed = Some(StackFailure {
+                    target,
+                    error: e.error,
+                });
+            }
+        }
+    }
+    audit_stack(state, "stack-deploy", &response).await;
+    response
+}
+
+/// A stack's services in rollout order, for an admin
+fn stack_services(
+    state: &AppState,
+    auth: &crate::server::AuthIdentity,
+    stack: &str,
+) -> Result<Vec<String>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Stacks require admin token")),
+        ));
+    }
+    let services = state.hypervisor.config().stack_services(stack);
+    if services.is_empty() {
+        return Err((
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!("Unknown stack: {}", stack))),
+        ));
+    }
+    Ok(services)
+}
+
+async fn audit_stack(state: &AppState, action: &str, response: &StackResponse) {
+    let details = match &response.failed {
+        Some(failed) => format!(
+            "{} done, failed at {}: {}",
+            response.completed.len(),
+            failed.target,
+            failed.error
+        ),
+        None => format!("{} done", response.completed.len()),
+    };
+    if let Err(e) = state
+        .deploy_log
+        .log(
+            action,
+            &response.stack,
+            "",
+            Some(&details),
+            response.failed.is_none(),
+        )
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+}
+
+/// Fault injection state: GET /api/faults (admin only)
+pub async fn get_faults(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+) -> Result<Json<FaultsResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Fault injection requires admin token")),
+        ));
+    }
+    Ok(Json(faults_response(&state)))
+}
+
+/// Fault injection on or off: PUT /api/faults (admin only). Lasts until
+/// tenement restarts, which goes back to `settings.fault_injection`.
+pub async fn put_faults(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Json(req): Json<FaultsRequest>,
+) -> Result<Json<FaultsResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Fault injection requires admin token")),
+        ));
+    }
+    state.hypervisor.set_fault_injection(req.enabled);
+
+    // Audit log
+    let action = if req.enabled { "on" } else { "off" };
+    if let Err(e) = state
+        .deploy_log
+        .log("faults", "", "", Some(action), true)
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+
+    Ok(Json(faults_response(&state)))
+}
+
+/// Replace a service's faults: PUT /api/faults/{process} (admin only)
+pub async fn put_service_fault(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(process): Path<String>,
+    Json(fault): Json<FaultConfig>,
+) -> Result<Json<FaultsResponse>, (StatusCode, Json<ApiError>)> {
+    set_service_fault(&state, &auth, &process, Some(fault)).await?;
+    Ok(Json(faults_response(&state)))
+}
+
+/// Put a service's faults back to its `[fault]` block:
+/// DELETE /api/faults/{process} (admin only)
+pub async fn delete_service_fault(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(process): Path<String>,
+) -> Result<Json<FaultsResponse>, (StatusCode, Json<ApiError>)> {
+    set_service_fault(&state, &auth, &process, None).await?;
+    Ok(Json(faults_response(&state)))
+}
+
+async fn set_service_fault(
+    state: &AppState,
+    auth: &crate::server::AuthIdentity,
+    process: &str,
+    fault: Option<FaultConfig>,
+) -> Result<(), (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Fault injection requires admin token")),
+        ));
+    }
+    if !state.hypervisor.has_process(process) {
+        return Err((
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!("Unknown service: {}", process))),
+        ));
+    }
+    let details = fault.as_ref().map(|fault| format!("{:?}", fault));
+    state
+        .hypervisor
+        .set_fault(process, fault)
+        .map_err(|e| (StatusCode::BAD_REQUEST, Json(ApiError::new(e.to_string()))))?;
+
+    // Audit log
+    let action = details.as_deref().unwrap_or("cleared");
+    if let Err(e) = state
+        .deploy_log
+        .log("fault", process, "", Some(action), true)
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+    Ok(())
+}
+
+fn faults_response(state: &AppState) -> FaultsResponse {
+    FaultsResponse {
+        enabled: state.hypervisor.fault_injection_enabled(),
+        services: state.hypervisor.faults(),
+    }
+}
+
+/// Registered event webhooks: GET /api/webhooks (admin only)
+pub async fn get_webhooks(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+) -> Result<Json<Vec<WebhookInfo>>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Webhooks require admin token")),
+        ));
+    }
+    let webhooks = webhooks::list_webhooks(&state.config_store)
+        .await
+        .map_err(|e| {
+            (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(ApiError::new(e.to_string())),
+            )
+        })?;
+    Ok(Json(webhooks.into_iter().map(WebhookInfo::from).collect()))
+}
+
+/// Register an event webhook: POST /api/webhooks (admin only)
+pub async fn post_webhook(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Json(req): Json<WebhookRequest>,
+) -> Result<Json<WebhookInfo>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Webhooks require admin token")),
+        ));
+    }
+    let data_dir = &state.hypervisor.config().settings.data_dir;
+    let added = webhooks::add_webhook(
+        &state.config_store,
+        data_dir,
+        &req.url,
+        req.events,
+        req.secret,
+    );
+    let webhook = added.await.map_err(|e| {
+        (
+            StatusCode::BAD_REQUEST,
+            Json(ApiError::new(format!("{:#}", e))),
+        )
+    })?;
+
+    // Audit log
+    if let Err(e) = state
+        .deploy_log
+        .log("webhook", "", &webhook.id, Some(&webhook.url), true)
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+
+    Ok(Json(webhook.into()))
+}
+
+/// Unregister an event webhook: DELETE /api/webhooks/{id} (admin only)
+pub async fn delete_webhook(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path(id): Path<String>,
+) -> Result<StatusCode, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Webhooks require admin token")),
+        ));
+    }
+    let data_dir = &state.hypervisor.config().settings.data_dir;
+    let removed = webhooks::remove_webhook(&state.config_store, data_dir, &id)
+        .await
+        .map_err(|e| {
+            (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(ApiError::new(e.to_string())),
+            )
+        })?;
+    if !removed {
+        return Err((
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!("Webhook not found: {}", id))),
+        ));
+    }
+
+    // Audit log
+    if let Err(e) = state
+        .deploy_log
+        .log("webhook", "", &id, Some("removed"), true)
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+
+    Ok(StatusCode::NO_CONTENT)
+}
+
+/// Cluster membership as this node sees it: GET /api/cluster (admin only)
+pub async fn get_cluster(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+) -> Result<Json<ClusterResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Cluster status requires admin token")),
+        ));
+    }
+    let (Some(cluster), Some(local)) = (
+        state.hypervisor.cluster(),
+        crate::cluster::local_state(&state.hypervisor).await,
+    ) else {
+        return Err((
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new("Not clustered: [settings.cluster] isn't set")),
+        ));
+    };
+    let now = std::time::Instant::now();
+    Ok(Json(ClusterResponse {
+        node: cluster.node().to_string(),
+        mode: cluster.mode(),
+        leader: cluster.leader(now),
+        members: cluster.status(&local, now),
+    }))
+}
+
+/// Spin up a preview environment from a branch or artifact:
+/// POST /api/previews (admin only)
+///
+/// The preview runs as instance `{name}` of the service with weight 0, so
+/// only its own subdomain reaches it, and is torn down once its TTL passes.
+/// Creating one under a live preview's name replaces it, once the new one is
+/// built.
+pub async fn post_preview(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Json(req): Json<PreviewRequest>,
+) -> Result<Json<PreviewResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Previews require admin token")),
+        ));
+    }
+    let task = create_preview(state.clone(), req);
+    run_deploy(&state, task).await.map(Json)
+}
+
+async fn create_preview(
+    state: AppState,
+    req: PreviewRequest,
+) -> Result<PreviewResponse, (StatusCode, Json<ApiError>)> {
+    let error = |status: StatusCode, msg: String| (status, Json(ApiError::new(msg)));
+    let internal = |e: anyhow::Error| error(StatusCode::INTERNAL_SERVER_ERROR, format!("{:#}", e));
+    let config = state.hypervisor.config();
+    let process = &req.process;
+    let svc = config.get_service(process).ok_or_else(|| {
+        error(
+            StatusCode::NOT_FOUND,
+            format!("Unknown process: {}", process),
+        )
+    })?;
+    let Some(settings) = &svc.preview else {
+        return Err(error(
+            StatusCode::BAD_REQUEST,
+            format!("{} has no [service.{}.preview] table", process, process),
+        ));
+    };
+    let source = match (&req.revision, &req.artifact) {
+        (Some(revision), None) => revision,
+        (None, Some(artifact)) => artifact,
+        _ => {
+            return Err(error(
+                StatusCode::BAD_REQUEST,
+                "Give exactly one of revision or artifact".to_string(),
+            ))
+        }
+    };
+    let name = match (&req.name, &req.revision) {
+        (Some(name), _) => name.clone(),
+        (None, Some(revision)) => previews::name_for(revision),
+        (None, None) => {
+            return Err(error(
+                StatusCode::BAD_REQUEST,
+                "An artifact preview needs a name".to_string(),
+            ))
+        }
+    };
+    previews::validate_name(&name).map_err(|e| error(StatusCode::BAD_REQUEST, e.to_string()))?;
+
+    let existing = previews::list(&state.config_store)
+        .await
+        .map_err(internal)?;
+    let replacing = existing
+        .iter()
+        .any(|p| &p.process == process && p.name == name);
+    if !replacing && state.hypervisor.get(process, &name).await.is_some() {
+        return Err(error(
+            StatusCode::CONFLICT,
+            format!(
+                "{}:{} is already running and isn't a preview",
+                process, name
+            ),
+        ));
+    }
+    let live = existing.iter().filter(|p| &p.process == process).count();
+    if !replacing && live >= settings.max {
+        return Err(error(
+            StatusCode::CONFLICT,
+            format!(
+                "{} already has {} previews (max {})",
+                process, live, settings.max
+            ),
+        ));
+    }
+    // Check out and build the branch, or unpack the artifact, beside any
+    // preview this replaces: it keeps running if the build fails
+    let data_dir = &config.settings.data_dir;
+    let dir = previews::build_dir(data_dir, process, &name);
+    let built = build_preview(&config, &req, source, &dir).await;
+    let (sha, build_output, start) = match built {
+        Ok(built) => built,
+        Err(e) => {
+            tokio::fs::remove_dir_all(&dir).await.ok();
+            return Err(e);
+        }
+    };
+    if replacing {
+        previews::retire_builds(&state.hypervisor, process, &name, &dir)
+            .await
+            .map_err(internal)?;
+    }
+
+    let (command, args) = start.unzip();
+    let pin = tenement::hypervisor::ReleasePin {
+        command,
+        args,
+        artifact: req
+            .artifact
+            .clone()
+            .or_else(|| Some(dir.display().to_string())),
+        app_version: sha.clone(),
+        workdir: Some(dir.display().to_string()),
+        preview: true,
+        git_sha: sha.clone(),
+        ..Default::default()
+    };
+    state.hypervisor.pin_release(process, &name, pin).await;
+    if let Err(e) = state
+        .hypervisor
+        .deploy_and_wait_healthy(process, &name, 0, req.timeout)
+        .await
+    {
+        tracing::error!("Preview {}:{} failed: {:#}", process, name, e);
+        if let Err(e) =
+            previews::tear_down(&state.hypervisor, &state.config_store, process, &name).await
+        {
+            tracing::error!("Cleaning up preview {}:{} failed: {:#}", process, name, e);
+        }
+        return Err(internal(e));
+    }
+
+    let host = match &settings.domain {
+        Some(domain) => format!("{}.{}", name, domain),
+        None => format!("{}.{}.{}", name, process, state.domain),
+    };
+    let scheme = if state.tls_status.enabled {
+        "https"
+    } else {
+        "http"
+    };
+    let now = chrono::Utc::now();
+    let ttl = req.ttl.unwrap_or(settings.ttl);
+    let preview = Preview {
+        process: process.clone(),
+        name: name.clone(),
+        revision: req.revision.clone(),
+        sha,
+        artifact: req.artifact.clone(),
+        url: format!("{}://{}", scheme, host),
+        host,
+        created_at: now.to_rfc3339(),
+        expires_at: (now + chrono::Duration::seconds(ttl as i64)).to_rfc3339(),
+    };
+    previews::save(&state.config_store, &preview)
+        .await
+        .map_err(internal)?;
+
+    // Audit log
+    let details = format!("{} ttl={}s", source, ttl);
+    if let Err(e) = state
+        .deploy_log
+        .log("preview", process, &name, Some(&details), true)
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+
+    Ok(PreviewResponse {
+        preview,
+        build_output,
+    })
+}
+
+/// What a preview build gives: its commit, build output and detected start
+type PreviewBuild = (Option<String>, String, Option<(String, Vec<String>)>);
+
+/// Check out and build `req.revision` into `dir`, or unpack `req.artifact` there
+async fn build_preview(
+    config: &tenement::Config,
+    req: &PreviewRequest,
+    source: &str,
+    dir: &std::path::Path,
+) -> Result<PreviewBuild, (StatusCode, Json<ApiError>)> {
+    let error = |status: StatusCode, msg: String| (status, Json(ApiError::new(msg)));
+    let (data_dir, process) = (&config.settings.data_dir, &req.process);
+    if let Some(revision) = &req.revision {
+        let git = git_config(config, process)?;
+        let prepared =
+            tenement::git_deploy::prepare_release_at(data_dir, process, git, revision, dir)
+                .await
+                .map_err(|e| error(StatusCode::BAD_REQUEST, format!("{:#}", e)))?;
+        let start = detected_start(config, process, prepared.plan.as_ref())
+            .map_err(|e| error(StatusCode::BAD_REQUEST, format!("{:#}", e)))?;
+        return Ok((Some(prepared.sha), prepared.build_output, start));
+    }
+    let fetchers = tenement::artifact::Fetchers::default();
+    if fetchers.get(source).is_none() {
+        return Err(error(
+            StatusCode::BAD_REQUEST,
+            format!("No fetcher for artifact {}", source),
+        ));
+    }
+    fetchers
+        .fetch_into(source, req.checksum.as_deref(), dir)
+        .await
+        .map_err(|e| error(StatusCode::BAD_REQUEST, format!("{:#}", e)))?;
+    Ok((None, String::new(), None))
+}
+
+/// Live preview environments: GET /api/previews (admin only)
+pub async fn get_previews(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+) -> Result<Json<Vec<Preview>>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Previews require admin token")),
+        ));
+    }
+    let previews = previews::list(&state.config_store).await.map_err(|e| {
+        (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            Json(ApiError::new(e.to_string())),
+        )
+    })?;
+    Ok(Json(previews))
+}
+
+/// Tear down a preview environment now: DELETE /api/previews/{process}/{name}
+/// (admin only)
+pub async fn delete_preview(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Path((process, name)): Path<(String, String)>,
+) -> Result<StatusCode, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Previews require admin token")),
+        ));
+    }
+    let internal = |e: anyhow::Error| {
+        (
+            StatusCode::INTERNAL_SERVER_ERROR,
+            Json(ApiError::new(format!("{:#}", e))),
+        )
+    };
+    let existing = previews::list(&state.config_store)
+        .await
+        .map_err(internal)?;
+    if !existing
+        .iter()
+        .any(|p| p.process == process && p.name == name)
+    {
+        return Err((
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!(
+                "Preview not found: {}:{}",
+                process, name
+            ))),
+        ));
+    }
+    previews::tear_down(&state.hypervisor, &state.config_store, &process, &name)
+        .await
+        .map_err(internal)?;
+
+    // Audit log
+    if let Err(e) = state
+        .deploy_log
+        .log("preview", &process, &name, Some("removed"), true)
+        .await
+    {
+        tracing::error!("Audit log failed: {}", e);
+    }
+
+    Ok(StatusCode::NO_CONTENT)
+}
+
+/// Reload admin tokens from `settings.admin_tokens_file`: POST /api/auth/reload
+pub async fn post_auth_reload(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+) -> Result<Json<AuthReloadResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Credential reload requires admin token")),
+        ));
+    }
+    let tokens = crate::server::reload_admin_tokens(&state.admin_tokens).map_err(|e| {
+        (
+            StatusCode::BAD_REQUEST,
+            Json(ApiError::new(format!("{:#}", e))),
+        )
+    })?;
+    Ok(Json(AuthReloadResponse { tokens }))
+}
+
+/// Re-read tenement.toml and apply the differences: POST /api/reload
+pub async fn post_reload(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+) -> Result<Json<ReloadResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Config reload requires admin token")),
+        ));
+    }
+    let report = crate::server::reload_config(&state.hypervisor)
+        .await
+        .map_err(|e| {
+            (
+                StatusCode::BAD_REQUEST,
+                Json(ApiError::new(format!("{:#}", e))),
+            )
+        })?;
+    Ok(Json(report.into()))
+}
+
+/// What reloading a config would do, without doing it: POST /api/reload/plan.
+/// `failed` is always empty.
+pub async fn post_reload_plan(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+    Json(req): Json<ReloadPlanRequest>,
+) -> Result<Json<ReloadResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Config reload requires admin token")),
+        ));
+    }
+    // Read as the running config's file would be, beside its overlay files
+    let environment = req.environment.as_deref();
+    let parsed = match &state.hypervisor.config().source {
+        Some(path) => tenement::Config::from_source(&req.config, environment, path),
+        None => tenement::Config::from_str_for_env(&req.config, environment),
+    };
+    let checked = parsed.and_then(|config| crate::middleware::check(&config).map(|()| config));
+    let config = checked.map_err(|e| {
+        (
+            StatusCode::BAD_REQUEST,
+            Json(ApiError::new(format!("{:#}", e))),
+        )
+    })?;
+    let report = state.hypervisor.plan_reload(config).await;
+    Ok(Json(report.into()))
+}
+
+/// Hand over to the tenement binary now installed, keeping instances and
+/// listeners: POST /api/upgrade. This server shuts down once it responds.
+pub async fn post_upgrade(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<crate::server::AuthIdentity>,
+) -> Result<Json<UpgradeResponse>, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Upgrades require admin token")),
+        ));
+    }
+    let pid = crate::upgrade::upgrade(&state.hypervisor)
+        .await
+        .map_err(|e| {
+            (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(ApiError::new(format!("{:#}", e))),
+            )
+        })?;
+    Ok(Json(UpgradeResponse { pid }))
+}
+
+// ===================
+// Helpers
+// ===================
+
+/// The number the next release of `process` is recorded as, for the version
+/// being deployed to see as TENEMENT_RELEASE
+async fn next_release(state: &AppState, process: &str) -> Option<u32> {
+    let releases = state.releases.list(process).await.ok()?;
+    Some(releases.first().map_or(1, |release| release.number + 1))
+}
+
+/// What a deploy of `svc` runs, to record with its release
+fn release_definition(
+    svc: &tenement::config::ProcessConfig,
+    req: &DeployRequest,
+    workdir: Option<String>,
+) -> tenement::ReleaseDefinition {
+    tenement::ReleaseDefinition {
+        command: svc.command.clone(),
+        args: svc.args.clone(),
+        env: svc.env.clone().into_iter().collect(),
+        artifact: req.artifact.clone(),
+        app_version: req.app_version.clone(),
+        workdir,
+        image: req.image.clone().or_else(|| svc.image.clone()),
+        git_sha: req.git_sha.clone(),
+    }
+}
+
+/// The command and args a checkout runs with, when the service has no
+/// `command` and `detect` worked one out
+fn detected_start(
+    config: &tenement::Config,
+    process: &str,
+    plan: Option<&tenement::buildpack::BuildPlan>,
+) -> anyhow::Result<Option<(String, Vec<String>)>> {
+    let has_command = config
+        .get_service(process)
+        .is_some_and(|svc| !svc.command.trim().is_empty());
+    match plan {
+        Some(plan) if !has_command => plan.start_command().map(Some),
+        _ => Ok(None),
+    }
+}
+
+/// The `git` table of a service that deploys by push
+fn git_config<'a>(
+    config: &'a tenement::Config,
+    process: &str,
+) -> Result<&'a tenement::config::GitConfig, (StatusCode, Json<ApiError>)> {
+    let svc = config.get_service(process).ok_or_else(|| {
+        (
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!("Unknown process: {}", process))),
+        )
+    })?;
+    svc.git.as_ref().ok_or_else(|| {
+        (
+            StatusCode::NOT_FOUND,
+            Json(ApiError::new(format!(
+                "{} has no [service.{}.git] table",
+                process, process
+            ))),
+        )
+    })
+}
+
+/// The repository a smart HTTP push to `/git/:repo` goes to, created if needed
+async fn git_repo(
+    state: &AppState,
+    auth: &crate::server::AuthIdentity,
+    repo: &str,
+) -> Result<std::path::PathBuf, (StatusCode, Json<ApiError>)> {
+    if auth.tenant_id.is_some() {
+        return Err((
+            StatusCode::FORBIDDEN,
+            Json(ApiError::new("Git push requires admin token")),
+        ));
+    }
+    let process = tenement::git_deploy::service_for_repo(repo);
+    let config = state.hypervisor.config();
+    let git = git_config(&config, process)?;
+    crate::server::init_git_repo(&state.hypervisor, process, git)
+        .await
+        .map_err(|e| {
+            (
+                StatusCode::INTERNAL_SERVER_ERROR,
+                Json(ApiError::new(format!("{:#}", e))),
+            )
+        })
+}
 
 /// Check that a tenant token is authorized to access the given instance ID.
 /// Admin tokens (tenant_id = None) have full access.
@@ -1,25 +1,221 @@
-//! HTTP client for CLI commands to talk to the running tenement server.
+//! Client for CLI commands to talk to the running tenement server.
 //!
-//! All CLI commands except `serve` and `init` use this client
-//! to send requests to the running server process.
+//! All CLI commands except `serve` and `init` use this client to send
+//! requests to the server's admin API. Without `--server`, the client uses the
+//! server's local admin socket (`{data_dir}/admin.sock`) when it exists, which
+//! needs no token; otherwise it talks HTTP to localhost:8080 with a token.
 
+#[cfg(windows)]
+use crate::pipes::{UnixConnector, Uri as SocketUri};
 use anyhow::{Context, Result};
+use axum::body::Bytes;
+use axum::http::{header, Method, StatusCode};
+use futures::stream::{BoxStream, StreamExt};
+use http_body_util::{BodyExt, Full};
+use hyper_util::client::legacy::Client;
+use hyper_util::rt::TokioExecutor;
+#[cfg(unix)]
+use hyperlocal::{UnixConnector, Uri as SocketUri};
 use serde::de::DeserializeOwned;
 use serde::Serialize;
+use std::path::{Path, PathBuf};
+use std::time::Duration;
+use tenement::events::{Event, EventKind};
+use tenement::fault::FaultConfig;
 
 use crate::api_routes::{
-    ApiError, DeployRequest, DeployResponse, RouteRequest, RouteResponse, SpawnRequest,
-    SpawnResponse, WeightRequest, WeightResponse,
+    ApiError, ClusterResponse, DeployRequest, DeployResponse, DrainRequest, DrainResponse,
+    FaultsRequest, FaultsResponse, GitDeployRequest, GitDeployResponse, MaintenanceRequest,
+    MaintenanceResponse, PreviewRequest, PreviewResponse, ReloadPlanRequest, ReloadResponse,
+    RollbackRequest, RollbackResponse, RouteRequest, RouteResponse, SpawnRequest, SpawnResponse,
+    StackDeployRequest, StackResponse, StackStatus, UpgradeResponse, WebhookInfo, WebhookRequest,
+    WeightRequest, WeightResponse,
 };
+use crate::previews::Preview;
+#[cfg(unix)]
+use tenement::exec::{ExecRequest, ATTACH_PROTOCOL, EXEC_PROTOCOL};
+
+/// An exec or attach connection once the server has switched protocols
+#[cfg(unix)]
+pub type Upgraded = hyper_util::rt::TokioIo<hyper::upgrade::Upgraded>;
 
 /// Token file name stored in data_dir alongside tenement.db
 const TOKEN_FILE: &str = "api_token";
 
-/// HTTP client for the tenement API
+/// Server URL when neither `--server` nor an admin socket is available
+const DEFAULT_SERVER_URL: &str = "http://localhost:8080";
+
+/// Longest the client waits on a deploy that downloads something, or that
+/// replaces a version and so may run a canary. The server carries on with it
+/// after the client gives up.
+const LONG_DEPLOY_WAIT: Duration = Duration::from_secs(3600);
+
+/// How requests reach the server
+enum Transport {
+    /// HTTP(S) with a bearer token
+    Http {
+        server_url: String,
+        token: String,
+        client: reqwest::Client,
+    },
+    /// The local admin socket; its file permissions stand in for a token
+    Unix {
+        socket: PathBuf,
+        client: Client<UnixConnector, Full<Bytes>>,
+    },
+}
+
+/// Status and body of a response, whichever transport carried it
+struct Reply {
+    status: StatusCode,
+    body: BoxStream<'static, Result<Bytes>>,
+}
+
+impl Reply {
+    async fn bytes(mut self) -> Result<Vec<u8>> {
+        let mut bytes = Vec::new();
+        while let Some(chunk) = self.body.next().await {
+            bytes.extend_from_slice(&chunk?);
+        }
+        Ok(bytes)
+    }
+}
+
+/// Filters for the log endpoints. Unset fields match everything.
+#[derive(Debug, Default, Clone)]
+pub struct LogFilter {
+    pub process: Option<String>,
+    pub id: Option<String>,
+    pub level: Option<String>,
+    pub search: Option<String>,
+    /// Most recent entries to return (the server's backlog size when streaming)
+    pub limit: Option<usize>,
+    /// Only entries at or after this Unix timestamp (milliseconds)
+    pub since: Option<u64>,
+}
+
+impl LogFilter {
+    /// `?key=value&...` for the set fields, or "" if none are
+    fn query_string(&self) -> String {
+        let mut params = Vec::new();
+        let text = [
+            ("process", &self.process),
+            ("id", &self.id),
+            ("level", &self.level),
+            ("search", &self.search),
+        ];
+        for (key, value) in text {
+            if let Some(value) = value {
+                params.push(format!("{}={}", key, urlencoding::encode(value)));
+            }
+        }
+        if let Some(limit) = self.limit {
+            params.push(format!("limit={}", limit));
+        }
+        if let Some(since) = self.since {
+            params.push(format!("since={}", since));
+        }
+        if params.is_empty() {
+            String::new()
+        } else {
+            format!("?{}", params.join("&"))
+        }
+    }
+}
+
+/// Which lifecycle events to fetch or stream
+#[derive(Debug, Clone, Default)]
+pub struct EventQuery {
+    pub app: Option<String>,
+    /// Kinds to include (all if empty)
+    pub kinds: Vec<EventKind>,
+    /// Most recent events to return (to replay first, when streaming)
+    pub limit: Option<usize>,
+}
+
+impl EventQuery {
+    /// `?key=value&...` for the set fields, plus `extra`
+    fn query_string(&self, extra: &[&str]) -> String {
+        let mut params: Vec<String> = extra.iter().map(|p| p.to_string()).collect();
+        if let Some(app) = &self.app {
+            params.push(format!("app={}", urlencoding::encode(app)));
+        }
+        if !self.kinds.is_empty() {
+            let kinds: Vec<_> = self.kinds.iter().map(EventKind::as_str).collect();
+            params.push(format!("type={}", kinds.join(",")));
+        }
+        if let Some(limit) = self.limit {
+            params.push(format!("limit={}", limit));
+        }
+        if params.is_empty() {
+            String::new()
+        } else {
+            format!("?{}", params.join("&"))
+        }
+    }
+}
+
+/// `e`, or when it's the client running out of `limit`, a note that the
+/// server is still at it
+fn gave_up(e: anyhow::Error, limit: Duration) -> anyhow::Error {
+    let timed_out = e.chain().any(|cause| {
+        cause.is::<tokio::time::error::Elapsed>()
+            || cause
+                .downcast_ref::<reqwest::Error>()
+                .is_some_and(reqwest::Error::is_timeout)
+    });
+    if !timed_out {
+        return e;
+    }
+    anyhow::anyhow!(
+        "Gave up waiting after {}s; the server carries on with it (see `ten ps` and \
+         `ten releases`)",
+        limit.as_secs()
+    )
+}
+
+/// `?key=value&...` for the audit log filters that are set, or "" if none are
+fn audit_query_string(query: &tenement::AuditQuery) -> String {
+    let mut params = Vec::new();
+    let text = [
+        ("actor", &query.actor),
+        ("action", &query.action),
+        ("process", &query.process),
+        ("since", &query.since),
+    ];
+    for (key, value) in text {
+        if let Some(value) = value {
+            params.push(format!("{}={}", key, urlencoding::encode(value)));
+        }
+    }
+    if query.failed {
+        params.push("failed=true".to_string());
+    }
+    if let Some(limit) = query.limit {
+        params.push(format!("limit={}", limit));
+    }
+    if params.is_empty() {
+        String::new()
+    } else {
+        format!("?{}", params.join("&"))
+    }
+}
+
+/// One log entry as the server reports it
+#[derive(Debug, Clone, PartialEq, serde::Deserialize)]
+pub struct LogLine {
+    /// Unix timestamp in milliseconds
+    pub timestamp: u64,
+    /// "stdout" or "stderr"
+    pub level: String,
+    pub process: String,
+    pub instance_id: String,
+    pub message: String,
+}
+
+/// Client for the tenement admin API
 pub struct ApiClient {
-    server_url: String,
-    token: String,
-    client: reqwest::Client,
+    transport: Transport,
 }
 
 impl ApiClient {
@@ -27,23 +223,51 @@ impl ApiClient {
     pub fn new(server_url: &str, token: String) -> Self {
         let server_url = server_url.trim_end_matches('/').to_string();
         Self {
-            server_url,
-            token,
-            client: reqwest::Client::new(),
+            transport: Transport::Http {
+                server_url,
+                token,
+                client: reqwest::Client::new(),
+            },
         }
     }
 
-    /// Create an API client by auto-detecting the token.
+    /// Create an API client that talks to the admin socket at `socket`
+    pub fn unix(socket: impl Into<PathBuf>) -> Self {
+        Self {
+            transport: Transport::Unix {
+                socket: socket.into(),
+                client: Client::builder(TokioExecutor::new()).build(UnixConnector),
+            },
+        }
+    }
+
+    /// Create an API client from CLI arguments.
+    ///
+    /// With an explicit `server_url` the client always uses HTTP. Otherwise it
+    /// uses the admin socket from tenement.toml if a server is listening there,
+    /// and falls back to HTTP on localhost:8080.
     ///
-    /// Token resolution order:
+    /// Token resolution order (HTTP only):
     /// 1. Explicit token passed via --token flag
     /// 2. TENEMENT_TOKEN environment variable
     /// 3. Token file at {data_dir}/api_token  (data_dir_override takes precedence over config)
     pub fn from_args(
-        server_url: &str,
+        server_url: Option<&str>,
         explicit_token: Option<String>,
-        data_dir_override: Option<&std::path::Path>,
+        data_dir_override: Option<&Path>,
     ) -> Result<Self> {
+        if server_url.is_none() {
+            let config =
+                tenement::Config::load_with_override(data_dir_override.map(Path::to_path_buf));
+            if let Ok(config) = config {
+                let socket = config.settings.admin_socket_path();
+                if socket.exists() {
+                    return Ok(Self::unix(socket));
+                }
+            }
+        }
+        let server_url = server_url.unwrap_or(DEFAULT_SERVER_URL);
+
         let token = if let Some(t) = explicit_token {
             t
         } else if let Ok(t) = std::env::var("TENEMENT_TOKEN") {
@@ -76,6 +300,14 @@ impl ApiClient {
         Ok(Self::new(server_url, token))
     }
 
+    /// Where this client sends requests, for messages
+    pub fn endpoint(&self) -> String {
+        match &self.transport {
+            Transport::Http { server_url, .. } => server_url.clone(),
+            Transport::Unix { socket, .. } => format!("unix:{}", socket.display()),
+        }
+    }
+
     // ===================
     // Instance operations
     // ===================
@@ -91,94 +323,95 @@ impl ApiClient {
 
     /// Stop an instance
     pub async fn stop(&self, instance: &str) -> Result<()> {
-        let url = format!("{}/api/instances/{}", self.server_url, instance);
-        let resp = self
-            .client
-            .delete(&url)
-            .bearer_auth(&self.token)
-            .send()
-            .await
-            .with_context(|| format!("Failed to connect to server at {}", self.server_url))?;
+        let path = format!("/api/instances/{}", instance);
+        let reply = self.send(Method::DELETE, &path, None, None).await?;
 
-        if resp.status().is_success() {
+        if reply.status.is_success() {
             Ok(())
         } else {
-            let err = self.parse_error(resp).await;
+            let err = self.parse_error(reply).await;
             anyhow::bail!("{}", err)
         }
     }
 
     /// Restart an instance
     pub async fn restart(&self, instance: &str) -> Result<SpawnResponse> {
-        let url = format!("{}/api/instances/{}/restart", self.server_url, instance);
-        let resp = self
-            .client
-            .post(&url)
-            .bearer_auth(&self.token)
-            .send()
-            .await
-            .with_context(|| format!("Failed to connect to server at {}", self.server_url))?;
+        let path = format!("/api/instances/{}/restart", instance);
+        let reply = self.send(Method::POST, &path, None, None).await?;
 
-        self.handle_response(resp).await
+        self.handle_response(reply).await
     }
 
     /// Set traffic weight
     pub async fn set_weight(&self, instance: &str, weight: u8) -> Result<WeightResponse> {
-        let url = format!("{}/api/instances/{}/weight", self.server_url, instance);
-        let req = WeightRequest { weight };
-        let resp = self
-            .client
-            .put(&url)
-            .bearer_auth(&self.token)
-            .json(&req)
-            .send()
-            .await
-            .with_context(|| format!("Failed to connect to server at {}", self.server_url))?;
+        let path = format!("/api/instances/{}/weight", instance);
+        let body = serde_json::to_vec(&WeightRequest { weight })?;
+        let reply = self.send(Method::PUT, &path, Some(body), None).await?;
 
-        self.handle_response(resp).await
+        self.handle_response(reply).await
     }
 
     /// Check instance health
     pub async fn health(&self, instance: &str) -> Result<serde_json::Value> {
-        let url = format!("{}/api/instances/{}/health", self.server_url, instance);
-        let resp = self
-            .client
-            .get(&url)
-            .bearer_auth(&self.token)
-            .send()
-            .await
-            .with_context(|| format!("Failed to connect to server at {}", self.server_url))?;
+        self.get(&format!("/api/instances/{}/health", instance)).await
+    }
 
-        self.handle_response(resp).await
+    /// Full details of one instance
+    pub async fn inspect(&self, instance: &str) -> Result<serde_json::Value> {
+        self.get(&format!("/api/instances/{}", instance)).await
     }
 
-    /// Deploy a new version
-    pub async fn deploy(
-        &self,
-        process: &str,
-        version: &str,
-        weight: u8,
-        timeout: u64,
-    ) -> Result<DeployResponse> {
-        let req = DeployRequest {
-            process: process.to_string(),
-            version: version.to_string(),
-            weight,
-            timeout,
+    /// The environment an instance was started with (or would start with), secrets masked
+    pub async fn env(&self, instance: &str) -> Result<std::collections::BTreeMap<String, String>> {
+        self.get(&format!("/api/instances/{}/env", instance)).await
+    }
+
+    /// Deploy a new version, optionally replacing a running one
+    pub async fn deploy(&self, req: &DeployRequest) -> Result<DeployResponse> {
+        // A replacement can run a canary for as long as the service's
+        // `deploy.canary_duration` (the server bounds each of its steps), and
+        // an artifact URL or image is downloaded before anything starts
+        let fetches =
+            req.artifact.as_deref().is_some_and(|a| a.contains("://")) || req.image.is_some();
+        let wait = Duration::from_secs(req.timeout + 10);
+        let limit = match req.replace.is_some() || fetches {
+            true => LONG_DEPLOY_WAIT.max(wait),
+            false => wait,
         };
 
-        let url = format!("{}/api/deploy", self.server_url);
-        let resp = self
-            .client
-            .post(&url)
-            .bearer_auth(&self.token)
-            .json(&req)
-            .timeout(std::time::Duration::from_secs(timeout + 10))
-            .send()
+        let body = serde_json::to_vec(req)?;
+        let reply = self
+            .send(Method::POST, "/api/deploy", Some(body), Some(limit))
             .await
-            .with_context(|| format!("Failed to connect to server at {}", self.server_url))?;
+            .map_err(|e| gave_up(e, limit))?;
+
+        self.handle_response(reply).await
+    }
 
-        self.handle_response(resp).await
+    /// A service's releases, newest first
+    pub async fn releases(&self, process: &str) -> Result<Vec<tenement::Release>> {
+        self.get(&format!("/api/releases/{}", process)).await
+    }
+
+    /// Roll a service back to an earlier release (the previous one if None)
+    pub async fn rollback(&self, req: &RollbackRequest) -> Result<RollbackResponse> {
+        // Like a replace deploy, it may run the service's canary
+        let (body, limit) = (serde_json::to_vec(req)?, LONG_DEPLOY_WAIT);
+        let reply = self
+            .send(Method::POST, "/api/rollback", Some(body), Some(limit))
+            .await
+            .map_err(|e| gave_up(e, limit))?;
+        self.handle_response(reply).await
+    }
+
+    /// Build and deploy a commit of a service's git repository
+    pub async fn git_deploy(
+        &self,
+        process: &str,
+        req: &GitDeployRequest,
+    ) -> Result<GitDeployResponse> {
+        // No timeout: the build is bounded by the service's `git.build_timeout`
+        self.post(&format!("/api/git/{}/deploy", process), req).await
     }
 
     /// Atomic traffic swap between versions
@@ -191,84 +424,209 @@ impl ApiClient {
         self.post("/api/route", &req).await
     }
 
+    /// Turn a service's maintenance mode on (serving its maintenance page
+    /// with `retry_after`) or off
+    pub async fn set_maintenance(
+        &self,
+        process: &str,
+        enabled: bool,
+        retry_after: u64,
+    ) -> Result<MaintenanceResponse> {
+        let path = format!("/api/maintenance/{}", process);
+        let body = serde_json::to_vec(&MaintenanceRequest {
+            enabled,
+            retry_after,
+        })?;
+        let reply = self.send(Method::PUT, &path, Some(body), None).await?;
+        self.handle_response(reply).await
+    }
+
+    /// Stop a service once its in-flight requests finish, killing whatever is
+    /// left after `timeout` seconds
+    pub async fn drain(&self, process: &str, timeout: u64) -> Result<DrainResponse> {
+        let path = format!("/api/drain/{}", process);
+        self.post(&path, &DrainRequest { timeout }).await
+    }
+
+    /// Each stack's services and their instances' health
+    pub async fn stacks(&self) -> Result<Vec<StackStatus>> {
+        self.get("/api/stacks").await
+    }
+
+    /// Restart a stack's running instances one at a time, stopping at the
+    /// first that fails
+    pub async fn restart_stack(&self, stack: &str) -> Result<StackResponse> {
+        let path = format!("/api/stacks/{}/restart", stack);
+        let reply = self.send(Method::POST, &path, None, None).await?;
+        self.handle_response(reply).await
+    }
+
+    /// Deploy a version of each of a stack's services in turn, stopping at
+    /// the first that fails
+    pub async fn deploy_stack(
+        &self,
+        stack: &str,
+        req: &StackDeployRequest,
+    ) -> Result<StackResponse> {
+        // No timeout: each service's deploy is bounded by the server
+        let path = format!("/api/stacks/{}/deploy", stack);
+        self.post(&path, req).await
+    }
+
+    /// Whether faults are being injected, and each service's fault settings
+    pub async fn faults(&self) -> Result<FaultsResponse> {
+        self.get("/api/faults").await
+    }
+
+    /// Turn fault injection on or off until the server restarts
+    pub async fn set_fault_injection(&self, enabled: bool) -> Result<FaultsResponse> {
+        let body = serde_json::to_vec(&FaultsRequest { enabled })?;
+        let reply = self
+            .send(Method::PUT, "/api/faults", Some(body), None)
+            .await?;
+        self.handle_response(reply).await
+    }
+
+    /// Replace a service's fault settings until the server restarts
+    pub async fn set_fault(&self, process: &str, fault: &FaultConfig) -> Result<FaultsResponse> {
+        let path = format!("/api/faults/{}", process);
+        let body = serde_json::to_vec(fault)?;
+        let reply = self.send(Method::PUT, &path, Some(body), None).await?;
+        self.handle_response(reply).await
+    }
+
+    /// Put a service's fault settings back to its `[fault]` block
+    pub async fn clear_fault(&self, process: &str) -> Result<FaultsResponse> {
+        let path = format!("/api/faults/{}", process);
+        let reply = self.send(Method::DELETE, &path, None, None).await?;
+        self.handle_response(reply).await
+    }
+
+    /// Registered event webhooks
+    pub async fn webhooks(&self) -> Result<Vec<WebhookInfo>> {
+        self.get("/api/webhooks").await
+    }
+
+    /// Register an event webhook
+    pub async fn add_webhook(&self, req: &WebhookRequest) -> Result<WebhookInfo> {
+        self.post("/api/webhooks", req).await
+    }
+
+    /// Unregister an event webhook
+    pub async fn remove_webhook(&self, id: &str) -> Result<()> {
+        let path = format!("/api/webhooks/{}", id);
+        let reply = self.send(Method::DELETE, &path, None, None).await?;
+
+        if reply.status.is_success() {
+            Ok(())
+        } else {
+            let err = self.parse_error(reply).await;
+            anyhow::bail!("{}", err)
+        }
+    }
+
+    /// This node's view of its cluster
+    pub async fn cluster(&self) -> Result<ClusterResponse> {
+        self.get("/api/cluster").await
+    }
+
+    /// Live preview environments
+    pub async fn previews(&self) -> Result<Vec<Preview>> {
+        self.get("/api/previews").await
+    }
+
+    /// Spin up a preview environment
+    pub async fn create_preview(&self, req: &PreviewRequest) -> Result<PreviewResponse> {
+        // No timeout: a branch's build is bounded by the service's `git.build_timeout`
+        self.post("/api/previews", req).await
+    }
+
+    /// Tear down a preview environment
+    pub async fn remove_preview(&self, process: &str, name: &str) -> Result<()> {
+        let path = format!("/api/previews/{}/{}", process, name);
+        let reply = self.send(Method::DELETE, &path, None, None).await?;
+
+        if reply.status.is_success() {
+            Ok(())
+        } else {
+            let err = self.parse_error(reply).await;
+            anyhow::bail!("{}", err)
+        }
+    }
+
+    /// Have the server re-read tenement.toml and apply the changes
+    pub async fn reload(&self) -> Result<ReloadResponse> {
+        let reply = self.send(Method::POST, "/api/reload", None, None).await?;
+        self.handle_response(reply).await
+    }
+
+    /// What the server would do on reloading `config`, without doing it
+    pub async fn plan_reload(
+        &self,
+        config: &str,
+        environment: Option<&str>,
+    ) -> Result<ReloadResponse> {
+        let req = ReloadPlanRequest {
+            config: config.to_string(),
+            environment: environment.map(str::to_string),
+        };
+        self.post("/api/reload/plan", &req).await
+    }
+
+    /// Have the server hand over to the tenement binary now installed
+    pub async fn upgrade(&self) -> Result<UpgradeResponse> {
+        let reply = self.send(Method::POST, "/api/upgrade", None, None).await?;
+        self.handle_response(reply).await
+    }
+
     /// List all running instances
     pub async fn list(&self) -> Result<Vec<serde_json::Value>> {
         self.get("/api/instances").await
     }
 
+    /// Scheduled jobs with their next and last runs
+    pub async fn jobs(&self) -> Result<Vec<tenement::jobs::JobStatus>> {
+        self.get("/api/jobs").await
+    }
+
+    /// Audit log entries matching `query`, newest first
+    pub async fn audit(
+        &self,
+        query: &tenement::AuditQuery,
+    ) -> Result<Vec<tenement::DeployLogEntry>> {
+        self.get(&format!("/api/audit{}", audit_query_string(query)))
+            .await
+    }
+
     // ===================
     // Log operations
     // ===================
 
-    /// Query logs with filters
-    pub async fn query_logs(
-        &self,
-        process: Option<&str>,
-        id: Option<&str>,
-        level: Option<&str>,
-        search: Option<&str>,
-        limit: usize,
-    ) -> Result<Vec<serde_json::Value>> {
-        let mut params = vec![format!("limit={}", limit)];
-        if let Some(p) = process {
-            params.push(format!("process={}", p));
-        }
-        if let Some(i) = id {
-            params.push(format!("id={}", i));
-        }
-        if let Some(l) = level {
-            params.push(format!("level={}", l));
-        }
-        if let Some(s) = search {
-            params.push(format!("search={}", urlencoding::encode(s)));
-        }
-        let query = params.join("&");
-        self.get(&format!("/api/logs?{}", query)).await
+    /// Query buffered logs with filters
+    pub async fn query_logs(&self, filter: &LogFilter) -> Result<Vec<LogLine>> {
+        self.get(&format!("/api/logs{}", filter.query_string())).await
     }
 
-    /// Stream logs via SSE (prints to stdout, blocks until interrupted)
+    /// Stream logs via SSE, calling `on_line` for each entry until the server
+    /// ends the stream. With `filter.since`, buffered entries from then on come
+    /// first.
     pub async fn stream_logs(
         &self,
-        process: Option<&str>,
-        id: Option<&str>,
-        level: Option<&str>,
+        filter: &LogFilter,
+        mut on_line: impl FnMut(LogLine),
     ) -> Result<()> {
-        let mut params = Vec::new();
-        if let Some(p) = process {
-            params.push(format!("process={}", p));
-        }
-        if let Some(i) = id {
-            params.push(format!("id={}", i));
-        }
-        if let Some(l) = level {
-            params.push(format!("level={}", l));
-        }
-        let query = if params.is_empty() {
-            String::new()
-        } else {
-            format!("?{}", params.join("&"))
-        };
-
-        let url = format!("{}/api/logs/stream{}", self.server_url, query);
-        let resp = self
-            .client
-            .get(&url)
-            .bearer_auth(&self.token)
-            .send()
-            .await
-            .with_context(|| format!("Failed to connect to server at {}", self.server_url))?;
+        let path = format!("/api/logs/stream{}", filter.query_string());
+        let mut reply = self.send(Method::GET, &path, None, None).await?;
 
-        if !resp.status().is_success() {
-            let err = self.parse_error(resp).await;
+        if !reply.status.is_success() {
+            let err = self.parse_error(reply).await;
             anyhow::bail!("{}", err);
         }
 
         // Read SSE stream line by line
-        use futures::StreamExt;
-        let mut stream = resp.bytes_stream();
         let mut buffer = String::new();
 
-        while let Some(chunk) = stream.next().await {
+        while let Some(chunk) = reply.body.next().await {
             let chunk = chunk.context("Stream error")?;
             buffer.push_str(&String::from_utf8_lossy(&chunk));
 
@@ -280,14 +638,8 @@ impl ApiClient {
                 // Parse SSE data lines
                 for line in event.lines() {
                     if let Some(data) = line.strip_prefix("data:") {
-                        let data = data.trim();
-                        if let Ok(entry) = serde_json::from_str::<serde_json::Value>(data) {
-                            let lvl = entry["level"].as_str().unwrap_or("?");
-                            let proc = entry["process"].as_str().unwrap_or("?");
-                            let inst = entry["instance_id"].as_str().unwrap_or("?");
-                            let msg = entry["message"].as_str().unwrap_or("");
-                            let level_marker = if lvl == "stderr" { "ERR" } else { "OUT" };
-                            println!("[{}] {}:{} {}", level_marker, proc, inst, msg);
+                        if let Ok(entry) = serde_json::from_str::<LogLine>(data.trim()) {
+                            on_line(entry);
                         }
                     }
                 }
@@ -297,52 +649,200 @@ impl ApiClient {
         Ok(())
     }
 
+    /// Recent lifecycle events, oldest first
+    pub async fn events(&self, query: &EventQuery) -> Result<Vec<Event>> {
+        self.get(&format!("/api/events{}", query.query_string(&[])))
+            .await
+    }
+
+    /// Stream lifecycle events as they happen, after `query.limit` recent ones
+    pub async fn stream_events(
+        &self,
+        query: &EventQuery,
+        mut on_event: impl FnMut(Event),
+    ) -> Result<()> {
+        let query = query.query_string(&["format=ndjson"]);
+        let path = format!("/api/events/stream{}", query);
+        let mut reply = self.send(Method::GET, &path, None, None).await?;
+
+        if !reply.status.is_success() {
+            let err = self.parse_error(reply).await;
+            anyhow::bail!("{}", err);
+        }
+
+        // One JSON event per line
+        let mut buffer = String::new();
+        while let Some(chunk) = reply.body.next().await {
+            let chunk = chunk.context("Stream error")?;
+            buffer.push_str(&String::from_utf8_lossy(&chunk));
+            while let Some(pos) = buffer.find('\n') {
+                let line = buffer[..pos].to_string();
+                buffer = buffer[pos + 1..].to_string();
+                if let Ok(event) = serde_json::from_str::<Event>(&line) {
+                    on_event(event);
+                }
+            }
+        }
+
+        Ok(())
+    }
+
     // ===================
-    // HTTP helpers
+    // Exec and attach
     // ===================
 
-    async fn get<T: DeserializeOwned>(&self, path: &str) -> Result<T> {
-        let url = format!("{}{}", self.server_url, path);
-        let resp = self
-            .client
-            .get(&url)
-            .bearer_auth(&self.token)
-            .send()
+    /// Run a command inside an instance; the connection then carries exec frames
+    #[cfg(unix)]
+    pub async fn exec(&self, instance: &str, request: &ExecRequest) -> Result<Upgraded> {
+        let path = format!("/api/instances/{}/exec", instance);
+        let body = serde_json::to_vec(request)?;
+        self.upgrade_connection(Method::POST, &path, EXEC_PROTOCOL, Some(body))
             .await
-            .with_context(|| format!("Failed to connect to server at {}", self.server_url))?;
+    }
 
-        self.handle_response(resp).await
+    /// Follow an instance's output; the connection then carries its frames
+    #[cfg(unix)]
+    pub async fn attach(&self, instance: &str) -> Result<Upgraded> {
+        let path = format!("/api/instances/{}/attach", instance);
+        self.upgrade_connection(Method::GET, &path, ATTACH_PROTOCOL, None)
+            .await
     }
 
-    async fn post<T: DeserializeOwned, B: Serialize>(&self, path: &str, body: &B) -> Result<T> {
-        let url = format!("{}{}", self.server_url, path);
-        let resp = self
-            .client
-            .post(&url)
-            .bearer_auth(&self.token)
-            .json(body)
-            .send()
+    /// Send a request that upgrades the connection to `protocol`. Only the
+    /// admin socket serves these.
+    #[cfg(unix)]
+    async fn upgrade_connection(
+        &self,
+        method: Method,
+        path: &str,
+        protocol: &str,
+        body: Option<Vec<u8>>,
+    ) -> Result<Upgraded> {
+        let Transport::Unix { socket, client } = &self.transport else {
+            anyhow::bail!(
+                "exec and attach only work on the server's host, over its admin socket; \
+                 run them there without --server"
+            );
+        };
+        let mut req = axum::http::Request::builder()
+            .method(method)
+            .uri(hyper::Uri::from(SocketUri::new(socket, path)))
+            .header(header::CONNECTION, "upgrade")
+            .header(header::UPGRADE, protocol);
+        if body.is_some() {
+            req = req.header(header::CONTENT_TYPE, "application/json");
+        }
+        let req = req.body(Full::new(Bytes::from(body.unwrap_or_default())))?;
+        let mut resp = client
+            .request(req)
             .await
-            .with_context(|| format!("Failed to connect to server at {}", self.server_url))?;
+            .with_context(|| format!("Failed to connect to admin socket {}", socket.display()))?;
+        if resp.status() != StatusCode::SWITCHING_PROTOCOLS {
+            let status = resp.status();
+            let body = resp.into_body().into_data_stream();
+            let reply = Reply {
+                status,
+                body: body.map(|c| c.map_err(anyhow::Error::from)).boxed(),
+            };
+            anyhow::bail!("{}", self.parse_error(reply).await);
+        }
+        let upgraded = hyper::upgrade::on(&mut resp)
+            .await
+            .context("The server didn't switch protocols")?;
+        Ok(hyper_util::rt::TokioIo::new(upgraded))
+    }
+
+    // ===================
+    // HTTP helpers
+    // ===================
+
+    async fn get<T: DeserializeOwned>(&self, path: &str) -> Result<T> {
+        let reply = self.send(Method::GET, path, None, None).await?;
+        self.handle_response(reply).await
+    }
+
+    async fn post<T: DeserializeOwned, B: Serialize>(&self, path: &str, body: &B) -> Result<T> {
+        let body = serde_json::to_vec(body)?;
+        let reply = self.send(Method::POST, path, Some(body), None).await?;
+        self.handle_response(reply).await
+    }
 
-        self.handle_response(resp).await
+    /// Send one request over the configured transport. `body` is JSON.
+    async fn send(
+        &self,
+        method: Method,
+        path: &str,
+        body: Option<Vec<u8>>,
+        timeout: Option<Duration>,
+    ) -> Result<Reply> {
+        match &self.transport {
+            Transport::Http {
+                server_url,
+                token,
+                client,
+            } => {
+                let mut req = client
+                    .request(method, format!("{}{}", server_url, path))
+                    .bearer_auth(token);
+                if let Some(body) = body {
+                    req = req.header(header::CONTENT_TYPE, "application/json").body(body);
+                }
+                if let Some(timeout) = timeout {
+                    req = req.timeout(timeout);
+                }
+                let resp = req
+                    .send()
+                    .await
+                    .with_context(|| format!("Failed to connect to server at {}", server_url))?;
+                Ok(Reply {
+                    status: resp.status(),
+                    body: resp
+                        .bytes_stream()
+                        .map(|c| c.map_err(anyhow::Error::from))
+                        .boxed(),
+                })
+            }
+            Transport::Unix { socket, client } => {
+                let mut req = axum::http::Request::builder()
+                    .method(method)
+                    .uri(hyper::Uri::from(SocketUri::new(socket, path)));
+                if body.is_some() {
+                    req = req.header(header::CONTENT_TYPE, "application/json");
+                }
+                let req = req.body(Full::new(Bytes::from(body.unwrap_or_default())))?;
+                let sent = match timeout {
+                    Some(timeout) => tokio::time::timeout(timeout, client.request(req))
+                        .await
+                        .context("Timed out waiting for the server")?,
+                    None => client.request(req).await,
+                };
+                let resp = sent.with_context(|| {
+                    format!("Failed to connect to admin socket {}", socket.display())
+                })?;
+                let status = resp.status();
+                let body = resp.into_body().into_data_stream();
+                Ok(Reply {
+                    status,
+                    body: body.map(|c| c.map_err(anyhow::Error::from)).boxed(),
+                })
+            }
+        }
     }
 
-    async fn handle_response<T: DeserializeOwned>(&self, resp: reqwest::Response) -> Result<T> {
-        let status = resp.status();
-        if status.is_success() {
-            resp.json::<T>()
-                .await
-                .context("Failed to parse server response")
+    async fn handle_response<T: DeserializeOwned>(&self, reply: Reply) -> Result<T> {
+        if reply.status.is_success() {
+            let body = reply.bytes().await?;
+            serde_json::from_slice(&body).context("Failed to parse server response")
         } else {
-            let err = self.parse_error(resp).await;
+            let err = self.parse_error(reply).await;
             anyhow::bail!("{}", err)
         }
     }
 
-    async fn parse_error(&self, resp: reqwest::Response) -> String {
-        let status = resp.status();
-        match resp.json::<ApiError>().await {
+    async fn parse_error(&self, reply: Reply) -> String {
+        let status = reply.status;
+        let body = reply.bytes().await.unwrap_or_default();
+        match serde_json::from_slice::<ApiError>(&body) {
             Ok(err) => err.error,
             Err(_) => format!("Server returned {}", status),
         }
@@ -376,3 +876,58 @@ pub fn save_token_file(data_dir: &std::path::Path, token: &str) -> Result<()> {
 
     Ok(())
 }
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_log_filter_query_string() {
+        assert_eq!(LogFilter::default().query_string(), "");
+
+        let filter = LogFilter {
+            process: Some("api".to_string()),
+            search: Some("a b&c".to_string()),
+            limit: Some(20),
+            since: Some(1_700_000_000_000),
+            ..Default::default()
+        };
+        assert_eq!(
+            filter.query_string(),
+            "?process=api&search=a%20b%26c&limit=20&since=1700000000000"
+        );
+    }
+
+    #[test]
+    fn test_audit_query_string() {
+        let query = tenement::AuditQuery::default();
+        assert_eq!(audit_query_string(&query), "");
+
+        let query = tenement::AuditQuery {
+            actor: Some("token:ci".to_string()),
+            since: Some("2026-01-01T00:00:00+00:00".to_string()),
+            failed: true,
+            limit: Some(5),
+            ..Default::default()
+        };
+        assert_eq!(
+            audit_query_string(&query),
+            "?actor=token%3Aci&since=2026-01-01T00%3A00%3A00%2B00%3A00&failed=true&limit=5"
+        );
+    }
+
+    #[test]
+    fn test_event_query_string() {
+        assert_eq!(EventQuery::default().query_string(&[]), "");
+
+        let query = EventQuery {
+            app: Some("api".to_string()),
+            kinds: vec![EventKind::Crashed, EventKind::HealthChanged],
+            limit: Some(5),
+        };
+        assert_eq!(
+            query.query_string(&["format=ndjson"]),
+            "?format=ndjson&app=api&type=crashed,health_changed&limit=5"
+        );
+    }
+}
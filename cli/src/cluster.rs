@@ -0,0 +1,221 @@
+//! Cluster heartbeats and failover
+//!
+//! Every heartbeat the node polls `GET /cluster/state` on each peer it knows,
+//! sending the shared token in `X-Tenement-Cluster-Token`, and then holds an
+//! election (see [`tenement::cluster`]). In standby mode only the leader runs
+//! instances: a node that becomes leader starts what the previous leader ran
+//! (or, with no leader heard from, the configured instances), and one that
+//! stops leading stops its own.
+//!
+//! Requests forwarded to a peer carry the token too, and a node only takes a
+//! forwarded request that has it. Both go to `http://{address}` unencrypted;
+//! run the nodes on a private network.
+
+use axum::{
+    extract::State,
+    http::{HeaderMap, StatusCode},
+    Json,
+};
+use std::collections::BTreeMap;
+use std::sync::Arc;
+use std::time::Instant;
+use tenement::cluster::{Cluster, NodeState, TOKEN_HEADER};
+use tenement::config::ClusterMode;
+use tenement::instance::InstanceStatus;
+use tenement::Hypervisor;
+
+use crate::server::{constant_time_eq, AppState};
+
+/// This node's state: the instances it runs, per service
+pub async fn local_state(hypervisor: &Hypervisor) -> Option<NodeState> {
+    let cluster = hypervisor.cluster()?;
+    let mut services: BTreeMap<String, Vec<String>> = BTreeMap::new();
+    for info in hypervisor.list().await {
+        if info.status == InstanceStatus::Running && !info.health.is_down() {
+            services
+                .entry(info.id.process)
+                .or_default()
+                .push(info.id.id);
+        }
+    }
+    for ids in services.values_mut() {
+        ids.sort();
+    }
+    Some(cluster.local_state(services))
+}
+
+/// This node's state, for its peers: GET /cluster/state (cluster token only)
+pub async fn cluster_state(
+    State(state): State<AppState>,
+    headers: HeaderMap,
+) -> Result<Json<NodeState>, StatusCode> {
+    let Some(cluster) = state.hypervisor.cluster() else {
+        return Err(StatusCode::NOT_FOUND);
+    };
+    if !from_peer(cluster, &headers) {
+        return Err(StatusCode::UNAUTHORIZED);
+    }
+    local_state(&state.hypervisor)
+        .await
+        .map(Json)
+        .ok_or(StatusCode::NOT_FOUND)
+}
+
+/// Whether `headers` carry the cluster token, so come from another node
+pub fn from_peer(cluster: &Cluster, headers: &HeaderMap) -> bool {
+    let given = headers.get(TOKEN_HEADER).and_then(|v| v.to_str().ok());
+    match (cluster.token(), given) {
+        (Some(token), Some(given)) => constant_time_eq(token.as_bytes(), given.as_bytes()),
+        _ => false,
+    }
+}
+
+/// Poll the peers and hold an election every heartbeat, starting and stopping
+/// instances as leadership moves in standby mode. Does nothing outside a cluster.
+pub fn spawn_cluster(hypervisor: Arc<Hypervisor>) -> Option<tokio::task::JoinHandle<()>> {
+    let cluster = hypervisor.cluster()?;
+    if cluster.token().is_none() {
+        tracing::error!("Cluster disabled: no token in the cluster's token_env variable");
+        return None;
+    }
+    let client = reqwest::Client::new();
+    let mut next = tokio::time::Instant::now();
+
+    Some(tokio::spawn(async move {
+        loop {
+            tokio::time::sleep_until(next).await;
+            // Heartbeat and token are read each round, so a reload applies them
+            let Some(cluster) = hypervisor.cluster() else {
+                break;
+            };
+            next += cluster.heartbeat();
+            let Some(token) = cluster.token() else {
+                tracing::warn!("Cluster: no token in the cluster's token_env variable");
+                continue;
+            };
+            let polls = cluster.peers().into_iter().map(|peer| {
+                let request = client
+                    .get(format!("http://{}/cluster/state", peer.address))
+                    .timeout(cluster.heartbeat())
+                    .header(TOKEN_HEADER, &token);
+                async move {
+                    let reply = request.send().await.and_then(|r| r.error_for_status());
+                    match reply {
+                        Ok(reply) => reply.json::<NodeState>().await.ok(),
+                        Err(e) => {
+                            tracing::debug!("Cluster: {} didn't answer: {}", peer.node, e);
+                            None
+                        }
+                    }
+                }
+            });
+            for state in futures::future::join_all(polls).await.into_iter().flatten() {
+                cluster.observe(state, Instant::now());
+            }
+
+            let was_leader = cluster.is_leader();
+            let leads = cluster.elect(Instant::now());
+            if leads == was_leader {
+                continue;
+            }
+            match leads {
+                true => tracing::info!("Cluster: {} is now the leader", cluster.node()),
+                false => tracing::info!("Cluster: {} is no longer the leader", cluster.node()),
+            }
+            if cluster.mode() == ClusterMode::Standby {
+                match leads {
+                    true => take_over(&hypervisor).await,
+                    false => stand_down(&hypervisor).await,
+                }
+            }
+        }
+    }))
+}
+
+/// Start what the previous leader ran, or the configured instances if no
+/// leader was heard from
+async fn take_over(hypervisor: &Hypervisor) {
+    let placement = match hypervisor.cluster() {
+        Some(cluster) => cluster.placement(),
+        None => return,
+    };
+    if placement.is_empty() {
+        let (success, failed) = hypervisor.spawn_configured_instances().await;
+        tracing::info!(
+            "Cluster: started {} instance(s), {} failed",
+            success,
+            failed
+        );
+        return;
+    }
+    for (process, ids) in placement {
+        if !hypervisor.has_process(&process) {
+            tracing::warn!(
+                "Cluster: the leader ran {}, which isn't configured here",
+                process
+            );
+            continue;
+        }
+        for id in ids {
+            if hypervisor.get(&process, &id).await.is_some() {
+                continue;
+            }
+            match hypervisor.spawn(&process, &id).await {
+                Ok(_) => tracing::info!("Cluster: took over {}:{}", process, id),
+                Err(e) => tracing::error!("Cluster: failed to start {}:{}: {}", process, id, e),
+            }
+        }
+    }
+}
+
+/// Stop every local instance: the new leader runs them now
+async fn stand_down(hypervisor: &Hypervisor) {
+    for info in hypervisor.list().await {
+        let (process, id) = (&info.id.process, &info.id.id);
+        if let Err(e) = hypervisor.stop(process, id).await {
+            tracing::error!("Cluster: failed to stop {}:{}: {}", process, id, e);
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tenement::config::PeerConfig;
+
+    fn cluster_config(mode: ClusterMode) -> tenement::Config {
+        let mut config = tenement::Config::default();
+        config.settings.cluster = Some(tenement::config::ClusterConfig {
+            node: "a".to_string(),
+            advertise: "10.0.0.1:8080".to_string(),
+            peers: vec![PeerConfig {
+                node: "b".to_string(),
+                address: "10.0.0.2:8080".to_string(),
+            }],
+            mode,
+            token_env: "TENEMENT_CLUSTER_TOKEN_TEST".to_string(),
+            heartbeat: 1,
+            failure_timeout: 5,
+        });
+        config
+    }
+
+    #[tokio::test]
+    async fn test_local_state() {
+        assert!(local_state(&Hypervisor::new(tenement::Config::default()))
+            .await
+            .is_none());
+        let hypervisor = Hypervisor::new(cluster_config(ClusterMode::Active));
+        let state = local_state(&hypervisor).await.unwrap();
+        assert_eq!(state.node, "a");
+        assert_eq!(state.address, "10.0.0.1:8080");
+        assert!(state.services.is_empty());
+        assert_eq!(state.peers[0].node, "b");
+    }
+
+    #[tokio::test]
+    async fn test_spawn_cluster_needs_token() {
+        let hypervisor = Hypervisor::new(cluster_config(ClusterMode::Standby));
+        assert!(spawn_cluster(hypervisor).is_none());
+    }
+}
@@ -0,0 +1,111 @@
+//! Service discovery files
+//!
+//! Rewrites `{data_dir}/discovery/hosts` and `services.env` (and the block in
+//! `settings.discovery.hosts_file`, if set) whenever an instance starts,
+//! crashes or changes health, and every few seconds to catch stops. See
+//! [`tenement::discovery`] for what they hold.
+
+use anyhow::Result;
+use std::sync::Arc;
+use std::time::Duration;
+use tenement::discovery;
+use tenement::Hypervisor;
+use tokio::sync::broadcast::error::RecvError;
+
+/// Longest the files go without a refresh
+const REFRESH_INTERVAL: Duration = Duration::from_secs(2);
+
+/// Write the discovery files for the instances running now. `port` is the
+/// plain HTTP listener, for the URLs through tenement (None: no URLs).
+pub async fn refresh(hypervisor: &Hypervisor, port: Option<u16>) -> Result<()> {
+    let Some(settings) = hypervisor.discovery() else {
+        return Ok(());
+    };
+    let config = hypervisor.config();
+    let mut services: Vec<String> = config.service.keys().cloned().collect();
+    services.sort();
+    let instances = hypervisor.list().await;
+
+    let data_dir = &config.settings.data_dir;
+    let hosts = discovery::render_hosts(&settings.domain, &instances, &services);
+    discovery::write_if_changed(&discovery::hosts_file(data_dir), &hosts)?;
+    if let Some(path) = &settings.hosts_file {
+        discovery::update_hosts_file(path, &hosts)?;
+    }
+    let upstreams = discovery::upstreams(&services, &instances);
+    let env = discovery::render_env(&settings.domain, port, &upstreams);
+    discovery::write_if_changed(&discovery::env_file(data_dir), &env)?;
+    Ok(())
+}
+
+/// Keep the discovery files current. Does nothing without `[settings.discovery]`.
+pub fn spawn_discovery(
+    hypervisor: Arc<Hypervisor>,
+    port: Option<u16>,
+) -> Option<tokio::task::JoinHandle<()>> {
+    hypervisor.discovery()?;
+    let mut events = hypervisor.subscribe_events();
+    let mut interval = tokio::time::interval(REFRESH_INTERVAL);
+
+    Some(tokio::spawn(async move {
+        loop {
+            tokio::select! {
+                _ = interval.tick() => {}
+                event = events.recv() => match event {
+                    Ok(_) | Err(RecvError::Lagged(_)) => {}
+                    Err(RecvError::Closed) => break,
+                },
+            }
+            if let Err(e) = refresh(&hypervisor, port).await {
+                tracing::warn!("Failed to write service discovery files: {:#}", e);
+            }
+        }
+    }))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tenement::config::DiscoveryConfig;
+
+    #[tokio::test]
+    async fn test_refresh_writes_files() {
+        let dir = tempfile::tempdir().unwrap();
+        let hosts_file = dir.path().join("etc-hosts");
+        std::fs::write(&hosts_file, "127.0.0.1 localhost\n").unwrap();
+        let mut config = tenement::Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+"#,
+        )
+        .unwrap();
+        config.settings.data_dir = dir.path().to_path_buf();
+        config.settings.discovery = Some(DiscoveryConfig {
+            hosts_file: Some(hosts_file.clone()),
+            ..DiscoveryConfig::default()
+        });
+        let hypervisor = Hypervisor::new(config);
+
+        refresh(&hypervisor, Some(8080)).await.unwrap();
+        let hosts = std::fs::read_to_string(discovery::hosts_file(dir.path())).unwrap();
+        assert_eq!(hosts, "127.0.0.1\tapi.tenement.local\n");
+        let shared = std::fs::read_to_string(&hosts_file).unwrap();
+        assert!(shared.starts_with("127.0.0.1 localhost\n# BEGIN tenement\n"));
+        assert!(shared.contains(&hosts));
+        let env = std::fs::read_to_string(discovery::env_file(dir.path())).unwrap();
+        assert!(env.contains("TENEMENT_SERVICE_API_URL=http://api.tenement.local:8080\n"));
+        assert!(env.contains("TENEMENT_SERVICE_API_UPSTREAMS=\n"));
+    }
+
+    #[tokio::test]
+    async fn test_discovery_off_without_settings() {
+        let dir = tempfile::tempdir().unwrap();
+        let mut config = tenement::Config::default();
+        config.settings.data_dir = dir.path().to_path_buf();
+        let hypervisor = Hypervisor::new(config);
+        refresh(&hypervisor, Some(8080)).await.unwrap();
+        assert!(!discovery::env_file(dir.path()).exists());
+        assert!(spawn_discovery(hypervisor, Some(8080)).is_none());
+    }
+}
@@ -0,0 +1,808 @@
+//! DNS providers for ACME DNS-01 challenges
+//!
+//! A DNS-01 challenge is answered by publishing a TXT record at
+//! `_acme-challenge.<name>`. [`DnsSolver`] publishes and removes those records
+//! through the provider `dns_provider` names: the Cloudflare API, the
+//! Route53 API (requests signed with AWS Signature Version 4), or any name server
+//! accepting RFC 2136 dynamic updates signed with a TSIG key.
+//!
+//! A wildcard name and its parent share a record name, so records are handled
+//! in batches and a provider keeps every value given for a name.
+
+use anyhow::{Context, Result};
+use base64::Engine;
+use ring::{digest, hmac};
+use std::collections::BTreeMap;
+use std::net::SocketAddr;
+use std::time::Duration;
+use tenement::config::{DnsChallengeConfig, DnsProvider};
+
+/// TTL of the challenge records, in seconds
+const RECORD_TTL: u32 = 60;
+
+/// How long to wait for a provider to answer
+const TIMEOUT: Duration = Duration::from_secs(30);
+
+const CLOUDFLARE_API: &str = "https://api.cloudflare.com/client/v4";
+const ROUTE53_HOST: &str = "route53.amazonaws.com";
+
+/// A challenge record: its fully qualified name (no trailing dot) and value
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct TxtRecord {
+    pub name: String,
+    pub value: String,
+}
+
+/// Publishes challenge records through the configured provider
+#[derive(Debug)]
+pub enum DnsSolver {
+    Cloudflare(Cloudflare),
+    Route53(Route53),
+    Rfc2136(Rfc2136),
+}
+
+impl DnsSolver {
+    /// `provider` set up by `config`, with its credentials read from the environment
+    pub fn from_config(provider: DnsProvider, config: &DnsChallengeConfig) -> Result<Self> {
+        let env = |default: &str| {
+            let var = config.credentials_env.as_deref().unwrap_or(default);
+            std::env::var(var).with_context(|| format!("DNS-01: {} is not set", var))
+        };
+        let http = || reqwest::Client::builder().timeout(TIMEOUT).build();
+        Ok(match provider {
+            DnsProvider::Cloudflare => Self::Cloudflare(Cloudflare {
+                http: http()?,
+                token: env("CF_API_TOKEN")?,
+                zone_id: config.zone_id.clone(),
+            }),
+            DnsProvider::Route53 => {
+                let var = |name: &str| {
+                    std::env::var(name).with_context(|| format!("DNS-01: {} is not set", name))
+                };
+                let zone_id = config.zone_id.as_deref().unwrap_or_default();
+                Self::Route53(Route53 {
+                    http: http()?,
+                    zone_id: zone_id.trim_start_matches("/hostedzone/").to_string(),
+                    access_key: var("AWS_ACCESS_KEY_ID")?,
+                    secret_key: var("AWS_SECRET_ACCESS_KEY")?,
+                    session_token: std::env::var("AWS_SESSION_TOKEN").ok(),
+                })
+            }
+            DnsProvider::Rfc2136 => {
+                let secret = base64::engine::general_purpose::STANDARD
+                    .decode(env("TSIG_SECRET")?.trim())
+                    .context("DNS-01: the TSIG secret is not base64")?;
+                Self::Rfc2136(Rfc2136 {
+                    server: config.server.context("DNS-01: rfc2136 needs server")?,
+                    zone: config.zone.clone().unwrap_or_default(),
+                    key_name: config.tsig_key_name.clone().unwrap_or_default(),
+                    secret,
+                })
+            }
+        })
+    }
+
+    /// Publish `records`, keeping every value given for the same name
+    pub async fn publish(&self, records: &[TxtRecord]) -> Result<()> {
+        match self {
+            Self::Cloudflare(cloudflare) => cloudflare.publish(records).await,
+            Self::Route53(route53) => route53.publish(records).await,
+            Self::Rfc2136(rfc2136) => rfc2136.update(true, records).await,
+        }
+    }
+
+    /// Remove `records` once their challenges are done
+    pub async fn remove(&self, records: &[TxtRecord]) -> Result<()> {
+        match self {
+            Self::Cloudflare(cloudflare) => cloudflare.remove(records).await,
+            Self::Route53(route53) => route53.remove(records).await,
+            Self::Rfc2136(rfc2136) => rfc2136.update(false, records).await,
+        }
+    }
+}
+
+// ===================
+// Cloudflare
+// ===================
+
+/// Records through the Cloudflare API, with an API token allowed to edit the zone
+pub struct Cloudflare {
+    http: reqwest::Client,
+    token: String,
+    zone_id: Option<String>,
+}
+
+impl std::fmt::Debug for Cloudflare {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Cloudflare")
+            .field("zone_id", &self.zone_id)
+            .finish_non_exhaustive()
+    }
+}
+
+impl Cloudflare {
+    async fn call(
+        &self,
+        method: reqwest::Method,
+        path: &str,
+        body: Option<serde_json::Value>,
+    ) -> Result<serde_json::Value> {
+        let mut request = self
+            .http
+            .request(method, format!("{}{}", CLOUDFLARE_API, path))
+            .bearer_auth(&self.token);
+        if let Some(body) = body {
+            request = request.json(&body);
+        }
+        let response: serde_json::Value = request.send().await?.json().await?;
+        if response["success"] != serde_json::Value::Bool(true) {
+            anyhow::bail!("Cloudflare {}: {}", path, response["errors"]);
+        }
+        Ok(response["result"].clone())
+    }
+
+    /// The configured zone, or the closest zone enclosing `name`
+    async fn zone(&self, name: &str) -> Result<String> {
+        if let Some(zone_id) = &self.zone_id {
+            return Ok(zone_id.clone());
+        }
+        let mut candidate = name;
+        while let Some((_, parent)) = candidate.split_once('.') {
+            let path = format!("/zones?name={}", urlencoding::encode(parent));
+            let zones = self.call(reqwest::Method::GET, &path, None).await?;
+            if let Some(id) = zones[0]["id"].as_str() {
+                return Ok(id.to_string());
+            }
+            candidate = parent;
+        }
+        anyhow::bail!("Cloudflare: no zone enclosing {} for this token", name)
+    }
+
+    async fn publish(&self, records: &[TxtRecord]) -> Result<()> {
+        for record in records {
+            let zone = self.zone(&record.name).await?;
+            let body = serde_json::json!({
+                "type": "TXT",
+                "name": record.name,
+                "content": record.value,
+                "ttl": RECORD_TTL,
+            });
+            let path = format!("/zones/{}/dns_records", zone);
+            self.call(reqwest::Method::POST, &path, Some(body)).await?;
+        }
+        Ok(())
+    }
+
+    async fn remove(&self, records: &[TxtRecord]) -> Result<()> {
+        for record in records {
+            let zone = self.zone(&record.name).await?;
+            let name = urlencoding::encode(&record.name);
+            let path = format!("/zones/{}/dns_records?type=TXT&name={}", zone, name);
+            let existing = self.call(reqwest::Method::GET, &path, None).await?;
+            for entry in existing.as_array().into_iter().flatten() {
+                let content = entry["content"].as_str().unwrap_or_default();
+                let Some(id) = entry["id"].as_str() else {
+                    continue;
+                };
+                if content.trim_matches('"') == record.value {
+                    let path = format!("/zones/{}/dns_records/{}", zone, id);
+                    self.call(reqwest::Method::DELETE, &path, None).await?;
+                }
+            }
+        }
+        Ok(())
+    }
+}
+
+// ===================
+// Route53
+// ===================
+
+/// Records in a Route53 hosted zone
+pub struct Route53 {
+    http: reqwest::Client,
+    zone_id: String,
+    access_key: String,
+    secret_key: String,
+    session_token: Option<String>,
+}
+
+impl std::fmt::Debug for Route53 {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Route53")
+            .field("zone_id", &self.zone_id)
+            .finish_non_exhaustive()
+    }
+}
+
+impl Route53 {
+    /// Add `records` to the TXT record sets at their names, keeping the values
+    /// already there (another challenge, a site verification record)
+    async fn publish(&self, records: &[TxtRecord]) -> Result<()> {
+        let mut changes = Vec::new();
+        for (name, ours) in quoted_values(records) {
+            let (ttl, mut values) = self.record_set(name).await?.unwrap_or((RECORD_TTL, vec![]));
+            for value in ours {
+                if !values.contains(&value) {
+                    values.push(value);
+                }
+            }
+            changes.push(RecordSetChange {
+                action: "UPSERT",
+                name,
+                ttl,
+                values,
+            });
+        }
+        self.change(&changes).await
+    }
+
+    /// Take `records` out of their TXT record sets, deleting a set once
+    /// nothing else is left in it
+    async fn remove(&self, records: &[TxtRecord]) -> Result<()> {
+        let mut changes = Vec::new();
+        for (name, ours) in quoted_values(records) {
+            let Some((ttl, values)) = self.record_set(name).await? else {
+                continue;
+            };
+            let left: Vec<String> = values
+                .iter()
+                .filter(|value| !ours.contains(value))
+                .cloned()
+                .collect();
+            let (action, values) = match left.len() {
+                n if n == values.len() => continue,
+                // A deletion names the set exactly as it stands
+                0 => ("DELETE", values),
+                _ => ("UPSERT", left),
+            };
+            changes.push(RecordSetChange {
+                action,
+                name,
+                ttl,
+                values,
+            });
+        }
+        if changes.is_empty() {
+            return Ok(());
+        }
+        self.change(&changes).await
+    }
+
+    /// The TTL and values of the TXT record set at `name`, if there is one
+    async fn record_set(&self, name: &str) -> Result<Option<(u32, Vec<String>)>> {
+        let path = format!("/2013-04-01/hostedzone/{}/rrset", self.zone_id);
+        let query = format!("maxitems=1&name={}.&type=TXT", urlencoding::encode(name));
+        let listed = self
+            .call(reqwest::Method::GET, &path, &query, String::new())
+            .await?;
+        Ok(record_set(&listed, name))
+    }
+
+    async fn change(&self, changes: &[RecordSetChange<'_>]) -> Result<()> {
+        let path = format!("/2013-04-01/hostedzone/{}/rrset", self.zone_id);
+        let body = change_batch(changes);
+        self.call(reqwest::Method::POST, &path, "", body).await?;
+        Ok(())
+    }
+
+    /// Send a signed request; the response body
+    async fn call(
+        &self,
+        method: reqwest::Method,
+        path: &str,
+        query: &str,
+        body: String,
+    ) -> Result<String> {
+        let amz_date = chrono::Utc::now().format("%Y%m%dT%H%M%SZ").to_string();
+        let mut headers = vec![("host", ROUTE53_HOST), ("x-amz-date", amz_date.as_str())];
+        if let Some(token) = &self.session_token {
+            headers.push(("x-amz-security-token", token.as_str()));
+        }
+        let request = SignedRequest {
+            method: method.as_str(),
+            path,
+            query,
+            headers: &headers,
+            body: body.as_bytes(),
+        };
+        let authorization = request.authorization(&self.access_key, &self.secret_key, &amz_date);
+
+        let url = match query {
+            "" => format!("https://{}{}", ROUTE53_HOST, path),
+            _ => format!("https://{}{}?{}", ROUTE53_HOST, path, query),
+        };
+        let mut builder = self
+            .http
+            .request(method.clone(), url)
+            .header("authorization", authorization)
+            .header("content-type", "application/xml");
+        for (name, value) in &headers[1..] {
+            builder = builder.header(*name, *value);
+        }
+        let response = builder.body(body).send().await?;
+        let status = response.status();
+        let text = response.text().await?;
+        if !status.is_success() {
+            anyhow::bail!("Route53 {} {}: {} {}", method, path, status, text);
+        }
+        Ok(text)
+    }
+}
+
+/// One change to the TXT record set at `name`: its TTL and every value it's
+/// to hold (quoted, as Route53 keeps them)
+struct RecordSetChange<'a> {
+    action: &'static str,
+    name: &'a str,
+    ttl: u32,
+    values: Vec<String>,
+}
+
+/// The values of `records` by name, quoted as TXT values are in Route53
+fn quoted_values(records: &[TxtRecord]) -> BTreeMap<&str, Vec<String>> {
+    let mut names: BTreeMap<&str, Vec<String>> = BTreeMap::new();
+    for record in records {
+        let value = format!("\"{}\"", record.value);
+        names.entry(&record.name).or_default().push(value);
+    }
+    names
+}
+
+/// The TTL and values of the TXT record set at `name` in a
+/// ListResourceRecordSets response, which may list other names after it
+fn record_set(listed: &str, name: &str) -> Option<(u32, Vec<String>)> {
+    for set in xml_elements(listed, "ResourceRecordSet") {
+        let field = |tag: &str| {
+            xml_elements(set, tag)
+                .first()
+                .map(|text| unescape_xml(text))
+        };
+        let set_name = field("Name").unwrap_or_default();
+        let same = set_name.trim_end_matches('.').eq_ignore_ascii_case(name);
+        if !same || field("Type").as_deref() != Some("TXT") {
+            continue;
+        }
+        let ttl = field("TTL").and_then(|ttl| ttl.parse().ok());
+        let values = xml_elements(set, "Value").into_iter().map(unescape_xml);
+        return Some((ttl.unwrap_or(RECORD_TTL), values.collect()));
+    }
+    None
+}
+
+/// ChangeResourceRecordSets body with each change's record set in full
+fn change_batch(changes: &[RecordSetChange<'_>]) -> String {
+    let mut body = String::new();
+    for change in changes {
+        let values: String = change
+            .values
+            .iter()
+            .map(|v| {
+                format!(
+                    "<ResourceRecord><Value>{}</Value></ResourceRecord>",
+                    escape_xml(v)
+                )
+            })
+            .collect();
+        body.push_str(&format!(
+            "<Change><Action>{}</Action><ResourceRecordSet><Name>{}.</Name><Type>TXT</Type>\
+             <TTL>{}</TTL><ResourceRecords>{}</ResourceRecords></ResourceRecordSet></Change>",
+            change.action, change.name, change.ttl, values
+        ));
+    }
+    format!(
+        "<?xml version=\"1.0\" encoding=\"UTF-8\"?>\
+         <ChangeResourceRecordSetsRequest xmlns=\"https://route53.amazonaws.com/doc/2013-04-01/\">\
+         <ChangeBatch><Changes>{}</Changes></ChangeBatch></ChangeResourceRecordSetsRequest>",
+        body
+    )
+}
+
+/// The contents of each `<tag>...</tag>` in `xml`, not unescaped
+fn xml_elements<'a>(xml: &'a str, tag: &str) -> Vec<&'a str> {
+    let open = format!("<{}>", tag);
+    let close = format!("</{}>", tag);
+    let mut found = Vec::new();
+    let mut rest = xml;
+    while let Some(start) = rest.find(&open).map(|i| i + open.len()) {
+        let Some(end) = rest[start..].find(&close).map(|i| start + i) else {
+            break;
+        };
+        found.push(&rest[start..end]);
+        rest = &rest[end + close.len()..];
+    }
+    found
+}
+
+fn unescape_xml(text: &str) -> String {
+    text.replace("&lt;", "<")
+        .replace("&gt;", ">")
+        .replace("&quot;", "\"")
+        .replace("&apos;", "'")
+        .replace("&amp;", "&")
+}
+
+fn escape_xml(text: &str) -> String {
+    text.replace('&', "&amp;")
+        .replace('<', "&lt;")
+        .replace('>', "&gt;")
+}
+
+/// A request to sign with AWS Signature Version 4 (Route53 is global, in us-east-1)
+struct SignedRequest<'a> {
+    method: &'a str,
+    path: &'a str,
+    /// Canonical: parameters sorted by name, URI-encoded
+    query: &'a str,
+    /// Lowercase names, sorted; all of them are signed
+    headers: &'a [(&'a str, &'a str)],
+    body: &'a [u8],
+}
+
+impl SignedRequest<'_> {
+    fn authorization(&self, access_key: &str, secret_key: &str, amz_date: &str) -> String {
+        self.authorization_for("us-east-1", "route53", access_key, secret_key, amz_date)
+    }
+
+    fn authorization_for(
+        &self,
+        region: &str,
+        service: &str,
+        access_key: &str,
+        secret_key: &str,
+        amz_date: &str,
+    ) -> String {
+        let canonical_headers: String = self
+            .headers
+            .iter()
+            .map(|(name, value)| format!("{}:{}\n", name, value.trim()))
+            .collect();
+        let signed_headers: Vec<&str> = self.headers.iter().map(|(name, _)| *name).collect();
+        let signed_headers = signed_headers.join(";");
+        let canonical_request = format!(
+            "{}\n{}\n{}\n{}\n{}\n{}",
+            self.method,
+            self.path,
+            self.query,
+            canonical_headers,
+            signed_headers,
+            sha256_hex(self.body)
+        );
+
+        let date = &amz_date[..8];
+        let scope = format!("{}/{}/{}/aws4_request", date, region, service);
+        let string_to_sign = format!(
+            "AWS4-HMAC-SHA256\n{}\n{}\n{}",
+            amz_date,
+            scope,
+            sha256_hex(canonical_request.as_bytes())
+        );
+        let mut key = format!("AWS4{}", secret_key).into_bytes();
+        for part in [date, region, service, "aws4_request"] {
+            key = hmac_sha256(&key, part.as_bytes());
+        }
+        let signature = hex(&hmac_sha256(&key, string_to_sign.as_bytes()));
+        format!(
+            "AWS4-HMAC-SHA256 Credential={}/{}, SignedHeaders={}, Signature={}",
+            access_key, scope, signed_headers, signature
+        )
+    }
+}
+
+fn hmac_sha256(key: &[u8], message: &[u8]) -> Vec<u8> {
+    let key = hmac::Key::new(hmac::HMAC_SHA256, key);
+    hmac::sign(&key, message).as_ref().to_vec()
+}
+
+fn sha256_hex(bytes: &[u8]) -> String {
+    hex(digest::digest(&digest::SHA256, bytes).as_ref())
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+// ===================
+// RFC 2136
+// ===================
+
+/// Dynamic updates (RFC 2136) sent over UDP, signed with TSIG HMAC-SHA256 (RFC 8945)
+pub struct Rfc2136 {
+    server: SocketAddr,
+    zone: String,
+    key_name: String,
+    secret: Vec<u8>,
+}
+
+impl std::fmt::Debug for Rfc2136 {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("Rfc2136")
+            .field("server", &self.server)
+            .field("zone", &self.zone)
+            .field("key_name", &self.key_name)
+            .finish_non_exhaustive()
+    }
+}
+
+const TYPE_SOA: u16 = 6;
+const TYPE_TXT: u16 = 16;
+const TYPE_TSIG: u16 = 250;
+const CLASS_IN: u16 = 1;
+const CLASS_NONE: u16 = 254;
+const CLASS_ANY: u16 = 255;
+/// Seconds of clock skew the server may allow the signature
+const TSIG_FUDGE: u16 = 300;
+
+impl Rfc2136 {
+    /// Add (or, with `add` false, delete) `records` in one signed update
+    async fn update(&self, add: bool, records: &[TxtRecord]) -> Result<()> {
+        let id = u16::from_be_bytes(rand_bytes());
+        let now = std::time::SystemTime::now()
+            .duration_since(std::time::UNIX_EPOCH)?
+            .as_secs();
+        let message = self.message(id, add, records, now);
+
+        let local: SocketAddr = if self.server.is_ipv4() {
+            ([0, 0, 0, 0], 0).into()
+        } else {
+            (std::net::Ipv6Addr::UNSPECIFIED, 0).into()
+        };
+        let socket = tokio::net::UdpSocket::bind(local).await?;
+        socket.connect(self.server).await?;
+        socket.send(&message).await?;
+        let mut reply = [0u8; 512];
+        tokio::time::timeout(TIMEOUT, async {
+            loop {
+                let n = socket.recv(&mut reply).await?;
+                if n >= 12 && reply[..2] == id.to_be_bytes() {
+                    return Ok::<_, std::io::Error>(n);
+                }
+            }
+        })
+        .await
+        .with_context(|| format!("DNS update to {} timed out", self.server))??;
+
+        match reply[3] & 0x0f {
+            0 => Ok(()),
+            rcode => anyhow::bail!(
+                "DNS update to {} for {} refused ({})",
+                self.server,
+                self.zone,
+                rcode_name(rcode)
+            ),
+        }
+    }
+
+    /// The signed UPDATE message for `records`
+    fn message(&self, id: u16, add: bool, records: &[TxtRecord], time_signed: u64) -> Vec<u8> {
+        let mut message = Vec::with_capacity(512);
+        message.extend_from_slice(&id.to_be_bytes());
+        // Opcode 5 (UPDATE); one zone, no prerequisites, the records, no additional yet
+        message.extend_from_slice(&[0x28, 0x00, 0, 1, 0, 0]);
+        message.extend_from_slice(&(records.len() as u16).to_be_bytes());
+        message.extend_from_slice(&[0, 0]);
+
+        push_name(&mut message, &self.zone);
+        message.extend_from_slice(&TYPE_SOA.to_be_bytes());
+        message.extend_from_slice(&CLASS_IN.to_be_bytes());
+        for record in records {
+            // Deleting one record is the same record with class NONE and TTL 0
+            let (class, ttl) = if add {
+                (CLASS_IN, RECORD_TTL)
+            } else {
+                (CLASS_NONE, 0)
+            };
+            push_name(&mut message, &record.name);
+            message.extend_from_slice(&TYPE_TXT.to_be_bytes());
+            message.extend_from_slice(&class.to_be_bytes());
+            message.extend_from_slice(&ttl.to_be_bytes());
+            let mut rdata = Vec::new();
+            for chunk in record.value.as_bytes().chunks(255) {
+                rdata.push(chunk.len() as u8);
+                rdata.extend_from_slice(chunk);
+            }
+            message.extend_from_slice(&(rdata.len() as u16).to_be_bytes());
+            message.extend_from_slice(&rdata);
+        }
+
+        let mut algorithm = Vec::new();
+        push_name(&mut algorithm, "hmac-sha256");
+        let mut key_name = Vec::new();
+        push_name(&mut key_name, &self.key_name.to_ascii_lowercase());
+        let time = &time_signed.to_be_bytes()[2..];
+
+        // The MAC covers the unsigned message and the TSIG variables
+        let mut signed = message.clone();
+        signed.extend_from_slice(&key_name);
+        signed.extend_from_slice(&CLASS_ANY.to_be_bytes());
+        signed.extend_from_slice(&0u32.to_be_bytes());
+        signed.extend_from_slice(&algorithm);
+        signed.extend_from_slice(time);
+        signed.extend_from_slice(&TSIG_FUDGE.to_be_bytes());
+        signed.extend_from_slice(&[0, 0, 0, 0]);
+        let mac = hmac_sha256(&self.secret, &signed);
+
+        let mut rdata = algorithm;
+        rdata.extend_from_slice(time);
+        rdata.extend_from_slice(&TSIG_FUDGE.to_be_bytes());
+        rdata.extend_from_slice(&(mac.len() as u16).to_be_bytes());
+        rdata.extend_from_slice(&mac);
+        rdata.extend_from_slice(&id.to_be_bytes());
+        rdata.extend_from_slice(&[0, 0, 0, 0]);
+
+        message.extend_from_slice(&key_name);
+        message.extend_from_slice(&TYPE_TSIG.to_be_bytes());
+        message.extend_from_slice(&CLASS_ANY.to_be_bytes());
+        message.extend_from_slice(&0u32.to_be_bytes());
+        message.extend_from_slice(&(rdata.len() as u16).to_be_bytes());
+        message.extend_from_slice(&rdata);
+        message[11] = 1;
+        message
+    }
+}
+
+/// Append `name` in wire format (length-prefixed labels, then the root)
+fn push_name(buf: &mut Vec<u8>, name: &str) {
+    for label in name
+        .trim_end_matches('.')
+        .split('.')
+        .filter(|l| !l.is_empty())
+    {
+        buf.push(label.len() as u8);
+        buf.extend_from_slice(label.as_bytes());
+    }
+    buf.push(0);
+}
+
+/// What an RCODE means, with a hint for the ones a misconfigured key causes
+fn rcode_name(rcode: u8) -> &'static str {
+    match rcode {
+        2 => "SERVFAIL",
+        3 => "NXDOMAIN",
+        4 => "NOTIMP",
+        5 => "REFUSED",
+        9 => "NOTAUTH: the key isn't valid for this zone, or the clocks differ",
+        10 => "NOTZONE: the record names aren't in the zone",
+        _ => "error",
+    }
+}
+
+fn rand_bytes() -> [u8; 2] {
+    use ring::rand::SecureRandom;
+    let mut bytes = [0u8; 2];
+    let _ = ring::rand::SystemRandom::new().fill(&mut bytes);
+    bytes
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn record(name: &str, value: &str) -> TxtRecord {
+        TxtRecord {
+            name: name.to_string(),
+            value: value.to_string(),
+        }
+    }
+
+    // ===================
+    // ROUTE53
+    // ===================
+
+    #[test]
+    fn test_sigv4_matches_aws_test_suite() {
+        // "get-vanilla" from the AWS Signature Version 4 test suite
+        let request = SignedRequest {
+            method: "GET",
+            path: "/",
+            query: "",
+            headers: &[
+                ("host", "example.amazonaws.com"),
+                ("x-amz-date", "20150830T123600Z"),
+            ],
+            body: b"",
+        };
+        let authorization = request.authorization_for(
+            "us-east-1",
+            "service",
+            "AKIDEXAMPLE",
+            "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY",
+            "20150830T123600Z",
+        );
+        assert_eq!(
+            authorization,
+            "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, \
+             SignedHeaders=host;x-amz-date, \
+             Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+        );
+    }
+
+    #[test]
+    fn test_change_batch_groups_values_by_name() {
+        let records = [
+            record("_acme-challenge.apps.example.com", "one"),
+            record("_acme-challenge.apps.example.com", "two"),
+        ];
+        let changes: Vec<RecordSetChange> = quoted_values(&records)
+            .into_iter()
+            .map(|(name, values)| RecordSetChange {
+                action: "UPSERT",
+                name,
+                ttl: RECORD_TTL,
+                values,
+            })
+            .collect();
+        let body = change_batch(&changes);
+        assert_eq!(body.matches("<Change>").count(), 1);
+        assert!(body.contains("<Name>_acme-challenge.apps.example.com.</Name>"));
+        assert!(body.contains("<Value>\"one\"</Value>"));
+        assert!(body.contains("<Value>\"two\"</Value>"));
+    }
+
+    #[test]
+    fn test_record_set_keeps_other_values() {
+        let listed = "<ListResourceRecordSetsResponse><ResourceRecordSets>\
+            <ResourceRecordSet><Name>_acme-challenge.apps.example.com.</Name><Type>TXT</Type>\
+            <TTL>300</TTL><ResourceRecords>\
+            <ResourceRecord><Value>&quot;site-verification=abc&quot;</Value></ResourceRecord>\
+            <ResourceRecord><Value>\"token\"</Value></ResourceRecord>\
+            </ResourceRecords></ResourceRecordSet>\
+            </ResourceRecordSets></ListResourceRecordSetsResponse>";
+        let (ttl, values) = record_set(listed, "_acme-challenge.apps.example.com").unwrap();
+        assert_eq!(ttl, 300);
+        assert_eq!(values, ["\"site-verification=abc\"", "\"token\""]);
+
+        // The listing starts at the name, but may hold only the ones after it
+        assert!(record_set(listed, "_acme-challenge.example.com").is_none());
+    }
+
+    // ===================
+    // RFC 2136
+    // ===================
+
+    #[test]
+    fn test_update_message_is_signed() {
+        let rfc2136 = Rfc2136 {
+            server: "127.0.0.1:53".parse().unwrap(),
+            zone: "example.com".to_string(),
+            key_name: "Tenement".to_string(),
+            secret: b"secret".to_vec(),
+        };
+        let records = [record("_acme-challenge.apps.example.com", "value")];
+        let message = rfc2136.message(0x1234, true, &records, 1_700_000_000);
+
+        assert_eq!(&message[..4], &[0x12, 0x34, 0x28, 0x00]);
+        // One zone, no prerequisites, one update, one TSIG
+        assert_eq!(&message[4..12], &[0, 1, 0, 0, 0, 1, 0, 1]);
+        let mut zone = Vec::new();
+        push_name(&mut zone, "example.com");
+        assert_eq!(&message[12..12 + zone.len()], &zone[..]);
+        assert_eq!(zone, b"\x07example\x03com\x00");
+
+        // The TSIG record ends the message: MAC, original id, no error, no other data
+        let tail = &message[message.len() - 6 - 32..];
+        assert_eq!(&tail[32..], &[0x12, 0x34, 0, 0, 0, 0]);
+        let mut key_name = Vec::new();
+        push_name(&mut key_name, "tenement");
+        let unsigned_end = message
+            .windows(key_name.len())
+            .rposition(|w| w == key_name)
+            .unwrap();
+        let mut signed = message[..unsigned_end].to_vec();
+        signed[11] = 0;
+        signed.extend_from_slice(&key_name);
+        signed.extend_from_slice(&[0, 255, 0, 0, 0, 0]);
+        signed.extend_from_slice(b"\x0bhmac-sha256\x00");
+        signed.extend_from_slice(&1_700_000_000u64.to_be_bytes()[2..]);
+        signed.extend_from_slice(&[1, 44, 0, 0, 0, 0]);
+        assert_eq!(&tail[..32], &hmac_sha256(b"secret", &signed)[..]);
+
+        // Deleting sends the same record with class NONE and TTL 0
+        let delete = rfc2136.message(0x1234, false, &records, 1_700_000_000);
+        let at = delete
+            .windows(4)
+            .position(|w| w == b"\x00\x10\x00\xfe")
+            .unwrap();
+        assert_eq!(&delete[at + 4..at + 8], &[0, 0, 0, 0]);
+    }
+}
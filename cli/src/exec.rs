@@ -0,0 +1,179 @@
+//! `ten exec` and `ten attach`: the client end of the admin socket sessions
+//! in `tenement::exec`
+//!
+//! While a command runs on a remote terminal, the local one is put in raw mode
+//! so keys like Ctrl-C and Ctrl-D reach the command instead of `ten`, and size
+//! changes are passed on. Without a terminal, stdin and stdout are piped
+//! through as they are.
+
+use anyhow::Result;
+use tenement_cli::client::ApiClient;
+
+/// Command `ten exec` runs when given none
+const DEFAULT_COMMAND: &str = "/bin/sh";
+
+/// Run `command` in `instance` and return its exit code. `tty` forces a
+/// terminal on or off; by default there's one when stdin and stdout are one.
+#[cfg(unix)]
+pub async fn exec(
+    client: &ApiClient,
+    instance: &str,
+    command: Vec<String>,
+    tty: Option<bool>,
+) -> Result<i32> {
+    use std::io::{Read, Write};
+    use tenement::exec::{ExecRequest, Frame};
+    use tokio::signal::unix::{signal, SignalKind};
+    use tokio::sync::mpsc;
+
+    let tty = tty.unwrap_or_else(|| unsafe { libc::isatty(0) == 1 && libc::isatty(1) == 1 });
+    let (rows, cols) = if tty { terminal_size() } else { (0, 0) };
+    let command = match command.is_empty() {
+        true => vec![DEFAULT_COMMAND.to_string()],
+        false => command,
+    };
+    let request = ExecRequest {
+        command,
+        tty,
+        rows,
+        cols,
+    };
+    let stream = client.exec(instance, &request).await?;
+    let _raw = if tty { Some(RawMode::enable()?) } else { None };
+
+    let (mut reader, mut writer) = tokio::io::split(stream);
+    let (output_tx, mut output) = mpsc::channel(16);
+    tokio::spawn(async move {
+        loop {
+            let frame = Frame::read(&mut reader).await;
+            let done = !matches!(frame, Ok(Some(_)));
+            if output_tx.send(frame).await.is_err() || done {
+                break;
+            }
+        }
+    });
+    // Reading stdin blocks, so it gets a thread; it's left behind at exit
+    let (input_tx, mut input) = mpsc::channel(16);
+    std::thread::spawn(move || {
+        let mut stdin = std::io::stdin();
+        let mut buf = [0u8; 4096];
+        loop {
+            let frame = match stdin.read(&mut buf) {
+                Ok(0) | Err(_) => Frame::Eof,
+                Ok(n) => Frame::Stdin(buf[..n].to_vec()),
+            };
+            let done = frame == Frame::Eof;
+            if input_tx.blocking_send(frame).is_err() || done {
+                break;
+            }
+        }
+    });
+
+    let mut resized = signal(SignalKind::window_change())?;
+    let mut input_open = true;
+    loop {
+        tokio::select! {
+            frame = output.recv() => match frame.transpose()?.flatten() {
+                Some(Frame::Stdout(data)) => {
+                    let mut stdout = std::io::stdout();
+                    stdout.write_all(&data)?;
+                    stdout.flush()?;
+                }
+                Some(Frame::Stderr(data)) => std::io::stderr().write_all(&data)?,
+                Some(Frame::Exit(code)) => return Ok(code),
+                Some(_) => {}
+                None => anyhow::bail!("The server closed the connection"),
+            },
+            frame = input.recv(), if input_open => match frame {
+                Some(frame) => frame.write(&mut writer).await?,
+                None => input_open = false,
+            },
+            _ = resized.recv(), if tty => {
+                let (rows, cols) = terminal_size();
+                Frame::Resize { rows, cols }.write(&mut writer).await?;
+            }
+        }
+    }
+}
+
+/// Print `instance`'s output as it writes it, until it stops (returning 0) or
+/// `ten` is interrupted
+#[cfg(unix)]
+pub async fn attach(client: &ApiClient, instance: &str) -> Result<i32> {
+    use std::io::Write;
+    use tenement::exec::Frame;
+
+    let mut stream = client.attach(instance).await?;
+    eprintln!("Attached to {}; Ctrl-C to detach", instance);
+    loop {
+        match Frame::read(&mut stream).await? {
+            Some(Frame::Stdout(data)) => {
+                let mut stdout = std::io::stdout();
+                stdout.write_all(&data)?;
+                stdout.flush()?;
+            }
+            Some(Frame::Stderr(data)) => std::io::stderr().write_all(&data)?,
+            Some(Frame::Exit(code)) => {
+                eprintln!("{} stopped", instance);
+                return Ok(code);
+            }
+            Some(_) => {}
+            None => anyhow::bail!("The server closed the connection"),
+        }
+    }
+}
+
+#[cfg(not(unix))]
+pub async fn exec(_: &ApiClient, _: &str, _: Vec<String>, _: Option<bool>) -> Result<i32> {
+    anyhow::bail!("`ten exec` needs a Unix host")
+}
+
+#[cfg(not(unix))]
+pub async fn attach(_: &ApiClient, _: &str) -> Result<i32> {
+    anyhow::bail!("`ten attach` needs a Unix host")
+}
+
+/// Rows and columns of the terminal on stdout (24x80 if it can't tell)
+#[cfg(unix)]
+fn terminal_size() -> (u16, u16) {
+    // SAFETY: TIOCGWINSZ fills in a winsize
+    let mut size: libc::winsize = unsafe { std::mem::zeroed() };
+    let ok = unsafe { libc::ioctl(1, libc::TIOCGWINSZ as _, &mut size) } == 0;
+    if !ok || size.ws_row == 0 || size.ws_col == 0 {
+        return (24, 80);
+    }
+    (size.ws_row, size.ws_col)
+}
+
+/// The terminal on stdin in raw mode, restored when dropped
+#[cfg(unix)]
+struct RawMode(libc::termios);
+
+#[cfg(unix)]
+impl RawMode {
+    fn enable() -> Result<Self> {
+        // SAFETY: tcgetattr fills in a termios, which cfmakeraw then edits
+        unsafe {
+            let mut termios: libc::termios = std::mem::zeroed();
+            if libc::tcgetattr(0, &mut termios) != 0 {
+                return Err(std::io::Error::last_os_error().into());
+            }
+            let saved = termios;
+            libc::cfmakeraw(&mut termios);
+            if libc::tcsetattr(0, libc::TCSANOW, &termios) != 0 {
+                return Err(std::io::Error::last_os_error().into());
+            }
+            Ok(Self(saved))
+        }
+    }
+}
+
+#[cfg(unix)]
+impl Drop for RawMode {
+    fn drop(&mut self) {
+        // SAFETY: puts back the settings read in `enable`
+        unsafe {
+            libc::tcsetattr(0, libc::TCSANOW, &self.0);
+        }
+    }
+}
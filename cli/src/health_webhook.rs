@@ -0,0 +1,273 @@
+//! Health transition webhooks
+//!
+//! Subscribes to the hypervisor's health events and POSTs each state change to
+//! `[settings.health_webhook] url`. Every delivery runs in its own task with a
+//! per-attempt timeout, so a slow or unreachable endpoint never holds up health
+//! checks or later notifications. Deliveries can arrive out of order; receivers
+//! should go by `timestamp`.
+
+use serde::Serialize;
+use std::sync::Arc;
+use std::time::Duration;
+use tenement::config::HealthWebhookConfig;
+use tenement::instance::{HealthStatus, HealthTransition};
+use tenement::Hypervisor;
+use tokio::sync::broadcast::error::RecvError;
+
+/// JSON body POSTed for each transition
+#[derive(Debug, Clone, Serialize)]
+pub struct HealthWebhookPayload {
+    /// Service name
+    pub app: String,
+    /// Active config environment, if any
+    pub env: Option<String>,
+    /// Instance ID ("process:id")
+    pub backend: String,
+    pub old_state: HealthStatus,
+    pub new_state: HealthStatus,
+    /// RFC 3339 time the health check saw the change
+    pub timestamp: String,
+}
+
+impl HealthWebhookPayload {
+    pub fn new(transition: &HealthTransition, env: Option<&str>) -> Self {
+        Self {
+            app: transition.instance.process.clone(),
+            env: env.map(str::to_string),
+            backend: transition.instance.to_string(),
+            old_state: transition.old,
+            new_state: transition.new,
+            timestamp: transition.at.to_rfc3339(),
+        }
+    }
+}
+
+/// Forward health transitions to the configured webhook, if there is one
+pub fn spawn_health_webhook(hypervisor: &Hypervisor) -> Option<tokio::task::JoinHandle<()>> {
+    let config = Arc::new(hypervisor.health_webhook()?.clone());
+    let env = hypervisor.environment().map(str::to_string);
+    let mut events = hypervisor.subscribe_health();
+    let client = reqwest::Client::new();
+
+    tracing::info!("Sending health transitions to {}", config.url);
+    Some(tokio::spawn(async move {
+        loop {
+            match events.recv().await {
+                Ok(transition) => {
+                    let payload = HealthWebhookPayload::new(&transition, env.as_deref());
+                    let (client, config) = (client.clone(), config.clone());
+                    tokio::spawn(async move { deliver(&client, &config, &payload).await });
+                }
+                Err(RecvError::Lagged(skipped)) => {
+                    tracing::warn!("Health webhook fell behind; dropped {} transition(s)", skipped)
+                }
+                Err(RecvError::Closed) => break,
+            }
+        }
+    }))
+}
+
+/// POST `payload`, retrying failures with doubling backoff. Returns whether it got a 2xx.
+pub async fn deliver(
+    client: &reqwest::Client,
+    config: &HealthWebhookConfig,
+    payload: &HealthWebhookPayload,
+) -> bool {
+    let attempts = config.max_retries + 1;
+    let mut backoff = Duration::from_millis(config.retry_backoff_ms);
+    for attempt in 1..=attempts {
+        if attempt > 1 {
+            tokio::time::sleep(backoff).await;
+            backoff = backoff.saturating_mul(2);
+        }
+        let result = client
+            .post(&config.url)
+            .timeout(Duration::from_millis(config.timeout_ms))
+            .json(payload)
+            .send()
+            .await;
+        match result {
+            Ok(resp) if resp.status().is_success() => return true,
+            Ok(resp) => tracing::warn!(
+                "Health webhook returned {} (attempt {}/{})",
+                resp.status(),
+                attempt,
+                attempts
+            ),
+            Err(e) => tracing::warn!(
+                "Health webhook failed: {} (attempt {}/{})",
+                e,
+                attempt,
+                attempts
+            ),
+        }
+    }
+    tracing::error!(
+        "Gave up on health webhook for {} ({} -> {})",
+        payload.backend,
+        payload.old_state,
+        payload.new_state
+    );
+    false
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::{extract::State, http::StatusCode, routing::post, Json, Router};
+    use std::sync::atomic::{AtomicU32, Ordering};
+    use std::time::Instant;
+    use tenement::Config;
+    use tokio::sync::mpsc;
+
+    #[derive(Clone)]
+    struct Stub {
+        received: mpsc::UnboundedSender<serde_json::Value>,
+        /// Requests still to answer with a 500
+        failures_left: Arc<AtomicU32>,
+        delay: Duration,
+    }
+
+    async fn stub_handler(
+        State(stub): State<Stub>,
+        Json(body): Json<serde_json::Value>,
+    ) -> StatusCode {
+        stub.received.send(body).ok();
+        tokio::time::sleep(stub.delay).await;
+        let failing = stub
+            .failures_left
+            .fetch_update(Ordering::SeqCst, Ordering::SeqCst, |n| n.checked_sub(1))
+            .is_ok();
+        if failing {
+            StatusCode::INTERNAL_SERVER_ERROR
+        } else {
+            StatusCode::NO_CONTENT
+        }
+    }
+
+    /// Webhook receiver that records every body it's sent
+    async fn spawn_stub(
+        failures: u32,
+        delay: Duration,
+    ) -> (String, mpsc::UnboundedReceiver<serde_json::Value>) {
+        let (tx, rx) = mpsc::unbounded_channel();
+        let stub = Stub {
+            received: tx,
+            failures_left: Arc::new(AtomicU32::new(failures)),
+            delay,
+        };
+        let app = Router::new()
+            .route("/hook", post(stub_handler))
+            .with_state(stub);
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move { axum::serve(listener, app).await.unwrap() });
+        (format!("http://{}/hook", addr), rx)
+    }
+
+    fn webhook(url: &str, timeout_ms: u64, max_retries: u32) -> HealthWebhookConfig {
+        HealthWebhookConfig {
+            url: url.to_string(),
+            timeout_ms,
+            max_retries,
+            retry_backoff_ms: 10,
+        }
+    }
+
+    fn payload() -> HealthWebhookPayload {
+        HealthWebhookPayload {
+            app: "api".to_string(),
+            env: None,
+            backend: "api:prod".to_string(),
+            old_state: HealthStatus::Healthy,
+            new_state: HealthStatus::Degraded,
+            timestamp: "2026-01-01T00:00:00+00:00".to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_posts_payload_on_health_transition() {
+        let (url, mut received) = spawn_stub(0, Duration::ZERO).await;
+        let data_dir = tempfile::tempdir().unwrap();
+        let content = format!(
+            r#"
+[settings]
+data_dir = "{}"
+
+[settings.health_webhook]
+url = "{}"
+
+[service.api]
+command = "sleep"
+args = ["30"]
+isolation = "process"
+health = "/health"
+restart = "never"
+"#,
+            data_dir.path().display(),
+            url
+        );
+        let config = Config::from_str_for_env(&content, Some("prod")).unwrap();
+        let hypervisor = Hypervisor::new(config);
+        spawn_health_webhook(&hypervisor).expect("webhook configured");
+
+        // `sleep` never answers /health, so the first check changes the state
+        hypervisor.spawn("api", "test").await.unwrap();
+        let status = hypervisor.check_health("api", "test").await;
+
+        let body = tokio::time::timeout(Duration::from_secs(5), received.recv())
+            .await
+            .expect("webhook called")
+            .unwrap();
+        assert_eq!(body["app"], "api");
+        assert_eq!(body["env"], "prod");
+        assert_eq!(body["backend"], "api:test");
+        assert_eq!(body["old_state"], "unknown");
+        assert_eq!(body["new_state"], status.to_string());
+        assert!(body["timestamp"].as_str().unwrap().contains('T'));
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_no_webhook_without_config() {
+        let hypervisor = Hypervisor::new(Config::default());
+        assert!(spawn_health_webhook(&hypervisor).is_none());
+    }
+
+    #[tokio::test]
+    async fn test_retries_until_delivered() {
+        let (url, mut received) = spawn_stub(2, Duration::ZERO).await;
+        let client = reqwest::Client::new();
+
+        assert!(deliver(&client, &webhook(&url, 1000, 3), &payload()).await);
+        for _ in 0..3 {
+            let body = received.recv().await.unwrap();
+            assert_eq!(body["backend"], "api:prod");
+            assert_eq!(body["new_state"], "degraded");
+        }
+        assert!(received.try_recv().is_err(), "no attempts after the first success");
+    }
+
+    #[tokio::test]
+    async fn test_gives_up_after_max_retries() {
+        let (url, mut received) = spawn_stub(u32::MAX, Duration::ZERO).await;
+        let client = reqwest::Client::new();
+
+        assert!(!deliver(&client, &webhook(&url, 1000, 2), &payload()).await);
+        for _ in 0..3 {
+            received.recv().await.unwrap();
+        }
+        assert!(received.try_recv().is_err());
+    }
+
+    #[tokio::test]
+    async fn test_slow_webhook_times_out() {
+        let (url, _received) = spawn_stub(0, Duration::from_secs(10)).await;
+        let client = reqwest::Client::new();
+
+        let started = Instant::now();
+        assert!(!deliver(&client, &webhook(&url, 50, 1), &payload()).await);
+        assert!(started.elapsed() < Duration::from_secs(2));
+    }
+}
@@ -1,6 +1,8 @@
 //! systemd installation for tenement
 //!
 //! Generates and installs a systemd unit file to run tenement as a service.
+//! The unit is `Type=notify` with a watchdog; with socket activation a
+//! `tenement.socket` unit holds the listening port instead of tenement.
 //! Optionally installs and configures Caddy as a reverse proxy with TLS.
 
 use anyhow::{Context, Result};
@@ -11,14 +13,24 @@ use crate::caddy;
 
 /// Paths for systemd installation
 const SYSTEMD_UNIT_PATH: &str = "/etc/systemd/system/tenement.service";
+const SYSTEMD_SOCKET_PATH: &str = "/etc/systemd/system/tenement.socket";
 const BINARY_INSTALL_PATH: &str = "/usr/local/bin/ten";
 const CONFIG_DIR: &str = "/etc/tenement";
 const DATA_DIR: &str = "/var/lib/tenement";
 
 /// Generate the systemd unit file content
-pub fn generate_unit(domain: &str, port: u16, config_path: &Path) -> String {
+pub fn generate_unit(
+    domain: &str,
+    port: u16,
+    config_path: &Path,
+    socket_activation: bool,
+) -> String {
     let binary_path = BINARY_INSTALL_PATH;
     let config_path_str = config_path.display();
+    let socket_deps = match socket_activation {
+        true => "Requires=tenement.socket\nAfter=tenement.socket\n",
+        false => "",
+    };
 
     format!(
         r#"# Tenement Process Supervisor
@@ -29,10 +41,13 @@ pub fn generate_unit(domain: &str, port: u16, config_path: &Path) -> String {
 Description=Tenement Process Supervisor
 Documentation=https://github.com/anthropics/tenement
 After=network.target
-
+{socket_deps}
 [Service]
-Type=simple
+Type=notify
+NotifyAccess=main
+WatchdogSec=30
 ExecStart={binary_path} serve --port {port} --domain {domain}
+ExecReload=/bin/kill -HUP $MAINPID
 WorkingDirectory={DATA_DIR}
 Restart=always
 RestartSec=5
@@ -54,6 +69,27 @@ WantedBy=multi-user.target
     )
 }
 
+/// Generate `tenement.socket`, which holds `port` and hands it to tenement
+pub fn generate_socket_unit(port: u16) -> String {
+    format!(
+        r#"# Tenement listening socket
+# Generated by: ten install --socket-activation
+# systemd holds the port, so tenement restarts without refusing connections
+
+[Unit]
+Description=Tenement listening socket
+
+[Socket]
+ListenStream={port}
+FileDescriptorName=http
+NoDelay=true
+
+[Install]
+WantedBy=sockets.target
+"#
+    )
+}
+
 /// Install tenement as a systemd service
 /// Optionally installs Caddy as a reverse proxy with automatic TLS
 pub fn install(
@@ -63,6 +99,7 @@ pub fn install(
     dry_run: bool,
     with_caddy: bool,
     dns_provider: Option<String>,
+    socket_activation: bool,
 ) -> Result<()> {
     // Find or use specified config file
     let config_path = match config {
@@ -91,7 +128,8 @@ pub fn install(
 
     // Generate unit file content
     let dest_config = PathBuf::from(CONFIG_DIR).join("tenement.toml");
-    let unit_content = generate_unit(&domain, port, &dest_config);
+    let unit_content = generate_unit(&domain, port, &dest_config, socket_activation);
+    let socket_content = generate_socket_unit(port);
 
     if dry_run {
         println!("=== Dry run - would perform these actions ===\n");
@@ -100,6 +138,9 @@ pub fn install(
         println!("3. Copy config to {}", dest_config.display());
         println!("4. Create directory {}", DATA_DIR);
         println!("5. Create systemd unit at {}", SYSTEMD_UNIT_PATH);
+        if socket_activation {
+            println!("   and socket unit at {}", SYSTEMD_SOCKET_PATH);
+        }
         if with_caddy {
             println!("6. Install Caddy (if not present)");
             println!("7. Generate Caddyfile at /etc/caddy/Caddyfile");
@@ -113,6 +154,10 @@ pub fn install(
         }
         println!("\n=== Generated systemd unit ===\n");
         println!("{}", unit_content);
+        if socket_activation {
+            println!("=== Generated socket unit ===\n");
+            println!("{}", socket_content);
+        }
         if with_caddy {
             println!("\n=== Would generate Caddyfile (see `ten caddy` for preview) ===\n");
         }
@@ -159,11 +204,21 @@ pub fn install(
     // Step 4: Write systemd unit
     println!("  Creating systemd unit at {}...", SYSTEMD_UNIT_PATH);
     std::fs::write(SYSTEMD_UNIT_PATH, &unit_content).context("Failed to write systemd unit")?;
+    if socket_activation {
+        println!("  Creating socket unit at {}...", SYSTEMD_SOCKET_PATH);
+        std::fs::write(SYSTEMD_SOCKET_PATH, &socket_content)
+            .context("Failed to write systemd socket unit")?;
+    }
 
     // Step 5: Reload systemd and enable service
     println!("  Reloading systemd daemon...");
     run_command("systemctl", &["daemon-reload"])?;
 
+    if socket_activation {
+        println!("  Enabling tenement socket...");
+        run_command("systemctl", &["enable", "--now", "tenement.socket"])?;
+    }
+
     println!("  Enabling tenement service...");
     run_command("systemctl", &["enable", "tenement"])?;
 
@@ -248,6 +303,11 @@ pub fn uninstall() -> Result<()> {
         println!("  Removing systemd unit...");
         std::fs::remove_file(SYSTEMD_UNIT_PATH)?;
     }
+    if Path::new(SYSTEMD_SOCKET_PATH).exists() {
+        println!("  Removing socket unit...");
+        let _ = run_command("systemctl", &["disable", "--now", "tenement.socket"]);
+        std::fs::remove_file(SYSTEMD_SOCKET_PATH)?;
+    }
 
     // Reload systemd
     println!("  Reloading systemd daemon...");
@@ -296,7 +356,7 @@ mod tests {
     #[test]
     fn test_generate_unit_basic() {
         let config_path = PathBuf::from("/etc/tenement/tenement.toml");
-        let unit = generate_unit("example.com", 8080, &config_path);
+        let unit = generate_unit("example.com", 8080, &config_path, false);
 
         assert!(unit.contains("[Unit]"));
         assert!(unit.contains("[Service]"));
@@ -312,7 +372,7 @@ mod tests {
     #[test]
     fn test_generate_unit_custom_port() {
         let config_path = PathBuf::from("/etc/tenement/tenement.toml");
-        let unit = generate_unit("myapp.io", 3000, &config_path);
+        let unit = generate_unit("myapp.io", 3000, &config_path, false);
 
         assert!(unit.contains("--port 3000"));
         assert!(unit.contains("--domain myapp.io"));
@@ -321,7 +381,7 @@ mod tests {
     #[test]
     fn test_generate_unit_security_settings() {
         let config_path = PathBuf::from("/etc/tenement/tenement.toml");
-        let unit = generate_unit("example.com", 8080, &config_path);
+        let unit = generate_unit("example.com", 8080, &config_path, false);
 
         // Security hardening options
         assert!(unit.contains("NoNewPrivileges=true"));
@@ -333,7 +393,7 @@ mod tests {
     #[test]
     fn test_generate_unit_restart_settings() {
         let config_path = PathBuf::from("/etc/tenement/tenement.toml");
-        let unit = generate_unit("example.com", 8080, &config_path);
+        let unit = generate_unit("example.com", 8080, &config_path, false);
 
         assert!(unit.contains("Restart=always"));
         assert!(unit.contains("RestartSec=5"));
@@ -342,7 +402,7 @@ mod tests {
     #[test]
     fn test_generate_unit_working_directory() {
         let config_path = PathBuf::from("/etc/tenement/tenement.toml");
-        let unit = generate_unit("example.com", 8080, &config_path);
+        let unit = generate_unit("example.com", 8080, &config_path, false);
 
         assert!(unit.contains("WorkingDirectory=/var/lib/tenement"));
     }
@@ -350,11 +410,35 @@ mod tests {
     #[test]
     fn test_generate_unit_network_dependency() {
         let config_path = PathBuf::from("/etc/tenement/tenement.toml");
-        let unit = generate_unit("example.com", 8080, &config_path);
+        let unit = generate_unit("example.com", 8080, &config_path, false);
 
         assert!(unit.contains("After=network.target"));
     }
 
+    #[test]
+    fn test_generate_unit_notify_and_watchdog() {
+        let config_path = PathBuf::from("/etc/tenement/tenement.toml");
+        let unit = generate_unit("example.com", 8080, &config_path, false);
+
+        assert!(unit.contains("Type=notify"));
+        assert!(unit.contains("WatchdogSec=30"));
+        assert!(unit.contains("ExecReload=/bin/kill -HUP $MAINPID"));
+        assert!(!unit.contains("tenement.socket"));
+    }
+
+    #[test]
+    fn test_generate_socket_activation_units() {
+        let config_path = PathBuf::from("/etc/tenement/tenement.toml");
+        let unit = generate_unit("example.com", 80, &config_path, true);
+        assert!(unit.contains("Requires=tenement.socket\nAfter=tenement.socket\n"));
+
+        let socket = generate_socket_unit(80);
+        assert!(socket.contains("[Socket]"));
+        assert!(socket.contains("ListenStream=80"));
+        assert!(socket.contains("FileDescriptorName=http"));
+        assert!(socket.contains("WantedBy=sockets.target"));
+    }
+
     #[test]
     fn test_install_missing_config() {
         let result = install(
@@ -364,6 +448,7 @@ mod tests {
             true,  // dry_run
             false, // with_caddy
             None,  // dns_provider
+            false, // socket_activation
         );
         assert!(result.is_err());
         assert!(result.unwrap_err().to_string().contains("not found"));
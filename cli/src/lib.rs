@@ -1,8 +1,25 @@
 //! tenement CLI library
 //!
-//! Exposes server, dashboard, API routes, and client modules.
+//! Exposes server, dashboard, API routes, client, static file, systemd, upgrade, and log viewer
+//! modules.
 
+pub mod acme_dns;
 pub mod api_routes;
 pub mod client;
+pub mod cluster;
 pub mod dashboard;
+pub mod discovery;
+pub mod dns_providers;
+pub mod health_webhook;
+pub mod logs;
+pub mod middleware;
+#[cfg(windows)]
+pub mod pipes;
+pub mod previews;
 pub mod server;
+pub mod static_files;
+pub mod systemd;
+pub mod tls_tickets;
+pub mod upgrade;
+pub mod upstream_pool;
+pub mod webhooks;
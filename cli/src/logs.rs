@@ -0,0 +1,259 @@
+//! `ten logs`: tail and follow instance output from the server's log buffer
+//!
+//! Each target is a service (`api`) or one instance (`api:prod`); with none,
+//! everything is shown. Targets are merged into one timeline, each line
+//! prefixed with `process:instance` (colored per instance on a terminal).
+
+use anyhow::Result;
+use std::cell::RefCell;
+use std::io::IsTerminal;
+use std::str::FromStr;
+
+use crate::client::{ApiClient, LogFilter, LogLine};
+
+/// ANSI colors for line prefixes. Red is left out so it doesn't read as an error.
+const PALETTE: [u8; 10] = [36, 33, 32, 35, 34, 96, 93, 92, 95, 94];
+
+/// A service, or one of its instances
+#[derive(Debug, Clone, PartialEq)]
+pub struct LogTarget {
+    pub process: String,
+    pub id: Option<String>,
+}
+
+impl FromStr for LogTarget {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        let (process, id) = match s.split_once(':') {
+            Some((process, id)) => (process, Some(id)),
+            None => (s, None),
+        };
+        if process.is_empty() || id.is_some_and(str::is_empty) {
+            anyhow::bail!(
+                "Invalid log target '{}'. Use a service (api) or an instance (api:prod)",
+                s
+            );
+        }
+        Ok(Self {
+            process: process.to_string(),
+            id: id.map(str::to_string),
+        })
+    }
+}
+
+/// What to show
+pub struct LogsOptions {
+    pub level: Option<String>,
+    pub search: Option<String>,
+    /// Most recent entries to print before following
+    pub tail: usize,
+    /// Unix timestamp (ms) to start from
+    pub since: Option<u64>,
+    pub follow: bool,
+    pub color: bool,
+}
+
+/// Print the last `tail` entries for the targets, then (with `follow`) new ones
+/// until the server ends the stream.
+pub async fn show(client: &ApiClient, targets: &[LogTarget], opts: &LogsOptions) -> Result<()> {
+    let base = LogFilter {
+        level: opts.level.clone(),
+        search: opts.search.clone(),
+        since: opts.since,
+        ..Default::default()
+    };
+    let filters: Vec<LogFilter> = if targets.is_empty() {
+        vec![base]
+    } else {
+        targets
+            .iter()
+            .map(|target| LogFilter {
+                process: Some(target.process.clone()),
+                id: target.id.clone(),
+                ..base.clone()
+            })
+            .collect()
+    };
+
+    // The newest `tail` entries across all targets, oldest first
+    let mut history: Vec<LogLine> = Vec::new();
+    for filter in &filters {
+        let filter = LogFilter {
+            limit: Some(opts.tail),
+            ..filter.clone()
+        };
+        history.extend(client.query_logs(&filter).await?);
+    }
+    history.sort_by_key(|line| line.timestamp);
+    history.dedup();
+    let history = history.split_off(history.len().saturating_sub(opts.tail));
+
+    let printer = LogPrinter { color: opts.color };
+    for line in &history {
+        println!("{}", printer.format(line));
+    }
+    if !opts.follow {
+        return Ok(());
+    }
+
+    // Follow on from the last entry shown, so nothing written between the query
+    // and the stream is missed; the stream replays from there and entries
+    // already printed are skipped
+    let since = history
+        .last()
+        .map(|line| line.timestamp)
+        .or(opts.since)
+        .unwrap_or_else(now_ms);
+    let shown = RefCell::new(
+        history
+            .into_iter()
+            .filter(|line| line.timestamp == since)
+            .collect::<Vec<_>>(),
+    );
+    let streams: Vec<LogFilter> = filters
+        .into_iter()
+        .map(|filter| LogFilter {
+            since: Some(since),
+            ..filter
+        })
+        .collect();
+    let follows = streams.iter().map(|filter| {
+        client.stream_logs(filter, |line| {
+            let mut shown = shown.borrow_mut();
+            if let Some(index) = shown.iter().position(|seen| *seen == line) {
+                shown.swap_remove(index);
+                return;
+            }
+            println!("{}", printer.format(&line));
+        })
+    });
+    futures::future::try_join_all(follows).await?;
+    Ok(())
+}
+
+/// Formats entries as `HH:MM:SS [OUT] process:instance message`
+pub struct LogPrinter {
+    pub color: bool,
+}
+
+impl LogPrinter {
+    pub fn format(&self, line: &LogLine) -> String {
+        // Format timestamp as HH:MM:SS
+        let secs = line.timestamp / 1000;
+        let hours = (secs % 86400) / 3600;
+        let mins = (secs % 3600) / 60;
+        let s = secs % 60;
+
+        let level_marker = if line.level == "stderr" { "ERR" } else { "OUT" };
+        let source = format!("{}:{}", line.process, line.instance_id);
+        let source = if self.color {
+            format!("\x1b[{}m{}\x1b[0m", color_code(&source), source)
+        } else {
+            source
+        };
+        format!(
+            "{:02}:{:02}:{:02} [{}] {} {}",
+            hours, mins, s, level_marker, source, line.message
+        )
+    }
+}
+
+/// A stable color for an instance, so its lines keep one color across runs
+fn color_code(source: &str) -> u8 {
+    // FNV-1a
+    let hash = source
+        .bytes()
+        .fold(0xcbf29ce484222325u64, |hash, b| (hash ^ b as u64).wrapping_mul(0x100000001b3));
+    PALETTE[(hash % PALETTE.len() as u64) as usize]
+}
+
+/// Color output unless `--no-color`, NO_COLOR is set, or stdout isn't a terminal
+pub fn use_color(no_color: bool) -> bool {
+    !no_color && std::env::var_os("NO_COLOR").is_none() && std::io::stdout().is_terminal()
+}
+
+/// `--since` as a Unix timestamp in milliseconds: a duration ago ("30s", "10m",
+/// "2h", "1d")
+pub fn parse_since(text: &str) -> Result<u64> {
+    let secs = tenement::config::parse_duration_secs(text)
+        .map_err(|e| anyhow::anyhow!("Invalid --since: {}", e))?;
+    Ok(now_ms().saturating_sub(secs.saturating_mul(1000)))
+}
+
+fn now_ms() -> u64 {
+    std::time::SystemTime::now()
+        .duration_since(std::time::UNIX_EPOCH)
+        .map(|d| d.as_millis() as u64)
+        .unwrap_or(0)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn line(process: &str, instance: &str, level: &str, message: &str) -> LogLine {
+        LogLine {
+            // 01:02:03 UTC
+            timestamp: 3_723_000,
+            level: level.to_string(),
+            process: process.to_string(),
+            instance_id: instance.to_string(),
+            message: message.to_string(),
+        }
+    }
+
+    #[test]
+    fn test_parse_log_target() {
+        let target: LogTarget = "api".parse().unwrap();
+        assert_eq!(target.process, "api");
+        assert_eq!(target.id, None);
+
+        let target: LogTarget = "api:prod".parse().unwrap();
+        assert_eq!(target.id.as_deref(), Some("prod"));
+
+        assert!("".parse::<LogTarget>().is_err());
+        assert!(":prod".parse::<LogTarget>().is_err());
+        assert!("api:".parse::<LogTarget>().is_err());
+    }
+
+    #[test]
+    fn test_format_plain() {
+        let printer = LogPrinter { color: false };
+        assert_eq!(
+            printer.format(&line("api", "prod", "stdout", "hello")),
+            "01:02:03 [OUT] api:prod hello"
+        );
+        assert_eq!(
+            printer.format(&line("api", "prod", "stderr", "oops")),
+            "01:02:03 [ERR] api:prod oops"
+        );
+    }
+
+    #[test]
+    fn test_format_colors_prefix_per_instance() {
+        let printer = LogPrinter { color: true };
+        let formatted = printer.format(&line("api", "prod", "stdout", "hello"));
+        let code = color_code("api:prod");
+        assert_eq!(formatted, format!("01:02:03 [OUT] \x1b[{}mapi:prod\x1b[0m hello", code));
+
+        // Same instance, same color; the palette spreads instances apart
+        assert_eq!(color_code("api:prod"), code);
+        let codes: std::collections::HashSet<u8> =
+            ["api:prod", "api:canary", "web:prod", "worker:1", "worker:2", "db:main"]
+                .iter()
+                .map(|source| color_code(source))
+                .collect();
+        assert!(codes.len() > 1);
+        assert!(codes.iter().all(|code| PALETTE.contains(code)));
+    }
+
+    #[test]
+    fn test_parse_since() {
+        let before = now_ms();
+        let since = parse_since("10m").unwrap();
+        assert!(since <= before.saturating_sub(600_000) + 1000);
+        assert!(since >= before.saturating_sub(600_000));
+        assert!(parse_since("yesterday").is_err());
+    }
+}
@@ -1,26 +1,30 @@
-use anyhow::Result;
-use clap::{Parser, Subcommand};
+use anyhow::{Context, Result};
+use clap::{Parser, Subcommand, ValueEnum};
 use std::path::PathBuf;
-use tenement::{init_db, Config, ConfigStore, Hypervisor, TokenStore};
+use tenement::events::EventKind;
+use tenement::secret_store::SecretStore;
+use tenement::{init_db, Config, ConfigStore, Hypervisor, Scope, TokenStore};
 
+use tenement_cli::api_routes::{
+    DeployRequest, GitDeployRequest, PreviewRequest, ReloadResponse, RollbackRequest,
+    StackDeployRequest, WebhookRequest,
+};
 use tenement_cli::client::{self, ApiClient};
+use tenement_cli::logs::{self, LogTarget, LogsOptions};
 use tenement_cli::server;
 
 mod caddy;
+mod exec;
 mod install;
+mod top;
 
 #[derive(Parser)]
 #[command(name = "tenement")]
 #[command(author, version, about = "Hyperlightweight process hypervisor")]
 struct Cli {
-    /// Server URL for CLI commands (default: http://localhost:8080)
-    #[arg(
-        long,
-        default_value = "http://localhost:8080",
-        global = true,
-        env = "TENEMENT_SERVER"
-    )]
-    server: String,
+    /// Server URL for CLI commands (default: the local admin socket, else http://localhost:8080)
+    #[arg(long, global = true, env = "TENEMENT_SERVER")]
+    server: Option<String>,
 
     /// API token (overrides TENEMENT_TOKEN env var and token file)
     #[arg(long, global = true)]
@@ -30,10 +34,22 @@ struct Cli {
     #[arg(long, global = true, env = "TENEMENT_DATA_DIR")]
     data_dir: Option<PathBuf>,
 
+    /// Log output format: "text" (default) or "json" (one object per line)
+    #[arg(long, global = true, env = "TENEMENT_LOG_FORMAT", value_enum, default_value_t)]
+    log_format: LogFormat,
+
     #[command(subcommand)]
     command: Commands,
 }
 
+/// How supervisor and app log lines are formatted
+#[derive(Clone, Copy, Default, ValueEnum)]
+enum LogFormat {
+    #[default]
+    Text,
+    Json,
+}
+
 #[derive(Subcommand)]
 enum Commands {
     /// Start the HTTP server with dashboard and reverse proxy
@@ -64,19 +80,94 @@ enum Commands {
         /// Instance identifier (process:id)
         instance: String,
     },
-    /// Restart an instance (e.g., ten restart api:prod)
+    /// Stop a service for maintenance: take it out of rotation, let in-flight
+    /// requests finish, then stop its instances (e.g., ten drain api)
+    Drain {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Seconds to wait before force-killing what's left (default 30)
+        #[arg(long, default_value = "30")]
+        timeout: u64,
+    },
+    /// Restart an instance (e.g., ten restart api:prod), or a stack's
+    /// instances one at a time (e.g., ten restart --stack acme-prod)
     Restart {
+        /// Instance identifier (process:id)
+        #[arg(required_unless_present = "stack")]
+        instance: Option<String>,
+        /// Restart every running instance of this stack, in rollout order,
+        /// stopping at the first that fails
+        #[arg(long, conflicts_with = "instance")]
+        stack: Option<String>,
+    },
+    /// Run a one-off command in a service's environment (e.g., ten run api:prod -- ./migrate up)
+    Run {
+        /// Service, or instance identifier (process:id) for `{id}` in its env
+        instance: String,
+        /// Command and arguments, after `--`
+        #[arg(last = true, required = true)]
+        command: Vec<String>,
+    },
+    /// Run a command inside a running instance, with a terminal if this is one
+    /// (e.g., ten exec api:prod, ten exec api:prod -- ls /data)
+    Exec {
+        /// Instance identifier (process:id)
+        instance: String,
+        /// Give the command a terminal even if stdin isn't one
+        #[arg(short = 't', long, conflicts_with = "no_tty")]
+        tty: bool,
+        /// Don't give the command a terminal
+        #[arg(short = 'T', long)]
+        no_tty: bool,
+        /// Command and arguments, after `--` (default: /bin/sh)
+        #[arg(last = true)]
+        command: Vec<String>,
+    },
+    /// Stream an instance's output as it writes it (e.g., ten attach api:prod)
+    Attach {
         /// Instance identifier (process:id)
         instance: String,
     },
     /// List running instances
     #[command(alias = "ls")]
     Ps,
+    /// List stacks with their services and instance health
+    Stacks,
+    /// Live memory, CPU, thread and descriptor use per app and instance
+    Top {
+        /// Only this service's instances
+        #[arg(long)]
+        app: Option<String>,
+        /// Seconds between refreshes
+        #[arg(short = 'n', long, default_value = "2")]
+        interval: u64,
+        /// Print the table once instead of refreshing it
+        #[arg(long)]
+        once: bool,
+    },
+    /// Show everything the server knows about an instance (e.g., ten inspect api:prod)
+    Inspect {
+        /// Instance identifier (process:id)
+        instance: String,
+    },
+    /// Print the environment an app's instances were started with, TENEMENT_*
+    /// metadata included and secrets masked (e.g., ten env api, ten env api:prod).
+    /// An instance that isn't running shows what it would start with.
+    Env {
+        /// Service, or one instance (process:id)
+        app: String,
+    },
     /// Check health of an instance (e.g., ten health api:prod)
     Health {
         /// Instance identifier (process:id)
         instance: String,
     },
+    /// Re-read tenement.toml on the server: start added services, stop removed
+    /// ones, and restart only the ones whose definitions changed
+    Reload,
+    /// Replace the running server with the tenement binary now installed,
+    /// keeping instances running and listeners open (same as SIGUSR2)
+    Upgrade,
     /// Set traffic weight for an instance (0-100)
     Weight {
         /// Instance identifier (process:id)
@@ -86,14 +177,72 @@ enum Commands {
     },
     /// Deploy a new version and wait for it to be healthy
     Deploy {
-        /// Instance identifier (process:version, e.g., api:v2)
+        /// Instance identifier (process:version, e.g., api:v2), or with
+        /// --stack just the version
         instance: String,
+        /// Deploy the version to each of this stack's services in rollout
+        /// order, stopping at the first that fails
+        #[arg(long, conflicts_with_all = ["artifact", "image"])]
+        stack: Option<String>,
         /// Initial traffic weight (0-100, default 100)
         #[arg(long, short, default_value = "100")]
         weight: u8,
         /// Health check timeout in seconds (default 30)
         #[arg(long, default_value = "30")]
         timeout: u64,
+        /// Running version to replace once the new one is healthy, using the
+        /// service's `deploy.strategy` (replace, blue-green or canary)
+        #[arg(long)]
+        replace: Option<String>,
+        /// Seconds to let the replaced version's connections finish (default 30)
+        #[arg(long, default_value = "30")]
+        drain_timeout: u64,
+        /// Build the version runs from, recorded with the release and passed
+        /// to the instance as TENEMENT_ARTIFACT. A URL (s3://, https://,
+        /// file://) is downloaded and unpacked into the version's release dir.
+        #[arg(long)]
+        artifact: Option<String>,
+        /// SHA-256 the downloaded artifact must match (sha256:<hex>; default:
+        /// the contents of <artifact>.sha256)
+        #[arg(long, requires = "artifact")]
+        checksum: Option<String>,
+        /// OCI image the version runs, in place of the service's `image`
+        /// (container services)
+        #[arg(long)]
+        image: Option<String>,
+    },
+    /// List a service's releases: one per deploy, newest first
+    Releases {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Also show each release's env (sensitive values redacted)
+        #[arg(long)]
+        env: bool,
+    },
+    /// Go back to an earlier release without dropping requests
+    Rollback {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Release number to restore (default: the previous release)
+        release: Option<u32>,
+        /// Health check timeout in seconds (default 30)
+        #[arg(long, default_value = "30")]
+        timeout: u64,
+        /// Seconds to let the current version's connections finish (default 30)
+        #[arg(long, default_value = "30")]
+        drain_timeout: u64,
+    },
+    /// Deploy a `git push` (run by the post-receive hook of a service's repository)
+    #[command(hide = true)]
+    GitReceive {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Branch that deploys
+        #[arg(long, default_value = "main")]
+        branch: String,
+        /// Admin socket of the server that owns the repository
+        #[arg(long)]
+        socket: PathBuf,
     },
     /// Atomically swap traffic from one version to another (blue/green)
     Route {
@@ -106,22 +255,104 @@ enum Commands {
         #[arg(long)]
         to: String,
     },
+    /// Serve a service's maintenance page (503) instead of proxying to it,
+    /// without stopping its instances
+    Maintenance {
+        #[command(subcommand)]
+        action: MaintenanceAction,
+    },
+    /// Inject faults (added latency, errors, killed instances) to test how apps
+    /// cope, e.g. ten faults set api --abort-status 503 --abort-percent 10
+    Faults {
+        #[command(subcommand)]
+        action: FaultsAction,
+    },
+    /// Show lifecycle events (started, crashed, deployed, health_changed,
+    /// cert_renewed, scaled), e.g. ten events --follow --app api --type crash
+    Events {
+        /// Only events about this service
+        #[arg(long)]
+        app: Option<String>,
+        /// Only these kinds (crash, deploy, health_changed, ...); repeat for several
+        #[arg(long = "type")]
+        kinds: Vec<EventKind>,
+        /// Number of recent events to show (default 20)
+        #[arg(short = 'n', long, default_value = "20")]
+        tail: usize,
+        /// Keep streaming new events as they happen
+        #[arg(short, long)]
+        follow: bool,
+        /// One JSON object per line, for piping into other tools
+        #[arg(long)]
+        json: bool,
+    },
+    /// Show the audit log of control-plane actions (deploys, restarts, reloads,
+    /// secret and token changes, rejected tokens), e.g. ten audit --since 1d --failed
+    Audit {
+        /// Only actions by this actor (e.g. token:ci, admin, local:alice)
+        #[arg(long)]
+        actor: Option<String>,
+        /// Only this kind of action (deploy, restart, reload, api, auth, ...)
+        #[arg(long)]
+        action: Option<String>,
+        /// Only actions on this service
+        #[arg(long)]
+        app: Option<String>,
+        /// Only actions this recent (e.g. 30m, 1d)
+        #[arg(long, value_parser = tenement::config::parse_duration_secs)]
+        since: Option<u64>,
+        /// Only actions that failed
+        #[arg(long)]
+        failed: bool,
+        /// Number of entries to show (default 50)
+        #[arg(short = 'n', long, default_value = "50")]
+        limit: usize,
+        /// One JSON object per line, for piping into other tools
+        #[arg(long)]
+        json: bool,
+        /// Instead of showing entries, move the ones older than this (e.g. 90d)
+        /// to the archive table in this host's tenement.db
+        #[arg(long, value_parser = tenement::config::parse_duration_secs)]
+        archive: Option<u64>,
+    },
+    /// POST lifecycle events (started, crashed, deployed, health_changed,
+    /// cert_renewed, scaled) to URLs, such as Slack or PagerDuty integrations
+    Webhook {
+        #[command(subcommand)]
+        action: WebhookAction,
+    },
+    /// Show the cluster's nodes as this server sees them: which are up, which
+    /// leads, and how many instances each runs
+    Cluster,
+    /// Ephemeral copies of a service built from a branch or artifact, each at
+    /// its own subdomain and torn down when its TTL passes
+    Preview {
+        #[command(subcommand)]
+        action: PreviewAction,
+    },
     /// Tail logs from running instances
     Logs {
-        /// Instance identifier (process:id), e.g. api:prod. Omit for all instances.
-        instance: Option<String>,
+        /// Services (api) or instances (api:prod) to show, merged into one
+        /// timeline. Omit for everything.
+        targets: Vec<LogTarget>,
         /// Filter by log level (stdout or stderr)
         #[arg(long)]
         level: Option<String>,
         /// Search log messages
         #[arg(long)]
         search: Option<String>,
-        /// Maximum number of entries (default 100)
-        #[arg(long, default_value = "100")]
-        limit: usize,
+        /// Number of recent entries to show (default 100)
+        #[arg(short = 'n', long, visible_alias = "limit", default_value = "100")]
+        tail: usize,
+        /// Only entries newer than this (e.g. 30s, 10m, 2h, 1d)
+        #[arg(long)]
+        since: Option<String>,
         /// Follow logs in real-time (stream new entries)
         #[arg(short, long)]
         follow: bool,
+        /// Don't color the process:instance prefixes
+        #[arg(long)]
+        no_color: bool,
     },
     /// Initialize a new tenement project in the current directory
     Init {
@@ -134,6 +365,25 @@ enum Commands {
     },
     /// Show config
     Config,
+    /// Validate tenement.toml without starting anything, and show what
+    /// reloading it on the running server would change
+    Check {
+        /// Config file (default: tenement.toml in this or a parent directory)
+        #[arg(short, long)]
+        file: Option<PathBuf>,
+        /// Port `serve` listens on (used when TLS is disabled)
+        #[arg(short, long, default_value = "8080")]
+        port: u16,
+        /// Print the result as JSON, for CI
+        #[arg(long)]
+        json: bool,
+    },
+    /// List stale sockets in service socket directories (dry run unless --prune)
+    Sockets {
+        /// Remove dead sockets not owned by any configured service
+        #[arg(long)]
+        prune: bool,
+    },
     /// Generate a new API token (admin or tenant-scoped)
     TokenGen {
         /// Generate a tenant-scoped token (can only access this tenant's instances/logs)
@@ -143,7 +393,38 @@ enum Commands {
         #[arg(long)]
         description: Option<String>,
     },
-    /// Install tenement as a systemd service
+    /// Manage named API tokens scoped to read, deploy or admin access
+    Tokens {
+        #[command(subcommand)]
+        action: TokensAction,
+    },
+    /// Manage secrets in the encrypted store (services list them as `secrets = [...]`)
+    Secrets {
+        #[command(subcommand)]
+        action: SecretsAction,
+    },
+    /// Inspect, snapshot and restore services' persistent volumes
+    /// (`[service.x.volumes]`)
+    Volume {
+        #[command(subcommand)]
+        action: VolumeAction,
+    },
+    /// Back up the state DB, secrets store and volumes (`[settings.backup]`)
+    Backup {
+        #[command(subcommand)]
+        action: BackupAction,
+    },
+    /// Rebuild this host's state DB, secrets store and volumes from a backup.
+    /// Stop the server first.
+    Restore {
+        /// Backup name (from `ten backup ls`), or the path or s3:// URL of one
+        backup: String,
+        /// Restore even though the server is running
+        #[arg(long)]
+        force: bool,
+    },
+    /// Install tenement as a systemd service (Type=notify, with a watchdog)
+    #[command(alias = "install-service")]
     Install {
         /// Domain for the service (e.g., example.com)
         #[arg(short, long)]
@@ -164,6 +445,9 @@ enum Commands {
         /// Required for per-process wildcards like *.api.example.com
         #[arg(long)]
         dns_provider: Option<String>,
+        /// Let a tenement.socket unit hold the port (e.g. 80) and pass it to tenement
+        #[arg(long)]
+        socket_activation: bool,
     },
     /// Uninstall tenement systemd service
     Uninstall,
@@ -191,12 +475,210 @@ enum Commands {
     },
 }
 
+#[derive(Subcommand)]
+enum MaintenanceAction {
+    /// Start serving the maintenance page (e.g., ten maintenance on api)
+    On {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Retry-After seconds sent with the maintenance page (default 300)
+        #[arg(long, default_value = "300")]
+        retry_after: u64,
+    },
+    /// Resume routing requests to the service's instances
+    Off {
+        /// Process name (from tenement.toml)
+        process: String,
+    },
+}
+
+#[derive(Subcommand)]
+enum FaultsAction {
+    /// Show whether faults are being injected, and each service's faults
+    Status,
+    /// Start injecting faults, until the server restarts (or `ten faults off`)
+    On,
+    /// Stop injecting faults
+    Off,
+    /// Replace a service's faults, until the server restarts (or `ten faults clear`)
+    Set {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Milliseconds of latency added before proxying
+        #[arg(long, default_value = "0")]
+        delay_ms: u64,
+        /// Percentage of requests delayed (default: all, when --delay-ms is set)
+        #[arg(long)]
+        delay_percent: Option<f64>,
+        /// Status answered instead of proxying (e.g. 503)
+        #[arg(long)]
+        abort_status: Option<u16>,
+        /// Percentage of requests aborted (default: all, when --abort-status is set)
+        #[arg(long)]
+        abort_percent: Option<f64>,
+        /// Kill one of its instances, picked at random, every this many seconds
+        #[arg(long, default_value = "0")]
+        kill_interval: u64,
+    },
+    /// Put a service's faults back to its [fault] block
+    Clear {
+        /// Process name (from tenement.toml)
+        process: String,
+    },
+}
+
+#[derive(Subcommand)]
+enum WebhookAction {
+    /// Register a URL (e.g., ten webhook add https://example.com/hook --event crashed)
+    Add {
+        url: String,
+        /// Event kinds to send; repeat for several (default: all)
+        #[arg(long = "event")]
+        events: Vec<EventKind>,
+        /// Sign each body with HMAC-SHA256 in X-Tenement-Signature (the key is
+        /// kept in the encrypted secret store)
+        #[arg(long)]
+        secret: Option<String>,
+    },
+    /// Show registered webhooks
+    List,
+    /// Unregister a webhook by ID
+    Remove { id: String },
+}
+
+#[derive(Subcommand)]
+enum PreviewAction {
+    /// Spin up a preview (e.g., ten preview create api --branch feature/login)
+    Create {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Branch or commit of the service's git repository to build
+        #[arg(long, visible_alias = "revision", conflicts_with = "artifact")]
+        branch: Option<String>,
+        /// Artifact URL to run instead (s3://, https://, file://)
+        #[arg(long, required_unless_present = "branch")]
+        artifact: Option<String>,
+        /// SHA-256 the artifact must match (sha256:<hex>)
+        #[arg(long, requires = "artifact")]
+        checksum: Option<String>,
+        /// Subdomain label, e.g. pr-123 (default: from the branch)
+        #[arg(long)]
+        name: Option<String>,
+        /// How long it lives, e.g. 2h or 3d (default: the service's preview.ttl)
+        #[arg(long, value_parser = tenement::config::parse_duration_secs)]
+        ttl: Option<u64>,
+        /// Seconds to wait for it to become healthy
+        #[arg(long, default_value = "30")]
+        timeout: u64,
+    },
+    /// Show live previews
+    List,
+    /// Tear down a preview now
+    Remove {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Preview name, e.g. pr-123
+        name: String,
+    },
+}
+
+#[derive(Subcommand)]
+enum TokensAction {
+    /// Issue a token (e.g., ten tokens create ci --scope deploy)
+    Create {
+        /// Name shown in the audit log as token:<name>
+        name: String,
+        /// read (GET only), deploy (also deploys, rollbacks, restarts) or admin
+        #[arg(long, default_value = "read")]
+        scope: Scope,
+    },
+    /// List token names and scopes
+    #[command(alias = "ls")]
+    List,
+    /// Revoke a token; requests using it fail from then on
+    Revoke {
+        /// Token name
+        name: String,
+    },
+}
+
+#[derive(Subcommand)]
+enum SecretsAction {
+    /// Store a secret (reads the value from stdin if not given)
+    Set {
+        /// Secret name, as the env var apps will see
+        name: String,
+        /// Value. Prefer stdin so it stays out of shell history.
+        value: Option<String>,
+    },
+    /// Print a secret's value
+    Get {
+        /// Secret name
+        name: String,
+    },
+    /// Delete a secret
+    #[command(alias = "remove")]
+    Rm {
+        /// Secret name
+        name: String,
+    },
+    /// List secret names (values are never shown)
+    #[command(alias = "ls")]
+    List,
+}
+
+#[derive(Subcommand)]
+enum VolumeAction {
+    /// List volumes with their sizes, including ones no longer configured
+    #[command(alias = "list")]
+    Ls,
+    /// Snapshot a volume to a .tar.gz (e.g., ten volume backup api uploads)
+    Backup {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Volume name
+        name: String,
+        /// Archive to write, or - for stdout (default: <process>-<name>-<time>.tar.gz)
+        #[arg(short, long)]
+        output: Option<PathBuf>,
+    },
+    /// Replace a volume's contents with a snapshot made by `backup`
+    Restore {
+        /// Process name (from tenement.toml)
+        process: String,
+        /// Volume name
+        name: String,
+        /// Archive to restore, or - for stdin
+        archive: PathBuf,
+        /// Restore even while the service has running instances
+        #[arg(long)]
+        force: bool,
+    },
+}
+
+#[derive(Subcommand)]
+enum BackupAction {
+    /// Take a backup now, then apply the retention policy
+    Create {
+        /// Directory or s3://bucket/prefix (default: [settings.backup] target)
+        #[arg(long)]
+        target: Option<String>,
+    },
+    /// List backups, newest first
+    #[command(alias = "list")]
+    Ls {
+        /// Directory or s3://bucket/prefix (default: [settings.backup] target)
+        #[arg(long)]
+        target: Option<String>,
+    },
+}
+
 #[tokio::main]
 async fn main() -> Result<()> {
-    init_tracing();
-
     let cli = Cli::parse();
 
+    init_tracing(cli.log_format);
+
     match cli.command {
         Commands::Serve {
             port,
@@ -209,7 +691,8 @@ async fn main() -> Result<()> {
         }
         Commands::Spawn { instance } => {
             let (process, id) = parse_instance(&instance)?;
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
             let resp = client.spawn(&process, &id).await?;
             println!("Spawned {}", resp.instance);
             if let Some(port) = resp.port {
@@ -217,25 +700,70 @@ async fn main() -> Result<()> {
             }
         }
         Commands::Stop { instance } => {
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
             client.stop(&instance).await?;
             println!("Stopped {}", instance);
         }
-        Commands::Restart { instance } => {
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
-            let resp = client.restart(&instance).await?;
-            println!("Restarted {}", resp.instance);
+        Commands::Drain { process, timeout } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let resp = client.drain(&process, timeout).await?;
+            for instance in &resp.stopped {
+                println!("Stopped {}", instance);
+            }
+            for instance in &resp.force_killed {
+                println!("Force-killed {} after {}s", instance, timeout);
+            }
+            if resp.cut_connections > 0 {
+                println!("{} connection(s) were cut off", resp.cut_connections);
+            }
+            println!("Drained {}; it takes no requests until started again", resp.process);
+        }
+        Commands::Restart { instance, stack } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            match (stack, instance) {
+                (Some(stack), _) => {
+                    println!("Restarting stack {}", stack);
+                    print_stack_rollout("Restarted", &client.restart_stack(&stack).await?)?;
+                }
+                (None, Some(instance)) => {
+                    let resp = client.restart(&instance).await?;
+                    println!("Restarted {}", resp.instance);
+                }
+                // clap requires one or the other
+                (None, None) => unreachable!(),
+            }
+        }
+        Commands::Run { instance, command } => {
+            let (process, id) = match instance.split_once(':') {
+                Some(_) => parse_instance(&instance)?,
+                None => (instance, tenement::task::DEFAULT_TASK_ID.to_string()),
+            };
+            let config = Config::load_with_override(cli.data_dir)?;
+            let mut child = tenement::task::command(&config, &process, &id, &command)?
+                .spawn()
+                .with_context(|| format!("Failed to run {}", command[0]))?;
+            // The terminal sends Ctrl-C to the command too; wait for it to exit
+            #[cfg(unix)]
+            unsafe {
+                libc::signal(libc::SIGINT, libc::SIG_IGN);
+            }
+            let status = child.wait()?;
+            std::process::exit(tenement::task::exit_code(status));
         }
         Commands::Ps => {
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
             let instances = client.list().await?;
             if instances.is_empty() {
                 println!("No running instances");
-                println!("Server: {}", cli.server);
+                println!("Server: {}", client.endpoint());
             } else {
                 println!(
-                    "{:<20} {:<20} {:<10} {:<10} {:<8} {:<6}",
-                    "INSTANCE", "LISTEN", "UPTIME", "IDLE", "HEALTH", "WEIGHT"
+                    "{:<20} {:<20} {:<14} {:<10} {:<10} {:<8} {:<6} {:<8}",
+                    "INSTANCE", "LISTEN", "STATUS", "UPTIME", "IDLE", "HEALTH", "WEIGHT", "RESTARTS"
                 );
                 for info in &instances {
                     let id = info["id"].as_str().unwrap_or("?");
@@ -244,50 +772,343 @@ async fn main() -> Result<()> {
                     let weight = info["weight"].as_u64().unwrap_or(0);
                     let idle = info["idle_secs"].as_u64().unwrap_or(0);
                     let listen = info["socket"].as_str().unwrap_or("?");
+                    let status = match info["status"].as_str().unwrap_or("?") {
+                        // Up, but held out of rotation by its readiness probe
+                        "running" if info["ready"] == false => "unready",
+                        status => status,
+                    };
+                    let restarts = info["restarts"].as_u64().unwrap_or(0);
 
                     println!(
-                        "{:<20} {:<20} {:<10} {:<10} {:<8} {:<6}",
+                        "{:<20} {:<20} {:<14} {:<10} {:<10} {:<8} {:<6} {:<8}",
                         id,
                         listen,
+                        status,
                         format_uptime(uptime),
                         format_uptime(idle),
                         health,
-                        weight
+                        weight,
+                        restarts
                     );
                 }
                 println!();
-                println!("{} instance(s) running on {}", instances.len(), cli.server);
+                println!("{} instance(s) running on {}", instances.len(), client.endpoint());
+            }
+
+            let jobs = client.jobs().await?;
+            if !jobs.is_empty() {
+                let now = chrono::Utc::now();
+                println!();
+                println!(
+                    "{:<20} {:<20} {:<12} {:<12} {:<10}",
+                    "JOB", "SCHEDULE", "NEXT RUN", "LAST RUN", "STATUS"
+                );
+                for job in &jobs {
+                    let next_run = match job.next_run {
+                        Some(at) => format!("in {}", format_uptime(secs_between(now, at))),
+                        None => "never".to_string(),
+                    };
+                    let last_run = match &job.last_run {
+                        Some(run) => {
+                            format!("{} ago", format_uptime(secs_between(run.started_at, now)))
+                        }
+                        None => "-".to_string(),
+                    };
+                    let status = match (&job.last_run, job.running) {
+                        (_, running) if running > 0 => "running".to_string(),
+                        (Some(run), _) => match run.exit_code {
+                            Some(code) if code != 0 => format!("{} ({})", run.outcome, code),
+                            _ => run.outcome.to_string(),
+                        },
+                        (None, _) => "-".to_string(),
+                    };
+                    println!(
+                        "{:<20} {:<20} {:<12} {:<12} {:<10}",
+                        job.name, job.schedule, next_run, last_run, status
+                    );
+                }
+            }
+        }
+        Commands::Exec {
+            instance,
+            tty,
+            no_tty,
+            command,
+        } => {
+            parse_instance(&instance)?;
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let tty = match (tty, no_tty) {
+                (true, _) => Some(true),
+                (_, true) => Some(false),
+                _ => None,
+            };
+            let code = exec::exec(&client, &instance, command, tty).await?;
+            std::process::exit(code);
+        }
+        Commands::Attach { instance } => {
+            parse_instance(&instance)?;
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let code = exec::attach(&client, &instance).await?;
+            std::process::exit(code);
+        }
+        Commands::Inspect { instance } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let info = client.inspect(&instance).await?;
+            println!("{}", serde_json::to_string_pretty(&info)?);
+        }
+        Commands::Env { app } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let instances: Vec<String> = if app.contains(':') {
+                vec![app.clone()]
+            } else {
+                let prefix = format!("{}:", app);
+                client
+                    .list()
+                    .await?
+                    .iter()
+                    .filter_map(|info| info["id"].as_str())
+                    .filter(|id| id.starts_with(&prefix))
+                    .map(String::from)
+                    .collect()
+            };
+            if instances.is_empty() {
+                anyhow::bail!(
+                    "No running instances of {}; name one (ten env {}:<id>) to see what it \
+                     would start with",
+                    app,
+                    app
+                );
+            }
+            for (i, instance) in instances.iter().enumerate() {
+                if instances.len() > 1 {
+                    if i > 0 {
+                        println!();
+                    }
+                    println!("# {}", instance);
+                }
+                for (key, value) in client.env(instance).await? {
+                    println!("{}={}", key, value);
+                }
             }
         }
         Commands::Health { instance } => {
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
             let resp = client.health(&instance).await?;
             let health = resp["health"].as_str().unwrap_or("unknown");
             println!("{}: {}", instance, health);
         }
+        Commands::Reload => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let resp = client.reload().await?;
+            let sections = [
+                ("Added", &resp.added),
+                ("Removed", &resp.removed),
+                ("Changed", &resp.changed),
+                ("Started", &resp.started),
+                ("Stopped", &resp.stopped),
+                ("Restarted", &resp.restarted),
+            ];
+            let mut any = false;
+            for (label, names) in sections {
+                if !names.is_empty() {
+                    println!("{}: {}", label, names.join(", "));
+                    any = true;
+                }
+            }
+            if !any {
+                println!("No service changes");
+            }
+            if !resp.failed.is_empty() {
+                anyhow::bail!("Failed to bring up: {}", resp.failed.join(", "));
+            }
+        }
+        Commands::Upgrade => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let resp = client.upgrade().await?;
+            println!("Upgraded: the server now runs as pid {}", resp.pid);
+        }
         Commands::Weight { instance, weight } => {
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
             let resp = client.set_weight(&instance, weight).await?;
             println!("Set {} weight to {}", resp.instance, resp.weight);
         }
         Commands::Deploy {
             instance,
+            stack: Some(stack),
+            weight,
+            timeout,
+            replace,
+            drain_timeout,
+            ..
+        } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            println!("Deploying {} to stack {}", instance, stack);
+            let req = StackDeployRequest {
+                version: instance,
+                weight,
+                timeout,
+                replace,
+                drain_timeout,
+            };
+            print_stack_rollout("Deployed", &client.deploy_stack(&stack, &req).await?)?;
+        }
+        Commands::Deploy {
+            instance,
+            stack: None,
             weight,
             timeout,
+            replace,
+            drain_timeout,
+            artifact,
+            checksum,
+            image,
         } => {
             let (process, version) = parse_instance(&instance)?;
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
-            println!("Deploying {}:{} with weight {}", process, version, weight);
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            match &replace {
+                Some(old) => println!("Deploying {}:{} to replace {}", process, version, old),
+                None => println!("Deploying {}:{} with weight {}", process, version, weight),
+            }
             println!("Waiting for health check (timeout: {}s)...", timeout);
 
-            let resp = client.deploy(&process, &version, weight, timeout).await?;
+            let resp = client
+                .deploy(&DeployRequest {
+                    process,
+                    version,
+                    weight,
+                    timeout,
+                    replace,
+                    drain_timeout,
+                    artifact,
+                    checksum,
+                    app_version: None,
+                    image,
+                    git_sha: None,
+                })
+                .await?;
 
             println!("Deployed {}", resp.instance);
             println!("Weight: {}", resp.weight);
             println!("Status: {}", resp.status);
+            if let Some(strategy) = &resp.strategy {
+                println!("Strategy: {}", strategy);
+            }
+            if let Some(release) = resp.release {
+                println!("Release: #{}", release);
+            }
+        }
+        Commands::Releases { process, env } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let releases = client.releases(&process).await?;
+            if releases.is_empty() {
+                println!("No releases of {}", process);
+                return Ok(());
+            }
+            let now = chrono::Utc::now();
+            println!(
+                "  {:<8} {:<16} {:<10} {:<20} {}",
+                "RELEASE", "VERSION", "CREATED", "DESCRIPTION", "ARTIFACT"
+            );
+            for (index, release) in releases.iter().enumerate() {
+                let created = chrono::DateTime::parse_from_rfc3339(&release.created_at)
+                    .map(|at| format!("{} ago", format_uptime(secs_between(at.into(), now))))
+                    .unwrap_or_else(|_| release.created_at.clone());
+                println!(
+                    "{} {:<8} {:<16} {:<10} {:<20} {}",
+                    if index == 0 { "*" } else { " " },
+                    format!("#{}", release.number),
+                    release.version,
+                    created,
+                    release.description,
+                    release
+                        .definition
+                        .artifact
+                        .as_deref()
+                        .or(release.definition.image.as_deref())
+                        .unwrap_or("-")
+                );
+                if env {
+                    for (key, value) in &release.definition.env {
+                        println!("      {}={}", key, value);
+                    }
+                }
+            }
+        }
+        Commands::Rollback {
+            process,
+            release,
+            timeout,
+            drain_timeout,
+        } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            match release {
+                Some(number) => println!("Rolling {} back to release #{}", process, number),
+                None => println!("Rolling {} back to the previous release", process),
+            }
+            println!("Waiting for health check (timeout: {}s)...", timeout);
+
+            let resp = client
+                .rollback(&RollbackRequest {
+                    process,
+                    release,
+                    timeout,
+                    drain_timeout,
+                })
+                .await?;
+
+            println!("Rolled back to #{}: {}", resp.rolled_back_to, resp.instance);
+            if let Some(strategy) = &resp.strategy {
+                println!("Strategy: {}", strategy);
+            }
+            println!("Release: #{}", resp.release);
+        }
+        Commands::GitReceive {
+            process,
+            branch,
+            socket,
+        } => {
+            let mut input = String::new();
+            std::io::Read::read_to_string(&mut std::io::stdin(), &mut input)?;
+            let updates = tenement::git_deploy::parse_ref_updates(&input);
+            let Some(revision) = tenement::git_deploy::pushed_revision(&updates, &branch) else {
+                println!("Only pushes to {} deploy {}", branch, process);
+                return Ok(());
+            };
+            let version = tenement::git_deploy::short_sha(revision);
+            println!("-----> Building and deploying {}:{}", process, version);
+
+            let req = GitDeployRequest {
+                revision: revision.to_string(),
+                timeout: 30,
+                drain_timeout: 30,
+            };
+            let resp = ApiClient::unix(socket).git_deploy(&process, &req).await?;
+            print!("{}", resp.build_output);
+            if let Some(strategy) = &resp.deploy.strategy {
+                println!("-----> Replaced the previous release ({})", strategy);
+            }
+            match resp.deploy.release {
+                Some(number) => {
+                    println!("-----> Deployed {} as release #{}", resp.deploy.instance, number)
+                }
+                None => println!("-----> Deployed {}", resp.deploy.instance),
+            }
         }
         Commands::Route { process, from, to } => {
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
             let resp = client.route(&process, &from, &to).await?;
 
             println!(
@@ -297,63 +1118,304 @@ async fn main() -> Result<()> {
             println!("  {} weight = {}", resp.from_instance, resp.from_weight);
             println!("  {} weight = {}", resp.to_instance, resp.to_weight);
         }
-        Commands::Logs {
-            instance,
-            level,
-            search,
-            limit,
-            follow,
+        Commands::Maintenance { action } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let resp = match action {
+                MaintenanceAction::On {
+                    process,
+                    retry_after,
+                } => client.set_maintenance(&process, true, retry_after).await?,
+                MaintenanceAction::Off { process } => {
+                    client.set_maintenance(&process, false, 0).await?
+                }
+            };
+            match resp.retry_after {
+                Some(secs) => println!(
+                    "{} is in maintenance mode (Retry-After: {}s)",
+                    resp.process, secs
+                ),
+                None => println!("{} is serving traffic again", resp.process),
+            }
+        }
+        Commands::Stacks => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let stacks = client.stacks().await?;
+            if stacks.is_empty() {
+                println!("No stacks (set `stack` on services in tenement.toml)");
+            }
+            for stack in &stacks {
+                println!("{}", stack.stack);
+                for service in &stack.services {
+                    println!(
+                        "  {:<20} {} instance(s), {} healthy, {} down",
+                        service.service, service.instances, service.healthy, service.down
+                    );
+                }
+            }
+        }
+        Commands::Faults { action } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let resp = match action {
+                FaultsAction::Status => client.faults().await?,
+                FaultsAction::On => client.set_fault_injection(true).await?,
+                FaultsAction::Off => client.set_fault_injection(false).await?,
+                FaultsAction::Set {
+                    process,
+                    delay_ms,
+                    delay_percent,
+                    abort_status,
+                    abort_percent,
+                    kill_interval,
+                } => {
+                    let all_if = |set: bool| if set { 100.0 } else { 0.0 };
+                    let fault = tenement::fault::FaultConfig {
+                        delay_ms,
+                        delay_percent: delay_percent.unwrap_or(all_if(delay_ms > 0)),
+                        abort_status,
+                        abort_percent: abort_percent.unwrap_or(all_if(abort_status.is_some())),
+                        kill_interval_secs: kill_interval,
+                    };
+                    client.set_fault(&process, &fault).await?
+                }
+                FaultsAction::Clear { process } => client.clear_fault(&process).await?,
+            };
+            print_faults(&resp);
+        }
+        Commands::Top {
+            app,
+            interval,
+            once,
         } => {
-            let client = ApiClient::from_args(&cli.server, cli.token, cli.data_dir.as_deref())?;
-            let (process, id) = match &instance {
-                Some(inst) => {
-                    let (p, i) = parse_instance(inst)?;
-                    (Some(p), Some(i))
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            loop {
+                let table = top::render(&client.list().await?, app.as_deref());
+                if once {
+                    print!("{}", table);
+                    break;
                 }
-                None => (None, None),
+                // Redraw from the top of a cleared screen
+                print!(
+                    "\x1b[2J\x1b[Htenement top: {} every {}s (Ctrl-C to quit)\n\n{}",
+                    client.endpoint(),
+                    interval.max(1),
+                    table
+                );
+                std::io::Write::flush(&mut std::io::stdout())?;
+                tokio::time::sleep(std::time::Duration::from_secs(interval.max(1))).await;
+            }
+        }
+        Commands::Events {
+            app,
+            kinds,
+            tail,
+            follow,
+            json,
+        } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let query = client::EventQuery {
+                app,
+                kinds,
+                limit: Some(tail),
             };
-
             if follow {
-                // Stream mode: connect to SSE endpoint
                 client
-                    .stream_logs(process.as_deref(), id.as_deref(), level.as_deref())
+                    .stream_events(&query, |event| print_event(&event, json))
                     .await?;
             } else {
-                // One-shot query
-                let entries = client
-                    .query_logs(
-                        process.as_deref(),
-                        id.as_deref(),
-                        level.as_deref(),
-                        search.as_deref(),
-                        limit,
-                    )
-                    .await?;
-
-                for entry in entries {
-                    let ts = entry["timestamp"].as_u64().unwrap_or(0);
-                    let lvl = entry["level"].as_str().unwrap_or("?");
-                    let proc = entry["process"].as_str().unwrap_or("?");
-                    let inst = entry["instance_id"].as_str().unwrap_or("?");
-                    let msg = entry["message"].as_str().unwrap_or("");
-
-                    // Format timestamp as HH:MM:SS
-                    let secs = ts / 1000;
-                    let hours = (secs % 86400) / 3600;
-                    let mins = (secs % 3600) / 60;
-                    let s = secs % 60;
-
-                    let level_marker = if lvl == "stderr" { "ERR" } else { "OUT" };
+                for event in client.events(&query).await? {
+                    print_event(&event, json);
+                }
+            }
+        }
+        Commands::Audit {
+            archive: Some(age), ..
+        } => {
+            let config = Config::load_with_override(cli.data_dir)?;
+            let pool = init_db(&config.settings.data_dir.join("tenement.db")).await?;
+            let deploy_log = tenement::DeployLogStore::new(pool);
+            let moved = deploy_log
+                .archive(std::time::Duration::from_secs(age))
+                .await?;
+            println!("Archived {} audit log entries", moved);
+        }
+        Commands::Audit {
+            actor,
+            action,
+            app,
+            since,
+            failed,
+            limit,
+            json,
+            archive: None,
+        } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let since = since.map(|secs| {
+                let ago = chrono::Duration::seconds(secs as i64);
+                (chrono::Utc::now() - ago).to_rfc3339()
+            });
+            let query = tenement::AuditQuery {
+                actor,
+                action,
+                process: app,
+                since,
+                failed,
+                limit: Some(limit),
+            };
+            let entries = client.audit(&query).await?;
+            print_audit(&entries, json);
+        }
+        Commands::Webhook { action } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            match action {
+                WebhookAction::Add {
+                    url,
+                    events,
+                    secret,
+                } => {
+                    let req = WebhookRequest {
+                        url,
+                        events,
+                        secret,
+                    };
+                    let webhook = client.add_webhook(&req).await?;
+                    println!("Registered webhook {} -> {}", webhook.id, webhook.url);
+                }
+                WebhookAction::List => {
+                    let webhooks = client.webhooks().await?;
+                    if webhooks.is_empty() {
+                        println!("No webhooks registered");
+                    }
+                    for webhook in webhooks {
+                        let events: Vec<_> = webhook.events.iter().map(|e| e.as_str()).collect();
+                        let events = match events.is_empty() {
+                            true => "all".to_string(),
+                            false => events.join(","),
+                        };
+                        let signed = if webhook.signed { "  signed" } else { "" };
+                        println!(
+                            "{}  {}  events={}{}",
+                            webhook.id, webhook.url, events, signed
+                        );
+                    }
+                }
+                WebhookAction::Remove { id } => {
+                    client.remove_webhook(&id).await?;
+                    println!("Removed webhook {}", id);
+                }
+            }
+        }
+        Commands::Cluster => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let cluster = client.cluster().await?;
+            println!(
+                "Node {} ({} mode), leader: {}",
+                cluster.node,
+                cluster.mode.as_str(),
+                cluster.leader.as_deref().unwrap_or("none")
+            );
+            for member in cluster.members {
+                let state = if member.alive { "up" } else { "down" };
+                let role = if member.leader { "  leader" } else { "" };
+                let seen = match (member.local, member.last_seen_secs) {
+                    (true, _) => "  (this node)".to_string(),
+                    (false, Some(secs)) => format!("  seen {}s ago", secs),
+                    (false, None) => "  never seen".to_string(),
+                };
+                println!(
+                    "{}  {}  {}  instances={}{}{}",
+                    member.node, member.address, state, member.instances, role, seen
+                );
+            }
+        }
+        Commands::Preview { action } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            match action {
+                PreviewAction::Create {
+                    process,
+                    branch,
+                    artifact,
+                    checksum,
+                    name,
+                    ttl,
+                    timeout,
+                } => {
+                    let req = PreviewRequest {
+                        process,
+                        name,
+                        revision: branch,
+                        artifact,
+                        checksum,
+                        ttl,
+                        timeout,
+                    };
+                    let created = client.create_preview(&req).await?;
+                    print!("{}", created.build_output);
+                    let preview = created.preview;
                     println!(
-                        "{:02}:{:02}:{:02} [{}] {}:{} {}",
-                        hours, mins, s, level_marker, proc, inst, msg
+                        "Preview {}:{} is up at {} (expires {})",
+                        preview.process, preview.name, preview.url, preview.expires_at
                     );
                 }
+                PreviewAction::List => {
+                    let previews = client.previews().await?;
+                    if previews.is_empty() {
+                        println!("No previews running");
+                    }
+                    for preview in previews {
+                        let source = preview
+                            .revision
+                            .or(preview.artifact)
+                            .unwrap_or_default();
+                        println!(
+                            "{}:{}  {}  {}  expires {}",
+                            preview.process, preview.name, preview.url, source, preview.expires_at
+                        );
+                    }
+                }
+                PreviewAction::Remove { process, name } => {
+                    client.remove_preview(&process, &name).await?;
+                    println!("Removed preview {}:{}", process, name);
+                }
             }
         }
+        Commands::Logs {
+            targets,
+            level,
+            search,
+            tail,
+            since,
+            follow,
+            no_color,
+        } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref())?;
+            let opts = LogsOptions {
+                level,
+                search,
+                tail,
+                since: since.as_deref().map(logs::parse_since).transpose()?,
+                follow,
+                color: logs::use_color(no_color),
+            };
+            logs::show(&client, &targets, &opts).await?;
+        }
         Commands::Init { name, command } => {
             cmd_init(name, command)?;
         }
+        Commands::Check { file, port, json } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref());
+            cmd_check(file, port, json, client).await?;
+        }
         Commands::Config => {
             let config = Config::load_with_override(cli.data_dir)?;
             println!("Data dir: {:?}", config.settings.data_dir);
@@ -366,12 +1428,52 @@ async fn main() -> Result<()> {
                 println!("  [{}]", name);
                 println!("    command: {}", svc.command);
                 println!("    isolation: {}", svc.isolation);
-                if let Some(health) = &svc.health {
-                    println!("    health: {}", health);
+                match (svc.health_check.check_type, &svc.health) {
+                    (tenement::config::HealthCheckType::Tcp, _) => println!("    health: tcp"),
+                    (tenement::config::HealthCheckType::Exec, _) => {
+                        let command = svc.health_check.command.as_deref().unwrap_or_default();
+                        println!("    health: exec {}", command);
+                    }
+                    (_, Some(health)) => println!("    health: {}", health),
+                    (_, None) => {}
                 }
                 if let Some(idle) = svc.idle_timeout {
                     println!("    idle_timeout: {}s", idle);
                 }
+                if !svc.env.is_empty() {
+                    println!("    env:");
+                    for (key, value) in svc.redactor().redact_env(&svc.env) {
+                        println!("      {}={}", key, value);
+                    }
+                }
+            }
+        }
+        Commands::Sockets { prune } => {
+            let config = Config::load_with_override(cli.data_dir)?;
+            let report = tenement::sockets::reconcile_sockets(&config, !prune);
+            if report.entries.is_empty() {
+                println!("No sockets found");
+                return Ok(());
+            }
+            println!("{:<10} {:<8} PATH", "STATE", "ACTION");
+            for entry in &report.entries {
+                let action = match entry.state {
+                    tenement::sockets::SocketState::Dead if entry.pruned => "pruned",
+                    tenement::sockets::SocketState::Dead => "prune",
+                    _ => "keep",
+                };
+                println!(
+                    "{:<10} {:<8} {}",
+                    entry.state.to_string(),
+                    action,
+                    entry.path.display()
+                );
+            }
+            let dead = report
+                .with_state(tenement::sockets::SocketState::Dead)
+                .count();
+            if report.dry_run && dead > 0 {
+                println!("\n{} stale socket(s). Run with --prune to remove.", dead);
             }
         }
         Commands::TokenGen {
@@ -382,6 +1484,7 @@ async fn main() -> Result<()> {
             let data_dir = config.settings.data_dir;
             let db_path = data_dir.join("tenement.db");
             let pool = init_db(&db_path).await?;
+            let deploy_log = tenement::DeployLogStore::new(pool.clone());
 
             if let Some(tenant_id) = tenant {
                 // Generate tenant-scoped token
@@ -390,6 +1493,9 @@ async fn main() -> Result<()> {
                     .generate_and_store(&tenant_id, description.as_deref())
                     .await?;
 
+                let details = format!("tenant token for {}", tenant_id);
+                audit_local(&deploy_log, "token-gen", &details).await?;
+
                 println!("Generated tenant token for '{}':", tenant_id);
                 println!();
                 println!("  {}", token);
@@ -407,6 +1513,7 @@ async fn main() -> Result<()> {
 
                 // Save plaintext token to file for CLI auto-read
                 client::save_token_file(&data_dir, &token)?;
+                audit_local(&deploy_log, "token-gen", "admin token").await?;
 
                 println!("Generated admin API token:");
                 println!();
@@ -416,6 +1523,43 @@ async fn main() -> Result<()> {
                 println!("Use it in the Authorization header: Bearer {}", token);
             }
         }
+        Commands::Tokens { action } => {
+            let config = Config::load_with_override(cli.data_dir)?;
+            let pool = init_db(&config.settings.data_dir.join("tenement.db")).await?;
+            let deploy_log = tenement::DeployLogStore::new(pool.clone());
+            cmd_tokens(action, &tenement::ApiTokenStore::new(pool), &deploy_log).await?;
+        }
+        Commands::Secrets { action } => {
+            let config = Config::load_with_override(cli.data_dir)?;
+            let data_dir = &config.settings.data_dir;
+            let audited = match &action {
+                SecretsAction::Set { name, .. } => Some(("secret-set", name.clone())),
+                SecretsAction::Rm { name } => Some(("secret-rm", name.clone())),
+                SecretsAction::Get { .. } | SecretsAction::List => None,
+            };
+            cmd_secrets(action, data_dir)?;
+            if let Some((audit_action, name)) = audited {
+                let pool = init_db(&data_dir.join("tenement.db")).await?;
+                let deploy_log = tenement::DeployLogStore::new(pool);
+                audit_local(&deploy_log, audit_action, &name).await?;
+            }
+        }
+        Commands::Backup { action } => {
+            let config = Config::load_with_override(cli.data_dir)?;
+            cmd_backup(action, &config).await?;
+        }
+        Commands::Restore { backup, force } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref());
+            let config = Config::load_with_override(cli.data_dir)?;
+            cmd_restore(&backup, force, &config, client).await?;
+        }
+        Commands::Volume { action } => {
+            let client =
+                ApiClient::from_args(cli.server.as_deref(), cli.token, cli.data_dir.as_deref());
+            let config = Config::load_with_override(cli.data_dir)?;
+            cmd_volume(action, &config, client).await?;
+        }
         Commands::Install {
             domain,
             port,
@@ -423,8 +1567,17 @@ async fn main() -> Result<()> {
             dry_run,
             caddy: with_caddy,
             dns_provider,
+            socket_activation,
         } => {
-            install::install(domain, port, config, dry_run, with_caddy, dns_provider)?;
+            install::install(
+                domain,
+                port,
+                config,
+                dry_run,
+                with_caddy,
+                dns_provider,
+                socket_activation,
+            )?;
         }
         Commands::Uninstall => {
             install::uninstall()?;
@@ -444,6 +1597,314 @@ async fn main() -> Result<()> {
     Ok(())
 }
 
+/// The backup target given on the command line, or else the configured one
+fn backup_target(target: Option<String>, config: &Config) -> Result<tenement::backup::Target> {
+    let target = target
+        .or_else(|| config.settings.backup.as_ref().map(|b| b.target.clone()))
+        .context("No backup target: set [settings.backup] target or pass --target")?;
+    tenement::backup::Target::parse(&target)
+}
+
+async fn cmd_backup(action: BackupAction, config: &Config) -> Result<()> {
+    use tenement::backup;
+    match action {
+        BackupAction::Create { target } => {
+            let configured = config
+                .settings
+                .backup
+                .as_ref()
+                .filter(|b| target.is_none() || target.as_deref() == Some(b.target.as_str()));
+            let target = backup_target(target, config)?;
+            let pool = init_db(&config.settings.data_dir.join(backup::DB_FILE_NAME)).await?;
+            let include_key = configured.is_some_and(|b| b.include_master_key);
+            let created = backup::create(config, &pool, &target, include_key).await?;
+            println!(
+                "Backed up to {}/{} ({})",
+                target,
+                created.name,
+                tenement::storage::format_bytes(created.bytes)
+            );
+            // Retention only applies to the target it's configured for
+            if let Some(configured) = configured {
+                for deleted in backup::prune(configured, &target).await? {
+                    println!("Deleted old backup {}", deleted.name);
+                }
+            }
+        }
+        BackupAction::Ls { target } => {
+            let target = backup_target(target, config)?;
+            let backups = target.list().await?;
+            if backups.is_empty() {
+                println!("No backups in {}", target);
+                return Ok(());
+            }
+            println!("{:<36} {:<22} SIZE", "NAME", "CREATED");
+            for backup in &backups {
+                println!(
+                    "{:<36} {:<22} {}",
+                    backup.name,
+                    backup.created_at.format("%Y-%m-%d %H:%M:%S UTC"),
+                    tenement::storage::format_bytes(backup.bytes)
+                );
+            }
+        }
+    }
+    Ok(())
+}
+
+async fn cmd_restore(
+    backup: &str,
+    force: bool,
+    config: &Config,
+    client: Result<ApiClient>,
+) -> Result<()> {
+    // A running server would keep using the DB it has open
+    if let Ok(client) = client {
+        if client.list().await.is_ok() && !force {
+            anyhow::bail!(
+                "The server at {} is running; stop it first or pass --force",
+                client.endpoint()
+            );
+        }
+    }
+    let (target, name) = if backup.contains('/') {
+        tenement::backup::Target::locate(backup)?
+    } else {
+        (backup_target(None, config)?, backup.to_string())
+    };
+    let manifest = tenement::backup::restore(config, &target, &name).await?;
+    println!(
+        "Restored {} (taken {}) into {}",
+        name,
+        manifest.created_at.format("%Y-%m-%d %H:%M:%S UTC"),
+        config.settings.data_dir.display()
+    );
+    println!(
+        "  state DB{}{}, {} volume(s)",
+        if manifest.secrets { ", secrets" } else { "" },
+        if manifest.master_key { ", master key" } else { "" },
+        manifest.volumes.len()
+    );
+    if manifest.secrets && !manifest.master_key {
+        println!("Secrets need this backup's master key: set TENEMENT_MASTER_KEY or master.key.");
+    }
+    Ok(())
+}
+
+/// List, back up and restore services' volumes in the data directory. A
+/// restore asks the server through `client` whether the service is running.
+async fn cmd_volume(
+    action: VolumeAction,
+    config: &Config,
+    client: Result<ApiClient>,
+) -> Result<()> {
+    use tenement::volumes;
+    let data_dir = &config.settings.data_dir;
+    match action {
+        VolumeAction::Ls => {
+            let volumes = volumes::list(config)?;
+            if volumes.is_empty() {
+                println!("No volumes");
+                return Ok(());
+            }
+            println!("{:<20} {:<16} {:<10} PATH", "SERVICE", "VOLUME", "SIZE");
+            for volume in &volumes {
+                let note = if volume.configured {
+                    ""
+                } else {
+                    " (not configured)"
+                };
+                println!(
+                    "{:<20} {:<16} {:<10} {}{}",
+                    volume.service,
+                    volume.name,
+                    tenement::storage::format_bytes(volume.bytes),
+                    volume.path.display(),
+                    note
+                );
+            }
+        }
+        VolumeAction::Backup {
+            process,
+            name,
+            output,
+        } => {
+            let dir = volumes::volume_dir(data_dir, &process, &name);
+            if !dir.is_dir() {
+                anyhow::bail!("No volume {} for {} at {}", name, process, dir.display());
+            }
+            let output = output.unwrap_or_else(|| {
+                let time = chrono::Utc::now().format("%Y%m%dT%H%M%SZ");
+                PathBuf::from(format!("{}-{}-{}.tar.gz", process, name, time))
+            });
+            if output.as_os_str() == "-" {
+                let mut out = volumes::backup(&dir, std::io::stdout().lock())?;
+                std::io::Write::flush(&mut out)?;
+                return Ok(());
+            }
+            let file = std::fs::File::create(&output)
+                .with_context(|| format!("Failed to create {}", output.display()))?;
+            let mut out = volumes::backup(&dir, std::io::BufWriter::new(file))?;
+            std::io::Write::flush(&mut out)?;
+            eprintln!("Backed up {}/{} to {}", process, name, output.display());
+        }
+        VolumeAction::Restore {
+            process,
+            name,
+            archive,
+            force,
+        } => {
+            let service = config
+                .get_service(&process)
+                .with_context(|| format!("No service named {}", process))?;
+            if !service.volumes.contains_key(&name) {
+                anyhow::bail!("Service {} has no volume {}", process, name);
+            }
+            // A server that isn't up has nothing running to restore under
+            let instances = match client {
+                Ok(client) => client.list().await.ok(),
+                Err(_) => None,
+            };
+            if let Some(instances) = instances {
+                let running = instances
+                    .iter()
+                    .filter(|info| info["process"].as_str() == Some(process.as_str()))
+                    .count();
+                if running > 0 && !force {
+                    anyhow::bail!(
+                        "{} has {} running instance(s); stop them first or pass --force",
+                        process,
+                        running
+                    );
+                }
+            }
+            let run_as =
+                tenement::users::resolve(service.user.as_deref(), service.group.as_deref())?;
+            let dir = volumes::volume_dir(data_dir, &process, &name);
+            if archive.as_os_str() == "-" {
+                volumes::restore(&dir, std::io::stdin().lock(), run_as.as_ref())?;
+            } else {
+                let file = std::fs::File::open(&archive)
+                    .with_context(|| format!("Failed to open {}", archive.display()))?;
+                volumes::restore(&dir, std::io::BufReader::new(file), run_as.as_ref())?;
+            }
+            println!("Restored {}/{} from {}", process, name, archive.display());
+        }
+    }
+    Ok(())
+}
+
+/// Read, write and list secrets in the data directory's encrypted store
+fn cmd_secrets(action: SecretsAction, data_dir: &std::path::Path) -> Result<()> {
+    match action {
+        SecretsAction::Set { name, value } => {
+            validate_secret_name(&name)?;
+            let value = match value {
+                Some(value) => value,
+                None => {
+                    let mut value = String::new();
+                    std::io::Read::read_to_string(&mut std::io::stdin(), &mut value)?;
+                    value.trim_end_matches(['\n', '\r']).to_string()
+                }
+            };
+            let mut store = SecretStore::open_or_init(data_dir)?;
+            store.set(&name, &value);
+            store.save()?;
+            println!("Set secret {}", name);
+            println!("Running instances pick it up on their next secrets check or restart.");
+        }
+        SecretsAction::Get { name } => {
+            let store = SecretStore::open(data_dir)?;
+            match store.get(&name) {
+                Some(value) => println!("{}", value),
+                None => anyhow::bail!("No secret named {}", name),
+            }
+        }
+        SecretsAction::Rm { name } => {
+            let mut store = SecretStore::open(data_dir)?;
+            if !store.remove(&name) {
+                anyhow::bail!("No secret named {}", name);
+            }
+            store.save()?;
+            println!("Removed secret {}", name);
+        }
+        SecretsAction::List => {
+            if !data_dir.join(tenement::secret_store::STORE_FILE_NAME).exists() {
+                println!("No secrets stored");
+                return Ok(());
+            }
+            let store = SecretStore::open(data_dir)?;
+            for name in store.names() {
+                println!("{}", name);
+            }
+        }
+    }
+    Ok(())
+}
+
+async fn cmd_tokens(
+    action: TokensAction,
+    store: &tenement::ApiTokenStore,
+    deploy_log: &tenement::DeployLogStore,
+) -> Result<()> {
+    match action {
+        TokensAction::Create { name, scope } => {
+            let token = store.generate_and_store(&name, scope).await?;
+            let details = format!("{} ({})", name, scope);
+            audit_local(deploy_log, "token-create", &details).await?;
+            println!("Generated {} token '{}':", scope, name);
+            println!();
+            println!("  {}", token);
+            println!();
+            println!("It is shown only once. Store it somewhere safe.");
+        }
+        TokensAction::List => {
+            let tokens = store.list().await?;
+            if tokens.is_empty() {
+                println!("No API tokens");
+                return Ok(());
+            }
+            println!("{:<24} {:<8} CREATED", "NAME", "SCOPE");
+            for token in tokens {
+                println!("{:<24} {:<8} {}", token.name, token.scope, token.created_at);
+            }
+        }
+        TokensAction::Revoke { name } => {
+            if !store.revoke(&name).await? {
+                anyhow::bail!("No API token named {}", name);
+            }
+            audit_local(deploy_log, "token-revoke", &name).await?;
+            println!("Revoked token {}", name);
+        }
+    }
+    Ok(())
+}
+
+/// Record an action taken from this host, not through the API, in the audit
+/// log as `local:$USER`
+async fn audit_local(
+    deploy_log: &tenement::DeployLogStore,
+    action: &str,
+    details: &str,
+) -> Result<()> {
+    let user = std::env::var("USER").unwrap_or_else(|_| "unknown".to_string());
+    let actor = format!("local:{}", user);
+    deploy_log
+        .log_as(Some(&actor), action, "", "", Some(details), true)
+        .await
+}
+
+/// Secret names become env var names, so hold them to the same rules
+fn validate_secret_name(name: &str) -> Result<()> {
+    if !tenement::env_files::is_valid_name(name) {
+        anyhow::bail!(
+            "Invalid secret name '{}': use letters, digits and underscores (e.g. DATABASE_URL)",
+            name
+        );
+    }
+    Ok(())
+}
+
 /// Start the server (this is the only command that creates a Hypervisor directly)
 async fn cmd_serve(
     port: u16,
@@ -454,12 +1915,20 @@ async fn cmd_serve(
     data_dir_override: Option<PathBuf>,
 ) -> Result<()> {
     let config = Config::load_with_override(data_dir_override)?;
+    match config.diff_against_last_applied() {
+        Ok(Some(diff)) if !diff.is_empty() => {
+            tracing::info!("Config changed since last start: {}", diff)
+        }
+        Ok(_) => {}
+        Err(e) => tracing::warn!("Could not compare config with the last start: {:#}", e),
+    }
     let db_path = config.settings.data_dir.join("tenement.db");
     let pool = init_db(&db_path).await?;
     let config_store = std::sync::Arc::new(ConfigStore::new(pool.clone()));
-    let state_store = std::sync::Arc::new(tenement::StateStore::new(pool.clone()));
+    let backends = tenement::Backends::open(&config, pool.clone())?;
     let deploy_log = std::sync::Arc::new(tenement::DeployLogStore::new(pool.clone()));
-    let tenant_tokens = std::sync::Arc::new(tenement::TenantTokenStore::new(pool));
+    let tenant_tokens = std::sync::Arc::new(tenement::TenantTokenStore::new(pool.clone()));
+    let api_tokens = std::sync::Arc::new(tenement::ApiTokenStore::new(pool.clone()));
 
     let tls_options = if tls {
         let acme_email = email
@@ -495,6 +1964,12 @@ async fn cmd_serve(
             staging: staging || config.settings.tls.staging,
             https_port: config.settings.tls.https_port,
             http_port: config.settings.tls.http_port,
+            ticket_rotation_secs: config.settings.tls.ticket_rotation_secs,
+            ticket_keys_retained: config.settings.tls.ticket_keys_retained,
+            extra_domains: config.service_domains(),
+            wildcard_domains: config.settings.tls.wildcard_domains.clone(),
+            dns: config.settings.tls.dns_challenge(),
+            challenge: config.settings.tls.challenge,
         })
     } else if config.settings.tls.enabled {
         let acme_email = config.settings.tls.acme_email.clone().ok_or_else(|| {
@@ -535,12 +2010,24 @@ async fn cmd_serve(
             staging: staging || config.settings.tls.staging,
             https_port: config.settings.tls.https_port,
             http_port: config.settings.tls.http_port,
+            ticket_rotation_secs: config.settings.tls.ticket_rotation_secs,
+            ticket_keys_retained: config.settings.tls.ticket_keys_retained,
+            extra_domains: config.service_domains(),
+            wildcard_domains: config.settings.tls.wildcard_domains.clone(),
+            dns: config.settings.tls.dns_challenge(),
+            challenge: config.settings.tls.challenge,
         })
     } else {
         None
     };
 
     if let Some(ref tls_opts) = tls_options {
+        if config.settings.cluster.is_some() {
+            anyhow::bail!(
+                "--tls can't be combined with [settings.cluster]: nodes poll and forward to \
+                each other over plain HTTP"
+            );
+        }
         if tls_opts.http_port == tls_opts.https_port {
             anyhow::bail!(
                 "HTTP port ({}) and HTTPS port ({}) cannot be the same.\n\
@@ -551,20 +2038,123 @@ async fn cmd_serve(
         }
     }
 
-    let hypervisor = Hypervisor::with_state_store(config, state_store);
+    let admin_tokens = tenement::AdminTokens::load(config.settings.admin_tokens_file.clone())?;
+    let hypervisor = Hypervisor::with_state_store(config, backends.state);
+    tenement::backup::spawn_scheduler(hypervisor.clone(), pool);
+    tenement::alerts::spawn(hypervisor.clone());
+    tenement::fault::spawn_killer(hypervisor.clone());
     server::serve(
         hypervisor,
         domain,
         port,
         config_store,
         deploy_log,
+        backends.releases,
         tenant_tokens,
+        api_tokens,
+        admin_tokens,
         tls_options,
     )
     .await?;
     Ok(())
 }
 
+/// What `tenement check --json` prints
+#[derive(serde::Serialize)]
+struct CheckOutput {
+    ok: bool,
+    problems: Vec<tenement::check::Problem>,
+    /// What a reload would do on the running server
+    plan: Option<ReloadResponse>,
+    /// Why there's no plan
+    plan_error: Option<String>,
+}
+
+/// Check a config file, and plan its reload on the server `client` reaches
+async fn cmd_check(
+    file: Option<PathBuf>,
+    port: u16,
+    json: bool,
+    client: Result<ApiClient>,
+) -> Result<()> {
+    let path = match file {
+        Some(path) => path,
+        None => Config::find_config_file()?,
+    };
+    let content = std::fs::read_to_string(&path)
+        .with_context(|| format!("Failed to read config file: {}", path.display()))?;
+    let environment = std::env::var("TENEMENT_ENV").ok().filter(|e| !e.is_empty());
+    let mut report = tenement::check::check(&content, &path, environment.as_deref(), Some(port));
+    if let Ok(config) = Config::from_source(&content, environment.as_deref(), &path) {
+        if let Err(e) = tenement_cli::middleware::check(&config) {
+            report.problems.push(tenement::check::Problem {
+                severity: tenement::check::Severity::Error,
+                message: e.to_string(),
+            });
+        }
+    }
+
+    // Only a config that would load is worth comparing
+    let plan = match client {
+        Ok(client) if report.is_ok() => client
+            .plan_reload(&content, environment.as_deref())
+            .await
+            .map_err(|e| format!("{:#}", e)),
+        Ok(_) => Err("the config has errors".to_string()),
+        Err(e) => Err(format!("{:#}", e)),
+    };
+    let errors = report.errors().count();
+
+    if json {
+        let output = CheckOutput {
+            ok: errors == 0,
+            problems: report.problems,
+            plan_error: plan.as_ref().err().cloned(),
+            plan: plan.ok(),
+        };
+        println!("{}", serde_json::to_string_pretty(&output)?);
+    } else {
+        for problem in &report.problems {
+            let label = match problem.severity {
+                tenement::check::Severity::Error => "error",
+                tenement::check::Severity::Warning => "warning",
+            };
+            println!("{}: {}", label, problem.message);
+        }
+        if report.problems.is_empty() {
+            println!("{} is valid", path.display());
+        }
+        match &plan {
+            Ok(plan) => {
+                let sections = [
+                    ("Added", &plan.added),
+                    ("Removed", &plan.removed),
+                    ("Changed", &plan.changed),
+                    ("Would start", &plan.started),
+                    ("Would stop", &plan.stopped),
+                    ("Would restart", &plan.restarted),
+                ];
+                let mut any = false;
+                for (label, names) in sections {
+                    if !names.is_empty() {
+                        println!("{}: {}", label, names.join(", "));
+                        any = true;
+                    }
+                }
+                if !any {
+                    println!("No changes from the running config");
+                }
+            }
+            Err(e) => println!("Not compared with a running server: {}", e),
+        }
+    }
+
+    if errors > 0 {
+        anyhow::bail!("{} error(s) in {}", errors, path.display());
+    }
+    Ok(())
+}
+
 /// Initialize a new tenement project
 fn cmd_init(name: Option<String>, command: Option<String>) -> Result<()> {
     let config_path = std::path::Path::new("tenement.toml");
@@ -653,6 +2243,100 @@ fn detect_framework_command() -> String {
     "./app".to_string()
 }
 
+/// One event as a line: JSON, or `time  kind  instance  data`
+fn print_event(event: &tenement::events::Event, json: bool) {
+    if json {
+        println!("{}", serde_json::to_string(event).unwrap_or_default());
+        return;
+    }
+    let subject = event.instance.as_deref().or(event.app.as_deref());
+    println!(
+        "{}  {:<14}  {}  {}",
+        event.timestamp,
+        event.event,
+        subject.unwrap_or("-"),
+        event.data
+    );
+}
+
+/// Audit log entries, oldest first, as a table or one JSON object per line
+fn print_audit(entries: &[tenement::DeployLogEntry], json: bool) {
+    if json {
+        for entry in entries.iter().rev() {
+            println!("{}", serde_json::to_string(entry).unwrap_or_default());
+        }
+        return;
+    }
+    if entries.is_empty() {
+        println!("No audit log entries");
+        return;
+    }
+    println!(
+        "{:<20} {:<20} {:<14} {:<20} {:<6} DETAILS",
+        "TIME", "ACTOR", "ACTION", "TARGET", "RESULT"
+    );
+    for entry in entries.iter().rev() {
+        let time = chrono::DateTime::parse_from_rfc3339(&entry.timestamp)
+            .map(|t| t.with_timezone(&chrono::Local).format("%Y-%m-%d %H:%M:%S").to_string())
+            .unwrap_or_else(|_| entry.timestamp.clone());
+        let target = match (entry.process.as_str(), entry.instance_id.as_str()) {
+            ("", _) => "-".to_string(),
+            (process, "") => process.to_string(),
+            (process, instance) => format!("{}:{}", process, instance),
+        };
+        println!(
+            "{:<20} {:<20} {:<14} {:<20} {:<6} {}",
+            time,
+            entry.actor.as_deref().unwrap_or("-"),
+            entry.action,
+            target,
+            if entry.success { "ok" } else { "failed" },
+            entry.details.as_deref().unwrap_or("")
+        );
+    }
+}
+
+/// What a stack operation did, step by step; an error if it stopped early
+fn print_stack_rollout(done: &str, resp: &tenement_cli::api_routes::StackResponse) -> Result<()> {
+    for target in &resp.completed {
+        println!("{} {}", done, target);
+    }
+    let Some(failed) = &resp.failed else {
+        if resp.completed.is_empty() {
+            println!("Nothing to do: stack {} has no running instances", resp.stack);
+        }
+        return Ok(());
+    };
+    if !resp.skipped.is_empty() {
+        println!("Skipped: {}", resp.skipped.join(", "));
+    }
+    anyhow::bail!("Stack {} stopped at {}: {}", resp.stack, failed.target, failed.error)
+}
+
+/// Fault injection on or off, then one line per service with faults
+fn print_faults(resp: &tenement_cli::api_routes::FaultsResponse) {
+    let state = if resp.enabled { "ON" } else { "off" };
+    println!("Fault injection is {}", state);
+    for service in &resp.services {
+        let fault = &service.fault;
+        let mut parts = Vec::new();
+        if fault.delay_ms > 0 {
+            parts.push(format!("{}ms delay on {}%", fault.delay_ms, fault.delay_percent));
+        }
+        if let Some(status) = fault.abort_status {
+            parts.push(format!("{} on {}%", status, fault.abort_percent));
+        }
+        if fault.kill_interval_secs > 0 {
+            parts.push(format!("kill every {}s", fault.kill_interval_secs));
+        }
+        if parts.is_empty() {
+            parts.push("none".to_string());
+        }
+        let source = if service.overridden { "set with ten faults" } else { "config" };
+        println!("  {:<16} {} ({})", service.service, parts.join(", "), source);
+    }
+}
+
 fn parse_instance(s: &str) -> Result<(String, String)> {
     let parts: Vec<&str> = s.splitn(2, ':').collect();
     if parts.len() != 2 || parts[0].is_empty() || parts[1].is_empty() {
@@ -691,7 +2375,10 @@ fn validate_acme_email(email: &str) -> Result<()> {
 
 /// Initialize tracing. If the `otlp` feature is enabled and OTEL_EXPORTER_OTLP_ENDPOINT
 /// is set, traces are exported via OTLP. Otherwise, logs to stderr.
-fn init_tracing() {
+///
+/// In JSON format each event's fields (app, instance, pid, event, stream) are
+/// top-level keys, next to `timestamp`, `level`, `target`, and `message`.
+fn init_tracing(format: LogFormat) {
     #[cfg(feature = "otlp")]
     {
         if std::env::var("OTEL_EXPORTER_OTLP_ENDPOINT").is_ok() {
@@ -715,8 +2402,17 @@ fn init_tracing() {
 
             let telemetry = tracing_opentelemetry::layer().with_tracer(provider.tracer("tenement"));
 
+            use tracing_subscriber::Layer;
+            let fmt_layer = match format {
+                LogFormat::Text => tracing_subscriber::fmt::layer().boxed(),
+                LogFormat::Json => tracing_subscriber::fmt::layer()
+                    .json()
+                    .flatten_event(true)
+                    .boxed(),
+            };
+
             tracing_subscriber::registry()
-                .with(tracing_subscriber::fmt::layer())
+                .with(fmt_layer)
                 .with(telemetry)
                 .init();
 
@@ -726,7 +2422,17 @@ fn init_tracing() {
     }
 
     // Default: log to stderr
-    tracing_subscriber::fmt::init();
+    let builder = tracing_subscriber::fmt()
+        .with_env_filter(tracing_subscriber::EnvFilter::from_default_env());
+    match format {
+        LogFormat::Text => builder.init(),
+        LogFormat::Json => builder.json().flatten_event(true).init(),
+    }
+}
+
+/// Whole seconds from `from` to `to`, or 0 if `to` is earlier
+fn secs_between(from: chrono::DateTime<chrono::Utc>, to: chrono::DateTime<chrono::Utc>) -> u64 {
+    (to - from).num_seconds().max(0) as u64
 }
 
 fn format_uptime(secs: u64) -> String {
@@ -0,0 +1,369 @@
+//! Proxy middleware
+//!
+//! A [`Middleware`] takes the handler for the rest of the chain and returns
+//! one that wraps it, so it can inspect or change the request, answer it
+//! itself, or rework the response on the way back. Middleware is registered
+//! by name at compile time, from a binary that builds on this crate:
+//!
+//! ```ignore
+//! tenement_cli::middleware::register("tenant-header", Arc::new(|next| {
+//!     handler(move |mut req| {
+//!         req.headers_mut().insert("x-tenant", HeaderValue::from_static("acme"));
+//!         next(req)
+//!     })
+//! }));
+//! ```
+//!
+//! and then applied to every proxied request with `[settings] middleware =
+//! ["tenant-header"]`, or to one service's with its own `middleware` list.
+//! The global list runs first (outermost), then the service's, each in the
+//! order written. Built in are `request-id` (passes on or generates
+//! `X-Request-Id`, and echoes it on the response) and `hide-server` (drops the
+//! app's `Server` and `X-Powered-By` response headers).
+
+use anyhow::Result;
+use axum::body::Body;
+use axum::http::{HeaderValue, Request, StatusCode};
+use axum::response::{IntoResponse, Response};
+use std::collections::{BTreeMap, HashMap};
+use std::future::Future;
+use std::pin::Pin;
+use std::sync::{Arc, RwLock};
+use tenement::Config;
+
+/// A response still being worked out
+pub type BoxFuture = Pin<Box<dyn Future<Output = Response> + Send>>;
+
+/// Something that answers a proxied request
+pub type Handler = Arc<dyn Fn(Request<Body>) -> BoxFuture + Send + Sync>;
+
+/// Wraps the handler for the rest of the chain
+pub type Middleware = Arc<dyn Fn(Handler) -> Handler + Send + Sync>;
+
+/// Header `request-id` passes on
+const REQUEST_ID: &str = "x-request-id";
+
+static REGISTRY: RwLock<BTreeMap<String, Middleware>> = RwLock::new(BTreeMap::new());
+
+static CHAINS: Chains = Chains::new();
+
+/// A [`Handler`] from an async closure
+pub fn handler<F, Fut>(f: F) -> Handler
+where
+    F: Fn(Request<Body>) -> Fut + Send + Sync + 'static,
+    Fut: Future<Output = Response> + Send + 'static,
+{
+    Arc::new(move |req| Box::pin(f(req)))
+}
+
+/// Make middleware available to configs under `name`, replacing any there
+pub fn register(name: &str, middleware: Middleware) {
+    REGISTRY
+        .write()
+        .unwrap()
+        .insert(name.to_string(), middleware);
+}
+
+/// Registered middleware, built-ins included
+pub fn get(name: &str) -> Option<Middleware> {
+    if let Some(middleware) = REGISTRY.read().unwrap().get(name) {
+        return Some(middleware.clone());
+    }
+    let builtin: Middleware = match name {
+        "request-id" => Arc::new(request_id),
+        "hide-server" => Arc::new(hide_server),
+        _ => return None,
+    };
+    Some(builtin)
+}
+
+/// The middleware names a request to `process` goes through, in order
+pub fn chain_for(config: &Config, process: &str) -> Vec<String> {
+    let service = config.get_service(process).map(|s| s.middleware.as_slice());
+    config
+        .settings
+        .middleware
+        .iter()
+        .chain(service.unwrap_or_default())
+        .cloned()
+        .collect()
+}
+
+/// Fail on middleware the config names that isn't registered
+pub fn check(config: &Config) -> Result<()> {
+    let services = config.service.iter().flat_map(|(name, service)| {
+        service
+            .middleware
+            .iter()
+            .map(move |m| (format!("service '{}'", name), m))
+    });
+    let global = config
+        .settings
+        .middleware
+        .iter()
+        .map(|m| ("settings".to_string(), m));
+    for (place, name) in global.chain(services) {
+        if get(name).is_none() {
+            anyhow::bail!("Unknown middleware '{}' in {}", name, place);
+        }
+    }
+    Ok(())
+}
+
+/// Where a request sent through a [`chain`] goes after its last middleware,
+/// carried in the request's extensions
+#[derive(Clone)]
+pub struct Destination(pub Handler);
+
+/// The chain in front of `process` under `config`, built the first time it's
+/// asked for and kept until the config is replaced (by a reload). None if a
+/// middleware isn't registered. Requests sent through it need a
+/// [`Destination`].
+pub fn chain(config: &Arc<Config>, process: &str) -> Option<Handler> {
+    CHAINS.get(config, process)
+}
+
+/// Built chains by service (None for names that aren't one), and the config
+/// they were built from
+struct Chains {
+    built: RwLock<Option<(Arc<Config>, HashMap<Option<String>, Option<Handler>>)>>,
+}
+
+impl Chains {
+    const fn new() -> Self {
+        Self {
+            built: RwLock::new(None),
+        }
+    }
+
+    fn get(&self, config: &Arc<Config>, process: &str) -> Option<Handler> {
+        // Names that aren't services share the global chain, so they can't grow the cache
+        let key = config.get_service(process).map(|_| process.to_string());
+        {
+            let built = self.built.read().unwrap();
+            if let Some((built_for, chains)) = built.as_ref() {
+                if Arc::ptr_eq(built_for, config) {
+                    if let Some(chain) = chains.get(&key) {
+                        return chain.clone();
+                    }
+                }
+            }
+        }
+        let chain = build(&chain_for(config, process), Arc::new(destination));
+        let mut built = self.built.write().unwrap();
+        match built.as_mut() {
+            Some((built_for, chains)) if Arc::ptr_eq(built_for, config) => {
+                chains.insert(key, chain.clone());
+            }
+            _ => *built = Some((config.clone(), HashMap::from([(key, chain.clone())]))),
+        }
+        chain
+    }
+}
+
+/// The end of a cached chain: on to the request's [`Destination`]
+fn destination(mut req: Request<Body>) -> BoxFuture {
+    match req.extensions_mut().remove::<Destination>() {
+        Some(Destination(next)) => next(req),
+        None => Box::pin(async {
+            tracing::error!("Request went through middleware with nowhere to go");
+            (StatusCode::INTERNAL_SERVER_ERROR, "Internal server error").into_response()
+        }),
+    }
+}
+
+/// `inner` wrapped in the named middleware, the first outermost. None if one
+/// isn't registered.
+pub fn build(names: &[String], inner: Handler) -> Option<Handler> {
+    let mut handler = inner;
+    for name in names.iter().rev() {
+        handler = get(name)?(handler);
+    }
+    Some(handler)
+}
+
+fn request_id(next: Handler) -> Handler {
+    handler(move |mut req: Request<Body>| {
+        let next = next.clone();
+        async move {
+            let id = match req.headers().get(REQUEST_ID) {
+                Some(id) => id.clone(),
+                None => {
+                    let id = HeaderValue::from_str(&tenement::generate_token())
+                        .expect("tokens are URL-safe base64");
+                    req.headers_mut().insert(REQUEST_ID, id.clone());
+                    id
+                }
+            };
+            let mut response = next(req).await;
+            response.headers_mut().insert(REQUEST_ID, id);
+            response
+        }
+    })
+}
+
+fn hide_server(next: Handler) -> Handler {
+    handler(move |req: Request<Body>| {
+        let next = next.clone();
+        async move {
+            let mut response = next(req).await;
+            response.headers_mut().remove(axum::http::header::SERVER);
+            response.headers_mut().remove("x-powered-by");
+            response
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    /// Echoes the request's headers back as response headers
+    fn echo() -> Handler {
+        handler(|req: Request<Body>| async move {
+            let mut response = "ok".into_response();
+            for (name, value) in req.headers() {
+                response.headers_mut().insert(name, value.clone());
+            }
+            response
+        })
+    }
+
+    /// Appends `tag` to the `x-trail` request header
+    fn trail(tag: &'static str) -> Middleware {
+        Arc::new(move |next: Handler| {
+            handler(move |mut req: Request<Body>| {
+                let next = next.clone();
+                async move {
+                    let trail = req
+                        .headers()
+                        .get("x-trail")
+                        .and_then(|v| v.to_str().ok())
+                        .unwrap_or("")
+                        .to_string();
+                    let value = HeaderValue::from_str(&format!("{}{}", trail, tag)).unwrap();
+                    req.headers_mut().insert("x-trail", value);
+                    next(req).await
+                }
+            })
+        })
+    }
+
+    // ===================
+    // Registry and chains
+    // ===================
+
+    #[tokio::test]
+    async fn test_chain_runs_in_order() {
+        register("test-a", trail("a"));
+        register("test-b", trail("b"));
+        let names = vec!["test-a".to_string(), "test-b".to_string()];
+        let chain = build(&names, echo()).unwrap();
+        let response = chain(Request::new(Body::empty())).await;
+        assert_eq!(response.headers()["x-trail"], "ab");
+
+        assert!(build(&["nope".to_string()], echo()).is_none());
+    }
+
+    #[test]
+    fn test_chain_for_and_check() {
+        register("test-auth", trail("x"));
+        let config = Config::from_str(
+            r#"
+[settings]
+middleware = ["request-id"]
+
+[service.api]
+command = "./api"
+middleware = ["test-auth", "hide-server"]
+
+[service.web]
+command = "./web"
+"#,
+        )
+        .unwrap();
+        assert_eq!(
+            chain_for(&config, "api"),
+            vec!["request-id", "test-auth", "hide-server"]
+        );
+        assert_eq!(chain_for(&config, "web"), vec!["request-id"]);
+        assert!(check(&config).is_ok());
+
+        let config =
+            Config::from_str("[service.api]\ncommand = \"./api\"\nmiddleware = [\"missing\"]\n")
+                .unwrap();
+        let err = check(&config).unwrap_err().to_string();
+        assert_eq!(err, "Unknown middleware 'missing' in service 'api'");
+    }
+
+    #[tokio::test]
+    async fn test_chain_is_kept_per_config() {
+        static BUILDS: std::sync::atomic::AtomicUsize = std::sync::atomic::AtomicUsize::new(0);
+        register(
+            "test-counted",
+            Arc::new(|next: Handler| {
+                BUILDS.fetch_add(1, std::sync::atomic::Ordering::SeqCst);
+                next
+            }),
+        );
+        let toml = "[service.api]\ncommand = \"./api\"\nmiddleware = [\"test-counted\"]\n";
+        let config = Arc::new(Config::from_str(toml).unwrap());
+        let send = |chain: Handler| async move {
+            let mut req = Request::new(Body::empty());
+            req.extensions_mut().insert(Destination(echo()));
+            chain(req).await
+        };
+
+        let chains = Chains::new();
+        let response = send(chains.get(&config, "api").unwrap()).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        send(chains.get(&config, "api").unwrap()).await;
+        assert_eq!(BUILDS.load(std::sync::atomic::Ordering::SeqCst), 1);
+
+        // A reloaded config builds afresh
+        let reloaded = Arc::new(Config::from_str(toml).unwrap());
+        send(chains.get(&reloaded, "api").unwrap()).await;
+        assert_eq!(BUILDS.load(std::sync::atomic::Ordering::SeqCst), 2);
+
+        // Without a destination there's nowhere to send it
+        let chain = chains.get(&reloaded, "api").unwrap();
+        let response = chain(Request::new(Body::empty())).await;
+        assert_eq!(response.status(), StatusCode::INTERNAL_SERVER_ERROR);
+    }
+
+    // ===================
+    // Built-ins
+    // ===================
+
+    #[tokio::test]
+    async fn test_request_id() {
+        let chain = build(&["request-id".to_string()], echo()).unwrap();
+        let response = chain(Request::new(Body::empty())).await;
+        let generated = response.headers()[REQUEST_ID].to_str().unwrap();
+        assert!(!generated.is_empty());
+
+        let req = Request::builder()
+            .header(REQUEST_ID, "abc")
+            .body(Body::empty())
+            .unwrap();
+        let response = chain(req).await;
+        assert_eq!(response.headers()[REQUEST_ID], "abc");
+    }
+
+    #[tokio::test]
+    async fn test_hide_server() {
+        let app = handler(|_req: Request<Body>| async move {
+            let mut response = "ok".into_response();
+            let headers = response.headers_mut();
+            headers.insert("server", HeaderValue::from_static("gunicorn"));
+            headers.insert("x-powered-by", HeaderValue::from_static("Express"));
+            headers.insert("x-kept", HeaderValue::from_static("1"));
+            response
+        });
+        let chain = build(&["hide-server".to_string()], app).unwrap();
+        let response = chain(Request::new(Body::empty())).await;
+        assert!(response.headers().get("server").is_none());
+        assert!(response.headers().get("x-powered-by").is_none());
+        assert_eq!(response.headers()["x-kept"], "1");
+    }
+}
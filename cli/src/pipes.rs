@@ -0,0 +1,139 @@
+//! HTTP over named pipes, for Windows
+//!
+//! Stands in for `hyperlocal` where there are no Unix sockets: the same
+//! `UnixConnector` and `Uri`, but connecting to the named pipe
+//! [`tenement::sockets::connect`] opens for a socket path. Instances on
+//! Windows normally listen on a TCP port; this covers the ones that don't.
+
+use hyper::rt::{Read, ReadBufCursor, Write};
+use hyper_util::client::legacy::connect::{Connected, Connection};
+use hyper_util::rt::TokioIo;
+use std::future::Future;
+use std::io;
+use std::path::{Path, PathBuf};
+use std::pin::Pin;
+use std::task::{Context, Poll};
+use tenement::sockets::LocalStream;
+
+/// URI scheme naming a socket path, hex-encoded in the host as `hyperlocal` does
+const SCHEME: &str = "unix";
+
+/// A `hyper::Uri` for `path` on the socket at `socket`
+pub struct Uri(hyper::Uri);
+
+impl Uri {
+    pub fn new(socket: impl AsRef<Path>, path: &str) -> Self {
+        let host = hex(socket.as_ref().to_string_lossy().as_bytes());
+        let uri = format!("{}://{}:0{}", SCHEME, host, path);
+        let uri = uri
+            .parse()
+            .expect("a hex host and a request path make a valid URI");
+        Self(uri)
+    }
+}
+
+impl From<Uri> for hyper::Uri {
+    fn from(uri: Uri) -> Self {
+        uri.0
+    }
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+fn unhex(s: &str) -> Option<Vec<u8>> {
+    if s.len() % 2 != 0 {
+        return None;
+    }
+    (0..s.len())
+        .step_by(2)
+        .map(|i| u8::from_str_radix(s.get(i..i + 2)?, 16).ok())
+        .collect()
+}
+
+/// The socket path a [`Uri`] was made for
+fn socket_path(uri: &hyper::Uri) -> io::Result<PathBuf> {
+    let invalid = || io::Error::new(io::ErrorKind::InvalidInput, "not a socket URI");
+    if uri.scheme_str() != Some(SCHEME) {
+        return Err(invalid());
+    }
+    let bytes = uri.host().and_then(unhex).ok_or_else(invalid)?;
+    let path = String::from_utf8(bytes).map_err(|_| invalid())?;
+    Ok(PathBuf::from(path))
+}
+
+/// Connects a hyper client to the named pipe of a [`Uri`]'s socket
+#[derive(Clone, Copy, Debug, Default)]
+pub struct UnixConnector;
+
+impl tower::Service<hyper::Uri> for UnixConnector {
+    type Response = PipeStream;
+    type Error = io::Error;
+    type Future = Pin<Box<dyn Future<Output = io::Result<PipeStream>> + Send>>;
+
+    fn poll_ready(&mut self, _cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Poll::Ready(Ok(()))
+    }
+
+    fn call(&mut self, uri: hyper::Uri) -> Self::Future {
+        Box::pin(async move {
+            let path = socket_path(&uri)?;
+            let stream = tenement::sockets::connect(&path).await?;
+            Ok(PipeStream(TokioIo::new(stream)))
+        })
+    }
+}
+
+/// A connection made by [`UnixConnector`]
+pub struct PipeStream(TokioIo<LocalStream>);
+
+impl Connection for PipeStream {
+    fn connected(&self) -> Connected {
+        Connected::new()
+    }
+}
+
+impl Read for PipeStream {
+    fn poll_read(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: ReadBufCursor<'_>,
+    ) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.0).poll_read(cx, buf)
+    }
+}
+
+impl Write for PipeStream {
+    fn poll_write(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        Pin::new(&mut self.0).poll_write(cx, buf)
+    }
+
+    fn poll_flush(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.0).poll_flush(cx)
+    }
+
+    fn poll_shutdown(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.0).poll_shutdown(cx)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_uri_round_trips_socket_path() {
+        let socket = r"C:\tenement\api-prod.sock";
+        let uri = hyper::Uri::from(Uri::new(socket, "/health?full=1"));
+        assert_eq!(uri.path_and_query().unwrap(), "/health?full=1");
+        assert_eq!(socket_path(&uri).unwrap(), PathBuf::from(socket));
+
+        let plain: hyper::Uri = "http://localhost/health".parse().unwrap();
+        assert!(socket_path(&plain).is_err());
+    }
+}
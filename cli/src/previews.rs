@@ -0,0 +1,383 @@
+//! Preview environments
+//!
+//! A preview (`ten preview create api --branch feature/login`) is an extra
+//! instance of a service, built from a branch of its git repository or from
+//! an artifact, that answers only at its own subdomain: `{name}.{domain}`
+//! under the service's `[service.x.preview] domain`, or
+//! `{name}.{service}.{domain}` without one. It joins no weighted routing. The
+//! config store keeps a record of each one, and a reaper tears a preview down
+//! (instance, pin and checkout) once its TTL has passed.
+
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tenement::{ConfigStore, DeployLogStore, Hypervisor};
+
+/// Config store key holding the live previews
+const PREVIEWS_KEY: &str = "previews";
+
+/// Directory under the data dir previews are checked out or unpacked into
+const PREVIEWS_DIR_NAME: &str = ".previews";
+
+/// How often the reaper looks for expired previews
+const REAP_INTERVAL: Duration = Duration::from_secs(30);
+
+/// Held while the preview records are read and written back, so two changes
+/// at once don't lose one
+static RECORDS: tokio::sync::Mutex<()> = tokio::sync::Mutex::const_new(());
+
+/// A live preview environment
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Preview {
+    pub process: String,
+    /// Instance ID and subdomain label, e.g. "pr-123"
+    pub name: String,
+    /// Branch or commit it was built from
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub revision: Option<String>,
+    /// Full commit SHA, for git previews
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub sha: Option<String>,
+    /// Artifact URL, for artifact previews
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub artifact: Option<String>,
+    pub host: String,
+    pub url: String,
+    /// RFC 3339 time it was created
+    pub created_at: String,
+    /// RFC 3339 time it is torn down
+    pub expires_at: String,
+}
+
+impl Preview {
+    /// Whether its TTL has passed at `now`
+    pub fn expired(&self, now: chrono::DateTime<chrono::Utc>) -> bool {
+        chrono::DateTime::parse_from_rfc3339(&self.expires_at)
+            .map(|expires| expires <= now)
+            .unwrap_or(true)
+    }
+}
+
+/// Where a preview's source lives
+pub fn preview_dir(data_dir: &Path, process: &str, name: &str) -> PathBuf {
+    data_dir.join(PREVIEWS_DIR_NAME).join(process).join(name)
+}
+
+/// A new dir under a preview's dir to build a revision in, so a preview being
+/// replaced keeps running from its own files until the new build is ready
+pub fn build_dir(data_dir: &Path, process: &str, name: &str) -> PathBuf {
+    let stamp = chrono::Utc::now().format("%Y%m%d%H%M%S%3f").to_string();
+    preview_dir(data_dir, process, name).join(stamp)
+}
+
+/// Stop a preview's instance, if it runs, and remove its builds but `keep`
+pub async fn retire_builds(
+    hypervisor: &Hypervisor,
+    process: &str,
+    name: &str,
+    keep: &Path,
+) -> Result<()> {
+    if hypervisor.get(process, name).await.is_some() {
+        hypervisor.stop(process, name).await?;
+    }
+    let dir = preview_dir(&hypervisor.config().settings.data_dir, process, name);
+    let mut entries = tokio::fs::read_dir(&dir).await?;
+    while let Some(entry) = entries.next_entry().await? {
+        let path = entry.path();
+        if path == keep {
+            continue;
+        }
+        match entry.file_type().await?.is_dir() {
+            true => tokio::fs::remove_dir_all(&path).await?,
+            false => tokio::fs::remove_file(&path).await?,
+        }
+    }
+    Ok(())
+}
+
+/// A subdomain label for a revision, e.g. "feature/Login" -> "feature-login"
+pub fn name_for(revision: &str) -> String {
+    let mut name = String::new();
+    for c in revision.chars() {
+        if c.is_ascii_alphanumeric() {
+            name.push(c.to_ascii_lowercase());
+        } else if !name.ends_with('-') {
+            name.push('-');
+        }
+    }
+    name.truncate(63);
+    name.trim_matches('-').to_string()
+}
+
+/// Check a preview name can be both an instance ID and a DNS label
+pub fn validate_name(name: &str) -> Result<()> {
+    let valid_chars = name
+        .chars()
+        .all(|c| c.is_ascii_lowercase() || c.is_ascii_digit() || c == '-');
+    if name.is_empty()
+        || name.len() > 63
+        || !valid_chars
+        || name.starts_with('-')
+        || name.ends_with('-')
+    {
+        anyhow::bail!(
+            "Invalid preview name {:?}: use 1-63 lowercase letters, digits and '-'",
+            name
+        );
+    }
+    Ok(())
+}
+
+/// Live previews, oldest first
+pub async fn list(store: &ConfigStore) -> Result<Vec<Preview>> {
+    match store.get(PREVIEWS_KEY).await? {
+        Some(saved) => Ok(serde_json::from_str(&saved)?),
+        None => Ok(Vec::new()),
+    }
+}
+
+/// Record a preview, replacing one of the service with the same name
+pub async fn save(store: &ConfigStore, preview: &Preview) -> Result<()> {
+    let _records = RECORDS.lock().await;
+    let mut previews = list(store).await?;
+    previews.retain(|p| !(p.process == preview.process && p.name == preview.name));
+    previews.push(preview.clone());
+    store
+        .set(PREVIEWS_KEY, &serde_json::to_string(&previews)?)
+        .await
+}
+
+/// Forget a preview's record. Returns whether it existed.
+pub async fn remove(store: &ConfigStore, process: &str, name: &str) -> Result<bool> {
+    let _records = RECORDS.lock().await;
+    let mut previews = list(store).await?;
+    let before = previews.len();
+    previews.retain(|p| !(p.process == process && p.name == name));
+    if previews.len() == before {
+        return Ok(false);
+    }
+    if previews.is_empty() {
+        store.delete(PREVIEWS_KEY).await?;
+    } else {
+        store
+            .set(PREVIEWS_KEY, &serde_json::to_string(&previews)?)
+            .await?;
+    }
+    Ok(true)
+}
+
+/// Stop a preview's instance and remove its pin, source and record
+pub async fn tear_down(
+    hypervisor: &Hypervisor,
+    store: &ConfigStore,
+    process: &str,
+    name: &str,
+) -> Result<()> {
+    if hypervisor.get(process, name).await.is_some() {
+        hypervisor.stop(process, name).await?;
+    }
+    hypervisor.unpin_release(process, name).await;
+    let dir = preview_dir(&hypervisor.config().settings.data_dir, process, name);
+    if dir.exists() {
+        tokio::fs::remove_dir_all(&dir).await?;
+    }
+    remove(store, process, name).await?;
+    Ok(())
+}
+
+/// Tear down every preview whose TTL passed by `now`; returns them
+pub async fn reap(
+    hypervisor: &Hypervisor,
+    store: &ConfigStore,
+    now: chrono::DateTime<chrono::Utc>,
+) -> Result<Vec<Preview>> {
+    let mut reaped = Vec::new();
+    for preview in list(store).await? {
+        if !preview.expired(now) {
+            continue;
+        }
+        match tear_down(hypervisor, store, &preview.process, &preview.name).await {
+            Ok(()) => reaped.push(preview),
+            Err(e) => tracing::error!(
+                "Tearing down preview {}:{} failed: {:#}",
+                preview.process,
+                preview.name,
+                e
+            ),
+        }
+    }
+    Ok(reaped)
+}
+
+/// Tear down previews as their TTLs pass, noting each in the deploy log
+pub fn spawn_reaper(
+    hypervisor: Arc<Hypervisor>,
+    store: Arc<ConfigStore>,
+    deploy_log: Arc<DeployLogStore>,
+) -> tokio::task::JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(REAP_INTERVAL);
+        loop {
+            interval.tick().await;
+            let reaped = match reap(&hypervisor, &store, chrono::Utc::now()).await {
+                Ok(reaped) => reaped,
+                Err(e) => {
+                    tracing::error!("Failed to read previews: {:#}", e);
+                    continue;
+                }
+            };
+            for preview in reaped {
+                tracing::info!("Preview {}:{} expired", preview.process, preview.name);
+                if let Err(e) = deploy_log
+                    .log(
+                        "preview-expire",
+                        &preview.process,
+                        &preview.name,
+                        None,
+                        true,
+                    )
+                    .await
+                {
+                    tracing::error!("Audit log failed: {}", e);
+                }
+            }
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    async fn test_store() -> (Arc<ConfigStore>, tempfile::TempDir) {
+        let dir = tempfile::tempdir().unwrap();
+        let pool = tenement::init_db(&dir.path().join("test.db"))
+            .await
+            .unwrap();
+        (Arc::new(ConfigStore::new(pool)), dir)
+    }
+
+    fn preview(process: &str, name: &str, expires_at: &str) -> Preview {
+        Preview {
+            process: process.to_string(),
+            name: name.to_string(),
+            revision: Some("main".to_string()),
+            sha: None,
+            artifact: None,
+            host: format!("{}.{}.example.com", name, process),
+            url: format!("http://{}.{}.example.com", name, process),
+            created_at: "2026-01-01T00:00:00Z".to_string(),
+            expires_at: expires_at.to_string(),
+        }
+    }
+
+    // ===================
+    // Names
+    // ===================
+
+    #[test]
+    fn test_name_for_revision() {
+        assert_eq!(name_for("feature/Login"), "feature-login");
+        assert_eq!(name_for("pr-123"), "pr-123");
+        assert_eq!(name_for("--fix__it--"), "fix-it");
+        assert_eq!(name_for(&"a".repeat(80)).len(), 63);
+        assert!(validate_name(&name_for("feature/Login")).is_ok());
+    }
+
+    #[test]
+    fn test_validate_name() {
+        assert!(validate_name("pr-123").is_ok());
+        assert!(validate_name("").is_err());
+        assert!(validate_name("PR-1").is_err());
+        assert!(validate_name("-pr").is_err());
+        assert!(validate_name("pr.1").is_err());
+        assert!(validate_name(&"a".repeat(64)).is_err());
+    }
+
+    // ===================
+    // Records and expiry
+    // ===================
+
+    #[tokio::test]
+    async fn test_save_list_remove() {
+        let (store, _dir) = test_store().await;
+        assert!(list(&store).await.unwrap().is_empty());
+
+        let first = preview("api", "pr-1", "2026-01-02T00:00:00Z");
+        save(&store, &first).await.unwrap();
+        save(&store, &preview("web", "pr-1", "2026-01-02T00:00:00Z"))
+            .await
+            .unwrap();
+        // Same service and name replaces the record
+        let rebuilt = preview("api", "pr-1", "2026-01-03T00:00:00Z");
+        save(&store, &rebuilt).await.unwrap();
+        let previews = list(&store).await.unwrap();
+        assert_eq!(previews.len(), 2);
+        assert_eq!(previews[1], rebuilt);
+
+        assert!(remove(&store, "api", "pr-1").await.unwrap());
+        assert!(!remove(&store, "api", "pr-1").await.unwrap());
+        assert!(remove(&store, "web", "pr-1").await.unwrap());
+        assert!(store.get(PREVIEWS_KEY).await.unwrap().is_none());
+    }
+
+    #[tokio::test]
+    async fn test_concurrent_saves_keep_every_record() {
+        let (store, _dir) = test_store().await;
+        let saves = (0..10).map(|i| {
+            let store = store.clone();
+            tokio::spawn(async move {
+                let name = format!("pr-{}", i);
+                save(&store, &preview("api", &name, "2026-01-02T00:00:00Z")).await
+            })
+        });
+        for saved in futures::future::join_all(saves).await {
+            saved.unwrap().unwrap();
+        }
+        assert_eq!(list(&store).await.unwrap().len(), 10);
+    }
+
+    #[tokio::test]
+    async fn test_retire_builds_keeps_the_new_one() {
+        let dir = tempfile::tempdir().unwrap();
+        let mut config = tenement::Config::default();
+        config.settings.data_dir = dir.path().to_path_buf();
+        let hypervisor = Hypervisor::new(config);
+        let old = build_dir(dir.path(), "api", "pr-1");
+        std::fs::create_dir_all(&old).unwrap();
+        std::thread::sleep(Duration::from_millis(2));
+        let new = build_dir(dir.path(), "api", "pr-1");
+        std::fs::create_dir_all(&new).unwrap();
+
+        retire_builds(&hypervisor, "api", "pr-1", &new)
+            .await
+            .unwrap();
+        assert!(!old.exists());
+        assert!(new.exists());
+    }
+
+    #[tokio::test]
+    async fn test_reap_expired() {
+        let (store, dir) = test_store().await;
+        let mut config = tenement::Config::default();
+        config.settings.data_dir = dir.path().to_path_buf();
+        let hypervisor = Hypervisor::new(config);
+
+        let old = preview("api", "pr-1", "2026-01-01T12:00:00Z");
+        let fresh = preview("api", "pr-2", "2026-01-03T00:00:00Z");
+        save(&store, &old).await.unwrap();
+        save(&store, &fresh).await.unwrap();
+        let source = preview_dir(dir.path(), "api", "pr-1");
+        std::fs::create_dir_all(&source).unwrap();
+
+        let now = "2026-01-02T00:00:00Z".parse().unwrap();
+        assert!(old.expired(now));
+        assert!(!fresh.expired(now));
+        let reaped = reap(&hypervisor, &store, now).await.unwrap();
+        assert_eq!(reaped, vec![old]);
+        assert_eq!(list(&store).await.unwrap(), vec![fresh]);
+        assert!(!source.exists());
+    }
+}
@@ -1,5 +1,8 @@
 //! HTTP server with subdomain routing, reverse proxy, and automatic TLS
 
+#[cfg(windows)]
+use crate::pipes::Uri as SocketUri;
+use crate::upstream_pool::{UpstreamClient, UpstreamPools};
 use anyhow::{Context, Result};
 use axum::{
     body::Body,
@@ -13,19 +16,39 @@ use axum::{
     routing::get,
     Router,
 };
+use axum_server::tls_rustls::{RustlsAcceptor, RustlsConfig};
 use futures::stream::Stream;
 use hyper_util::{client::legacy::Client, rt::TokioExecutor};
-use hyperlocal::UnixConnector;
-use rustls_acme::{caches::DirCache, AcmeConfig};
+#[cfg(unix)]
+use hyperlocal::Uri as SocketUri;
+use rustls::server::ResolvesServerCert;
+use rustls_acme::{caches::DirCache, AcmeConfig, EventOk};
 use serde::{Deserialize, Serialize};
 use std::convert::Infallible;
 use std::net::SocketAddr;
 use std::path::{Path, PathBuf};
 use std::sync::Arc;
-use tenement::{ConfigStore, Hypervisor, LogLevel, LogQuery, TokenStore};
+use tenement::access::AccessConfig;
+use tenement::cluster::{HOP_HEADER, TOKEN_HEADER};
+use tenement::config::{
+    AcmeChallenge, BackendProtocol, ClusterMode, CompressionConfig, DnsChallengeConfig,
+    DnsProvider, Encoding, GzipLevel,
+};
+use tenement::events::{Event as LifecycleEvent, EventFilter, EventKind};
+use tenement::headers::{ForwardedHeaders, HeaderRules, FORWARDED_HEADERS, HSTS, SECURITY_HEADERS};
+use tenement::response_cache::{CacheControl, CachedResponse, Hit, ResponseCache};
+use tenement::routing::{Mirror, Route};
+use tenement::telemetry::{Span, SpanKind, TraceContext, TRACEPARENT};
+use tenement::{
+    AdminTokens, ConfigStore, Hypervisor, LogEntry, LogLevel, LogQuery, RouteTarget, Scope,
+    TokenStore,
+};
 use tokio_stream::wrappers::BroadcastStream;
 use tokio_stream::StreamExt;
+use tower_http::catch_panic::CatchPanicLayer;
+use tower_http::compression::CompressionLayer;
 use tower_http::trace::TraceLayer;
+use tower_http::CompressionLevel;
 
 /// TLS configuration for the server
 #[derive(Debug, Clone)]
@@ -37,6 +60,36 @@ pub struct TlsOptions {
     pub staging: bool,
     pub https_port: u16,
     pub http_port: u16,
+    /// Seconds between session ticket key rotations
+    pub ticket_rotation_secs: u64,
+    /// Retired ticket keys still accepted for resumption
+    pub ticket_keys_retained: usize,
+    /// Service `domains` from tenement.toml, added to the certificate
+    pub extra_domains: Vec<String>,
+    /// Wildcard names issued over DNS-01 instead (`[settings.tls] wildcard_domains`)
+    pub wildcard_domains: Vec<String>,
+    /// The provider answering DNS-01 challenges, and how
+    pub dns: Option<(DnsProvider, DnsChallengeConfig)>,
+    /// How the certificate for `domain` and the extra domains is validated
+    pub challenge: AcmeChallenge,
+}
+
+impl TlsOptions {
+    /// Names on the certificate: `domain` first, then each extra domain once,
+    /// leaving out those a wildcard certificate already covers
+    pub fn certificate_domains(&self) -> Vec<String> {
+        let mut domains = vec![self.domain.clone()];
+        for extra in &self.extra_domains {
+            let extra = extra.trim().trim_end_matches('.').to_ascii_lowercase();
+            if crate::acme_dns::covers(&self.wildcard_domains, &extra) {
+                continue;
+            }
+            if !extra.is_empty() && !domains.iter().any(|d| d.eq_ignore_ascii_case(&extra)) {
+                domains.push(extra);
+            }
+        }
+        domains
+    }
 }
 
 /// TLS status information for the status endpoint
@@ -54,11 +107,20 @@ pub struct TlsStatus {
 pub struct AppState {
     pub hypervisor: Arc<Hypervisor>,
     pub domain: String,
-    pub client: Client<hyper_util::client::legacy::connect::HttpConnector, Body>,
-    pub unix_client: Client<UnixConnector, Body>,
+    pub client: Client<WarmConnector, Body>,
+    /// HTTP/2 (prior knowledge) client, for `protocol = "h2c"` and `"grpc"` services
+    pub h2_client: Client<WarmConnector, Body>,
+    /// Keep-alive clients for instances on Unix sockets, one per service
+    pub upstream_pools: Arc<UpstreamPools>,
     pub config_store: Arc<ConfigStore>,
     pub deploy_log: Arc<tenement::DeployLogStore>,
+    /// Numbered deploys of each service, for `tenement releases` and rollbacks
+    pub releases: Arc<dyn tenement::ReleaseBackend>,
     pub tenant_tokens: Arc<tenement::TenantTokenStore>,
+    /// Named tokens with a read, deploy or admin scope
+    pub api_tokens: Arc<tenement::ApiTokenStore>,
+    /// Admin tokens from `settings.admin_tokens_file` (swapped on reload)
+    pub admin_tokens: Arc<AdminTokens>,
     pub tls_status: TlsStatus,
     /// Tracks failed auth attempts for rate limiting.
     /// Stores (failure_count, last_failure_time). Resets after cooldown.
@@ -68,29 +130,100 @@ pub struct AppState {
 /// Authenticated caller identity, injected by auth middleware into request extensions.
 /// Admin token: tenant_id is None (full access).
 /// Tenant token: tenant_id is Some("alice") (scoped access).
+/// Named API token: tenant_id is None and `scope` limits what it can do.
 #[derive(Clone, Debug)]
 pub struct AuthIdentity {
     pub tenant_id: Option<String>,
+    /// What the caller may do (tenant tokens are limited by tenant_id instead)
+    pub scope: Scope,
+    /// Who is calling, for the audit log ("admin", "token:ci", "tenant:alice", ...)
+    pub name: String,
+}
+
+impl AuthIdentity {
+    /// Full access, as the admin token has
+    pub fn admin(name: &str) -> Self {
+        Self {
+            tenant_id: None,
+            scope: Scope::Admin,
+            name: name.to_string(),
+        }
+    }
 }
 
 /// Create the router (exposed for testing)
 pub fn create_router(state: AppState) -> Router {
-    Router::new()
-        // Dashboard/API routes (root domain)
-        .route("/", get(dashboard))
+    let router = match state.hypervisor.dashboard().on_public_listener() {
+        true => Router::new()
+            .route("/", get(dashboard))
+            .route("/assets/*path", get(dashboard_asset)),
+        false => Router::new(),
+    };
+    router
+        // API routes (root domain)
         .route("/health", get(health))
         .route("/metrics", get(metrics_endpoint))
+        // Heartbeats between cluster nodes (cluster token, not API tokens)
+        .route("/cluster/state", get(crate::cluster::cluster_state))
+        .merge(api_routes())
+        // `git push` deploys over smart HTTP
+        .route(
+            "/git/:repo/info/refs",
+            get(crate::api_routes::get_git_info_refs),
+        )
+        .route(
+            "/git/:repo/git-receive-pack",
+            axum::routing::post(crate::api_routes::post_git_receive_pack)
+                .layer(axum::extract::DefaultBodyLimit::max(GIT_PUSH_LIMIT)),
+        )
+        // Fallback handles subdomain routing (for non-subdomain 404s)
+        .fallback(handle_request)
+        // Middleware layers are applied inside-out:
+        // - CatchPanicLayer runs first (outermost) so a panicking handler
+        //   becomes a 500 instead of dropping the connection
+        // - TraceLayer runs second
+        // - reject_malformed runs third (400 before any routing)
+        // - subdomain_middleware runs fourth (intercepts subdomains before auth)
+        // - auth_middleware runs fifth for non-subdomain requests
+        // - scope_middleware runs last (token scopes and the audit log)
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            scope_middleware,
+        ))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            auth_middleware,
+        ))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            subdomain_middleware,
+        ))
+        .layer(middleware::from_fn(reject_malformed))
+        .layer(TraceLayer::new_for_http())
+        .layer(CatchPanicLayer::custom(handle_panic))
+        .with_state(state)
+}
+
+/// The `/api` routes, shared by the public listener and the admin socket
+fn api_routes() -> Router<AppState> {
+    Router::new()
         .route("/api/telemetry", get(telemetry_endpoint))
+        .route("/api/stats", get(stats_endpoint))
         .route("/api/instances", get(list_instances))
+        .route("/api/jobs", get(list_jobs))
         .route(
             "/api/instances/spawn",
             axum::routing::post(crate::api_routes::post_spawn),
         )
         .route(
             "/api/instances/:id",
-            axum::routing::delete(crate::api_routes::delete_instance),
+            get(crate::api_routes::get_instance).delete(crate::api_routes::delete_instance),
         )
         .route("/api/instances/:id/storage", get(get_instance_storage))
+        .route(
+            "/api/instances/:id/env",
+            get(crate::api_routes::get_instance_env),
+        )
         .route(
             "/api/instances/:id/restart",
             axum::routing::post(crate::api_routes::post_restart),
@@ -107,35 +240,198 @@ pub fn create_router(state: AppState) -> Router {
             "/api/deploy",
             axum::routing::post(crate::api_routes::post_deploy),
         )
+        .route(
+            "/api/rollback",
+            axum::routing::post(crate::api_routes::post_rollback),
+        )
+        .route(
+            "/api/releases/:process",
+            get(crate::api_routes::get_releases),
+        )
+        .route(
+            "/api/git/:process/deploy",
+            axum::routing::post(crate::api_routes::post_git_deploy),
+        )
         .route(
             "/api/route",
             axum::routing::post(crate::api_routes::post_route),
         )
+        .route(
+            "/api/auth/reload",
+            axum::routing::post(crate::api_routes::post_auth_reload),
+        )
+        .route(
+            "/api/maintenance/:process",
+            axum::routing::put(crate::api_routes::put_maintenance),
+        )
+        .route(
+            "/api/drain/:process",
+            axum::routing::post(crate::api_routes::post_drain),
+        )
+        .route("/api/stacks", get(crate::api_routes::get_stacks))
+        .route(
+            "/api/stacks/:stack/restart",
+            axum::routing::post(crate::api_routes::post_stack_restart),
+        )
+        .route(
+            "/api/stacks/:stack/deploy",
+            axum::routing::post(crate::api_routes::post_stack_deploy),
+        )
+        .route(
+            "/api/faults",
+            get(crate::api_routes::get_faults).put(crate::api_routes::put_faults),
+        )
+        .route(
+            "/api/faults/:process",
+            axum::routing::put(crate::api_routes::put_service_fault)
+                .delete(crate::api_routes::delete_service_fault),
+        )
+        .route(
+            "/api/webhooks",
+            get(crate::api_routes::get_webhooks).post(crate::api_routes::post_webhook),
+        )
+        .route(
+            "/api/webhooks/:id",
+            axum::routing::delete(crate::api_routes::delete_webhook),
+        )
+        .route("/api/cluster", get(crate::api_routes::get_cluster))
+        .route(
+            "/api/previews",
+            get(crate::api_routes::get_previews).post(crate::api_routes::post_preview),
+        )
+        .route(
+            "/api/previews/:process/:name",
+            axum::routing::delete(crate::api_routes::delete_preview),
+        )
+        .route("/api/reload", axum::routing::post(crate::api_routes::post_reload))
+        .route(
+            "/api/reload/plan",
+            axum::routing::post(crate::api_routes::post_reload_plan),
+        )
+        .route("/api/upgrade", axum::routing::post(crate::api_routes::post_upgrade))
+        .route("/api/deploys", get(crate::api_routes::get_deploys))
+        .route("/api/audit", get(crate::api_routes::get_audit))
+        .route("/api/events", get(recent_events))
+        .route("/api/events/stream", get(stream_events))
         .route("/api/logs", get(query_logs))
         .route("/api/logs/stream", get(stream_logs))
         .route("/api/tls/status", get(tls_status_endpoint))
-        // Dashboard static assets
+}
+
+/// Router for the dashboard's own address (`settings.dashboard.listen`): the
+/// dashboard pages and the token-protected `/api` routes it uses
+pub fn dashboard_router(state: AppState) -> Router {
+    api_routes()
+        .route("/", get(dashboard))
         .route("/assets/*path", get(dashboard_asset))
-        // Fallback handles subdomain routing (for non-subdomain 404s)
-        .fallback(handle_request)
-        // Middleware layers are applied inside-out:
-        // - TraceLayer runs first (outermost)
-        // - subdomain_middleware runs second (intercepts subdomains before auth)
-        // - auth_middleware runs last for non-subdomain requests
+        .route("/health", get(health))
+        .layer(middleware::from_fn_with_state(
+            state.clone(),
+            scope_middleware,
+        ))
         .layer(middleware::from_fn_with_state(
             state.clone(),
             auth_middleware,
         ))
+        .layer(TraceLayer::new_for_http())
+        .layer(CatchPanicLayer::custom(handle_panic))
+        .with_state(state)
+}
+
+/// Router for the admin socket: the `/api` routes and `/health`, with no token
+/// auth or subdomain routing. The socket's file mode is the access control.
+pub fn admin_router(state: AppState) -> Router {
+    let router = api_routes().route("/health", get(health)).route(
+        "/api/instances/:id/attach",
+        get(crate::api_routes::attach_instance),
+    );
+    #[cfg(unix)]
+    let router = router.route(
+        "/api/instances/:id/exec",
+        axum::routing::post(crate::api_routes::exec_instance),
+    );
+    router
         .layer(middleware::from_fn_with_state(
             state.clone(),
-            subdomain_middleware,
+            scope_middleware,
         ))
+        .layer(middleware::from_fn(local_admin))
         .layer(TraceLayer::new_for_http())
+        .layer(CatchPanicLayer::custom(handle_panic))
         .with_state(state)
 }
 
-/// Wait for shutdown signal (SIGTERM or SIGINT), then stop all instances.
-async fn shutdown_signal(hypervisor: Arc<Hypervisor>) {
+/// Admin socket requests act as the admin token would
+async fn local_admin(mut req: Request<Body>, next: Next) -> Response {
+    req.extensions_mut()
+        .insert(AuthIdentity::admin("admin-socket"));
+    next.run(req).await
+}
+
+/// Reject requests hyper accepts but tenement can't route or proxy.
+/// Unparseable request lines and headers never get this far: hyper answers
+/// those with 400 itself and keeps the listener running.
+async fn reject_malformed(req: Request<Body>, next: Next) -> Response {
+    match validate_request(&req) {
+        Ok(()) => next.run(req).await,
+        Err(reason) => {
+            tracing::warn!(
+                method = %req.method(),
+                uri = %req.uri(),
+                "Rejected malformed request: {}",
+                reason
+            );
+            (StatusCode::BAD_REQUEST, format!("Bad request: {}", reason)).into_response()
+        }
+    }
+}
+
+/// Check a request is something tenement can route
+fn validate_request(req: &Request<Body>) -> std::result::Result<(), &'static str> {
+    if req.method() == axum::http::Method::CONNECT {
+        return Err("CONNECT is not supported");
+    }
+    if !req.uri().path().starts_with('/') {
+        return Err("request target must be a path");
+    }
+
+    let mut hosts = req.headers().get_all(axum::http::header::HOST).iter();
+    if let Some(host) = hosts.next() {
+        let valid = host
+            .to_str()
+            .map(|h| !h.is_empty() && !h.contains(|c: char| c.is_whitespace() || c == '/'))
+            .unwrap_or(false);
+        if !valid {
+            return Err("invalid Host header");
+        }
+    }
+    if hosts.next().is_some() {
+        return Err("multiple Host headers");
+    }
+    Ok(())
+}
+
+/// Turn a handler panic into a 500 so one bad request can't take down its connection
+fn handle_panic(err: Box<dyn std::any::Any + Send + 'static>) -> Response {
+    let detail = if let Some(s) = err.downcast_ref::<String>() {
+        s.clone()
+    } else if let Some(s) = err.downcast_ref::<&str>() {
+        s.to_string()
+    } else {
+        "unknown panic".to_string()
+    };
+    tracing::error!("Request handler panicked: {}", detail);
+    (
+        StatusCode::INTERNAL_SERVER_ERROR,
+        "Internal server error".to_string(),
+    )
+        .into_response()
+}
+
+/// Wait for shutdown signal (SIGTERM or SIGINT; on Windows Ctrl+C or the console
+/// closing) or an upgrade's hand-off, then stop all instances. Returns when the
+/// signal arrived, which starts the shutdown deadline.
+async fn shutdown_signal(hypervisor: Arc<Hypervisor>) -> std::time::Instant {
     let ctrl_c = async {
         tokio::signal::ctrl_c()
             .await
@@ -150,24 +446,140 @@ async fn shutdown_signal(hypervisor: Arc<Hypervisor>) {
             .await;
     };
 
-    #[cfg(not(unix))]
+    // No SIGTERM on Windows: closing the console or shutting down stands in
+    #[cfg(windows)]
+    let terminate = async {
+        use tokio::signal::windows::{ctrl_close, ctrl_shutdown};
+        let mut close = ctrl_close().expect("failed to install close handler");
+        let mut shutdown = ctrl_shutdown().expect("failed to install shutdown handler");
+        tokio::select! {
+            _ = close.recv() => {}
+            _ = shutdown.recv() => {}
+        }
+    };
+
+    #[cfg(not(any(unix, windows)))]
     let terminate = std::future::pending::<()>();
 
+    let drain_file = async {
+        match hypervisor.drain_file() {
+            Some(path) => wait_for_drain_file(&hypervisor, path, DRAIN_FILE_POLL).await,
+            None => std::future::pending().await,
+        }
+    };
+
     tokio::select! {
         _ = ctrl_c => {
             tracing::info!("Received Ctrl+C, shutting down");
         },
+        _ = hypervisor.handed_off() => {
+            tracing::info!("Handed over to the upgraded tenement, shutting down");
+        },
         _ = terminate => {
             tracing::info!("Received SIGTERM, shutting down");
         },
+        _ = drain_file => {
+            tracing::info!("Drain file: connections drained, shutting down");
+        },
     }
 
+    // After a hand-off the new supervisor is systemd's main process, and
+    // stop_all leaves the instances to it
+    if !hypervisor.is_handed_off() {
+        crate::systemd::stopping();
+    }
+    let started = std::time::Instant::now();
     hypervisor.stop_all().await;
+    started
+}
+
+/// How often the drain file is checked
+const DRAIN_FILE_POLL: std::time::Duration = std::time::Duration::from_millis(250);
+
+/// Largest pack a smart HTTP `git push` may send
+const GIT_PUSH_LIMIT: usize = 512 * 1024 * 1024;
+
+/// Served for a service in maintenance mode that has no `maintenance_page`
+const MAINTENANCE_PAGE: &str = "<!DOCTYPE html>
+<html>
+<head><meta charset=\"utf-8\"><title>Down for maintenance</title></head>
+<body>
+<h1>Down for maintenance</h1>
+<p>We'll be back shortly. Please try again in a few minutes.</p>
+</body>
+</html>
+";
+
+/// Key in the config store of the services in maintenance mode, so it
+/// outlasts a restart
+const MAINTENANCE_KEY: &str = "maintenance";
+
+/// Resolve once a drain started by creating `path` has drained proxied connections
+/// (or run out of `shutdown_timeout_secs`). Deleting the file before then cancels
+/// the drain. A file already present at startup is ignored until it's recreated,
+/// so a leftover file can't put a restarted daemon into a shutdown loop.
+async fn wait_for_drain_file(hypervisor: &Hypervisor, path: &Path, poll: std::time::Duration) {
+    if path.exists() {
+        tracing::warn!(
+            "Drain file {} already exists; ignoring it until it's removed and created again",
+            path.display()
+        );
+        while path.exists() {
+            tokio::time::sleep(poll).await;
+        }
+    }
+
+    loop {
+        while !path.exists() {
+            tokio::time::sleep(poll).await;
+        }
+        tracing::info!("Drain file {} created; draining connections", path.display());
+        hypervisor.set_draining(true);
+
+        let give_up = std::time::Instant::now() + hypervisor.shutdown_timeout();
+        loop {
+            if !path.exists() {
+                hypervisor.set_draining(false);
+                tracing::info!("Drain file {} removed; drain cancelled", path.display());
+                break;
+            }
+            let active = hypervisor.total_active_connections().await;
+            if active == 0 {
+                return;
+            }
+            if std::time::Instant::now() >= give_up {
+                tracing::warn!(
+                    "{} connection(s) still open at the drain deadline; shutting down anyway",
+                    active
+                );
+                return;
+            }
+            tokio::time::sleep(poll).await;
+        }
+    }
+}
+
+/// Resolve once the shutdown deadline passes, so open connections (e.g. log
+/// streams) can't keep the server alive after every instance has stopped.
+async fn shutdown_deadline(
+    started: tokio::sync::oneshot::Receiver<std::time::Instant>,
+    deadline: std::time::Duration,
+) {
+    match started.await {
+        Ok(started) => {
+            tokio::time::sleep_until(tokio::time::Instant::from_std(started + deadline)).await;
+            tracing::warn!(
+                "Connections still open at the {:?} shutdown deadline; exiting",
+                deadline
+            );
+        }
+        // Server finished on its own before a signal arrived
+        Err(_) => std::future::pending().await,
+    }
 }
 
 /// Constant-time byte comparison to prevent timing attacks on token verification
-#[allow(dead_code)]
-fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+pub(crate) fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
     if a.len() != b.len() {
         return false;
     }
@@ -185,17 +597,37 @@ fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
 /// Non-subdomain requests continue to the normal route handlers.
 async fn subdomain_middleware(
     State(state): State<AppState>,
-    req: Request<Body>,
+    mut req: Request<Body>,
     next: Next,
 ) -> Response {
+    // HTTP/2 clients (gRPC included) send the host as :authority, not a Host header
+    if !req.headers().contains_key(axum::http::header::HOST) {
+        let authority = req
+            .uri()
+            .authority()
+            .and_then(|authority| axum::http::HeaderValue::from_str(authority.as_str()).ok());
+        if let Some(authority) = authority {
+            req.headers_mut().insert(axum::http::header::HOST, authority);
+        }
+    }
     let host = req
         .headers()
         .get("host")
         .and_then(|h| h.to_str().ok())
         .unwrap_or("");
 
+    // Preview environments answer at {name}.{preview domain}
+    let preview = state
+        .hypervisor
+        .config()
+        .preview_host(split_host_port(host).0)
+        .map(|(process, name)| (process.to_string(), name.to_string()));
+    if let Some((process, name)) = preview {
+        return proxy_to_instance(&state, &process, Some(&name), req).await;
+    }
+
     // Check if this is a subdomain request
-    match parse_subdomain(host, &state.domain) {
+    match subdomain_route(&state, host) {
         Some(SubdomainRoute::Direct { process, id }) => {
             // Direct route to specific instance: :id.{process}.{domain}
             proxy_to_instance(&state, &process, Some(&id), req).await
@@ -205,88 +637,613 @@ async fn subdomain_middleware(
             proxy_to_instance(&state, &process, None, req).await
         }
         None => {
-            // Not a subdomain request - continue to normal routes
-            next.run(req).await
+            // Built-in endpoints always take priority over configured path routes
+            if is_builtin_path(req.uri().path()) {
+                return next.run(req).await;
+            }
+
+            let matched = state
+                .hypervisor
+                .routes()
+                .resolve_for_host(Some(host), req.uri().path())
+                .map(|m| (m.route.clone(), m.rest.to_string()));
+            match matched {
+                Some((route, rest)) => {
+                    let start = std::time::Instant::now();
+                    let request_line = route
+                        .slo_target
+                        .map(|_| format!("{} {}", req.method(), req.uri().path()));
+                    let dispatch = |req| dispatch_route(&state, &route, &rest, req);
+                    let response = match route.gzip_level {
+                        Some(level) => gzip_response(level, req, dispatch).await,
+                        None => dispatch(req).await,
+                    };
+                    if let Some(request_line) = request_line {
+                        let metrics = state.hypervisor.metrics();
+                        record_slo(&metrics, &route, &request_line, start.elapsed(), &response)
+                            .await;
+                    }
+                    response
+                }
+                // Not a routed request - continue to normal routes
+                None => next.run(req).await,
+            }
         }
     }
 }
 
-/// Auth middleware - requires Bearer token for API endpoints
-async fn auth_middleware(
-    State(state): State<AppState>,
+/// Send a routed request to its service or static directory, applying the
+/// route's header rules on the way there and back
+async fn dispatch_route(
+    state: &AppState,
+    route: &Route,
+    rest: &str,
     mut req: Request<Body>,
-    next: Next,
-) -> Result<Response, StatusCode> {
-    let path = req.uri().path();
+) -> Response {
+    if let Some(access) = &route.access {
+        if let Some(denied) = check_access(state, access, &route.prefix, &mut req).await {
+            return denied;
+        }
+    }
+    // The route's own faults; its service's are applied when proxying
+    let fault = route
+        .fault
+        .as_ref()
+        .filter(|_| state.hypervisor.fault_injection_enabled());
+    if let Some(fault) = fault {
+        if let Some(aborted) = inject_fault(fault, &route.prefix).await {
+            return aborted;
+        }
+    }
+    let mut response = match &route.target {
+        RouteTarget::Service(process) => {
+            apply_request_headers(req.headers_mut(), &route.request_headers);
+            if let Some(path) = route.rewrite_path(rest) {
+                if let Err(e) = rewrite_request_path(&mut req, &path, &route.prefix) {
+                    tracing::warn!(
+                        "Cannot rewrite {} for route '{}': {}",
+                        path,
+                        route.prefix,
+                        e
+                    );
+                    return (StatusCode::BAD_REQUEST, "Bad request").into_response();
+                }
+            }
+            if let Some(mirror) = route.mirror.as_ref().filter(|mirror| mirror.sample()) {
+                req = match mirror_request(state, mirror, req).await {
+                    Ok(req) => req,
+                    Err(e) => {
+                        tracing::debug!("Cannot read body to mirror: {}", e);
+                        return (StatusCode::BAD_REQUEST, "Bad request").into_response();
+                    }
+                };
+            }
+            proxy_to_instance(state, process, None, req).await
+        }
+        RouteTarget::Static(dir) => {
+            strip_accepted_credentials(&mut req);
+            serve_static(dir, rest).await
+        }
+    };
+    let https = state.tls_status.enabled;
+    apply_response_headers(response.headers_mut(), &route.response_headers, https);
+    response
+}
 
-    // Skip auth for public endpoints
-    if path == "/health"
-        || path == "/metrics"
-        || path == "/api/telemetry"
-        || path == "/"
-        || path.starts_with("/assets/")
-    {
-        return Ok(next.run(req).await);
+/// Apply one roll of `fault` to a request: sleep out any delay, and return
+/// the response to send instead of proxying when it's aborted
+async fn inject_fault(fault: &tenement::fault::FaultConfig, scope: &str) -> Option<Response> {
+    let decision = fault.decide();
+    if let Some(delay) = decision.delay {
+        tracing::debug!("injecting {:?} delay into {}", delay, scope);
+        tokio::time::sleep(delay).await;
     }
+    let status = decision.abort?;
+    tracing::debug!("injecting {} abort into {}", status, scope);
+    let status = StatusCode::from_u16(status).unwrap_or(StatusCode::SERVICE_UNAVAILABLE);
+    Some(
+        (
+            status,
+            [("x-tenement-fault", "abort")],
+            "Fault injected".to_string(),
+        )
+            .into_response(),
+    )
+}
 
-    // Subdomain requests are handled by subdomain_middleware before reaching here
-    // so we don't need to check for subdomains in auth
+/// Largest request body copied to a route's mirror; bigger ones aren't mirrored
+const MAX_MIRROR_BODY: u64 = 1024 * 1024;
 
-    // Extract token from Authorization header
-    let auth_header = req
-        .headers()
-        .get("authorization")
-        .and_then(|v| v.to_str().ok());
+/// Most mirrored requests in flight at once, across routes
+const MAX_MIRRORS: usize = 256;
 
-    let token = match auth_header {
-        Some(h) if h.to_lowercase().starts_with("bearer ") => &h[7..],
-        _ => {
-            tracing::debug!("Missing or invalid Authorization header");
-            return Err(StatusCode::UNAUTHORIZED);
+/// Mirrored requests in flight. A slow mirror fills it up and further copies
+/// are dropped, rather than piling up tasks and buffered bodies.
+static MIRRORS: tokio::sync::Semaphore = tokio::sync::Semaphore::const_new(MAX_MIRRORS);
+
+/// Send a copy of `req` to `mirror` in the background, discarding the answer,
+/// and return the request to proxy as usual. The body is buffered to copy it,
+/// so upgrades and bodies that are large or of unknown length aren't mirrored,
+/// and neither is anything while [`MAX_MIRRORS`] copies are still in flight.
+async fn mirror_request(
+    state: &AppState,
+    mirror: &Mirror,
+    req: Request<Body>,
+) -> Result<Request<Body>> {
+    if requested_upgrade(req.headers()).is_some() {
+        return Ok(req);
+    }
+    let Ok(permit) = MIRRORS.try_acquire() else {
+        tracing::debug!(
+            "Not mirroring to {}: too many mirrors in flight",
+            mirror.service
+        );
+        return Ok(req);
+    };
+    let mut copy = copy_request(&req);
+    if req.extensions().get::<AcceptedCredentials>().is_some() {
+        copy.headers_mut().remove(axum::http::header::AUTHORIZATION);
+    }
+    let req = match hyper::body::Body::size_hint(req.body()).exact() {
+        Some(0) => req,
+        Some(len) if len <= MAX_MIRROR_BODY => {
+            let (parts, body) = req.into_parts();
+            let bytes = axum::body::to_bytes(body, len as usize).await?;
+            *copy.body_mut() = Body::from(bytes.clone());
+            Request::from_parts(parts, Body::from(bytes))
         }
+        _ => return Ok(req),
     };
+    copy.headers_mut().insert(
+        axum::http::HeaderName::from_static("x-tenement-mirror"),
+        axum::http::HeaderValue::from_static("1"),
+    );
 
-    // Rate limit: reject immediately if too many recent failures (prevents Argon2 DoS)
-    {
-        let failures = state.auth_failures.read().await;
-        let (count, last_time) = &*failures;
-        if *count >= 10 {
-            if let Some(last) = last_time {
-                // Cool down for 5 seconds after 10 consecutive failures
-                if last.elapsed() < std::time::Duration::from_secs(5) {
-                    tracing::debug!("Auth rate limited ({} recent failures)", count);
-                    return Err(StatusCode::TOO_MANY_REQUESTS);
-                }
-            }
-        }
+    let state = state.clone();
+    let service = mirror.service.clone();
+    tokio::spawn(async move {
+        use http_body_util::BodyExt;
+
+        let uri = copy.uri().clone();
+        let response = proxy_to_instance(&state, &service, None, copy).await;
+        let status = response.status();
+        // Read the answer through so the upstream connection can be reused
+        let _ = response.into_body().collect().await;
+        tracing::debug!("Mirrored {} to {}: {}", uri, service, status);
+        drop(permit);
+    });
+    Ok(req)
+}
+
+/// Send `req` on as a request for `path`, keeping its query, and tell the app
+/// which prefix was taken off in `X-Forwarded-Prefix` (for building links)
+fn rewrite_request_path(req: &mut Request<Body>, path: &str, prefix: &str) -> Result<()> {
+    let path_and_query = match req.uri().query() {
+        Some(query) => format!("{}?{}", path, query),
+        None => path.to_string(),
+    };
+    let mut parts = req.uri().clone().into_parts();
+    parts.path_and_query = Some(path_and_query.parse()?);
+    *req.uri_mut() = axum::http::Uri::from_parts(parts)?;
+    req.headers_mut().insert(
+        axum::http::HeaderName::from_static("x-forwarded-prefix"),
+        axum::http::HeaderValue::from_str(prefix)?,
+    );
+    Ok(())
+}
+
+/// Run `handler` behind gzip compression at `level`. Responses are only encoded
+/// when the client accepts gzip and they aren't already encoded, tiny, or images.
+async fn gzip_response<F, Fut>(level: GzipLevel, req: Request<Body>, handler: F) -> Response
+where
+    F: FnOnce(Request<Body>) -> Fut,
+    Fut: std::future::Future<Output = Response>,
+{
+    let quality = match level {
+        GzipLevel::Default => CompressionLevel::Default,
+        GzipLevel::Level(n) => CompressionLevel::Precise(n as i32),
+    };
+    let layer = CompressionLayer::new().br(false).quality(quality);
+    compress_response(layer, req, handler).await
+}
+
+/// Run `handler` behind a service's `compression`, in whichever of its
+/// encodings the client prefers
+async fn compressed_response<F, Fut>(
+    compression: &CompressionConfig,
+    req: Request<Body>,
+    handler: F,
+) -> Response
+where
+    F: FnOnce(Request<Body>) -> Fut,
+    Fut: std::future::Future<Output = Response>,
+{
+    let quality = match compression.level {
+        Some(n) => CompressionLevel::Precise(n as i32),
+        None => CompressionLevel::Default,
+    };
+    let layer = CompressionLayer::new()
+        .gzip(compression.encodings.contains(&Encoding::Gzip))
+        .br(compression.encodings.contains(&Encoding::Br))
+        .quality(quality);
+    compress_response(layer, req, handler).await
+}
+
+async fn compress_response<F, Fut>(
+    layer: CompressionLayer,
+    req: Request<Body>,
+    handler: F,
+) -> Response
+where
+    F: FnOnce(Request<Body>) -> Fut,
+    Fut: std::future::Future<Output = Response>,
+{
+    use tower::{Layer, ServiceExt};
+
+    let mut handler = Some(handler);
+    let service = tower::service_fn(move |req| {
+        let handler = handler.take().expect("oneshot calls the handler once");
+        async move { Ok::<_, Infallible>(handler(req).await) }
+    });
+    match layer.layer(service).oneshot(req).await {
+        Ok(response) => response.map(Body::new),
+        Err(never) => match never {},
     }
+}
 
-    // Try admin token first
-    let token_store = TokenStore::new(&state.config_store);
-    match token_store.verify(token).await {
-        Ok(true) => {
-            let mut failures = state.auth_failures.write().await;
-            *failures = (0, None);
-            // Admin token: full access (no tenant scoping)
-            req.extensions_mut()
-                .insert(AuthIdentity { tenant_id: None });
-            return Ok(next.run(req).await);
-        }
-        Ok(false) => {} // Not the admin token, try tenant tokens
-        Err(e) => {
-            tracing::error!("Token verification error: {}", e);
-            return Err(StatusCode::INTERNAL_SERVER_ERROR);
-        }
+/// Marks a response produced by the proxy's request timeout
+#[derive(Debug, Clone, Copy)]
+struct ProxyTimedOut;
+
+/// Count and log a routed request that took longer than its route's SLO target.
+/// Timeouts are reported separately and never count as slow. Returns whether it was slow.
+async fn record_slo(
+    metrics: &tenement::Metrics,
+    route: &Route,
+    request_line: &str,
+    elapsed: std::time::Duration,
+    response: &Response,
+) -> bool {
+    let Some(target) = route.slo_target else {
+        return false;
+    };
+    if elapsed <= target || response.extensions().get::<ProxyTimedOut>().is_some() {
+        return false;
     }
 
-    // Try tenant token
-    match state.tenant_tokens.verify(token).await {
+    tracing::warn!(
+        "Slow request: {} took {}ms via route '{}' (slo_target_ms = {})",
+        request_line,
+        elapsed.as_millis(),
+        route.prefix,
+        target.as_millis()
+    );
+    let mut labels = std::collections::HashMap::new();
+    labels.insert("route".to_string(), route.prefix.clone());
+    if let Some(host) = &route.host {
+        labels.insert("host".to_string(), host.clone());
+    }
+    metrics.requests_slow_total.with_labels(&labels).await.inc();
+    true
+}
+
+/// Apply a route's request header rules: dropping the client's forwarding
+/// headers if asked, then the common rules, then Accept-Encoding. The proxy
+/// adds this hop's `X-Forwarded-*` afterwards.
+fn apply_request_headers(headers: &mut axum::http::HeaderMap, rules: &HeaderRules) {
+    use axum::http::{header::ACCEPT_ENCODING, HeaderValue};
+
+    if rules.forwarded == ForwardedHeaders::Replace {
+        for name in FORWARDED_HEADERS {
+            headers.remove(*name);
+        }
+    }
+    apply_header_rules(headers, rules);
+    if let Some(rule) = &rules.accept_encoding {
+        let current = headers.get(ACCEPT_ENCODING).and_then(|v| v.to_str().ok());
+        match rule.apply(current).and_then(|v| HeaderValue::from_str(&v).ok()) {
+            Some(value) => {
+                headers.insert(ACCEPT_ENCODING, value);
+            }
+            None => {
+                headers.remove(ACCEPT_ENCODING);
+            }
+        }
+    }
+}
+
+/// Apply a route's response header rules, after any security headers it asks
+/// for (HSTS only when serving HTTPS) that the response doesn't already carry
+fn apply_response_headers(headers: &mut axum::http::HeaderMap, rules: &HeaderRules, https: bool) {
+    use axum::http::HeaderValue;
+
+    if rules.security_headers {
+        let hsts = https.then_some(("strict-transport-security", HSTS));
+        for (name, value) in SECURITY_HEADERS.iter().copied().chain(hsts) {
+            if !headers.contains_key(name) {
+                headers.insert(name, HeaderValue::from_static(value));
+            }
+        }
+    }
+    apply_header_rules(headers, rules);
+}
+
+/// Removals, sets, adds, then rewrites. Names and values are validated at config load.
+fn apply_header_rules(headers: &mut axum::http::HeaderMap, rules: &HeaderRules) {
+    use axum::http::{HeaderName, HeaderValue};
+
+    let parse = |name: &str, value: &str| {
+        Some((
+            HeaderName::from_bytes(name.as_bytes()).ok()?,
+            HeaderValue::from_str(value).ok()?,
+        ))
+    };
+    for name in &rules.remove {
+        headers.remove(name.as_str());
+    }
+    for (name, value) in &rules.set {
+        if let Some((name, value)) = parse(name, value) {
+            headers.insert(name, value);
+        }
+    }
+    for (name, value) in &rules.add {
+        if let Some((name, value)) = parse(name, value) {
+            headers.append(name, value);
+        }
+    }
+    for (name, rewrite) in &rules.rewrite {
+        let Ok(name) = HeaderName::from_bytes(name.as_bytes()) else {
+            continue;
+        };
+        let values: Vec<HeaderValue> = headers
+            .get_all(&name)
+            .iter()
+            .map(|value| {
+                let rewritten = value.to_str().ok().and_then(|v| rewrite.apply(v));
+                rewritten
+                    .and_then(|v| HeaderValue::from_str(&v).ok())
+                    .unwrap_or_else(|| value.clone())
+            })
+            .collect();
+        if values.is_empty() {
+            continue;
+        }
+        headers.remove(&name);
+        for value in values {
+            headers.append(name.clone(), value);
+        }
+    }
+}
+
+/// The password of Basic credentials (`user:password`, base64); the user is ignored
+fn basic_password(credentials: &str) -> Option<String> {
+    basic_credentials(credentials).map(|(_, password)| password)
+}
+
+/// The user and password of Basic credentials (`user:password`, base64)
+fn basic_credentials(credentials: &str) -> Option<(String, String)> {
+    use base64::Engine;
+    let decoded = base64::engine::general_purpose::STANDARD
+        .decode(credentials.trim())
+        .ok()?;
+    let decoded = String::from_utf8(decoded).ok()?;
+    decoded
+        .split_once(':')
+        .map(|(user, password)| (user.to_string(), password.to_string()))
+}
+
+/// Marks a request whose Basic credentials an `access` check accepted. They're
+/// left on it for any later check (a route's service can have its own), and
+/// [`strip_accepted_credentials`] takes them off before it goes upstream.
+#[derive(Clone, Copy)]
+struct AcceptedCredentials;
+
+/// Take credentials an `access` check accepted off a request, so the app (or
+/// static dir, or mirror) never sees them
+fn strip_accepted_credentials(req: &mut Request<Body>) {
+    if req.extensions().get::<AcceptedCredentials>().is_some() {
+        req.headers_mut().remove(axum::http::header::AUTHORIZATION);
+    }
+}
+
+/// Turn away a request `access` doesn't let through: 403 for a client outside
+/// its networks, 401 with a Basic challenge for missing or wrong credentials.
+/// Credentials that pass are marked with [`AcceptedCredentials`].
+async fn check_access(
+    state: &AppState,
+    access: &AccessConfig,
+    realm: &str,
+    req: &mut Request<Body>,
+) -> Option<Response> {
+    let client_ip = req
+        .extensions()
+        .get::<axum::extract::ConnectInfo<SocketAddr>>()
+        .map(|info| info.0.ip());
+    if !access.allows(client_ip) {
+        tracing::debug!(realm = realm, client = ?client_ip, "Client not allowed");
+        return Some((StatusCode::FORBIDDEN, "Forbidden").into_response());
+    }
+    let path = access.basic_auth.as_ref()?;
+
+    let credentials = req
+        .headers()
+        .get(axum::http::header::AUTHORIZATION)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|h| h.split_once(' '))
+        .filter(|(scheme, _)| scheme.eq_ignore_ascii_case("basic"))
+        .and_then(|(_, credentials)| basic_credentials(credentials));
+    let htpasswd = state.hypervisor.htpasswd(path);
+    let valid = match credentials {
+        Some((user, password)) => htpasswd.check(user, password).await,
+        None => false,
+    };
+    if valid {
+        req.extensions_mut().insert(AcceptedCredentials);
+        return None;
+    }
+    let realm = access.realm.as_deref().unwrap_or(realm);
+    let challenge = format!("Basic realm=\"{}\"", realm);
+    let challenge = [(axum::http::header::WWW_AUTHENTICATE, challenge)];
+    Some((StatusCode::UNAUTHORIZED, challenge, "Unauthorized").into_response())
+}
+
+/// Paths served by tenement itself (dashboard, API, metrics, git pushes)
+fn is_builtin_path(path: &str) -> bool {
+    path == "/"
+        || path == "/health"
+        || path == "/metrics"
+        || path == "/cluster/state"
+        || path.starts_with("/api/")
+        || path.starts_with("/assets/")
+        || path.starts_with("/git/")
+}
+
+/// Serve a file from a static route directory.
+/// Rejects `..` segments so requests can't escape the route's root.
+async fn serve_static(root: &Path, rest: &str) -> Response {
+    let Some(path) = crate::static_files::resolve(root, rest) else {
+        return (StatusCode::NOT_FOUND, "Not found").into_response();
+    };
+
+    match tokio::fs::read(&path).await {
+        Ok(content) => {
+            let mime = mime_guess::from_path(&path).first_or_octet_stream();
+            (
+                StatusCode::OK,
+                [(axum::http::header::CONTENT_TYPE, mime.as_ref())],
+                Body::from(content),
+            )
+                .into_response()
+        }
+        Err(_) => (StatusCode::NOT_FOUND, "Not found").into_response(),
+    }
+}
+
+/// Auth middleware - requires Bearer token for API endpoints
+async fn auth_middleware(
+    State(state): State<AppState>,
+    mut req: Request<Body>,
+    next: Next,
+) -> Result<Response, StatusCode> {
+    let path = req.uri().path();
+
+    // Skip auth for public endpoints
+    if path == "/health"
+        || path == "/metrics"
+        || path == "/api/telemetry"
+        || path == "/cluster/state"
+        || path == "/"
+        || path.starts_with("/assets/")
+    {
+        return Ok(next.run(req).await);
+    }
+
+    // Subdomain requests are handled by subdomain_middleware before reaching here
+    // so we don't need to check for subdomains in auth
+
+    // git only sends credentials after a Basic challenge, so pushes to /git/
+    // give the token as the password
+    let git = path.starts_with("/git/");
+    let unauthorized = || {
+        if git {
+            let challenge = [(axum::http::header::WWW_AUTHENTICATE, "Basic realm=\"tenement\"")];
+            Ok((StatusCode::UNAUTHORIZED, challenge).into_response())
+        } else {
+            Err(StatusCode::UNAUTHORIZED)
+        }
+    };
+
+    // Extract token from Authorization header
+    let auth_header = req
+        .headers()
+        .get("authorization")
+        .and_then(|v| v.to_str().ok());
+
+    let token = match auth_header {
+        Some(h) if h.to_lowercase().starts_with("bearer ") => h[7..].to_string(),
+        Some(h) if git && h.to_lowercase().starts_with("basic ") => {
+            match basic_password(&h[6..]) {
+                Some(password) => password,
+                None => return unauthorized(),
+            }
+        }
+        _ => {
+            tracing::debug!("Missing or invalid Authorization header");
+            return unauthorized();
+        }
+    };
+    let token = token.as_str();
+
+    // Rate limit: reject immediately if too many recent failures (prevents Argon2 DoS)
+    {
+        let failures = state.auth_failures.read().await;
+        let (count, last_time) = &*failures;
+        if *count >= 10 {
+            if let Some(last) = last_time {
+                // Cool down for 5 seconds after 10 consecutive failures
+                if last.elapsed() < std::time::Duration::from_secs(5) {
+                    tracing::debug!("Auth rate limited ({} recent failures)", count);
+                    return Err(StatusCode::TOO_MANY_REQUESTS);
+                }
+            }
+        }
+    }
+
+    // Try admin token first
+    let token_store = TokenStore::new(&state.config_store);
+    match token_store.verify(token).await {
+        Ok(true) => {
+            let mut failures = state.auth_failures.write().await;
+            *failures = (0, None);
+            // Admin token: full access (no tenant scoping)
+            req.extensions_mut().insert(AuthIdentity::admin("admin"));
+            return Ok(next.run(req).await);
+        }
+        Ok(false) => {} // Not the admin token, try tenant tokens
+        Err(e) => {
+            tracing::error!("Token verification error: {}", e);
+            return Err(StatusCode::INTERNAL_SERVER_ERROR);
+        }
+    }
+
+    // Then file-backed admin tokens (reloadable)
+    if state.admin_tokens.clone().check(token.to_string()).await {
+        let mut failures = state.auth_failures.write().await;
+        *failures = (0, None);
+        req.extensions_mut()
+            .insert(AuthIdentity::admin("admin-tokens-file"));
+        return Ok(next.run(req).await);
+    }
+
+    // Then named tokens, limited to their scope by scope_middleware
+    match state.api_tokens.verify(token).await {
+        Ok(Some(api_token)) => {
+            let mut failures = state.auth_failures.write().await;
+            *failures = (0, None);
+            req.extensions_mut().insert(AuthIdentity {
+                tenant_id: None,
+                scope: api_token.scope,
+                name: format!("token:{}", api_token.name),
+            });
+            return Ok(next.run(req).await);
+        }
+        Ok(None) => {}
+        Err(e) => {
+            tracing::error!("API token verification error: {}", e);
+            return Err(StatusCode::INTERNAL_SERVER_ERROR);
+        }
+    }
+
+    // Try tenant token
+    match state.tenant_tokens.verify(token).await {
         Ok(Some(tenant_id)) => {
             let mut failures = state.auth_failures.write().await;
             *failures = (0, None);
             // Tenant token: scoped access
             req.extensions_mut().insert(AuthIdentity {
+                name: format!("tenant:{}", tenant_id),
                 tenant_id: Some(tenant_id),
+                scope: Scope::Admin,
             });
             Ok(next.run(req).await)
         }
@@ -296,7 +1253,12 @@ async fn auth_middleware(
             failures.0 += 1;
             failures.1 = Some(std::time::Instant::now());
             tracing::debug!("Invalid token (failure #{})", failures.0);
-            Err(StatusCode::UNAUTHORIZED)
+            drop(failures);
+            let details = format!("{} {} rejected", req.method(), req.uri().path());
+            if let Err(e) = state.deploy_log.log_rejected(&details).await {
+                tracing::error!("Audit log failed: {}", e);
+            }
+            unauthorized()
         }
         Err(e) => {
             tracing::error!("Tenant token verification error: {}", e);
@@ -305,6 +1267,284 @@ async fn auth_middleware(
     }
 }
 
+/// Whether a request can change anything (and so is audited)
+fn is_mutating(method: &axum::http::Method) -> bool {
+    use axum::http::Method;
+    !matches!(*method, Method::GET | Method::HEAD | Method::OPTIONS)
+}
+
+/// The scope a request needs: reads need `read`, deploys and the operations
+/// that go with them (rollbacks, restarts, traffic shifts) need `deploy`, and
+/// every other change needs `admin`
+fn required_scope(method: &axum::http::Method, path: &str) -> Scope {
+    if !is_mutating(method) {
+        return Scope::Read;
+    }
+    let segments: Vec<&str> = path.trim_start_matches('/').split('/').collect();
+    match segments.as_slice() {
+        ["api", "deploy" | "rollback" | "route"]
+        | ["api", "instances", _, "restart" | "weight"]
+        | ["api", "git", _, "deploy"]
+        | ["api", "stacks", _, "restart" | "deploy"]
+        | ["api", "previews"]
+        | ["api", "previews", _, _]
+        | ["git", _, "git-receive-pack"] => Scope::Deploy,
+        _ => Scope::Admin,
+    }
+}
+
+/// Scope middleware - rejects calls the caller's token scope doesn't cover, and
+/// records every mutating call in the deploy log with the caller's identity
+async fn scope_middleware(
+    State(state): State<AppState>,
+    req: Request<Body>,
+    next: Next,
+) -> Response {
+    // Public endpoints carry no identity
+    let Some(identity) = req.extensions().get::<AuthIdentity>().cloned() else {
+        return next.run(req).await;
+    };
+    let method = req.method().clone();
+    let path = req.uri().path().to_string();
+    let required = required_scope(&method, &path);
+
+    let response = if identity.scope < required {
+        let message = format!(
+            "{} has {} scope; {} {} needs {}",
+            identity.name, identity.scope, method, path, required
+        );
+        (StatusCode::FORBIDDEN, message).into_response()
+    } else {
+        next.run(req).await
+    };
+
+    if is_mutating(&method) {
+        let status = response.status();
+        let details = format!("{} {} {}", method, path, status.as_u16());
+        let result = state
+            .deploy_log
+            .log_as(
+                Some(&identity.name),
+                "api",
+                "",
+                "",
+                Some(&details),
+                status.is_success(),
+            )
+            .await;
+        if let Err(e) = result {
+            tracing::error!("Audit log failed: {}", e);
+        }
+    }
+    response
+}
+
+/// Reload admin tokens from `settings.admin_tokens_file` and tenement.toml on
+/// every SIGHUP. Anything that fails to load leaves the current state in place.
+#[cfg(unix)]
+fn spawn_sighup_reloader(
+    admin_tokens: Arc<AdminTokens>,
+    hypervisor: Arc<Hypervisor>,
+    deploy_log: Arc<tenement::DeployLogStore>,
+) {
+    tokio::spawn(async move {
+        let mut hangup =
+            match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::hangup()) {
+                Ok(signal) => signal,
+                Err(e) => {
+                    tracing::warn!("Failed to install SIGHUP handler: {}", e);
+                    return;
+                }
+            };
+        while hangup.recv().await.is_some() {
+            crate::systemd::reloading();
+            let tokens = reload_admin_tokens(&admin_tokens);
+            let config = reload_config(&hypervisor).await;
+            crate::systemd::ready();
+            let details = match (&tokens, &config) {
+                (Ok(count), Ok(_)) => format!("{} admin token(s), config applied", count),
+                (Err(e), _) | (_, Err(e)) => format!("{:#}", e),
+            };
+            let success = tokens.is_ok() && config.is_ok();
+            audit_signal(&deploy_log, "SIGHUP", "reload", &details, success).await;
+        }
+    });
+}
+
+/// Upgrade in place on every SIGUSR2 (see `upgrade`)
+#[cfg(unix)]
+fn spawn_sigusr2_upgrader(hypervisor: Arc<Hypervisor>, deploy_log: Arc<tenement::DeployLogStore>) {
+    tokio::spawn(async move {
+        let mut usr2 =
+            match tokio::signal::unix::signal(tokio::signal::unix::SignalKind::user_defined2()) {
+                Ok(signal) => signal,
+                Err(e) => {
+                    tracing::warn!("Failed to install SIGUSR2 handler: {}", e);
+                    return;
+                }
+            };
+        while usr2.recv().await.is_some() {
+            let (details, success) = match crate::upgrade::upgrade(&hypervisor).await {
+                Ok(pid) => (format!("handed over to pid {}", pid), true),
+                Err(e) => {
+                    tracing::error!("Upgrade failed, still serving: {:#}", e);
+                    (format!("{:#}", e), false)
+                }
+            };
+            audit_signal(&deploy_log, "SIGUSR2", "upgrade", &details, success).await;
+        }
+    });
+}
+
+/// Record an action taken on a signal in the audit log
+#[cfg(unix)]
+async fn audit_signal(
+    deploy_log: &tenement::DeployLogStore,
+    signal: &str,
+    action: &str,
+    details: &str,
+    success: bool,
+) {
+    let actor = format!("signal:{}", signal);
+    let result = deploy_log
+        .log_as(Some(&actor), action, "", "", Some(details), success)
+        .await;
+    if let Err(e) = result {
+        tracing::error!("Audit log failed: {}", e);
+    }
+}
+
+/// Forward each audit log entry to the log sinks as a JSON line
+fn spawn_audit_shipper(hypervisor: Arc<Hypervisor>, deploy_log: &tenement::DeployLogStore) {
+    let mut appended = deploy_log.subscribe();
+    tokio::spawn(async move {
+        loop {
+            match appended.recv().await {
+                Ok(entry) => {
+                    let Ok(line) = serde_json::to_string(&entry) else {
+                        continue;
+                    };
+                    let level = tenement::LogLevel::Stdout;
+                    let entry = tenement::LogEntry::new("tenement", "audit", level, line);
+                    hypervisor.ship_log(&entry);
+                }
+                Err(tokio::sync::broadcast::error::RecvError::Lagged(missed)) => {
+                    tracing::warn!("Audit log shipping fell behind by {} entries", missed);
+                }
+                Err(tokio::sync::broadcast::error::RecvError::Closed) => break,
+            }
+        }
+    });
+}
+
+/// Reload admin tokens and log the outcome
+pub(crate) fn reload_admin_tokens(admin_tokens: &AdminTokens) -> Result<usize> {
+    match admin_tokens.reload() {
+        Ok(count) => {
+            tracing::info!("Reloaded {} admin token(s)", count);
+            Ok(count)
+        }
+        Err(e) => {
+            tracing::warn!("Admin token reload failed, keeping current tokens: {:#}", e);
+            Err(e)
+        }
+    }
+}
+
+/// Re-read tenement.toml, apply it, and log the outcome. A config naming
+/// middleware this build doesn't have is refused, as it is at startup.
+pub(crate) async fn reload_config(hypervisor: &Hypervisor) -> Result<tenement::ReloadReport> {
+    let reloaded = async {
+        let config = hypervisor.config().reread()?;
+        crate::middleware::check(&config)?;
+        hypervisor.reload(config).await
+    };
+    match reloaded.await {
+        Ok(report) => {
+            init_git_repos(hypervisor).await;
+            if !report.failed.is_empty() {
+                let failed: Vec<String> = report.failed.iter().map(|id| id.to_string()).collect();
+                tracing::warn!("Config reload: failed to bring up {}", failed.join(", "));
+            }
+            Ok(report)
+        }
+        Err(e) => {
+            tracing::warn!("Config reload failed, keeping current config: {:#}", e);
+            Err(e)
+        }
+    }
+}
+
+/// Create the repository of every service with a `git` table, so pushes over
+/// SSH find it, and point each post-receive hook at the current config
+async fn init_git_repos(hypervisor: &Hypervisor) {
+    let config = hypervisor.config();
+    for (name, svc) in &config.service {
+        if let Some(git) = &svc.git {
+            if let Err(e) = init_git_repo(hypervisor, name, git).await {
+                tracing::warn!("Failed to set up git repository for {}: {:#}", name, e);
+            }
+        }
+    }
+}
+
+/// Create `process`'s repository if needed, with a post-receive hook that runs
+/// `ten git-receive` to deploy through the admin socket
+pub(crate) async fn init_git_repo(
+    hypervisor: &Hypervisor,
+    process: &str,
+    git: &tenement::config::GitConfig,
+) -> Result<PathBuf> {
+    let exe = std::env::current_exe().context("Failed to find the tenement binary")?;
+    let hook = vec![
+        exe.display().to_string(),
+        "git-receive".to_string(),
+        process.to_string(),
+        "--branch".to_string(),
+        git.branch.clone(),
+        "--socket".to_string(),
+        hypervisor.admin_socket().display().to_string(),
+    ];
+    let config = hypervisor.config();
+    tenement::git_deploy::init_repo(&config.settings.data_dir, process, git, &hook).await
+}
+
+/// Save which services are in maintenance mode, for the next run
+pub(crate) async fn save_maintenance(state: &AppState) -> Result<()> {
+    let services = state.hypervisor.maintenance_all();
+    if services.is_empty() {
+        state.config_store.delete(MAINTENANCE_KEY).await?;
+        return Ok(());
+    }
+    let value = serde_json::to_string(&services)?;
+    state.config_store.set(MAINTENANCE_KEY, &value).await
+}
+
+/// Put services back in the maintenance mode a previous run saved
+async fn restore_maintenance(hypervisor: &Hypervisor, config_store: &ConfigStore) {
+    let saved = match config_store.get(MAINTENANCE_KEY).await {
+        Ok(Some(saved)) => saved,
+        Ok(None) => return,
+        Err(e) => {
+            tracing::warn!("Failed to read saved maintenance mode: {}", e);
+            return;
+        }
+    };
+    let services: std::collections::HashMap<String, u64> = match serde_json::from_str(&saved) {
+        Ok(services) => services,
+        Err(e) => {
+            tracing::warn!("Ignoring invalid saved maintenance mode: {}", e);
+            return;
+        }
+    };
+    for (process, retry_after) in services {
+        match hypervisor.set_maintenance(&process, Some(retry_after)) {
+            Ok(()) => tracing::info!("Service {} is in maintenance mode", process),
+            Err(e) => tracing::warn!("Not restoring maintenance mode: {}", e),
+        }
+    }
+}
+
 /// Start the HTTP server (with optional TLS)
 pub async fn serve(
     hypervisor: Arc<Hypervisor>,
@@ -312,14 +1552,57 @@ pub async fn serve(
     port: u16,
     config_store: Arc<ConfigStore>,
     deploy_log: Arc<tenement::DeployLogStore>,
+    releases: Arc<dyn tenement::ReleaseBackend>,
     tenant_tokens: Arc<tenement::TenantTokenStore>,
+    api_tokens: Arc<tenement::ApiTokenStore>,
+    admin_tokens: Arc<AdminTokens>,
     tls_options: Option<TlsOptions>,
 ) -> Result<()> {
-    // Recover any orphaned instances from a previous crash
+    // Adopt systemd's listening sockets before any instance could inherit them
+    let mut activated = crate::systemd::ActivatedSockets::take()?;
+
+    // Or take over from the supervisor this one replaces, if an upgrade started it
+    #[cfg(unix)]
+    let mut admin_listener = None;
+    #[cfg(unix)]
+    if let Some(handoff) = crate::upgrade::Handoff::take()? {
+        activated = handoff.listeners;
+        admin_listener = handoff.admin;
+        hypervisor.adopt_on_recovery(handoff.instances);
+    }
+
+    // Kill orphans of a previous run and bring back what it was running
     hypervisor.recover_orphans().await;
 
-    // Spawn configured instances before accepting connections
-    let (success, failed) = hypervisor.spawn_configured_instances().await;
+    // Prune stale sockets left behind by crashed apps
+    let report = hypervisor.prune_orphaned_sockets(false);
+    if report.pruned_count() > 0 {
+        tracing::info!("Pruned {} stale socket(s)", report.pruned_count());
+    }
+
+    // Scratch directories of instances that died with the previous run
+    let removed = hypervisor.prune_orphaned_tmp_dirs().await;
+    if removed > 0 {
+        tracing::info!("Removed {} orphaned temp dir(s)", removed);
+    }
+
+    // Middleware the config names must be registered in this build
+    crate::middleware::check(&hypervisor.config())?;
+
+    // Private sockets between apps, up before the apps that use them
+    if let Err(e) = tenement::mesh::spawn_listeners(hypervisor.clone()) {
+        tracing::error!("Private sockets between apps are off: {:#}", e);
+    }
+
+    // Spawn configured instances before accepting connections; a standby
+    // node starts them only once it leads the cluster
+    let standby = hypervisor
+        .cluster()
+        .is_some_and(|cluster| cluster.mode() == ClusterMode::Standby);
+    let (success, failed) = match standby {
+        true => (0, 0),
+        false => hypervisor.spawn_configured_instances().await,
+    };
     if failed > 0 {
         tracing::warn!(
             "Auto-spawn: {} succeeded, {} failed - check logs for details",
@@ -330,11 +1613,41 @@ pub async fn serve(
         tracing::info!("Auto-spawn: {} instance(s) started", success);
     }
 
-    // Start health monitor
+    // Services left in maintenance mode by the previous run stay in it
+    restore_maintenance(&hypervisor, &config_store).await;
+
+    // Repositories for `git push` deploys
+    init_git_repos(&hypervisor).await;
+
+    // Start health monitor, reporting state changes to the webhook if configured
+    crate::health_webhook::spawn_health_webhook(&hypervisor);
+    crate::webhooks::spawn_webhooks(&hypervisor, config_store.clone(), Default::default());
+    crate::previews::spawn_reaper(hypervisor.clone(), config_store.clone(), deploy_log.clone());
+    crate::cluster::spawn_cluster(hypervisor.clone());
+    // Discovery URLs go through the plain HTTP listener; with TLS, only the addresses
+    let discovery_port = match &tls_options {
+        Some(tls) if tls.enabled => None,
+        _ => Some(port),
+    };
+    crate::discovery::spawn_discovery(hypervisor.clone(), discovery_port);
     hypervisor.clone().start_monitor();
+    hypervisor.clone().start_jobs();
+
+    // Reload admin tokens and tenement.toml on SIGHUP, upgrade on SIGUSR2
+    #[cfg(unix)]
+    spawn_sighup_reloader(admin_tokens.clone(), hypervisor.clone(), deploy_log.clone());
+    #[cfg(unix)]
+    spawn_sigusr2_upgrader(hypervisor.clone(), deploy_log.clone());
+    if hypervisor.config().settings.ship_audit_log {
+        spawn_audit_shipper(hypervisor.clone(), &deploy_log);
+    }
+    crate::systemd::spawn_watchdog();
 
-    let client = Client::builder(TokioExecutor::new()).build_http();
-    let unix_client = Client::builder(TokioExecutor::new()).build(UnixConnector);
+    let client = Client::builder(TokioExecutor::new())
+        .build(WarmConnector::new(hypervisor.warm_pool()));
+    let h2_client = Client::builder(TokioExecutor::new())
+        .http2_only(true)
+        .build(WarmConnector::new(hypervisor.warm_pool()));
 
     // Build TLS status from options
     let tls_status = match &tls_options {
@@ -352,39 +1665,176 @@ pub async fn serve(
         hypervisor,
         domain: domain.clone(),
         client,
-        unix_client,
+        h2_client,
+        upstream_pools: Arc::new(UpstreamPools::new()),
         config_store,
         deploy_log,
+        releases,
         tenant_tokens,
+        api_tokens,
+        admin_tokens: admin_tokens.clone(),
         tls_status,
         auth_failures: Arc::new(tokio::sync::RwLock::new((0, None))),
     };
 
-    match tls_options {
-        Some(tls) if tls.enabled => serve_with_tls(state, tls).await,
-        _ => serve_http_only(state, port).await,
+    if let Some(addr) = state.hypervisor.metrics_listen() {
+        spawn_metrics_listener(state.clone(), addr, activated.named("metrics")).await?;
+    }
+    if let Some(addr) = state.hypervisor.dashboard().admin_listen() {
+        spawn_dashboard_listener(state.clone(), addr, activated.named("dashboard")).await?;
+    }
+    spawn_stream_listeners(&state.hypervisor, &mut activated).await?;
+
+    #[cfg(unix)]
+    let admin_socket = state.hypervisor.admin_socket();
+    #[cfg(unix)]
+    spawn_admin_socket(state.clone(), &admin_socket, admin_listener).await?;
+
+    #[cfg(unix)]
+    let hypervisor = state.hypervisor.clone();
+    let result = match tls_options {
+        Some(tls) if tls.enabled => {
+            let https = activated.listener("https", 0);
+            let http = activated.listener("http", 1);
+            warn_unused_sockets(&activated);
+            serve_with_tls(state, tls, https, http).await
+        }
+        _ => {
+            let http = activated.listener("http", 0);
+            warn_unused_sockets(&activated);
+            serve_http_only(state, port, http).await
+        }
+    };
+
+    // After a hand-off the socket is the new supervisor's
+    #[cfg(unix)]
+    if !hypervisor.is_handed_off() {
+        std::fs::remove_file(&admin_socket).ok();
+    }
+    result
+}
+
+fn warn_unused_sockets(activated: &crate::systemd::ActivatedSockets) {
+    let unused = activated.unused();
+    if !unused.is_empty() {
+        tracing::warn!("Ignoring socket-activated listeners: {}", unused.join(", "));
+    }
+}
+
+/// The socket systemd or an upgrade passed in for this listener, or a fresh
+/// bind on `addr`. Either is handed on to the next supervisor as `name`.
+async fn listen(
+    name: &str,
+    activated: Option<std::net::TcpListener>,
+    addr: SocketAddr,
+) -> Result<tokio::net::TcpListener> {
+    let listener = match activated {
+        Some(listener) => {
+            listener.set_nonblocking(true)?;
+            tokio::net::TcpListener::from_std(listener)?
+        }
+        None => tokio::net::TcpListener::bind(addr)
+            .await
+            .with_context(|| format!("Failed to bind {} ({})", addr, name))?,
+    };
+    #[cfg(unix)]
+    crate::upgrade::register(name, std::os::fd::AsRawFd::as_raw_fd(&listener));
+    Ok(listener)
+}
+
+/// Like [`listen`], for a UDP socket
+fn listen_udp(
+    name: &str,
+    activated: Option<std::net::TcpListener>,
+    addr: SocketAddr,
+) -> Result<tokio::net::UdpSocket> {
+    let socket = match activated {
+        #[cfg(unix)]
+        Some(listener) => {
+            use std::os::fd::{FromRawFd, IntoRawFd};
+            // SAFETY: the descriptor is ours; it was only adopted as a TcpListener
+            unsafe { std::net::UdpSocket::from_raw_fd(listener.into_raw_fd()) }
+        }
+        _ => std::net::UdpSocket::bind(addr)
+            .with_context(|| format!("Failed to bind {} ({})", addr, name))?,
+    };
+    socket.set_nonblocking(true)?;
+    let socket = tokio::net::UdpSocket::from_std(socket)?;
+    #[cfg(unix)]
+    crate::upgrade::register(name, std::os::fd::AsRawFd::as_raw_fd(&socket));
+    Ok(socket)
+}
+
+/// Listen on the `listen` port of every TCP and UDP service
+async fn spawn_stream_listeners(
+    hypervisor: &Arc<Hypervisor>,
+    activated: &mut crate::systemd::ActivatedSockets,
+) -> Result<()> {
+    let config = hypervisor.config();
+    for (name, service) in &config.service {
+        let Some(listen) = &service.listen else {
+            continue;
+        };
+        let socket_name = tenement::streams::listener_name(name);
+        let inherited = activated.named(&socket_name);
+        let addr = listen.addr();
+        if service.protocol == BackendProtocol::Udp {
+            let socket = listen_udp(&socket_name, inherited, addr)?;
+            tracing::info!("{} listening on udp://{}", name, socket.local_addr()?);
+            let serve = tenement::streams::serve_udp(hypervisor.clone(), name.clone(), socket);
+            tokio::spawn(serve);
+        } else {
+            let listener = listen(&socket_name, inherited, addr).await?;
+            tracing::info!("{} listening on tcp://{}", name, listener.local_addr()?);
+            let serve = tenement::streams::serve_tcp(hypervisor.clone(), name.clone(), listener);
+            tokio::spawn(serve);
+        }
     }
+    Ok(())
 }
 
 /// HTTP-only server (no TLS)
-async fn serve_http_only(state: AppState, port: u16) -> Result<()> {
+async fn serve_http_only(
+    state: AppState,
+    port: u16,
+    activated: Option<std::net::TcpListener>,
+) -> Result<()> {
     let app = create_router(state.clone());
-    let addr = format!("0.0.0.0:{}", port);
-    let listener = tokio::net::TcpListener::bind(&addr).await?;
+    let listener = listen("http", activated, SocketAddr::from(([0, 0, 0, 0], port))).await?;
 
-    tracing::info!("tenement listening on http://{}", addr);
-    tracing::info!("Dashboard at http://{}", state.domain);
+    tracing::info!("tenement listening on http://{}", listener.local_addr()?);
+    if state.hypervisor.dashboard().on_public_listener() {
+        tracing::info!("Dashboard at http://{}", state.domain);
+    }
+    crate::upgrade::ready();
 
     let hypervisor = state.hypervisor.clone();
-    axum::serve(listener, app)
-        .with_graceful_shutdown(shutdown_signal(hypervisor))
-        .await?;
+    let deadline = hypervisor.shutdown_timeout();
+    let (started_tx, started_rx) = tokio::sync::oneshot::channel();
+    let server = axum::serve(
+        listener,
+        app.into_make_service_with_connect_info::<SocketAddr>(),
+    )
+    .with_graceful_shutdown(async move {
+        let _ = started_tx.send(shutdown_signal(hypervisor).await);
+    });
+
+    tokio::select! {
+        result = std::future::IntoFuture::into_future(server) => result?,
+        _ = shutdown_deadline(started_rx, deadline) => {}
+    }
     Ok(())
 }
 
 /// HTTPS server with automatic Let's Encrypt certificates
-/// Uses TLS-ALPN-01 challenge (default in rustls-acme) - handles everything on port 443
-async fn serve_with_tls(state: AppState, tls: TlsOptions) -> Result<()> {
+/// Uses TLS-ALPN-01 challenge (default in rustls-acme) - handles everything on port 443 -
+/// or HTTP-01 answered on the HTTP port. Wildcard domains are issued separately over DNS-01.
+async fn serve_with_tls(
+    state: AppState,
+    tls: TlsOptions,
+    activated_https: Option<std::net::TcpListener>,
+    activated_http: Option<std::net::TcpListener>,
+) -> Result<()> {
     // Ensure cache directory exists with secure permissions
     std::fs::create_dir_all(&tls.cache_dir)?;
 
@@ -401,74 +1851,81 @@ async fn serve_with_tls(state: AppState, tls: TlsOptions) -> Result<()> {
         })?;
     }
 
-    // Create ACME configuration - uses TLS-ALPN-01 by default
-    // TLS-ALPN-01 handles challenges on port 443, no separate port 80 listener needed
-    let cache_dir = tls.cache_dir.clone();
-    let mut acme_state = AcmeConfig::new([tls.domain.clone()])
-        .contact([format!("mailto:{}", tls.email)])
-        .cache(DirCache::new(cache_dir))
-        .directory_lets_encrypt(!tls.staging) // true = production, false = staging
-        .state();
-
-    // Get acceptor for TLS connections (includes ACME challenge handling)
-    let acceptor = acme_state.axum_acceptor(acme_state.default_rustls_config());
-
-    // Spawn ACME event handler (handles cert acquisition/renewal)
-    // Tracks consecutive errors and provides troubleshooting hints
-    let acme_domain = tls.domain.clone();
-    tokio::spawn(async move {
-        let mut consecutive_errors: u32 = 0;
-        let mut cert_acquired = false;
-
-        loop {
-            match acme_state.next().await {
-                Some(Ok(event)) => {
-                    consecutive_errors = 0;
-                    cert_acquired = true;
-                    tracing::info!("ACME: Certificate event for {}: {:?}", acme_domain, event);
-                }
-                Some(Err(err)) => {
-                    consecutive_errors += 1;
-                    tracing::error!(
-                        "ACME error (attempt {}) for {}: {:?}",
-                        consecutive_errors,
-                        acme_domain,
-                        err
-                    );
-
-                    // After 3 consecutive errors, provide troubleshooting hints
-                    if consecutive_errors == 3 {
-                        tracing::warn!(
-                            "ACME certificate acquisition failing. Troubleshooting checklist:\n\
-                            - Verify DNS for {} points to this server\n\
-                            - Ensure port 443 is accessible from the internet\n\
-                            - Check firewall allows inbound HTTPS traffic\n\
-                            - Verify domain ownership if using production Let's Encrypt",
-                            acme_domain
-                        );
-                    }
+    let directory = match tls.staging {
+        true => crate::acme_dns::LETS_ENCRYPT_STAGING,
+        false => crate::acme_dns::LETS_ENCRYPT,
+    };
+    // Names under a wildcard get the DNS-01 certificate
+    let wildcards = &tls.wildcard_domains;
+    let wildcard_cert = match tls.dns.as_ref().filter(|_| !wildcards.is_empty()) {
+        Some((provider, dns)) => {
+            let cert = Arc::new(crate::acme_dns::IssuedCert::default());
+            let solver = crate::acme_dns::Solver::Dns {
+                dns: crate::dns_providers::DnsSolver::from_config(*provider, dns)?,
+                propagation: std::time::Duration::from_secs(dns.propagation_secs),
+            };
+            let names = wildcards.clone();
+            spawn_issuer(&state, &tls, directory, names, solver, cert.clone());
+            Some(cert)
+        }
+        None => None,
+    };
+    let with_wildcards = |fallback: Arc<dyn ResolvesServerCert>| -> Arc<dyn ResolvesServerCert> {
+        match &wildcard_cert {
+            Some(cert) => Arc::new(crate::acme_dns::WildcardResolver::new(
+                wildcards.clone(),
+                cert.clone(),
+                fallback,
+            )),
+            None => fallback,
+        }
+    };
 
-                    // After 10 consecutive errors, warn about rate limits
-                    if consecutive_errors == 10 && !cert_acquired {
-                        tracing::error!(
-                            "ACME has failed {} times without acquiring a certificate.\n\
-                            Consider using --staging flag to avoid hitting Let's Encrypt rate limits.\n\
-                            Rate limit: 5 failed validations per account per hostname per hour.",
-                            consecutive_errors
-                        );
-                    }
-                }
-                None => break,
-            }
+    let domains = tls.certificate_domains();
+    if domains.len() > 1 {
+        tracing::info!("ACME: requesting a certificate for {}", domains.join(", "));
+    }
+    let http01 = Arc::new(crate::acme_dns::Http01Tokens::default());
+    let acceptor = match tls.challenge {
+        // TLS-ALPN-01 handles challenges on port 443, no separate port 80 listener needed
+        AcmeChallenge::TlsAlpn01 => {
+            let acme_state = AcmeConfig::new(domains.clone())
+                .contact([format!("mailto:{}", tls.email)])
+                .cache(DirCache::new(tls.cache_dir.clone()))
+                .directory_lets_encrypt(!tls.staging) // true = production, false = staging
+                .state();
+            let mut rustls_config = (*acme_state.default_rustls_config()).clone();
+            rustls_config.cert_resolver = with_wildcards(acme_state.resolver());
+            tune_rustls_config(&mut rustls_config, &tls)?;
+            // Includes ACME challenge handling
+            let acceptor = acme_state.axum_acceptor(Arc::new(rustls_config));
+            let (domain, hypervisor) = (tls.domain.clone(), state.hypervisor.clone());
+            tokio::spawn(watch_acme(acme_state, domain, domains, hypervisor));
+            HttpsAcceptor::Acme(acceptor)
         }
-    });
+        // Ordered by tenement itself, answered by the HTTP listener
+        AcmeChallenge::Http01 => {
+            let cert = Arc::new(crate::acme_dns::IssuedCert::default());
+            let solver = crate::acme_dns::Solver::Http(http01.clone());
+            spawn_issuer(&state, &tls, directory, domains, solver, cert.clone());
+            let provider = Arc::new(rustls::crypto::aws_lc_rs::default_provider());
+            let mut rustls_config = rustls::ServerConfig::builder_with_provider(provider)
+                .with_safe_default_protocol_versions()?
+                .with_no_client_auth()
+                .with_cert_resolver(with_wildcards(cert));
+            tune_rustls_config(&mut rustls_config, &tls)?;
+            let config = RustlsConfig::from_config(Arc::new(rustls_config));
+            HttpsAcceptor::Issued(RustlsAcceptor::new(config))
+        }
+    };
 
     // Spawn HTTP redirect server on port 80
     let https_port = tls.https_port;
-    let http_port = tls.http_port;
+    let http_addr = SocketAddr::from(([0, 0, 0, 0], tls.http_port));
+    let http_listener = listen("http", activated_http, http_addr).await?;
 
     let http_server = tokio::spawn(async move {
-        if let Err(e) = serve_http_redirect(http_port, https_port).await {
+        if let Err(e) = serve_http_redirect(http_listener, https_port, http01).await {
             tracing::error!("HTTP redirect server error: {}", e);
         }
     });
@@ -476,6 +1933,9 @@ async fn serve_with_tls(state: AppState, tls: TlsOptions) -> Result<()> {
     // Create HTTPS server
     let app = create_router(state.clone());
     let https_addr = SocketAddr::from(([0, 0, 0, 0], tls.https_port));
+    let https_listener = listen("https", activated_https, https_addr)
+        .await?
+        .into_std()?;
 
     tracing::info!(
         "tenement listening on https://{}:{}",
@@ -487,23 +1947,169 @@ async fn serve_with_tls(state: AppState, tls: TlsOptions) -> Result<()> {
         tracing::warn!("Using Let's Encrypt STAGING environment (certs not trusted by browsers)");
     }
 
-    // Bind and serve HTTPS
-    axum_server::bind(https_addr)
-        .acceptor(acceptor)
-        .serve(app.into_make_service())
-        .await?;
+    // Stop instances on SIGTERM/SIGINT, then close HTTPS connections within the deadline
+    let handle = axum_server::Handle::new();
+    let shutdown_handle = handle.clone();
+    let hypervisor = state.hypervisor.clone();
+    tokio::spawn(async move {
+        let deadline = hypervisor.shutdown_timeout();
+        let started = shutdown_signal(hypervisor).await;
+        let remaining = (started + deadline).saturating_duration_since(std::time::Instant::now());
+        shutdown_handle.graceful_shutdown(Some(remaining));
+    });
+
+    // Serve HTTPS
+    crate::upgrade::ready();
+    let service = app.into_make_service_with_connect_info::<SocketAddr>();
+    let server = axum_server::from_tcp(https_listener).handle(handle);
+    match acceptor {
+        HttpsAcceptor::Acme(acceptor) => server.acceptor(acceptor).serve(service).await?,
+        HttpsAcceptor::Issued(acceptor) => server.acceptor(acceptor).serve(service).await?,
+    }
 
     http_server.abort();
     Ok(())
 }
 
-/// HTTP server on port 80 - redirects all traffic to HTTPS
-/// (TLS-ALPN-01 handles ACME challenges on port 443, so no challenge handling needed here)
-async fn serve_http_redirect(http_port: u16, https_port: u16) -> Result<()> {
-    let redirect_app = Router::new().fallback(move |Host(host): Host, req: Request<Body>| {
+/// Accepts HTTPS connections with rustls-acme's certificates (TLS-ALPN-01) or
+/// with the ones tenement orders itself (HTTP-01)
+enum HttpsAcceptor {
+    Acme(rustls_acme::axum::AxumAcceptor),
+    Issued(RustlsAcceptor),
+}
+
+/// Session ticket rotation and ALPN for the HTTPS listener
+fn tune_rustls_config(rustls_config: &mut rustls::ServerConfig, tls: &TlsOptions) -> Result<()> {
+    // Rotate session ticket keys instead of keeping one for the process lifetime
+    rustls_config.ticketer = crate::tls_tickets::RotatingTicketer::new(
+        std::time::Duration::from_secs(tls.ticket_rotation_secs),
+        tls.ticket_keys_retained,
+    )?;
+    // Offer HTTP/2 ahead of HTTP/1.1, so gRPC clients can connect over TLS
+    rustls_config
+        .alpn_protocols
+        .retain(|protocol| protocol != b"h2" && protocol != b"http/1.1");
+    let mut alpn = vec![b"h2".to_vec(), b"http/1.1".to_vec()];
+    alpn.append(&mut rustls_config.alpn_protocols);
+    rustls_config.alpn_protocols = alpn;
+    Ok(())
+}
+
+/// Keep a certificate tenement orders itself for `names` current in `cert`,
+/// emitting `cert_renewed` for each new one
+fn spawn_issuer(
+    state: &AppState,
+    tls: &TlsOptions,
+    directory: &str,
+    names: Vec<String>,
+    solver: crate::acme_dns::Solver,
+    cert: Arc<crate::acme_dns::IssuedCert>,
+) {
+    let issuer = crate::acme_dns::Issuer {
+        directory: directory.to_string(),
+        email: tls.email.clone(),
+        cache_dir: tls.cache_dir.clone(),
+        names,
+        solver,
+    };
+    let hypervisor = state.hypervisor.clone();
+    tokio::spawn(issuer.run(cert, move |names| {
+        let data = serde_json::json!({ "domains": names });
+        hypervisor.emit(LifecycleEvent::new(EventKind::CertRenewed, data));
+    }));
+}
+
+/// Handle rustls-acme's certificate acquisition and renewal events.
+/// Tracks consecutive errors and provides troubleshooting hints
+async fn watch_acme<S, E>(
+    mut events: S,
+    domain: String,
+    domains: Vec<String>,
+    hypervisor: Arc<Hypervisor>,
+) where
+    S: Stream<Item = Result<EventOk, E>> + Unpin,
+    E: std::fmt::Debug,
+{
+    let mut consecutive_errors: u32 = 0;
+    let mut cert_acquired = false;
+
+    loop {
+        match events.next().await {
+            Some(Ok(event)) => {
+                consecutive_errors = 0;
+                cert_acquired = true;
+                tracing::info!("ACME: Certificate event for {}: {:?}", domain, event);
+                if matches!(event, EventOk::DeployedNewCert) {
+                    let data = serde_json::json!({ "domains": domains });
+                    hypervisor.emit(LifecycleEvent::new(EventKind::CertRenewed, data));
+                }
+            }
+            Some(Err(err)) => {
+                consecutive_errors += 1;
+                tracing::error!(
+                    "ACME error (attempt {}) for {}: {:?}",
+                    consecutive_errors,
+                    domain,
+                    err
+                );
+
+                // After 3 consecutive errors, provide troubleshooting hints
+                if consecutive_errors == 3 {
+                    tracing::warn!(
+                        "ACME certificate acquisition failing. Troubleshooting checklist:\n\
+                        - Verify DNS for {} points to this server\n\
+                        - Ensure port 443 is accessible from the internet\n\
+                        - Check firewall allows inbound HTTPS traffic\n\
+                        - Verify domain ownership if using production Let's Encrypt",
+                        domain
+                    );
+                }
+
+                // After 10 consecutive errors, warn about rate limits
+                if consecutive_errors == 10 && !cert_acquired {
+                    tracing::error!(
+                        "ACME has failed {} times without acquiring a certificate.\n\
+                        Consider using --staging flag to avoid hitting Let's Encrypt rate limits.\n\
+                        Rate limit: 5 failed validations per account per hostname per hour.",
+                        consecutive_errors
+                    );
+                }
+            }
+            None => break,
+        }
+    }
+}
+
+/// HTTP server on port 80 - answers HTTP-01 challenges and redirects all
+/// other traffic to HTTPS
+async fn serve_http_redirect(
+    listener: tokio::net::TcpListener,
+    https_port: u16,
+    http01: Arc<crate::acme_dns::Http01Tokens>,
+) -> Result<()> {
+    let redirect_app = redirect_router(https_port, http01);
+
+    let addr = listener.local_addr()?;
+    tracing::debug!("HTTP redirect server listening on {}", addr);
+
+    axum::serve(listener, redirect_app).await?;
+    Ok(())
+}
+
+/// Routes of the HTTP listener
+fn redirect_router(https_port: u16, http01: Arc<crate::acme_dns::Http01Tokens>) -> Router {
+    let challenge = move |axum::extract::Path(token): axum::extract::Path<String>| async move {
+        match http01.answer(&token) {
+            Some(answer) => answer.into_response(),
+            None => StatusCode::NOT_FOUND.into_response(),
+        }
+    };
+    let challenge_route = format!("{}:token", crate::acme_dns::HTTP01_PATH);
+    let router = Router::new().route(&challenge_route, get(challenge));
+    router.fallback(move |Host(host): Host, req: Request<Body>| {
         async move {
             // Strip port from host if present
-            let host = host.split(':').next().unwrap_or(&host);
+            let (host, _) = split_host_port(&host);
             let path = req
                 .uri()
                 .path_and_query()
@@ -518,15 +2124,7 @@ async fn serve_http_redirect(http_port: u16, https_port: u16) -> Result<()> {
 
             Redirect::permanent(&redirect_url)
         }
-    });
-
-    let addr = SocketAddr::from(([0, 0, 0, 0], http_port));
-    let listener = tokio::net::TcpListener::bind(addr).await?;
-
-    tracing::debug!("HTTP redirect server listening on port {}", http_port);
-
-    axum::serve(listener, redirect_app).await?;
-    Ok(())
+    })
 }
 
 /// Serve dashboard
@@ -542,8 +2140,16 @@ async fn dashboard_asset(
 }
 
 /// Health check endpoint
-async fn health() -> impl IntoResponse {
-    Json(HealthResponse { status: "ok" })
+/// 503 while draining, so load balancers stop sending traffic here
+async fn health(State(state): State<AppState>) -> Response {
+    if state.hypervisor.is_draining() {
+        return (
+            StatusCode::SERVICE_UNAVAILABLE,
+            Json(HealthResponse { status: "draining" }),
+        )
+            .into_response();
+    }
+    Json(HealthResponse { status: "ok" }).into_response()
 }
 
 #[derive(Serialize)]
@@ -577,10 +2183,130 @@ struct TlsStatusResponse {
     recommendation: Option<String>,
 }
 
+/// Serve `/metrics` alone on `addr` (`settings.metrics_listen`), or on an
+/// inherited socket, without auth, for scrapers on a private interface.
+/// Returns the bound address.
+async fn spawn_metrics_listener(
+    state: AppState,
+    addr: SocketAddr,
+    activated: Option<std::net::TcpListener>,
+) -> Result<SocketAddr> {
+    let listener = listen("metrics", activated, addr).await?;
+    let bound = listener.local_addr()?;
+    let app = Router::new()
+        .route("/metrics", get(metrics_endpoint))
+        .with_state(state);
+    tracing::info!("Metrics on http://{}/metrics", bound);
+    tokio::spawn(async move {
+        if let Err(e) = axum::serve(listener, app).await {
+            tracing::error!("Metrics listener error: {}", e);
+        }
+    });
+    Ok(bound)
+}
+
+/// Serve the dashboard on `addr` (`settings.dashboard.listen`). Returns the bound address.
+async fn spawn_dashboard_listener(
+    state: AppState,
+    addr: SocketAddr,
+    activated: Option<std::net::TcpListener>,
+) -> Result<SocketAddr> {
+    let listener = listen("dashboard", activated, addr).await?;
+    let bound = listener.local_addr()?;
+    let app = dashboard_router(state);
+    tracing::info!("Dashboard at http://{}", bound);
+    tokio::spawn(async move {
+        let app = app.into_make_service_with_connect_info::<SocketAddr>();
+        if let Err(e) = axum::serve(listener, app).await {
+            tracing::error!("Dashboard listener error: {}", e);
+        }
+    });
+    Ok(bound)
+}
+
+/// Serve the admin API on the Unix socket at `path`, accessible to this user
+/// only. A stale socket left by an earlier run is replaced; a live one is an
+/// error, unless it was handed over on upgrade (`inherited`).
+#[cfg(unix)]
+async fn spawn_admin_socket(
+    state: AppState,
+    path: &Path,
+    inherited: Option<std::os::unix::net::UnixListener>,
+) -> Result<()> {
+    use std::os::fd::AsRawFd;
+    use tower::ServiceExt;
+
+    let listener = match inherited {
+        Some(listener) => {
+            listener.set_nonblocking(true)?;
+            tokio::net::UnixListener::from_std(listener)?
+        }
+        None => bind_admin_socket(path)?,
+    };
+    crate::upgrade::register("admin", listener.as_raw_fd());
+
+    let app = admin_router(state);
+    tracing::info!("Admin API on unix:{}", path.display());
+    tokio::spawn(async move {
+        loop {
+            let stream = match listener.accept().await {
+                Ok((stream, _)) => stream,
+                Err(e) => {
+                    tracing::warn!("Admin socket accept failed: {}", e);
+                    tokio::time::sleep(std::time::Duration::from_millis(100)).await;
+                    continue;
+                }
+            };
+            let app = app.clone();
+            tokio::spawn(async move {
+                let service = hyper::service::service_fn(
+                    move |req: Request<hyper::body::Incoming>| app.clone().oneshot(req),
+                );
+                // Upgrades carry `ten exec` and `ten attach`
+                if let Err(e) = hyper::server::conn::http1::Builder::new()
+                    .serve_connection(hyper_util::rt::TokioIo::new(stream), service)
+                    .with_upgrades()
+                    .await
+                {
+                    tracing::debug!("Admin socket connection error: {}", e);
+                }
+            });
+        }
+    });
+    Ok(())
+}
+
+/// Bind the admin socket at `path`, replacing a stale one
+#[cfg(unix)]
+fn bind_admin_socket(path: &Path) -> Result<tokio::net::UnixListener> {
+    use std::os::unix::fs::PermissionsExt;
+
+    if std::os::unix::net::UnixStream::connect(path).is_ok() {
+        anyhow::bail!("Another tenement is already serving {}", path.display());
+    }
+    if let Some(parent) = path.parent() {
+        std::fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create {}", parent.display()))?;
+    }
+    match std::fs::remove_file(path) {
+        Err(e) if e.kind() != std::io::ErrorKind::NotFound => {
+            return Err(e).with_context(|| format!("Failed to remove {}", path.display()));
+        }
+        _ => {}
+    }
+    let listener = tokio::net::UnixListener::bind(path)
+        .with_context(|| format!("Failed to bind admin socket {}", path.display()))?;
+    std::fs::set_permissions(path, std::fs::Permissions::from_mode(0o600))
+        .with_context(|| format!("Failed to restrict admin socket {}", path.display()))?;
+    Ok(listener)
+}
+
 /// Prometheus metrics endpoint
 async fn metrics_endpoint(State(state): State<AppState>) -> impl IntoResponse {
     let metrics = state.hypervisor.metrics();
-    let output = metrics.format_prometheus().await;
+    let mut output = metrics.format_prometheus().await;
+    let samples = state.hypervisor.instance_samples().await;
+    output.push_str(&tenement::metrics::format_instance_samples(&samples));
     (
         [(
             axum::http::header::CONTENT_TYPE,
@@ -651,6 +2377,85 @@ async fn telemetry_endpoint(State(state): State<AppState>) -> impl IntoResponse
     }))
 }
 
+/// JSON snapshot of key counters and gauges: GET /api/stats (admin only)
+///
+/// Reads the same metric state as /metrics, for scripts that don't speak Prometheus.
+async fn stats_endpoint(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<AuthIdentity>,
+) -> Response {
+    if auth.tenant_id.is_some() {
+        return (StatusCode::FORBIDDEN, "Stats require admin token").into_response();
+    }
+
+    let metrics = state.hypervisor.metrics();
+    let instances = state.hypervisor.list().await;
+    let requests = metrics.requests_total.totals_by("process").await;
+    let errors = metrics.request_errors_total.totals_by("process").await;
+    let restarts = metrics.instance_restarts.totals_by("process").await;
+    let pool = state.hypervisor.concurrency_pool();
+
+    // Every app that has instances or has recorded any metric
+    let mut names: std::collections::BTreeSet<String> =
+        instances.iter().map(|i| i.id.process.clone()).collect();
+    names.extend(requests.keys().cloned());
+    names.extend(errors.keys().cloned());
+    names.extend(restarts.keys().cloned());
+
+    let mut apps = serde_json::Map::new();
+    for name in names {
+        let mut health = std::collections::BTreeMap::new();
+        for info in instances.iter().filter(|i| i.id.process == name) {
+            *health.entry(info.health.to_string()).or_insert(0u64) += 1;
+        }
+        let instance_count: u64 = health.values().sum();
+        let usage: Vec<_> = instances
+            .iter()
+            .filter(|i| i.id.process == name)
+            .filter_map(|i| i.usage)
+            .collect();
+        let app_limit = state.hypervisor.app_limit(&name);
+        apps.insert(
+            name.clone(),
+            serde_json::json!({
+                "instances": instance_count,
+                "health": health,
+                "requests": requests.get(&name).copied().unwrap_or(0),
+                "errors": errors.get(&name).copied().unwrap_or(0),
+                "restarts": restarts.get(&name).copied().unwrap_or(0),
+                "in_flight": pool.map(|p| p.in_use_for(&name)),
+                "max_concurrency": app_limit.as_ref().map(|l| l.limit()),
+                "queued": app_limit.as_ref().map(|l| l.waiting()),
+                "memory_bytes": usage.iter().map(|u| u.rss_bytes).sum::<u64>(),
+                "cpu_percent": usage.iter().filter_map(|u| u.cpu_percent).sum::<f64>(),
+            }),
+        );
+    }
+
+    let healthy = instances
+        .iter()
+        .filter(|i| i.health == tenement::instance::HealthStatus::Healthy)
+        .count();
+
+    Json(serde_json::json!({
+        "requests": { "total": metrics.requests_total.total().await },
+        "errors": { "total": metrics.request_errors_total.total().await },
+        "restarts": { "total": metrics.instance_restarts.total().await },
+        "instances": {
+            "up": metrics.instances_up.get(),
+            "total": instances.len(),
+            "healthy": healthy,
+        },
+        "concurrency": {
+            "limit": pool.map(|p| p.capacity()),
+            "in_use": pool.map(|p| p.in_use()).unwrap_or(0),
+            "waiting": pool.map(|p| p.waiting()).unwrap_or(0),
+        },
+        "apps": apps,
+    }))
+    .into_response()
+}
+
 /// List all running instances (scoped by tenant token if present)
 async fn list_instances(
     State(state): State<AppState>,
@@ -673,14 +2478,30 @@ async fn list_instances(
             idle_secs: i.idle_secs,
             restarts: i.restarts,
             health: i.health.to_string(),
+            ready: i.ready,
+            status: i.status.to_string(),
             storage_used_bytes: i.storage_used_bytes,
             storage_quota_bytes: i.storage_quota_bytes,
             weight: i.weight,
+            last_startup_ms: i.last_startup_ms,
+            usage: i.usage,
         })
         .collect();
     Json(response)
 }
 
+/// Scheduled jobs and their last runs; jobs aren't tenant-owned, so admin only
+async fn list_jobs(
+    State(state): State<AppState>,
+    axum::Extension(auth): axum::Extension<AuthIdentity>,
+) -> impl IntoResponse {
+    let jobs = match auth.tenant_id {
+        Some(_) => Vec::new(),
+        None => state.hypervisor.job_statuses(),
+    };
+    Json(jobs)
+}
+
 #[derive(Serialize)]
 struct InstanceInfo {
     id: String,
@@ -689,9 +2510,17 @@ struct InstanceInfo {
     idle_secs: u64,
     restarts: u32,
     health: String,
+    /// Passing its readiness probe, so getting proxied traffic
+    ready: bool,
+    /// "running" or "crash-looping"
+    status: String,
     storage_used_bytes: u64,
     storage_quota_bytes: Option<u64>,
     weight: u8,
+    /// Time from launch to first ready for the current run (null until ready)
+    last_startup_ms: Option<u64>,
+    /// Last sampled memory, CPU, threads and open descriptors (null until sampled)
+    usage: Option<tenement::metrics::ProcessUsage>,
 }
 
 /// Get storage info for a specific instance
@@ -740,6 +2569,8 @@ struct LogQueryParams {
     level: Option<String>,
     search: Option<String>,
     limit: Option<usize>,
+    /// Unix timestamp in milliseconds
+    since: Option<u64>,
 }
 
 impl From<LogQueryParams> for LogQuery {
@@ -754,6 +2585,7 @@ impl From<LogQueryParams> for LogQuery {
             }),
             search: params.search,
             limit: params.limit,
+            since: params.since,
         }
     }
 }
@@ -774,61 +2606,190 @@ async fn query_logs(
     Json(logs)
 }
 
-/// Stream logs via SSE
+/// Stream logs via SSE. With `since`, buffered entries from then on (the last
+/// `limit` of them, if set) are replayed before live ones.
 async fn stream_logs(
     State(state): State<AppState>,
     Query(params): Query<LogQueryParams>,
+    axum::Extension(auth): axum::Extension<AuthIdentity>,
 ) -> Sse<impl Stream<Item = Result<Event, Infallible>>> {
+    let mut query: LogQuery = params.into();
+    // Tenant tokens can only see their own logs
+    if let Some(ref tenant) = auth.tenant_id {
+        query.instance_id = Some(tenant.clone());
+    }
     let log_buffer = state.hypervisor.log_buffer();
+    // Subscribe before reading the backlog so nothing lands in between
     let rx = log_buffer.subscribe();
+    let backlog = match query.since {
+        Some(_) => log_buffer.query(&query).await,
+        None => Vec::new(),
+    };
 
-    // Filter parameters
-    let process_filter = params.process;
-    let id_filter = params.id;
-    let level_filter = params.level.and_then(|l| match l.as_str() {
-        "stdout" => Some(LogLevel::Stdout),
-        "stderr" => Some(LogLevel::Stderr),
-        _ => None,
-    });
-
-    let stream = BroadcastStream::new(rx)
-        // Filter out errors and apply filters
-        .filter(move |result| {
-            let process_filter = process_filter.clone();
-            let id_filter = id_filter.clone();
-            match result {
-                Ok(entry) => {
-                    // Apply filters
-                    if let Some(ref p) = process_filter {
-                        if &entry.process != p {
-                            return false;
-                        }
-                    }
-                    if let Some(ref id) = id_filter {
-                        if &entry.instance_id != id {
-                            return false;
-                        }
-                    }
-                    if let Some(level) = level_filter {
-                        if entry.level != level {
-                            return false;
-                        }
-                    }
-                    true
+    // Live entries already in the backlog are skipped: everything before its
+    // newest timestamp, and the backlog's own entries at that timestamp
+    let cutoff = backlog.iter().map(|e| e.timestamp).max();
+    let mut at_cutoff: Vec<LogEntry> = backlog
+        .iter()
+        .filter(|e| Some(e.timestamp) == cutoff)
+        .cloned()
+        .collect();
+    let mut is_new = move |entry: &LogEntry| match cutoff {
+        Some(cutoff) if entry.timestamp < cutoff => false,
+        Some(cutoff) if entry.timestamp == cutoff => {
+            match at_cutoff.iter().position(|seen| seen == entry) {
+                Some(index) => {
+                    at_cutoff.swap_remove(index);
+                    false
                 }
-                Err(_) => false,
+                None => true,
             }
-        })
+        }
+        _ => true,
+    };
+
+    let live = BroadcastStream::new(rx)
+        // Drop lagged-receiver errors, entries that don't match, and replays
+        .filter_map(move |result| match result {
+            Ok(entry) if query.matches(&entry) && is_new(&entry) => Some(entry),
+            _ => None,
+        });
+    let stream = tokio_stream::iter(backlog)
+        .chain(live)
         // Convert to SSE events
-        .map(|result| {
-            let entry = result.expect("filtered out errors above");
+        .map(|entry| {
             let json = serde_json::to_string(&entry).unwrap_or_default();
             Ok(Event::default().data(json))
         });
 
+    // A credential reload ends the stream so the client has to re-authenticate
+    let mut credentials = state.admin_tokens.subscribe();
+    let reloaded = async move {
+        if credentials.changed().await.is_err() {
+            std::future::pending::<()>().await;
+        }
+    };
+    let stream = futures::StreamExt::take_until(stream, reloaded);
+
     Sse::new(stream).keep_alive(KeepAlive::default())
 }
 
+/// Query parameters for the event endpoints
+#[derive(Debug, Deserialize)]
+struct EventQueryParams {
+    app: Option<String>,
+    /// Comma-separated event kinds
+    #[serde(rename = "type")]
+    kinds: Option<String>,
+    /// Most recent matching events to return (to replay, when streaming)
+    limit: Option<usize>,
+    /// "ndjson" for one JSON event per line instead of SSE (streaming only)
+    format: Option<String>,
+}
+
+impl EventQueryParams {
+    /// The filter these ask for, narrowed to a tenant's own instances
+    fn filter(&self, auth: &AuthIdentity) -> Result<EventFilter, Response> {
+        let kinds = self
+            .kinds
+            .iter()
+            .flat_map(|kinds| kinds.split(','))
+            .filter(|kind| !kind.is_empty())
+            .map(str::parse)
+            .collect::<Result<Vec<EventKind>>>()
+            .map_err(|e| {
+                let error = crate::api_routes::ApiError::new(e.to_string());
+                (StatusCode::BAD_REQUEST, Json(error)).into_response()
+            })?;
+        Ok(EventFilter {
+            app: self.app.clone(),
+            id: auth.tenant_id.clone(),
+            kinds,
+        })
+    }
+
+    /// The last `limit` of `events` that match `filter`
+    fn recent(&self, events: Vec<LifecycleEvent>, filter: &EventFilter) -> Vec<LifecycleEvent> {
+        let mut events: Vec<_> = events.into_iter().filter(|e| filter.matches(e)).collect();
+        if let Some(limit) = self.limit {
+            events.drain(..events.len().saturating_sub(limit));
+        }
+        events
+    }
+}
+
+/// Recent lifecycle events, oldest first
+async fn recent_events(
+    State(state): State<AppState>,
+    Query(params): Query<EventQueryParams>,
+    axum::Extension(auth): axum::Extension<AuthIdentity>,
+) -> Response {
+    let filter = match params.filter(&auth) {
+        Ok(filter) => filter,
+        Err(response) => return response,
+    };
+    let events = params.recent(state.hypervisor.events().recent(), &filter);
+    Json(events).into_response()
+}
+
+/// Stream lifecycle events as SSE, or as NDJSON with `format=ndjson` (or an
+/// `Accept: application/x-ndjson`). With `limit`, that many recent events are
+/// replayed first.
+async fn stream_events(
+    State(state): State<AppState>,
+    Query(params): Query<EventQueryParams>,
+    axum::Extension(auth): axum::Extension<AuthIdentity>,
+    headers: axum::http::HeaderMap,
+) -> Response {
+    let filter = match params.filter(&auth) {
+        Ok(filter) => filter,
+        Err(response) => return response,
+    };
+    let (recent, rx) = state.hypervisor.events().subscribe_with_recent();
+    let backlog = match params.limit {
+        Some(_) => params.recent(recent, &filter),
+        None => Vec::new(),
+    };
+    let live = BroadcastStream::new(rx).filter_map(move |result| match result {
+        Ok(event) if filter.matches(&event) => Some(event),
+        _ => None,
+    });
+    let events = tokio_stream::iter(backlog).chain(live);
+
+    // A credential reload ends the stream so the client has to re-authenticate
+    let mut credentials = state.admin_tokens.subscribe();
+    let reloaded = async move {
+        if credentials.changed().await.is_err() {
+            std::future::pending::<()>().await;
+        }
+    };
+    let events = futures::StreamExt::take_until(events, reloaded);
+
+    let accepts_ndjson = headers
+        .get(axum::http::header::ACCEPT)
+        .and_then(|v| v.to_str().ok())
+        .is_some_and(|accept| accept.contains("application/x-ndjson"));
+    if params.format.as_deref() == Some("ndjson") || accepts_ndjson {
+        let lines = events.map(|event| {
+            let mut line = serde_json::to_vec(&event).unwrap_or_default();
+            line.push(b'\n');
+            Ok::<_, Infallible>(line)
+        });
+        return (
+            [(axum::http::header::CONTENT_TYPE, "application/x-ndjson")],
+            Body::from_stream(lines),
+        )
+            .into_response();
+    }
+    let events = events.map(|event| {
+        let json = serde_json::to_string(&event).unwrap_or_default();
+        Ok::<_, Infallible>(Event::default().event(event.event.as_str()).data(json))
+    });
+    Sse::new(events)
+        .keep_alive(KeepAlive::default())
+        .into_response()
+}
+
 /// Instance connection info for proxying
 struct ProxyTarget {
     socket: std::path::PathBuf,
@@ -856,7 +2817,7 @@ impl ProxyTarget {
                 .map(|r| r.is_ok())
                 .unwrap_or(false)
         } else {
-            tokio::time::timeout(timeout, tokio::net::UnixStream::connect(&self.socket))
+            tokio::time::timeout(timeout, tenement::sockets::connect(&self.socket))
                 .await
                 .map(|r| r.is_ok())
                 .unwrap_or(false)
@@ -910,7 +2871,7 @@ async fn handle_request(
     req: Request<Body>,
 ) -> Response {
     // Parse subdomain pattern
-    match parse_subdomain(&host, &state.domain) {
+    match subdomain_route(&state, &host) {
         Some(SubdomainRoute::Direct { process, id }) => {
             // Direct route to specific instance: :id.{process}.{domain}
             proxy_to_instance(&state, &process, Some(&id), req).await
@@ -927,6 +2888,15 @@ async fn handle_request(
     }
 }
 
+/// The subdomain route for a host, under the public domain or the service
+/// discovery one (`api.tenement.local`)
+fn subdomain_route(state: &AppState, host: &str) -> Option<SubdomainRoute> {
+    parse_subdomain(host, &state.domain).or_else(|| {
+        let discovery = state.hypervisor.discovery()?;
+        parse_subdomain(host, &discovery.domain)
+    })
+}
+
 /// Subdomain routing types
 enum SubdomainRoute {
     /// Direct route to a specific instance: :id.{process}.{domain}
@@ -939,8 +2909,8 @@ enum SubdomainRoute {
 /// - :id.{process}.{domain} -> Direct route to specific instance
 /// - {process}.{domain} -> Weighted route across all instances
 fn parse_subdomain(host: &str, domain: &str) -> Option<SubdomainRoute> {
-    // Strip port if present
-    let host = host.split(':').next().unwrap_or(host);
+    // Strip port if present (IPv6 literals keep their brackets and never match a domain)
+    let (host, _) = split_host_port(host);
 
     // Check if host ends with domain
     if !host.ends_with(domain) {
@@ -978,20 +2948,274 @@ fn parse_subdomain(host: &str, domain: &str) -> Option<SubdomainRoute> {
     }
 }
 
-/// Proxy request to a process instance via unix socket
-///
-/// If `id` is Some, routes directly to that specific instance.
-/// If `id` is None, uses weighted random selection across all instances.
-///
-/// Implements wake-on-request: if the instance is not running but the process
-/// is configured, it will spawn the instance and wait for it to be ready.
-async fn proxy_to_instance(
+/// Split a Host header into host and port. IPv6 literals keep their brackets:
+/// "[::1]:8080" -> ("[::1]", Some(8080)), "example.com" -> ("example.com", None)
+fn split_host_port(host: &str) -> (&str, Option<u16>) {
+    if host.starts_with('[') {
+        return match host.find(']') {
+            Some(end) => {
+                let port = host[end + 1..]
+                    .strip_prefix(':')
+                    .and_then(|p| p.parse().ok());
+                (&host[..=end], port)
+            }
+            None => (host, None),
+        };
+    }
+    // A bare IPv6 address (more than one colon) has no port to strip
+    if host.matches(':').count() > 1 {
+        return (host, None);
+    }
+    match host.rsplit_once(':') {
+        Some((name, port)) => (name, port.parse().ok()),
+        None => (host, None),
+    }
+}
+
+/// Add X-Forwarded-Host/Proto/Port (and X-Forwarded-For when the peer is known)
+fn add_forwarded_headers(
+    headers: &mut axum::http::HeaderMap,
+    proto: &str,
+    client: Option<std::net::IpAddr>,
+) {
+    use axum::http::HeaderValue;
+
+    let host = headers
+        .get(axum::http::header::HOST)
+        .and_then(|h| h.to_str().ok())
+        .map(str::to_string);
+    if let Some(host) = host {
+        let default_port = if proto == "https" { 443 } else { 80 };
+        let port = split_host_port(&host).1.unwrap_or(default_port);
+        if let Ok(value) = HeaderValue::from_str(&host) {
+            headers.insert("x-forwarded-host", value);
+        }
+        headers.insert("x-forwarded-port", HeaderValue::from(port));
+    }
+    if let Ok(value) = HeaderValue::from_str(proto) {
+        headers.insert("x-forwarded-proto", value);
+    }
+
+    if let Some(ip) = client {
+        // X-Forwarded-For carries bare addresses (no brackets), appended to any existing chain
+        let chain = match headers.get("x-forwarded-for").and_then(|h| h.to_str().ok()) {
+            Some(existing) => format!("{}, {}", existing, ip),
+            None => ip.to_string(),
+        };
+        if let Ok(value) = HeaderValue::from_str(&chain) {
+            headers.insert("x-forwarded-for", value);
+        }
+    }
+}
+
+/// Rewrite a Location pointing at the upstream address to the public host.
+/// Returns None when the Location doesn't need rewriting (relative or external).
+fn rewrite_location(
+    location: &str,
+    upstream: &str,
+    proto: &str,
+    public_host: &str,
+) -> Option<String> {
+    let (_, port) = split_host_port(upstream);
+    let port = port?;
+    let candidates = [
+        format!("http://{}", upstream),
+        format!("http://localhost:{}", port),
+        format!("http://[::1]:{}", port),
+    ];
+    candidates.iter().find_map(|prefix| {
+        let rest = location.strip_prefix(prefix.as_str())?;
+        if !rest.is_empty() && !rest.starts_with(['/', '?', '#']) {
+            return None;
+        }
+        Some(format!("{}://{}{}", proto, public_host, rest))
+    })
+}
+
+/// The instance that answered a proxied request and how long its response
+/// headers took, carried in the response's extensions for the access log
+#[derive(Debug, Clone)]
+struct Answered {
+    instance: String,
+    upstream_ms: f64,
+}
+
+/// Proxy request to a process instance, in a "proxy" span when tracing is
+/// on, writing its access log line (when the service has one) once the
+/// response has been sent
+async fn proxy_to_instance(
     state: &AppState,
     process: &str,
     id: Option<&str>,
-    req: Request<Body>,
+    mut req: Request<Body>,
+) -> Response {
+    // The span continues the caller's trace, and goes in the request's
+    // extensions for forward_to_instance to hang routing and upstream spans off
+    let span = state.hypervisor.tracer().map(|tracer| {
+        let parent = req
+            .headers()
+            .get(TRACEPARENT)
+            .and_then(|value| value.to_str().ok())
+            .and_then(TraceContext::parse);
+        let mut span = tracer.start("proxy", SpanKind::Server, parent.as_ref());
+        span.set("tenement.app", process);
+        span.set("http.request.method", req.method().as_str());
+        span.set("url.path", req.uri().path());
+        req.extensions_mut().insert(span.context());
+        span
+    });
+    let log = state
+        .hypervisor
+        .access_log(process)
+        .filter(|_| state.hypervisor.has_process(process));
+    let pending = log.map(|log| (log, access_record(process, &req), std::time::Instant::now()));
+
+    let compression = state
+        .hypervisor
+        .config()
+        .get_service(process)
+        .and_then(|service| service.compression.clone());
+    let forward = |req| forward_through_middleware(state, process, id, req);
+    let response = match &compression {
+        Some(compression) => compressed_response(compression, req, forward).await,
+        None => forward(req).await,
+    };
+    if let Some(span) = span {
+        end_http_span(span, response.status());
+    }
+    match pending {
+        Some((log, record, started)) => log_access(state, log, record, started, response),
+        None => response,
+    }
+}
+
+/// Send a request through the middleware configured for `process` (the
+/// global `settings.middleware`, then the service's own) on to its instance
+async fn forward_through_middleware(
+    state: &AppState,
+    process: &str,
+    id: Option<&str>,
+    mut req: Request<Body>,
+) -> Response {
+    let config = state.hypervisor.config();
+    if crate::middleware::chain_for(&config, process).is_empty() {
+        return forward_to_instance(state, process, id, req).await;
+    }
+    let Some(chain) = crate::middleware::chain(&config, process) else {
+        tracing::error!("Unknown middleware for {}", process);
+        return (StatusCode::INTERNAL_SERVER_ERROR, "Internal server error").into_response();
+    };
+    let (owned_state, owned_process) = (state.clone(), process.to_string());
+    let owned_id = id.map(str::to_string);
+    let destination = crate::middleware::handler(move |req| {
+        let (state, process, id) = (owned_state.clone(), owned_process.clone(), owned_id.clone());
+        async move { forward_to_instance(&state, &process, id.as_deref(), req).await }
+    });
+    req.extensions_mut()
+        .insert(crate::middleware::Destination(destination));
+    chain(req).await
+}
+
+/// End a proxy or upstream span with the response's status (5xx is a failure)
+fn end_http_span(mut span: Span, status: StatusCode) {
+    span.set("http.response.status_code", status.as_u16());
+    if status.is_server_error() {
+        span.fail(status.to_string());
+    }
+}
+
+/// The access log record for a request, finished by `log_access`
+fn access_record(process: &str, req: &Request<Body>) -> tenement::access_log::AccessRecord {
+    let uri = req.uri();
+    tenement::access_log::AccessRecord {
+        time: chrono::Utc::now(),
+        client: req
+            .extensions()
+            .get::<axum::extract::ConnectInfo<SocketAddr>>()
+            .map(|info| info.0.ip()),
+        method: req.method().to_string(),
+        target: uri
+            .path_and_query()
+            .map_or_else(|| uri.path().to_string(), |pq| pq.to_string()),
+        protocol: format!("{:?}", req.version()),
+        status: 0,
+        bytes: 0,
+        app: process.to_string(),
+        instance: None,
+        release: None,
+        upstream_ms: None,
+        duration_ms: 0.0,
+    }
+}
+
+/// Finish an access log record from the response, then hold it in the body so
+/// the line is written, with the bytes sent, once the body is done
+fn log_access(
+    state: &AppState,
+    log: Arc<tenement::access_log::AccessLog>,
+    mut record: tenement::access_log::AccessRecord,
+    started: std::time::Instant,
+    mut response: Response,
+) -> Response {
+    use http_body_util::BodyExt;
+
+    record.status = response.status().as_u16();
+    if let Some(answered) = response.extensions_mut().remove::<Answered>() {
+        record.release = state.hypervisor.release(&record.app, &answered.instance);
+        record.instance = Some(answered.instance);
+        record.upstream_ms = Some(answered.upstream_ms);
+    }
+    let mut pending = tenement::access_log::PendingAccess::new(log, record, started);
+    let (parts, body) = response.into_parts();
+    let body = Body::new(body.map_frame(move |frame| {
+        if let Some(data) = frame.data_ref() {
+            pending.sent(data.len());
+        }
+        frame
+    }));
+    Response::from_parts(parts, body)
+}
+
+/// Forward a request to a process instance via unix socket
+///
+/// If `id` is Some, routes directly to that specific instance.
+/// If `id` is None, uses weighted random selection across all instances.
+///
+/// Implements wake-on-request: if the instance is not running but the process
+/// is configured, it will spawn the instance and wait for it to be ready.
+async fn forward_to_instance(
+    state: &AppState,
+    process: &str,
+    id: Option<&str>,
+    mut req: Request<Body>,
 ) -> Response {
+    // A drain is in progress: let in-flight requests finish, take no new ones
+    if state.hypervisor.is_draining() {
+        return (StatusCode::SERVICE_UNAVAILABLE, "Draining").into_response();
+    }
+
+    // Only a request carrying the cluster token passes for one a peer forwarded,
+    // and the token goes no further than this node
+    if let Some(cluster) = state.hypervisor.cluster() {
+        let hop = req.headers().contains_key(HOP_HEADER);
+        if hop && !crate::cluster::from_peer(cluster, req.headers()) {
+            return (StatusCode::FORBIDDEN, "Forbidden").into_response();
+        }
+    }
+    req.headers_mut().remove(TOKEN_HEADER);
+
+    // Clustered: what this node can't answer goes to a peer that can. The
+    // peer checks the service's own Basic auth; other credentials stop here.
+    if let Some(peer) = cluster_peer(state, process, id, &req).await {
+        let access = state.hypervisor.access(process);
+        if !access.is_some_and(|access| access.basic_auth.is_some()) {
+            strip_accepted_credentials(&mut req);
+        }
+        return forward_to_peer(state, process, &peer, req).await;
+    }
+
     let start = std::time::Instant::now();
+    let trace = req.extensions().get::<TraceContext>().copied();
     tracing::debug!(
         process = process,
         instance = id.unwrap_or("weighted"),
@@ -1005,12 +3229,145 @@ async fn proxy_to_instance(
         tracing::debug!("Subdomain request for unconfigured process: {}", process);
         return (StatusCode::NOT_FOUND, "Not found").into_response();
     }
+    // TCP and UDP services are reached on their own port, never over HTTP
+    if state.hypervisor.backend_protocol(process).is_stream() {
+        return (StatusCode::NOT_FOUND, "Not found").into_response();
+    }
+
+    // IP allow/deny lists and Basic auth (only when the service sets access)
+    if let Some(access) = state.hypervisor.access(process) {
+        if let Some(denied) = check_access(state, &access, process, &mut req).await {
+            return denied;
+        }
+    }
+    // The last check: the app doesn't see credentials meant for tenement
+    strip_accepted_credentials(&mut req);
+
+    // Drained for maintenance (`tenement drain`): refuse rather than wake it
+    if state.hypervisor.is_app_draining(process) {
+        return (StatusCode::SERVICE_UNAVAILABLE, "Draining").into_response();
+    }
+
+    // Maintenance mode: the instances keep running, but nothing reaches them
+    if let Some(retry_after) = state.hypervisor.maintenance(process) {
+        return maintenance_response(state, process, retry_after).await;
+    }
+
+    // Static services are files tenement serves itself, with no instances
+    let site = state
+        .hypervisor
+        .config()
+        .get_service(process)
+        .and_then(crate::static_files::StaticSite::for_service);
+    if let Some(site) = site {
+        let path = req.uri().path();
+        return crate::static_files::serve(&site, req.method(), path, req.headers()).await;
+    }
+
+    // Per-client request limit (only when the service sets rate_limit)
+    let client_ip = req
+        .extensions()
+        .get::<axum::extract::ConnectInfo<SocketAddr>>()
+        .map(|info| info.0.ip());
+    if let (Some(limiter), Some(ip)) = (state.hypervisor.rate_limiter(process), client_ip) {
+        if let Err(wait) = limiter.check(ip) {
+            tracing::debug!(process = process, client = %ip, "Rate limited for {:?}", wait);
+            let mut labels = std::collections::HashMap::new();
+            labels.insert("process".to_string(), process.to_string());
+            let metrics = state.hypervisor.metrics();
+            metrics
+                .requests_rate_limited_total
+                .with_labels(&labels)
+                .await
+                .inc();
+            let retry_after = wait.as_secs_f64().ceil().max(1.0) as u64;
+            return (
+                StatusCode::TOO_MANY_REQUESTS,
+                [(axum::http::header::RETRY_AFTER, retry_after.to_string())],
+                "Too many requests",
+            )
+                .into_response();
+        }
+    }
+
+    // Response cache (only when the service sets cache): a fresh stored copy
+    // answers without reaching an instance
+    let cached = state.hypervisor.response_cache(process).and_then(|cache| {
+        let (key, reuse) = cache_request(&req)?;
+        Some((cache, key, reuse))
+    });
+    if let Some((cache, key, true)) = &cached {
+        let hit = cache.get(key);
+        let mut labels = std::collections::HashMap::new();
+        labels.insert("process".to_string(), process.to_string());
+        let result = if hit.is_some() { "hit" } else { "miss" };
+        labels.insert("result".to_string(), result.to_string());
+        let metrics = state.hypervisor.metrics();
+        metrics.cache_lookups_total.with_labels(&labels).await.inc();
+        if let Some(hit) = hit {
+            return cached_response(hit);
+        }
+    }
+
+    // Fault injection (only while fault injection is on)
+    if let Some(fault) = state.hypervisor.fault_for(process) {
+        if let Some(aborted) = inject_fault(&fault, process).await {
+            return aborted;
+        }
+    }
+
+    // The app's own cap (only when it sets max_concurrency), taken before a
+    // global slot so requests queued for a slow app don't hold those
+    let _app_permit = match state.hypervisor.app_limit(process) {
+        Some(limit) => {
+            let wait = state.hypervisor.app_queue_timeout(process);
+            match limit.acquire(wait).await {
+                Ok(permit) => Some(permit),
+                Err(e) => {
+                    tracing::warn!(process = process, "Rejecting request: {}", e);
+                    return (
+                        StatusCode::SERVICE_UNAVAILABLE,
+                        [(axum::http::header::RETRY_AFTER, "1")],
+                        "Server busy",
+                    )
+                        .into_response();
+                }
+            }
+        }
+        None => None,
+    };
+
+    // Global concurrency cap (only when settings.max_concurrency is set)
+    let _permit = match state.hypervisor.concurrency_pool() {
+        Some(pool) => {
+            let wait = state.hypervisor.concurrency_queue_timeout();
+            match pool.acquire(process, wait).await {
+                Ok(permit) => Some(permit),
+                Err(e) => {
+                    tracing::warn!(process = process, "Rejecting request: {}", e);
+                    return (
+                        StatusCode::SERVICE_UNAVAILABLE,
+                        [(axum::http::header::RETRY_AFTER, "1")],
+                        "Server busy",
+                    )
+                        .into_response();
+                }
+            }
+        }
+        None => None,
+    };
 
+    // Routing: finding (or waking) the instance that takes the request
+    let route_span = state
+        .hypervisor
+        .tracer()
+        .map(|tracer| tracer.start("route", SpanKind::Internal, trace.as_ref()));
     let mut resolved_instance_id: Option<String> = None;
-    let target = match id {
-        Some(instance_id) => {
-            // Direct routing to specific instance
-            let registered = match state.hypervisor.get_and_touch(process, instance_id).await {
+    let mut target = match id {
+        Some(requested) => {
+            // Direct routing to specific instance (a live replica, if it has replicas)
+            let mut instance_id = state.hypervisor.pick_replica(process, requested).await;
+            let registered = match state.hypervisor.get_and_touch(process, &instance_id).await {
                 Some(info) => Some(ProxyTarget {
                     socket: info.socket,
                     port: info.port,
@@ -1018,15 +3375,19 @@ async fn proxy_to_instance(
                 None => {
                     // Wake-on-request: spawn and wait for instance to be ready
                     tracing::info!("Waking instance {}:{}", process, instance_id);
-                    match state.hypervisor.spawn_and_wait(process, instance_id).await {
+                    match state.hypervisor.spawn_and_wait(process, &instance_id).await {
                         Ok(socket) => {
+                            // A woken replicated instance answers through a replica
+                            instance_id =
+                                state.hypervisor.pick_replica(process, &instance_id).await;
                             // Get port info from the now-running instance
-                            let port = state
-                                .hypervisor
-                                .get(process, instance_id)
-                                .await
-                                .and_then(|info| info.port);
-                            Some(ProxyTarget { socket, port })
+                            match state.hypervisor.get(process, &instance_id).await {
+                                Some(info) => Some(ProxyTarget {
+                                    socket: info.socket,
+                                    port: info.port,
+                                }),
+                                None => Some(ProxyTarget { socket, port: None }),
+                            }
                         }
                         Err(e) => {
                             tracing::error!(
@@ -1049,7 +3410,8 @@ async fn proxy_to_instance(
             // health-checker to restart it before forwarding the request.
             let initial = registered.unwrap();
             let deadline = std::time::Instant::now() + std::time::Duration::from_secs(15);
-            match wait_for_alive_target(state, process, instance_id, initial, deadline).await {
+            resolved_instance_id = Some(instance_id.clone());
+            match wait_for_alive_target(state, process, &instance_id, initial, deadline).await {
                 Some(t) => t,
                 None => {
                     tracing::error!(
@@ -1067,13 +3429,13 @@ async fn proxy_to_instance(
         }
         None => {
             // Weighted routing across all instances. Happy path: use
-            // select_weighted (respects configured weights). If that pick
+            // select_instance (the service's load_balance strategy). If that pick
             // is unreachable, fall back to a deterministic scan over the
             // remaining candidates so a dead backend can't burn the request.
             let mut chosen: Option<(ProxyTarget, String)> = None;
             let mut tried: std::collections::HashSet<String> = std::collections::HashSet::new();
 
-            if let Some(info) = state.hypervisor.select_weighted(process).await {
+            if let Some(info) = state.hypervisor.select_instance(process).await {
                 let candidate = ProxyTarget {
                     socket: info.socket.clone(),
                     port: info.port,
@@ -1093,7 +3455,13 @@ async fn proxy_to_instance(
 
             if chosen.is_none() {
                 for info in state.hypervisor.list_by_process(process).await {
-                    if !tried.insert(info.id.id.clone()) {
+                    // Unhealthy, unready and ejected instances are out of rotation
+                    // until they recover
+                    if info.health.is_down()
+                        || !info.ready
+                        || state.hypervisor.is_ejected(process, &info.id.id)
+                        || !tried.insert(info.id.id.clone())
+                    {
                         continue;
                     }
                     let candidate = ProxyTarget {
@@ -1108,6 +3476,30 @@ async fn proxy_to_instance(
                 }
             }
 
+            // Scale-to-zero: nothing is up, but an instance stopped for idleness
+            // is waiting to be woken by this request
+            if chosen.is_none() {
+                if let Some(idle_id) = state.hypervisor.scaled_to_zero_instance(process).await {
+                    tracing::info!("Waking idle instance {}:{}", process, idle_id);
+                    match state.hypervisor.spawn_and_wait(process, &idle_id).await {
+                        Ok(socket) => {
+                            let port = state
+                                .hypervisor
+                                .get(process, &idle_id)
+                                .await
+                                .and_then(|info| info.port);
+                            chosen = Some((ProxyTarget { socket, port }, idle_id));
+                        }
+                        Err(e) => tracing::error!(
+                            "Failed to wake instance {}:{}: {}",
+                            process,
+                            idle_id,
+                            e
+                        ),
+                    }
+                }
+            }
+
             match chosen {
                 Some((target, id)) => {
                     resolved_instance_id = Some(id);
@@ -1126,22 +3518,317 @@ async fn proxy_to_instance(
     };
 
     // Use the resolved instance ID (from weighted selection or direct routing)
-    let conn_instance_id = resolved_instance_id.as_deref().or(id).unwrap_or("unknown");
-    let _conn_guard = state
+    let mut conn_instance_id = resolved_instance_id
+        .as_deref()
+        .or(id)
+        .unwrap_or("unknown")
+        .to_string();
+    if let Some(mut span) = route_span {
+        span.set("tenement.instance", conn_instance_id.as_str());
+    }
+    let mut conn_guard = state
         .hypervisor
-        .connection_start(process, conn_instance_id)
+        .connection_start(process, &conn_instance_id)
         .await;
 
+    // The client's side of a WebSocket (or other) upgrade, joined to the backend's on a 101
+    let client_upgrade = requested_upgrade(req.headers()).map(|_| hyper::upgrade::on(&mut req));
+
+    // Forwarding headers, and the public host for Location rewrites
+    let proto = if state.tls_status.enabled { "https" } else { "http" };
+    add_forwarded_headers(req.headers_mut(), proto, client_ip);
+    let public_host = req
+        .headers()
+        .get(axum::http::header::HOST)
+        .and_then(|h| h.to_str().ok())
+        .map(str::to_string);
+    let mut upstream_addr = target.tcp_addr();
+
+    // h2c and gRPC backends are spoken to over HTTP/2; gRPC calls are metered per method
+    let protocol = state.hypervisor.backend_protocol(process);
+    let grpc_path = (protocol == BackendProtocol::Grpc).then(|| req.uri().path().to_string());
+
+    // Every request earns toward the retry budget; only those that are safe to
+    // send twice are retried (service `retry`)
+    let retry = state.hypervisor.retry_policy(process);
+    if let Some((_, budget)) = &retry {
+        budget.deposit();
+    }
+    let replay = retry
+        .filter(|_| client_upgrade.is_none() && is_replayable(&req))
+        .map(|(attempts, budget)| (attempts, budget, copy_request(&req)));
+
     // Proxy with request timeout
     let timeout = state.hypervisor.request_timeout(process);
+    let upstream_started = std::time::Instant::now();
+    let mut response = send_upstream(state, process, protocol, &target, req, timeout, trace).await;
+    let mut retries_left = replay.as_ref().map_or(0, |(attempts, _, _)| *attempts);
+    let mut tried = vec![conn_instance_id.clone()];
+    loop {
+        let failed = is_upstream_failure(response.status());
+        state
+            .hypervisor
+            .record_upstream_result(process, &conn_instance_id, !failed)
+            .await;
+        let Some((_, budget, template)) = &replay else {
+            break;
+        };
+        if !failed || retries_left == 0 || !budget.withdraw() {
+            break;
+        }
+        retries_left -= 1;
+
+        // Weighted routing retries on another instance when there is one
+        if id.is_none() {
+            if let Some(info) = state
+                .hypervisor
+                .select_instance_except(process, &tried)
+                .await
+            {
+                target = ProxyTarget {
+                    socket: info.socket,
+                    port: info.port,
+                };
+                conn_instance_id = info.id.id;
+                tried.push(conn_instance_id.clone());
+                conn_guard = state
+                    .hypervisor
+                    .connection_start(process, &conn_instance_id)
+                    .await;
+                upstream_addr = target.tcp_addr();
+            }
+        }
+        tracing::debug!(
+            process = process,
+            instance = %conn_instance_id,
+            "Retrying after {}",
+            response.status()
+        );
+        let mut labels = std::collections::HashMap::new();
+        labels.insert("process".to_string(), process.to_string());
+        let metrics = state.hypervisor.metrics();
+        metrics
+            .requests_retried_total
+            .with_labels(&labels)
+            .await
+            .inc();
+        let req = copy_request(template);
+        response = send_upstream(state, process, protocol, &target, req, timeout, trace).await;
+    }
+    let upstream_ms = upstream_started.elapsed().as_secs_f64() * 1000.0;
+
+    // Redirects to the internal address would leak it to the client
+    if let (Some(upstream), Some(public_host)) = (&upstream_addr, &public_host) {
+        let rewritten = response
+            .headers()
+            .get(axum::http::header::LOCATION)
+            .and_then(|h| h.to_str().ok())
+            .and_then(|loc| rewrite_location(loc, upstream, proto, public_host))
+            .and_then(|loc| axum::http::HeaderValue::from_str(&loc).ok());
+        if let Some(value) = rewritten {
+            response
+                .headers_mut()
+                .insert(axum::http::header::LOCATION, value);
+        }
+    }
+
+    // Upgraded connections and streamed bodies stay active connections until they end
+    let idle = state.hypervisor.stream_idle_timeout(process);
+    let response = match client_upgrade {
+        Some(client) if response.status() == StatusCode::SWITCHING_PROTOCOLS => {
+            splice_upgrade(client, response, idle, conn_guard)
+        }
+        _ => stream_response(response, conn_guard, idle),
+    };
+
+    // Record request metrics
+    let duration_ms = start.elapsed().as_secs_f64() * 1000.0;
+    let instance_id = conn_instance_id;
+    let metrics = state.hypervisor.metrics();
+    let mut response = match grpc_path {
+        Some(path) => observe_grpc_call(metrics.clone(), process, &path, start, response),
+        None => response,
+    };
+    let mut labels = std::collections::HashMap::new();
+    labels.insert("process".to_string(), process.to_string());
+    labels.insert("instance".to_string(), instance_id.to_string());
+    let counter = metrics.requests_total.with_labels(&labels).await;
+    counter.inc();
+    let histogram = metrics.request_duration_ms.with_labels(&labels).await;
+    histogram.observe(duration_ms);
+    if response.status().is_server_error() {
+        let errors = metrics.request_errors_total.with_labels(&labels).await;
+        errors.inc();
+    }
+    labels.insert("status".to_string(), response.status().as_u16().to_string());
+    metrics.responses_total.with_labels(&labels).await.inc();
+
+    if let Some((cache, key, _)) = cached {
+        response = store_response(cache, key, response);
+    }
+    response.extensions_mut().insert(Answered {
+        instance: instance_id,
+        upstream_ms,
+    });
+    response
+}
+
+/// The node to forward a request to, when this one is in a cluster: a standby
+/// that doesn't lead sends everything to the leader, and an active node sends
+/// requests for instances it doesn't run to a peer running them. A request
+/// another node forwarded is always answered here.
+async fn cluster_peer(
+    state: &AppState,
+    process: &str,
+    id: Option<&str>,
+    req: &Request<Body>,
+) -> Option<String> {
+    let cluster = state.hypervisor.cluster()?;
+    if req.headers().contains_key(HOP_HEADER) {
+        return None;
+    }
+    if cluster.mode() == ClusterMode::Active {
+        let runs_here = match id {
+            Some(id) => {
+                let instance_id = state.hypervisor.pick_replica(process, id).await;
+                state.hypervisor.get(process, &instance_id).await.is_some()
+            }
+            None => !state.hypervisor.list_by_process(process).await.is_empty(),
+        };
+        if runs_here {
+            return None;
+        }
+    }
+    cluster.peer_for(process, id, std::time::Instant::now())
+}
+
+/// Proxy a request to another cluster node, marked so it goes no further and
+/// carrying the cluster token so the peer takes it
+async fn forward_to_peer(
+    state: &AppState,
+    process: &str,
+    address: &str,
+    mut req: Request<Body>,
+) -> Response {
+    let client_ip = req
+        .extensions()
+        .get::<axum::extract::ConnectInfo<SocketAddr>>()
+        .map(|info| info.0.ip());
+    let proto = if state.tls_status.enabled {
+        "https"
+    } else {
+        "http"
+    };
+    add_forwarded_headers(req.headers_mut(), proto, client_ip);
+    let Some(cluster) = state.hypervisor.cluster() else {
+        return (StatusCode::BAD_GATEWAY, "Bad gateway").into_response();
+    };
+    let token = cluster
+        .token()
+        .and_then(|t| axum::http::HeaderValue::from_str(&t).ok());
+    let Some(token) = token else {
+        tracing::error!("No cluster token; not forwarding to {}", address);
+        return (StatusCode::BAD_GATEWAY, "Bad gateway").into_response();
+    };
+    req.headers_mut().insert(TOKEN_HEADER, token);
+    if let Ok(node) = axum::http::HeaderValue::from_str(cluster.node()) {
+        req.headers_mut().insert(HOP_HEADER, node);
+    }
+    tracing::debug!(
+        process = process,
+        peer = address,
+        "forwarding to cluster peer"
+    );
+
+    let timeout = state.hypervisor.request_timeout(process);
+    match tokio::time::timeout(timeout, proxy_to_tcp(&state.client, address, req)).await {
+        Ok(response) => response,
+        Err(_) => {
+            tracing::error!(
+                "Request to cluster peer {} timed out after {:?}",
+                address,
+                timeout
+            );
+            (StatusCode::GATEWAY_TIMEOUT, "Gateway timeout").into_response()
+        }
+    }
+}
+
+/// The 503 served for a service in maintenance mode: its `maintenance_page`,
+/// read on each request so it can be edited in place, or the built-in page
+async fn maintenance_response(state: &AppState, process: &str, retry_after: u64) -> Response {
+    let page = match state.hypervisor.maintenance_page(process) {
+        Some(path) => match tokio::fs::read_to_string(&path).await {
+            Ok(page) => Some(page),
+            Err(e) => {
+                tracing::warn!(
+                    "Can't read maintenance page {} for {}: {}",
+                    path.display(),
+                    process,
+                    e
+                );
+                None
+            }
+        },
+        None => None,
+    };
+    (
+        StatusCode::SERVICE_UNAVAILABLE,
+        [
+            (
+                axum::http::header::CONTENT_TYPE,
+                "text/html; charset=utf-8".to_string(),
+            ),
+            (axum::http::header::CACHE_CONTROL, "no-store".to_string()),
+            (axum::http::header::RETRY_AFTER, retry_after.to_string()),
+        ],
+        page.unwrap_or_else(|| MAINTENANCE_PAGE.to_string()),
+    )
+        .into_response()
+}
+
+/// Send a request to `target` in the service's protocol, answering 504 if it
+/// takes longer than `timeout`
+async fn send_upstream(
+    state: &AppState,
+    process: &str,
+    protocol: BackendProtocol,
+    target: &ProxyTarget,
+    mut req: Request<Body>,
+    timeout: std::time::Duration,
+    trace: Option<TraceContext>,
+) -> Response {
+    // The backend sees this span as its parent
+    let span = state.hypervisor.tracer().map(|tracer| {
+        let mut span = tracer.start("upstream", SpanKind::Client, trace.as_ref());
+        span.set("tenement.app", process);
+        let address = target.tcp_addr();
+        span.set(
+            "server.address",
+            address.unwrap_or_else(|| target.socket.display().to_string()),
+        );
+        span
+    });
+    if let Some(span) = &span {
+        if let Ok(value) = axum::http::HeaderValue::from_str(&span.context().traceparent()) {
+            req.headers_mut().insert(TRACEPARENT, value);
+        }
+    }
+
     let proxy_future: std::pin::Pin<Box<dyn std::future::Future<Output = Response> + Send>> =
         if let Some(addr) = target.tcp_addr() {
-            let client = state.client.clone();
+            let client = match protocol.is_http2() {
+                true => state.h2_client.clone(),
+                false => state.client.clone(),
+            };
             Box::pin(async move { proxy_to_tcp(&client, &addr, req).await })
         } else {
             let socket = target.socket.clone();
-            let unix_client = state.unix_client.clone();
-            Box::pin(async move { proxy_to_unix_socket(&unix_client, &socket, req).await })
+            let pool = state.hypervisor.connection_pool(process);
+            let client = state
+                .upstream_pools
+                .client(process, &pool, protocol.is_http2());
+            Box::pin(async move { proxy_to_unix_socket(&client, &socket, req).await })
         };
 
     let response = match tokio::time::timeout(timeout, proxy_future).await {
@@ -1152,28 +3839,50 @@ async fn proxy_to_instance(
                 timeout,
                 process
             );
-            (StatusCode::GATEWAY_TIMEOUT, "Gateway timeout").into_response()
+            let mut response = (StatusCode::GATEWAY_TIMEOUT, "Gateway timeout").into_response();
+            response.extensions_mut().insert(ProxyTimedOut);
+            response
         }
     };
+    if let Some(span) = span {
+        end_http_span(span, response.status());
+    }
+    response
+}
 
-    // Record request metrics
-    let duration_ms = start.elapsed().as_secs_f64() * 1000.0;
-    let instance_id = conn_instance_id;
-    let metrics = state.hypervisor.metrics();
-    let mut labels = std::collections::HashMap::new();
-    labels.insert("process".to_string(), process.to_string());
-    labels.insert("instance".to_string(), instance_id.to_string());
-    let counter = metrics.requests_total.with_labels(&labels).await;
-    counter.inc();
-    let histogram = metrics.request_duration_ms.with_labels(&labels).await;
-    histogram.observe(duration_ms);
+/// Responses that count against an instance's circuit breaker, and that a
+/// retry might do better on
+fn is_upstream_failure(status: StatusCode) -> bool {
+    matches!(
+        status,
+        StatusCode::BAD_GATEWAY | StatusCode::SERVICE_UNAVAILABLE | StatusCode::GATEWAY_TIMEOUT
+    )
+}
 
-    response
+/// Whether a request can safely be sent again: an idempotent method, no body
+fn is_replayable(req: &Request<Body>) -> bool {
+    use axum::http::Method;
+    let idempotent = matches!(
+        *req.method(),
+        Method::GET | Method::HEAD | Method::OPTIONS | Method::PUT | Method::DELETE
+    );
+    idempotent && hyper::body::Body::size_hint(req.body()).exact() == Some(0)
 }
 
-/// Proxy an HTTP request to a Unix socket (uses pooled client)
+/// A body-less copy of a request, to send on a retry
+fn copy_request(req: &Request<Body>) -> Request<Body> {
+    let mut copy = Request::new(Body::empty());
+    *copy.method_mut() = req.method().clone();
+    *copy.uri_mut() = req.uri().clone();
+    *copy.version_mut() = req.version();
+    *copy.headers_mut() = req.headers().clone();
+    copy
+}
+
+/// Proxy an HTTP request to a Unix socket over the service's connection pool.
+/// The request body is streamed to the backend as it arrives, never buffered.
 async fn proxy_to_unix_socket(
-    client: &Client<UnixConnector, Body>,
+    client: &UpstreamClient,
     socket_path: &Path,
     req: Request<Body>,
 ) -> Response {
@@ -1183,15 +3892,11 @@ async fn proxy_to_unix_socket(
         .path_and_query()
         .map(|pq| pq.as_str())
         .unwrap_or("/");
-    let socket_uri = hyperlocal::Uri::new(socket_path, path_and_query);
+    let socket_uri = SocketUri::new(socket_path, path_and_query);
 
-    // Build proxy request preserving method and headers
-    let mut proxy_req = Request::builder().method(req.method()).uri(socket_uri);
-
-    // Copy headers from original request
-    for (key, value) in req.headers() {
-        proxy_req = proxy_req.header(key, value);
-    }
+    // Build proxy request preserving method and end-to-end headers
+    let builder = Request::builder().method(req.method()).uri(socket_uri);
+    let proxy_req = forward_headers(builder, req.headers());
 
     let proxy_req = match proxy_req.body(req.into_body()) {
         Ok(r) => r,
@@ -1207,11 +3912,7 @@ async fn proxy_to_unix_socket(
 
     // Forward request to Unix socket
     match client.request(proxy_req).await {
-        Ok(response) => {
-            // Convert hyper Response to axum Response
-            let (parts, body) = response.into_parts();
-            Response::from_parts(parts, Body::new(body))
-        }
+        Ok(response) => proxy_response(response),
         Err(e) => {
             tracing::error!("Proxy error to {}: {}", socket_path.display(), e);
             (StatusCode::BAD_GATEWAY, "Bad gateway".to_string()).into_response()
@@ -1219,9 +3920,400 @@ async fn proxy_to_unix_socket(
     }
 }
 
-/// Proxy an HTTP request to a TCP address
+/// Headers that describe a single connection (RFC 9110 section 7.6.1) and must not be
+/// forwarded: the fixed set plus anything named in `Connection`
+fn hop_by_hop_headers(headers: &axum::http::HeaderMap) -> Vec<axum::http::HeaderName> {
+    use axum::http::{header, HeaderName};
+
+    let mut names = vec![
+        header::CONNECTION,
+        header::TE,
+        header::TRAILER,
+        header::TRANSFER_ENCODING,
+        header::UPGRADE,
+        HeaderName::from_static("keep-alive"),
+        HeaderName::from_static("proxy-connection"),
+    ];
+    for value in headers.get_all(header::CONNECTION) {
+        let Ok(value) = value.to_str() else { continue };
+        names.extend(
+            value
+                .split(',')
+                .filter_map(|name| HeaderName::from_bytes(name.trim().as_bytes()).ok()),
+        );
+    }
+    names
+}
+
+/// Drop hop-by-hop headers from a proxied response. The body has already been
+/// de-chunked by the client, and the server re-frames it for the caller's
+/// protocol: chunked or keep-alive for HTTP/1.1, Content-Length or
+/// close-delimited with `Connection: close` for HTTP/1.0.
+fn strip_hop_by_hop(headers: &mut axum::http::HeaderMap) {
+    for name in hop_by_hop_headers(headers) {
+        headers.remove(name);
+    }
+}
+
+/// The protocol a request asks to switch to (`Connection: upgrade` with an
+/// `Upgrade` header), e.g. `websocket`
+fn requested_upgrade(headers: &axum::http::HeaderMap) -> Option<axum::http::HeaderValue> {
+    use axum::http::header;
+
+    let asks = headers
+        .get_all(header::CONNECTION)
+        .iter()
+        .filter_map(|value| value.to_str().ok())
+        .flat_map(|value| value.split(','))
+        .any(|token| token.trim().eq_ignore_ascii_case("upgrade"));
+    asks.then(|| headers.get(header::UPGRADE).cloned())
+        .flatten()
+}
+
+/// The upstream request's headers: end-to-end ones, plus the upgrade handshake
+/// when the client asked for one (hop-by-hop, so otherwise dropped)
+fn forward_headers(
+    mut builder: axum::http::request::Builder,
+    headers: &axum::http::HeaderMap,
+) -> axum::http::request::Builder {
+    use axum::http::header;
+
+    let hop_by_hop = hop_by_hop_headers(headers);
+    for (key, value) in headers {
+        if !hop_by_hop.contains(key) {
+            builder = builder.header(key, value);
+        }
+    }
+    // Trailers are passed through, so the client's acceptance of them is too
+    // (gRPC servers refuse calls without it)
+    if let Some(te) = headers
+        .get(header::TE)
+        .filter(|te| te.as_bytes() == b"trailers")
+    {
+        builder = builder.header(header::TE, te);
+    }
+    if let Some(protocol) = requested_upgrade(headers) {
+        builder = builder
+            .header(header::CONNECTION, "upgrade")
+            .header(header::UPGRADE, protocol);
+    }
+    builder
+}
+
+/// A backend's response as the client's, minus hop-by-hop headers. A 101
+/// Switching Protocols keeps its handshake, and the backend's upgraded
+/// connection rides along in the extensions for [`splice_upgrade`].
+fn proxy_response(response: axum::http::Response<hyper::body::Incoming>) -> Response {
+    use axum::http::{header, HeaderValue};
+
+    let (mut parts, body) = response.into_parts();
+    let upgrade = match parts.status {
+        StatusCode::SWITCHING_PROTOCOLS => parts.headers.get(header::UPGRADE).cloned(),
+        _ => None,
+    };
+    strip_hop_by_hop(&mut parts.headers);
+    if let Some(protocol) = upgrade {
+        parts
+            .headers
+            .insert(header::CONNECTION, HeaderValue::from_static("upgrade"));
+        parts.headers.insert(header::UPGRADE, protocol);
+    }
+    Response::from_parts(parts, Body::new(body))
+}
+
+/// Once the backend has switched protocols, join the client's upgraded
+/// connection to the backend's and copy bytes both ways until either side
+/// closes, or nothing has moved for `idle`. `guard` is held for as long as the
+/// tunnel is open.
+fn splice_upgrade<G: Send + 'static>(
+    client: hyper::upgrade::OnUpgrade,
+    mut response: Response,
+    idle: Option<std::time::Duration>,
+    guard: G,
+) -> Response {
+    let backend = hyper::upgrade::on(&mut response);
+    tokio::spawn(async move {
+        let _guard = guard;
+        let (client, backend) = match tokio::try_join!(client, backend) {
+            Ok(upgraded) => upgraded,
+            Err(e) => {
+                tracing::debug!("Upgrade failed: {}", e);
+                return;
+            }
+        };
+        let mut client = hyper_util::rt::TokioIo::new(client);
+        let mut backend = hyper_util::rt::TokioIo::new(backend);
+        if let Err(e) =
+            tenement::streams::copy_bidirectional_idle(&mut client, &mut backend, idle).await
+        {
+            tracing::debug!("Upgraded connection closed: {}", e);
+        }
+    });
+    response
+}
+
+/// Record a gRPC call once its response stream ends: the `grpc-status` from
+/// the trailers (or the headers, for a trailers-only response) and how long the
+/// whole call took. A call that ends without a status counts as code "none".
+fn observe_grpc_call(
+    metrics: Arc<tenement::Metrics>,
+    process: &str,
+    path: &str,
+    start: std::time::Instant,
+    response: Response,
+) -> Response {
+    use http_body_util::BodyExt;
+
+    let (service, method) = grpc_method(path);
+    let mut labels = std::collections::HashMap::new();
+    labels.insert("process".to_string(), process.to_string());
+    labels.insert("service".to_string(), service.to_string());
+    labels.insert("method".to_string(), method.to_string());
+    let header_status = grpc_status(response.headers());
+
+    let (status_tx, status_rx) = tokio::sync::oneshot::channel();
+    let mut status_tx = Some(status_tx);
+    let (parts, body) = response.into_parts();
+    let body = Body::new(body.map_frame(move |frame| {
+        if let Some(status) = frame.trailers_ref().and_then(grpc_status) {
+            if let Some(tx) = status_tx.take() {
+                let _ = tx.send(status);
+            }
+        }
+        frame
+    }));
+
+    // The sender is dropped with the body, once it has been sent or abandoned
+    tokio::spawn(async move {
+        let code = match status_rx.await {
+            Ok(code) => code,
+            Err(_) => header_status.unwrap_or_else(|| "none".to_string()),
+        };
+        let duration_ms = start.elapsed().as_secs_f64() * 1000.0;
+        let histogram = metrics.grpc_request_duration_ms.with_labels(&labels).await;
+        histogram.observe(duration_ms);
+        labels.insert("code".to_string(), code);
+        metrics.grpc_requests_total.with_labels(&labels).await.inc();
+    });
+    Response::from_parts(parts, body)
+}
+
+/// The service and method of a gRPC call from its path, `/package.Service/Method`
+fn grpc_method(path: &str) -> (&str, &str) {
+    path.strip_prefix('/')
+        .and_then(|rest| rest.split_once('/'))
+        .filter(|(service, method)| {
+            !service.is_empty() && !method.is_empty() && !method.contains('/')
+        })
+        .unwrap_or(("unknown", "unknown"))
+}
+
+/// The `grpc-status` code in a call's headers or trailers
+fn grpc_status(headers: &axum::http::HeaderMap) -> Option<String> {
+    headers
+        .get("grpc-status")
+        .and_then(|value| value.to_str().ok())
+        .map(str::to_string)
+}
+
+/// The response cache key for `req`, and whether a stored copy may answer it.
+/// Only GETs without credentials use the cache; a client asking for `no-store`
+/// skips it, and one asking for `no-cache` gets (and stores) a fresh answer.
+fn cache_request(req: &Request<Body>) -> Option<(String, bool)> {
+    use axum::http::header;
+
+    let headers = req.headers();
+    if req.method() != axum::http::Method::GET
+        || headers.contains_key(header::AUTHORIZATION)
+        || requested_upgrade(headers).is_some()
+    {
+        return None;
+    }
+    let control = headers
+        .get(header::CACHE_CONTROL)
+        .and_then(|v| v.to_str().ok())
+        .map(CacheControl::parse)
+        .unwrap_or_default();
+    if control.no_store {
+        return None;
+    }
+    let pragma = headers
+        .get(header::PRAGMA)
+        .and_then(|v| v.to_str().ok())
+        .is_some_and(|v| v.contains("no-cache"));
+    let reuse = !(control.no_cache || control.max_age == Some(0) || pragma);
+    let host = headers.get(header::HOST).and_then(|v| v.to_str().ok());
+    let path = req.uri().path_and_query().map_or("/", |pq| pq.as_str());
+    Some((ResponseCache::key(host, path), reuse))
+}
+
+/// Answer from a cached copy, with its `Age`
+fn cached_response(hit: Hit) -> Response {
+    use axum::http::{HeaderName, HeaderValue};
+
+    let mut response = Response::new(Body::from(hit.response.body));
+    *response.status_mut() = StatusCode::from_u16(hit.response.status).unwrap_or(StatusCode::OK);
+    let headers = response.headers_mut();
+    for (name, value) in &hit.response.headers {
+        let name = HeaderName::from_bytes(name.as_bytes());
+        if let (Ok(name), Ok(value)) = (name, HeaderValue::from_str(value)) {
+            headers.append(name, value);
+        }
+    }
+    let age = HeaderValue::from(hit.age.as_secs());
+    headers.insert(axum::http::header::AGE, age);
+    headers.insert("x-cache", HeaderValue::from_static("HIT"));
+    response
+}
+
+/// Keep a copy of `response` in `cache` as its body streams to the client,
+/// when the app lets shared caches store it. Answers that set cookies, vary
+/// by request headers or come encoded aren't kept, nor bodies cut short or
+/// over `max_entry_size`.
+fn store_response(cache: Arc<ResponseCache>, key: String, response: Response) -> Response {
+    use axum::http::header;
+
+    let headers = response.headers();
+    let cache_control = headers
+        .get(header::CACHE_CONTROL)
+        .and_then(|v| v.to_str().ok());
+    let status = response.status().as_u16();
+    let Some(ttl) = cache.ttl(status, cache_control) else {
+        return response;
+    };
+    // The proxy's own compression comes later, so Accept-Encoding is no variant
+    let varies = headers.get_all(header::VARY).iter().any(|value| {
+        value.to_str().map_or(true, |value| {
+            value
+                .split(',')
+                .any(|name| !name.trim().eq_ignore_ascii_case("accept-encoding"))
+        })
+    });
+    let too_big = headers
+        .get(header::CONTENT_LENGTH)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| v.parse::<usize>().ok())
+        .is_some_and(|len| len > cache.max_entry_bytes());
+    if varies
+        || too_big
+        || headers.contains_key(header::SET_COOKIE)
+        || headers.contains_key(header::CONTENT_ENCODING)
+    {
+        return response;
+    }
+    let stored_headers: Vec<(String, String)> = headers
+        .iter()
+        .filter(|(name, _)| *name != header::CONNECTION && *name != header::TRANSFER_ENCODING)
+        .filter_map(|(name, value)| Some((name.to_string(), value.to_str().ok()?.to_string())))
+        .collect();
+
+    let max = cache.max_entry_bytes();
+    let collected = Arc::new(std::sync::Mutex::new(Some(Vec::new())));
+    let collecting = collected.clone();
+    let (parts, body) = response.into_parts();
+    let data = body.into_data_stream().map(move |chunk| {
+        let mut buffer = collecting.lock().unwrap();
+        match (&chunk, buffer.as_mut()) {
+            (Ok(data), Some(body)) if body.len() + data.len() <= max => {
+                body.extend_from_slice(data)
+            }
+            _ => *buffer = None,
+        }
+        chunk
+    });
+    // Runs once the whole body has gone out
+    let done = futures::stream::once(async move {
+        let body = collected.lock().unwrap().take();
+        if let Some(body) = body {
+            let response = CachedResponse {
+                status,
+                headers: stored_headers,
+                body,
+            };
+            cache.insert(key, response, ttl);
+        }
+        None::<Result<axum::body::Bytes, axum::Error>>
+    });
+    let body = Body::from_stream(data.chain(done.filter_map(|item| item)));
+    Response::from_parts(parts, body)
+}
+
+/// Hold `guard` until the response body has been sent, so a streamed response
+/// (SSE, a long download) counts as an active connection for its whole life.
+/// An event stream that sends nothing for `idle` is ended.
+fn stream_response<G: Send + 'static>(
+    response: Response,
+    guard: G,
+    idle: Option<std::time::Duration>,
+) -> Response {
+    use http_body_util::BodyExt;
+
+    let event_stream = response
+        .headers()
+        .get(axum::http::header::CONTENT_TYPE)
+        .and_then(|value| value.to_str().ok())
+        .is_some_and(|value| value.starts_with("text/event-stream"));
+    let (parts, body) = response.into_parts();
+    let body = Body::new(body.map_frame(move |frame| {
+        let _held = &guard;
+        frame
+    }));
+    let body = match idle {
+        Some(idle) if event_stream => {
+            Body::from_stream(body.into_data_stream().timeout(idle).map_while(Result::ok))
+        }
+        _ => body,
+    };
+    Response::from_parts(parts, body)
+}
+
+/// HTTP connector for TCP backends that hands out pre-opened connections from the
+/// hypervisor's warm pool before dialing. Once used, a connection lives in the
+/// client's own keep-alive pool like any other.
+#[derive(Clone)]
+pub struct WarmConnector {
+    http: hyper_util::client::legacy::connect::HttpConnector,
+    warm_pool: Arc<tenement::WarmPool>,
+}
+
+impl WarmConnector {
+    pub fn new(warm_pool: Arc<tenement::WarmPool>) -> Self {
+        Self {
+            http: hyper_util::client::legacy::connect::HttpConnector::new(),
+            warm_pool,
+        }
+    }
+}
+
+impl tower::Service<axum::http::Uri> for WarmConnector {
+    type Response = hyper_util::rt::TokioIo<tokio::net::TcpStream>;
+    type Error = Box<dyn std::error::Error + Send + Sync>;
+    type Future = std::pin::Pin<
+        Box<dyn std::future::Future<Output = Result<Self::Response, Self::Error>> + Send>,
+    >;
+
+    fn poll_ready(
+        &mut self,
+        cx: &mut std::task::Context<'_>,
+    ) -> std::task::Poll<Result<(), Self::Error>> {
+        tower::Service::poll_ready(&mut self.http, cx).map_err(Into::into)
+    }
+
+    fn call(&mut self, uri: axum::http::Uri) -> Self::Future {
+        // Backends always listen on loopback (see InstanceInfo::tcp_addr)
+        if uri.host() == Some("127.0.0.1") {
+            if let Some(stream) = uri.port_u16().and_then(|port| self.warm_pool.take(port)) {
+                return Box::pin(async move { Ok(hyper_util::rt::TokioIo::new(stream)) });
+            }
+        }
+        let connecting = tower::Service::call(&mut self.http, uri);
+        Box::pin(async move { connecting.await.map_err(Into::into) })
+    }
+}
+
+/// Proxy an HTTP request to a TCP address (request body streamed, as for sockets)
 async fn proxy_to_tcp(
-    client: &Client<hyper_util::client::legacy::connect::HttpConnector, Body>,
+    client: &Client<WarmConnector, Body>,
     addr: &str,
     req: Request<Body>,
 ) -> Response {
@@ -1233,13 +4325,9 @@ async fn proxy_to_tcp(
         .unwrap_or("/");
     let uri = format!("http://{}{}", addr, path_and_query);
 
-    // Build proxy request preserving method and headers
-    let mut proxy_req = Request::builder().method(req.method()).uri(&uri);
-
-    // Copy headers from original request
-    for (key, value) in req.headers() {
-        proxy_req = proxy_req.header(key, value);
-    }
+    // Build proxy request preserving method and end-to-end headers
+    let builder = Request::builder().method(req.method()).uri(&uri);
+    let proxy_req = forward_headers(builder, req.headers());
 
     let proxy_req = match proxy_req.body(req.into_body()) {
         Ok(r) => r,
@@ -1255,11 +4343,7 @@ async fn proxy_to_tcp(
 
     // Forward request to TCP address
     match client.request(proxy_req).await {
-        Ok(response) => {
-            // Convert hyper Response to axum Response
-            let (parts, body) = response.into_parts();
-            Response::from_parts(parts, Body::new(body))
-        }
+        Ok(response) => proxy_response(response),
         Err(e) => {
             tracing::error!("Proxy error to {}: {}", addr, e);
             (StatusCode::BAD_GATEWAY, "Bad gateway".to_string()).into_response()
@@ -1322,29 +4406,41 @@ mod tests {
     /// Create test state with auth token
     /// Returns (state, token, temp_dir) - temp_dir must be kept alive during test
     async fn create_test_state() -> (AppState, String, TempDir) {
+        create_test_state_with_config(Config::default()).await
+    }
+
+    async fn create_test_state_with_config(config: Config) -> (AppState, String, TempDir) {
         let dir = TempDir::new().unwrap();
         let db_path = dir.path().join("test.db");
         let pool = init_db(&db_path).await.unwrap();
         let config_store = Arc::new(ConfigStore::new(pool.clone()));
         let deploy_log = Arc::new(tenement::DeployLogStore::new(pool.clone()));
-        let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool));
+        let releases = Arc::new(tenement::ReleaseStore::new(pool.clone()));
+        let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool.clone()));
+        let api_tokens = Arc::new(tenement::ApiTokenStore::new(pool));
 
         // Generate and store a test token
         let token_store = TokenStore::new(&config_store);
         let token = token_store.generate_and_store().await.unwrap();
 
-        let config = Config::default();
         let hypervisor = Hypervisor::new(config);
-        let client = Client::builder(TokioExecutor::new()).build_http();
-        let unix_client = Client::builder(TokioExecutor::new()).build(UnixConnector);
+        let client = Client::builder(TokioExecutor::new())
+            .build(WarmConnector::new(hypervisor.warm_pool()));
+        let h2_client = Client::builder(TokioExecutor::new())
+            .http2_only(true)
+            .build(WarmConnector::new(hypervisor.warm_pool()));
         let state = AppState {
             hypervisor,
             domain: "example.com".to_string(),
             client,
-            unix_client,
+            h2_client,
+            upstream_pools: Arc::new(UpstreamPools::new()),
             config_store,
             deploy_log,
+            releases,
             tenant_tokens,
+            api_tokens,
+            admin_tokens: AdminTokens::empty(),
             tls_status: TlsStatus::default(),
             auth_failures: Arc::new(tokio::sync::RwLock::new((0, None))),
         };
@@ -1352,601 +4448,4208 @@ mod tests {
     }
 
     #[tokio::test]
-    async fn test_health_endpoint() {
-        let (state, _token, _dir) = create_test_state().await;
+    async fn test_health_endpoint() {
+        let (state, _token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server.get("/health").await;
+        response.assert_status_ok();
+
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["status"], "ok");
+    }
+
+    #[tokio::test]
+    async fn test_http_listener_answers_http01_and_redirects() {
+        let http01 = Arc::new(crate::acme_dns::Http01Tokens::default());
+        http01.insert("tok", "thumb");
+        let server = TestServer::new(redirect_router(443, http01)).unwrap();
+
+        let response = server
+            .get("/.well-known/acme-challenge/tok")
+            .add_header("Host", "example.com")
+            .await;
+        response.assert_status_ok();
+        assert_eq!(response.text(), "tok.thumb");
+        let response = server
+            .get("/.well-known/acme-challenge/other")
+            .add_header("Host", "example.com")
+            .await;
+        response.assert_status(StatusCode::NOT_FOUND);
+
+        let response = server.get("/app").add_header("Host", "example.com").await;
+        response.assert_status(StatusCode::PERMANENT_REDIRECT);
+        assert_eq!(response.header("location"), "https://example.com/app");
+    }
+
+    #[tokio::test]
+    async fn test_instances_endpoint_empty() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/instances")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert!(json.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_jobs_endpoint() {
+        let config = Config::from_str(
+            "[jobs.backup]\nschedule = \"0 3 * * *\"\ncommand = \"true\"\n",
+        )
+        .unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/api/jobs")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 1);
+        assert_eq!(json[0]["name"], "backup");
+        assert_eq!(json[0]["timezone"], "UTC");
+        assert!(json[0]["next_run"].is_string());
+        assert!(json[0]["last_run"].is_null());
+    }
+
+    #[tokio::test]
+    async fn test_dashboard_endpoint() {
+        let (state, _token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server.get("/").await;
+        response.assert_status_ok();
+        response.assert_text_contains("tenement dashboard");
+    }
+
+    #[tokio::test]
+    async fn test_dashboard_on_its_own_listener() {
+        let config = Config::from_str("[settings.dashboard]\nlisten = \"127.0.0.1:0\"\n").unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let public = TestServer::new(create_router(state.clone())).unwrap();
+        public.get("/").await.assert_status_not_found();
+        public
+            .get("/assets/index.js")
+            .await
+            .assert_status_not_found();
+
+        let addr = spawn_dashboard_listener(state, "127.0.0.1:0".parse().unwrap(), None)
+            .await
+            .unwrap();
+        let client = reqwest::Client::new();
+        let response = client
+            .get(format!("http://{}/", addr))
+            .send()
+            .await
+            .unwrap();
+        assert_eq!(response.status(), reqwest::StatusCode::OK);
+        let page = response.text().await.unwrap();
+        assert!(page.contains("tenement dashboard"));
+
+        // The page is public, the API behind it is not
+        let url = format!("http://{}/api/instances", addr);
+        let response = client.get(&url).send().await.unwrap();
+        assert_eq!(response.status(), reqwest::StatusCode::UNAUTHORIZED);
+        let response = client.get(&url).bearer_auth(&token).send().await.unwrap();
+        assert_eq!(response.status(), reqwest::StatusCode::OK);
+    }
+
+    #[tokio::test]
+    async fn test_disabled_dashboard_is_not_served() {
+        let config = Config::from_str("[settings.dashboard]\nenabled = false\n").unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        server.get("/").await.assert_status_not_found();
+    }
+
+    #[tokio::test]
+    async fn test_deploys_endpoint() {
+        let (state, admin_token, tenant_token, _dir) = create_test_state_with_tenant().await;
+        state
+            .deploy_log
+            .log("deploy", "api", "v1", Some("weight=100"), true)
+            .await
+            .unwrap();
+        state
+            .deploy_log
+            .log("restart", "api", "prod", None, false)
+            .await
+            .unwrap();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/api/deploys?limit=1")
+            .add_header("Authorization", format!("Bearer {}", admin_token))
+            .await;
+        response.assert_status_ok();
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 1);
+
+        let response = server
+            .get("/api/deploys")
+            .add_header("Authorization", format!("Bearer {}", admin_token))
+            .await;
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 2);
+        let deploy = json.iter().find(|e| e["action"] == "deploy").unwrap();
+        assert_eq!(deploy["success"], true);
+
+        let response = server
+            .get("/api/deploys")
+            .add_header("Authorization", format!("Bearer {}", tenant_token))
+            .await;
+        response.assert_status_forbidden();
+    }
+
+    #[tokio::test]
+    async fn test_audit_endpoint_filters_and_records_rejected_tokens() {
+        let (state, admin_token, tenant_token, _dir) = create_test_state_with_tenant().await;
+        let deploy_log = state.deploy_log.clone();
+        deploy_log
+            .log_as(Some("token:ci"), "deploy", "api", "v1", None, true)
+            .await
+            .unwrap();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/api/instances")
+            .add_header("Authorization", "Bearer not-a-token")
+            .await;
+        response.assert_status_unauthorized();
+
+        let response = server
+            .get("/api/audit?failed=true&action=auth")
+            .add_header("Authorization", format!("Bearer {}", admin_token))
+            .await;
+        response.assert_status_ok();
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 1);
+        assert_eq!(json[0]["details"], "GET /api/instances rejected");
+
+        let response = server
+            .get("/api/audit?actor=token:ci")
+            .add_header("Authorization", format!("Bearer {}", admin_token))
+            .await;
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 1);
+        assert_eq!(json[0]["action"], "deploy");
+
+        let response = server
+            .get("/api/audit?since=yesterday")
+            .add_header("Authorization", format!("Bearer {}", admin_token))
+            .await;
+        response.assert_status_bad_request();
+
+        let response = server
+            .get("/api/audit")
+            .add_header("Authorization", format!("Bearer {}", tenant_token))
+            .await;
+        response.assert_status_forbidden();
+    }
+
+    #[tokio::test]
+    async fn test_unknown_subdomain_returns_404() {
+        let (state, _token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        // Simulate request to subdomain for unconfigured process
+        let response = server
+            .get("/some-path")
+            .add_header("Host", "prod.api.example.com")
+            .await;
+
+        response.assert_status_not_found();
+        // Error message is sanitized (no internal details for unauthenticated users)
+        response.assert_text_contains("Not found");
+    }
+
+    #[tokio::test]
+    async fn test_logs_endpoint_empty() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/logs")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert!(json.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_logs_endpoint_with_entries() {
+        let (state, token, _dir) = create_test_state().await;
+        let log_buffer = state.hypervisor.log_buffer();
+
+        // Add some log entries
+        log_buffer
+            .push_stdout("api", "prod", "hello world".to_string())
+            .await;
+        log_buffer
+            .push_stderr("api", "prod", "error message".to_string())
+            .await;
+
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/logs")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_logs_endpoint_filter_by_process() {
+        let (state, token, _dir) = create_test_state().await;
+        let log_buffer = state.hypervisor.log_buffer();
+
+        // Add entries for different processes
+        log_buffer
+            .push_stdout("api", "prod", "api message".to_string())
+            .await;
+        log_buffer
+            .push_stdout("web", "prod", "web message".to_string())
+            .await;
+
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/logs?process=api")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 1);
+        assert_eq!(json[0]["process"], "api");
+    }
+
+    #[tokio::test]
+    async fn test_logs_endpoint_filter_by_id() {
+        let (state, token, _dir) = create_test_state().await;
+        let log_buffer = state.hypervisor.log_buffer();
+
+        // Add entries for different instances
+        log_buffer
+            .push_stdout("api", "prod", "prod message".to_string())
+            .await;
+        log_buffer
+            .push_stdout("api", "staging", "staging message".to_string())
+            .await;
+
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/logs?id=prod")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 1);
+        assert_eq!(json[0]["instance_id"], "prod");
+    }
+
+    #[tokio::test]
+    async fn test_logs_endpoint_filter_by_level() {
+        let (state, token, _dir) = create_test_state().await;
+        let log_buffer = state.hypervisor.log_buffer();
+
+        // Add stdout and stderr entries
+        log_buffer
+            .push_stdout("api", "prod", "stdout message".to_string())
+            .await;
+        log_buffer
+            .push_stderr("api", "prod", "stderr message".to_string())
+            .await;
+
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/logs?level=stderr")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 1);
+        assert_eq!(json[0]["level"], "stderr");
+    }
+
+    #[tokio::test]
+    async fn test_logs_endpoint_with_limit() {
+        let (state, token, _dir) = create_test_state().await;
+        let log_buffer = state.hypervisor.log_buffer();
+
+        // Add multiple entries
+        for i in 0..5 {
+            log_buffer
+                .push_stdout("api", "prod", format!("msg{}", i))
+                .await;
+        }
+
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/logs?limit=2")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_logs_endpoint_search() {
+        let (state, token, _dir) = create_test_state().await;
+        let log_buffer = state.hypervisor.log_buffer();
+
+        // Add entries with different content
+        log_buffer
+            .push_stdout("api", "prod", "hello world".to_string())
+            .await;
+        log_buffer
+            .push_stdout("api", "prod", "goodbye world".to_string())
+            .await;
+        log_buffer
+            .push_stdout("api", "prod", "hello there".to_string())
+            .await;
+
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/logs?search=hello")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 2);
+    }
+
+    #[tokio::test]
+    async fn test_metrics_endpoint() {
+        let (state, _token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server.get("/metrics").await;
+        response.assert_status_ok();
+
+        let text = response.text();
+        // Should contain Prometheus format headers
+        assert!(text.contains("# HELP tenement_requests_total"));
+        assert!(text.contains("# TYPE tenement_requests_total counter"));
+        assert!(text.contains("# HELP tenement_instances_up"));
+        assert!(text.contains("# TYPE tenement_instances_up gauge"));
+        assert!(text.contains("tenement_instances_up 0"));
+    }
+
+    #[tokio::test]
+    async fn test_metrics_listener_serves_only_metrics() {
+        let (state, _token, _dir) = create_test_state().await;
+        let addr = spawn_metrics_listener(state, "127.0.0.1:0".parse().unwrap(), None)
+            .await
+            .unwrap();
+        let client = reqwest::Client::new();
+
+        let response = client.get(format!("http://{}/metrics", addr)).send().await.unwrap();
+        assert_eq!(response.status(), reqwest::StatusCode::OK);
+        let text = response.text().await.unwrap();
+        assert!(text.contains("# TYPE tenement_responses_total counter"));
+        assert!(text.contains("# TYPE tenement_instance_uptime_seconds gauge"));
+
+        let response = client.get(format!("http://{}/api/instances", addr)).send().await.unwrap();
+        assert_eq!(response.status(), reqwest::StatusCode::NOT_FOUND);
+    }
+
+    #[tokio::test]
+    async fn test_api_requires_auth() {
+        let (state, _token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        // API endpoints should return 401 without token
+        let response = server.get("/api/instances").await;
+        response.assert_status_unauthorized();
+
+        let response = server.get("/api/logs").await;
+        response.assert_status_unauthorized();
+    }
+
+    #[tokio::test]
+    async fn test_api_invalid_token() {
+        let (state, _token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        // Invalid token should return 401
+        let response = server
+            .get("/api/instances")
+            .add_header("Authorization", "Bearer invalid_token")
+            .await;
+        response.assert_status_unauthorized();
+    }
+
+    // ===================
+    // MALFORMED REQUEST TESTS
+    // ===================
+
+    /// Serve the router on a real socket so raw bytes reach hyper's parser
+    async fn spawn_raw_server() -> (SocketAddr, TempDir) {
+        let (state, _token, dir) = create_test_state().await;
+        let app = create_router(state);
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(listener, app).await.unwrap();
+        });
+        (addr, dir)
+    }
+
+    /// Send raw bytes and return the response status line
+    async fn send_raw(addr: SocketAddr, raw: &[u8]) -> String {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+        let mut stream = tokio::net::TcpStream::connect(addr).await.unwrap();
+        stream.write_all(raw).await.unwrap();
+        let mut buf = vec![0u8; 1024];
+        let n = tokio::time::timeout(std::time::Duration::from_secs(5), stream.read(&mut buf))
+            .await
+            .expect("server should answer, not hang")
+            .unwrap();
+        let response = String::from_utf8_lossy(&buf[..n]).to_string();
+        response.lines().next().unwrap_or("").to_string()
+    }
+
+    #[tokio::test]
+    async fn test_malformed_requests_get_400_and_server_keeps_serving() {
+        let (addr, _dir) = spawn_raw_server().await;
+
+        let malformed: &[&[u8]] = &[
+            b"GARBAGE\r\n\r\n",
+            b"G@T / HTTP/1.1\r\nHost: localhost\r\n\r\n",
+            b"GET /\x01bad HTTP/1.1\r\nHost: localhost\r\n\r\n",
+            b"GET / HTTP/9.9\r\nHost: localhost\r\n\r\n",
+            b"GET / HTTP/1.1\r\nBad Header\r\n\r\n",
+            b"OPTIONS * HTTP/1.1\r\nHost: localhost\r\n\r\n",
+            b"CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+            b"GET /health HTTP/1.1\r\nHost: a b\r\n\r\n",
+            b"GET /health HTTP/1.1\r\nHost: a.com\r\nHost: b.com\r\n\r\n",
+        ];
+        for raw in malformed {
+            let status = send_raw(addr, raw).await;
+            assert!(
+                status.starts_with("HTTP/1.1 400"),
+                "expected 400 for {:?}, got {:?}",
+                String::from_utf8_lossy(raw),
+                status
+            );
+        }
+
+        // Listener survived all of the above
+        let status = send_raw(
+            addr,
+            b"GET /health HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+        )
+        .await;
+        assert!(status.starts_with("HTTP/1.1 200"), "got {:?}", status);
+    }
+
+    #[test]
+    fn test_validate_request() {
+        let ok = Request::builder()
+            .uri("/api/instances")
+            .header("host", "example.com:8080")
+            .body(Body::empty())
+            .unwrap();
+        assert!(validate_request(&ok).is_ok());
+
+        let connect = Request::builder()
+            .method("CONNECT")
+            .uri("example.com:443")
+            .body(Body::empty())
+            .unwrap();
+        assert_eq!(
+            validate_request(&connect),
+            Err("CONNECT is not supported")
+        );
+
+        let asterisk = Request::builder()
+            .method("OPTIONS")
+            .uri("*")
+            .body(Body::empty())
+            .unwrap();
+        assert_eq!(
+            validate_request(&asterisk),
+            Err("request target must be a path")
+        );
+    }
+
+    #[tokio::test]
+    async fn test_handler_panic_returns_500() {
+        async fn boom() -> &'static str {
+            panic!("boom")
+        }
+        let app = Router::new()
+            .route("/boom", get(boom))
+            .route("/ok", get(|| async { "ok" }))
+            .layer(CatchPanicLayer::custom(handle_panic));
+        let server = TestServer::new(app).unwrap();
+
+        let response = server.get("/boom").await;
+        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+
+        // Same server keeps handling requests after a panic
+        let response = server.get("/ok").await;
+        response.assert_status_ok();
+    }
+
+    // ===================
+    // FAULT INJECTION TESTS
+    // ===================
+
+    fn fault_config(enabled: bool, fault: &str) -> Config {
+        Config::from_str(&format!(
+            r#"
+[settings]
+fault_injection = {}
+
+[service.api]
+command = "./api"
+
+[service.api.fault]
+{}
+"#,
+            enabled, fault
+        ))
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_fault_abort_applied_before_proxying() {
+        let config = fault_config(true, "abort_status = 418\nabort_percent = 100.0");
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/")
+            .add_header("Host", "api.example.com")
+            .await;
+        response.assert_status(StatusCode::IM_A_TEAPOT);
+        assert_eq!(response.header("x-tenement-fault"), "abort");
+    }
+
+    #[tokio::test]
+    async fn test_fault_delay_applied_before_proxying() {
+        let config = fault_config(true, "delay_ms = 200\ndelay_percent = 100.0");
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let start = std::time::Instant::now();
+        let _ = server
+            .get("/")
+            .add_header("Host", "api.example.com")
+            .await;
+        assert!(start.elapsed() >= std::time::Duration::from_millis(200));
+    }
+
+    #[tokio::test]
+    async fn test_fault_ignored_without_global_switch() {
+        let config = fault_config(false, "abort_status = 418\nabort_percent = 100.0");
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        assert!(state.hypervisor.fault_for("api").is_none());
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/")
+            .add_header("Host", "api.example.com")
+            .await;
+        assert_ne!(response.status_code(), StatusCode::IM_A_TEAPOT);
+    }
+
+    // ===================
+    // STACK TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_stacks_summary_and_unknown_stack() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+stack = "acme"
+depends_on = ["db"]
+
+[service.db]
+command = "./db"
+stack = "acme"
+
+[service.blog]
+command = "./blog"
+"#,
+        )
+        .unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        let auth = format!("Bearer {}", token);
+
+        let stacks = server
+            .get("/api/stacks")
+            .add_header("Authorization", auth.clone())
+            .await
+            .json::<Vec<crate::api_routes::StackStatus>>();
+        assert_eq!(stacks.len(), 1);
+        assert_eq!(stacks[0].stack, "acme");
+        let services: Vec<_> = stacks[0].services.iter().map(|s| &s.service).collect();
+        assert_eq!(services, ["db", "api"]);
+        assert_eq!(stacks[0].services[0].instances, 0);
+
+        server
+            .post("/api/stacks/nope/restart")
+            .add_header("Authorization", auth.clone())
+            .await
+            .assert_status(StatusCode::NOT_FOUND);
+    }
+
+    #[tokio::test]
+    async fn test_stack_deploy_stops_at_first_failure() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./missing-api"
+stack = "acme"
+depends_on = ["db"]
+
+[service.db]
+command = "./missing-db"
+stack = "acme"
+"#,
+        )
+        .unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .post("/api/stacks/acme/deploy")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({"version": "v2", "timeout": 1}))
+            .await;
+        response.assert_status_ok();
+        let report = response.json::<crate::api_routes::StackResponse>();
+        assert!(report.completed.is_empty());
+        assert_eq!(report.failed.unwrap().target, "db:v2");
+        assert_eq!(report.skipped, ["api:v2"]);
+    }
+
+    async fn api_status(server: &TestServer) -> StatusCode {
+        server
+            .get("/")
+            .add_header("Host", "api.example.com")
+            .await
+            .status_code()
+    }
+
+    #[tokio::test]
+    async fn test_fault_api_toggles_and_overrides() {
+        let config = fault_config(false, "abort_status = 418\nabort_percent = 100.0");
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        let auth = format!("Bearer {}", token);
+        let status = || api_status(&server);
+
+        let faults = server
+            .get("/api/faults")
+            .add_header("Authorization", auth.clone())
+            .await
+            .json::<crate::api_routes::FaultsResponse>();
+        assert!(!faults.enabled);
+        assert_eq!(faults.services[0].fault.abort_status, Some(418));
+        assert_ne!(status().await, StatusCode::IM_A_TEAPOT);
+
+        server
+            .put("/api/faults")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({"enabled": true}))
+            .await
+            .assert_status_ok();
+        assert_eq!(status().await, StatusCode::IM_A_TEAPOT);
+
+        // An override replaces the [fault] block until it's cleared
+        let faults = server
+            .put("/api/faults/api")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({"abort_status": 502, "abort_percent": 100.0}))
+            .await
+            .json::<crate::api_routes::FaultsResponse>();
+        assert!(faults.services[0].overridden);
+        assert_eq!(status().await, StatusCode::BAD_GATEWAY);
+        server
+            .delete("/api/faults/api")
+            .add_header("Authorization", auth.clone())
+            .await
+            .assert_status_ok();
+        assert_eq!(status().await, StatusCode::IM_A_TEAPOT);
+
+        server
+            .put("/api/faults/api")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({"abort_percent": 100.0}))
+            .await
+            .assert_status(StatusCode::BAD_REQUEST);
+        server
+            .put("/api/faults/nope")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({}))
+            .await
+            .assert_status(StatusCode::NOT_FOUND);
+    }
+
+    #[tokio::test]
+    async fn test_route_fault_applied_while_enabled() {
+        let public = TempDir::new().unwrap();
+        std::fs::write(public.path().join("index.html"), "home").unwrap();
+        let config = Config::from_str(&format!(
+            r#"
+[[routing.route]]
+prefix = "/"
+static = "{}"
+fault = {{ abort_status = 503, abort_percent = 100.0 }}
+"#,
+            public.path().display()
+        ))
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let hypervisor = state.hypervisor.clone();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server.get("/index.html").await;
+        response.assert_status_ok();
+        assert_eq!(response.text(), "home");
+
+        hypervisor.set_fault_injection(true);
+        let response = server.get("/index.html").await;
+        response.assert_status(StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(response.header("x-tenement-fault"), "abort");
+    }
+
+    // ===================
+    // STATS ENDPOINT TESTS
+    // ===================
+
+    /// Record proxied traffic the same way proxy_to_instance does
+    async fn simulate_traffic(
+        state: &AppState,
+        process: &str,
+        instance: &str,
+        ok: u64,
+        failed: u64,
+    ) {
+        let metrics = state.hypervisor.metrics();
+        let mut labels = std::collections::HashMap::new();
+        labels.insert("process".to_string(), process.to_string());
+        labels.insert("instance".to_string(), instance.to_string());
+        metrics.requests_total.with_labels(&labels).await.inc_by(ok + failed);
+        metrics.request_errors_total.with_labels(&labels).await.inc_by(failed);
+    }
+
+    #[tokio::test]
+    async fn test_stats_endpoint_after_traffic() {
+        let config = Config::from_str(
+            r#"
+[settings]
+max_concurrency = 8
+
+[service.api]
+command = "./api"
+"#,
+        )
+        .unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        simulate_traffic(&state, "api", "prod", 7, 3).await;
+        simulate_traffic(&state, "api", "canary", 2, 0).await;
+        simulate_traffic(&state, "web", "prod", 4, 1).await;
+
+        let mut restart_labels = std::collections::HashMap::new();
+        restart_labels.insert("process".to_string(), "api".to_string());
+        restart_labels.insert("id".to_string(), "prod".to_string());
+        let metrics = state.hypervisor.metrics();
+        metrics.instance_restarts.with_labels(&restart_labels).await.inc();
+
+        let pool = state.hypervisor.concurrency_pool().unwrap().clone();
+        let _permit = pool
+            .acquire("api", std::time::Duration::from_secs(1))
+            .await
+            .unwrap();
+
+        let server = TestServer::new(create_router(state)).unwrap();
+        let response = server
+            .get("/api/stats")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["requests"]["total"], 17);
+        assert_eq!(json["errors"]["total"], 4);
+        assert_eq!(json["restarts"]["total"], 1);
+        assert_eq!(json["instances"]["total"], 0);
+        assert_eq!(json["concurrency"]["limit"], 8);
+        assert_eq!(json["concurrency"]["in_use"], 1);
+        assert_eq!(json["concurrency"]["waiting"], 0);
+
+        let api = &json["apps"]["api"];
+        assert_eq!(api["requests"], 12);
+        assert_eq!(api["errors"], 3);
+        assert_eq!(api["restarts"], 1);
+        assert_eq!(api["in_flight"], 1);
+        assert!(api["health"].is_object());
+        assert_eq!(api["memory_bytes"], 0);
+        assert_eq!(json["apps"]["web"]["requests"], 5);
+        assert_eq!(json["apps"]["web"]["errors"], 1);
+    }
+
+    #[tokio::test]
+    async fn test_stats_endpoint_empty_and_requires_auth() {
+        let (state, token, _dir) = create_test_state().await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        server.get("/api/stats").await.assert_status_unauthorized();
+
+        let response = server
+            .get("/api/stats")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status_ok();
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["requests"]["total"], 0);
+        assert!(json["concurrency"]["limit"].is_null());
+        assert!(json["apps"].as_object().unwrap().is_empty());
+    }
+
+    // ===================
+    // CONCURRENCY POOL TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_concurrency_pool_full_returns_503() {
+        let config = Config::from_str(
+            r#"
+[settings]
+max_concurrency = 1
+concurrency_queue_timeout_ms = 50
+
+[service.api]
+command = "./api"
+"#,
+        )
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let pool = state.hypervisor.concurrency_pool().unwrap().clone();
+        let _held = pool
+            .acquire("other", std::time::Duration::from_secs(1))
+            .await
+            .unwrap();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/")
+            .add_header("Host", "api.example.com")
+            .await;
+        response.assert_status(StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(response.header("retry-after"), "1");
+        assert_eq!(pool.waiting(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_app_concurrency_limit_sheds_load() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+max_concurrency = 1
+max_queue = 0
+
+[service.web]
+command = "./web"
+max_concurrency = 1
+queue_timeout_ms = 50
+"#,
+        )
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let api = state.hypervisor.app_limit("api").unwrap();
+        let web = state.hypervisor.app_limit("web").unwrap();
+        let wait = std::time::Duration::from_secs(1);
+        let _api_held = api.acquire(wait).await.unwrap();
+        let _web_held = web.acquire(wait).await.unwrap();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        // No queue: turned away at once; a queue: turned away after the timeout
+        for host in ["api.example.com", "web.example.com"] {
+            let response = server.get("/").add_header("Host", host).await;
+            response.assert_status(StatusCode::SERVICE_UNAVAILABLE);
+            assert_eq!(response.header("retry-after"), "1");
+        }
+        assert_eq!(api.waiting() + web.waiting(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_concurrency_pool_disabled_by_default() {
+        let (state, _token, _dir) = create_test_state().await;
+        assert!(state.hypervisor.concurrency_pool().is_none());
+    }
+
+    // ===================
+    // STATIC SERVICE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_static_service_is_served_without_instances() {
+        let site = TempDir::new().unwrap();
+        std::fs::write(site.path().join("index.html"), "<h1>frontend</h1>").unwrap();
+        std::fs::write(site.path().join("app.css"), "body {}").unwrap();
+        std::fs::write(site.path().join("app.css.gz"), "gzipped").unwrap();
+        let config = Config::from_str(&format!(
+            r#"
+[service.web]
+type = "static"
+root = "{}"
+spa = true
+"#,
+            site.path().display()
+        ))
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let hypervisor = state.hypervisor.clone();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/app.css")
+            .add_header("Host", "web.example.com")
+            .add_header("Accept-Encoding", "gzip")
+            .await;
+        response.assert_status_ok();
+        assert_eq!(response.header("content-encoding"), "gzip");
+        assert_eq!(response.text(), "gzipped");
+
+        // Client-side routes get the app's index.html
+        let response = server
+            .get("/settings/profile")
+            .add_header("Host", "web.example.com")
+            .await;
+        response.assert_status_ok();
+        assert_eq!(response.text(), "<h1>frontend</h1>");
+
+        assert!(hypervisor.spawn("web", "main").await.is_err());
+        assert!(hypervisor.list_by_process("web").await.is_empty());
+    }
+
+    // ===================
+    // ACCESS LOG TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_access_log_line_written_after_response() {
+        let site = TempDir::new().unwrap();
+        let logs = TempDir::new().unwrap();
+        std::fs::write(site.path().join("app.css"), "body {}").unwrap();
+        let config = Config::from_str(&format!(
+            r#"
+[service.web]
+type = "static"
+root = "{}"
+
+[service.web.access_log]
+format = "json"
+dir = "{}"
+"#,
+            site.path().display(),
+            logs.path().display()
+        ))
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        for path in ["/app.css?v=2", "/missing.css"] {
+            server.get(path).add_header("Host", "web.example.com").await;
+        }
+        // Unknown services aren't logged
+        server.get("/").add_header("Host", "nope.example.com").await;
+
+        let text = std::fs::read_to_string(logs.path().join("web.log")).unwrap();
+        let lines: Vec<serde_json::Value> = text
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+        assert_eq!(lines.len(), 2, "{}", text);
+        assert_eq!(lines[0]["path"], "/app.css?v=2");
+        assert_eq!(lines[0]["status"], 200);
+        assert_eq!(lines[0]["bytes"], 7);
+        assert_eq!(lines[0]["app"], "web");
+        // Tenement answered itself, so there's no instance or upstream time
+        assert!(lines[0]["instance"].is_null());
+        assert!(lines[0]["upstream_ms"].is_null());
+        assert_eq!(lines[1]["status"], 404);
+        assert_eq!(std::fs::read_dir(logs.path()).unwrap().count(), 1);
+    }
+
+    // ===================
+    // MAINTENANCE MODE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_maintenance_mode_serves_page_until_turned_off() {
+        let pages = TempDir::new().unwrap();
+        let page = pages.path().join("maintenance.html");
+        std::fs::write(&page, "<h1>Upgrading the database</h1>").unwrap();
+        let config_str = format!(
+            r#"
+[service.api]
+command = "./api"
+maintenance_page = "{}"
+
+[service.web]
+command = "./web"
+"#,
+            page.display()
+        );
+        let config = Config::from_str(&config_str).unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let config_store = state.config_store.clone();
+        let server = TestServer::new(create_router(state)).unwrap();
+        let auth = format!("Bearer {}", token);
+
+        for (process, body) in [
+            (
+                "api",
+                serde_json::json!({"enabled": true, "retry_after": 600}),
+            ),
+            ("web", serde_json::json!({"enabled": true})),
+        ] {
+            server
+                .put(&format!("/api/maintenance/{}", process))
+                .add_header("Authorization", auth.clone())
+                .json(&body)
+                .await
+                .assert_status_ok();
+        }
+
+        let response = server.get("/").add_header("Host", "api.example.com").await;
+        response.assert_status(StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(response.header("retry-after"), "600");
+        assert_eq!(response.header("cache-control"), "no-store");
+        assert_eq!(response.text(), "<h1>Upgrading the database</h1>");
+        let response = server.get("/").add_header("Host", "web.example.com").await;
+        response.assert_status(StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(response.header("retry-after"), "300");
+        assert!(response.text().contains("Down for maintenance"));
+
+        // A restart picks up where it left off
+        let restarted = Hypervisor::new(Config::from_str(&config_str).unwrap());
+        restore_maintenance(&restarted, &config_store).await;
+        assert_eq!(restarted.maintenance("api"), Some(600));
+        assert_eq!(restarted.maintenance("web"), Some(300));
+
+        server
+            .put("/api/maintenance/api")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({"enabled": false}))
+            .await
+            .assert_status_ok();
+        let response = server.get("/").add_header("Host", "api.example.com").await;
+        assert!(response.maybe_header("retry-after").is_none());
+        assert!(!response.text().contains("Upgrading"));
+
+        server
+            .put("/api/maintenance/nope")
+            .add_header("Authorization", auth)
+            .json(&serde_json::json!({"enabled": true}))
+            .await
+            .assert_status_not_found();
+    }
+
+    #[tokio::test]
+    async fn test_drain_takes_service_out_of_rotation() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+
+[service.web]
+command = "./web"
+"#,
+        )
+        .unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let hypervisor = state.hypervisor.clone();
+        let server = TestServer::new(create_router(state)).unwrap();
+        let auth = format!("Bearer {}", token);
+
+        let response = server
+            .post("/api/drain/api")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({"timeout": 1}))
+            .await;
+        response.assert_status_ok();
+        let drained: crate::api_routes::DrainResponse = response.json();
+        assert_eq!(drained.process, "api");
+        assert!(drained.stopped.is_empty() && drained.force_killed.is_empty());
+
+        // Refused rather than woken
+        let response = server.get("/").add_header("Host", "api.example.com").await;
+        response.assert_status(StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(response.text(), "Draining");
+        assert!(!hypervisor.is_app_draining("web"));
+
+        server
+            .post("/api/drain/nope")
+            .add_header("Authorization", auth)
+            .json(&serde_json::json!({}))
+            .await
+            .assert_status_not_found();
+    }
+
+    // ===================
+    // WEBHOOK TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_webhook_api_hides_secrets_and_requires_admin() {
+        let data_dir = TempDir::new().unwrap();
+        let mut config = Config::default();
+        config.settings.data_dir = data_dir.path().to_path_buf();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        let auth = format!("Bearer {}", token);
+
+        let response = server
+            .post("/api/webhooks")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({
+                "url": "https://hooks.example.com/tenement",
+                "events": ["crashed", "health_changed"],
+                "secret": "s3cret",
+            }))
+            .await;
+        response.assert_status_ok();
+        let added: serde_json::Value = response.json();
+        assert_eq!(added["signed"], true);
+        assert!(added.get("secret").is_none());
+        let id = added["id"].as_str().unwrap().to_string();
+
+        server
+            .post("/api/webhooks")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({"url": "https://x", "events": ["rebooted"]}))
+            .await
+            .assert_status(StatusCode::UNPROCESSABLE_ENTITY);
+
+        let listed = server
+            .get("/api/webhooks")
+            .add_header("Authorization", auth.clone())
+            .await;
+        assert!(!listed.text().contains("s3cret"));
+        let listed: Vec<serde_json::Value> = listed.json();
+        assert_eq!(listed.len(), 1);
+        assert_eq!(
+            listed[0]["events"],
+            serde_json::json!(["crashed", "health_changed"])
+        );
+
+        let delete = |id: String| {
+            server
+                .delete(&format!("/api/webhooks/{}", id))
+                .add_header("Authorization", auth.clone())
+        };
+        delete(id.clone())
+            .await
+            .assert_status(StatusCode::NO_CONTENT);
+        delete(id).await.assert_status_not_found();
+
+        let (state, _admin_token, tenant_token, _dir) = create_test_state_with_tenant().await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        server
+            .get("/api/webhooks")
+            .add_header("Authorization", format!("Bearer {}", tenant_token))
+            .await
+            .assert_status_forbidden();
+    }
+
+    // ===================
+    // CLUSTER TESTS
+    // ===================
+
+    /// A test state for node "a" of a cluster, with no services of its own
+    async fn create_cluster_state(token_env: &str) -> (AppState, TempDir) {
+        let mut config = Config::default();
+        config.settings.cluster = Some(tenement::config::ClusterConfig {
+            node: "a".to_string(),
+            advertise: "127.0.0.1:1".to_string(),
+            peers: Vec::new(),
+            mode: ClusterMode::Active,
+            token_env: token_env.to_string(),
+            heartbeat: 1,
+            failure_timeout: 5,
+        });
+        let (state, _token, dir) = create_test_state_with_config(config).await;
+        (state, dir)
+    }
+
+    #[tokio::test]
+    async fn test_cluster_state_requires_cluster_token() {
+        let token_env = "TENEMENT_CLUSTER_TOKEN_STATE_TEST";
+        std::env::set_var(token_env, "s3cret");
+        let (state, _dir) = create_cluster_state(token_env).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        server
+            .get("/cluster/state")
+            .await
+            .assert_status_unauthorized();
+        server
+            .get("/cluster/state")
+            .add_header(TOKEN_HEADER, "wrong")
+            .await
+            .assert_status_unauthorized();
+        let response = server
+            .get("/cluster/state")
+            .add_header(TOKEN_HEADER, "s3cret")
+            .await;
+        response.assert_status_ok();
+        let node: tenement::cluster::NodeState = response.json();
+        assert_eq!(node.node, "a");
+        assert!(!node.leader);
+
+        // Outside a cluster there's nothing to answer
+        let (state, _token, _dir) = create_test_state().await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        server.get("/cluster/state").await.assert_status_not_found();
+    }
+
+    #[tokio::test]
+    async fn test_requests_forward_to_peer_running_the_app() {
+        // The peer echoes the host, hop marker and token it was sent
+        let peer = Router::new().fallback(|headers: axum::http::HeaderMap| async move {
+            let header = |name: &str| {
+                headers
+                    .get(name)
+                    .and_then(|v| v.to_str().ok())
+                    .unwrap_or("")
+                    .to_string()
+            };
+            let (host, hop) = (header("host"), header(HOP_HEADER));
+            format!("{} via {} with {}", host, hop, header(TOKEN_HEADER))
+        });
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let peer_addr = listener.local_addr().unwrap();
+        tokio::spawn(async move { axum::serve(listener, peer).await.unwrap() });
+
+        let token_env = "TENEMENT_CLUSTER_TOKEN_FORWARD_TEST";
+        std::env::set_var(token_env, "s3cret");
+        let (state, _dir) = create_cluster_state(token_env).await;
+        let mut services = std::collections::BTreeMap::new();
+        services.insert("api".to_string(), vec!["prod".to_string()]);
+        let peer_state = tenement::cluster::NodeState {
+            node: "b".to_string(),
+            address: peer_addr.to_string(),
+            leader: true,
+            services,
+            peers: Vec::new(),
+        };
+        let cluster = state.hypervisor.cluster().unwrap();
+        cluster.observe(peer_state, std::time::Instant::now());
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server.get("/").add_header("Host", "api.example.com").await;
+        response.assert_status_ok();
+        assert_eq!(response.text(), "api.example.com via a with s3cret");
+        let response = server
+            .get("/")
+            .add_header("Host", "prod.api.example.com")
+            .await;
+        assert_eq!(response.text(), "prod.api.example.com via a with s3cret");
+
+        // Nobody runs it, or another node already forwarded it: answered here
+        server
+            .get("/")
+            .add_header("Host", "web.example.com")
+            .await
+            .assert_status_not_found();
+        server
+            .get("/")
+            .add_header("Host", "api.example.com")
+            .add_header(HOP_HEADER, "c")
+            .add_header(TOKEN_HEADER, "s3cret")
+            .await
+            .assert_status_not_found();
+
+        // Claiming to be forwarded without the token is refused
+        server
+            .get("/")
+            .add_header("Host", "api.example.com")
+            .add_header(HOP_HEADER, "c")
+            .await
+            .assert_status_forbidden();
+    }
+
+    // ===================
+    // DISCOVERY TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_discovery_names_route_to_services() {
+        // An abort fault shows the request reached the service
+        let config = Config::from_str(
+            r#"
+[settings]
+fault_injection = true
+
+[settings.discovery]
+
+[service.api]
+command = "./api"
+
+[service.api.fault]
+abort_status = 418
+abort_percent = 100
+"#,
+        )
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        for host in ["api.tenement.local", "prod.api.tenement.local:8080"] {
+            let response = server.get("/").add_header("Host", host).await;
+            response.assert_status(StatusCode::IM_A_TEAPOT);
+        }
+        server
+            .get("/")
+            .add_header("Host", "web.tenement.local")
+            .await
+            .assert_status_not_found();
+    }
+
+    // ===================
+    // MIDDLEWARE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_proxied_requests_go_through_middleware() {
+        let config = Config::from_str(
+            r#"
+[settings]
+fault_injection = true
+middleware = ["request-id"]
+
+[service.api]
+command = "./api"
+middleware = ["hide-server"]
+
+[service.api.fault]
+abort_status = 418
+abort_percent = 100
+
+[service.web]
+command = "./web"
+middleware = ["not-registered"]
+"#,
+        )
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/")
+            .add_header("Host", "api.example.com")
+            .add_header("X-Request-Id", "abc")
+            .await;
+        response.assert_status(StatusCode::IM_A_TEAPOT);
+        assert_eq!(response.headers()["x-request-id"], "abc");
+
+        // Middleware that isn't registered fails closed
+        let response = server.get("/").add_header("Host", "web.example.com").await;
+        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+    }
+
+    // ===================
+    // PREVIEW TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_preview_api_validates_requests() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+
+[service.api.preview]
+domain = "apps.example.com"
+
+[service.worker]
+command = "./worker"
+"#,
+        )
+        .unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        let auth = format!("Bearer {}", token);
+        let create = |body: serde_json::Value| {
+            server
+                .post("/api/previews")
+                .add_header("Authorization", auth.clone())
+                .json(&body)
+        };
+
+        let response = create(serde_json::json!({"process": "worker", "revision": "main"})).await;
+        response.assert_status_bad_request();
+        response.assert_text_contains("no [service.worker.preview] table");
+        create(serde_json::json!({"process": "nope", "revision": "main"}))
+            .await
+            .assert_status_not_found();
+        create(serde_json::json!({"process": "api"}))
+            .await
+            .assert_status_bad_request();
+        let both = serde_json::json!({"process": "api", "revision": "main", "artifact": "x"});
+        create(both).await.assert_status_bad_request();
+        let response = create(serde_json::json!({"process": "api", "artifact": "x.tar.gz"})).await;
+        response.assert_status_bad_request();
+        response.assert_text_contains("needs a name");
+        let bad_name = serde_json::json!({"process": "api", "revision": "main", "name": "PR_1"});
+        create(bad_name).await.assert_status_bad_request();
+
+        let listed = server
+            .get("/api/previews")
+            .add_header("Authorization", auth.clone())
+            .await;
+        listed.assert_status_ok();
+        assert_eq!(listed.json::<Vec<serde_json::Value>>().len(), 0);
+        server
+            .delete("/api/previews/api/pr-1")
+            .add_header("Authorization", auth.clone())
+            .await
+            .assert_status_not_found();
+
+        let (state, _admin_token, tenant_token, _dir) = create_test_state_with_tenant().await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        server
+            .get("/api/previews")
+            .add_header("Authorization", format!("Bearer {}", tenant_token))
+            .await
+            .assert_status_forbidden();
+    }
+
+    // ===================
+    // EVENT STREAM TESTS
+    // ===================
+
+    fn crash(app: &str) -> LifecycleEvent {
+        let instance = tenement::InstanceId::new(app, "prod");
+        LifecycleEvent::for_instance(EventKind::Crashed, &instance, serde_json::json!({}))
+    }
+
+    #[tokio::test]
+    async fn test_recent_events_are_filtered() {
+        let (state, token, _dir) = create_test_state().await;
+        state.hypervisor.emit(crash("api"));
+        state.hypervisor.emit(crash("web"));
+        let cert = LifecycleEvent::new(EventKind::CertRenewed, serde_json::json!({}));
+        state.hypervisor.emit(cert);
+        let server = TestServer::new(create_router(state)).unwrap();
+        let auth = format!("Bearer {}", token);
+
+        let events: Vec<serde_json::Value> = server
+            .get("/api/events?app=api&type=crash")
+            .add_header("Authorization", auth.clone())
+            .await
+            .json();
+        assert_eq!(events.len(), 1);
+        assert_eq!(events[0]["instance"], "api:prod");
+
+        let events: Vec<serde_json::Value> = server
+            .get("/api/events?limit=2")
+            .add_header("Authorization", auth.clone())
+            .await
+            .json();
+        assert_eq!(events.len(), 2);
+        assert_eq!(events[0]["app"], "web");
+        assert_eq!(events[1]["event"], "cert_renewed");
+
+        server
+            .get("/api/events?type=crash,rebooted")
+            .add_header("Authorization", auth)
+            .await
+            .assert_status_bad_request();
+    }
+
+    #[tokio::test]
+    async fn test_event_stream_ndjson() {
+        use http_body_util::BodyExt;
+
+        let (state, _token, _dir) = create_test_state().await;
+        let hypervisor = state.hypervisor.clone();
+        hypervisor.emit(crash("web"));
+        hypervisor.emit(crash("api"));
+
+        let params = EventQueryParams {
+            app: Some("api".to_string()),
+            kinds: Some("crashed".to_string()),
+            limit: Some(5),
+            format: Some("ndjson".to_string()),
+        };
+        let admin = axum::Extension(AuthIdentity::admin("admin"));
+        let headers = axum::http::HeaderMap::new();
+        let response = stream_events(State(state), Query(params), admin, headers).await;
+        assert_eq!(
+            response.headers()[axum::http::header::CONTENT_TYPE],
+            "application/x-ndjson"
+        );
+        let mut body = response.into_body();
+
+        // The replayed crash, then only live events that match
+        hypervisor.emit(crash("web"));
+        hypervisor.emit(LifecycleEvent::new(EventKind::CertRenewed, serde_json::json!({})));
+        hypervisor.emit(crash("api"));
+        for _ in 0..2 {
+            let frame = tokio::time::timeout(std::time::Duration::from_secs(2), body.frame())
+                .await
+                .expect("event streamed")
+                .unwrap()
+                .unwrap();
+            let data = frame.into_data().unwrap();
+            assert!(data.ends_with(b"\n"));
+            let event: serde_json::Value = serde_json::from_slice(&data).unwrap();
+            assert_eq!(event["event"], "crashed");
+            assert_eq!(event["app"], "api");
+        }
+    }
+
+    // ===================
+    // MIRROR TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_mirrored_request_keeps_its_body() {
+        use http_body_util::BodyExt;
+
+        let (state, _token, _dir) = create_test_state().await;
+        let mirror = Mirror {
+            service: "api-v2".to_string(),
+            per_million: 1_000_000,
+        };
+        let post = Request::post("/items")
+            .body(Body::from("{\"a\":1}"))
+            .unwrap();
+        let req = mirror_request(&state, &mirror, post).await.unwrap();
+        let body = req.into_body().collect().await.unwrap().to_bytes();
+        assert_eq!(body, "{\"a\":1}");
+
+        // Unknown length: passed through untouched, not buffered
+        let chunks = futures::stream::iter([Ok::<_, Infallible>("chunk")]);
+        let streamed = Request::post("/items")
+            .body(Body::from_stream(chunks))
+            .unwrap();
+        let req = mirror_request(&state, &mirror, streamed).await.unwrap();
+        assert_eq!(hyper::body::Body::size_hint(req.body()).exact(), None);
+    }
+
+    // ===================
+    // RETRY TESTS
+    // ===================
+
+    #[test]
+    fn test_only_bodyless_idempotent_requests_are_replayable() {
+        let request = |method: &str, body: Body| {
+            Request::builder()
+                .method(method)
+                .uri("/items/1?full=true")
+                .header("x-request-id", "abc")
+                .body(body)
+                .unwrap()
+        };
+        for method in ["GET", "HEAD", "OPTIONS", "PUT", "DELETE"] {
+            assert!(is_replayable(&request(method, Body::empty())), "{}", method);
+        }
+        assert!(!is_replayable(&request("POST", Body::empty())));
+        assert!(!is_replayable(&request("PATCH", Body::empty())));
+        assert!(!is_replayable(&request("PUT", Body::from("update"))));
+
+        let copy = copy_request(&request("DELETE", Body::empty()));
+        assert_eq!(copy.method(), "DELETE");
+        assert_eq!(copy.uri(), "/items/1?full=true");
+        assert_eq!(copy.headers()["x-request-id"], "abc");
+
+        assert!(is_upstream_failure(StatusCode::BAD_GATEWAY));
+        assert!(is_upstream_failure(StatusCode::GATEWAY_TIMEOUT));
+        assert!(!is_upstream_failure(StatusCode::INTERNAL_SERVER_ERROR));
+    }
+
+    // ===================
+    // TRACING TESTS
+    // ===================
+
+    /// Unix socket backend that answers 200 and reports each request head
+    fn spawn_head_backend(path: &Path) -> tokio::sync::mpsc::UnboundedReceiver<String> {
+        use tokio::io::AsyncWriteExt;
+
+        let listener = tokio::net::UnixListener::bind(path).unwrap();
+        let (tx, rx) = tokio::sync::mpsc::unbounded_channel();
+        tokio::spawn(async move {
+            loop {
+                let (mut conn, _) = listener.accept().await.unwrap();
+                let tx = tx.clone();
+                tokio::spawn(async move {
+                    tx.send(read_head(&mut conn).await).ok();
+                    let response = "HTTP/1.1 200 OK\r\ncontent-length: 0\r\n\r\n";
+                    conn.write_all(response.as_bytes()).await.ok();
+                });
+            }
+        });
+        rx
+    }
+
+    #[tokio::test]
+    async fn test_upstream_requests_carry_traceparent() {
+        let caller = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01";
+        let request = || {
+            Request::builder()
+                .uri("/orders")
+                .header(TRACEPARENT, caller)
+                .body(Body::empty())
+                .unwrap()
+        };
+        let timeout = std::time::Duration::from_secs(5);
+        let parent = TraceContext::parse(caller).unwrap();
+
+        let config = Config::from_str(
+            "[settings.tracing]\nendpoint = \"http://127.0.0.1:4318\"\n\n\
+             [service.api]\ncommand = \"./api\"\n",
+        )
+        .unwrap();
+        let (state, _token, dir) = create_test_state_with_config(config).await;
+        let socket = dir.path().join("api.sock");
+        let mut heads = spawn_head_backend(&socket);
+        let target = ProxyTarget {
+            socket: socket.clone(),
+            port: None,
+        };
+        let protocol = BackendProtocol::Http;
+        let trace = Some(parent);
+        let response =
+            send_upstream(&state, "api", protocol, &target, request(), timeout, trace).await;
+        assert_eq!(response.status(), StatusCode::OK);
+
+        // Same trace, with tenement's upstream span as the backend's parent
+        let head = heads.recv().await.unwrap();
+        let sent = head
+            .lines()
+            .find_map(|line| line.strip_prefix("traceparent: "))
+            .unwrap();
+        let sent = TraceContext::parse(sent).unwrap();
+        assert_eq!(sent.trace_id, parent.trace_id);
+        assert_ne!(sent.span_id, parent.span_id);
+        assert!(sent.sampled);
+
+        // Without [settings.tracing] the caller's header goes through untouched
+        let (state, _token, dir) = create_test_state().await;
+        let socket = dir.path().join("api.sock");
+        let mut heads = spawn_head_backend(&socket);
+        let target = ProxyTarget { socket, port: None };
+        send_upstream(&state, "api", protocol, &target, request(), timeout, None).await;
+        let head = heads.recv().await.unwrap();
+        assert!(head.contains(&format!("traceparent: {}", caller)), "{}", head);
+    }
+
+    // ===================
+    // RATE LIMIT TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_rate_limited_client_gets_429_with_retry_after() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+rate_limit = { requests_per_second = 1, burst = 2 }
+
+[service.web]
+command = "./web"
+"#,
+        )
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let metrics = state.hypervisor.metrics();
+        let client = SocketAddr::from(([203, 0, 113, 7], 40000));
+        let app = create_router(state).layer(axum::extract::connect_info::MockConnectInfo(client));
+        let server = TestServer::new(app).unwrap();
+
+        // The burst gets through (to no instance, here); the next request doesn't
+        for _ in 0..2 {
+            let response = server.get("/").add_header("Host", "api.example.com").await;
+            assert_ne!(response.status_code(), StatusCode::TOO_MANY_REQUESTS);
+        }
+        let response = server.get("/").add_header("Host", "api.example.com").await;
+        response.assert_status(StatusCode::TOO_MANY_REQUESTS);
+        assert_eq!(response.header("retry-after"), "1");
+        assert_eq!(metrics.requests_rate_limited_total.total().await, 1);
+
+        // Other apps have their own limits (here: none)
+        for _ in 0..5 {
+            let response = server.get("/").add_header("Host", "web.example.com").await;
+            assert_ne!(response.status_code(), StatusCode::TOO_MANY_REQUESTS);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_access_lists_turn_clients_away_with_403() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+access = { allow = ["10.0.0.0/8"], deny = ["10.6.6.0/24"] }
+"#,
+        )
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        // Denied, outside the allowlist, and let through (to no instance, here)
+        let denied = [[10, 6, 6, 6], [203, 0, 113, 7]];
+        for ip in denied.into_iter().chain([[10, 1, 2, 3]]) {
+            let client = SocketAddr::from((ip, 40000));
+            let app = create_router(state.clone())
+                .layer(axum::extract::connect_info::MockConnectInfo(client));
+            let server = TestServer::new(app).unwrap();
+            let response = server.get("/").add_header("Host", "api.example.com").await;
+            let forbidden = response.status_code() == StatusCode::FORBIDDEN;
+            assert_eq!(forbidden, denied.contains(&ip), "{:?}", ip);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_route_basic_auth_challenges_then_strips_credentials() {
+        use base64::Engine;
+
+        let public = TempDir::new().unwrap();
+        std::fs::write(public.path().join("report.txt"), "numbers").unwrap();
+        let htpasswd = public.path().join("htpasswd");
+        let hash = tenement::auth::hash_token("s3cret").unwrap();
+        std::fs::write(&htpasswd, format!("alice:{}\n", hash)).unwrap();
+        let config = Config::from_str(&format!(
+            r#"
+[[routing.route]]
+prefix = "/reports"
+static = "{}"
+access = {{ basic_auth = "{}", realm = "Reports" }}
+"#,
+            public.path().display(),
+            htpasswd.display()
+        ))
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        let basic = |credentials: &str| {
+            let encoded = base64::engine::general_purpose::STANDARD.encode(credentials);
+            format!("Basic {}", encoded)
+        };
+
+        let response = server.get("/reports/report.txt").await;
+        response.assert_status(StatusCode::UNAUTHORIZED);
+        let challenge = response.header("www-authenticate");
+        assert_eq!(challenge, "Basic realm=\"Reports\"");
+        let response = server
+            .get("/reports/report.txt")
+            .add_header("Authorization", basic("alice:wrong"))
+            .await;
+        response.assert_status(StatusCode::UNAUTHORIZED);
+
+        let response = server
+            .get("/reports/report.txt")
+            .add_header("Authorization", basic("alice:s3cret"))
+            .await;
+        response.assert_status_ok();
+        assert_eq!(response.text(), "numbers");
+    }
+
+    #[tokio::test]
+    async fn test_check_access_removes_accepted_credentials() {
+        use base64::Engine;
+
+        let dir = TempDir::new().unwrap();
+        let htpasswd = dir.path().join("htpasswd");
+        let hash = tenement::auth::hash_token("s3cret").unwrap();
+        std::fs::write(&htpasswd, format!("alice:{}\n", hash)).unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(Config::default()).await;
+        let access = AccessConfig {
+            basic_auth: Some(htpasswd),
+            ..Default::default()
+        };
+
+        let encoded = base64::engine::general_purpose::STANDARD.encode("alice:s3cret");
+        let mut req = Request::builder()
+            .uri("/")
+            .header("authorization", format!("Basic {}", encoded))
+            .body(Body::empty())
+            .unwrap();
+        let denied = check_access(&state, &access, "api", &mut req).await;
+        assert!(denied.is_none());
+        // Kept for a later check until the request goes upstream
+        assert!(req.headers().get("authorization").is_some());
+        strip_accepted_credentials(&mut req);
+        assert!(req.headers().get("authorization").is_none());
+    }
+
+    // ===================
+    // PATH ROUTE TESTS
+    // ===================
+
+    fn static_route_config(root: &Path) -> Config {
+        Config::from_str(&format!(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/docs"
+static = "{}"
+
+[[routing.route]]
+prefix = "/docs/api"
+service = "api"
+
+[[routing.route]]
+prefix = "/"
+static = "{}"
+"#,
+            root.join("docs").display(),
+            root.display()
+        ))
+        .unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_static_route_serves_file() {
+        let public = TempDir::new().unwrap();
+        std::fs::create_dir_all(public.path().join("docs")).unwrap();
+        std::fs::write(public.path().join("docs/intro.html"), "<h1>Intro</h1>").unwrap();
+
+        let (state, _token, _dir) =
+            create_test_state_with_config(static_route_config(public.path())).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        // No auth needed: routed paths are public like subdomain routes
+        let response = server.get("/docs/intro.html").await;
+        response.assert_status_ok();
+        assert_eq!(response.text(), "<h1>Intro</h1>");
+        assert_eq!(response.header("content-type"), "text/html");
+    }
+
+    #[tokio::test]
+    async fn test_more_specific_proxied_route_wins_over_static() {
+        let public = TempDir::new().unwrap();
+        std::fs::create_dir_all(public.path().join("docs/api")).unwrap();
+        std::fs::write(public.path().join("docs/api/index.html"), "static").unwrap();
+
+        let (state, _token, _dir) =
+            create_test_state_with_config(static_route_config(public.path())).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        // /docs/api goes to the service (not running), never the static file
+        let response = server.get("/docs/api/").await;
+        assert_ne!(response.status_code(), StatusCode::OK);
+        assert_ne!(response.text(), "static");
+    }
+
+    #[tokio::test]
+    async fn test_builtin_paths_beat_root_route() {
+        let public = TempDir::new().unwrap();
+        let (state, _token, _dir) =
+            create_test_state_with_config(static_route_config(public.path())).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server.get("/health").await;
+        response.assert_status_ok();
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["status"], "ok");
+
+        // API still requires auth even with a catch-all route
+        server.get("/api/instances").await.assert_status_unauthorized();
+    }
+
+    #[tokio::test]
+    async fn test_host_default_catches_only_its_host() {
+        let public = TempDir::new().unwrap();
+        std::fs::write(public.path().join("page.html"), "site").unwrap();
+        let config = Config::from_str(&format!(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/"
+static = "{}"
+
+[routing.host_default]
+"docs.other.org" = "api"
+"#,
+            public.path().display()
+        ))
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        // Other hosts use the global catch-all route
+        let response = server.get("/page.html").add_header("Host", "www.other.org").await;
+        response.assert_status_ok();
+        assert_eq!(response.text(), "site");
+
+        // The host's own catch-all goes to its service (not running here)
+        let response = server.get("/page.html").add_header("Host", "docs.other.org").await;
+        assert_ne!(response.status_code(), StatusCode::OK);
+        assert_ne!(response.text(), "site");
+    }
+
+    #[tokio::test]
+    async fn test_serve_static_rejects_traversal() {
+        let public = TempDir::new().unwrap();
+        std::fs::write(public.path().join("secret.txt"), "secret").unwrap();
+        let root = public.path().join("docs");
+        std::fs::create_dir_all(&root).unwrap();
+
+        let response = serve_static(&root, "/../secret.txt").await;
+        assert_eq!(response.status(), StatusCode::NOT_FOUND);
+
+        let response = serve_static(&root, "/missing.txt").await;
+        assert_eq!(response.status(), StatusCode::NOT_FOUND);
+    }
+
+    // ===================
+    // ROUTE SLO TESTS
+    // ===================
+
+    fn slo_route(target_ms: Option<u64>) -> tenement::routing::Route {
+        tenement::routing::Route {
+            prefix: "/api".to_string(),
+            target: RouteTarget::Service("api".to_string()),
+            request_headers: HeaderRules::default(),
+            response_headers: HeaderRules::default(),
+            host: None,
+            host_default: false,
+            slo_target: target_ms.map(std::time::Duration::from_millis),
+            gzip_level: None,
+            rewrite: None,
+            access: None,
+            mirror: None,
+            fault: None,
+        }
+    }
+
+    async fn slow_count(metrics: &tenement::Metrics) -> u64 {
+        metrics.requests_slow_total.total().await
+    }
+
+    #[tokio::test]
+    async fn test_record_slo_counts_only_requests_over_target() {
+        let metrics = tenement::Metrics::new();
+        let route = slo_route(Some(100));
+        let ok = StatusCode::OK.into_response();
+        let ms = std::time::Duration::from_millis;
+
+        assert!(!record_slo(&metrics, &route, "GET /api/fast", ms(20), &ok).await);
+        assert!(!record_slo(&metrics, &route, "GET /api/edge", ms(100), &ok).await);
+        assert_eq!(slow_count(&metrics).await, 0);
+
+        assert!(record_slo(&metrics, &route, "GET /api/slow", ms(250), &ok).await);
+        assert!(record_slo(&metrics, &route, "GET /api/slow", ms(900), &ok).await);
+        assert_eq!(slow_count(&metrics).await, 2);
+        let output = metrics.format_prometheus().await;
+        assert!(output.contains("tenement_requests_slow_total{route=\"/api\"} 2"));
+    }
+
+    #[tokio::test]
+    async fn test_record_slo_ignores_timeouts_and_routes_without_target() {
+        let metrics = tenement::Metrics::new();
+        let slow = std::time::Duration::from_secs(5);
+
+        let mut timed_out = StatusCode::GATEWAY_TIMEOUT.into_response();
+        timed_out.extensions_mut().insert(ProxyTimedOut);
+        assert!(!record_slo(&metrics, &slo_route(Some(100)), "GET /api", slow, &timed_out).await);
+
+        // A 504 from the app itself is still a slow response
+        let upstream_504 = StatusCode::GATEWAY_TIMEOUT.into_response();
+        assert!(record_slo(&metrics, &slo_route(Some(100)), "GET /api", slow, &upstream_504).await);
+
+        let ok = StatusCode::OK.into_response();
+        assert!(!record_slo(&metrics, &slo_route(None), "GET /api", slow, &ok).await);
+        assert_eq!(slow_count(&metrics).await, 1);
+    }
+
+    #[tokio::test]
+    async fn test_routed_request_under_target_not_counted() {
+        let public = TempDir::new().unwrap();
+        std::fs::write(public.path().join("a.txt"), "a").unwrap();
+        let config = Config::from_str(&format!(
+            "[[routing.route]]\nprefix = \"/files\"\nstatic = \"{}\"\nslo_target_ms = 60000\n",
+            public.path().display()
+        ))
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let metrics = state.hypervisor.metrics();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        server.get("/files/a.txt").await.assert_status_ok();
+        assert_eq!(slow_count(&metrics).await, 0);
+    }
+
+    // ===================
+    // ROUTE COMPRESSION TESTS
+    // ===================
+
+    /// Compressible text served from a static route with an optional `gzip_level`
+    async fn gzip_test_server(gzip_level: Option<&str>) -> (TestServer, String, [TempDir; 2]) {
+        let public = TempDir::new().unwrap();
+        let text: String = (0..2000)
+            .map(|i| format!("line {} of some very compressible text\n", i))
+            .collect();
+        std::fs::write(public.path().join("big.txt"), &text).unwrap();
+        let gzip_level = gzip_level
+            .map(|level| format!("gzip_level = {}\n", level))
+            .unwrap_or_default();
+        let config = Config::from_str(&format!(
+            "[[routing.route]]\nprefix = \"/files\"\nstatic = \"{}\"\n{}",
+            public.path().display(),
+            gzip_level
+        ))
+        .unwrap();
+        let (state, _token, dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        (server, text, [public, dir])
+    }
+
+    #[tokio::test]
+    async fn test_route_gzip_level_applied() {
+        // The gzip header's XFL byte records the level: 4 = fastest, 2 = best, 0 = other
+        let mut sizes = Vec::new();
+        for (level, xfl) in [("1", 4), ("\"default\"", 0), ("9", 2)] {
+            let (server, text, _dirs) = gzip_test_server(Some(level)).await;
+            let response = server
+                .get("/files/big.txt")
+                .add_header("Accept-Encoding", "gzip")
+                .await;
+            response.assert_status_ok();
+            assert_eq!(response.header("content-encoding"), "gzip");
+
+            let body = response.as_bytes();
+            assert_eq!(body[..2], [0x1f, 0x8b], "gzip magic");
+            assert_eq!(body[8], xfl, "XFL for gzip_level = {}", level);
+            assert!(body.len() < text.len() / 4);
+            sizes.push(body.len());
+        }
+        assert!(sizes[2] <= sizes[0], "level 9 is no larger than level 1: {:?}", sizes);
+    }
+
+    #[tokio::test]
+    async fn test_route_gzip_needs_client_support() {
+        let (server, text, _dirs) = gzip_test_server(Some("6")).await;
+        let response = server.get("/files/big.txt").await;
+        response.assert_status_ok();
+        assert!(response.maybe_header("content-encoding").is_none());
+        assert_eq!(response.text(), text);
+    }
+
+    #[tokio::test]
+    async fn test_route_without_gzip_level_not_compressed() {
+        let (server, text, _dirs) = gzip_test_server(None).await;
+        let response = server
+            .get("/files/big.txt")
+            .add_header("Accept-Encoding", "gzip")
+            .await;
+        assert!(response.maybe_header("content-encoding").is_none());
+        assert_eq!(response.text(), text);
+    }
+
+    #[tokio::test]
+    async fn test_service_compression_uses_encoding_client_prefers() {
+        let site = TempDir::new().unwrap();
+        let text: String = (0..2000)
+            .map(|i| format!("line {} of some very compressible text\n", i))
+            .collect();
+        std::fs::write(site.path().join("big.txt"), &text).unwrap();
+        let config = Config::from_str(&format!(
+            r#"
+[service.web]
+type = "static"
+root = "{0}"
+compression = {{}}
+
+[service.docs]
+type = "static"
+root = "{0}"
+compression = {{ encodings = ["gzip"], level = 9 }}
+"#,
+            site.path().display()
+        ))
+        .unwrap();
+        let (state, _token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        let get = |host: &'static str, accept: &'static str| {
+            server
+                .get("/big.txt")
+                .add_header("Host", host)
+                .add_header("Accept-Encoding", accept)
+        };
+
+        let response = get("web.example.com", "gzip, br").await;
+        response.assert_status_ok();
+        assert_eq!(response.header("content-encoding"), "br");
+        assert!(response.as_bytes().len() < text.len() / 4);
+        let response = get("web.example.com", "gzip").await;
+        assert_eq!(response.header("content-encoding"), "gzip");
+
+        // Only the encodings the service offers
+        let response = get("docs.example.com", "br").await;
+        assert!(response.maybe_header("content-encoding").is_none());
+        assert_eq!(response.text(), text);
+        let response = get("docs.example.com", "gzip, br").await;
+        assert_eq!(response.header("content-encoding"), "gzip");
+    }
+
+    // ===================
+    // RESPONSE CACHE TESTS
+    // ===================
+
+    #[test]
+    fn test_cache_request_rules() {
+        // Whether a stored copy may answer, or None when the cache is skipped
+        let reuse = |method: &str, headers: &[(&str, &str)]| {
+            let mut builder = Request::builder()
+                .method(method)
+                .uri("/users?page=2")
+                .header("host", "API.example.com");
+            for (name, value) in headers {
+                builder = builder.header(*name, *value);
+            }
+            let (key, reuse) = cache_request(&builder.body(Body::empty()).unwrap())?;
+            assert_eq!(key, "api.example.com/users?page=2");
+            Some(reuse)
+        };
+
+        assert_eq!(reuse("GET", &[]), Some(true));
+        assert_eq!(reuse("GET", &[("cache-control", "no-cache")]), Some(false));
+        assert_eq!(reuse("GET", &[("pragma", "no-cache")]), Some(false));
+        assert_eq!(reuse("GET", &[("cache-control", "no-store")]), None);
+        assert_eq!(reuse("GET", &[("authorization", "Bearer x")]), None);
+        assert_eq!(reuse("POST", &[]), None);
+    }
+
+    fn cacheable(extra: &[(&str, &str)]) -> Response {
+        let mut builder = Response::builder()
+            .header("cache-control", "public, max-age=60")
+            .header("content-type", "application/json");
+        for (name, value) in extra {
+            builder = builder.header(*name, *value);
+        }
+        builder.body(Body::from("[1,2,3]")).unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_store_response_then_answer_from_cache() {
+        use http_body_util::BodyExt;
+
+        let settings = tenement::config::CacheConfig::default();
+        let cache = Arc::new(ResponseCache::new(&settings, None));
+        let response = store_response(cache.clone(), "k".to_string(), cacheable(&[]));
+        // Kept once the whole body has been sent, not before
+        assert!(cache.get("k").is_none());
+        let body = response.into_body().collect().await.unwrap().to_bytes();
+        assert_eq!(&body[..], b"[1,2,3]");
+
+        let response = cached_response(cache.get("k").unwrap());
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(response.headers()["x-cache"], "HIT");
+        assert_eq!(response.headers()["age"], "0");
+        assert_eq!(response.headers()["content-type"], "application/json");
+        let body = response.into_body().collect().await.unwrap().to_bytes();
+        assert_eq!(&body[..], b"[1,2,3]");
+    }
+
+    #[tokio::test]
+    async fn test_store_response_skips_what_cant_be_shared() {
+        use http_body_util::BodyExt;
+
+        let settings = tenement::config::CacheConfig::default();
+        let cache = Arc::new(ResponseCache::new(&settings, None));
+        let skipped = [
+            vec![("set-cookie", "session=1")],
+            vec![("vary", "Cookie")],
+            vec![("content-encoding", "gzip")],
+            vec![("cache-control", "private")],
+        ];
+        for extra in skipped {
+            let response = store_response(cache.clone(), "k".to_string(), cacheable(&extra));
+            response.into_body().collect().await.unwrap();
+            assert!(cache.get("k").is_none(), "{:?}", extra);
+        }
+
+        let response = cacheable(&[("vary", "Accept-Encoding")]);
+        let response = store_response(cache.clone(), "k".to_string(), response);
+        response.into_body().collect().await.unwrap();
+        assert!(cache.get("k").is_some());
+    }
+
+    // ===================
+    // MUTATION API TESTS (Phase My Way)
+    // ===================
+
+    #[tokio::test]
+    async fn test_spawn_requires_auth() {
+        let (state, _token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .post("/api/instances/spawn")
+            .json(&serde_json::json!({"process": "api", "id": "prod"}))
+            .await;
+        response.assert_status_unauthorized();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_unknown_process() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .post("/api/instances/spawn")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({"process": "nonexistent", "id": "prod"}))
+            .await;
+
+        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+        let json: serde_json::Value = response.json();
+        assert!(json["error"].as_str().unwrap().contains("Unknown process"));
+    }
+
+    #[tokio::test]
+    async fn test_stop_not_found() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .delete("/api/instances/api:prod")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+
+        response.assert_status(StatusCode::NOT_FOUND);
+    }
+
+    #[tokio::test]
+    async fn test_stop_invalid_id_format() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        // Instance ID without colon: parse_instance_id returns BAD_REQUEST
+        let response = server
+            .delete("/api/instances/invalid-no-colon")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+
+        let status = response.status_code();
+        // Either BAD_REQUEST (handler reached) or NOT_FOUND (fallback)
+        assert!(
+            status == StatusCode::BAD_REQUEST || status == StatusCode::NOT_FOUND,
+            "Expected 400 or 404, got {}",
+            status
+        );
+    }
+
+    #[tokio::test]
+    async fn test_weight_not_found() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .put("/api/instances/api:prod/weight")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({"weight": 50}))
+            .await;
+
+        response.assert_status(StatusCode::NOT_FOUND);
+    }
+
+    #[tokio::test]
+    async fn test_health_check_unknown_instance() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .get("/api/instances/api:prod/health")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+
+        response.assert_status_ok();
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["health"], "unknown");
+    }
+
+    #[tokio::test]
+    async fn test_env_not_found() {
+        let (state, token, _dir) = create_test_state().await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/api/instances/api:prod/env")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+
+        response.assert_status(StatusCode::NOT_FOUND);
+    }
+
+    #[tokio::test]
+    async fn test_env_of_stopped_instance_is_resolved() {
+        let config = Config::from_str(
+            "[service.api]\ncommand = \"./api\"\n[service.api.env]\nLEVEL = \"info\"\n",
+        )
+        .unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .get("/api/instances/api:prod/env")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+
+        response.assert_status_ok();
+        let env: std::collections::BTreeMap<String, String> = response.json();
+        assert_eq!(env["LEVEL"], "info");
+        assert_eq!(env["TENEMENT_INSTANCE"], "api:prod");
+    }
+
+    #[tokio::test]
+    async fn test_deploy_unknown_process() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .post("/api/deploy")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({
+                "process": "nonexistent",
+                "version": "v1",
+                "weight": 100,
+                "timeout": 2
+            }))
+            .await;
+
+        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+    }
+
+    #[tokio::test]
+    async fn test_deploy_replace_missing_version() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .post("/api/deploy")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({
+                "process": "api",
+                "version": "v2",
+                "replace": "v1",
+                "timeout": 2
+            }))
+            .await;
+
+        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+        let json: serde_json::Value = response.json();
+        assert!(json["error"].as_str().unwrap().contains("api:v1 not found"));
+    }
+
+    #[tokio::test]
+    async fn test_route_not_found() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .post("/api/route")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({
+                "process": "api",
+                "from": "v1",
+                "to": "v2"
+            }))
+            .await;
+
+        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+    }
+
+    #[tokio::test]
+    async fn test_restart_not_found() {
+        let (state, token, _dir) = create_test_state().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .post("/api/instances/api:prod/restart")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+
+        // Restart on non-existent instance should fail (stop fails, then spawn fails for unknown process)
+        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+    }
+
+    // ===================
+    // TENANT TOKEN TESTS
+    // ===================
+
+    /// Create test state with both admin and tenant tokens
+    async fn create_test_state_with_tenant() -> (AppState, String, String, TempDir) {
+        let dir = TempDir::new().unwrap();
+        let db_path = dir.path().join("test.db");
+        let pool = init_db(&db_path).await.unwrap();
+        let config_store = Arc::new(ConfigStore::new(pool.clone()));
+        let deploy_log = Arc::new(tenement::DeployLogStore::new(pool.clone()));
+        let releases = Arc::new(tenement::ReleaseStore::new(pool.clone()));
+        let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool.clone()));
+        let api_tokens = Arc::new(tenement::ApiTokenStore::new(pool.clone()));
+
+        // Generate admin token
+        let token_store = TokenStore::new(&config_store);
+        let admin_token = token_store.generate_and_store().await.unwrap();
+
+        // Generate tenant token for "alice"
+        let tenant_token = tenant_tokens
+            .generate_and_store("alice", Some("test"))
+            .await
+            .unwrap();
+
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+        let client = Client::builder(TokioExecutor::new())
+            .build(WarmConnector::new(hypervisor.warm_pool()));
+        let h2_client = Client::builder(TokioExecutor::new())
+            .http2_only(true)
+            .build(WarmConnector::new(hypervisor.warm_pool()));
+        let state = AppState {
+            hypervisor,
+            domain: "example.com".to_string(),
+            client,
+            h2_client,
+            upstream_pools: Arc::new(UpstreamPools::new()),
+            config_store,
+            deploy_log,
+            releases,
+            tenant_tokens,
+            api_tokens,
+            admin_tokens: AdminTokens::empty(),
+            tls_status: TlsStatus::default(),
+            auth_failures: Arc::new(tokio::sync::RwLock::new((0, None))),
+        };
+        (state, admin_token, tenant_token, dir)
+    }
+
+    #[tokio::test]
+    async fn test_tenant_token_can_list_instances() {
+        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        // Tenant token should be able to list (will see only their instances)
+        let response = server
+            .get("/api/instances")
+            .add_header("Authorization", format!("Bearer {}", tenant))
+            .await;
+        response.assert_status_ok();
+    }
+
+    #[tokio::test]
+    async fn test_tenant_token_cannot_deploy() {
+        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        // Tenant token should be rejected for deploy
+        let response = server
+            .post("/api/deploy")
+            .add_header("Authorization", format!("Bearer {}", tenant))
+            .json(&serde_json::json!({
+                "process": "api",
+                "version": "v1",
+                "weight": 100,
+                "timeout": 2
+            }))
+            .await;
+        response.assert_status(StatusCode::FORBIDDEN);
+    }
+
+    #[tokio::test]
+    async fn test_tenant_token_cannot_route() {
+        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        // Tenant token should be rejected for route swap
+        let response = server
+            .post("/api/route")
+            .add_header("Authorization", format!("Bearer {}", tenant))
+            .json(&serde_json::json!({
+                "process": "api",
+                "from": "v1",
+                "to": "v2"
+            }))
+            .await;
+        response.assert_status(StatusCode::FORBIDDEN);
+    }
+
+    #[tokio::test]
+    async fn test_rollback_needs_admin_and_a_release() {
+        let (state, admin, tenant, _dir) = create_test_state_with_tenant().await;
+        let app = create_router(state);
+        let server = TestServer::new(app).unwrap();
+
+        let response = server
+            .post("/api/rollback")
+            .add_header("Authorization", format!("Bearer {}", tenant))
+            .json(&serde_json::json!({"process": "api"}))
+            .await;
+        response.assert_status(StatusCode::FORBIDDEN);
+
+        let response = server
+            .post("/api/rollback")
+            .add_header("Authorization", format!("Bearer {}", admin))
+            .json(&serde_json::json!({"process": "api"}))
+            .await;
+        response.assert_status(StatusCode::NOT_FOUND);
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["error"], "No releases of api");
+    }
+
+    #[tokio::test]
+    async fn test_git_push_endpoints_take_basic_auth() {
+        use base64::Engine;
+        let data = TempDir::new().unwrap();
+        let config = Config::from_str(&format!(
+            "[settings]\ndata_dir = \"{}\"\n\n\
+             [service.api]\ncommand = \"./api\"\n[service.api.git]\nbranch = \"main\"\n\n\
+             [service.worker]\ncommand = \"./worker\"\n",
+            data.path().display()
+        ))
+        .unwrap();
+        let (state, token, _dir) = create_test_state_with_config(config).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+        let refs = "/git/api.git/info/refs?service=git-receive-pack";
+        let basic = |password: &str| {
+            let credentials = format!("git:{}", password);
+            let encoded = base64::engine::general_purpose::STANDARD.encode(credentials);
+            format!("Basic {}", encoded)
+        };
+
+        // git only sends credentials once challenged
+        let response = server.get(refs).await;
+        response.assert_status(StatusCode::UNAUTHORIZED);
+        assert_eq!(response.header("www-authenticate"), "Basic realm=\"tenement\"");
+        let response = server
+            .get(refs)
+            .add_header("Authorization", basic("wrong"))
+            .await;
+        response.assert_status(StatusCode::UNAUTHORIZED);
+
+        let response = server
+            .get(refs)
+            .add_header("Authorization", basic(&token))
+            .await;
+        response.assert_status_ok();
+        assert_eq!(
+            response.header("content-type"),
+            "application/x-git-receive-pack-advertisement"
+        );
+        assert!(response
+            .as_bytes()
+            .starts_with(b"001e# service=git-receive-pack\n0000"));
+        assert!(data.path().join(".repos/api.git/hooks/post-receive").exists());
+
+        // Fetches aren't served, and only services with a git table have a repository
+        let response = server
+            .get("/git/api.git/info/refs?service=git-upload-pack")
+            .add_header("Authorization", basic(&token))
+            .await;
+        response.assert_status(StatusCode::FORBIDDEN);
+        let response = server
+            .get("/git/worker.git/info/refs?service=git-receive-pack")
+            .add_header("Authorization", basic(&token))
+            .await;
+        response.assert_status(StatusCode::NOT_FOUND);
+    }
+
+    #[tokio::test]
+    async fn test_tenant_token_scoped_to_own_instances() {
+        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
         let app = create_router(state);
         let server = TestServer::new(app).unwrap();
 
-        let response = server.get("/health").await;
-        response.assert_status_ok();
-
-        let json: serde_json::Value = response.json();
-        assert_eq!(json["status"], "ok");
+        // Tenant "alice" should be rejected when trying to stop "bob"
+        let response = server
+            .delete("/api/instances/api:bob")
+            .add_header("Authorization", format!("Bearer {}", tenant))
+            .await;
+        response.assert_status(StatusCode::FORBIDDEN);
     }
 
     #[tokio::test]
-    async fn test_instances_endpoint_empty() {
-        let (state, token, _dir) = create_test_state().await;
+    async fn test_admin_token_has_full_access() {
+        let (state, admin, _tenant, _dir) = create_test_state_with_tenant().await;
         let app = create_router(state);
         let server = TestServer::new(app).unwrap();
 
+        // Admin can access any instance
         let response = server
             .get("/api/instances")
-            .add_header("Authorization", format!("Bearer {}", token))
+            .add_header("Authorization", format!("Bearer {}", admin))
             .await;
         response.assert_status_ok();
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert!(json.is_empty());
+        // Admin can deploy
+        let response = server
+            .post("/api/deploy")
+            .add_header("Authorization", format!("Bearer {}", admin))
+            .json(&serde_json::json!({
+                "process": "nonexistent",
+                "version": "v1",
+                "weight": 100,
+                "timeout": 1
+            }))
+            .await;
+        // Will fail because process doesn't exist, but NOT because of auth
+        assert_ne!(response.status_code(), StatusCode::FORBIDDEN);
+        assert_ne!(response.status_code(), StatusCode::UNAUTHORIZED);
     }
 
     #[tokio::test]
-    async fn test_dashboard_endpoint() {
-        let (state, _token, _dir) = create_test_state().await;
+    async fn test_tenant_token_scoped_logs() {
+        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
+        let log_buffer = state.hypervisor.log_buffer();
+
+        // Add logs for different instances
+        log_buffer
+            .push_stdout("api", "alice", "alice's log".to_string())
+            .await;
+        log_buffer
+            .push_stdout("api", "bob", "bob's log".to_string())
+            .await;
+
         let app = create_router(state);
         let server = TestServer::new(app).unwrap();
 
-        let response = server.get("/").await;
+        // Tenant "alice" should only see alice's logs
+        let response = server
+            .get("/api/logs")
+            .add_header("Authorization", format!("Bearer {}", tenant))
+            .await;
         response.assert_status_ok();
-        response.assert_text_contains("tenement dashboard");
+
+        let json: Vec<serde_json::Value> = response.json();
+        assert_eq!(json.len(), 1, "Tenant should only see their own logs");
+        assert_eq!(json[0]["instance_id"], "alice");
+    }
+
+    // ===================
+    // IPV6 HOST TESTS
+    // ===================
+
+    #[test]
+    fn test_split_host_port() {
+        assert_eq!(split_host_port("[::1]:8080"), ("[::1]", Some(8080)));
+        assert_eq!(split_host_port("[::1]"), ("[::1]", None));
+        assert_eq!(split_host_port("[2001:db8::1]:443"), ("[2001:db8::1]", Some(443)));
+        assert_eq!(split_host_port("::1"), ("::1", None));
+        assert_eq!(split_host_port("example.com:8080"), ("example.com", Some(8080)));
+        assert_eq!(split_host_port("example.com"), ("example.com", None));
+        assert_eq!(split_host_port("127.0.0.1:30001"), ("127.0.0.1", Some(30001)));
+    }
+
+    #[test]
+    fn test_parse_subdomain_ipv6_literal() {
+        assert!(parse_subdomain("[::1]:8080", "example.com").is_none());
+        assert!(parse_subdomain("[::1]", "example.com").is_none());
+        // Ports are still stripped for normal hosts
+        match parse_subdomain("api.example.com:8080", "example.com") {
+            Some(SubdomainRoute::Weighted { process }) => assert_eq!(process, "api"),
+            _ => panic!("Expected Weighted route"),
+        }
     }
 
     #[tokio::test]
-    async fn test_unknown_subdomain_returns_404() {
-        let (state, _token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_ipv6_host_matches_path_routes() {
+        let public = TempDir::new().unwrap();
+        std::fs::create_dir_all(public.path().join("docs")).unwrap();
+        std::fs::write(public.path().join("docs/intro.html"), "<h1>Intro</h1>").unwrap();
+
+        let (state, _token, _dir) =
+            create_test_state_with_config(static_route_config(public.path())).await;
+        let server = TestServer::new(create_router(state)).unwrap();
 
-        // Simulate request to subdomain for unconfigured process
         let response = server
-            .get("/some-path")
-            .add_header("Host", "prod.api.example.com")
+            .get("/docs/intro.html")
+            .add_header("Host", "[::1]:8080")
             .await;
+        response.assert_status_ok();
+        assert_eq!(response.text(), "<h1>Intro</h1>");
 
-        response.assert_status_not_found();
-        // Error message is sanitized (no internal details for unauthenticated users)
-        response.assert_text_contains("Not found");
+        let response = server.get("/health").add_header("Host", "[::1]").await;
+        response.assert_status_ok();
+    }
+
+    #[test]
+    fn test_forwarded_headers_ipv6_host() {
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("host", "[::1]:8080".parse().unwrap());
+        add_forwarded_headers(&mut headers, "http", Some("::1".parse().unwrap()));
+
+        assert_eq!(headers["x-forwarded-host"], "[::1]:8080");
+        assert_eq!(headers["x-forwarded-port"], "8080");
+        assert_eq!(headers["x-forwarded-proto"], "http");
+        assert_eq!(headers["x-forwarded-for"], "::1");
+    }
+
+    #[test]
+    fn test_forwarded_headers_default_port_and_chain() {
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("host", "[2001:db8::1]".parse().unwrap());
+        headers.insert("x-forwarded-for", "203.0.113.7".parse().unwrap());
+        add_forwarded_headers(&mut headers, "https", Some("2001:db8::2".parse().unwrap()));
+
+        assert_eq!(headers["x-forwarded-host"], "[2001:db8::1]");
+        assert_eq!(headers["x-forwarded-port"], "443");
+        assert_eq!(headers["x-forwarded-for"], "203.0.113.7, 2001:db8::2");
+    }
+
+    #[test]
+    fn test_rewrite_location_to_ipv6_host() {
+        let rewrite = |loc, proto, host| rewrite_location(loc, "127.0.0.1:30001", proto, host);
+        assert_eq!(
+            rewrite("http://127.0.0.1:30001/login?next=/", "http", "[::1]:8080"),
+            Some("http://[::1]:8080/login?next=/".to_string())
+        );
+        assert_eq!(
+            rewrite("http://localhost:30001", "https", "[2001:db8::1]"),
+            Some("https://[2001:db8::1]".to_string())
+        );
+        assert_eq!(
+            rewrite("http://[::1]:30001/x", "http", "[::1]:8080"),
+            Some("http://[::1]:8080/x".to_string())
+        );
+
+        // Relative, external, and look-alike ports are left alone
+        assert!(rewrite("/login", "http", "[::1]:8080").is_none());
+        assert!(rewrite("https://other.com/", "http", "[::1]:8080").is_none());
+        assert!(rewrite("http://127.0.0.1:300012/", "http", "[::1]:8080").is_none());
+    }
+
+    // ===================
+    // API TOKEN SCOPE TESTS
+    // ===================
+
+    #[test]
+    fn test_required_scope() {
+        use axum::http::Method;
+        let scope = |method: Method, path: &str| required_scope(&method, path);
+        assert_eq!(scope(Method::GET, "/api/webhooks"), Scope::Read);
+        assert_eq!(scope(Method::GET, "/api/logs/stream"), Scope::Read);
+        assert_eq!(scope(Method::POST, "/api/deploy"), Scope::Deploy);
+        assert_eq!(scope(Method::POST, "/api/rollback"), Scope::Deploy);
+        let restart = scope(Method::POST, "/api/instances/api:prod/restart");
+        assert_eq!(restart, Scope::Deploy);
+        let push = scope(Method::POST, "/git/api.git/git-receive-pack");
+        assert_eq!(push, Scope::Deploy);
+        assert_eq!(scope(Method::POST, "/api/previews"), Scope::Deploy);
+        let stack = scope(Method::POST, "/api/stacks/acme-prod/deploy");
+        assert_eq!(stack, Scope::Deploy);
+        let preview = scope(Method::DELETE, "/api/previews/api/pr-1");
+        assert_eq!(preview, Scope::Deploy);
+        let stop = scope(Method::DELETE, "/api/instances/api:prod");
+        assert_eq!(stop, Scope::Admin);
+        assert_eq!(scope(Method::POST, "/api/webhooks"), Scope::Admin);
+        assert_eq!(scope(Method::POST, "/api/deploy/extra"), Scope::Admin);
     }
 
     #[tokio::test]
-    async fn test_logs_endpoint_empty() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_api_token_scopes() {
+        let (state, _token, _dir) = create_test_state().await;
+        let viewer = state
+            .api_tokens
+            .generate_and_store("viewer", Scope::Read)
+            .await
+            .unwrap();
+        let ci = state
+            .api_tokens
+            .generate_and_store("ci", Scope::Deploy)
+            .await
+            .unwrap();
+        let server = TestServer::new(create_router(state.clone())).unwrap();
+        let bearer = |token: &str| format!("Bearer {}", token);
 
         let response = server
-            .get("/api/logs")
-            .add_header("Authorization", format!("Bearer {}", token))
+            .get("/api/instances")
+            .add_header("Authorization", bearer(&viewer))
             .await;
         response.assert_status_ok();
+        let response = server
+            .post("/api/instances/api:prod/restart")
+            .add_header("Authorization", bearer(&viewer))
+            .await;
+        response.assert_status_forbidden();
+        response.assert_text_contains("token:viewer has read scope");
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert!(json.is_empty());
+        // Deploy scope gets past the scope check, then the handler decides
+        let response = server
+            .post("/api/instances/api:prod/restart")
+            .add_header("Authorization", bearer(&ci))
+            .await;
+        assert_ne!(response.status_code(), StatusCode::FORBIDDEN);
+        assert_ne!(response.status_code(), StatusCode::UNAUTHORIZED);
+        let response = server
+            .delete("/api/instances/api:prod")
+            .add_header("Authorization", bearer(&ci))
+            .await;
+        response.assert_status_forbidden();
+
+        state.api_tokens.revoke("ci").await.unwrap();
+        let response = server
+            .get("/api/instances")
+            .add_header("Authorization", bearer(&ci))
+            .await;
+        response.assert_status_unauthorized();
     }
 
     #[tokio::test]
-    async fn test_logs_endpoint_with_entries() {
+    async fn test_mutating_calls_are_audited_with_identity() {
         let (state, token, _dir) = create_test_state().await;
-        let log_buffer = state.hypervisor.log_buffer();
+        let viewer = state
+            .api_tokens
+            .generate_and_store("viewer", Scope::Read)
+            .await
+            .unwrap();
+        let server = TestServer::new(create_router(state.clone())).unwrap();
 
-        // Add some log entries
-        log_buffer
-            .push_stdout("api", "prod", "hello world".to_string())
+        server
+            .post("/api/instances/api:prod/restart")
+            .add_header("Authorization", format!("Bearer {}", token))
             .await;
-        log_buffer
-            .push_stderr("api", "prod", "error message".to_string())
+        server
+            .delete("/api/instances/api:prod")
+            .add_header("Authorization", format!("Bearer {}", viewer))
+            .await;
+        server
+            .get("/api/instances")
+            .add_header("Authorization", format!("Bearer {}", token))
             .await;
 
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+        let entries = state.deploy_log.recent(10).await.unwrap();
+        let calls: Vec<_> = entries.iter().filter(|e| e.action == "api").collect();
+        assert_eq!(calls.len(), 2, "reads aren't audited: {:?}", entries);
+        let denied = calls
+            .iter()
+            .find(|e| e.actor.as_deref() == Some("token:viewer"))
+            .unwrap();
+        assert_eq!(
+            denied.details.as_deref(),
+            Some("DELETE /api/instances/api:prod 403")
+        );
+        assert!(!denied.success);
+        assert!(calls.iter().any(|e| e.actor.as_deref() == Some("admin")));
+    }
 
-        let response = server
-            .get("/api/logs")
+    // ===================
+    // REQUEST HEADER RULE TESTS
+    // ===================
+
+    fn header_rules(toml: &str) -> HeaderRules {
+        toml::from_str(toml).unwrap()
+    }
+
+    #[test]
+    fn test_accept_encoding_normalized_before_proxying() {
+        let rules = header_rules(r#"accept_encoding = "normalize""#);
+
+        // Equivalent client preferences reach the backend as one value, so
+        // anything upstream that varies on Accept-Encoding sees a single variant
+        let mut upstream = Vec::new();
+        let clients = ["gzip, deflate, br", "br;q=1.0, gzip;q=0.9, deflate", "deflate,BR,gzip"];
+        for client in clients {
+            let mut headers = axum::http::HeaderMap::new();
+            headers.insert("accept-encoding", client.parse().unwrap());
+            apply_request_headers(&mut headers, &rules);
+            upstream.push(headers["accept-encoding"].to_str().unwrap().to_string());
+        }
+        assert_eq!(upstream, vec!["br, gzip, deflate"; 3]);
+
+        // Nothing acceptable left: the header is dropped rather than sent empty
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("accept-encoding", "identity".parse().unwrap());
+        apply_request_headers(&mut headers, &rules);
+        assert!(headers.get("accept-encoding").is_none());
+    }
+
+    #[test]
+    fn test_request_header_rules_strip_force_set_remove() {
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("accept-encoding", "gzip".parse().unwrap());
+        headers.insert("cookie", "session=1".parse().unwrap());
+        apply_request_headers(
+            &mut headers,
+            &header_rules(
+                r#"
+accept_encoding = "strip"
+remove = ["cookie"]
+set = { "x-cache-tier" = "edge" }
+"#,
+            ),
+        );
+        assert!(headers.get("accept-encoding").is_none());
+        assert!(headers.get("cookie").is_none());
+        assert_eq!(headers["x-cache-tier"], "edge");
+
+        let mut headers = axum::http::HeaderMap::new();
+        apply_request_headers(&mut headers, &header_rules(r#"accept_encoding = "gzip""#));
+        assert_eq!(headers["accept-encoding"], "gzip");
+    }
+
+    #[test]
+    fn test_request_header_rules_add_rewrite_and_replace_forwarded() {
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("x-forwarded-for", "10.9.9.9".parse().unwrap());
+        headers.insert("x-forwarded-proto", "https".parse().unwrap());
+        headers.insert("x-tenant", "acme".parse().unwrap());
+        headers.insert("referer", "http://example.com/a".parse().unwrap());
+        let rules = header_rules(
+            r#"
+forwarded = "replace"
+add = { "x-tenant" = "edge" }
+rewrite = { referer = { from = "http://", to = "https://" } }
+"#,
+        );
+        apply_request_headers(&mut headers, &rules);
+        // A spoofed chain is dropped; the proxy then adds only the real peer
+        assert!(headers.get("x-forwarded-proto").is_none());
+        add_forwarded_headers(&mut headers, "http", Some("192.0.2.1".parse().unwrap()));
+        assert_eq!(headers["x-forwarded-for"], "192.0.2.1");
+        assert_eq!(headers["x-forwarded-proto"], "http");
+        let tenants: Vec<_> = headers.get_all("x-tenant").iter().collect();
+        assert_eq!(tenants, ["acme", "edge"]);
+        assert_eq!(headers["referer"], "https://example.com/a");
+
+        // By default the client's chain is kept and extended
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("x-forwarded-for", "10.9.9.9".parse().unwrap());
+        apply_request_headers(&mut headers, &HeaderRules::default());
+        add_forwarded_headers(&mut headers, "http", Some("192.0.2.1".parse().unwrap()));
+        assert_eq!(headers["x-forwarded-for"], "10.9.9.9, 192.0.2.1");
+    }
+
+    #[test]
+    fn test_response_header_rules_and_security_headers() {
+        let rules = header_rules(
+            r#"
+security_headers = true
+remove = ["server", "x-powered-by"]
+set = { "cache-control" = "no-store" }
+"#,
+        );
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("server", "gunicorn".parse().unwrap());
+        headers.insert("x-powered-by", "php".parse().unwrap());
+        headers.insert("x-frame-options", "DENY".parse().unwrap());
+        apply_response_headers(&mut headers, &rules, true);
+        assert!(headers.get("server").is_none());
+        assert!(headers.get("x-powered-by").is_none());
+        assert_eq!(headers["cache-control"], "no-store");
+        assert_eq!(headers["x-content-type-options"], "nosniff");
+        assert_eq!(headers["strict-transport-security"], HSTS);
+        // What the app chose wins over the defaults
+        assert_eq!(headers["x-frame-options"], "DENY");
+
+        // No HSTS over plain HTTP
+        let mut headers = axum::http::HeaderMap::new();
+        apply_response_headers(&mut headers, &rules, false);
+        assert!(headers.get("strict-transport-security").is_none());
+        assert_eq!(headers["x-content-type-options"], "nosniff");
+    }
+
+    #[test]
+    fn test_empty_rules_leave_headers_alone() {
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("accept-encoding", "gzip;q=0.5, br".parse().unwrap());
+        apply_request_headers(&mut headers, &HeaderRules::default());
+        assert_eq!(headers["accept-encoding"], "gzip;q=0.5, br");
+    }
+
+    #[test]
+    fn test_rewritten_request_keeps_query_and_reports_prefix() {
+        let mut req = Request::builder()
+            .uri("/api/users?page=2")
+            .header("x-forwarded-prefix", "/spoofed")
+            .body(Body::empty())
+            .unwrap();
+        rewrite_request_path(&mut req, "/v2/users", "/api").unwrap();
+        assert_eq!(req.uri(), "/v2/users?page=2");
+        assert_eq!(req.headers()["x-forwarded-prefix"], "/api");
+
+        let mut req = Request::builder()
+            .uri("/admin")
+            .body(Body::empty())
+            .unwrap();
+        rewrite_request_path(&mut req, "/", "/admin").unwrap();
+        assert_eq!(req.uri(), "/");
+    }
+
+    // ===================
+    // WARM CONNECTION TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_warm_connector_uses_pool_before_dialing() {
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let port = listener.local_addr().unwrap().port();
+        let pool = Arc::new(tenement::WarmPool::new());
+        pool.fill(port, 2).await;
+        let mut connector = WarmConnector::new(pool.clone());
+
+        let uri: axum::http::Uri = format!("http://127.0.0.1:{}/", port).parse().unwrap();
+        tower::Service::call(&mut connector, uri.clone()).await.unwrap();
+        assert_eq!(pool.idle(port), 1);
+        tower::Service::call(&mut connector, uri.clone()).await.unwrap();
+        assert_eq!(pool.idle(port), 0);
+
+        // Pool exhausted: falls back to a normal connect
+        tower::Service::call(&mut connector, uri).await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_proxy_reuses_warm_connection() {
+        // Backend that answers one request per connection and counts accepts
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let port = listener.local_addr().unwrap().port();
+        let pool = Arc::new(tenement::WarmPool::new());
+        pool.fill(port, 1).await;
+
+        let accepted = Arc::new(std::sync::atomic::AtomicUsize::new(0));
+        let counter = accepted.clone();
+        tokio::spawn(async move {
+            use tokio::io::{AsyncReadExt, AsyncWriteExt};
+            loop {
+                let (mut conn, _) = listener.accept().await.unwrap();
+                counter.fetch_add(1, std::sync::atomic::Ordering::SeqCst);
+                tokio::spawn(async move {
+                    let mut buf = [0u8; 1024];
+                    let _ = conn.read(&mut buf).await;
+                    let _ = conn
+                        .write_all(b"HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\nok")
+                        .await;
+                });
+            }
+        });
+
+        let client = Client::builder(TokioExecutor::new()).build(WarmConnector::new(pool.clone()));
+        let req = Request::builder().uri("/").body(Body::empty()).unwrap();
+        let response = proxy_to_tcp(&client, &format!("127.0.0.1:{}", port), req).await;
+        assert_eq!(response.status(), StatusCode::OK);
+
+        // The pre-opened connection was accepted during fill; no new dial happened
+        assert_eq!(pool.idle(port), 0);
+        assert_eq!(accepted.load(std::sync::atomic::Ordering::SeqCst), 1);
+    }
+
+    // ===================
+    // ADMIN TOKEN RELOAD TESTS
+    // ===================
+
+    /// Test state whose file-backed admin tokens come from `tokens_file`
+    async fn create_test_state_with_token_file(tokens_file: &Path) -> (AppState, String, TempDir) {
+        let (mut state, token, dir) = create_test_state().await;
+        state.admin_tokens = AdminTokens::load(Some(tokens_file.to_path_buf())).unwrap();
+        (state, token, dir)
+    }
+
+    async fn status_with(server: &TestServer, token: &str) -> StatusCode {
+        server
+            .get("/api/instances")
             .add_header("Authorization", format!("Bearer {}", token))
+            .await
+            .status_code()
+    }
+
+    #[tokio::test]
+    async fn test_reload_swaps_admin_tokens() {
+        let files = TempDir::new().unwrap();
+        let tokens_file = files.path().join("admin-tokens");
+        std::fs::write(&tokens_file, "old-token\n").unwrap();
+        let (state, db_token, _dir) = create_test_state_with_token_file(&tokens_file).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        assert_eq!(status_with(&server, "old-token").await, StatusCode::OK);
+        assert_eq!(status_with(&server, "new-token").await, StatusCode::UNAUTHORIZED);
+
+        std::fs::write(&tokens_file, "new-token\n").unwrap();
+        let response = server
+            .post("/api/auth/reload")
+            .add_header("Authorization", format!("Bearer {}", db_token))
             .await;
         response.assert_status_ok();
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["tokens"], 1);
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert_eq!(json.len(), 2);
+        assert_eq!(status_with(&server, "old-token").await, StatusCode::UNAUTHORIZED);
+        assert_eq!(status_with(&server, "new-token").await, StatusCode::OK);
+        // The database admin token is unaffected by the file
+        assert_eq!(status_with(&server, &db_token).await, StatusCode::OK);
     }
 
     #[tokio::test]
-    async fn test_logs_endpoint_filter_by_process() {
-        let (state, token, _dir) = create_test_state().await;
-        let log_buffer = state.hypervisor.log_buffer();
+    async fn test_token_used_for_reload_stops_working_after() {
+        let files = TempDir::new().unwrap();
+        let tokens_file = files.path().join("admin-tokens");
+        std::fs::write(&tokens_file, "rotating-token\n").unwrap();
+        let (state, _db_token, _dir) = create_test_state_with_token_file(&tokens_file).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        std::fs::write(&tokens_file, "# rotated out\n").unwrap();
+        server
+            .post("/api/auth/reload")
+            .add_header("Authorization", "Bearer rotating-token")
+            .await
+            .assert_status_ok();
+        assert_eq!(
+            status_with(&server, "rotating-token").await,
+            StatusCode::UNAUTHORIZED
+        );
+    }
 
-        // Add entries for different processes
-        log_buffer
-            .push_stdout("api", "prod", "api message".to_string())
-            .await;
-        log_buffer
-            .push_stdout("web", "prod", "web message".to_string())
+    #[tokio::test]
+    async fn test_failed_reload_keeps_current_tokens() {
+        let files = TempDir::new().unwrap();
+        let tokens_file = files.path().join("admin-tokens");
+        std::fs::write(&tokens_file, "kept-token\n").unwrap();
+        let (state, db_token, _dir) = create_test_state_with_token_file(&tokens_file).await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        std::fs::remove_file(&tokens_file).unwrap();
+        let response = server
+            .post("/api/auth/reload")
+            .add_header("Authorization", format!("Bearer {}", db_token))
             .await;
+        response.assert_status(StatusCode::BAD_REQUEST);
+        assert_eq!(status_with(&server, "kept-token").await, StatusCode::OK);
+    }
 
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    #[tokio::test]
+    async fn test_tenant_cannot_reload_admin_tokens() {
+        let (state, _admin_token, tenant_token, _dir) = create_test_state_with_tenant().await;
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        let response = server
+            .post("/api/auth/reload")
+            .add_header("Authorization", format!("Bearer {}", tenant_token))
+            .await;
+        response.assert_status(StatusCode::FORBIDDEN);
+    }
 
+    #[tokio::test]
+    async fn test_config_reload_endpoint() {
+        let dir = TempDir::new().unwrap();
+        let config_path = dir.path().join("tenement.toml");
+        std::fs::write(&config_path, "[service.api]\ncommand = \"./api\"\n").unwrap();
+        let config = Config::load_from_path(&config_path).unwrap();
+        let (state, token, _data) = create_test_state_with_config(config).await;
+        let hypervisor = state.hypervisor.clone();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        std::fs::write(&config_path, "[service.web]\ncommand = \"./web\"\n").unwrap();
         let response = server
-            .get("/api/logs?process=api")
+            .post("/api/reload")
             .add_header("Authorization", format!("Bearer {}", token))
             .await;
         response.assert_status_ok();
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["added"], serde_json::json!(["web"]));
+        assert_eq!(json["removed"], serde_json::json!(["api"]));
+        assert!(hypervisor.has_process("web"));
+        assert!(!hypervisor.has_process("api"));
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert_eq!(json.len(), 1);
-        assert_eq!(json[0]["process"], "api");
+        // A broken file is reported and the running config stays
+        std::fs::write(&config_path, "[service.web\n").unwrap();
+        let response = server
+            .post("/api/reload")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await;
+        response.assert_status(StatusCode::BAD_REQUEST);
+        assert!(hypervisor.has_process("web"));
     }
 
     #[tokio::test]
-    async fn test_logs_endpoint_filter_by_id() {
-        let (state, token, _dir) = create_test_state().await;
-        let log_buffer = state.hypervisor.log_buffer();
+    async fn test_reload_plan_endpoint() {
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        let (state, token, _data) = create_test_state_with_config(config).await;
+        let hypervisor = state.hypervisor.clone();
+        let server = TestServer::new(create_router(state)).unwrap();
 
-        // Add entries for different instances
-        log_buffer
-            .push_stdout("api", "prod", "prod message".to_string())
-            .await;
-        log_buffer
-            .push_stdout("api", "staging", "staging message".to_string())
+        let response = server
+            .post("/api/reload/plan")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({ "config": "[service.web]\ncommand = \"./web\"\n" }))
             .await;
-
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+        response.assert_status_ok();
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["added"], serde_json::json!(["web"]));
+        assert_eq!(json["removed"], serde_json::json!(["api"]));
+        assert!(hypervisor.has_process("api"), "a plan applies nothing");
+        assert!(!hypervisor.has_process("web"));
 
         let response = server
-            .get("/api/logs?id=prod")
+            .post("/api/reload/plan")
             .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({ "config": "[service.web\n" }))
             .await;
-        response.assert_status_ok();
+        response.assert_status(StatusCode::BAD_REQUEST);
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert_eq!(json.len(), 1);
-        assert_eq!(json[0]["instance_id"], "prod");
+        // Middleware this build doesn't have is refused, as at startup
+        let config = "[service.web]\ncommand = \"./web\"\nmiddleware = [\"missing\"]\n";
+        let response = server
+            .post("/api/reload/plan")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .json(&serde_json::json!({ "config": config }))
+            .await;
+        response.assert_status(StatusCode::BAD_REQUEST);
+        assert!(response.text().contains("Unknown middleware 'missing'"));
     }
 
     #[tokio::test]
-    async fn test_logs_endpoint_filter_by_level() {
-        let (state, token, _dir) = create_test_state().await;
-        let log_buffer = state.hypervisor.log_buffer();
+    async fn test_tenant_cannot_reload_config() {
+        let (state, _admin_token, tenant_token, _dir) = create_test_state_with_tenant().await;
+        let server = TestServer::new(create_router(state)).unwrap();
 
-        // Add stdout and stderr entries
-        log_buffer
-            .push_stdout("api", "prod", "stdout message".to_string())
-            .await;
-        log_buffer
-            .push_stderr("api", "prod", "stderr message".to_string())
+        let response = server
+            .post("/api/reload")
+            .add_header("Authorization", format!("Bearer {}", tenant_token))
             .await;
+        response.assert_status(StatusCode::FORBIDDEN);
+    }
 
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    #[tokio::test]
+    async fn test_log_stream_ends_on_credential_reload() {
+        use http_body_util::BodyExt;
 
-        let response = server
-            .get("/api/logs?level=stderr")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .await;
-        response.assert_status_ok();
+        let (state, _token, _dir) = create_test_state().await;
+        let admin_tokens = state.admin_tokens.clone();
+        let params = LogQueryParams {
+            process: None,
+            id: None,
+            level: None,
+            search: None,
+            limit: None,
+            since: None,
+        };
+        let admin = axum::Extension(AuthIdentity::admin("admin"));
+        let mut body = stream_logs(State(state), Query(params), admin)
+            .await
+            .into_response()
+            .into_body();
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert_eq!(json.len(), 1);
-        assert_eq!(json[0]["level"], "stderr");
+        admin_tokens.swap(Vec::new());
+
+        // The open stream finishes instead of outliving the credentials it was opened with
+        let drained = tokio::time::timeout(std::time::Duration::from_secs(2), async {
+            while let Some(frame) = body.frame().await {
+                frame.unwrap();
+            }
+        })
+        .await;
+        assert!(drained.is_ok(), "log stream should end after a reload");
+    }
+
+    /// Read SSE events from a log stream body until `count` entries arrive
+    async fn read_log_events(body: &mut Body, count: usize) -> Vec<serde_json::Value> {
+        use http_body_util::BodyExt;
+
+        let mut entries = Vec::new();
+        let mut pending = String::new();
+        tokio::time::timeout(std::time::Duration::from_secs(2), async {
+            while entries.len() < count {
+                let frame = body.frame().await.unwrap().unwrap();
+                let Ok(data) = frame.into_data() else { continue };
+                pending.push_str(&String::from_utf8_lossy(&data));
+                while let Some(end) = pending.find("\n\n") {
+                    let event: String = pending.drain(..end + 2).collect();
+                    if let Some(json) = event.trim().strip_prefix("data:") {
+                        entries.push(serde_json::from_str(json.trim()).unwrap());
+                    }
+                }
+            }
+        })
+        .await
+        .expect("log events should arrive");
+        entries
     }
 
     #[tokio::test]
-    async fn test_logs_endpoint_with_limit() {
-        let (state, token, _dir) = create_test_state().await;
+    async fn test_log_stream_replays_since_then_follows() {
+        let (state, _token, _dir) = create_test_state().await;
         let log_buffer = state.hypervisor.log_buffer();
-
-        // Add multiple entries
-        for i in 0..5 {
-            log_buffer
-                .push_stdout("api", "prod", format!("msg{}", i))
-                .await;
+        for (timestamp, message) in [(1_000, "old"), (2_000, "edge"), (3_000, "recent")] {
+            let mut entry = LogEntry::new("api", "prod", LogLevel::Stdout, message.to_string());
+            entry.timestamp = timestamp;
+            log_buffer.push(entry).await;
         }
+        let params = LogQueryParams {
+            process: Some("api".to_string()),
+            id: None,
+            level: None,
+            search: None,
+            limit: None,
+            since: Some(2_000),
+        };
+        let admin = axum::Extension(AuthIdentity::admin("admin"));
+        let mut body = stream_logs(State(state), Query(params), admin)
+            .await
+            .into_response()
+            .into_body();
 
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
-
-        let response = server
-            .get("/api/logs?limit=2")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .await;
-        response.assert_status_ok();
+        log_buffer.push_stdout("web", "prod", "other service".to_string()).await;
+        log_buffer.push_stdout("api", "prod", "live".to_string()).await;
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert_eq!(json.len(), 2);
+        let messages: Vec<String> = read_log_events(&mut body, 3)
+            .await
+            .iter()
+            .map(|e| e["message"].as_str().unwrap().to_string())
+            .collect();
+        assert_eq!(messages, ["edge", "recent", "live"]);
     }
 
     #[tokio::test]
-    async fn test_logs_endpoint_search() {
-        let (state, token, _dir) = create_test_state().await;
+    async fn test_log_stream_is_scoped_to_tenant() {
+        let (state, _token, _dir) = create_test_state().await;
         let log_buffer = state.hypervisor.log_buffer();
+        log_buffer.push_stdout("api", "other", "not yours".to_string()).await;
+        log_buffer.push_stdout("api", "acme", "backlog".to_string()).await;
+        let params = LogQueryParams {
+            process: None,
+            id: Some("other".to_string()),
+            level: None,
+            search: None,
+            limit: None,
+            since: Some(0),
+        };
+        let tenant = axum::Extension(AuthIdentity {
+            tenant_id: Some("acme".to_string()),
+            scope: Scope::Admin,
+            name: "tenant:acme".to_string(),
+        });
+        let mut body = stream_logs(State(state), Query(params), tenant)
+            .await
+            .into_response()
+            .into_body();
 
-        // Add entries with different content
-        log_buffer
-            .push_stdout("api", "prod", "hello world".to_string())
-            .await;
-        log_buffer
-            .push_stdout("api", "prod", "goodbye world".to_string())
-            .await;
-        log_buffer
-            .push_stdout("api", "prod", "hello there".to_string())
-            .await;
+        log_buffer.push_stdout("api", "other", "still not yours".to_string()).await;
+        log_buffer.push_stdout("api", "acme", "live".to_string()).await;
 
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+        let entries = read_log_events(&mut body, 2).await;
+        let messages: Vec<&str> = entries.iter().map(|e| e["message"].as_str().unwrap()).collect();
+        assert_eq!(messages, ["backlog", "live"]);
+    }
 
-        let response = server
-            .get("/api/logs?search=hello")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .await;
-        response.assert_status_ok();
+    // ===================
+    // DRAIN FILE TESTS
+    // ===================
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert_eq!(json.len(), 2);
+    const TEST_DRAIN_POLL: std::time::Duration = std::time::Duration::from_millis(10);
+
+    fn spawn_drain_watcher(
+        hypervisor: &Arc<Hypervisor>,
+        path: &Path,
+    ) -> tokio::task::JoinHandle<()> {
+        let hypervisor = hypervisor.clone();
+        let path = path.to_path_buf();
+        tokio::spawn(async move { wait_for_drain_file(&hypervisor, &path, TEST_DRAIN_POLL).await })
+    }
+
+    async fn wait_for_draining(hypervisor: &Hypervisor, draining: bool) {
+        tokio::time::timeout(std::time::Duration::from_secs(2), async {
+            while hypervisor.is_draining() != draining {
+                tokio::time::sleep(TEST_DRAIN_POLL).await;
+            }
+        })
+        .await
+        .expect("draining state should change");
     }
 
     #[tokio::test]
-    async fn test_metrics_endpoint() {
-        let (state, _token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_drain_file_starts_drain_after_connections_finish() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("drain");
+        let hypervisor = Hypervisor::new(Config::default());
+        let in_flight = hypervisor.connection_start("api", "prod").await;
+        let watcher = spawn_drain_watcher(&hypervisor, &path);
 
-        let response = server.get("/metrics").await;
-        response.assert_status_ok();
+        tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+        assert!(!hypervisor.is_draining());
 
-        let text = response.text();
-        // Should contain Prometheus format headers
-        assert!(text.contains("# HELP tenement_requests_total"));
-        assert!(text.contains("# TYPE tenement_requests_total counter"));
-        assert!(text.contains("# HELP tenement_instances_up"));
-        assert!(text.contains("# TYPE tenement_instances_up gauge"));
-        assert!(text.contains("tenement_instances_up 0"));
+        std::fs::write(&path, "").unwrap();
+        wait_for_draining(&hypervisor, true).await;
+        tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+        assert!(!watcher.is_finished(), "drain waits for the in-flight connection");
+
+        drop(in_flight);
+        tokio::time::timeout(std::time::Duration::from_secs(2), watcher)
+            .await
+            .expect("drain should complete once connections finish")
+            .unwrap();
     }
 
     #[tokio::test]
-    async fn test_api_requires_auth() {
-        let (state, _token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
-
-        // API endpoints should return 401 without token
-        let response = server.get("/api/instances").await;
-        response.assert_status_unauthorized();
+    async fn test_removing_drain_file_cancels_drain() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("drain");
+        let hypervisor = Hypervisor::new(Config::default());
+        let in_flight = hypervisor.connection_start("api", "prod").await;
+        let watcher = spawn_drain_watcher(&hypervisor, &path);
+
+        std::fs::write(&path, "").unwrap();
+        wait_for_draining(&hypervisor, true).await;
+        std::fs::remove_file(&path).unwrap();
+        wait_for_draining(&hypervisor, false).await;
+
+        // Cancelled: connections finishing now doesn't shut anything down
+        drop(in_flight);
+        tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+        assert!(!watcher.is_finished());
+
+        // A new drain file starts a fresh drain
+        std::fs::write(&path, "").unwrap();
+        tokio::time::timeout(std::time::Duration::from_secs(2), watcher)
+            .await
+            .expect("second drain should complete")
+            .unwrap();
+        assert!(hypervisor.is_draining());
+    }
 
-        let response = server.get("/api/logs").await;
-        response.assert_status_unauthorized();
+    #[tokio::test]
+    async fn test_drain_file_present_at_startup_is_ignored() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("drain");
+        std::fs::write(&path, "").unwrap();
+        let hypervisor = Hypervisor::new(Config::default());
+        let watcher = spawn_drain_watcher(&hypervisor, &path);
+
+        tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+        assert!(!hypervisor.is_draining());
+        assert!(!watcher.is_finished());
+
+        std::fs::remove_file(&path).unwrap();
+        tokio::time::sleep(std::time::Duration::from_millis(50)).await;
+        std::fs::write(&path, "").unwrap();
+        tokio::time::timeout(std::time::Duration::from_secs(2), watcher)
+            .await
+            .expect("recreated drain file should drain")
+            .unwrap();
     }
 
     #[tokio::test]
-    async fn test_api_invalid_token() {
+    async fn test_draining_rejects_proxied_requests_and_fails_health() {
         let (state, _token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
-
-        // Invalid token should return 401
-        let response = server
-            .get("/api/instances")
-            .add_header("Authorization", "Bearer invalid_token")
+        let hypervisor = state.hypervisor.clone();
+        let server = TestServer::new(create_router(state)).unwrap();
+
+        hypervisor.set_draining(true);
+        let health = server.get("/health").await;
+        health.assert_status(StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(health.json::<serde_json::Value>()["status"], "draining");
+        let proxied = server
+            .get("/")
+            .add_header("Host", "api.example.com")
             .await;
-        response.assert_status_unauthorized();
+        proxied.assert_status(StatusCode::SERVICE_UNAVAILABLE);
+        assert_eq!(proxied.text(), "Draining");
+
+        hypervisor.set_draining(false);
+        server.get("/health").await.assert_status_ok();
     }
 
     // ===================
-    // MUTATION API TESTS (Phase My Way)
+    // HTTP/1.0 PROXY TESTS
     // ===================
 
-    #[tokio::test]
-    async fn test_spawn_requires_auth() {
-        let (state, _token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    /// Backend that reports each raw request head and answers with a chunked,
+    /// keep-alive HTTP/1.1 response
+    async fn spawn_chunked_backend() -> (u16, tokio::sync::mpsc::UnboundedReceiver<String>) {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let port = listener.local_addr().unwrap().port();
+        let (tx, rx) = tokio::sync::mpsc::unbounded_channel();
+        tokio::spawn(async move {
+            loop {
+                let (mut conn, _) = listener.accept().await.unwrap();
+                let tx = tx.clone();
+                tokio::spawn(async move {
+                    let mut buf = vec![0u8; 4096];
+                    let n = conn.read(&mut buf).await.unwrap_or(0);
+                    tx.send(String::from_utf8_lossy(&buf[..n]).to_lowercase()).ok();
+                    let response = "HTTP/1.1 200 OK\r\n\
+                        Transfer-Encoding: chunked\r\n\
+                        Connection: keep-alive\r\n\
+                        Keep-Alive: timeout=5\r\n\
+                        X-App: yes\r\n\r\n\
+                        5\r\nhello\r\n6\r\n world\r\n0\r\n\r\n";
+                    conn.write_all(response.as_bytes()).await.ok();
+                });
+            }
+        });
+        (port, rx)
+    }
 
-        let response = server
-            .post("/api/instances/spawn")
-            .json(&serde_json::json!({"process": "api", "id": "prod"}))
-            .await;
-        response.assert_status_unauthorized();
+    /// Serve a router that proxies every request to the backend on `port`
+    async fn spawn_proxy_front(port: u16) -> SocketAddr {
+        let pool = Arc::new(tenement::WarmPool::new());
+        let client = Client::builder(TokioExecutor::new()).build(WarmConnector::new(pool));
+        let upstream = format!("127.0.0.1:{}", port);
+        let app = Router::new().fallback(move |req: Request<Body>| {
+            let client = client.clone();
+            let upstream = upstream.clone();
+            async move { proxy_to_tcp(&client, &upstream, req).await }
+        });
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(listener, app).await.unwrap();
+        });
+        addr
+    }
+
+    /// Send a raw request and read until the server closes the connection
+    async fn send_raw_to_close(addr: SocketAddr, raw: &str) -> String {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+        let mut stream = tokio::net::TcpStream::connect(addr).await.unwrap();
+        stream.write_all(raw.as_bytes()).await.unwrap();
+        let mut response = Vec::new();
+        tokio::time::timeout(
+            std::time::Duration::from_secs(5),
+            stream.read_to_end(&mut response),
+        )
+        .await
+        .expect("server should close the connection")
+        .unwrap();
+        String::from_utf8_lossy(&response).to_string()
     }
 
     #[tokio::test]
-    async fn test_spawn_unknown_process() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_http10_client_gets_unchunked_response_and_close() {
+        let (port, _requests) = spawn_chunked_backend().await;
+        let front = spawn_proxy_front(port).await;
+
+        let response = send_raw_to_close(front, "GET /x HTTP/1.0\r\nHost: localhost\r\n\r\n").await;
+        let (head, body) = response.split_once("\r\n\r\n").unwrap();
+        let head = head.to_lowercase();
+
+        assert!(head.starts_with("http/1.0 200"), "got {:?}", head);
+        assert!(!head.contains("transfer-encoding"), "no chunking for 1.0: {:?}", head);
+        assert!(!head.contains("keep-alive"), "backend keep-alive must not leak: {:?}", head);
+        assert!(head.contains("x-app: yes"));
+        assert_eq!(body, "hello world");
+    }
 
-        let response = server
-            .post("/api/instances/spawn")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .json(&serde_json::json!({"process": "nonexistent", "id": "prod"}))
-            .await;
+    #[tokio::test]
+    async fn test_http11_client_still_gets_streamed_response() {
+        let (port, _requests) = spawn_chunked_backend().await;
+        let front = spawn_proxy_front(port).await;
 
-        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
-        let json: serde_json::Value = response.json();
-        assert!(json["error"].as_str().unwrap().contains("Unknown process"));
+        let response = send_raw_to_close(
+            front,
+            "GET /x HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+        )
+        .await;
+        let (head, body) = response.split_once("\r\n\r\n").unwrap();
+        let head = head.to_lowercase();
+
+        assert!(head.starts_with("http/1.1 200"), "got {:?}", head);
+        assert!(!head.contains("keep-alive"));
+        // Re-framed by tenement for the client, not passed through from the backend
+        assert!(body.contains("hello") && body.contains(" world"));
     }
 
     #[tokio::test]
-    async fn test_stop_not_found() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_client_connection_headers_not_forwarded() {
+        let (port, mut requests) = spawn_chunked_backend().await;
+        let front = spawn_proxy_front(port).await;
+
+        send_raw_to_close(
+            front,
+            "GET /x HTTP/1.0\r\nHost: localhost\r\nConnection: close, x-hop\r\n\
+             X-Hop: secret\r\nKeep-Alive: timeout=1\r\nX-End: kept\r\n\r\n",
+        )
+        .await;
+        let upstream = requests.recv().await.unwrap();
+
+        // Upstream is a pooled HTTP/1.1 connection regardless of the client's version
+        assert!(upstream.starts_with("get /x http/1.1"), "got {:?}", upstream);
+        assert!(!upstream.contains("connection: close"));
+        assert!(!upstream.contains("keep-alive"));
+        assert!(!upstream.contains("x-hop"));
+        assert!(upstream.contains("x-end: kept"));
+    }
 
-        let response = server
-            .delete("/api/instances/api:prod")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .await;
+    #[test]
+    fn test_hop_by_hop_headers_include_connection_tokens() {
+        let mut headers = axum::http::HeaderMap::new();
+        headers.insert("connection", "Keep-Alive, X-Custom".parse().unwrap());
+        headers.insert("x-custom", "1".parse().unwrap());
+        headers.insert("transfer-encoding", "chunked".parse().unwrap());
+        headers.insert("content-type", "text/plain".parse().unwrap());
+
+        strip_hop_by_hop(&mut headers);
+        assert_eq!(headers.len(), 1);
+        assert_eq!(headers["content-type"], "text/plain");
+    }
 
-        response.assert_status(StatusCode::NOT_FOUND);
+    // ===================
+    // WEBSOCKET AND SSE PROXY TESTS
+    // ===================
+
+    /// Read a response or request head, up to and including the blank line
+    async fn read_head<S: tokio::io::AsyncRead + Unpin>(stream: &mut S) -> String {
+        use tokio::io::AsyncReadExt;
+        let mut head = Vec::new();
+        while !head.ends_with(b"\r\n\r\n") {
+            let mut byte = [0u8; 1];
+            if stream.read(&mut byte).await.unwrap() == 0 {
+                break;
+            }
+            head.push(byte[0]);
+        }
+        String::from_utf8_lossy(&head).to_lowercase()
+    }
+
+    /// Unix socket backend that switches protocols on any request, reports the
+    /// request head, then echoes whatever it's sent
+    fn spawn_echo_upgrade_backend(path: &Path) -> tokio::sync::mpsc::UnboundedReceiver<String> {
+        use tokio::io::AsyncWriteExt;
+
+        let listener = tokio::net::UnixListener::bind(path).unwrap();
+        let (tx, rx) = tokio::sync::mpsc::unbounded_channel();
+        tokio::spawn(async move {
+            loop {
+                let (mut conn, _) = listener.accept().await.unwrap();
+                let tx = tx.clone();
+                tokio::spawn(async move {
+                    tx.send(read_head(&mut conn).await).ok();
+                    let handshake = "HTTP/1.1 101 Switching Protocols\r\n\
+                        Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n";
+                    conn.write_all(handshake.as_bytes()).await.unwrap();
+                    let (mut reader, mut writer) = conn.split();
+                    tokio::io::copy(&mut reader, &mut writer).await.ok();
+                });
+            }
+        });
+        rx
+    }
+
+    /// Serve a router that proxies every request to the socket at `path`,
+    /// splicing upgrades the way `proxy_to_instance` does
+    async fn spawn_upgrade_front(path: PathBuf, idle: Option<std::time::Duration>) -> SocketAddr {
+        let unix_client = UpstreamClient::new(&Default::default(), false);
+        let app = Router::new().fallback(move |mut req: Request<Body>| {
+            let unix_client = unix_client.clone();
+            let path = path.clone();
+            async move {
+                let upgrade =
+                    requested_upgrade(req.headers()).map(|_| hyper::upgrade::on(&mut req));
+                let response = proxy_to_unix_socket(&unix_client, &path, req).await;
+                match upgrade {
+                    Some(client) if response.status() == StatusCode::SWITCHING_PROTOCOLS => {
+                        splice_upgrade(client, response, idle, ())
+                    }
+                    _ => stream_response(response, (), idle),
+                }
+            }
+        });
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move {
+            axum::serve(listener, app).await.unwrap();
+        });
+        addr
     }
 
+    const WEBSOCKET_HANDSHAKE: &str = "GET /chat HTTP/1.1\r\nHost: localhost\r\n\
+        Connection: keep-alive, Upgrade\r\nUpgrade: websocket\r\n\
+        Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n";
+
     #[tokio::test]
-    async fn test_stop_invalid_id_format() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_websocket_upgrade_tunnels_to_unix_socket() {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
 
-        // Instance ID without colon: parse_instance_id returns BAD_REQUEST
-        let response = server
-            .delete("/api/instances/invalid-no-colon")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .await;
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("app.sock");
+        let mut requests = spawn_echo_upgrade_backend(&socket);
+        let front = spawn_upgrade_front(socket, None).await;
 
-        let status = response.status_code();
-        // Either BAD_REQUEST (handler reached) or NOT_FOUND (fallback)
+        let mut stream = tokio::net::TcpStream::connect(front).await.unwrap();
+        stream
+            .write_all(WEBSOCKET_HANDSHAKE.as_bytes())
+            .await
+            .unwrap();
+        let head = read_head(&mut stream).await;
+        assert!(head.starts_with("http/1.1 101"), "got {:?}", head);
+        assert!(head.contains("upgrade: websocket"), "got {:?}", head);
+        assert!(head.contains("connection: upgrade"), "got {:?}", head);
+
+        // The handshake reaches the app, though Connection/Upgrade are hop-by-hop
+        let upstream = requests.recv().await.unwrap();
         assert!(
-            status == StatusCode::BAD_REQUEST || status == StatusCode::NOT_FOUND,
-            "Expected 400 or 404, got {}",
-            status
+            upstream.contains("connection: upgrade"),
+            "got {:?}",
+            upstream
         );
+        assert!(
+            upstream.contains("upgrade: websocket"),
+            "got {:?}",
+            upstream
+        );
+        assert!(upstream.contains("sec-websocket-key: dghlihnhbxbszsbub25jzq=="));
+
+        // Frames flow both ways, well past the point a request would have finished
+        for message in ["ping", "pong"] {
+            stream.write_all(message.as_bytes()).await.unwrap();
+            let mut echoed = [0u8; 4];
+            tokio::time::timeout(
+                std::time::Duration::from_secs(2),
+                stream.read_exact(&mut echoed),
+            )
+            .await
+            .unwrap()
+            .unwrap();
+            assert_eq!(&echoed, message.as_bytes());
+        }
     }
 
     #[tokio::test]
-    async fn test_weight_not_found() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_idle_upgraded_connection_is_closed() {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
 
-        let response = server
-            .put("/api/instances/api:prod/weight")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .json(&serde_json::json!({"weight": 50}))
-            .await;
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("app.sock");
+        let _requests = spawn_echo_upgrade_backend(&socket);
+        let idle = std::time::Duration::from_millis(200);
+        let front = spawn_upgrade_front(socket, Some(idle)).await;
+
+        let mut stream = tokio::net::TcpStream::connect(front).await.unwrap();
+        stream
+            .write_all(WEBSOCKET_HANDSHAKE.as_bytes())
+            .await
+            .unwrap();
+        assert!(read_head(&mut stream).await.starts_with("http/1.1 101"));
 
-        response.assert_status(StatusCode::NOT_FOUND);
+        let mut rest = Vec::new();
+        tokio::time::timeout(
+            std::time::Duration::from_secs(3),
+            stream.read_to_end(&mut rest),
+        )
+        .await
+        .expect("an idle tunnel should be closed")
+        .unwrap();
+        assert!(rest.is_empty());
     }
 
     #[tokio::test]
-    async fn test_health_check_unknown_instance() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
-
-        let response = server
-            .get("/api/instances/api:prod/health")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .await;
+    async fn test_event_stream_holds_guard_until_done() {
+        use http_body_util::BodyExt;
+
+        let events = futures::stream::iter([Ok::<_, Infallible>("data: 1\n\n")])
+            .chain(futures::stream::pending());
+        let response = Response::builder()
+            .header("content-type", "text/event-stream")
+            .body(Body::from_stream(events))
+            .unwrap();
+        let guard = Arc::new(());
+        let idle = std::time::Duration::from_millis(100);
+        let response = stream_response(response, guard.clone(), Some(idle));
+        assert_eq!(
+            Arc::strong_count(&guard),
+            2,
+            "held while the stream is open"
+        );
 
-        response.assert_status_ok();
-        let json: serde_json::Value = response.json();
-        assert_eq!(json["health"], "unknown");
+        // The stream never ends on its own; going quiet for `idle` ends it
+        let body = tokio::time::timeout(
+            std::time::Duration::from_secs(2),
+            response.into_body().collect(),
+        )
+        .await
+        .expect("an idle event stream should end")
+        .unwrap()
+        .to_bytes();
+        assert_eq!(body, "data: 1\n\n");
+        assert_eq!(
+            Arc::strong_count(&guard),
+            1,
+            "released once the stream is done"
+        );
     }
 
     #[tokio::test]
-    async fn test_deploy_unknown_process() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_event_stream_without_idle_timeout_stays_open() {
+        let events = futures::stream::iter([Ok::<_, Infallible>("data: 1\n\n")])
+            .chain(futures::stream::pending());
+        let response = Response::builder()
+            .header("content-type", "text/event-stream")
+            .body(Body::from_stream(events))
+            .unwrap();
+        let mut body = stream_response(response, (), None)
+            .into_body()
+            .into_data_stream();
+        assert_eq!(body.next().await.unwrap().unwrap(), "data: 1\n\n");
+        let next = tokio::time::timeout(std::time::Duration::from_millis(300), body.next()).await;
+        assert!(next.is_err(), "a quiet stream must not be cut off");
+    }
 
-        let response = server
-            .post("/api/deploy")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .json(&serde_json::json!({
-                "process": "nonexistent",
-                "version": "v1",
-                "weight": 100,
-                "timeout": 2
-            }))
-            .await;
+    // ===================
+    // HTTP/2 AND GRPC PROXY TESTS
+    // ===================
 
-        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+    /// A reply in gRPC's shape: one data frame, then `grpc-status` in trailers
+    fn grpc_body(reply: String, status: &str) -> Body {
+        use hyper::body::Frame;
+
+        let mut trailers = axum::http::HeaderMap::new();
+        trailers.insert("grpc-status", status.parse().unwrap());
+        let frames = futures::stream::iter([
+            Ok::<_, Infallible>(Frame::data(axum::body::Bytes::from(reply))),
+            Ok(Frame::trailers(trailers)),
+        ]);
+        Body::new(http_body_util::StreamBody::new(frames))
     }
 
-    #[tokio::test]
-    async fn test_route_not_found() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    /// Unix socket backend that speaks only HTTP/2, answering every call with
+    /// its path and `te` header and a `grpc-status: 0` trailer
+    fn spawn_h2_backend(path: &Path) {
+        let listener = tokio::net::UnixListener::bind(path).unwrap();
+        tokio::spawn(async move {
+            loop {
+                let (conn, _) = listener.accept().await.unwrap();
+                let service =
+                    hyper::service::service_fn(|req: Request<hyper::body::Incoming>| async move {
+                        let te = req
+                            .headers()
+                            .get("te")
+                            .map(|te| te.to_str().unwrap().to_string());
+                        let reply = format!("{} te={}", req.uri().path(), te.unwrap_or_default());
+                        Ok::<_, Infallible>(Response::new(grpc_body(reply, "0")))
+                    });
+                tokio::spawn(
+                    hyper::server::conn::http2::Builder::new(TokioExecutor::new())
+                        .serve_connection(hyper_util::rt::TokioIo::new(conn), service),
+                );
+            }
+        });
+    }
 
-        let response = server
-            .post("/api/route")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .json(&serde_json::json!({
-                "process": "api",
-                "from": "v1",
-                "to": "v2"
-            }))
-            .await;
+    #[tokio::test]
+    async fn test_h2c_backend_trailers_pass_through() {
+        use http_body_util::BodyExt;
 
-        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("app.sock");
+        spawn_h2_backend(&socket);
+
+        let h2_unix_client = UpstreamClient::new(&Default::default(), true);
+        let req = Request::builder()
+            .method("POST")
+            .uri("/users.Users/Get")
+            .header("content-type", "application/grpc")
+            .header("te", "trailers")
+            .body(Body::from("call"))
+            .unwrap();
+        let response = proxy_to_unix_socket(&h2_unix_client, &socket, req).await;
+        assert_eq!(response.status(), StatusCode::OK);
+
+        let collected = response.into_body().collect().await.unwrap();
+        let trailers = collected
+            .trailers()
+            .cloned()
+            .expect("trailers are forwarded");
+        assert_eq!(trailers.get("grpc-status").unwrap(), "0");
+        // gRPC servers need `te: trailers`, though TE is otherwise hop-by-hop
+        assert_eq!(collected.to_bytes(), "/users.Users/Get te=trailers");
     }
 
     #[tokio::test]
-    async fn test_restart_not_found() {
-        let (state, token, _dir) = create_test_state().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_grpc_calls_are_metered_by_method_and_status() {
+        use http_body_util::BodyExt;
 
-        let response = server
-            .post("/api/instances/api:prod/restart")
-            .add_header("Authorization", format!("Bearer {}", token))
-            .await;
+        let metrics = tenement::Metrics::new();
+        let start = std::time::Instant::now();
 
-        // Restart on non-existent instance should fail (stop fails, then spawn fails for unknown process)
-        response.assert_status(StatusCode::INTERNAL_SERVER_ERROR);
+        let response = Response::new(grpc_body("reply".to_string(), "5"));
+        let response =
+            observe_grpc_call(metrics.clone(), "api", "/users.Users/Get", start, response);
+        response.into_body().collect().await.unwrap();
+
+        // Trailers-only: the status comes in the headers and there's no body
+        let response = Response::builder()
+            .header("grpc-status", "12")
+            .body(Body::empty())
+            .unwrap();
+        let response =
+            observe_grpc_call(metrics.clone(), "api", "/users.Users/Gone", start, response);
+        response.into_body().collect().await.unwrap();
+
+        let expected = [
+            "tenement_grpc_requests_total{code=\"5\",method=\"Get\",process=\"api\",\
+             service=\"users.Users\"} 1",
+            "tenement_grpc_requests_total{code=\"12\",method=\"Gone\",process=\"api\",\
+             service=\"users.Users\"} 1",
+            "tenement_grpc_request_duration_ms_count{method=\"Get\",process=\"api\",\
+             service=\"users.Users\"} 1",
+        ];
+        // Calls are recorded in the background once their streams end
+        let mut output = String::new();
+        for _ in 0..100 {
+            output = metrics.format_prometheus().await;
+            if expected.iter().all(|line| output.contains(line)) {
+                return;
+            }
+            tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+        }
+        panic!("gRPC calls not recorded: {}", output);
+    }
+
+    #[test]
+    fn test_grpc_method_from_path() {
+        assert_eq!(grpc_method("/users.Users/Get"), ("users.Users", "Get"));
+        assert_eq!(grpc_method("/health"), ("unknown", "unknown"));
+        assert_eq!(grpc_method("/a/b/c"), ("unknown", "unknown"));
+        assert_eq!(grpc_method("//Get"), ("unknown", "unknown"));
     }
 
     // ===================
-    // TENANT TOKEN TESTS
+    // STREAMING UPLOAD TESTS
     // ===================
 
-    /// Create test state with both admin and tenant tokens
-    async fn create_test_state_with_tenant() -> (AppState, String, String, TempDir) {
-        let dir = TempDir::new().unwrap();
-        let db_path = dir.path().join("test.db");
-        let pool = init_db(&db_path).await.unwrap();
-        let config_store = Arc::new(ConfigStore::new(pool.clone()));
-        let deploy_log = Arc::new(tenement::DeployLogStore::new(pool.clone()));
-        let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool.clone()));
+    /// Resident set size of this test process in bytes
+    #[cfg(target_os = "linux")]
+    fn rss_bytes() -> u64 {
+        let statm = std::fs::read_to_string("/proc/self/statm").unwrap();
+        let pages: u64 = statm.split_whitespace().nth(1).unwrap().parse().unwrap();
+        pages * unsafe { libc::sysconf(libc::_SC_PAGESIZE) } as u64
+    }
 
-        // Generate admin token
-        let token_store = TokenStore::new(&config_store);
-        let admin_token = token_store.generate_and_store().await.unwrap();
+    /// Unix socket backend that discards the request body and replies with its length
+    fn spawn_counting_socket_backend(path: &Path) {
+        use http_body_util::BodyExt;
+
+        let listener = tokio::net::UnixListener::bind(path).unwrap();
+        tokio::spawn(async move {
+            loop {
+                let (stream, _) = listener.accept().await.unwrap();
+                tokio::spawn(async move {
+                    let service = hyper::service::service_fn(
+                        |req: Request<hyper::body::Incoming>| async move {
+                            let mut body = req.into_body();
+                            let mut total = 0u64;
+                            while let Some(frame) = body.frame().await {
+                                if let Ok(data) = frame?.into_data() {
+                                    total += data.len() as u64;
+                                }
+                            }
+                            Ok::<_, hyper::Error>(Response::new(Body::from(total.to_string())))
+                        },
+                    );
+                    hyper::server::conn::http1::Builder::new()
+                        .serve_connection(hyper_util::rt::TokioIo::new(stream), service)
+                        .await
+                        .ok();
+                });
+            }
+        });
+    }
 
-        // Generate tenant token for "alice"
-        let tenant_token = tenant_tokens
-            .generate_and_store("alice", Some("test"))
-            .await
-            .unwrap();
+    #[cfg(target_os = "linux")]
+    #[tokio::test(flavor = "multi_thread", worker_threads = 4)]
+    async fn test_large_upload_to_socket_backend_streams_with_bounded_memory() {
+        use std::sync::atomic::{AtomicBool, AtomicU64, Ordering};
 
-        let config = Config::default();
-        let hypervisor = Hypervisor::new(config);
-        let client = Client::builder(TokioExecutor::new()).build_http();
-        let unix_client = Client::builder(TokioExecutor::new()).build(UnixConnector);
-        let state = AppState {
-            hypervisor,
-            domain: "example.com".to_string(),
-            client,
-            unix_client,
-            config_store,
-            deploy_log,
-            tenant_tokens,
-            tls_status: TlsStatus::default(),
-            auth_failures: Arc::new(tokio::sync::RwLock::new((0, None))),
+        const CHUNK: usize = 1024 * 1024;
+        const CHUNKS: usize = 512;
+        static ZEROS: [u8; CHUNK] = [0; CHUNK];
+
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("upload.sock");
+        spawn_counting_socket_backend(&socket);
+        let client = UpstreamClient::new(&Default::default(), false);
+
+        // Sample RSS in the background while the upload runs
+        let baseline = rss_bytes();
+        let peak = Arc::new(AtomicU64::new(baseline));
+        let done = Arc::new(AtomicBool::new(false));
+        let sampler = {
+            let (peak, done) = (peak.clone(), done.clone());
+            tokio::spawn(async move {
+                while !done.load(Ordering::Relaxed) {
+                    peak.fetch_max(rss_bytes(), Ordering::Relaxed);
+                    tokio::time::sleep(std::time::Duration::from_millis(5)).await;
+                }
+            })
         };
-        (state, admin_token, tenant_token, dir)
+
+        // 512 MiB body produced chunk by chunk from one static buffer
+        let chunks = futures::stream::iter(
+            (0..CHUNKS).map(|_| Ok::<_, std::io::Error>(axum::body::Bytes::from_static(&ZEROS))),
+        );
+        let req = Request::builder()
+            .method("POST")
+            .uri("/upload")
+            .header("host", "localhost")
+            .body(Body::from_stream(chunks))
+            .unwrap();
+        let started = std::time::Instant::now();
+        let response = proxy_to_unix_socket(&client, &socket, req).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        let body = axum::body::to_bytes(response.into_body(), 1024).await.unwrap();
+
+        done.store(true, Ordering::Relaxed);
+        sampler.await.unwrap();
+
+        assert_eq!(body, (CHUNK * CHUNKS).to_string());
+        let growth = peak.load(Ordering::Relaxed).saturating_sub(baseline);
+        eprintln!(
+            "streamed {} MiB in {:?}, peak RSS growth {} MiB",
+            CHUNK * CHUNKS / (1024 * 1024),
+            started.elapsed(),
+            growth / (1024 * 1024)
+        );
+        // Buffering the body would need at least its full 512 MiB
+        assert!(growth < 64 * 1024 * 1024, "RSS grew by {} bytes", growth);
     }
 
+    // ===================
+    // ADMIN SOCKET TESTS
+    // ===================
+
     #[tokio::test]
-    async fn test_tenant_token_can_list_instances() {
-        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_admin_router_needs_no_token() {
+        let (state, _token, _dir) = create_test_state().await;
+        let server = TestServer::new(admin_router(state)).unwrap();
 
-        // Tenant token should be able to list (will see only their instances)
-        let response = server
-            .get("/api/instances")
-            .add_header("Authorization", format!("Bearer {}", tenant))
-            .await;
-        response.assert_status_ok();
+        server.get("/api/instances").await.assert_status_ok();
+        server.get("/health").await.assert_status_ok();
+        server
+            .get("/api/instances/api:prod")
+            .await
+            .assert_status(StatusCode::NOT_FOUND);
     }
 
     #[tokio::test]
-    async fn test_tenant_token_cannot_deploy() {
-        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_admin_router_skips_public_routes() {
+        let (state, _token, _dir) = create_test_state().await;
+        let server = TestServer::new(admin_router(state)).unwrap();
 
-        // Tenant token should be rejected for deploy
-        let response = server
-            .post("/api/deploy")
-            .add_header("Authorization", format!("Bearer {}", tenant))
-            .json(&serde_json::json!({
-                "process": "api",
-                "version": "v1",
-                "weight": 100,
-                "timeout": 2
-            }))
-            .await;
-        response.assert_status(StatusCode::FORBIDDEN);
+        server.get("/").await.assert_status(StatusCode::NOT_FOUND);
+        server.get("/metrics").await.assert_status(StatusCode::NOT_FOUND);
     }
 
     #[tokio::test]
-    async fn test_tenant_token_cannot_route() {
-        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_inspect_instance_requires_auth() {
+        let (state, token, _dir) = create_test_state().await;
+        let server = TestServer::new(create_router(state)).unwrap();
 
-        // Tenant token should be rejected for route swap
-        let response = server
-            .post("/api/route")
-            .add_header("Authorization", format!("Bearer {}", tenant))
-            .json(&serde_json::json!({
-                "process": "api",
-                "from": "v1",
-                "to": "v2"
-            }))
-            .await;
-        response.assert_status(StatusCode::FORBIDDEN);
+        server
+            .get("/api/instances/api:prod")
+            .await
+            .assert_status_unauthorized();
+        server
+            .get("/api/instances/api:prod")
+            .add_header("Authorization", format!("Bearer {}", token))
+            .await
+            .assert_status(StatusCode::NOT_FOUND);
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_tenant_token_scoped_to_own_instances() {
-        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_cli_client_over_admin_socket() {
+        use std::os::unix::fs::PermissionsExt;
 
-        // Tenant "alice" should be rejected when trying to stop "bob"
-        let response = server
-            .delete("/api/instances/api:bob")
-            .add_header("Authorization", format!("Bearer {}", tenant))
-            .await;
-        response.assert_status(StatusCode::FORBIDDEN);
-    }
+        let (state, _token, dir) = create_test_state().await;
+        let socket = dir.path().join("run").join("admin.sock");
+        spawn_admin_socket(state.clone(), &socket, None)
+            .await
+            .unwrap();
 
-    #[tokio::test]
-    async fn test_admin_token_has_full_access() {
-        let (state, admin, _tenant, _dir) = create_test_state_with_tenant().await;
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+        let mode = std::fs::metadata(&socket).unwrap().permissions().mode();
+        assert_eq!(mode & 0o777, 0o600);
 
-        // Admin can access any instance
-        let response = server
-            .get("/api/instances")
-            .add_header("Authorization", format!("Bearer {}", admin))
-            .await;
-        response.assert_status_ok();
+        let client = crate::client::ApiClient::unix(&socket);
+        assert_eq!(client.endpoint(), format!("unix:{}", socket.display()));
+        assert!(client.list().await.unwrap().is_empty());
+        let err = client.inspect("api:prod").await.unwrap_err();
+        assert!(err.to_string().contains("Instance not found"), "{}", err);
 
-        // Admin can deploy
-        let response = server
-            .post("/api/deploy")
-            .add_header("Authorization", format!("Bearer {}", admin))
-            .json(&serde_json::json!({
-                "process": "nonexistent",
-                "version": "v1",
-                "weight": 100,
-                "timeout": 1
-            }))
-            .await;
-        // Will fail because process doesn't exist, but NOT because of auth
-        assert_ne!(response.status_code(), StatusCode::FORBIDDEN);
-        assert_ne!(response.status_code(), StatusCode::UNAUTHORIZED);
+        // A second server can't take over a live socket
+        let err = spawn_admin_socket(state, &socket, None).await.unwrap_err();
+        assert!(err.to_string().contains("already serving"), "{}", err);
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_tenant_token_scoped_logs() {
-        let (state, _admin, tenant, _dir) = create_test_state_with_tenant().await;
-        let log_buffer = state.hypervisor.log_buffer();
-
-        // Add logs for different instances
-        log_buffer
-            .push_stdout("api", "alice", "alice's log".to_string())
-            .await;
-        log_buffer
-            .push_stdout("api", "bob", "bob's log".to_string())
-            .await;
-
-        let app = create_router(state);
-        let server = TestServer::new(app).unwrap();
+    async fn test_admin_socket_replaces_stale_socket() {
+        let (state, _token, dir) = create_test_state().await;
+        let socket = dir.path().join("admin.sock");
+        drop(std::os::unix::net::UnixListener::bind(&socket).unwrap());
+
+        spawn_admin_socket(state, &socket, None).await.unwrap();
+        let client = crate::client::ApiClient::unix(&socket);
+        assert!(client.list().await.unwrap().is_empty());
+    }
 
-        // Tenant "alice" should only see alice's logs
-        let response = server
-            .get("/api/logs")
-            .add_header("Authorization", format!("Bearer {}", tenant))
-            .await;
-        response.assert_status_ok();
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_admin_socket_served_from_handed_over_listener() {
+        let (state, _token, dir) = create_test_state().await;
+        let socket = dir.path().join("admin.sock");
+        // Still live, as the old supervisor's is during an upgrade
+        let inherited = std::os::unix::net::UnixListener::bind(&socket).unwrap();
 
-        let json: Vec<serde_json::Value> = response.json();
-        assert_eq!(json.len(), 1, "Tenant should only see their own logs");
-        assert_eq!(json[0]["instance_id"], "alice");
+        spawn_admin_socket(state, &socket, Some(inherited))
+            .await
+            .unwrap();
+        let client = crate::client::ApiClient::unix(&socket);
+        assert!(client.list().await.unwrap().is_empty());
     }
 }
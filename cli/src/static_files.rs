@@ -0,0 +1,323 @@
+//! Files served by tenement itself: `type = "static"` services and static routes
+//!
+//! A static service maps request paths onto its `root`. A file with a
+//! precompressed sibling (`app.js.br`, `app.js.gz`) is sent in that encoding
+//! when the client accepts it. Every file carries an ETag and Last-Modified
+//! so browsers can revalidate with a 304, and a Cache-Control of
+//! `cache_max_age` seconds, except HTML, which is always revalidated so a new
+//! build shows up at once. With `spa`, paths that match no file get the
+//! root's index.html, for apps that route in the browser.
+
+use axum::body::Body;
+use axum::http::{header, HeaderMap, HeaderValue, Method, StatusCode};
+use axum::response::{IntoResponse, Response};
+use std::path::{Path, PathBuf};
+use tenement::config::{ProcessConfig, ServiceKind};
+
+/// Precompressed variants, in order of preference: (coding, file extension)
+const PRECOMPRESSED: [(&str, &str); 2] = [("br", "br"), ("gzip", "gz")];
+
+/// How a static service is served
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct StaticSite {
+    pub root: PathBuf,
+    pub spa: bool,
+    pub cache_max_age: u64,
+}
+
+impl StaticSite {
+    /// The site a `type = "static"` service serves (None for other services)
+    pub fn for_service(service: &ProcessConfig) -> Option<Self> {
+        if service.kind != ServiceKind::Static {
+            return None;
+        }
+        Some(Self {
+            root: service.root.clone()?,
+            spa: service.spa,
+            cache_max_age: service.cache_max_age,
+        })
+    }
+}
+
+/// `rest` (a request path) as a file under `root`, or None if it tries to
+/// leave it. Directories resolve to their index.html.
+pub fn resolve(root: &Path, rest: &str) -> Option<PathBuf> {
+    let mut path = root.to_path_buf();
+    for segment in rest.split('/').filter(|s| !s.is_empty()) {
+        let segment = urlencoding::decode(segment).ok()?;
+        if segment == ".." || segment == "." || segment.contains(['/', '\\']) {
+            return None;
+        }
+        path.push(segment.as_ref());
+    }
+    if path.is_dir() {
+        path.push("index.html");
+    }
+    Some(path)
+}
+
+/// Answer a request for `path` from a static site
+pub async fn serve(
+    site: &StaticSite,
+    method: &Method,
+    path: &str,
+    headers: &HeaderMap,
+) -> Response {
+    if method != Method::GET && method != Method::HEAD {
+        return (
+            StatusCode::METHOD_NOT_ALLOWED,
+            [(header::ALLOW, "GET, HEAD")],
+            "Method not allowed",
+        )
+            .into_response();
+    }
+    let Some(mut file) = resolve(&site.root, path) else {
+        return not_found();
+    };
+    if !file.is_file() {
+        if !site.spa {
+            return not_found();
+        }
+        file = site.root.join("index.html");
+    }
+    let Ok(metadata) = tokio::fs::metadata(&file).await else {
+        return not_found();
+    };
+
+    let mime = mime_guess::from_path(&file).first_or_octet_stream();
+    let cache_control = match mime.essence_str() {
+        "text/html" => "no-cache".to_string(),
+        _ => format!("public, max-age={}", site.cache_max_age),
+    };
+    let modified = metadata
+        .modified()
+        .ok()
+        .map(chrono::DateTime::<chrono::Utc>::from);
+    let (body_path, coding) = precompressed(&file, headers);
+    let etag = format!(
+        "\"{:x}-{:x}{}\"",
+        metadata.len(),
+        modified.map_or(0, |m| m.timestamp_nanos_opt().unwrap_or(0)),
+        coding.map(|c| format!("-{}", c)).unwrap_or_default()
+    );
+
+    let mut response = if is_fresh(headers, &etag, modified) {
+        StatusCode::NOT_MODIFIED.into_response()
+    } else {
+        match tokio::fs::read(&body_path).await {
+            Ok(content) => {
+                let mut response = Body::from(content).into_response();
+                let headers = response.headers_mut();
+                if let Ok(value) = HeaderValue::from_str(mime.as_ref()) {
+                    headers.insert(header::CONTENT_TYPE, value);
+                }
+                if let Some(coding) = coding {
+                    headers.insert(header::CONTENT_ENCODING, HeaderValue::from_static(coding));
+                }
+                response
+            }
+            Err(_) => return not_found(),
+        }
+    };
+    let headers = response.headers_mut();
+    headers.insert(header::VARY, HeaderValue::from_static("accept-encoding"));
+    if let Ok(value) = HeaderValue::from_str(&etag) {
+        headers.insert(header::ETAG, value);
+    }
+    if let Ok(value) = HeaderValue::from_str(&cache_control) {
+        headers.insert(header::CACHE_CONTROL, value);
+    }
+    if let Some(value) = modified.and_then(|m| HeaderValue::from_str(&http_date(m)).ok()) {
+        headers.insert(header::LAST_MODIFIED, value);
+    }
+    response
+}
+
+fn not_found() -> Response {
+    (StatusCode::NOT_FOUND, "Not found").into_response()
+}
+
+/// The file to send for `file`: a precompressed sibling the client accepts,
+/// with its coding, or `file` itself
+fn precompressed(file: &Path, headers: &HeaderMap) -> (PathBuf, Option<&'static str>) {
+    let accepted = headers
+        .get(header::ACCEPT_ENCODING)
+        .and_then(|v| v.to_str().ok())
+        .unwrap_or("");
+    for (coding, extension) in PRECOMPRESSED {
+        if !accepts(accepted, coding) {
+            continue;
+        }
+        let mut variant = file.as_os_str().to_owned();
+        variant.push(".");
+        variant.push(extension);
+        let variant = PathBuf::from(variant);
+        if variant.is_file() {
+            return (variant, Some(coding));
+        }
+    }
+    (file.to_path_buf(), None)
+}
+
+/// Whether an Accept-Encoding value allows `coding` (listed, or `*`, without q=0)
+fn accepts(accept_encoding: &str, coding: &str) -> bool {
+    accept_encoding.split(',').any(|item| {
+        let mut parts = item.split(';');
+        let name = parts.next().unwrap_or("").trim();
+        let refused = parts.any(|param| {
+            let param = param.trim().replace(' ', "");
+            param == "q=0" || param.starts_with("q=0.") && param[4..].chars().all(|c| c == '0')
+        });
+        (name.eq_ignore_ascii_case(coding) || name == "*") && !refused
+    })
+}
+
+/// Whether the client's cached copy (If-None-Match, else If-Modified-Since) is current
+fn is_fresh(
+    headers: &HeaderMap,
+    etag: &str,
+    modified: Option<chrono::DateTime<chrono::Utc>>,
+) -> bool {
+    if let Some(tags) = headers
+        .get(header::IF_NONE_MATCH)
+        .and_then(|v| v.to_str().ok())
+    {
+        return tags
+            .split(',')
+            .map(|tag| tag.trim().trim_start_matches("W/"))
+            .any(|tag| tag == etag || tag == "*");
+    }
+    let since = headers
+        .get(header::IF_MODIFIED_SINCE)
+        .and_then(|v| v.to_str().ok())
+        .and_then(|v| chrono::DateTime::parse_from_rfc2822(v).ok());
+    match (since, modified) {
+        (Some(since), Some(modified)) => modified.timestamp() <= since.timestamp(),
+        _ => false,
+    }
+}
+
+/// A time as an HTTP date ("Sun, 06 Nov 1994 08:49:37 GMT")
+fn http_date(time: chrono::DateTime<chrono::Utc>) -> String {
+    time.format("%a, %d %b %Y %H:%M:%S GMT").to_string()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use http_body_util::BodyExt;
+    use tempfile::TempDir;
+
+    fn site(dir: &TempDir, spa: bool) -> StaticSite {
+        StaticSite {
+            root: dir.path().to_path_buf(),
+            spa,
+            cache_max_age: 600,
+        }
+    }
+
+    fn build(dir: &TempDir) {
+        std::fs::create_dir_all(dir.path().join("assets")).unwrap();
+        std::fs::write(dir.path().join("index.html"), "<h1>app</h1>").unwrap();
+        std::fs::write(dir.path().join("assets/app.css"), "body {}").unwrap();
+        std::fs::write(dir.path().join("assets/app.css.br"), "brotli").unwrap();
+        std::fs::write(dir.path().join("assets/app.css.gz"), "gzip").unwrap();
+    }
+
+    async fn get(site: &StaticSite, path: &str, headers: &[(&str, &str)]) -> Response {
+        let mut map = HeaderMap::new();
+        for (name, value) in headers {
+            map.insert(
+                header::HeaderName::from_bytes(name.as_bytes()).unwrap(),
+                HeaderValue::from_str(value).unwrap(),
+            );
+        }
+        serve(site, &Method::GET, path, &map).await
+    }
+
+    async fn text(response: Response) -> String {
+        let bytes = response.into_body().collect().await.unwrap().to_bytes();
+        String::from_utf8(bytes.to_vec()).unwrap()
+    }
+
+    #[tokio::test]
+    async fn test_serves_files_with_caching_headers() {
+        let dir = TempDir::new().unwrap();
+        build(&dir);
+        let site = site(&dir, false);
+
+        let response = get(&site, "/", &[]).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(response.headers()[header::CONTENT_TYPE], "text/html");
+        assert_eq!(response.headers()[header::CACHE_CONTROL], "no-cache");
+        assert!(response.headers().contains_key(header::LAST_MODIFIED));
+        assert_eq!(text(response).await, "<h1>app</h1>");
+
+        let response = get(&site, "/assets/app.css", &[]).await;
+        assert_eq!(
+            response.headers()[header::CACHE_CONTROL],
+            "public, max-age=600"
+        );
+        assert!(response.headers().get(header::CONTENT_ENCODING).is_none());
+        let etag = response.headers()[header::ETAG].clone();
+        let etag = etag.to_str().unwrap();
+        assert_eq!(text(response).await, "body {}");
+
+        // Revalidation: unchanged files are a 304 with no body
+        let response = get(&site, "/assets/app.css", &[("if-none-match", etag)]).await;
+        assert_eq!(response.status(), StatusCode::NOT_MODIFIED);
+        assert_eq!(text(response).await, "");
+        let response = get(&site, "/assets/app.css", &[("if-none-match", "\"other\"")]).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        let later = http_date(chrono::Utc::now() + chrono::Duration::hours(1));
+        let response = get(
+            &site,
+            "/assets/app.css",
+            &[("if-modified-since", later.as_str())],
+        )
+        .await;
+        assert_eq!(response.status(), StatusCode::NOT_MODIFIED);
+    }
+
+    #[tokio::test]
+    async fn test_precompressed_variants() {
+        let dir = TempDir::new().unwrap();
+        build(&dir);
+        let site = site(&dir, false);
+
+        let cases = [
+            ("gzip, deflate, br", Some("br"), "brotli"),
+            ("gzip", Some("gzip"), "gzip"),
+            ("br;q=0, gzip;q=0.8", Some("gzip"), "gzip"),
+            ("identity", None, "body {}"),
+        ];
+        for (accept, coding, body) in cases {
+            let response = get(&site, "/assets/app.css", &[("accept-encoding", accept)]).await;
+            let encoding = response.headers().get(header::CONTENT_ENCODING);
+            let encoding = encoding.map(|v| v.to_str().unwrap().to_string());
+            assert_eq!(encoding.as_deref(), coding, "{}", accept);
+            // The type is the original file's, not the variant's
+            assert_eq!(response.headers()[header::CONTENT_TYPE], "text/css");
+            assert_eq!(text(response).await, body);
+        }
+    }
+
+    #[tokio::test]
+    async fn test_spa_fallback_and_escapes() {
+        let dir = TempDir::new().unwrap();
+        build(&dir);
+
+        let response = get(&site(&dir, false), "/users/42", &[]).await;
+        assert_eq!(response.status(), StatusCode::NOT_FOUND);
+        let response = get(&site(&dir, true), "/users/42", &[]).await;
+        assert_eq!(response.status(), StatusCode::OK);
+        assert_eq!(text(response).await, "<h1>app</h1>");
+
+        for path in ["/../secret", "/assets/%2e%2e/x", "/a%2Fb"] {
+            let response = get(&site(&dir, true), path, &[]).await;
+            assert_eq!(response.status(), StatusCode::NOT_FOUND, "{}", path);
+        }
+        let response = serve(&site(&dir, true), &Method::POST, "/", &HeaderMap::new()).await;
+        assert_eq!(response.status(), StatusCode::METHOD_NOT_ALLOWED);
+    }
+}
@@ -0,0 +1,309 @@
+//! systemd integration: readiness, watchdog and socket activation
+//!
+//! Under `Type=notify` tenement sends `READY=1` once its listeners are up,
+//! `RELOADING=1` and `READY=1` around a SIGHUP reload, and `STOPPING=1` when it
+//! starts shutting down. With `WatchdogSec=` set it pings the watchdog at half
+//! the interval. With a `.socket` unit, the proxy serves on the sockets systemd
+//! passes in (`LISTEN_FDS`) instead of binding its own, so systemd can hold
+//! ports 80/443 and tenement needs no privileges to use them. Outside systemd
+//! all of this is a no-op.
+
+use anyhow::Result;
+use std::net::TcpListener;
+use std::time::Duration;
+
+/// First descriptor systemd passes to an activated service (SD_LISTEN_FDS_START)
+#[cfg(unix)]
+const LISTEN_FDS_START: i32 = 3;
+
+/// Send a state line such as `READY=1` to the service manager. Returns false
+/// when not started by systemd with `NOTIFY_SOCKET` set.
+pub fn notify(state: &str) -> std::io::Result<bool> {
+    #[cfg(unix)]
+    {
+        match std::env::var_os("NOTIFY_SOCKET") {
+            Some(socket) => notify_to(&socket, state).map(|()| true),
+            None => Ok(false),
+        }
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = state;
+        Ok(false)
+    }
+}
+
+/// Send `state` to the notify socket at `socket` ("@name" is an abstract socket)
+#[cfg(unix)]
+fn notify_to(socket: &std::ffi::OsStr, state: &str) -> std::io::Result<()> {
+    use std::os::unix::ffi::OsStrExt;
+    use std::os::unix::net::UnixDatagram;
+
+    let sender = UnixDatagram::unbound()?;
+    match socket.as_bytes() {
+        #[cfg(target_os = "linux")]
+        [b'@', name @ ..] => {
+            use std::os::linux::net::SocketAddrExt;
+            let addr = std::os::unix::net::SocketAddr::from_abstract_name(name)?;
+            sender.send_to_addr(state.as_bytes(), &addr)?;
+        }
+        _ => {
+            sender.send_to(state.as_bytes(), socket)?;
+        }
+    }
+    Ok(())
+}
+
+/// Notify, logging rather than failing when the manager can't be reached
+fn send(state: &str) {
+    if let Err(e) = notify(state) {
+        tracing::warn!("systemd notify ({}) failed: {}", state, e);
+    }
+}
+
+/// The service is up: configured instances started and listeners bound
+pub fn ready() {
+    send("READY=1");
+}
+
+/// A reload started; `ready()` again once it's done
+pub fn reloading() {
+    send("RELOADING=1");
+}
+
+/// Shutdown started (instances are being stopped)
+pub fn stopping() {
+    send("STOPPING=1");
+}
+
+/// How often systemd expects a watchdog ping (`WatchdogSec=`), if it
+/// expects them from this process
+pub fn watchdog_interval() -> Option<Duration> {
+    parse_watchdog(
+        std::env::var("WATCHDOG_USEC").ok().as_deref(),
+        std::env::var("WATCHDOG_PID").ok().as_deref(),
+        std::process::id(),
+    )
+}
+
+fn parse_watchdog(usec: Option<&str>, pid: Option<&str>, own_pid: u32) -> Option<Duration> {
+    if let Some(pid) = pid {
+        if pid.parse::<u32>().ok()? != own_pid {
+            return None;
+        }
+    }
+    match usec?.parse::<u64>().ok()? {
+        0 => None,
+        usec => Some(Duration::from_micros(usec)),
+    }
+}
+
+/// Ping the watchdog at half its interval from the async runtime, so a wedged
+/// runtime gets the service restarted. Does nothing without `WatchdogSec=`.
+pub fn spawn_watchdog() {
+    let Some(interval) = watchdog_interval() else {
+        return;
+    };
+    tracing::info!("systemd watchdog: pinging every {:?}", interval / 2);
+    tokio::spawn(async move {
+        let mut ticks = tokio::time::interval(interval / 2);
+        loop {
+            ticks.tick().await;
+            send("WATCHDOG=1");
+        }
+    });
+}
+
+/// TCP sockets passed in by systemd socket activation, with their
+/// `FileDescriptorName=` names ("unknown" when the unit sets none), or handed
+/// over by the supervisor this one replaced (see `upgrade`)
+#[derive(Default)]
+pub struct ActivatedSockets {
+    sockets: Vec<Option<(String, TcpListener)>>,
+}
+
+impl ActivatedSockets {
+    /// Take the sockets passed to this process, if any. Clears `LISTEN_*` and
+    /// marks the descriptors close-on-exec, so instances inherit none of them.
+    pub fn take() -> Result<Self> {
+        #[cfg(unix)]
+        {
+            let fds = listen_fds(
+                std::env::var("LISTEN_PID").ok().as_deref(),
+                std::env::var("LISTEN_FDS").ok().as_deref(),
+                std::env::var("LISTEN_FDNAMES").ok().as_deref(),
+                std::process::id(),
+            );
+            for var in ["LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"] {
+                std::env::remove_var(var);
+            }
+            Self::from_fds(fds)
+        }
+        #[cfg(not(unix))]
+        {
+            Ok(Self::default())
+        }
+    }
+
+    /// Adopt already-open descriptors as TCP listeners
+    #[cfg(unix)]
+    pub(crate) fn from_fds(fds: Vec<(i32, String)>) -> Result<Self> {
+        use std::os::unix::io::FromRawFd;
+
+        let mut sockets = Vec::with_capacity(fds.len());
+        for (fd, name) in fds {
+            // SAFETY: the descriptor was passed for us to own
+            unsafe {
+                libc::fcntl(fd, libc::F_SETFD, libc::FD_CLOEXEC);
+            }
+            let listener = unsafe { TcpListener::from_raw_fd(fd) };
+            if listener.local_addr().is_err() {
+                anyhow::bail!(
+                    "Inherited descriptor {} ({}) is not a TCP listener",
+                    fd,
+                    name
+                );
+            }
+            sockets.push(Some((name, listener)));
+        }
+        Ok(Self { sockets })
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.sockets.iter().all(Option::is_none)
+    }
+
+    /// The socket named `name`, or else the unnamed one at `index` (in
+    /// `ListenStream=` order)
+    pub fn listener(&mut self, name: &str, index: usize) -> Option<TcpListener> {
+        if let Some(listener) = self.named(name) {
+            return Some(listener);
+        }
+        match self.sockets.get(index) {
+            Some(Some((n, _))) if n == "unknown" => self.take_slot(index, name),
+            _ => None,
+        }
+    }
+
+    /// The socket named `name`, never an unnamed one
+    pub fn named(&mut self, name: &str) -> Option<TcpListener> {
+        let slot = self
+            .sockets
+            .iter()
+            .position(|s| matches!(s, Some((n, _)) if n == name))?;
+        self.take_slot(slot, name)
+    }
+
+    fn take_slot(&mut self, slot: usize, name: &str) -> Option<TcpListener> {
+        let (_, listener) = self.sockets[slot].take()?;
+        if let Ok(addr) = listener.local_addr() {
+            tracing::info!("Using inherited listener {} ({})", addr, name);
+        }
+        Some(listener)
+    }
+
+    /// Names of sockets nothing took
+    pub fn unused(&self) -> Vec<String> {
+        self.sockets
+            .iter()
+            .flatten()
+            .map(|(n, _)| n.clone())
+            .collect()
+    }
+}
+
+/// The descriptors `LISTEN_*` describe, when they are meant for `own_pid`
+#[cfg(unix)]
+fn listen_fds(
+    pid: Option<&str>,
+    fds: Option<&str>,
+    names: Option<&str>,
+    own_pid: u32,
+) -> Vec<(i32, String)> {
+    if pid.and_then(|p| p.parse::<u32>().ok()) != Some(own_pid) {
+        return Vec::new();
+    }
+    let count = fds.and_then(|n| n.parse::<i32>().ok()).unwrap_or(0);
+    let mut names = names.unwrap_or("").split(':');
+    (0..count.max(0))
+        .map(|i| {
+            let name = names.next().filter(|n| !n.is_empty()).unwrap_or("unknown");
+            (LISTEN_FDS_START + i, name.to_string())
+        })
+        .collect()
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_watchdog() {
+        let usec = Some("30000000");
+        assert_eq!(
+            parse_watchdog(usec, None, 42),
+            Some(Duration::from_secs(30))
+        );
+        assert_eq!(
+            parse_watchdog(usec, Some("42"), 42),
+            Some(Duration::from_secs(30))
+        );
+        // Meant for another process, disabled, or unset
+        assert_eq!(parse_watchdog(usec, Some("7"), 42), None);
+        assert_eq!(parse_watchdog(Some("0"), None, 42), None);
+        assert_eq!(parse_watchdog(None, None, 42), None);
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_listen_fds() {
+        let fds = listen_fds(Some("42"), Some("2"), Some("https:http"), 42);
+        assert_eq!(fds, vec![(3, "https".to_string()), (4, "http".to_string())]);
+        let unnamed = listen_fds(Some("42"), Some("1"), None, 42);
+        assert_eq!(unnamed, vec![(3, "unknown".to_string())]);
+        assert!(listen_fds(Some("7"), Some("2"), None, 42).is_empty());
+        assert!(listen_fds(None, Some("2"), None, 42).is_empty());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_activated_sockets_by_name_then_position() {
+        use std::os::unix::io::IntoRawFd;
+
+        let bind = || TcpListener::bind("127.0.0.1:0").unwrap();
+        let (first, second, third) = (bind(), bind(), bind());
+        let first_addr = first.local_addr().unwrap();
+        let third_addr = third.local_addr().unwrap();
+        let mut sockets = ActivatedSockets::from_fds(vec![
+            (first.into_raw_fd(), "unknown".to_string()),
+            (second.into_raw_fd(), "metrics".to_string()),
+            (third.into_raw_fd(), "https".to_string()),
+        ])
+        .unwrap();
+
+        let https = sockets.listener("https", 0).unwrap();
+        assert_eq!(https.local_addr().unwrap(), third_addr);
+        // No socket named "http": the unnamed first one
+        let http = sockets.listener("http", 0).unwrap();
+        assert_eq!(http.local_addr().unwrap(), first_addr);
+        // A named socket isn't taken by position
+        assert!(sockets.listener("http", 1).is_none());
+        assert_eq!(sockets.unused(), vec!["metrics".to_string()]);
+        assert!(!sockets.is_empty());
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_notify_sends_state_to_socket() {
+        use std::os::unix::net::UnixDatagram;
+
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("notify.sock");
+        let receiver = UnixDatagram::bind(&path).unwrap();
+
+        notify_to(path.as_os_str(), "READY=1").unwrap();
+        let mut buf = [0u8; 64];
+        let n = receiver.recv(&mut buf).unwrap();
+        assert_eq!(&buf[..n], b"READY=1");
+    }
+}
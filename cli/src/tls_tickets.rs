@@ -0,0 +1,306 @@
+//! Rotating TLS session ticket keys
+//!
+//! Session tickets are encrypted with a server-side key; anyone holding that
+//! key can decrypt every session resumed with it, so a key that lives for the
+//! whole process lifetime undermines forward secrecy. [`RotatingTicketer`]
+//! generates a fresh key every `rotation` interval and keeps the last few
+//! retired keys for decryption only, so clients holding a recent ticket can
+//! still resume across a rotation. Retired keys beyond that are erased.
+//!
+//! Ticket layout: `key id (16) || nonce (12) || ChaCha20-Poly1305 ciphertext+tag`.
+
+use anyhow::{anyhow, Result};
+use ring::aead::{Aad, LessSafeKey, Nonce, UnboundKey, CHACHA20_POLY1305, NONCE_LEN};
+use ring::rand::{SecureRandom, SystemRandom};
+use rustls::server::ProducesTickets;
+use std::collections::VecDeque;
+use std::sync::{Arc, RwLock};
+use std::time::{Duration, Instant};
+
+const KEY_ID_LEN: usize = 16;
+
+struct TicketKey {
+    id: [u8; KEY_ID_LEN],
+    key: LessSafeKey,
+}
+
+impl TicketKey {
+    fn generate(rng: &SystemRandom) -> Option<Self> {
+        let mut id = [0u8; KEY_ID_LEN];
+        let mut secret = [0u8; 32];
+        rng.fill(&mut id).ok()?;
+        rng.fill(&mut secret).ok()?;
+        let key = UnboundKey::new(&CHACHA20_POLY1305, &secret).ok()?;
+        Some(Self {
+            id,
+            key: LessSafeKey::new(key),
+        })
+    }
+}
+
+struct KeyRing {
+    /// Newest first; only the front key encrypts
+    keys: VecDeque<TicketKey>,
+    rotated_at: Instant,
+}
+
+/// Session ticketer that rotates its key on a fixed interval
+pub struct RotatingTicketer {
+    rotation: Duration,
+    retained: usize,
+    rng: SystemRandom,
+    ring: RwLock<KeyRing>,
+}
+
+impl RotatingTicketer {
+    /// Rotate every `rotation`, accepting tickets from the `retained` previous keys
+    pub fn new(rotation: Duration, retained: usize) -> Result<Arc<Self>> {
+        if rotation.is_zero() {
+            anyhow::bail!("Session ticket rotation interval must be greater than zero");
+        }
+        let rng = SystemRandom::new();
+        let first = TicketKey::generate(&rng)
+            .ok_or_else(|| anyhow!("Failed to generate a session ticket key"))?;
+        Ok(Arc::new(Self {
+            rotation,
+            retained,
+            rng,
+            ring: RwLock::new(KeyRing {
+                keys: VecDeque::from([first]),
+                rotated_at: Instant::now(),
+            }),
+        }))
+    }
+
+    /// Start encrypting with a new key now, retiring the current one
+    pub fn rotate(&self) {
+        self.rotate_if(|_| true);
+    }
+
+    /// Install a new key if `due` still holds once the write lock is held,
+    /// so concurrent callers noticing the same deadline rotate only once
+    fn rotate_if(&self, due: impl Fn(&KeyRing) -> bool) {
+        let Some(key) = TicketKey::generate(&self.rng) else {
+            tracing::warn!("Failed to generate a session ticket key; keeping the current key");
+            return;
+        };
+        let mut ring = self.ring.write().unwrap();
+        if !due(&ring) {
+            return;
+        }
+        ring.keys.push_front(key);
+        ring.keys.truncate(self.retained + 1);
+        ring.rotated_at = Instant::now();
+    }
+
+    /// Number of keys that can currently decrypt tickets (current + retained)
+    pub fn key_count(&self) -> usize {
+        self.ring.read().unwrap().keys.len()
+    }
+
+    /// Rotate if the interval has passed since the last rotation
+    fn maybe_rotate(&self) {
+        let due = |ring: &KeyRing| ring.rotated_at.elapsed() >= self.rotation;
+        if due(&self.ring.read().unwrap()) {
+            self.rotate_if(due);
+        }
+    }
+}
+
+impl std::fmt::Debug for RotatingTicketer {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("RotatingTicketer")
+            .field("rotation", &self.rotation)
+            .field("retained", &self.retained)
+            .field("keys", &self.key_count())
+            .finish()
+    }
+}
+
+impl ProducesTickets for RotatingTicketer {
+    fn enabled(&self) -> bool {
+        true
+    }
+
+    /// Tickets stay decryptable until their key falls off the ring
+    fn lifetime(&self) -> u32 {
+        let secs = self.rotation.as_secs().saturating_mul(self.retained as u64 + 1);
+        u32::try_from(secs).unwrap_or(u32::MAX)
+    }
+
+    fn encrypt(&self, plain: &[u8]) -> Option<Vec<u8>> {
+        self.maybe_rotate();
+        let mut nonce = [0u8; NONCE_LEN];
+        self.rng.fill(&mut nonce).ok()?;
+
+        let ring = self.ring.read().unwrap();
+        let current = ring.keys.front()?;
+        let mut sealed = plain.to_vec();
+        current
+            .key
+            .seal_in_place_append_tag(
+                Nonce::assume_unique_for_key(nonce),
+                Aad::from(&current.id),
+                &mut sealed,
+            )
+            .ok()?;
+
+        let mut ticket = Vec::with_capacity(KEY_ID_LEN + NONCE_LEN + sealed.len());
+        ticket.extend_from_slice(&current.id);
+        ticket.extend_from_slice(&nonce);
+        ticket.extend_from_slice(&sealed);
+        Some(ticket)
+    }
+
+    fn decrypt(&self, cipher: &[u8]) -> Option<Vec<u8>> {
+        self.maybe_rotate();
+        if cipher.len() < KEY_ID_LEN + NONCE_LEN {
+            return None;
+        }
+        let (id, rest) = cipher.split_at(KEY_ID_LEN);
+        let (nonce, sealed) = rest.split_at(NONCE_LEN);
+
+        let ring = self.ring.read().unwrap();
+        let key = ring.keys.iter().find(|k| k.id[..] == *id)?;
+        let nonce = Nonce::try_assume_unique_for_key(nonce).ok()?;
+        let mut buf = sealed.to_vec();
+        let plain_len = key.key.open_in_place(nonce, Aad::from(&key.id), &mut buf).ok()?.len();
+        buf.truncate(plain_len);
+        Some(buf)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const HOUR: Duration = Duration::from_secs(3600);
+
+    #[test]
+    fn test_round_trip() {
+        let ticketer = RotatingTicketer::new(HOUR, 2).unwrap();
+        let ticket = ticketer.encrypt(b"session state").unwrap();
+        assert_ne!(&ticket[KEY_ID_LEN + NONCE_LEN..], b"session state");
+        assert_eq!(ticketer.decrypt(&ticket).unwrap(), b"session state");
+    }
+
+    #[test]
+    fn test_rotation_changes_key_and_keeps_old_tickets_valid() {
+        let ticketer = RotatingTicketer::new(HOUR, 2).unwrap();
+        let before = ticketer.encrypt(b"a").unwrap();
+
+        ticketer.rotate();
+        let after = ticketer.encrypt(b"b").unwrap();
+
+        assert_ne!(before[..KEY_ID_LEN], after[..KEY_ID_LEN], "new key id after rotation");
+        assert_eq!(ticketer.decrypt(&before).unwrap(), b"a");
+        assert_eq!(ticketer.decrypt(&after).unwrap(), b"b");
+    }
+
+    #[test]
+    fn test_keys_beyond_retained_are_erased() {
+        let ticketer = RotatingTicketer::new(HOUR, 2).unwrap();
+        let oldest = ticketer.encrypt(b"a").unwrap();
+
+        ticketer.rotate();
+        ticketer.rotate();
+        assert_eq!(ticketer.key_count(), 3);
+        assert!(ticketer.decrypt(&oldest).is_some());
+
+        ticketer.rotate();
+        assert_eq!(ticketer.key_count(), 3);
+        assert!(ticketer.decrypt(&oldest).is_none());
+    }
+
+    #[test]
+    fn test_rotates_after_interval() {
+        let ticketer = RotatingTicketer::new(Duration::from_millis(20), 1).unwrap();
+        let first = ticketer.encrypt(b"a").unwrap();
+        std::thread::sleep(Duration::from_millis(40));
+
+        let second = ticketer.encrypt(b"b").unwrap();
+        assert_ne!(first[..KEY_ID_LEN], second[..KEY_ID_LEN]);
+        assert_eq!(ticketer.decrypt(&first).unwrap(), b"a");
+    }
+
+    #[test]
+    fn test_rejects_tampered_and_short_tickets() {
+        let ticketer = RotatingTicketer::new(HOUR, 1).unwrap();
+        let mut ticket = ticketer.encrypt(b"session").unwrap();
+        let last = ticket.len() - 1;
+        ticket[last] ^= 0x01;
+        assert!(ticketer.decrypt(&ticket).is_none());
+        assert!(ticketer.decrypt(&[0u8; 8]).is_none());
+    }
+
+    #[test]
+    fn test_lifetime_covers_retained_keys() {
+        let ticketer = RotatingTicketer::new(HOUR, 2).unwrap();
+        assert_eq!(ticketer.lifetime(), 3 * 3600);
+        assert!(RotatingTicketer::new(Duration::ZERO, 2).is_err());
+    }
+
+    #[test]
+    fn test_resumption_across_rotation() {
+        use rustls::pki_types::{CertificateDer, PrivatePkcs8KeyDer, ServerName};
+        use rustls::{ClientConfig, ClientConnection, Connection, RootCertStore, ServerConfig};
+
+        let cert = rcgen::generate_simple_self_signed(vec!["localhost".to_string()]).unwrap();
+        let cert_der = CertificateDer::from(cert.cert.der().to_vec());
+        let key_der = PrivatePkcs8KeyDer::from(cert.key_pair.serialize_der());
+        let provider = Arc::new(rustls::crypto::aws_lc_rs::default_provider());
+
+        let ticketer = RotatingTicketer::new(HOUR, 1).unwrap();
+        let mut server_config = ServerConfig::builder_with_provider(provider.clone())
+            .with_safe_default_protocol_versions()
+            .unwrap()
+            .with_no_client_auth()
+            .with_single_cert(vec![cert_der.clone()], key_der.into())
+            .unwrap();
+        server_config.ticketer = ticketer.clone();
+        // No session cache, so resumption can only come from a ticket
+        server_config.session_storage = Arc::new(rustls::server::NoServerSessionStorage {});
+        let server_config = Arc::new(server_config);
+
+        let mut roots = RootCertStore::empty();
+        roots.add(cert_der).unwrap();
+        let client_config = Arc::new(
+            ClientConfig::builder_with_provider(provider)
+                .with_safe_default_protocol_versions()
+                .unwrap()
+                .with_root_certificates(roots)
+                .with_no_client_auth(),
+        );
+
+        fn transfer(from: &mut Connection, to: &mut Connection) {
+            let mut buf = Vec::new();
+            while from.wants_write() {
+                from.write_tls(&mut buf).unwrap();
+            }
+            let mut slice = &buf[..];
+            while !slice.is_empty() {
+                to.read_tls(&mut slice).unwrap();
+            }
+            to.process_new_packets().unwrap();
+        }
+
+        // Handshake in memory, with enough round trips for the client to get its tickets
+        let handshake = || {
+            let name = ServerName::try_from("localhost").unwrap();
+            let client = ClientConnection::new(client_config.clone(), name).unwrap();
+            let server = rustls::ServerConnection::new(server_config.clone()).unwrap();
+            let mut client = Connection::Client(client);
+            let mut server = Connection::Server(server);
+            for _ in 0..4 {
+                transfer(&mut client, &mut server);
+                transfer(&mut server, &mut client);
+            }
+            assert!(!client.is_handshaking() && !server.is_handshaking());
+            server.handshake_kind()
+        };
+
+        assert_eq!(handshake(), Some(rustls::HandshakeKind::Full));
+        ticketer.rotate();
+        assert_eq!(handshake(), Some(rustls::HandshakeKind::Resumed));
+    }
+}
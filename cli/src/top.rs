@@ -0,0 +1,157 @@
+//! `ten top`: live resource use per app and instance
+//!
+//! Reads the usage the server samples for each instance (`usage` in
+//! `/api/instances`) and lays it out as one line per app with its totals,
+//! followed by its instances and replicas.
+
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::fmt::Write;
+use tenement::format_bytes;
+use tenement::metrics::ProcessUsage;
+
+use crate::format_uptime;
+
+/// The parts of an `/api/instances` entry the table shows
+#[derive(Debug, Deserialize)]
+struct Row {
+    id: String,
+    status: String,
+    uptime_secs: u64,
+    #[serde(default)]
+    usage: Option<ProcessUsage>,
+}
+
+/// The table for `instances`, only those of `app` if given
+pub fn render(instances: &[serde_json::Value], app: Option<&str>) -> String {
+    let mut apps: BTreeMap<String, Vec<Row>> = BTreeMap::new();
+    for value in instances {
+        let Ok(row) = serde_json::from_value::<Row>(value.clone()) else {
+            continue;
+        };
+        let name = row
+            .id
+            .split_once(':')
+            .map_or(row.id.as_str(), |(name, _)| name);
+        if app.is_some_and(|app| app != name) {
+            continue;
+        }
+        apps.entry(name.to_string()).or_default().push(row);
+    }
+
+    let mut out = String::new();
+    let _ = writeln!(
+        out,
+        "{:<24} {:<14} {:<8} {:>7} {:>8} {:>8} {:>6}",
+        "APP / INSTANCE", "STATUS", "UPTIME", "CPU%", "MEM", "THREADS", "FDS"
+    );
+    if apps.is_empty() {
+        out.push_str("No running instances\n");
+        return out;
+    }
+    for (name, mut rows) in apps {
+        rows.sort_by(|a, b| a.id.cmp(&b.id));
+        let sampled: Vec<&ProcessUsage> = rows.iter().filter_map(|r| r.usage.as_ref()).collect();
+        let total = (!sampled.is_empty()).then(|| ProcessUsage {
+            rss_bytes: sampled.iter().map(|u| u.rss_bytes).sum(),
+            cpu_seconds: sampled.iter().map(|u| u.cpu_seconds).sum(),
+            cpu_percent: sampled
+                .iter()
+                .filter_map(|u| u.cpu_percent)
+                .reduce(|a, b| a + b),
+            threads: sampled.iter().map(|u| u.threads).sum(),
+            open_fds: sampled
+                .iter()
+                .filter_map(|u| u.open_fds)
+                .reduce(|a, b| a + b),
+        });
+        let status = format!("{} instance(s)", rows.len());
+        line(&mut out, &name, &status, "", total.as_ref());
+        for row in &rows {
+            let id = format!("  {}", row.id);
+            let uptime = format_uptime(row.uptime_secs);
+            line(&mut out, &id, &row.status, &uptime, row.usage.as_ref());
+        }
+    }
+    out
+}
+
+fn line(out: &mut String, name: &str, status: &str, uptime: &str, usage: Option<&ProcessUsage>) {
+    let dash = || "-".to_string();
+    let cpu = usage
+        .and_then(|u| u.cpu_percent)
+        .map_or_else(dash, |p| format!("{:.1}", p));
+    let memory = usage.map_or_else(dash, |u| format_bytes(u.rss_bytes));
+    let threads = usage.map_or_else(dash, |u| u.threads.to_string());
+    let fds = usage
+        .and_then(|u| u.open_fds)
+        .map_or_else(dash, |n| n.to_string());
+    let _ = writeln!(
+        out,
+        "{:<24} {:<14} {:<8} {:>7} {:>8} {:>8} {:>6}",
+        name, status, uptime, cpu, memory, threads, fds
+    );
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn instance(id: &str, usage: Option<serde_json::Value>) -> serde_json::Value {
+        let mut value = serde_json::json!({
+            "id": id,
+            "status": "running",
+            "uptime_secs": 7200,
+            "health": "healthy",
+        });
+        if let Some(usage) = usage {
+            value["usage"] = usage;
+        }
+        value
+    }
+
+    #[test]
+    fn test_render_totals_per_app() {
+        let instances = vec![
+            instance(
+                "api:prod-1",
+                Some(serde_json::json!({
+                    "rss_bytes": 30 * 1024 * 1024,
+                    "cpu_seconds": 4.0,
+                    "cpu_percent": 2.5,
+                    "threads": 4,
+                    "open_fds": 12,
+                })),
+            ),
+            instance(
+                "api:prod-0",
+                Some(serde_json::json!({
+                    "rss_bytes": 10 * 1024 * 1024,
+                    "cpu_seconds": 1.0,
+                    "cpu_percent": 10.0,
+                    "threads": 2,
+                    "open_fds": 8,
+                })),
+            ),
+            instance("web:main", None),
+        ];
+        let table = render(&instances, None);
+        let lines: Vec<&str> = table.lines().collect();
+        assert!(lines[0].starts_with("APP / INSTANCE"));
+        // The app's totals, then its instances in order
+        assert!(lines[1].starts_with("api "), "{}", table);
+        assert!(lines[1].contains("2 instance(s)"));
+        assert!(lines[1].contains("12.5"));
+        assert!(lines[1].contains("40MB"));
+        assert!(lines[2].trim_start().starts_with("api:prod-0"));
+        assert!(lines[2].contains("2h"));
+        assert!(lines[3].trim_start().starts_with("api:prod-1"));
+        // Not sampled yet: dashes, not zeros
+        assert!(lines[5].trim_start().starts_with("web:main"));
+        assert!(lines[5].trim_end().ends_with('-'), "{}", lines[5]);
+
+        let only_web = render(&instances, Some("web"));
+        assert!(!only_web.contains("api"));
+        assert!(render(&instances, Some("db")).contains("No running instances"));
+    }
+}
@@ -0,0 +1,325 @@
+//! In-place upgrades of the tenement binary
+//!
+//! `ten upgrade` (or SIGUSR2) starts the binary now installed at tenement's
+//! path as a new supervisor, with the same arguments, and hands it the
+//! listening sockets, the admin socket and the output pipes of every instance
+//! tenement runs as a process. The new supervisor serves on those sockets and
+//! adopts the instances where they run instead of starting them. Once it's
+//! ready, the old one stops accepting, finishes its in-flight requests and
+//! exits, leaving the instances running; under systemd it first makes the new
+//! process the service's main PID. If the new binary fails before it's ready,
+//! nothing changes.
+
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Mutex;
+use std::time::Duration;
+use tenement::Hypervisor;
+
+#[cfg(unix)]
+use std::os::fd::{FromRawFd, OwnedFd, RawFd};
+#[cfg(not(unix))]
+type RawFd = i32;
+
+/// Environment variable describing what was handed to a new supervisor
+const HANDOFF_ENV: &str = "TENEMENT_HANDOFF";
+
+/// How long the new supervisor may take to be ready
+const READY_TIMEOUT: Duration = Duration::from_secs(60);
+
+/// Name the admin API's Unix socket is handed over under
+const ADMIN_SOCKET: &str = "admin";
+
+/// Listening sockets to hand over, by name
+static SOCKETS: Mutex<Vec<(String, RawFd)>> = Mutex::new(Vec::new());
+
+/// Where to report readiness, when this process was started by an upgrade
+#[cfg(unix)]
+static READY: Mutex<Option<OwnedFd>> = Mutex::new(None);
+
+/// Set while an upgrade is starting the new supervisor
+static UPGRADING: AtomicBool = AtomicBool::new(false);
+
+/// What the old supervisor passes in `TENEMENT_HANDOFF`: descriptor numbers,
+/// which stay the same across exec
+#[derive(Debug, Default, PartialEq, Serialize, Deserialize)]
+struct HandoffSpec {
+    /// Write end of the pipe the new supervisor reports readiness on
+    ready: RawFd,
+    /// Listening sockets by name ("http", "https", "metrics", "dashboard", "admin")
+    sockets: Vec<(String, RawFd)>,
+    /// Output pipes (stdout, then stderr) by instance ID
+    instances: HashMap<String, Vec<RawFd>>,
+}
+
+/// Offer a listening socket to the next supervisor on upgrade. It must stay
+/// open for the life of the process.
+pub fn register(name: &str, fd: RawFd) {
+    SOCKETS.lock().unwrap().push((name.to_string(), fd));
+}
+
+/// Everything the supervisor this one replaces handed over
+#[cfg(unix)]
+pub struct Handoff {
+    /// TCP listeners, by the names they were registered under
+    pub listeners: crate::systemd::ActivatedSockets,
+    /// The admin API's socket
+    pub admin: Option<std::os::unix::net::UnixListener>,
+    /// Output pipes of the instances to adopt
+    pub instances: HashMap<tenement::InstanceId, Vec<OwnedFd>>,
+}
+
+#[cfg(unix)]
+impl Handoff {
+    /// Take what was handed to this process, if an upgrade started it. Clears
+    /// `TENEMENT_HANDOFF` and marks the descriptors close-on-exec, so
+    /// instances inherit none of them.
+    pub fn take() -> Result<Option<Self>> {
+        let Some(spec) = std::env::var_os(HANDOFF_ENV) else {
+            return Ok(None);
+        };
+        std::env::remove_var(HANDOFF_ENV);
+        let spec: HandoffSpec = serde_json::from_str(&spec.to_string_lossy())
+            .with_context(|| format!("Invalid {}", HANDOFF_ENV))?;
+        Self::from_spec(spec).map(Some)
+    }
+
+    fn from_spec(spec: HandoffSpec) -> Result<Self> {
+        use std::os::fd::AsRawFd;
+
+        // SAFETY: the old supervisor passed these descriptors for us to own
+        let own = |fd: RawFd| {
+            let owned = unsafe { OwnedFd::from_raw_fd(fd) };
+            unsafe {
+                libc::fcntl(owned.as_raw_fd(), libc::F_SETFD, libc::FD_CLOEXEC);
+            }
+            owned
+        };
+        *READY.lock().unwrap() = Some(own(spec.ready));
+
+        let mut tcp = Vec::new();
+        let mut admin = None;
+        for (name, fd) in spec.sockets {
+            if name == ADMIN_SOCKET {
+                admin = Some(std::os::unix::net::UnixListener::from(own(fd)));
+            } else {
+                tcp.push((fd, name));
+            }
+        }
+        let mut instances = HashMap::new();
+        for (id, fds) in spec.instances {
+            let fds: Vec<OwnedFd> = fds.into_iter().map(own).collect();
+            match tenement::InstanceId::parse(&id) {
+                Some(id) => {
+                    instances.insert(id, fds);
+                }
+                None => tracing::warn!("Ignoring handed-over pipes of unknown instance {}", id),
+            }
+        }
+        Ok(Self {
+            listeners: crate::systemd::ActivatedSockets::from_fds(tcp)?,
+            admin,
+            instances,
+        })
+    }
+}
+
+/// The listeners are up: tell the supervisor this one replaces, which then
+/// hands over and exits, or else systemd
+pub fn ready() {
+    #[cfg(unix)]
+    if let Some(fd) = READY.lock().unwrap().take() {
+        use std::io::Write;
+        if let Err(e) = std::fs::File::from(fd).write_all(b"1") {
+            tracing::warn!("Failed to report readiness to the old supervisor: {}", e);
+        }
+        return;
+    }
+    crate::systemd::ready();
+}
+
+/// Start the installed binary as a new supervisor and hand everything over to
+/// it. Once this returns its PID, this process has stopped supervising and
+/// shuts down, leaving its instances to the new one.
+pub async fn upgrade(hypervisor: &Hypervisor) -> Result<u32> {
+    if UPGRADING.swap(true, Ordering::SeqCst) {
+        anyhow::bail!("An upgrade is already in progress");
+    }
+    let (pid, handed) = match start_successor(hypervisor).await {
+        Ok(started) => started,
+        Err(e) => {
+            UPGRADING.store(false, Ordering::SeqCst);
+            return Err(e);
+        }
+    };
+    // systemd follows the service, and its watchdog, to the new process
+    if let Err(e) = crate::systemd::notify(&format!("MAINPID={}", pid)) {
+        tracing::warn!("systemd notify (MAINPID) failed: {}", e);
+    }
+    hypervisor.hand_off(&handed).await;
+    tracing::info!("Upgraded: tenement now runs as pid {}; shutting down", pid);
+    Ok(pid)
+}
+
+/// Spawn the new supervisor and wait until it's ready. Returns its PID and the
+/// instances it took over.
+#[cfg(unix)]
+async fn start_successor(hypervisor: &Hypervisor) -> Result<(u32, Vec<tenement::InstanceId>)> {
+    use std::io::Read;
+    use std::os::fd::AsRawFd;
+    use std::os::unix::process::CommandExt;
+
+    let exe = installed(&std::env::current_exe().context("Failed to find the tenement binary")?);
+    let outputs = hypervisor.handoff_outputs().await;
+    let (reader, writer) = pipe()?;
+    let spec = HandoffSpec {
+        ready: writer.as_raw_fd(),
+        sockets: SOCKETS.lock().unwrap().clone(),
+        instances: outputs
+            .iter()
+            .map(|(id, fds)| (id.to_string(), fds.clone()))
+            .collect(),
+    };
+    let mut inherit = vec![spec.ready];
+    inherit.extend(spec.sockets.iter().map(|(_, fd)| *fd));
+    inherit.extend(spec.instances.values().flatten());
+
+    tracing::info!(
+        "Upgrading: starting {} with {} instance(s) to adopt",
+        exe.display(),
+        outputs.len()
+    );
+    let mut command = std::process::Command::new(&exe);
+    command
+        .args(std::env::args_os().skip(1))
+        .env(HANDOFF_ENV, serde_json::to_string(&spec)?)
+        // Meant for this process; the new one gets the watchdog with MAINPID
+        .env_remove("WATCHDOG_PID");
+    unsafe {
+        command.pre_exec(move || {
+            // Only fcntl here: nothing that allocates between fork and exec
+            for fd in &inherit {
+                if libc::fcntl(*fd, libc::F_SETFD, 0) == -1 {
+                    return Err(std::io::Error::last_os_error());
+                }
+            }
+            Ok(())
+        });
+    }
+    let mut child = command
+        .spawn()
+        .with_context(|| format!("Failed to start {}", exe.display()))?;
+    // Only the new process holds the write end now, so EOF means it died
+    drop(writer);
+
+    let wait = tokio::task::spawn_blocking(move || {
+        let mut byte = [0u8; 1];
+        std::fs::File::from(reader).read(&mut byte)
+    });
+    match tokio::time::timeout(READY_TIMEOUT, wait).await {
+        Ok(Ok(Ok(1))) => {
+            let handed = outputs.into_iter().map(|(id, _)| id).collect();
+            Ok((child.id(), handed))
+        }
+        Ok(_) => {
+            let status = child.wait()?;
+            anyhow::bail!("The new tenement exited before it was ready ({})", status)
+        }
+        Err(_) => {
+            child.kill().ok();
+            child.wait().ok();
+            anyhow::bail!(
+                "The new tenement wasn't ready within {:?}; stopped it",
+                READY_TIMEOUT
+            )
+        }
+    }
+}
+
+#[cfg(not(unix))]
+async fn start_successor(_hypervisor: &Hypervisor) -> Result<(u32, Vec<tenement::InstanceId>)> {
+    anyhow::bail!("In-place upgrades need a Unix host")
+}
+
+/// A close-on-exec pipe: (read end, write end)
+#[cfg(unix)]
+fn pipe() -> Result<(OwnedFd, OwnedFd)> {
+    let mut fds = [0; 2];
+    if unsafe { libc::pipe2(fds.as_mut_ptr(), libc::O_CLOEXEC) } != 0 {
+        return Err(std::io::Error::last_os_error()).context("Failed to create a pipe");
+    }
+    // SAFETY: pipe2 just opened both
+    Ok(unsafe { (OwnedFd::from_raw_fd(fds[0]), OwnedFd::from_raw_fd(fds[1])) })
+}
+
+/// The path a running binary was started from. Linux reports a binary that has
+/// since been replaced on disk as "<path> (deleted)"; the new one is at <path>.
+fn installed(exe: &Path) -> PathBuf {
+    let path = exe.to_string_lossy();
+    match path.strip_suffix(" (deleted)") {
+        Some(path) => PathBuf::from(path),
+        None => exe.to_path_buf(),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_installed_path_of_replaced_binary() {
+        assert_eq!(
+            installed(Path::new("/usr/local/bin/ten (deleted)")),
+            PathBuf::from("/usr/local/bin/ten")
+        );
+        assert_eq!(
+            installed(Path::new("/usr/local/bin/ten")),
+            PathBuf::from("/usr/local/bin/ten")
+        );
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_handoff_from_spec() {
+        use std::io::Read;
+        use std::os::fd::{AsRawFd, IntoRawFd};
+
+        let dir = tempfile::TempDir::new().unwrap();
+        let http = std::net::TcpListener::bind("127.0.0.1:0").unwrap();
+        let http_addr = http.local_addr().unwrap();
+        let admin = std::os::unix::net::UnixListener::bind(dir.path().join("api.sock")).unwrap();
+        let (reader, writer) = pipe().unwrap();
+        let (stdout, _stdout_writer) = pipe().unwrap();
+
+        let spec = HandoffSpec {
+            ready: writer.into_raw_fd(),
+            sockets: vec![
+                ("http".to_string(), http.into_raw_fd()),
+                ("admin".to_string(), admin.into_raw_fd()),
+            ],
+            instances: HashMap::from([("api:prod".to_string(), vec![stdout.into_raw_fd()])]),
+        };
+        let json = serde_json::to_string(&spec).unwrap();
+        let spec: HandoffSpec = serde_json::from_str(&json).unwrap();
+        let mut handoff = Handoff::from_spec(spec).unwrap();
+
+        let http = handoff.listeners.named("http").unwrap();
+        assert_eq!(http.local_addr().unwrap(), http_addr);
+        assert!(handoff.listeners.is_empty());
+        let admin = handoff.admin.unwrap();
+        assert!(admin.local_addr().unwrap().as_pathname().is_some());
+        let pipes = &handoff.instances[&tenement::InstanceId::new("api", "prod")];
+        assert_eq!(pipes.len(), 1);
+        let flags = unsafe { libc::fcntl(pipes[0].as_raw_fd(), libc::F_GETFD) };
+        assert_eq!(flags & libc::FD_CLOEXEC, libc::FD_CLOEXEC);
+
+        // Readiness goes to the old supervisor's pipe
+        ready();
+        let mut byte = [0u8; 1];
+        let read = std::fs::File::from(reader).read(&mut byte).unwrap();
+        assert_eq!((read, byte[0]), (1, b'1'));
+    }
+}
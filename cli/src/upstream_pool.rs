@@ -0,0 +1,292 @@
+//! Keep-alive connection pools to instances on Unix sockets
+//!
+//! Each service gets its own HTTP client, sized by its `connection_pool`
+//! settings: how many idle connections are kept per instance, how long they may
+//! sit idle, and how long one may be reused before it's closed. Under load a
+//! service holds a steady set of sockets open instead of churning through file
+//! descriptors, and requests skip the connect.
+
+#[cfg(windows)]
+use crate::pipes::UnixConnector;
+use axum::body::Body;
+use axum::http::{Request, Response};
+use hyper::rt::{Read, ReadBufCursor, Write};
+use hyper_util::client::legacy::connect::{capture_connection, Connected, Connection};
+use hyper_util::client::legacy::Client;
+use hyper_util::rt::{TokioExecutor, TokioTimer};
+#[cfg(unix)]
+use hyperlocal::UnixConnector;
+use std::collections::HashMap;
+use std::future::Future;
+use std::io;
+use std::pin::Pin;
+use std::sync::Mutex;
+use std::task::{Context, Poll};
+use std::time::{Duration, Instant};
+use tenement::config::ConnectionPoolConfig;
+
+type Dial = <UnixConnector as tower::Service<hyper::Uri>>::Response;
+
+/// When a connection was opened, copied into the extensions of each response
+/// it carries
+#[derive(Debug, Clone, Copy)]
+struct OpenedAt(Instant);
+
+/// Dials instance sockets, noting when each connection was opened
+#[derive(Clone, Copy, Debug, Default)]
+pub struct PoolConnector;
+
+impl tower::Service<hyper::Uri> for PoolConnector {
+    type Response = Opened<Dial>;
+    type Error = <UnixConnector as tower::Service<hyper::Uri>>::Error;
+    type Future = Pin<Box<dyn Future<Output = Result<Self::Response, Self::Error>> + Send>>;
+
+    fn poll_ready(&mut self, cx: &mut Context<'_>) -> Poll<Result<(), Self::Error>> {
+        tower::Service::poll_ready(&mut UnixConnector, cx)
+    }
+
+    fn call(&mut self, uri: hyper::Uri) -> Self::Future {
+        let connecting = tower::Service::call(&mut UnixConnector, uri);
+        Box::pin(async move {
+            let stream = connecting.await?;
+            Ok(Opened {
+                stream,
+                at: Instant::now(),
+            })
+        })
+    }
+}
+
+/// A socket connection and when it was opened
+#[derive(Debug)]
+pub struct Opened<S> {
+    stream: S,
+    at: Instant,
+}
+
+impl<S: Read + Unpin> Read for Opened<S> {
+    fn poll_read(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: ReadBufCursor<'_>,
+    ) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.stream).poll_read(cx, buf)
+    }
+}
+
+impl<S: Write + Unpin> Write for Opened<S> {
+    fn poll_write(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        buf: &[u8],
+    ) -> Poll<io::Result<usize>> {
+        Pin::new(&mut self.stream).poll_write(cx, buf)
+    }
+
+    fn poll_flush(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.stream).poll_flush(cx)
+    }
+
+    fn poll_shutdown(mut self: Pin<&mut Self>, cx: &mut Context<'_>) -> Poll<io::Result<()>> {
+        Pin::new(&mut self.stream).poll_shutdown(cx)
+    }
+
+    fn is_write_vectored(&self) -> bool {
+        self.stream.is_write_vectored()
+    }
+
+    fn poll_write_vectored(
+        mut self: Pin<&mut Self>,
+        cx: &mut Context<'_>,
+        bufs: &[io::IoSlice<'_>],
+    ) -> Poll<io::Result<usize>> {
+        Pin::new(&mut self.stream).poll_write_vectored(cx, bufs)
+    }
+}
+
+impl<S: Connection> Connection for Opened<S> {
+    fn connected(&self) -> Connected {
+        self.stream.connected().extra(OpenedAt(self.at))
+    }
+}
+
+/// A service's pooled HTTP client for its instances' sockets
+#[derive(Clone)]
+pub struct UpstreamClient {
+    client: Client<PoolConnector, Body>,
+    max_lifetime: Option<Duration>,
+}
+
+impl UpstreamClient {
+    /// A client keeping connections as `config` says, speaking HTTP/2 (prior
+    /// knowledge) when `h2`
+    pub fn new(config: &ConnectionPoolConfig, h2: bool) -> Self {
+        let client = Client::builder(TokioExecutor::new())
+            .pool_timer(TokioTimer::new())
+            .pool_idle_timeout(config.idle_timeout())
+            .pool_max_idle_per_host(config.max_idle)
+            .http2_only(h2)
+            .build(PoolConnector);
+        Self {
+            client,
+            max_lifetime: config.max_lifetime(),
+        }
+    }
+
+    /// Send `req` over a pooled connection, or a new one. A connection past
+    /// `max_lifetime` carries this request and is then closed.
+    pub async fn request(
+        &self,
+        mut req: Request<Body>,
+    ) -> Result<Response<hyper::body::Incoming>, hyper_util::client::legacy::Error> {
+        let connection = capture_connection(&mut req);
+        let response = self.client.request(req).await?;
+        let opened_at = response.extensions().get::<OpenedAt>().map(|at| at.0);
+        if let (Some(max), Some(opened_at)) = (self.max_lifetime, opened_at) {
+            if opened_at.elapsed() >= max {
+                if let Some(connected) = connection.connection_metadata().as_ref() {
+                    connected.poison();
+                }
+            }
+        }
+        Ok(response)
+    }
+}
+
+/// Clients by service and protocol, rebuilt when a service's settings change
+#[derive(Default)]
+pub struct UpstreamPools {
+    clients: Mutex<HashMap<(String, bool), (ConnectionPoolConfig, UpstreamClient)>>,
+}
+
+impl UpstreamPools {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// The client for `service`'s sockets under `config`, HTTP/2 when `h2`
+    pub fn client(&self, service: &str, config: &ConnectionPoolConfig, h2: bool) -> UpstreamClient {
+        let mut clients = self.clients.lock().unwrap();
+        let key = (service.to_string(), h2);
+        if let Some((current, client)) = clients.get(&key) {
+            if current == config {
+                return client.clone();
+            }
+        }
+        // A replaced client's idle connections close when it's dropped
+        let client = UpstreamClient::new(config, h2);
+        clients.insert(key, (config.clone(), client.clone()));
+        client
+    }
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use hyperlocal::Uri as SocketUri;
+    use std::path::Path;
+    use std::sync::atomic::{AtomicUsize, Ordering};
+    use std::sync::Arc;
+    use tempfile::TempDir;
+
+    /// HTTP/1.1 backend on `path` answering "ok"; returns its count of
+    /// accepted connections
+    fn spawn_backend(path: &Path) -> Arc<AtomicUsize> {
+        let listener = tokio::net::UnixListener::bind(path).unwrap();
+        let accepted = Arc::new(AtomicUsize::new(0));
+        let count = accepted.clone();
+        tokio::spawn(async move {
+            loop {
+                let (stream, _) = listener.accept().await.unwrap();
+                count.fetch_add(1, Ordering::SeqCst);
+                tokio::spawn(async move {
+                    let service = hyper::service::service_fn(|_req| async {
+                        Ok::<_, std::convert::Infallible>(hyper::Response::new(Body::from("ok")))
+                    });
+                    hyper::server::conn::http1::Builder::new()
+                        .serve_connection(hyper_util::rt::TokioIo::new(stream), service)
+                        .await
+                        .ok();
+                });
+            }
+        });
+        accepted
+    }
+
+    /// Send `count` requests one after another, reading each response
+    async fn send(client: &UpstreamClient, socket: &Path, count: usize) {
+        for _ in 0..count {
+            let req = Request::builder()
+                .uri(SocketUri::new(socket, "/"))
+                .body(Body::empty())
+                .unwrap();
+            let response = client.request(req).await.unwrap();
+            let body = axum::body::to_bytes(Body::new(response.into_body()), 1024)
+                .await
+                .unwrap();
+            assert_eq!(body, "ok");
+            // The finished connection goes back to the pool from a spawned task
+            tokio::time::sleep(Duration::from_millis(20)).await;
+        }
+    }
+
+    #[tokio::test]
+    async fn test_connections_are_reused() {
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("app.sock");
+        let accepted = spawn_backend(&socket);
+
+        let client = UpstreamClient::new(&ConnectionPoolConfig::default(), false);
+        send(&client, &socket, 5).await;
+        assert_eq!(accepted.load(Ordering::SeqCst), 1);
+    }
+
+    #[tokio::test]
+    async fn test_no_idle_connections_dials_per_request() {
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("app.sock");
+        let accepted = spawn_backend(&socket);
+
+        let config = ConnectionPoolConfig {
+            max_idle: 0,
+            ..Default::default()
+        };
+        send(&UpstreamClient::new(&config, false), &socket, 3).await;
+        assert_eq!(accepted.load(Ordering::SeqCst), 3);
+    }
+
+    #[tokio::test]
+    async fn test_connections_past_max_lifetime_are_closed() {
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("app.sock");
+        let accepted = spawn_backend(&socket);
+
+        // Every connection is already too old once its request is sent
+        let config = ConnectionPoolConfig {
+            max_lifetime: Some(0),
+            ..Default::default()
+        };
+        send(&UpstreamClient::new(&config, false), &socket, 3).await;
+        assert_eq!(accepted.load(Ordering::SeqCst), 3);
+    }
+
+    #[tokio::test]
+    async fn test_pools_rebuild_client_on_config_change() {
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("app.sock");
+        let accepted = spawn_backend(&socket);
+        let pools = UpstreamPools::new();
+        let config = ConnectionPoolConfig::default();
+
+        send(&pools.client("api", &config, false), &socket, 2).await;
+        send(&pools.client("api", &config, false), &socket, 2).await;
+        assert_eq!(accepted.load(Ordering::SeqCst), 1);
+
+        let changed = ConnectionPoolConfig {
+            max_idle: 4,
+            ..Default::default()
+        };
+        send(&pools.client("api", &changed, false), &socket, 1).await;
+        assert_eq!(accepted.load(Ordering::SeqCst), 2);
+    }
+}
@@ -0,0 +1,534 @@
+//! Event webhooks
+//!
+//! Webhooks registered through `/api/webhooks` (`ten webhook add`) are saved in
+//! the config store and get a POST of every hypervisor [`Event`] of the kinds
+//! they asked for (all kinds when they named none). The body is the event's
+//! JSON; `X-Tenement-Event` names its kind and, for webhooks with a secret,
+//! `X-Tenement-Signature` is `sha256=` and the hex HMAC-SHA256 of the body, so
+//! receivers can check it came from this server. Secrets are kept in the
+//! encrypted secret store (as `TENEMENT_WEBHOOK_{ID}`), not with the webhook.
+//! Like health webhooks, every delivery runs in its own task and failures are
+//! retried with backoff.
+
+use anyhow::{Context, Result};
+use ring::hmac;
+use serde::{Deserialize, Serialize};
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tenement::events::{Event, EventKind};
+use tenement::secret_store::SecretStore;
+use tenement::{ConfigStore, Hypervisor};
+use tokio::sync::broadcast::error::RecvError;
+
+/// Config store key holding the registered webhooks
+const WEBHOOKS_KEY: &str = "webhooks";
+
+/// Held while the registered webhooks are read, changed and written back, so
+/// registrations made at the same time aren't lost
+static WEBHOOKS: tokio::sync::Mutex<()> = tokio::sync::Mutex::const_new(());
+
+/// Header naming the event kind
+pub const EVENT_HEADER: &str = "x-tenement-event";
+
+/// Header carrying the body's HMAC, for webhooks with a secret
+pub const SIGNATURE_HEADER: &str = "x-tenement-signature";
+
+/// A registered webhook
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Webhook {
+    pub id: String,
+    pub url: String,
+    /// Kinds to send (empty for all)
+    #[serde(default)]
+    pub events: Vec<EventKind>,
+    /// Whether deliveries carry a signature; the key is in the secret store
+    #[serde(default)]
+    pub signed: bool,
+    /// RFC 3339 time it was registered
+    pub created_at: String,
+}
+
+impl Webhook {
+    /// Whether this webhook gets events of `kind`
+    pub fn wants(&self, kind: EventKind) -> bool {
+        self.events.is_empty() || self.events.contains(&kind)
+    }
+
+    /// Name of its signing secret in the secret store
+    fn secret_name(&self) -> String {
+        format!("TENEMENT_WEBHOOK_{}", self.id.to_uppercase())
+    }
+}
+
+/// Timeout and retries for one delivery
+#[derive(Debug, Clone)]
+pub struct DeliveryPolicy {
+    pub timeout: Duration,
+    pub max_retries: u32,
+    /// Wait before the first retry; doubled for each one after
+    pub backoff: Duration,
+}
+
+impl Default for DeliveryPolicy {
+    fn default() -> Self {
+        Self {
+            timeout: Duration::from_secs(10),
+            max_retries: 5,
+            backoff: Duration::from_secs(1),
+        }
+    }
+}
+
+/// Registered webhooks, oldest first
+pub async fn list_webhooks(store: &ConfigStore) -> Result<Vec<Webhook>> {
+    match store.get(WEBHOOKS_KEY).await? {
+        Some(saved) => Ok(serde_json::from_str(&saved)?),
+        None => Ok(Vec::new()),
+    }
+}
+
+/// Register a webhook for `events` (all kinds if empty), keeping its
+/// `secret` in the secret store of `data_dir`
+pub async fn add_webhook(
+    store: &ConfigStore,
+    data_dir: &Path,
+    url: &str,
+    events: Vec<EventKind>,
+    secret: Option<String>,
+) -> Result<Webhook> {
+    if !url.starts_with("http://") && !url.starts_with("https://") {
+        anyhow::bail!("Webhook URL must be http:// or https://, got '{}'", url);
+    }
+    if secret.as_deref() == Some("") {
+        anyhow::bail!("Webhook secret must not be empty");
+    }
+    let mut events = events;
+    events.sort_by_key(|kind| kind.as_str());
+    events.dedup();
+
+    let _changing = WEBHOOKS.lock().await;
+    let mut webhooks = list_webhooks(store).await?;
+    let webhook = Webhook {
+        id: new_id()?,
+        url: url.to_string(),
+        events,
+        signed: secret.is_some(),
+        created_at: chrono::Utc::now().to_rfc3339(),
+    };
+    if let Some(secret) = secret {
+        let name = webhook.secret_name();
+        update_secrets(data_dir, move |secrets| secrets.set(&name, &secret)).await?;
+    }
+    webhooks.push(webhook.clone());
+    store
+        .set(WEBHOOKS_KEY, &serde_json::to_string(&webhooks)?)
+        .await?;
+    Ok(webhook)
+}
+
+/// Unregister a webhook, and forget its secret. Returns whether it existed.
+pub async fn remove_webhook(store: &ConfigStore, data_dir: &Path, id: &str) -> Result<bool> {
+    let _changing = WEBHOOKS.lock().await;
+    let mut webhooks = list_webhooks(store).await?;
+    let Some(index) = webhooks.iter().position(|webhook| webhook.id == id) else {
+        return Ok(false);
+    };
+    let removed = webhooks.remove(index);
+    if removed.signed {
+        let name = removed.secret_name();
+        update_secrets(data_dir, move |secrets| {
+            secrets.remove(&name);
+        })
+        .await?;
+    }
+    if webhooks.is_empty() {
+        store.delete(WEBHOOKS_KEY).await?;
+    } else {
+        store
+            .set(WEBHOOKS_KEY, &serde_json::to_string(&webhooks)?)
+            .await?;
+    }
+    Ok(true)
+}
+
+/// Open the secret store of `data_dir`, change it and save it, off the runtime
+async fn update_secrets<F>(data_dir: &Path, change: F) -> Result<()>
+where
+    F: FnOnce(&mut SecretStore) + Send + 'static,
+{
+    let data_dir = data_dir.to_path_buf();
+    tokio::task::spawn_blocking(move || {
+        let mut secrets = SecretStore::open_or_init(&data_dir)?;
+        change(&mut secrets);
+        secrets.save()
+    })
+    .await?
+    .context("Failed to update the webhook secret")
+}
+
+/// The signing secrets of `webhooks`, read from the secret store of `data_dir`
+async fn secrets_of(data_dir: PathBuf, webhooks: &[Webhook]) -> Result<Vec<Option<String>>> {
+    if !webhooks.iter().any(|webhook| webhook.signed) {
+        return Ok(vec![None; webhooks.len()]);
+    }
+    let names: Vec<_> = webhooks
+        .iter()
+        .map(|webhook| webhook.signed.then(|| webhook.secret_name()))
+        .collect();
+    tokio::task::spawn_blocking(move || -> Result<Vec<Option<String>>> {
+        let secrets = SecretStore::open(&data_dir)?;
+        names
+            .iter()
+            .map(|name| match name {
+                Some(name) => secrets
+                    .get(name)
+                    .map(|secret| Some(secret.to_string()))
+                    .with_context(|| format!("Secret {} is missing", name)),
+                None => Ok(None),
+            })
+            .collect()
+    })
+    .await?
+}
+
+/// A random webhook ID (16 hex characters)
+fn new_id() -> Result<String> {
+    use ring::rand::SecureRandom;
+    let mut bytes = [0u8; 8];
+    ring::rand::SystemRandom::new()
+        .fill(&mut bytes)
+        .map_err(|_| anyhow::anyhow!("Failed to generate a webhook ID"))?;
+    Ok(hex(&bytes))
+}
+
+fn hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// The signature header's value for `body` under `secret`
+pub fn sign(secret: &str, body: &[u8]) -> String {
+    let key = hmac::Key::new(hmac::HMAC_SHA256, secret.as_bytes());
+    format!("sha256={}", hex(hmac::sign(&key, body).as_ref()))
+}
+
+/// Send every event to the webhooks registered for it, as they are at the time
+pub fn spawn_webhooks(
+    hypervisor: &Hypervisor,
+    store: Arc<ConfigStore>,
+    policy: DeliveryPolicy,
+) -> tokio::task::JoinHandle<()> {
+    let mut events = hypervisor.subscribe_events();
+    let data_dir = hypervisor.config().settings.data_dir.clone();
+    let client = reqwest::Client::new();
+    let policy = Arc::new(policy);
+
+    tokio::spawn(async move {
+        loop {
+            let event = match events.recv().await {
+                Ok(event) => event,
+                Err(RecvError::Lagged(skipped)) => {
+                    tracing::warn!("Event webhooks fell behind; dropped {} event(s)", skipped);
+                    continue;
+                }
+                Err(RecvError::Closed) => break,
+            };
+            let webhooks = match list_webhooks(&store).await {
+                Ok(webhooks) => webhooks,
+                Err(e) => {
+                    tracing::error!("Failed to read webhooks: {}", e);
+                    continue;
+                }
+            };
+            let wanted: Vec<_> = webhooks
+                .into_iter()
+                .filter(|w| w.wants(event.event))
+                .collect();
+            if wanted.is_empty() {
+                continue;
+            }
+            let secrets = match secrets_of(data_dir.clone(), &wanted).await {
+                Ok(secrets) => secrets,
+                Err(e) => {
+                    tracing::error!("Failed to read webhook secrets: {:#}", e);
+                    continue;
+                }
+            };
+            let body = match serde_json::to_vec(&event) {
+                Ok(body) => Arc::new(body),
+                Err(e) => {
+                    tracing::error!("Failed to encode {} event: {}", event.event, e);
+                    continue;
+                }
+            };
+            let kind = event.event;
+            for (webhook, secret) in wanted.into_iter().zip(secrets) {
+                let (client, policy, body) = (client.clone(), policy.clone(), body.clone());
+                tokio::spawn(async move {
+                    let secret = secret.as_deref();
+                    deliver(&client, &webhook, secret, kind, &body, &policy).await;
+                });
+            }
+        }
+    })
+}
+
+/// POST an event's `body`, signed with `secret` if there is one, retrying
+/// failures with doubling backoff. Returns whether it got a 2xx.
+pub async fn deliver(
+    client: &reqwest::Client,
+    webhook: &Webhook,
+    secret: Option<&str>,
+    kind: EventKind,
+    body: &[u8],
+    policy: &DeliveryPolicy,
+) -> bool {
+    let signature = secret.map(|secret| sign(secret, body));
+    let attempts = policy.max_retries + 1;
+    let mut backoff = policy.backoff;
+    for attempt in 1..=attempts {
+        if attempt > 1 {
+            tokio::time::sleep(backoff).await;
+            backoff = backoff.saturating_mul(2);
+        }
+        let mut request = client
+            .post(&webhook.url)
+            .timeout(policy.timeout)
+            .header(reqwest::header::CONTENT_TYPE, "application/json")
+            .header(EVENT_HEADER, kind.as_str())
+            .body(body.to_vec());
+        if let Some(signature) = &signature {
+            request = request.header(SIGNATURE_HEADER, signature);
+        }
+        match request.send().await {
+            Ok(resp) if resp.status().is_success() => return true,
+            Ok(resp) => tracing::warn!(
+                "Webhook {} returned {} (attempt {}/{})",
+                webhook.id,
+                resp.status(),
+                attempt,
+                attempts
+            ),
+            Err(e) => tracing::warn!(
+                "Webhook {} failed: {} (attempt {}/{})",
+                webhook.id,
+                e,
+                attempt,
+                attempts
+            ),
+        }
+    }
+    tracing::error!("Gave up on webhook {} for a {} event", webhook.id, kind);
+    false
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use axum::{extract::State, http::HeaderMap, http::StatusCode, routing::post, Router};
+    use std::sync::atomic::{AtomicU32, Ordering};
+    use tokio::sync::mpsc;
+
+    #[derive(Clone)]
+    struct Stub {
+        received: mpsc::UnboundedSender<(HeaderMap, String)>,
+        /// Requests still to answer with a 500
+        failures_left: Arc<AtomicU32>,
+    }
+
+    async fn stub_handler(
+        State(stub): State<Stub>,
+        headers: HeaderMap,
+        body: String,
+    ) -> StatusCode {
+        stub.received.send((headers, body)).ok();
+        let failing = stub
+            .failures_left
+            .fetch_update(Ordering::SeqCst, Ordering::SeqCst, |n| n.checked_sub(1))
+            .is_ok();
+        if failing {
+            StatusCode::INTERNAL_SERVER_ERROR
+        } else {
+            StatusCode::NO_CONTENT
+        }
+    }
+
+    /// Webhook receiver that records every request it's sent
+    async fn spawn_stub(failures: u32) -> (String, mpsc::UnboundedReceiver<(HeaderMap, String)>) {
+        let (tx, rx) = mpsc::unbounded_channel();
+        let stub = Stub {
+            received: tx,
+            failures_left: Arc::new(AtomicU32::new(failures)),
+        };
+        let app = Router::new()
+            .route("/hook", post(stub_handler))
+            .with_state(stub);
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        tokio::spawn(async move { axum::serve(listener, app).await.unwrap() });
+        (format!("http://{}/hook", addr), rx)
+    }
+
+    async fn test_store() -> (Arc<ConfigStore>, tempfile::TempDir) {
+        let dir = tempfile::tempdir().unwrap();
+        let pool = tenement::init_db(&dir.path().join("test.db"))
+            .await
+            .unwrap();
+        (Arc::new(ConfigStore::new(pool)), dir)
+    }
+
+    fn fast() -> DeliveryPolicy {
+        DeliveryPolicy {
+            timeout: Duration::from_secs(1),
+            max_retries: 3,
+            backoff: Duration::from_millis(10),
+        }
+    }
+
+    #[test]
+    fn test_signature() {
+        // RFC 4231 test case 2
+        assert_eq!(
+            sign("Jefe", b"what do ya want for nothing?"),
+            "sha256=5bdcc146bf60754e6a042426089575c75a003f089d2739839dec58b964ec3843"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_add_list_remove() {
+        let (store, dir) = test_store().await;
+        let data_dir = dir.path();
+        assert!(list_webhooks(&store).await.unwrap().is_empty());
+        let ftp = add_webhook(&store, data_dir, "ftp://example.com", vec![], None).await;
+        assert!(ftp.is_err());
+
+        let events = vec![EventKind::Crashed, EventKind::Deployed, EventKind::Crashed];
+        let crashes = add_webhook(&store, data_dir, "https://example.com/a", events, None)
+            .await
+            .unwrap();
+        assert_eq!(
+            crashes.events,
+            vec![EventKind::Crashed, EventKind::Deployed]
+        );
+        assert!(crashes.wants(EventKind::Crashed));
+        assert!(!crashes.wants(EventKind::Started));
+        let secret = Some("s3cret".to_string());
+        let all = add_webhook(&store, data_dir, "https://example.com/b", vec![], secret)
+            .await
+            .unwrap();
+        assert!(all.wants(EventKind::CertRenewed));
+        assert!(all.signed && !crashes.signed);
+        assert_ne!(crashes.id, all.id);
+        assert_eq!(
+            list_webhooks(&store).await.unwrap(),
+            vec![crashes.clone(), all.clone()]
+        );
+        // The secret is only in the secret store
+        let saved = store.get(WEBHOOKS_KEY).await.unwrap().unwrap();
+        assert!(!saved.contains("s3cret"), "{}", saved);
+        let secrets = secrets_of(data_dir.to_path_buf(), &[crashes.clone(), all.clone()]);
+        assert_eq!(secrets.await.unwrap(), [None, Some("s3cret".to_string())]);
+
+        assert!(remove_webhook(&store, data_dir, &crashes.id).await.unwrap());
+        assert!(!remove_webhook(&store, data_dir, &crashes.id).await.unwrap());
+        assert_eq!(list_webhooks(&store).await.unwrap().len(), 1);
+        assert!(remove_webhook(&store, data_dir, &all.id).await.unwrap());
+        let secrets = SecretStore::open(data_dir).unwrap();
+        assert_eq!(secrets.names().count(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_concurrent_adds_are_kept() {
+        let (store, dir) = test_store().await;
+        let adds = (0..10).map(|i| {
+            let (store, data_dir) = (store.clone(), dir.path().to_path_buf());
+            tokio::spawn(async move {
+                let url = format!("https://example.com/{}", i);
+                add_webhook(&store, &data_dir, &url, vec![], None).await
+            })
+        });
+        for add in adds.collect::<Vec<_>>() {
+            add.await.unwrap().unwrap();
+        }
+        assert_eq!(list_webhooks(&store).await.unwrap().len(), 10);
+    }
+
+    #[tokio::test]
+    async fn test_delivers_matching_events_signed() {
+        let (url, mut received) = spawn_stub(0).await;
+        let (store, dir) = test_store().await;
+        let mut config = tenement::Config::default();
+        config.settings.data_dir = dir.path().to_path_buf();
+        let hypervisor = Hypervisor::new(config);
+        add_webhook(
+            &store,
+            dir.path(),
+            &url,
+            vec![EventKind::Crashed],
+            Some("secret".into()),
+        )
+        .await
+        .unwrap();
+        spawn_webhooks(&hypervisor, store.clone(), fast());
+
+        // Not a kind it asked for
+        let instance = tenement::InstanceId::new("api", "prod");
+        hypervisor.emit(Event::for_instance(
+            EventKind::Started,
+            &instance,
+            serde_json::json!({}),
+        ));
+        hypervisor.emit(Event::for_instance(
+            EventKind::Crashed,
+            &instance,
+            serde_json::json!({ "pid": 42 }),
+        ));
+
+        let (headers, body) = tokio::time::timeout(Duration::from_secs(5), received.recv())
+            .await
+            .expect("webhook called")
+            .unwrap();
+        assert_eq!(headers[EVENT_HEADER], "crashed");
+        assert_eq!(
+            headers[SIGNATURE_HEADER],
+            sign("secret", body.as_bytes()).as_str()
+        );
+        let event: Event = serde_json::from_str(&body).unwrap();
+        assert_eq!(event.event, EventKind::Crashed);
+        assert_eq!(event.instance.as_deref(), Some("api:prod"));
+        assert_eq!(event.data["pid"], 42);
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        assert!(
+            received.try_recv().is_err(),
+            "the started event was not sent"
+        );
+    }
+
+    #[tokio::test]
+    async fn test_retries_until_delivered() {
+        let (url, mut received) = spawn_stub(2).await;
+        let webhook = Webhook {
+            id: "1".to_string(),
+            url,
+            events: vec![],
+            signed: false,
+            created_at: chrono::Utc::now().to_rfc3339(),
+        };
+        let client = reqwest::Client::new();
+
+        let kind = EventKind::Deployed;
+        assert!(deliver(&client, &webhook, None, kind, b"{}", &fast()).await);
+        for _ in 0..3 {
+            let (headers, _) = received.recv().await.unwrap();
+            assert!(headers.get(SIGNATURE_HEADER).is_none());
+        }
+        assert!(
+            received.try_recv().is_err(),
+            "no attempts after the first success"
+        );
+
+        let (url, _received) = spawn_stub(u32::MAX).await;
+        let webhook = Webhook { url, ..webhook };
+        assert!(!deliver(&client, &webhook, None, kind, b"{}", &fast()).await);
+    }
+}
@@ -8,7 +8,8 @@ use hyper_util::{client::legacy::Client, rt::TokioExecutor};
 use std::sync::Arc;
 use tempfile::TempDir;
 use tenement::{generate_token, init_db, Config, ConfigStore, Hypervisor, TokenStore};
-use tenement_cli::server::{create_router, AppState, TlsStatus};
+use tenement_cli::server::{create_router, AppState, TlsStatus, WarmConnector};
+use tenement_cli::upstream_pool::UpstreamPools;
 
 /// Create test state with auth token.
 /// Returns (TestServer, token, config_store, temp_dir) - temp_dir must be kept alive during test.
@@ -18,7 +19,9 @@ async fn setup_test_server() -> (TestServer, String, Arc<ConfigStore>, TempDir)
     let pool = init_db(&db_path).await.unwrap();
     let config_store = Arc::new(ConfigStore::new(pool.clone()));
     let deploy_log = Arc::new(tenement::DeployLogStore::new(pool.clone()));
-    let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool));
+    let releases = Arc::new(tenement::ReleaseStore::new(pool.clone()));
+    let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool.clone()));
+    let api_tokens = Arc::new(tenement::ApiTokenStore::new(pool));
 
     // Generate and store a test token
     let token_store = TokenStore::new(&config_store);
@@ -26,16 +29,23 @@ async fn setup_test_server() -> (TestServer, String, Arc<ConfigStore>, TempDir)
 
     let config = Config::default();
     let hypervisor = Hypervisor::new(config);
-    let client = Client::builder(TokioExecutor::new()).build_http();
-    let unix_client = Client::builder(TokioExecutor::new()).build(hyperlocal::UnixConnector);
+    let client = Client::builder(TokioExecutor::new())
+        .build(WarmConnector::new(hypervisor.warm_pool()));
+    let h2_client = Client::builder(TokioExecutor::new())
+        .http2_only(true)
+        .build(WarmConnector::new(hypervisor.warm_pool()));
     let state = AppState {
         hypervisor,
         domain: "example.com".to_string(),
         client,
-        unix_client,
+        h2_client,
+        upstream_pools: Arc::new(UpstreamPools::new()),
         config_store: config_store.clone(),
         deploy_log: deploy_log.clone(),
+        releases,
         tenant_tokens: tenant_tokens.clone(),
+        api_tokens,
+        admin_tokens: tenement::AdminTokens::empty(),
         tls_status: TlsStatus::default(),
         auth_failures: std::sync::Arc::new(tokio::sync::RwLock::new((0, None))),
     };
@@ -770,21 +780,30 @@ async fn test_no_token_configured() {
     let pool = init_db(&db_path).await.unwrap();
     let config_store = Arc::new(ConfigStore::new(pool.clone()));
     let deploy_log = Arc::new(tenement::DeployLogStore::new(pool.clone()));
-    let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool));
+    let releases = Arc::new(tenement::ReleaseStore::new(pool.clone()));
+    let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool.clone()));
+    let api_tokens = Arc::new(tenement::ApiTokenStore::new(pool));
 
     // Don't generate a token - leave it empty
     let config = Config::default();
     let hypervisor = Hypervisor::new(config);
-    let client = Client::builder(TokioExecutor::new()).build_http();
-    let unix_client = Client::builder(TokioExecutor::new()).build(hyperlocal::UnixConnector);
+    let client = Client::builder(TokioExecutor::new())
+        .build(WarmConnector::new(hypervisor.warm_pool()));
+    let h2_client = Client::builder(TokioExecutor::new())
+        .http2_only(true)
+        .build(WarmConnector::new(hypervisor.warm_pool()));
     let state = AppState {
         hypervisor,
         domain: "example.com".to_string(),
         client,
-        unix_client,
+        h2_client,
+        upstream_pools: Arc::new(UpstreamPools::new()),
         config_store,
         deploy_log,
+        releases,
         tenant_tokens,
+        api_tokens,
+        admin_tokens: tenement::AdminTokens::empty(),
         tls_status: TlsStatus::default(),
         auth_failures: std::sync::Arc::new(tokio::sync::RwLock::new((0, None))),
     };
@@ -28,7 +28,8 @@ fn unique_id(prefix: &str) -> String {
 use tenement::config::ProcessConfig;
 use tenement::runtime::RuntimeType;
 use tenement::{init_db, Config, ConfigStore, Hypervisor, TokenStore};
-use tenement_cli::server::{create_router, AppState, TlsStatus};
+use tenement_cli::server::{create_router, AppState, TlsStatus, WarmConnector};
+use tenement_cli::upstream_pool::UpstreamPools;
 
 /// Create a simple script that touches the socket file and sleeps
 fn create_touch_socket_script(dir: &TempDir) -> std::path::PathBuf {
@@ -79,6 +80,8 @@ fn test_config_with_process(name: &str, command: &str, args: Vec<&str>) -> Confi
         command: command.to_string(),
         args: args.into_iter().map(|s| s.to_string()).collect(),
         socket: format!("/tmp/tenement-{test_id}-{{name}}-{{id}}.sock"),
+        unix_socket: Default::default(),
+        connection_pool: Default::default(),
         isolation: RuntimeType::Process,
         health: None,
         env: HashMap::new(),
@@ -98,6 +101,62 @@ fn test_config_with_process(name: &str, command: &str, args: Vec<&str>) -> Confi
         vsock_port: 5000,
         storage_quota_mb: None,
         storage_persist: false,
+        secrets: HashMap::new(),
+        reload_signal: None,
+        fault: None,
+        concurrency_weight: 1,
+        shell: None,
+        health_check: Default::default(),
+        readiness: None,
+        warm_connections: 0,
+        log_rate_limit: None,
+        tmp_dir: false,
+        required_env: Vec::new(),
+        redact_env: Vec::new(),
+        post_stop: None,
+        post_stop_timeout: 10,
+        stop_signal: None,
+        stop_timeout: None,
+        stop_process_group: true,
+        hooks: Default::default(),
+        domains: Vec::new(),
+        replicas: 1,
+        load_balance: Default::default(),
+        slow_start: None,
+        autoscale: None,
+        access: None,
+        compression: None,
+        cache: None,
+        preview: None,
+        env_files: Vec::new(),
+        log_sinks: Vec::new(),
+        limits: Default::default(),
+        filesystem: Default::default(),
+        egress: None,
+        volumes: Default::default(),
+        listen: None,
+        user: None,
+        group: None,
+        depends_on: Default::default(),
+        stack: None,
+        uses: Vec::new(),
+        middleware: Vec::new(),
+        deploy: Default::default(),
+        git: None,
+        stream_idle_timeout: None,
+        protocol: Default::default(),
+        rate_limit: None,
+        max_concurrency: None,
+        max_queue: None,
+        queue_timeout_ms: None,
+        retry: None,
+        circuit_breaker: None,
+        maintenance_page: None,
+        kind: Default::default(),
+        root: None,
+        spa: false,
+        cache_max_age: 3600,
+        access_log: None,
     };
 
     config.service.insert(name.to_string(), process);
@@ -122,29 +181,44 @@ async fn setup_with_process(
     process_name: &str,
     script_path: &std::path::Path,
 ) -> (TestServer, String, Arc<Hypervisor>, TempDir) {
+    let config = test_config_with_process(process_name, script_path.to_str().unwrap(), vec![]);
+    setup_with_config(config).await
+}
+
+/// Setup test server with the given config.
+/// Returns (TestServer, token, hypervisor, db_dir)
+async fn setup_with_config(config: Config) -> (TestServer, String, Arc<Hypervisor>, TempDir) {
     let db_dir = TempDir::new().unwrap();
     let db_path = db_dir.path().join("test.db");
     let pool = init_db(&db_path).await.unwrap();
     let config_store = Arc::new(ConfigStore::new(pool.clone()));
     let deploy_log = Arc::new(tenement::DeployLogStore::new(pool.clone()));
-    let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool));
+    let releases = Arc::new(tenement::ReleaseStore::new(pool.clone()));
+    let tenant_tokens = Arc::new(tenement::TenantTokenStore::new(pool.clone()));
+    let api_tokens = Arc::new(tenement::ApiTokenStore::new(pool));
 
     // Generate and store a test token
     let token_store = TokenStore::new(&config_store);
     let token = token_store.generate_and_store().await.unwrap();
 
-    let config = test_config_with_process(process_name, script_path.to_str().unwrap(), vec![]);
     let hypervisor = Hypervisor::new(config);
-    let client = Client::builder(TokioExecutor::new()).build_http();
-    let unix_client = Client::builder(TokioExecutor::new()).build(hyperlocal::UnixConnector);
+    let client = Client::builder(TokioExecutor::new())
+        .build(WarmConnector::new(hypervisor.warm_pool()));
+    let h2_client = Client::builder(TokioExecutor::new())
+        .http2_only(true)
+        .build(WarmConnector::new(hypervisor.warm_pool()));
     let state = AppState {
         hypervisor: hypervisor.clone(),
         domain: "example.com".to_string(),
         client,
-        unix_client,
+        h2_client,
+        upstream_pools: Arc::new(UpstreamPools::new()),
         config_store,
         deploy_log,
+        releases,
         tenant_tokens,
+        api_tokens,
+        admin_tokens: tenement::AdminTokens::empty(),
         tls_status: TlsStatus::default(),
         auth_failures: std::sync::Arc::new(tokio::sync::RwLock::new((0, None))),
     };
@@ -677,6 +751,8 @@ async fn test_spawn_bad_command_fails() {
         command: "/nonexistent/binary/that/does/not/exist".to_string(),
         args: vec![],
         socket: "/tmp/{name}-{id}.sock".to_string(),
+        unix_socket: Default::default(),
+        connection_pool: Default::default(),
         isolation: RuntimeType::Process,
         health: None,
         env: HashMap::new(),
@@ -696,6 +772,62 @@ async fn test_spawn_bad_command_fails() {
         vsock_port: 5000,
         storage_quota_mb: None,
         storage_persist: false,
+        secrets: HashMap::new(),
+        reload_signal: None,
+        fault: None,
+        concurrency_weight: 1,
+        shell: None,
+        health_check: Default::default(),
+        readiness: None,
+        warm_connections: 0,
+        log_rate_limit: None,
+        tmp_dir: false,
+        required_env: Vec::new(),
+        redact_env: Vec::new(),
+        post_stop: None,
+        post_stop_timeout: 10,
+        stop_signal: None,
+        stop_timeout: None,
+        stop_process_group: true,
+        hooks: Default::default(),
+        domains: Vec::new(),
+        replicas: 1,
+        load_balance: Default::default(),
+        slow_start: None,
+        autoscale: None,
+        access: None,
+        compression: None,
+        cache: None,
+        preview: None,
+        env_files: Vec::new(),
+        log_sinks: Vec::new(),
+        limits: Default::default(),
+        filesystem: Default::default(),
+        egress: None,
+        volumes: Default::default(),
+        listen: None,
+        user: None,
+        group: None,
+        depends_on: Default::default(),
+        stack: None,
+        uses: Vec::new(),
+        middleware: Vec::new(),
+        deploy: Default::default(),
+        git: None,
+        stream_idle_timeout: None,
+        protocol: Default::default(),
+        rate_limit: None,
+        max_concurrency: None,
+        max_queue: None,
+        queue_timeout_ms: None,
+        retry: None,
+        circuit_breaker: None,
+        maintenance_page: None,
+        kind: Default::default(),
+        root: None,
+        spa: false,
+        cache_max_age: 3600,
+        access_log: None,
     };
     config.service.insert("badcmd".to_string(), process);
 
@@ -1032,3 +1164,301 @@ async fn test_port_released_after_stop() {
     }
     // If we got here without running out of ports, the test passes
 }
+
+// =============================================================================
+// RELEASE / ROLLBACK INTEGRATION TESTS
+// =============================================================================
+
+/// Test that deploys are numbered and a rollback swaps back to the old version
+#[tokio::test]
+async fn test_rollback_restores_previous_release() {
+    let script_dir = TempDir::new().unwrap();
+    let script = create_touch_socket_script(&script_dir);
+    let (server, token, hypervisor, _db_dir) = setup_with_process("api", &script).await;
+    let auth = format!("Bearer {}", token);
+
+    for (version, replace) in [("v1", None), ("v2", Some("v1"))] {
+        let response = server
+            .post("/api/deploy")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({
+                "process": "api",
+                "version": version,
+                "replace": replace,
+                "timeout": 5,
+                "drain_timeout": 1,
+                "artifact": format!("/builds/{}", version)
+            }))
+            .await;
+        response.assert_status_ok();
+    }
+    assert!(hypervisor.get("api", "v1").await.is_none(), "v2 replaced v1");
+
+    let response = server
+        .post("/api/rollback")
+        .add_header("Authorization", auth.clone())
+        .json(&serde_json::json!({"process": "api", "timeout": 5, "drain_timeout": 1}))
+        .await;
+    response.assert_status_ok();
+    let json: serde_json::Value = response.json();
+    assert_eq!(json["rolled_back_to"], 1);
+    assert_eq!(json["release"], 3);
+    assert_eq!(hypervisor.get("api", "v1").await.unwrap().weight, 100);
+    assert!(hypervisor.get("api", "v2").await.is_none());
+
+    let response = server
+        .get("/api/releases/api")
+        .add_header("Authorization", auth.clone())
+        .await;
+    response.assert_status_ok();
+    let releases: Vec<tenement::Release> = response.json();
+    let summary: Vec<(u32, &str, &str)> = releases
+        .iter()
+        .map(|r| (r.number, r.version.as_str(), r.description.as_str()))
+        .collect();
+    assert_eq!(
+        summary,
+        vec![(3, "v1", "rollback to #1"), (2, "v2", "deploy"), (1, "v1", "deploy")]
+    );
+    assert_eq!(releases[0].definition.artifact.as_deref(), Some("/builds/v1"));
+
+    // Rolling back to the running release is refused
+    let response = server
+        .post("/api/rollback")
+        .add_header("Authorization", auth)
+        .json(&serde_json::json!({"process": "api", "release": 1}))
+        .await;
+    response.assert_status(axum::http::StatusCode::BAD_REQUEST);
+
+    // Cleanup
+    hypervisor.stop("api", "v1").await.ok();
+}
+
+/// Test that an artifact URL is fetched, checked and unpacked into the
+/// release dir the version then runs in
+#[tokio::test]
+async fn test_deploy_fetches_artifact_into_release_dir() {
+    let config = test_config_with_process("api", "sh", vec!["run.sh"]);
+    let data_dir = config.settings.data_dir.clone();
+    let (server, token, hypervisor, _db_dir) = setup_with_config(config).await;
+    let auth = format!("Bearer {}", token);
+
+    let build_dir = TempDir::new().unwrap();
+    let artifact = build_dir.path().join("run.sh");
+    let app = "pwd > cwd\ntouch \"$SOCKET_PATH\"\nsleep 30\n";
+    std::fs::write(&artifact, app).unwrap();
+    let sha256 = ring::digest::digest(&ring::digest::SHA256, app.as_bytes());
+    let sha256: String = sha256.as_ref().iter().map(|b| format!("{:02x}", b)).collect();
+    let url = format!("file://{}", artifact.display());
+    let deploy = |checksum: String| {
+        serde_json::json!({
+            "process": "api",
+            "version": "v1",
+            "timeout": 5,
+            "artifact": url,
+            "checksum": checksum
+        })
+    };
+
+    let response = server
+        .post("/api/deploy")
+        .add_header("Authorization", auth.clone())
+        .json(&deploy(format!("sha256:{}", "0".repeat(64))))
+        .await;
+    response.assert_status(axum::http::StatusCode::BAD_REQUEST);
+    let json: serde_json::Value = response.json();
+    assert!(json["error"].as_str().unwrap().contains("Checksum mismatch"), "{}", json);
+    assert!(hypervisor.get("api", "v1").await.is_none());
+
+    let response = server
+        .post("/api/deploy")
+        .add_header("Authorization", auth.clone())
+        .json(&deploy(format!("sha256:{}", sha256)))
+        .await;
+    response.assert_status_ok();
+    let release_dir = tenement::artifact::release_dir(&data_dir, "api", "v1");
+    let cwd = std::fs::read_to_string(release_dir.join("cwd")).unwrap();
+    assert_eq!(cwd.trim(), release_dir.canonicalize().unwrap().display().to_string());
+
+    let response = server
+        .get("/api/releases/api")
+        .add_header("Authorization", auth.clone())
+        .await;
+    let releases: Vec<tenement::Release> = response.json();
+    assert_eq!(releases[0].definition.artifact.as_deref(), Some(url.as_str()));
+    let workdir = releases[0].definition.workdir.as_deref();
+    assert_eq!(workdir, Some(release_dir.display().to_string().as_str()));
+
+    // The running version's release dir can't be unpacked over
+    let response = server
+        .post("/api/deploy")
+        .add_header("Authorization", auth.clone())
+        .json(&deploy(sha256.clone()))
+        .await;
+    response.assert_status(axum::http::StatusCode::CONFLICT);
+
+    let response = server
+        .post("/api/deploy")
+        .add_header("Authorization", auth)
+        .json(&serde_json::json!({"process": "api", "version": "v2", "artifact": "gs://b/api"}))
+        .await;
+    response.assert_status(axum::http::StatusCode::BAD_REQUEST);
+
+    // Cleanup
+    hypervisor.stop("api", "v1").await.ok();
+}
+
+// =============================================================================
+// GIT PUSH DEPLOY INTEGRATION TESTS
+// =============================================================================
+
+/// Run git in `dir`, returning its trimmed stdout
+fn git(dir: &std::path::Path, args: &[&str]) -> String {
+    let output = std::process::Command::new("git")
+        .args(["-c", "user.name=test", "-c", "user.email=test@example.com"])
+        .args(args)
+        .current_dir(dir)
+        .output()
+        .unwrap();
+    assert!(output.status.success(), "git {:?}: {:?}", args, output);
+    String::from_utf8_lossy(&output.stdout).trim().to_string()
+}
+
+/// Test that a pushed commit is built in its own release dir and deployed with
+/// its SHA as APP_VERSION, and that the next push replaces it
+#[tokio::test]
+async fn test_git_deploy_builds_and_replaces() {
+    let mut config = test_config_with_process("api", "sh", vec!["run.sh"]);
+    let git_config = tenement::config::GitConfig {
+        build: Some("echo building $APP_VERSION; echo built > BUILT".to_string()),
+        ..Default::default()
+    };
+    config.service.get_mut("api").unwrap().git = Some(git_config.clone());
+    let data_dir = config.settings.data_dir.clone();
+    let (server, token, hypervisor, _db_dir) = setup_with_config(config).await;
+    let auth = format!("Bearer {}", token);
+
+    let hook = vec!["true".to_string()];
+    let repo = tenement::git_deploy::init_repo(&data_dir, "api", &git_config, &hook)
+        .await
+        .unwrap();
+    let work = TempDir::new().unwrap();
+    git(work.path(), &["init", "--quiet", "--initial-branch", "main"]);
+    let app = "echo \"$APP_VERSION\" > app_version\ntouch \"$SOCKET_PATH\"\nsleep 30\n";
+
+    let mut deployed = Vec::new();
+    for message in ["first", "second"] {
+        std::fs::write(work.path().join("run.sh"), format!("# {}\n{}", message, app)).unwrap();
+        git(work.path(), &["add", "run.sh"]);
+        git(work.path(), &["commit", "--quiet", "-m", message]);
+        git(work.path(), &["push", "--quiet", repo.to_str().unwrap(), "main"]);
+        let sha = git(work.path(), &["rev-parse", "HEAD"]);
+
+        let response = server
+            .post("/api/git/api/deploy")
+            .add_header("Authorization", auth.clone())
+            .json(&serde_json::json!({"revision": sha, "timeout": 5, "drain_timeout": 1}))
+            .await;
+        response.assert_status_ok();
+        let json: serde_json::Value = response.json();
+        assert_eq!(json["sha"], sha);
+        assert_eq!(json["build_output"], format!("building {}\n", sha));
+        assert_eq!(json["instance"], format!("api:{}", &sha[..7]));
+        deployed.push(sha);
+    }
+    let (first, second) = (&deployed[0][..7], &deployed[1][..7]);
+    assert!(hypervisor.get("api", first).await.is_none(), "second push replaced the first");
+    assert_eq!(hypervisor.get("api", second).await.unwrap().weight, 100);
+
+    // The instance runs in its checkout, with the commit as APP_VERSION
+    let release_dir = tenement::git_deploy::release_dir(&data_dir, "api", &deployed[1]);
+    assert!(release_dir.join("BUILT").exists());
+    let app_version = std::fs::read_to_string(release_dir.join("app_version")).unwrap();
+    assert_eq!(app_version.trim(), deployed[1]);
+
+    let response = server
+        .get("/api/releases/api")
+        .add_header("Authorization", auth.clone())
+        .await;
+    let releases: Vec<tenement::Release> = response.json();
+    assert_eq!(releases[0].version, second);
+    assert_eq!(releases[0].definition.app_version.as_deref(), Some(deployed[1].as_str()));
+
+    // Deploying the running commit again would rewrite its working directory
+    let response = server
+        .post("/api/git/api/deploy")
+        .add_header("Authorization", auth)
+        .json(&serde_json::json!({"revision": "main"}))
+        .await;
+    response.assert_status(axum::http::StatusCode::CONFLICT);
+
+    // Cleanup
+    hypervisor.stop("api", second).await.ok();
+}
+
+/// Test that a service with `detect` and no command builds and starts each
+/// push the way its files say
+#[tokio::test]
+async fn test_git_deploy_detects_build_and_start() {
+    let mut config = test_config_with_process("api", "", vec![]);
+    let git_config = tenement::config::GitConfig {
+        detect: true,
+        ..Default::default()
+    };
+    config.service.get_mut("api").unwrap().git = Some(git_config.clone());
+    let data_dir = config.settings.data_dir.clone();
+    let (server, token, hypervisor, _db_dir) = setup_with_config(config).await;
+    let auth = format!("Bearer {}", token);
+
+    let hook = vec!["true".to_string()];
+    let repo = tenement::git_deploy::init_repo(&data_dir, "api", &git_config, &hook)
+        .await
+        .unwrap();
+    let work = TempDir::new().unwrap();
+    git(work.path(), &["init", "--quiet", "--initial-branch", "main"]);
+    let app = "touch \"$SOCKET_PATH\"\nsleep 30\n";
+    std::fs::write(work.path().join("run.sh"), app).unwrap();
+    git(work.path(), &["add", "run.sh"]);
+    git(work.path(), &["commit", "--quiet", "-m", "app"]);
+    git(work.path(), &["push", "--quiet", repo.to_str().unwrap(), "main"]);
+
+    // Nothing says how to start it yet
+    let response = server
+        .post("/api/git/api/deploy")
+        .add_header("Authorization", auth.clone())
+        .json(&serde_json::json!({"revision": "main", "timeout": 5}))
+        .await;
+    response.assert_status(axum::http::StatusCode::BAD_REQUEST);
+    assert!(response.text().contains("Procfile"), "{}", response.text());
+
+    let nixpacks = "[phases.build]\ncmds = [\"echo built > BUILT\"]\n";
+    std::fs::write(work.path().join("nixpacks.toml"), nixpacks).unwrap();
+    std::fs::write(work.path().join("Procfile"), "web: sh run.sh\n").unwrap();
+    git(work.path(), &["add", "."]);
+    git(work.path(), &["commit", "--quiet", "-m", "procfile"]);
+    git(work.path(), &["push", "--quiet", repo.to_str().unwrap(), "main"]);
+    let sha = git(work.path(), &["rev-parse", "HEAD"]);
+
+    let response = server
+        .post("/api/git/api/deploy")
+        .add_header("Authorization", auth.clone())
+        .json(&serde_json::json!({"revision": sha, "timeout": 5}))
+        .await;
+    response.assert_status_ok();
+    let version = &sha[..7];
+    assert!(hypervisor.is_running("api", version).await);
+    let release_dir = tenement::git_deploy::release_dir(&data_dir, "api", &sha);
+    assert!(release_dir.join("BUILT").exists());
+
+    // The release records the detected start, so a rollback runs it too
+    let response = server
+        .get("/api/releases/api")
+        .add_header("Authorization", auth)
+        .await;
+    let releases: Vec<tenement::Release> = response.json();
+    assert_eq!(releases[0].definition.command, "sh");
+    assert_eq!(releases[0].definition.args, vec!["-c", "exec sh run.sh"]);
+
+    // Cleanup
+    hypervisor.stop("api", version).await.ok();
+}
@@ -19,6 +19,7 @@ use axum::{
 use axum_test::TestServer;
 use std::path::PathBuf;
 use tempfile::TempDir;
+use tenement::config::AcmeChallenge;
 
 // Re-export TlsOptions for testing
 use tenement_cli::server::TlsOptions;
@@ -41,6 +42,12 @@ mod tls_options_tests {
             staging: false,
             https_port: 443,
             http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         assert!(opts.enabled);
@@ -62,6 +69,12 @@ mod tls_options_tests {
             staging: true,
             https_port: 443,
             http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         assert!(opts.staging);
@@ -78,6 +91,12 @@ mod tls_options_tests {
             staging: false,
             https_port: 8443,
             http_port: 8080,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         assert_eq!(opts.https_port, 8443);
@@ -96,11 +115,76 @@ mod tls_options_tests {
             staging: false,
             https_port: 443,
             http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         assert_eq!(opts.cache_dir, cache_path);
     }
 
+    #[test]
+    fn test_certificate_domains_include_service_domains() {
+        let dir = TempDir::new().unwrap();
+        let opts = TlsOptions {
+            enabled: true,
+            email: "test@example.com".to_string(),
+            domain: "example.com".to_string(),
+            cache_dir: dir.path().to_path_buf(),
+            staging: false,
+            https_port: 443,
+            http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: vec![
+                "api.example.com".to_string(),
+                "Shop.Example.org.".to_string(),
+                "EXAMPLE.com".to_string(),
+                " ".to_string(),
+            ],
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
+        };
+
+        assert_eq!(
+            opts.certificate_domains(),
+            vec!["example.com", "api.example.com", "shop.example.org"]
+        );
+    }
+
+    #[test]
+    fn test_certificate_domains_skip_wildcard_names() {
+        let dir = TempDir::new().unwrap();
+        let opts = TlsOptions {
+            enabled: true,
+            email: "test@example.com".to_string(),
+            domain: "example.com".to_string(),
+            cache_dir: dir.path().to_path_buf(),
+            staging: false,
+            https_port: 443,
+            http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: vec![
+                "blog.apps.example.com".to_string(),
+                "apps.example.com".to_string(),
+            ],
+            wildcard_domains: vec!["*.apps.example.com".to_string()],
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
+        };
+
+        // The DNS-01 wildcard certificate serves blog; only its parent goes to TLS-ALPN
+        assert_eq!(
+            opts.certificate_domains(),
+            vec!["example.com", "apps.example.com"]
+        );
+    }
+
     #[test]
     fn test_tls_options_clone() {
         let dir = TempDir::new().unwrap();
@@ -112,6 +196,12 @@ mod tls_options_tests {
             staging: true,
             https_port: 443,
             http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         let cloned = opts.clone();
@@ -342,6 +432,27 @@ mod tls_config_tests {
         assert_eq!(config.settings.tls.http_port, 8080);
     }
 
+    #[test]
+    fn test_tls_config_ticket_rotation() {
+        assert_eq!(TlsConfig::default().ticket_rotation_secs, 3600);
+        assert_eq!(TlsConfig::default().ticket_keys_retained, 2);
+
+        let toml_str = r#"
+            [settings.tls]
+            enabled = true
+            acme_email = "test@example.com"
+            ticket_rotation_secs = 600
+            ticket_keys_retained = 1
+        "#;
+        let config = Config::from_str(toml_str).unwrap();
+        assert_eq!(config.settings.tls.ticket_rotation_secs, 600);
+        assert_eq!(config.settings.tls.ticket_keys_retained, 1);
+
+        let zero = toml_str.replace("600", "0");
+        let err = Config::from_str(&zero).unwrap_err();
+        assert!(err.to_string().contains("ticket_rotation_secs must be at least 1"));
+    }
+
     #[test]
     fn test_tls_config_cache_dir() {
         let toml_str = r#"
@@ -599,6 +710,12 @@ mod edge_case_tests {
             staging: false,
             https_port: 443,
             http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         // Empty domain is technically allowed at struct level
@@ -616,6 +733,12 @@ mod edge_case_tests {
             staging: false,
             https_port: 443,
             http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         // Empty email is technically allowed at struct level
@@ -633,6 +756,12 @@ mod edge_case_tests {
             staging: false,
             https_port: 0,
             http_port: 0,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         // Port 0 is valid at struct level (means OS picks a port)
@@ -650,6 +779,12 @@ mod edge_case_tests {
             staging: false,
             https_port: 8443,
             http_port: 8443, // Same as HTTPS - would fail at runtime
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         // Struct allows this, runtime will fail with port conflict
@@ -666,6 +801,12 @@ mod edge_case_tests {
             staging: false,
             https_port: 443,
             http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         // Unicode domains are allowed at struct level
@@ -686,6 +827,12 @@ mod edge_case_tests {
             staging: false,
             https_port: 443,
             http_port: 80,
+            ticket_rotation_secs: 3600,
+            ticket_keys_retained: 2,
+            extra_domains: Vec::new(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::TlsAlpn01,
         };
 
         assert!(opts.domain.len() > 70);
@@ -0,0 +1,379 @@
+// Package client is a Go client for the tenement admin API.
+//
+// It speaks the same API as the `ten` CLI, either over HTTP with a bearer
+// token or over the server's local admin socket ({data_dir}/admin.sock),
+// which needs no token:
+//
+//	c := client.NewUnix("/var/lib/tenement/admin.sock")
+//	apps, err := c.ListApps(ctx)
+//	_, err = c.Restart(ctx, "api")
+//
+// Every call takes a context; cancelling it aborts the request, including a
+// log stream in progress.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Client talks to one tenement server. It is safe for concurrent use.
+type Client struct {
+	baseURL string
+	token   string
+	http    *http.Client
+}
+
+// Option configures a Client.
+type Option func(*Client)
+
+// WithHTTPClient sets the underlying HTTP client (for timeouts, proxies, TLS).
+func WithHTTPClient(hc *http.Client) Option {
+	return func(c *Client) { c.http = hc }
+}
+
+// New returns a client for the server at baseURL (e.g. "http://localhost:8080"),
+// authenticating with an admin or tenant token.
+func New(baseURL, token string, opts ...Option) *Client {
+	c := &Client{
+		baseURL: strings.TrimRight(baseURL, "/"),
+		token:   token,
+		http:    &http.Client{},
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// NewUnix returns a client for the server's admin socket at socketPath.
+// The socket's file permissions stand in for a token.
+func NewUnix(socketPath string, opts ...Option) *Client {
+	var dialer net.Dialer
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+	opts = append([]Option{WithHTTPClient(&http.Client{Transport: transport})}, opts...)
+	return New("http://tenement", "", opts...)
+}
+
+// APIError is a non-2xx response from the server.
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("tenement: %s (HTTP %d)", e.Message, e.StatusCode)
+}
+
+// IsNotFound reports whether err is a 404 from the server.
+func IsNotFound(err error) bool {
+	var apiErr *APIError
+	return errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusNotFound
+}
+
+// Instance is one running instance, as listed by the server.
+type Instance struct {
+	// ID is "process:id", e.g. "api:prod".
+	ID string `json:"id"`
+	// Socket is the Unix socket path or "127.0.0.1:port" the instance listens on.
+	Socket            string  `json:"socket"`
+	UptimeSecs        uint64  `json:"uptime_secs"`
+	IdleSecs          uint64  `json:"idle_secs"`
+	Restarts          uint32  `json:"restarts"`
+	Health            string  `json:"health"`
+	Status            string  `json:"status"`
+	StorageUsedBytes  uint64  `json:"storage_used_bytes"`
+	StorageQuotaBytes *uint64 `json:"storage_quota_bytes"`
+	Weight            uint8   `json:"weight"`
+	LastStartupMs     *uint64 `json:"last_startup_ms"`
+}
+
+// App returns the process (service) name part of the instance ID.
+func (i Instance) App() string {
+	app, _, _ := strings.Cut(i.ID, ":")
+	return app
+}
+
+// App is a service with its running instances.
+type App struct {
+	Name      string
+	Instances []Instance
+}
+
+// InstanceID names an instance by process and id.
+type InstanceID struct {
+	Process string `json:"process"`
+	ID      string `json:"id"`
+}
+
+func (id InstanceID) String() string {
+	return id.Process + ":" + id.ID
+}
+
+// InstanceDetail is everything the server knows about one instance.
+type InstanceDetail struct {
+	ID                InstanceID `json:"id"`
+	Runtime           string     `json:"runtime"`
+	Socket            string     `json:"socket"`
+	Port              *uint16    `json:"port,omitempty"`
+	UptimeSecs        uint64     `json:"uptime_secs"`
+	Restarts          uint32     `json:"restarts"`
+	Health            string     `json:"health"`
+	Status            string     `json:"status"`
+	IdleSecs          uint64     `json:"idle_secs"`
+	IdleTimeout       *uint64    `json:"idle_timeout"`
+	StorageUsedBytes  uint64     `json:"storage_used_bytes"`
+	StorageQuotaBytes *uint64    `json:"storage_quota_bytes"`
+	DataDir           string     `json:"data_dir"`
+	Weight            uint8      `json:"weight"`
+	LastStartupMs     *uint64    `json:"last_startup_ms,omitempty"`
+}
+
+// Spawned is the result of starting or restarting an instance.
+type Spawned struct {
+	Instance string  `json:"instance"`
+	Socket   string  `json:"socket"`
+	Port     *uint16 `json:"port"`
+}
+
+// DeployRequest starts a new version of a service.
+type DeployRequest struct {
+	Process string `json:"process"`
+	Version string `json:"version"`
+	// Weight is the new version's traffic weight once healthy (0-100).
+	Weight uint8 `json:"weight"`
+	// Timeout is how long to wait for the new version to become healthy, in seconds.
+	Timeout uint64 `json:"timeout"`
+	// Replace names a running version to drain and stop once the new one is healthy.
+	Replace string `json:"replace,omitempty"`
+	// DrainTimeout is how long the replaced version's connections get to finish, in seconds.
+	DrainTimeout uint64 `json:"drain_timeout,omitempty"`
+}
+
+// DeployResponse is the outcome of a deploy.
+type DeployResponse struct {
+	Instance string `json:"instance"`
+	Socket   string `json:"socket"`
+	Weight   uint8  `json:"weight"`
+	Status   string `json:"status"`
+}
+
+// RouteResponse is the outcome of a traffic swap.
+type RouteResponse struct {
+	FromInstance string `json:"from_instance"`
+	ToInstance   string `json:"to_instance"`
+	FromWeight   uint8  `json:"from_weight"`
+	ToWeight     uint8  `json:"to_weight"`
+}
+
+// ListInstances returns every running instance the token can see.
+func (c *Client) ListInstances(ctx context.Context) ([]Instance, error) {
+	var instances []Instance
+	err := c.do(ctx, http.MethodGet, "/api/instances", nil, &instances)
+	return instances, err
+}
+
+// ListApps returns the running instances grouped by service, sorted by name.
+func (c *Client) ListApps(ctx context.Context) ([]App, error) {
+	instances, err := c.ListInstances(ctx)
+	if err != nil {
+		return nil, err
+	}
+	byName := map[string]*App{}
+	var apps []*App
+	for _, inst := range instances {
+		app, ok := byName[inst.App()]
+		if !ok {
+			app = &App{Name: inst.App()}
+			byName[app.Name] = app
+			apps = append(apps, app)
+		}
+		app.Instances = append(app.Instances, inst)
+	}
+	sort.Slice(apps, func(i, j int) bool { return apps[i].Name < apps[j].Name })
+	result := make([]App, len(apps))
+	for i, app := range apps {
+		result[i] = *app
+	}
+	return result, nil
+}
+
+// Inspect returns the full details of one instance ("process:id").
+func (c *Client) Inspect(ctx context.Context, instance string) (*InstanceDetail, error) {
+	var detail InstanceDetail
+	if err := c.do(ctx, http.MethodGet, "/api/instances/"+instance, nil, &detail); err != nil {
+		return nil, err
+	}
+	return &detail, nil
+}
+
+// Spawn starts instance id of process.
+func (c *Client) Spawn(ctx context.Context, process, id string) (*Spawned, error) {
+	body := map[string]string{"process": process, "id": id}
+	var spawned Spawned
+	if err := c.do(ctx, http.MethodPost, "/api/instances/spawn", body, &spawned); err != nil {
+		return nil, err
+	}
+	return &spawned, nil
+}
+
+// Stop stops one instance ("process:id").
+func (c *Client) Stop(ctx context.Context, instance string) error {
+	return c.do(ctx, http.MethodDelete, "/api/instances/"+instance, nil, nil)
+}
+
+// Restart restarts one instance ("api:prod"), or every running instance of a
+// service when given just its name ("api"). Restarts run one at a time and stop
+// at the first failure.
+func (c *Client) Restart(ctx context.Context, name string) ([]Spawned, error) {
+	targets := []string{name}
+	if !strings.Contains(name, ":") {
+		instances, err := c.ListInstances(ctx)
+		if err != nil {
+			return nil, err
+		}
+		targets = targets[:0]
+		for _, inst := range instances {
+			if inst.App() == name {
+				targets = append(targets, inst.ID)
+			}
+		}
+		if len(targets) == 0 {
+			return nil, &APIError{StatusCode: http.StatusNotFound, Message: "no running instances of " + name}
+		}
+	}
+
+	var restarted []Spawned
+	for _, target := range targets {
+		var spawned Spawned
+		path := "/api/instances/" + target + "/restart"
+		if err := c.do(ctx, http.MethodPost, path, nil, &spawned); err != nil {
+			return restarted, err
+		}
+		restarted = append(restarted, spawned)
+	}
+	return restarted, nil
+}
+
+// SetWeight sets an instance's traffic weight (0-100).
+func (c *Client) SetWeight(ctx context.Context, instance string, weight uint8) error {
+	body := map[string]uint8{"weight": weight}
+	return c.do(ctx, http.MethodPut, "/api/instances/"+instance+"/weight", body, nil)
+}
+
+// Health runs a health check on an instance and returns its status
+// ("healthy", "degraded", "unhealthy", "failed", or "unknown").
+func (c *Client) Health(ctx context.Context, instance string) (string, error) {
+	var resp struct {
+		Health string `json:"health"`
+	}
+	err := c.do(ctx, http.MethodGet, "/api/instances/"+instance+"/health", nil, &resp)
+	return resp.Health, err
+}
+
+// Deploy starts a new version and waits for it to become healthy.
+func (c *Client) Deploy(ctx context.Context, req DeployRequest) (*DeployResponse, error) {
+	var resp DeployResponse
+	if err := c.do(ctx, http.MethodPost, "/api/deploy", req, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Route moves all of process's traffic from one version to another.
+func (c *Client) Route(ctx context.Context, process, from, to string) (*RouteResponse, error) {
+	body := map[string]string{"process": process, "from": from, "to": to}
+	var resp RouteResponse
+	if err := c.do(ctx, http.MethodPost, "/api/route", body, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// do sends a JSON request and decodes a JSON response into out (if non-nil).
+func (c *Client) do(ctx context.Context, method, path string, in, out any) error {
+	resp, err := c.send(ctx, method, path, in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("tenement: decoding %s response: %w", path, err)
+	}
+	return nil
+}
+
+// send makes a request and returns the response if it was a 2xx; any other
+// status comes back as an *APIError.
+func (c *Client) send(ctx context.Context, method, path string, in any) (*http.Response, error) {
+	var body io.Reader
+	if in != nil {
+		encoded, err := json.Marshal(in)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(encoded)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	return nil, readError(resp)
+}
+
+func readError(resp *http.Response) error {
+	apiErr := &APIError{StatusCode: resp.StatusCode, Message: http.StatusText(resp.StatusCode)}
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) == nil && body.Error != "" {
+		apiErr.Message = body.Error
+	}
+	return apiErr
+}
+
+// query builds "?k=v&..." from the non-empty values, or "" if there are none.
+func query(values map[string]string) string {
+	q := url.Values{}
+	for k, v := range values {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	if len(q) == 0 {
+		return ""
+	}
+	return "?" + q.Encode()
+}
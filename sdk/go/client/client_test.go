@@ -0,0 +1,230 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeServer answers the admin API routes the tests use.
+type fakeServer struct {
+	mu        sync.Mutex
+	restarted []string
+	authSeen  []string
+}
+
+func (f *fakeServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/instances", func(w http.ResponseWriter, r *http.Request) {
+		f.record(r)
+		writeJSON(w, []Instance{
+			{ID: "web:prod", Health: "healthy", Status: "running", Weight: 100},
+			{ID: "api:prod", Health: "healthy", Status: "running", Weight: 100},
+			{ID: "api:canary", Health: "degraded", Status: "crash-looping", Restarts: 4},
+		})
+	})
+	mux.HandleFunc("GET /api/instances/{id}", func(w http.ResponseWriter, r *http.Request) {
+		if r.PathValue("id") != "api:prod" {
+			w.WriteHeader(http.StatusNotFound)
+			writeJSON(w, map[string]string{"error": "Instance not found: " + r.PathValue("id")})
+			return
+		}
+		writeJSON(w, map[string]any{
+			"id":      map[string]string{"process": "api", "id": "prod"},
+			"runtime": "process",
+			"port":    3001,
+			"health":  "healthy",
+			"status":  "running",
+		})
+	})
+	mux.HandleFunc("POST /api/instances/{id}/restart", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.restarted = append(f.restarted, r.PathValue("id"))
+		f.mu.Unlock()
+		writeJSON(w, Spawned{Instance: r.PathValue("id"), Socket: "/tmp/x.sock"})
+	})
+	mux.HandleFunc("POST /api/deploy", func(w http.ResponseWriter, r *http.Request) {
+		var req DeployRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		writeJSON(w, DeployResponse{
+			Instance: req.Process + ":" + req.Version,
+			Weight:   req.Weight,
+			Status:   "healthy",
+		})
+	})
+	mux.HandleFunc("GET /api/logs/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		flusher := w.(http.Flusher)
+		fmt.Fprint(w, ":\n\n")
+		for i := 0; i < 2; i++ {
+			entry := LogEntry{Process: r.URL.Query().Get("process"), InstanceID: "prod",
+				Level: "stdout", Message: fmt.Sprintf("line %d", i)}
+			data, _ := json.Marshal(entry)
+			fmt.Fprintf(w, "data: %s\n\n", data)
+			flusher.Flush()
+		}
+		// Hold the stream open until the client goes away
+		<-r.Context().Done()
+	})
+	return mux
+}
+
+func (f *fakeServer) record(r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.authSeen = append(f.authSeen, r.Header.Get("Authorization"))
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func newTestClient(t *testing.T) (*Client, *fakeServer) {
+	t.Helper()
+	fake := &fakeServer{}
+	srv := httptest.NewServer(fake.handler())
+	t.Cleanup(srv.Close)
+	return New(srv.URL, "secret"), fake
+}
+
+func TestListAppsGroupsInstances(t *testing.T) {
+	c, fake := newTestClient(t)
+
+	apps, err := c.ListApps(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(apps) != 2 || apps[0].Name != "api" || apps[1].Name != "web" {
+		t.Fatalf("apps = %+v", apps)
+	}
+	if len(apps[0].Instances) != 2 || apps[0].Instances[1].Status != "crash-looping" {
+		t.Fatalf("api instances = %+v", apps[0].Instances)
+	}
+	if fake.authSeen[0] != "Bearer secret" {
+		t.Fatalf("Authorization = %q", fake.authSeen[0])
+	}
+}
+
+func TestRestartAppRestartsEachInstance(t *testing.T) {
+	c, fake := newTestClient(t)
+
+	restarted, err := c.Restart(context.Background(), "api")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted) != 2 || fake.restarted[0] != "api:prod" || fake.restarted[1] != "api:canary" {
+		t.Fatalf("restarted = %v", fake.restarted)
+	}
+
+	if _, err := c.Restart(context.Background(), "web:prod"); err != nil {
+		t.Fatal(err)
+	}
+	if last := fake.restarted[len(fake.restarted)-1]; last != "web:prod" {
+		t.Fatalf("last restart = %q", last)
+	}
+
+	if _, err := c.Restart(context.Background(), "missing"); !IsNotFound(err) {
+		t.Fatalf("err = %v, want not found", err)
+	}
+}
+
+func TestInspectDecodesDetailsAndErrors(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	detail, err := c.Inspect(context.Background(), "api:prod")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if detail.ID.String() != "api:prod" || detail.Port == nil || *detail.Port != 3001 {
+		t.Fatalf("detail = %+v", detail)
+	}
+
+	_, err = c.Inspect(context.Background(), "api:gone")
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("err = %v", err)
+	}
+	if apiErr.Message != "Instance not found: api:gone" {
+		t.Fatalf("message = %q", apiErr.Message)
+	}
+}
+
+func TestDeploy(t *testing.T) {
+	c, _ := newTestClient(t)
+
+	resp, err := c.Deploy(context.Background(), DeployRequest{
+		Process: "api", Version: "v2", Weight: 100, Timeout: 30, Replace: "v1",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Instance != "api:v2" || resp.Status != "healthy" {
+		t.Fatalf("resp = %+v", resp)
+	}
+}
+
+func TestStreamLogsUntilCancelled(t *testing.T) {
+	c, _ := newTestClient(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := c.StreamLogs(ctx, StreamOptions{Process: "api"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stream.Close()
+	for i := 0; i < 2; i++ {
+		entry, err := stream.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if entry.Process != "api" || entry.Message != fmt.Sprintf("line %d", i) {
+			t.Fatalf("entry = %+v", entry)
+		}
+	}
+
+	cancel()
+	done := make(chan error, 1)
+	go func() {
+		_, err := stream.Next()
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || err == io.EOF {
+			t.Fatalf("Next after cancel = %v, want context error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Next did not return after cancel")
+	}
+}
+
+func TestUnixSocketClientSendsNoToken(t *testing.T) {
+	fake := &fakeServer{}
+	socket := filepath.Join(t.TempDir(), "admin.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: fake.handler()}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	instances, err := NewUnix(socket).ListInstances(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(instances) != 3 || fake.authSeen[0] != "" {
+		t.Fatalf("instances = %+v, auth = %q", instances, fake.authSeen)
+	}
+}
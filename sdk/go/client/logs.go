@@ -0,0 +1,114 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// LogEntry is one line of instance output.
+type LogEntry struct {
+	// Timestamp is Unix milliseconds.
+	Timestamp uint64 `json:"timestamp"`
+	// Level is "stdout" or "stderr".
+	Level      string `json:"level"`
+	Process    string `json:"process"`
+	InstanceID string `json:"instance_id"`
+	Message    string `json:"message"`
+}
+
+// LogQuery filters buffered logs. Empty fields match everything.
+type LogQuery struct {
+	Process string
+	// ID is the instance id within the process (the "prod" of "api:prod").
+	ID string
+	// Level is "stdout" or "stderr".
+	Level  string
+	Search string
+	// Limit caps the entries returned (server default when zero).
+	Limit int
+}
+
+// StreamOptions filters a live log stream. Empty fields match everything.
+type StreamOptions struct {
+	Process string
+	ID      string
+	Level   string
+}
+
+// Logs returns buffered log entries matching q.
+func (c *Client) Logs(ctx context.Context, q LogQuery) ([]LogEntry, error) {
+	params := map[string]string{
+		"process": q.Process,
+		"id":      q.ID,
+		"level":   q.Level,
+		"search":  q.Search,
+	}
+	if q.Limit > 0 {
+		params["limit"] = strconv.Itoa(q.Limit)
+	}
+	var entries []LogEntry
+	err := c.do(ctx, http.MethodGet, "/api/logs"+query(params), nil, &entries)
+	return entries, err
+}
+
+// StreamLogs follows new log entries as instances write them. Read them with
+// Next until it returns an error; cancel ctx or call Close to stop.
+func (c *Client) StreamLogs(ctx context.Context, opts StreamOptions) (*LogStream, error) {
+	params := map[string]string{
+		"process": opts.Process,
+		"id":      opts.ID,
+		"level":   opts.Level,
+	}
+	resp, err := c.send(ctx, http.MethodGet, "/api/logs/stream"+query(params), nil)
+	if err != nil {
+		return nil, err
+	}
+	return &LogStream{body: resp.Body, lines: bufio.NewScanner(resp.Body)}, nil
+}
+
+// LogStream is a live feed of log entries from the server.
+type LogStream struct {
+	body  io.ReadCloser
+	lines *bufio.Scanner
+}
+
+// Next blocks until the next entry arrives. It returns io.EOF when the server
+// ends the stream, or the context's error once it's cancelled.
+func (s *LogStream) Next() (LogEntry, error) {
+	var data strings.Builder
+	for s.lines.Scan() {
+		line := s.lines.Text()
+		if line == "" {
+			// End of an event; keep-alive comments have no data
+			if data.Len() == 0 {
+				continue
+			}
+			var entry LogEntry
+			if err := json.Unmarshal([]byte(data.String()), &entry); err != nil {
+				data.Reset()
+				continue
+			}
+			return entry, nil
+		}
+		if value, ok := strings.CutPrefix(line, "data:"); ok {
+			if data.Len() > 0 {
+				data.WriteByte('\n')
+			}
+			data.WriteString(strings.TrimPrefix(value, " "))
+		}
+	}
+	if err := s.lines.Err(); err != nil {
+		return LogEntry{}, err
+	}
+	return LogEntry{}, io.EOF
+}
+
+// Close ends the stream.
+func (s *LogStream) Close() error {
+	return s.body.Close()
+}
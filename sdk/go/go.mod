@@ -0,0 +1,3 @@
+module github.com/russellromney/tenement/sdk/go
+
+go 1.22
@@ -0,0 +1,390 @@
+//! Proxy access control: IP allow/deny lists and HTTP Basic auth
+//!
+//! A service (`[service.<name>.access]`) or route (`[routing.route.access]`)
+//! can limit which client networks reach it and make clients log in with
+//! credentials from an htpasswd-style file, for apps that have no auth of
+//! their own. The client address is the peer of the connection; an
+//! `X-Forwarded-For` it sends is not trusted.
+
+use anyhow::Result;
+use base64::{engine::general_purpose::STANDARD, Engine};
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, HashSet};
+use std::fmt;
+use std::net::IpAddr;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::{Arc, Mutex};
+use std::time::SystemTime;
+
+/// A network in CIDR notation ("10.0.0.0/8", "2001:db8::/32"), or one address
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(try_from = "String", into = "String")]
+pub struct IpNet {
+    addr: IpAddr,
+    prefix: u8,
+}
+
+impl IpNet {
+    /// Whether `ip` is in this network. IPv4-mapped IPv6 addresses
+    /// (`::ffff:10.0.0.1`) match the IPv4 networks they map to.
+    pub fn contains(&self, ip: IpAddr) -> bool {
+        let ip = match ip {
+            IpAddr::V6(v6) => v6.to_ipv4_mapped().map_or(ip, IpAddr::V4),
+            v4 => v4,
+        };
+        match (self.addr, ip) {
+            (IpAddr::V4(net), IpAddr::V4(ip)) => {
+                let mask = u32::MAX.checked_shl(32 - self.prefix as u32).unwrap_or(0);
+                u32::from(net) & mask == u32::from(ip) & mask
+            }
+            (IpAddr::V6(net), IpAddr::V6(ip)) => {
+                let mask = u128::MAX.checked_shl(128 - self.prefix as u32).unwrap_or(0);
+                u128::from(net) & mask == u128::from(ip) & mask
+            }
+            _ => false,
+        }
+    }
+}
+
+impl FromStr for IpNet {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        let (addr, prefix) = match s.trim().split_once('/') {
+            Some((addr, prefix)) => (addr, Some(prefix)),
+            None => (s.trim(), None),
+        };
+        let addr: IpAddr = addr
+            .parse()
+            .map_err(|_| anyhow::anyhow!("invalid address '{}' in '{}'", addr, s))?;
+        let max = if addr.is_ipv4() { 32 } else { 128 };
+        let prefix = match prefix {
+            Some(prefix) => prefix
+                .parse::<u8>()
+                .ok()
+                .filter(|p| *p <= max)
+                .ok_or_else(|| anyhow::anyhow!("invalid prefix length in '{}'", s))?,
+            None => max,
+        };
+        Ok(Self { addr, prefix })
+    }
+}
+
+impl TryFrom<String> for IpNet {
+    type Error = String;
+
+    fn try_from(value: String) -> std::result::Result<Self, Self::Error> {
+        value.parse().map_err(|e: anyhow::Error| e.to_string())
+    }
+}
+
+impl From<IpNet> for String {
+    fn from(net: IpNet) -> Self {
+        net.to_string()
+    }
+}
+
+impl fmt::Display for IpNet {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        write!(f, "{}/{}", self.addr, self.prefix)
+    }
+}
+
+/// Who may reach a service or route
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct AccessConfig {
+    /// Only clients in these networks (default: any)
+    #[serde(default)]
+    pub allow: Vec<IpNet>,
+
+    /// Never clients in these networks, even when `allow` matches
+    #[serde(default)]
+    pub deny: Vec<IpNet>,
+
+    /// htpasswd-style file of `user:hash` lines (bcrypt, argon2 or `{SHA}`).
+    /// Clients must log in with HTTP Basic auth as one of them.
+    #[serde(default)]
+    pub basic_auth: Option<PathBuf>,
+
+    /// Realm named in the login prompt (default: the service or route)
+    #[serde(default)]
+    pub realm: Option<String>,
+}
+
+impl AccessConfig {
+    /// Whether a client at `ip` gets past `allow` and `deny`. A client whose
+    /// address isn't known only does when neither is set.
+    pub fn allows(&self, ip: Option<IpAddr>) -> bool {
+        let Some(ip) = ip else {
+            return self.allow.is_empty() && self.deny.is_empty();
+        };
+        if self.deny.iter().any(|net| net.contains(ip)) {
+            return false;
+        }
+        self.allow.is_empty() || self.allow.iter().any(|net| net.contains(ip))
+    }
+
+    pub fn validate(&self, section: &str) -> Result<()> {
+        if self
+            .basic_auth
+            .as_ref()
+            .is_some_and(|p| p.as_os_str().is_empty())
+        {
+            anyhow::bail!("{} access.basic_auth must name an htpasswd file", section);
+        }
+        if let Some(path) = self.basic_auth.as_ref().filter(|p| !p.exists()) {
+            tracing::warn!(
+                "{} access.basic_auth file {} doesn't exist; every login will fail",
+                section,
+                path.display()
+            );
+        }
+        if self.realm.as_deref().is_some_and(|r| r.contains('"')) {
+            anyhow::bail!("{} access.realm can't contain '\"'", section);
+        }
+        Ok(())
+    }
+}
+
+/// Credentials from an htpasswd file, re-read whenever it changes. Checking a
+/// password hash is slow by design, so logins that passed are remembered (as
+/// digests) until the file changes, and only a few hashes are checked at once.
+pub struct Htpasswd {
+    path: PathBuf,
+    state: Mutex<HtpasswdState>,
+    checks: tokio::sync::Semaphore,
+}
+
+/// Logins remembered per file; past this the memory starts over
+const MAX_REMEMBERED: usize = 1024;
+
+/// Password hashes checked at once per file; more logins wait their turn
+const MAX_CHECKS: usize = 4;
+
+#[derive(Default)]
+struct HtpasswdState {
+    modified: Option<SystemTime>,
+    users: HashMap<String, String>,
+    verified: HashSet<Vec<u8>>,
+}
+
+impl Htpasswd {
+    pub fn new(path: &Path) -> Self {
+        Self {
+            path: path.to_path_buf(),
+            state: Mutex::new(HtpasswdState::default()),
+            checks: tokio::sync::Semaphore::new(MAX_CHECKS),
+        }
+    }
+
+    /// Whether `user` and `password` match an entry in the file. A missing or
+    /// unreadable file lets no one in.
+    pub fn verify(&self, user: &str, password: &str) -> bool {
+        let key = login_digest(user, password);
+        let state = self.load();
+        if state.verified.contains(key.as_ref()) {
+            return true;
+        }
+        // Not under the lock, so one slow check doesn't hold up the others
+        let hash = state.users.get(user).cloned();
+        drop(state);
+        let valid = hash.is_some_and(|hash| verify_password(password, &hash));
+        if valid {
+            let mut state = self.state.lock().unwrap();
+            if state.verified.len() >= MAX_REMEMBERED {
+                state.verified.clear();
+            }
+            state.verified.insert(key.as_ref().to_vec());
+        }
+        valid
+    }
+
+    /// [`verify`](Self::verify) without blocking the runtime: a login that
+    /// passed before answers at once, others wait for one of a few hash checks
+    pub async fn check(self: Arc<Self>, user: String, password: String) -> bool {
+        let key = login_digest(&user, &password);
+        if self.load().verified.contains(key.as_ref()) {
+            return true;
+        }
+        let Ok(_permit) = self.checks.acquire().await else {
+            return false;
+        };
+        let htpasswd = self.clone();
+        tokio::task::spawn_blocking(move || htpasswd.verify(&user, &password))
+            .await
+            .unwrap_or(false)
+    }
+
+    /// The state, re-read first if the file changed
+    fn load(&self) -> std::sync::MutexGuard<'_, HtpasswdState> {
+        let mut state = self.state.lock().unwrap();
+        let modified = std::fs::metadata(&self.path)
+            .and_then(|m| m.modified())
+            .ok();
+        if modified != state.modified {
+            *state = HtpasswdState {
+                modified,
+                users: match std::fs::read_to_string(&self.path) {
+                    Ok(content) => parse_htpasswd(&content),
+                    Err(e) => {
+                        tracing::warn!("Can't read {}: {}", self.path.display(), e);
+                        HashMap::new()
+                    }
+                },
+                verified: HashSet::new(),
+            };
+        }
+        state
+    }
+}
+
+fn login_digest(user: &str, password: &str) -> ring::digest::Digest {
+    ring::digest::digest(
+        &ring::digest::SHA256,
+        format!("{}:{}", user, password).as_bytes(),
+    )
+}
+
+/// `user:hash` entries, skipping blank lines and `#` comments
+fn parse_htpasswd(content: &str) -> HashMap<String, String> {
+    content
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .filter_map(|line| line.split_once(':'))
+        .map(|(user, hash)| (user.to_string(), hash.to_string()))
+        .collect()
+}
+
+/// Check `password` against an htpasswd hash: bcrypt (`htpasswd -B`), argon2,
+/// or `{SHA}` (`htpasswd -s`). Anything else (such as `$apr1$` MD5) never matches.
+fn verify_password(password: &str, hash: &str) -> bool {
+    if hash.starts_with("$2y$") || hash.starts_with("$2b$") || hash.starts_with("$2a$") {
+        return bcrypt::verify(password, hash).unwrap_or(false);
+    }
+    if hash.starts_with("$argon2") {
+        return crate::auth::verify_token(password, hash);
+    }
+    if let Some(encoded) = hash.strip_prefix("{SHA}") {
+        let digest =
+            ring::digest::digest(&ring::digest::SHA1_FOR_LEGACY_USE_ONLY, password.as_bytes());
+        return STANDARD
+            .decode(encoded)
+            .is_ok_and(|stored| constant_time_eq(&stored, digest.as_ref()));
+    }
+    tracing::debug!("Unsupported htpasswd hash format");
+    false
+}
+
+fn constant_time_eq(a: &[u8], b: &[u8]) -> bool {
+    a.len() == b.len() && a.iter().zip(b).fold(0, |acc, (x, y)| acc | (x ^ y)) == 0
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn net(s: &str) -> IpNet {
+        s.parse().unwrap()
+    }
+
+    fn ip(s: &str) -> IpAddr {
+        s.parse().unwrap()
+    }
+
+    #[test]
+    fn test_ip_net_contains() {
+        assert!(net("10.0.0.0/8").contains(ip("10.20.30.40")));
+        assert!(!net("10.0.0.0/8").contains(ip("11.0.0.1")));
+        assert!(net("192.168.1.7").contains(ip("192.168.1.7")));
+        assert!(!net("192.168.1.7").contains(ip("192.168.1.8")));
+        assert!(net("0.0.0.0/0").contains(ip("8.8.8.8")));
+        assert!(net("2001:db8::/32").contains(ip("2001:db8:1::5")));
+        assert!(!net("2001:db8::/32").contains(ip("10.0.0.1")));
+        // An IPv4 client on a dual-stack listener
+        assert!(net("10.0.0.0/8").contains(ip("::ffff:10.0.0.1")));
+
+        assert_eq!(net("10.1.0.0/16").to_string(), "10.1.0.0/16");
+        assert!("10.0.0.0/33".parse::<IpNet>().is_err());
+        assert!("example.com".parse::<IpNet>().is_err());
+    }
+
+    #[test]
+    fn test_allow_and_deny() {
+        let access = AccessConfig {
+            allow: vec![net("10.0.0.0/8")],
+            deny: vec![net("10.6.6.0/24")],
+            ..Default::default()
+        };
+        assert!(access.allows(Some(ip("10.1.2.3"))));
+        assert!(!access.allows(Some(ip("10.6.6.6"))));
+        assert!(!access.allows(Some(ip("203.0.113.9"))));
+        assert!(!access.allows(None));
+
+        let deny_only = AccessConfig {
+            deny: vec![net("203.0.113.0/24")],
+            ..Default::default()
+        };
+        assert!(deny_only.allows(Some(ip("198.51.100.1"))));
+        assert!(!deny_only.allows(Some(ip("203.0.113.9"))));
+        assert!(AccessConfig::default().allows(None));
+    }
+
+    #[test]
+    fn test_htpasswd_formats_and_reload() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("htpasswd");
+        let sha = STANDARD.encode(ring::digest::digest(
+            &ring::digest::SHA1_FOR_LEGACY_USE_ONLY,
+            b"hunter2",
+        ));
+        let bcrypt = bcrypt::hash("s3cret", 4).unwrap();
+        let argon = crate::auth::hash_token("letmein").unwrap();
+        let content = format!(
+            "# ops\nalice:{{SHA}}{}\nbob:{}\ncarol:{}\nmallory:$apr1$x$y\n",
+            sha, bcrypt, argon
+        );
+        std::fs::write(&path, content).unwrap();
+
+        let htpasswd = Htpasswd::new(&path);
+        assert!(htpasswd.verify("alice", "hunter2"));
+        assert!(htpasswd.verify("alice", "hunter2"));
+        assert!(!htpasswd.verify("alice", "hunter3"));
+        assert!(htpasswd.verify("bob", "s3cret"));
+        assert!(htpasswd.verify("carol", "letmein"));
+        assert!(!htpasswd.verify("mallory", "anything"));
+        assert!(!htpasswd.verify("dave", "hunter2"));
+
+        // Removing a user takes effect without a restart
+        std::fs::write(&path, format!("bob:{}\n", bcrypt)).unwrap();
+        let later = SystemTime::now() + std::time::Duration::from_secs(5);
+        std::fs::File::options()
+            .write(true)
+            .open(&path)
+            .unwrap()
+            .set_modified(later)
+            .unwrap();
+        assert!(!htpasswd.verify("alice", "hunter2"));
+        assert!(htpasswd.verify("bob", "s3cret"));
+
+        std::fs::remove_file(&path).unwrap();
+        assert!(!htpasswd.verify("bob", "s3cret"));
+    }
+
+    #[tokio::test]
+    async fn test_htpasswd_check_off_the_runtime() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("htpasswd");
+        let bcrypt = bcrypt::hash("s3cret", 4).unwrap();
+        std::fs::write(&path, format!("bob:{}\n", bcrypt)).unwrap();
+
+        let htpasswd = Arc::new(Htpasswd::new(&path));
+        let check = |password: &str| htpasswd.clone().check("bob".into(), password.into());
+        assert!(!check("wrong").await);
+        assert!(check("s3cret").await);
+        // Remembered now
+        assert!(check("s3cret").await);
+        assert_eq!(htpasswd.checks.available_permits(), MAX_CHECKS);
+    }
+}
@@ -0,0 +1,249 @@
+//! Proxy access logs (`[settings.access_log]`, `[service.x.access_log]`)
+//!
+//! Every request the proxy answers for a service gets one line, written once
+//! its response body has been sent (or the client went away), so the size and
+//! total time are what the client actually got. "common" lines are the Common
+//! Log Format followed by `key=value` fields; "json" lines are one object each.
+//! File output goes to `{dir}/{service}.log`, rotated like `[settings.log_files]`.
+
+use crate::config::{AccessLogConfig, AccessLogFormat, AccessLogOutput};
+use crate::log_files::LogFiles;
+use std::io::Write;
+use std::net::IpAddr;
+use std::path::Path;
+use std::sync::Arc;
+use std::time::Instant;
+
+/// Writes access lines in one format to one destination
+pub struct AccessLog {
+    format: AccessLogFormat,
+    files: Option<Arc<LogFiles>>,
+}
+
+impl AccessLog {
+    /// An access log for `config`, with file output under `data_dir` unless it sets `dir`
+    pub fn new(config: &AccessLogConfig, data_dir: &Path) -> Arc<Self> {
+        let files = match config.output {
+            AccessLogOutput::File => Some(LogFiles::new(config.dir(data_dir), &config.rotation())),
+            AccessLogOutput::Stdout => None,
+        };
+        Arc::new(Self {
+            format: config.format,
+            files,
+        })
+    }
+
+    /// Write one request's line (write failures never reach the request)
+    pub fn write(&self, record: &AccessRecord) {
+        let line = record.format(self.format);
+        match &self.files {
+            Some(files) => files.append_line(&record.app, &line),
+            None => {
+                let _ = std::io::stdout().lock().write_all(line.as_bytes());
+            }
+        }
+    }
+}
+
+/// One proxied request, as logged
+#[derive(Debug, Clone)]
+pub struct AccessRecord {
+    /// When the request arrived
+    pub time: chrono::DateTime<chrono::Utc>,
+    pub client: Option<IpAddr>,
+    pub method: String,
+    /// Path and query string
+    pub target: String,
+    /// "HTTP/1.1", "HTTP/2.0", ...
+    pub protocol: String,
+    pub status: u16,
+    /// Response body bytes sent
+    pub bytes: u64,
+    pub app: String,
+    /// The instance that answered (None when no instance did)
+    pub instance: Option<String>,
+    /// The release (APP_VERSION) that instance runs
+    pub release: Option<String>,
+    /// Time until the instance's response headers arrived
+    pub upstream_ms: Option<f64>,
+    /// Time until the response body was done
+    pub duration_ms: f64,
+}
+
+impl AccessRecord {
+    /// The record as a line in `format`, ending in a newline
+    pub fn format(&self, format: AccessLogFormat) -> String {
+        match format {
+            AccessLogFormat::Common => self.common(),
+            AccessLogFormat::Json => {
+                let line = serde_json::json!({
+                    "time": self.time.to_rfc3339_opts(chrono::SecondsFormat::Millis, true),
+                    "client": self.client.map(|ip| ip.to_string()),
+                    "method": self.method,
+                    "path": self.target,
+                    "protocol": self.protocol,
+                    "status": self.status,
+                    "bytes": self.bytes,
+                    "app": self.app,
+                    "instance": self.instance,
+                    "release": self.release,
+                    "upstream_ms": self.upstream_ms.map(round_ms),
+                    "duration_ms": round_ms(self.duration_ms),
+                });
+                format!("{}\n", line)
+            }
+        }
+    }
+
+    /// `client - - [time] "request" status bytes` and then the extra fields
+    fn common(&self) -> String {
+        let dash = |value: Option<String>| value.unwrap_or_else(|| "-".to_string());
+        let bytes = match self.bytes {
+            0 => "-".to_string(),
+            n => n.to_string(),
+        };
+        let target = self.target.replace('"', "%22");
+        format!(
+            "{} - - [{}] \"{} {} {}\" {} {} app={} instance={} release={} upstream_ms={} \
+             duration_ms={}\n",
+            dash(self.client.map(|ip| ip.to_string())),
+            self.time.format("%d/%b/%Y:%H:%M:%S %z"),
+            self.method,
+            target,
+            self.protocol,
+            self.status,
+            bytes,
+            self.app,
+            dash(self.instance.clone()),
+            dash(self.release.as_ref().map(|r| r.replace(' ', "_"))),
+            dash(self.upstream_ms.map(|ms| round_ms(ms).to_string())),
+            round_ms(self.duration_ms),
+        )
+    }
+}
+
+/// Milliseconds to microsecond precision
+fn round_ms(ms: f64) -> f64 {
+    (ms * 1000.0).round() / 1000.0
+}
+
+/// A request whose line is written when this is dropped: hold it in the
+/// response body, counting bytes as they go out
+pub struct PendingAccess {
+    log: Arc<AccessLog>,
+    record: AccessRecord,
+    started: Instant,
+}
+
+impl PendingAccess {
+    pub fn new(log: Arc<AccessLog>, record: AccessRecord, started: Instant) -> Self {
+        Self {
+            log,
+            record,
+            started,
+        }
+    }
+
+    /// Count body bytes sent to the client
+    pub fn sent(&mut self, bytes: usize) {
+        self.record.bytes += bytes as u64;
+    }
+}
+
+impl Drop for PendingAccess {
+    fn drop(&mut self) {
+        self.record.duration_ms = self.started.elapsed().as_secs_f64() * 1000.0;
+        self.log.write(&self.record);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use chrono::TimeZone;
+    use tempfile::TempDir;
+
+    fn record() -> AccessRecord {
+        AccessRecord {
+            time: chrono::Utc
+                .with_ymd_and_hms(2026, 10, 14, 12, 30, 5)
+                .unwrap(),
+            client: Some(IpAddr::from([10, 0, 0, 7])),
+            method: "GET".to_string(),
+            target: "/users?page=2".to_string(),
+            protocol: "HTTP/1.1".to_string(),
+            status: 502,
+            bytes: 1234,
+            app: "api".to_string(),
+            instance: Some("prod".to_string()),
+            release: Some("v42".to_string()),
+            upstream_ms: Some(12.3456),
+            duration_ms: 15.0,
+        }
+    }
+
+    fn config(format: &str, dir: &Path) -> AccessLogConfig {
+        let toml = format!("format = \"{}\"\ndir = {:?}\n", format, dir);
+        toml::from_str(&toml).unwrap()
+    }
+
+    #[test]
+    fn test_common_log_format() {
+        assert_eq!(
+            record().format(AccessLogFormat::Common),
+            "10.0.0.7 - - [14/Oct/2026:12:30:05 +0000] \"GET /users?page=2 HTTP/1.1\" 502 1234 \
+             app=api instance=prod release=v42 upstream_ms=12.346 duration_ms=15\n"
+        );
+
+        // Requests no instance answered, with nothing in the body
+        let mut unanswered = record();
+        unanswered.status = 429;
+        unanswered.bytes = 0;
+        unanswered.client = None;
+        unanswered.instance = None;
+        unanswered.release = None;
+        unanswered.upstream_ms = None;
+        let line = unanswered.format(AccessLogFormat::Common);
+        assert!(line.starts_with("- - - ["), "{}", line);
+        assert!(
+            line.ends_with("429 - app=api instance=- release=- upstream_ms=- duration_ms=15\n"),
+            "{}",
+            line
+        );
+    }
+
+    #[test]
+    fn test_json_format() {
+        let line = record().format(AccessLogFormat::Json);
+        assert!(line.ends_with('\n'));
+        let value: serde_json::Value = serde_json::from_str(&line).unwrap();
+        assert_eq!(value["time"], "2026-10-14T12:30:05.000Z");
+        assert_eq!(value["client"], "10.0.0.7");
+        assert_eq!(value["path"], "/users?page=2");
+        assert_eq!(value["status"], 502);
+        assert_eq!(value["bytes"], 1234);
+        assert_eq!(value["app"], "api");
+        assert_eq!(value["release"], "v42");
+        assert_eq!(value["upstream_ms"], 12.346);
+    }
+
+    #[test]
+    fn test_pending_access_writes_on_drop() {
+        let dir = TempDir::new().unwrap();
+        let log = AccessLog::new(&config("json", dir.path()), dir.path());
+
+        let mut record = record();
+        record.bytes = 0;
+        let mut pending = PendingAccess::new(log, record, Instant::now());
+        pending.sent(100);
+        pending.sent(23);
+        let path = dir.path().join("api.log");
+        assert!(!path.exists(), "nothing is written until the body is done");
+        drop(pending);
+
+        let text = std::fs::read_to_string(&path).unwrap();
+        let value: serde_json::Value = serde_json::from_str(text.trim_end()).unwrap();
+        assert_eq!(value["bytes"], 123);
+        assert!(value["duration_ms"].as_f64().unwrap() < 1000.0);
+    }
+}
@@ -0,0 +1,894 @@
+//! Alerts on unhealthy services, restart loops and error rates
+//!
+//! With `[settings.alerts]`, every service is checked each [`CHECK_INTERVAL`]:
+//! how long it has had an unhealthy instance, how often its instances
+//! restarted in the last hour and what share of its requests got a 5xx over
+//! `window`. An alert is kept per service and rule, so crossing a threshold
+//! sends one "firing" notification (repeated every `repeat_interval`, if set)
+//! and dropping back under it one "resolved" notification, to every
+//! `[[settings.alerts.notify]]` webhook, Slack channel or mailbox.
+
+use crate::config::{AlertsConfig, NotifierConfig, NotifierKind};
+use crate::Hypervisor;
+use anyhow::{Context, Result};
+use base64::{engine::general_purpose::STANDARD, Engine};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap, VecDeque};
+use std::fmt;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tokio::io::{AsyncBufReadExt, AsyncWrite, AsyncWriteExt, BufReader};
+use tracing::{error, info, warn};
+
+/// How often services are checked
+pub const CHECK_INTERVAL: Duration = Duration::from_secs(10);
+
+/// Restarts are counted over this long
+const RESTART_WINDOW: Duration = Duration::from_secs(3600);
+
+/// Per-attempt timeout for a notification
+const SEND_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Attempts per notification, with doubling backoff from one second
+const SEND_ATTEMPTS: u32 = 3;
+
+/// What an alert is about
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, PartialOrd, Ord, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum Rule {
+    /// An instance stayed unhealthy past `unhealthy_for`
+    Unhealthy,
+    /// More than `max_restarts_per_hour` restarts
+    Restarts,
+    /// More than `max_error_rate` of requests got a 5xx
+    ErrorRate,
+}
+
+impl Rule {
+    pub const ALL: [Rule; 3] = [Rule::Unhealthy, Rule::Restarts, Rule::ErrorRate];
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Rule::Unhealthy => "unhealthy",
+            Rule::Restarts => "restarts",
+            Rule::ErrorRate => "error_rate",
+        }
+    }
+}
+
+impl fmt::Display for Rule {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.pad(self.as_str())
+    }
+}
+
+/// Whether an alert started or stopped
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum AlertStatus {
+    Firing,
+    Resolved,
+}
+
+impl fmt::Display for AlertStatus {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        match self {
+            AlertStatus::Firing => write!(f, "firing"),
+            AlertStatus::Resolved => write!(f, "resolved"),
+        }
+    }
+}
+
+/// One notification, as POSTed to webhooks
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Alert {
+    pub status: AlertStatus,
+    pub rule: Rule,
+    /// Service the alert is about
+    pub app: String,
+    /// Active config environment, if any
+    pub env: Option<String>,
+    /// What was seen, e.g. "api restarted 7 times in the last hour (limit 5)"
+    pub summary: String,
+    /// The measurement: seconds unhealthy, restarts, or the error rate (0.0-1.0)
+    pub value: f64,
+    pub threshold: f64,
+    /// RFC 3339 time it started firing
+    pub started_at: String,
+    /// RFC 3339 time of this notification
+    pub timestamp: String,
+}
+
+impl Alert {
+    /// Email subject and first line of chat messages
+    pub fn title(&self) -> String {
+        let env = self
+            .env
+            .as_deref()
+            .map(|env| format!(" ({})", env))
+            .unwrap_or_default();
+        format!(
+            "[{}] {} {}{}",
+            self.status.to_string().to_uppercase(),
+            self.app,
+            self.rule,
+            env
+        )
+    }
+}
+
+/// A service's state at one check. Counters are totals since startup.
+#[derive(Debug, Clone, Default, PartialEq)]
+pub struct Sample {
+    /// Whether any of its instances is unhealthy or failed
+    pub down: bool,
+    pub restarts: u64,
+    pub requests: u64,
+    pub errors: u64,
+}
+
+/// An alert that's firing
+struct Firing {
+    started_at: DateTime<Utc>,
+    last_sent: Instant,
+}
+
+/// Keeps enough history to evaluate each rule, and which alerts are firing
+pub struct Alerter {
+    env: Option<String>,
+    history: HashMap<String, VecDeque<(Instant, Sample)>>,
+    down_since: HashMap<String, Instant>,
+    firing: BTreeMap<(String, Rule), Firing>,
+}
+
+impl Alerter {
+    pub fn new(env: Option<String>) -> Self {
+        Self {
+            env,
+            history: HashMap::new(),
+            down_since: HashMap::new(),
+            firing: BTreeMap::new(),
+        }
+    }
+
+    /// Record `samples` taken at `now` and return the notifications due. A
+    /// service missing from `samples` resolves its alerts.
+    pub fn check(
+        &mut self,
+        config: &AlertsConfig,
+        now: Instant,
+        samples: &BTreeMap<String, Sample>,
+    ) -> Vec<Alert> {
+        let keep = RESTART_WINDOW.max(config.window());
+        self.history.retain(|app, _| samples.contains_key(app));
+        self.down_since.retain(|app, _| samples.contains_key(app));
+        for (app, sample) in samples {
+            let history = self.history.entry(app.clone()).or_default();
+            while history
+                .front()
+                .is_some_and(|(at, _)| now.saturating_duration_since(*at) > keep)
+            {
+                history.pop_front();
+            }
+            history.push_back((now, sample.clone()));
+            if sample.down {
+                self.down_since.entry(app.clone()).or_insert(now);
+            } else {
+                self.down_since.remove(app);
+            }
+        }
+
+        let mut alerts = Vec::new();
+        let mut seen = Vec::new();
+        for app in samples.keys() {
+            for rule in Rule::ALL {
+                let Some(reading) = self.read(config, app, rule, now) else {
+                    continue;
+                };
+                let key = (app.clone(), rule);
+                seen.push(key.clone());
+                match (reading.active, self.firing.get_mut(&key)) {
+                    (true, None) => {
+                        let started_at = Utc::now();
+                        self.firing.insert(
+                            key,
+                            Firing {
+                                started_at,
+                                last_sent: now,
+                            },
+                        );
+                        alerts.push(self.alert(
+                            AlertStatus::Firing,
+                            app,
+                            rule,
+                            reading,
+                            started_at,
+                        ));
+                    }
+                    (true, Some(firing)) => {
+                        let repeat = config.repeat_interval.map(Duration::from_secs);
+                        if repeat.is_some_and(|r| now.duration_since(firing.last_sent) >= r) {
+                            firing.last_sent = now;
+                            let started_at = firing.started_at;
+                            alerts.push(self.alert(
+                                AlertStatus::Firing,
+                                app,
+                                rule,
+                                reading,
+                                started_at,
+                            ));
+                        }
+                    }
+                    (false, Some(_)) => {
+                        let firing = self.firing.remove(&key).expect("just found");
+                        if config.send_resolved {
+                            alerts.push(self.alert(
+                                AlertStatus::Resolved,
+                                app,
+                                rule,
+                                reading,
+                                firing.started_at,
+                            ));
+                        }
+                    }
+                    (false, None) => {}
+                }
+            }
+        }
+
+        // Services that are gone, or rules no longer configured
+        let stale: Vec<_> = self
+            .firing
+            .keys()
+            .filter(|key| !seen.contains(key))
+            .cloned()
+            .collect();
+        for (app, rule) in stale {
+            let firing = self.firing.remove(&(app.clone(), rule)).expect("listed");
+            if config.send_resolved {
+                let reading = Reading {
+                    active: false,
+                    value: 0.0,
+                    threshold: 0.0,
+                    summary: format!("{} is no longer checked for {}", app, rule),
+                };
+                alerts.push(self.alert(
+                    AlertStatus::Resolved,
+                    &app,
+                    rule,
+                    reading,
+                    firing.started_at,
+                ));
+            }
+        }
+        alerts
+    }
+
+    /// Evaluate `rule` for `app`, if it's configured
+    fn read(&self, config: &AlertsConfig, app: &str, rule: Rule, now: Instant) -> Option<Reading> {
+        let history = self.history.get(app)?;
+        let (_, latest) = history.back()?;
+        // The oldest sample within `window` of now
+        let since = |window: Duration| {
+            history
+                .iter()
+                .find(|(at, _)| now.saturating_duration_since(*at) <= window)
+                .map_or(latest, |(_, sample)| sample)
+        };
+        let reading = match rule {
+            Rule::Unhealthy => {
+                let threshold = config.unhealthy_for?;
+                let secs = self
+                    .down_since
+                    .get(app)
+                    .map_or(0, |since| now.saturating_duration_since(*since).as_secs());
+                let summary = match self.down_since.contains_key(app) {
+                    true => format!(
+                        "{} has had an unhealthy instance for {}s (limit {}s)",
+                        app, secs, threshold
+                    ),
+                    false => format!("{} has no unhealthy instances", app),
+                };
+                Reading {
+                    active: self.down_since.contains_key(app) && secs >= threshold,
+                    value: secs as f64,
+                    threshold: threshold as f64,
+                    summary,
+                }
+            }
+            Rule::Restarts => {
+                let max = config.max_restarts_per_hour?;
+                let restarts = latest
+                    .restarts
+                    .saturating_sub(since(RESTART_WINDOW).restarts);
+                Reading {
+                    active: restarts > max,
+                    value: restarts as f64,
+                    threshold: max as f64,
+                    summary: format!(
+                        "{} restarted {} times in the last hour (limit {})",
+                        app, restarts, max
+                    ),
+                }
+            }
+            Rule::ErrorRate => {
+                let max = config.max_error_rate?;
+                let base = since(config.window());
+                let served = latest.requests.saturating_sub(base.requests);
+                let failed = latest.errors.saturating_sub(base.errors);
+                let rate = match served {
+                    0 => 0.0,
+                    _ => failed as f64 / served as f64,
+                };
+                Reading {
+                    active: served >= config.min_requests.max(1) && rate > max,
+                    value: rate,
+                    threshold: max,
+                    summary: format!(
+                        "{} failed {:.1}% of {} requests in the last {}s (limit {:.1}%)",
+                        app,
+                        rate * 100.0,
+                        served,
+                        config.window().as_secs(),
+                        max * 100.0
+                    ),
+                }
+            }
+        };
+        Some(reading)
+    }
+
+    fn alert(
+        &self,
+        status: AlertStatus,
+        app: &str,
+        rule: Rule,
+        reading: Reading,
+        started_at: DateTime<Utc>,
+    ) -> Alert {
+        Alert {
+            status,
+            rule,
+            app: app.to_string(),
+            env: self.env.clone(),
+            summary: reading.summary,
+            value: reading.value,
+            threshold: reading.threshold,
+            started_at: started_at.to_rfc3339(),
+            timestamp: Utc::now().to_rfc3339(),
+        }
+    }
+}
+
+/// One rule's result for one service
+struct Reading {
+    active: bool,
+    value: f64,
+    threshold: f64,
+    summary: String,
+}
+
+/// Every configured service's current state
+pub async fn sample(hypervisor: &Hypervisor) -> BTreeMap<String, Sample> {
+    let metrics = hypervisor.metrics();
+    let requests = metrics.requests_total.totals_by("process").await;
+    let errors = metrics.request_errors_total.totals_by("process").await;
+    let restarts = metrics.instance_restarts.totals_by("process").await;
+    let instances = hypervisor.list().await;
+
+    let config = hypervisor.config();
+    let mut samples = BTreeMap::new();
+    for app in config.service.keys() {
+        let count = |totals: &BTreeMap<String, u64>| totals.get(app).copied().unwrap_or(0);
+        let down = instances
+            .iter()
+            .any(|i| &i.id.process == app && i.health.is_down());
+        samples.insert(
+            app.clone(),
+            Sample {
+                down,
+                restarts: count(&restarts),
+                requests: count(&requests),
+                errors: count(&errors),
+            },
+        );
+    }
+    samples
+}
+
+/// Check services against `[settings.alerts]` and send what fires, picking up
+/// config reloads
+pub fn spawn(hypervisor: Arc<Hypervisor>) -> tokio::task::JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(CHECK_INTERVAL);
+        let mut alerter = Alerter::new(hypervisor.environment().map(str::to_string));
+        let client = reqwest::Client::new();
+        loop {
+            interval.tick().await;
+            let config = hypervisor.config();
+            let Some(alerts_config) = config.settings.alerts.clone() else {
+                alerter = Alerter::new(hypervisor.environment().map(str::to_string));
+                continue;
+            };
+            let samples = sample(&hypervisor).await;
+            for alert in alerter.check(&alerts_config, Instant::now(), &samples) {
+                info!(
+                    app = alert.app.as_str(),
+                    event = "alert",
+                    "{}: {}",
+                    alert.title(),
+                    alert.summary
+                );
+                let alert = Arc::new(alert);
+                for notifier in alerts_config.notify.iter().cloned() {
+                    let (client, alert) = (client.clone(), alert.clone());
+                    tokio::spawn(async move { deliver(&client, &notifier, &alert).await });
+                }
+            }
+        }
+    })
+}
+
+/// Send `alert` through `notifier`, retrying failures. Returns whether it went.
+pub async fn deliver(client: &reqwest::Client, notifier: &NotifierConfig, alert: &Alert) -> bool {
+    let mut backoff = Duration::from_secs(1);
+    for attempt in 1..=SEND_ATTEMPTS {
+        if attempt > 1 {
+            tokio::time::sleep(backoff).await;
+            backoff = backoff.saturating_mul(2);
+        }
+        match tokio::time::timeout(SEND_TIMEOUT, notify(client, notifier, alert)).await {
+            Ok(Ok(())) => return true,
+            Ok(Err(e)) => warn!(
+                "Alert {} failed: {:#} (attempt {}/{})",
+                notifier.kind, e, attempt, SEND_ATTEMPTS
+            ),
+            Err(_) => warn!(
+                "Alert {} timed out (attempt {}/{})",
+                notifier.kind, attempt, SEND_ATTEMPTS
+            ),
+        }
+    }
+    error!("Gave up sending {} by {}", alert.title(), notifier.kind);
+    false
+}
+
+/// Send `alert` through `notifier` once
+pub async fn notify(
+    client: &reqwest::Client,
+    notifier: &NotifierConfig,
+    alert: &Alert,
+) -> Result<()> {
+    let body = match notifier.kind {
+        NotifierKind::Webhook => serde_json::to_vec(alert)?,
+        NotifierKind::Slack => slack_message(alert).to_string().into_bytes(),
+        NotifierKind::Email => return send_email(notifier, alert).await,
+    };
+    let url = notifier.url.as_deref().context("notifier has no url")?;
+    client
+        .post(url)
+        .header("content-type", "application/json")
+        .body(body)
+        .send()
+        .await?
+        .error_for_status()?;
+    Ok(())
+}
+
+/// Body for a Slack incoming webhook
+pub fn slack_message(alert: &Alert) -> serde_json::Value {
+    let icon = match alert.status {
+        AlertStatus::Firing => ":rotating_light:",
+        AlertStatus::Resolved => ":white_check_mark:",
+    };
+    serde_json::json!({
+        "text": format!("{} *{}*\n{}", icon, alert.title(), alert.summary),
+    })
+}
+
+/// Mail `alert` over plain SMTP, logging in with AUTH PLAIN when there's a
+/// username (only to a loopback relay; see [`NotifierConfig::smtp_is_loopback`])
+async fn send_email(notifier: &NotifierConfig, alert: &Alert) -> Result<()> {
+    let smtp = notifier
+        .smtp
+        .as_deref()
+        .context("notifier has no smtp server")?;
+    let addr = match smtp.rsplit_once(':') {
+        Some(_) => smtp.to_string(),
+        None => format!("{}:25", smtp),
+    };
+    let from = notifier
+        .from
+        .as_deref()
+        .context("notifier has no from address")?;
+    if notifier.username.is_some() && !notifier.smtp_is_loopback() {
+        anyhow::bail!("Not sending an SMTP password to {} without TLS", addr);
+    }
+    let stream = tokio::net::TcpStream::connect(&addr)
+        .await
+        .with_context(|| format!("Failed to connect to {}", addr))?;
+    let (read, mut write) = stream.into_split();
+    let mut read = BufReader::new(read);
+
+    expect(&mut read, 220).await?;
+    command(&mut read, &mut write, "EHLO tenement", 250).await?;
+    if let Some(username) = &notifier.username {
+        let password = match &notifier.password_env {
+            Some(var) => std::env::var(var).with_context(|| format!("{} is not set", var))?,
+            None => String::new(),
+        };
+        let login = STANDARD.encode(format!("\0{}\0{}", username, password));
+        command(&mut read, &mut write, &format!("AUTH PLAIN {}", login), 235).await?;
+    }
+    command(&mut read, &mut write, &format!("MAIL FROM:<{}>", from), 250).await?;
+    for to in &notifier.to {
+        command(&mut read, &mut write, &format!("RCPT TO:<{}>", to), 250).await?;
+    }
+    command(&mut read, &mut write, "DATA", 354).await?;
+    let message = email_message(from, &notifier.to, alert);
+    write.write_all(message.as_bytes()).await?;
+    command(&mut read, &mut write, ".", 250).await?;
+    command(&mut read, &mut write, "QUIT", 221).await.ok();
+    Ok(())
+}
+
+/// Headers and dot-stuffed body of an alert email, ending in CRLF
+fn email_message(from: &str, to: &[String], alert: &Alert) -> String {
+    let mut message = format!(
+        "From: {}\r\nTo: {}\r\nSubject: {}\r\nDate: {}\r\nMIME-Version: 1.0\r\n\
+         Content-Type: text/plain; charset=utf-8\r\n\r\n",
+        from,
+        to.join(", "),
+        alert.title(),
+        Utc::now().to_rfc2822()
+    );
+    let body = format!(
+        "{}\n\nStatus: {}\nStarted: {}\nValue: {}\nThreshold: {}\n",
+        alert.summary, alert.status, alert.started_at, alert.value, alert.threshold
+    );
+    for line in body.lines() {
+        if line.starts_with('.') {
+            message.push('.');
+        }
+        message.push_str(line);
+        message.push_str("\r\n");
+    }
+    message
+}
+
+/// Send one SMTP command and check the reply code
+async fn command<R, W>(read: &mut R, write: &mut W, line: &str, code: u16) -> Result<()>
+where
+    R: tokio::io::AsyncBufRead + Unpin,
+    W: AsyncWrite + Unpin,
+{
+    write.write_all(format!("{}\r\n", line).as_bytes()).await?;
+    let verb = line.split(' ').next().unwrap_or(line);
+    expect(read, code)
+        .await
+        .with_context(|| format!("SMTP {} failed", verb))
+}
+
+/// Read a (possibly multi-line) SMTP reply and check its code
+async fn expect<R>(read: &mut R, code: u16) -> Result<()>
+where
+    R: tokio::io::AsyncBufRead + Unpin,
+{
+    loop {
+        let mut line = String::new();
+        if read.read_line(&mut line).await? == 0 {
+            anyhow::bail!("SMTP server closed the connection");
+        }
+        let got: u16 = line
+            .get(..3)
+            .and_then(|c| c.parse().ok())
+            .with_context(|| format!("Bad SMTP reply {:?}", line.trim_end()))?;
+        // "250-..." continues, "250 ..." ends
+        if line.as_bytes().get(3) == Some(&b'-') {
+            continue;
+        }
+        if got != code {
+            anyhow::bail!("expected {}, got {:?}", code, line.trim_end());
+        }
+        return Ok(());
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn config(extra: &str) -> AlertsConfig {
+        let content = format!(
+            "[settings.alerts]\n{}\n\
+             [[settings.alerts.notify]]\ntype = \"webhook\"\nurl = \"https://example.com/hook\"\n",
+            extra
+        );
+        crate::Config::from_str(&content)
+            .unwrap()
+            .settings
+            .alerts
+            .unwrap()
+    }
+
+    fn samples(app: &str, sample: Sample) -> BTreeMap<String, Sample> {
+        BTreeMap::from([(app.to_string(), sample)])
+    }
+
+    fn down(down: bool) -> Sample {
+        Sample {
+            down,
+            ..Default::default()
+        }
+    }
+
+    fn summary(alerts: &[Alert]) -> Vec<(AlertStatus, Rule)> {
+        alerts.iter().map(|a| (a.status, a.rule)).collect()
+    }
+
+    // ===================
+    // Rules
+    // ===================
+
+    #[test]
+    fn test_unhealthy_fires_once_and_resolves() {
+        let config = config("unhealthy_for = \"1m\"");
+        let mut alerter = Alerter::new(Some("prod".to_string()));
+        let start = Instant::now();
+        let at = |secs| start + Duration::from_secs(secs);
+
+        assert!(alerter
+            .check(&config, at(0), &samples("api", down(true)))
+            .is_empty());
+        assert!(alerter
+            .check(&config, at(30), &samples("api", down(true)))
+            .is_empty());
+        let fired = alerter.check(&config, at(60), &samples("api", down(true)));
+        assert_eq!(
+            summary(&fired),
+            vec![(AlertStatus::Firing, Rule::Unhealthy)]
+        );
+        assert_eq!(fired[0].app, "api");
+        assert_eq!(fired[0].value, 60.0);
+        assert_eq!(fired[0].title(), "[FIRING] api unhealthy (prod)");
+
+        // Deduplicated while it keeps firing
+        assert!(alerter
+            .check(&config, at(90), &samples("api", down(true)))
+            .is_empty());
+        let resolved = alerter.check(&config, at(100), &samples("api", down(false)));
+        assert_eq!(
+            summary(&resolved),
+            vec![(AlertStatus::Resolved, Rule::Unhealthy)]
+        );
+        assert_eq!(resolved[0].started_at, fired[0].started_at);
+
+        // A flap restarts the clock
+        assert!(alerter
+            .check(&config, at(110), &samples("api", down(true)))
+            .is_empty());
+    }
+
+    #[test]
+    fn test_repeat_interval_and_send_resolved() {
+        let config = config("unhealthy_for = 10\nrepeat_interval = 60\nsend_resolved = false");
+        let mut alerter = Alerter::new(None);
+        let start = Instant::now();
+        let at = |secs| start + Duration::from_secs(secs);
+
+        alerter.check(&config, at(0), &samples("api", down(true)));
+        assert_eq!(
+            alerter
+                .check(&config, at(10), &samples("api", down(true)))
+                .len(),
+            1
+        );
+        assert!(alerter
+            .check(&config, at(40), &samples("api", down(true)))
+            .is_empty());
+        let repeated = alerter.check(&config, at(70), &samples("api", down(true)));
+        assert_eq!(
+            summary(&repeated),
+            vec![(AlertStatus::Firing, Rule::Unhealthy)]
+        );
+        assert!(alerter
+            .check(&config, at(80), &samples("api", down(false)))
+            .is_empty());
+    }
+
+    #[test]
+    fn test_restarts_per_hour() {
+        let config = config("max_restarts_per_hour = 2");
+        let mut alerter = Alerter::new(None);
+        let start = Instant::now();
+        let restarts = |restarts| {
+            samples(
+                "api",
+                Sample {
+                    restarts,
+                    ..Default::default()
+                },
+            )
+        };
+
+        assert!(alerter.check(&config, start, &restarts(10)).is_empty());
+        let at = |secs| start + Duration::from_secs(secs);
+        assert!(alerter.check(&config, at(60), &restarts(12)).is_empty());
+        let fired = alerter.check(&config, at(120), &restarts(13));
+        assert_eq!(summary(&fired), vec![(AlertStatus::Firing, Rule::Restarts)]);
+        assert_eq!(fired[0].value, 3.0);
+        assert!(
+            fired[0].summary.contains("restarted 3 times"),
+            "{}",
+            fired[0].summary
+        );
+
+        // An hour on, only the last hour's restarts count
+        let resolved = alerter.check(&config, at(3700), &restarts(13));
+        assert_eq!(
+            summary(&resolved),
+            vec![(AlertStatus::Resolved, Rule::Restarts)]
+        );
+    }
+
+    #[test]
+    fn test_error_rate_needs_min_requests() {
+        let config = config("max_error_rate = 0.1\nwindow = \"1m\"\nmin_requests = 10");
+        let mut alerter = Alerter::new(None);
+        let start = Instant::now();
+        let at = |secs| start + Duration::from_secs(secs);
+        let counts = |requests, errors| {
+            samples(
+                "api",
+                Sample {
+                    requests,
+                    errors,
+                    ..Default::default()
+                },
+            )
+        };
+
+        alerter.check(&config, at(0), &counts(100, 0));
+        // 5 of 5 failed, but too few requests to count
+        assert!(alerter.check(&config, at(10), &counts(105, 5)).is_empty());
+        let fired = alerter.check(&config, at(20), &counts(120, 10));
+        assert_eq!(
+            summary(&fired),
+            vec![(AlertStatus::Firing, Rule::ErrorRate)]
+        );
+        assert_eq!(fired[0].value, 0.5);
+
+        // The failures age out of the window
+        let resolved = alerter.check(&config, at(90), &counts(200, 10));
+        assert_eq!(
+            summary(&resolved),
+            vec![(AlertStatus::Resolved, Rule::ErrorRate)]
+        );
+    }
+
+    #[test]
+    fn test_removed_service_resolves() {
+        let config = config("unhealthy_for = 0");
+        let mut alerter = Alerter::new(None);
+        let now = Instant::now();
+        assert_eq!(
+            alerter
+                .check(&config, now, &samples("api", down(true)))
+                .len(),
+            1
+        );
+        let resolved = alerter.check(&config, now, &BTreeMap::new());
+        assert_eq!(
+            summary(&resolved),
+            vec![(AlertStatus::Resolved, Rule::Unhealthy)]
+        );
+        assert!(alerter.firing.is_empty());
+    }
+
+    // ===================
+    // Notifiers
+    // ===================
+
+    fn alert() -> Alert {
+        Alert {
+            status: AlertStatus::Firing,
+            rule: Rule::Restarts,
+            app: "api".to_string(),
+            env: None,
+            summary: "api restarted 7 times in the last hour (limit 5)".to_string(),
+            value: 7.0,
+            threshold: 5.0,
+            started_at: "2026-01-01T00:00:00+00:00".to_string(),
+            timestamp: "2026-01-01T00:00:00+00:00".to_string(),
+        }
+    }
+
+    #[test]
+    fn test_slack_message() {
+        let text = slack_message(&alert())["text"]
+            .as_str()
+            .unwrap()
+            .to_string();
+        assert!(
+            text.starts_with(":rotating_light: *[FIRING] api restarts*\n"),
+            "{}",
+            text
+        );
+        assert!(text.ends_with("(limit 5)"), "{}", text);
+    }
+
+    #[tokio::test]
+    async fn test_email_over_smtp() {
+        let listener = tokio::net::TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let addr = listener.local_addr().unwrap();
+        let server = tokio::spawn(async move {
+            let (stream, _) = listener.accept().await.unwrap();
+            let (read, mut write) = stream.into_split();
+            let mut read = BufReader::new(read);
+            write.write_all(b"220 mail ready\r\n").await.unwrap();
+            let mut commands = Vec::new();
+            let mut in_data = false;
+            loop {
+                let mut line = String::new();
+                if read.read_line(&mut line).await.unwrap() == 0 {
+                    break;
+                }
+                let line = line.trim_end().to_string();
+                commands.push(line.clone());
+                let reply: &[u8] = match line.as_str() {
+                    "." => {
+                        in_data = false;
+                        b"250 queued\r\n"
+                    }
+                    _ if in_data => continue,
+                    "DATA" => {
+                        in_data = true;
+                        b"354 go ahead\r\n"
+                    }
+                    "QUIT" => b"221 bye\r\n",
+                    l if l.starts_with("EHLO") => b"250-mail\r\n250 AUTH PLAIN\r\n",
+                    l if l.starts_with("AUTH") => b"235 ok\r\n",
+                    _ => b"250 ok\r\n",
+                };
+                write.write_all(reply).await.unwrap();
+            }
+            commands
+        });
+
+        std::env::set_var("TEST_ALERT_SMTP_PASSWORD", "hunter2");
+        let notifier = NotifierConfig {
+            kind: NotifierKind::Email,
+            url: None,
+            smtp: Some(addr.to_string()),
+            username: Some("ops".to_string()),
+            password_env: Some("TEST_ALERT_SMTP_PASSWORD".to_string()),
+            from: Some("ten@example.com".to_string()),
+            to: vec!["a@example.com".to_string(), "b@example.com".to_string()],
+        };
+        notify(&reqwest::Client::new(), &notifier, &alert())
+            .await
+            .unwrap();
+
+        let commands = server.await.unwrap();
+        let login = STANDARD.encode("\0ops\0hunter2");
+        assert_eq!(commands[1], format!("AUTH PLAIN {}", login));
+        assert_eq!(commands[2], "MAIL FROM:<ten@example.com>");
+        assert_eq!(
+            &commands[3..6],
+            ["RCPT TO:<a@example.com>", "RCPT TO:<b@example.com>", "DATA"]
+        );
+        assert!(commands.contains(&"Subject: [FIRING] api restarts".to_string()));
+        assert!(commands.contains(&"To: a@example.com, b@example.com".to_string()));
+        assert_eq!(commands.last().unwrap(), "QUIT");
+    }
+
+    #[test]
+    fn test_email_body_is_dot_stuffed() {
+        let mut alert = alert();
+        alert.summary = "first\n.hidden".to_string();
+        let message = email_message("ten@example.com", &["a@example.com".to_string()], &alert);
+        assert!(message.contains("\r\n..hidden\r\n"), "{}", message);
+        assert!(message.ends_with("\r\n"));
+    }
+}
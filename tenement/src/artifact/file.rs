@@ -0,0 +1,26 @@
+//! `file://` artifacts: a path on this host
+
+use super::Fetcher;
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use std::path::Path;
+
+/// Copies `file:///path/to/artifact`; checksums are optional
+pub struct FileFetcher;
+
+#[async_trait]
+impl Fetcher for FileFetcher {
+    async fn fetch(&self, url: &str, dest: &Path) -> Result<()> {
+        let path = url
+            .strip_prefix("file://")
+            .with_context(|| format!("Not a file:// URL: {}", url))?;
+        tokio::fs::copy(path, dest)
+            .await
+            .with_context(|| format!("Failed to copy {}", path))?;
+        Ok(())
+    }
+
+    fn requires_checksum(&self) -> bool {
+        false
+    }
+}
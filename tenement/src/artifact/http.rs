@@ -0,0 +1,52 @@
+//! `http://` and `https://` artifacts
+
+use super::Fetcher;
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use std::path::Path;
+use std::time::Duration;
+use tokio::io::AsyncWriteExt;
+
+/// Longest wait to connect to the artifact's host
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Longest a download may go without receiving anything. A large artifact
+/// may take as long as it needs while it keeps moving.
+const READ_TIMEOUT: Duration = Duration::from_secs(60);
+
+/// Downloads artifacts with a plain GET (no credentials; use a presigned URL)
+pub struct HttpFetcher {
+    client: reqwest::Client,
+}
+
+impl Default for HttpFetcher {
+    fn default() -> Self {
+        let client = reqwest::Client::builder()
+            .connect_timeout(CONNECT_TIMEOUT)
+            .read_timeout(READ_TIMEOUT)
+            .build()
+            .unwrap_or_default();
+        Self { client }
+    }
+}
+
+#[async_trait]
+impl Fetcher for HttpFetcher {
+    async fn fetch(&self, url: &str, dest: &Path) -> Result<()> {
+        let response = self.client.get(url).send().await?;
+        save_response(response, dest).await
+    }
+}
+
+/// Stream a successful response's body to `dest`
+pub(super) async fn save_response(response: reqwest::Response, dest: &Path) -> Result<()> {
+    let mut response = response.error_for_status()?;
+    let mut file = tokio::fs::File::create(dest)
+        .await
+        .with_context(|| format!("Failed to create {}", dest.display()))?;
+    while let Some(chunk) = response.chunk().await? {
+        file.write_all(&chunk).await?;
+    }
+    file.flush().await?;
+    Ok(())
+}
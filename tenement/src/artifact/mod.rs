@@ -0,0 +1,424 @@
+//! Release artifacts fetched for deploys
+//!
+//! `ten deploy api v42 --artifact s3://bucket/api-v42.tar.gz` downloads the
+//! artifact, verifies its SHA-256, unpacks it into
+//! {data_dir}/.releases/{service}/{version} and runs the version there. Each
+//! URL scheme has a [`Fetcher`]: `file://`, `http(s)://` and `s3://` are built
+//! in, and embedders can register their own with [`Fetchers::register`].
+//!
+//! The checksum is the deploy's `--checksum sha256:<hex>`, or else the
+//! contents of `<url>.sha256` published next to the artifact. Remote artifacts
+//! must have one; a `file://` artifact without one is used unverified.
+//! `.tar.gz`, `.tgz` and `.tar` artifacts are unpacked; anything else (a
+//! single binary, say) is placed in the release dir as an executable.
+
+mod file;
+mod http;
+mod s3;
+
+pub use file::FileFetcher;
+pub use http::HttpFetcher;
+pub use s3::S3Fetcher;
+pub(crate) use s3::split_s3_url;
+
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use std::collections::HashMap;
+use std::io::Read;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+
+/// Release dirs live at {data_dir}/.releases/{service}/{version}
+const RELEASES_DIR_NAME: &str = ".releases";
+
+/// Where a deployed version of a service is unpacked or checked out
+pub fn release_dir(data_dir: &Path, service: &str, version: &str) -> PathBuf {
+    data_dir.join(RELEASES_DIR_NAME).join(service).join(version)
+}
+
+/// Downloads artifacts for one URL scheme
+#[async_trait]
+pub trait Fetcher: Send + Sync {
+    /// Download the artifact at `url` to the file `dest`
+    async fn fetch(&self, url: &str, dest: &Path) -> Result<()>;
+
+    /// Whether artifacts from here must come with a checksum
+    fn requires_checksum(&self) -> bool {
+        true
+    }
+}
+
+/// An artifact downloaded, verified and unpacked
+#[derive(Debug, Clone)]
+pub struct FetchedArtifact {
+    pub dir: PathBuf,
+    /// SHA-256 of the downloaded file, hex
+    pub sha256: String,
+}
+
+/// Fetchers by URL scheme
+#[derive(Clone)]
+pub struct Fetchers {
+    by_scheme: HashMap<String, Arc<dyn Fetcher>>,
+}
+
+impl Default for Fetchers {
+    /// The built-in fetchers; S3 credentials come from the environment
+    fn default() -> Self {
+        let mut fetchers = Self::empty();
+        let http = Arc::new(HttpFetcher::default());
+        fetchers.register("file", Arc::new(FileFetcher));
+        fetchers.register("http", http.clone());
+        fetchers.register("https", http);
+        fetchers.register("s3", Arc::new(S3Fetcher::from_env()));
+        fetchers
+    }
+}
+
+impl Fetchers {
+    pub fn empty() -> Self {
+        Self {
+            by_scheme: HashMap::new(),
+        }
+    }
+
+    /// Fetch `scheme://` URLs with `fetcher`, replacing any earlier one
+    pub fn register(&mut self, scheme: &str, fetcher: Arc<dyn Fetcher>) {
+        self.by_scheme.insert(scheme.to_ascii_lowercase(), fetcher);
+    }
+
+    /// The fetcher for `url`, if it is a URL with a registered scheme.
+    /// Plain paths have none: they are recorded as given, not fetched.
+    pub fn get(&self, url: &str) -> Option<&dyn Fetcher> {
+        let scheme = scheme(url)?.to_ascii_lowercase();
+        self.by_scheme.get(&scheme).map(|fetcher| fetcher.as_ref())
+    }
+
+    /// Download `url`, check it against `checksum` (or `<url>.sha256`), and
+    /// unpack it into `dir`, replacing what was there
+    pub async fn fetch_into(
+        &self,
+        url: &str,
+        checksum: Option<&str>,
+        dir: &Path,
+    ) -> Result<FetchedArtifact> {
+        let fetcher = self
+            .get(url)
+            .with_context(|| format!("No fetcher for artifact {}", url))?;
+        let parent = dir.parent().context("Release dir has no parent")?;
+        std::fs::create_dir_all(parent)
+            .with_context(|| format!("Failed to create {}", parent.display()))?;
+
+        let expected = match checksum {
+            Some(checksum) => Some(parse_checksum(checksum)?),
+            None => published_checksum(fetcher, url, dir).await?,
+        };
+
+        let download = beside(dir, ".download");
+        let result = fetch_verified(fetcher, url, expected, &download, dir)
+            .await
+            .with_context(|| format!("Artifact {}", url));
+        std::fs::remove_file(&download).ok();
+        result
+    }
+}
+
+/// Download `url` to `download`, verify it, and unpack it into `dir`
+async fn fetch_verified(
+    fetcher: &dyn Fetcher,
+    url: &str,
+    expected: Option<String>,
+    download: &Path,
+    dir: &Path,
+) -> Result<FetchedArtifact> {
+    fetcher
+        .fetch(url, download)
+        .await
+        .with_context(|| format!("Failed to fetch {}", url))?;
+    let name = artifact_name(url).to_string();
+    let (download, dir) = (download.to_path_buf(), dir.to_path_buf());
+    tokio::task::spawn_blocking(move || {
+        let sha256 = sha256_file(&download)?;
+        if let Some(expected) = expected {
+            if expected != sha256 {
+                anyhow::bail!("Checksum mismatch: expected {}, got {}", expected, sha256);
+            }
+        }
+        unpack_into(&download, &name, &dir)?;
+        Ok(FetchedArtifact { dir, sha256 })
+    })
+    .await?
+}
+
+/// The scheme of `url` ("s3" for "s3://bucket/key"), if it has one
+pub fn scheme(url: &str) -> Option<&str> {
+    let (scheme, _) = url.split_once("://")?;
+    let valid = scheme.starts_with(|c: char| c.is_ascii_alphabetic())
+        && scheme
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '+' | '-' | '.'));
+    valid.then_some(scheme)
+}
+
+/// A checksum as `sha256:<hex>` or bare hex, normalized to lowercase hex
+pub fn parse_checksum(checksum: &str) -> Result<String> {
+    let checksum = checksum.trim();
+    let hex = match checksum.split_once(':') {
+        Some((algorithm, hex)) if algorithm.eq_ignore_ascii_case("sha256") => hex,
+        Some((algorithm, _)) => anyhow::bail!("Unsupported checksum algorithm {:?}", algorithm),
+        None => checksum,
+    };
+    if hex.len() != 64 || !hex.chars().all(|c| c.is_ascii_hexdigit()) {
+        anyhow::bail!("Invalid SHA-256 checksum {:?}", checksum);
+    }
+    Ok(hex.to_ascii_lowercase())
+}
+
+/// The checksum published at `<url>.sha256` (`sha256sum` output works), or
+/// None where the fetcher doesn't require one and none is published
+async fn published_checksum(
+    fetcher: &dyn Fetcher,
+    url: &str,
+    dir: &Path,
+) -> Result<Option<String>> {
+    let sidecar = beside(dir, ".sha256");
+    let fetched = fetcher.fetch(&format!("{}.sha256", url), &sidecar).await;
+    let contents = std::fs::read_to_string(&sidecar);
+    std::fs::remove_file(&sidecar).ok();
+    match (fetched, contents) {
+        (Ok(()), Ok(contents)) => {
+            let hex = contents.split_whitespace().next().unwrap_or_default();
+            parse_checksum(hex)
+                .map(Some)
+                .with_context(|| format!("Malformed {}.sha256", url))
+        }
+        _ if !fetcher.requires_checksum() => Ok(None),
+        (Err(e), _) => Err(e).with_context(|| {
+            format!(
+                "No checksum for {}: pass one with the deploy or publish {}.sha256",
+                url, url
+            )
+        }),
+        (_, Err(e)) => Err(e).with_context(|| format!("Failed to read {}.sha256", url)),
+    }
+}
+
+/// The artifact's file name: the last path segment of its URL
+fn artifact_name(url: &str) -> &str {
+    let path = url.split(['?', '#']).next().unwrap_or(url);
+    path.rsplit('/').next().unwrap_or(path)
+}
+
+/// A scratch path next to `dir` (versions may contain dots, so not an extension)
+fn beside(dir: &Path, suffix: &str) -> PathBuf {
+    let mut name = dir.file_name().unwrap_or_default().to_os_string();
+    name.push(suffix);
+    dir.with_file_name(name)
+}
+
+fn sha256_file(path: &Path) -> Result<String> {
+    let mut file = std::fs::File::open(path)?;
+    let mut context = ring::digest::Context::new(&ring::digest::SHA256);
+    let mut buffer = vec![0; 64 * 1024];
+    loop {
+        let read = file.read(&mut buffer)?;
+        if read == 0 {
+            break;
+        }
+        context.update(&buffer[..read]);
+    }
+    Ok(to_hex(context.finish().as_ref()))
+}
+
+fn to_hex(bytes: &[u8]) -> String {
+    bytes.iter().map(|b| format!("{:02x}", b)).collect()
+}
+
+/// Unpack the downloaded artifact beside `dir`, then swap it into place, so
+/// a failed unpack leaves no half-written release
+fn unpack_into(download: &Path, name: &str, dir: &Path) -> Result<()> {
+    let staging = beside(dir, ".partial");
+    if staging.exists() {
+        std::fs::remove_dir_all(&staging)?;
+    }
+    std::fs::create_dir_all(&staging)?;
+    let unpacked = unpack(download, name, &staging);
+    if let Err(e) = unpacked {
+        std::fs::remove_dir_all(&staging).ok();
+        return Err(e);
+    }
+    if dir.exists() {
+        std::fs::remove_dir_all(dir)
+            .with_context(|| format!("Failed to replace {}", dir.display()))?;
+    }
+    std::fs::rename(&staging, dir)
+        .with_context(|| format!("Failed to move release into {}", dir.display()))
+}
+
+fn unpack(download: &Path, name: &str, dir: &Path) -> Result<()> {
+    let file = std::fs::File::open(download)?;
+    // Archive::unpack skips entries that would land outside `dir`
+    if name.ends_with(".tar.gz") || name.ends_with(".tgz") {
+        tar::Archive::new(flate2::read::GzDecoder::new(file))
+            .unpack(dir)
+            .context("Failed to unpack tar.gz")
+    } else if name.ends_with(".tar") {
+        tar::Archive::new(file)
+            .unpack(dir)
+            .context("Failed to unpack tar")
+    } else {
+        let target = dir.join(name);
+        std::fs::copy(download, &target)?;
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&target, std::fs::Permissions::from_mode(0o755))?;
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::sync::Mutex;
+    use tempfile::TempDir;
+
+    /// A .tar.gz with `bin/app` in it, and its SHA-256
+    fn tarball(dir: &Path) -> (PathBuf, String) {
+        let path = dir.join("api-v42.tar.gz");
+        let file = std::fs::File::create(&path).unwrap();
+        let gz = flate2::write::GzEncoder::new(file, flate2::Compression::default());
+        let mut builder = tar::Builder::new(gz);
+        let contents = b"#!/bin/sh\necho v42\n";
+        let mut header = tar::Header::new_gnu();
+        header.set_size(contents.len() as u64);
+        header.set_mode(0o755);
+        header.set_cksum();
+        builder
+            .append_data(&mut header, "bin/app", &contents[..])
+            .unwrap();
+        builder.into_inner().unwrap().finish().unwrap();
+        let sha256 = sha256_file(&path).unwrap();
+        (path, sha256)
+    }
+
+    /// Serves fixed bytes for any URL, recording what was asked for
+    struct MemoryFetcher {
+        body: Vec<u8>,
+        fetched: Mutex<Vec<String>>,
+    }
+
+    #[async_trait]
+    impl Fetcher for MemoryFetcher {
+        async fn fetch(&self, url: &str, dest: &Path) -> Result<()> {
+            self.fetched.lock().unwrap().push(url.to_string());
+            if url.ends_with(".sha256") {
+                anyhow::bail!("404 Not Found");
+            }
+            std::fs::write(dest, &self.body)?;
+            Ok(())
+        }
+    }
+
+    // ===================
+    // FETCH TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_fetch_file_unpacks_verified_tarball() {
+        let dir = TempDir::new().unwrap();
+        let (tarball, sha256) = tarball(dir.path());
+        let url = format!("file://{}", tarball.display());
+        let release = release_dir(dir.path(), "api", "v42");
+        let fetchers = Fetchers::default();
+
+        let checksum = format!("sha256:{}", sha256.to_uppercase());
+        let fetched = fetchers
+            .fetch_into(&url, Some(&checksum), &release)
+            .await
+            .unwrap();
+        assert_eq!(fetched.dir, release);
+        assert_eq!(fetched.sha256, sha256);
+        let app = std::fs::read_to_string(release.join("bin/app")).unwrap();
+        assert_eq!(app, "#!/bin/sh\necho v42\n");
+        assert!(!beside(&release, ".download").exists());
+
+        // A published <url>.sha256 is used without --checksum
+        std::fs::write(
+            format!("{}.sha256", tarball.display()),
+            format!("{}  x\n", sha256),
+        )
+        .unwrap();
+        fetchers.fetch_into(&url, None, &release).await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_fetch_rejects_checksum_mismatch() {
+        let dir = TempDir::new().unwrap();
+        let (tarball, _) = tarball(dir.path());
+        let url = format!("file://{}", tarball.display());
+        let release = release_dir(dir.path(), "api", "v42");
+
+        let wrong = "0".repeat(64);
+        let err = Fetchers::default()
+            .fetch_into(&url, Some(&wrong), &release)
+            .await
+            .unwrap_err();
+        assert!(
+            format!("{:#}", err).contains("Checksum mismatch"),
+            "{:#}",
+            err
+        );
+        assert!(!release.exists());
+        assert!(!beside(&release, ".download").exists());
+    }
+
+    #[tokio::test]
+    async fn test_registered_fetcher_needs_a_checksum() {
+        let dir = TempDir::new().unwrap();
+        let fetcher = Arc::new(MemoryFetcher {
+            body: b"binary".to_vec(),
+            fetched: Mutex::new(Vec::new()),
+        });
+        let mut fetchers = Fetchers::empty();
+        fetchers.register("mem", fetcher.clone());
+        let release = release_dir(dir.path(), "api", "v1");
+        let url = "mem://builds/api?rev=1";
+
+        // Nothing published at <url>.sha256 and none given
+        let err = fetchers.fetch_into(url, None, &release).await.unwrap_err();
+        assert!(format!("{:#}", err).contains("No checksum"), "{:#}", err);
+
+        let checksum = to_hex(ring::digest::digest(&ring::digest::SHA256, b"binary").as_ref());
+        fetchers
+            .fetch_into(url, Some(&checksum), &release)
+            .await
+            .unwrap();
+        // Not an archive: placed as an executable named like the URL's last segment
+        assert_eq!(std::fs::read(release.join("api")).unwrap(), b"binary");
+        assert_eq!(fetcher.fetched.lock().unwrap().len(), 2);
+
+        assert!(fetchers.get("/srv/builds/api.tar.gz").is_none());
+        assert!(fetchers.get("s3://bucket/api.tar.gz").is_none());
+        assert!(Fetchers::default().get("S3://bucket/api.tar.gz").is_some());
+    }
+
+    #[test]
+    fn test_parse_checksum() {
+        let hex = "ab".repeat(32);
+        assert_eq!(parse_checksum(&hex).unwrap(), hex);
+        assert_eq!(
+            parse_checksum(&format!("SHA256:{}", hex.to_uppercase())).unwrap(),
+            hex
+        );
+        assert!(parse_checksum(&format!("md5:{}", hex)).is_err());
+        assert!(parse_checksum("abc").is_err());
+        assert_eq!(scheme("s3://bucket/key"), Some("s3"));
+        assert_eq!(scheme("/srv/builds/api.tar.gz"), None);
+        assert_eq!(
+            artifact_name("https://host/builds/api-v1.tgz?sig=x"),
+            "api-v1.tgz"
+        );
+    }
+}
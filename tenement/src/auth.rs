@@ -2,13 +2,20 @@
 //!
 //! Provides Bearer token authentication for the API.
 
-use anyhow::Result;
+use anyhow::{Context, Result};
 use argon2::{
     password_hash::{rand_core::OsRng, PasswordHash, PasswordHasher, PasswordVerifier, SaltString},
     Argon2,
 };
 use base64::{engine::general_purpose::URL_SAFE_NO_PAD, Engine};
 use rand::Rng;
+use serde::{Deserialize, Serialize};
+use std::collections::HashSet;
+use std::fmt;
+use std::path::{Path, PathBuf};
+use std::str::FromStr;
+use std::sync::{Arc, Mutex, RwLock};
+use tokio::sync::watch;
 
 /// Length of generated tokens in bytes (32 bytes = 256 bits)
 const TOKEN_LENGTH: usize = 32;
@@ -89,6 +96,191 @@ impl<'a> TokenStore<'a> {
     }
 }
 
+/// What a named API token may do, from least to most
+#[derive(Debug, Clone, Copy, PartialEq, Eq, PartialOrd, Ord, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Scope {
+    /// Read-only: status, logs, events, releases
+    Read,
+    /// Read, plus deploys, rollbacks, restarts and traffic shifts
+    Deploy,
+    /// Everything, like the admin token
+    Admin,
+}
+
+impl Scope {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            Scope::Read => "read",
+            Scope::Deploy => "deploy",
+            Scope::Admin => "admin",
+        }
+    }
+}
+
+impl fmt::Display for Scope {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.pad(self.as_str())
+    }
+}
+
+impl FromStr for Scope {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> Result<Self> {
+        match s {
+            "read" | "read-only" | "readonly" => Ok(Scope::Read),
+            "deploy" | "deploy-only" => Ok(Scope::Deploy),
+            "admin" | "full" => Ok(Scope::Admin),
+            _ => anyhow::bail!("Unknown scope '{}' (expected read, deploy or admin)", s),
+        }
+    }
+}
+
+/// Extra admin tokens from `settings.admin_tokens_file`, reloadable at runtime.
+///
+/// The file holds one token per line, either plaintext or an Argon2 hash from
+/// `hash_token` (blank lines and `#` comments are skipped). A reload parses the
+/// whole file first and swaps the set in one step, so a request sees either the
+/// old tokens or the new ones, never a mix; a file that fails to parse leaves
+/// the current set in place. Every swap bumps a generation that long-lived
+/// sessions (log streams) watch so they end and re-authenticate.
+///
+/// Checking an Argon2 hash is slow by design, so tokens that passed are
+/// remembered (as digests) until the next swap.
+pub struct AdminTokens {
+    path: Option<PathBuf>,
+    hashes: RwLock<Arc<Vec<String>>>,
+    generation: watch::Sender<u64>,
+    verified: Mutex<HashSet<Vec<u8>>>,
+}
+
+/// Tokens remembered as verified; past this the memory starts over
+const MAX_VERIFIED_TOKENS: usize = 256;
+
+impl AdminTokens {
+    /// A set with no file-backed tokens
+    pub fn empty() -> Arc<Self> {
+        Arc::new(Self {
+            path: None,
+            hashes: RwLock::new(Arc::new(Vec::new())),
+            generation: watch::channel(0).0,
+            verified: Mutex::new(HashSet::new()),
+        })
+    }
+
+    /// Load tokens from a file (or an empty set when no file is configured)
+    pub fn load(path: Option<PathBuf>) -> Result<Arc<Self>> {
+        let hashes = match &path {
+            Some(path) => read_token_file(path)?,
+            None => Vec::new(),
+        };
+        Ok(Arc::new(Self {
+            path,
+            hashes: RwLock::new(Arc::new(hashes)),
+            generation: watch::channel(0).0,
+            verified: Mutex::new(HashSet::new()),
+        }))
+    }
+
+    /// Re-read the token file and swap it in. Returns the number of tokens loaded.
+    pub fn reload(&self) -> Result<usize> {
+        let Some(path) = &self.path else {
+            anyhow::bail!("No settings.admin_tokens_file configured");
+        };
+        let hashes = read_token_file(path)?;
+        let count = hashes.len();
+        self.swap(hashes);
+        Ok(count)
+    }
+
+    /// Replace the token set with already-hashed tokens
+    pub fn swap(&self, hashes: Vec<String>) {
+        // Under the verified lock, so a check of the old set can't be remembered
+        let mut verified = self.verified.lock().unwrap();
+        verified.clear();
+        *self.hashes.write().unwrap() = Arc::new(hashes);
+        self.generation.send_modify(|g| *g += 1);
+    }
+
+    /// Check a token against the current set
+    pub fn verify(&self, token: &str) -> bool {
+        let digest = ring::digest::digest(&ring::digest::SHA256, token.as_bytes());
+        if self.verified.lock().unwrap().contains(digest.as_ref()) {
+            return true;
+        }
+        let generation = self.generation();
+        let hashes = self.hashes.read().unwrap().clone();
+        let valid = hashes.iter().any(|hash| verify_token(token, hash));
+        if valid {
+            let mut verified = self.verified.lock().unwrap();
+            if self.generation() == generation {
+                if verified.len() >= MAX_VERIFIED_TOKENS {
+                    verified.clear();
+                }
+                verified.insert(digest.as_ref().to_vec());
+            }
+        }
+        valid
+    }
+
+    /// [`verify`](Self::verify) without blocking the runtime on a hash check
+    pub async fn check(self: Arc<Self>, token: String) -> bool {
+        if self.is_empty() {
+            return false;
+        }
+        tokio::task::spawn_blocking(move || self.verify(&token))
+            .await
+            .unwrap_or(false)
+    }
+
+    /// Number of tokens in the current set
+    pub fn len(&self) -> usize {
+        self.hashes.read().unwrap().len()
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.len() == 0
+    }
+
+    /// Current generation (increments on every swap)
+    pub fn generation(&self) -> u64 {
+        *self.generation.borrow()
+    }
+
+    /// Watch for swaps
+    pub fn subscribe(&self) -> watch::Receiver<u64> {
+        self.generation.subscribe()
+    }
+}
+
+/// Parse a token file into Argon2 hashes, hashing plaintext lines
+fn read_token_file(path: &Path) -> Result<Vec<String>> {
+    let content = std::fs::read_to_string(path)
+        .with_context(|| format!("Failed to read admin tokens file {}", path.display()))?;
+    content
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .enumerate()
+        .map(|(i, line)| {
+            if line.starts_with("$argon2") {
+                PasswordHash::new(line).map_err(|e| {
+                    anyhow::anyhow!(
+                        "{}: entry {} is not a valid hash: {}",
+                        path.display(),
+                        i + 1,
+                        e
+                    )
+                })?;
+                Ok(line.to_string())
+            } else {
+                hash_token(line)
+            }
+        })
+        .collect()
+}
+
 #[cfg(test)]
 mod tests {
     use super::*;
@@ -281,6 +473,23 @@ mod tests {
         assert!(!verify_token("MYTOKEN123", &hash));
     }
 
+    // ===================
+    // SCOPE TESTS
+    // ===================
+
+    #[test]
+    fn test_scope_parse_and_order() {
+        for scope in [Scope::Read, Scope::Deploy, Scope::Admin] {
+            assert_eq!(scope.as_str().parse::<Scope>().unwrap(), scope);
+        }
+        assert_eq!("read-only".parse::<Scope>().unwrap(), Scope::Read);
+        assert_eq!("full".parse::<Scope>().unwrap(), Scope::Admin);
+        assert!("owner".parse::<Scope>().is_err());
+
+        assert!(Scope::Read < Scope::Deploy && Scope::Deploy < Scope::Admin);
+        assert_eq!(serde_json::to_value(Scope::Deploy).unwrap(), "deploy");
+    }
+
     // ===================
     // TOKEN STORE TESTS
     // ===================
@@ -412,4 +621,77 @@ mod tests {
         // Each call should generate a unique token
         assert_ne!(token1, token2);
     }
+
+    // ===================
+    // ADMIN TOKEN FILE TESTS
+    // ===================
+
+    #[test]
+    fn test_admin_tokens_load_plaintext_and_hashes() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("admin-tokens");
+        let hashed = hash_token("hashed-token").unwrap();
+        std::fs::write(&path, format!("# ops\nplain-token\n\n{}\n", hashed)).unwrap();
+
+        let tokens = AdminTokens::load(Some(path)).unwrap();
+        assert_eq!(tokens.len(), 2);
+        assert!(tokens.verify("plain-token"));
+        assert!(tokens.verify("hashed-token"));
+        assert!(!tokens.verify("other"));
+    }
+
+    #[test]
+    fn test_admin_tokens_reload_swaps_set() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("admin-tokens");
+        std::fs::write(&path, "old-token\n").unwrap();
+        let tokens = AdminTokens::load(Some(path.clone())).unwrap();
+        let mut changes = tokens.subscribe();
+
+        std::fs::write(&path, "new-token\n").unwrap();
+        assert_eq!(tokens.reload().unwrap(), 1);
+
+        assert!(!tokens.verify("old-token"));
+        assert!(tokens.verify("new-token"));
+        assert_eq!(tokens.generation(), 1);
+        assert!(changes.has_changed().unwrap());
+    }
+
+    #[test]
+    fn test_admin_tokens_bad_reload_keeps_current_set() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("admin-tokens");
+        std::fs::write(&path, "good-token\n").unwrap();
+        let tokens = AdminTokens::load(Some(path.clone())).unwrap();
+
+        std::fs::write(&path, "$argon2id$!!!\n").unwrap();
+        assert!(tokens.reload().is_err());
+        assert!(tokens.verify("good-token"));
+        assert_eq!(tokens.generation(), 0);
+
+        std::fs::remove_file(&path).unwrap();
+        assert!(tokens.reload().is_err());
+        assert!(tokens.verify("good-token"));
+    }
+
+    #[tokio::test]
+    async fn test_admin_tokens_remembered_until_swap() {
+        let tokens = AdminTokens::empty();
+        tokens.swap(vec![hash_token("token").unwrap()]);
+        assert!(tokens.clone().check("token".to_string()).await);
+        assert!(!tokens.clone().check("other".to_string()).await);
+        assert_eq!(tokens.verified.lock().unwrap().len(), 1);
+
+        tokens.swap(vec![hash_token("new-token").unwrap()]);
+        assert!(!tokens.verify("token"));
+        assert!(tokens.verify("new-token"));
+    }
+
+    #[test]
+    fn test_admin_tokens_empty() {
+        let tokens = AdminTokens::empty();
+        assert!(tokens.is_empty());
+        assert!(!tokens.verify(""));
+        assert!(tokens.reload().is_err());
+    }
 }
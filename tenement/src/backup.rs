@@ -0,0 +1,727 @@
+//! Backups of a host's state
+//!
+//! A backup is one .tar.gz with what it takes to rebuild a host: a snapshot
+//! of the state DB (taken with `VACUUM INTO`, so it's consistent while the
+//! server runs), the encrypted secrets store and every service's volumes.
+//! `[settings.backup]` names the target, a directory or s3://bucket/prefix,
+//! and optionally a cron schedule to take them on; after each backup the ones
+//! beyond `keep` or older than `max_age` are deleted.
+//!
+//! `ten backup create` takes one on demand, `ten backup ls` lists them, and
+//! `ten restore <name>` unpacks one into the data dir of a stopped server.
+//! master.key stays out unless `include_master_key` is set, so the restored
+//! host needs the same TENEMENT_MASTER_KEY or key file to read its secrets.
+
+use crate::artifact::S3Fetcher;
+use crate::config::{BackupConfig, Config};
+use crate::secret_store::{KEY_FILE_NAME, STORE_FILE_NAME};
+use crate::store::DbPool;
+use crate::users::RunAs;
+use crate::volumes;
+use crate::Hypervisor;
+use anyhow::{Context, Result};
+use chrono::{DateTime, NaiveDateTime, TimeZone, Utc};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::Arc;
+use std::time::Duration;
+use tracing::{error, info};
+
+/// The state DB, in the data dir and in backups
+pub const DB_FILE_NAME: &str = "tenement.db";
+
+/// Describes a backup's contents, first in the archive
+const MANIFEST_NAME: &str = "manifest.json";
+
+/// Bumped when the archive layout changes
+const MANIFEST_VERSION: u32 = 1;
+
+/// Volumes sit at volumes/{service}/{name} in the archive
+const VOLUMES_PREFIX: &str = "volumes";
+
+/// Backups are named tenement-{time}.tar.gz
+const NAME_PREFIX: &str = "tenement-";
+const NAME_SUFFIX: &str = ".tar.gz";
+const NAME_TIME_FORMAT: &str = "%Y%m%dT%H%M%SZ";
+
+/// How often the scheduler checks whether a backup is due
+const CHECK_INTERVAL: Duration = Duration::from_secs(15);
+
+/// Where backups are kept
+#[derive(Debug, Clone, PartialEq)]
+pub enum Target {
+    Dir(PathBuf),
+    S3 { bucket: String, prefix: String },
+}
+
+impl Target {
+    /// A directory (a path or file:// URL) or s3://bucket/prefix
+    pub fn parse(target: &str) -> Result<Self> {
+        if target.len() >= 5 && target[..5].eq_ignore_ascii_case("s3://") {
+            let (bucket, prefix) = crate::artifact::split_s3_url(target)?;
+            return Ok(Self::S3 {
+                bucket: bucket.to_string(),
+                prefix: prefix.trim_matches('/').to_string(),
+            });
+        }
+        let path = target.strip_prefix("file://").unwrap_or(target);
+        if path.is_empty() || (target.contains("://") && !target.starts_with("file://")) {
+            anyhow::bail!(
+                "Backup target {:?} must be a directory or s3://bucket/prefix",
+                target
+            );
+        }
+        Ok(Self::Dir(PathBuf::from(path)))
+    }
+
+    /// The target holding the backup file at `location`, and its name
+    pub fn locate(location: &str) -> Result<(Self, String)> {
+        match location.rsplit_once('/') {
+            Some((_, "")) => anyhow::bail!("{} doesn't name a backup file", location),
+            Some(("", name)) => Ok((Self::Dir(PathBuf::from("/")), name.to_string())),
+            Some((parent, name)) => Ok((Self::parse(parent)?, name.to_string())),
+            None => Ok((Self::Dir(PathBuf::from(".")), location.to_string())),
+        }
+    }
+
+    /// The s3:// URL of a backup
+    fn object_url(bucket: &str, prefix: &str, name: &str) -> String {
+        match prefix {
+            "" => format!("s3://{}/{}", bucket, name),
+            _ => format!("s3://{}/{}/{}", bucket, prefix, name),
+        }
+    }
+
+    /// Backups here, newest first
+    pub async fn list(&self) -> Result<Vec<Backup>> {
+        let mut found: Vec<(String, u64)> = Vec::new();
+        match self {
+            Self::Dir(dir) => {
+                let mut entries = match tokio::fs::read_dir(dir).await {
+                    Ok(entries) => entries,
+                    Err(e) if e.kind() == std::io::ErrorKind::NotFound => return Ok(Vec::new()),
+                    Err(e) => {
+                        return Err(e).with_context(|| format!("Failed to list {}", dir.display()))
+                    }
+                };
+                while let Some(entry) = entries.next_entry().await? {
+                    let name = entry.file_name().to_string_lossy().to_string();
+                    found.push((name, entry.metadata().await?.len()));
+                }
+            }
+            Self::S3 { bucket, prefix } => {
+                let url = match prefix.as_str() {
+                    "" => format!("s3://{}", bucket),
+                    _ => format!("s3://{}/{}/", bucket, prefix),
+                };
+                for (key, size) in S3Fetcher::from_env().list(&url).await? {
+                    let name = key.rsplit('/').next().unwrap_or(&key).to_string();
+                    found.push((name, size));
+                }
+            }
+        }
+        let mut backups: Vec<Backup> = found
+            .into_iter()
+            .filter_map(|(name, bytes)| {
+                let created_at = parse_name(&name)?;
+                Some(Backup {
+                    name,
+                    created_at,
+                    bytes,
+                })
+            })
+            .collect();
+        backups.sort_by(|a, b| b.created_at.cmp(&a.created_at));
+        Ok(backups)
+    }
+
+    async fn upload(&self, file: &Path, name: &str) -> Result<()> {
+        match self {
+            Self::Dir(dir) => {
+                tokio::fs::create_dir_all(dir)
+                    .await
+                    .with_context(|| format!("Failed to create {}", dir.display()))?;
+                // Copied under a name `list` skips, so a partial copy never counts
+                let partial = dir.join(format!(".{}.partial", name));
+                tokio::fs::copy(file, &partial)
+                    .await
+                    .with_context(|| format!("Failed to write {}", partial.display()))?;
+                tokio::fs::rename(&partial, dir.join(name)).await?;
+                Ok(())
+            }
+            Self::S3 { bucket, prefix } => {
+                let url = Self::object_url(bucket, prefix, name);
+                S3Fetcher::from_env().put_file(&url, file).await
+            }
+        }
+    }
+
+    async fn download(&self, name: &str, dest: &Path) -> Result<()> {
+        match self {
+            Self::Dir(dir) => {
+                let path = dir.join(name);
+                tokio::fs::copy(&path, dest)
+                    .await
+                    .with_context(|| format!("Failed to read backup {}", path.display()))?;
+                Ok(())
+            }
+            Self::S3 { bucket, prefix } => {
+                let url = Self::object_url(bucket, prefix, name);
+                crate::artifact::Fetcher::fetch(&S3Fetcher::from_env(), &url, dest)
+                    .await
+                    .with_context(|| format!("Failed to download {}", url))
+            }
+        }
+    }
+
+    async fn delete(&self, name: &str) -> Result<()> {
+        match self {
+            Self::Dir(dir) => Ok(tokio::fs::remove_file(dir.join(name)).await?),
+            Self::S3 { bucket, prefix } => {
+                let url = Self::object_url(bucket, prefix, name);
+                S3Fetcher::from_env().delete(&url).await
+            }
+        }
+    }
+}
+
+impl std::fmt::Display for Target {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            Self::Dir(dir) => write!(f, "{}", dir.display()),
+            Self::S3 { bucket, prefix } if prefix.is_empty() => write!(f, "s3://{}", bucket),
+            Self::S3 { bucket, prefix } => write!(f, "s3://{}/{}", bucket, prefix),
+        }
+    }
+}
+
+/// A backup at a target
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Backup {
+    pub name: String,
+    pub created_at: DateTime<Utc>,
+    pub bytes: u64,
+}
+
+/// What a backup holds, as manifest.json
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Manifest {
+    pub version: u32,
+    pub created_at: DateTime<Utc>,
+    /// Version of tenement that took it
+    pub tenement_version: String,
+    pub secrets: bool,
+    pub master_key: bool,
+    pub volumes: Vec<VolumeEntry>,
+}
+
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct VolumeEntry {
+    pub service: String,
+    pub name: String,
+}
+
+/// A backup's file name for its time
+fn backup_name(at: DateTime<Utc>) -> String {
+    format!(
+        "{}{}{}",
+        NAME_PREFIX,
+        at.format(NAME_TIME_FORMAT),
+        NAME_SUFFIX
+    )
+}
+
+/// When a backup was taken, from its name; None if it isn't a backup's name
+fn parse_name(name: &str) -> Option<DateTime<Utc>> {
+    let time = name.strip_prefix(NAME_PREFIX)?.strip_suffix(NAME_SUFFIX)?;
+    let time = NaiveDateTime::parse_from_str(time, NAME_TIME_FORMAT).ok()?;
+    Some(Utc.from_utc_datetime(&time))
+}
+
+/// Back up the host to `target`: snapshot the state DB through `pool`, then
+/// archive it with the secrets store and volumes of `config`'s data dir
+pub async fn create(
+    config: &Config,
+    pool: &DbPool,
+    target: &Target,
+    include_master_key: bool,
+) -> Result<Backup> {
+    let data_dir = &config.settings.data_dir;
+    // Whole seconds, as the name has them
+    let created_at = DateTime::from_timestamp(Utc::now().timestamp(), 0).unwrap_or_default();
+    let name = backup_name(created_at);
+    let staging = data_dir.join(format!(".backup-{}", created_at.format(NAME_TIME_FORMAT)));
+    if tokio::fs::try_exists(&staging).await.unwrap_or(false) {
+        tokio::fs::remove_dir_all(&staging).await?;
+    }
+    tokio::fs::create_dir_all(&staging)
+        .await
+        .with_context(|| format!("Failed to create {}", staging.display()))?;
+
+    let archive = staging.join(&name);
+    let created = async {
+        let db = staging.join(DB_FILE_NAME);
+        sqlx::query("VACUUM INTO ?")
+            .bind(db.to_string_lossy().to_string())
+            .execute(pool)
+            .await
+            .context("Failed to snapshot the state DB")?;
+        // Sizing volumes and compressing them is all disk work
+        let (config, archive) = (config.clone(), archive.clone());
+        tokio::task::spawn_blocking(move || {
+            let manifest = manifest(&config, created_at, include_master_key)?;
+            write_archive(&archive, &config.settings.data_dir, &db, &manifest)
+        })
+        .await??;
+        target.upload(&archive, &name).await
+    };
+    let result = created.await;
+    let bytes = tokio::fs::metadata(&archive)
+        .await
+        .map(|m| m.len())
+        .unwrap_or(0);
+    tokio::fs::remove_dir_all(&staging).await.ok();
+    result.with_context(|| format!("Backup to {} failed", target))?;
+    Ok(Backup {
+        name,
+        created_at,
+        bytes,
+    })
+}
+
+/// What a backup of `config`'s data dir taken at `created_at` holds
+fn manifest(
+    config: &Config,
+    created_at: DateTime<Utc>,
+    include_master_key: bool,
+) -> Result<Manifest> {
+    let data_dir = &config.settings.data_dir;
+    let volumes: Vec<_> = volumes::list(config)?
+        .into_iter()
+        .filter(|volume| volume.path.is_dir())
+        .collect();
+    Ok(Manifest {
+        version: MANIFEST_VERSION,
+        created_at,
+        tenement_version: env!("CARGO_PKG_VERSION").to_string(),
+        secrets: data_dir.join(STORE_FILE_NAME).exists(),
+        master_key: include_master_key && data_dir.join(KEY_FILE_NAME).exists(),
+        volumes: volumes
+            .iter()
+            .map(|volume| VolumeEntry {
+                service: volume.service.clone(),
+                name: volume.name.clone(),
+            })
+            .collect(),
+    })
+}
+
+fn write_archive(archive: &Path, data_dir: &Path, db: &Path, manifest: &Manifest) -> Result<()> {
+    let file = std::fs::File::create(archive)?;
+    let gz = flate2::write::GzEncoder::new(
+        std::io::BufWriter::new(file),
+        flate2::Compression::default(),
+    );
+    let mut tar = tar::Builder::new(gz);
+    tar.follow_symlinks(false);
+
+    let json = serde_json::to_vec_pretty(manifest)?;
+    let mut header = tar::Header::new_gnu();
+    header.set_size(json.len() as u64);
+    header.set_mode(0o644);
+    header.set_mtime(manifest.created_at.timestamp().max(0) as u64);
+    header.set_cksum();
+    tar.append_data(&mut header, MANIFEST_NAME, &json[..])?;
+    tar.append_path_with_name(db, DB_FILE_NAME)?;
+    if manifest.secrets {
+        tar.append_path_with_name(data_dir.join(STORE_FILE_NAME), STORE_FILE_NAME)?;
+    }
+    if manifest.master_key {
+        tar.append_path_with_name(data_dir.join(KEY_FILE_NAME), KEY_FILE_NAME)?;
+    }
+    for volume in &manifest.volumes {
+        let dir = volumes::volume_dir(data_dir, &volume.service, &volume.name);
+        let path = format!("{}/{}/{}", VOLUMES_PREFIX, volume.service, volume.name);
+        tar.append_dir_all(&path, &dir)
+            .with_context(|| format!("Failed to archive {}", dir.display()))?;
+    }
+    tar.into_inner()?.finish()?.flush()?;
+    Ok(())
+}
+
+/// The backups retention deletes: all but the newest `keep` (0 = no limit)
+/// and any older than `max_age` seconds. The newest is always kept. `backups`
+/// is newest first, as [`Target::list`] returns them.
+pub fn expired(
+    backups: &[Backup],
+    keep: usize,
+    max_age: Option<u64>,
+    now: DateTime<Utc>,
+) -> Vec<Backup> {
+    backups
+        .iter()
+        .enumerate()
+        .skip(1)
+        .filter(|(index, backup)| {
+            let too_many = keep > 0 && *index >= keep;
+            let too_old = max_age.is_some_and(|max_age| {
+                now.signed_duration_since(backup.created_at).num_seconds() > max_age as i64
+            });
+            too_many || too_old
+        })
+        .map(|(_, backup)| backup.clone())
+        .collect()
+}
+
+/// Delete the backups at `target` that `config`'s retention expires; returns them
+pub async fn prune(config: &BackupConfig, target: &Target) -> Result<Vec<Backup>> {
+    let backups = target.list().await?;
+    let expired = expired(&backups, config.keep, config.max_age, Utc::now());
+    for backup in &expired {
+        target
+            .delete(&backup.name)
+            .await
+            .with_context(|| format!("Failed to delete old backup {}", backup.name))?;
+    }
+    Ok(expired)
+}
+
+/// Replace `config`'s data dir's state DB, secrets store and volumes with the
+/// backup `name` at `target`; volumes go to their services' users. Only for a
+/// stopped server: a running one keeps the old DB open.
+pub async fn restore(config: &Config, target: &Target, name: &str) -> Result<Manifest> {
+    let data_dir = config.settings.data_dir.clone();
+    let mut owners = HashMap::new();
+    for (service, service_config) in &config.service {
+        if service_config.volumes.is_empty() {
+            continue;
+        }
+        let run_as = crate::users::resolve(
+            service_config.user.as_deref(),
+            service_config.group.as_deref(),
+        )
+        .with_context(|| format!("Cannot give {}'s volumes to its user", service))?;
+        owners.insert(service.clone(), run_as);
+    }
+
+    let staging = data_dir.join(format!(".restore-{}", name.trim_end_matches(NAME_SUFFIX)));
+    if staging.exists() {
+        std::fs::remove_dir_all(&staging)?;
+    }
+    std::fs::create_dir_all(&staging)
+        .with_context(|| format!("Failed to create {}", staging.display()))?;
+    let archive = staging.join(name);
+    let restored = async {
+        target.download(name, &archive).await?;
+        let (archive, staging, data_dir) = (archive.clone(), staging.clone(), data_dir.clone());
+        tokio::task::spawn_blocking(move || {
+            unpack_into(&archive, &staging.join("unpacked"), &data_dir, &owners)
+        })
+        .await?
+    };
+    let result = restored.await;
+    std::fs::remove_dir_all(&staging).ok();
+    result.with_context(|| format!("Failed to restore {} from {}", name, target))
+}
+
+fn unpack_into(
+    archive: &Path,
+    unpacked: &Path,
+    data_dir: &Path,
+    owners: &HashMap<String, Option<RunAs>>,
+) -> Result<Manifest> {
+    let file = std::io::BufReader::new(std::fs::File::open(archive)?);
+    let mut tar = tar::Archive::new(flate2::read::GzDecoder::new(file));
+    tar.set_preserve_permissions(true);
+    // Archive::unpack skips entries that would land outside `unpacked`
+    tar.unpack(unpacked).context("Failed to unpack backup")?;
+    let manifest = std::fs::read(unpacked.join(MANIFEST_NAME))
+        .context("Not a tenement backup: it has no manifest")?;
+    let manifest: Manifest = serde_json::from_slice(&manifest)?;
+    if manifest.version != MANIFEST_VERSION {
+        anyhow::bail!(
+            "Backup has layout version {}; this tenement reads version {}",
+            manifest.version,
+            MANIFEST_VERSION
+        );
+    }
+
+    // The old DB's write-ahead log mustn't be replayed into the new one
+    std::fs::create_dir_all(data_dir)?;
+    for suffix in ["-wal", "-shm"] {
+        std::fs::remove_file(data_dir.join(format!("{}{}", DB_FILE_NAME, suffix))).ok();
+    }
+    std::fs::rename(unpacked.join(DB_FILE_NAME), data_dir.join(DB_FILE_NAME))
+        .context("Failed to restore the state DB")?;
+    for file in [STORE_FILE_NAME, KEY_FILE_NAME] {
+        let from = unpacked.join(file);
+        if from.exists() {
+            std::fs::rename(&from, data_dir.join(file))
+                .with_context(|| format!("Failed to restore {}", file))?;
+        }
+    }
+    for volume in &manifest.volumes {
+        let from = unpacked
+            .join(VOLUMES_PREFIX)
+            .join(&volume.service)
+            .join(&volume.name);
+        if !from.is_dir() {
+            continue;
+        }
+        let dir = volumes::volume_dir(data_dir, &volume.service, &volume.name);
+        let run_as = owners.get(&volume.service).copied().flatten();
+        volumes::replace(&dir, &from, run_as.as_ref())?;
+    }
+    Ok(manifest)
+}
+
+/// Take the backups `[settings.backup]` schedules, picking up config reloads.
+/// A cluster node only takes them while it leads.
+pub fn spawn_scheduler(hypervisor: Arc<Hypervisor>, pool: DbPool) -> tokio::task::JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(CHECK_INTERVAL);
+        let mut planned: Option<(BackupConfig, DateTime<Utc>)> = None;
+        loop {
+            interval.tick().await;
+            let config = hypervisor.config();
+            let Some(backup) = config.settings.backup.clone() else {
+                planned = None;
+                continue;
+            };
+            let now = Utc::now();
+            let current = matches!(&planned, Some((planned_for, _)) if *planned_for == backup);
+            let due = current && planned.as_ref().is_some_and(|(_, at)| *at <= now);
+            // Plan the next one after each run, and afresh when the config changes
+            if due || !current {
+                planned = next_run(&backup, now).map(|at| (backup.clone(), at));
+            }
+            let follower = hypervisor
+                .cluster()
+                .is_some_and(|cluster| !cluster.is_leader());
+            if !due || follower {
+                continue;
+            }
+            run_scheduled(&config, &pool, &backup).await;
+        }
+    })
+}
+
+/// The next time a backup is due after `now`, if it has a valid schedule
+fn next_run(backup: &BackupConfig, now: DateTime<Utc>) -> Option<DateTime<Utc>> {
+    let schedule = backup.parsed_schedule().ok()??;
+    schedule.next_after(now, &backup.tz().ok()?)
+}
+
+async fn run_scheduled(config: &Config, pool: &DbPool, backup: &BackupConfig) {
+    let target = match Target::parse(&backup.target) {
+        Ok(target) => target,
+        Err(e) => {
+            error!("Scheduled backup skipped: {:#}", e);
+            return;
+        }
+    };
+    match create(config, pool, &target, backup.include_master_key).await {
+        Ok(created) => info!(
+            event = "backup",
+            "Backed up to {}/{} ({} bytes)", target, created.name, created.bytes
+        ),
+        Err(e) => {
+            error!("Scheduled backup failed: {:#}", e);
+            return;
+        }
+    }
+    match prune(backup, &target).await {
+        Ok(deleted) if !deleted.is_empty() => {
+            info!("Deleted {} old backup(s) from {}", deleted.len(), target)
+        }
+        Ok(_) => {}
+        Err(e) => error!("Backup retention failed: {:#}", e),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn backup_at(at: &str) -> Backup {
+        let created_at = DateTime::parse_from_rfc3339(at)
+            .unwrap()
+            .with_timezone(&Utc);
+        Backup {
+            name: backup_name(created_at),
+            created_at,
+            bytes: 0,
+        }
+    }
+
+    // ===================
+    // Targets and names
+    // ===================
+
+    #[test]
+    fn test_parse_targets() {
+        assert_eq!(
+            Target::parse("/var/backups/ten").unwrap(),
+            Target::Dir(PathBuf::from("/var/backups/ten"))
+        );
+        assert_eq!(
+            Target::parse("file:///var/backups").unwrap(),
+            Target::Dir(PathBuf::from("/var/backups"))
+        );
+        assert_eq!(
+            Target::parse("s3://backups/hosts/web1/").unwrap(),
+            Target::S3 {
+                bucket: "backups".to_string(),
+                prefix: "hosts/web1".to_string()
+            }
+        );
+        assert!(Target::parse("https://example.com/backups").is_err());
+        assert!(Target::parse("").is_err());
+
+        let (target, name) = Target::locate("s3://backups/web1/tenement-x.tar.gz").unwrap();
+        assert_eq!(target.to_string(), "s3://backups/web1");
+        assert_eq!(name, "tenement-x.tar.gz");
+        let (target, name) = Target::locate("tenement-x.tar.gz").unwrap();
+        assert_eq!(target, Target::Dir(PathBuf::from(".")));
+        assert_eq!(name, "tenement-x.tar.gz");
+    }
+
+    #[test]
+    fn test_backup_names() {
+        let backup = backup_at("2026-10-14T03:00:00Z");
+        assert_eq!(backup.name, "tenement-20261014T030000Z.tar.gz");
+        assert_eq!(parse_name(&backup.name), Some(backup.created_at));
+        assert_eq!(parse_name("notes.txt"), None);
+        assert_eq!(
+            parse_name(".tenement-20261014T030000Z.tar.gz.partial"),
+            None
+        );
+    }
+
+    // ===================
+    // Retention
+    // ===================
+
+    #[test]
+    fn test_retention() {
+        let now = DateTime::parse_from_rfc3339("2026-10-14T12:00:00Z")
+            .unwrap()
+            .with_timezone(&Utc);
+        let backups: Vec<Backup> = (0..5)
+            .map(|day| backup_at(&format!("2026-10-{:02}T03:00:00Z", 14 - day)))
+            .collect();
+        let names = |expired: Vec<Backup>| -> Vec<String> {
+            expired
+                .into_iter()
+                .map(|b| b.created_at.format("%d").to_string())
+                .collect()
+        };
+
+        assert_eq!(names(expired(&backups, 3, None, now)), ["11", "10"]);
+        assert_eq!(
+            names(expired(&backups, 0, Some(2 * 86400), now)),
+            ["12", "11", "10"]
+        );
+        assert!(expired(&backups, 0, None, now).is_empty());
+        // The newest survives even when it's too old
+        assert_eq!(
+            names(expired(&backups, 1, Some(1), now)),
+            ["13", "12", "11", "10"]
+        );
+    }
+
+    // ===================
+    // Backup and restore
+    // ===================
+
+    #[tokio::test]
+    async fn test_backup_and_restore_round_trip() {
+        let dir = TempDir::new().unwrap();
+        let data_dir = dir.path().join("data");
+        let content = format!(
+            "[settings]\ndata_dir = {:?}\n\n[service.api]\ncommand = \"./api\"\n\
+             volumes = {{ uploads = {{}} }}\n",
+            data_dir
+        );
+        let config = Config::from_str(&content).unwrap();
+        let pool = crate::store::init_db(&data_dir.join(DB_FILE_NAME))
+            .await
+            .unwrap();
+        let store = crate::store::ConfigStore::new(pool.clone());
+        store.set("greeting", "hello").await.unwrap();
+        std::fs::write(data_dir.join(STORE_FILE_NAME), b"sealed").unwrap();
+        std::fs::write(data_dir.join(KEY_FILE_NAME), b"key").unwrap();
+        let uploads = volumes::volume_dir(&data_dir, "api", "uploads");
+        std::fs::create_dir_all(&uploads).unwrap();
+        std::fs::write(uploads.join("a.jpg"), b"photo").unwrap();
+
+        let target = Target::Dir(dir.path().join("backups"));
+        let backup = create(&config, &pool, &target, false).await.unwrap();
+        assert_eq!(target.list().await.unwrap(), [backup.clone()]);
+        assert!(backup.bytes > 0);
+        pool.close().await;
+
+        // A fresh host
+        std::fs::remove_dir_all(&data_dir).unwrap();
+        let manifest = restore(&config, &target, &backup.name).await.unwrap();
+        assert!(manifest.secrets);
+        assert!(!manifest.master_key);
+        assert_eq!(manifest.volumes.len(), 1);
+        assert_eq!(std::fs::read(uploads.join("a.jpg")).unwrap(), b"photo");
+        assert_eq!(
+            std::fs::read(data_dir.join(STORE_FILE_NAME)).unwrap(),
+            b"sealed"
+        );
+        assert!(!data_dir.join(KEY_FILE_NAME).exists());
+
+        let pool = crate::store::init_db(&data_dir.join(DB_FILE_NAME))
+            .await
+            .unwrap();
+        let store = crate::store::ConfigStore::new(pool);
+        assert_eq!(
+            store.get("greeting").await.unwrap().as_deref(),
+            Some("hello")
+        );
+        // Nothing left over besides what was restored
+        let mut left: Vec<_> = std::fs::read_dir(&data_dir)
+            .unwrap()
+            .map(|entry| entry.unwrap().file_name().to_string_lossy().to_string())
+            .filter(|name| !name.starts_with(DB_FILE_NAME))
+            .collect();
+        left.sort();
+        assert_eq!(left, [".volumes", STORE_FILE_NAME]);
+    }
+
+    #[tokio::test]
+    async fn test_prune_deletes_expired_backups() {
+        let dir = TempDir::new().unwrap();
+        let target = Target::Dir(dir.path().to_path_buf());
+        for day in 10..14 {
+            let name = format!("tenement-202610{}T030000Z.tar.gz", day);
+            std::fs::write(dir.path().join(name), b"x").unwrap();
+        }
+        std::fs::write(dir.path().join("unrelated.txt"), b"x").unwrap();
+        let config: BackupConfig = toml::from_str("target = \"/unused\"\nkeep = 2\n").unwrap();
+
+        let deleted = prune(&config, &target).await.unwrap();
+        assert_eq!(deleted.len(), 2);
+        let left: Vec<_> = target
+            .list()
+            .await
+            .unwrap()
+            .into_iter()
+            .map(|b| b.name)
+            .collect();
+        assert_eq!(
+            left,
+            [
+                "tenement-20261013T030000Z.tar.gz",
+                "tenement-20261012T030000Z.tar.gz"
+            ]
+        );
+        assert!(dir.path().join("unrelated.txt").exists());
+    }
+}
@@ -0,0 +1,396 @@
+//! Build and start commands worked out from an app's source
+//!
+//! For a git-push service with `detect = true`, each checkout is looked at the
+//! way buildpacks and nixpacks do, so a simple app needs no `build` or
+//! `command` of its own:
+//!
+//! 1. The language, from its usual files: `go.mod`, `package.json`,
+//!    `requirements.txt`/`pyproject.toml`, `Gemfile` or `Cargo.toml`. Each
+//!    has a conventional build and start.
+//! 2. `nixpacks.toml`: its `[phases.*] cmds` (setup, install, build, in that
+//!    order) replace the build, and `[start] cmd` the start.
+//! 3. A `Procfile`: its `web` process (or its only one) replaces the start.
+//!
+//! Start commands run through `sh -c`, so `$PORT` and the like work as they
+//! do on Heroku.
+
+use anyhow::{Context, Result};
+use serde::Deserialize;
+use std::collections::BTreeMap;
+use std::path::Path;
+
+/// The phases of `nixpacks.toml` that make up the build, in the order they run
+const NIXPACKS_PHASES: [&str; 3] = ["setup", "install", "build"];
+
+/// The language of an app, from the files it has
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum AppKind {
+    Go,
+    Node,
+    Python,
+    Ruby,
+    Rust,
+}
+
+impl AppKind {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            AppKind::Go => "go",
+            AppKind::Node => "node",
+            AppKind::Python => "python",
+            AppKind::Ruby => "ruby",
+            AppKind::Rust => "rust",
+        }
+    }
+}
+
+impl std::fmt::Display for AppKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// How to build and start a checkout
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct BuildPlan {
+    /// None if no language was recognized (a Procfile or nixpacks.toml alone)
+    pub kind: Option<AppKind>,
+    /// Shell command run in the checkout; None needs no build
+    pub build: Option<String>,
+    /// Shell command that runs the app; None if nothing says
+    pub start: Option<String>,
+}
+
+impl BuildPlan {
+    /// The instance command and args that run `start`
+    pub fn start_command(&self) -> Result<(String, Vec<String>)> {
+        let Some(start) = &self.start else {
+            let what = match self.kind {
+                Some(kind) => format!("this {} app", kind),
+                None => "the app".to_string(),
+            };
+            anyhow::bail!(
+                "Can't tell how to start {}; add a Procfile with a `web:` line",
+                what
+            );
+        };
+        let script = format!("exec {}", start);
+        Ok(("sh".to_string(), vec!["-c".to_string(), script]))
+    }
+}
+
+/// Work out how to build and start the app in `dir`
+pub fn detect(dir: &Path) -> Result<BuildPlan> {
+    let (kind, mut build, mut start) = match detect_language(dir)? {
+        Some((kind, build, start)) => (Some(kind), build, start),
+        None => (None, None, None),
+    };
+    if let Some(nixpacks) = read_nixpacks(dir)? {
+        let cmds: Vec<String> = NIXPACKS_PHASES
+            .iter()
+            .filter_map(|phase| nixpacks.phases.get(*phase))
+            .flat_map(|phase| phase.cmds.iter().cloned())
+            .collect();
+        if !cmds.is_empty() {
+            build = Some(cmds.join(" && "));
+        }
+        if let Some(cmd) = nixpacks.start.and_then(|start| start.cmd) {
+            start = Some(cmd);
+        }
+    }
+    if let Some(web) = read_procfile(dir)? {
+        start = Some(web);
+    }
+    Ok(BuildPlan { kind, build, start })
+}
+
+/// The start command of a Procfile: its `web` process, or its only one
+pub fn parse_procfile(text: &str) -> Option<String> {
+    let processes: Vec<(&str, &str)> = text
+        .lines()
+        .map(str::trim)
+        .filter(|line| !line.is_empty() && !line.starts_with('#'))
+        .filter_map(|line| line.split_once(':'))
+        .map(|(name, command)| (name.trim(), command.trim()))
+        .filter(|(_, command)| !command.is_empty())
+        .collect();
+    if let Some((_, command)) = processes.iter().find(|(name, _)| *name == "web") {
+        return Some(command.to_string());
+    }
+    match processes.as_slice() {
+        [(_, command)] => Some(command.to_string()),
+        _ => None,
+    }
+}
+
+fn read_procfile(dir: &Path) -> Result<Option<String>> {
+    let Some(text) = read_optional(&dir.join("Procfile"))? else {
+        return Ok(None);
+    };
+    match parse_procfile(&text) {
+        Some(command) => Ok(Some(command)),
+        None => anyhow::bail!("Procfile has no `web:` process to start"),
+    }
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct NixpacksFile {
+    #[serde(default)]
+    phases: BTreeMap<String, NixpacksPhase>,
+    #[serde(default)]
+    start: Option<NixpacksStart>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct NixpacksPhase {
+    #[serde(default)]
+    cmds: Vec<String>,
+}
+
+#[derive(Debug, Default, Deserialize)]
+struct NixpacksStart {
+    cmd: Option<String>,
+}
+
+fn read_nixpacks(dir: &Path) -> Result<Option<NixpacksFile>> {
+    let Some(text) = read_optional(&dir.join("nixpacks.toml"))? else {
+        return Ok(None);
+    };
+    let file = toml::from_str(&text).context("Failed to parse nixpacks.toml")?;
+    Ok(Some(file))
+}
+
+/// A language's build and start, if `dir` is in one tenement knows
+fn detect_language(dir: &Path) -> Result<Option<(AppKind, Option<String>, Option<String>)>> {
+    let has = |name: &str| dir.join(name).exists();
+
+    if has("go.mod") {
+        let build = "go build -o app .".to_string();
+        return Ok(Some((AppKind::Go, Some(build), Some("./app".to_string()))));
+    }
+
+    if let Some(text) = read_optional(&dir.join("package.json"))? {
+        let package: PackageJson =
+            serde_json::from_str(&text).context("Failed to parse package.json")?;
+        let (install, run) = if has("pnpm-lock.yaml") {
+            ("pnpm install --frozen-lockfile", "pnpm")
+        } else if has("yarn.lock") {
+            ("yarn install --frozen-lockfile", "yarn")
+        } else if has("package-lock.json") {
+            ("npm ci", "npm")
+        } else {
+            ("npm install", "npm")
+        };
+        let mut build = install.to_string();
+        if package.scripts.contains_key("build") {
+            build.push_str(&format!(" && {} run build", run));
+        }
+        let start = if package.scripts.contains_key("start") {
+            format!("{} start", run)
+        } else {
+            format!("node {}", package.main.as_deref().unwrap_or("index.js"))
+        };
+        return Ok(Some((AppKind::Node, Some(build), Some(start))));
+    }
+
+    if has("requirements.txt") || has("pyproject.toml") {
+        let install = match has("requirements.txt") {
+            true => "-r requirements.txt",
+            false => ".",
+        };
+        let build = format!("python3 -m venv .venv && .venv/bin/pip install {}", install);
+        let start = ["main.py", "app.py"]
+            .into_iter()
+            .find(|script| has(script))
+            .map(|script| format!(".venv/bin/python {}", script));
+        return Ok(Some((AppKind::Python, Some(build), start)));
+    }
+
+    if has("Gemfile") {
+        let build = "bundle install".to_string();
+        let start = has("config.ru").then(|| "bundle exec rackup -p $PORT".to_string());
+        return Ok(Some((AppKind::Ruby, Some(build), start)));
+    }
+
+    if let Some(text) = read_optional(&dir.join("Cargo.toml"))? {
+        let manifest: CargoToml = toml::from_str(&text).context("Failed to parse Cargo.toml")?;
+        let build = "cargo build --release".to_string();
+        let start = manifest
+            .package
+            .map(|package| format!("./target/release/{}", package.name));
+        return Ok(Some((AppKind::Rust, Some(build), start)));
+    }
+
+    Ok(None)
+}
+
+#[derive(Debug, Deserialize)]
+struct PackageJson {
+    #[serde(default)]
+    scripts: BTreeMap<String, String>,
+    main: Option<String>,
+}
+
+#[derive(Debug, Deserialize)]
+struct CargoToml {
+    package: Option<CargoPackage>,
+}
+
+#[derive(Debug, Deserialize)]
+struct CargoPackage {
+    name: String,
+}
+
+/// A file's contents, or None if it isn't there
+fn read_optional(path: &Path) -> Result<Option<String>> {
+    match std::fs::read_to_string(path) {
+        Ok(text) => Ok(Some(text)),
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(None),
+        Err(e) => Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    /// A checkout holding `files`
+    fn app(files: &[(&str, &str)]) -> TempDir {
+        let dir = TempDir::new().unwrap();
+        for (name, contents) in files {
+            std::fs::write(dir.path().join(name), contents).unwrap();
+        }
+        dir
+    }
+
+    fn plan(files: &[(&str, &str)]) -> BuildPlan {
+        detect(app(files).path()).unwrap()
+    }
+
+    // ===================
+    // Languages
+    // ===================
+
+    #[test]
+    fn test_detects_languages() {
+        let go = plan(&[("go.mod", "module example.com/api\n")]);
+        assert_eq!(go.kind, Some(AppKind::Go));
+        assert_eq!(go.build.as_deref(), Some("go build -o app ."));
+        assert_eq!(go.start.as_deref(), Some("./app"));
+
+        let node = plan(&[
+            (
+                "package.json",
+                r#"{"scripts": {"build": "tsc", "start": "node dist/server.js"}}"#,
+            ),
+            ("yarn.lock", ""),
+        ]);
+        assert_eq!(node.kind, Some(AppKind::Node));
+        assert_eq!(
+            node.build.as_deref(),
+            Some("yarn install --frozen-lockfile && yarn run build")
+        );
+        assert_eq!(node.start.as_deref(), Some("yarn start"));
+        let node = plan(&[
+            ("package.json", r#"{"main": "server.js"}"#),
+            ("package-lock.json", ""),
+        ]);
+        assert_eq!(node.build.as_deref(), Some("npm ci"));
+        assert_eq!(node.start.as_deref(), Some("node server.js"));
+
+        let python = plan(&[("requirements.txt", "flask\n"), ("app.py", "")]);
+        assert_eq!(python.kind, Some(AppKind::Python));
+        assert_eq!(
+            python.build.as_deref(),
+            Some("python3 -m venv .venv && .venv/bin/pip install -r requirements.txt")
+        );
+        assert_eq!(python.start.as_deref(), Some(".venv/bin/python app.py"));
+
+        let rust = plan(&[(
+            "Cargo.toml",
+            "[package]\nname = \"api\"\nversion = \"0.1.0\"\n",
+        )]);
+        assert_eq!(rust.kind, Some(AppKind::Rust));
+        assert_eq!(rust.start.as_deref(), Some("./target/release/api"));
+
+        let ruby = plan(&[("Gemfile", ""), ("config.ru", "")]);
+        assert_eq!(ruby.start.as_deref(), Some("bundle exec rackup -p $PORT"));
+    }
+
+    #[test]
+    fn test_unknown_start() {
+        let python = plan(&[("requirements.txt", "")]);
+        assert!(python.build.is_some());
+        assert_eq!(python.start, None);
+        let err = python.start_command().unwrap_err().to_string();
+        assert!(err.contains("this python app"), "{}", err);
+        assert!(err.contains("Procfile"), "{}", err);
+
+        let unknown = plan(&[("README.md", "")]);
+        assert_eq!(
+            unknown,
+            BuildPlan {
+                kind: None,
+                build: None,
+                start: None
+            }
+        );
+    }
+
+    // ===================
+    // Procfile and nixpacks.toml
+    // ===================
+
+    #[test]
+    fn test_parse_procfile() {
+        let text = "# processes\nworker: ./worker\nweb: gunicorn app:app -b :$PORT\n";
+        assert_eq!(
+            parse_procfile(text).as_deref(),
+            Some("gunicorn app:app -b :$PORT")
+        );
+        assert_eq!(parse_procfile("api: ./api\n").as_deref(), Some("./api"));
+        assert_eq!(parse_procfile("a: ./a\nb: ./b\n"), None);
+        assert_eq!(parse_procfile(""), None);
+    }
+
+    #[test]
+    fn test_procfile_and_nixpacks_override() {
+        let python = plan(&[
+            ("requirements.txt", ""),
+            ("Procfile", "web: .venv/bin/gunicorn app:app\n"),
+        ]);
+        assert_eq!(python.kind, Some(AppKind::Python));
+        assert!(python.build.is_some());
+        assert_eq!(python.start.as_deref(), Some(".venv/bin/gunicorn app:app"));
+
+        let nixpacks = r#"
+[phases.install]
+cmds = ["make deps"]
+
+[phases.build]
+cmds = ["make"]
+
+[start]
+cmd = "./bin/server"
+"#;
+        let custom = plan(&[("nixpacks.toml", nixpacks)]);
+        assert_eq!(custom.kind, None);
+        assert_eq!(custom.build.as_deref(), Some("make deps && make"));
+        assert_eq!(custom.start.as_deref(), Some("./bin/server"));
+        // The Procfile still has the last word on the start
+        let both = plan(&[("nixpacks.toml", nixpacks), ("Procfile", "web: ./other\n")]);
+        assert_eq!(both.start.as_deref(), Some("./other"));
+
+        let dir = app(&[("go.mod", ""), ("Procfile", "a: ./a\nb: ./b\n")]);
+        assert!(detect(dir.path()).is_err());
+    }
+
+    #[test]
+    fn test_start_command_runs_through_shell() {
+        let plan = plan(&[("Procfile", "web: ./server --port $PORT\n")]);
+        let (command, args) = plan.start_command().unwrap();
+        assert_eq!(command, "sh");
+        assert_eq!(args, vec!["-c", "exec ./server --port $PORT"]);
+    }
+}
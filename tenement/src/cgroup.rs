@@ -1,6 +1,7 @@
 //! Cgroup v2 resource limits for Linux
 //!
-//! Provides memory and CPU limits via cgroups v2 unified hierarchy.
+//! Provides memory and CPU limits via cgroups v2 unified hierarchy, and
+//! reports OOM kills so the monitor can restart instances that hit their cap.
 //! Requires Linux kernel 4.5+ with cgroups v2 enabled.
 //!
 //! **Linux only** - on other platforms, returns Ok() (no-op).
@@ -17,6 +18,9 @@ const CGROUP_BASE: &str = "/sys/fs/cgroup";
 /// Tenement cgroup subtree
 const TENEMENT_CGROUP: &str = "/sys/fs/cgroup/tenement";
 
+/// cpu.max period in microseconds; the quota is a share of this
+const CPU_PERIOD_US: u64 = 100_000;
+
 /// Resource limits for a service instance
 #[derive(Debug, Clone, Default)]
 pub struct ResourceLimits {
@@ -24,12 +28,14 @@ pub struct ResourceLimits {
     pub memory_limit_mb: Option<u32>,
     /// CPU weight (1-10000, None = default 100)
     pub cpu_shares: Option<u32>,
+    /// CPU cap in cores (None = unlimited)
+    pub cpu_max: Option<f64>,
 }
 
 impl ResourceLimits {
     /// Check if any limits are configured
     pub fn has_limits(&self) -> bool {
-        self.memory_limit_mb.is_some() || self.cpu_shares.is_some()
+        self.memory_limit_mb.is_some() || self.cpu_shares.is_some() || self.cpu_max.is_some()
     }
 }
 
@@ -146,11 +152,27 @@ impl CgroupManager {
             tracing::debug!("Set CPU weight for {}: {}", instance_id, weight);
         }
 
+        // Apply CPU cap
+        if let Some(cores) = limits.cpu_max {
+            let cpu_max_path = cgroup_path.join("cpu.max");
+            std::fs::write(&cpu_max_path, cpu_max_value(cores)).with_context(|| {
+                format!(
+                    "Failed to set CPU cap: {}\n\
+                    Ensure cpu controller is enabled in parent cgroup",
+                    cpu_max_path.display()
+                )
+            })?;
+            tracing::debug!("Set CPU cap for {}: {} cores", instance_id, cores);
+        }
+
         tracing::info!(
-            "Created cgroup for {} with limits: memory={}MB, cpu_weight={}",
+            "Created cgroup for {} with limits: memory={}MB, cpu_weight={}, cpu_max={}",
             instance_id,
             limits.memory_limit_mb.unwrap_or(0),
-            limits.cpu_shares.unwrap_or(100)
+            limits.cpu_shares.unwrap_or(100),
+            limits
+                .cpu_max
+                .map_or_else(|| "max".to_string(), |cores| cores.to_string())
         );
 
         Ok(())
@@ -202,6 +224,18 @@ impl CgroupManager {
         Ok(())
     }
 
+    /// OOM kills in the instance's cgroup so far (None = no cgroup for it)
+    #[cfg(target_os = "linux")]
+    pub fn oom_kills(&self, instance_id: &str) -> Option<u64> {
+        let events = std::fs::read_to_string(self.cgroup_path(instance_id).join("memory.events"));
+        parse_oom_kills(&events.ok()?)
+    }
+
+    #[cfg(not(target_os = "linux"))]
+    pub fn oom_kills(&self, _instance_id: &str) -> Option<u64> {
+        None
+    }
+
     /// Remove the cgroup for an instance
     #[cfg(target_os = "linux")]
     pub fn remove_cgroup(&self, instance_id: &str) -> Result<()> {
@@ -279,6 +313,23 @@ impl CgroupManager {
     }
 }
 
+/// cpu.max contents for a cap in cores: "<quota> <period>"
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+fn cpu_max_value(cores: f64) -> String {
+    // The kernel rejects quotas under 1ms
+    let quota = ((cores * CPU_PERIOD_US as f64).round() as u64).max(1000);
+    format!("{} {}", quota, CPU_PERIOD_US)
+}
+
+/// The `oom_kill` counter from a memory.events file
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+fn parse_oom_kills(events: &str) -> Option<u64> {
+    events
+        .lines()
+        .find_map(|line| line.strip_prefix("oom_kill "))
+        .and_then(|count| count.trim().parse().ok())
+}
+
 impl Default for CgroupManager {
     fn default() -> Self {
         Self::new()
@@ -301,20 +352,29 @@ mod tests {
         let with_memory = ResourceLimits {
             memory_limit_mb: Some(256),
             cpu_shares: None,
+            cpu_max: None,
         };
         assert!(with_memory.has_limits());
 
         let with_cpu = ResourceLimits {
             memory_limit_mb: None,
             cpu_shares: Some(200),
+            cpu_max: None,
         };
         assert!(with_cpu.has_limits());
 
         let with_both = ResourceLimits {
             memory_limit_mb: Some(512),
             cpu_shares: Some(500),
+            cpu_max: None,
         };
         assert!(with_both.has_limits());
+
+        let with_cpu_max = ResourceLimits {
+            cpu_max: Some(0.5),
+            ..Default::default()
+        };
+        assert!(with_cpu_max.has_limits());
     }
 
     #[test]
@@ -330,6 +390,7 @@ mod tests {
         let limits = ResourceLimits {
             memory_limit_mb: Some(512),
             cpu_shares: Some(200),
+            cpu_max: None,
         };
         let cloned = limits.clone();
         assert_eq!(limits.memory_limit_mb, cloned.memory_limit_mb);
@@ -341,6 +402,7 @@ mod tests {
         let limits = ResourceLimits {
             memory_limit_mb: Some(256),
             cpu_shares: Some(100),
+            cpu_max: None,
         };
         let debug = format!("{:?}", limits);
         assert!(debug.contains("256"));
@@ -352,6 +414,7 @@ mod tests {
         let limits = ResourceLimits {
             memory_limit_mb: Some(1024),
             cpu_shares: None,
+            cpu_max: None,
         };
         assert!(limits.has_limits());
         assert_eq!(limits.memory_limit_mb, Some(1024));
@@ -362,6 +425,7 @@ mod tests {
         let limits = ResourceLimits {
             memory_limit_mb: None,
             cpu_shares: Some(500),
+            cpu_max: None,
         };
         assert!(limits.has_limits());
         assert_eq!(limits.cpu_shares, Some(500));
@@ -374,6 +438,7 @@ mod tests {
         let limits = ResourceLimits {
             memory_limit_mb: Some(0),
             cpu_shares: None,
+            cpu_max: None,
         };
         assert!(limits.has_limits());
     }
@@ -383,6 +448,7 @@ mod tests {
         let limits = ResourceLimits {
             memory_limit_mb: None,
             cpu_shares: Some(0),
+            cpu_max: None,
         };
         assert!(limits.has_limits());
     }
@@ -392,6 +458,7 @@ mod tests {
         let limits = ResourceLimits {
             memory_limit_mb: Some(u32::MAX),
             cpu_shares: Some(10000),
+            cpu_max: None,
         };
         assert!(limits.has_limits());
         assert_eq!(limits.memory_limit_mb, Some(u32::MAX));
@@ -456,6 +523,7 @@ mod tests {
         let limits = ResourceLimits {
             memory_limit_mb: Some(256),
             cpu_shares: Some(100),
+            cpu_max: None,
         };
 
         // All operations should succeed as no-ops
@@ -520,6 +588,7 @@ mod tests {
             let limits = ResourceLimits {
                 memory_limit_mb: Some(256),
                 cpu_shares: Some(100),
+                cpu_max: None,
             };
 
             let instance_id = format!("test-{}", std::process::id());
@@ -545,6 +614,7 @@ mod tests {
             let limits = ResourceLimits {
                 memory_limit_mb: Some(256),
                 cpu_shares: None,
+                cpu_max: None,
             };
 
             let instance_id = format!("test-mem-{}", std::process::id());
@@ -570,6 +640,7 @@ mod tests {
             let limits = ResourceLimits {
                 memory_limit_mb: None,
                 cpu_shares: Some(500),
+                cpu_max: None,
             };
 
             let instance_id = format!("test-cpu-{}", std::process::id());
@@ -594,6 +665,7 @@ mod tests {
             let limits = ResourceLimits {
                 memory_limit_mb: None,
                 cpu_shares: Some(0), // Below minimum, should clamp to 1
+                cpu_max: None,
             };
 
             let instance_id = format!("test-cpu-min-{}", std::process::id());
@@ -616,6 +688,7 @@ mod tests {
             let limits = ResourceLimits {
                 memory_limit_mb: None,
                 cpu_shares: Some(50000), // Above maximum, should clamp to 10000
+                cpu_max: None,
             };
 
             let instance_id = format!("test-cpu-max-{}", std::process::id());
@@ -710,4 +783,23 @@ mod tests {
         assert!(bytes > 0);
         assert_eq!(bytes, (u32::MAX as u64) * 1024 * 1024);
     }
+
+    // ===================
+    // CPU MAX AND OOM EVENTS TESTS
+    // ===================
+
+    #[test]
+    fn test_cpu_max_value() {
+        assert_eq!(cpu_max_value(0.5), "50000 100000");
+        assert_eq!(cpu_max_value(2.0), "200000 100000");
+        // Never below the kernel's 1ms minimum
+        assert_eq!(cpu_max_value(0.001), "1000 100000");
+    }
+
+    #[test]
+    fn test_parse_oom_kills() {
+        let events = "low 0\nhigh 0\nmax 12\noom 3\noom_kill 2\noom_group_kill 0\n";
+        assert_eq!(parse_oom_kills(events), Some(2));
+        assert_eq!(parse_oom_kills("low 0\nhigh 0\n"), None);
+    }
 }
@@ -0,0 +1,459 @@
+//! Config checks for `tenement check`
+//!
+//! Parsing stops at the first error, and takes some mistakes quietly: keys
+//! nothing reads are ignored, and a command or env file that doesn't exist
+//! only fails when an instance starts. [`check`] parses the config as
+//! tenement would (so duplicate domains and `depends_on` cycles surface
+//! here), then looks for those: unknown keys, listeners sharing a port or
+//! inside `port_range`, commands, workdirs and static roots that can't be
+//! found, and missing or invalid env files. Nothing is started or written.
+
+use serde::Serialize;
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+use crate::config::{expand_toml, Config, ServiceKind};
+use crate::env_files;
+use crate::runtime::RuntimeType;
+
+/// Keys read under another name: (alias, field)
+const KEY_ALIASES: &[(&str, &str)] = &[("runtime", "isolation")];
+
+/// How bad a problem is
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum Severity {
+    /// tenement would refuse the config, or an instance would fail to start
+    Error,
+    /// Works, but likely not as meant
+    Warning,
+}
+
+/// One thing wrong with a config
+#[derive(Debug, Clone, PartialEq, Eq, Serialize)]
+pub struct Problem {
+    pub severity: Severity,
+    pub message: String,
+}
+
+/// Everything [`check`] found
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct CheckReport {
+    pub problems: Vec<Problem>,
+}
+
+impl CheckReport {
+    /// Whether there's nothing worse than a warning
+    pub fn is_ok(&self) -> bool {
+        self.errors().next().is_none()
+    }
+
+    pub fn errors(&self) -> impl Iterator<Item = &Problem> {
+        self.problems
+            .iter()
+            .filter(|p| p.severity == Severity::Error)
+    }
+
+    fn error(&mut self, message: String) {
+        self.problems.push(Problem {
+            severity: Severity::Error,
+            message,
+        });
+    }
+
+    fn warn(&mut self, message: String) {
+        self.problems.push(Problem {
+            severity: Severity::Warning,
+            message,
+        });
+    }
+}
+
+/// Check `content` as the config file at `path`. Relative commands, workdirs
+/// and env files are looked up from its directory; `http_port` is the plain
+/// HTTP listener's port (`serve --port`), used when TLS is off.
+pub fn check(
+    content: &str,
+    path: &Path,
+    environment: Option<&str>,
+    http_port: Option<u16>,
+) -> CheckReport {
+    let mut report = CheckReport::default();
+    let config = match Config::from_source(content, environment, path) {
+        Ok(config) => config,
+        Err(e) => {
+            report.error(format!("{:#}", e));
+            return report;
+        }
+    };
+
+    // Keys as read: the overlays in effect merged, templates and vars expanded
+    let raw = expand_toml(content, environment, Some(path)).ok();
+    if let (Some((raw, _)), Ok(known)) = (raw, serde_json::to_value(&config)) {
+        let mut unknown = Vec::new();
+        unknown_keys(&raw, &known, "", &mut unknown);
+        for key in unknown {
+            report.error(format!("Unknown key '{}' (not read by tenement)", key));
+        }
+    }
+
+    check_ports(&config, http_port, &mut report);
+    let base_dir = path.parent().unwrap_or(Path::new("."));
+    check_services(&config, base_dir, &mut report);
+    report
+}
+
+/// Keys of `raw` with no counterpart in `known` (the parsed config,
+/// serialized back), as dotted paths
+fn unknown_keys(raw: &toml::Value, known: &serde_json::Value, path: &str, found: &mut Vec<String>) {
+    match (raw, known) {
+        (toml::Value::Table(raw), serde_json::Value::Object(known)) => {
+            for (key, value) in raw {
+                let field = KEY_ALIASES
+                    .iter()
+                    .find(|(alias, _)| alias == key)
+                    .map_or(key.as_str(), |(_, field)| field);
+                let path = match path {
+                    "" => key.clone(),
+                    _ => format!("{}.{}", path, key),
+                };
+                match known.get(field) {
+                    Some(known) => unknown_keys(value, known, &path, found),
+                    None => found.push(path),
+                }
+            }
+        }
+        (toml::Value::Array(raw), serde_json::Value::Array(known)) => {
+            for (index, (value, known)) in raw.iter().zip(known).enumerate() {
+                unknown_keys(value, known, &format!("{}[{}]", path, index), found);
+            }
+        }
+        _ => {}
+    }
+}
+
+/// Listeners that would collide with each other or with instances' ports
+fn check_ports(config: &Config, http_port: Option<u16>, report: &mut CheckReport) {
+    let settings = &config.settings;
+    let mut listeners: Vec<(&str, u16)> = Vec::new();
+    if settings.tls.enabled {
+        listeners.push(("settings.tls.https_port", settings.tls.https_port));
+        listeners.push(("settings.tls.http_port", settings.tls.http_port));
+    } else if let Some(port) = http_port {
+        listeners.push(("the HTTP listener", port));
+    }
+    if let Some(addr) = settings.metrics_listen {
+        listeners.push(("settings.metrics_listen", addr.port()));
+    }
+    if let Some(addr) = settings.dashboard.admin_listen() {
+        listeners.push(("settings.dashboard.listen", addr.port()));
+    }
+
+    let mut by_port: BTreeMap<u16, Vec<&str>> = BTreeMap::new();
+    for (name, port) in &listeners {
+        by_port.entry(*port).or_default().push(name);
+    }
+    for (port, names) in by_port.iter().filter(|(_, names)| names.len() > 1) {
+        report.error(format!("Port {} is used by {}", port, names.join(" and ")));
+    }
+
+    let (low, high) = settings.port_range;
+    for (name, port) in listeners {
+        if (low..=high).contains(&port) {
+            report.error(format!(
+                "Port {} of {} is inside settings.port_range ({}-{}), which instances are given",
+                port, name, low, high
+            ));
+        }
+    }
+}
+
+/// Commands, workdirs, static roots and env files of each service
+fn check_services(config: &Config, base_dir: &Path, report: &mut CheckReport) {
+    let mut names: Vec<&String> = config.service.keys().collect();
+    names.sort();
+    for name in names {
+        let service = &config.service[name];
+        if service.kind == ServiceKind::Static {
+            if let Some(root) = service.root.as_ref().map(|root| base_dir.join(root)) {
+                if !root.is_dir() {
+                    report.error(format!(
+                        "Service '{}' root {} doesn't exist",
+                        name,
+                        root.display()
+                    ));
+                }
+            }
+            continue;
+        }
+
+        for file in &service.env_files {
+            let path = base_dir.join(file);
+            if !path.exists() {
+                report.error(format!(
+                    "Service '{}' env file {} doesn't exist",
+                    name,
+                    path.display()
+                ));
+            } else if let Err(e) = env_files::load(&[path]) {
+                report.error(format!("Service '{}': {:#}", name, e));
+            }
+        }
+
+        // Git deploys build their own workdir, and other runtimes run the
+        // command somewhere other than this host
+        let on_host = matches!(
+            service.isolation,
+            RuntimeType::Process | RuntimeType::Namespace
+        );
+        if service.git.is_some() || !on_host {
+            continue;
+        }
+        let workdir = match &service.workdir {
+            Some(workdir) if workdir.to_string_lossy().contains('{') => continue,
+            Some(workdir) => base_dir.join(workdir),
+            None => base_dir.to_path_buf(),
+        };
+        if !workdir.is_dir() {
+            report.error(format!(
+                "Service '{}' workdir {} doesn't exist",
+                name,
+                workdir.display()
+            ));
+            continue;
+        }
+        // A login shell finds the command on its own PATH
+        let program = service.shell.as_deref().unwrap_or(&service.command);
+        if program.is_empty() || program.contains('{') {
+            continue;
+        }
+        if find_program(program, &workdir).is_none() {
+            let place = match program.contains('/') {
+                true => format!("in {}", workdir.display()),
+                false => "on PATH".to_string(),
+            };
+            report.error(format!(
+                "Service '{}' runs '{}', which isn't {}",
+                name, program, place
+            ));
+        }
+    }
+    if config.service.is_empty() {
+        report.warn("No services are defined".to_string());
+    }
+}
+
+/// Where `program` would be run from: `dir` for a path, PATH otherwise
+fn find_program(program: &str, dir: &Path) -> Option<PathBuf> {
+    if program.contains('/') {
+        let path = dir.join(program);
+        return path.is_file().then_some(path);
+    }
+    let path = std::env::var_os("PATH")?;
+    std::env::split_paths(&path)
+        .map(|dir| dir.join(program))
+        .find(|candidate| candidate.is_file())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn messages(report: &CheckReport) -> Vec<String> {
+        report.problems.iter().map(|p| p.message.clone()).collect()
+    }
+
+    // ===================
+    // Keys
+    // ===================
+
+    #[test]
+    fn test_unknown_keys() {
+        let dir = TempDir::new().unwrap();
+        let content = r#"
+[settings]
+health_check_intervall = 5
+
+[service.api]
+command = "sh"
+runtime = "process"
+comand = "./api"
+
+[service.api.restart_backof]
+max = 3
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+strip = true
+
+[overlay.prod.service.api]
+bogus = 1
+"#;
+        let report = check(content, &dir.path().join("tenement.toml"), None, None);
+        assert_eq!(
+            messages(&report),
+            vec![
+                "Unknown key 'routing.route[0].strip' (not read by tenement)",
+                "Unknown key 'service.api.comand' (not read by tenement)",
+                "Unknown key 'service.api.restart_backof' (not read by tenement)",
+                "Unknown key 'settings.health_check_intervall' (not read by tenement)",
+            ]
+        );
+        assert!(!report.is_ok());
+    }
+
+    #[test]
+    fn test_keys_from_templates_and_overlay_files() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("tenement.toml");
+        let overlay = "[service.api]\nreplica = 2\n";
+        std::fs::write(dir.path().join("tenement.prod.toml"), overlay).unwrap();
+        let content = r#"
+[vars]
+shell = "sh"
+
+[template.base]
+command = "{{ shell }}"
+healthh = "/health"
+
+[service.api]
+extends = "base"
+"#;
+        let healthh = "Unknown key 'service.api.healthh' (not read by tenement)";
+        let report = check(content, &path, None, None);
+        assert_eq!(messages(&report), vec![healthh]);
+
+        let report = check(content, &path, Some("prod"), None);
+        let replica = "Unknown key 'service.api.replica' (not read by tenement)";
+        assert_eq!(messages(&report), vec![healthh, replica]);
+    }
+
+    #[test]
+    fn test_parse_errors_are_reported() {
+        let dir = TempDir::new().unwrap();
+        let cycle = r#"
+[service.a]
+command = "sh"
+depends_on = ["b"]
+
+[service.b]
+command = "sh"
+depends_on = ["a"]
+"#;
+        let report = check(cycle, &dir.path().join("tenement.toml"), None, None);
+        assert_eq!(messages(&report), vec!["Dependency cycle: a -> b -> a"]);
+
+        let domains = r#"
+[service.a]
+command = "sh"
+domains = ["example.com"]
+
+[service.b]
+command = "sh"
+domains = ["example.com"]
+"#;
+        let report = check(domains, &dir.path().join("tenement.toml"), None, None);
+        assert!(messages(&report)[0].contains("already routed to service 'a'"));
+    }
+
+    // ===================
+    // Ports
+    // ===================
+
+    #[test]
+    fn test_port_collisions() {
+        let dir = TempDir::new().unwrap();
+        let content = r#"
+[settings]
+metrics_listen = "127.0.0.1:9100"
+port_range = [9000, 9200]
+
+[settings.dashboard]
+listen = "127.0.0.1:8080"
+
+[service.api]
+command = "sh"
+"#;
+        let report = check(content, &dir.path().join("tenement.toml"), None, Some(8080));
+        assert_eq!(
+            messages(&report),
+            vec![
+                "Port 8080 is used by the HTTP listener and settings.dashboard.listen",
+                "Port 9100 of settings.metrics_listen is inside settings.port_range \
+                 (9000-9200), which instances are given",
+            ]
+        );
+    }
+
+    // ===================
+    // Services
+    // ===================
+
+    #[test]
+    fn test_missing_commands_and_env_files() {
+        let dir = TempDir::new().unwrap();
+        std::fs::write(dir.path().join("app.sh"), "#!/bin/sh\n").unwrap();
+        std::fs::write(dir.path().join("good.env"), "A=1\n").unwrap();
+        std::fs::write(dir.path().join("bad.env"), "not a variable\n").unwrap();
+        let content = r#"
+[service.ok]
+command = "./app.sh"
+env_files = ["good.env"]
+
+[service.onpath]
+command = "sh"
+
+[service.gone]
+command = "./missing"
+env_files = ["bad.env", "nope.env"]
+
+[service.typo]
+command = "definitely-not-a-binary-xyz"
+
+[service.elsewhere]
+command = "./app.sh"
+workdir = "no-such-dir"
+
+[service.site]
+type = "static"
+root = "public"
+"#;
+        let report = check(content, &dir.path().join("tenement.toml"), None, None);
+        let messages = messages(&report);
+        let base = dir.path().display();
+        assert_eq!(messages.len(), 6, "{:?}", messages);
+        assert!(messages[0].starts_with(&format!("Service 'elsewhere' workdir {}", base)));
+        assert!(messages[1].starts_with("Service 'gone': Invalid env file"));
+        assert_eq!(
+            messages[2],
+            format!("Service 'gone' env file {}/nope.env doesn't exist", base)
+        );
+        assert_eq!(
+            messages[3],
+            format!("Service 'gone' runs './missing', which isn't in {}", base)
+        );
+        assert_eq!(
+            messages[4],
+            format!("Service 'site' root {}/public doesn't exist", base)
+        );
+        assert_eq!(
+            messages[5],
+            "Service 'typo' runs 'definitely-not-a-binary-xyz', which isn't on PATH"
+        );
+    }
+
+    #[test]
+    fn test_clean_config_passes() {
+        let dir = TempDir::new().unwrap();
+        let content = "[service.api]\ncommand = \"sh\"\nargs = [\"-c\", \"sleep 1\"]\n";
+        let report = check(content, &dir.path().join("tenement.toml"), None, Some(8080));
+        assert!(report.problems.is_empty(), "{:?}", report.problems);
+        assert!(report.is_ok());
+
+        let report = check("", &dir.path().join("tenement.toml"), None, None);
+        assert!(report.is_ok());
+        assert_eq!(messages(&report), vec!["No services are defined"]);
+    }
+}
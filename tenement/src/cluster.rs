@@ -0,0 +1,494 @@
+//! Clustering
+//!
+//! With `[settings.cluster]`, tenement servers poll each other's [`NodeState`]
+//! (the instances it runs, the nodes it knows and whether it leads) every
+//! heartbeat. [`Cluster`] keeps what each node last said: nodes learn of new
+//! peers from their peers, a node silent for `failure_timeout` is down, and
+//! [`Cluster::peer_for`] picks a live node to forward a request to.
+//!
+//! Leadership is sticky. A live node that already leads keeps leading (the
+//! lowest-named one, if a healed partition left two); when none does, the
+//! lowest-named live node takes over. There's no quorum, so a partitioned
+//! standby cluster has a leader on each side until it heals.
+//!
+//! A reload applies a changed peer list, address, token variable and timings
+//! ([`Cluster::reconfigure`]); the node's name and mode only change on restart.
+
+use crate::config::{ClusterConfig, ClusterMode, PeerConfig};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::sync::atomic::{AtomicBool, AtomicUsize, Ordering};
+use std::sync::RwLock;
+use std::time::{Duration, Instant};
+
+/// Header marking a request another node forwarded; it's never forwarded again
+pub const HOP_HEADER: &str = "x-tenement-cluster-hop";
+
+/// Header carrying the cluster token on requests between nodes
+pub const TOKEN_HEADER: &str = "x-tenement-cluster-token";
+
+/// What a node tells the others about itself
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct NodeState {
+    pub node: String,
+    pub address: String,
+    pub leader: bool,
+    /// IDs of the instances it runs, per service
+    #[serde(default)]
+    pub services: BTreeMap<String, Vec<String>>,
+    /// Other nodes it knows of
+    #[serde(default)]
+    pub peers: Vec<PeerConfig>,
+}
+
+impl NodeState {
+    /// Whether it runs instance `id` of `process` (any instance, for None)
+    pub fn runs(&self, process: &str, id: Option<&str>) -> bool {
+        match (self.services.get(process), id) {
+            (Some(ids), Some(id)) => ids.iter().any(|i| i == id),
+            (Some(ids), None) => !ids.is_empty(),
+            (None, _) => false,
+        }
+    }
+}
+
+/// One node, as `GET /api/cluster` shows it
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct MemberStatus {
+    pub node: String,
+    pub address: String,
+    /// Whether it's the node answering
+    pub local: bool,
+    pub alive: bool,
+    pub leader: bool,
+    /// Seconds since it last answered a poll (None: it never has)
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_seen_secs: Option<u64>,
+    /// Instances it runs
+    pub instances: usize,
+}
+
+#[derive(Debug)]
+struct Member {
+    address: String,
+    state: Option<NodeState>,
+    last_seen: Option<Instant>,
+}
+
+/// This node's view of the cluster
+#[derive(Debug)]
+pub struct Cluster {
+    node: String,
+    mode: ClusterMode,
+    config: RwLock<ClusterConfig>,
+    members: RwLock<BTreeMap<String, Member>>,
+    leader: AtomicBool,
+    /// What the last leader heard from runs, for a standby taking over
+    placement: RwLock<BTreeMap<String, Vec<String>>>,
+    /// Next round-robin turn across peers
+    next_peer: AtomicUsize,
+}
+
+impl Cluster {
+    pub fn new(config: ClusterConfig) -> Self {
+        let members = config
+            .peers
+            .iter()
+            .map(|peer| {
+                let member = Member {
+                    address: peer.address.clone(),
+                    state: None,
+                    last_seen: None,
+                };
+                (peer.node.clone(), member)
+            })
+            .collect();
+        Self {
+            node: config.node.clone(),
+            mode: config.mode,
+            config: RwLock::new(config),
+            members: RwLock::new(members),
+            leader: AtomicBool::new(false),
+            placement: RwLock::new(BTreeMap::new()),
+            next_peer: AtomicUsize::new(0),
+        }
+    }
+
+    /// Apply a reloaded `[settings.cluster]`: peers added to it are polled
+    /// from the next heartbeat, peers dropped from it are forgotten (until
+    /// another node mentions them). Refused when it renames the node or
+    /// changes its mode.
+    pub fn reconfigure(&self, config: ClusterConfig) -> anyhow::Result<()> {
+        if config.node != self.node || config.mode != self.mode {
+            anyhow::bail!("[settings.cluster] node and mode only change on restart");
+        }
+        let dropped: Vec<String> = {
+            let current = self.config.read().unwrap();
+            current
+                .peers
+                .iter()
+                .filter(|peer| !config.peers.iter().any(|p| p.node == peer.node))
+                .map(|peer| peer.node.clone())
+                .collect()
+        };
+        // Never holding the config lock while taking the members one, which
+        // the liveness checks take the other way round
+        {
+            let mut members = self.members.write().unwrap();
+            for node in &dropped {
+                members.remove(node);
+            }
+            for peer in &config.peers {
+                let member = members.entry(peer.node.clone()).or_insert_with(|| Member {
+                    address: peer.address.clone(),
+                    state: None,
+                    last_seen: None,
+                });
+                member.address = peer.address.clone();
+            }
+        }
+        *self.config.write().unwrap() = config;
+        Ok(())
+    }
+
+    /// This node's name
+    pub fn node(&self) -> &str {
+        &self.node
+    }
+
+    pub fn mode(&self) -> ClusterMode {
+        self.mode
+    }
+
+    /// Time between polls of the other nodes
+    pub fn heartbeat(&self) -> Duration {
+        Duration::from_secs(self.config.read().unwrap().heartbeat)
+    }
+
+    /// The shared token, from `token_env` (None when it isn't set)
+    pub fn token(&self) -> Option<String> {
+        let token_env = self.config.read().unwrap().token_env.clone();
+        std::env::var(token_env)
+            .ok()
+            .filter(|token| !token.is_empty())
+    }
+
+    /// Every other node known, to poll
+    pub fn peers(&self) -> Vec<PeerConfig> {
+        let members = self.members.read().unwrap();
+        members
+            .iter()
+            .map(|(node, member)| PeerConfig {
+                node: node.clone(),
+                address: member.address.clone(),
+            })
+            .collect()
+    }
+
+    /// This node's state, running `services`, as the others are told it
+    pub fn local_state(&self, services: BTreeMap<String, Vec<String>>) -> NodeState {
+        NodeState {
+            node: self.node.clone(),
+            address: self.config.read().unwrap().advertise.clone(),
+            leader: self.is_leader(),
+            services,
+            peers: self.peers(),
+        }
+    }
+
+    /// Record a node's reply to a poll at `now`, and the peers it knows
+    pub fn observe(&self, state: NodeState, now: Instant) {
+        if state.node == self.node {
+            return;
+        }
+        if state.leader {
+            *self.placement.write().unwrap() = state.services.clone();
+        }
+        let mut members = self.members.write().unwrap();
+        for peer in &state.peers {
+            if peer.node != self.node && !members.contains_key(&peer.node) {
+                tracing::info!("Cluster: learned of {} at {}", peer.node, peer.address);
+                let member = Member {
+                    address: peer.address.clone(),
+                    state: None,
+                    last_seen: None,
+                };
+                members.insert(peer.node.clone(), member);
+            }
+        }
+        let member = Member {
+            address: state.address.clone(),
+            state: Some(state.clone()),
+            last_seen: Some(now),
+        };
+        members.insert(state.node, member);
+    }
+
+    fn is_alive(&self, member: &Member, now: Instant) -> bool {
+        let timeout = Duration::from_secs(self.config.read().unwrap().failure_timeout);
+        member
+            .last_seen
+            .is_some_and(|seen| now.saturating_duration_since(seen) < timeout)
+    }
+
+    /// The live nodes' states, this one's excluded
+    fn alive_states(&self, now: Instant) -> Vec<NodeState> {
+        let members = self.members.read().unwrap();
+        members
+            .values()
+            .filter(|member| self.is_alive(member, now))
+            .filter_map(|member| member.state.clone())
+            .collect()
+    }
+
+    /// Decide who leads as of `now`; returns whether this node does
+    pub fn elect(&self, now: Instant) -> bool {
+        let alive = self.alive_states(now);
+        let mut nodes = vec![(self.node.as_str(), self.is_leader())];
+        for state in &alive {
+            nodes.push((state.node.as_str(), state.leader));
+        }
+        let claimed = nodes.iter().filter(|(_, leads)| *leads).min();
+        let leader = claimed
+            .or_else(|| nodes.iter().min())
+            .map(|(node, _)| *node);
+        let leads = leader == Some(self.node.as_str());
+        self.leader.store(leads, Ordering::SeqCst);
+        leads
+    }
+
+    /// Whether this node led at the last election
+    pub fn is_leader(&self) -> bool {
+        self.leader.load(Ordering::SeqCst)
+    }
+
+    /// The live leader other than this node, by the last election
+    fn remote_leader(&self, now: Instant) -> Option<NodeState> {
+        if self.is_leader() {
+            return None;
+        }
+        self.alive_states(now)
+            .into_iter()
+            .filter(|state| state.leader)
+            .min_by(|a, b| a.node.cmp(&b.node))
+    }
+
+    /// The leader's name, if there is one
+    pub fn leader(&self, now: Instant) -> Option<String> {
+        match self.is_leader() {
+            true => Some(self.node.clone()),
+            false => self.remote_leader(now).map(|state| state.node),
+        }
+    }
+
+    /// Where to forward a request for instance `id` of `process` (any
+    /// instance, for None) that this node can't answer itself: a standby sends
+    /// everything to the leader; an active node picks, in turn, a live node
+    /// that runs it
+    pub fn peer_for(&self, process: &str, id: Option<&str>, now: Instant) -> Option<String> {
+        if self.mode == ClusterMode::Standby {
+            return self.remote_leader(now).map(|state| state.address);
+        }
+        let candidates: Vec<NodeState> = self
+            .alive_states(now)
+            .into_iter()
+            .filter(|state| state.runs(process, id))
+            .collect();
+        if candidates.is_empty() {
+            return None;
+        }
+        let turn = self.next_peer.fetch_add(1, Ordering::Relaxed);
+        Some(candidates[turn % candidates.len()].address.clone())
+    }
+
+    /// What the leader last said it runs
+    pub fn placement(&self) -> BTreeMap<String, Vec<String>> {
+        self.placement.read().unwrap().clone()
+    }
+
+    /// Every member, this node (running `local`) first
+    pub fn status(&self, local: &NodeState, now: Instant) -> Vec<MemberStatus> {
+        let count = |state: &NodeState| state.services.values().map(Vec::len).sum();
+        let mut status = vec![MemberStatus {
+            node: local.node.clone(),
+            address: local.address.clone(),
+            local: true,
+            alive: true,
+            leader: local.leader,
+            last_seen_secs: Some(0),
+            instances: count(local),
+        }];
+        let members = self.members.read().unwrap();
+        for (node, member) in members.iter() {
+            let alive = self.is_alive(member, now);
+            status.push(MemberStatus {
+                node: node.clone(),
+                address: member.address.clone(),
+                local: false,
+                alive,
+                leader: alive && member.state.as_ref().is_some_and(|state| state.leader),
+                last_seen_secs: member
+                    .last_seen
+                    .map(|seen| now.saturating_duration_since(seen).as_secs()),
+                instances: member.state.as_ref().map_or(0, count),
+            });
+        }
+        status
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn cluster(node: &str, mode: ClusterMode) -> Cluster {
+        Cluster::new(ClusterConfig {
+            node: node.to_string(),
+            advertise: format!("{}:8080", node),
+            peers: vec![PeerConfig {
+                node: "seed".to_string(),
+                address: "seed:8080".to_string(),
+            }],
+            mode,
+            token_env: "TENEMENT_CLUSTER_TOKEN".to_string(),
+            heartbeat: 1,
+            failure_timeout: 5,
+        })
+    }
+
+    fn state(node: &str, leader: bool, services: &[(&str, &str)]) -> NodeState {
+        let mut running: BTreeMap<String, Vec<String>> = BTreeMap::new();
+        for (process, id) in services {
+            running
+                .entry(process.to_string())
+                .or_default()
+                .push(id.to_string());
+        }
+        NodeState {
+            node: node.to_string(),
+            address: format!("{}:8080", node),
+            leader,
+            services: running,
+            peers: Vec::new(),
+        }
+    }
+
+    // ===================
+    // Membership
+    // ===================
+
+    #[test]
+    fn test_learns_peers_from_peers() {
+        let cluster = cluster("b", ClusterMode::Active);
+        let mut seed = state("seed", false, &[]);
+        seed.peers = vec![
+            PeerConfig {
+                node: "b".to_string(),
+                address: "b:8080".to_string(),
+            },
+            PeerConfig {
+                node: "c".to_string(),
+                address: "c:8080".to_string(),
+            },
+        ];
+        cluster.observe(seed, Instant::now());
+        let peers: Vec<_> = cluster.peers().into_iter().map(|p| p.node).collect();
+        assert_eq!(peers, vec!["c", "seed"]);
+
+        let status = cluster.status(&cluster.local_state(BTreeMap::new()), Instant::now());
+        assert_eq!(status.len(), 3);
+        assert!(status[0].local);
+        assert!(!status[1].alive, "c hasn't answered yet");
+        assert!(status[2].alive);
+    }
+
+    #[test]
+    fn test_reconfigure_updates_peers() {
+        let cluster = cluster("b", ClusterMode::Active);
+        let mut config = cluster.config.read().unwrap().clone();
+        config.peers = vec![PeerConfig {
+            node: "c".to_string(),
+            address: "c:9090".to_string(),
+        }];
+        config.heartbeat = 3;
+        cluster.reconfigure(config.clone()).unwrap();
+        let peers: Vec<_> = cluster.peers().into_iter().map(|p| p.address).collect();
+        assert_eq!(peers, vec!["c:9090"]);
+        assert_eq!(cluster.heartbeat(), Duration::from_secs(3));
+
+        config.mode = ClusterMode::Standby;
+        assert!(cluster.reconfigure(config.clone()).is_err());
+        config.mode = ClusterMode::Active;
+        config.node = "z".to_string();
+        assert!(cluster.reconfigure(config).is_err());
+        assert_eq!(cluster.node(), "b");
+    }
+
+    // ===================
+    // Election
+    // ===================
+
+    #[test]
+    fn test_lowest_live_node_leads_and_keeps_leading() {
+        let now = Instant::now();
+        let b = cluster("b", ClusterMode::Standby);
+        assert!(b.elect(now), "alone, b leads");
+
+        // A lower-named node joining doesn't take over from a live leader
+        b.observe(state("a", false, &[]), now);
+        assert!(b.elect(now));
+        let a = cluster("a", ClusterMode::Standby);
+        a.observe(state("b", true, &[("api", "prod")]), now);
+        assert!(!a.elect(now));
+        assert_eq!(a.leader(now).as_deref(), Some("b"));
+        assert_eq!(a.placement()["api"], vec!["prod"]);
+
+        // Once b goes quiet, a takes over
+        let later = now + Duration::from_secs(6);
+        assert!(a.elect(later));
+        assert_eq!(a.leader(later).as_deref(), Some("a"));
+    }
+
+    #[test]
+    fn test_two_leaders_settle_on_lowest() {
+        let now = Instant::now();
+        let b = cluster("b", ClusterMode::Standby);
+        assert!(b.elect(now));
+        b.observe(state("a", true, &[]), now);
+        assert!(!b.elect(now));
+        assert_eq!(b.leader(now).as_deref(), Some("a"));
+    }
+
+    // ===================
+    // Forwarding
+    // ===================
+
+    #[test]
+    fn test_peer_for_active_round_robins_over_runners() {
+        let now = Instant::now();
+        let a = cluster("a", ClusterMode::Active);
+        a.observe(state("b", false, &[("api", "prod")]), now);
+        a.observe(state("c", false, &[("api", "prod"), ("web", "1")]), now);
+        assert_eq!(a.peer_for("web", None, now).as_deref(), Some("c:8080"));
+        assert_eq!(a.peer_for("web", Some("2"), now), None);
+        let picks: Vec<_> = (0..4)
+            .filter_map(|_| a.peer_for("api", Some("prod"), now))
+            .collect();
+        assert!(picks.contains(&"b:8080".to_string()));
+        assert!(picks.contains(&"c:8080".to_string()));
+        assert_eq!(a.peer_for("api", None, now + Duration::from_secs(10)), None);
+    }
+
+    #[test]
+    fn test_peer_for_standby_is_leader() {
+        let now = Instant::now();
+        let b = cluster("b", ClusterMode::Standby);
+        b.observe(state("a", true, &[]), now);
+        assert!(!b.elect(now));
+        assert_eq!(b.peer_for("api", None, now).as_deref(), Some("a:8080"));
+
+        let a = cluster("a", ClusterMode::Standby);
+        assert!(a.elect(now));
+        assert_eq!(a.peer_for("api", None, now), None);
+    }
+}
@@ -0,0 +1,555 @@
+//! Global request concurrency pool with weighted fair sharing
+//!
+//! When `settings.max_concurrency` is set, every proxied request holds a
+//! permit from one shared pool. While slots are free, any app can take them
+//! (work-conserving). Once the pool is full, requests queue per app, and each
+//! freed slot goes to the waiting app furthest below its fair share
+//! (`in_flight / concurrency_weight`). A flooding app therefore can't starve a
+//! quiet one: the quiet app's next request is first in line for the next slot.
+//!
+//! A service's own `max_concurrency` caps its in-flight requests separately
+//! ([`AppLimit`]): the rest wait in a first-come queue of at most `max_queue`
+//! for up to `queue_timeout_ms`, so a slow backend sheds load instead of
+//! piling up requests in the proxy.
+
+use std::collections::{BTreeMap, HashMap, VecDeque};
+use std::sync::atomic::{AtomicUsize, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::sync::{oneshot, OwnedSemaphorePermit, Semaphore};
+
+/// Why a permit couldn't be acquired
+#[derive(Debug, Clone, Copy, PartialEq, Eq, thiserror::Error)]
+pub enum PoolError {
+    #[error("timed out waiting for a concurrency slot")]
+    Timeout,
+    #[error("concurrency queue is full")]
+    QueueFull,
+}
+
+/// Shared concurrency pool
+#[derive(Debug)]
+pub struct ConcurrencyPool {
+    capacity: usize,
+    /// Fair-share weight per app (apps not listed use weight 1)
+    weights: HashMap<String, u32>,
+    state: Mutex<PoolState>,
+}
+
+#[derive(Debug, Default)]
+struct PoolState {
+    in_use: usize,
+    per_app: HashMap<String, usize>,
+    /// Waiting requests per app, oldest first. BTreeMap keeps tie-breaks deterministic.
+    waiters: BTreeMap<String, VecDeque<Waiter>>,
+    next_waiter_id: u64,
+}
+
+#[derive(Debug)]
+struct Waiter {
+    id: u64,
+    tx: oneshot::Sender<()>,
+}
+
+/// A held slot. Dropping it frees the slot for the next waiter.
+#[derive(Debug)]
+pub struct Permit {
+    pool: Arc<ConcurrencyPool>,
+    app: String,
+}
+
+impl Drop for Permit {
+    fn drop(&mut self) {
+        self.pool.release(&self.app);
+    }
+}
+
+impl ConcurrencyPool {
+    pub fn new(capacity: usize, weights: HashMap<String, u32>) -> Arc<Self> {
+        Arc::new(Self {
+            capacity: capacity.max(1),
+            weights,
+            state: Mutex::new(PoolState::default()),
+        })
+    }
+
+    pub fn capacity(&self) -> usize {
+        self.capacity
+    }
+
+    /// Total slots currently held
+    pub fn in_use(&self) -> usize {
+        self.state.lock().unwrap().in_use
+    }
+
+    /// Slots currently held by one app
+    pub fn in_use_for(&self, app: &str) -> usize {
+        self.state
+            .lock()
+            .unwrap()
+            .per_app
+            .get(app)
+            .copied()
+            .unwrap_or(0)
+    }
+
+    /// Requests currently queued for a slot
+    pub fn waiting(&self) -> usize {
+        self.state
+            .lock()
+            .unwrap()
+            .waiters
+            .values()
+            .map(|q| q.len())
+            .sum()
+    }
+
+    /// Guaranteed share of the pool for an app under full contention
+    pub fn fair_share(&self, app: &str) -> usize {
+        let total: u32 = self.weights.values().sum::<u32>().max(1);
+        let share = self.capacity as u64 * self.weight(app) as u64 / total as u64;
+        (share as usize).max(1)
+    }
+
+    fn weight(&self, app: &str) -> u32 {
+        self.weights.get(app).copied().unwrap_or(1).max(1)
+    }
+
+    /// Acquire a slot for an app, waiting up to `timeout` when the pool is full
+    pub async fn acquire(
+        self: &Arc<Self>,
+        app: &str,
+        timeout: Duration,
+    ) -> Result<Permit, PoolError> {
+        let (waiter_id, rx) = {
+            let mut state = self.state.lock().unwrap();
+            if state.in_use < self.capacity {
+                state.in_use += 1;
+                *state.per_app.entry(app.to_string()).or_insert(0) += 1;
+                return Ok(self.permit(app));
+            }
+
+            let (tx, rx) = oneshot::channel();
+            let id = state.next_waiter_id;
+            state.next_waiter_id += 1;
+            state
+                .waiters
+                .entry(app.to_string())
+                .or_default()
+                .push_back(Waiter { id, tx });
+            (id, rx)
+        };
+
+        let mut waiter = QueuedWaiter {
+            pool: self,
+            app,
+            id: waiter_id,
+            rx,
+            done: false,
+        };
+        match tokio::time::timeout(timeout, &mut waiter.rx).await {
+            Ok(Ok(())) => {
+                waiter.done = true;
+                Ok(self.permit(app))
+            }
+            _ if waiter.leave() => Ok(self.permit(app)),
+            _ => Err(PoolError::Timeout),
+        }
+    }
+
+    fn permit(self: &Arc<Self>, app: &str) -> Permit {
+        Permit {
+            pool: self.clone(),
+            app: app.to_string(),
+        }
+    }
+
+    /// Free a slot and hand it to the waiting app furthest below its fair share
+    fn release(&self, app: &str) {
+        let mut state = self.state.lock().unwrap();
+        state.in_use = state.in_use.saturating_sub(1);
+        if let Some(count) = state.per_app.get_mut(app) {
+            *count = count.saturating_sub(1);
+            if *count == 0 {
+                state.per_app.remove(app);
+            }
+        }
+
+        while state.in_use < self.capacity {
+            let next = state
+                .waiters
+                .keys()
+                .map(|name| {
+                    let held = state.per_app.get(name).copied().unwrap_or(0);
+                    (held as f64 / self.weight(name) as f64, name.clone())
+                })
+                .min_by(|a, b| a.0.total_cmp(&b.0));
+            let Some((_, name)) = next else {
+                return;
+            };
+
+            let queue = state.waiters.get_mut(&name).expect("key from waiters");
+            let waiter = queue.pop_front().expect("queues are never left empty");
+            if queue.is_empty() {
+                state.waiters.remove(&name);
+            }
+
+            state.in_use += 1;
+            *state.per_app.entry(name.clone()).or_insert(0) += 1;
+            if waiter.tx.send(()).is_err() {
+                // Receiver gave up between timing out and taking the lock; undo and retry
+                state.in_use -= 1;
+                if let Some(count) = state.per_app.get_mut(&name) {
+                    *count -= 1;
+                    if *count == 0 {
+                        state.per_app.remove(&name);
+                    }
+                }
+            }
+        }
+    }
+}
+
+/// A request queued in the pool. Dropping it early, e.g. with the handler
+/// future, takes it out of the queue or frees the slot it was just granted.
+struct QueuedWaiter<'a> {
+    pool: &'a Arc<ConcurrencyPool>,
+    app: &'a str,
+    id: u64,
+    rx: oneshot::Receiver<()>,
+    done: bool,
+}
+
+impl QueuedWaiter<'_> {
+    /// Leave the queue, returning whether a slot was granted first
+    fn leave(&mut self) -> bool {
+        self.done = true;
+        // Grants happen under the lock, so once we hold it we know for sure
+        // whether we were handed a slot or are still queued.
+        let mut state = self.pool.state.lock().unwrap();
+        if let Some(queue) = state.waiters.get_mut(self.app) {
+            if let Some(pos) = queue.iter().position(|w| w.id == self.id) {
+                queue.remove(pos);
+                if queue.is_empty() {
+                    state.waiters.remove(self.app);
+                }
+                return false;
+            }
+        }
+        drop(state);
+        self.rx.try_recv().is_ok()
+    }
+}
+
+impl Drop for QueuedWaiter<'_> {
+    fn drop(&mut self) {
+        if !self.done && self.leave() {
+            self.pool.release(self.app);
+        }
+    }
+}
+
+/// One service's in-flight cap, with a bounded wait queue
+#[derive(Debug)]
+pub struct AppLimit {
+    limit: usize,
+    max_queue: Option<usize>,
+    semaphore: Arc<Semaphore>,
+    queued: AtomicUsize,
+}
+
+/// A held slot under an [`AppLimit`]; dropping it frees the slot
+pub type AppPermit = OwnedSemaphorePermit;
+
+/// Counts a request as queued for as long as it waits
+struct Queued<'a>(&'a AtomicUsize);
+
+impl Drop for Queued<'_> {
+    fn drop(&mut self) {
+        self.0.fetch_sub(1, Ordering::SeqCst);
+    }
+}
+
+impl AppLimit {
+    /// `max_queue` None: any number may wait
+    pub fn new(limit: usize, max_queue: Option<usize>) -> Arc<Self> {
+        let limit = limit.max(1);
+        Arc::new(Self {
+            limit,
+            max_queue,
+            semaphore: Arc::new(Semaphore::new(limit)),
+            queued: AtomicUsize::new(0),
+        })
+    }
+
+    pub fn limit(&self) -> usize {
+        self.limit
+    }
+
+    pub fn max_queue(&self) -> Option<usize> {
+        self.max_queue
+    }
+
+    /// Slots currently held
+    pub fn in_use(&self) -> usize {
+        self.limit - self.semaphore.available_permits()
+    }
+
+    /// Requests currently waiting for a slot
+    pub fn waiting(&self) -> usize {
+        self.queued.load(Ordering::SeqCst)
+    }
+
+    /// Take a slot, queueing for up to `timeout` when all are held. Fails at
+    /// once when `max_queue` requests are already waiting.
+    pub async fn acquire(&self, timeout: Duration) -> Result<AppPermit, PoolError> {
+        if let Ok(permit) = self.semaphore.clone().try_acquire_owned() {
+            return Ok(permit);
+        }
+        let ahead = self.queued.fetch_add(1, Ordering::SeqCst);
+        let _queued = Queued(&self.queued);
+        if self.max_queue.is_some_and(|max| ahead >= max) {
+            return Err(PoolError::QueueFull);
+        }
+        match tokio::time::timeout(timeout, self.semaphore.clone().acquire_owned()).await {
+            Ok(Ok(permit)) => Ok(permit),
+            _ => Err(PoolError::Timeout),
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const WAIT: Duration = Duration::from_secs(5);
+
+    fn pool(capacity: usize, weights: &[(&str, u32)]) -> Arc<ConcurrencyPool> {
+        ConcurrencyPool::new(
+            capacity,
+            weights.iter().map(|(k, v)| (k.to_string(), *v)).collect(),
+        )
+    }
+
+    #[tokio::test]
+    async fn test_acquire_and_release() {
+        let pool = pool(2, &[]);
+        let a = pool.acquire("api", WAIT).await.unwrap();
+        let _b = pool.acquire("api", WAIT).await.unwrap();
+        assert_eq!(pool.in_use(), 2);
+        assert_eq!(pool.in_use_for("api"), 2);
+
+        drop(a);
+        assert_eq!(pool.in_use(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_acquire_times_out_when_full() {
+        let pool = pool(1, &[]);
+        let _held = pool.acquire("api", WAIT).await.unwrap();
+
+        let result = pool.acquire("api", Duration::from_millis(50)).await;
+        assert_eq!(result.unwrap_err(), PoolError::Timeout);
+        assert_eq!(pool.waiting(), 0);
+        assert_eq!(pool.in_use(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_dropped_acquire_gives_back_its_slot() {
+        let pool = pool(1, &[]);
+        let held = pool.acquire("api", WAIT).await.unwrap();
+
+        // Dropped while still queued: it leaves the queue
+        let mut queued = Box::pin(pool.acquire("api", WAIT));
+        let pending = tokio::time::timeout(Duration::from_millis(20), &mut queued).await;
+        assert!(pending.is_err());
+        assert_eq!(pool.waiting(), 1);
+        drop(queued);
+        assert_eq!(pool.waiting(), 0);
+
+        // Dropped after the slot was granted but before it was polled again
+        let mut granted = Box::pin(pool.acquire("api", WAIT));
+        let pending = tokio::time::timeout(Duration::from_millis(20), &mut granted).await;
+        assert!(pending.is_err());
+        drop(held);
+        assert_eq!(pool.waiting(), 0);
+        assert_eq!(pool.in_use(), 1);
+        drop(granted);
+        assert_eq!(pool.in_use(), 0);
+        assert_eq!(pool.in_use_for("api"), 0);
+    }
+
+    #[tokio::test]
+    async fn test_idle_capacity_is_borrowable() {
+        // No contention: a single app may use the whole pool
+        let pool = pool(4, &[("noisy", 1), ("quiet", 1)]);
+        let mut held = Vec::new();
+        for _ in 0..4 {
+            held.push(pool.acquire("noisy", WAIT).await.unwrap());
+        }
+        assert_eq!(pool.in_use_for("noisy"), 4);
+    }
+
+    #[tokio::test]
+    async fn test_quiet_app_jumps_flooding_queue() {
+        let pool = pool(4, &[("noisy", 1), ("quiet", 1)]);
+        let mut noisy_held = Vec::new();
+        for _ in 0..4 {
+            noisy_held.push(pool.acquire("noisy", WAIT).await.unwrap());
+        }
+
+        // Noisy queues a pile of requests before quiet shows up
+        let mut noisy_waiting = Vec::new();
+        for _ in 0..10 {
+            let pool = pool.clone();
+            noisy_waiting.push(tokio::spawn(async move { pool.acquire("noisy", WAIT).await }));
+        }
+        tokio::time::sleep(Duration::from_millis(20)).await;
+
+        let quiet = {
+            let pool = pool.clone();
+            tokio::spawn(async move { pool.acquire("quiet", WAIT).await })
+        };
+        tokio::time::sleep(Duration::from_millis(20)).await;
+        assert_eq!(pool.waiting(), 11);
+
+        // The first freed slot goes to quiet, not the ten noisy requests ahead of it
+        drop(noisy_held.pop());
+        let quiet_permit = tokio::time::timeout(Duration::from_secs(1), quiet)
+            .await
+            .expect("quiet app should be served")
+            .unwrap()
+            .unwrap();
+        assert_eq!(pool.in_use_for("quiet"), 1);
+        assert_eq!(pool.waiting(), 10);
+
+        drop(quiet_permit);
+        drop(noisy_held);
+        for handle in noisy_waiting {
+            drop(handle.await.unwrap().unwrap());
+        }
+        assert_eq!(pool.in_use(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_weighted_shares_under_contention() {
+        let pool = pool(4, &[("big", 3), ("small", 1)]);
+        assert_eq!(pool.fair_share("big"), 3);
+        assert_eq!(pool.fair_share("small"), 1);
+
+        // small floods first and takes everything
+        let mut small_held = Vec::new();
+        for _ in 0..4 {
+            small_held.push(pool.acquire("small", WAIT).await.unwrap());
+        }
+
+        let mut waiting = Vec::new();
+        for app in ["small", "big"] {
+            for _ in 0..5 {
+                let pool = pool.clone();
+                waiting.push(tokio::spawn(async move { pool.acquire(app, WAIT).await }));
+            }
+        }
+        tokio::time::sleep(Duration::from_millis(20)).await;
+
+        // As small's original requests finish, slots rebalance toward 3:1
+        for permit in small_held.drain(..) {
+            drop(permit);
+        }
+        tokio::time::sleep(Duration::from_millis(20)).await;
+        assert_eq!(pool.in_use_for("big"), 3);
+        assert_eq!(pool.in_use_for("small"), 1);
+
+        for handle in waiting {
+            handle.abort();
+        }
+    }
+
+    #[tokio::test]
+    async fn test_flooding_app_does_not_starve_others() {
+        let pool = pool(4, &[("noisy", 1), ("quiet", 1)]);
+        let served = Arc::new(AtomicUsize::new(0));
+
+        // 100 long-ish noisy requests against a pool of 4
+        let mut noisy = Vec::new();
+        for _ in 0..100 {
+            let pool = pool.clone();
+            noisy.push(tokio::spawn(async move {
+                if let Ok(_permit) = pool.acquire("noisy", Duration::from_secs(30)).await {
+                    tokio::time::sleep(Duration::from_millis(20)).await;
+                }
+            }));
+        }
+        tokio::time::sleep(Duration::from_millis(10)).await;
+
+        // Quiet requests arrive mid-flood and must all be served promptly
+        let start = std::time::Instant::now();
+        let mut quiet = Vec::new();
+        for _ in 0..5 {
+            let pool = pool.clone();
+            let served = served.clone();
+            quiet.push(tokio::spawn(async move {
+                let _permit = pool.acquire("quiet", Duration::from_secs(2)).await.unwrap();
+                served.fetch_add(1, Ordering::SeqCst);
+                tokio::time::sleep(Duration::from_millis(5)).await;
+            }));
+        }
+        for handle in quiet {
+            handle.await.unwrap();
+        }
+        assert_eq!(served.load(Ordering::SeqCst), 5);
+        // Well under the ~500ms it would take to drain the noisy backlog first
+        assert!(start.elapsed() < Duration::from_millis(400));
+
+        for handle in noisy {
+            handle.abort();
+        }
+    }
+
+    #[tokio::test]
+    async fn test_app_limit_queues_then_times_out() {
+        let limit = AppLimit::new(1, None);
+        let held = limit.acquire(WAIT).await.unwrap();
+        assert_eq!(limit.in_use(), 1);
+
+        let result = limit.acquire(Duration::from_millis(50)).await;
+        assert_eq!(result.unwrap_err(), PoolError::Timeout);
+        assert_eq!(limit.waiting(), 0);
+
+        // A queued request gets the slot as soon as it's freed
+        let waiter = {
+            let limit = limit.clone();
+            tokio::spawn(async move { limit.acquire(WAIT).await.map(|_| ()) })
+        };
+        tokio::time::sleep(Duration::from_millis(20)).await;
+        assert_eq!(limit.waiting(), 1);
+        drop(held);
+        waiter.await.unwrap().unwrap();
+        assert_eq!(limit.waiting(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_app_limit_rejects_once_queue_is_full() {
+        let limit = AppLimit::new(1, Some(1));
+        let _held = limit.acquire(WAIT).await.unwrap();
+        let queued = {
+            let limit = limit.clone();
+            tokio::spawn(async move { limit.acquire(WAIT).await.map(|_| ()) })
+        };
+        tokio::time::sleep(Duration::from_millis(20)).await;
+
+        let result = limit.acquire(WAIT).await;
+        assert_eq!(result.unwrap_err(), PoolError::QueueFull);
+        assert_eq!(limit.waiting(), 1);
+
+        // A request that gives up while queued leaves the queue
+        queued.abort();
+        let _ = queued.await;
+        assert_eq!(limit.waiting(), 0);
+
+        let none_waiting = AppLimit::new(1, Some(0));
+        let _held = none_waiting.acquire(WAIT).await.unwrap();
+        let result = none_waiting.acquire(WAIT).await;
+        assert_eq!(result.unwrap_err(), PoolError::QueueFull);
+    }
+}
@@ -1,9 +1,17 @@
 //! Configuration parsing for tenement.toml
 
+use crate::access::AccessConfig;
+use crate::env_files;
+use crate::fault::FaultConfig;
+use crate::headers::HeaderRules;
+use crate::hooks::HookKind;
+use crate::redact::Redactor;
 use crate::runtime::RuntimeType;
 use anyhow::{Context, Result};
 use serde::{Deserialize, Serialize};
-use std::collections::HashMap;
+use std::collections::hash_map::DefaultHasher;
+use std::collections::{BTreeMap, HashMap};
+use std::hash::{Hash, Hasher};
 use std::path::{Path, PathBuf};
 
 /// Main configuration structure
@@ -26,6 +34,14 @@ pub struct Config {
     /// Example: { "api": ["prod"], "worker": ["bg-1", "bg-2"] }
     #[serde(default)]
     pub instances: HashMap<String, Vec<String>>,
+
+    /// Scheduled one-shot commands (`[jobs.<name>]`)
+    #[serde(default)]
+    pub jobs: HashMap<String, JobConfig>,
+
+    /// File this config was loaded from, re-read on reload
+    #[serde(skip)]
+    pub source: Option<PathBuf>,
 }
 
 #[derive(Debug, Clone, Serialize, Deserialize)]
@@ -57,488 +73,4507 @@ pub struct Settings {
     #[serde(default = "default_backoff_max_ms")]
     pub backoff_max_ms: u64,
 
+    /// Seconds an instance must go without restarting before its backoff and
+    /// crash count start over. Three restarts inside this window is a crash loop.
+    #[serde(default = "default_backoff_reset_secs")]
+    pub backoff_reset_secs: u64,
+
     /// TLS configuration for HTTPS
     #[serde(default)]
     pub tls: TlsConfig,
-}
 
-/// TLS configuration for the HTTP API server
-#[derive(Debug, Clone, Serialize, Deserialize)]
-pub struct TlsConfig {
-    /// Enable TLS
+    /// Master switch for `[service.*.fault]` blocks (default: false).
+    /// Fault configs are ignored unless this is explicitly enabled.
     #[serde(default)]
-    pub enabled: bool,
-
-    /// Email for Let's Encrypt ACME registration
-    pub acme_email: Option<String>,
-
-    /// Domain name for TLS certificate
-    pub domain: Option<String>,
+    pub fault_injection: bool,
 
-    /// Directory for storing ACME account and certificate cache
-    /// Defaults to {data_dir}/acme
-    pub cache_dir: Option<PathBuf>,
-
-    /// Use Let's Encrypt staging environment (for testing, avoids rate limits)
+    /// Cap on concurrent proxied requests across all services (default: unlimited).
+    /// When full, slots are shared by each service's `concurrency_weight`.
     #[serde(default)]
-    pub staging: bool,
-
-    /// HTTPS port (default: 443)
-    #[serde(default = "default_https_port")]
-    pub https_port: u16,
-
-    /// HTTP port for redirects and ACME challenges (default: 80)
-    #[serde(default = "default_http_port")]
-    pub http_port: u16,
-
-    /// DNS provider for Caddy wildcard certificates (cloudflare, route53, etc.)
-    /// Used when generating Caddyfile with per-process wildcards
-    pub dns_provider: Option<String>,
-}
-
-fn default_https_port() -> u16 {
-    443
-}
-
-fn default_http_port() -> u16 {
-    80
-}
-
-impl Default for TlsConfig {
-    fn default() -> Self {
-        Self {
-            enabled: false,
-            acme_email: None,
-            domain: None,
-            cache_dir: None,
-            staging: false,
-            https_port: default_https_port(),
-            http_port: default_http_port(),
-            dns_provider: None,
-        }
-    }
-}
-
-impl Default for Settings {
-    fn default() -> Self {
-        Self {
-            data_dir: default_data_dir(),
-            health_check_interval: default_health_interval(),
-            max_restarts: default_max_restarts(),
-            restart_window: default_restart_window(),
-            backoff_base_ms: default_backoff_base_ms(),
-            backoff_max_ms: default_backoff_max_ms(),
-            tls: TlsConfig::default(),
-        }
-    }
-}
-
-fn default_data_dir() -> PathBuf {
-    PathBuf::from("./tenement-data")
-}
-
-/// Reject paths that start with a literal `~`. We don't expand tilde, and a
-/// literal `~/foo` directory is almost never what the user wants.
-fn reject_tilde(path: &Path, source: &str) -> Result<()> {
-    if path.to_string_lossy().starts_with('~') {
-        anyhow::bail!(
-            "{} path {:?} starts with '~'. Tilde is not expanded; \
-             pass an absolute path (e.g. $HOME/.local/share/tenement) instead.",
-            source,
-            path
-        );
-    }
-    Ok(())
-}
-
-fn default_health_interval() -> u64 {
-    10
-}
-
-fn default_max_restarts() -> u32 {
-    3
-}
+    pub max_concurrency: Option<usize>,
 
-fn default_restart_window() -> u64 {
-    300
-}
+    /// How long a request waits for a concurrency slot before a 503 (in milliseconds)
+    #[serde(default = "default_concurrency_queue_timeout_ms")]
+    pub concurrency_queue_timeout_ms: u64,
 
-fn default_backoff_base_ms() -> u64 {
-    1000 // 1 second
-}
+    /// Overall shutdown deadline in seconds: connection drain, SIGTERM and process
+    /// exit all share it, then remaining instances are force-killed
+    #[serde(default = "default_shutdown_timeout_secs")]
+    pub shutdown_timeout_secs: u64,
 
-fn default_backoff_max_ms() -> u64 {
-    60000 // 60 seconds
-}
+    /// Ports instances on TCP runtimes are given as PORT, lowest and highest
+    /// (default: [30000, 40000]). Each instance keeps its port across restarts.
+    #[serde(default = "default_port_range")]
+    pub port_range: (u16, u16),
 
-/// A host->guest bind mount for OCI runtimes (Quark). Rendered by Tinyhost as
-/// `[[service.<name>.mounts]]`. Non-OCI runtimes ignore these.
-#[derive(Debug, Clone, Serialize, Deserialize)]
-pub struct MountConfig {
-    /// Host source path
-    pub source: PathBuf,
-    /// Guest destination path (absolute, inside the rootfs)
-    pub destination: PathBuf,
-    /// Mount read-only (default false)
+    /// Active environment, selecting an `[overlay.<env>]` table to merge on top
+    /// of the base config. The TENEMENT_ENV variable takes precedence.
     #[serde(default)]
-    pub readonly: bool,
-}
+    pub environment: Option<String>,
 
-/// Service template definition (also known as ProcessConfig for backwards compatibility)
-#[derive(Debug, Clone, Serialize, Deserialize)]
-pub struct ProcessConfig {
-    /// Isolation level: "namespace" (default), "process", "firecracker", or "qemu"
+    /// File of extra admin API tokens (one per line, plaintext or Argon2 hash).
+    /// Re-read on SIGHUP or `POST /api/auth/reload` without a restart.
     #[serde(default)]
-    pub isolation: RuntimeType,
+    pub admin_tokens_file: Option<PathBuf>,
 
-    /// Command to run (supports {name}, {id}, {data_dir} interpolation)
-    pub command: String,
-
-    /// Arguments (optional)
+    /// POST a JSON notification to a URL whenever an instance's health state changes
     #[serde(default)]
-    pub args: Vec<String>,
-
-    /// Unix socket path pattern (supports {name}, {id})
-    /// Note: For process/namespace/sandbox runtimes, tenement automatically allocates
-    /// TCP ports from the range 30000-40000 and sets the PORT environment variable.
-    /// This socket field is primarily used for vsock communication with VMs.
-    #[serde(default = "default_socket")]
-    pub socket: String,
+    pub health_webhook: Option<HealthWebhookConfig>,
 
-    /// Health check endpoint (e.g., "/health")
+    /// Creating this file starts the same graceful drain as SIGTERM: proxied requests
+    /// get 503 while in-flight ones finish, then tenement shuts down. Deleting the file
+    /// before the connections finish cancels the drain.
     #[serde(default)]
-    pub health: Option<String>,
+    pub drain_file: Option<PathBuf>,
 
-    /// Environment variables (supports {name}, {id}, {data_dir}, {socket})
+    /// Also serve `/metrics` on this address (e.g. "127.0.0.1:9100"), so it can
+    /// be scraped without going through the public listener
     #[serde(default)]
-    pub env: HashMap<String, String>,
+    pub metrics_listen: Option<std::net::SocketAddr>,
 
-    /// Working directory
+    /// Unix socket for the local admin API (default: {data_dir}/admin.sock).
+    /// Anyone who can open it has admin access, so it's created owner-only.
     #[serde(default)]
-    pub workdir: Option<PathBuf>,
+    pub admin_socket: Option<PathBuf>,
 
-    /// Host->guest bind mounts for OCI runtimes (Quark). Other runtimes ignore.
+    /// Write each service's output to its own rotated log file
     #[serde(default)]
-    pub mounts: Vec<MountConfig>,
+    pub log_files: Option<LogFilesConfig>,
 
-    /// OCI image reference. Required for container runtimes that run via
-    /// docker/containerd (e.g. `isolation = "quark"`); ignored otherwise.
+    /// Forward every service's output to syslog, Loki or an HTTP collector
+    /// (`[[settings.log_sinks]]`)
     #[serde(default)]
-    pub image: Option<String>,
+    pub log_sinks: Vec<LogSinkConfig>,
 
-    /// Restart policy: "always", "on-failure", "never"
-    #[serde(default = "default_restart_policy")]
-    pub restart: String,
+    /// Also forward each audit log entry to `[[settings.log_sinks]]`, as a
+    /// JSON line from process "tenement", instance "audit" (default: false)
+    #[serde(default)]
+    pub ship_audit_log: bool,
 
-    /// Idle timeout in seconds before auto-stopping (0 = never stop)
-    /// When set, instance will be stopped after this many seconds of inactivity.
-    /// Health checks do NOT count as activity - only real requests do.
+    /// Keep instance state and release history in a bucket rather than
+    /// tenement.db (`[settings.state_backend]`)
     #[serde(default)]
-    pub idle_timeout: Option<u64>,
+    pub state_backend: Option<StateBackendConfig>,
 
-    /// Startup timeout in seconds (default: 10)
-    /// How long to wait for a process to pass its first health check.
-    /// Increase for commands that compile before serving (e.g. `go run`: 30-60s).
-    #[serde(default = "default_startup_timeout")]
-    pub startup_timeout: u64,
+    /// Where `ten backup` writes backups, and the schedule it takes them on
+    /// (`[settings.backup]`)
+    #[serde(default)]
+    pub backup: Option<BackupConfig>,
 
-    /// Request timeout in seconds (default: 30)
-    /// Maximum time a proxied request can take before being terminated.
-    #[serde(default = "default_request_timeout")]
-    pub request_timeout: u64,
+    /// Notify people when services stay unhealthy, restart in a loop or serve
+    /// too many errors (`[settings.alerts]`)
+    #[serde(default)]
+    pub alerts: Option<AlertsConfig>,
 
-    // --- Resource limits (cgroups v2 on Linux) ---
-    /// Memory limit in MB (0 = unlimited)
-    /// Applied via cgroups v2 on Linux for process/namespace/sandbox isolation.
-    /// For Firecracker/QEMU VMs, this sets the VM memory.
+    /// Log every proxied request; a service's own `access_log` takes its place
     #[serde(default)]
-    pub memory_limit_mb: Option<u32>,
+    pub access_log: Option<AccessLogConfig>,
 
-    /// CPU weight (1-10000, default 100)
-    /// Higher values get more CPU time relative to other services.
-    /// Applied via cgroups v2 cpu.weight on Linux.
-    /// 100 = normal priority, 1 = minimum, 10000 = maximum
+    /// Export OpenTelemetry spans for proxied requests, health checks and deploys
     #[serde(default)]
-    pub cpu_shares: Option<u32>,
+    pub tracing: Option<TracingConfig>,
 
-    // --- Storage limits ---
-    /// Storage quota in MB (None = unlimited)
-    /// Soft limit: exceeding quota triggers warnings and metrics but doesn't kill the process.
+    /// The web dashboard: on the public listener by default, or on its own address
     #[serde(default)]
-    pub storage_quota_mb: Option<u32>,
+    pub dashboard: DashboardConfig,
 
-    /// Keep data directory on stop (default: true)
-    /// If true, data is preserved for the next spawn (databases, files, etc.)
-    /// If false, the instance's data directory is deleted when stopped.
-    #[serde(default = "default_storage_persist")]
-    pub storage_persist: bool,
+    /// Run as one node of a cluster of tenement servers
+    #[serde(default)]
+    pub cluster: Option<ClusterConfig>,
 
-    // --- Firecracker/QEMU-specific fields ---
-    /// Path to kernel image (required for firecracker runtime)
+    /// Reach services by name, e.g. `api.tenement.local`
     #[serde(default)]
-    pub kernel: Option<PathBuf>,
+    pub discovery: Option<DiscoveryConfig>,
 
-    /// Path to root filesystem image (required for firecracker runtime)
+    /// Proxy middleware every proxied request goes through, by registered name
     #[serde(default)]
-    pub rootfs: Option<PathBuf>,
+    pub middleware: Vec<String>,
+}
 
-    /// Memory in MB for VM (firecracker/qemu only, default 256)
-    #[serde(default = "default_memory_mb")]
-    pub memory_mb: u32,
+/// Admin socket file name under data_dir
+pub const ADMIN_SOCKET_FILE: &str = "admin.sock";
 
-    /// Number of vCPUs (firecracker/qemu only)
-    #[serde(default = "default_vcpus")]
-    pub vcpus: u32,
+impl Settings {
+    /// Where the admin API socket lives
+    pub fn admin_socket_path(&self) -> PathBuf {
+        self.admin_socket
+            .clone()
+            .unwrap_or_else(|| self.data_dir.join(ADMIN_SOCKET_FILE))
+    }
 
-    /// VSOCK port for guest communication (firecracker only)
-    #[serde(default = "default_vsock_port")]
-    pub vsock_port: u32,
+    /// Where per-service log files go, when they're enabled
+    pub fn log_dir(&self) -> Option<PathBuf> {
+        let log_files = self.log_files.as_ref()?;
+        Some(log_files.dir.clone().unwrap_or_else(|| self.data_dir.join("logs")))
+    }
 }
 
-fn default_memory_mb() -> u32 {
-    256
-}
+/// Per-service log files (`[settings.log_files]`)
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct LogFilesConfig {
+    /// Directory for `{service}.log` files (default: {data_dir}/logs)
+    #[serde(default)]
+    pub dir: Option<PathBuf>,
 
-fn default_vcpus() -> u32 {
-    1
-}
+    /// Rotate once a file reaches this size in megabytes (default: 10)
+    #[serde(default = "default_log_max_size_mb")]
+    pub max_size_mb: u64,
 
-fn default_vsock_port() -> u32 {
-    5000
+    /// Also rotate once a file is this old, in seconds or as "1d" (default: never)
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub max_age: Option<u64>,
+
+    /// Rotated files kept per service; older ones are deleted (default: 5)
+    #[serde(default = "default_log_keep")]
+    pub keep: usize,
+
+    /// Gzip rotated files (default: true)
+    #[serde(default = "default_log_compress")]
+    pub compress: bool,
 }
 
-fn default_socket() -> String {
-    "/tmp/tenement/{name}-{id}.sock".to_string()
+fn default_log_max_size_mb() -> u64 {
+    10
 }
 
-fn default_restart_policy() -> String {
-    "on-failure".to_string()
+fn default_log_keep() -> usize {
+    5
 }
 
-fn default_storage_persist() -> bool {
+fn default_log_compress() -> bool {
     true
 }
 
-fn default_startup_timeout() -> u64 {
-    10
+/// A collector service output is forwarded to (`[[settings.log_sinks]]` for
+/// every service, `[[service.x.log_sinks]]` for one). Entries are sent in
+/// batches; batches the collector doesn't take are kept on disk and retried.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct LogSinkConfig {
+    /// "syslog" (RFC 5424), "loki" (push API) or "http" (NDJSON POSTs)
+    #[serde(rename = "type")]
+    pub kind: LogSinkKind,
+
+    /// syslog: "udp://host:514" or "tcp://host:514"; loki: the server, e.g.
+    /// "http://loki:3100" (pushed to /loki/api/v1/push); http: the URL POSTed to
+    pub url: String,
+
+    /// Names the sink in logs and its buffer directory (default: the type);
+    /// letters, digits, '-' and '_'
+    #[serde(default)]
+    pub name: Option<String>,
+
+    /// Extra headers on each request (loki, http), e.g. an API key
+    #[serde(default)]
+    pub headers: HashMap<String, String>,
+
+    /// Added to every entry: stream labels for loki, fields for http
+    #[serde(default)]
+    pub labels: BTreeMap<String, String>,
+
+    /// Entries per batch (default: 500)
+    #[serde(default = "default_log_sink_batch_size")]
+    pub batch_size: usize,
+
+    /// Longest an entry waits for its batch to fill, in seconds or as "1m"
+    /// (default: 2)
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub flush_interval: Option<u64>,
+
+    /// Megabytes of unsent batches kept on disk while the collector is down;
+    /// past it the oldest are dropped (default: 64; 0 = drop failed batches)
+    #[serde(default = "default_log_sink_buffer_mb")]
+    pub buffer_mb: u64,
 }
 
-fn default_request_timeout() -> u64 {
-    30
+/// The protocol a log sink speaks
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum LogSinkKind {
+    Syslog,
+    Loki,
+    Http,
 }
 
-/// Routing configuration
-#[derive(Debug, Clone, Serialize, Deserialize, Default)]
-pub struct RoutingConfig {
-    /// Default process to route to
-    pub default: Option<String>,
+impl std::fmt::Display for LogSinkKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            LogSinkKind::Syslog => write!(f, "syslog"),
+            LogSinkKind::Loki => write!(f, "loki"),
+            LogSinkKind::Http => write!(f, "http"),
+        }
+    }
+}
 
-    /// Route by subdomain: "*.example.com" -> "process-name"
-    #[serde(default)]
-    pub subdomain: HashMap<String, String>,
+fn default_log_sink_batch_size() -> usize {
+    500
+}
 
-    /// Route by path prefix: "/api" -> "process-name"
-    #[serde(default)]
-    pub path: HashMap<String, String>,
+fn default_log_sink_buffer_mb() -> u64 {
+    64
 }
 
-impl Config {
-    /// Load config from tenement.toml in current directory or parents
-    pub fn load() -> Result<Self> {
-        let config_path = Self::find_config_file()?;
-        Self::load_from_path(&config_path)
+impl LogSinkConfig {
+    /// Its name, or its type when it has none
+    pub fn name(&self) -> String {
+        self.name.clone().unwrap_or_else(|| self.kind.to_string())
     }
 
-    /// Load config and optionally replace `settings.data_dir`.
-    ///
-    /// Used by the CLI to apply the `--data-dir` flag (or `TENEMENT_DATA_DIR`).
-    /// Precedence: override arg > value in tenement.toml > built-in default.
-    pub fn load_with_override(data_dir_override: Option<PathBuf>) -> Result<Self> {
-        let mut config = Self::load()?;
-        config.apply_data_dir_override(data_dir_override)?;
-        Ok(config)
+    /// How long entries wait for a batch to fill
+    pub fn flush_interval(&self) -> std::time::Duration {
+        std::time::Duration::from_secs(self.flush_interval.unwrap_or(2))
     }
 
-    /// Apply a `--data-dir` override on top of an already-loaded config.
-    ///
-    /// Both the override and any toml-supplied data_dir must not start with `~`
-    /// (no tilde expansion is performed; reject early so users see a clear error
-    /// instead of a literal `~` directory being created).
-    pub fn apply_data_dir_override(&mut self, data_dir_override: Option<PathBuf>) -> Result<()> {
-        reject_tilde(&self.settings.data_dir, "data_dir in tenement.toml")?;
-        if let Some(dir) = data_dir_override {
-            reject_tilde(&dir, "--data-dir")?;
-            self.settings.data_dir = dir;
+    /// Reject sinks that can't send. `section` names the table in errors.
+    pub fn validate(&self, section: &str) -> Result<()> {
+        let name = self.name();
+        let valid_name = !name.is_empty()
+            && name
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_');
+        if !valid_name {
+            anyhow::bail!(
+                "{} name '{}' may only use letters, digits, '-' and '_'",
+                section,
+                name
+            );
+        }
+        let schemes: &[&str] = match self.kind {
+            LogSinkKind::Syslog => &["udp://", "tcp://"],
+            LogSinkKind::Loki | LogSinkKind::Http => &["http://", "https://"],
+        };
+        let Some(rest) = schemes.iter().find_map(|s| self.url.strip_prefix(s)) else {
+            anyhow::bail!(
+                "{} '{}' url must start with {}",
+                section,
+                name,
+                schemes.join(" or ")
+            );
+        };
+        if self.kind == LogSinkKind::Syslog && rest.rsplit_once(':').is_none() {
+            anyhow::bail!(
+                "{} '{}' url needs a port, e.g. udp://host:514",
+                section,
+                name
+            );
+        }
+        if self.batch_size == 0 {
+            anyhow::bail!("{} '{}' batch_size must be at least 1", section, name);
+        }
+        if self.flush_interval == Some(0) {
+            anyhow::bail!(
+                "{} '{}' flush_interval must be at least 1 second",
+                section,
+                name
+            );
         }
         Ok(())
     }
+}
 
-    /// Load config from a specific path
-    ///
-    /// Load config from a specific path.
-    /// Both are merged into the `service` field.
-    pub fn load_from_path(path: &Path) -> Result<Self> {
-        let content = std::fs::read_to_string(path)
-            .with_context(|| format!("Failed to read config file: {}", path.display()))?;
+/// Check each sink in a list, and that their names don't repeat
+fn validate_log_sinks(sinks: &[LogSinkConfig], section: &str) -> Result<()> {
+    let mut names = std::collections::HashSet::new();
+    for sink in sinks {
+        sink.validate(section)?;
+        if !names.insert(sink.name()) {
+            anyhow::bail!(
+                "{} has two sinks named '{}'; give one a `name`",
+                section,
+                sink.name()
+            );
+        }
+    }
+    Ok(())
+}
 
-        Self::from_str(&content)
-            .with_context(|| format!("Failed to parse config file: {}", path.display()))
+/// Where instance state and release history are kept instead of tenement.db,
+/// e.g. `state_backend = { url = "s3://state/tenement/prod" }`
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct StateBackendConfig {
+    /// s3://bucket/prefix; credentials and endpoint come from the AWS variables
+    pub url: String,
+}
+
+impl StateBackendConfig {
+    pub fn validate(&self) -> Result<()> {
+        crate::artifact::split_s3_url(&self.url).context("Invalid [settings.state_backend] url")?;
+        Ok(())
     }
+}
 
-    /// Parse config from a TOML string
-    #[allow(clippy::should_implement_trait)]
-    pub fn from_str(content: &str) -> Result<Self> {
-        let config: Config = toml::from_str(content)?;
+/// Backups of the state DB, secrets store and volumes, e.g.
+/// `backup = { target = "s3://backups/tenement", schedule = "@daily", keep = 14 }`
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct BackupConfig {
+    /// Directory, or s3://bucket/prefix, backups are written to and restored from
+    pub target: String,
 
-        // Validate instances reference defined services
-        for service_name in config.instances.keys() {
-            if !config.service.contains_key(service_name) {
-                anyhow::bail!(
-                    "Instance references undefined service '{}'. \
-                    Define it in [service.{}] first.",
-                    service_name,
-                    service_name
-                );
-            }
+    /// Cron expression ("0 3 * * *") or macro ("@daily") to take them on
+    /// (default: only when `ten backup create` is run)
+    #[serde(default)]
+    pub schedule: Option<String>,
+
+    /// IANA timezone the schedule is read in (default UTC)
+    #[serde(default)]
+    pub timezone: Option<String>,
+
+    /// How many to keep, newest first; older ones are deleted after each
+    /// backup (default 7, 0 = no limit)
+    #[serde(default = "default_backup_keep")]
+    pub keep: usize,
+
+    /// Also delete ones older than this, e.g. "30d" (the newest is always kept)
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub max_age: Option<u64>,
+
+    /// Put master.key in backups too. Off by default, so a leaked backup doesn't
+    /// give its secrets away; the restored host then needs the same key.
+    #[serde(default)]
+    pub include_master_key: bool,
+}
+
+fn default_backup_keep() -> usize {
+    7
+}
+
+impl BackupConfig {
+    pub fn parsed_schedule(&self) -> Result<Option<crate::schedule::Schedule>> {
+        self.schedule
+            .as_deref()
+            .map(crate::schedule::Schedule::parse)
+            .transpose()
+    }
+
+    pub fn tz(&self) -> Result<chrono_tz::Tz> {
+        match &self.timezone {
+            None => Ok(chrono_tz::UTC),
+            Some(name) => name
+                .parse()
+                .map_err(|_| anyhow::anyhow!("unknown timezone '{}'", name)),
         }
+    }
 
-        Ok(config)
+    pub fn validate(&self) -> Result<()> {
+        crate::backup::Target::parse(&self.target)?;
+        self.parsed_schedule()
+            .and_then(|_| self.tz())
+            .context("Invalid [settings.backup] schedule")?;
+        Ok(())
     }
+}
 
-    /// Find tenement.toml by walking up from current directory
-    fn find_config_file() -> Result<PathBuf> {
-        let mut current = std::env::current_dir()?;
+/// Alert rules, checked for every service, e.g.
+/// `alerts = { unhealthy_for = "2m", max_restarts_per_hour = 5, max_error_rate = 0.05 }`.
+/// Each alert is sent once when it fires and once when it resolves.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct AlertsConfig {
+    /// Fire when a service has had an instance unhealthy this long, in seconds
+    /// or as "2m"
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub unhealthy_for: Option<u64>,
+
+    /// Fire when a service's instances restart more often than this in an hour
+    #[serde(default)]
+    pub max_restarts_per_hour: Option<u64>,
 
-        loop {
-            let config_path = current.join("tenement.toml");
-            if config_path.exists() {
-                return Ok(config_path);
-            }
+    /// Fire when more than this share (0.0-1.0) of a service's requests get a
+    /// 5xx over `window`
+    #[serde(default)]
+    pub max_error_rate: Option<f64>,
 
-            if !current.pop() {
-                anyhow::bail!(
-                    "No tenement.toml found. Create one with:\n\n\
-                    [service.myapp]\n\
-                    command = \"./my-app\"\n\
-                    socket = \"/tmp/myapp-{{id}}.sock\"\n"
-                );
+    /// How far back error rates look (default: "5m")
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub window: Option<u64>,
+
+    /// Requests a service must serve within `window` before its error rate
+    /// counts (default: 20)
+    #[serde(default = "default_alert_min_requests")]
+    pub min_requests: u64,
+
+    /// Send a firing alert again after this long, e.g. "4h" (default: once)
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub repeat_interval: Option<u64>,
+
+    /// Also notify when an alert resolves (default: true)
+    #[serde(default = "default_alert_send_resolved")]
+    pub send_resolved: bool,
+
+    /// Where alerts go (`[[settings.alerts.notify]]`)
+    #[serde(default)]
+    pub notify: Vec<NotifierConfig>,
+}
+
+fn default_alert_min_requests() -> u64 {
+    20
+}
+
+fn default_alert_send_resolved() -> bool {
+    true
+}
+
+impl AlertsConfig {
+    /// How far back error rates look
+    pub fn window(&self) -> std::time::Duration {
+        std::time::Duration::from_secs(self.window.unwrap_or(300))
+    }
+
+    pub fn validate(&self) -> Result<()> {
+        if self.unhealthy_for.is_none()
+            && self.max_restarts_per_hour.is_none()
+            && self.max_error_rate.is_none()
+        {
+            anyhow::bail!(
+                "[settings.alerts] needs unhealthy_for, max_restarts_per_hour or max_error_rate"
+            );
+        }
+        if let Some(rate) = self.max_error_rate {
+            if !(0.0..1.0).contains(&rate) {
+                anyhow::bail!("[settings.alerts] max_error_rate must be at least 0 and below 1");
             }
         }
+        if self.window == Some(0) || self.repeat_interval == Some(0) {
+            anyhow::bail!("[settings.alerts] window and repeat_interval must be at least 1 second");
+        }
+        if self.notify.is_empty() {
+            anyhow::bail!(
+                "[settings.alerts] has nowhere to send alerts; add [[settings.alerts.notify]]"
+            );
+        }
+        for notifier in &self.notify {
+            notifier.validate()?;
+        }
+        Ok(())
     }
+}
 
-    /// Get a service config by name
-    pub fn get_service(&self, name: &str) -> Option<&ProcessConfig> {
-        self.service.get(name)
+/// Somewhere alerts are sent (`[[settings.alerts.notify]]`)
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct NotifierConfig {
+    /// "webhook" (the alert's JSON), "slack" (an incoming webhook) or "email"
+    #[serde(rename = "type")]
+    pub kind: NotifierKind,
+
+    /// webhook and slack: the URL POSTed to
+    #[serde(default)]
+    pub url: Option<String>,
+
+    /// email: SMTP server as host:port (port 25 if left out). Mail is sent
+    /// without TLS, so point it at a local relay.
+    #[serde(default)]
+    pub smtp: Option<String>,
+
+    /// email: login for SMTP AUTH, if the server wants one. Only allowed for
+    /// a loopback `smtp`, since the password would cross the network in the
+    /// clear.
+    #[serde(default)]
+    pub username: Option<String>,
+
+    /// email: env var holding the SMTP password
+    #[serde(default)]
+    pub password_env: Option<String>,
+
+    /// email: sender address
+    #[serde(default)]
+    pub from: Option<String>,
+
+    /// email: recipient addresses
+    #[serde(default)]
+    pub to: Vec<String>,
+}
+
+/// How a notifier delivers alerts
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum NotifierKind {
+    Webhook,
+    Slack,
+    Email,
+}
+
+impl std::fmt::Display for NotifierKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            NotifierKind::Webhook => write!(f, "webhook"),
+            NotifierKind::Slack => write!(f, "slack"),
+            NotifierKind::Email => write!(f, "email"),
+        }
     }
+}
 
-    /// Get all configured instances to spawn on boot
-    /// Returns pairs of (service_name, instance_id)
-    pub fn get_instances_to_spawn(&self) -> Vec<(String, String)> {
-        let mut result = Vec::new();
-        for (service_name, instance_ids) in &self.instances {
-            for instance_id in instance_ids {
-                result.push((service_name.clone(), instance_id.clone()));
+impl NotifierConfig {
+    pub fn validate(&self) -> Result<()> {
+        match self.kind {
+            NotifierKind::Webhook | NotifierKind::Slack => {
+                let url = self.url.as_deref().unwrap_or_default();
+                if !url.starts_with("http://") && !url.starts_with("https://") {
+                    anyhow::bail!(
+                        "[[settings.alerts.notify]] {} url must start with http:// or https://",
+                        self.kind
+                    );
+                }
+            }
+            NotifierKind::Email => {
+                if self.smtp.as_deref().map_or(true, str::is_empty) {
+                    anyhow::bail!("[[settings.alerts.notify]] email needs `smtp`");
+                }
+                let address = |a: &str| a.contains('@') && !a.contains(['<', '>', '\r', '\n']);
+                if !self.from.as_deref().is_some_and(address) {
+                    anyhow::bail!("[[settings.alerts.notify]] email needs a `from` address");
+                }
+                if self.to.is_empty() || !self.to.iter().all(|to| address(to)) {
+                    anyhow::bail!("[[settings.alerts.notify]] email needs `to` addresses");
+                }
+                if self.password_env.is_some() && self.username.is_none() {
+                    anyhow::bail!("[[settings.alerts.notify]] email password_env needs a username");
+                }
+                if self.username.is_some() && !self.smtp_is_loopback() {
+                    anyhow::bail!(
+                        "[[settings.alerts.notify]] email username needs a loopback `smtp` \
+                         (mail is sent without TLS)"
+                    );
+                }
             }
         }
-        result
+        Ok(())
     }
 
-    /// Check if any instances are configured for auto-spawn
-    pub fn has_instances_to_spawn(&self) -> bool {
-        self.instances.values().any(|ids| !ids.is_empty())
+    /// Whether `smtp` is on this host (localhost or a loopback address)
+    pub fn smtp_is_loopback(&self) -> bool {
+        let smtp = self.smtp.as_deref().unwrap_or_default();
+        let host = match smtp.strip_prefix('[') {
+            Some(rest) => rest.split(']').next().unwrap_or_default(),
+            None => smtp.rsplit_once(':').map_or(smtp, |(host, _)| host),
+        };
+        host.eq_ignore_ascii_case("localhost")
+            || host
+                .parse::<std::net::IpAddr>()
+                .is_ok_and(|ip| ip.is_loopback())
     }
 }
 
-/// Listen address for a service
-#[derive(Debug, Clone)]
-pub enum ListenAddr {
-    /// Unix socket path
-    Socket(PathBuf),
-    /// TCP address (127.0.0.1:port)
-    Tcp(String, u16),
+/// Proxy access logs (`[settings.access_log]`, or `[service.x.access_log]` for one app)
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct AccessLogConfig {
+    /// Line format: "common" (Common Log Format plus app, instance, release and
+    /// latency) or "json" (default: "common")
+    #[serde(default)]
+    pub format: AccessLogFormat,
+
+    /// Where lines go: "file" (default) or "stdout"
+    #[serde(default)]
+    pub output: AccessLogOutput,
+
+    /// Directory for `{service}.log` access files (default: {data_dir}/logs/access)
+    #[serde(default)]
+    pub dir: Option<PathBuf>,
+
+    /// Rotate once a file reaches this size in megabytes (default: 10)
+    #[serde(default = "default_log_max_size_mb")]
+    pub max_size_mb: u64,
+
+    /// Also rotate once a file is this old, in seconds or as "1d" (default: never)
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub max_age: Option<u64>,
+
+    /// Rotated files kept per service; older ones are deleted (default: 5)
+    #[serde(default = "default_log_keep")]
+    pub keep: usize,
+
+    /// Gzip rotated files (default: true)
+    #[serde(default = "default_log_compress")]
+    pub compress: bool,
 }
 
-impl ListenAddr {
-    /// Check if this is a TCP address
-    pub fn is_tcp(&self) -> bool {
-        matches!(self, ListenAddr::Tcp(_, _))
+impl AccessLogConfig {
+    /// Where "file" output goes
+    pub fn dir(&self, data_dir: &Path) -> PathBuf {
+        self.dir
+            .clone()
+            .unwrap_or_else(|| data_dir.join("logs").join("access"))
     }
 
-    /// Check if this is a Unix socket
-    pub fn is_socket(&self) -> bool {
-        matches!(self, ListenAddr::Socket(_))
+    /// Reject rotation settings that would rotate on every line. `section`
+    /// names the table in errors.
+    pub fn validate(&self, section: &str) -> Result<()> {
+        if self.max_size_mb == 0 {
+            anyhow::bail!("{} max_size_mb must be at least 1", section);
+        }
+        if self.max_age == Some(0) {
+            anyhow::bail!("{} max_age must be at least 1 second", section);
+        }
+        Ok(())
     }
 
-    /// Get the TCP port if this is a TCP address
-    pub fn port(&self) -> Option<u16> {
-        match self {
-            ListenAddr::Tcp(_, port) => Some(*port),
-            ListenAddr::Socket(_) => None,
+    /// Rotation and retention for "file" output
+    pub fn rotation(&self) -> LogFilesConfig {
+        LogFilesConfig {
+            dir: self.dir.clone(),
+            max_size_mb: self.max_size_mb,
+            max_age: self.max_age,
+            keep: self.keep,
+            compress: self.compress,
         }
     }
 }
 
-impl ProcessConfig {
-    /// Validate config for the specified isolation level
-    pub fn validate(&self, name: &str) -> Result<()> {
-        if self.isolation == RuntimeType::Firecracker {
-            if self.kernel.is_none() {
-                anyhow::bail!(
-                    "Service '{}' uses firecracker isolation but 'kernel' is not specified",
-                    name
-                );
+/// OpenTelemetry export (`[settings.tracing]`)
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TracingConfig {
+    /// OTLP/HTTP collector, e.g. "http://localhost:4318"; spans are POSTed to
+    /// `{endpoint}/v1/traces`
+    pub endpoint: String,
+
+    /// `service.name` of the exported spans (default: "tenement")
+    #[serde(default = "default_tracing_service_name")]
+    pub service_name: String,
+
+    /// Share of new traces recorded, 0.0 to 1.0 (default: 1.0). Requests that
+    /// arrive with a `traceparent` keep the caller's decision.
+    #[serde(default = "default_tracing_sample_ratio")]
+    pub sample_ratio: f64,
+
+    /// Extra headers on export requests, e.g. a vendor API key
+    #[serde(default)]
+    pub headers: HashMap<String, String>,
+}
+
+fn default_tracing_service_name() -> String {
+    "tenement".to_string()
+}
+
+fn default_tracing_sample_ratio() -> f64 {
+    1.0
+}
+
+/// Clustering (`[settings.cluster]`)
+///
+/// Nodes poll each other's state every `heartbeat`, learning of peers their
+/// peers know (so `peers` can be a single seed), and each proxies requests for
+/// apps it doesn't run to a node that does. One node is elected leader.
+///
+/// Nodes talk to each other over plain HTTP, so the cluster token and
+/// forwarded requests are only as private as the network between them: keep
+/// `advertise` and peer addresses on a private network or VPN. It can't be
+/// combined with `[settings.tls]`, whose listener only speaks HTTPS.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ClusterConfig {
+    /// This node's name, unique in the cluster
+    pub node: String,
+
+    /// Address the other nodes reach this one's listener at, e.g. "10.0.0.1:8080"
+    pub advertise: String,
+
+    /// Other nodes to start from
+    #[serde(default)]
+    pub peers: Vec<PeerConfig>,
+
+    /// "active" (every node runs its apps) or "standby" (only the leader runs
+    /// them; the others forward to it and take over if it fails)
+    #[serde(default)]
+    pub mode: ClusterMode,
+
+    /// Environment variable holding the token nodes authenticate to each other
+    /// with, on state polls and forwarded requests (default: TENEMENT_CLUSTER_TOKEN)
+    #[serde(default = "default_cluster_token_env")]
+    pub token_env: String,
+
+    /// Seconds between state polls (default: 2); also accepts "2s"
+    #[serde(
+        default = "default_cluster_heartbeat",
+        deserialize_with = "deserialize_cluster_heartbeat"
+    )]
+    pub heartbeat: u64,
+
+    /// Seconds without a reply before a node counts as down (default: 10)
+    #[serde(
+        default = "default_cluster_failure_timeout",
+        deserialize_with = "deserialize_cluster_failure_timeout"
+    )]
+    pub failure_timeout: u64,
+}
+
+impl ClusterConfig {
+    /// Reject names, addresses, timings and TLS settings the cluster can't work with
+    pub fn validate(&self, tls: &TlsConfig) -> Result<()> {
+        let valid_address = |address: &str| {
+            address
+                .rsplit_once(':')
+                .is_some_and(|(host, port)| !host.is_empty() && port.parse::<u16>().is_ok())
+        };
+        if self.node.trim().is_empty() {
+            anyhow::bail!("[settings.cluster] node must not be empty");
+        }
+        if !valid_address(&self.advertise) {
+            anyhow::bail!(
+                "[settings.cluster] advertise must be host:port, got {:?}",
+                self.advertise
+            );
+        }
+        let mut seen = std::collections::HashSet::new();
+        for peer in &self.peers {
+            if peer.node == self.node {
+                anyhow::bail!("[settings.cluster] peer {:?} is this node", peer.node);
             }
-            if self.rootfs.is_none() {
+            if !seen.insert(&peer.node) {
+                anyhow::bail!("[settings.cluster] peer {:?} is listed twice", peer.node);
+            }
+            if !valid_address(&peer.address) {
                 anyhow::bail!(
-                    "Service '{}' uses firecracker isolation but 'rootfs' is not specified",
-                    name
+                    "[settings.cluster] peer {:?} address must be host:port, got {:?}",
+                    peer.node,
+                    peer.address
                 );
             }
         }
-        if self.isolation == RuntimeType::Litebox && self.rootfs.is_none() {
-            anyhow::bail!(
-                "Service '{}' uses litebox isolation but 'rootfs' is not specified. \
-                 LiteBox sandboxes the app inside a rootfs; point it at the extracted app root.",
-                name
-            );
+        if self.heartbeat == 0 {
+            anyhow::bail!("[settings.cluster] heartbeat must be at least 1 second");
         }
-        if matches!(self.isolation, RuntimeType::Sandbox | RuntimeType::Quark)
-            && self.image.is_none()
-        {
+        if self.failure_timeout <= self.heartbeat {
+            anyhow::bail!("[settings.cluster] failure_timeout must be longer than heartbeat");
+        }
+        if tls.enabled {
             anyhow::bail!(
-                "Service '{}' uses {} isolation but 'image' is not specified. \
-                 Container runtimes require an OCI image reference.",
-                name,
-                self.isolation
+                "[settings.cluster] can't be combined with [settings.tls]: nodes poll and \
+                 forward to each other over plain HTTP"
             );
         }
         Ok(())
     }
+}
 
-    /// Get the isolation level (preferred name)
-    pub fn isolation(&self) -> RuntimeType {
-        self.isolation
-    }
+/// Another node of the cluster
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct PeerConfig {
+    pub node: String,
+    /// Its listener, e.g. "10.0.0.2:8080"
+    pub address: String,
+}
 
-    /// Get the listen address for an instance
-    /// Returns a socket path. TCP ports are allocated separately by the hypervisor.
-    pub fn listen_addr(&self, name: &str, id: &str, port: Option<u16>) -> ListenAddr {
-        if let Some(port) = port {
-            ListenAddr::Tcp(format!("127.0.0.1:{}", port), port)
-        } else {
-            ListenAddr::Socket(self.socket_path(name, id))
+/// How a cluster shares its apps
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ClusterMode {
+    #[default]
+    Active,
+    Standby,
+}
+
+impl ClusterMode {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            ClusterMode::Active => "active",
+            ClusterMode::Standby => "standby",
         }
     }
+}
 
-    /// Interpolate variables in a string
-    /// Supports: {name}, {id}, {data_dir}, {socket}, {port}
-    pub fn interpolate(
-        &self,
-        template: &str,
-        name: &str,
-        id: &str,
-        data_dir: &Path,
-        port: Option<u16>,
+fn default_cluster_token_env() -> String {
+    "TENEMENT_CLUSTER_TOKEN".to_string()
+}
+
+fn default_cluster_heartbeat() -> u64 {
+    2
+}
+
+fn default_cluster_failure_timeout() -> u64 {
+    10
+}
+
+fn deserialize_cluster_heartbeat<'de, D>(deserializer: D) -> std::result::Result<u64, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(deserialize_duration_secs(deserializer)?.unwrap_or_else(default_cluster_heartbeat))
+}
+
+fn deserialize_cluster_failure_timeout<'de, D>(
+    deserializer: D,
+) -> std::result::Result<u64, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(deserialize_duration_secs(deserializer)?.unwrap_or_else(default_cluster_failure_timeout))
+}
+
+/// Service discovery (`[settings.discovery]`): each service answers through
+/// tenement at `{service}.{domain}`, and `hosts` and `services.env` files under
+/// `{data_dir}/discovery` list the names and the instances' addresses
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DiscoveryConfig {
+    /// Domain the names are under (default: "tenement.local")
+    #[serde(default = "default_discovery_domain")]
+    pub domain: String,
+
+    /// A hosts file to keep the names in as well, e.g. "/etc/hosts". tenement
+    /// only touches the block between its `# BEGIN tenement` and `# END
+    /// tenement` lines.
+    #[serde(default)]
+    pub hosts_file: Option<PathBuf>,
+}
+
+impl Default for DiscoveryConfig {
+    fn default() -> Self {
+        Self {
+            domain: default_discovery_domain(),
+            hosts_file: None,
+        }
+    }
+}
+
+fn default_discovery_domain() -> String {
+    "tenement.local".to_string()
+}
+
+/// Access log line format
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum AccessLogFormat {
+    #[default]
+    Common,
+    Json,
+}
+
+/// Access log destination
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum AccessLogOutput {
+    /// Rotated per-service files
+    #[default]
+    File,
+    Stdout,
+}
+
+/// Health transition webhook (`[settings.health_webhook]`)
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct HealthWebhookConfig {
+    /// http(s) URL that receives the POST
+    pub url: String,
+
+    /// Per-attempt timeout in milliseconds (default: 5000)
+    #[serde(default = "default_webhook_timeout_ms")]
+    pub timeout_ms: u64,
+
+    /// Extra attempts after a failed delivery, with doubling backoff (default: 3)
+    #[serde(default = "default_webhook_max_retries")]
+    pub max_retries: u32,
+
+    /// Delay before the first retry in milliseconds (default: 500)
+    #[serde(default = "default_webhook_retry_backoff_ms")]
+    pub retry_backoff_ms: u64,
+}
+
+fn default_webhook_timeout_ms() -> u64 {
+    5000
+}
+
+fn default_webhook_max_retries() -> u32 {
+    3
+}
+
+fn default_webhook_retry_backoff_ms() -> u64 {
+    500
+}
+
+/// Web dashboard (`[settings.dashboard]`). The pages are public; everything
+/// they show or do goes through the API with an admin or tenant token.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct DashboardConfig {
+    /// Serve the dashboard at all (default: true)
+    #[serde(default = "default_dashboard_enabled")]
+    pub enabled: bool,
+
+    /// Serve it (and the API it uses) on this address instead of the public
+    /// listener, e.g. "127.0.0.1:9000" for an admin port reached over a VPN or tunnel
+    #[serde(default)]
+    pub listen: Option<std::net::SocketAddr>,
+}
+
+fn default_dashboard_enabled() -> bool {
+    true
+}
+
+impl Default for DashboardConfig {
+    fn default() -> Self {
+        Self {
+            enabled: true,
+            listen: None,
+        }
+    }
+}
+
+impl DashboardConfig {
+    /// Whether the public listener serves the dashboard pages
+    pub fn on_public_listener(&self) -> bool {
+        self.enabled && self.listen.is_none()
+    }
+
+    /// The admin port the dashboard has to itself, if any
+    pub fn admin_listen(&self) -> Option<std::net::SocketAddr> {
+        self.listen.filter(|_| self.enabled)
+    }
+}
+
+/// TLS configuration for the HTTP API server
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct TlsConfig {
+    /// Enable TLS
+    #[serde(default)]
+    pub enabled: bool,
+
+    /// Email for Let's Encrypt ACME registration
+    pub acme_email: Option<String>,
+
+    /// Domain name for TLS certificate
+    pub domain: Option<String>,
+
+    /// Directory for storing ACME account and certificate cache
+    /// Defaults to {data_dir}/acme
+    pub cache_dir: Option<PathBuf>,
+
+    /// Use Let's Encrypt staging environment (for testing, avoids rate limits)
+    #[serde(default)]
+    pub staging: bool,
+
+    /// HTTPS port (default: 443)
+    #[serde(default = "default_https_port")]
+    pub https_port: u16,
+
+    /// HTTP port for redirects and ACME challenges (default: 80)
+    #[serde(default = "default_http_port")]
+    pub http_port: u16,
+
+    /// DNS provider for wildcard certificates (cloudflare, route53, etc.). Used
+    /// when generating a Caddyfile with per-process wildcards, and to issue
+    /// `wildcard_domains` (cloudflare, route53 or rfc2136)
+    pub dns_provider: Option<String>,
+
+    /// Seconds between TLS session ticket key rotations (default: 3600)
+    #[serde(default = "default_ticket_rotation_secs")]
+    pub ticket_rotation_secs: u64,
+
+    /// Retired ticket keys still accepted for resumption (default: 2)
+    #[serde(default = "default_ticket_keys_retained")]
+    pub ticket_keys_retained: usize,
+
+    /// Wildcard names (e.g. "*.apps.example.com") issued over DNS-01 through
+    /// `dns_provider`, so apps added under them are served without a
+    /// certificate of their own
+    #[serde(default)]
+    pub wildcard_domains: Vec<String>,
+
+    /// How `dns_provider` publishes the DNS-01 challenge records
+    #[serde(default)]
+    pub dns: Option<DnsChallengeConfig>,
+
+    /// How Let's Encrypt checks `domain` and the service domains: "tls-alpn-01"
+    /// on the HTTPS port (default) or "http-01" on the HTTP port, for hosts
+    /// whose HTTPS port sits behind something that terminates TLS. Let's
+    /// Encrypt connects on port 80, so `http_port` must be reachable there.
+    #[serde(default)]
+    pub challenge: AcmeChallenge,
+}
+
+/// ACME challenge for the certificate of the main and service domains
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub enum AcmeChallenge {
+    #[default]
+    #[serde(rename = "tls-alpn-01")]
+    TlsAlpn01,
+    #[serde(rename = "http-01")]
+    Http01,
+}
+
+/// A DNS API that can publish `_acme-challenge` TXT records
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DnsProvider {
+    Cloudflare,
+    Route53,
+    Rfc2136,
+}
+
+impl DnsProvider {
+    /// The provider a `dns_provider` value names, if tenement can publish to it
+    pub fn from_name(name: &str) -> Option<Self> {
+        match name {
+            "cloudflare" => Some(Self::Cloudflare),
+            "route53" => Some(Self::Route53),
+            "rfc2136" => Some(Self::Rfc2136),
+            _ => None,
+        }
+    }
+}
+
+/// DNS-01 challenges through `dns_provider` (`[settings.tls.dns]`)
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct DnsChallengeConfig {
+    /// Cloudflare zone id (looked up by name when unset) or Route53 hosted zone id
+    #[serde(default)]
+    pub zone_id: Option<String>,
+
+    /// RFC2136: the zone to update, e.g. "example.com"
+    #[serde(default)]
+    pub zone: Option<String>,
+
+    /// RFC2136: name server accepting dynamic updates, e.g. "10.0.0.53:53"
+    #[serde(default)]
+    pub server: Option<std::net::SocketAddr>,
+
+    /// RFC2136: name of the TSIG key (HMAC-SHA256) updates are signed with
+    #[serde(default)]
+    pub tsig_key_name: Option<String>,
+
+    /// Env var holding the secret: the Cloudflare API token (default: CF_API_TOKEN)
+    /// or the base64 TSIG key (default: TSIG_SECRET). Route53 reads the usual
+    /// AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN.
+    #[serde(default)]
+    pub credentials_env: Option<String>,
+
+    /// Seconds to wait after publishing before asking for validation (default: 30)
+    #[serde(default = "default_dns_propagation_secs")]
+    pub propagation_secs: u64,
+}
+
+fn default_dns_propagation_secs() -> u64 {
+    30
+}
+
+impl Default for DnsChallengeConfig {
+    fn default() -> Self {
+        Self {
+            zone_id: None,
+            zone: None,
+            server: None,
+            tsig_key_name: None,
+            credentials_env: None,
+            propagation_secs: default_dns_propagation_secs(),
+        }
+    }
+}
+
+impl TlsConfig {
+    /// The provider and settings `wildcard_domains` are issued through, when
+    /// `dns_provider` is one tenement can publish to
+    pub fn dns_challenge(&self) -> Option<(DnsProvider, DnsChallengeConfig)> {
+        let provider = DnsProvider::from_name(self.dns_provider.as_deref()?)?;
+        Some((provider, self.dns.clone().unwrap_or_default()))
+    }
+}
+
+fn default_https_port() -> u16 {
+    443
+}
+
+fn default_ticket_rotation_secs() -> u64 {
+    3600
+}
+
+fn default_ticket_keys_retained() -> usize {
+    2
+}
+
+fn default_http_port() -> u16 {
+    80
+}
+
+impl Default for TlsConfig {
+    fn default() -> Self {
+        Self {
+            enabled: false,
+            acme_email: None,
+            domain: None,
+            cache_dir: None,
+            staging: false,
+            https_port: default_https_port(),
+            http_port: default_http_port(),
+            dns_provider: None,
+            ticket_rotation_secs: default_ticket_rotation_secs(),
+            ticket_keys_retained: default_ticket_keys_retained(),
+            wildcard_domains: Vec::new(),
+            dns: None,
+            challenge: AcmeChallenge::default(),
+        }
+    }
+}
+
+impl Default for Settings {
+    fn default() -> Self {
+        Self {
+            data_dir: default_data_dir(),
+            health_check_interval: default_health_interval(),
+            max_restarts: default_max_restarts(),
+            restart_window: default_restart_window(),
+            backoff_base_ms: default_backoff_base_ms(),
+            backoff_max_ms: default_backoff_max_ms(),
+            backoff_reset_secs: default_backoff_reset_secs(),
+            tls: TlsConfig::default(),
+            fault_injection: false,
+            max_concurrency: None,
+            concurrency_queue_timeout_ms: default_concurrency_queue_timeout_ms(),
+            shutdown_timeout_secs: default_shutdown_timeout_secs(),
+            port_range: default_port_range(),
+            environment: None,
+            admin_tokens_file: None,
+            health_webhook: None,
+            drain_file: None,
+            metrics_listen: None,
+            admin_socket: None,
+            log_files: None,
+            log_sinks: Vec::new(),
+            ship_audit_log: false,
+            state_backend: None,
+            backup: None,
+            alerts: None,
+            access_log: None,
+            tracing: None,
+            dashboard: DashboardConfig::default(),
+            cluster: None,
+            discovery: None,
+            middleware: Vec::new(),
+        }
+    }
+}
+
+fn default_concurrency_queue_timeout_ms() -> u64 {
+    5000
+}
+
+fn default_shutdown_timeout_secs() -> u64 {
+    30
+}
+
+fn default_port_range() -> (u16, u16) {
+    (crate::port_allocator::PORT_MIN, crate::port_allocator::PORT_MAX)
+}
+
+/// Deep-merge `overlay` into `base`: tables merge key by key, anything else replaces
+pub(crate) fn merge_toml(base: &mut toml::Value, overlay: toml::Value) {
+    match (base, overlay) {
+        (toml::Value::Table(base), toml::Value::Table(overlay)) => {
+            for (key, value) in overlay {
+                match base.get_mut(&key) {
+                    Some(existing) => merge_toml(existing, value),
+                    None => {
+                        base.insert(key, value);
+                    }
+                }
+            }
+        }
+        (base, overlay) => *base = overlay,
+    }
+}
+
+/// The TOML a config is read from, with overlays, templates and variables
+/// resolved, and the environment it's for. The overlay file `<stem>.<env>.toml`
+/// beside `path` (when there's one) is merged over the `[overlay.<env>]` table.
+pub(crate) fn expand_toml(
+    content: &str,
+    environment: Option<&str>,
+    path: Option<&Path>,
+) -> Result<(toml::Value, Option<String>)> {
+    let mut root: toml::Value = toml::from_str(content)?;
+    let overlays = match root.as_table_mut() {
+        Some(table) => table.remove("overlay"),
+        None => None,
+    };
+    let environment = environment.map(str::to_string).or_else(|| {
+        root.get("settings")
+            .and_then(|s| s.get("environment"))
+            .and_then(|e| e.as_str())
+            .map(str::to_string)
+    });
+
+    if let Some(env) = &environment {
+        let overlay_file = path
+            .and_then(|path| Some((path, path.file_stem()?.to_string_lossy())))
+            .map(|(path, stem)| path.with_file_name(format!("{}.{}.toml", stem, env)))
+            .filter(|file| file.is_file());
+        match overlays.as_ref().and_then(|o| o.get(env)) {
+            Some(overlay) => merge_toml(&mut root, overlay.clone()),
+            None if overlays.is_some() && overlay_file.is_none() => {
+                tracing::warn!("No [overlay.{}] table; using the base config", env)
+            }
+            None => {}
+        }
+        if let Some(file) = overlay_file {
+            let overlay = std::fs::read_to_string(&file)
+                .map_err(anyhow::Error::from)
+                .and_then(|content| Ok(toml::from_str(&content)?))
+                .with_context(|| format!("Failed to read overlay file: {}", file.display()))?;
+            merge_toml(&mut root, overlay);
+        }
+    }
+
+    crate::templates::expand_templates(&mut root)?;
+    crate::templates::substitute_vars(&mut root)?;
+    Ok((root, environment))
+}
+
+fn default_data_dir() -> PathBuf {
+    PathBuf::from("./tenement-data")
+}
+
+/// Reject paths that start with a literal `~`. We don't expand tilde, and a
+/// literal `~/foo` directory is almost never what the user wants.
+fn reject_tilde(path: &Path, source: &str) -> Result<()> {
+    if path.to_string_lossy().starts_with('~') {
+        anyhow::bail!(
+            "{} path {:?} starts with '~'. Tilde is not expanded; \
+             pass an absolute path (e.g. $HOME/.local/share/tenement) instead.",
+            source,
+            path
+        );
+    }
+    Ok(())
+}
+
+fn default_health_interval() -> u64 {
+    10
+}
+
+fn default_max_restarts() -> u32 {
+    3
+}
+
+fn default_restart_window() -> u64 {
+    300
+}
+
+fn default_backoff_base_ms() -> u64 {
+    1000 // 1 second
+}
+
+fn default_backoff_max_ms() -> u64 {
+    60000 // 60 seconds
+}
+
+fn default_backoff_reset_secs() -> u64 {
+    600
+}
+
+/// A host->guest bind mount for OCI runtimes (Quark). Rendered by Tinyhost as
+/// `[[service.<name>.mounts]]`. Non-OCI runtimes ignore these.
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct MountConfig {
+    /// Host source path
+    pub source: PathBuf,
+    /// Guest destination path (absolute, inside the rootfs)
+    pub destination: PathBuf,
+    /// Mount read-only (default false)
+    #[serde(default)]
+    pub readonly: bool,
+}
+
+/// Per-service resource caps, e.g.
+/// `limits = { memory = "256MB", cpu = 0.5, nofile = 1024 }`
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct LimitsConfig {
+    /// Memory cap in MB; also accepts a size string ("256MB", "1G"). Enforced
+    /// with cgroups v2 where available; otherwise the monitor restarts instances
+    /// whose resident memory goes over it.
+    #[serde(default, deserialize_with = "deserialize_size_mb")]
+    pub memory: Option<u32>,
+
+    /// CPU cap in cores (0.5 = half a core), via cgroups v2 cpu.max
+    #[serde(default)]
+    pub cpu: Option<f64>,
+
+    /// Open file descriptor limit (RLIMIT_NOFILE)
+    #[serde(default)]
+    pub nofile: Option<u64>,
+}
+
+impl LimitsConfig {
+    /// Reject limits that would stop the service from running at all
+    pub fn validate(&self, name: &str) -> Result<()> {
+        if self.memory == Some(0) {
+            anyhow::bail!("Service '{}' has limits.memory of 0; omit it for no limit", name);
+        }
+        if self.cpu.is_some_and(|cpu| !cpu.is_finite() || cpu <= 0.0) {
+            anyhow::bail!("Service '{}' has limits.cpu that isn't a positive core count", name);
+        }
+        if self.nofile == Some(0) {
+            anyhow::bail!("Service '{}' has limits.nofile of 0", name);
+        }
+        Ok(())
+    }
+}
+
+/// What a service's processes may see and change of the host filesystem, e.g.
+/// `filesystem = { read_only = true, private_tmp = true, writable = ["/srv/uploads"] }`.
+/// Mount options need `isolation = "namespace"` (and root); `no_new_privileges`
+/// also works with `process`.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct FilesystemConfig {
+    /// Mount the host filesystem read-only, except the instance's data dir,
+    /// socket directory, `tmp_dir` and `writable` paths
+    #[serde(default)]
+    pub read_only: bool,
+
+    /// Give each instance an empty /tmp and /var/tmp of its own
+    #[serde(default)]
+    pub private_tmp: bool,
+
+    /// Absolute paths the instance may still write to under `read_only`, and
+    /// still see under `hide`
+    #[serde(default)]
+    pub writable: Vec<PathBuf>,
+
+    /// Absolute paths covered with an empty directory, such as other tenants'
+    /// data (`hide = ["/var/lib/tenement"]` still leaves the instance its own)
+    #[serde(default)]
+    pub hide: Vec<PathBuf>,
+
+    /// Set no_new_privs, so setuid binaries and file capabilities can't raise
+    /// the process's privileges
+    #[serde(default)]
+    pub no_new_privileges: bool,
+}
+
+impl FilesystemConfig {
+    /// Whether any option needs a mount namespace
+    pub fn needs_mounts(&self) -> bool {
+        self.read_only || self.private_tmp || !self.hide.is_empty()
+    }
+
+    pub fn validate(&self, name: &str, isolation: RuntimeType, rootfs: bool) -> Result<()> {
+        let paths = [("writable", &self.writable), ("hide", &self.hide)];
+        for (field, paths) in paths {
+            for path in paths {
+                if !path.is_absolute() || path == Path::new("/") {
+                    anyhow::bail!(
+                        "Service '{}' filesystem.{} path {:?} must be absolute and not /",
+                        name,
+                        field,
+                        path
+                    );
+                }
+            }
+        }
+        if !self.needs_mounts() {
+            if self.no_new_privileges
+                && !matches!(isolation, RuntimeType::Process | RuntimeType::Namespace)
+            {
+                anyhow::bail!(
+                    "Service '{}' sets filesystem.no_new_privileges, which needs process \
+                     or namespace isolation",
+                    name
+                );
+            }
+            return Ok(());
+        }
+        if isolation != RuntimeType::Namespace {
+            anyhow::bail!(
+                "Service '{}' sandboxes its filesystem, which needs isolation = \"namespace\"",
+                name
+            );
+        }
+        if rootfs {
+            anyhow::bail!(
+                "Service '{}' sets both rootfs and filesystem mount options; a rootfs \
+                 already gives it a filesystem of its own",
+                name
+            );
+        }
+        Ok(())
+    }
+}
+
+/// Where a service's processes may connect out to, e.g.
+/// `egress = { allow = ["api.stripe.com:443", "*.amazonaws.com"] }`. Each
+/// instance gets a network namespace with only loopback; HTTP and HTTPS go
+/// through a proxy in HTTP_PROXY that lets these through, and `forward` carries
+/// other TCP. `egress = {}` denies everything. Needs `isolation = "namespace"`
+/// (and root).
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct EgressConfig {
+    /// Destinations the proxy allows: "host:port", "host" for any port, or
+    /// "*.example.com" for its subdomains
+    #[serde(default)]
+    pub allow: Vec<String>,
+
+    /// Ports inside passed to a fixed destination, as "5432:db.internal:5432"
+    #[serde(default)]
+    pub forward: Vec<String>,
+}
+
+impl EgressConfig {
+    /// The proxy's policy and the forwards
+    pub fn parse(&self) -> Result<(crate::egress::Policy, Vec<crate::egress::Forward>)> {
+        let policy = crate::egress::Policy::parse(&self.allow)?;
+        let forwards = self
+            .forward
+            .iter()
+            .map(|entry| crate::egress::Forward::parse(entry))
+            .collect::<Result<Vec<_>>>()?;
+        let mut ports: Vec<u16> = forwards.iter().map(|forward| forward.listen).collect();
+        ports.sort_unstable();
+        if let Some(pair) = ports.windows(2).find(|pair| pair[0] == pair[1]) {
+            anyhow::bail!("egress.forward listens on port {} twice", pair[0]);
+        }
+        Ok((policy, forwards))
+    }
+
+    pub fn validate(&self, name: &str, isolation: RuntimeType) -> Result<()> {
+        self.parse()
+            .with_context(|| format!("Service '{}' has an invalid egress policy", name))?;
+        if isolation != RuntimeType::Namespace {
+            anyhow::bail!(
+                "Service '{}' restricts egress, which needs isolation = \"namespace\"",
+                name
+            );
+        }
+        Ok(())
+    }
+}
+
+/// Where a `protocol = "tcp"` or `"udp"` service is reachable, e.g.
+/// `listen = { port = 5432, max_connections = 200 }`. Connections, or a UDP
+/// client's datagrams, are forwarded to a running instance's PORT (or, for TCP,
+/// its socket); `stream_idle_timeout` closes ones that go quiet.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ListenConfig {
+    pub port: u16,
+
+    /// Address to listen on (default: 0.0.0.0)
+    #[serde(default = "default_listen_address")]
+    pub address: std::net::IpAddr,
+
+    /// TCP connections, or UDP clients, served at once; more are turned away
+    /// (default: 1000)
+    #[serde(default = "default_listen_max_connections")]
+    pub max_connections: usize,
+}
+
+fn default_listen_address() -> std::net::IpAddr {
+    std::net::IpAddr::from([0, 0, 0, 0])
+}
+
+fn default_listen_max_connections() -> usize {
+    1000
+}
+
+impl ListenConfig {
+    pub fn addr(&self) -> std::net::SocketAddr {
+        std::net::SocketAddr::new(self.address, self.port)
+    }
+
+    pub fn validate(
+        &self,
+        service: &str,
+        protocol: BackendProtocol,
+        isolation: RuntimeType,
+    ) -> Result<()> {
+        if self.port == 0 {
+            anyhow::bail!("Service '{}' listen.port must be set", service);
+        }
+        if self.max_connections == 0 {
+            anyhow::bail!(
+                "Service '{}' listen.max_connections must be at least 1",
+                service
+            );
+        }
+        if protocol == BackendProtocol::Udp && !isolation.uses_tcp_port() {
+            anyhow::bail!(
+                "Service '{}' speaks udp, which needs an instance PORT; {} isolation has none",
+                service,
+                isolation
+            );
+        }
+        Ok(())
+    }
+}
+
+/// A data directory a service keeps across restarts, deploys and releases, e.g.
+/// `volumes = { uploads = {}, db = { env = "DB_DIR", destination = "/data" } }`.
+/// Each lives at {data_dir}/.volumes/{service}/{name}, is shared by all the
+/// service's instances and is owned by its `user`.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct VolumeConfig {
+    /// Env var holding its path (default VOLUME_<NAME>, e.g. VOLUME_UPLOADS)
+    #[serde(default)]
+    pub env: Option<String>,
+
+    /// Guest path to mount it at for OCI runtimes (Quark); the env var then
+    /// holds this path instead
+    #[serde(default)]
+    pub destination: Option<PathBuf>,
+}
+
+impl VolumeConfig {
+    /// Env var the instance finds the volume in
+    pub fn env_var(&self, name: &str) -> String {
+        match &self.env {
+            Some(env) => env.clone(),
+            None => crate::volumes::env_var(name),
+        }
+    }
+
+    pub fn validate(&self, service: &str, name: &str) -> Result<()> {
+        let valid_name = !name.is_empty()
+            && name
+                .chars()
+                .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_');
+        if !valid_name {
+            anyhow::bail!(
+                "Service '{}' volume '{}' must be named with letters, digits, - and _",
+                service,
+                name
+            );
+        }
+        if let Some(env) = &self.env {
+            let valid_env = !env.is_empty()
+                && !env.starts_with(|c: char| c.is_ascii_digit())
+                && env.chars().all(|c| c.is_ascii_alphanumeric() || c == '_');
+            if !valid_env {
+                anyhow::bail!(
+                    "Service '{}' volume '{}' env {:?} isn't a valid env var name",
+                    service,
+                    name,
+                    env
+                );
+            }
+        }
+        if let Some(destination) = &self.destination {
+            if !destination.is_absolute() || destination == Path::new("/") {
+                anyhow::bail!(
+                    "Service '{}' volume '{}' destination {:?} must be absolute and not /",
+                    service,
+                    name,
+                    destination
+                );
+            }
+        }
+        Ok(())
+    }
+}
+
+/// Where an instance's Unix socket goes and who may use it, e.g.
+/// `unix_socket = { dir = "/run/api", mode = 0o660, group = "www-data" }`
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct UnixSocketConfig {
+    /// Directory for the socket, in place of the one in `socket` (supports {name}, {id}).
+    /// Tenement creates it if it's missing.
+    #[serde(default)]
+    pub dir: Option<String>,
+
+    /// File name, in place of the one in `socket` (supports {name}, {id})
+    #[serde(default)]
+    pub name: Option<String>,
+
+    /// Permission bits to give the socket once the app creates it (e.g. 0o660;
+    /// default: 0o660 for services with `user`, else as the app left it)
+    #[serde(default)]
+    pub mode: Option<u32>,
+
+    /// User to give the socket to (name or uid)
+    #[serde(default)]
+    pub owner: Option<String>,
+
+    /// Group to give the socket to (name or gid)
+    #[serde(default)]
+    pub group: Option<String>,
+}
+
+impl UnixSocketConfig {
+    pub fn validate(&self, name: &str) -> Result<()> {
+        if self.mode.is_some_and(|mode| mode > 0o777) {
+            anyhow::bail!("Service '{}' has unix_socket.mode above 0o777", name);
+        }
+        let fields = [
+            ("dir", &self.dir),
+            ("name", &self.name),
+            ("owner", &self.owner),
+            ("group", &self.group),
+        ];
+        for (field, value) in fields {
+            if value.as_deref().is_some_and(|v| v.trim().is_empty()) {
+                anyhow::bail!("Service '{}' has an empty unix_socket.{}", name, field);
+            }
+        }
+        if self.name.as_deref().is_some_and(|n| n.contains('/')) {
+            anyhow::bail!(
+                "Service '{}' has a path in unix_socket.name; set the directory with \
+                 unix_socket.dir",
+                name
+            );
+        }
+        Ok(())
+    }
+}
+
+/// Keep-alive connections the proxy holds to a service's instances on Unix
+/// sockets (`[service.x.connection_pool]`)
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ConnectionPoolConfig {
+    /// Idle connections kept open per instance (default: 32; 0 = a new
+    /// connection for every request)
+    #[serde(default = "default_pool_max_idle")]
+    pub max_idle: usize,
+
+    /// Seconds an idle connection is kept before it's closed (default: 90).
+    /// Also accepts "30s", "2m".
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub idle_timeout: Option<u64>,
+
+    /// Seconds a connection may be reused for, counted from when it was
+    /// opened; an older one is closed after its current request (default: no
+    /// limit). Also accepts "10m".
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub max_lifetime: Option<u64>,
+}
+
+impl Default for ConnectionPoolConfig {
+    fn default() -> Self {
+        Self {
+            max_idle: default_pool_max_idle(),
+            idle_timeout: None,
+            max_lifetime: None,
+        }
+    }
+}
+
+fn default_pool_max_idle() -> usize {
+    32
+}
+
+impl ConnectionPoolConfig {
+    pub fn validate(&self, name: &str) -> Result<()> {
+        if self.idle_timeout == Some(0) {
+            anyhow::bail!(
+                "Service '{}' connection_pool.idle_timeout must be at least 1s",
+                name
+            );
+        }
+        if self.max_lifetime == Some(0) {
+            anyhow::bail!(
+                "Service '{}' connection_pool.max_lifetime must be at least 1s",
+                name
+            );
+        }
+        Ok(())
+    }
+
+    /// How long an idle connection is kept (default: 90s)
+    pub fn idle_timeout(&self) -> std::time::Duration {
+        std::time::Duration::from_secs(self.idle_timeout.unwrap_or(90))
+    }
+
+    /// How long a connection may be reused for (None = no limit)
+    pub fn max_lifetime(&self) -> Option<std::time::Duration> {
+        self.max_lifetime.map(std::time::Duration::from_secs)
+    }
+}
+
+/// How `tenement deploy --replace` moves traffic to a new version
+/// (`[service.x.deploy]`)
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct DeployConfig {
+    #[serde(default)]
+    pub strategy: DeployStrategy,
+
+    /// Canary: percent of traffic the new version gets while it's watched (default: 10)
+    #[serde(default = "default_canary_percent")]
+    pub canary_percent: u8,
+
+    /// Canary: seconds to watch before promoting (default: 300); also accepts "5m"
+    #[serde(
+        default = "default_canary_duration",
+        deserialize_with = "deserialize_canary_duration"
+    )]
+    pub canary_duration: u64,
+
+    /// Canary: roll back once the share of the new version's proxied requests
+    /// ending in a 5xx goes over this (default: 0.05)
+    #[serde(default = "default_max_error_rate")]
+    pub max_error_rate: f64,
+
+    /// Canary: requests the new version must serve before its error rate is
+    /// judged (default: 20)
+    #[serde(default = "default_min_requests")]
+    pub min_requests: u64,
+}
+
+impl Default for DeployConfig {
+    fn default() -> Self {
+        Self {
+            strategy: DeployStrategy::default(),
+            canary_percent: default_canary_percent(),
+            canary_duration: default_canary_duration(),
+            max_error_rate: default_max_error_rate(),
+            min_requests: default_min_requests(),
+        }
+    }
+}
+
+impl DeployConfig {
+    pub fn validate(&self, name: &str) -> Result<()> {
+        if !(1..=99).contains(&self.canary_percent) {
+            anyhow::bail!("Service '{}' has deploy.canary_percent outside 1-99", name);
+        }
+        if !(0.0..=1.0).contains(&self.max_error_rate) {
+            anyhow::bail!("Service '{}' has deploy.max_error_rate outside 0.0-1.0", name);
+        }
+        Ok(())
+    }
+}
+
+/// How a replacement version takes over
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum DeployStrategy {
+    /// Swap all traffic once the new version is healthy, then drain and stop the old
+    #[default]
+    Replace,
+    /// Swap all traffic, but leave the old version running with none, so
+    /// `tenement route` can switch back instantly
+    BlueGreen,
+    /// Send the new version `canary_percent` of traffic for `canary_duration`,
+    /// then promote it, or roll back if its error rate is too high
+    Canary,
+}
+
+impl std::fmt::Display for DeployStrategy {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            DeployStrategy::Replace => write!(f, "replace"),
+            DeployStrategy::BlueGreen => write!(f, "blue-green"),
+            DeployStrategy::Canary => write!(f, "canary"),
+        }
+    }
+}
+
+/// The protocol the proxy speaks to a service's instances
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum BackendProtocol {
+    /// HTTP/1.1
+    #[default]
+    Http,
+    /// HTTP/2 over cleartext (prior knowledge)
+    H2c,
+    /// gRPC: h2c, with per-RPC metrics
+    Grpc,
+    /// Raw TCP, forwarded from the service's `listen` port instead of routed
+    Tcp,
+    /// Raw UDP datagrams, forwarded from the service's `listen` port
+    Udp,
+}
+
+impl BackendProtocol {
+    /// Whether requests go to the backend over HTTP/2
+    pub fn is_http2(&self) -> bool {
+        matches!(self, BackendProtocol::H2c | BackendProtocol::Grpc)
+    }
+
+    /// Whether the service is a raw TCP or UDP one, not served over HTTP
+    pub fn is_stream(&self) -> bool {
+        matches!(self, BackendProtocol::Tcp | BackendProtocol::Udp)
+    }
+}
+
+impl std::fmt::Display for BackendProtocol {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            BackendProtocol::Http => write!(f, "http"),
+            BackendProtocol::H2c => write!(f, "h2c"),
+            BackendProtocol::Grpc => write!(f, "grpc"),
+            BackendProtocol::Tcp => write!(f, "tcp"),
+            BackendProtocol::Udp => write!(f, "udp"),
+        }
+    }
+}
+
+fn default_canary_percent() -> u8 {
+    10
+}
+
+fn default_canary_duration() -> u64 {
+    300
+}
+
+fn default_max_error_rate() -> f64 {
+    0.05
+}
+
+fn default_min_requests() -> u64 {
+    20
+}
+
+fn deserialize_canary_duration<'de, D>(deserializer: D) -> std::result::Result<u64, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(deserialize_duration_secs(deserializer)?.unwrap_or_else(default_canary_duration))
+}
+
+/// Proxied request limit per client IP (`[service.x.rate_limit]`)
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct RateLimitConfig {
+    /// Sustained requests per second allowed from one client
+    pub requests_per_second: u32,
+
+    /// Requests a client may make at once after being quiet (default:
+    /// `requests_per_second`)
+    #[serde(default)]
+    pub burst: Option<u32>,
+}
+
+impl RateLimitConfig {
+    /// The bucket size: `burst`, or a second's worth of requests
+    pub fn burst(&self) -> u32 {
+        self.burst.unwrap_or(self.requests_per_second)
+    }
+}
+
+/// Retries of failed proxied requests (`[service.x.retry]`)
+///
+/// Only GET, HEAD, OPTIONS, PUT and DELETE requests without a body are
+/// retried, on another instance when there is one.
+#[derive(Debug, Clone, Copy, PartialEq, Serialize, Deserialize)]
+pub struct RetryConfig {
+    /// Retries after the first attempt (default: 1)
+    #[serde(default = "default_retry_attempts")]
+    pub attempts: u32,
+
+    /// Retries allowed as a percentage of requests, so retries can't pile
+    /// extra load onto a struggling service (default: 20)
+    #[serde(default = "default_retry_budget_percent")]
+    pub budget_percent: f64,
+}
+
+fn default_cache_max_age() -> u64 {
+    3600
+}
+
+fn default_retry_attempts() -> u32 {
+    1
+}
+
+fn default_retry_budget_percent() -> f64 {
+    20.0
+}
+
+/// Per-instance circuit breaker (`[service.x.circuit_breaker]`)
+///
+/// An instance that fails `failures` proxied requests in a row (502/503/504)
+/// is routed around for `cooldown`, then gets one trial request: success puts
+/// it back in rotation, failure ejects it again.
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CircuitBreakerConfig {
+    /// Consecutive failures that open the breaker (default: 5)
+    #[serde(default = "default_breaker_failures")]
+    pub failures: u32,
+
+    /// Seconds an ejected instance stays out of rotation (default: 30);
+    /// also accepts "30s", "1m"
+    #[serde(
+        default = "default_breaker_cooldown",
+        deserialize_with = "deserialize_breaker_cooldown"
+    )]
+    pub cooldown: u64,
+}
+
+fn default_breaker_failures() -> u32 {
+    5
+}
+
+fn default_breaker_cooldown() -> u64 {
+    30
+}
+
+fn deserialize_breaker_cooldown<'de, D>(deserializer: D) -> std::result::Result<u64, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(deserialize_duration_secs(deserializer)?.unwrap_or_else(default_breaker_cooldown))
+}
+
+/// Deploys by `git push` (`[service.x.git]`): a push to `branch` is checked out
+/// into a release directory, built, and deployed in place of the running version
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct GitConfig {
+    /// Branch that deploys (default: "main"); pushes to other branches are kept
+    /// in the repository but not deployed
+    #[serde(default = "default_git_branch")]
+    pub branch: String,
+
+    /// Shell command run in the checkout before deploying, e.g. "npm ci && npm run build"
+    #[serde(default)]
+    pub build: Option<String>,
+
+    /// Seconds the build may take (default: 600); also accepts "10m"
+    #[serde(
+        default = "default_build_timeout",
+        deserialize_with = "deserialize_build_timeout"
+    )]
+    pub build_timeout: u64,
+
+    /// Work out the build and start from each checkout (a Procfile,
+    /// nixpacks.toml or the language's usual files) where `build` or the
+    /// service's `command` are left out
+    #[serde(default)]
+    pub detect: bool,
+}
+
+impl Default for GitConfig {
+    fn default() -> Self {
+        Self {
+            branch: default_git_branch(),
+            build: None,
+            build_timeout: default_build_timeout(),
+            detect: false,
+        }
+    }
+}
+
+fn default_git_branch() -> String {
+    "main".to_string()
+}
+
+fn default_build_timeout() -> u64 {
+    600
+}
+
+/// Preview environments (`[service.x.preview]`): copies of the service started
+/// from a branch of its git repository or an artifact through `/api/previews`,
+/// reached at their own subdomain and torn down when their TTL runs out.
+/// Previews get no share of the service's traffic.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct PreviewConfig {
+    /// Domain previews answer under, e.g. "apps.example.com" for
+    /// `pr-123.apps.example.com` (default: `pr-123.{service}.{domain}`).
+    /// A `wildcard_domains` entry for it covers every preview over HTTPS.
+    #[serde(default)]
+    pub domain: Option<String>,
+
+    /// Seconds a preview lives when it isn't given a TTL (default: 86400); also accepts "24h"
+    #[serde(
+        default = "default_preview_ttl",
+        deserialize_with = "deserialize_preview_ttl"
+    )]
+    pub ttl: u64,
+
+    /// Most previews of the service at once (default: 10)
+    #[serde(default = "default_max_previews")]
+    pub max: usize,
+}
+
+impl Default for PreviewConfig {
+    fn default() -> Self {
+        Self {
+            domain: None,
+            ttl: default_preview_ttl(),
+            max: default_max_previews(),
+        }
+    }
+}
+
+fn default_preview_ttl() -> u64 {
+    24 * 60 * 60
+}
+
+fn default_max_previews() -> usize {
+    10
+}
+
+fn deserialize_preview_ttl<'de, D>(deserializer: D) -> std::result::Result<u64, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(deserialize_duration_secs(deserializer)?.unwrap_or_else(default_preview_ttl))
+}
+
+fn deserialize_build_timeout<'de, D>(deserializer: D) -> std::result::Result<u64, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(deserialize_duration_secs(deserializer)?.unwrap_or_else(default_build_timeout))
+}
+
+/// How a service's health is probed
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum HealthCheckType {
+    /// `GET` the service's `health` path; healthy on a 200
+    #[default]
+    Http,
+    /// Healthy if the instance's port (or socket) accepts a connection
+    Tcp,
+    /// Healthy if `command` exits 0
+    Exec,
+}
+
+/// A command run on a cron schedule (`[jobs.<name>]`)
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct JobConfig {
+    /// Cron expression ("*/15 * * * *") or macro ("@daily")
+    pub schedule: String,
+
+    /// Shell command, run with `sh -c`
+    pub command: String,
+
+    /// IANA timezone the schedule is read in (default UTC)
+    #[serde(default)]
+    pub timezone: Option<String>,
+
+    /// What to do when a run is due while the previous one is still going
+    #[serde(default)]
+    pub overlap: OverlapPolicy,
+
+    /// Kill a run after this many seconds; also accepts "90s", "10m", "1h"
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub timeout: Option<u64>,
+
+    /// Environment variables, on top of tenement's own
+    #[serde(default)]
+    pub env: HashMap<String, String>,
+
+    /// Working directory
+    #[serde(default)]
+    pub workdir: Option<PathBuf>,
+}
+
+impl JobConfig {
+    pub fn parsed_schedule(&self) -> Result<crate::schedule::Schedule> {
+        crate::schedule::Schedule::parse(&self.schedule)
+    }
+
+    pub fn tz(&self) -> Result<chrono_tz::Tz> {
+        match &self.timezone {
+            None => Ok(chrono_tz::UTC),
+            Some(name) => name
+                .parse()
+                .map_err(|_| anyhow::anyhow!("unknown timezone '{}'", name)),
+        }
+    }
+}
+
+/// A job's policy for a run that comes due while the last is still running
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum OverlapPolicy {
+    /// Don't start the new run
+    #[default]
+    Skip,
+    /// Run both
+    Allow,
+    /// Kill the running one, then start the new run
+    Replace,
+}
+
+/// What a service is: processes tenement runs, or files it serves itself
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ServiceKind {
+    /// Instances running `command`, proxied to
+    #[default]
+    Process,
+    /// The files in `root`, served by tenement with no process behind them
+    Static,
+}
+
+/// How the proxy picks among a service's live instances
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum LoadBalance {
+    /// Random, in proportion to instance weights
+    #[default]
+    Weighted,
+    /// Each in turn
+    RoundRobin,
+    /// Whichever has the fewest requests in flight
+    LeastConnections,
+}
+
+/// Per-service health check settings (`[service.<name>.health_check]`)
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct HealthThresholds {
+    /// Probe type: "http" (default), "tcp", or "exec"
+    #[serde(default, rename = "type")]
+    pub check_type: HealthCheckType,
+
+    /// Shell command for `type = "exec"`. Runs on the host with PORT or
+    /// SOCKET_PATH and TENEMENT_INSTANCE set.
+    #[serde(default)]
+    pub command: Option<String>,
+
+    /// Per-probe timeout in milliseconds (default: 5000)
+    #[serde(default = "default_health_timeout_ms")]
+    pub timeout_ms: u64,
+
+    /// Seconds between checks (default: settings.health_check_interval)
+    #[serde(default)]
+    pub interval: Option<u64>,
+
+    /// Consecutive failures before the instance is marked unhealthy and restarted
+    #[serde(default = "default_failure_threshold")]
+    pub failure_threshold: u32,
+
+    /// Consecutive successes needed to return to healthy after a failure
+    #[serde(default = "default_recovery_threshold")]
+    pub recovery_threshold: u32,
+
+    /// Seconds after launch before the first check, for apps that take a
+    /// while to boot; also accepts "30s", "2m"
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub initial_delay: Option<u64>,
+
+    /// Consecutive failures allowed before an instance first passes, in place
+    /// of `failure_threshold` (default: failure_threshold). Lets a slow
+    /// starter fail its startup checks for a while without being restarted.
+    #[serde(default)]
+    pub startup_failure_threshold: Option<u32>,
+}
+
+fn default_health_timeout_ms() -> u64 {
+    5000
+}
+
+fn default_failure_threshold() -> u32 {
+    3
+}
+
+fn default_recovery_threshold() -> u32 {
+    1
+}
+
+impl Default for HealthThresholds {
+    fn default() -> Self {
+        Self {
+            check_type: HealthCheckType::default(),
+            command: None,
+            timeout_ms: default_health_timeout_ms(),
+            interval: None,
+            failure_threshold: default_failure_threshold(),
+            recovery_threshold: default_recovery_threshold(),
+            initial_delay: None,
+            startup_failure_threshold: None,
+        }
+    }
+}
+
+impl HealthThresholds {
+    /// Failures allowed in a row, depending on whether the instance has passed
+    /// a check since it launched
+    pub fn failures_allowed(&self, passed: bool) -> u32 {
+        match self.startup_failure_threshold {
+            Some(threshold) if !passed => threshold,
+            _ => self.failure_threshold,
+        }
+    }
+}
+
+/// Readiness probe (`[service.<name>.readiness]`). Failing it takes an instance
+/// out of the proxy's rotation until it passes again; unlike `health_check`, it
+/// never restarts the instance.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ReadinessConfig {
+    /// Probe type: "http" (default), "tcp", or "exec"
+    #[serde(default, rename = "type")]
+    pub check_type: HealthCheckType,
+
+    /// Path to `GET` for `type = "http"` (default: the service's `health` path)
+    #[serde(default)]
+    pub path: Option<String>,
+
+    /// Shell command for `type = "exec"`, run like a `health_check` command
+    #[serde(default)]
+    pub command: Option<String>,
+
+    /// Per-probe timeout in milliseconds (default: 5000)
+    #[serde(default = "default_health_timeout_ms")]
+    pub timeout_ms: u64,
+
+    /// Seconds between checks (default: the health check interval)
+    #[serde(default)]
+    pub interval: Option<u64>,
+
+    /// Consecutive failures before the instance stops getting traffic
+    #[serde(default = "default_failure_threshold")]
+    pub failure_threshold: u32,
+
+    /// Consecutive successes before it gets traffic (again)
+    #[serde(default = "default_recovery_threshold")]
+    pub success_threshold: u32,
+}
+
+/// What the autoscaler tracks, per replica
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum AutoscaleMetric {
+    /// Proxied requests per second
+    Rps,
+    /// 95th percentile proxied request latency, in milliseconds
+    P95LatencyMs,
+    /// Requests in flight
+    Concurrency,
+    /// CPU use, in percent of one core
+    Cpu,
+}
+
+impl AutoscaleMetric {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            AutoscaleMetric::Rps => "rps",
+            AutoscaleMetric::P95LatencyMs => "p95_latency_ms",
+            AutoscaleMetric::Concurrency => "concurrency",
+            AutoscaleMetric::Cpu => "cpu",
+        }
+    }
+}
+
+/// Replica autoscaling (`[service.<name>.autoscale]`). Adds replicas while
+/// `metric` runs above `target` and removes them while it runs below, keeping
+/// between `min` and `max`. `replicas` is where the service starts.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct AutoscaleConfig {
+    /// Fewest replicas to run (default: 1)
+    #[serde(default = "default_replicas")]
+    pub min: u32,
+
+    /// Most replicas to run
+    pub max: u32,
+
+    /// Signal to scale on
+    pub metric: AutoscaleMetric,
+
+    /// Value of `metric` to hold each replica at
+    pub target: f64,
+
+    /// Seconds of observations each decision looks at (default: 30);
+    /// also accepts "30s", "1m"
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub interval: Option<u64>,
+
+    /// Seconds after a change before scaling up again (default: 60)
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub scale_up_cooldown: Option<u64>,
+
+    /// Seconds after a change before scaling down again (default: 300)
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub scale_down_cooldown: Option<u64>,
+}
+
+impl AutoscaleConfig {
+    pub fn interval(&self) -> std::time::Duration {
+        std::time::Duration::from_secs(self.interval.unwrap_or(30))
+    }
+
+    /// How long to wait after the last change before scaling up (or down)
+    pub fn cooldown(&self, up: bool) -> std::time::Duration {
+        let secs = match up {
+            true => self.scale_up_cooldown.unwrap_or(60),
+            false => self.scale_down_cooldown.unwrap_or(300),
+        };
+        std::time::Duration::from_secs(secs)
+    }
+
+    /// Replicas to run given `current` and the observed per-replica `value`:
+    /// enough to bring it back to `target`, within min..max. Readings within
+    /// 10% of the target leave the count alone.
+    pub fn desired_replicas(&self, current: u32, value: f64) -> u32 {
+        let ratio = value / self.target;
+        if (ratio - 1.0).abs() <= 0.1 {
+            return current.clamp(self.min, self.max);
+        }
+        let desired = (current as f64 * ratio).ceil().min(self.max as f64);
+        (desired as u32).clamp(self.min, self.max)
+    }
+}
+
+/// An encoding the proxy can compress responses with
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+pub enum Encoding {
+    #[serde(rename = "gzip")]
+    Gzip,
+    #[serde(rename = "br", alias = "brotli")]
+    Br,
+}
+
+/// Compression of everything a service answers (`[service.<name>.compression]`).
+/// Responses are only encoded when the client accepts one of `encodings` and
+/// they aren't already encoded, tiny, or images.
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CompressionConfig {
+    /// Encodings to offer (default: ["br", "gzip"])
+    #[serde(default = "default_encodings")]
+    pub encodings: Vec<Encoding>,
+
+    /// 1 (fastest) to 9 (smallest) (default: each encoder's own)
+    #[serde(default)]
+    pub level: Option<u32>,
+}
+
+fn default_encodings() -> Vec<Encoding> {
+    vec![Encoding::Br, Encoding::Gzip]
+}
+
+/// Cache of a service's GET responses (`[service.<name>.cache]`). Only
+/// responses the app lets shared caches keep are stored; see `response_cache`.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CacheConfig {
+    /// Total size of cached responses, in MB or as "64MB" (default: 16)
+    #[serde(default, deserialize_with = "deserialize_size_mb")]
+    pub max_size: Option<u32>,
+
+    /// Largest response body kept, in MB or as "2MB" (default: 1)
+    #[serde(default, deserialize_with = "deserialize_size_mb")]
+    pub max_entry_size: Option<u32>,
+
+    /// Keep bodies in files under this directory instead of in memory
+    #[serde(default)]
+    pub dir: Option<PathBuf>,
+
+    /// Seconds to keep responses that don't set max-age, or as "5m"
+    /// (default: such responses aren't cached)
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub default_ttl: Option<u64>,
+}
+
+impl CacheConfig {
+    pub fn max_bytes(&self) -> usize {
+        self.max_size.unwrap_or(16) as usize * 1024 * 1024
+    }
+
+    pub fn max_entry_bytes(&self) -> usize {
+        self.max_entry_size.unwrap_or(1) as usize * 1024 * 1024
+    }
+}
+
+/// Service template definition (also known as ProcessConfig for backwards compatibility)
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct ProcessConfig {
+    /// "process" (default) runs `command`; "static" serves the files in `root`
+    #[serde(default, rename = "type")]
+    pub kind: ServiceKind,
+
+    /// Directory a `type = "static"` service serves
+    #[serde(default)]
+    pub root: Option<PathBuf>,
+
+    /// Static services: answer paths that match no file with `root`/index.html,
+    /// for single-page apps that route in the browser
+    #[serde(default)]
+    pub spa: bool,
+
+    /// Static services: Cache-Control max-age, in seconds, for files other than
+    /// HTML, which browsers always revalidate (default: 3600)
+    #[serde(default = "default_cache_max_age")]
+    pub cache_max_age: u64,
+
+    /// Isolation level: "namespace" (default), "process", "container", "firecracker", or "qemu".
+    /// Also accepted as `runtime`.
+    #[serde(default, alias = "runtime")]
+    pub isolation: RuntimeType,
+
+    /// Command to run (supports {name}, {id}, {data_dir} interpolation). Container
+    /// runtimes may leave it out to run the image's own entrypoint.
+    #[serde(default)]
+    pub command: String,
+
+    /// Arguments (optional)
+    #[serde(default)]
+    pub args: Vec<String>,
+
+    /// Launch through this shell as a login shell (`<shell> -lc 'exec <command>'`)
+    /// so profile scripts run first. Unset = exec the command directly.
+    #[serde(default)]
+    pub shell: Option<String>,
+
+    /// Unix socket path pattern (supports {name}, {id})
+    /// Note: For process/namespace/sandbox runtimes, tenement automatically allocates
+    /// TCP ports from the range 30000-40000 and sets the PORT environment variable.
+    /// This socket field is primarily used for vsock communication with VMs.
+    /// Precedence: the proxy uses the TCP port whenever the runtime has one, and the
+    /// socket only for VM runtimes; it's never both for one instance.
+    #[serde(default = "default_socket")]
+    pub socket: String,
+
+    /// Socket directory, file name, mode and ownership (`[service.x.unix_socket]`)
+    #[serde(default)]
+    pub unix_socket: UnixSocketConfig,
+
+    /// Keep-alive connections the proxy keeps to instances on Unix sockets
+    /// (`[service.x.connection_pool]`)
+    #[serde(default)]
+    pub connection_pool: ConnectionPoolConfig,
+
+    /// Health check endpoint (e.g., "/health")
+    #[serde(default)]
+    pub health: Option<String>,
+
+    /// Health check interval and failure/recovery thresholds for this service
+    #[serde(default)]
+    pub health_check: HealthThresholds,
+
+    /// Readiness probe gating traffic, separate from the health check (None =
+    /// instances get traffic as long as they're not unhealthy)
+    #[serde(default)]
+    pub readiness: Option<ReadinessConfig>,
+
+    /// Environment variables (supports {name}, {id}, {data_dir}, {socket})
+    #[serde(default)]
+    pub env: HashMap<String, String>,
+
+    /// Dotenv-style files read in order before `env`; later files override earlier
+    /// ones and `env` overrides them all. Values may use `${VAR}` / `${VAR:-default}`.
+    #[serde(default)]
+    pub env_files: Vec<PathBuf>,
+
+    /// Working directory
+    #[serde(default)]
+    pub workdir: Option<PathBuf>,
+
+    /// Unix user to run as (name or uid). Needs tenement to run as root; the
+    /// instance's data dir, tmp dir and workdir are chowned to this user.
+    #[serde(default)]
+    pub user: Option<String>,
+
+    /// Unix group to run as (name or gid; default: the user's primary group)
+    #[serde(default)]
+    pub group: Option<String>,
+
+    /// Host->guest bind mounts for OCI runtimes (Quark). Other runtimes ignore.
+    #[serde(default)]
+    pub mounts: Vec<MountConfig>,
+
+    /// OCI image reference. Required for container runtimes that run via
+    /// docker/containerd (`isolation = "container"`, `"quark"`); ignored otherwise.
+    #[serde(default)]
+    pub image: Option<String>,
+
+    /// Restart policy: "always", "on-failure", "never"
+    #[serde(default = "default_restart_policy")]
+    pub restart: String,
+
+    /// Idle timeout in seconds before auto-stopping (0 = never stop)
+    /// When set, instance will be stopped after this many seconds of inactivity.
+    /// Health checks do NOT count as activity - only real requests do.
+    /// Also accepts a duration string ("90s", "10m", "1h"). A stopped instance
+    /// is woken by the next request for it.
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub idle_timeout: Option<u64>,
+
+    /// Startup timeout in seconds (default: 10)
+    /// How long to wait for a process to pass its first health check.
+    /// Increase for commands that compile before serving (e.g. `go run`: 30-60s).
+    #[serde(default = "default_startup_timeout")]
+    pub startup_timeout: u64,
+
+    /// Services that must be up before an instance of this one starts: a list of
+    /// names (each waited on until healthy), or a table of
+    /// `name = { condition = "started", timeout = "1m", id = "main" }`.
+    /// A dependency that isn't running is spawned first.
+    #[serde(default, deserialize_with = "deserialize_depends_on")]
+    pub depends_on: BTreeMap<String, Dependency>,
+
+    /// Named group this service belongs to, e.g. `stack = "acme-prod"`, for
+    /// bulk operations like `ten restart --stack acme-prod`. Letters, digits,
+    /// '-' and '_'.
+    #[serde(default)]
+    pub stack: Option<String>,
+
+    /// Services this one connects to over tenement's private sockets, e.g.
+    /// `["db-proxy", "cache"]`. Each socket's path is in
+    /// `TENEMENT_UPSTREAM_{SERVICE}`, and only declared users may connect to it.
+    #[serde(default)]
+    pub uses: Vec<String>,
+
+    /// Proxy middleware this service's requests go through, after the global
+    /// `settings.middleware`, by registered name
+    #[serde(default)]
+    pub middleware: Vec<String>,
+
+    /// Request timeout in seconds (default: 30)
+    /// Maximum time a proxied request can take before being terminated.
+    #[serde(default = "default_request_timeout")]
+    pub request_timeout: u64,
+
+    /// Seconds a WebSocket (or other upgraded connection) or SSE stream may go
+    /// without traffic before the proxy closes it. Unset: long-lived connections
+    /// stay open for as long as both ends keep them. `request_timeout` only
+    /// bounds the wait for response headers, so it never cuts these off.
+    #[serde(default)]
+    pub stream_idle_timeout: Option<u64>,
+
+    /// What the app speaks on its socket (default: http). `h2c` and `grpc` make
+    /// the proxy talk HTTP/2 without TLS to it, so trailers and streaming RPCs
+    /// pass through; `grpc` also records per-RPC metrics. `tcp` and `udp`
+    /// services aren't routed: they're forwarded to from their `listen` port.
+    #[serde(default)]
+    pub protocol: BackendProtocol,
+
+    /// Public port of a `tcp` or `udp` service (`[service.x.listen]`)
+    #[serde(default)]
+    pub listen: Option<ListenConfig>,
+
+    // --- Resource limits (cgroups v2 on Linux) ---
+    /// Memory limit in MB (0 = unlimited)
+    /// Applied via cgroups v2 on Linux for process/namespace/sandbox isolation.
+    /// For Firecracker/QEMU VMs, this sets the VM memory.
+    #[serde(default)]
+    pub memory_limit_mb: Option<u32>,
+
+    /// CPU weight (1-10000, default 100)
+    /// Higher values get more CPU time relative to other services.
+    /// Applied via cgroups v2 cpu.weight on Linux.
+    /// 100 = normal priority, 1 = minimum, 10000 = maximum
+    #[serde(default)]
+    pub cpu_shares: Option<u32>,
+
+    /// Memory, CPU and open-file caps (`[service.x.limits]`)
+    #[serde(default)]
+    pub limits: LimitsConfig,
+
+    /// Read-only root, private /tmp, hidden paths (`[service.x.filesystem]`)
+    #[serde(default)]
+    pub filesystem: FilesystemConfig,
+
+    /// Hosts and ports it may connect out to (`[service.x.egress]`; unset =
+    /// anywhere)
+    #[serde(default)]
+    pub egress: Option<EgressConfig>,
+
+    /// Data directories kept across deploys (`[service.x.volumes]`)
+    #[serde(default)]
+    pub volumes: BTreeMap<String, VolumeConfig>,
+
+    /// Strategy for replacing a running version (`[service.x.deploy]`)
+    #[serde(default)]
+    pub deploy: DeployConfig,
+
+    /// Deploy by `git push` to the service's repository (`[service.x.git]`)
+    #[serde(default)]
+    pub git: Option<GitConfig>,
+
+    /// Short-lived copies of the service started from a branch or artifact
+    #[serde(default)]
+    pub preview: Option<PreviewConfig>,
+
+    // --- Storage limits ---
+    /// Storage quota in MB (None = unlimited)
+    /// Soft limit: exceeding quota triggers warnings and metrics but doesn't kill the process.
+    #[serde(default)]
+    pub storage_quota_mb: Option<u32>,
+
+    /// Keep data directory on stop (default: true)
+    /// If true, data is preserved for the next spawn (databases, files, etc.)
+    /// If false, the instance's data directory is deleted when stopped.
+    #[serde(default = "default_storage_persist")]
+    pub storage_persist: bool,
+
+    /// Give each instance its own scratch directory, exposed as TMPDIR (default: false).
+    /// It's emptied on every spawn and removed when the instance stops.
+    #[serde(default)]
+    pub tmp_dir: bool,
+
+    // --- Secrets ---
+    /// Secrets exposed as env vars: a table of ENV_NAME -> host file path, or a list
+    /// of names held in the encrypted store (`tenement secrets set`).
+    /// Also written to `{data_dir}/secrets.env` (path in TENEMENT_SECRETS_FILE).
+    #[serde(default, deserialize_with = "deserialize_secrets")]
+    pub secrets: HashMap<String, SecretSource>,
+
+    /// Env vars the app needs; spawning fails naming any that aren't set (or are empty)
+    /// by `env`, `env_files`, `secrets`, or (process/namespace isolation) tenement's
+    /// own environment.
+    #[serde(default)]
+    pub required_env: Vec<String>,
+
+    /// Extra env var names (or `*` globs) whose values are masked wherever the env is
+    /// printed. `*_TOKEN`, `*_SECRET`, `*PASSWORD*`-style keys and `secrets` always are.
+    #[serde(default)]
+    pub redact_env: Vec<String>,
+
+    /// Hosts served by this service, e.g. `["api.example.com"]`. Each becomes a
+    /// `[routing.host_default]` entry, so more specific path routes still win.
+    #[serde(default)]
+    pub domains: Vec<String>,
+
+    /// Signal that asks an instance to exit when it's stopped (default: "SIGTERM"),
+    /// e.g. "SIGQUIT", "INT", "USR1" or a number
+    #[serde(default)]
+    pub stop_signal: Option<String>,
+
+    /// Seconds an instance gets to exit after `stop_signal` before it's sent
+    /// SIGKILL (default: 10). Also accepts "30s", "2m". Shutdown still ends by
+    /// `settings.shutdown_timeout_secs`.
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub stop_timeout: Option<u64>,
+
+    /// Send `stop_signal` to the instance's whole process group (default), or
+    /// only to its main process, for supervisors that stop their own workers
+    #[serde(default = "default_stop_process_group")]
+    pub stop_process_group: bool,
+
+    /// Shell command run on the host after each instance's process ends, for any
+    /// reason (exit, crash, stop, force-kill). Gets the instance's env plus
+    /// TENEMENT_INSTANCE and TENEMENT_STOP_REASON ("exited" or "stopped").
+    #[serde(default)]
+    pub post_stop: Option<String>,
+
+    /// Seconds the post_stop hook may run before it's killed (default: 10)
+    #[serde(default = "default_post_stop_timeout")]
+    pub post_stop_timeout: u64,
+
+    /// Commands run at points of the service's lifecycle: `build`, `pre_start`,
+    /// `post_deploy` and `pre_stop` (`[service.x.hooks]`)
+    #[serde(default)]
+    pub hooks: HooksConfig,
+
+    /// Processes to run per instance (default: 1). With N > 1, instance `prod`
+    /// runs as `prod-0`..`prod-{N-1}`, each with its own socket/port and
+    /// TENEMENT_REPLICA set to its index; requests for `prod` go to a live one.
+    #[serde(default = "default_replicas")]
+    pub replicas: u32,
+
+    /// Scale `replicas` with load instead of keeping it fixed
+    #[serde(default)]
+    pub autoscale: Option<AutoscaleConfig>,
+
+    /// Client IP allow/deny lists and Basic auth, checked by the proxy before
+    /// any request reaches an instance
+    #[serde(default)]
+    pub access: Option<AccessConfig>,
+
+    /// Compress responses to clients that accept it
+    #[serde(default)]
+    pub compression: Option<CompressionConfig>,
+
+    /// Answer repeated GET requests from a cache of the app's responses
+    #[serde(default)]
+    pub cache: Option<CacheConfig>,
+
+    /// How requests are spread over instances and replicas (default: "weighted")
+    #[serde(default)]
+    pub load_balance: LoadBalance,
+
+    /// Ramp a newly ready instance from a trickle up to its full weight over
+    /// this many seconds, instead of giving it its whole share at once
+    /// (weighted load balancing only). Also accepts "30s", "2m".
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub slow_start: Option<u64>,
+
+    /// Signal sent when a secret changes (e.g. "SIGHUP"), for apps that can
+    /// re-read secrets.env. Unset = health-gated restart on secret change.
+    #[serde(default)]
+    pub reload_signal: Option<String>,
+
+    /// Delay/abort a percentage of proxied requests (resilience testing).
+    /// Only applied when `settings.fault_injection = true`.
+    #[serde(default)]
+    pub fault: Option<FaultConfig>,
+
+    /// Relative share of `settings.max_concurrency` under contention (default: 1)
+    #[serde(default = "default_concurrency_weight")]
+    pub concurrency_weight: u32,
+
+    /// Cap on this service's in-flight proxied requests (default: unlimited).
+    /// Requests over it queue for a slot, or get a 503 once the queue is full
+    /// or they've waited `queue_timeout_ms`.
+    #[serde(default)]
+    pub max_concurrency: Option<usize>,
+
+    /// Requests that may queue under `max_concurrency` (default: no bound;
+    /// 0 turns requests away as soon as every slot is taken)
+    #[serde(default)]
+    pub max_queue: Option<usize>,
+
+    /// How long a request queues under `max_concurrency` before a 503, in
+    /// milliseconds (default: `settings.concurrency_queue_timeout_ms`)
+    #[serde(default)]
+    pub queue_timeout_ms: Option<u64>,
+
+    /// Idle connections to pre-open to each instance once it's ready (TCP backends only)
+    #[serde(default)]
+    pub warm_connections: u32,
+
+    /// Max log lines per second kept from this service's instances (default: unlimited).
+    /// Excess lines are dropped and reported in a periodic summary line.
+    #[serde(default)]
+    pub log_rate_limit: Option<u32>,
+
+    /// Per-client-IP request limit enforced by the proxy (default: unlimited).
+    /// Requests over it get 429 Too Many Requests with `Retry-After`.
+    #[serde(default)]
+    pub rate_limit: Option<RateLimitConfig>,
+
+    /// Retry idempotent requests that fail with 502/503/504 (default: no retries)
+    #[serde(default)]
+    pub retry: Option<RetryConfig>,
+
+    /// Take an instance out of rotation after consecutive failures (default: off)
+    #[serde(default)]
+    pub circuit_breaker: Option<CircuitBreakerConfig>,
+
+    /// HTML page served with a 503 while the service is in maintenance mode
+    /// (`tenement maintenance on`); default: a built-in page
+    #[serde(default)]
+    pub maintenance_page: Option<PathBuf>,
+
+    /// Log this service's proxied requests here instead of `[settings.access_log]`
+    #[serde(default)]
+    pub access_log: Option<AccessLogConfig>,
+
+    /// Also forward this service's output here, besides `[[settings.log_sinks]]`
+    #[serde(default)]
+    pub log_sinks: Vec<LogSinkConfig>,
+
+    // --- Firecracker/QEMU-specific fields ---
+    /// Path to kernel image (required for firecracker runtime)
+    #[serde(default)]
+    pub kernel: Option<PathBuf>,
+
+    /// Path to root filesystem image (required for firecracker runtime)
+    #[serde(default)]
+    pub rootfs: Option<PathBuf>,
+
+    /// Memory in MB for VM (firecracker/qemu only, default 256)
+    #[serde(default = "default_memory_mb")]
+    pub memory_mb: u32,
+
+    /// Number of vCPUs (firecracker/qemu only)
+    #[serde(default = "default_vcpus")]
+    pub vcpus: u32,
+
+    /// VSOCK port for guest communication (firecracker only)
+    #[serde(default = "default_vsock_port")]
+    pub vsock_port: u32,
+}
+
+fn default_memory_mb() -> u32 {
+    256
+}
+
+fn default_vcpus() -> u32 {
+    1
+}
+
+fn default_vsock_port() -> u32 {
+    5000
+}
+
+fn default_socket() -> String {
+    "/tmp/tenement/{name}-{id}.sock".to_string()
+}
+
+fn default_restart_policy() -> String {
+    "on-failure".to_string()
+}
+
+fn default_storage_persist() -> bool {
+    true
+}
+
+fn default_concurrency_weight() -> u32 {
+    1
+}
+
+fn default_startup_timeout() -> u64 {
+    10
+}
+
+fn default_post_stop_timeout() -> u64 {
+    10
+}
+
+fn default_stop_process_group() -> bool {
+    true
+}
+
+/// Lifecycle hooks (`[service.x.hooks]`). Each is a shell command, or a table
+/// `{ command = "...", timeout = "5m", on_failure = "continue" }`.
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct HooksConfig {
+    /// Before a deploy starts the new version; failing aborts the deploy
+    #[serde(default, deserialize_with = "deserialize_hook")]
+    pub build: Option<HookConfig>,
+
+    /// Before each instance's process starts; failing stops the start
+    #[serde(default, deserialize_with = "deserialize_hook")]
+    pub pre_start: Option<HookConfig>,
+
+    /// Once a deploy's new version is healthy and serving; failures are logged
+    #[serde(default, deserialize_with = "deserialize_hook")]
+    pub post_deploy: Option<HookConfig>,
+
+    /// Before tenement stops an instance; failures are logged and it stops anyway
+    #[serde(default, deserialize_with = "deserialize_hook")]
+    pub pre_stop: Option<HookConfig>,
+}
+
+impl HooksConfig {
+    pub fn get(&self, kind: HookKind) -> Option<&HookConfig> {
+        match kind {
+            HookKind::Build => self.build.as_ref(),
+            HookKind::PreStart => self.pre_start.as_ref(),
+            HookKind::PostDeploy => self.post_deploy.as_ref(),
+            HookKind::PreStop => self.pre_stop.as_ref(),
+        }
+    }
+}
+
+/// One lifecycle hook
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct HookConfig {
+    /// Shell command, run with `sh -c`
+    pub command: String,
+
+    /// Seconds it may run before it's killed and counts as failed (default: 600
+    /// for build, 60 for the others); also accepts "5m"
+    #[serde(default, deserialize_with = "deserialize_duration_secs")]
+    pub timeout: Option<u64>,
+
+    /// "abort" or "continue" (default: abort for build and pre_start, continue
+    /// for post_deploy and pre_stop). post_deploy can only continue.
+    #[serde(default)]
+    pub on_failure: Option<HookFailure>,
+}
+
+/// What a failed hook does to the step it's part of
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum HookFailure {
+    /// Fail the deploy, start or stop
+    Abort,
+    /// Log the failure and go on
+    Continue,
+}
+
+/// A hook as written: a command, or a table
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum RawHook {
+    Command(String),
+    Full(HookConfig),
+}
+
+fn deserialize_hook<'de, D>(deserializer: D) -> std::result::Result<Option<HookConfig>, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(Some(match RawHook::deserialize(deserializer)? {
+        RawHook::Command(command) => HookConfig {
+            command,
+            timeout: None,
+            on_failure: None,
+        },
+        RawHook::Full(hook) => hook,
+    }))
+}
+
+fn default_replicas() -> u32 {
+    1
+}
+
+fn default_request_timeout() -> u64 {
+    30
+}
+
+/// Routing configuration
+#[derive(Debug, Clone, Serialize, Deserialize, Default)]
+pub struct RoutingConfig {
+    /// Default process to route to
+    pub default: Option<String>,
+
+    /// Route by subdomain: "*.example.com" -> "process-name"
+    #[serde(default)]
+    pub subdomain: HashMap<String, String>,
+
+    /// Route by path prefix: "/api" -> "process-name"
+    #[serde(default)]
+    pub path: HashMap<String, String>,
+
+    /// Ordered static-file and proxied routes (`[[routing.route]]`).
+    /// Longest prefix wins; identical prefixes resolve to the first declared.
+    #[serde(default)]
+    pub route: Vec<RouteConfig>,
+
+    /// Per-host catch-all: "docs.example.com" -> "process-name".
+    /// Used for that host when no more specific path route matches.
+    #[serde(default)]
+    pub host_default: HashMap<String, String>,
+}
+
+/// A path-prefix route to either a static directory or a service
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct RouteConfig {
+    /// Path prefix, matched on `/` segment boundaries
+    pub prefix: String,
+
+    /// Only match requests for this host (default: any host)
+    #[serde(default)]
+    pub host: Option<String>,
+
+    /// Service to proxy to
+    #[serde(default)]
+    pub service: Option<String>,
+
+    /// Directory to serve files from
+    #[serde(default, rename = "static")]
+    pub static_dir: Option<PathBuf>,
+
+    /// Request header rules applied before proxying (service routes only)
+    #[serde(default)]
+    pub request_headers: HeaderRules,
+
+    /// Response header rules applied before answering the client
+    #[serde(default)]
+    pub response_headers: HeaderRules,
+
+    /// Forward the path with `prefix` removed, so `/api/users` reaches the
+    /// service as `/users` (and `/api` as `/`). Service routes only.
+    #[serde(default)]
+    pub strip_prefix: bool,
+
+    /// Replace `prefix` with this path before forwarding: with `prefix = "/api"`
+    /// and `rewrite = "/v2"`, `/api/users` reaches the service as `/v2/users`.
+    /// Service routes only.
+    #[serde(default)]
+    pub rewrite: Option<String>,
+
+    /// Response time target in milliseconds. Slower requests are logged and
+    /// counted in `tenement_requests_slow_total`; they are not cut off.
+    #[serde(default)]
+    pub slo_target_ms: Option<u64>,
+
+    /// Gzip responses whose client accepts it: 1 (fastest) to 9 (smallest), or
+    /// "default". Unset = responses pass through uncompressed.
+    #[serde(default)]
+    pub gzip_level: Option<GzipLevel>,
+
+    /// Client IP allow/deny lists and Basic auth for this route
+    #[serde(default)]
+    pub access: Option<AccessConfig>,
+
+    /// Also send a share of this route's requests to another service, whose
+    /// responses are discarded (service routes only)
+    #[serde(default)]
+    pub mirror: Option<MirrorConfig>,
+
+    /// Delay/abort a percentage of this route's requests, on top of its
+    /// service's own faults. Only applied while fault injection is on.
+    #[serde(default)]
+    pub fault: Option<FaultConfig>,
+}
+
+/// Traffic shadowing for a route, e.g. `mirror = { service = "api-v2", percent = 10 }`.
+/// Copies go out after the route's header rules and rewrite, with
+/// `X-Tenement-Mirror: 1`. Requests with a body over 1 MB, or none of known
+/// length, and upgrades (WebSockets) aren't copied.
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct MirrorConfig {
+    /// Service the copies go to
+    pub service: String,
+
+    /// Share of requests copied, 0-100 (default 100)
+    #[serde(default = "default_mirror_percent")]
+    pub percent: f64,
+}
+
+fn default_mirror_percent() -> f64 {
+    100.0
+}
+
+/// Gzip compression level for a route
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(try_from = "RawGzipLevel", into = "RawGzipLevel")]
+pub enum GzipLevel {
+    /// The encoder's own default (6)
+    Default,
+    /// 1-9
+    Level(u32),
+}
+
+/// `gzip_level` as written: a number or a name
+#[derive(Serialize, Deserialize)]
+#[serde(untagged)]
+enum RawGzipLevel {
+    Level(i64),
+    Name(String),
+}
+
+impl TryFrom<RawGzipLevel> for GzipLevel {
+    type Error = String;
+
+    fn try_from(raw: RawGzipLevel) -> std::result::Result<Self, Self::Error> {
+        match raw {
+            RawGzipLevel::Level(n @ 1..=9) => Ok(Self::Level(n as u32)),
+            RawGzipLevel::Name(name) if name.eq_ignore_ascii_case("default") => Ok(Self::Default),
+            RawGzipLevel::Level(n) => Err(format!(
+                "gzip_level must be 1-9 or \"default\", got {}",
+                n
+            )),
+            RawGzipLevel::Name(name) => Err(format!(
+                "gzip_level must be 1-9 or \"default\", got {:?}",
+                name
+            )),
+        }
+    }
+}
+
+impl From<GzipLevel> for RawGzipLevel {
+    fn from(level: GzipLevel) -> Self {
+        match level {
+            GzipLevel::Default => Self::Name("default".to_string()),
+            GzipLevel::Level(n) => Self::Level(n as i64),
+        }
+    }
+}
+
+/// Where a secret's value comes from
+#[derive(Debug, Clone, PartialEq, Serialize)]
+#[serde(untagged)]
+pub enum SecretSource {
+    /// Contents of a host file
+    File(PathBuf),
+    /// The encrypted secret store, under the same name
+    Store,
+}
+
+/// Secrets as written: a table of files, or a list of store names
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum RawSecrets {
+    Files(HashMap<String, PathBuf>),
+    Stored(Vec<String>),
+}
+
+fn deserialize_secrets<'de, D>(
+    deserializer: D,
+) -> std::result::Result<HashMap<String, SecretSource>, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(match RawSecrets::deserialize(deserializer)? {
+        RawSecrets::Files(files) => files
+            .into_iter()
+            .map(|(name, path)| (name, SecretSource::File(path)))
+            .collect(),
+        RawSecrets::Stored(names) => names
+            .into_iter()
+            .map(|name| (name, SecretSource::Store))
+            .collect(),
+    })
+}
+
+/// How an instance waits for a service it `depends_on`
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Dependency {
+    /// What counts as up (default: "healthy")
+    #[serde(default)]
+    pub condition: DependencyCondition,
+
+    /// Seconds to wait before the spawn fails (default: 30); also accepts "2m"
+    #[serde(
+        default = "default_dependency_timeout",
+        deserialize_with = "deserialize_dependency_timeout"
+    )]
+    pub timeout: u64,
+
+    /// Instance to wait for (default: the one with the same id)
+    #[serde(default)]
+    pub id: Option<String>,
+}
+
+impl Default for Dependency {
+    fn default() -> Self {
+        Self {
+            condition: DependencyCondition::default(),
+            timeout: default_dependency_timeout(),
+            id: None,
+        }
+    }
+}
+
+/// When a dependency counts as up
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum DependencyCondition {
+    /// Its process is running
+    Started,
+    /// It passes its health check (same as started if it has no health probe)
+    #[default]
+    Healthy,
+}
+
+impl std::fmt::Display for DependencyCondition {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            DependencyCondition::Started => write!(f, "started"),
+            DependencyCondition::Healthy => write!(f, "healthy"),
+        }
+    }
+}
+
+fn default_dependency_timeout() -> u64 {
+    30
+}
+
+fn deserialize_dependency_timeout<'de, D>(deserializer: D) -> std::result::Result<u64, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(deserialize_duration_secs(deserializer)?.unwrap_or_else(default_dependency_timeout))
+}
+
+/// `depends_on` as written: a list of names, or a table of edges
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum RawDependsOn {
+    Names(Vec<String>),
+    Edges(BTreeMap<String, Dependency>),
+}
+
+fn deserialize_depends_on<'de, D>(
+    deserializer: D,
+) -> std::result::Result<BTreeMap<String, Dependency>, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    Ok(match RawDependsOn::deserialize(deserializer)? {
+        RawDependsOn::Names(names) => names
+            .into_iter()
+            .map(|name| (name, Dependency::default()))
+            .collect(),
+        RawDependsOn::Edges(edges) => edges,
+    })
+}
+
+/// Add `name` to `order` after what it depends on, if it's in `stack`.
+/// Dependencies outside the stack are followed (but not added), so members
+/// that depend on each other through them still roll out in order.
+fn stack_order(
+    config: &Config,
+    name: &str,
+    stack: &str,
+    seen: &mut std::collections::HashSet<String>,
+    order: &mut Vec<String>,
+) {
+    if !seen.insert(name.to_string()) {
+        return;
+    }
+    let Some(service) = config.get_service(name) else {
+        return;
+    };
+    for dependency in service.depends_on.keys() {
+        stack_order(config, dependency, stack, seen, order);
+    }
+    if service.stack.as_deref() == Some(stack) {
+        order.push(name.to_string());
+    }
+}
+
+/// A `depends_on` cycle, as the services around it with the first repeated at
+/// the end (`["a", "b", "a"]`)
+fn find_dependency_cycle(services: &HashMap<String, ProcessConfig>) -> Option<Vec<String>> {
+    fn visit<'a>(
+        name: &'a str,
+        services: &'a HashMap<String, ProcessConfig>,
+        path: &mut Vec<&'a str>,
+        visited: &mut std::collections::HashSet<&'a str>,
+    ) -> Option<Vec<String>> {
+        if let Some(start) = path.iter().position(|n| *n == name) {
+            let mut cycle: Vec<String> = path[start..].iter().map(|n| n.to_string()).collect();
+            cycle.push(name.to_string());
+            return Some(cycle);
+        }
+        if !visited.insert(name) {
+            return None;
+        }
+        path.push(name);
+        for dependency in services.get(name).into_iter().flat_map(|s| s.depends_on.keys()) {
+            if let Some(cycle) = visit(dependency, services, path, visited) {
+                return Some(cycle);
+            }
+        }
+        path.pop();
+        None
+    }
+
+    let mut names: Vec<&String> = services.keys().collect();
+    names.sort();
+    let mut visited = std::collections::HashSet::new();
+    names
+        .into_iter()
+        .find_map(|name| visit(name, services, &mut Vec::new(), &mut visited))
+}
+
+/// A duration as written: seconds, or a string like "10m"
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum RawDuration {
+    Secs(u64),
+    Text(String),
+}
+
+fn deserialize_duration_secs<'de, D>(deserializer: D) -> std::result::Result<Option<u64>, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    match Option::<RawDuration>::deserialize(deserializer)? {
+        None => Ok(None),
+        Some(RawDuration::Secs(secs)) => Ok(Some(secs)),
+        Some(RawDuration::Text(text)) => parse_duration_secs(&text)
+            .map(Some)
+            .map_err(serde::de::Error::custom),
+    }
+}
+
+/// A size as written: MB, or a string like "256MB"
+#[derive(Deserialize)]
+#[serde(untagged)]
+enum RawSize {
+    Mb(u32),
+    Text(String),
+}
+
+fn deserialize_size_mb<'de, D>(deserializer: D) -> std::result::Result<Option<u32>, D::Error>
+where
+    D: serde::Deserializer<'de>,
+{
+    match Option::<RawSize>::deserialize(deserializer)? {
+        None => Ok(None),
+        Some(RawSize::Mb(mb)) => Ok(Some(mb)),
+        Some(RawSize::Text(text)) => parse_size_mb(&text)
+            .map(Some)
+            .map_err(serde::de::Error::custom),
+    }
+}
+
+/// Parse "512", "256M", "256MB", "1G", or "1GiB" into MB (units are powers of
+/// 1024). Sizes that aren't whole MB round up.
+pub fn parse_size_mb(text: &str) -> std::result::Result<u32, String> {
+    let invalid = || format!("invalid size {:?} (use e.g. \"256MB\", \"1G\")", text);
+    let trimmed = text.trim();
+    let split = trimmed
+        .find(|c: char| !c.is_ascii_digit())
+        .unwrap_or(trimmed.len());
+    let (digits, unit) = trimmed.split_at(split);
+    let kb_per_unit: u64 = match unit.trim().to_ascii_uppercase().as_str() {
+        "K" | "KB" | "KIB" => 1,
+        "" | "M" | "MB" | "MIB" => 1024,
+        "G" | "GB" | "GIB" => 1024 * 1024,
+        _ => return Err(invalid()),
+    };
+    digits
+        .parse::<u64>()
+        .ok()
+        .and_then(|n| n.checked_mul(kb_per_unit))
+        .and_then(|kb| u32::try_from(kb.div_ceil(1024)).ok())
+        .ok_or_else(invalid)
+}
+
+/// Parse "30", "45s", "10m", "2h", or "1d" into seconds
+pub fn parse_duration_secs(text: &str) -> std::result::Result<u64, String> {
+    let invalid = || format!("invalid duration {:?} (use e.g. \"90s\", \"10m\", \"1h\")", text);
+    let trimmed = text.trim();
+    let split = trimmed
+        .find(|c: char| !c.is_ascii_digit())
+        .unwrap_or(trimmed.len());
+    let (digits, unit) = trimmed.split_at(split);
+    let multiplier = match unit.trim() {
+        "" | "s" => 1,
+        "m" => 60,
+        "h" => 60 * 60,
+        "d" => 24 * 60 * 60,
+        _ => return Err(invalid()),
+    };
+    digits
+        .parse::<u64>()
+        .ok()
+        .and_then(|n| n.checked_mul(multiplier))
+        .ok_or_else(invalid)
+}
+
+impl Config {
+    /// Load config from tenement.toml in current directory or parents
+    pub fn load() -> Result<Self> {
+        let config_path = Self::find_config_file()?;
+        Self::load_from_path(&config_path)
+    }
+
+    /// Load config and optionally replace `settings.data_dir`.
+    ///
+    /// Used by the CLI to apply the `--data-dir` flag (or `TENEMENT_DATA_DIR`).
+    /// Precedence: override arg > value in tenement.toml > built-in default.
+    pub fn load_with_override(data_dir_override: Option<PathBuf>) -> Result<Self> {
+        let mut config = Self::load()?;
+        config.apply_data_dir_override(data_dir_override)?;
+        Ok(config)
+    }
+
+    /// Apply a `--data-dir` override on top of an already-loaded config.
+    ///
+    /// Both the override and any toml-supplied data_dir must not start with `~`
+    /// (no tilde expansion is performed; reject early so users see a clear error
+    /// instead of a literal `~` directory being created).
+    pub fn apply_data_dir_override(&mut self, data_dir_override: Option<PathBuf>) -> Result<()> {
+        reject_tilde(&self.settings.data_dir, "data_dir in tenement.toml")?;
+        if let Some(dir) = data_dir_override {
+            reject_tilde(&dir, "--data-dir")?;
+            self.settings.data_dir = dir;
+        }
+        Ok(())
+    }
+
+    /// Load config from a specific path
+    ///
+    /// Load config from a specific path.
+    /// Both are merged into the `service` field.
+    pub fn load_from_path(path: &Path) -> Result<Self> {
+        let content = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read config file: {}", path.display()))?;
+
+        let environment = std::env::var("TENEMENT_ENV").ok().filter(|e| !e.is_empty());
+        Self::from_source(&content, environment.as_deref(), path)
+            .with_context(|| format!("Failed to parse config file: {}", path.display()))
+    }
+
+    /// Parse `content` as the config file at `path`: as `from_str_for_env`,
+    /// with the environment's overlay file beside it (`tenement.prod.toml`
+    /// for `tenement.toml`) merged over its `[overlay.<env>]` table
+    pub fn from_source(content: &str, environment: Option<&str>, path: &Path) -> Result<Self> {
+        let mut config = Self::parse(content, environment, Some(path))?;
+        config.source = Some(path.to_path_buf());
+        Ok(config)
+    }
+
+    /// Load the file this config came from again (for SIGHUP / `tenement reload`)
+    pub fn reread(&self) -> Result<Self> {
+        let path = self
+            .source
+            .as_deref()
+            .context("Config wasn't loaded from a file, so there is nothing to reload")?;
+        Self::load_from_path(path)
+    }
+
+    /// Parse config from a TOML string
+    #[allow(clippy::should_implement_trait)]
+    pub fn from_str(content: &str) -> Result<Self> {
+        Self::from_str_for_env(content, None)
+    }
+
+    /// Parse config from a TOML string, merging the `[overlay.<env>]` table for
+    /// `environment` (or `settings.environment` when None) over the base config,
+    /// then expanding `[template]`s and `[vars]` (see [`crate::templates`]).
+    pub fn from_str_for_env(content: &str, environment: Option<&str>) -> Result<Self> {
+        Self::parse(content, environment, None)
+    }
+
+    fn parse(content: &str, environment: Option<&str>, path: Option<&Path>) -> Result<Self> {
+        let (root, environment) = expand_toml(content, environment, path)?;
+        let mut config: Config = root.try_into()?;
+        config.settings.environment = environment;
+
+        // Validate instances reference defined services
+        for service_name in config.instances.keys() {
+            if !config.service.contains_key(service_name) {
+                anyhow::bail!(
+                    "Instance references undefined service '{}'. \
+                    Define it in [service.{}] first.",
+                    service_name,
+                    service_name
+                );
+            }
+        }
+
+        // Validate path routes have exactly one target
+        for route in &config.routing.route {
+            match (&route.service, &route.static_dir) {
+                (Some(_), Some(_)) => anyhow::bail!(
+                    "Route '{}' sets both `service` and `static`; pick one.",
+                    route.prefix
+                ),
+                (None, None) => anyhow::bail!(
+                    "Route '{}' needs either `service` or `static`.",
+                    route.prefix
+                ),
+                (Some(service), None) if !config.service.contains_key(service) => {
+                    anyhow::bail!(
+                        "Route '{}' references undefined service '{}'. \
+                        Define it in [service.{}] first.",
+                        route.prefix,
+                        service,
+                        service
+                    );
+                }
+                _ => {}
+            }
+            route.request_headers.validate(&route.prefix)?;
+            route.response_headers.validate_response(&route.prefix)?;
+            if let Some(access) = &route.access {
+                access.validate(&format!("Route '{}'", route.prefix))?;
+            }
+            if route.slo_target_ms == Some(0) {
+                anyhow::bail!(
+                    "Route '{}' slo_target_ms must be at least 1 (omit it to disable)",
+                    route.prefix
+                );
+            }
+            if route.static_dir.is_some() && !route.request_headers.is_empty() {
+                tracing::warn!(
+                    "Route '{}' sets request_headers on a static route; they are ignored",
+                    route.prefix
+                );
+            }
+            if let Some(rewrite) = &route.rewrite {
+                if route.strip_prefix {
+                    anyhow::bail!(
+                        "Route '{}' sets both `strip_prefix` and `rewrite`; \
+                         `rewrite = \"/\"` strips the prefix",
+                        route.prefix
+                    );
+                }
+                if !rewrite.starts_with('/') {
+                    anyhow::bail!(
+                        "Route '{}' rewrite must be a path starting with '/', got {:?}",
+                        route.prefix,
+                        rewrite
+                    );
+                }
+            }
+            if route.static_dir.is_some() && (route.strip_prefix || route.rewrite.is_some()) {
+                tracing::warn!(
+                    "Route '{}' rewrites the path of a static route; files are always \
+                     looked up below the prefix",
+                    route.prefix
+                );
+            }
+            if let Some(mirror) = &route.mirror {
+                if route.static_dir.is_some() {
+                    anyhow::bail!(
+                        "Route '{}' mirrors a static route; only service routes can mirror",
+                        route.prefix
+                    );
+                }
+                if !config.service.contains_key(&mirror.service) {
+                    anyhow::bail!(
+                        "Route '{}' mirrors to undefined service '{}'",
+                        route.prefix,
+                        mirror.service
+                    );
+                }
+                if route.service.as_ref() == Some(&mirror.service) {
+                    anyhow::bail!(
+                        "Route '{}' mirrors to the service it already routes to",
+                        route.prefix
+                    );
+                }
+                if !(0.0..=100.0).contains(&mirror.percent) {
+                    anyhow::bail!(
+                        "Route '{}' mirror percent must be 0-100, got {}",
+                        route.prefix,
+                        mirror.percent
+                    );
+                }
+            }
+            if let Some(fault) = &route.fault {
+                fault.validate(&format!("Route '{}'", route.prefix))?;
+                if fault.kill_interval_secs > 0 {
+                    anyhow::bail!(
+                        "Route '{}' sets fault.kill_interval_secs; instances are killed per \
+                         service, in `[service.<name>.fault]`",
+                        route.prefix
+                    );
+                }
+            }
+        }
+
+        let (port_min, port_max) = config.settings.port_range;
+        if port_min == 0 || port_min > port_max {
+            anyhow::bail!(
+                "[settings] port_range must be [lowest, highest] with 1 <= lowest <= highest, \
+                 got [{}, {}]",
+                port_min,
+                port_max
+            );
+        }
+
+        if config.settings.tls.ticket_rotation_secs == 0 {
+            anyhow::bail!("[settings.tls] ticket_rotation_secs must be at least 1");
+        }
+
+        let tls = &config.settings.tls;
+        for wildcard in &tls.wildcard_domains {
+            let parent = wildcard.strip_prefix("*.").unwrap_or_default();
+            if !parent.contains('.') || parent.contains('*') {
+                anyhow::bail!(
+                    "[settings.tls] wildcard_domains entries look like \"*.apps.example.com\", \
+                     got {:?}",
+                    wildcard
+                );
+            }
+        }
+        // Without wildcards, dns_provider may be only for a generated Caddyfile
+        let wildcards = !tls.wildcard_domains.is_empty();
+        match tls.dns_challenge().filter(|_| wildcards) {
+            None if wildcards => {
+                anyhow::bail!(
+                    "[settings.tls] wildcard_domains need dns_provider = \"cloudflare\", \
+                     \"route53\" or \"rfc2136\""
+                );
+            }
+            Some((DnsProvider::Route53, dns)) if dns.zone_id.is_none() => {
+                anyhow::bail!("[settings.tls.dns] route53 needs zone_id (the hosted zone id)");
+            }
+            Some((DnsProvider::Rfc2136, dns)) => {
+                if dns.zone.is_none() || dns.server.is_none() || dns.tsig_key_name.is_none() {
+                    anyhow::bail!(
+                        "[settings.tls.dns] rfc2136 needs zone, server and tsig_key_name"
+                    );
+                }
+            }
+            _ => {}
+        }
+
+        if let Some(webhook) = &config.settings.health_webhook {
+            if !webhook.url.starts_with("http://") && !webhook.url.starts_with("https://") {
+                anyhow::bail!(
+                    "[settings.health_webhook] url must start with http:// or https://, got {:?}",
+                    webhook.url
+                );
+            }
+            if webhook.timeout_ms == 0 {
+                anyhow::bail!("[settings.health_webhook] timeout_ms must be at least 1");
+            }
+        }
+
+        if let Some(log_files) = &config.settings.log_files {
+            if log_files.max_size_mb == 0 {
+                anyhow::bail!("[settings.log_files] max_size_mb must be at least 1");
+            }
+            if log_files.max_age == Some(0) {
+                anyhow::bail!("[settings.log_files] max_age must be at least 1 second");
+            }
+        }
+        if let Some(access_log) = &config.settings.access_log {
+            access_log.validate("[settings.access_log]")?;
+        }
+        validate_log_sinks(&config.settings.log_sinks, "[[settings.log_sinks]]")?;
+        if config.settings.ship_audit_log && config.settings.log_sinks.is_empty() {
+            tracing::warn!("settings.ship_audit_log is on but there are no [[settings.log_sinks]]");
+        }
+        if let Some(state_backend) = &config.settings.state_backend {
+            state_backend.validate()?;
+        }
+        if let Some(backup) = &config.settings.backup {
+            backup.validate()?;
+        }
+        if let Some(alerts) = &config.settings.alerts {
+            alerts.validate()?;
+        }
+
+        if let Some(export) = &config.settings.tracing {
+            if !export.endpoint.starts_with("http://") && !export.endpoint.starts_with("https://") {
+                anyhow::bail!(
+                    "[settings.tracing] endpoint must start with http:// or https://, got {:?}",
+                    export.endpoint
+                );
+            }
+            if !(0.0..=1.0).contains(&export.sample_ratio) {
+                anyhow::bail!("[settings.tracing] sample_ratio must be between 0 and 1");
+            }
+        }
+
+        if let Some(cluster) = &config.settings.cluster {
+            cluster.validate(&config.settings.tls)?;
+        }
+
+        if let Some(discovery) = &config.settings.discovery {
+            let label =
+                |l: &str| !l.is_empty() && l.chars().all(|c| c.is_ascii_alphanumeric() || c == '-');
+            if !discovery.domain.split('.').all(label) {
+                anyhow::bail!(
+                    "[settings.discovery] domain {:?} is not a domain name",
+                    discovery.domain
+                );
+            }
+        }
+
+        // Validate per-host catch-all routes
+        for (host, service) in &config.routing.host_default {
+            if host.trim().is_empty() {
+                anyhow::bail!("[routing.host_default] has an empty host name");
+            }
+            if !config.service.contains_key(service) {
+                anyhow::bail!(
+                    "Default route for host '{}' references undefined service '{}'. \
+                    Define it in [service.{}] first.",
+                    host,
+                    service,
+                    service
+                );
+            }
+        }
+
+        // TCP and UDP services are only reachable on their own port
+        let routed = config
+            .routing
+            .route
+            .iter()
+            .flat_map(|route| {
+                [
+                    route.service.as_ref(),
+                    route.mirror.as_ref().map(|m| &m.service),
+                ]
+            })
+            .flatten()
+            .chain(config.routing.path.values())
+            .chain(config.routing.host_default.values());
+        for service in routed {
+            if let Some(svc) = config.service.get(service) {
+                if svc.protocol.is_stream() {
+                    anyhow::bail!(
+                        "[routing] sends HTTP requests to '{}', a {} service; it's only \
+                         reachable on its `listen` port",
+                        service,
+                        svc.protocol
+                    );
+                }
+            }
+        }
+        let mut listening: HashMap<(bool, std::net::SocketAddr), &String> = HashMap::new();
+        let mut names: Vec<&String> = config.service.keys().collect();
+        names.sort();
+        for name in names {
+            let service = &config.service[name];
+            let Some(listen) = &service.listen else {
+                continue;
+            };
+            let key = (service.protocol == BackendProtocol::Udp, listen.addr());
+            if let Some(other) = listening.insert(key, name) {
+                anyhow::bail!(
+                    "Services '{}' and '{}' both listen on {} {}",
+                    other,
+                    name,
+                    service.protocol,
+                    listen.addr()
+                );
+            }
+        }
+
+        // Per-service domains are host-wide catch-alls; a host belongs to one service
+        let mut names: Vec<&String> = config.service.keys().collect();
+        names.sort();
+        for name in names {
+            for domain in &config.service[name].domains {
+                if domain.trim().is_empty() {
+                    anyhow::bail!("Service '{}' has an empty entry in domains", name);
+                }
+                let taken = config
+                    .routing
+                    .host_default
+                    .iter()
+                    .find(|(host, _)| host.eq_ignore_ascii_case(domain.trim()));
+                match taken {
+                    Some((_, owner)) if owner == name => {}
+                    Some((host, owner)) => anyhow::bail!(
+                        "Domain '{}' of service '{}' is already routed to service '{}'",
+                        host,
+                        name,
+                        owner
+                    ),
+                    None => {
+                        let host = domain.trim().to_string();
+                        config.routing.host_default.insert(host, name.clone());
+                    }
+                }
+            }
+        }
+
+        // Validate health thresholds
+        for (name, service) in &config.service {
+            let thresholds = &service.health_check;
+            if thresholds.failure_threshold == 0 || thresholds.recovery_threshold == 0 {
+                anyhow::bail!(
+                    "Service '{}' health_check thresholds must be at least 1",
+                    name
+                );
+            }
+            if thresholds.interval == Some(0) {
+                anyhow::bail!("Service '{}' health_check.interval must be at least 1", name);
+            }
+            if thresholds.startup_failure_threshold == Some(0) {
+                anyhow::bail!(
+                    "Service '{}' health_check.startup_failure_threshold must be at least 1",
+                    name
+                );
+            }
+            if thresholds.timeout_ms == 0 {
+                anyhow::bail!("Service '{}' health_check.timeout_ms must be at least 1", name);
+            }
+            let has_command = thresholds.command.as_deref().is_some_and(|c| !c.trim().is_empty());
+            match thresholds.check_type {
+                HealthCheckType::Exec if !has_command => anyhow::bail!(
+                    "Service '{}' health_check type \"exec\" needs a command",
+                    name
+                ),
+                HealthCheckType::Http | HealthCheckType::Tcp if thresholds.command.is_some() => {
+                    anyhow::bail!(
+                        "Service '{}' health_check.command is only used with type = \"exec\"",
+                        name
+                    )
+                }
+                _ => {}
+            }
+        }
+
+        // Validate readiness probes
+        for (name, service) in &config.service {
+            let Some(readiness) = &service.readiness else {
+                continue;
+            };
+            if readiness.failure_threshold == 0 || readiness.success_threshold == 0 {
+                anyhow::bail!("Service '{}' readiness thresholds must be at least 1", name);
+            }
+            if readiness.interval == Some(0) {
+                anyhow::bail!("Service '{}' readiness.interval must be at least 1", name);
+            }
+            if readiness.timeout_ms == 0 {
+                anyhow::bail!("Service '{}' readiness.timeout_ms must be at least 1", name);
+            }
+            let has_command = readiness
+                .command
+                .as_deref()
+                .is_some_and(|c| !c.trim().is_empty());
+            match readiness.check_type {
+                HealthCheckType::Http if readiness.path.is_none() && service.health.is_none() => {
+                    anyhow::bail!(
+                        "Service '{}' readiness type \"http\" needs a path or health",
+                        name
+                    )
+                }
+                HealthCheckType::Exec if !has_command => {
+                    anyhow::bail!("Service '{}' readiness type \"exec\" needs a command", name)
+                }
+                HealthCheckType::Http | HealthCheckType::Tcp if readiness.command.is_some() => {
+                    anyhow::bail!(
+                        "Service '{}' readiness.command is only used with type = \"exec\"",
+                        name
+                    )
+                }
+                _ => {}
+            }
+        }
+
+        // Validate concurrency limits
+        if config.settings.max_concurrency == Some(0) {
+            anyhow::bail!("settings.max_concurrency must be at least 1 (omit it for unlimited)");
+        }
+        for (name, service) in &config.service {
+            if service.concurrency_weight == 0 {
+                anyhow::bail!("Service '{}' concurrency_weight must be at least 1", name);
+            }
+            if service.max_concurrency == Some(0) {
+                anyhow::bail!(
+                    "Service '{}' max_concurrency must be at least 1 (omit it for unlimited)",
+                    name
+                );
+            }
+            if service.max_concurrency.is_none()
+                && (service.max_queue.is_some() || service.queue_timeout_ms.is_some())
+            {
+                anyhow::bail!(
+                    "Service '{}' sets max_queue or queue_timeout_ms without max_concurrency",
+                    name
+                );
+            }
+            if let Some(rate_limit) = &service.rate_limit {
+                if rate_limit.requests_per_second == 0 || rate_limit.burst == Some(0) {
+                    anyhow::bail!(
+                        "Service '{}' rate_limit needs requests_per_second and burst of at \
+                         least 1 (omit rate_limit for unlimited)",
+                        name
+                    );
+                }
+            }
+            if let Some(retry) = &service.retry {
+                if !(0.0..=100.0).contains(&retry.budget_percent) {
+                    anyhow::bail!(
+                        "Service '{}' retry.budget_percent must be between 0 and 100",
+                        name
+                    );
+                }
+            }
+            if let Some(breaker) = &service.circuit_breaker {
+                if breaker.failures == 0 || breaker.cooldown == 0 {
+                    anyhow::bail!(
+                        "Service '{}' circuit_breaker needs failures and cooldown of at least 1 \
+                         (omit circuit_breaker to turn it off)",
+                        name
+                    );
+                }
+            }
+            if let Some(access_log) = &service.access_log {
+                access_log.validate(&format!("Service '{}' access_log", name))?;
+            }
+            if service.log_rate_limit == Some(0) {
+                anyhow::bail!(
+                    "Service '{}' log_rate_limit must be at least 1 (omit it for unlimited)",
+                    name
+                );
+            }
+            if service.redact_env.iter().any(|p| p.trim().is_empty()) {
+                anyhow::bail!("Service '{}' has an empty redact_env entry", name);
+            }
+            if service.post_stop.as_deref().is_some_and(|c| c.trim().is_empty()) {
+                anyhow::bail!("Service '{}' sets an empty `post_stop` command", name);
+            }
+            if service.post_stop_timeout == 0 {
+                anyhow::bail!("Service '{}' post_stop_timeout must be at least 1", name);
+            }
+            #[cfg(unix)]
+            if let Some(signal) = &service.stop_signal {
+                crate::runtime::parse_stop_signal(signal)
+                    .with_context(|| format!("Service '{}' has an invalid stop_signal", name))?;
+            }
+            for kind in HookKind::ALL {
+                let Some(hook) = service.hooks.get(kind) else {
+                    continue;
+                };
+                if hook.command.trim().is_empty() {
+                    anyhow::bail!("Service '{}' sets an empty `hooks.{}` command", name, kind);
+                }
+                if hook.timeout == Some(0) {
+                    anyhow::bail!(
+                        "Service '{}' hooks.{} timeout must be at least 1",
+                        name,
+                        kind
+                    );
+                }
+                if kind == HookKind::PostDeploy && hook.on_failure == Some(HookFailure::Abort) {
+                    anyhow::bail!(
+                        "Service '{}' hooks.post_deploy can't abort: the new version is \
+                         already serving when it runs",
+                        name
+                    );
+                }
+            }
+            if service.replicas == 0 {
+                anyhow::bail!("Service '{}' replicas must be at least 1", name);
+            }
+            if let Some(autoscale) = &service.autoscale {
+                if autoscale.min == 0 || autoscale.max <= autoscale.min {
+                    anyhow::bail!(
+                        "Service '{}' autoscale needs min of at least 1 and max above min",
+                        name
+                    );
+                }
+                if !(autoscale.target > 0.0 && autoscale.target.is_finite()) {
+                    anyhow::bail!("Service '{}' autoscale.target must be above 0", name);
+                }
+                if autoscale.interval == Some(0) {
+                    anyhow::bail!("Service '{}' autoscale.interval must be at least 1", name);
+                }
+            }
+            if let Some(access) = &service.access {
+                access.validate(&format!("Service '{}'", name))?;
+            }
+            if let Some(compression) = &service.compression {
+                if compression.encodings.is_empty() {
+                    anyhow::bail!("Service '{}' compression.encodings can't be empty", name);
+                }
+                if compression.level.is_some_and(|l| !(1..=9).contains(&l)) {
+                    anyhow::bail!("Service '{}' compression.level must be 1-9", name);
+                }
+            }
+            if let Some(preview) = &service.preview {
+                if preview.ttl == 0 || preview.max == 0 {
+                    anyhow::bail!("Service '{}' preview ttl and max must be at least 1", name);
+                }
+                if let Some(domain) = &preview.domain {
+                    let label = |l: &str| {
+                        !l.is_empty() && l.chars().all(|c| c.is_ascii_alphanumeric() || c == '-')
+                    };
+                    if !domain.split('.').all(label) {
+                        anyhow::bail!(
+                            "Service '{}' preview.domain {:?} is not a domain name",
+                            name,
+                            domain
+                        );
+                    }
+                    let shared = config.service.iter().find(|(other, svc)| {
+                        *other != name
+                            && svc.preview.as_ref().and_then(|p| p.domain.as_ref()) == Some(domain)
+                    });
+                    if let Some((other, _)) = shared {
+                        anyhow::bail!(
+                            "Services '{}' and '{}' have the same preview.domain",
+                            name,
+                            other
+                        );
+                    }
+                }
+            }
+            if let Some(cache) = &service.cache {
+                if cache.max_size == Some(0) || cache.max_entry_size == Some(0) {
+                    anyhow::bail!("Service '{}' cache sizes must be at least 1MB", name);
+                }
+                if cache.max_entry_bytes() > cache.max_bytes() {
+                    anyhow::bail!(
+                        "Service '{}' cache.max_entry_size is larger than cache.max_size",
+                        name
+                    );
+                }
+            }
+            if service.stream_idle_timeout == Some(0) {
+                anyhow::bail!(
+                    "Service '{}' stream_idle_timeout must be at least 1; omit it to keep \
+                     idle streams open",
+                    name
+                );
+            }
+            if service.kind == ServiceKind::Static {
+                if service.root.is_none() {
+                    anyhow::bail!(
+                        "Service '{}' is type = \"static\" but has no `root` to serve",
+                        name
+                    );
+                }
+                if !service.command.trim().is_empty() || service.image.is_some() {
+                    anyhow::bail!(
+                        "Service '{}' is type = \"static\" and runs nothing; remove its \
+                         `command`/`image`",
+                        name
+                    );
+                }
+                if config.instances.contains_key(name) {
+                    anyhow::bail!(
+                        "Service '{}' is type = \"static\" and has no instances; remove it \
+                         from [instances]",
+                        name
+                    );
+                }
+                continue;
+            }
+            if service.root.is_some() || service.spa {
+                anyhow::bail!(
+                    "Service '{}' sets `root`/`spa`, which only apply to type = \"static\"",
+                    name
+                );
+            }
+            // Only an image has an entrypoint to fall back on, and a detecting
+            // git service gets its command with each push
+            let detects = service.git.as_ref().is_some_and(|git| git.detect);
+            if service.command.trim().is_empty() && service.image.is_none() {
+                if !detects {
+                    anyhow::bail!("Service '{}' has no `command` to run", name);
+                }
+                if config.instances.contains_key(name) {
+                    anyhow::bail!(
+                        "Service '{}' gets its command from each push, so it can't start \
+                         from [instances] before one; give it a `command` or remove it",
+                        name
+                    );
+                }
+            }
+        }
+
+        // Each instance listens on one address, which tenement picks and exports
+        // as PORT (TCP runtimes) or SOCKET_PATH; setting either by hand conflicts
+        for (name, service) in &config.service {
+            for var in ["PORT", "SOCKET_PATH"] {
+                if service.env.contains_key(var) {
+                    anyhow::bail!(
+                        "Service '{}' sets {} in [service.{}.env], but tenement assigns the \
+                         listen address itself. Remove it; use `socket` to choose the socket \
+                         path (VM runtimes) and let tenement allocate the port.",
+                        name,
+                        var,
+                        name
+                    );
+                }
+            }
+            let custom_socket =
+                service.socket != default_socket() || service.unix_socket != Default::default();
+            if service.isolation.uses_tcp_port() && custom_socket {
+                tracing::warn!(
+                    "Service '{}' sets `socket` but {} isolation listens on the allocated \
+                     PORT; the proxy ignores the socket",
+                    name,
+                    service.isolation
+                );
+            }
+        }
+
+        // Validate limits, deploy settings, users and fault injection; warn when
+        // faults are configured but switched off
+        for (name, service) in &config.service {
+            service.limits.validate(name)?;
+            validate_log_sinks(
+                &service.log_sinks,
+                &format!("[[service.{}.log_sinks]]", name),
+            )?;
+            service
+                .filesystem
+                .validate(name, service.isolation, service.rootfs.is_some())?;
+            if let Some(egress) = &service.egress {
+                egress.validate(name, service.isolation)?;
+            }
+            for (volume, volume_config) in &service.volumes {
+                volume_config.validate(name, volume)?;
+            }
+            match (&service.listen, service.protocol.is_stream()) {
+                (Some(listen), true) => {
+                    listen.validate(name, service.protocol, service.isolation)?
+                }
+                (None, true) => anyhow::bail!(
+                    "Service '{}' speaks {} but has no `listen` port to be reached on",
+                    name,
+                    service.protocol
+                ),
+                (Some(_), false) => anyhow::bail!(
+                    "Service '{}' sets `listen`, which needs protocol = \"tcp\" or \"udp\"",
+                    name
+                ),
+                (None, false) => {}
+            }
+            if service.protocol.is_stream() && !service.domains.is_empty() {
+                anyhow::bail!(
+                    "Service '{}' speaks {}, so it can't serve HTTP `domains`",
+                    name,
+                    service.protocol
+                );
+            }
+            service.unix_socket.validate(name)?;
+            service.connection_pool.validate(name)?;
+            service.deploy.validate(name)?;
+            if [&service.user, &service.group]
+                .iter()
+                .any(|v| v.as_deref().is_some_and(|v| v.trim().is_empty()))
+            {
+                anyhow::bail!("Service '{}' sets an empty `user` or `group`", name);
+            }
+            if let Some(stack) = &service.stack {
+                let valid = !stack.is_empty()
+                    && stack
+                        .chars()
+                        .all(|c| c.is_ascii_alphanumeric() || c == '-' || c == '_');
+                if !valid {
+                    anyhow::bail!(
+                        "Service '{}' stack '{}' may only use letters, digits, '-' and '_'",
+                        name,
+                        stack
+                    );
+                }
+            }
+            if let Some(fault) = &service.fault {
+                fault.validate(&format!("Service '{}'", name))?;
+                if fault.is_active() && !config.settings.fault_injection {
+                    tracing::warn!(
+                        "Service '{}' has a [fault] block but settings.fault_injection is off; \
+                         it applies only once fault injection is turned on",
+                        name
+                    );
+                }
+            }
+        }
+        for (name, service) in &config.service {
+            for dependency in service.depends_on.keys() {
+                if !config.service.contains_key(dependency) {
+                    anyhow::bail!(
+                        "Service '{}' depends on unknown service '{}'",
+                        name,
+                        dependency
+                    );
+                }
+            }
+        }
+        for (name, service) in &config.service {
+            for used in &service.uses {
+                if used == name {
+                    anyhow::bail!("Service '{}' can't use itself", name);
+                }
+                if !config.service.contains_key(used) {
+                    anyhow::bail!("Service '{}' uses unknown service '{}'", name, used);
+                }
+            }
+        }
+        if let Some(cycle) = find_dependency_cycle(&config.service) {
+            anyhow::bail!("Dependency cycle: {}", cycle.join(" -> "));
+        }
+        for (name, job) in &config.jobs {
+            if config.service.contains_key(name) {
+                anyhow::bail!(
+                    "Job '{}' has the same name as a service; their logs would mix",
+                    name
+                );
+            }
+            job.parsed_schedule()
+                .and_then(|_| job.tz())
+                .with_context(|| format!("Job '{}' has an invalid schedule", name))?;
+        }
+
+        // An autoscaled service starts at `replicas`, held within its bounds
+        for service in config.service.values_mut() {
+            if let Some(autoscale) = &service.autoscale {
+                service.replicas = service.replicas.clamp(autoscale.min, autoscale.max);
+            }
+        }
+
+        if config.settings.fault_injection {
+            tracing::warn!("Fault injection is ENABLED - proxied requests may be delayed or aborted");
+        }
+
+        // Identical prefixes can't both match; the later one is dead config
+        for conflict in crate::routing::RouteTable::from_config(&config.routing).conflicts() {
+            let host = conflict
+                .host
+                .map(|h| format!(" (host '{}')", h))
+                .unwrap_or_default();
+            tracing::warn!(
+                "Route '{}'{} is declared more than once: {} wins, {} is shadowed",
+                conflict.prefix,
+                host,
+                conflict.winner,
+                conflict.shadowed
+            );
+        }
+
+        Ok(config)
+    }
+
+    /// Find tenement.toml by walking up from current directory
+    pub fn find_config_file() -> Result<PathBuf> {
+        let mut current = std::env::current_dir()?;
+
+        loop {
+            let config_path = current.join("tenement.toml");
+            if config_path.exists() {
+                return Ok(config_path);
+            }
+
+            if !current.pop() {
+                anyhow::bail!(
+                    "No tenement.toml found. Create one with:\n\n\
+                    [service.myapp]\n\
+                    command = \"./my-app\"\n\
+                    socket = \"/tmp/myapp-{{id}}.sock\"\n"
+                );
+            }
+        }
+    }
+
+    /// Get a service config by name
+    pub fn get_service(&self, name: &str) -> Option<&ProcessConfig> {
+        self.service.get(name)
+    }
+
+    /// The services in `stack`, in rollout order: each after the services it
+    /// depends on (directly or not), otherwise by name. Empty for an unknown stack.
+    pub fn stack_services(&self, stack: &str) -> Vec<String> {
+        let mut members: Vec<&String> = self
+            .service
+            .iter()
+            .filter(|(_, service)| service.stack.as_deref() == Some(stack))
+            .map(|(name, _)| name)
+            .collect();
+        members.sort();
+        let mut order = Vec::new();
+        let mut seen = std::collections::HashSet::new();
+        for name in members {
+            stack_order(self, name, stack, &mut seen, &mut order);
+        }
+        order
+    }
+
+    /// Every stack's services, in rollout order
+    pub fn stacks(&self) -> BTreeMap<String, Vec<String>> {
+        let names: std::collections::BTreeSet<_> = self
+            .service
+            .values()
+            .filter_map(|service| service.stack.clone())
+            .collect();
+        names
+            .into_iter()
+            .map(|stack| {
+                let services = self.stack_services(&stack);
+                (stack, services)
+            })
+            .collect()
+    }
+
+    /// Get all configured instances to spawn on boot
+    /// Returns pairs of (service_name, instance_id)
+    pub fn get_instances_to_spawn(&self) -> Vec<(String, String)> {
+        let mut result = Vec::new();
+        for (service_name, instance_ids) in &self.instances {
+            for instance_id in instance_ids {
+                result.push((service_name.clone(), instance_id.clone()));
+            }
+        }
+        result
+    }
+
+    /// Check if any instances are configured for auto-spawn
+    pub fn has_instances_to_spawn(&self) -> bool {
+        self.instances.values().any(|ids| !ids.is_empty())
+    }
+
+    /// Every service's `domains`, sorted
+    pub fn service_domains(&self) -> Vec<String> {
+        let mut domains: Vec<String> = self
+            .service
+            .values()
+            .flat_map(|service| service.domains.iter().cloned())
+            .collect();
+        domains.sort();
+        domains
+    }
+
+    /// The service and preview a host is a preview subdomain of, for services
+    /// with a `preview.domain`: "pr-123.apps.example.com" -> ("app", "pr-123")
+    pub fn preview_host<'a>(&'a self, host: &'a str) -> Option<(&'a str, &'a str)> {
+        self.service.iter().find_map(|(name, service)| {
+            let domain = service.preview.as_ref()?.domain.as_deref()?;
+            let name_part = host.strip_suffix(domain)?.strip_suffix('.')?;
+            let single_label = !name_part.is_empty() && !name_part.contains('.');
+            single_label.then_some((name.as_str(), name_part))
+        })
+    }
+
+    /// Fingerprint each service's definition, including its `[instances]` entry.
+    /// Only hashes are kept, so env values and secrets never reach disk.
+    pub fn service_fingerprints(&self) -> BTreeMap<String, u64> {
+        self.service
+            .iter()
+            .map(|(name, service)| {
+                // serde_json::Value keeps object keys sorted, so env maps hash stably
+                let definition = serde_json::to_value(service)
+                    .map(|v| v.to_string())
+                    .unwrap_or_default();
+                let mut instances = self.instances.get(name).cloned().unwrap_or_default();
+                instances.sort();
+                let mut hasher = DefaultHasher::new();
+                (definition, instances).hash(&mut hasher);
+                (name.clone(), hasher.finish())
+            })
+            .collect()
+    }
+
+    /// Compare services against the config applied on the previous start, then
+    /// record this one. Returns None on the first start with this data_dir.
+    pub fn diff_against_last_applied(&self) -> Result<Option<ConfigDiff>> {
+        let path = self.settings.data_dir.join(APPLIED_SERVICES_FILE);
+        let current = self.service_fingerprints();
+        let previous = match std::fs::read_to_string(&path) {
+            Ok(content) => match serde_json::from_str::<BTreeMap<String, u64>>(&content) {
+                Ok(previous) => Some(previous),
+                Err(e) => {
+                    tracing::warn!("Ignoring unreadable {}: {}", path.display(), e);
+                    None
+                }
+            },
+            Err(e) if e.kind() == std::io::ErrorKind::NotFound => None,
+            Err(e) => {
+                return Err(e).with_context(|| format!("Failed to read {}", path.display()))
+            }
+        };
+
+        std::fs::create_dir_all(&self.settings.data_dir)?;
+        std::fs::write(&path, serde_json::to_string_pretty(&current)?)
+            .with_context(|| format!("Failed to write {}", path.display()))?;
+
+        Ok(previous.map(|previous| ConfigDiff::between(&previous, &current)))
+    }
+}
+
+/// File in data_dir holding the service fingerprints of the last applied config
+const APPLIED_SERVICES_FILE: &str = "applied-services.json";
+
+/// Services that differ between two configs
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct ConfigDiff {
+    pub added: Vec<String>,
+    pub removed: Vec<String>,
+    pub changed: Vec<String>,
+}
+
+impl ConfigDiff {
+    /// Diff two sets of service fingerprints (see `Config::service_fingerprints`)
+    pub fn between(previous: &BTreeMap<String, u64>, current: &BTreeMap<String, u64>) -> Self {
+        let mut diff = Self::default();
+        for (name, fingerprint) in current {
+            match previous.get(name) {
+                None => diff.added.push(name.clone()),
+                Some(old) if old != fingerprint => diff.changed.push(name.clone()),
+                Some(_) => {}
+            }
+        }
+        diff.removed = previous
+            .keys()
+            .filter(|name| !current.contains_key(*name))
+            .cloned()
+            .collect();
+        diff
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.added.is_empty() && self.removed.is_empty() && self.changed.is_empty()
+    }
+}
+
+impl std::fmt::Display for ConfigDiff {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        if self.is_empty() {
+            return write!(f, "no service changes");
+        }
+        let sections = [
+            ("added", &self.added),
+            ("removed", &self.removed),
+            ("changed", &self.changed),
+        ];
+        let parts: Vec<String> = sections
+            .into_iter()
+            .filter(|(_, names)| !names.is_empty())
+            .map(|(label, names)| format!("{}: {}", label, names.join(", ")))
+            .collect();
+        write!(f, "{}", parts.join("; "))
+    }
+}
+
+/// Listen address for a service
+#[derive(Debug, Clone)]
+pub enum ListenAddr {
+    /// Unix socket path
+    Socket(PathBuf),
+    /// TCP address (127.0.0.1:port)
+    Tcp(String, u16),
+}
+
+impl ListenAddr {
+    /// Check if this is a TCP address
+    pub fn is_tcp(&self) -> bool {
+        matches!(self, ListenAddr::Tcp(_, _))
+    }
+
+    /// Check if this is a Unix socket
+    pub fn is_socket(&self) -> bool {
+        matches!(self, ListenAddr::Socket(_))
+    }
+
+    /// Get the TCP port if this is a TCP address
+    pub fn port(&self) -> Option<u16> {
+        match self {
+            ListenAddr::Tcp(_, port) => Some(*port),
+            ListenAddr::Socket(_) => None,
+        }
+    }
+}
+
+impl ProcessConfig {
+    /// Validate config for the specified isolation level
+    pub fn validate(&self, name: &str) -> Result<()> {
+        if self.isolation == RuntimeType::Firecracker {
+            if self.kernel.is_none() {
+                anyhow::bail!(
+                    "Service '{}' uses firecracker isolation but 'kernel' is not specified",
+                    name
+                );
+            }
+            if self.rootfs.is_none() {
+                anyhow::bail!(
+                    "Service '{}' uses firecracker isolation but 'rootfs' is not specified",
+                    name
+                );
+            }
+        }
+        if self.isolation == RuntimeType::Litebox && self.rootfs.is_none() {
+            anyhow::bail!(
+                "Service '{}' uses litebox isolation but 'rootfs' is not specified. \
+                 LiteBox sandboxes the app inside a rootfs; point it at the extracted app root.",
+                name
+            );
+        }
+        if matches!(
+            self.isolation,
+            RuntimeType::Sandbox | RuntimeType::Quark | RuntimeType::Container
+        ) && self.image.is_none()
+        {
+            anyhow::bail!(
+                "Service '{}' uses {} isolation but 'image' is not specified. \
+                 Container runtimes require an OCI image reference.",
+                name,
+                self.isolation
+            );
+        }
+        if let Some(signal) = &self.reload_signal {
+            crate::secrets::parse_signal(signal)
+                .with_context(|| format!("Service '{}' has an invalid reload_signal", name))?;
+        }
+        if self.shell.as_deref().is_some_and(|s| s.trim().is_empty()) {
+            anyhow::bail!("Service '{}' sets an empty `shell`", name);
+        }
+        for var in &self.required_env {
+            if var.is_empty() || var.contains('=') || var.contains('\0') {
+                anyhow::bail!(
+                    "Service '{}' has an invalid required_env name {:?}",
+                    name,
+                    var
+                );
+            }
+        }
+        Ok(())
+    }
+
+    /// Required env vars that are unset or empty in `env`, falling back to
+    /// tenement's own environment when the instance inherits it
+    pub fn missing_required_env(
+        &self,
+        env: &HashMap<String, String>,
+        inherits_env: bool,
+    ) -> Vec<&str> {
+        self.required_env
+            .iter()
+            .filter(|var| match env.get(var.as_str()) {
+                Some(value) => value.is_empty(),
+                None => !inherits_env || std::env::var_os(var).map_or(true, |v| v.is_empty()),
+            })
+            .map(String::as_str)
+            .collect()
+    }
+
+    /// How long an instance gets to exit after `stop_signal` (default: 10s)
+    pub fn stop_timeout(&self) -> std::time::Duration {
+        std::time::Duration::from_secs(self.stop_timeout.unwrap_or(10))
+    }
+
+    /// Memory cap in MB: `limits.memory`, else `memory_limit_mb` (0 = none)
+    pub fn memory_limit(&self) -> Option<u32> {
+        self.limits.memory.or(self.memory_limit_mb).filter(|mb| *mb > 0)
+    }
+
+    /// Redactor for this service's env: auto-detection, `redact_env`, and every secret
+    pub fn redactor(&self) -> Redactor {
+        Redactor::new(self.redact_env.iter().chain(self.secrets.keys()))
+    }
+
+    /// Get the isolation level (preferred name)
+    pub fn isolation(&self) -> RuntimeType {
+        self.isolation
+    }
+
+    /// Get the listen address for an instance
+    /// Returns a socket path. TCP ports are allocated separately by the hypervisor.
+    pub fn listen_addr(&self, name: &str, id: &str, port: Option<u16>) -> ListenAddr {
+        if let Some(port) = port {
+            ListenAddr::Tcp(format!("127.0.0.1:{}", port), port)
+        } else {
+            ListenAddr::Socket(self.socket_path(name, id))
+        }
+    }
+
+    /// Interpolate variables in a string
+    /// Supports: {name}, {id}, {data_dir}, {socket}, {port}
+    pub fn interpolate(
+        &self,
+        template: &str,
+        name: &str,
+        id: &str,
+        data_dir: &Path,
+        port: Option<u16>,
     ) -> String {
         let socket = self.socket_path(name, id);
         let port_str = port.map(|p| p.to_string()).unwrap_or_default();
@@ -550,521 +4585,2341 @@ impl ProcessConfig {
             .replace("{port}", &port_str)
     }
 
-    /// Get the socket path for an instance (used for Unix socket mode)
-    pub fn socket_path(&self, name: &str, id: &str) -> PathBuf {
-        let path = self.socket.replace("{name}", name).replace("{id}", id);
-        PathBuf::from(path)
+    /// Get the socket path for an instance (used for Unix socket mode)
+    pub fn socket_path(&self, name: &str, id: &str) -> PathBuf {
+        let path = self
+            .socket_template()
+            .replace("{name}", name)
+            .replace("{id}", id);
+        PathBuf::from(path)
+    }
+
+    /// The socket path pattern: `socket`, with `unix_socket.dir` and `name`
+    /// in place of its parts
+    pub fn socket_template(&self) -> String {
+        let UnixSocketConfig { dir, name, .. } = &self.unix_socket;
+        if dir.is_none() && name.is_none() {
+            return self.socket.clone();
+        }
+        let socket = Path::new(&self.socket);
+        let dir = match dir {
+            Some(dir) => PathBuf::from(dir),
+            None => socket.parent().map(Path::to_path_buf).unwrap_or_default(),
+        };
+        let name = match name {
+            Some(name) => name.clone(),
+            None => socket
+                .file_name()
+                .map_or_else(String::new, |n| n.to_string_lossy().into()),
+        };
+        dir.join(name).to_string_lossy().into_owned()
+    }
+
+    /// Whether a health probe is configured (a TCP or exec check, or an HTTP path)
+    pub fn has_health_probe(&self) -> bool {
+        match self.health_check.check_type {
+            HealthCheckType::Http => self.health.is_some(),
+            HealthCheckType::Tcp => true,
+            HealthCheckType::Exec => self.health_check.command.is_some(),
+        }
+    }
+
+    /// Index of replica `id` (`{instance}-{index}`), if this service has replicas
+    pub fn replica_index(&self, id: &str) -> Option<u32> {
+        let most = self.autoscale.as_ref().map_or(self.replicas, |a| a.max);
+        if most <= 1 {
+            return None;
+        }
+        let (instance, index) = id.rsplit_once('-')?;
+        let index: u32 = index.parse().ok()?;
+        (!instance.is_empty() && index < most).then_some(index)
+    }
+
+    /// Replica IDs that instance `id` runs as; empty when this service has no
+    /// replicas or `id` already names one. An autoscaled service always runs
+    /// replicas, even just one, so scaling never renames its instances.
+    pub fn replica_ids(&self, id: &str) -> Vec<String> {
+        let replicated = self.replicas > 1 || self.autoscale.is_some();
+        if !replicated || self.replica_index(id).is_some() {
+            return Vec::new();
+        }
+        (0..self.replicas).map(|i| format!("{}-{}", id, i)).collect()
+    }
+
+    /// Get interpolated command
+    pub fn command_interpolated(
+        &self,
+        name: &str,
+        id: &str,
+        data_dir: &Path,
+        port: Option<u16>,
+    ) -> String {
+        self.interpolate(&self.command, name, id, data_dir, port)
+    }
+
+    /// Get interpolated args
+    pub fn args_interpolated(
+        &self,
+        name: &str,
+        id: &str,
+        data_dir: &Path,
+        port: Option<u16>,
+    ) -> Vec<String> {
+        self.args
+            .iter()
+            .map(|arg| self.interpolate(arg, name, id, data_dir, port))
+            .collect()
+    }
+
+    /// Wrap a resolved command in the configured login shell, if any.
+    /// `exec` replaces the shell with the app, so signals and the tracked PID reach it directly.
+    pub fn launch_command(&self, command: String, args: Vec<String>) -> (String, Vec<String>) {
+        match &self.shell {
+            Some(shell) => {
+                let words = std::iter::once(command.as_str()).chain(args.iter().map(String::as_str));
+                let script = format!("exec {}", shell_words::join(words));
+                (shell.clone(), vec!["-lc".to_string(), script])
+            }
+            None => (command, args),
+        }
+    }
+
+    /// Effective health check interval, falling back to the global setting
+    pub fn health_interval(&self, settings: &Settings) -> std::time::Duration {
+        let secs = self
+            .health_check
+            .interval
+            .unwrap_or(settings.health_check_interval);
+        std::time::Duration::from_secs(secs)
+    }
+
+    /// Effective readiness check interval, falling back to the health interval
+    pub fn readiness_interval(&self, settings: &Settings) -> std::time::Duration {
+        match self.readiness.as_ref().and_then(|r| r.interval) {
+            Some(secs) => std::time::Duration::from_secs(secs),
+            None => self.health_interval(settings),
+        }
+    }
+
+    /// Get interpolated environment variables
+    ///
+    /// `env` is layered over `file_env` (from `env_files`), and its `${VAR}`
+    /// references resolve against `file_env`, then tenement's environment.
+    pub fn env_interpolated(
+        &self,
+        file_env: HashMap<String, String>,
+        name: &str,
+        id: &str,
+        data_dir: &Path,
+        port: Option<u16>,
+    ) -> HashMap<String, String> {
+        let inline: Vec<(String, String)> = self
+            .env
+            .iter()
+            .map(|(k, v)| {
+                let value = self.interpolate(v, name, id, data_dir, port);
+                (k.clone(), env_files::expand(&value, &file_env))
+            })
+            .collect();
+        let mut env = file_env;
+        env.extend(inline);
+        env
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_parse_minimal_config() {
+        let config_str = r#"
+[service.api]
+command = "./api-server"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+
+        assert!(config.service.contains_key("api"));
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.command, "./api-server");
+        assert_eq!(api.socket, "/tmp/tenement/{name}-{id}.sock");
+    }
+
+    #[test]
+    fn test_parse_full_config() {
+        let config_str = r#"
+[settings]
+data_dir = "/data/tenement"
+health_check_interval = 30
+
+[service.api]
+command = "./api"
+args = ["--port", "8080"]
+socket = "/tmp/api-{id}.sock"
+health = "/health"
+restart = "always"
+
+[service.api.env]
+DATABASE_PATH = "{data_dir}/{id}/app.db"
+LOG_LEVEL = "info"
+
+[routing]
+default = "api"
+
+[routing.subdomain]
+"api.example.com" = "api"
+"*.example.com" = "api"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+
+        assert_eq!(config.settings.data_dir, PathBuf::from("/data/tenement"));
+        assert_eq!(config.settings.health_check_interval, 30);
+
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.command, "./api");
+        assert_eq!(api.args, vec!["--port", "8080"]);
+        assert_eq!(api.health, Some("/health".to_string()));
+        assert_eq!(api.restart, "always");
+        assert_eq!(api.env.get("LOG_LEVEL"), Some(&"info".to_string()));
+
+        assert_eq!(config.routing.default, Some("api".to_string()));
+    }
+
+    #[test]
+    fn test_interpolation() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+socket = "/tmp/tenement/{name}-{id}.sock"
+
+[service.api.env]
+DB = "{data_dir}/{id}/app.db"
+SOCKET = "{socket}"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+
+        let data_dir = PathBuf::from("/var/lib/tenement");
+
+        let socket = api.socket_path("api", "user123");
+        assert_eq!(socket, PathBuf::from("/tmp/tenement/api-user123.sock"));
+
+        let env = api.env_interpolated(HashMap::new(), "api", "user123", &data_dir, None);
+        assert_eq!(
+            env.get("DB"),
+            Some(&"/var/lib/tenement/user123/app.db".to_string())
+        );
+        assert_eq!(
+            env.get("SOCKET"),
+            Some(&"/tmp/tenement/api-user123.sock".to_string())
+        );
+    }
+
+    #[test]
+    fn test_default_settings() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+
+        assert_eq!(config.settings.data_dir, PathBuf::from("./tenement-data"));
+        assert_eq!(config.settings.health_check_interval, 10);
+        assert_eq!(config.settings.max_restarts, 3);
+        assert_eq!(config.settings.restart_window, 300);
+    }
+
+    #[test]
+    fn test_multiple_services() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+
+[service.worker]
+command = "./worker"
+socket = "/tmp/worker-{id}.sock"
+
+[service.scheduler]
+command = "./scheduler"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+
+        assert_eq!(config.service.len(), 3);
+        assert!(config.get_service("api").is_some());
+        assert!(config.get_service("worker").is_some());
+        assert!(config.get_service("scheduler").is_some());
+        assert!(config.get_service("nonexistent").is_none());
+    }
+
+    #[test]
+    fn test_service_with_workdir() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+workdir = "/var/app"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.workdir, Some(PathBuf::from("/var/app")));
+    }
+
+    #[test]
+    fn test_service_restart_policies() {
+        let config_str = r#"
+[service.always]
+command = "./always"
+restart = "always"
+
+[service.never]
+command = "./never"
+restart = "never"
+
+[service.default]
+command = "./default"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+
+        assert_eq!(config.get_service("always").unwrap().restart, "always");
+        assert_eq!(config.get_service("never").unwrap().restart, "never");
+        assert_eq!(config.get_service("default").unwrap().restart, "on-failure");
+    }
+
+    #[test]
+    fn test_routing_config() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+
+[routing]
+default = "api"
+
+[routing.subdomain]
+"api.example.com" = "api"
+"*.tenant.example.com" = "api"
+
+[routing.path]
+"/api" = "api"
+"/health" = "api"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+
+        assert_eq!(config.routing.default, Some("api".to_string()));
+        assert_eq!(config.routing.subdomain.len(), 2);
+        assert_eq!(config.routing.path.len(), 2);
+        assert_eq!(config.routing.path.get("/api"), Some(&"api".to_string()));
+    }
+
+    #[test]
+    fn test_empty_routing() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+
+        assert!(config.routing.default.is_none());
+        assert!(config.routing.subdomain.is_empty());
+        assert!(config.routing.path.is_empty());
+        assert!(config.routing.route.is_empty());
+    }
+
+    #[test]
+    fn test_route_config_static_and_service() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/static"
+static = "./public"
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+
+        assert_eq!(config.routing.route.len(), 2);
+        assert_eq!(config.routing.route[0].prefix, "/static");
+        assert_eq!(
+            config.routing.route[0].static_dir,
+            Some(PathBuf::from("./public"))
+        );
+        assert_eq!(config.routing.route[1].service, Some("api".to_string()));
+    }
+
+    #[test]
+    fn test_route_config_rejects_both_targets() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/app"
+service = "api"
+static = "./public"
+"#;
+        let err = Config::from_str(config_str).unwrap_err();
+        assert!(err.to_string().contains("both `service` and `static`"));
+    }
+
+    #[test]
+    fn test_route_config_rejects_missing_target() {
+        let config_str = r#"
+[[routing.route]]
+prefix = "/app"
+"#;
+        let err = Config::from_str(config_str).unwrap_err();
+        assert!(err.to_string().contains("needs either `service` or `static`"));
+    }
+
+    #[test]
+    fn test_route_config_rejects_undefined_service() {
+        let config_str = r#"
+[[routing.route]]
+prefix = "/app"
+service = "missing"
+"#;
+        let err = Config::from_str(config_str).unwrap_err();
+        assert!(err.to_string().contains("undefined service 'missing'"));
+    }
+
+    #[test]
+    fn test_route_host_and_host_default() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+
+[service.docs]
+command = "./docs"
+
+[[routing.route]]
+prefix = "/v1"
+host = "docs.example.com"
+service = "api"
+
+[routing.host_default]
+"docs.example.com" = "docs"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        assert_eq!(config.routing.route[0].host, Some("docs.example.com".to_string()));
+        assert_eq!(
+            config.routing.host_default.get("docs.example.com"),
+            Some(&"docs".to_string())
+        );
+    }
+
+    #[test]
+    fn test_route_path_rewrites() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+
+[service.admin]
+command = "./admin"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+rewrite = "/v2"
+
+[[routing.route]]
+prefix = "/admin"
+service = "admin"
+strip_prefix = true
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        assert_eq!(config.routing.route[0].rewrite, Some("/v2".to_string()));
+        assert!(!config.routing.route[0].strip_prefix);
+        assert!(config.routing.route[1].strip_prefix);
+
+        let route = |extra: &str| {
+            format!(
+                "[service.api]\ncommand = \"./api\"\n\n\
+                 [[routing.route]]\nprefix = \"/api\"\nservice = \"api\"\n{}",
+                extra
+            )
+        };
+        let both = route("strip_prefix = true\nrewrite = \"/v2\"\n");
+        let err = Config::from_str(&both).unwrap_err();
+        assert!(err.to_string().contains("both"), "{}", err);
+        let err = Config::from_str(&route("rewrite = \"v2\"\n")).unwrap_err();
+        assert!(err.to_string().contains("starting with '/'"), "{}", err);
+    }
+
+    #[test]
+    fn test_route_mirror() {
+        let route = |mirror: &str| {
+            format!(
+                "[service.api]\ncommand = \"./api\"\n\n\
+                 [service.api-v2]\ncommand = \"./api-v2\"\n\n\
+                 [[routing.route]]\nprefix = \"/api\"\nservice = \"api\"\nmirror = {}\n",
+                mirror
+            )
+        };
+        let config = Config::from_str(&route("{ service = \"api-v2\" }")).unwrap();
+        let mirror = config.routing.route[0].mirror.as_ref().unwrap();
+        assert_eq!(mirror.service, "api-v2");
+        assert_eq!(mirror.percent, 100.0);
+
+        let cases = [
+            ("{ service = \"missing\" }", "undefined service 'missing'"),
+            ("{ service = \"api\" }", "already routes to"),
+            ("{ service = \"api-v2\", percent = 150 }", "0-100"),
+            ("{ service = \"api-v2\", percent = -1 }", "0-100"),
+        ];
+        for (mirror, expected) in cases {
+            let err = Config::from_str(&route(mirror)).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}: {}", mirror, err);
+        }
+    }
+
+    #[test]
+    fn test_route_fault() {
+        let route = |fault: &str| {
+            format!(
+                "[service.api]\ncommand = \"./api\"\n\n\
+                 [[routing.route]]\nprefix = \"/api\"\nservice = \"api\"\nfault = {}\n",
+                fault
+            )
+        };
+        let config = Config::from_str(&route("{ delay_ms = 50, delay_percent = 10 }")).unwrap();
+        let fault = config.routing.route[0].fault.as_ref().unwrap();
+        assert_eq!(fault.delay_ms, 50);
+        assert_eq!(fault.delay_percent, 10.0);
+
+        let cases = [
+            ("{ abort_percent = 10 }", "Route '/api' sets fault"),
+            ("{ delay_percent = 101 }", "Route '/api' fault.delay"),
+            ("{ kill_interval_secs = 30 }", "killed per service"),
+        ];
+        for (fault, expected) in cases {
+            let err = Config::from_str(&route(fault)).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}: {}", fault, err);
+        }
+    }
+
+    #[test]
+    fn test_route_slo_target() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+slo_target_ms = 250
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        assert_eq!(config.routing.route[0].slo_target_ms, Some(250));
+
+        let zero = config_str.replace("250", "0");
+        let err = Config::from_str(&zero).unwrap_err();
+        assert!(err.to_string().contains("slo_target_ms must be at least 1"));
+    }
+
+    #[test]
+    fn test_route_gzip_level() {
+        let config_str = |level: &str| {
+            format!(
+                "[service.api]\ncommand = \"./api\"\n\n\
+                 [[routing.route]]\nprefix = \"/api\"\nservice = \"api\"\ngzip_level = {}\n",
+                level
+            )
+        };
+        let level = |value: &str| {
+            Config::from_str(&config_str(value)).map(|c| c.routing.route[0].gzip_level)
+        };
+        assert_eq!(level("1").unwrap(), Some(GzipLevel::Level(1)));
+        assert_eq!(level("9").unwrap(), Some(GzipLevel::Level(9)));
+        assert_eq!(level("\"default\"").unwrap(), Some(GzipLevel::Default));
+
+        for invalid in ["0", "10", "-1", "\"fast\""] {
+            let err = level(invalid).unwrap_err().to_string();
+            assert!(err.contains("gzip_level must be 1-9 or \"default\""), "{}: {}", invalid, err);
+        }
+    }
+
+    #[test]
+    fn test_service_domains() {
+        use crate::routing::{RouteTable, RouteTarget};
+
+        let config_str = r#"
+[service.api]
+command = "./api"
+domains = ["api.example.com", "api.example.org"]
+
+[service.docs]
+command = "./docs"
+domains = ["docs.example.com"]
+
+[routing.host_default]
+"API.example.com" = "api"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let host_default = &config.routing.host_default;
+        assert_eq!(host_default.len(), 3);
+        assert_eq!(host_default.get("api.example.org"), Some(&"api".to_string()));
+        assert_eq!(host_default.get("docs.example.com"), Some(&"docs".to_string()));
+
+        let table = RouteTable::from_config(&config.routing);
+        let matched = table.resolve_for_host(Some("docs.example.com:443"), "/guide").unwrap();
+        assert_eq!(matched.route.target, RouteTarget::Service("docs".to_string()));
+    }
+
+    #[test]
+    fn test_service_domains_must_be_unique() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+domains = ["shared.example.com"]
+
+[service.docs]
+command = "./docs"
+domains = ["Shared.example.com"]
+"#;
+        let err = Config::from_str(config_str).unwrap_err().to_string();
+        assert!(err.contains("is already routed to service 'api'"), "{}", err);
+
+        let empty = "[service.api]\ncommand = \"./api\"\ndomains = [\" \"]\n";
+        let err = Config::from_str(empty).unwrap_err().to_string();
+        assert!(err.contains("empty entry in domains"), "{}", err);
+    }
+
+    #[test]
+    fn test_host_default_rejects_undefined_service() {
+        let config_str = r#"
+[routing.host_default]
+"docs.example.com" = "missing"
+"#;
+        let err = Config::from_str(config_str).unwrap_err();
+        assert!(err.to_string().contains("undefined service 'missing'"));
+    }
+
+    #[test]
+    fn test_route_request_headers() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/assets"
+service = "api"
+
+[routing.route.request_headers]
+accept_encoding = "gzip"
+remove = ["cookie"]
+set = { "x-cache-tier" = "edge" }
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let rules = &config.routing.route[0].request_headers;
+        assert_eq!(
+            rules.accept_encoding,
+            Some(crate::headers::AcceptEncodingRule::Force("gzip".to_string()))
+        );
+        assert_eq!(rules.set.get("x-cache-tier"), Some(&"edge".to_string()));
+    }
+
+    #[test]
+    fn test_route_request_headers_rejects_bad_values() {
+        let bad_encoding = r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/assets"
+service = "api"
+request_headers = { accept_encoding = "lzma" }
+"#;
+        let err = Config::from_str(bad_encoding).unwrap_err();
+        assert!(format!("{:#}", err).contains("unknown accept_encoding"));
+
+        let bad_name = r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/assets"
+service = "api"
+request_headers = { remove = ["bad header"] }
+"#;
+        let err = Config::from_str(bad_name).unwrap_err();
+        assert!(err.to_string().contains("invalid header name"));
+    }
+
+    #[test]
+    fn test_route_response_headers() {
+        let route = |table: &str| {
+            let content = format!(
+                "[service.api]\ncommand = \"./api\"\n\n[[routing.route]]\nprefix = \"/\"\n\
+                 service = \"api\"\n\n[routing.route.response_headers]\n{}",
+                table
+            );
+            Config::from_str(&content).map(|c| c.routing.route[0].clone())
+        };
+
+        let main = route("security_headers = true\nremove = [\"server\"]\n").unwrap();
+        assert!(main.response_headers.security_headers);
+        assert_eq!(main.response_headers.remove, vec!["server".to_string()]);
+        assert!(main.request_headers.is_empty());
+
+        let err = route("accept_encoding = \"gzip\"\n").unwrap_err();
+        assert!(err.to_string().contains("apply to requests"), "{}", err);
+        let err = route("add = { \"bad header\" = \"1\" }\n").unwrap_err();
+        assert!(err.to_string().contains("in response_headers"), "{}", err);
+    }
+
+    #[test]
+    fn test_access_config() {
+        let content = r#"
+[service.api]
+command = "./api"
+
+[service.api.access]
+allow = ["10.0.0.0/8", "192.168.1.5"]
+deny = ["10.6.6.0/24"]
+
+[[routing.route]]
+prefix = "/admin"
+service = "api"
+access = { basic_auth = "/etc/tenement/htpasswd", realm = "ops" }
+"#;
+        let config = Config::from_str(content).unwrap();
+        let access = config.get_service("api").unwrap().access.clone().unwrap();
+        assert_eq!(access.allow.len(), 2);
+        assert!(access.allows(Some("10.1.1.1".parse().unwrap())));
+        assert!(!access.allows(Some("10.6.6.1".parse().unwrap())));
+        let route = config.routing.route[0].access.clone().unwrap();
+        let htpasswd = PathBuf::from("/etc/tenement/htpasswd");
+        assert_eq!(route.basic_auth, Some(htpasswd));
+        assert_eq!(route.realm.as_deref(), Some("ops"));
+
+        let service = |access: &str| {
+            let content = format!("[service.api]\ncommand = \"./api\"\naccess = {}\n", access);
+            Config::from_str(&content).map_err(|e| format!("{:#}", e))
+        };
+        let err = service(r#"{ allow = ["10.0.0.0/40"] }"#).unwrap_err();
+        assert!(err.contains("invalid prefix length"), "{}", err);
+        let err = service(r#"{ realm = 'a"b' }"#).unwrap_err();
+        assert!(err.contains("access.realm"), "{}", err);
+    }
+
+    #[test]
+    fn test_compression_and_cache_config() {
+        let content = r#"
+[service.api]
+command = "./api"
+compression = { encodings = ["brotli"] }
+
+[service.api.cache]
+max_size = "64MB"
+dir = "/var/cache/tenement"
+default_ttl = "5m"
+
+[service.web]
+command = "./web"
+compression = {}
+cache = {}
+"#;
+        let config = Config::from_str(content).unwrap();
+        let api = config.get_service("api").unwrap();
+        let compression = api.compression.clone().unwrap();
+        assert_eq!(compression.encodings, vec![Encoding::Br]);
+        let cache = api.cache.clone().unwrap();
+        assert_eq!(cache.max_bytes(), 64 * 1024 * 1024);
+        assert_eq!(cache.max_entry_bytes(), 1024 * 1024);
+        assert_eq!(cache.default_ttl, Some(300));
+        let web = config.get_service("web").unwrap();
+        let compression = web.compression.clone().unwrap();
+        assert_eq!(compression.encodings, vec![Encoding::Br, Encoding::Gzip]);
+        assert_eq!(compression.level, None);
+        assert_eq!(web.cache.as_ref().unwrap().max_bytes(), 16 * 1024 * 1024);
+
+        let service = |table: &str| {
+            let content = format!("[service.api]\ncommand = \"./api\"\n{}\n", table);
+            Config::from_str(&content).map_err(|e| format!("{:#}", e))
+        };
+        for (table, message) in [
+            ("compression = { encodings = [] }", "compression.encodings"),
+            ("compression = { level = 10 }", "compression.level"),
+            ("cache = { max_size = 0 }", "cache sizes"),
+            ("cache = { max_size = 1, max_entry_size = 2 }", "larger"),
+        ] {
+            let err = service(table).unwrap_err();
+            assert!(err.contains(message), "{}: {}", table, err);
+        }
+    }
+
+    #[test]
+    fn test_tls_wildcard_domains_over_dns() {
+        let content = r#"
+[settings.tls]
+enabled = true
+wildcard_domains = ["*.apps.example.com"]
+dns_provider = "rfc2136"
+
+[settings.tls.dns]
+zone = "example.com"
+server = "10.0.0.53:53"
+tsig_key_name = "tenement"
+"#;
+        let config = Config::from_str(content).unwrap();
+        let tls = &config.settings.tls;
+        assert_eq!(tls.wildcard_domains, vec!["*.apps.example.com"]);
+        let (provider, dns) = tls.dns_challenge().unwrap();
+        assert_eq!(provider, DnsProvider::Rfc2136);
+        assert_eq!(dns.server, Some("10.0.0.53:53".parse().unwrap()));
+        assert_eq!(dns.propagation_secs, 30);
+        assert_eq!(tls.challenge, AcmeChallenge::TlsAlpn01);
+
+        let tls = |table: &str| {
+            let content = format!("[settings.tls]\n{}\n", table);
+            Config::from_str(&content).map_err(|e| format!("{:#}", e))
+        };
+        let cloudflare = "dns_provider = \"cloudflare\"\nwildcard_domains = [\"*.example.com\"]";
+        let config = tls(cloudflare).unwrap();
+        let (_, dns) = config.settings.tls.dns_challenge().unwrap();
+        assert_eq!(dns, DnsChallengeConfig::default());
+        // Caddy knows more providers than tenement issues through
+        assert!(tls("dns_provider = \"digitalocean\"").is_ok());
+        let http = Config::from_str("[settings.tls]\nchallenge = \"http-01\"\n").unwrap();
+        assert_eq!(http.settings.tls.challenge, AcmeChallenge::Http01);
+        assert!(tls("challenge = \"dns-01\"").is_err());
+        for (table, message) in [
+            ("wildcard_domains = [\"*.example.com\"]", "dns_provider"),
+            ("dns_provider = \"digitalocean\"", "need dns_provider"),
+            ("wildcard_domains = [\"apps.example.com\"]", "look like"),
+            ("wildcard_domains = [\"*.com\"]", "look like"),
+            ("dns_provider = \"route53\"", "zone_id"),
+            ("dns_provider = \"rfc2136\"", "tsig_key_name"),
+        ] {
+            let table = match table.starts_with("dns_provider") {
+                true => format!("{}\nwildcard_domains = [\"*.example.com\"]", table),
+                false => table.to_string(),
+            };
+            let err = tls(&table).unwrap_err();
+            assert!(err.contains(message), "{}: {}", table, err);
+        }
+        assert!(tls("dns_provider = \"route53\"").is_ok());
+    }
+
+    #[test]
+    fn test_preview_config() {
+        let content = r#"
+[service.app]
+command = "./app"
+preview = { domain = "apps.example.com", ttl = "2h" }
+
+[service.api]
+command = "./api"
+preview = {}
+"#;
+        let config = Config::from_str(content).unwrap();
+        let preview = config.get_service("app").unwrap().preview.clone().unwrap();
+        assert_eq!(preview.ttl, 7200);
+        assert_eq!(preview.max, 10);
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.preview, Some(PreviewConfig::default()));
+        let host = config.preview_host("pr-1.apps.example.com");
+        assert_eq!(host, Some(("app", "pr-1")));
+        assert_eq!(config.preview_host("a.pr-1.apps.example.com"), None);
+        assert_eq!(config.preview_host("apps.example.com"), None);
+
+        let service = |name: &str, table: &str| {
+            format!("[service.{}]\ncommand = \"./{}\"\n{}\n", name, name, table)
+        };
+        let shared = "preview = { domain = \"apps.example.com\" }";
+        let content = service("a", shared) + &service("b", shared);
+        let err = format!("{:#}", Config::from_str(&content).unwrap_err());
+        assert!(err.contains("same preview.domain"), "{}", err);
+        for (table, message) in [
+            ("preview = { ttl = 0 }", "at least 1"),
+            ("preview = { domain = \"apps..com\" }", "not a domain name"),
+        ] {
+            let err = format!("{:#}", Config::from_str(&service("a", table)).unwrap_err());
+            assert!(err.contains(message), "{}: {}", table, err);
+        }
+    }
+
+    #[test]
+    fn test_command_interpolated() {
+        let config_str = r#"
+[service.api]
+command = "./api --id {id} --name {name}"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        let data_dir = PathBuf::from("/data");
+
+        let cmd = api.command_interpolated("api", "user123", &data_dir, None);
+        assert_eq!(cmd, "./api --id user123 --name api");
+    }
+
+    #[test]
+    fn test_args_interpolated() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+args = ["--socket", "{socket}", "--data", "{data_dir}/{id}"]
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        let data_dir = PathBuf::from("/data");
+
+        let args = api.args_interpolated("api", "user123", &data_dir, None);
+        assert_eq!(args.len(), 4);
+        assert_eq!(args[0], "--socket");
+        assert_eq!(args[1], "/tmp/tenement/api-user123.sock");
+        assert_eq!(args[2], "--data");
+        assert_eq!(args[3], "/data/user123");
+    }
+
+    #[test]
+    fn test_load_from_path() {
+        use std::io::Write;
+
+        let dir = tempfile::tempdir().unwrap();
+        let config_path = dir.path().join("tenement.toml");
+
+        let config_content = r#"
+[service.api]
+command = "./api"
+"#;
+        let mut file = std::fs::File::create(&config_path).unwrap();
+        file.write_all(config_content.as_bytes()).unwrap();
+
+        let config = Config::load_from_path(&config_path).unwrap();
+        assert!(config.get_service("api").is_some());
+    }
+
+    #[test]
+    fn test_reread_picks_up_changes() {
+        let dir = tempfile::tempdir().unwrap();
+        let config_path = dir.path().join("tenement.toml");
+        std::fs::write(&config_path, "[service.api]\ncommand = \"./api\"\n").unwrap();
+
+        let config = Config::load_from_path(&config_path).unwrap();
+        assert_eq!(config.source.as_deref(), Some(config_path.as_path()));
+
+        std::fs::write(&config_path, "[service.web]\ncommand = \"./web\"\n").unwrap();
+        let reread = config.reread().unwrap();
+        assert!(reread.get_service("api").is_none());
+        assert!(reread.get_service("web").is_some());
+
+        let err = Config::default().reread().unwrap_err();
+        assert!(err.to_string().contains("nothing to reload"));
+    }
+
+    #[test]
+    fn test_load_from_nonexistent_path() {
+        let result = Config::load_from_path(std::path::Path::new("/nonexistent/tenement.toml"));
+        assert!(result.is_err());
+    }
+
+    #[test]
+    fn test_invalid_toml() {
+        use std::io::Write;
+
+        let dir = tempfile::tempdir().unwrap();
+        let config_path = dir.path().join("tenement.toml");
+
+        let config_content = "this is not valid toml [[[";
+        let mut file = std::fs::File::create(&config_path).unwrap();
+        file.write_all(config_content.as_bytes()).unwrap();
+
+        let result = Config::load_from_path(&config_path);
+        assert!(result.is_err());
+    }
+
+    #[test]
+    fn test_apply_data_dir_override_no_override_keeps_default() {
+        let mut config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        assert_eq!(config.settings.data_dir, PathBuf::from("./tenement-data"));
+
+        config.apply_data_dir_override(None).unwrap();
+        assert_eq!(config.settings.data_dir, PathBuf::from("./tenement-data"));
+    }
+
+    #[test]
+    fn test_apply_data_dir_override_no_override_keeps_toml_value() {
+        let toml = r#"
+[settings]
+data_dir = "/opt/tenement"
+[service.api]
+command = "./api"
+"#;
+        let mut config = Config::from_str(toml).unwrap();
+
+        config.apply_data_dir_override(None).unwrap();
+        assert_eq!(config.settings.data_dir, PathBuf::from("/opt/tenement"));
+    }
+
+    #[test]
+    fn test_apply_data_dir_override_replaces_default() {
+        let mut config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+
+        config
+            .apply_data_dir_override(Some(PathBuf::from("/tmp/x")))
+            .unwrap();
+        assert_eq!(config.settings.data_dir, PathBuf::from("/tmp/x"));
+    }
+
+    #[test]
+    fn test_apply_data_dir_override_beats_toml_value() {
+        let toml = r#"
+[settings]
+data_dir = "/opt/tenement"
+[service.api]
+command = "./api"
+"#;
+        let mut config = Config::from_str(toml).unwrap();
+
+        config
+            .apply_data_dir_override(Some(PathBuf::from("/tmp/from-flag")))
+            .unwrap();
+        assert_eq!(config.settings.data_dir, PathBuf::from("/tmp/from-flag"));
+    }
+
+    #[test]
+    fn test_apply_data_dir_override_rejects_tilde_in_flag() {
+        let mut config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+
+        let err = config
+            .apply_data_dir_override(Some(PathBuf::from("~/foo")))
+            .unwrap_err();
+        let msg = format!("{:#}", err);
+        assert!(msg.contains("--data-dir"), "got: {}", msg);
+        assert!(msg.contains("~"), "got: {}", msg);
+        // Original data_dir is unchanged.
+        assert_eq!(config.settings.data_dir, PathBuf::from("./tenement-data"));
+    }
+
+    #[test]
+    fn test_apply_data_dir_override_rejects_tilde_in_toml() {
+        let toml = r#"
+[settings]
+data_dir = "~/tenement"
+[service.api]
+command = "./api"
+"#;
+        let mut config = Config::from_str(toml).unwrap();
+
+        let err = config.apply_data_dir_override(None).unwrap_err();
+        let msg = format!("{:#}", err);
+        assert!(msg.contains("tenement.toml"), "got: {}", msg);
+    }
+
+    #[test]
+    fn test_apply_data_dir_override_user_tilde_form_rejected() {
+        // ~user/foo style is also rejected (we don't know how to resolve it).
+        let mut config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+
+        let err = config
+            .apply_data_dir_override(Some(PathBuf::from("~russell/foo")))
+            .unwrap_err();
+        assert!(format!("{:#}", err).contains("--data-dir"));
+    }
+
+    #[test]
+    fn test_settings_clone() {
+        let settings = Settings::default();
+        let cloned = settings.clone();
+        assert_eq!(settings.data_dir, cloned.data_dir);
+        assert_eq!(settings.health_check_interval, cloned.health_check_interval);
+    }
+
+    #[test]
+    fn test_config_clone() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let cloned = config.clone();
+        assert_eq!(config.service.len(), cloned.service.len());
+    }
+
+    #[test]
+    fn test_service_config_clone() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+health = "/health"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        let cloned = api.clone();
+        assert_eq!(api.command, cloned.command);
+        assert_eq!(api.health, cloned.health);
+    }
+
+    #[test]
+    fn test_firecracker_config_with_isolation() {
+        // Test new 'isolation' field name
+        let config_str = r#"
+[service.secure]
+isolation = "firecracker"
+command = "./worker"
+kernel = "/var/lib/tenement/vmlinux"
+rootfs = "/var/lib/tenement/worker.ext4"
+memory_mb = 512
+vcpus = 2
+vsock_port = 6000
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let secure = config.get_service("secure").unwrap();
+
+        assert_eq!(secure.isolation, RuntimeType::Firecracker);
+        assert_eq!(
+            secure.kernel,
+            Some(PathBuf::from("/var/lib/tenement/vmlinux"))
+        );
+        assert_eq!(
+            secure.rootfs,
+            Some(PathBuf::from("/var/lib/tenement/worker.ext4"))
+        );
+        assert_eq!(secure.memory_mb, 512);
+        assert_eq!(secure.vcpus, 2);
+        assert_eq!(secure.vsock_port, 6000);
+
+        // Validation should pass
+        assert!(secure.validate("secure").is_ok());
+    }
+
+    #[test]
+    fn test_firecracker_defaults() {
+        let config_str = r#"
+[service.secure]
+isolation = "firecracker"
+command = "./worker"
+kernel = "/vmlinux"
+rootfs = "/rootfs.ext4"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let secure = config.get_service("secure").unwrap();
+
+        assert_eq!(secure.memory_mb, 256);
+        assert_eq!(secure.vcpus, 1);
+        assert_eq!(secure.vsock_port, 5000);
+    }
+
+    #[test]
+    fn test_firecracker_validation_missing_kernel() {
+        let config_str = r#"
+[service.secure]
+isolation = "firecracker"
+command = "./worker"
+rootfs = "/rootfs.ext4"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let secure = config.get_service("secure").unwrap();
+
+        let result = secure.validate("secure");
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("kernel"));
+    }
+
+    #[test]
+    fn test_firecracker_validation_missing_rootfs() {
+        let config_str = r#"
+[service.secure]
+isolation = "firecracker"
+command = "./worker"
+kernel = "/vmlinux"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let secure = config.get_service("secure").unwrap();
+
+        let result = secure.validate("secure");
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("rootfs"));
+    }
+
+    #[test]
+    fn test_secrets_and_reload_signal() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+reload_signal = "SIGHUP"
+
+[service.api.secrets]
+DB_PASSWORD = "/run/secrets/db"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(
+            api.secrets.get("DB_PASSWORD"),
+            Some(&SecretSource::File(PathBuf::from("/run/secrets/db")))
+        );
+        assert_eq!(api.reload_signal, Some("SIGHUP".to_string()));
+        assert!(api.validate("api").is_ok());
+    }
+
+    #[test]
+    fn test_secrets_from_store() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+secrets = ["DATABASE_URL", "API_KEY"]
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.secrets.len(), 2);
+        assert_eq!(api.secrets.get("DATABASE_URL"), Some(&SecretSource::Store));
+        assert!(api.redactor().is_sensitive("DATABASE_URL"));
     }
 
-    /// Get interpolated command
-    pub fn command_interpolated(
-        &self,
-        name: &str,
-        id: &str,
-        data_dir: &Path,
-        port: Option<u16>,
-    ) -> String {
-        self.interpolate(&self.command, name, id, data_dir, port)
-    }
+    #[test]
+    fn test_required_env_config() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+required_env = ["DATABASE_URL", "API_KEY"]
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.required_env, vec!["DATABASE_URL", "API_KEY"]);
 
-    /// Get interpolated args
-    pub fn args_interpolated(
-        &self,
-        name: &str,
-        id: &str,
-        data_dir: &Path,
-        port: Option<u16>,
-    ) -> Vec<String> {
-        self.args
-            .iter()
-            .map(|arg| self.interpolate(arg, name, id, data_dir, port))
-            .collect()
-    }
+        assert!(api.validate("api").is_ok());
 
-    /// Get interpolated environment variables
-    pub fn env_interpolated(
-        &self,
-        name: &str,
-        id: &str,
-        data_dir: &Path,
-        port: Option<u16>,
-    ) -> HashMap<String, String> {
-        self.env
-            .iter()
-            .map(|(k, v)| (k.clone(), self.interpolate(v, name, id, data_dir, port)))
-            .collect()
+        let bad = config_str.replace("\"API_KEY\"", "\"API_KEY=1\"");
+        let config = Config::from_str(&bad).unwrap();
+        let err = config.get_service("api").unwrap().validate("api").unwrap_err();
+        assert!(format!("{:#}", err).contains("invalid required_env name"));
     }
-}
 
-#[cfg(test)]
-mod tests {
-    use super::*;
+    #[test]
+    fn test_env_files_layered_under_inline_env() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+env_files = [".env", "secrets.env"]
+
+[service.api.env]
+LEVEL = "debug"
+URL = "postgres://${HOST}/{id}"
+"#,
+        )
+        .unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(
+            api.env_files,
+            vec![PathBuf::from(".env"), PathBuf::from("secrets.env")]
+        );
+
+        let mut file_env = HashMap::new();
+        file_env.insert("LEVEL".to_string(), "info".to_string());
+        file_env.insert("HOST".to_string(), "db".to_string());
+        let env = api.env_interpolated(file_env, "api", "prod", Path::new("/data"), None);
+        assert_eq!(env["LEVEL"], "debug");
+        assert_eq!(env["HOST"], "db");
+        assert_eq!(env["URL"], "postgres://db/prod");
+    }
 
     #[test]
-    fn test_parse_minimal_config() {
+    fn test_missing_required_env() {
         let config_str = r#"
 [service.api]
-command = "./api-server"
+command = "./api"
+required_env = ["DATABASE_URL", "EMPTY", "PATH", "TENEMENT_TEST_SURELY_UNSET"]
 "#;
         let config = Config::from_str(config_str).unwrap();
-
-        assert!(config.service.contains_key("api"));
         let api = config.get_service("api").unwrap();
-        assert_eq!(api.command, "./api-server");
-        assert_eq!(api.socket, "/tmp/tenement/{name}-{id}.sock");
+        let mut env = HashMap::new();
+        env.insert("DATABASE_URL".to_string(), "sqlite://db".to_string());
+        env.insert("EMPTY".to_string(), String::new());
+
+        // PATH comes from tenement's environment only when the instance inherits it
+        assert_eq!(
+            api.missing_required_env(&env, true),
+            vec!["EMPTY", "TENEMENT_TEST_SURELY_UNSET"]
+        );
+        assert_eq!(
+            api.missing_required_env(&env, false),
+            vec!["EMPTY", "PATH", "TENEMENT_TEST_SURELY_UNSET"]
+        );
     }
 
     #[test]
-    fn test_parse_full_config() {
-        let config_str = r#"
+    fn test_health_webhook_config() {
+        let config = Config::from_str(
+            "[settings.health_webhook]\nurl = \"https://alerts.example.com/hook\"\n",
+        )
+        .unwrap();
+        let webhook = config.settings.health_webhook.unwrap();
+        assert_eq!(webhook.url, "https://alerts.example.com/hook");
+        assert_eq!(webhook.timeout_ms, 5000);
+        assert_eq!(webhook.max_retries, 3);
+        assert_eq!(webhook.retry_backoff_ms, 500);
+        assert!(Config::default().settings.health_webhook.is_none());
+
+        let err = Config::from_str("[settings.health_webhook]\nurl = \"alerts.example.com\"\n")
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("must start with http:// or https://"), "{}", err);
+        let err = Config::from_str(
+            "[settings.health_webhook]\nurl = \"http://localhost/hook\"\ntimeout_ms = 0\n",
+        )
+        .unwrap_err()
+        .to_string();
+        assert!(err.contains("timeout_ms must be at least 1"), "{}", err);
+    }
+
+    #[test]
+    fn test_log_files_config() {
+        assert!(Config::default().settings.log_files.is_none());
+        assert!(Config::default().settings.log_dir().is_none());
+
+        let config = Config::from_str(
+            "[settings]\ndata_dir = \"/var/lib/tenement\"\n\n[settings.log_files]\n",
+        )
+        .unwrap();
+        let log_files = config.settings.log_files.as_ref().unwrap();
+        assert_eq!(log_files.max_size_mb, 10);
+        assert_eq!(log_files.max_age, None);
+        assert_eq!(log_files.keep, 5);
+        assert!(log_files.compress);
+        assert_eq!(config.settings.log_dir(), Some(PathBuf::from("/var/lib/tenement/logs")));
+
+        let config = Config::from_str(
+            r#"
+[settings.log_files]
+dir = "/var/log/tenement"
+max_size_mb = 50
+max_age = "1d"
+keep = 2
+compress = false
+"#,
+        )
+        .unwrap();
+        let log_files = config.settings.log_files.as_ref().unwrap();
+        assert_eq!(log_files.max_age, Some(86400));
+        assert_eq!(log_files.keep, 2);
+        assert!(!log_files.compress);
+        assert_eq!(config.settings.log_dir(), Some(PathBuf::from("/var/log/tenement")));
+
+        let err = Config::from_str("[settings.log_files]\nmax_size_mb = 0\n")
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("max_size_mb must be at least 1"), "{}", err);
+    }
+
+    #[test]
+    fn test_access_log_config() {
+        let config = Config::from_str(
+            r#"
 [settings]
-data_dir = "/data/tenement"
-health_check_interval = 30
+data_dir = "/var/lib/tenement"
+
+[settings.access_log]
 
 [service.api]
 command = "./api"
-args = ["--port", "8080"]
-socket = "/tmp/api-{id}.sock"
-health = "/health"
-restart = "always"
 
-[service.api.env]
-DATABASE_PATH = "{data_dir}/{id}/app.db"
-LOG_LEVEL = "info"
+[service.web]
+command = "./web"
 
-[routing]
-default = "api"
+[service.web.access_log]
+format = "json"
+output = "stdout"
+"#,
+        )
+        .unwrap();
+        let global = config.settings.access_log.as_ref().unwrap();
+        assert_eq!(global.format, AccessLogFormat::Common);
+        assert_eq!(global.output, AccessLogOutput::File);
+        assert_eq!(
+            global.dir(&config.settings.data_dir),
+            PathBuf::from("/var/lib/tenement/logs/access")
+        );
+        assert_eq!(global.rotation().max_size_mb, 10);
+        assert!(config.service["api"].access_log.is_none());
+        let web = config.service["web"].access_log.as_ref().unwrap();
+        assert_eq!(web.format, AccessLogFormat::Json);
+        assert_eq!(web.output, AccessLogOutput::Stdout);
+
+        let err = Config::from_str(
+            "[service.api]\ncommand = \"./api\"\n\n[service.api.access_log]\nmax_age = 0\n",
+        )
+        .unwrap_err()
+        .to_string();
+        assert!(err.contains("Service 'api' access_log max_age"), "{}", err);
+        assert!(Config::from_str("[settings.access_log]\nformat = \"xml\"\n").is_err());
+    }
 
-[routing.subdomain]
-"api.example.com" = "api"
-"*.example.com" = "api"
-"#;
-        let config = Config::from_str(config_str).unwrap();
+    #[test]
+    fn test_tracing_config() {
+        assert!(Config::default().settings.tracing.is_none());
+
+        let config = Config::from_str(
+            r#"
+[settings.tracing]
+endpoint = "http://otel-collector:4318"
+
+[settings.tracing.headers]
+x-honeycomb-team = "secret"
+"#,
+        )
+        .unwrap();
+        let tracing = config.settings.tracing.as_ref().unwrap();
+        assert_eq!(tracing.endpoint, "http://otel-collector:4318");
+        assert_eq!(tracing.service_name, "tenement");
+        assert_eq!(tracing.sample_ratio, 1.0);
+        assert_eq!(tracing.headers["x-honeycomb-team"], "secret");
+
+        let err = Config::from_str("[settings.tracing]\nendpoint = \"otel:4318\"\n")
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("must start with http://"), "{}", err);
+        let err = Config::from_str(
+            "[settings.tracing]\nendpoint = \"http://otel:4318\"\nsample_ratio = 1.5\n",
+        )
+        .unwrap_err()
+        .to_string();
+        assert!(err.contains("sample_ratio must be between 0 and 1"), "{}", err);
+    }
 
-        assert_eq!(config.settings.data_dir, PathBuf::from("/data/tenement"));
-        assert_eq!(config.settings.health_check_interval, 30);
+    #[test]
+    fn test_cluster_config() {
+        assert!(Config::default().settings.cluster.is_none());
+        let config = Config::from_str(
+            r#"
+[settings.cluster]
+node = "a"
+advertise = "10.0.0.1:8080"
+mode = "standby"
+heartbeat = "1s"
+peers = [{ node = "b", address = "10.0.0.2:8080" }]
+"#,
+        )
+        .unwrap();
+        let cluster = config.settings.cluster.unwrap();
+        assert_eq!(cluster.mode, ClusterMode::Standby);
+        assert_eq!(cluster.heartbeat, 1);
+        assert_eq!(cluster.failure_timeout, 10);
+        assert_eq!(cluster.token_env, "TENEMENT_CLUSTER_TOKEN");
+        assert_eq!(cluster.peers[0].address, "10.0.0.2:8080");
+
+        let peer = |node: &str, address: &str| {
+            format!(
+                "advertise = \"h:1\"\npeers = [{{ node = {:?}, address = {:?} }}]",
+                node, address
+            )
+        };
+        let cases = [
+            (
+                "advertise = \"10.0.0.1\"".to_string(),
+                "advertise must be host:port",
+            ),
+            (peer("a", "x:1"), "is this node"),
+            (peer("b", "x"), "address must be host:port"),
+            (
+                peer("b", "x:1") + "\nheartbeat = 2\nfailure_timeout = 1",
+                "longer than heartbeat",
+            ),
+        ];
+        for (extra, expected) in cases {
+            let toml = format!("[settings.cluster]\nnode = \"a\"\n{}\n", extra);
+            let err = Config::from_str(&toml).unwrap_err().to_string();
+            assert!(err.contains(expected), "{}: {}", extra, err);
+        }
 
-        let api = config.get_service("api").unwrap();
-        assert_eq!(api.command, "./api");
-        assert_eq!(api.args, vec!["--port", "8080"]);
-        assert_eq!(api.health, Some("/health".to_string()));
-        assert_eq!(api.restart, "always");
-        assert_eq!(api.env.get("LOG_LEVEL"), Some(&"info".to_string()));
+        let err = Config::from_str(
+            r#"
+[settings.tls]
+enabled = true
+acme_email = "ops@example.com"
+domain = "example.com"
+
+[settings.cluster]
+node = "a"
+advertise = "10.0.0.1:8080"
+"#,
+        )
+        .unwrap_err()
+        .to_string();
+        assert!(err.contains("combined with [settings.tls]"), "{}", err);
+    }
 
-        assert_eq!(config.routing.default, Some("api".to_string()));
+    #[test]
+    fn test_discovery_config() {
+        assert!(Config::default().settings.discovery.is_none());
+        let config = Config::from_str("[settings.discovery]\n").unwrap();
+        let discovery = config.settings.discovery.unwrap();
+        assert_eq!(discovery, DiscoveryConfig::default());
+
+        let config = Config::from_str(
+            r#"
+[settings.discovery]
+domain = "svc.internal"
+hosts_file = "/etc/hosts"
+"#,
+        )
+        .unwrap();
+        let discovery = config.settings.discovery.unwrap();
+        assert_eq!(discovery.domain, "svc.internal");
+        assert_eq!(discovery.hosts_file, Some(PathBuf::from("/etc/hosts")));
+
+        for domain in ["", ".local", "a..local", "bad_domain"] {
+            let toml = format!("[settings.discovery]\ndomain = {:?}\n", domain);
+            let err = Config::from_str(&toml).unwrap_err().to_string();
+            assert!(err.contains("is not a domain name"), "{}: {}", domain, err);
+        }
     }
 
     #[test]
-    fn test_interpolation() {
-        let config_str = r#"
+    fn test_replicas_and_load_balance() {
+        let config = Config::from_str(
+            r#"
 [service.api]
 command = "./api"
-socket = "/tmp/tenement/{name}-{id}.sock"
+replicas = 3
+load_balance = "least-connections"
 
-[service.api.env]
-DB = "{data_dir}/{id}/app.db"
-SOCKET = "{socket}"
-"#;
-        let config = Config::from_str(config_str).unwrap();
+[service.web]
+command = "./web"
+"#,
+        )
+        .unwrap();
         let api = config.get_service("api").unwrap();
+        assert_eq!(api.replicas, 3);
+        assert_eq!(api.load_balance, LoadBalance::LeastConnections);
+        assert_eq!(api.replica_ids("prod"), vec!["prod-0", "prod-1", "prod-2"]);
+        assert_eq!(api.replica_index("prod-2"), Some(2));
+        assert!(api.replica_ids("prod-2").is_empty());
+        assert_eq!(api.replica_index("prod-3"), None);
+        assert_eq!(api.replica_index("-1"), None);
 
-        let data_dir = PathBuf::from("/var/lib/tenement");
+        let web = config.get_service("web").unwrap();
+        assert_eq!(web.replicas, 1);
+        assert_eq!(web.load_balance, LoadBalance::Weighted);
+        assert!(web.replica_ids("prod").is_empty());
+        assert_eq!(web.replica_index("prod-0"), None);
 
-        let socket = api.socket_path("api", "user123");
-        assert_eq!(socket, PathBuf::from("/tmp/tenement/api-user123.sock"));
+        let err = Config::from_str("[service.api]\ncommand = \"./api\"\nreplicas = 0\n")
+            .unwrap_err();
+        assert!(err.to_string().contains("replicas must be at least 1"), "{}", err);
+        let bad = "[service.api]\ncommand = \"./api\"\nload_balance = \"random\"\n";
+        assert!(Config::from_str(bad).is_err());
+    }
 
-        let env = api.env_interpolated("api", "user123", &data_dir, None);
-        assert_eq!(
-            env.get("DB"),
-            Some(&"/var/lib/tenement/user123/app.db".to_string())
-        );
+    #[test]
+    fn test_autoscale_config() {
+        let parse = |table: &str| {
+            let content = format!(
+                "[service.api]\ncommand = \"./api\"\n[service.api.autoscale]\n{}",
+                table
+            );
+            Config::from_str(&content).map(|c| c.service["api"].clone())
+        };
+
+        let api = parse("max = 4\nmetric = \"rps\"\ntarget = 50\ninterval = \"1m\"\n").unwrap();
+        let autoscale = api.autoscale.clone().unwrap();
+        assert_eq!(autoscale.min, 1);
+        assert_eq!(autoscale.metric, AutoscaleMetric::Rps);
+        let secs = std::time::Duration::from_secs;
+        assert_eq!(autoscale.interval(), secs(60));
+        assert_eq!(autoscale.cooldown(true), secs(60));
+        assert_eq!(autoscale.cooldown(false), secs(300));
+        // Even at one replica it runs as one, so scaling never renames it
+        assert_eq!(api.replicas, 1);
+        assert_eq!(api.replica_ids("prod"), vec!["prod-0"]);
+        assert_eq!(api.replica_index("prod-3"), Some(3));
+        assert_eq!(api.replica_index("prod-4"), None);
+
+        // Starts at `replicas`, within min..max
+        let api = parse("min = 2\nmax = 4\nmetric = \"cpu\"\ntarget = 60\n").unwrap();
+        assert_eq!(api.replicas, 2);
+        let autoscale = api.autoscale.unwrap();
+        assert_eq!(autoscale.desired_replicas(2, 120.0), 4);
+        assert_eq!(autoscale.desired_replicas(2, 200.0), 4);
+        assert_eq!(autoscale.desired_replicas(4, 20.0), 2);
+        assert_eq!(autoscale.desired_replicas(3, 63.0), 3);
+        assert_eq!(autoscale.desired_replicas(3, 81.0), 4);
+
+        for (table, expected) in [
+            ("max = 1\ntarget = 5\n", "max above min"),
+            ("min = 0\nmax = 2\ntarget = 5\n", "max above min"),
+            ("max = 2\ntarget = 0\n", "autoscale.target"),
+            ("max = 2\ntarget = 5\ninterval = 0\n", "autoscale.interval"),
+        ] {
+            let err = parse(&format!("metric = \"rps\"\n{}", table)).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}", err);
+        }
+        assert!(parse("max = 2\nmetric = \"memory\"\ntarget = 5\n").is_err());
+    }
+
+    #[test]
+    fn test_admin_socket_path() {
+        let config = Config::from_str("[settings]\ndata_dir = \"/var/lib/ten\"\n").unwrap();
+        assert_eq!(config.settings.admin_socket_path(), PathBuf::from("/var/lib/ten/admin.sock"));
+
+        let config = Config::from_str("[settings]\nadmin_socket = \"/run/ten.sock\"\n").unwrap();
+        assert_eq!(config.settings.admin_socket_path(), PathBuf::from("/run/ten.sock"));
+    }
+
+    #[test]
+    fn test_dashboard_config() {
+        let dashboard = Config::default().settings.dashboard;
+        assert!(dashboard.on_public_listener());
+        assert_eq!(dashboard.admin_listen(), None);
+
+        let config =
+            Config::from_str("[settings.dashboard]\nlisten = \"127.0.0.1:9000\"\n").unwrap();
+        let dashboard = config.settings.dashboard;
+        assert!(!dashboard.on_public_listener());
         assert_eq!(
-            env.get("SOCKET"),
-            Some(&"/tmp/tenement/api-user123.sock".to_string())
+            dashboard.admin_listen(),
+            Some("127.0.0.1:9000".parse().unwrap())
         );
+
+        let config = Config::from_str(
+            "[settings.dashboard]\nenabled = false\nlisten = \"127.0.0.1:9000\"\n",
+        )
+        .unwrap();
+        assert!(!config.settings.dashboard.on_public_listener());
+        assert_eq!(config.settings.dashboard.admin_listen(), None);
     }
 
     #[test]
-    fn test_default_settings() {
+    fn test_metrics_listen_config() {
+        let config = Config::from_str("[settings]\nmetrics_listen = \"127.0.0.1:9100\"\n").unwrap();
+        assert_eq!(config.settings.metrics_listen, Some("127.0.0.1:9100".parse().unwrap()));
+        assert!(Config::default().settings.metrics_listen.is_none());
+
+        let err = Config::from_str("[settings]\nmetrics_listen = \"localhost\"\n").unwrap_err();
+        assert!(format!("{:#}", err).contains("metrics_listen"), "{:#}", err);
+    }
+
+    #[test]
+    fn test_port_range_config() {
+        assert_eq!(Config::default().settings.port_range, (30000, 40000));
+        let config = Config::from_str("[settings]\nport_range = [20000, 20999]\n").unwrap();
+        assert_eq!(config.settings.port_range, (20000, 20999));
+
+        for range in ["[2000, 1000]", "[0, 1000]"] {
+            let toml = format!("[settings]\nport_range = {}\n", range);
+            let err = Config::from_str(&toml).unwrap_err();
+            assert!(err.to_string().contains("port_range"), "{}", err);
+        }
+    }
+
+    #[test]
+    fn test_drain_file_config() {
+        let config =
+            Config::from_str("[settings]\ndrain_file = \"/run/tenement/drain\"\n").unwrap();
+        assert_eq!(config.settings.drain_file, Some(PathBuf::from("/run/tenement/drain")));
+        assert!(Config::default().settings.drain_file.is_none());
+    }
+
+    #[test]
+    fn test_post_stop_config() {
+        let config = Config::from_str(
+            "[service.api]\ncommand = \"./api\"\npost_stop = \"rm -f /tmp/api.lock\"\n",
+        )
+        .unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.post_stop.as_deref(), Some("rm -f /tmp/api.lock"));
+        assert_eq!(api.post_stop_timeout, 10);
+
+        for bad in ["post_stop = \" \"", "post_stop = \"true\"\npost_stop_timeout = 0"] {
+            let content = format!("[service.api]\ncommand = \"./api\"\n{}\n", bad);
+            assert!(Config::from_str(&content).is_err(), "{}", bad);
+        }
+    }
+
+    #[test]
+    fn test_stop_config() {
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        let api = config.get_service("api").unwrap();
+        assert!(api.stop_signal.is_none());
+        assert_eq!(api.stop_timeout(), std::time::Duration::from_secs(10));
+        assert!(api.stop_process_group);
+
         let config_str = r#"
 [service.api]
-command = "./api"
+command = "gunicorn app:app"
+stop_signal = "SIGQUIT"
+stop_timeout = "30s"
+stop_process_group = false
 "#;
         let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.stop_signal.as_deref(), Some("SIGQUIT"));
+        assert_eq!(api.stop_timeout(), std::time::Duration::from_secs(30));
+        assert!(!api.stop_process_group);
+    }
 
-        assert_eq!(config.settings.data_dir, PathBuf::from("./tenement-data"));
-        assert_eq!(config.settings.health_check_interval, 10);
-        assert_eq!(config.settings.max_restarts, 3);
-        assert_eq!(config.settings.restart_window, 300);
+    #[cfg(unix)]
+    #[test]
+    fn test_invalid_stop_signal() {
+        for bad in ["\"SIGSTOP\"", "\"0\"", "\"99\""] {
+            let content = format!(
+                "[service.api]\ncommand = \"./api\"\nstop_signal = {}\n",
+                bad
+            );
+            let err = Config::from_str(&content).unwrap_err();
+            assert!(format!("{:#}", err).contains("stop_signal"), "{}", bad);
+        }
     }
 
     #[test]
-    fn test_multiple_services() {
+    fn test_redact_env_config() {
         let config_str = r#"
 [service.api]
 command = "./api"
+redact_env = ["DATABASE_URL", "SENTRY_*"]
 
-[service.worker]
-command = "./worker"
-socket = "/tmp/worker-{id}.sock"
-
-[service.scheduler]
-command = "./scheduler"
+[service.api.secrets]
+LICENSE = "/etc/api/license"
 "#;
         let config = Config::from_str(config_str).unwrap();
+        let redactor = config.get_service("api").unwrap().redactor();
+        assert!(redactor.is_sensitive("DATABASE_URL"));
+        assert!(redactor.is_sensitive("SENTRY_DSN"));
+        assert!(redactor.is_sensitive("LICENSE"), "secrets are always redacted");
+        assert!(redactor.is_sensitive("STRIPE_SECRET"), "auto-detection still applies");
+        assert!(!redactor.is_sensitive("PORT"));
+
+        let err = Config::from_str("[service.api]\ncommand = \"./api\"\nredact_env = [\" \"]\n")
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("empty redact_env entry"), "{}", err);
+    }
 
-        assert_eq!(config.service.len(), 3);
-        assert!(config.get_service("api").is_some());
-        assert!(config.get_service("worker").is_some());
-        assert!(config.get_service("scheduler").is_some());
-        assert!(config.get_service("nonexistent").is_none());
+    #[test]
+    fn test_env_port_or_socket_path_rejected() {
+        for var in ["PORT", "SOCKET_PATH"] {
+            let config_str = format!(
+                "[service.api]\ncommand = \"./api\"\n\n[service.api.env]\n{} = \"8080\"\n",
+                var
+            );
+            let err = Config::from_str(&config_str).unwrap_err().to_string();
+            assert!(err.contains(&format!("sets {} in [service.api.env]", var)), "{}", err);
+        }
     }
 
     #[test]
-    fn test_service_with_workdir() {
+    fn test_custom_socket_with_tcp_runtime_still_loads() {
+        // The port takes precedence; the socket is only a warning
         let config_str = r#"
 [service.api]
 command = "./api"
-workdir = "/var/app"
+isolation = "process"
+socket = "/tmp/api-{id}.sock"
 "#;
         let config = Config::from_str(config_str).unwrap();
         let api = config.get_service("api").unwrap();
-        assert_eq!(api.workdir, Some(PathBuf::from("/var/app")));
+        assert!(api.isolation.uses_tcp_port());
+        assert!(!RuntimeType::Firecracker.uses_tcp_port());
+        assert!(api.listen_addr("api", "a", Some(31000)).is_tcp());
     }
 
     #[test]
-    fn test_service_restart_policies() {
-        let config_str = r#"
-[service.always]
-command = "./always"
-restart = "always"
-
-[service.never]
-command = "./never"
-restart = "never"
-
-[service.default]
-command = "./default"
-"#;
-        let config = Config::from_str(config_str).unwrap();
-
-        assert_eq!(config.get_service("always").unwrap().restart, "always");
-        assert_eq!(config.get_service("never").unwrap().restart, "never");
-        assert_eq!(config.get_service("default").unwrap().restart, "on-failure");
+    fn test_secrets_default_empty() {
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        let api = config.get_service("api").unwrap();
+        assert!(api.secrets.is_empty());
+        assert!(api.reload_signal.is_none());
     }
 
+    #[cfg(unix)]
     #[test]
-    fn test_routing_config() {
+    fn test_invalid_reload_signal() {
         let config_str = r#"
 [service.api]
 command = "./api"
-
-[routing]
-default = "api"
-
-[routing.subdomain]
-"api.example.com" = "api"
-"*.tenant.example.com" = "api"
-
-[routing.path]
-"/api" = "api"
-"/health" = "api"
+reload_signal = "SIGKILL"
 "#;
         let config = Config::from_str(config_str).unwrap();
-
-        assert_eq!(config.routing.default, Some("api".to_string()));
-        assert_eq!(config.routing.subdomain.len(), 2);
-        assert_eq!(config.routing.path.len(), 2);
-        assert_eq!(config.routing.path.get("/api"), Some(&"api".to_string()));
+        let err = config.get_service("api").unwrap().validate("api").unwrap_err();
+        assert!(format!("{:#}", err).contains("reload_signal"));
     }
 
     #[test]
-    fn test_empty_routing() {
+    fn test_fault_config_parsing() {
         let config_str = r#"
+[settings]
+fault_injection = true
+
 [service.api]
 command = "./api"
+
+[service.api.fault]
+delay_ms = 250
+delay_percent = 10.0
+abort_status = 503
+abort_percent = 5.0
+kill_interval_secs = 60
 "#;
         let config = Config::from_str(config_str).unwrap();
+        assert!(config.settings.fault_injection);
+        let fault = config.get_service("api").unwrap().fault.clone().unwrap();
+        assert_eq!(fault.delay_ms, 250);
+        assert_eq!(fault.delay_percent, 10.0);
+        assert_eq!(fault.abort_status, Some(503));
+        assert_eq!(fault.abort_percent, 5.0);
+        assert_eq!(fault.kill_interval_secs, 60);
+    }
 
-        assert!(config.routing.default.is_none());
-        assert!(config.routing.subdomain.is_empty());
-        assert!(config.routing.path.is_empty());
+    #[test]
+    fn test_fault_injection_off_by_default() {
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        assert!(!config.settings.fault_injection);
+        assert!(config.get_service("api").unwrap().fault.is_none());
     }
 
     #[test]
-    fn test_command_interpolated() {
-        let config_str = r#"
-[service.api]
-command = "./api --id {id} --name {name}"
-"#;
-        let config = Config::from_str(config_str).unwrap();
+    fn test_launch_command_direct_by_default() {
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
         let api = config.get_service("api").unwrap();
-        let data_dir = PathBuf::from("/data");
-
-        let cmd = api.command_interpolated("api", "user123", &data_dir, None);
-        assert_eq!(cmd, "./api --id user123 --name api");
+        assert!(api.shell.is_none());
+        let (cmd, args) = api.launch_command("./api".to_string(), vec!["--port".to_string()]);
+        assert_eq!(cmd, "./api");
+        assert_eq!(args, vec!["--port"]);
     }
 
     #[test]
-    fn test_args_interpolated() {
+    fn test_launch_command_login_shell() {
         let config_str = r#"
 [service.api]
-command = "./api"
-args = ["--socket", "{socket}", "--data", "{data_dir}/{id}"]
+command = "bundle exec rails s"
+shell = "sh"
 "#;
         let config = Config::from_str(config_str).unwrap();
         let api = config.get_service("api").unwrap();
-        let data_dir = PathBuf::from("/data");
-
-        let args = api.args_interpolated("api", "user123", &data_dir, None);
-        assert_eq!(args.len(), 4);
-        assert_eq!(args[0], "--socket");
-        assert_eq!(args[1], "/tmp/tenement/api-user123.sock");
-        assert_eq!(args[2], "--data");
-        assert_eq!(args[3], "/data/user123");
+        let (cmd, args) = api.launch_command(
+            "bundle".to_string(),
+            vec!["exec".to_string(), "it's here".to_string()],
+        );
+        assert_eq!(cmd, "sh");
+        assert_eq!(args, vec!["-lc", "exec bundle exec 'it'\\''s here'"]);
     }
 
     #[test]
-    fn test_load_from_path() {
-        use std::io::Write;
+    fn test_empty_shell_rejected() {
+        let config_str = "[service.api]\ncommand = \"./api\"\nshell = \" \"\n";
+        let config = Config::from_str(config_str).unwrap();
+        let err = config.get_service("api").unwrap().validate("api").unwrap_err();
+        assert!(err.to_string().contains("shell"));
+    }
 
-        let dir = tempfile::tempdir().unwrap();
-        let config_path = dir.path().join("tenement.toml");
+    const OVERLAY_CONFIG: &str = r#"
+[settings]
+health_check_interval = 10
 
-        let config_content = r#"
 [service.api]
 command = "./api"
+health = "/health"
+
+[service.api.health_check]
+failure_threshold = 2
+recovery_threshold = 3
+
+[service.api.env]
+LOG_LEVEL = "info"
+
+[overlay.dev.service.api.health_check]
+interval = 30
+failure_threshold = 10
+recovery_threshold = 1
+
+[overlay.dev.service.api.env]
+LOG_LEVEL = "debug"
+
+[overlay.prod.service.api.health_check]
+interval = 5
 "#;
-        let mut file = std::fs::File::create(&config_path).unwrap();
-        file.write_all(config_content.as_bytes()).unwrap();
 
-        let config = Config::load_from_path(&config_path).unwrap();
-        assert!(config.get_service("api").is_some());
+    #[test]
+    fn test_health_thresholds_default() {
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.health_check, HealthThresholds::default());
+        assert_eq!(api.health_check.failure_threshold, 3);
+        assert_eq!(api.health_check.recovery_threshold, 1);
+        assert_eq!(api.health_interval(&config.settings), std::time::Duration::from_secs(10));
     }
 
     #[test]
-    fn test_load_from_nonexistent_path() {
-        let result = Config::load_from_path(std::path::Path::new("/nonexistent/tenement.toml"));
-        assert!(result.is_err());
+    fn test_health_check_types() {
+        let parse = |table: &str| {
+            let content = format!(
+                "[service.api]\ncommand = \"./api\"\n\n[service.api.health_check]\n{}",
+                table
+            );
+            Config::from_str(&content).map(|c| c.service["api"].health_check.clone())
+        };
+
+        let default = parse("").unwrap();
+        assert_eq!(default.check_type, HealthCheckType::Http);
+        assert_eq!(default.timeout_ms, 5000);
+
+        let tcp = parse("type = \"tcp\"\ntimeout_ms = 250\n").unwrap();
+        assert_eq!(tcp.check_type, HealthCheckType::Tcp);
+        assert_eq!(tcp.timeout_ms, 250);
+
+        let exec = parse("type = \"exec\"\ncommand = \"./check.sh\"\n").unwrap();
+        assert_eq!(exec.check_type, HealthCheckType::Exec);
+        assert_eq!(exec.command.as_deref(), Some("./check.sh"));
+
+        let err = parse("type = \"exec\"\n").unwrap_err().to_string();
+        assert!(err.contains("needs a command"), "{}", err);
+        let err = parse("type = \"tcp\"\ncommand = \"true\"\n").unwrap_err().to_string();
+        assert!(err.contains("only used with type = \"exec\""), "{}", err);
+        let err = parse("timeout_ms = 0\n").unwrap_err().to_string();
+        assert!(err.contains("timeout_ms must be at least 1"), "{}", err);
+        assert!(parse("type = \"grpc\"\n").is_err());
     }
 
     #[test]
-    fn test_invalid_toml() {
-        use std::io::Write;
-
-        let dir = tempfile::tempdir().unwrap();
-        let config_path = dir.path().join("tenement.toml");
-
-        let config_content = "this is not valid toml [[[";
-        let mut file = std::fs::File::create(&config_path).unwrap();
-        file.write_all(config_content.as_bytes()).unwrap();
-
-        let result = Config::load_from_path(&config_path);
-        assert!(result.is_err());
+    fn test_startup_probe_and_slow_start_config() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+slow_start = "1m"
+
+[service.api.health_check]
+initial_delay = "30s"
+failure_threshold = 2
+startup_failure_threshold = 20
+"#,
+        )
+        .unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.slow_start, Some(60));
+        assert_eq!(api.health_check.initial_delay, Some(30));
+        assert_eq!(api.health_check.failures_allowed(false), 20);
+        assert_eq!(api.health_check.failures_allowed(true), 2);
+
+        let defaults = HealthThresholds::default();
+        assert_eq!(defaults.initial_delay, None);
+        assert_eq!(defaults.failures_allowed(false), defaults.failure_threshold);
+
+        let err = Config::from_str(
+            "[service.api]\ncommand = \"./api\"\n\n[service.api.health_check]\n\
+             startup_failure_threshold = 0\n",
+        )
+        .unwrap_err();
+        assert!(err.to_string().contains("startup_failure_threshold"), "{}", err);
     }
 
     #[test]
-    fn test_apply_data_dir_override_no_override_keeps_default() {
-        let mut config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
-        assert_eq!(config.settings.data_dir, PathBuf::from("./tenement-data"));
+    fn test_readiness_config() {
+        let parse = |health: &str, table: &str| {
+            let content = format!(
+                "[service.api]\ncommand = \"./api\"\n{}\n[service.api.readiness]\n{}",
+                health, table
+            );
+            Config::from_str(&content).map(|c| c.service["api"].clone())
+        };
+
+        let api = parse("health = \"/health\"\n", "path = \"/ready\"\ninterval = 2").unwrap();
+        let readiness = api.readiness.clone().unwrap();
+        assert_eq!(readiness.check_type, HealthCheckType::Http);
+        assert_eq!(readiness.path.as_deref(), Some("/ready"));
+        assert_eq!(readiness.failure_threshold, 3);
+        assert_eq!(readiness.success_threshold, 1);
+        let settings = Settings::default();
+        let secs = std::time::Duration::from_secs;
+        assert_eq!(api.readiness_interval(&settings), secs(2));
+        assert_eq!(api.health_interval(&settings), secs(10));
+
+        // Without a path of its own it probes the health path
+        let api = parse("health = \"/health\"\n", "").unwrap();
+        assert_eq!(api.readiness_interval(&settings), secs(10));
+        assert!(parse("", "type = \"tcp\"\n").is_ok());
+        let plain = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        assert!(plain.service["api"].readiness.is_none());
+
+        for (table, expected) in [
+            ("", "needs a path"),
+            ("type = \"exec\"\n", "needs a command"),
+            ("type = \"tcp\"\ncommand = \"true\"\n", "only used with"),
+            ("type = \"tcp\"\nsuccess_threshold = 0\n", "at least 1"),
+            ("type = \"tcp\"\ninterval = 0\n", "readiness.interval"),
+        ] {
+            let err = parse("", table).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}", err);
+        }
+    }
 
-        config.apply_data_dir_override(None).unwrap();
-        assert_eq!(config.settings.data_dir, PathBuf::from("./tenement-data"));
+    #[test]
+    fn test_overlay_health_thresholds_differ_by_env() {
+        let prod = Config::from_str_for_env(OVERLAY_CONFIG, Some("prod")).unwrap();
+        let dev = Config::from_str_for_env(OVERLAY_CONFIG, Some("dev")).unwrap();
+
+        let prod_api = prod.get_service("api").unwrap();
+        assert_eq!(prod_api.health_check.interval, Some(5));
+        // Keys the overlay doesn't mention keep their base values
+        assert_eq!(prod_api.health_check.failure_threshold, 2);
+        assert_eq!(prod_api.health_check.recovery_threshold, 3);
+        assert_eq!(prod_api.env.get("LOG_LEVEL"), Some(&"info".to_string()));
+
+        let dev_api = dev.get_service("api").unwrap();
+        assert_eq!(dev_api.health_check.interval, Some(30));
+        assert_eq!(dev_api.health_check.failure_threshold, 10);
+        assert_eq!(dev_api.health_check.recovery_threshold, 1);
+        assert_eq!(dev_api.env.get("LOG_LEVEL"), Some(&"debug".to_string()));
+        assert_eq!(dev.settings.environment.as_deref(), Some("dev"));
+
+        assert_ne!(
+            prod_api.health_interval(&prod.settings),
+            dev_api.health_interval(&dev.settings)
+        );
     }
 
     #[test]
-    fn test_apply_data_dir_override_no_override_keeps_toml_value() {
-        let toml = r#"
-[settings]
-data_dir = "/opt/tenement"
-[service.api]
-command = "./api"
-"#;
-        let mut config = Config::from_str(toml).unwrap();
+    fn test_overlay_base_config_without_env() {
+        let config = Config::from_str(OVERLAY_CONFIG).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.health_check.interval, None);
+        assert_eq!(api.health_check.failure_threshold, 2);
+        assert!(config.settings.environment.is_none());
 
-        config.apply_data_dir_override(None).unwrap();
-        assert_eq!(config.settings.data_dir, PathBuf::from("/opt/tenement"));
+        // An unknown environment falls back to the base config
+        let config = Config::from_str_for_env(OVERLAY_CONFIG, Some("staging")).unwrap();
+        assert_eq!(config.get_service("api").unwrap().health_check.failure_threshold, 2);
     }
 
     #[test]
-    fn test_apply_data_dir_override_replaces_default() {
-        let mut config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+    fn test_overlay_selected_by_settings_environment() {
+        let content = format!("{}\n", OVERLAY_CONFIG).replacen(
+            "[settings]\n",
+            "[settings]\nenvironment = \"dev\"\n",
+            1,
+        );
+        let config = Config::from_str(&content).unwrap();
+        assert_eq!(config.get_service("api").unwrap().health_check.failure_threshold, 10);
 
-        config
-            .apply_data_dir_override(Some(PathBuf::from("/tmp/x")))
-            .unwrap();
-        assert_eq!(config.settings.data_dir, PathBuf::from("/tmp/x"));
+        // An explicit environment (TENEMENT_ENV) wins over the file
+        let config = Config::from_str_for_env(&content, Some("prod")).unwrap();
+        assert_eq!(config.get_service("api").unwrap().health_check.interval, Some(5));
+        assert_eq!(config.settings.environment.as_deref(), Some("prod"));
     }
 
     #[test]
-    fn test_apply_data_dir_override_beats_toml_value() {
-        let toml = r#"
-[settings]
-data_dir = "/opt/tenement"
+    fn test_overlay_file_templates_and_vars() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let path = dir.path().join("tenement.toml");
+        let content = r#"
+[vars]
+domain = "example.com"
+replicas = 1
+
+[template.web]
+health = "/health"
+replicas = "{{ replicas }}"
+env = { BASE_URL = "https://{{ domain }}" }
+
 [service.api]
+extends = "web"
 command = "./api"
+
+[service.site]
+extends = "web"
+command = "./site"
 "#;
-        let mut config = Config::from_str(toml).unwrap();
+        std::fs::write(
+            dir.path().join("tenement.prod.toml"),
+            "[vars]\nreplicas = 3\n\n[service.site]\nreplicas = 2\n",
+        )
+        .unwrap();
 
-        config
-            .apply_data_dir_override(Some(PathBuf::from("/tmp/from-flag")))
-            .unwrap();
-        assert_eq!(config.settings.data_dir, PathBuf::from("/tmp/from-flag"));
+        let config = Config::from_source(content, None, &path).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.health.as_deref(), Some("/health"));
+        assert_eq!(api.replicas, 1);
+        assert_eq!(api.env["BASE_URL"], "https://example.com");
+        assert_eq!(config.source.as_deref(), Some(path.as_path()));
+
+        let config = Config::from_source(content, Some("prod"), &path).unwrap();
+        assert_eq!(config.get_service("api").unwrap().replicas, 3);
+        // The service's own key wins over the template's
+        assert_eq!(config.get_service("site").unwrap().replicas, 2);
+
+        // Only files loaded from a path get an overlay file
+        let config = Config::from_str_for_env(content, Some("prod")).unwrap();
+        assert_eq!(config.get_service("api").unwrap().replicas, 1);
     }
 
     #[test]
-    fn test_apply_data_dir_override_rejects_tilde_in_flag() {
-        let mut config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+    fn test_zero_health_threshold_rejected() {
+        let content = r#"
+[service.api]
+command = "./api"
 
-        let err = config
-            .apply_data_dir_override(Some(PathBuf::from("~/foo")))
-            .unwrap_err();
-        let msg = format!("{:#}", err);
-        assert!(msg.contains("--data-dir"), "got: {}", msg);
-        assert!(msg.contains("~"), "got: {}", msg);
-        // Original data_dir is unchanged.
-        assert_eq!(config.settings.data_dir, PathBuf::from("./tenement-data"));
+[service.api.health_check]
+failure_threshold = 0
+"#;
+        let err = Config::from_str(content).unwrap_err();
+        assert!(err.to_string().contains("health_check"));
     }
 
     #[test]
-    fn test_apply_data_dir_override_rejects_tilde_in_toml() {
-        let toml = r#"
+    fn test_merge_toml_deep_merges_tables() {
+        let mut base: toml::Value = toml::from_str("a = 1\n[t]\nx = 1\ny = [1, 2]\n").unwrap();
+        let overlay: toml::Value = toml::from_str("b = 2\n[t]\ny = [3]\n").unwrap();
+        merge_toml(&mut base, overlay);
+        assert_eq!(base["a"].as_integer(), Some(1));
+        assert_eq!(base["b"].as_integer(), Some(2));
+        assert_eq!(base["t"]["x"].as_integer(), Some(1));
+        // Arrays are replaced, not appended
+        assert_eq!(base["t"]["y"].as_array().unwrap().len(), 1);
+    }
+
+    #[test]
+    fn test_concurrency_settings() {
+        let config_str = r#"
 [settings]
-data_dir = "~/tenement"
+max_concurrency = 64
+concurrency_queue_timeout_ms = 250
+
 [service.api]
 command = "./api"
+concurrency_weight = 3
+
+[service.worker]
+command = "./worker"
 "#;
-        let mut config = Config::from_str(toml).unwrap();
+        let config = Config::from_str(config_str).unwrap();
+        assert_eq!(config.settings.max_concurrency, Some(64));
+        assert_eq!(config.settings.concurrency_queue_timeout_ms, 250);
+        assert_eq!(config.get_service("api").unwrap().concurrency_weight, 3);
+        assert_eq!(config.get_service("worker").unwrap().concurrency_weight, 1);
+    }
 
-        let err = config.apply_data_dir_override(None).unwrap_err();
-        let msg = format!("{:#}", err);
-        assert!(msg.contains("tenement.toml"), "got: {}", msg);
+    #[test]
+    fn test_concurrency_defaults() {
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        assert!(config.settings.max_concurrency.is_none());
+        assert_eq!(config.settings.concurrency_queue_timeout_ms, 5000);
     }
 
     #[test]
-    fn test_apply_data_dir_override_user_tilde_form_rejected() {
-        // ~user/foo style is also rejected (we don't know how to resolve it).
-        let mut config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+    fn test_service_concurrency_limit() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+max_concurrency = 50
+max_queue = 100
+queue_timeout_ms = 2000
 
-        let err = config
-            .apply_data_dir_override(Some(PathBuf::from("~russell/foo")))
-            .unwrap_err();
-        assert!(format!("{:#}", err).contains("--data-dir"));
+[service.worker]
+command = "./worker"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.max_concurrency, Some(50));
+        assert_eq!(api.max_queue, Some(100));
+        assert_eq!(api.queue_timeout_ms, Some(2000));
+        let worker = config.get_service("worker").unwrap();
+        assert_eq!(worker.max_concurrency, None);
+        assert_eq!(worker.max_queue, None);
     }
 
     #[test]
-    fn test_settings_clone() {
-        let settings = Settings::default();
-        let cloned = settings.clone();
-        assert_eq!(settings.data_dir, cloned.data_dir);
-        assert_eq!(settings.health_check_interval, cloned.health_check_interval);
+    fn test_warm_connections_config() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+warm_connections = 4
+
+[service.worker]
+command = "./worker"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        assert_eq!(config.get_service("api").unwrap().warm_connections, 4);
+        assert_eq!(config.get_service("worker").unwrap().warm_connections, 0);
     }
 
     #[test]
-    fn test_config_clone() {
+    fn test_tmp_dir_config() {
         let config_str = r#"
 [service.api]
 command = "./api"
+tmp_dir = true
+
+[service.worker]
+command = "./worker"
 "#;
         let config = Config::from_str(config_str).unwrap();
-        let cloned = config.clone();
-        assert_eq!(config.service.len(), cloned.service.len());
+        assert!(config.get_service("api").unwrap().tmp_dir);
+        assert!(!config.get_service("worker").unwrap().tmp_dir);
     }
 
     #[test]
-    fn test_service_config_clone() {
+    fn test_rate_limit_config() {
         let config_str = r#"
 [service.api]
 command = "./api"
-health = "/health"
+rate_limit = { requests_per_second = 20, burst = 50 }
+
+[service.web]
+command = "./web"
+
+[service.web.rate_limit]
+requests_per_second = 5
 "#;
         let config = Config::from_str(config_str).unwrap();
-        let api = config.get_service("api").unwrap();
-        let cloned = api.clone();
-        assert_eq!(api.command, cloned.command);
-        assert_eq!(api.health, cloned.health);
+        let api = config.get_service("api").unwrap().rate_limit.unwrap();
+        assert_eq!((api.requests_per_second, api.burst()), (20, 50));
+        let web = config.get_service("web").unwrap().rate_limit.unwrap();
+        assert_eq!((web.requests_per_second, web.burst()), (5, 5));
+
+        for limit in [
+            "requests_per_second = 0",
+            "requests_per_second = 5, burst = 0",
+        ] {
+            let toml = format!(
+                "[service.api]\ncommand = \"./api\"\nrate_limit = {{ {} }}\n",
+                limit
+            );
+            let err = Config::from_str(&toml).unwrap_err();
+            assert!(err.to_string().contains("rate_limit"), "{}", err);
+        }
     }
 
     #[test]
-    fn test_firecracker_config_with_isolation() {
-        // Test new 'isolation' field name
+    fn test_retry_and_circuit_breaker_config() {
         let config_str = r#"
-[service.secure]
-isolation = "firecracker"
+[service.api]
+command = "./api"
+retry = { attempts = 2, budget_percent = 10 }
+circuit_breaker = { failures = 3, cooldown = "1m" }
+
+[service.web]
+command = "./web"
+retry = {}
+circuit_breaker = {}
+
+[service.worker]
 command = "./worker"
-kernel = "/var/lib/tenement/vmlinux"
-rootfs = "/var/lib/tenement/worker.ext4"
-memory_mb = 512
-vcpus = 2
-vsock_port = 6000
 "#;
         let config = Config::from_str(config_str).unwrap();
-        let secure = config.get_service("secure").unwrap();
-
-        assert_eq!(secure.isolation, RuntimeType::Firecracker);
+        let api = config.get_service("api").unwrap();
         assert_eq!(
-            secure.kernel,
-            Some(PathBuf::from("/var/lib/tenement/vmlinux"))
+            api.retry,
+            Some(RetryConfig {
+                attempts: 2,
+                budget_percent: 10.0
+            })
         );
         assert_eq!(
-            secure.rootfs,
-            Some(PathBuf::from("/var/lib/tenement/worker.ext4"))
+            api.circuit_breaker,
+            Some(CircuitBreakerConfig {
+                failures: 3,
+                cooldown: 60
+            })
         );
-        assert_eq!(secure.memory_mb, 512);
-        assert_eq!(secure.vcpus, 2);
-        assert_eq!(secure.vsock_port, 6000);
-
-        // Validation should pass
-        assert!(secure.validate("secure").is_ok());
+        let web = config.get_service("web").unwrap();
+        assert_eq!(web.retry.unwrap().attempts, 1);
+        assert_eq!(web.retry.unwrap().budget_percent, 20.0);
+        assert_eq!(web.circuit_breaker.unwrap().failures, 5);
+        assert_eq!(web.circuit_breaker.unwrap().cooldown, 30);
+        let worker = config.get_service("worker").unwrap();
+        assert!(worker.retry.is_none() && worker.circuit_breaker.is_none());
+
+        for (setting, value) in [
+            ("retry", "budget_percent = 150"),
+            ("circuit_breaker", "failures = 0"),
+            ("circuit_breaker", "cooldown = 0"),
+        ] {
+            let toml = format!(
+                "[service.api]\ncommand = \"./api\"\n{} = {{ {} }}\n",
+                setting, value
+            );
+            let err = Config::from_str(&toml).unwrap_err();
+            assert!(err.to_string().contains(setting), "{}", err);
+        }
     }
 
     #[test]
-    fn test_firecracker_defaults() {
+    fn test_static_service_config() {
         let config_str = r#"
-[service.secure]
-isolation = "firecracker"
-command = "./worker"
-kernel = "/vmlinux"
-rootfs = "/rootfs.ext4"
+[service.site]
+type = "static"
+root = "./dist"
+spa = true
+cache_max_age = 86400
+
+[service.api]
+command = "./api"
 "#;
         let config = Config::from_str(config_str).unwrap();
-        let secure = config.get_service("secure").unwrap();
-
-        assert_eq!(secure.memory_mb, 256);
-        assert_eq!(secure.vcpus, 1);
-        assert_eq!(secure.vsock_port, 5000);
+        let site = config.get_service("site").unwrap();
+        assert_eq!(site.kind, ServiceKind::Static);
+        assert_eq!(site.root, Some(PathBuf::from("./dist")));
+        assert!(site.spa);
+        assert_eq!(site.cache_max_age, 86400);
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.kind, ServiceKind::Process);
+        assert_eq!(api.cache_max_age, 3600);
+
+        for (toml, expected) in [
+            ("[service.site]\ntype = \"static\"\n", "no `root`"),
+            (
+                "[service.site]\ntype = \"static\"\nroot = \"./dist\"\ncommand = \"./x\"\n",
+                "runs nothing",
+            ),
+            (
+                "[service.site]\ntype = \"static\"\nroot = \"./dist\"\n\n\
+                 [instances]\nsite = [\"main\"]\n",
+                "[instances]",
+            ),
+            ("[service.api]\ncommand = \"./api\"\nspa = true\n", "only apply"),
+        ] {
+            let err = Config::from_str(toml).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}", err);
+        }
     }
 
     #[test]
-    fn test_firecracker_validation_missing_kernel() {
+    fn test_log_rate_limit_config() {
         let config_str = r#"
-[service.secure]
-isolation = "firecracker"
-command = "./worker"
-rootfs = "/rootfs.ext4"
+[service.api]
+command = "./api"
+log_rate_limit = 200
 "#;
         let config = Config::from_str(config_str).unwrap();
-        let secure = config.get_service("secure").unwrap();
+        assert_eq!(config.get_service("api").unwrap().log_rate_limit, Some(200));
 
-        let result = secure.validate("secure");
-        assert!(result.is_err());
-        assert!(result.unwrap_err().to_string().contains("kernel"));
+        let zero = "[service.api]\ncommand = \"./api\"\nlog_rate_limit = 0\n";
+        assert!(Config::from_str(zero).is_err());
     }
 
     #[test]
-    fn test_firecracker_validation_missing_rootfs() {
-        let config_str = r#"
-[service.secure]
-isolation = "firecracker"
-command = "./worker"
-kernel = "/vmlinux"
-"#;
-        let config = Config::from_str(config_str).unwrap();
-        let secure = config.get_service("secure").unwrap();
+    fn test_concurrency_zero_rejected() {
+        let zero_cap = "[settings]\nmax_concurrency = 0\n[service.api]\ncommand = \"./api\"\n";
+        assert!(Config::from_str(zero_cap).is_err());
+
+        let zero_weight = "[service.api]\ncommand = \"./api\"\nconcurrency_weight = 0\n";
+        let err = Config::from_str(zero_weight).unwrap_err();
+        assert!(err.to_string().contains("concurrency_weight"));
+
+        let zero_limit = "[service.api]\ncommand = \"./api\"\nmax_concurrency = 0\n";
+        let err = Config::from_str(zero_limit).unwrap_err();
+        assert!(err.to_string().contains("max_concurrency"));
+
+        let queue_only = "[service.api]\ncommand = \"./api\"\nmax_queue = 10\n";
+        let err = Config::from_str(queue_only).unwrap_err();
+        assert!(err.to_string().contains("without max_concurrency"));
+    }
+
+    #[test]
+    fn test_fault_config_invalid_percent_rejected() {
+        let config_str = r#"
+[service.api]
+command = "./api"
 
-        let result = secure.validate("secure");
-        assert!(result.is_err());
-        assert!(result.unwrap_err().to_string().contains("rootfs"));
+[service.api.fault]
+abort_status = 503
+abort_percent = 120.0
+"#;
+        let err = Config::from_str(config_str).unwrap_err();
+        assert!(err.to_string().contains("abort_percent"));
     }
 
     #[test]
@@ -1114,6 +6969,133 @@ command = "/app/server"
         assert!(err.contains("image"), "got: {err}");
     }
 
+    #[test]
+    fn test_stream_idle_timeout() {
+        let config = Config::from_str("[service.chat]\ncommand = \"./chat\"\n").unwrap();
+        assert_eq!(config.get_service("chat").unwrap().stream_idle_timeout, None);
+
+        let config = Config::from_str(
+            "[service.chat]\ncommand = \"./chat\"\nstream_idle_timeout = 300\n",
+        )
+        .unwrap();
+        assert_eq!(config.get_service("chat").unwrap().stream_idle_timeout, Some(300));
+
+        let err = Config::from_str(
+            "[service.chat]\ncommand = \"./chat\"\nstream_idle_timeout = 0\n",
+        )
+        .unwrap_err();
+        assert!(err.to_string().contains("stream_idle_timeout"), "{}", err);
+    }
+
+    #[test]
+    fn test_backend_protocol() {
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.protocol, BackendProtocol::Http);
+        assert!(!api.protocol.is_http2());
+
+        for (name, protocol) in [
+            ("h2c", BackendProtocol::H2c),
+            ("grpc", BackendProtocol::Grpc),
+        ] {
+            let toml = format!(
+                "[service.api]\ncommand = \"./api\"\nprotocol = \"{}\"\n",
+                name
+            );
+            let config = Config::from_str(&toml).unwrap();
+            let api = config.get_service("api").unwrap();
+            assert_eq!(api.protocol, protocol);
+            assert!(api.protocol.is_http2());
+            assert_eq!(api.protocol.to_string(), name);
+        }
+
+        let toml = "[service.api]\ncommand = \"./api\"\nprotocol = \"spdy\"\n";
+        assert!(Config::from_str(toml).is_err());
+    }
+
+    #[test]
+    fn test_stream_services() {
+        let config = Config::from_str(
+            "[service.db]\ncommand = \"./db\"\nprotocol = \"tcp\"\n\
+             listen = { port = 5432 }\n\n\
+             [service.game]\ncommand = \"./game\"\nprotocol = \"udp\"\n\
+             listen = { port = 27015, address = \"127.0.0.1\", max_connections = 64 }\n",
+        )
+        .unwrap();
+        let db = config.get_service("db").unwrap();
+        assert!(db.protocol.is_stream() && !db.protocol.is_http2());
+        let listen = db.listen.as_ref().unwrap();
+        assert_eq!(listen.addr(), "0.0.0.0:5432".parse().unwrap());
+        assert_eq!(listen.max_connections, 1000);
+        let game = config.get_service("game").unwrap();
+        assert_eq!(game.protocol.to_string(), "udp");
+        assert_eq!(game.listen.as_ref().unwrap().max_connections, 64);
+
+        let service = |name: &str, extra: &str| {
+            format!("[service.{}]\ncommand = \"./{}\"\n{}\n", name, name, extra)
+        };
+        let tcp = |name: &str, listen: &str| {
+            service(name, &format!("protocol = \"tcp\"\nlisten = {}", listen))
+        };
+        let db = tcp("db", "{ port = 5432 }");
+        let vm_udp = "protocol = \"udp\"\nisolation = \"firecracker\"\nlisten = { port = 53 }";
+        let cases = [
+            (service("db", "protocol = \"tcp\""), "no `listen` port"),
+            (service("db", "listen = { port = 5432 }"), "needs protocol"),
+            (
+                tcp("db", "{ port = 5432, max_connections = 0 }"),
+                "max_connections",
+            ),
+            (service("dns", vm_udp), "needs an instance PORT"),
+            (
+                format!("{}\n{}", db, tcp("db2", "{ port = 5432 }")),
+                "both listen on tcp 0.0.0.0:5432",
+            ),
+            (
+                format!("{}\n[routing.path]\n\"/db\" = \"db\"\n", db),
+                "only reachable on its `listen` port",
+            ),
+        ];
+        for (toml, expected) in cases {
+            let err = Config::from_str(&toml).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}: {}", toml, err);
+        }
+
+        // The same port over UDP is another listener
+        let both = format!(
+            "{}\n{}",
+            db,
+            service("dns", "protocol = \"udp\"\nlisten = { port = 5432 }")
+        );
+        assert!(Config::from_str(&both).is_ok());
+    }
+
+    #[test]
+    fn test_container_runtime_runs_image_entrypoint() {
+        let config_str = r#"
+[service.web]
+runtime = "container"
+image = "nginx:1.27"
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let web = config.get_service("web").unwrap();
+        assert_eq!(web.isolation, RuntimeType::Container);
+        assert!(web.command.is_empty());
+        assert!(web.isolation.uses_tcp_port());
+        assert!(web.validate("web").is_ok());
+
+        let config = Config::from_str(
+            "[service.web]\nisolation = \"container\"\ncommand = \"/app/server\"\n",
+        )
+        .unwrap();
+        let err = config.get_service("web").unwrap().validate("web").unwrap_err();
+        assert!(err.to_string().contains("image"), "got: {err}");
+        let err = Config::from_str("[service.web]\nisolation = \"process\"\n")
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("no `command`"), "got: {err}");
+    }
+
     #[test]
     fn test_container_runtime_image_and_mounts_parse() {
         let config_str = r#"
@@ -1165,6 +7147,299 @@ workdir = "/app"
         assert!(web.validate("web").is_ok());
     }
 
+    #[test]
+    fn test_filesystem_sandbox_config() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+isolation = "namespace"
+command = "./api"
+filesystem = { read_only = true, private_tmp = true, writable = ["/srv/uploads"] }
+
+[service.web]
+command = "./web"
+filesystem = { no_new_privileges = true }
+"#,
+        )
+        .unwrap();
+        let api = &config.get_service("api").unwrap().filesystem;
+        assert!(api.read_only && api.private_tmp && api.needs_mounts());
+        assert_eq!(api.writable, vec![PathBuf::from("/srv/uploads")]);
+        let web = &config.get_service("web").unwrap().filesystem;
+        assert!(web.no_new_privileges && !web.needs_mounts());
+
+        let cases = [
+            (
+                "command = \"./api\"\nfilesystem = { read_only = true }",
+                "needs isolation = \"namespace\"",
+            ),
+            (
+                "isolation = \"namespace\"\ncommand = \"./api\"\n\
+                 filesystem = { hide = [\"data\"] }",
+                "must be absolute",
+            ),
+            (
+                "isolation = \"namespace\"\ncommand = \"./api\"\nrootfs = \"/rootfs\"\n\
+                 filesystem = { private_tmp = true }",
+                "rootfs",
+            ),
+        ];
+        for (service, expected) in cases {
+            let content = format!("[service.api]\n{}\n", service);
+            let err = Config::from_str(&content).unwrap_err().to_string();
+            assert!(err.contains(expected), "{}: {}", expected, err);
+        }
+    }
+
+    #[test]
+    fn test_log_sinks_config() {
+        let config = Config::from_str(
+            r#"
+[[settings.log_sinks]]
+type = "loki"
+url = "http://loki:3100"
+labels = { env = "production" }
+
+[[settings.log_sinks]]
+type = "syslog"
+url = "udp://logs.internal:514"
+flush_interval = "1m"
+
+[service.api]
+command = "./api"
+
+[[service.api.log_sinks]]
+type = "http"
+name = "vector"
+url = "https://vector.internal/logs"
+batch_size = 100
+buffer_mb = 0
+"#,
+        )
+        .unwrap();
+        assert!(!config.settings.ship_audit_log);
+        let sinks = &config.settings.log_sinks;
+        assert_eq!(sinks.len(), 2);
+        assert_eq!(sinks[0].kind, LogSinkKind::Loki);
+        assert_eq!(sinks[0].name(), "loki");
+        assert_eq!(sinks[0].batch_size, 500);
+        assert_eq!(sinks[0].buffer_mb, 64);
+        assert_eq!(sinks[0].flush_interval(), std::time::Duration::from_secs(2));
+        let minute = std::time::Duration::from_secs(60);
+        assert_eq!(sinks[1].flush_interval(), minute);
+        let api = &config.get_service("api").unwrap().log_sinks[0];
+        assert_eq!(api.name(), "vector");
+        assert_eq!((api.batch_size, api.buffer_mb), (100, 0));
+
+        let cases = [
+            ("loki", "url = \"loki:3100\"", "must start with http://"),
+            ("syslog", "url = \"http://logs\"", "must start with udp://"),
+            ("syslog", "url = \"tcp://logs\"", "needs a port"),
+            ("http", "url = \"http://x\"\nbatch_size = 0", "batch_size"),
+            ("http", "url = \"http://x\"\nname = \"a/b\"", "may only use"),
+        ];
+        for (kind, sink, expected) in cases {
+            let content = format!("[[settings.log_sinks]]\ntype = \"{}\"\n{}\n", kind, sink);
+            let err = Config::from_str(&content).unwrap_err().to_string();
+            assert!(err.contains(expected), "{}: {}", expected, err);
+        }
+        let twice = "[service.api]\ncommand = \"./api\"\n\
+                     [[service.api.log_sinks]]\ntype = \"http\"\nurl = \"http://a\"\n\
+                     [[service.api.log_sinks]]\ntype = \"http\"\nurl = \"http://b\"\n";
+        let err = Config::from_str(twice).unwrap_err().to_string();
+        assert!(err.contains("two sinks named 'http'"), "{}", err);
+    }
+
+    #[test]
+    fn test_egress_config() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+egress = { allow = ["api.stripe.com:443", "*.amazonaws.com"], forward = ["5432:db:5432"] }
+
+[service.locked]
+command = "./locked"
+egress = {}
+
+[service.open]
+command = "./open"
+"#,
+        )
+        .unwrap();
+        let egress = |name: &str| config.get_service(name).unwrap().egress.clone();
+        let (policy, forwards) = egress("api").unwrap().parse().unwrap();
+        assert!(policy.allows("api.stripe.com", 443));
+        assert_eq!(forwards[0].listen, 5432);
+        let (locked, _) = egress("locked").unwrap().parse().unwrap();
+        assert!(!locked.allows("api.stripe.com", 443));
+        assert!(egress("open").is_none());
+
+        let cases = [
+            (
+                "isolation = \"process\"\ncommand = \"./api\"\negress = {}",
+                "needs isolation = \"namespace\"",
+            ),
+            (
+                "command = \"./api\"\negress = { allow = [\"a b\"] }",
+                "isn't host",
+            ),
+            (
+                "command = \"./api\"\negress = { forward = [\"80:a:80\", \"80:b:80\"] }",
+                "port 80 twice",
+            ),
+        ];
+        for (service, expected) in cases {
+            let content = format!("[service.api]\n{}\n", service);
+            let err = format!("{:#}", Config::from_str(&content).unwrap_err());
+            assert!(err.contains(expected), "{}: {}", expected, err);
+        }
+    }
+
+    #[test]
+    fn test_volumes_config() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+
+[service.api.volumes]
+uploads = {}
+db = { env = "DB_DIR", destination = "/data" }
+"#,
+        )
+        .unwrap();
+        let volumes = &config.get_service("api").unwrap().volumes;
+        assert_eq!(volumes.keys().collect::<Vec<_>>(), ["db", "uploads"]);
+        assert_eq!(volumes["db"].destination, Some(PathBuf::from("/data")));
+        assert!(volumes["uploads"].env.is_none());
+
+        let cases = [
+            ("\"a/b\" = {}", "must be named with letters"),
+            ("db = { env = \"1DB\" }", "isn't a valid env var name"),
+            ("db = { destination = \"data\" }", "must be absolute"),
+        ];
+        for (volumes, expected) in cases {
+            let content = format!(
+                "[service.api]\ncommand = \"./api\"\n[service.api.volumes]\n{}\n",
+                volumes
+            );
+            let err = Config::from_str(&content).unwrap_err().to_string();
+            assert!(err.contains(expected), "{}: {}", expected, err);
+        }
+    }
+
+    #[test]
+    fn test_backup_config() {
+        let config = Config::from_str(
+            r#"
+[settings.backup]
+target = "s3://backups/web1"
+schedule = "@daily"
+timezone = "Europe/Berlin"
+max_age = "30d"
+"#,
+        )
+        .unwrap();
+        let backup = config.settings.backup.unwrap();
+        assert_eq!(backup.keep, 7);
+        assert_eq!(backup.max_age, Some(30 * 86400));
+        assert!(!backup.include_master_key);
+        assert!(backup.parsed_schedule().unwrap().is_some());
+
+        let cases = [
+            ("target = \"ftp://host/backups\"", "must be a directory"),
+            (
+                "target = \"/b\"\nschedule = \"daily\"",
+                "Invalid [settings.backup]",
+            ),
+            (
+                "target = \"/b\"\ntimezone = \"Mars/Base\"",
+                "Invalid [settings.backup]",
+            ),
+        ];
+        for (backup, expected) in cases {
+            let content = format!("[settings.backup]\n{}\n", backup);
+            let err = Config::from_str(&content).unwrap_err().to_string();
+            assert!(err.contains(expected), "{}: {}", expected, err);
+        }
+    }
+
+    #[test]
+    fn test_state_backend_config() {
+        let content = "[settings.state_backend]\nurl = \"s3://state/tenement/prod\"\n";
+        let config = Config::from_str(content).unwrap();
+        let url = config.settings.state_backend.unwrap().url;
+        assert_eq!(url, "s3://state/tenement/prod");
+        let config = Config::from_str("").unwrap();
+        assert!(config.settings.state_backend.is_none());
+
+        let content = "[settings.state_backend]\nurl = \"/var/lib/state\"\n";
+        let err = Config::from_str(content).unwrap_err().to_string();
+        assert!(err.contains("state_backend] url"), "{}", err);
+    }
+
+    #[test]
+    fn test_alerts_config() {
+        let webhook = "[[settings.alerts.notify]]\ntype = \"webhook\"\nurl = \"https://x.dev/a\"\n";
+        let content = format!(
+            "[settings.alerts]\nunhealthy_for = \"2m\"\nmax_error_rate = 0.05\n{}\
+             [[settings.alerts.notify]]\ntype = \"email\"\nsmtp = \"localhost\"\n\
+             from = \"ten@x.dev\"\nto = [\"ops@x.dev\"]\n",
+            webhook
+        );
+        let alerts = Config::from_str(&content).unwrap().settings.alerts.unwrap();
+        assert_eq!(alerts.unhealthy_for, Some(120));
+        assert_eq!(alerts.max_restarts_per_hour, None);
+        assert_eq!(alerts.window(), std::time::Duration::from_secs(300));
+        assert_eq!((alerts.min_requests, alerts.send_resolved), (20, true));
+        assert_eq!(alerts.notify[1].kind, NotifierKind::Email);
+
+        let mut notifier = alerts.notify[1].clone();
+        for (smtp, loopback) in [
+            ("localhost", true),
+            ("127.0.0.1:2525", true),
+            ("[::1]:25", true),
+            ("mx.x.dev:25", false),
+            ("10.0.0.5", false),
+        ] {
+            notifier.smtp = Some(smtp.to_string());
+            assert_eq!(notifier.smtp_is_loopback(), loopback, "{}", smtp);
+        }
+
+        let cases = [
+            ("window = 60", webhook, "needs unhealthy_for"),
+            ("max_error_rate = 1.0", webhook, "below 1"),
+            (
+                "unhealthy_for = 60\nrepeat_interval = 0",
+                webhook,
+                "at least 1 second",
+            ),
+            ("unhealthy_for = 60", "", "nowhere to send alerts"),
+            (
+                "unhealthy_for = 60",
+                "[[settings.alerts.notify]]\ntype = \"slack\"\nurl = \"hooks.slack.com\"\n",
+                "slack url must start with http",
+            ),
+            (
+                "unhealthy_for = 60",
+                "[[settings.alerts.notify]]\ntype = \"email\"\nsmtp = \"mx:25\"\nto = [\"a@x\"]\n",
+                "needs a `from` address",
+            ),
+            (
+                "unhealthy_for = 60",
+                "[[settings.alerts.notify]]\ntype = \"email\"\nsmtp = \"mx.x.dev:587\"\n\
+                 username = \"ops\"\nfrom = \"ten@x.dev\"\nto = [\"a@x\"]\n",
+                "needs a loopback `smtp`",
+            ),
+        ];
+        for (rules, notify, expected) in cases {
+            let content = format!("[settings.alerts]\n{}\n{}", rules, notify);
+            let err = Config::from_str(&content).unwrap_err().to_string();
+            assert!(err.contains(expected), "{}: {}", expected, err);
+        }
+    }
+
     #[test]
     fn test_namespace_isolation_default() {
         let config_str = r#"
@@ -1217,6 +7492,58 @@ command = "./api"
         assert_eq!(api.idle_timeout, None);
     }
 
+    #[test]
+    fn test_idle_timeout_duration_string() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+idle_timeout = "10m"
+"#,
+        )
+        .unwrap();
+        assert_eq!(config.get_service("api").unwrap().idle_timeout, Some(600));
+
+        let content = "[service.api]\ncommand = \"./api\"\nidle_timeout = \"soon\"\n";
+        let err = Config::from_str(content).unwrap_err();
+        assert!(format!("{:#}", err).contains("invalid duration"), "{:#}", err);
+    }
+
+    #[test]
+    fn test_parse_duration_secs() {
+        assert_eq!(parse_duration_secs("30"), Ok(30));
+        assert_eq!(parse_duration_secs("45s"), Ok(45));
+        assert_eq!(parse_duration_secs("10m"), Ok(600));
+        assert_eq!(parse_duration_secs(" 2h "), Ok(7200));
+        assert_eq!(parse_duration_secs("1d"), Ok(86400));
+        assert!(parse_duration_secs("").is_err());
+        assert!(parse_duration_secs("m").is_err());
+        assert!(parse_duration_secs("5 minutes").is_err());
+        assert!(parse_duration_secs("-5s").is_err());
+    }
+
+    #[test]
+    fn test_has_health_probe() {
+        let config = Config::from_str(
+            r#"
+[service.plain]
+command = "./a"
+
+[service.http]
+command = "./a"
+health = "/health"
+
+[service.tcp]
+command = "./a"
+health_check = { type = "tcp" }
+"#,
+        )
+        .unwrap();
+        assert!(!config.get_service("plain").unwrap().has_health_probe());
+        assert!(config.get_service("http").unwrap().has_health_probe());
+        assert!(config.get_service("tcp").unwrap().has_health_probe());
+    }
+
     #[test]
     fn test_idle_timeout_zero_means_never() {
         let config_str = r#"
@@ -1263,6 +7590,7 @@ command = "./api"
 [settings]
 backoff_base_ms = 2000
 backoff_max_ms = 120000
+backoff_reset_secs = 60
 
 [service.api]
 command = "./api"
@@ -1271,6 +7599,7 @@ command = "./api"
 
         assert_eq!(config.settings.backoff_base_ms, 2000);
         assert_eq!(config.settings.backoff_max_ms, 120000);
+        assert_eq!(config.settings.backoff_reset_secs, 60);
     }
 
     #[test]
@@ -1281,9 +7610,10 @@ command = "./api"
 "#;
         let config = Config::from_str(config_str).unwrap();
 
-        // Default: 1s base, 60s max
+        // Default: 1s base, 60s max, reset after 10 stable minutes
         assert_eq!(config.settings.backoff_base_ms, 1000);
         assert_eq!(config.settings.backoff_max_ms, 60000);
+        assert_eq!(config.settings.backoff_reset_secs, 600);
     }
 
     #[test]
@@ -1372,6 +7702,368 @@ command = "./api"
         // Both should default to None (unlimited)
         assert_eq!(api.memory_limit_mb, None);
         assert_eq!(api.cpu_shares, None);
+        assert_eq!(api.limits, LimitsConfig::default());
+        assert_eq!(api.memory_limit(), None);
+    }
+
+    #[test]
+    fn test_limits_table() {
+        let config_str = r#"
+[service.api]
+command = "./api"
+memory_limit_mb = 512
+limits = { memory = "256MB", cpu = 0.5, nofile = 1024 }
+
+[service.worker]
+command = "./worker"
+memory_limit_mb = 512
+
+[service.worker.limits]
+memory = 128
+"#;
+        let config = Config::from_str(config_str).unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.limits.memory, Some(256));
+        assert_eq!(api.limits.cpu, Some(0.5));
+        assert_eq!(api.limits.nofile, Some(1024));
+        // limits.memory wins over memory_limit_mb
+        assert_eq!(api.memory_limit(), Some(256));
+
+        let worker = config.get_service("worker").unwrap();
+        assert_eq!(worker.memory_limit(), Some(128));
+        assert_eq!(worker.limits.cpu, None);
+    }
+
+    #[test]
+    fn test_user_and_group() {
+        let config = Config::from_str(
+            "[service.api]\ncommand = \"./api\"\nuser = \"app\"\ngroup = \"web\"\n",
+        )
+        .unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.user.as_deref(), Some("app"));
+        assert_eq!(api.group.as_deref(), Some("web"));
+
+        let err = Config::from_str("[service.api]\ncommand = \"./api\"\nuser = \"\"\n")
+            .unwrap_err();
+        assert!(err.to_string().contains("empty `user` or `group`"), "{}", err);
+    }
+
+    #[test]
+    fn test_depends_on() {
+        let config = Config::from_str(
+            r#"
+[service.db]
+command = "./db"
+
+[service.api]
+command = "./api"
+depends_on = ["db"]
+
+[service.worker]
+command = "./worker"
+
+[service.worker.depends_on.api]
+condition = "started"
+timeout = "2m"
+id = "main"
+"#,
+        )
+        .unwrap();
+        assert_eq!(config.get_service("db").unwrap().depends_on, BTreeMap::new());
+        assert_eq!(
+            config.get_service("api").unwrap().depends_on["db"],
+            Dependency {
+                condition: DependencyCondition::Healthy,
+                timeout: 30,
+                id: None,
+            }
+        );
+        assert_eq!(
+            config.get_service("worker").unwrap().depends_on["api"],
+            Dependency {
+                condition: DependencyCondition::Started,
+                timeout: 120,
+                id: Some("main".to_string()),
+            }
+        );
+    }
+
+    #[test]
+    fn test_depends_on_validation() {
+        let err = Config::from_str("[service.api]\ncommand = \"./api\"\ndepends_on = [\"db\"]\n")
+            .unwrap_err();
+        assert!(err.to_string().contains("unknown service 'db'"), "{}", err);
+
+        let err = Config::from_str(
+            r#"
+[service.a]
+command = "./a"
+depends_on = ["b"]
+
+[service.b]
+command = "./b"
+depends_on = ["c"]
+
+[service.c]
+command = "./c"
+depends_on = ["a"]
+"#,
+        )
+        .unwrap_err();
+        assert_eq!(err.to_string(), "Dependency cycle: a -> b -> c -> a");
+
+        let err = Config::from_str("[service.a]\ncommand = \"./a\"\ndepends_on = [\"a\"]\n")
+            .unwrap_err();
+        assert_eq!(err.to_string(), "Dependency cycle: a -> a");
+    }
+
+    #[test]
+    fn test_stacks() {
+        let config = Config::from_str(
+            r#"
+[service.web]
+command = "./web"
+stack = "acme-prod"
+depends_on = ["api"]
+
+[service.api]
+command = "./api"
+stack = "acme-prod"
+depends_on = ["db-proxy"]
+
+[service.db-proxy]
+command = "./db-proxy"
+depends_on = ["worker"]
+
+[service.worker]
+command = "./worker"
+stack = "acme-prod"
+
+[service.admin]
+command = "./admin"
+stack = "acme-prod"
+
+[service.blog]
+command = "./blog"
+stack = "side"
+"#,
+        )
+        .unwrap();
+        // Dependencies first, even through services outside the stack
+        assert_eq!(
+            config.stack_services("acme-prod"),
+            vec!["admin", "worker", "api", "web"]
+        );
+        assert!(config.stack_services("missing").is_empty());
+        let stacks = config.stacks();
+        assert_eq!(stacks.keys().collect::<Vec<_>>(), vec!["acme-prod", "side"]);
+        assert_eq!(stacks["side"], vec!["blog"]);
+
+        let err = Config::from_str("[service.api]\ncommand = \"./api\"\nstack = \"acme prod\"\n")
+            .unwrap_err();
+        assert!(err.to_string().contains("stack 'acme prod'"), "{}", err);
+    }
+
+    #[test]
+    fn test_uses() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+uses = ["cache"]
+
+[service.cache]
+command = "./cache"
+"#,
+        )
+        .unwrap();
+        assert_eq!(config.get_service("api").unwrap().uses, vec!["cache"]);
+        assert!(config.get_service("cache").unwrap().uses.is_empty());
+
+        let unknown = "[service.api]\ncommand = \"./api\"\nuses = [\"db\"]\n";
+        let err = Config::from_str(unknown).unwrap_err();
+        assert!(err.to_string().contains("unknown service 'db'"), "{}", err);
+        let itself = "[service.api]\ncommand = \"./api\"\nuses = [\"api\"]\n";
+        let err = Config::from_str(itself).unwrap_err();
+        assert!(err.to_string().contains("can't use itself"), "{}", err);
+    }
+
+    #[test]
+    fn test_hooks() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+
+[service.api.hooks]
+build = "make release"
+pre_stop = { command = "./flush.sh", timeout = "2m", on_failure = "abort" }
+"#,
+        )
+        .unwrap();
+        let hooks = &config.get_service("api").unwrap().hooks;
+        let build = hooks.get(HookKind::Build).unwrap();
+        assert_eq!(build.command, "make release");
+        assert_eq!((build.timeout, build.on_failure), (None, None));
+        let pre_stop = hooks.get(HookKind::PreStop).unwrap();
+        assert_eq!(pre_stop.timeout, Some(120));
+        assert_eq!(pre_stop.on_failure, Some(HookFailure::Abort));
+        assert!(hooks.pre_start.is_none() && hooks.post_deploy.is_none());
+
+        let empty = "[service.api]\ncommand = \"./api\"\nhooks = { pre_start = \" \" }\n";
+        let err = Config::from_str(empty).unwrap_err();
+        assert!(
+            err.to_string().contains("empty `hooks.pre_start`"),
+            "{}",
+            err
+        );
+        let instant = "[service.api]\ncommand = \"./api\"\n\
+                       hooks = { build = { command = \"make\", timeout = 0 } }\n";
+        let err = Config::from_str(instant).unwrap_err();
+        assert!(
+            err.to_string().contains("timeout must be at least 1"),
+            "{}",
+            err
+        );
+        let late = "[service.api]\ncommand = \"./api\"\n\
+                    hooks = { post_deploy = { command = \"./notify\", on_failure = \"abort\" } }\n";
+        let err = Config::from_str(late).unwrap_err();
+        assert!(err.to_string().contains("can't abort"), "{}", err);
+    }
+
+    #[test]
+    fn test_jobs() {
+        let config = Config::from_str(
+            r#"
+[jobs.backup]
+schedule = "0 3 * * *"
+command = "./backup.sh"
+timezone = "Europe/Berlin"
+overlap = "replace"
+timeout = "10m"
+env = { BUCKET = "backups" }
+
+[jobs.tick]
+schedule = "@hourly"
+command = "true"
+"#,
+        )
+        .unwrap();
+        let backup = &config.jobs["backup"];
+        assert_eq!(backup.overlap, OverlapPolicy::Replace);
+        assert_eq!(backup.timeout, Some(600));
+        assert_eq!(backup.env["BUCKET"], "backups");
+        assert_eq!(backup.tz().unwrap(), chrono_tz::Europe::Berlin);
+        let tick = &config.jobs["tick"];
+        assert_eq!((tick.overlap, tick.timeout), (OverlapPolicy::Skip, None));
+        assert_eq!(tick.tz().unwrap(), chrono_tz::UTC);
+
+        for (toml, expected) in [
+            ("[jobs.x]\nschedule = \"* * *\"\ncommand = \"true\"\n", "needs 5 fields"),
+            (
+                "[jobs.x]\nschedule = \"@daily\"\ncommand = \"true\"\ntimezone = \"Mars/Base\"\n",
+                "unknown timezone",
+            ),
+            (
+                "[service.x]\ncommand = \"./x\"\n\
+                 [jobs.x]\nschedule = \"@daily\"\ncommand = \"true\"\n",
+                "same name as a service",
+            ),
+        ] {
+            let err = format!("{:#}", Config::from_str(toml).unwrap_err());
+            assert!(err.contains(expected), "{}", err);
+        }
+    }
+
+    #[test]
+    fn test_parse_size_mb() {
+        assert_eq!(parse_size_mb("512"), Ok(512));
+        assert_eq!(parse_size_mb("256MB"), Ok(256));
+        assert_eq!(parse_size_mb("256m"), Ok(256));
+        assert_eq!(parse_size_mb("1G"), Ok(1024));
+        assert_eq!(parse_size_mb("2GiB"), Ok(2048));
+        assert_eq!(parse_size_mb("1536KB"), Ok(2));
+        assert!(parse_size_mb("lots").is_err());
+        assert!(parse_size_mb("1TB").is_err());
+        assert!(parse_size_mb("").is_err());
+    }
+
+    #[test]
+    fn test_deploy_strategy() {
+        let config = Config::from_str(
+            "[service.api]\ncommand = \"./api\"\n\
+             [service.api.deploy]\nstrategy = \"canary\"\ncanary_percent = 20\n\
+             canary_duration = \"10m\"\nmax_error_rate = 0.01\n",
+        )
+        .unwrap();
+        let deploy = &config.get_service("api").unwrap().deploy;
+        assert_eq!(deploy.strategy, DeployStrategy::Canary);
+        assert_eq!((deploy.canary_percent, deploy.canary_duration), (20, 600));
+        assert_eq!((deploy.max_error_rate, deploy.min_requests), (0.01, 20));
+
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        assert_eq!(config.get_service("api").unwrap().deploy, DeployConfig::default());
+
+        for (deploy, expected) in [
+            ("strategy = \"blue-green\"\ncanary_percent = 100", "canary_percent outside 1-99"),
+            ("max_error_rate = 1.5", "max_error_rate outside 0.0-1.0"),
+        ] {
+            let toml = format!(
+                "[service.api]\ncommand = \"./api\"\n[service.api.deploy]\n{}\n",
+                deploy
+            );
+            let err = Config::from_str(&toml).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}", err);
+        }
+    }
+
+    #[test]
+    fn test_git_config() {
+        let config = Config::from_str(
+            "[service.api]\ncommand = \"./api\"\n\
+             [service.api.git]\nbuild = \"make\"\nbuild_timeout = \"2m\"\n",
+        )
+        .unwrap();
+        let git = config.get_service("api").unwrap().git.clone().unwrap();
+        assert_eq!(git.branch, "main");
+        assert_eq!(git.build.as_deref(), Some("make"));
+        assert_eq!(git.build_timeout, 120);
+
+        let config = Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        assert!(config.get_service("api").unwrap().git.is_none());
+    }
+
+    #[test]
+    fn test_git_detect_needs_no_command() {
+        let config = Config::from_str("[service.api.git]\ndetect = true\n").unwrap();
+        let api = config.get_service("api").unwrap();
+        assert!(api.command.is_empty());
+        assert!(api.git.as_ref().unwrap().detect);
+
+        let err = Config::from_str("[service.api.git]\nbuild = \"make\"\n").unwrap_err();
+        assert!(err.to_string().contains("no `command`"), "{}", err);
+        let started = "[service.api.git]\ndetect = true\n\n[instances]\napi = [\"prod\"]\n";
+        let err = Config::from_str(started).unwrap_err();
+        assert!(err.to_string().contains("can't start"), "{}", err);
+    }
+
+    #[test]
+    fn test_limits_validation() {
+        for (limits, expected) in [
+            ("memory = \"0MB\"", "limits.memory of 0"),
+            ("memory = \"huge\"", "invalid size"),
+            ("cpu = 0.0", "limits.cpu"),
+            ("cpu = -1.0", "limits.cpu"),
+            ("nofile = 0", "limits.nofile"),
+        ] {
+            let config_str = format!(
+                "[service.api]\ncommand = \"./api\"\n\n[service.api.limits]\n{}\n",
+                limits
+            );
+            let err = Config::from_str(&config_str).unwrap_err();
+            assert!(format!("{:#}", err).contains(expected), "{}: {:#}", limits, err);
+        }
     }
 
     // ===================
@@ -1657,6 +8349,78 @@ worker = ["bg-1", "bg-2", "bg-3"]
         assert!(instances.contains(&("worker".to_string(), "bg-3".to_string())));
     }
 
+    // ===================
+    // CONFIG DIFF TESTS
+    // ===================
+
+    fn config_in(data_dir: &Path, services: &str) -> Config {
+        let content = format!("[settings]\ndata_dir = \"{}\"\n{}", data_dir.display(), services);
+        Config::from_str(&content).unwrap()
+    }
+
+    #[test]
+    fn test_diff_against_last_applied() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let services = r#"
+[service.api]
+command = "./api"
+env = { A = "1", B = "2", C = "3" }
+
+[service.worker]
+command = "./worker"
+
+[service.old]
+command = "./old"
+"#;
+        let first = config_in(dir.path(), services);
+        assert_eq!(first.diff_against_last_applied().unwrap(), None);
+        // Reparsing (new HashMap order) is not a change
+        let diff = config_in(dir.path(), services).diff_against_last_applied().unwrap();
+        let diff = diff.unwrap();
+        assert!(diff.is_empty(), "{}", diff);
+
+        let second = config_in(
+            dir.path(),
+            r#"
+[service.api]
+command = "./api"
+env = { A = "1", B = "2", C = "3" }
+
+[service.worker]
+command = "./worker"
+
+[service.web]
+command = "./web"
+
+[instances]
+worker = ["bg-1", "bg-2"]
+"#,
+        );
+        let diff = second.diff_against_last_applied().unwrap().unwrap();
+        assert_eq!(diff.added, vec!["web"]);
+        assert_eq!(diff.removed, vec!["old"]);
+        assert_eq!(diff.changed, vec!["worker"]);
+        assert_eq!(diff.to_string(), "added: web; removed: old; changed: worker");
+    }
+
+    #[test]
+    fn test_applied_services_file_has_no_env_values() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let config = config_in(
+            dir.path(),
+            r#"
+[service.api]
+command = "./api"
+env = { API_TOKEN = "hunter2-secret" }
+"#,
+        );
+        config.diff_against_last_applied().unwrap();
+
+        let written = std::fs::read_to_string(dir.path().join(APPLIED_SERVICES_FILE)).unwrap();
+        assert!(written.contains("\"api\""));
+        assert!(!written.contains("hunter2"));
+    }
+
     // ===================
     // TCP PORT AND LISTEN ADDR TESTS
     // ===================
@@ -1679,6 +8443,86 @@ socket = "/tmp/api-{id}.sock"
         );
     }
 
+    #[test]
+    fn test_unix_socket_config() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+isolation = "firecracker"
+kernel = "/vm/vmlinux"
+rootfs = "/vm/rootfs.ext4"
+socket = "/tmp/api-{id}.sock"
+unix_socket = { dir = "/run/tenement/{name}", mode = 0o660, owner = "0", group = "0" }
+
+[service.web]
+command = "./web"
+unix_socket = { name = "{id}.sock" }
+"#,
+        )
+        .unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.unix_socket.mode, Some(0o660));
+        assert_eq!(api.unix_socket.owner.as_deref(), Some("0"));
+        assert_eq!(
+            api.socket_path("api", "prod"),
+            PathBuf::from("/run/tenement/api/api-prod.sock")
+        );
+        let web = config.get_service("web").unwrap();
+        assert_eq!(
+            web.socket_path("web", "prod"),
+            PathBuf::from("/tmp/tenement/prod.sock")
+        );
+
+        for (table, expected) in [
+            ("{ mode = 0o1777 }", "above 0o777"),
+            ("{ name = \"run/{id}.sock\" }", "unix_socket.dir"),
+            ("{ group = \"\" }", "empty unix_socket.group"),
+        ] {
+            let toml = format!("[service.api]\ncommand = \"./api\"\nunix_socket = {table}\n");
+            let err = Config::from_str(&toml).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}", err);
+        }
+    }
+
+    #[test]
+    fn test_connection_pool_config() {
+        use std::time::Duration;
+
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+
+[service.web]
+command = "./web"
+connection_pool = { max_idle = 4, idle_timeout = "30s", max_lifetime = "10m" }
+"#,
+        )
+        .unwrap();
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.connection_pool, ConnectionPoolConfig::default());
+        assert_eq!(api.connection_pool.max_idle, 32);
+        assert_eq!(api.connection_pool.idle_timeout(), Duration::from_secs(90));
+        assert_eq!(api.connection_pool.max_lifetime(), None);
+        let web = config.get_service("web").unwrap();
+        assert_eq!(web.connection_pool.max_idle, 4);
+        assert_eq!(web.connection_pool.idle_timeout(), Duration::from_secs(30));
+        assert_eq!(
+            web.connection_pool.max_lifetime(),
+            Some(Duration::from_secs(600))
+        );
+
+        for (table, expected) in [
+            ("{ idle_timeout = 0 }", "idle_timeout"),
+            ("{ max_lifetime = \"0s\" }", "max_lifetime"),
+        ] {
+            let toml = format!("[service.api]\ncommand = \"./api\"\nconnection_pool = {table}\n");
+            let err = Config::from_str(&toml).unwrap_err();
+            assert!(err.to_string().contains(expected), "{}", err);
+        }
+    }
+
     #[test]
     fn test_listen_addr_tcp() {
         let config_str = r#"
@@ -0,0 +1,330 @@
+//! Service discovery
+//!
+//! With `[settings.discovery]` every service answers through tenement at
+//! `{service}.{domain}`, and each instance at `{id}.{service}.{domain}`. The
+//! default domain is "tenement.local". Two files under `{data_dir}/discovery`
+//! follow the instances as they come and go:
+//!
+//! - `hosts`: /etc/hosts lines pointing each name at this machine. When
+//!   `hosts_file` is set (e.g. "/etc/hosts"), they are also kept in a marked
+//!   block of that file.
+//! - `services.env`: for each service, the URL that reaches it through tenement
+//!   and the addresses of its running instances:
+//!   `TENEMENT_SERVICE_API_URL=http://api.tenement.local:8080` and
+//!   `TENEMENT_SERVICE_API_UPSTREAMS=127.0.0.1:30001,unix:/run/api/2.sock`
+//!
+//! Instances get the path of `services.env` in `TENEMENT_DISCOVERY_FILE`.
+
+use anyhow::{Context, Result};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+use crate::instance::{InstanceInfo, InstanceStatus};
+
+/// Directory under the data dir holding the generated files
+pub const DISCOVERY_DIR_NAME: &str = "discovery";
+
+/// Generated hosts file name
+pub const HOSTS_FILE_NAME: &str = "hosts";
+
+/// Generated env file name
+pub const ENV_FILE_NAME: &str = "services.env";
+
+/// Variable instances find the env file's path in
+pub const DISCOVERY_FILE_ENV: &str = "TENEMENT_DISCOVERY_FILE";
+
+/// Lines fencing tenement's block in a shared hosts file
+const BEGIN_MARKER: &str = "# BEGIN tenement";
+const END_MARKER: &str = "# END tenement";
+
+/// Where the discovery names point
+const LOOPBACK: &str = "127.0.0.1";
+
+/// The generated env file
+pub fn env_file(data_dir: &Path) -> PathBuf {
+    data_dir.join(DISCOVERY_DIR_NAME).join(ENV_FILE_NAME)
+}
+
+/// The generated hosts file
+pub fn hosts_file(data_dir: &Path) -> PathBuf {
+    data_dir.join(DISCOVERY_DIR_NAME).join(HOSTS_FILE_NAME)
+}
+
+/// A service's name, e.g. ("api", "tenement.local") -> "api.tenement.local"
+pub fn host_name(process: &str, domain: &str) -> String {
+    format!("{}.{}", process, domain)
+}
+
+/// Prefix of a service's variables, e.g. "my-api" -> "TENEMENT_SERVICE_MY_API"
+pub fn var_prefix(process: &str) -> String {
+    let name: String = process
+        .chars()
+        .map(|c| match c.is_ascii_alphanumeric() {
+            true => c.to_ascii_uppercase(),
+            false => '_',
+        })
+        .collect();
+    format!("TENEMENT_SERVICE_{}", name)
+}
+
+/// Addresses of each service's running instances, in ID order: "127.0.0.1:{port}"
+/// for TCP and "unix:{path}" for Unix sockets. Every service in `services` is
+/// listed, with no addresses if nothing of it runs.
+pub fn upstreams<'a>(
+    services: impl IntoIterator<Item = &'a String>,
+    instances: &[InstanceInfo],
+) -> BTreeMap<String, Vec<String>> {
+    let mut upstreams: BTreeMap<String, Vec<(String, String)>> = services
+        .into_iter()
+        .map(|process| (process.clone(), Vec::new()))
+        .collect();
+    for info in instances {
+        if info.status != InstanceStatus::Running || info.health.is_down() {
+            continue;
+        }
+        let Some(addresses) = upstreams.get_mut(&info.id.process) else {
+            continue;
+        };
+        let address = match info.port {
+            Some(port) => format!("{}:{}", LOOPBACK, port),
+            None => format!("unix:{}", info.socket.display()),
+        };
+        addresses.push((info.id.id.clone(), address));
+    }
+    upstreams
+        .into_iter()
+        .map(|(process, mut addresses)| {
+            addresses.sort();
+            (process, addresses.into_iter().map(|(_, a)| a).collect())
+        })
+        .collect()
+}
+
+/// /etc/hosts lines for each service and its instances
+pub fn render_hosts(domain: &str, instances: &[InstanceInfo], services: &[String]) -> String {
+    let mut names: Vec<String> = services.iter().map(|p| host_name(p, domain)).collect();
+    for info in instances {
+        if services.contains(&info.id.process) {
+            let service = host_name(&info.id.process, domain);
+            names.push(format!("{}.{}", info.id.id, service));
+        }
+    }
+    names.sort();
+    names.dedup();
+    names
+        .iter()
+        .map(|name| format!("{}\t{}\n", LOOPBACK, name))
+        .collect()
+}
+
+/// `services.env`: each service's URL through tenement (when it serves plain
+/// HTTP on `port`) and its instances' addresses
+pub fn render_env(
+    domain: &str,
+    port: Option<u16>,
+    upstreams: &BTreeMap<String, Vec<String>>,
+) -> String {
+    let mut env = String::from("# Generated by tenement; rewritten as instances change\n");
+    for (process, addresses) in upstreams {
+        let prefix = var_prefix(process);
+        env.push_str(&format!("{}_HOST={}\n", prefix, host_name(process, domain)));
+        if let Some(port) = port {
+            let url = format!("http://{}:{}", host_name(process, domain), port);
+            env.push_str(&format!("{}_URL={}\n", prefix, url));
+        }
+        env.push_str(&format!("{}_UPSTREAMS={}\n", prefix, addresses.join(",")));
+    }
+    env
+}
+
+/// `existing` with tenement's marked block replaced by `lines`, or appended
+/// if it has none
+pub fn merge_hosts_block(existing: &str, lines: &str) -> String {
+    let block = format!("{}\n{}{}\n", BEGIN_MARKER, lines, END_MARKER);
+    let begin = existing.find(BEGIN_MARKER);
+    let end = existing.find(END_MARKER).map(|end| end + END_MARKER.len());
+    match (begin, end) {
+        (Some(begin), Some(end)) if begin < end => {
+            let rest = existing[end..]
+                .strip_prefix('\n')
+                .unwrap_or(&existing[end..]);
+            format!("{}{}{}", &existing[..begin], block, rest)
+        }
+        _ if existing.is_empty() || existing.ends_with('\n') => {
+            format!("{}{}", existing, block)
+        }
+        _ => format!("{}\n{}", existing, block),
+    }
+}
+
+/// Replace `path` with `content` unless it already holds it. Returns whether
+/// it was written.
+pub fn write_if_changed(path: &Path, content: &str) -> Result<bool> {
+    if std::fs::read_to_string(path).is_ok_and(|current| current == content) {
+        return Ok(false);
+    }
+    if let Some(dir) = path.parent() {
+        std::fs::create_dir_all(dir)
+            .with_context(|| format!("Failed to create {}", dir.display()))?;
+    }
+    // Write beside it and rename, so a reader never sees half a file
+    let tmp = path.with_extension("tmp");
+    std::fs::write(&tmp, content).with_context(|| format!("Failed to write {}", tmp.display()))?;
+    std::fs::rename(&tmp, path).with_context(|| format!("Failed to replace {}", path.display()))?;
+    Ok(true)
+}
+
+/// Keep tenement's block of a shared hosts file current. The file is written
+/// in place: /etc/hosts is often a bind mount that can't be renamed over.
+pub fn update_hosts_file(path: &Path, lines: &str) -> Result<bool> {
+    let existing = match std::fs::read_to_string(path) {
+        Ok(existing) => existing,
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => String::new(),
+        Err(e) => return Err(e).with_context(|| format!("Failed to read {}", path.display())),
+    };
+    let merged = merge_hosts_block(&existing, lines);
+    if merged == existing {
+        return Ok(false);
+    }
+    std::fs::write(path, merged).with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(true)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::instance::{HealthStatus, InstanceId};
+    use crate::runtime::RuntimeType;
+
+    fn instance(
+        process: &str,
+        id: &str,
+        port: Option<u16>,
+        status: InstanceStatus,
+    ) -> InstanceInfo {
+        InstanceInfo {
+            id: InstanceId::new(process, id),
+            runtime: RuntimeType::Process,
+            socket: PathBuf::from(format!("/tmp/{}-{}.sock", process, id)),
+            port,
+            uptime_secs: 0,
+            restarts: 0,
+            health: HealthStatus::Healthy,
+            ready: true,
+            status,
+            idle_secs: 0,
+            idle_timeout: None,
+            storage_used_bytes: 0,
+            storage_quota_bytes: None,
+            data_dir: PathBuf::new(),
+            weight: 100,
+            last_startup_ms: None,
+            usage: None,
+        }
+    }
+
+    // ===================
+    // Names and addresses
+    // ===================
+
+    #[test]
+    fn test_names() {
+        assert_eq!(host_name("api", "tenement.local"), "api.tenement.local");
+        assert_eq!(var_prefix("api"), "TENEMENT_SERVICE_API");
+        assert_eq!(var_prefix("my-api.v2"), "TENEMENT_SERVICE_MY_API_V2");
+        assert_eq!(
+            env_file(Path::new("/var/lib/tenement")),
+            PathBuf::from("/var/lib/tenement/discovery/services.env")
+        );
+    }
+
+    #[test]
+    fn test_upstreams_list_running_instances() {
+        let services = vec!["api".to_string(), "web".to_string()];
+        let instances = vec![
+            instance("api", "2", None, InstanceStatus::Running),
+            instance("api", "1", Some(30001), InstanceStatus::Running),
+            instance("api", "3", Some(30003), InstanceStatus::Stopped),
+            instance("gone", "1", Some(30009), InstanceStatus::Running),
+        ];
+        let upstreams = upstreams(&services, &instances);
+        assert_eq!(
+            upstreams["api"],
+            vec!["127.0.0.1:30001", "unix:/tmp/api-2.sock"]
+        );
+        assert!(upstreams["web"].is_empty());
+        assert!(!upstreams.contains_key("gone"));
+    }
+
+    // ===================
+    // Generated files
+    // ===================
+
+    #[test]
+    fn test_render_hosts_and_env() {
+        let services = vec!["api".to_string(), "web".to_string()];
+        let instances = vec![instance("api", "1", Some(30001), InstanceStatus::Running)];
+        let hosts = render_hosts("tenement.local", &instances, &services);
+        assert_eq!(
+            hosts,
+            "127.0.0.1\t1.api.tenement.local\n\
+             127.0.0.1\tapi.tenement.local\n\
+             127.0.0.1\tweb.tenement.local\n"
+        );
+
+        let upstreams = upstreams(&services, &instances);
+        let env = render_env("tenement.local", Some(8080), &upstreams);
+        let mut parsed = std::collections::HashMap::new();
+        crate::env_files::parse_into(&env, &mut parsed).unwrap();
+        assert_eq!(parsed["TENEMENT_SERVICE_API_HOST"], "api.tenement.local");
+        assert_eq!(
+            parsed["TENEMENT_SERVICE_API_URL"],
+            "http://api.tenement.local:8080"
+        );
+        assert_eq!(parsed["TENEMENT_SERVICE_API_UPSTREAMS"], "127.0.0.1:30001");
+        assert_eq!(parsed["TENEMENT_SERVICE_WEB_UPSTREAMS"], "");
+
+        // Without a plain HTTP listener there's no URL
+        let env = render_env("tenement.local", None, &upstreams);
+        assert!(!env.contains("_URL="));
+    }
+
+    #[test]
+    fn test_merge_hosts_block() {
+        let lines = "127.0.0.1\tapi.tenement.local\n";
+        let block = "# BEGIN tenement\n127.0.0.1\tapi.tenement.local\n# END tenement\n";
+        assert_eq!(merge_hosts_block("", lines), block);
+        assert_eq!(
+            merge_hosts_block("127.0.0.1 localhost", lines),
+            format!("127.0.0.1 localhost\n{}", block)
+        );
+
+        // An existing block is replaced, keeping what's around it
+        let existing = "127.0.0.1 localhost\n\
+                        # BEGIN tenement\n127.0.0.1\told.tenement.local\n# END tenement\n\
+                        ::1 localhost\n";
+        assert_eq!(
+            merge_hosts_block(existing, lines),
+            format!("127.0.0.1 localhost\n{}::1 localhost\n", block)
+        );
+        let merged = merge_hosts_block(existing, lines);
+        assert_eq!(merge_hosts_block(&merged, lines), merged);
+    }
+
+    #[test]
+    fn test_write_if_changed() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("discovery").join("services.env");
+        assert!(write_if_changed(&path, "A=1\n").unwrap());
+        assert!(!write_if_changed(&path, "A=1\n").unwrap());
+        assert!(write_if_changed(&path, "A=2\n").unwrap());
+        assert_eq!(std::fs::read_to_string(&path).unwrap(), "A=2\n");
+
+        let hosts = dir.path().join("hosts");
+        std::fs::write(&hosts, "127.0.0.1 localhost\n").unwrap();
+        assert!(update_hosts_file(&hosts, "127.0.0.1\tapi.tenement.local\n").unwrap());
+        assert!(!update_hosts_file(&hosts, "127.0.0.1\tapi.tenement.local\n").unwrap());
+        let content = std::fs::read_to_string(&hosts).unwrap();
+        assert!(content.starts_with("127.0.0.1 localhost\n# BEGIN tenement\n"));
+    }
+}
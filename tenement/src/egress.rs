@@ -0,0 +1,855 @@
+//! Outbound network policy
+//!
+//! A service with `egress` runs in a network namespace of its own, where the
+//! only interface is loopback. Inside it tenement listens on
+//! 127.0.0.1:[`PROXY_PORT`], given to the instance as `HTTP_PROXY` and
+//! `HTTPS_PROXY`: an HTTP proxy (CONNECT for TLS, absolute URIs for plain
+//! HTTP) that connects out from the host only to destinations on the `allow`
+//! list, and answers anything else with 403. Each `forward` listens inside on
+//! a port of its own and splices to one fixed destination, for protocols that
+//! aren't HTTP. Connections to the instance's PORT on the host's loopback are
+//! passed in to it, so the proxy and health checks reach it as before. Unix
+//! sockets aren't affected: the instance's own and the mesh's work as usual.
+//!
+//! The allow list matches the host named in the request, not the address it
+//! resolves to. Network namespaces need Linux (and root); elsewhere
+//! [`Netns::start`] fails.
+
+use anyhow::{Context, Result};
+use std::time::Duration;
+
+/// Port the proxy listens on inside the namespace
+pub const PROXY_PORT: u16 = 3128;
+
+/// Largest request head the proxy reads
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+const MAX_HEAD: usize = 16 * 1024;
+
+/// How long connecting to a destination may take
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Headers about the connection to the proxy, not meant for the origin
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+const HOP_HEADERS: [&str; 4] = [
+    "connection",
+    "keep-alive",
+    "proxy-connection",
+    "proxy-authorization",
+];
+
+/// One `allow` entry
+#[derive(Debug, Clone, PartialEq, Eq)]
+struct Rule {
+    /// Lowercase host, or for a wildcard the domain whose subdomains match
+    host: String,
+    wildcard: bool,
+    /// None = any port
+    port: Option<u16>,
+}
+
+/// The destinations the proxy lets an instance connect to. Empty denies all.
+#[derive(Debug, Clone, Default, PartialEq, Eq)]
+pub struct Policy {
+    rules: Vec<Rule>,
+}
+
+impl Policy {
+    /// Parse `allow` entries: "host:port", "host" for any port, or
+    /// "*.example.com" (optionally with a port) for its subdomains
+    pub fn parse(allow: &[String]) -> Result<Self> {
+        let rules = allow
+            .iter()
+            .map(|entry| parse_rule(entry))
+            .collect::<Result<_>>()?;
+        Ok(Self { rules })
+    }
+
+    /// Whether the instance may connect to `host` on `port`
+    pub fn allows(&self, host: &str, port: u16) -> bool {
+        let host = normalize(host);
+        self.rules.iter().any(|rule| {
+            let host_matches = match rule.wildcard {
+                true => host
+                    .strip_suffix(rule.host.as_str())
+                    .is_some_and(|sub| sub.len() > 1 && sub.ends_with('.')),
+                false => host == rule.host,
+            };
+            host_matches && rule.port.map_or(true, |allowed| allowed == port)
+        })
+    }
+}
+
+fn parse_rule(entry: &str) -> Result<Rule> {
+    let invalid = || {
+        anyhow::anyhow!(
+            "egress.allow entry '{}' isn't host, host:port or *.domain",
+            entry
+        )
+    };
+    let (host, port) = split_host_port(entry.trim()).map_err(|_| invalid())?;
+    let (host, wildcard) = match host.strip_prefix("*.") {
+        Some(domain) => (domain.to_string(), true),
+        None => (host, false),
+    };
+    if host.is_empty() || host.contains('*') {
+        return Err(invalid());
+    }
+    Ok(Rule {
+        host,
+        wildcard,
+        port,
+    })
+}
+
+/// A `forward` entry: connections to `listen` inside reach `host:port`
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Forward {
+    pub listen: u16,
+    pub host: String,
+    pub port: u16,
+}
+
+impl Forward {
+    /// Parse "listen:host:port", e.g. "5432:db.internal:5432"
+    pub fn parse(entry: &str) -> Result<Self> {
+        let invalid = || {
+            anyhow::anyhow!(
+                "egress.forward entry '{}' isn't listen_port:host:port",
+                entry
+            )
+        };
+        let (listen, destination) = entry.trim().split_once(':').ok_or_else(invalid)?;
+        let listen = parse_port(listen).ok_or_else(invalid)?;
+        let (host, port) = split_host_port(destination).map_err(|_| invalid())?;
+        let port = port.ok_or_else(invalid)?;
+        if host.contains('*') {
+            return Err(invalid());
+        }
+        if listen == PROXY_PORT {
+            anyhow::bail!(
+                "egress.forward entry '{}' listens on {}, the proxy's port",
+                entry,
+                PROXY_PORT
+            );
+        }
+        Ok(Self { listen, host, port })
+    }
+}
+
+/// Variables pointing an instance's HTTP clients at the proxy
+pub fn proxy_env() -> Vec<(String, String)> {
+    let url = format!("http://127.0.0.1:{}", PROXY_PORT);
+    let mut env = Vec::new();
+    for name in ["HTTP_PROXY", "HTTPS_PROXY", "http_proxy", "https_proxy"] {
+        env.push((name.to_string(), url.clone()));
+    }
+    for name in ["NO_PROXY", "no_proxy"] {
+        env.push((name.to_string(), "localhost,127.0.0.1".to_string()));
+    }
+    env
+}
+
+/// Lowercase, without a trailing dot or IPv6 brackets
+fn normalize(host: &str) -> String {
+    let host = host.trim_end_matches('.');
+    let host = host
+        .strip_prefix('[')
+        .and_then(|h| h.strip_suffix(']'))
+        .unwrap_or(host);
+    host.to_ascii_lowercase()
+}
+
+fn parse_port(s: &str) -> Option<u16> {
+    s.parse().ok().filter(|&port| port != 0)
+}
+
+/// "host", "host:port", "[v6]:port" or a bare IPv6 address
+fn split_host_port(s: &str) -> Result<(String, Option<u16>)> {
+    let (host, port) = if let Some(rest) = s.strip_prefix('[') {
+        let (host, rest) = rest.split_once(']').context("unclosed [")?;
+        match rest {
+            "" => (host, None),
+            _ => (host, Some(rest.strip_prefix(':').context("junk after ]")?)),
+        }
+    } else {
+        match s.matches(':').count() {
+            0 => (s, None),
+            1 => {
+                let (host, port) = s.split_once(':').expect("has a colon");
+                (host, Some(port))
+            }
+            _ => (s, None),
+        }
+    };
+    let valid = !host.is_empty()
+        && host
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || matches!(c, '-' | '.' | '_' | ':' | '*'));
+    if !valid {
+        anyhow::bail!("invalid host '{}'", host);
+    }
+    let port = match port {
+        Some(port) => Some(parse_port(port).context("invalid port")?),
+        None => None,
+    };
+    Ok((normalize(host), port))
+}
+
+/// Where a request to the proxy wants to go
+#[derive(Debug, PartialEq, Eq)]
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+enum Request {
+    /// CONNECT: splice once the tunnel is acknowledged
+    Tunnel { host: String, port: u16 },
+    /// Plain HTTP with an absolute URI: `head` is rewritten for the origin
+    Http {
+        host: String,
+        port: u16,
+        head: Vec<u8>,
+    },
+}
+
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+impl Request {
+    fn destination(&self) -> (&str, u16) {
+        match self {
+            Request::Tunnel { host, port } | Request::Http { host, port, .. } => (host, *port),
+        }
+    }
+}
+
+/// Where the request head ends (just past the blank line), if it has
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+fn head_end(buf: &[u8]) -> Option<usize> {
+    buf.windows(4)
+        .position(|window| window == b"\r\n\r\n")
+        .map(|i| i + 4)
+}
+
+/// Parse a request head, through the blank line
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+fn parse_request(head: &[u8]) -> Result<Request> {
+    let head = std::str::from_utf8(head).context("request head isn't UTF-8")?;
+    let (line, headers) = head.split_once("\r\n").context("no request line")?;
+    let mut parts = line.split(' ');
+    let (Some(method), Some(target), Some(version), None) =
+        (parts.next(), parts.next(), parts.next(), parts.next())
+    else {
+        anyhow::bail!("malformed request line");
+    };
+    if method.eq_ignore_ascii_case("CONNECT") {
+        let (host, port) = split_host_port(target)?;
+        let port = port.context("CONNECT target has no port")?;
+        return Ok(Request::Tunnel { host, port });
+    }
+    let rest = target
+        .strip_prefix("http://")
+        .context("only CONNECT and http:// URIs go through the proxy")?;
+    let (authority, path) = match rest.find(|c: char| c == '/' || c == '?') {
+        Some(i) => rest.split_at(i),
+        None => (rest, "/"),
+    };
+    let authority = authority
+        .rsplit_once('@')
+        .map_or(authority, |(_, host)| host);
+    let (host, port) = split_host_port(authority)?;
+
+    let mut out = match path.starts_with('/') {
+        true => format!("{} {} {}\r\n", method, path, version),
+        false => format!("{} /{} {}\r\n", method, path, version),
+    };
+    for header in headers.split("\r\n").filter(|h| !h.is_empty()) {
+        let name = header.split_once(':').map_or(header, |(name, _)| name);
+        if HOP_HEADERS
+            .iter()
+            .any(|h| name.trim().eq_ignore_ascii_case(h))
+        {
+            continue;
+        }
+        out.push_str(header);
+        out.push_str("\r\n");
+    }
+    // One request per connection, so each is checked against the policy
+    out.push_str("Connection: close\r\n\r\n");
+    Ok(Request::Http {
+        host,
+        port: port.unwrap_or(80),
+        head: out.into_bytes(),
+    })
+}
+
+#[cfg(target_os = "linux")]
+pub use linux::Netns;
+
+/// Network namespaces need Linux; nothing makes one of these elsewhere
+#[cfg(not(target_os = "linux"))]
+pub struct Netns(std::convert::Infallible);
+
+#[cfg(not(target_os = "linux"))]
+impl Netns {
+    pub async fn start(
+        _id: &str,
+        _policy: Policy,
+        _forwards: Vec<Forward>,
+        _port: Option<u16>,
+    ) -> Result<Self> {
+        anyhow::bail!("egress policies need Linux network namespaces")
+    }
+
+    pub fn fd(&self) -> i32 {
+        match self.0 {}
+    }
+}
+
+#[cfg(target_os = "linux")]
+mod linux {
+    use super::*;
+    use crate::sockets::AcceptBackoff;
+    use std::fs::File;
+    use std::io;
+    use std::os::fd::{AsRawFd, FromRawFd, OwnedFd};
+    use std::sync::{mpsc, Arc};
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+    use tokio::net::{TcpListener, TcpSocket, TcpStream};
+    use tokio::sync::{oneshot, Notify};
+
+    /// How often the bridge checks whether the instance listens on its port
+    const BRIDGE_POLL: Duration = Duration::from_millis(100);
+
+    type Reply = oneshot::Sender<io::Result<OwnedFd>>;
+    type Ready = oneshot::Sender<io::Result<Inside>>;
+
+    /// What the namespace thread hands back once it's in the namespace
+    struct Inside {
+        file: File,
+        listeners: Vec<std::net::TcpListener>,
+        /// The thread's id, whose /proc/self/task entry shows the namespace's sockets
+        tid: libc::pid_t,
+    }
+
+    /// An instance's network namespace and the listeners tenement keeps in it.
+    /// Dropping it stops them; the namespace goes once its processes exit.
+    pub struct Netns {
+        /// The namespace, for the instance to join before exec
+        file: File,
+        tasks: Vec<tokio::task::JoinHandle<()>>,
+    }
+
+    impl Netns {
+        /// A namespace with only loopback for instance `id`, with the proxy
+        /// for `policy` and the `forwards` in it, and `port` passed in to it
+        /// from the host
+        pub async fn start(
+            id: &str,
+            policy: Policy,
+            forwards: Vec<Forward>,
+            port: Option<u16>,
+        ) -> Result<Self> {
+            let mut ports = vec![PROXY_PORT];
+            ports.extend(forwards.iter().map(|forward| forward.listen));
+            if let Some(port) = port.filter(|port| ports.contains(port)) {
+                anyhow::bail!(
+                    "{} was given port {}, which its egress proxy or a forward uses",
+                    id,
+                    port
+                );
+            }
+
+            let (ready, setup) = oneshot::channel();
+            let (dial, dials) = mpsc::channel();
+            std::thread::Builder::new()
+                .name(format!("netns-{}", id))
+                .spawn(move || hold(ports, ready, dials))
+                .context("Failed to start the network namespace thread")?;
+            let Inside {
+                file,
+                listeners,
+                tid,
+            } = setup
+                .await
+                .context("The network namespace thread exited")?
+                .context("Failed to set up a network namespace (needs root)")?;
+            let mut listeners = listeners
+                .into_iter()
+                .map(|listener| {
+                    listener.set_nonblocking(true)?;
+                    TcpListener::from_std(listener)
+                })
+                .collect::<io::Result<Vec<_>>>()?
+                .into_iter();
+
+            let id = id.to_string();
+            let proxy = listeners.next().expect("the proxy's port was bound");
+            let mut tasks = vec![tokio::spawn(accept_proxy(
+                id.clone(),
+                Arc::new(policy),
+                proxy,
+            ))];
+            for (forward, listener) in forwards.into_iter().zip(listeners) {
+                tasks.push(tokio::spawn(accept_forward(id.clone(), forward, listener)));
+            }
+            if let Some(port) = port {
+                tasks.push(tokio::spawn(bridge(id, port, tid, dial)));
+            }
+            Ok(Self { file, tasks })
+        }
+
+        /// Descriptor of the namespace, to `setns` into
+        pub fn fd(&self) -> i32 {
+            self.file.as_raw_fd()
+        }
+    }
+
+    impl Drop for Netns {
+        fn drop(&mut self) {
+            for task in &self.tasks {
+                task.abort();
+            }
+        }
+    }
+
+    /// Body of the thread that makes the namespace and stays in it. Sockets
+    /// belong to the namespace they were made in, wherever they're used later,
+    /// so it binds the listeners and makes the sockets the bridge connects to
+    /// the instance's port with. The connects themselves run on the runtime.
+    fn hold(ports: Vec<u16>, ready: Ready, sockets: mpsc::Receiver<Reply>) {
+        if ready.send(setup(&ports)).is_err() {
+            return;
+        }
+        // Ends once the bridge is dropped
+        for reply in sockets {
+            reply.send(tcp_socket()).ok();
+        }
+    }
+
+    /// Move this thread into a new namespace, and listen on `ports` in it
+    fn setup(ports: &[u16]) -> io::Result<Inside> {
+        if unsafe { libc::unshare(libc::CLONE_NEWNET) } != 0 {
+            return Err(io::Error::last_os_error());
+        }
+        loopback_up()?;
+        let file = File::open("/proc/thread-self/ns/net")?;
+        let listeners = ports
+            .iter()
+            .map(|&port| std::net::TcpListener::bind(("127.0.0.1", port)))
+            .collect::<io::Result<_>>()?;
+        let tid = unsafe { libc::gettid() };
+        Ok(Inside {
+            file,
+            listeners,
+            tid,
+        })
+    }
+
+    /// A new, unconnected, non-blocking TCP socket in this thread's namespace
+    fn tcp_socket() -> io::Result<OwnedFd> {
+        let flags = libc::SOCK_STREAM | libc::SOCK_CLOEXEC | libc::SOCK_NONBLOCK;
+        let fd = unsafe { libc::socket(libc::AF_INET, flags, 0) };
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+        Ok(unsafe { OwnedFd::from_raw_fd(fd) })
+    }
+
+    /// Bring up `lo`, which starts down in a new namespace
+    fn loopback_up() -> io::Result<()> {
+        #[repr(C)]
+        struct IfReq {
+            name: [u8; libc::IFNAMSIZ],
+            flags: libc::c_short,
+            pad: [u8; 22],
+        }
+
+        let fd = unsafe { libc::socket(libc::AF_INET, libc::SOCK_DGRAM | libc::SOCK_CLOEXEC, 0) };
+        if fd < 0 {
+            return Err(io::Error::last_os_error());
+        }
+        let socket = unsafe { OwnedFd::from_raw_fd(fd) };
+        let mut req = IfReq {
+            name: [0; libc::IFNAMSIZ],
+            flags: 0,
+            pad: [0; 22],
+        };
+        req.name[..2].copy_from_slice(b"lo");
+        let req = &mut req as *mut IfReq;
+        unsafe {
+            if libc::ioctl(socket.as_raw_fd(), libc::SIOCGIFFLAGS as _, req) < 0 {
+                return Err(io::Error::last_os_error());
+            }
+            (*req).flags |= libc::IFF_UP as libc::c_short;
+            if libc::ioctl(socket.as_raw_fd(), libc::SIOCSIFFLAGS as _, req) < 0 {
+                return Err(io::Error::last_os_error());
+            }
+        }
+        Ok(())
+    }
+
+    async fn accept_proxy(id: String, policy: Arc<Policy>, listener: TcpListener) {
+        let mut backoff = AcceptBackoff::default();
+        loop {
+            let conn = match listener.accept().await {
+                Ok((conn, _)) => conn,
+                Err(e) => {
+                    tracing::warn!("Egress proxy of {}: accept failed: {}", id, e);
+                    backoff.failed().await;
+                    continue;
+                }
+            };
+            backoff.succeeded();
+            let (id, policy) = (id.clone(), policy.clone());
+            tokio::spawn(async move {
+                if let Err(e) = proxy(&id, &policy, conn).await {
+                    tracing::debug!("Egress proxy of {}: {:#}", id, e);
+                }
+            });
+        }
+    }
+
+    /// Serve one request to the proxy: check it, then tunnel or forward it
+    async fn proxy(id: &str, policy: &Policy, mut conn: TcpStream) -> Result<()> {
+        let (head, early) = read_head(&mut conn).await?;
+        let request = match parse_request(&head) {
+            Ok(request) => request,
+            Err(e) => {
+                respond(&mut conn, "400 Bad Request", &format!("{:#}", e)).await;
+                return Err(e);
+            }
+        };
+        let (host, port) = request.destination();
+        if !policy.allows(host, port) {
+            tracing::warn!("Egress from {} to {}:{} denied", id, host, port);
+            let reason = format!("egress to {}:{} isn't allowed", host, port);
+            respond(&mut conn, "403 Forbidden", &reason).await;
+            return Ok(());
+        }
+        let mut upstream = match connect(host, port).await {
+            Ok(upstream) => upstream,
+            Err(e) => {
+                respond(&mut conn, "502 Bad Gateway", &format!("{:#}", e)).await;
+                return Err(e);
+            }
+        };
+        tracing::debug!("Egress from {} to {}:{}", id, host, port);
+        match &request {
+            Request::Tunnel { .. } => {
+                conn.write_all(b"HTTP/1.1 200 Connection established\r\n\r\n")
+                    .await?
+            }
+            Request::Http { head, .. } => upstream.write_all(head).await?,
+        }
+        upstream.write_all(&early).await?;
+        // Either side hanging up ends the splice; that's no error
+        tokio::io::copy_bidirectional(&mut conn, &mut upstream)
+            .await
+            .ok();
+        Ok(())
+    }
+
+    /// The request head, and whatever was read after it
+    async fn read_head(conn: &mut TcpStream) -> Result<(Vec<u8>, Vec<u8>)> {
+        let mut buf = Vec::new();
+        let mut chunk = [0u8; 4096];
+        loop {
+            if let Some(end) = head_end(&buf) {
+                let early = buf.split_off(end);
+                return Ok((buf, early));
+            }
+            if buf.len() > MAX_HEAD {
+                anyhow::bail!("request head is over {} bytes", MAX_HEAD);
+            }
+            let n = conn.read(&mut chunk).await?;
+            if n == 0 {
+                anyhow::bail!("connection closed before the request head ended");
+            }
+            buf.extend_from_slice(&chunk[..n]);
+        }
+    }
+
+    async fn respond(conn: &mut TcpStream, status: &str, reason: &str) {
+        let response = format!(
+            "HTTP/1.1 {}\r\nContent-Type: text/plain\r\nContent-Length: {}\r\n\
+             Connection: close\r\n\r\n{}\n",
+            status,
+            reason.len() + 1,
+            reason
+        );
+        conn.write_all(response.as_bytes()).await.ok();
+    }
+
+    async fn connect(host: &str, port: u16) -> Result<TcpStream> {
+        tokio::time::timeout(CONNECT_TIMEOUT, TcpStream::connect((host, port)))
+            .await
+            .map_err(|_| anyhow::anyhow!("Timed out connecting to {}:{}", host, port))?
+            .with_context(|| format!("Failed to connect to {}:{}", host, port))
+    }
+
+    async fn accept_forward(id: String, forward: Forward, listener: TcpListener) {
+        let mut backoff = AcceptBackoff::default();
+        loop {
+            let mut conn = match listener.accept().await {
+                Ok((conn, _)) => conn,
+                Err(e) => {
+                    tracing::warn!("Egress forward of {}: accept failed: {}", id, e);
+                    backoff.failed().await;
+                    continue;
+                }
+            };
+            backoff.succeeded();
+            let (id, forward) = (id.clone(), forward.clone());
+            tokio::spawn(async move {
+                match connect(&forward.host, forward.port).await {
+                    Ok(mut upstream) => {
+                        tokio::io::copy_bidirectional(&mut conn, &mut upstream)
+                            .await
+                            .ok();
+                    }
+                    Err(e) => tracing::warn!("Egress forward of {}: {:#}", id, e),
+                }
+            });
+        }
+    }
+
+    /// Pass connections to `port` on the host's loopback to `port` inside.
+    /// The host side listens only while the instance does, so connection
+    /// probes see it as they would without a namespace. Whether it listens is
+    /// read from the namespace's socket tables (through thread `tid`), so the
+    /// app never sees a probe connection.
+    async fn bridge(id: String, port: u16, tid: libc::pid_t, dial: mpsc::Sender<Reply>) {
+        let tcp = format!("/proc/self/task/{}/net/tcp", tid);
+        let tcp6 = format!("/proc/self/task/{}/net/tcp6", tid);
+        loop {
+            // Wait for the instance to listen
+            loop {
+                // Gone along with the namespace thread
+                let Ok(tcp) = tokio::fs::read_to_string(&tcp).await else {
+                    return;
+                };
+                // Missing with IPv6 off
+                let tcp6 = tokio::fs::read_to_string(&tcp6).await.unwrap_or_default();
+                if listening(&tcp, port) || listening(&tcp6, port) {
+                    break;
+                }
+                tokio::time::sleep(BRIDGE_POLL).await;
+            }
+            let listener = match TcpListener::bind(("127.0.0.1", port)).await {
+                Ok(listener) => listener,
+                Err(e) => {
+                    tracing::warn!("{} isn't reachable on port {}: {}", id, port, e);
+                    tokio::time::sleep(BRIDGE_POLL).await;
+                    continue;
+                }
+            };
+            let stopped = Arc::new(Notify::new());
+            let mut backoff = AcceptBackoff::default();
+            loop {
+                let accepted = tokio::select! {
+                    accepted = listener.accept() => accepted,
+                    _ = stopped.notified() => break,
+                };
+                let mut conn = match accepted {
+                    Ok((conn, _)) => conn,
+                    Err(e) => {
+                        tracing::warn!("Port {} of {}: accept failed: {}", port, id, e);
+                        backoff.failed().await;
+                        continue;
+                    }
+                };
+                backoff.succeeded();
+                let (inner, stopped) = (dial_in(&dial, port), stopped.clone());
+                tokio::spawn(async move {
+                    match inner.await {
+                        Some(Ok(mut inner)) => {
+                            tokio::io::copy_bidirectional(&mut conn, &mut inner)
+                                .await
+                                .ok();
+                        }
+                        // It stopped listening; so does the host side until it's back
+                        Some(Err(_)) | None => stopped.notify_one(),
+                    }
+                });
+            }
+        }
+    }
+
+    /// Whether a /proc/net/tcp or tcp6 table has a socket listening on `port`
+    pub(super) fn listening(table: &str, port: u16) -> bool {
+        let port = format!(":{:04X}", port);
+        table.lines().skip(1).any(|line| {
+            let mut fields = line.split_whitespace();
+            let local = fields.nth(1);
+            let state = fields.nth(1);
+            local.is_some_and(|local| local.ends_with(&port)) && state == Some("0A")
+        })
+    }
+
+    /// Connect to `port` inside the namespace with a socket made there; None
+    /// once its thread is gone
+    fn dial_in(
+        dial: &mpsc::Sender<Reply>,
+        port: u16,
+    ) -> impl std::future::Future<Output = Option<io::Result<TcpStream>>> {
+        let (reply, socket) = oneshot::channel();
+        let sent = dial.send(reply).is_ok();
+        async move {
+            if !sent {
+                return None;
+            }
+            let socket = socket.await.ok()?;
+            let connected = async {
+                let socket = TcpSocket::from_std_stream(std::net::TcpStream::from(socket?));
+                let inside = std::net::SocketAddr::from(([127, 0, 0, 1], port));
+                tokio::time::timeout(CONNECT_TIMEOUT, socket.connect(inside))
+                    .await
+                    .map_err(|_| io::Error::from(io::ErrorKind::TimedOut))?
+            };
+            Some(connected.await)
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn policy(allow: &[&str]) -> Policy {
+        let allow: Vec<String> = allow.iter().map(|s| s.to_string()).collect();
+        Policy::parse(&allow).unwrap()
+    }
+
+    // ===================
+    // Policy
+    // ===================
+
+    #[test]
+    fn test_policy_matches_hosts_and_ports() {
+        let policy = policy(&["api.stripe.com:443", "*.amazonaws.com", "10.0.0.5:5432"]);
+        assert!(policy.allows("api.stripe.com", 443));
+        assert!(policy.allows("API.Stripe.com.", 443));
+        assert!(!policy.allows("api.stripe.com", 80));
+        assert!(!policy.allows("files.stripe.com", 443));
+        assert!(policy.allows("s3.us-east-1.amazonaws.com", 443));
+        assert!(policy.allows("s3.amazonaws.com", 8080));
+        // The wildcard covers subdomains only
+        assert!(!policy.allows("amazonaws.com", 443));
+        assert!(!policy.allows("evilamazonaws.com", 443));
+        assert!(policy.allows("10.0.0.5", 5432));
+        assert!(!policy.allows("10.0.0.6", 5432));
+
+        assert!(!Policy::default().allows("example.com", 443));
+        assert!(self::policy(&["[::1]:8080"]).allows("::1", 8080));
+    }
+
+    #[test]
+    fn test_invalid_rules() {
+        for entry in [
+            "",
+            "host:0",
+            "host:http",
+            "a*.example.com",
+            "ex ample.com",
+            "[::1",
+        ] {
+            let err = Policy::parse(&[entry.to_string()]).unwrap_err();
+            assert!(err.to_string().contains("isn't host"), "{}: {}", entry, err);
+        }
+    }
+
+    #[test]
+    fn test_forward_parse() {
+        let forward = Forward::parse("5432:db.internal:5432").unwrap();
+        assert_eq!(
+            forward,
+            Forward {
+                listen: 5432,
+                host: "db.internal".to_string(),
+                port: 5432
+            }
+        );
+        assert_eq!(
+            Forward::parse("6000:[fd00::1]:6379").unwrap().host,
+            "fd00::1"
+        );
+        for entry in ["5432", "5432:db", "x:db:5432", "5432:*.db:5432"] {
+            assert!(Forward::parse(entry).is_err(), "{}", entry);
+        }
+        let err = Forward::parse("3128:db:80").unwrap_err();
+        assert!(err.to_string().contains("the proxy's port"));
+    }
+
+    #[test]
+    fn test_proxy_env() {
+        let env: std::collections::HashMap<_, _> = proxy_env().into_iter().collect();
+        assert_eq!(env["HTTPS_PROXY"], "http://127.0.0.1:3128");
+        assert_eq!(env["http_proxy"], "http://127.0.0.1:3128");
+        assert_eq!(env["NO_PROXY"], "localhost,127.0.0.1");
+    }
+
+    // ===================
+    // Requests
+    // ===================
+
+    #[cfg(target_os = "linux")]
+    #[test]
+    fn test_listening_reads_socket_table() {
+        let table = "  sl  local_address rem_address   st tx_queue rx_queue\n\
+            0: 0100007F:1F90 00000000:0000 0A 00000000:00000000\n\
+            1: 0100007F:0BB8 0100007F:D431 01 00000000:00000000\n";
+        assert!(linux::listening(table, 8080));
+        // Connected, not listening
+        assert!(!linux::listening(table, 3000));
+        assert!(!linux::listening(table, 80));
+        assert!(!linux::listening("", 8080));
+    }
+
+    #[test]
+    fn test_head_end() {
+        assert_eq!(head_end(b"GET / HTTP/1.1\r\nHost: a\r\n\r\nbody"), Some(27));
+        assert_eq!(head_end(b"GET / HTTP/1.1\r\nHost: a\r\n"), None);
+    }
+
+    #[test]
+    fn test_parse_connect() {
+        let request = parse_request(b"CONNECT api.stripe.com:443 HTTP/1.1\r\n\r\n").unwrap();
+        assert_eq!(
+            request,
+            Request::Tunnel {
+                host: "api.stripe.com".to_string(),
+                port: 443
+            }
+        );
+        assert!(parse_request(b"CONNECT api.stripe.com HTTP/1.1\r\n\r\n").is_err());
+    }
+
+    #[test]
+    fn test_parse_http_rewrites_for_origin() {
+        let head = b"GET http://user@Example.com:8080/a?b=1 HTTP/1.1\r\nHost: example.com\r\n\
+                     Proxy-Connection: keep-alive\r\nConnection: keep-alive\r\nAccept: */*\r\n\r\n";
+        let Request::Http { host, port, head } = parse_request(head).unwrap() else {
+            panic!("expected a plain HTTP request");
+        };
+        assert_eq!((host.as_str(), port), ("example.com", 8080));
+        assert_eq!(
+            String::from_utf8(head).unwrap(),
+            "GET /a?b=1 HTTP/1.1\r\nHost: example.com\r\nAccept: */*\r\nConnection: close\r\n\r\n"
+        );
+
+        let request = parse_request(b"GET http://example.com?q HTTP/1.1\r\n\r\n").unwrap();
+        assert_eq!(request.destination(), ("example.com", 80));
+        let Request::Http { head, .. } = request else {
+            panic!("expected a plain HTTP request");
+        };
+        assert!(head.starts_with(b"GET /?q HTTP/1.1\r\n"));
+    }
+
+    #[test]
+    fn test_parse_rejects_other_requests() {
+        for head in [
+            &b"GET /local HTTP/1.1\r\n\r\n"[..],
+            b"GET https://example.com/ HTTP/1.1\r\n\r\n",
+            b"GARBAGE\r\n\r\n",
+        ] {
+            assert!(parse_request(head).is_err());
+        }
+    }
+}
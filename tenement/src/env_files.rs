@@ -0,0 +1,191 @@
+//! Dotenv-style env files for tenement instances
+//!
+//! Services list files as `env_files = [".env", "secrets.env"]`. Files are read
+//! in order at spawn, so later files override earlier ones, and the service's
+//! inline `env` overrides them all. Values may reference `${VAR}` (or
+//! `${VAR:-default}`), resolved from variables defined earlier and then from
+//! tenement's own environment.
+
+use anyhow::{Context, Result};
+use std::collections::HashMap;
+use std::path::PathBuf;
+
+/// Read env files in order; later files override earlier ones
+pub fn load(paths: &[PathBuf]) -> Result<HashMap<String, String>> {
+    let mut env = HashMap::new();
+    for path in paths {
+        let content = std::fs::read_to_string(path)
+            .with_context(|| format!("Failed to read env file {}", path.display()))?;
+        parse_into(&content, &mut env)
+            .with_context(|| format!("Invalid env file {}", path.display()))?;
+    }
+    Ok(env)
+}
+
+/// Parse `KEY=value` lines into `env`. Blank lines, `#` comments and an
+/// `export ` prefix are allowed. Single-quoted values are taken literally;
+/// double-quoted and bare values are interpolated.
+pub fn parse_into(content: &str, env: &mut HashMap<String, String>) -> Result<()> {
+    for (index, line) in content.lines().enumerate() {
+        let line = line.trim();
+        if line.is_empty() || line.starts_with('#') {
+            continue;
+        }
+        let line = line.strip_prefix("export ").map(str::trim_start).unwrap_or(line);
+        let (key, raw) = line
+            .split_once('=')
+            .with_context(|| format!("line {}: expected KEY=value", index + 1))?;
+        let key = key.trim();
+        if !is_valid_name(key) {
+            anyhow::bail!("line {}: invalid variable name '{}'", index + 1, key);
+        }
+        let value = parse_value(raw.trim(), env)
+            .with_context(|| format!("line {}: {}", index + 1, key))?;
+        env.insert(key.to_string(), value);
+    }
+    Ok(())
+}
+
+fn parse_value(raw: &str, env: &HashMap<String, String>) -> Result<String> {
+    if let Some(rest) = raw.strip_prefix('\'') {
+        let end = rest.find('\'').context("unterminated single quote")?;
+        return Ok(rest[..end].to_string());
+    }
+    if let Some(rest) = raw.strip_prefix('"') {
+        let mut value = String::new();
+        let mut chars = rest.chars();
+        loop {
+            match chars.next().context("unterminated double quote")? {
+                '"' => break,
+                '\\' => match chars.next().context("unterminated double quote")? {
+                    'n' => value.push('\n'),
+                    't' => value.push('\t'),
+                    c => value.push(c),
+                },
+                c => value.push(c),
+            }
+        }
+        return Ok(expand(&value, env));
+    }
+    // Bare values end at an inline comment
+    let value = match raw.find(" #") {
+        Some(end) => raw[..end].trim_end(),
+        None => raw,
+    };
+    Ok(expand(value, env))
+}
+
+/// Replace `${VAR}` and `${VAR:-default}` with values from `vars`, falling back
+/// to tenement's environment. Unset variables without a default become empty.
+pub fn expand(value: &str, vars: &HashMap<String, String>) -> String {
+    let mut out = String::with_capacity(value.len());
+    let mut rest = value;
+    while let Some(start) = rest.find("${") {
+        let Some(len) = rest[start..].find('}') else {
+            break;
+        };
+        out.push_str(&rest[..start]);
+        let inner = &rest[start + 2..start + len];
+        let (name, default) = match inner.split_once(":-") {
+            Some((name, default)) => (name, Some(default)),
+            None => (inner, None),
+        };
+        let found = vars
+            .get(name)
+            .cloned()
+            .or_else(|| std::env::var(name).ok())
+            .filter(|v| !v.is_empty());
+        out.push_str(&found.or(default.map(str::to_string)).unwrap_or_default());
+        rest = &rest[start + len + 1..];
+    }
+    out.push_str(rest);
+    out
+}
+
+/// Whether `name` works as an env var name: letters, digits and `_`, not
+/// starting with a digit
+pub fn is_valid_name(name: &str) -> bool {
+    !name.is_empty()
+        && !name.starts_with(|c: char| c.is_ascii_digit())
+        && name.chars().all(|c| c.is_ascii_alphanumeric() || c == '_')
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn parse(content: &str) -> HashMap<String, String> {
+        let mut env = HashMap::new();
+        parse_into(content, &mut env).unwrap();
+        env
+    }
+
+    #[test]
+    fn test_parse_dotenv_syntax() {
+        let env = parse(
+            "# comment\n\
+             \n\
+             PLAIN=abc\n\
+             export EXPORTED = yes\n\
+             SPACED=hello world # trailing comment\n\
+             SINGLE='${NOT_EXPANDED} #kept'\n\
+             DOUBLE=\"line\\none \\\"quoted\\\"\"\n\
+             EMPTY=\n",
+        );
+        assert_eq!(env["PLAIN"], "abc");
+        assert_eq!(env["EXPORTED"], "yes");
+        assert_eq!(env["SPACED"], "hello world");
+        assert_eq!(env["SINGLE"], "${NOT_EXPANDED} #kept");
+        assert_eq!(env["DOUBLE"], "line\none \"quoted\"");
+        assert_eq!(env["EMPTY"], "");
+    }
+
+    #[test]
+    fn test_parse_rejects_bad_lines() {
+        let mut env = HashMap::new();
+        let err = parse_into("OK=1\nNOT A PAIR\n", &mut env).unwrap_err();
+        assert!(err.to_string().contains("line 2"));
+
+        let err = parse_into("1BAD=x\n", &mut env).unwrap_err();
+        assert!(err.to_string().contains("invalid variable name"));
+
+        let err = parse_into("KEY=\"open\n", &mut env).unwrap_err();
+        assert!(format!("{:#}", err).contains("unterminated double quote"));
+    }
+
+    #[test]
+    fn test_expand_uses_earlier_vars_then_host_env() {
+        let env = parse(
+            "HOST=db.internal\n\
+             URL=postgres://${HOST}:${PORT:-5432}/app\n\
+             HOME_COPY=${HOME}\n\
+             MISSING=[${TENEMENT_TEST_SURELY_UNSET}]\n\
+             UNCLOSED=${HOST\n",
+        );
+        assert_eq!(env["URL"], "postgres://db.internal:5432/app");
+        assert_eq!(env["HOME_COPY"], std::env::var("HOME").unwrap_or_default());
+        assert_eq!(env["MISSING"], "[]");
+        assert_eq!(env["UNCLOSED"], "${HOST");
+    }
+
+    #[test]
+    fn test_load_later_files_override_earlier() {
+        let dir = TempDir::new().unwrap();
+        let base = dir.path().join(".env");
+        let local = dir.path().join("local.env");
+        std::fs::write(&base, "LEVEL=info\nNAME=api\n").unwrap();
+        std::fs::write(&local, "LEVEL=debug\nGREETING=hi ${NAME}\n").unwrap();
+
+        let env = load(&[base, local]).unwrap();
+        assert_eq!(env["LEVEL"], "debug");
+        assert_eq!(env["NAME"], "api");
+        assert_eq!(env["GREETING"], "hi api");
+    }
+
+    #[test]
+    fn test_load_missing_file() {
+        let err = load(&[PathBuf::from("/nonexistent/.env")]).unwrap_err();
+        assert!(err.to_string().contains("/nonexistent/.env"));
+    }
+}
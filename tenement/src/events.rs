@@ -0,0 +1,315 @@
+//! Structured lifecycle events
+//!
+//! The hypervisor publishes an [`Event`] whenever an instance starts, crashes
+//! or changes health state, a deploy completes, the autoscaler changes a
+//! service's replica count, or (from the server) a TLS certificate is
+//! renewed. Subscribers such as the webhook notifier get every event from the
+//! moment they subscribe; a subscriber that falls too far behind loses the
+//! oldest ones. The most recent events are also kept, for `ten events` to
+//! show before it follows.
+
+use crate::instance::InstanceId;
+use serde::{Deserialize, Serialize};
+use std::collections::VecDeque;
+use std::fmt;
+use std::str::FromStr;
+use std::sync::Mutex;
+use tokio::sync::broadcast;
+
+/// Events buffered per subscriber before the oldest are dropped
+const SUBSCRIBER_CAPACITY: usize = 256;
+
+/// Events kept for [`EventBus::recent`]
+const RECENT_EVENTS: usize = 1000;
+
+/// What happened
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Hash, Serialize, Deserialize)]
+#[serde(rename_all = "snake_case")]
+pub enum EventKind {
+    /// An instance was spawned
+    Started,
+    /// An instance exited without being stopped
+    Crashed,
+    /// A deploy finished with the new version healthy and serving
+    Deployed,
+    /// An instance's health check result changed
+    HealthChanged,
+    /// A new TLS certificate was issued and deployed
+    CertRenewed,
+    /// The autoscaler changed a service's replica count
+    Scaled,
+}
+
+impl EventKind {
+    /// Every kind, in declaration order
+    pub const ALL: [EventKind; 6] = [
+        EventKind::Started,
+        EventKind::Crashed,
+        EventKind::Deployed,
+        EventKind::HealthChanged,
+        EventKind::CertRenewed,
+        EventKind::Scaled,
+    ];
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            EventKind::Started => "started",
+            EventKind::Crashed => "crashed",
+            EventKind::Deployed => "deployed",
+            EventKind::HealthChanged => "health_changed",
+            EventKind::CertRenewed => "cert_renewed",
+            EventKind::Scaled => "scaled",
+        }
+    }
+}
+
+impl fmt::Display for EventKind {
+    fn fmt(&self, f: &mut fmt::Formatter<'_>) -> fmt::Result {
+        f.pad(self.as_str())
+    }
+}
+
+impl FromStr for EventKind {
+    type Err = anyhow::Error;
+
+    fn from_str(s: &str) -> anyhow::Result<Self> {
+        // "crash", "deploy", ... name the same kinds
+        let kind = match s {
+            "start" => Some(EventKind::Started),
+            "crash" => Some(EventKind::Crashed),
+            "deploy" => Some(EventKind::Deployed),
+            "health" => Some(EventKind::HealthChanged),
+            "cert" => Some(EventKind::CertRenewed),
+            "scale" => Some(EventKind::Scaled),
+            _ => EventKind::ALL.into_iter().find(|kind| kind.as_str() == s),
+        };
+        kind.ok_or_else(|| {
+            let known: Vec<_> = EventKind::ALL.iter().map(EventKind::as_str).collect();
+            anyhow::anyhow!(
+                "Unknown event '{}' (expected one of: {})",
+                s,
+                known.join(", ")
+            )
+        })
+    }
+}
+
+/// One event, as published and as POSTed to webhooks
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Event {
+    pub event: EventKind,
+    /// Service the event is about, if any
+    pub app: Option<String>,
+    /// Instance ID ("process:id"), if the event is about one
+    pub instance: Option<String>,
+    /// Active config environment, if any
+    pub env: Option<String>,
+    /// RFC 3339 time the event happened
+    pub timestamp: String,
+    /// Details that depend on the kind (e.g. `old_state`/`new_state`)
+    pub data: serde_json::Value,
+}
+
+impl Event {
+    /// An event not tied to any service
+    pub fn new(event: EventKind, data: serde_json::Value) -> Self {
+        Self {
+            event,
+            app: None,
+            instance: None,
+            env: None,
+            timestamp: chrono::Utc::now().to_rfc3339(),
+            data,
+        }
+    }
+
+    /// An event about a service as a whole
+    pub fn for_app(event: EventKind, app: &str, data: serde_json::Value) -> Self {
+        Self {
+            app: Some(app.to_string()),
+            ..Self::new(event, data)
+        }
+    }
+
+    /// An event about one instance
+    pub fn for_instance(event: EventKind, instance: &InstanceId, data: serde_json::Value) -> Self {
+        Self {
+            app: Some(instance.process.clone()),
+            instance: Some(instance.to_string()),
+            ..Self::new(event, data)
+        }
+    }
+}
+
+/// Which events a subscriber wants
+#[derive(Debug, Clone, Default)]
+pub struct EventFilter {
+    /// Only events about this service
+    pub app: Option<String>,
+    /// Only events about instances with this ID (the part after "process:")
+    pub id: Option<String>,
+    /// Only these kinds (all if empty)
+    pub kinds: Vec<EventKind>,
+}
+
+impl EventFilter {
+    pub fn matches(&self, event: &Event) -> bool {
+        if let Some(ref app) = self.app {
+            if event.app.as_ref() != Some(app) {
+                return false;
+            }
+        }
+        if let Some(ref id) = self.id {
+            let event_id = event.instance.as_deref().and_then(|i| i.split_once(':'));
+            if event_id.map(|(_, event_id)| event_id) != Some(id.as_str()) {
+                return false;
+            }
+        }
+        self.kinds.is_empty() || self.kinds.contains(&event.event)
+    }
+}
+
+/// Publishes events to subscribers and keeps the most recent ones
+pub struct EventBus {
+    sender: broadcast::Sender<Event>,
+    recent: Mutex<VecDeque<Event>>,
+}
+
+impl Default for EventBus {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+impl EventBus {
+    pub fn new() -> Self {
+        Self {
+            sender: broadcast::channel(SUBSCRIBER_CAPACITY).0,
+            recent: Mutex::new(VecDeque::with_capacity(RECENT_EVENTS)),
+        }
+    }
+
+    pub fn publish(&self, event: Event) {
+        let mut recent = self.recent.lock().unwrap();
+        if recent.len() == RECENT_EVENTS {
+            recent.pop_front();
+        }
+        recent.push_back(event.clone());
+        // Sent under the lock, so `subscribe_with_recent` can't see it twice
+        let _ = self.sender.send(event);
+    }
+
+    /// Receive every event from now on
+    pub fn subscribe(&self) -> broadcast::Receiver<Event> {
+        self.sender.subscribe()
+    }
+
+    /// Recent events, oldest first
+    pub fn recent(&self) -> Vec<Event> {
+        self.recent.lock().unwrap().iter().cloned().collect()
+    }
+
+    /// Recent events and a receiver for every event after them, with none
+    /// missed or repeated in between
+    pub fn subscribe_with_recent(&self) -> (Vec<Event>, broadcast::Receiver<Event>) {
+        let recent = self.recent.lock().unwrap();
+        (recent.iter().cloned().collect(), self.sender.subscribe())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_event_kind_names_round_trip() {
+        for kind in EventKind::ALL {
+            assert_eq!(kind.as_str().parse::<EventKind>().unwrap(), kind);
+            assert_eq!(
+                serde_json::to_value(kind).unwrap(),
+                serde_json::json!(kind.as_str())
+            );
+        }
+        assert_eq!("crash".parse::<EventKind>().unwrap(), EventKind::Crashed);
+        assert_eq!("scale".parse::<EventKind>().unwrap(), EventKind::Scaled);
+        let err = "restarted".parse::<EventKind>().unwrap_err().to_string();
+        assert!(err.contains("health_changed"), "{}", err);
+    }
+
+    #[test]
+    fn test_event_serialization() {
+        let instance = InstanceId::new("api", "prod");
+        let event = Event::for_instance(
+            EventKind::HealthChanged,
+            &instance,
+            serde_json::json!({"old_state": "healthy", "new_state": "unhealthy"}),
+        );
+        let value = serde_json::to_value(&event).unwrap();
+        assert_eq!(value["event"], "health_changed");
+        assert_eq!(value["app"], "api");
+        assert_eq!(value["instance"], "api:prod");
+        assert_eq!(value["env"], serde_json::Value::Null);
+        assert_eq!(value["data"]["new_state"], "unhealthy");
+        assert!(chrono::DateTime::parse_from_rfc3339(&event.timestamp).is_ok());
+
+        let cert = Event::new(EventKind::CertRenewed, serde_json::json!({}));
+        assert_eq!(cert.app, None);
+        assert_eq!(cert.instance, None);
+
+        let scaled = Event::for_app(EventKind::Scaled, "api", serde_json::json!({"to": 3}));
+        assert_eq!(scaled.app.as_deref(), Some("api"));
+        assert_eq!(scaled.instance, None);
+    }
+
+    #[test]
+    fn test_filter() {
+        let api = Event::for_instance(
+            EventKind::Crashed,
+            &InstanceId::new("api", "prod"),
+            serde_json::json!({}),
+        );
+        let cert = Event::new(EventKind::CertRenewed, serde_json::json!({}));
+
+        assert!(EventFilter::default().matches(&api));
+        assert!(EventFilter::default().matches(&cert));
+        let crashes = EventFilter {
+            app: Some("api".to_string()),
+            kinds: vec![EventKind::Crashed],
+            ..Default::default()
+        };
+        assert!(crashes.matches(&api));
+        assert!(!crashes.matches(&cert));
+        let other = EventFilter {
+            app: Some("web".to_string()),
+            ..Default::default()
+        };
+        assert!(!other.matches(&api));
+        let tenant = |id: &str| EventFilter {
+            id: Some(id.to_string()),
+            ..Default::default()
+        };
+        assert!(tenant("prod").matches(&api));
+        assert!(!tenant("staging").matches(&api));
+        assert!(!tenant("prod").matches(&cert));
+    }
+
+    #[tokio::test]
+    async fn test_bus_keeps_recent_events() {
+        let bus = EventBus::new();
+        for i in 0..RECENT_EVENTS + 5 {
+            bus.publish(Event::new(
+                EventKind::Started,
+                serde_json::json!({ "n": i }),
+            ));
+        }
+        let recent = bus.recent();
+        assert_eq!(recent.len(), RECENT_EVENTS);
+        assert_eq!(recent[0].data["n"], 5);
+
+        let (backlog, mut rx) = bus.subscribe_with_recent();
+        assert_eq!(backlog.len(), RECENT_EVENTS);
+        bus.publish(Event::new(EventKind::Deployed, serde_json::json!({})));
+        assert_eq!(rx.recv().await.unwrap().event, EventKind::Deployed);
+        assert!(rx.try_recv().is_err());
+    }
+}
@@ -0,0 +1,794 @@
+//! `ten exec` and `ten attach`
+//!
+//! `ten exec api:prod -- sh` runs a command inside a running instance: with the
+//! environment it was started with, in its working directory, as its user and,
+//! when it's isolated, in its mount, network, UTS and IPC namespaces and under
+//! its root. `ten attach api:prod` follows one instance's stdout and stderr as
+//! it writes them.
+//!
+//! Both are HTTP upgrades on the admin socket only. After the upgrade the
+//! connection carries [`Frame`]s both ways; exec gets a pseudo-terminal when
+//! the client has one, and keeps its size in step with the client's.
+
+use crate::users::RunAs;
+use crate::Hypervisor;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::Duration;
+use tokio::io::{AsyncRead, AsyncReadExt, AsyncWrite, AsyncWriteExt};
+use tokio::sync::broadcast::error::RecvError;
+
+/// `Upgrade` protocol of an exec connection
+pub const EXEC_PROTOCOL: &str = "tenement-exec";
+
+/// `Upgrade` protocol of an attach connection
+pub const ATTACH_PROTOCOL: &str = "tenement-attach";
+
+/// Largest frame either side accepts
+const MAX_FRAME: usize = 1024 * 1024;
+
+/// Output still read after the command exits, before its exit code is sent
+const DRAIN_AFTER_EXIT: Duration = Duration::from_millis(500);
+
+/// How often attach checks that its instance is still running
+const ATTACH_POLL: Duration = Duration::from_secs(1);
+
+/// What `ten exec` asks to run: the upgrade request's JSON body
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ExecRequest {
+    pub command: Vec<String>,
+    /// Run it on a pseudo-terminal of `rows` x `cols`
+    #[serde(default)]
+    pub tty: bool,
+    #[serde(default)]
+    pub rows: u16,
+    #[serde(default)]
+    pub cols: u16,
+}
+
+/// One message on an exec or attach connection: a kind byte, a big-endian
+/// u32 length and the payload
+#[derive(Debug, Clone, PartialEq)]
+pub enum Frame {
+    /// Client to server: input for the command
+    Stdin(Vec<u8>),
+    /// Client to server: no more input
+    Eof,
+    /// Client to server: the terminal was resized
+    Resize {
+        rows: u16,
+        cols: u16,
+    },
+    Stdout(Vec<u8>),
+    Stderr(Vec<u8>),
+    /// Server to client, last: the command, or the attached instance, ended
+    Exit(i32),
+}
+
+impl Frame {
+    /// The next frame, or None once the other side has closed the connection
+    pub async fn read<R: AsyncRead + Unpin>(reader: &mut R) -> Result<Option<Frame>> {
+        let mut header = [0u8; 5];
+        match reader.read_exact(&mut header).await {
+            Ok(_) => {}
+            Err(e) if e.kind() == std::io::ErrorKind::UnexpectedEof => return Ok(None),
+            Err(e) => return Err(e.into()),
+        }
+        let len = u32::from_be_bytes([header[1], header[2], header[3], header[4]]) as usize;
+        if len > MAX_FRAME {
+            anyhow::bail!("Frame of {} bytes is too large", len);
+        }
+        let mut payload = vec![0u8; len];
+        reader.read_exact(&mut payload).await?;
+        let frame = match (header[0], payload.len()) {
+            (0, _) => Frame::Stdin(payload),
+            (1, 0) => Frame::Eof,
+            (2, 4) => Frame::Resize {
+                rows: u16::from_be_bytes([payload[0], payload[1]]),
+                cols: u16::from_be_bytes([payload[2], payload[3]]),
+            },
+            (3, _) => Frame::Stdout(payload),
+            (4, _) => Frame::Stderr(payload),
+            (5, 4) => Frame::Exit(i32::from_be_bytes([
+                payload[0], payload[1], payload[2], payload[3],
+            ])),
+            (kind, len) => anyhow::bail!("Bad frame: kind {} with {} bytes", kind, len),
+        };
+        Ok(Some(frame))
+    }
+
+    pub async fn write<W: AsyncWrite + Unpin>(&self, writer: &mut W) -> Result<()> {
+        let (kind, payload): (u8, &[u8]) = match self {
+            Frame::Stdin(data) => (0, data),
+            Frame::Eof => (1, &[]),
+            Frame::Resize { rows, cols } => {
+                let [r0, r1] = rows.to_be_bytes();
+                let [c0, c1] = cols.to_be_bytes();
+                return write_frame(writer, 2, &[r0, r1, c0, c1]).await;
+            }
+            Frame::Stdout(data) => (3, data),
+            Frame::Stderr(data) => (4, data),
+            Frame::Exit(code) => return write_frame(writer, 5, &code.to_be_bytes()).await,
+        };
+        write_frame(writer, kind, payload).await
+    }
+}
+
+async fn write_frame<W: AsyncWrite + Unpin>(
+    writer: &mut W,
+    kind: u8,
+    payload: &[u8],
+) -> Result<()> {
+    let mut frame = Vec::with_capacity(5 + payload.len());
+    frame.push(kind);
+    frame.extend_from_slice(&(payload.len() as u32).to_be_bytes());
+    frame.extend_from_slice(payload);
+    writer.write_all(&frame).await?;
+    writer.flush().await?;
+    Ok(())
+}
+
+/// A running instance, as exec needs it
+#[derive(Debug, Clone)]
+pub struct Target {
+    pub pid: u32,
+    /// The environment it was started with
+    pub env: HashMap<String, String>,
+    /// Its service's `workdir`, inside its root
+    pub workdir: Option<String>,
+    pub run_as: Option<RunAs>,
+}
+
+/// Follow the `process:id` instance's output on `stream` until it stops or
+/// the client goes away
+pub async fn attach<S>(
+    hypervisor: Arc<Hypervisor>,
+    process: &str,
+    id: &str,
+    stream: S,
+) -> Result<()>
+where
+    S: AsyncRead + AsyncWrite + Unpin,
+{
+    let mut logs = hypervisor.log_buffer().subscribe();
+    let (mut reader, mut writer) = tokio::io::split(stream);
+    let mut poll = tokio::time::interval(ATTACH_POLL);
+    let mut closed = [0u8; 64];
+    loop {
+        tokio::select! {
+            entry = logs.recv() => {
+                let entry = match entry {
+                    Ok(entry) => entry,
+                    Err(RecvError::Lagged(skipped)) => {
+                        let note = format!("[ten attach: skipped {} lines]\n", skipped);
+                        Frame::Stderr(note.into_bytes()).write(&mut writer).await?;
+                        continue;
+                    }
+                    Err(RecvError::Closed) => break,
+                };
+                if entry.process != process || entry.instance_id != id {
+                    continue;
+                }
+                let mut line = entry.message.into_bytes();
+                line.push(b'\n');
+                let frame = match entry.level {
+                    crate::LogLevel::Stdout => Frame::Stdout(line),
+                    crate::LogLevel::Stderr => Frame::Stderr(line),
+                };
+                frame.write(&mut writer).await?;
+            }
+            _ = poll.tick() => {
+                if hypervisor.get(process, id).await.is_none() {
+                    break;
+                }
+            }
+            read = reader.read(&mut closed) => {
+                if matches!(read, Ok(0) | Err(_)) {
+                    return Ok(());
+                }
+            }
+        }
+    }
+    Frame::Exit(0).write(&mut writer).await
+}
+
+#[cfg(unix)]
+pub use session::{command, Session};
+
+#[cfg(unix)]
+mod session {
+    use super::*;
+    use std::os::fd::{AsRawFd, FromRawFd, OwnedFd};
+    use std::process::Stdio;
+    use tokio::io::unix::AsyncFd;
+    use tokio::process::{Child, ChildStdin};
+    use tokio::sync::mpsc;
+
+    /// Build the command for `argv` as `target` runs: its env, workdir, user
+    /// and, on Linux, the cgroup, namespaces and root it doesn't share with
+    /// tenement
+    pub fn command(target: &Target, argv: &[String]) -> Result<std::process::Command> {
+        use std::os::unix::process::CommandExt;
+
+        let (program, args) = argv.split_first().context("No command given to run")?;
+        let mut cmd = std::process::Command::new(program);
+        cmd.args(args).env_clear().envs(&target.env);
+
+        #[cfg(target_os = "linux")]
+        let enter = namespaces::Enter::of(target.pid)?;
+        #[cfg(target_os = "linux")]
+        let chroots = enter.root.is_some();
+        #[cfg(not(target_os = "linux"))]
+        let chroots = false;
+
+        // Under a new root the workdir is only reachable after the chroot
+        let workdir = std::ffi::CString::new(target.workdir.as_deref().unwrap_or("/"))?;
+        if !chroots {
+            if let Some(workdir) = &target.workdir {
+                cmd.current_dir(workdir);
+            }
+        }
+        let run_as = target.run_as;
+        // SAFETY: the closure only makes async-signal-safe syscalls
+        unsafe {
+            cmd.pre_exec(move || {
+                #[cfg(target_os = "linux")]
+                enter.apply()?;
+                if chroots && libc::chdir(workdir.as_ptr()) != 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+                match &run_as {
+                    Some(run_as) => run_as.apply(),
+                    None => Ok(()),
+                }
+            });
+        }
+        Ok(cmd)
+    }
+
+    /// An exec'd command and its input, output and terminal
+    pub struct Session {
+        child: Child,
+        input: Input,
+        output: mpsc::Receiver<Frame>,
+    }
+
+    enum Input {
+        Pty(Arc<Pty>),
+        Pipe(Option<ChildStdin>),
+    }
+
+    impl Session {
+        /// Start `request.command` in `target`
+        pub fn spawn(target: &Target, request: &ExecRequest) -> Result<Self> {
+            let mut cmd = command(target, &request.command)?;
+            let (tx, output) = mpsc::channel(16);
+            if request.tty {
+                let (pty, terminal) = Pty::open(request.rows, request.cols)?;
+                cmd.stdin(Stdio::from(terminal.try_clone()?))
+                    .stdout(Stdio::from(terminal.try_clone()?))
+                    .stderr(Stdio::from(terminal));
+                // SAFETY: setsid and ioctl are async-signal-safe
+                unsafe {
+                    use std::os::unix::process::CommandExt;
+                    // After the closure `command` added: a new session,
+                    // with the terminal as its controlling one
+                    cmd.pre_exec(|| {
+                        if libc::setsid() < 0 || libc::ioctl(0, libc::TIOCSCTTY as _, 0) != 0 {
+                            return Err(std::io::Error::last_os_error());
+                        }
+                        Ok(())
+                    });
+                }
+                let child = spawn(cmd, &request.command[0])?;
+                let pty = Arc::new(pty);
+                tokio::spawn(forward_pty(pty.clone(), tx));
+                return Ok(Self {
+                    child,
+                    input: Input::Pty(pty),
+                    output,
+                });
+            }
+            cmd.stdin(Stdio::piped())
+                .stdout(Stdio::piped())
+                .stderr(Stdio::piped());
+            let mut child = spawn(cmd, &request.command[0])?;
+            let stdout = child.stdout.take().expect("piped");
+            let stderr = child.stderr.take().expect("piped");
+            tokio::spawn(forward(stdout, Frame::Stdout, tx.clone()));
+            tokio::spawn(forward(stderr, Frame::Stderr, tx));
+            let stdin = child.stdin.take();
+            Ok(Self {
+                child,
+                input: Input::Pipe(stdin),
+                output,
+            })
+        }
+
+        /// Relay frames between the command and `stream` until the command
+        /// exits, then send its exit code. The command is killed if the
+        /// client goes away first.
+        pub async fn run<S>(mut self, stream: S) -> Result<()>
+        where
+            S: AsyncRead + AsyncWrite + Send + 'static,
+        {
+            let (mut reader, mut writer) = tokio::io::split(stream);
+            let (input_tx, mut input) = mpsc::channel(16);
+            let reading = tokio::spawn(async move {
+                while let Ok(Some(frame)) = Frame::read(&mut reader).await {
+                    if input_tx.send(frame).await.is_err() {
+                        break;
+                    }
+                }
+            });
+
+            let mut output_open = true;
+            let status = loop {
+                tokio::select! {
+                    status = self.child.wait() => break status?,
+                    frame = self.output.recv(), if output_open => match frame {
+                        Some(frame) => frame.write(&mut writer).await?,
+                        None => output_open = false,
+                    },
+                    frame = input.recv() => match frame {
+                        Some(frame) => self.feed(frame).await,
+                        None => {
+                            self.child.start_kill().ok();
+                            self.child.wait().await.ok();
+                            return Ok(());
+                        }
+                    },
+                }
+            };
+            // Its last output can still be on its way
+            let drain = async {
+                while let Some(frame) = self.output.recv().await {
+                    frame.write(&mut writer).await?;
+                }
+                Ok::<_, anyhow::Error>(())
+            };
+            if let Ok(drained) = tokio::time::timeout(DRAIN_AFTER_EXIT, drain).await {
+                drained?;
+            }
+            Frame::Exit(crate::task::exit_code(status))
+                .write(&mut writer)
+                .await?;
+            reading.abort();
+            writer.shutdown().await.ok();
+            Ok(())
+        }
+
+        async fn feed(&mut self, frame: Frame) {
+            match (&mut self.input, frame) {
+                (Input::Pty(pty), Frame::Stdin(data)) => {
+                    pty.write_all(&data).await.ok();
+                }
+                // EOT: the terminal's end of input
+                (Input::Pty(pty), Frame::Eof) => {
+                    pty.write_all(&[4]).await.ok();
+                }
+                (Input::Pty(pty), Frame::Resize { rows, cols }) => {
+                    pty.resize(rows, cols).ok();
+                }
+                (Input::Pipe(Some(stdin)), Frame::Stdin(data)) => {
+                    stdin.write_all(&data).await.ok();
+                }
+                (Input::Pipe(stdin), Frame::Eof) => *stdin = None,
+                _ => {}
+            }
+        }
+    }
+
+    fn spawn(cmd: std::process::Command, program: &str) -> Result<Child> {
+        let mut cmd = tokio::process::Command::from(cmd);
+        // Dropping the command closes our copies of the terminal, so the
+        // terminal reports EOF once the command and its children are done
+        let child = cmd
+            .kill_on_drop(true)
+            .spawn()
+            .with_context(|| format!("Failed to run {}", program))?;
+        drop(cmd);
+        Ok(child)
+    }
+
+    async fn forward<R: AsyncRead + Unpin>(
+        mut reader: R,
+        frame: fn(Vec<u8>) -> Frame,
+        tx: mpsc::Sender<Frame>,
+    ) {
+        let mut buf = vec![0u8; 8192];
+        while let Ok(n) = reader.read(&mut buf).await {
+            if n == 0 || tx.send(frame(buf[..n].to_vec())).await.is_err() {
+                break;
+            }
+        }
+    }
+
+    async fn forward_pty(pty: Arc<Pty>, tx: mpsc::Sender<Frame>) {
+        let mut buf = vec![0u8; 8192];
+        while let Ok(n) = pty.read(&mut buf).await {
+            if n == 0 || tx.send(Frame::Stdout(buf[..n].to_vec())).await.is_err() {
+                break;
+            }
+        }
+    }
+
+    /// The controlling side of a pseudo-terminal
+    pub(super) struct Pty {
+        master: AsyncFd<OwnedFd>,
+    }
+
+    impl Pty {
+        /// A new terminal of `rows` x `cols`, and the descriptor the command
+        /// gets as its stdin, stdout and stderr
+        pub(super) fn open(rows: u16, cols: u16) -> Result<(Self, OwnedFd)> {
+            let (mut master, mut terminal) = (0, 0);
+            // SAFETY: openpty fills in two descriptors we then own
+            let opened = unsafe {
+                libc::openpty(
+                    &mut master,
+                    &mut terminal,
+                    std::ptr::null_mut(),
+                    std::ptr::null_mut(),
+                    std::ptr::null_mut(),
+                )
+            };
+            if opened != 0 {
+                return Err(std::io::Error::last_os_error()).context("Failed to open a terminal");
+            }
+            // SAFETY: both were just opened and nothing else owns them
+            let (master, terminal) =
+                unsafe { (OwnedFd::from_raw_fd(master), OwnedFd::from_raw_fd(terminal)) };
+            unsafe {
+                libc::fcntl(master.as_raw_fd(), libc::F_SETFD, libc::FD_CLOEXEC);
+                let flags = libc::fcntl(master.as_raw_fd(), libc::F_GETFL);
+                libc::fcntl(master.as_raw_fd(), libc::F_SETFL, flags | libc::O_NONBLOCK);
+            }
+            let pty = Self {
+                master: AsyncFd::new(master)?,
+            };
+            pty.resize(rows, cols)?;
+            Ok((pty, terminal))
+        }
+
+        pub(super) fn resize(&self, rows: u16, cols: u16) -> std::io::Result<()> {
+            if rows == 0 || cols == 0 {
+                return Ok(());
+            }
+            let size = libc::winsize {
+                ws_row: rows,
+                ws_col: cols,
+                ws_xpixel: 0,
+                ws_ypixel: 0,
+            };
+            // SAFETY: TIOCSWINSZ reads a winsize
+            if unsafe { libc::ioctl(self.master.as_raw_fd(), libc::TIOCSWINSZ as _, &size) } != 0 {
+                return Err(std::io::Error::last_os_error());
+            }
+            Ok(())
+        }
+
+        /// Read output; 0 once every process has closed the terminal
+        pub(super) async fn read(&self, buf: &mut [u8]) -> std::io::Result<usize> {
+            loop {
+                let mut ready = self.master.readable().await?;
+                let read = ready.try_io(|fd| {
+                    // SAFETY: reads into `buf`, at most its length
+                    let n =
+                        unsafe { libc::read(fd.as_raw_fd(), buf.as_mut_ptr().cast(), buf.len()) };
+                    if n < 0 {
+                        return Err(std::io::Error::last_os_error());
+                    }
+                    Ok(n as usize)
+                });
+                match read {
+                    // Linux reports a closed terminal as EIO
+                    Ok(Err(e)) if e.raw_os_error() == Some(libc::EIO) => return Ok(0),
+                    Ok(result) => return result,
+                    Err(_would_block) => continue,
+                }
+            }
+        }
+
+        pub(super) async fn write_all(&self, mut data: &[u8]) -> std::io::Result<()> {
+            while !data.is_empty() {
+                let mut ready = self.master.writable().await?;
+                let written = ready.try_io(|fd| {
+                    // SAFETY: writes from `data`, at most its length
+                    let n =
+                        unsafe { libc::write(fd.as_raw_fd(), data.as_ptr().cast(), data.len()) };
+                    if n < 0 {
+                        return Err(std::io::Error::last_os_error());
+                    }
+                    Ok(n as usize)
+                });
+                match written {
+                    Ok(n) => data = &data[n?..],
+                    Err(_would_block) => continue,
+                }
+            }
+            Ok(())
+        }
+    }
+}
+
+#[cfg(target_os = "linux")]
+mod namespaces {
+    use anyhow::{Context, Result};
+    use std::fs::File;
+    use std::os::fd::{AsRawFd, OwnedFd};
+    use std::path::{Path, PathBuf};
+
+    /// Namespaces, in the order nsenter joins them; the mount namespace goes
+    /// last, while /proc still shows the target's
+    const NAMESPACES: [(&str, libc::c_int); 4] = [
+        ("ipc", libc::CLONE_NEWIPC),
+        ("uts", libc::CLONE_NEWUTS),
+        ("net", libc::CLONE_NEWNET),
+        ("mnt", libc::CLONE_NEWNS),
+    ];
+
+    /// What a command joins to run beside process `pid`, opened up front
+    pub(super) struct Enter {
+        /// Its cgroup's cgroup.procs, if it isn't in ours, so the command
+        /// counts against its memory, CPU and pids limits
+        cgroup: Option<OwnedFd>,
+        namespaces: Vec<(OwnedFd, libc::c_int)>,
+        /// Its root, if it isn't ours
+        pub(super) root: Option<OwnedFd>,
+    }
+
+    impl Enter {
+        pub(super) fn of(pid: u32) -> Result<Self> {
+            let proc = Path::new("/proc").join(pid.to_string());
+            let ours = cgroup_procs(Path::new("/proc/self/cgroup"));
+            let cgroup = match cgroup_procs(&proc.join("cgroup")) {
+                Some(theirs) if Some(&theirs) != ours.as_ref() => {
+                    let fd = std::fs::OpenOptions::new()
+                        .write(true)
+                        .open(&theirs)
+                        .with_context(|| format!("Failed to open {}", theirs.display()))?;
+                    Some(fd.into())
+                }
+                _ => None,
+            };
+            let mut namespaces = Vec::new();
+            for (name, flag) in NAMESPACES {
+                let theirs = proc.join("ns").join(name);
+                let ours = Path::new("/proc/self/ns").join(name);
+                let link = std::fs::read_link(&theirs)
+                    .with_context(|| format!("Failed to read {}", theirs.display()))?;
+                if std::fs::read_link(&ours).ok().as_deref() != Some(link.as_path()) {
+                    let fd = File::open(&theirs)
+                        .with_context(|| format!("Failed to open {}", theirs.display()))?;
+                    namespaces.push((fd.into(), flag));
+                }
+            }
+            let new_mounts = namespaces
+                .iter()
+                .any(|(_, flag)| *flag == libc::CLONE_NEWNS);
+            let root_link = proc.join("root");
+            let moved = std::fs::read_link(&root_link)
+                .with_context(|| format!("Failed to read {}", root_link.display()))?
+                != Path::new("/");
+            let root = match new_mounts || moved {
+                true => Some(File::open(&root_link)?.into()),
+                false => None,
+            };
+            Ok(Self {
+                cgroup,
+                namespaces,
+                root,
+            })
+        }
+
+        /// Join them; called between fork and exec
+        pub(super) fn apply(&self) -> std::io::Result<()> {
+            if let Some(cgroup) = &self.cgroup {
+                // Writing 0 moves the writer: this process, before it execs
+                // SAFETY: a write from a static buffer to a descriptor we own
+                if unsafe { libc::write(cgroup.as_raw_fd(), b"0".as_ptr().cast(), 1) } < 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+            }
+            for (fd, flag) in &self.namespaces {
+                // SAFETY: setns on a descriptor we own
+                if unsafe { libc::setns(fd.as_raw_fd(), *flag) } != 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+            }
+            if let Some(root) = &self.root {
+                // SAFETY: plain syscalls on a descriptor we own and a static path
+                unsafe {
+                    let here = b".\0".as_ptr().cast();
+                    if libc::fchdir(root.as_raw_fd()) != 0 || libc::chroot(here) != 0 {
+                        return Err(std::io::Error::last_os_error());
+                    }
+                }
+            }
+            Ok(())
+        }
+    }
+
+    /// The cgroup.procs of the (v2) cgroup a /proc/{pid}/cgroup file names
+    pub(super) fn cgroup_procs(file: &Path) -> Option<PathBuf> {
+        let cgroups = std::fs::read_to_string(file).ok()?;
+        let path = cgroups.lines().find_map(|line| line.strip_prefix("0::"))?;
+        let dir = Path::new("/sys/fs/cgroup").join(path.trim_start_matches('/'));
+        Some(dir.join("cgroup.procs"))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    // ===================
+    // Frames
+    // ===================
+
+    #[tokio::test]
+    async fn test_frames_round_trip() {
+        let frames = [
+            Frame::Stdin(b"ls\n".to_vec()),
+            Frame::Eof,
+            Frame::Resize {
+                rows: 40,
+                cols: 120,
+            },
+            Frame::Stdout(b"a.txt\n".to_vec()),
+            Frame::Stderr(Vec::new()),
+            Frame::Exit(-1),
+        ];
+        let mut wire = Vec::new();
+        for frame in &frames {
+            frame.write(&mut wire).await.unwrap();
+        }
+        let mut reader = &wire[..];
+        for frame in frames {
+            assert_eq!(Frame::read(&mut reader).await.unwrap(), Some(frame));
+        }
+        assert_eq!(Frame::read(&mut reader).await.unwrap(), None);
+
+        let mut bad = &[9u8, 0, 0, 0, 0][..];
+        assert!(Frame::read(&mut bad).await.is_err());
+        let mut huge = &[0u8, 0xff, 0xff, 0xff, 0xff][..];
+        assert!(Frame::read(&mut huge).await.is_err());
+    }
+
+    // ===================
+    // Sessions
+    // ===================
+
+    #[cfg(target_os = "linux")]
+    #[test]
+    fn test_cgroup_of_a_process() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let file = dir.path().join("cgroup");
+        std::fs::write(&file, "0::/tenement/api:prod\n").unwrap();
+        assert_eq!(
+            namespaces::cgroup_procs(&file).unwrap(),
+            std::path::Path::new("/sys/fs/cgroup/tenement/api:prod/cgroup.procs")
+        );
+        // cgroup v1 only
+        std::fs::write(&file, "4:memory:/tenement/api:prod\n").unwrap();
+        assert!(namespaces::cgroup_procs(&file).is_none());
+    }
+
+    #[cfg(unix)]
+    fn target() -> Target {
+        let dir = std::env::temp_dir();
+        Target {
+            pid: std::process::id(),
+            env: HashMap::from([
+                ("PATH".to_string(), "/usr/bin:/bin".to_string()),
+                ("GREETING".to_string(), "hello".to_string()),
+            ]),
+            workdir: Some(dir.display().to_string()),
+            run_as: None,
+        }
+    }
+
+    /// Everything the server sent, stdout and stderr each joined up
+    #[cfg(unix)]
+    async fn collect<R: AsyncRead + Unpin>(mut reader: R) -> (Vec<u8>, Vec<u8>, Option<i32>) {
+        let (mut stdout, mut stderr, mut exit) = (Vec::new(), Vec::new(), None);
+        while let Some(frame) = Frame::read(&mut reader).await.unwrap() {
+            match frame {
+                Frame::Stdout(data) => stdout.extend(data),
+                Frame::Stderr(data) => stderr.extend(data),
+                Frame::Exit(code) => exit = Some(code),
+                other => panic!("unexpected {:?}", other),
+            }
+        }
+        (stdout, stderr, exit)
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_exec_runs_in_target_env() {
+        let request = ExecRequest {
+            command: vec![
+                "sh".to_string(),
+                "-c".to_string(),
+                "read line; echo \"$GREETING $line\"; pwd; echo oops >&2; exit 3".to_string(),
+            ],
+            tty: false,
+            rows: 0,
+            cols: 0,
+        };
+        let session = Session::spawn(&target(), &request).unwrap();
+        let (server, client) = tokio::io::duplex(4096);
+        let run = tokio::spawn(session.run(server));
+
+        let (reader, mut writer) = tokio::io::split(client);
+        Frame::Stdin(b"world\n".to_vec())
+            .write(&mut writer)
+            .await
+            .unwrap();
+        Frame::Eof.write(&mut writer).await.unwrap();
+        let (stdout, stderr, exit) = collect(reader).await;
+        run.await.unwrap().unwrap();
+
+        let stdout = String::from_utf8(stdout).unwrap();
+        let mut lines = stdout.lines();
+        assert_eq!(lines.next(), Some("hello world"));
+        let cwd = std::fs::canonicalize(std::env::temp_dir()).unwrap();
+        let pwd = std::fs::canonicalize(lines.next().unwrap()).unwrap();
+        assert_eq!(pwd, cwd);
+        assert_eq!(stderr, b"oops\n");
+        assert_eq!(exit, Some(3));
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_exec_on_a_terminal() {
+        let request = ExecRequest {
+            command: vec![
+                "sh".to_string(),
+                "-c".to_string(),
+                "test -t 0 && stty size".to_string(),
+            ],
+            tty: true,
+            rows: 24,
+            cols: 100,
+        };
+        let session = Session::spawn(&target(), &request).unwrap();
+        let (server, client) = tokio::io::duplex(4096);
+        let run = tokio::spawn(session.run(server));
+
+        let (stdout, _, exit) = collect(client).await;
+        run.await.unwrap().unwrap();
+        assert_eq!(exit, Some(0));
+        assert!(String::from_utf8_lossy(&stdout).contains("24 100"));
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_exec_killed_when_client_leaves() {
+        let request = ExecRequest {
+            command: vec!["sleep".to_string(), "30".to_string()],
+            tty: false,
+            rows: 0,
+            cols: 0,
+        };
+        let session = Session::spawn(&target(), &request).unwrap();
+        let (server, client) = tokio::io::duplex(4096);
+        let run = tokio::spawn(session.run(server));
+        drop(client);
+        tokio::time::timeout(Duration::from_secs(5), run)
+            .await
+            .expect("session ends")
+            .unwrap()
+            .unwrap();
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_command_needs_a_program() {
+        let err = command(&target(), &[]).unwrap_err();
+        assert!(err.to_string().contains("No command"), "{}", err);
+    }
+}
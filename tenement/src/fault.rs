@@ -0,0 +1,303 @@
+//! Fault injection for resilience testing
+//!
+//! A service can declare `[service.<name>.fault]` to delay or abort a
+//! percentage of its proxied requests, or to kill one of its instances at an
+//! interval; a route can declare the same delays and aborts for its own
+//! requests. Faults only take effect while fault injection is on: it starts as
+//! `[settings] fault_injection`, so a leftover fault block in a production
+//! config is inert (and warned about at load), and the admin API can turn it
+//! on and off, and change a service's faults, without a restart.
+
+use crate::hypervisor::Hypervisor;
+use anyhow::Result;
+use rand::Rng;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::sync::Arc;
+use std::time::{Duration, Instant};
+use tracing::{debug, warn};
+
+/// How often the killer checks which services are due a kill
+const KILL_CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// Fault injection config for a service's (or route's) proxied traffic
+#[derive(Debug, Clone, Default, PartialEq, Serialize, Deserialize)]
+pub struct FaultConfig {
+    /// Delay added before proxying, in milliseconds
+    #[serde(default)]
+    pub delay_ms: u64,
+
+    /// Percentage of requests (0-100) that get the delay
+    #[serde(default)]
+    pub delay_percent: f64,
+
+    /// Status returned instead of proxying (e.g. 503)
+    #[serde(default)]
+    pub abort_status: Option<u16>,
+
+    /// Percentage of requests (0-100) that are aborted
+    #[serde(default)]
+    pub abort_percent: f64,
+
+    /// SIGKILL one of the service's instances, picked at random, this often
+    /// (in seconds). 0 = never. Services only.
+    #[serde(default)]
+    pub kill_interval_secs: u64,
+}
+
+/// A service's fault settings, as listed by the admin API
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct ServiceFault {
+    pub service: String,
+    pub fault: FaultConfig,
+    /// Set through the API rather than the service's `[fault]` block
+    pub overridden: bool,
+}
+
+/// What to do to a single request
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct FaultDecision {
+    pub delay: Option<Duration>,
+    pub abort: Option<u16>,
+}
+
+impl FaultDecision {
+    pub fn is_none(&self) -> bool {
+        self.delay.is_none() && self.abort.is_none()
+    }
+}
+
+impl FaultConfig {
+    /// Check percentages and status are in range. `owner` names what the
+    /// fault belongs to in errors, e.g. "Service 'api'".
+    pub fn validate(&self, owner: &str) -> Result<()> {
+        for (field, value) in [
+            ("delay_percent", self.delay_percent),
+            ("abort_percent", self.abort_percent),
+        ] {
+            if !(0.0..=100.0).contains(&value) {
+                anyhow::bail!(
+                    "{} fault.{} must be between 0 and 100 (got {})",
+                    owner,
+                    field,
+                    value
+                );
+            }
+        }
+        if let Some(status) = self.abort_status {
+            if !(400..=599).contains(&status) {
+                anyhow::bail!(
+                    "{} fault.abort_status must be a 4xx or 5xx status (got {})",
+                    owner,
+                    status
+                );
+            }
+        }
+        if self.abort_percent > 0.0 && self.abort_status.is_none() {
+            anyhow::bail!(
+                "{} sets fault.abort_percent without fault.abort_status",
+                owner
+            );
+        }
+        Ok(())
+    }
+
+    /// Whether this config would ever affect a request
+    pub fn is_active(&self) -> bool {
+        (self.delay_ms > 0 && self.delay_percent > 0.0)
+            || (self.abort_status.is_some() && self.abort_percent > 0.0)
+            || self.kill_interval_secs > 0
+    }
+
+    /// How often an instance is killed (None = never)
+    pub fn kill_interval(&self) -> Option<Duration> {
+        (self.kill_interval_secs > 0).then(|| Duration::from_secs(self.kill_interval_secs))
+    }
+
+    /// Roll the dice for one request
+    pub fn decide(&self) -> FaultDecision {
+        self.decide_with(&mut rand::thread_rng())
+    }
+
+    /// Roll the dice for one request with a caller-provided RNG (for tests)
+    pub fn decide_with<R: Rng>(&self, rng: &mut R) -> FaultDecision {
+        let mut decision = FaultDecision::default();
+        if self.delay_ms > 0 && rng.gen_range(0.0..100.0) < self.delay_percent {
+            decision.delay = Some(Duration::from_millis(self.delay_ms));
+        }
+        if let Some(status) = self.abort_status {
+            if rng.gen_range(0.0..100.0) < self.abort_percent {
+                decision.abort = Some(status);
+            }
+        }
+        decision
+    }
+}
+
+/// Start killing instances of services with a `kill_interval_secs`, while
+/// fault injection is on. A service's first kill comes one interval after it
+/// got its interval (or fault injection was turned on).
+pub fn spawn_killer(hypervisor: Arc<Hypervisor>) -> tokio::task::JoinHandle<()> {
+    tokio::spawn(async move {
+        let mut interval = tokio::time::interval(KILL_CHECK_INTERVAL);
+        let mut last_kill: HashMap<String, Instant> = HashMap::new();
+        loop {
+            interval.tick().await;
+            let config = hypervisor.config();
+            let due: Vec<_> = config
+                .service
+                .keys()
+                .filter_map(|name| {
+                    let every = hypervisor.fault_for(name)?.kill_interval()?;
+                    Some((name.clone(), every))
+                })
+                .collect();
+            last_kill.retain(|name, _| due.iter().any(|(due, _)| due == name));
+            let now = Instant::now();
+            for (name, every) in due {
+                let since = *last_kill.entry(name.clone()).or_insert(now);
+                if now.duration_since(since) < every {
+                    continue;
+                }
+                last_kill.insert(name.clone(), now);
+                match hypervisor.kill_random_instance(&name).await {
+                    Some(id) => warn!(app = name.as_str(), "Fault injection killed {}", id),
+                    None => debug!(app = name.as_str(), "Fault injection found nothing to kill"),
+                }
+            }
+        }
+    })
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use rand::rngs::StdRng;
+    use rand::SeedableRng;
+
+    const SAMPLES: usize = 10_000;
+
+    fn count<F: Fn(&FaultDecision) -> bool>(fault: &FaultConfig, pred: F) -> usize {
+        let mut rng = StdRng::seed_from_u64(42);
+        (0..SAMPLES)
+            .filter(|_| pred(&fault.decide_with(&mut rng)))
+            .count()
+    }
+
+    #[test]
+    fn test_delay_percentage() {
+        let fault = FaultConfig {
+            delay_ms: 100,
+            delay_percent: 25.0,
+            ..Default::default()
+        };
+        let delayed = count(&fault, |d| d.delay == Some(Duration::from_millis(100)));
+        let ratio = delayed as f64 / SAMPLES as f64;
+        assert!((0.23..0.27).contains(&ratio), "got {}", ratio);
+    }
+
+    #[test]
+    fn test_abort_percentage() {
+        let fault = FaultConfig {
+            abort_status: Some(503),
+            abort_percent: 10.0,
+            ..Default::default()
+        };
+        let aborted = count(&fault, |d| d.abort == Some(503));
+        let ratio = aborted as f64 / SAMPLES as f64;
+        assert!((0.08..0.12).contains(&ratio), "got {}", ratio);
+    }
+
+    #[test]
+    fn test_zero_and_full_percentages() {
+        let never = FaultConfig {
+            delay_ms: 50,
+            delay_percent: 0.0,
+            abort_status: Some(500),
+            abort_percent: 0.0,
+            kill_interval_secs: 0,
+        };
+        assert_eq!(count(&never, |d| !d.is_none()), 0);
+
+        let always = FaultConfig {
+            delay_ms: 50,
+            delay_percent: 100.0,
+            abort_status: Some(500),
+            abort_percent: 100.0,
+            kill_interval_secs: 0,
+        };
+        assert_eq!(
+            count(&always, |d| d.delay.is_some() && d.abort.is_some()),
+            SAMPLES
+        );
+    }
+
+    #[test]
+    fn test_is_active() {
+        assert!(!FaultConfig::default().is_active());
+        assert!(!FaultConfig {
+            delay_ms: 0,
+            delay_percent: 50.0,
+            ..Default::default()
+        }
+        .is_active());
+        assert!(FaultConfig {
+            abort_status: Some(503),
+            abort_percent: 1.0,
+            ..Default::default()
+        }
+        .is_active());
+    }
+
+    #[test]
+    fn test_kill_interval() {
+        assert_eq!(FaultConfig::default().kill_interval(), None);
+        let killing = FaultConfig {
+            kill_interval_secs: 30,
+            ..Default::default()
+        };
+        assert!(killing.is_active());
+        assert_eq!(killing.kill_interval(), Some(Duration::from_secs(30)));
+        // Killing instances never touches an individual request
+        assert_eq!(count(&killing, |d| !d.is_none()), 0);
+    }
+
+    #[test]
+    fn test_validate() {
+        let ok = FaultConfig {
+            delay_ms: 10,
+            delay_percent: 50.0,
+            abort_status: Some(503),
+            abort_percent: 5.0,
+            kill_interval_secs: 30,
+        };
+        assert!(ok.validate("Service 'api'").is_ok());
+
+        let bad_percent = FaultConfig {
+            delay_percent: 150.0,
+            ..Default::default()
+        };
+        let err = bad_percent
+            .validate("Service 'api'")
+            .unwrap_err()
+            .to_string();
+        assert!(err.contains("Service 'api' fault.delay_percent"), "{}", err);
+
+        let bad_status = FaultConfig {
+            abort_status: Some(200),
+            abort_percent: 5.0,
+            ..Default::default()
+        };
+        assert!(bad_status
+            .validate("api")
+            .unwrap_err()
+            .to_string()
+            .contains("abort_status"));
+
+        let missing_status = FaultConfig {
+            abort_percent: 5.0,
+            ..Default::default()
+        };
+        assert!(missing_status.validate("api").is_err());
+    }
+}
@@ -0,0 +1,526 @@
+//! Git-push deploys
+//!
+//! A service with a `[service.X.git]` table gets a bare repository at
+//! {data_dir}/.repos/{service}.git. Pushing to it over SSH (that path, as
+//! tenement's user) or HTTP (`/git/{service}.git` on the API, with an admin
+//! token as the password) runs a post-receive hook that hands the new tip of
+//! the deploy branch to the server. The server checks that revision out into
+//! {data_dir}/.releases/{service}/{sha}, runs the `build` command there, and
+//! deploys it: the release dir is the working directory, the short SHA is the
+//! version and the full SHA is `APP_VERSION`.
+//!
+//! With `detect = true`, a checkout's build (when there's no `build`) and
+//! start (when the service has no `command`) come from its own files; see
+//! [`crate::buildpack`].
+
+use crate::buildpack::{self, BuildPlan};
+use crate::config::GitConfig;
+use anyhow::{Context, Result};
+use std::path::{Path, PathBuf};
+use std::process::Stdio;
+use std::time::Duration;
+use tokio::io::AsyncWriteExt;
+use tokio::process::Command;
+
+/// Bare repositories live at {data_dir}/.repos/{service}.git
+const REPOS_DIR_NAME: &str = ".repos";
+
+/// Length of the SHA prefix used as the deployed version
+const SHORT_SHA_LEN: usize = 7;
+
+/// Build output kept for the push response; the start is dropped past this
+const MAX_BUILD_OUTPUT: usize = 64 * 1024;
+
+pub fn repo_path(data_dir: &Path, service: &str) -> PathBuf {
+    data_dir.join(REPOS_DIR_NAME).join(format!("{}.git", service))
+}
+
+/// Checked-out revisions live at {data_dir}/.releases/{service}/{short sha}
+pub fn release_dir(data_dir: &Path, service: &str, sha: &str) -> PathBuf {
+    crate::artifact::release_dir(data_dir, service, short_sha(sha))
+}
+
+/// The version a revision deploys as
+pub fn short_sha(sha: &str) -> &str {
+    &sha[..sha.len().min(SHORT_SHA_LEN)]
+}
+
+/// The service a pushed repository path (`api.git` or `api`) deploys
+pub fn service_for_repo(repo: &str) -> &str {
+    repo.strip_suffix(".git").unwrap_or(repo)
+}
+
+/// Create the service's bare repository if needed and (re)write its
+/// post-receive hook to `exec` `hook_command` with the push on stdin
+pub async fn init_repo(
+    data_dir: &Path,
+    service: &str,
+    git: &GitConfig,
+    hook_command: &[String],
+) -> Result<PathBuf> {
+    let repo = repo_path(data_dir, service);
+    if !repo.join("HEAD").exists() {
+        std::fs::create_dir_all(&repo)
+            .with_context(|| format!("Failed to create {}", repo.display()))?;
+        git_command(&repo)
+            .args(["init", "--bare", "--quiet"])
+            .arg(&repo)
+            .output()
+            .await
+            .and_then(require_success)
+            .with_context(|| format!("Failed to create git repository {}", repo.display()))?;
+    }
+    // Clones of the repository check out the deploy branch
+    let head = format!("refs/heads/{}", git.branch);
+    git_command(&repo)
+        .args(["symbolic-ref", "HEAD", &head])
+        .output()
+        .await
+        .and_then(require_success)
+        .with_context(|| format!("Failed to set HEAD of {}", repo.display()))?;
+
+    let hook = repo.join("hooks").join("post-receive");
+    std::fs::create_dir_all(repo.join("hooks"))?;
+    let script = format!("#!/bin/sh\nexec {}\n", shell_words::join(hook_command));
+    std::fs::write(&hook, script)
+        .with_context(|| format!("Failed to write {}", hook.display()))?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(&hook, std::fs::Permissions::from_mode(0o755))?;
+    }
+    Ok(repo)
+}
+
+/// One ref a push updated, as a post-receive hook reads it: "old new ref"
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RefUpdate {
+    pub old: String,
+    pub new: String,
+    pub name: String,
+}
+
+impl RefUpdate {
+    /// A deleted ref's new SHA is all zeros
+    pub fn is_delete(&self) -> bool {
+        self.new.chars().all(|c| c == '0')
+    }
+}
+
+/// Parse a post-receive hook's stdin
+pub fn parse_ref_updates(input: &str) -> Vec<RefUpdate> {
+    input
+        .lines()
+        .filter_map(|line| {
+            let mut fields = line.split_whitespace();
+            Some(RefUpdate {
+                old: fields.next()?.to_string(),
+                new: fields.next()?.to_string(),
+                name: fields.next()?.to_string(),
+            })
+        })
+        .collect()
+}
+
+/// The revision a push deploys: the new tip of `branch`, unless it was deleted
+pub fn pushed_revision<'a>(updates: &'a [RefUpdate], branch: &str) -> Option<&'a str> {
+    let name = format!("refs/heads/{}", branch);
+    updates
+        .iter()
+        .find(|update| update.name == name && !update.is_delete())
+        .map(|update| update.new.as_str())
+}
+
+/// A revision checked out and built, ready to deploy
+#[derive(Debug, Clone)]
+pub struct PreparedRelease {
+    /// Full commit SHA
+    pub sha: String,
+    pub dir: PathBuf,
+    /// Combined stdout and stderr of the build command (empty without one)
+    pub build_output: String,
+    /// What `detect` found in the checkout (None without it)
+    pub plan: Option<BuildPlan>,
+}
+
+impl PreparedRelease {
+    pub fn version(&self) -> &str {
+        short_sha(&self.sha)
+    }
+}
+
+/// Check `revision` of the service's repository out into its release dir and
+/// run the service's build command there
+pub async fn prepare_release(
+    data_dir: &Path,
+    service: &str,
+    git: &GitConfig,
+    revision: &str,
+) -> Result<PreparedRelease> {
+    let repo = repo_path(data_dir, service);
+    let sha = resolve_commit(&repo, revision).await?;
+    let dir = release_dir(data_dir, service, &sha);
+    build_release(&repo, git, sha, dir).await
+}
+
+/// Like [`prepare_release`], but into `dir`: a preview's checkout, kept apart
+/// from the release dir a deploy of the same commit would use
+pub async fn prepare_release_at(
+    data_dir: &Path,
+    service: &str,
+    git: &GitConfig,
+    revision: &str,
+    dir: &Path,
+) -> Result<PreparedRelease> {
+    let repo = repo_path(data_dir, service);
+    let sha = resolve_commit(&repo, revision).await?;
+    build_release(&repo, git, sha, dir.to_path_buf()).await
+}
+
+async fn build_release(
+    repo: &Path,
+    git: &GitConfig,
+    sha: String,
+    dir: PathBuf,
+) -> Result<PreparedRelease> {
+    checkout(repo, &sha, &dir).await?;
+    let plan = match git.detect {
+        true => Some(buildpack::detect(&dir)?),
+        false => None,
+    };
+    let detected = plan.as_ref().and_then(|plan| plan.build.as_ref());
+    let build_output = match git.build.as_ref().or(detected) {
+        Some(command) => {
+            let timeout = Duration::from_secs(git.build_timeout);
+            run_build(command, &dir, &sha, timeout).await?
+        }
+        None => String::new(),
+    };
+    Ok(PreparedRelease {
+        sha,
+        dir,
+        build_output,
+        plan,
+    })
+}
+
+/// The full SHA of the commit `revision` names
+pub async fn resolve_commit(repo: &Path, revision: &str) -> Result<String> {
+    // Never let a revision be read as an option
+    if revision.starts_with('-') {
+        anyhow::bail!("Invalid revision {:?}", revision);
+    }
+    let output = git_command(repo)
+        .args(["rev-parse", "--verify", "--quiet"])
+        .arg(format!("{}^{{commit}}", revision))
+        .output()
+        .await
+        .and_then(require_success)
+        .with_context(|| format!("No commit {} in {}", revision, repo.display()))?;
+    Ok(String::from_utf8_lossy(&output.stdout).trim().to_string())
+}
+
+/// Write the tree of `sha` to `dir`, replacing anything already there
+async fn checkout(repo: &Path, sha: &str, dir: &Path) -> Result<()> {
+    if dir.exists() {
+        std::fs::remove_dir_all(dir)
+            .with_context(|| format!("Failed to clear {}", dir.display()))?;
+    }
+    std::fs::create_dir_all(dir).with_context(|| format!("Failed to create {}", dir.display()))?;
+    // A private index keeps the bare repository untouched and lets pushes of
+    // different services (or revisions) check out at the same time
+    let index = dir.with_extension("index");
+    let result = git_command(repo)
+        .arg("--work-tree")
+        .arg(dir)
+        .args(["checkout", "--force", sha, "--", "."])
+        .env("GIT_INDEX_FILE", &index)
+        .output()
+        .await
+        .and_then(require_success)
+        .with_context(|| format!("Failed to check out {} into {}", sha, dir.display()));
+    std::fs::remove_file(&index).ok();
+    result.map(|_| ())
+}
+
+/// Run `command` through `sh -c` in `dir` with `APP_VERSION` set, killing it
+/// at `timeout`. Returns its output; a failed build's output is in the error.
+async fn run_build(command: &str, dir: &Path, sha: &str, timeout: Duration) -> Result<String> {
+    let child = Command::new("sh")
+        .arg("-c")
+        // 2>&1 keeps stdout and stderr in the order the build wrote them
+        .arg(format!("exec 2>&1\n{}", command))
+        .current_dir(dir)
+        .env("APP_VERSION", sha)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::null())
+        .kill_on_drop(true)
+        .spawn()
+        .context("Failed to start build command")?;
+    let output = match tokio::time::timeout(timeout, child.wait_with_output()).await {
+        Ok(output) => output.context("Build command failed")?,
+        Err(_) => anyhow::bail!("Build timed out after {}s", timeout.as_secs()),
+    };
+    let mut text = String::from_utf8_lossy(&output.stdout).into_owned();
+    if text.len() > MAX_BUILD_OUTPUT {
+        let mut start = text.len() - MAX_BUILD_OUTPUT;
+        while !text.is_char_boundary(start) {
+            start += 1;
+        }
+        text.drain(..start);
+    }
+    if !output.status.success() {
+        anyhow::bail!("Build {}:\n{}", output.status, text);
+    }
+    Ok(text)
+}
+
+/// The ref advertisement that starts a smart HTTP push (`info/refs`)
+pub async fn advertise_refs(repo: &Path) -> Result<Vec<u8>> {
+    let output = git_command(repo)
+        .args(["receive-pack", "--stateless-rpc", "--advertise-refs"])
+        .arg(repo)
+        .output()
+        .await
+        .and_then(require_success)
+        .context("git receive-pack failed")?;
+    let mut body = pkt_line("# service=git-receive-pack\n");
+    body.extend_from_slice(b"0000");
+    body.extend_from_slice(&output.stdout);
+    Ok(body)
+}
+
+/// Run one smart HTTP `git-receive-pack` request; the repository's hooks
+/// (and so the deploy) run before it returns
+pub async fn receive_pack(repo: &Path, request: &[u8]) -> Result<Vec<u8>> {
+    let mut child = git_command(repo)
+        .args(["receive-pack", "--stateless-rpc"])
+        .arg(repo)
+        .stdin(Stdio::piped())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true)
+        .spawn()
+        .context("Failed to start git receive-pack")?;
+    let mut stdin = child.stdin.take().context("git receive-pack has no stdin")?;
+    let request = request.to_vec();
+    let writer = tokio::spawn(async move {
+        stdin.write_all(&request).await?;
+        stdin.shutdown().await
+    });
+    let output = child.wait_with_output().await?;
+    let _ = writer.await;
+    require_success(output).context("git receive-pack failed").map(|output| output.stdout)
+}
+
+/// Frame `data` as a git pkt-line: four hex digits of length, then the data
+fn pkt_line(data: &str) -> Vec<u8> {
+    format!("{:04x}{}", data.len() + 4, data).into_bytes()
+}
+
+/// `git --git-dir <repo>`, free of the caller's git environment
+fn git_command(repo: &Path) -> Command {
+    let mut cmd = Command::new("git");
+    cmd.arg("--git-dir")
+        .arg(repo)
+        // Hooks run with GIT_DIR set to the repository that received the push
+        .env_remove("GIT_DIR")
+        .env_remove("GIT_INDEX_FILE")
+        .env_remove("GIT_WORK_TREE")
+        .stdin(Stdio::null());
+    cmd
+}
+
+fn require_success(output: std::process::Output) -> std::io::Result<std::process::Output> {
+    if output.status.success() {
+        return Ok(output);
+    }
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    Err(std::io::Error::other(format!("{}: {}", output.status, stderr.trim())))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn git(dir: &Path, args: &[&str]) -> String {
+        let output = std::process::Command::new("git")
+            .args(["-c", "user.name=test", "-c", "user.email=test@example.com"])
+            .args(args)
+            .current_dir(dir)
+            .env_remove("GIT_DIR")
+            .output()
+            .unwrap();
+        assert!(output.status.success(), "git {:?}: {:?}", args, output);
+        String::from_utf8_lossy(&output.stdout).trim().to_string()
+    }
+
+    /// A work tree with one commit of `app.sh`, pushed to the service's repo
+    async fn pushed_repo(data_dir: &Path, git_config: &GitConfig) -> String {
+        let hook = vec!["true".to_string()];
+        let repo = init_repo(data_dir, "api", git_config, &hook).await.unwrap();
+        let work = data_dir.join("work");
+        std::fs::create_dir_all(&work).unwrap();
+        git(&work, &["init", "--quiet", "--initial-branch", "main"]);
+        std::fs::write(work.join("app.sh"), "echo hello\n").unwrap();
+        git(&work, &["add", "app.sh"]);
+        git(&work, &["commit", "--quiet", "-m", "first"]);
+        git(&work, &["push", "--quiet", repo.to_str().unwrap(), "main"]);
+        git(&work, &["rev-parse", "HEAD"])
+    }
+
+    // ===================
+    // PUSH PARSING TESTS
+    // ===================
+
+    #[test]
+    fn test_pushed_revision_is_the_deploy_branch() {
+        let zeros = "0".repeat(40);
+        let input = format!(
+            "{z} {a} refs/heads/feature\n{z} {b} refs/heads/main\n{b} {z} refs/heads/old\n",
+            z = zeros,
+            a = "a".repeat(40),
+            b = "b".repeat(40),
+        );
+        let updates = parse_ref_updates(&input);
+        assert_eq!(updates.len(), 3);
+        assert_eq!(pushed_revision(&updates, "main"), Some("b".repeat(40).as_str()));
+        assert_eq!(pushed_revision(&updates, "feature"), Some("a".repeat(40).as_str()));
+        // Deleting the branch deploys nothing
+        assert_eq!(pushed_revision(&updates, "old"), None);
+        assert_eq!(pushed_revision(&updates, "release"), None);
+    }
+
+    #[test]
+    fn test_paths_and_versions() {
+        let sha = "0123456789abcdef0123456789abcdef01234567";
+        assert_eq!(short_sha(sha), "0123456");
+        assert_eq!(service_for_repo("api.git"), "api");
+        assert_eq!(service_for_repo("api"), "api");
+        assert_eq!(
+            release_dir(Path::new("/var/lib/ten"), "api", sha),
+            PathBuf::from("/var/lib/ten/.releases/api/0123456")
+        );
+        assert_eq!(pkt_line("# service=git-receive-pack\n"), b"001e# service=git-receive-pack\n");
+    }
+
+    // ===================
+    // RELEASE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_init_repo_writes_hook() {
+        let dir = TempDir::new().unwrap();
+        let hook: Vec<String> =
+            ["/usr/bin/ten", "git-receive", "my api"].iter().map(|s| s.to_string()).collect();
+        let repo = init_repo(dir.path(), "api", &GitConfig::default(), &hook).await.unwrap();
+        assert!(repo.join("HEAD").exists());
+        let script = std::fs::read_to_string(repo.join("hooks/post-receive")).unwrap();
+        assert_eq!(script, "#!/bin/sh\nexec /usr/bin/ten git-receive 'my api'\n");
+        // Running it again keeps the repository
+        init_repo(dir.path(), "api", &GitConfig::default(), &hook).await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_prepare_release_checks_out_and_builds() {
+        let dir = TempDir::new().unwrap();
+        let git_config = GitConfig {
+            build: Some("echo built $APP_VERSION > BUILD; echo building; echo warn >&2".into()),
+            ..Default::default()
+        };
+        let sha = pushed_repo(dir.path(), &git_config).await;
+
+        let release = prepare_release(dir.path(), "api", &git_config, &sha).await.unwrap();
+        assert_eq!(release.sha, sha);
+        assert_eq!(release.version(), &sha[..7]);
+        assert_eq!(release.dir, release_dir(dir.path(), "api", &sha));
+        assert_eq!(std::fs::read_to_string(release.dir.join("app.sh")).unwrap(), "echo hello\n");
+        let build = std::fs::read_to_string(release.dir.join("BUILD")).unwrap();
+        assert_eq!(build.trim(), format!("built {}", sha));
+        assert_eq!(release.build_output, "building\nwarn\n");
+        assert!(!release.dir.with_extension("index").exists());
+
+        // A branch name resolves to its commit
+        let release = prepare_release(dir.path(), "api", &git_config, "main").await.unwrap();
+        assert_eq!(release.sha, sha);
+
+        // A preview checks the branch out into a dir of its own
+        let preview_dir = dir.path().join("previews/pr-1");
+        let preview = prepare_release_at(dir.path(), "api", &git_config, "main", &preview_dir)
+            .await
+            .unwrap();
+        assert_eq!(preview.dir, preview_dir);
+        assert!(preview_dir.join("BUILD").exists());
+    }
+
+    #[tokio::test]
+    async fn test_prepare_release_detects_build() {
+        let dir = TempDir::new().unwrap();
+        let git_config = GitConfig {
+            detect: true,
+            ..Default::default()
+        };
+        let sha = pushed_repo(dir.path(), &git_config).await;
+        // app.sh alone says nothing about how to build or start it
+        let plan = prepare_release(dir.path(), "api", &git_config, &sha)
+            .await
+            .unwrap()
+            .plan
+            .unwrap();
+        assert_eq!((plan.build, plan.start), (None, None));
+
+        let work = dir.path().join("work");
+        let nixpacks = "[phases.build]\ncmds = [\"echo built > BUILT\"]\n";
+        std::fs::write(work.join("nixpacks.toml"), nixpacks).unwrap();
+        std::fs::write(work.join("Procfile"), "web: sh app.sh\n").unwrap();
+        git(&work, &["add", "."]);
+        git(&work, &["commit", "--quiet", "-m", "procfile"]);
+        let repo = repo_path(dir.path(), "api");
+        git(&work, &["push", "--quiet", repo.to_str().unwrap(), "main"]);
+
+        let release = prepare_release(dir.path(), "api", &git_config, "main")
+            .await
+            .unwrap();
+        assert!(release.dir.join("BUILT").exists());
+        assert_eq!(release.plan.unwrap().start.as_deref(), Some("sh app.sh"));
+
+        // An explicit build wins over the detected one
+        let git_config = GitConfig {
+            build: Some("echo mine > MINE".into()),
+            ..git_config
+        };
+        let release = prepare_release(dir.path(), "api", &git_config, "main")
+            .await
+            .unwrap();
+        assert!(release.dir.join("MINE").exists());
+        assert!(!release.dir.join("BUILT").exists());
+    }
+
+    #[tokio::test]
+    async fn test_prepare_release_failures() {
+        let dir = TempDir::new().unwrap();
+        let failing = GitConfig {
+            build: Some("echo compile error; exit 2".into()),
+            ..Default::default()
+        };
+        let sha = pushed_repo(dir.path(), &failing).await;
+
+        let err = prepare_release(dir.path(), "api", &failing, &sha).await.unwrap_err();
+        let err = format!("{:#}", err);
+        assert!(err.contains("compile error"), "{}", err);
+
+        let slow = GitConfig {
+            build: Some("sleep 30".into()),
+            build_timeout: 1,
+            ..Default::default()
+        };
+        let err = prepare_release(dir.path(), "api", &slow, &sha).await.unwrap_err();
+        assert!(err.to_string().contains("timed out"), "{}", err);
+
+        let none = GitConfig::default();
+        assert!(prepare_release(dir.path(), "api", &none, "nope").await.is_err());
+        assert!(prepare_release(dir.path(), "api", &none, "--all").await.is_err());
+    }
+}
@@ -0,0 +1,394 @@
+//! Per-route request and response header rules
+//!
+//! Routes can remove, set, add to, and rewrite headers on the way to the app
+//! and on the way back, drop the `X-Forwarded-*` headers a client sent, and
+//! add the usual security headers (HSTS and friends) to responses.
+//! `Accept-Encoding` normalization is built in: clients send dozens of
+//! spellings of the same preference (`gzip, deflate, br`, `br;q=1.0, gzip;q=0.8`,
+//! ...), and collapsing them to one canonical value keeps upstream caches that
+//! vary on the header from fragmenting.
+
+use anyhow::Result;
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+
+/// Content codings kept by `normalize`, in canonical output order
+const KNOWN_CODINGS: &[&str] = &["br", "zstd", "gzip", "deflate"];
+
+/// Headers describing the client's connection, which the proxy sets or appends to
+pub const FORWARDED_HEADERS: &[&str] = &[
+    "forwarded",
+    "x-forwarded-for",
+    "x-forwarded-host",
+    "x-forwarded-port",
+    "x-forwarded-proto",
+];
+
+/// Added by `security_headers` to responses that don't carry them already
+pub const SECURITY_HEADERS: &[(&str, &str)] = &[
+    ("x-content-type-options", "nosniff"),
+    ("x-frame-options", "SAMEORIGIN"),
+    ("referrer-policy", "strict-origin-when-cross-origin"),
+];
+
+/// `Strict-Transport-Security` added by `security_headers` over HTTPS
+pub const HSTS: &str = "max-age=31536000; includeSubDomains";
+
+/// How to rewrite `Accept-Encoding`
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(try_from = "String", into = "String")]
+pub enum AcceptEncodingRule {
+    /// Remove the header so the backend responds uncompressed
+    Strip,
+    /// Keep only known codings the client accepts, in a canonical order
+    Normalize,
+    /// Replace the header with a fixed value (e.g. "gzip")
+    Force(String),
+}
+
+impl TryFrom<String> for AcceptEncodingRule {
+    type Error = String;
+
+    fn try_from(value: String) -> std::result::Result<Self, Self::Error> {
+        match value.trim().to_ascii_lowercase().as_str() {
+            "strip" => Ok(Self::Strip),
+            "normalize" => Ok(Self::Normalize),
+            "" => Err("accept_encoding must not be empty".to_string()),
+            forced => {
+                for coding in forced.split(',').map(str::trim) {
+                    if coding != "identity" && !KNOWN_CODINGS.contains(&coding) {
+                        return Err(format!(
+                            "unknown accept_encoding '{}'; use strip, normalize, \
+                             or a list of: identity, {}",
+                            coding,
+                            KNOWN_CODINGS.join(", ")
+                        ));
+                    }
+                }
+                Ok(Self::Force(forced.to_string()))
+            }
+        }
+    }
+}
+
+impl From<AcceptEncodingRule> for String {
+    fn from(rule: AcceptEncodingRule) -> Self {
+        match rule {
+            AcceptEncodingRule::Strip => "strip".to_string(),
+            AcceptEncodingRule::Normalize => "normalize".to_string(),
+            AcceptEncodingRule::Force(value) => value,
+        }
+    }
+}
+
+impl AcceptEncodingRule {
+    /// New header value for a request's `Accept-Encoding` (None = remove it)
+    pub fn apply(&self, current: Option<&str>) -> Option<String> {
+        match self {
+            Self::Strip => None,
+            Self::Force(value) => Some(value.clone()),
+            Self::Normalize => normalize_accept_encoding(current?),
+        }
+    }
+}
+
+/// What the proxy does with `X-Forwarded-*` headers a client sent
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "lowercase")]
+pub enum ForwardedHeaders {
+    /// Keep them and add this hop (right behind another proxy)
+    #[default]
+    Append,
+    /// Drop them first, so the app sees only the connection this proxy saw
+    /// (at the edge, where clients could claim any address)
+    Replace,
+}
+
+/// Text to replace in a header's value
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HeaderRewrite {
+    pub from: String,
+    pub to: String,
+}
+
+impl HeaderRewrite {
+    /// `value` with every `from` replaced, or None if it has none
+    pub fn apply(&self, value: &str) -> Option<String> {
+        value
+            .contains(&self.from)
+            .then(|| value.replace(&self.from, &self.to))
+    }
+}
+
+/// Header rules for a route (`[routing.route.request_headers]` and
+/// `[routing.route.response_headers]`). Applied in field order: removals,
+/// sets, adds, then rewrites.
+#[derive(Debug, Clone, Default, PartialEq, Eq, Serialize, Deserialize)]
+pub struct HeaderRules {
+    /// Header names to remove
+    #[serde(default)]
+    pub remove: Vec<String>,
+
+    /// Headers to set, replacing any existing value
+    #[serde(default)]
+    pub set: BTreeMap<String, String>,
+
+    /// Headers to add, keeping any values already there
+    #[serde(default)]
+    pub add: BTreeMap<String, String>,
+
+    /// Text to replace in header values, e.g.
+    /// `location = { from = "http://", to = "https://" }`
+    #[serde(default)]
+    pub rewrite: BTreeMap<String, HeaderRewrite>,
+
+    /// Accept-Encoding rewrite ("strip", "normalize", or a fixed value).
+    /// Requests only.
+    #[serde(default)]
+    pub accept_encoding: Option<AcceptEncodingRule>,
+
+    /// "append" (default) or "replace" the client's `X-Forwarded-*`. Requests only.
+    #[serde(default)]
+    pub forwarded: ForwardedHeaders,
+
+    /// Add HSTS (over HTTPS), X-Content-Type-Options, X-Frame-Options and
+    /// Referrer-Policy where the app didn't set them. Responses only.
+    #[serde(default)]
+    pub security_headers: bool,
+}
+
+impl HeaderRules {
+    pub fn is_empty(&self) -> bool {
+        *self == Self::default()
+    }
+
+    /// Check request rules: valid HTTP header syntax, and no response-only rules
+    pub fn validate(&self, prefix: &str) -> Result<()> {
+        self.check(prefix, "request_headers")?;
+        if self.security_headers {
+            anyhow::bail!(
+                "Route '{}' sets request_headers.security_headers; it belongs in \
+                 response_headers",
+                prefix
+            );
+        }
+        Ok(())
+    }
+
+    /// Check response rules: valid HTTP header syntax, and no request-only rules
+    pub fn validate_response(&self, prefix: &str) -> Result<()> {
+        self.check(prefix, "response_headers")?;
+        if self.accept_encoding.is_some() || self.forwarded != ForwardedHeaders::default() {
+            anyhow::bail!(
+                "Route '{}' response_headers can't set accept_encoding or forwarded; \
+                 they apply to requests",
+                prefix
+            );
+        }
+        Ok(())
+    }
+
+    fn check(&self, prefix: &str, table: &str) -> Result<()> {
+        let names = self.remove.iter().chain(self.set.keys());
+        for name in names.chain(self.add.keys()).chain(self.rewrite.keys()) {
+            if !is_token(name) {
+                anyhow::bail!(
+                    "Route '{}' has an invalid header name '{}' in {}",
+                    prefix,
+                    name,
+                    table
+                );
+            }
+        }
+        let values = self.set.iter().map(|(name, v)| ("set", name, v));
+        let added = self.add.iter().map(|(name, v)| ("add", name, v));
+        let rewritten = self
+            .rewrite
+            .iter()
+            .map(|(name, r)| ("rewrite", name, &r.to));
+        for (rule, name, value) in values.chain(added).chain(rewritten) {
+            if value.chars().any(|c| c.is_control() && c != '\t') {
+                anyhow::bail!(
+                    "Route '{}' {}.{}.{} contains control characters",
+                    prefix,
+                    table,
+                    rule,
+                    name
+                );
+            }
+        }
+        if let Some((name, _)) = self.rewrite.iter().find(|(_, r)| r.from.is_empty()) {
+            anyhow::bail!(
+                "Route '{}' {}.rewrite.{} has an empty `from`",
+                prefix,
+                table,
+                name
+            );
+        }
+        Ok(())
+    }
+}
+
+/// Canonical form of an Accept-Encoding value: known codings with q > 0, deduplicated,
+/// in a fixed order. `*` expands to all known codings. None when nothing is left.
+pub fn normalize_accept_encoding(value: &str) -> Option<String> {
+    let mut accepted = Vec::new();
+    let mut refused = Vec::new();
+    let mut wildcard = false;
+
+    for item in value.split(',') {
+        let mut parts = item.split(';');
+        let coding = parts.next().unwrap_or("").trim().to_ascii_lowercase();
+        let q = parts
+            .filter_map(|p| p.trim().strip_prefix("q="))
+            .filter_map(|q| q.trim().parse::<f32>().ok())
+            .next()
+            .unwrap_or(1.0);
+        match (coding.as_str(), q > 0.0) {
+            ("*", true) => wildcard = true,
+            (_, true) => accepted.push(coding),
+            (_, false) => refused.push(coding),
+        }
+    }
+
+    let codings: Vec<&str> = KNOWN_CODINGS
+        .iter()
+        .copied()
+        .filter(|c| !refused.iter().any(|r| r == c))
+        .filter(|c| wildcard || accepted.iter().any(|a| a == c))
+        .collect();
+    if codings.is_empty() {
+        None
+    } else {
+        Some(codings.join(", "))
+    }
+}
+
+/// RFC 9110 token characters (valid header names)
+fn is_token(name: &str) -> bool {
+    !name.is_empty()
+        && name
+            .chars()
+            .all(|c| c.is_ascii_alphanumeric() || "!#$%&'*+-.^_`|~".contains(c))
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    #[test]
+    fn test_normalize_collapses_equivalent_values() {
+        let variants = [
+            "gzip, deflate, br",
+            "br;q=1.0, gzip;q=0.8, deflate;q=0.5",
+            "deflate,gzip,br",
+            "GZIP, Deflate, BR, identity",
+        ];
+        for variant in variants {
+            assert_eq!(
+                normalize_accept_encoding(variant).as_deref(),
+                Some("br, gzip, deflate"),
+                "for {:?}",
+                variant
+            );
+        }
+    }
+
+    #[test]
+    fn test_normalize_refusals_and_wildcard() {
+        assert_eq!(normalize_accept_encoding("gzip;q=0, br").as_deref(), Some("br"));
+        assert_eq!(
+            normalize_accept_encoding("*").as_deref(),
+            Some("br, zstd, gzip, deflate")
+        );
+        assert_eq!(
+            normalize_accept_encoding("*, br;q=0").as_deref(),
+            Some("zstd, gzip, deflate")
+        );
+        assert_eq!(normalize_accept_encoding("identity"), None);
+        assert_eq!(normalize_accept_encoding("compress, x-custom"), None);
+    }
+
+    #[test]
+    fn test_rule_apply() {
+        assert_eq!(AcceptEncodingRule::Strip.apply(Some("gzip")), None);
+        assert_eq!(
+            AcceptEncodingRule::Force("gzip".to_string()).apply(None),
+            Some("gzip".to_string())
+        );
+        assert_eq!(
+            AcceptEncodingRule::Normalize.apply(Some("gzip, br")),
+            Some("br, gzip".to_string())
+        );
+        assert_eq!(AcceptEncodingRule::Normalize.apply(None), None);
+    }
+
+    #[test]
+    fn test_rule_parsing() {
+        let parse = |s: &str| AcceptEncodingRule::try_from(s.to_string());
+        assert_eq!(parse("strip"), Ok(AcceptEncodingRule::Strip));
+        assert_eq!(parse("Normalize"), Ok(AcceptEncodingRule::Normalize));
+        assert_eq!(
+            parse("gzip"),
+            Ok(AcceptEncodingRule::Force("gzip".to_string()))
+        );
+        assert!(parse("gzip, br").is_ok());
+        assert!(parse("lzma").is_err());
+        assert!(parse("").is_err());
+    }
+
+    #[test]
+    fn test_validate_header_names() {
+        let mut rules = HeaderRules::default();
+        rules.remove.push("cookie".to_string());
+        rules.set.insert("x-tier".to_string(), "edge".to_string());
+        assert!(rules.validate("/assets").is_ok());
+
+        rules.set.insert("bad header".to_string(), "v".to_string());
+        assert!(rules.validate("/assets").is_err());
+    }
+
+    #[test]
+    fn test_validate_keeps_rules_to_their_side() {
+        let security = HeaderRules {
+            security_headers: true,
+            ..Default::default()
+        };
+        assert!(security.validate_response("/").is_ok());
+        let err = security.validate("/").unwrap_err().to_string();
+        assert!(err.contains("response_headers"), "{}", err);
+
+        let replace = HeaderRules {
+            forwarded: ForwardedHeaders::Replace,
+            ..Default::default()
+        };
+        assert!(replace.validate("/").is_ok());
+        assert!(replace.validate_response("/").is_err());
+
+        let mut rules = HeaderRules::default();
+        let bad = "bad\nvalue".to_string();
+        rules.add.insert("vary".to_string(), bad);
+        let err = rules.validate_response("/").unwrap_err().to_string();
+        assert!(err.contains("response_headers.add.vary"), "{}", err);
+        let mut rules = HeaderRules::default();
+        let empty = HeaderRewrite {
+            from: String::new(),
+            to: "x".to_string(),
+        };
+        rules.rewrite.insert("location".to_string(), empty);
+        assert!(rules.validate_response("/").is_err());
+    }
+
+    #[test]
+    fn test_rewrite_replaces_text() {
+        let rewrite = HeaderRewrite {
+            from: "http://".to_string(),
+            to: "https://".to_string(),
+        };
+        assert_eq!(
+            rewrite.apply("http://example.com/a").as_deref(),
+            Some("https://example.com/a")
+        );
+        assert_eq!(rewrite.apply("/relative"), None);
+    }
+}
@@ -0,0 +1,345 @@
+//! Lifecycle hooks
+//!
+//! `[service.x.hooks]` runs shell commands at four points of a service's life:
+//!
+//! - `build`, before a deploy starts the new version
+//! - `pre_start`, before each instance's process starts
+//! - `post_deploy`, once a deploy's new version is healthy and serving
+//! - `pre_stop`, before an instance is stopped (not when it exits, or at shutdown)
+//!
+//! Hooks run on the host through `sh -c`, in the app's environment and working
+//! directory, plus TENEMENT_INSTANCE and TENEMENT_HOOK. Their output goes to
+//! the instance's logs, prefixed with the hook's name. A failed `build` or
+//! `pre_start` aborts what it was part of; `post_deploy` and `pre_stop` are
+//! best effort. `on_failure` overrides that either way, except that
+//! `post_deploy` can't abort a deploy that's already serving. A hook that
+//! times out is killed along with everything it started.
+
+use anyhow::Result;
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::process::Stdio;
+use std::time::Duration;
+use tokio::process::Command;
+use tracing::{info, warn};
+
+use crate::config::{HookConfig, HookFailure, ProcessConfig};
+use crate::instance::InstanceId;
+use crate::logs::{LogBuffer, LogLevel};
+use crate::post_stop::forward_lines;
+
+/// Where in the lifecycle a hook runs
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum HookKind {
+    Build,
+    PreStart,
+    PostDeploy,
+    PreStop,
+}
+
+impl HookKind {
+    pub const ALL: [HookKind; 4] = [
+        HookKind::Build,
+        HookKind::PreStart,
+        HookKind::PostDeploy,
+        HookKind::PreStop,
+    ];
+
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            HookKind::Build => "build",
+            HookKind::PreStart => "pre_start",
+            HookKind::PostDeploy => "post_deploy",
+            HookKind::PreStop => "pre_stop",
+        }
+    }
+
+    /// Seconds it may run without a `timeout`
+    pub fn default_timeout(&self) -> u64 {
+        match self {
+            HookKind::Build => 600,
+            _ => 60,
+        }
+    }
+
+    /// What failing does without an `on_failure`
+    pub fn default_on_failure(&self) -> HookFailure {
+        match self {
+            HookKind::Build | HookKind::PreStart => HookFailure::Abort,
+            HookKind::PostDeploy | HookKind::PreStop => HookFailure::Continue,
+        }
+    }
+}
+
+impl std::fmt::Display for HookKind {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.write_str(self.as_str())
+    }
+}
+
+/// A hook of one instance, with what it runs with
+#[derive(Debug, Clone)]
+pub struct BoundHook {
+    pub kind: HookKind,
+    pub instance: InstanceId,
+    pub command: String,
+    /// The instance's environment (the hook sees what the app sees)
+    pub env: HashMap<String, String>,
+    pub workdir: Option<PathBuf>,
+    pub timeout: Duration,
+    pub on_failure: HookFailure,
+}
+
+/// The service's `kind` hook for `instance`, if it has one
+pub fn bind(
+    kind: HookKind,
+    config: &ProcessConfig,
+    instance: &InstanceId,
+    env: HashMap<String, String>,
+) -> Option<BoundHook> {
+    let hook = config.hooks.get(kind)?;
+    Some(BoundHook::new(
+        kind,
+        hook,
+        instance.clone(),
+        env,
+        config.workdir.clone(),
+    ))
+}
+
+impl BoundHook {
+    pub fn new(
+        kind: HookKind,
+        hook: &HookConfig,
+        instance: InstanceId,
+        env: HashMap<String, String>,
+        workdir: Option<PathBuf>,
+    ) -> Self {
+        Self {
+            kind,
+            instance,
+            command: hook.command.clone(),
+            env,
+            workdir,
+            timeout: Duration::from_secs(hook.timeout.unwrap_or(kind.default_timeout())),
+            on_failure: hook.on_failure.unwrap_or(kind.default_on_failure()),
+        }
+    }
+
+    /// Run the hook, logging its output as the instance's. Fails only when it
+    /// failed and its `on_failure` is abort.
+    pub async fn run(&self, log_buffer: &LogBuffer) -> Result<()> {
+        let Err(failure) = self.execute(log_buffer).await else {
+            info!("{} hook for {} finished", self.kind, self.instance);
+            return Ok(());
+        };
+        warn!("{} hook for {} {}", self.kind, self.instance, failure);
+        let id = &self.instance;
+        let message = format!("{}: {}", self.kind, failure);
+        log_buffer.push_stderr(&id.process, &id.id, message).await;
+        match self.on_failure {
+            HookFailure::Abort => anyhow::bail!("{} hook {}", self.kind, failure),
+            HookFailure::Continue => Ok(()),
+        }
+    }
+
+    /// Run the command to the end or the timeout; the error describes the failure
+    async fn execute(&self, log_buffer: &LogBuffer) -> std::result::Result<(), String> {
+        let mut cmd = Command::new("sh");
+        cmd.arg("-c")
+            .arg(&self.command)
+            .envs(&self.env)
+            .env("TENEMENT_INSTANCE", self.instance.to_string())
+            .env("TENEMENT_HOOK", self.kind.as_str())
+            .stdin(Stdio::null())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .kill_on_drop(true);
+        if let Some(workdir) = &self.workdir {
+            cmd.current_dir(workdir);
+        }
+        // Own process group, so a timeout kills whatever the command started
+        #[cfg(unix)]
+        unsafe {
+            cmd.pre_exec(|| {
+                if libc::setpgid(0, 0) != 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+                Ok(())
+            });
+        }
+        let mut child = cmd.spawn().map_err(|e| format!("failed to start: {}", e))?;
+        let pid = child.id();
+
+        let prefix = format!("{}: ", self.kind);
+        let id = &self.instance;
+        let stdout = forward_lines(
+            child.stdout.take(),
+            log_buffer,
+            id,
+            LogLevel::Stdout,
+            &prefix,
+        );
+        let stderr = forward_lines(
+            child.stderr.take(),
+            log_buffer,
+            id,
+            LogLevel::Stderr,
+            &prefix,
+        );
+        let finished = tokio::time::timeout(self.timeout, async {
+            tokio::join!(stdout, stderr);
+            child.wait().await
+        })
+        .await;
+        match finished {
+            Ok(Ok(status)) if status.success() => Ok(()),
+            Ok(Ok(status)) => Err(format!("exited with {}", status)),
+            Ok(Err(e)) => Err(format!("failed: {}", e)),
+            Err(_) => {
+                #[cfg(unix)]
+                if let Some(pid) = pid {
+                    unsafe {
+                        libc::kill(-(pid as i32), libc::SIGKILL);
+                    }
+                }
+                let _ = child.kill().await;
+                Err(format!("timed out after {:?} and was killed", self.timeout))
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::logs::LogQuery;
+
+    fn hook(kind: HookKind, command: &str, on_failure: Option<HookFailure>) -> BoundHook {
+        let config = HookConfig {
+            command: command.to_string(),
+            timeout: Some(5),
+            on_failure,
+        };
+        let env = HashMap::from([("APP_NAME".to_string(), "demo".to_string())]);
+        BoundHook::new(kind, &config, InstanceId::new("api", "prod"), env, None)
+    }
+
+    async fn messages(log_buffer: &LogBuffer) -> Vec<String> {
+        log_buffer
+            .query(&LogQuery::default())
+            .await
+            .into_iter()
+            .map(|entry| entry.message)
+            .collect()
+    }
+
+    // ===================
+    // Defaults
+    // ===================
+
+    #[test]
+    fn test_defaults_by_kind() {
+        for (kind, on_failure) in [
+            (HookKind::Build, HookFailure::Abort),
+            (HookKind::PreStart, HookFailure::Abort),
+            (HookKind::PostDeploy, HookFailure::Continue),
+            (HookKind::PreStop, HookFailure::Continue),
+        ] {
+            assert_eq!(hook(kind, "true", None).on_failure, on_failure, "{}", kind);
+        }
+        let overridden = hook(HookKind::PreStop, "true", Some(HookFailure::Abort));
+        assert_eq!(overridden.on_failure, HookFailure::Abort);
+
+        let config = HookConfig {
+            command: "make".to_string(),
+            timeout: None,
+            on_failure: None,
+        };
+        let id = InstanceId::new("api", "prod");
+        let bound = BoundHook::new(HookKind::Build, &config, id.clone(), HashMap::new(), None);
+        assert_eq!(bound.timeout, Duration::from_secs(600));
+        let bound = BoundHook::new(HookKind::PreStop, &config, id, HashMap::new(), None);
+        assert_eq!(bound.timeout, Duration::from_secs(60));
+    }
+
+    // ===================
+    // Running
+    // ===================
+
+    #[tokio::test]
+    async fn test_hook_runs_in_app_env_and_logs_output() {
+        let log_buffer = LogBuffer::new();
+        let hook = hook(
+            HookKind::PreStart,
+            "echo $APP_NAME $TENEMENT_INSTANCE $TENEMENT_HOOK",
+            None,
+        );
+        hook.run(&log_buffer).await.unwrap();
+        let messages = messages(&log_buffer).await;
+        assert!(messages.contains(&"pre_start: demo api:prod pre_start".to_string()));
+    }
+
+    #[tokio::test]
+    async fn test_failure_policy() {
+        let log_buffer = LogBuffer::new();
+        let err = hook(HookKind::Build, "exit 2", None)
+            .run(&log_buffer)
+            .await
+            .unwrap_err();
+        assert!(err.to_string().starts_with("build hook exited with"));
+        assert!(messages(&log_buffer)
+            .await
+            .iter()
+            .any(|m| m.starts_with("build: exited with")));
+
+        // Best effort: logged, not returned
+        let log_buffer = LogBuffer::new();
+        hook(HookKind::PreStop, "exit 2", None)
+            .run(&log_buffer)
+            .await
+            .unwrap();
+        assert!(messages(&log_buffer)
+            .await
+            .iter()
+            .any(|m| m.starts_with("pre_stop: exited with")));
+    }
+
+    #[tokio::test]
+    async fn test_timeout_kills_hook() {
+        let log_buffer = LogBuffer::new();
+        let mut hook = hook(HookKind::PreStart, "sleep 30", None);
+        hook.timeout = Duration::from_millis(100);
+        let started = std::time::Instant::now();
+        let err = hook.run(&log_buffer).await.unwrap_err();
+        assert!(started.elapsed() < Duration::from_secs(5));
+        assert!(err.to_string().contains("timed out"), "{}", err);
+    }
+
+    #[cfg(target_os = "linux")]
+    #[tokio::test]
+    async fn test_timeout_kills_what_the_hook_started() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let pid_file = dir.path().join("pid");
+        let log_buffer = LogBuffer::new();
+        let command = format!("sleep 30 & echo $! > {}; wait", pid_file.display());
+        let mut hook = hook(HookKind::PreStart, &command, None);
+        hook.timeout = Duration::from_millis(300);
+        hook.run(&log_buffer).await.unwrap_err();
+
+        let pid: u32 = std::fs::read_to_string(&pid_file)
+            .unwrap()
+            .trim()
+            .parse()
+            .unwrap();
+        tokio::time::sleep(Duration::from_millis(100)).await;
+        // Gone, or a zombie waiting for init to reap it
+        let stat = std::fs::read_to_string(format!("/proc/{}/stat", pid)).unwrap_or_default();
+        let state = stat.rsplit_once(") ").map(|(_, rest)| &rest[..1]);
+        assert!(
+            matches!(state, None | Some("Z")),
+            "sleep {} outlived the hook",
+            pid
+        );
+    }
+}
@@ -1,30 +1,78 @@
 //! Process hypervisor - spawns and supervises instances
 
+use crate::access::{AccessConfig, Htpasswd};
+use crate::access_log::AccessLog;
 use crate::cgroup::{CgroupManager, ResourceLimits};
-use crate::config::Config;
-use crate::instance::{HealthStatus, Instance, InstanceId, InstanceInfo};
-use crate::logs::LogBuffer;
-use crate::metrics::Metrics;
+use crate::cluster::Cluster;
+use crate::concurrency::{AppLimit, ConcurrencyPool};
+use crate::config::{
+    AutoscaleMetric, BackendProtocol, Config, ConfigDiff, ConnectionPoolConfig, DashboardConfig,
+    Dependency, DependencyCondition, DeployConfig, DeployStrategy, DiscoveryConfig,
+    HealthCheckType, HealthWebhookConfig, LoadBalance, ProcessConfig, ServiceKind, Settings,
+};
+use crate::discovery;
+use crate::egress;
+use crate::env_files;
+use crate::events::{Event, EventBus, EventKind};
+use crate::fault::{FaultConfig, ServiceFault};
+use crate::hooks::{self, BoundHook, HookKind};
+use crate::instance::{
+    HealthStatus, HealthTransition, Instance, InstanceId, InstanceInfo, Readiness,
+};
+use crate::jobs::{JobScheduler, JobStatus};
+use crate::log_files::LogFiles;
+use crate::log_shipping::LogShipper;
+use crate::logs::{LogBuffer, LogEntry, LogLevel, LogRateLimiter};
+use crate::mesh;
+use crate::metrics::{InstanceSample, Metrics};
 use crate::port_allocator::PortAllocator;
-use crate::runtime::LiteBoxRuntime;
+use crate::post_stop::{PostStopHook, PostStopRunner, StopReason};
+use crate::rate_limit::RequestRateLimiter;
+use crate::response_cache::ResponseCache;
+use crate::routing::RouteTable;
+use crate::runtime::{ContainerRuntime, LiteBoxRuntime};
+use crate::secrets;
+use crate::sockets;
 #[cfg(feature = "quark")]
 use crate::runtime::QuarkRuntime;
 #[cfg(feature = "sandbox")]
 use crate::runtime::SandboxRuntime;
 use crate::runtime::{
-    Mount, NamespaceRuntime, ProcessRuntime, Runtime, RuntimeHandle, RuntimeType, SpawnConfig,
+    FsSandbox, Mount, NamespaceRuntime, ProcessRuntime, Runtime, RuntimeHandle, RuntimeType,
+    SpawnConfig, StopSignal,
 };
 use crate::storage::{calculate_dir_size, StorageInfo};
+use crate::telemetry::{Span, SpanKind, TraceContext, Tracer};
+use crate::upstream::{BreakerEvent, CircuitBreakers, RetryBudget};
+use crate::users;
+use crate::volumes;
+use crate::warm_pool::WarmPool;
 use anyhow::{Context, Result};
 use std::collections::HashMap;
-use std::path::PathBuf;
+#[cfg(unix)]
+use std::os::fd::{AsFd, AsRawFd, OwnedFd, RawFd};
+use std::path::{Path, PathBuf};
 use std::sync::Arc;
 use std::time::{Duration, Instant};
 use tokio::io::{AsyncBufReadExt, BufReader};
-use tokio::sync::RwLock;
-use tracing::{error, info, warn};
+use tokio::sync::{broadcast, RwLock};
+use tracing::{debug, error, info, warn};
+
+/// Per-instance scratch dirs live at {data_dir}/.tmp/{process}/{id}, outside the
+/// instance data dir so they're never persisted or counted against storage quotas
+const TMP_DIR_NAME: &str = ".tmp";
+
+/// Health transitions buffered per subscriber before the oldest are dropped
+const HEALTH_EVENT_CAPACITY: usize = 256;
 
-const HEALTH_CHECK_TIMEOUT: Duration = Duration::from_secs(5);
+/// How long a plain stop waits for active connections to finish
+const STOP_DRAIN: Duration = Duration::from_secs(5);
+
+/// How often a canary's error rate and health are checked
+const CANARY_CHECK_INTERVAL: Duration = Duration::from_secs(1);
+
+/// How often each instance's memory, CPU, threads and descriptors are read
+const USAGE_SAMPLE_INTERVAL: Duration = Duration::from_secs(2);
 
 /// RAII guard that decrements the active connection count when dropped.
 pub struct ConnectionGuard {
@@ -38,9 +86,286 @@ impl Drop for ConnectionGuard {
     }
 }
 
+/// Outcome of a bounded shutdown
+#[derive(Debug, Clone, Default)]
+pub struct ShutdownReport {
+    /// Instances that exited on their own (or needed no signal)
+    pub stopped: Vec<InstanceId>,
+    /// Instances still running at the deadline, killed with SIGKILL
+    pub force_killed: Vec<InstanceId>,
+}
+
+/// What `Hypervisor::drain_app` stopped
+#[derive(Debug, Clone, Default)]
+pub struct DrainReport {
+    /// Instances that finished their connections and exited on SIGTERM
+    pub stopped: Vec<InstanceId>,
+    /// Instances still busy or running at the deadline, killed with SIGKILL
+    pub force_killed: Vec<InstanceId>,
+    /// Connections still open at the deadline, cut by the kill
+    pub cut_connections: u32,
+}
+
+/// What `Hypervisor::reload` changed
+#[derive(Debug, Clone, Default)]
+pub struct ReloadReport {
+    /// Services added, removed and changed
+    pub diff: ConfigDiff,
+    /// Instances of added services (or newly listed in `[instances]`) started
+    pub started: Vec<InstanceId>,
+    /// Instances of removed services (or dropped from `[instances]`) stopped
+    pub stopped: Vec<InstanceId>,
+    /// Instances of changed services restarted on the new definition
+    pub restarted: Vec<InstanceId>,
+    /// Instances that failed to start, or weren't healthy after a restart
+    pub failed: Vec<InstanceId>,
+}
+
+/// What the autoscaler saw of a service when its current window began
+struct AutoscaleWindow {
+    started: Instant,
+    /// The service's `requests_total` then
+    requests: u64,
+    /// Its `request_duration_ms` bucket counts then
+    latency: Vec<u64>,
+    /// When the autoscaler last changed its replica count
+    scaled_at: Option<Instant>,
+}
+
+/// How a deployed version runs when that differs from the service's current
+/// definition: a rollback pins the command, args and env of its release, and a
+/// deploy from an artifact hands the instance its path as `TENEMENT_ARTIFACT`
+/// (and runs it in the release dir it was unpacked or checked out into)
+#[derive(Debug, Clone, Default, serde::Serialize, serde::Deserialize)]
+pub struct ReleasePin {
+    pub command: Option<String>,
+    pub args: Option<Vec<String>>,
+    /// Inline env, in place of the service's `env` (still interpolated)
+    pub env: Option<HashMap<String, String>>,
+    pub artifact: Option<String>,
+    #[serde(default)]
+    pub app_version: Option<String>,
+    /// Working directory, in place of the service's `workdir`
+    #[serde(default)]
+    pub workdir: Option<String>,
+    /// OCI image, in place of the service's `image` (container runtimes)
+    #[serde(default)]
+    pub image: Option<String>,
+    /// A preview environment: it starts with weight 0, so only its own
+    /// subdomain reaches it
+    #[serde(default)]
+    pub preview: bool,
+    /// Commit the version was built from, given to it as `TENEMENT_GIT_SHA`
+    #[serde(default)]
+    pub git_sha: Option<String>,
+    /// Number of the release it was deployed as, given to it as
+    /// `TENEMENT_RELEASE` (a version without one gets its id)
+    #[serde(default)]
+    pub release: Option<u32>,
+}
+
+impl ReleasePin {
+    fn apply(&self, process_config: &mut ProcessConfig) {
+        if let Some(command) = &self.command {
+            process_config.command = command.clone();
+        }
+        if let Some(args) = &self.args {
+            process_config.args = args.clone();
+        }
+        if let Some(env) = &self.env {
+            process_config.env = env.clone();
+        }
+        if let Some(artifact) = &self.artifact {
+            process_config.env.insert("TENEMENT_ARTIFACT".to_string(), artifact.clone());
+        }
+        if let Some(workdir) = &self.workdir {
+            process_config.workdir = Some(PathBuf::from(workdir));
+        }
+        if let Some(image) = &self.image {
+            process_config.image = Some(image.clone());
+        }
+        if let Some(app_version) = &self.app_version {
+            process_config.env.insert("APP_VERSION".to_string(), app_version.clone());
+        }
+        if let Some(git_sha) = &self.git_sha {
+            process_config.env.insert("TENEMENT_GIT_SHA".to_string(), git_sha.clone());
+        }
+    }
+}
+
+/// Fetch a pinned version's artifact into its release dir again when the dir
+/// is missing. Releases record where an artifact came from, not its files, so
+/// a host pointed at another's state backend gets them this way. A plain path
+/// or a git checkout has nowhere to be fetched from, and is left to fail.
+async fn restore_release_dir(instance_id: &InstanceId, pin: &ReleasePin) -> Result<()> {
+    let (Some(workdir), Some(url)) = (&pin.workdir, &pin.artifact) else {
+        return Ok(());
+    };
+    let workdir = Path::new(workdir);
+    let fetchers = crate::artifact::Fetchers::default();
+    if workdir.exists() || fetchers.get(url).is_none() {
+        return Ok(());
+    }
+    info!(
+        "Release dir {} of {} is missing; fetching {} again",
+        workdir.display(),
+        instance_id,
+        url
+    );
+    fetchers
+        .fetch_into(url, None, workdir)
+        .await
+        .with_context(|| format!("Failed to restore the release dir of {}", instance_id))?;
+    Ok(())
+}
+
+/// Build the shared concurrency pool from settings and per-service weights
+fn concurrency_pool_for(config: &Config) -> Option<Arc<ConcurrencyPool>> {
+    let capacity = config.settings.max_concurrency?;
+    let weights = config
+        .service
+        .iter()
+        .map(|(name, svc)| (name.clone(), svc.concurrency_weight))
+        .collect();
+    Some(ConcurrencyPool::new(capacity, weights))
+}
+
+/// Build an in-flight cap for every service that sets `max_concurrency`. A cap
+/// whose settings are unchanged is kept, so requests already holding its slots
+/// still count against it.
+fn app_limits_for(
+    config: &Config,
+    previous: &HashMap<String, Arc<AppLimit>>,
+) -> HashMap<String, Arc<AppLimit>> {
+    config
+        .service
+        .iter()
+        .filter_map(|(name, svc)| {
+            let limit = svc.max_concurrency?;
+            let kept = previous
+                .get(name)
+                .filter(|l| l.limit() == limit && l.max_queue() == svc.max_queue);
+            let app_limit = match kept {
+                Some(app_limit) => app_limit.clone(),
+                None => AppLimit::new(limit, svc.max_queue),
+            };
+            Some((name.clone(), app_limit))
+        })
+        .collect()
+}
+
+/// Build a response cache for every service that sets `cache`, keeping the
+/// previous one (and what it holds) where the settings are unchanged
+fn response_caches_for(
+    config: &Config,
+    previous: &HashMap<String, Arc<ResponseCache>>,
+) -> HashMap<String, Arc<ResponseCache>> {
+    config
+        .service
+        .iter()
+        .filter_map(|(name, svc)| {
+            let settings = svc.cache.as_ref()?;
+            let cache = match previous.get(name).filter(|c| c.config() == settings) {
+                Some(cache) => cache.clone(),
+                None => {
+                    let dir = settings.dir.as_ref().map(|dir| dir.join(name));
+                    Arc::new(ResponseCache::new(settings, dir))
+                }
+            };
+            Some((name.clone(), cache))
+        })
+        .collect()
+}
+
+/// Keep `current`'s `[settings]`, `[routing]` and autoscaled replica counts in
+/// a config about to be reloaded, and name the services it changes
+fn carry_over(current: &Config, config: &mut Config) -> Vec<String> {
+    config.settings = current.settings.clone();
+    config.routing = current.routing.clone();
+    // An autoscaled service keeps the replica count it has scaled to
+    for (name, service) in config.service.iter_mut() {
+        let old = current.get_service(name).filter(|s| s.autoscale.is_some());
+        if let (Some(autoscale), Some(old)) = (&service.autoscale, old) {
+            service.replicas = old.replicas.clamp(autoscale.min, autoscale.max);
+        }
+    }
+    config
+        .service
+        .iter()
+        .filter(|(name, svc)| {
+            current
+                .get_service(name)
+                .is_some_and(|old| serde_json::to_value(old).ok() != serde_json::to_value(svc).ok())
+        })
+        .map(|(name, _)| name.clone())
+        .collect()
+}
+
+/// Build a log line limiter for every service that sets `log_rate_limit`
+fn log_limiters_for(config: &Config) -> HashMap<String, Arc<LogRateLimiter>> {
+    config
+        .service
+        .iter()
+        .filter_map(|(name, svc)| Some((name.clone(), LogRateLimiter::new(svc.log_rate_limit?))))
+        .collect()
+}
+
+/// Build a per-client request limiter for every service that sets `rate_limit`
+fn rate_limiters_for(config: &Config) -> HashMap<String, Arc<RequestRateLimiter>> {
+    config
+        .service
+        .iter()
+        .filter_map(|(name, svc)| {
+            let limit = svc.rate_limit?;
+            let limiter = RequestRateLimiter::new(limit.requests_per_second, limit.burst());
+            Some((name.clone(), Arc::new(limiter)))
+        })
+        .collect()
+}
+
+/// Build a retry budget for every service that sets `retry`
+fn retry_budgets_for(config: &Config) -> HashMap<String, Arc<RetryBudget>> {
+    config
+        .service
+        .iter()
+        .filter_map(|(name, svc)| {
+            let budget = RetryBudget::new(svc.retry?.budget_percent);
+            Some((name.clone(), Arc::new(budget)))
+        })
+        .collect()
+}
+
+/// Build an access log for every service with its own `access_log`, and one
+/// for the rest from `[settings.access_log]` (keyed by "")
+fn access_logs_for(config: &Config, settings: &Settings) -> HashMap<String, Arc<AccessLog>> {
+    let global = settings
+        .access_log
+        .as_ref()
+        .map(|log| (String::new(), AccessLog::new(log, &settings.data_dir)));
+    config
+        .service
+        .iter()
+        .filter_map(|(name, svc)| {
+            let log = svc.access_log.as_ref()?;
+            Some((name.clone(), AccessLog::new(log, &settings.data_dir)))
+        })
+        .chain(global)
+        .collect()
+}
+
 /// The hypervisor manages all running instances
 pub struct Hypervisor {
-    config: Config,
+    /// Current config, swapped by `reload`
+    config: std::sync::RwLock<Arc<Config>>,
+    /// Settings as of startup. A reload keeps these (and `[routing]`); changing
+    /// them needs a restart.
+    settings: Settings,
+    /// Path-prefix routes resolved from `[routing]`
+    routes: RouteTable,
+    /// Global proxied-request pool, when `settings.max_concurrency` is set
+    concurrency: Option<Arc<ConcurrencyPool>>,
+    /// Per-service in-flight caps, for services with `max_concurrency`
+    app_limits: std::sync::RwLock<HashMap<String, Arc<AppLimit>>>,
     instances: RwLock<HashMap<InstanceId, Instance>>,
     /// Guard against concurrent spawns of the same instance.
     /// An instance ID is added before spawn begins and removed after it completes.
@@ -48,21 +373,61 @@ pub struct Hypervisor {
     /// Wake-once notifications: when an instance is being woken, other requests
     /// wait on the Notify instead of spawning duplicate processes.
     waking: RwLock<HashMap<InstanceId, Arc<tokio::sync::Notify>>>,
+    /// Instances stopped for being idle. They stay routable: the next request
+    /// for their process wakes them (scale-to-zero).
+    scaled_to_zero: RwLock<std::collections::HashSet<InstanceId>>,
     /// Active connection count per instance (for connection-aware idle timeout and draining)
     active_connections: RwLock<HashMap<InstanceId, Arc<std::sync::atomic::AtomicU32>>>,
     /// Restart history that persists across stop/spawn cycles.
     /// Maps instance ID to (restart_count, restart_times).
     restart_history: RwLock<HashMap<InstanceId, (u32, Vec<Instant>)>>,
     log_buffer: Arc<LogBuffer>,
+    /// Per-service log line limiters, for services with `log_rate_limit`
+    log_limiters: std::sync::RwLock<HashMap<String, Arc<LogRateLimiter>>>,
+    /// Per-service proxied request limiters, for services with `rate_limit`
+    rate_limiters: std::sync::RwLock<HashMap<String, Arc<RequestRateLimiter>>>,
+    /// Per-service retry budgets, for services with `retry`
+    retry_budgets: std::sync::RwLock<HashMap<String, Arc<RetryBudget>>>,
+    /// Per-service response caches, for services with `cache`
+    response_caches: std::sync::RwLock<HashMap<String, Arc<ResponseCache>>>,
+    /// Credential files named by `access.basic_auth`, each re-read on change
+    htpasswd_files: std::sync::Mutex<HashMap<PathBuf, Arc<Htpasswd>>>,
+    /// Consecutive proxy failures per instance, for services with `circuit_breaker`
+    circuit_breakers: CircuitBreakers,
+    /// Versions that run a release other than the service's current definition
+    release_pins: std::sync::RwLock<HashMap<InstanceId, ReleasePin>>,
+    /// Port each instance was given, offered to it again whenever it starts
+    /// (persisted, and held in `port_allocator` so others get it last)
+    assigned_ports: std::sync::Mutex<HashMap<InstanceId, u16>>,
+    /// Output pipes of instances the supervisor this one replaced handed over,
+    /// for `recover_orphans` to adopt
+    #[cfg(unix)]
+    adoptable: std::sync::Mutex<HashMap<InstanceId, Vec<OwnedFd>>>,
+    /// Set once instances were handed to a new supervisor on upgrade
+    handed_off: tokio::sync::watch::Sender<bool>,
+    /// Per-service log files, when `[settings.log_files]` is set
+    log_files: Option<Arc<LogFiles>>,
+    /// Forwards service output to the log sinks, when any are configured
+    log_shipper: Option<Arc<LogShipper>>,
+    /// Proxy access logs, per service and from `[settings.access_log]`
+    access_logs: std::sync::RwLock<HashMap<String, Arc<AccessLog>>>,
+    /// OpenTelemetry spans, when `[settings.tracing]` is set
+    tracer: Option<Arc<Tracer>>,
+    /// This node's view of its cluster, when `[settings.cluster]` is set
+    cluster: Option<Cluster>,
     metrics: Arc<Metrics>,
-    /// Port allocator for TCP ports (30000-40000)
+    /// Port allocator for TCP ports (`[settings] port_range`)
     port_allocator: Arc<PortAllocator>,
+    /// Pre-opened idle connections to TCP instances (`warm_connections`)
+    warm_pool: Arc<WarmPool>,
     /// Process runtime (always available, fallback)
     process_runtime: ProcessRuntime,
     /// Namespace runtime (default on Linux)
     namespace_runtime: NamespaceRuntime,
     /// LiteBox runtime - supervised external runner
     litebox_runtime: LiteBoxRuntime,
+    /// Container runtime (OCI image) - requires docker or a compatible CLI
+    container_runtime: ContainerRuntime,
     /// Sandbox runtime (gVisor) - requires runsc
     #[cfg(feature = "sandbox")]
     sandbox_runtime: SandboxRuntime,
@@ -72,7 +437,39 @@ pub struct Hypervisor {
     /// Cgroup manager for resource limits (Linux cgroups v2)
     cgroup_manager: CgroupManager,
     /// Optional state store for crash recovery persistence
-    state_store: Option<Arc<crate::store::StateStore>>,
+    state_store: Option<Arc<dyn crate::state_backend::StateBackend>>,
+    /// Health state changes, for subscribers such as the health webhook
+    health_events: broadcast::Sender<HealthTransition>,
+    /// Lifecycle events, for subscribers such as the event webhooks
+    events: Arc<EventBus>,
+    /// Set while a drain is in progress; the proxy turns new requests away
+    draining: std::sync::atomic::AtomicBool,
+    /// Services in maintenance mode, with the Retry-After (seconds) their 503s carry
+    maintenance: std::sync::RwLock<HashMap<String, u64>>,
+    /// Services `drain_app` took out of rotation, until they're spawned again
+    drained: std::sync::RwLock<std::collections::HashSet<String>>,
+    /// Running `post_stop` hooks
+    post_stop: Arc<PostStopRunner>,
+    /// `[jobs]` runs and their last results
+    jobs: Arc<JobScheduler>,
+    /// Next round-robin turn per process (or replicated instance)
+    round_robin: std::sync::Mutex<HashMap<String, usize>>,
+    /// Held for the length of a `reload`, so reloads don't interleave
+    reloading: tokio::sync::Mutex<()>,
+    /// Instances the monitor is restarting in tasks of their own
+    monitor_restarts: std::sync::Mutex<std::collections::HashSet<InstanceId>>,
+    /// Versions deployed at weight 0, announced as deployed once given traffic
+    unannounced: std::sync::Mutex<std::collections::HashSet<InstanceId>>,
+    /// Read-held by each deploy running in its own task (`spawn_deploy`);
+    /// shutdown takes the write side to wait for them
+    deploys: Arc<RwLock<()>>,
+    /// Observation window per autoscaled service
+    autoscale_windows: std::sync::Mutex<HashMap<String, AutoscaleWindow>>,
+    /// Whether `[fault]` blocks apply: starts as `settings.fault_injection`,
+    /// and the admin API can flip it
+    fault_injection: std::sync::atomic::AtomicBool,
+    /// Faults set through the admin API, in place of a service's `[fault]` block
+    fault_overrides: std::sync::RwLock<HashMap<String, FaultConfig>>,
 }
 
 impl Hypervisor {
@@ -80,27 +477,80 @@ impl Hypervisor {
     pub fn new(config: Config) -> Arc<Self> {
         let namespace_runtime = NamespaceRuntime::new();
         let cgroup_manager = CgroupManager::new();
-        let port_allocator = Arc::new(PortAllocator::new());
+        let (port_min, port_max) = config.settings.port_range;
+        let port_allocator = Arc::new(PortAllocator::with_range(port_min, port_max).skip_bound());
+        let routes = RouteTable::from_config(&config.routing);
+        let concurrency = concurrency_pool_for(&config);
+        let app_limits = app_limits_for(&config, &HashMap::new());
+        let log_limiters = log_limiters_for(&config);
+        let rate_limiters = rate_limiters_for(&config);
+        let response_caches = response_caches_for(&config, &HashMap::new());
+        let retry_budgets = retry_budgets_for(&config);
+        let log_files = LogFiles::from_settings(&config.settings);
+        let log_shipper = LogShipper::from_config(&config);
+        let access_logs = access_logs_for(&config, &config.settings);
+        let tracer = config.settings.tracing.as_ref().map(Tracer::new);
+        let cluster = config.settings.cluster.clone().map(Cluster::new);
+        let log_buffer = LogBuffer::new();
+        let fault_injection = config.settings.fault_injection;
 
         Arc::new(Self {
-            config,
+            settings: config.settings.clone(),
+            config: std::sync::RwLock::new(Arc::new(config)),
+            routes,
+            concurrency,
+            app_limits: std::sync::RwLock::new(app_limits),
             instances: RwLock::new(HashMap::new()),
             spawning: RwLock::new(std::collections::HashSet::new()),
             waking: RwLock::new(HashMap::new()),
+            scaled_to_zero: RwLock::new(std::collections::HashSet::new()),
             active_connections: RwLock::new(HashMap::new()),
             restart_history: RwLock::new(HashMap::new()),
-            log_buffer: LogBuffer::new(),
+            jobs: JobScheduler::new(log_buffer.clone()),
+            log_buffer,
+            log_limiters: std::sync::RwLock::new(log_limiters),
+            rate_limiters: std::sync::RwLock::new(rate_limiters),
+            response_caches: std::sync::RwLock::new(response_caches),
+            htpasswd_files: std::sync::Mutex::new(HashMap::new()),
+            retry_budgets: std::sync::RwLock::new(retry_budgets),
+            circuit_breakers: CircuitBreakers::new(),
+            release_pins: std::sync::RwLock::new(HashMap::new()),
+            assigned_ports: std::sync::Mutex::new(HashMap::new()),
+            #[cfg(unix)]
+            adoptable: std::sync::Mutex::new(HashMap::new()),
+            handed_off: tokio::sync::watch::Sender::new(false),
+            log_files,
+            log_shipper,
+            access_logs: std::sync::RwLock::new(access_logs),
+            tracer,
+            cluster,
             metrics: Metrics::new(),
             port_allocator,
+            warm_pool: Arc::new(WarmPool::new()),
             process_runtime: ProcessRuntime::new(),
             namespace_runtime,
             litebox_runtime: LiteBoxRuntime::new(),
+            container_runtime: ContainerRuntime::new(),
             #[cfg(feature = "sandbox")]
             sandbox_runtime: SandboxRuntime::new(),
             #[cfg(feature = "quark")]
             quark_runtime: QuarkRuntime::new(),
             cgroup_manager,
             state_store: None,
+            health_events: broadcast::channel(HEALTH_EVENT_CAPACITY).0,
+            events: Arc::new(EventBus::new()),
+            draining: std::sync::atomic::AtomicBool::new(false),
+            maintenance: std::sync::RwLock::new(HashMap::new()),
+            drained: std::sync::RwLock::new(std::collections::HashSet::new()),
+            post_stop: PostStopRunner::new(),
+            round_robin: std::sync::Mutex::new(HashMap::new()),
+            reloading: tokio::sync::Mutex::new(()),
+            monitor_restarts: std::sync::Mutex::new(std::collections::HashSet::new()),
+            unannounced: std::sync::Mutex::new(std::collections::HashSet::new()),
+            deploys: Arc::new(RwLock::new(())),
+            autoscale_windows: std::sync::Mutex::new(HashMap::new()),
+            fault_injection: std::sync::atomic::AtomicBool::new(fault_injection),
+            fault_overrides: std::sync::RwLock::new(HashMap::new()),
         })
     }
 
@@ -108,34 +558,85 @@ impl Hypervisor {
     pub fn with_log_buffer(config: Config, log_buffer: Arc<LogBuffer>) -> Arc<Self> {
         let namespace_runtime = NamespaceRuntime::new();
         let cgroup_manager = CgroupManager::new();
-        let port_allocator = Arc::new(PortAllocator::new());
+        let (port_min, port_max) = config.settings.port_range;
+        let port_allocator = Arc::new(PortAllocator::with_range(port_min, port_max).skip_bound());
+        let routes = RouteTable::from_config(&config.routing);
+        let concurrency = concurrency_pool_for(&config);
+        let app_limits = app_limits_for(&config, &HashMap::new());
+        let log_limiters = log_limiters_for(&config);
+        let rate_limiters = rate_limiters_for(&config);
+        let response_caches = response_caches_for(&config, &HashMap::new());
+        let retry_budgets = retry_budgets_for(&config);
+        let log_files = LogFiles::from_settings(&config.settings);
+        let log_shipper = LogShipper::from_config(&config);
+        let access_logs = access_logs_for(&config, &config.settings);
+        let tracer = config.settings.tracing.as_ref().map(Tracer::new);
+        let cluster = config.settings.cluster.clone().map(Cluster::new);
 
         Arc::new(Self {
-            config,
+            settings: config.settings.clone(),
+            config: std::sync::RwLock::new(Arc::new(config)),
+            routes,
+            concurrency,
+            app_limits: std::sync::RwLock::new(app_limits),
             instances: RwLock::new(HashMap::new()),
             spawning: RwLock::new(std::collections::HashSet::new()),
             waking: RwLock::new(HashMap::new()),
+            scaled_to_zero: RwLock::new(std::collections::HashSet::new()),
             active_connections: RwLock::new(HashMap::new()),
             restart_history: RwLock::new(HashMap::new()),
+            jobs: JobScheduler::new(log_buffer.clone()),
             log_buffer,
+            log_limiters: std::sync::RwLock::new(log_limiters),
+            rate_limiters: std::sync::RwLock::new(rate_limiters),
+            response_caches: std::sync::RwLock::new(response_caches),
+            htpasswd_files: std::sync::Mutex::new(HashMap::new()),
+            retry_budgets: std::sync::RwLock::new(retry_budgets),
+            circuit_breakers: CircuitBreakers::new(),
+            release_pins: std::sync::RwLock::new(HashMap::new()),
+            assigned_ports: std::sync::Mutex::new(HashMap::new()),
+            #[cfg(unix)]
+            adoptable: std::sync::Mutex::new(HashMap::new()),
+            handed_off: tokio::sync::watch::Sender::new(false),
+            log_files,
+            log_shipper,
+            access_logs: std::sync::RwLock::new(access_logs),
+            tracer,
+            cluster,
             metrics: Metrics::new(),
             port_allocator,
+            warm_pool: Arc::new(WarmPool::new()),
             process_runtime: ProcessRuntime::new(),
             namespace_runtime,
             litebox_runtime: LiteBoxRuntime::new(),
+            container_runtime: ContainerRuntime::new(),
             #[cfg(feature = "sandbox")]
             sandbox_runtime: SandboxRuntime::new(),
             #[cfg(feature = "quark")]
             quark_runtime: QuarkRuntime::new(),
             cgroup_manager,
             state_store: None,
+            health_events: broadcast::channel(HEALTH_EVENT_CAPACITY).0,
+            events: Arc::new(EventBus::new()),
+            draining: std::sync::atomic::AtomicBool::new(false),
+            maintenance: std::sync::RwLock::new(HashMap::new()),
+            drained: std::sync::RwLock::new(std::collections::HashSet::new()),
+            post_stop: PostStopRunner::new(),
+            round_robin: std::sync::Mutex::new(HashMap::new()),
+            reloading: tokio::sync::Mutex::new(()),
+            monitor_restarts: std::sync::Mutex::new(std::collections::HashSet::new()),
+            unannounced: std::sync::Mutex::new(std::collections::HashSet::new()),
+            deploys: Arc::new(RwLock::new(())),
+            autoscale_windows: std::sync::Mutex::new(HashMap::new()),
+            fault_injection: std::sync::atomic::AtomicBool::new(fault_injection),
+            fault_overrides: std::sync::RwLock::new(HashMap::new()),
         })
     }
 
-    /// Create a new hypervisor with a state store for crash recovery
+    /// Create a new hypervisor with a state backend for crash recovery
     pub fn with_state_store(
         config: Config,
-        state_store: Arc<crate::store::StateStore>,
+        state_store: Arc<dyn crate::state_backend::StateBackend>,
     ) -> Arc<Self> {
         let mut hyp = Self::new(config);
         // SAFETY: Arc::get_mut works because we just created this Arc and hold the only reference
@@ -155,6 +656,145 @@ impl Hypervisor {
         self.metrics.clone()
     }
 
+    /// Get the pool of pre-opened backend connections
+    pub fn warm_pool(&self) -> Arc<WarmPool> {
+        self.warm_pool.clone()
+    }
+
+    /// The current config. `reload` can change its services and instances.
+    pub fn config(&self) -> Arc<Config> {
+        self.config.read().unwrap().clone()
+    }
+
+    /// Get the path-prefix route table
+    pub fn routes(&self) -> &RouteTable {
+        &self.routes
+    }
+
+    /// Fault injection config for a service, if fault injection is enabled globally
+    pub fn fault_for(&self, process_name: &str) -> Option<FaultConfig> {
+        if !self.fault_injection_enabled() {
+            return None;
+        }
+        self.service_fault(process_name)
+            .filter(|fault| fault.is_active())
+    }
+
+    /// Whether faults are being injected right now
+    pub fn fault_injection_enabled(&self) -> bool {
+        self.fault_injection
+            .load(std::sync::atomic::Ordering::SeqCst)
+    }
+
+    /// Turn fault injection on or off until the next restart
+    pub fn set_fault_injection(&self, enabled: bool) {
+        self.fault_injection
+            .store(enabled, std::sync::atomic::Ordering::SeqCst);
+        if enabled {
+            tracing::warn!("Fault injection ENABLED - proxied requests may be delayed or aborted");
+        } else {
+            tracing::info!("Fault injection disabled");
+        }
+    }
+
+    /// A service's fault settings, whether or not fault injection is on: the
+    /// ones set through the API, else its `[fault]` block
+    pub fn service_fault(&self, process_name: &str) -> Option<FaultConfig> {
+        if let Some(fault) = self.fault_overrides.read().unwrap().get(process_name) {
+            return Some(fault.clone());
+        }
+        self.config()
+            .get_service(process_name)
+            .and_then(|svc| svc.fault.clone())
+    }
+
+    /// Each service with fault settings, and whether they came from the API
+    pub fn faults(&self) -> Vec<ServiceFault> {
+        let overrides = self.fault_overrides.read().unwrap();
+        let config = self.config();
+        let mut faults: Vec<_> = config
+            .service
+            .iter()
+            .filter_map(|(name, svc)| {
+                let (fault, overridden) = match overrides.get(name) {
+                    Some(fault) => (fault.clone(), true),
+                    None => (svc.fault.clone()?, false),
+                };
+                Some(ServiceFault {
+                    service: name.clone(),
+                    fault,
+                    overridden,
+                })
+            })
+            .collect();
+        faults.sort_by(|a, b| a.service.cmp(&b.service));
+        faults
+    }
+
+    /// Replace a service's fault settings until the next restart, or with
+    /// None go back to its `[fault]` block
+    pub fn set_fault(&self, process_name: &str, fault: Option<FaultConfig>) -> Result<()> {
+        if !self.has_process(process_name) {
+            anyhow::bail!("Unknown service: {}", process_name);
+        }
+        let mut overrides = self.fault_overrides.write().unwrap();
+        match fault {
+            Some(fault) => {
+                fault.validate(&format!("Service '{}'", process_name))?;
+                overrides.insert(process_name.to_string(), fault);
+            }
+            None => {
+                overrides.remove(process_name);
+            }
+        }
+        Ok(())
+    }
+
+    /// SIGKILL one of a service's running instances, picked at random, so it
+    /// goes through the same crash handling (events, restarts) as a real crash.
+    /// Returns the instance killed; VMs and containers are never picked.
+    pub async fn kill_random_instance(&self, process_name: &str) -> Option<InstanceId> {
+        use rand::seq::SliceRandom;
+
+        let instances = self.instances.read().await;
+        let running: Vec<_> = instances
+            .values()
+            .filter(|instance| instance.id.process == process_name && !instance.stopping)
+            .collect();
+        let victim = running.choose(&mut rand::thread_rng())?;
+        let kill = StopSignal {
+            // SIGKILL is 9 everywhere
+            signal: 9,
+            process_group: true,
+        };
+        victim.handle.terminate(kill).then(|| victim.id.clone())
+    }
+
+    /// Get the global concurrency pool (None when unlimited)
+    pub fn concurrency_pool(&self) -> Option<&Arc<ConcurrencyPool>> {
+        self.concurrency.as_ref()
+    }
+
+    /// How long a proxied request may wait for a concurrency slot
+    pub fn concurrency_queue_timeout(&self) -> Duration {
+        Duration::from_millis(self.settings.concurrency_queue_timeout_ms)
+    }
+
+    /// A process's own in-flight cap (None when it doesn't set `max_concurrency`)
+    pub fn app_limit(&self, process_name: &str) -> Option<Arc<AppLimit>> {
+        self.app_limits.read().unwrap().get(process_name).cloned()
+    }
+
+    /// How long a request may queue under a process's `max_concurrency`
+    pub fn app_queue_timeout(&self, process_name: &str) -> Duration {
+        let ms = self
+            .config()
+            .get_service(process_name)
+            .and_then(|p| p.queue_timeout_ms)
+            .unwrap_or(self.settings.concurrency_queue_timeout_ms);
+        Duration::from_millis(ms)
+    }
+
     /// Load config from tenement.toml and create hypervisor
     pub fn from_config_file() -> Result<Arc<Self>> {
         let config = Config::load()?;
@@ -162,25 +802,70 @@ impl Hypervisor {
     }
 
     /// Spawn a new instance of a process
+    /// A service with `replicas` spawns every replica of `id`, returning the
+    /// first one's socket; a replica that fails stops the rest from starting.
     pub async fn spawn(&self, process_name: &str, id: &str) -> Result<PathBuf> {
-        self.spawn_with_env(process_name, id, HashMap::new()).await
+        let replicas = self.replica_ids(process_name, id);
+        let mut first = None;
+        for replica in &replicas {
+            let socket = self.spawn_with_env(process_name, replica, HashMap::new()).await?;
+            first.get_or_insert(socket);
+        }
+        match first {
+            Some(socket) => Ok(socket),
+            None => self.spawn_with_env(process_name, id, HashMap::new()).await,
+        }
     }
 
-    /// Spawn a new instance with additional environment variables
+    /// Spawn a new instance with additional environment variables. Services it
+    /// `depends_on` are brought up first.
     pub async fn spawn_with_env(
         &self,
         process_name: &str,
         id: &str,
         extra_env: HashMap<String, String>,
     ) -> Result<PathBuf> {
-        let process_config = self
-            .config
+        let instance_id = InstanceId::new(process_name, id);
+        if !self.instances.read().await.contains_key(&instance_id) {
+            self.start_dependencies(&instance_id).await?;
+        }
+        self.spawn_instance(process_name, id, extra_env).await
+    }
+
+    /// `spawn_with_env` without bringing up dependencies
+    async fn spawn_instance(
+        &self,
+        process_name: &str,
+        id: &str,
+        extra_env: HashMap<String, String>,
+    ) -> Result<PathBuf> {
+        if self.is_handed_off() {
+            anyhow::bail!("Instances are supervised by the upgraded tenement now");
+        }
+        let mut process_config = self
+            .config()
             .get_service(process_name)
             .with_context(|| format!("Unknown process: {}", process_name))?
             .clone();
+        if process_config.kind == ServiceKind::Static {
+            anyhow::bail!(
+                "Service {} is type = \"static\": tenement serves its files, with no \
+                 instances to spawn",
+                process_name
+            );
+        }
+
+        // Started again: a drained service takes requests once more
+        self.drained.write().unwrap().remove(process_name);
 
         let instance_id = InstanceId::new(process_name, id);
-        let data_dir = &self.config.settings.data_dir;
+        let mut preview = false;
+        let pin = self.release_pins.read().unwrap().get(&instance_id).cloned();
+        if let Some(pin) = &pin {
+            pin.apply(&mut process_config);
+            preview = pin.preview;
+        }
+        let data_dir = &self.settings.data_dir;
         let socket = process_config.socket_path(process_name, id);
 
         // Create instance data directory
@@ -209,7 +894,15 @@ impl Hypervisor {
             }
         }
 
-        let data_dir = &self.config.settings.data_dir;
+        // A host rebuilt from shared state has the release but not its files
+        if let Some(pin) = &pin {
+            if let Err(e) = restore_release_dir(&instance_id, pin).await {
+                self.spawning.write().await.remove(&instance_id);
+                return Err(e);
+            }
+        }
+
+        let data_dir = &self.settings.data_dir;
 
         // Validate isolation level is available - fail loudly if not
         let isolation = process_config.isolation;
@@ -279,6 +972,16 @@ impl Hypervisor {
                     );
                 }
             }
+            RuntimeType::Container => {
+                if !self.container_runtime.is_available() {
+                    anyhow::bail!(
+                        "Instance {}: container isolation requires docker on PATH.\n\
+                         Install Docker, or set TENEMENT_CONTAINER_CLI to a docker-compatible \
+                         CLI such as nerdctl (containerd).",
+                        instance_id
+                    );
+                }
+            }
             RuntimeType::Firecracker | RuntimeType::Qemu => {
                 anyhow::bail!(
                     "Instance {}: {} isolation not yet supported in hypervisor",
@@ -288,25 +991,79 @@ impl Hypervisor {
             }
         }
 
+        // Read secrets up front so a missing secret fails before a port is allocated
+        let secret_values = if process_config.secrets.is_empty() {
+            None
+        } else {
+            match secrets::read_secrets(&process_config.secrets, data_dir) {
+                Ok(values) => Some(values),
+                Err(e) => {
+                    self.spawning.write().await.remove(&instance_id);
+                    return Err(e)
+                        .with_context(|| format!("Failed to load secrets for {}", instance_id));
+                }
+            }
+        };
+
+        // Env files too, so a missing or malformed file names itself
+        let file_env = match env_files::load(&process_config.env_files) {
+            Ok(env) => env,
+            Err(e) => {
+                self.spawning.write().await.remove(&instance_id);
+                return Err(e)
+                    .with_context(|| format!("Failed to load env files for {}", instance_id));
+            }
+        };
+
+        // And the user to run as, so a typo'd name fails before anything is allocated
+        let run_as = match users::resolve(
+            process_config.user.as_deref(),
+            process_config.group.as_deref(),
+        ) {
+            Ok(run_as) => run_as,
+            Err(e) => {
+                self.spawning.write().await.remove(&instance_id);
+                return Err(e).with_context(|| format!("Cannot run {} as its user", instance_id));
+            }
+        };
+
+        // Likewise who gets its socket, and a stale socket from before mustn't
+        // pass for the new instance's (while a live one isn't replaced at all)
+        let socket_owner = match users::resolve_socket_owner(
+            process_config.unix_socket.owner.as_deref(),
+            process_config.unix_socket.group.as_deref(),
+        )
+        .and_then(|owner| sockets::clear_stale_socket(&socket).map(|()| owner))
+        {
+            Ok(owner) => owner,
+            Err(e) => {
+                self.spawning.write().await.remove(&instance_id);
+                return Err(e)
+                    .with_context(|| format!("Cannot set up the socket of {}", instance_id));
+            }
+        };
+
         info!(
+            app = process_name,
+            instance = id,
+            event = "spawn",
             "Spawning instance {} (isolation: {})",
-            instance_id, isolation
+            instance_id,
+            isolation
         );
 
         // Allocate a TCP port for process/namespace/sandbox runtimes
         // VMs (Firecracker/QEMU) use vsock, so they don't need TCP ports
-        let port = match isolation {
-            RuntimeType::Process
-            | RuntimeType::Namespace
-            | RuntimeType::Litebox
-            | RuntimeType::Sandbox
-            | RuntimeType::Quark => Some(
-                self.port_allocator
-                    .allocate()
-                    .await
-                    .with_context(|| format!("Failed to allocate port for {}", instance_id))?,
-            ),
-            RuntimeType::Firecracker | RuntimeType::Qemu => None,
+        let port = if isolation.uses_tcp_port() {
+            match self.assign_port(&instance_id).await {
+                Ok(port) => Some(port),
+                Err(e) => {
+                    self.spawning.write().await.remove(&instance_id);
+                    return Err(e);
+                }
+            }
+        } else {
+            None
         };
 
         // Build environment
@@ -325,22 +1082,234 @@ impl Hypervisor {
         } else {
             (raw_command, explicit_args)
         };
-        let mut env = process_config.env_interpolated(process_name, id, data_dir, port);
+        let (command, args) = process_config.launch_command(command, args);
+        let mut env =
+            process_config.env_interpolated(file_env, process_name, id, data_dir, port);
 
         // Merge extra env vars
         env.extend(extra_env);
 
+        // Secrets go into the environment and the instance's secrets file
+        let secrets_fingerprint = match &secret_values {
+            Some(values) => {
+                let secrets_file = instance_data_dir.join(secrets::SECRETS_FILE_NAME);
+                if let Err(e) = secrets::write_env_file(&secrets_file, values) {
+                    if let Some(port) = port {
+                        self.port_allocator.release(port).await;
+                    }
+                    self.spawning.write().await.remove(&instance_id);
+                    return Err(e);
+                }
+                env.extend(values.clone());
+                env.insert(
+                    secrets::SECRETS_FILE_ENV.to_string(),
+                    secrets_file.to_string_lossy().to_string(),
+                );
+                Some(secrets::fingerprint(values))
+            }
+            None => None,
+        };
+
+        // Fresh scratch directory, so nothing survives from a previous run or a crash
+        let tmp_dir = if process_config.tmp_dir {
+            let tmp_dir = data_dir.join(TMP_DIR_NAME).join(process_name).join(id);
+            if let Err(e) = reset_tmp_dir(&tmp_dir) {
+                if let Some(port) = port {
+                    self.port_allocator.release(port).await;
+                }
+                self.spawning.write().await.remove(&instance_id);
+                return Err(e);
+            }
+            env.insert("TMPDIR".to_string(), tmp_dir.to_string_lossy().to_string());
+            Some(tmp_dir)
+        } else {
+            None
+        };
+
+        // Volumes outlive the instance, so they're only ever created here
+        let volumes = match volumes::prepare(
+            data_dir,
+            process_name,
+            &process_config.volumes,
+            run_as.as_ref(),
+        ) {
+            Ok(volumes) => volumes,
+            Err(e) => {
+                if let Some(port) = port {
+                    self.port_allocator.release(port).await;
+                }
+                if let Some(tmp_dir) = &tmp_dir {
+                    std::fs::remove_dir_all(tmp_dir).ok();
+                }
+                self.spawning.write().await.remove(&instance_id);
+                return Err(e)
+                    .with_context(|| format!("Failed to prepare volumes of {}", instance_id));
+            }
+        };
+        for (name, dir) in &volumes {
+            let volume = &process_config.volumes[name];
+            let path = volume.destination.as_deref().unwrap_or(dir);
+            env.insert(volume.env_var(name), path.to_string_lossy().to_string());
+        }
+
         // Always set SOCKET_PATH for backwards compatibility and test scripts
-        env.insert(
-            "SOCKET_PATH".to_string(),
-            socket.to_string_lossy().to_string(),
-        );
+        env.insert("SOCKET_PATH".to_string(), sockets::address(&socket));
+        let release = pin.as_ref().and_then(|pin| pin.release);
+        env.extend(metadata_env(&instance_id, release, &socket));
+
+        // Private sockets of the services it uses
+        for used in &process_config.uses {
+            let path = mesh::socket_path(data_dir, used);
+            env.insert(mesh::env_var(used), path.to_string_lossy().to_string());
+        }
+
+        // Where to look up the other services
+        if self.settings.discovery.is_some() {
+            let path = discovery::env_file(data_dir);
+            env.insert(
+                discovery::DISCOVERY_FILE_ENV.to_string(),
+                path.to_string_lossy().to_string(),
+            );
+        }
 
         // Also set PORT for TCP-based runtimes (Process/Namespace/Sandbox)
         if let Some(port) = port {
             env.insert("PORT".to_string(), port.to_string());
         }
 
+        if let Some(index) = process_config.replica_index(id) {
+            env.insert("TENEMENT_REPLICA".to_string(), index.to_string());
+            env.insert(
+                "TENEMENT_REPLICAS".to_string(),
+                process_config.replicas.to_string(),
+            );
+        }
+
+        // Fail with a clear message now rather than a confusing crash later
+        let inherits_env = matches!(isolation, RuntimeType::Process | RuntimeType::Namespace);
+        let missing = process_config.missing_required_env(&env, inherits_env);
+        if !missing.is_empty() {
+            let missing = missing.join(", ");
+            if let Some(port) = port {
+                self.port_allocator.release(port).await;
+            }
+            if let Some(tmp_dir) = &tmp_dir {
+                std::fs::remove_dir_all(tmp_dir).ok();
+            }
+            self.spawning.write().await.remove(&instance_id);
+            anyhow::bail!(
+                "Instance {} is missing required env var(s): {}. \
+                 Set them in [service.{}.env], env_files, [service.{}.secrets], \
+                 or tenement's environment.",
+                instance_id,
+                missing,
+                process_name,
+                process_name
+            );
+        }
+
+        // Hand the instance's files to the user it runs as
+        if let Some(run_as) = &run_as {
+            if let Err(e) = self.prepare_for_user(
+                run_as,
+                &process_config,
+                &instance_data_dir,
+                tmp_dir.as_deref(),
+                secret_values.is_some(),
+                port.is_none().then_some(socket.as_path()),
+            ) {
+                if let Some(port) = port {
+                    self.port_allocator.release(port).await;
+                }
+                if let Some(tmp_dir) = &tmp_dir {
+                    std::fs::remove_dir_all(tmp_dir).ok();
+                }
+                self.spawning.write().await.remove(&instance_id);
+                return Err(e)
+                    .with_context(|| format!("Failed to prepare {} for {}", instance_id, run_as));
+            }
+        }
+
+        // Runs before the process starts, in its environment
+        let pre_start = hooks::bind(
+            HookKind::PreStart,
+            &process_config,
+            &instance_id,
+            env.clone(),
+        );
+        if let Some(hook) = pre_start {
+            if let Err(e) = hook.run(&self.log_buffer).await {
+                if let Some(port) = port {
+                    self.port_allocator.release(port).await;
+                }
+                if let Some(tmp_dir) = &tmp_dir {
+                    std::fs::remove_dir_all(tmp_dir).ok();
+                }
+                self.spawning.write().await.remove(&instance_id);
+                return Err(e).with_context(|| format!("Failed to start {}", instance_id));
+            }
+        }
+
+        // Its own network namespace, reaching out only through the egress proxy
+        // and forwards. Hooks run on the host, so they aren't given the proxy.
+        let hook_env = env.clone();
+        let netns = match &process_config.egress {
+            Some(egress) => {
+                let started = async {
+                    let (policy, forwards) = egress.parse()?;
+                    egress::Netns::start(&instance_id.to_string(), policy, forwards, port).await
+                };
+                match started.await {
+                    Ok(netns) => {
+                        env.extend(egress::proxy_env());
+                        Some(netns)
+                    }
+                    Err(e) => {
+                        if let Some(port) = port {
+                            self.port_allocator.release(port).await;
+                        }
+                        if let Some(tmp_dir) = &tmp_dir {
+                            std::fs::remove_dir_all(tmp_dir).ok();
+                        }
+                        self.spawning.write().await.remove(&instance_id);
+                        return Err(e).with_context(|| {
+                            format!("Failed to restrict egress of {}", instance_id)
+                        });
+                    }
+                }
+            }
+            None => None,
+        };
+
+        let redactor = process_config.redactor();
+        debug!("Instance {} env: {:?}", instance_id, redactor.redact_env(&env));
+        let spawn_env = env.clone();
+
+        // The instance's own directories stay writable and visible in its sandbox
+        let filesystem = process_config.filesystem.needs_mounts().then(|| {
+            let sandbox = &process_config.filesystem;
+            let socket_dir = socket.parent().filter(|_| port.is_none());
+            let own = [
+                Some(instance_data_dir.as_path()),
+                socket_dir,
+                tmp_dir.as_deref(),
+            ];
+            let keep = sandbox
+                .writable
+                .iter()
+                .map(PathBuf::as_path)
+                .chain(own.into_iter().flatten())
+                .chain(volumes.iter().map(|(_, dir)| dir.as_path()))
+                .map(|path| std::fs::canonicalize(path).unwrap_or_else(|_| path.to_path_buf()))
+                .collect();
+            FsSandbox {
+                read_only: sandbox.read_only,
+                private_tmp: sandbox.private_tmp,
+                keep,
+                hide: sandbox.hide.clone(),
+            }
+        });
+
         // Build spawn config
         let spawn_config = SpawnConfig {
             command,
@@ -358,36 +1327,59 @@ impl Hypervisor {
                     destination: m.destination.clone(),
                     readonly: m.readonly,
                 })
+                .chain(volumes.iter().filter_map(|(name, dir)| {
+                    let destination = process_config.volumes[name].destination.clone()?;
+                    Some(Mount {
+                        source: dir.clone(),
+                        destination,
+                        readonly: false,
+                    })
+                }))
                 .collect(),
             image: process_config.image.clone(),
-            memory_limit_mb: process_config.memory_limit_mb,
+            memory_limit_mb: process_config.memory_limit(),
             cpu_shares: process_config.cpu_shares,
+            cpu_max: process_config.limits.cpu,
+            nofile: process_config.limits.nofile,
+            run_as,
+            filesystem,
+            no_new_privileges: process_config.filesystem.no_new_privileges,
+            netns: netns.as_ref().map(egress::Netns::fd),
         };
 
         // Spawn using the selected isolation level (we already validated it's available above)
-        let mut handle = match isolation {
-            RuntimeType::Namespace => self.namespace_runtime.spawn(&spawn_config).await?,
-            RuntimeType::Process => self.process_runtime.spawn(&spawn_config).await?,
-            RuntimeType::Litebox => self.litebox_runtime.spawn(&spawn_config).await?,
+        let spawned = match isolation {
+            RuntimeType::Namespace => self.namespace_runtime.spawn(&spawn_config).await,
+            RuntimeType::Process => self.process_runtime.spawn(&spawn_config).await,
+            RuntimeType::Litebox => self.litebox_runtime.spawn(&spawn_config).await,
+            RuntimeType::Container => self.container_runtime.spawn(&spawn_config).await,
             #[cfg(feature = "sandbox")]
-            RuntimeType::Sandbox => self.sandbox_runtime.spawn(&spawn_config).await?,
+            RuntimeType::Sandbox => self.sandbox_runtime.spawn(&spawn_config).await,
             #[cfg(not(feature = "sandbox"))]
             RuntimeType::Sandbox => unreachable!("sandbox feature not enabled"),
             #[cfg(feature = "quark")]
-            RuntimeType::Quark => self.quark_runtime.spawn(&spawn_config).await?,
+            RuntimeType::Quark => self.quark_runtime.spawn(&spawn_config).await,
             #[cfg(not(feature = "quark"))]
             RuntimeType::Quark => unreachable!("quark feature not enabled"),
             // Firecracker/Qemu already rejected above
             _ => unreachable!(),
         };
+        // Runtimes echo commands and tool output back in errors; keep secrets out of them
+        let mut handle = spawned.map_err(|e| {
+            anyhow::anyhow!("{}", redactor.redact_text(&format!("{:#}", e), &spawn_config.env))
+        })?;
 
         // Apply resource limits via cgroups v2 (Linux only)
         let resource_limits = ResourceLimits {
-            memory_limit_mb: process_config.memory_limit_mb,
+            memory_limit_mb: process_config.memory_limit(),
             cpu_shares: process_config.cpu_shares,
+            cpu_max: process_config.limits.cpu,
         };
         if resource_limits.has_limits()
-            && !matches!(isolation, RuntimeType::Sandbox | RuntimeType::Quark)
+            && !matches!(
+                isolation,
+                RuntimeType::Sandbox | RuntimeType::Quark | RuntimeType::Container
+            )
         {
             // Create cgroup and add process. Fail loudly if resource limits are
             // configured but can't be applied (process would run unrestricted).
@@ -421,40 +1413,33 @@ impl Hypervisor {
         }
 
         // Set up log capture for runtimes where Tenement owns a child process.
+        #[cfg(unix)]
+        let mut output = Vec::new();
         match &mut handle {
             RuntimeHandle::Process { ref mut child, .. }
             | RuntimeHandle::Namespace { ref mut child, .. }
             | RuntimeHandle::Litebox { ref mut child, .. } => {
-                // Take stdout/stderr handles and spawn capture tasks
-                let stdout = child.stdout.take();
-                let stderr = child.stderr.take();
-
-                // Spawn stdout capture task
-                if let Some(stdout) = stdout {
-                    let log_buffer = self.log_buffer.clone();
-                    let process = process_name.to_string();
-                    let inst_id = id.to_string();
-                    tokio::spawn(async move {
-                        let reader = BufReader::new(stdout);
-                        let mut lines = reader.lines();
-                        while let Ok(Some(line)) = lines.next_line().await {
-                            log_buffer.push_stdout(&process, &inst_id, line).await;
-                        }
-                    });
+                // Take stdout/stderr handles and spawn capture tasks, keeping a
+                // copy of each pipe to hand over on upgrade
+                let pid = child.id();
+                if let Some(stdout) = child.stdout.take() {
+                    #[cfg(unix)]
+                    output.extend(stdout.as_fd().try_clone_to_owned().ok());
+                    self.capture_output(stdout, LogLevel::Stdout, process_name, id, pid);
                 }
-
-                // Spawn stderr capture task
-                if let Some(stderr) = stderr {
-                    let log_buffer = self.log_buffer.clone();
-                    let process = process_name.to_string();
-                    let inst_id = id.to_string();
-                    tokio::spawn(async move {
-                        let reader = BufReader::new(stderr);
-                        let mut lines = reader.lines();
-                        while let Ok(Some(line)) = lines.next_line().await {
-                            log_buffer.push_stderr(&process, &inst_id, line).await;
-                        }
-                    });
+                if let Some(stderr) = child.stderr.take() {
+                    #[cfg(unix)]
+                    output.extend(stderr.as_fd().try_clone_to_owned().ok());
+                    self.capture_output(stderr, LogLevel::Stderr, process_name, id, pid);
+                }
+            }
+            RuntimeHandle::Container { ref mut logs, .. } => {
+                // `docker logs -f` carries the container's stdout and stderr
+                if let Some(stdout) = logs.stdout.take() {
+                    self.capture_output(stdout, LogLevel::Stdout, process_name, id, None);
+                }
+                if let Some(stderr) = logs.stderr.take() {
+                    self.capture_output(stderr, LogLevel::Stderr, process_name, id, None);
                 }
             }
             _ => {
@@ -474,6 +1459,18 @@ impl Hypervisor {
                 .unwrap_or((0, Vec::new()))
         };
 
+        let post_stop_hook = process_config.post_stop.as_ref().map(|command| {
+            PostStopHook::new(
+                instance_id.clone(),
+                command.clone(),
+                hook_env.clone(),
+                process_config.workdir.clone(),
+                Duration::from_secs(process_config.post_stop_timeout),
+            )
+        });
+
+        let pre_stop = hooks::bind(HookKind::PreStop, &process_config, &instance_id, hook_env);
+
         let instance = Instance {
             id: instance_id.clone(),
             handle,
@@ -483,22 +1480,44 @@ impl Hypervisor {
             started_at: now,
             restarts,
             consecutive_failures: 0,
+            consecutive_successes: 0,
+            probe_in_flight: Default::default(),
             last_health_check: None,
+            health_passed: false,
             health_status: HealthStatus::Unknown,
+            readiness: Readiness::new(process_config.readiness.is_some()),
             restart_times,
+            backoff_reset: Duration::from_secs(self.settings.backoff_reset_secs),
             last_activity: now,
             idle_timeout: process_config.idle_timeout,
             storage_quota_mb: process_config.storage_quota_mb,
             storage_persist: process_config.storage_persist,
             storage_used_bytes: 0,
             data_dir: instance_data_dir.clone(),
-            weight: 100, // Default weight - receives full traffic
+            tmp_dir,
+            // Default weight - receives full traffic; previews get none
+            weight: if preview { 0 } else { 100 },
+            startup_duration: None,
+            usage: None,
+            secrets_fingerprint,
+            env: spawn_env,
+            post_stop: post_stop_hook.clone(),
+            pre_stop,
+            stopping: false,
+            oom_kills: self
+                .cgroup_manager
+                .oom_kills(&instance_id.to_string())
+                .unwrap_or(0),
+            egress: netns,
+            #[cfg(unix)]
+            output,
         };
 
         {
             let mut instances = self.instances.write().await;
             instances.insert(instance_id.clone(), instance);
         }
+        self.scaled_to_zero.write().await.remove(&instance_id);
 
         // Remove from spawning set now that instance is registered
         {
@@ -508,20 +1527,27 @@ impl Hypervisor {
 
         // Update metrics
         self.metrics.instances_up.inc();
+        let data = serde_json::json!({ "socket": socket, "port": port });
+        self.emit(Event::for_instance(EventKind::Started, &instance_id, data));
 
         // Persist instance state for crash recovery (only if we have a PID to track)
         if let Some(ref store) = self.state_store {
-            let pid = {
+            let running = {
                 let instances = self.instances.read().await;
-                instances.get(&instance_id).and_then(|i| i.handle.pid())
+                instances
+                    .get(&instance_id)
+                    .and_then(|i| Some((i.handle.pid()?, i.weight, i.restarts)))
             };
-            if let Some(pid) = pid {
+            if let Some((pid, weight, restarts)) = running {
                 let state = crate::store::InstanceState {
                     instance_id: instance_id.to_string(),
                     process_name: process_name.to_string(),
                     id: id.to_string(),
                     pid,
                     port,
+                    socket: socket.display().to_string(),
+                    weight,
+                    restarts,
                     started_at: chrono::Utc::now().to_rfc3339(),
                 };
                 if let Err(e) = store.save(&state).await {
@@ -535,51 +1561,12 @@ impl Hypervisor {
 
         // Spawn exit monitor: detects process exit within 1s instead of
         // waiting for the next health check cycle (up to 10s).
-        if let Some(pid) = {
+        let spawned_pid = {
             let instances = self.instances.read().await;
             instances.get(&instance_id).and_then(|i| i.handle.pid())
-        } {
-            let exit_instance_id = instance_id.clone();
-            let log_buffer = self.log_buffer.clone();
-            // Reference to the instances map so the monitor can check
-            // if the instance was intentionally stopped (removed from map).
-            let instances_ref = unsafe {
-                // SAFETY: The RwLock<HashMap> lives as long as the Arc<Hypervisor>,
-                // which outlives all spawned instances.
-                &*(&self.instances as *const RwLock<HashMap<InstanceId, Instance>>)
-            };
-            tokio::spawn(async move {
-                loop {
-                    tokio::time::sleep(Duration::from_secs(1)).await;
-
-                    #[cfg(unix)]
-                    let alive = unsafe { libc::kill(pid as i32, 0) } == 0;
-                    #[cfg(not(unix))]
-                    let alive = true;
-
-                    if !alive {
-                        // Check if instance was intentionally stopped (removed from map)
-                        let still_tracked = {
-                            let map = instances_ref.read().await;
-                            map.contains_key(&exit_instance_id)
-                        };
-                        if still_tracked {
-                            error!(
-                                "Instance {} (pid {}) exited unexpectedly",
-                                exit_instance_id, pid
-                            );
-                            log_buffer
-                                .push_stderr(
-                                    &exit_instance_id.process,
-                                    &exit_instance_id.id,
-                                    format!("Process exited unexpectedly (pid {})", pid),
-                                )
-                                .await;
-                        }
-                        break;
-                    }
-                }
-            });
+        };
+        if let Some(pid) = spawned_pid {
+            self.watch_exit(instance_id.clone(), pid, post_stop_hook);
         }
 
         // Wait for service to be ready
@@ -587,8 +1574,18 @@ impl Hypervisor {
             // TCP mode: try to connect
             let addr = format!("127.0.0.1:{}", port);
             for _ in 0..50 {
-                if tokio::net::TcpStream::connect(&addr).await.is_ok() {
-                    info!("Instance {} ready at {}", instance_id, addr);
+                if let Ok(probe) = tokio::net::TcpStream::connect(&addr).await {
+                    info!(
+                        app = process_name,
+                        instance = id,
+                        event = "ready",
+                        "Instance {} ready at {}",
+                        instance_id,
+                        addr
+                    );
+                    self.record_startup(&instance_id).await;
+                    self.prefill_connections(&instance_id, port, probe).await;
+                    self.check_readiness(process_name, id).await;
                     return Ok(socket);
                 }
                 tokio::time::sleep(Duration::from_millis(10)).await;
@@ -600,8 +1597,32 @@ impl Hypervisor {
         } else {
             // Socket mode: check if file exists (VMs use vsock)
             for _ in 0..50 {
-                if socket.exists() {
-                    info!("Instance {} ready at {:?}", instance_id, socket);
+                if socket_ready(&socket).await {
+                    let mode = socket_mode(
+                        &self.config(),
+                        process_name,
+                        process_config.unix_socket.mode,
+                        socket_owner,
+                    );
+                    // An instance whose socket has the wrong owner or mode
+                    // isn't started at all
+                    let secured = secure_socket(&socket, run_as.as_ref(), socket_owner, mode);
+                    if let Err(e) = secured {
+                        let _ = self.stop(process_name, id).await;
+                        return Err(e).with_context(|| {
+                            format!("Cannot secure the socket of {}", instance_id)
+                        });
+                    }
+                    info!(
+                        app = process_name,
+                        instance = id,
+                        event = "ready",
+                        "Instance {} ready at {:?}",
+                        instance_id,
+                        socket
+                    );
+                    self.record_startup(&instance_id).await;
+                    self.check_readiness(process_name, id).await;
                     return Ok(socket);
                 }
                 tokio::time::sleep(Duration::from_millis(10)).await;
@@ -612,1141 +1633,6505 @@ impl Hypervisor {
         Ok(socket)
     }
 
-    /// Stop all running instances. Called on graceful shutdown.
-    pub async fn stop_all(&self) {
-        let instance_ids: Vec<InstanceId> = {
-            let instances = self.instances.read().await;
-            instances.keys().cloned().collect()
-        };
-
-        if instance_ids.is_empty() {
-            return;
-        }
-
-        info!("Stopping {} instance(s) for shutdown", instance_ids.len());
-        for instance_id in instance_ids {
-            if let Err(e) = self.stop(&instance_id.process, &instance_id.id).await {
-                error!("Failed to stop {} during shutdown: {}", instance_id, e);
+    /// Spawn everything `instance_id` depends on, deepest first, waiting for
+    /// each until it meets its edge's condition. A dependency that isn't up in
+    /// time fails the spawn.
+    async fn start_dependencies(&self, instance_id: &InstanceId) -> Result<()> {
+        let mut order = Vec::new();
+        dependency_order(
+            &self.config(),
+            &instance_id.process,
+            &instance_id.id,
+            &mut std::collections::HashSet::new(),
+            &mut order,
+        );
+        for (dependency, id, edge) in order {
+            let mut ids = self.replica_ids(&dependency, &id);
+            if ids.is_empty() {
+                ids.push(id.clone());
+            }
+            for replica in &ids {
+                self.spawn_instance(&dependency, replica, HashMap::new())
+                    .await
+                    .with_context(|| {
+                        format!(
+                            "{} depends on {}:{}, which failed to start",
+                            instance_id, dependency, id
+                        )
+                    })?;
             }
-        }
-        info!("All instances stopped");
-    }
-
-    /// Stop an instance. Waits up to 5 seconds for active connections to drain.
-    pub async fn stop(&self, process_name: &str, id: &str) -> Result<()> {
-        let instance_id = InstanceId::new(process_name, id);
-
-        // Clear spawning guard if present (in case spawn failed and left it)
-        {
-            let mut spawning = self.spawning.write().await;
-            spawning.remove(&instance_id);
-        }
 
-        // Wait for active connections to drain (up to 5 seconds)
-        let active = self.active_connection_count(process_name, id).await;
-        if active > 0 {
-            info!(
-                "Instance {} has {} active connection(s), draining...",
-                instance_id, active
-            );
-            for _ in 0..50 {
-                if self.active_connection_count(process_name, id).await == 0 {
+            // A replicated dependency counts as up once its first replica is
+            let target = InstanceId::new(&dependency, &ids[0]);
+            let deadline = Instant::now() + Duration::from_secs(edge.timeout);
+            loop {
+                let up = match edge.condition {
+                    DependencyCondition::Started => {
+                        self.instances.read().await.contains_key(&target)
+                    }
+                    DependencyCondition::Healthy => {
+                        self.check_health(&target.process, &target.id).await
+                            == HealthStatus::Healthy
+                    }
+                };
+                if up {
                     break;
                 }
-                tokio::time::sleep(Duration::from_millis(100)).await;
-            }
-            let remaining = self.active_connection_count(process_name, id).await;
-            if remaining > 0 {
-                warn!(
-                    "Instance {} still has {} connection(s) after drain timeout, force stopping",
-                    instance_id, remaining
-                );
+                if Instant::now() >= deadline {
+                    anyhow::bail!(
+                        "{} gave up waiting for {} to be {} after {}s",
+                        instance_id,
+                        target,
+                        edge.condition,
+                        edge.timeout
+                    );
+                }
+                tokio::time::sleep(Duration::from_millis(250)).await;
             }
+            debug!("{}: dependency {} is {}", instance_id, target, edge.condition);
         }
+        Ok(())
+    }
 
-        let mut instances = self.instances.write().await;
-
-        if let Some(mut instance) = instances.remove(&instance_id) {
-            info!("Stopping instance {}", instance_id);
-
-            instance
-                .handle
-                .kill()
-                .await
-                .with_context(|| format!("Failed to kill process: {}", instance_id))?;
-
-            // Release allocated port back to the pool
-            if let Some(port) = instance.port {
-                self.port_allocator.release(port).await;
-            }
-
-            // Clean up cgroup (if one was created)
-            if let Err(e) = self.cgroup_manager.remove_cgroup(&instance_id.to_string()) {
-                warn!("Failed to remove cgroup for {}: {}", instance_id, e);
+    /// Chown what an instance writes to (data dir, secrets file, tmp dir, workdir)
+    /// to the user it runs as, and let that user create its socket
+    fn prepare_for_user(
+        &self,
+        run_as: &users::RunAs,
+        process_config: &ProcessConfig,
+        instance_data_dir: &Path,
+        tmp_dir: Option<&Path>,
+        has_secrets: bool,
+        socket: Option<&Path>,
+    ) -> Result<()> {
+        run_as.chown(instance_data_dir)?;
+        if has_secrets {
+            run_as.chown(&instance_data_dir.join(secrets::SECRETS_FILE_NAME))?;
+        }
+        if let Some(tmp_dir) = tmp_dir {
+            run_as.chown(tmp_dir)?;
+        }
+        // Inside a rootfs the workdir is a guest path
+        if process_config.rootfs.is_none() {
+            if let Some(workdir) = &process_config.workdir {
+                run_as.chown(workdir)?;
             }
+        }
+        if let Some(dir) = socket.and_then(Path::parent) {
+            run_as.open_socket_dir(dir)?;
+        }
+        Ok(())
+    }
 
-            // Clean up socket
-            if instance.socket.exists() {
-                std::fs::remove_file(&instance.socket).ok();
-            }
+    /// Queue `entry` for the log sinks, if any are configured
+    pub fn ship_log(&self, entry: &LogEntry) {
+        if let Some(log_shipper) = &self.log_shipper {
+            log_shipper.ship(entry);
+        }
+    }
 
-            // Clean up data directory if storage_persist is false
-            if !instance.storage_persist && instance.data_dir.exists() {
-                if let Err(e) = std::fs::remove_dir_all(&instance.data_dir) {
-                    warn!(
-                        "Failed to remove data directory {:?} for {}: {}",
-                        instance.data_dir, instance_id, e
-                    );
-                } else {
+    /// Copy a child's output into the log buffer line by line, append each kept
+    /// line to the service's log file and log sinks (if enabled), and re-emit
+    /// it as a `tenement::output` event tagged with the app, instance, and pid
+    /// so it shares the supervisor's log format.
+    fn capture_output<R>(
+        &self,
+        stream: R,
+        level: LogLevel,
+        process_name: &str,
+        id: &str,
+        pid: Option<u32>,
+    ) where
+        R: tokio::io::AsyncRead + Unpin + Send + 'static,
+    {
+        let log_buffer = self.log_buffer.clone();
+        let limiter = self.log_limiters.read().unwrap().get(process_name).cloned();
+        let log_files = self.log_files.clone();
+        let log_shipper = self.log_shipper.clone();
+        let process = process_name.to_string();
+        let inst_id = id.to_string();
+        tokio::spawn(async move {
+            let mut lines = BufReader::new(stream).lines();
+            while let Ok(Some(line)) = lines.next_line().await {
+                let entry = LogEntry::new(&process, &inst_id, level, line);
+                let kept = match &limiter {
+                    Some(limiter) => log_buffer.push_limited(limiter, entry.clone()).await,
+                    None => {
+                        log_buffer.push(entry.clone()).await;
+                        true
+                    }
+                };
+                if kept {
+                    if let Some(log_files) = &log_files {
+                        log_files.append(&entry);
+                    }
+                    if let Some(log_shipper) = &log_shipper {
+                        log_shipper.ship(&entry);
+                    }
                     info!(
-                        "Removed data directory {:?} for {}",
-                        instance.data_dir, instance_id
+                        target: "tenement::output",
+                        app = %process,
+                        instance = %inst_id,
+                        pid,
+                        stream = %level,
+                        "{}",
+                        entry.message
                     );
                 }
             }
-
-            // Update metrics
-            self.metrics.instances_up.dec();
-
-            // Remove persisted state
-            if let Some(ref store) = self.state_store {
-                if let Err(e) = store.remove(&instance_id.to_string()).await {
-                    error!("Failed to remove instance state for {}: {}", instance_id, e);
-                }
+            if let Some(limiter) = &limiter {
+                log_buffer.flush_dropped(limiter, &process, &inst_id).await;
             }
-
-            Ok(())
-        } else {
-            anyhow::bail!("Instance not found: {}", instance_id)
-        }
+        });
     }
 
-    /// Restart an instance with exponential backoff
-    pub async fn restart(&self, process_name: &str, id: &str) -> Result<PathBuf> {
-        let instance_id = InstanceId::new(process_name, id);
-
-        // Get restart count from persistent history (survives stop/spawn cycles)
-        let restarts = {
-            let history = self.restart_history.read().await;
-            history
-                .get(&instance_id)
-                .map(|(count, _)| *count)
-                .unwrap_or(0)
+    /// Watch `pid` and report it exiting on its own (rather than being stopped)
+    /// within a second, instead of at the next health check
+    fn watch_exit(&self, instance_id: InstanceId, pid: u32, post_stop_hook: Option<PostStopHook>) {
+        let log_buffer = self.log_buffer.clone();
+        let events = self.events.clone();
+        let env = self.environment().map(str::to_string);
+        let post_stop = (self.post_stop.clone(), post_stop_hook);
+        // Reference to the instances map so the monitor can check
+        // if the instance was intentionally stopped (removed from map).
+        let instances_ref = unsafe {
+            // SAFETY: The RwLock<HashMap> lives as long as the Arc<Hypervisor>,
+            // which outlives all spawned instances.
+            &*(&self.instances as *const RwLock<HashMap<InstanceId, Instance>>)
         };
+        tokio::spawn(async move {
+            loop {
+                tokio::time::sleep(Duration::from_secs(1)).await;
+
+                // try_wait reaps the child, so an exited process can't linger
+                // as a zombie that still answers kill(pid, 0)
+                let exited = {
+                    let mut map = instances_ref.write().await;
+                    match map.get_mut(&instance_id) {
+                        // Intentionally stopped; remove_instance runs the hook
+                        None => break,
+                        Some(instance) if instance.stopping => break,
+                        Some(instance) => match instance.handle.pid() {
+                            Some(current) if current != pid => break,
+                            Some(_) => !instance.handle.is_running().await,
+                            // Already reaped elsewhere (e.g. a health check)
+                            None => true,
+                        },
+                    }
+                };
 
-        // Stop if running
-        let _ = self.stop(process_name, id).await;
+                if exited {
+                    error!(
+                        app = %instance_id.process,
+                        instance = %instance_id.id,
+                        pid,
+                        event = "exit",
+                        "Instance {} (pid {}) exited unexpectedly",
+                        instance_id,
+                        pid
+                    );
+                    log_buffer
+                        .push_stderr(
+                            &instance_id.process,
+                            &instance_id.id,
+                            format!("Process exited unexpectedly (pid {})", pid),
+                        )
+                        .await;
+                    let data = serde_json::json!({ "pid": pid });
+                    let mut event = Event::for_instance(EventKind::Crashed, &instance_id, data);
+                    event.env = env;
+                    events.publish(event);
+                    if let (runner, Some(hook)) = &post_stop {
+                        runner.fire(hook, StopReason::Exited, log_buffer.clone());
+                    }
+                    break;
+                }
+            }
+        });
+    }
 
-        // Calculate and apply exponential backoff delay
-        let backoff_delay = self.calculate_backoff(restarts);
-        if backoff_delay > Duration::ZERO {
-            info!(
-                "Applying backoff delay of {:?} before restarting {} (restart #{})",
-                backoff_delay,
-                instance_id,
-                restarts + 1
-            );
-            tokio::time::sleep(backoff_delay).await;
+    /// Pre-open `warm_connections` idle connections to an instance that just became
+    /// ready. The readiness probe's connection is kept as the first one.
+    async fn prefill_connections(
+        &self,
+        instance_id: &InstanceId,
+        port: u16,
+        probe: tokio::net::TcpStream,
+    ) {
+        let count = self
+            .config()
+            .get_service(&instance_id.process)
+            .map_or(0, |c| c.warm_connections as usize);
+        if count == 0 {
+            return;
         }
-
-        // Spawn again
-        let socket = self.spawn(process_name, id).await?;
-
-        // Update persistent restart history
-        let window = Duration::from_secs(self.config.settings.restart_window);
-        {
-            let mut history = self.restart_history.write().await;
-            let entry = history
-                .entry(instance_id.clone())
-                .or_insert((0, Vec::new()));
-            entry.0 = restarts + 1;
-            entry.1.push(Instant::now());
-            entry.1.retain(|t| t.elapsed() < window);
+        self.warm_pool.put(port, probe);
+        let idle = self.warm_pool.fill(port, count).await;
+        if idle < count {
+            warn!(
+                "Instance {}: pre-opened {} of {} warm connections",
+                instance_id, idle, count
+            );
+        } else {
+            debug!("Instance {}: pre-opened {} warm connections", instance_id, idle);
         }
+    }
 
-        // Also update the instance's restart count for display
-        {
+    /// Record time from launch to first ready for an instance.
+    /// Only the first call per run counts; a restart resets it with the new instance.
+    async fn record_startup(&self, instance_id: &InstanceId) {
+        let elapsed = {
             let mut instances = self.instances.write().await;
-            if let Some(instance) = instances.get_mut(&instance_id) {
-                instance.restarts = restarts + 1;
-                // Copy restart_times from persistent history
-                let history = self.restart_history.read().await;
-                if let Some((_, times)) = history.get(&instance_id) {
-                    instance.restart_times = times.clone();
+            match instances.get_mut(instance_id) {
+                Some(instance) if instance.startup_duration.is_none() => {
+                    let elapsed = instance.started_at.elapsed();
+                    instance.startup_duration = Some(elapsed);
+                    elapsed
                 }
+                _ => return,
             }
-        }
+        };
+
+        info!(
+            "Instance {} started in {}ms",
+            instance_id,
+            elapsed.as_millis()
+        );
 
         // Update metrics
         let mut labels = HashMap::new();
-        labels.insert("process".to_string(), process_name.to_string());
-        labels.insert("id".to_string(), id.to_string());
-        let counter = self.metrics.instance_restarts.with_labels(&labels).await;
-        counter.inc();
+        labels.insert("process".to_string(), instance_id.process.clone());
+        labels.insert("id".to_string(), instance_id.id.clone());
+        let histogram = self
+            .metrics
+            .instance_startup_duration_ms
+            .with_labels(&labels)
+            .await;
+        histogram.observe(elapsed.as_secs_f64() * 1000.0);
+    }
 
-        Ok(socket)
+    /// Stop all running instances. Called on graceful shutdown.
+    /// Bounded by `settings.shutdown_timeout_secs`.
+    pub async fn stop_all(&self) {
+        self.shutdown(self.shutdown_timeout()).await;
     }
 
-    /// Calculate exponential backoff delay based on restart count
-    /// Formula: base * 2^(restarts - 1), capped at max
-    fn calculate_backoff(&self, restarts: u32) -> Duration {
-        if restarts == 0 {
-            return Duration::ZERO;
-        }
+    /// Extra address serving only `/metrics` (`settings.metrics_listen`)
+    pub fn metrics_listen(&self) -> Option<std::net::SocketAddr> {
+        self.settings.metrics_listen
+    }
 
-        let base_ms = self.config.settings.backoff_base_ms;
-        let max_ms = self.config.settings.backoff_max_ms;
+    /// Service discovery names and files (`settings.discovery`)
+    pub fn discovery(&self) -> Option<&DiscoveryConfig> {
+        self.settings.discovery.as_ref()
+    }
 
-        // Calculate delay: base * 2^(restarts - 1)
-        // Cap the shift amount to prevent overflow (max 63 bits for u64)
-        let shift = (restarts - 1).min(63);
-        let multiplier = 1u64.checked_shl(shift).unwrap_or(u64::MAX);
-        let delay_ms = base_ms.saturating_mul(multiplier).min(max_ms);
+    /// Where the web dashboard is served (`settings.dashboard`)
+    pub fn dashboard(&self) -> &DashboardConfig {
+        &self.settings.dashboard
+    }
 
-        Duration::from_millis(delay_ms)
+    /// Unix socket serving the admin API (`settings.admin_socket`)
+    pub fn admin_socket(&self) -> PathBuf {
+        self.settings.admin_socket_path()
     }
 
-    /// Check if an instance is running
-    pub async fn is_running(&self, process_name: &str, id: &str) -> bool {
-        let instance_id = InstanceId::new(process_name, id);
-        let instances = self.instances.read().await;
-        instances.contains_key(&instance_id)
+    /// File whose creation starts a drain (`settings.drain_file`)
+    pub fn drain_file(&self) -> Option<&Path> {
+        self.settings.drain_file.as_deref()
     }
 
-    /// Spawn if not already running
-    pub async fn spawn_if_not_running(&self, process_name: &str, id: &str) -> Result<PathBuf> {
-        if self.is_running(process_name, id).await {
-            let process_config = self
-                .config
-                .get_service(process_name)
-                .context("Unknown process")?;
-            Ok(process_config.socket_path(process_name, id))
-        } else {
-            self.spawn(process_name, id).await
-        }
+    /// Start or cancel a drain: while set, new proxied requests are refused
+    pub fn set_draining(&self, draining: bool) {
+        self.draining.store(draining, std::sync::atomic::Ordering::SeqCst);
     }
 
-    /// List all running instances
-    pub async fn list(&self) -> Vec<InstanceInfo> {
-        let instances = self.instances.read().await;
-        instances.values().map(|i| i.info()).collect()
+    /// Whether a drain is in progress
+    pub fn is_draining(&self) -> bool {
+        self.draining.load(std::sync::atomic::Ordering::SeqCst)
     }
 
-    /// Get info for a specific instance
-    pub async fn get(&self, process_name: &str, id: &str) -> Option<InstanceInfo> {
-        let instance_id = InstanceId::new(process_name, id);
-        let instances = self.instances.read().await;
-        instances.get(&instance_id).map(|i| i.info())
+    /// Whether `drain_app` took a service out of rotation
+    pub fn is_app_draining(&self, process_name: &str) -> bool {
+        self.drained.read().unwrap().contains(process_name)
     }
 
-    /// Get storage information for a specific instance
-    pub async fn get_storage_info(&self, process_name: &str, id: &str) -> Option<StorageInfo> {
-        let instance_id = InstanceId::new(process_name, id);
-        let (data_dir, quota_mb) = {
-            let instances = self.instances.read().await;
-            instances
-                .get(&instance_id)
-                .map(|i| (i.data_dir.clone(), i.storage_quota_mb))?
+    /// Put a service in maintenance mode (`Some(retry_after)`, in seconds) or
+    /// take it out (`None`). Its instances keep running; the proxy answers
+    /// for them with the maintenance page.
+    pub fn set_maintenance(&self, process_name: &str, retry_after: Option<u64>) -> Result<()> {
+        if !self.has_process(process_name) {
+            anyhow::bail!("Unknown service: {}", process_name);
+        }
+        let mut maintenance = self.maintenance.write().unwrap();
+        match retry_after {
+            Some(secs) => maintenance.insert(process_name.to_string(), secs),
+            None => maintenance.remove(process_name),
         };
+        Ok(())
+    }
 
-        // Calculate current directory size
-        let used_bytes = calculate_dir_size(data_dir.clone()).await.unwrap_or(0);
-
-        // Convert quota from MB to bytes
-        let quota_bytes = quota_mb.map(|mb| (mb as u64) * 1024 * 1024);
+    /// The Retry-After for a service in maintenance mode (None: serving normally)
+    pub fn maintenance(&self, process_name: &str) -> Option<u64> {
+        self.maintenance.read().unwrap().get(process_name).copied()
+    }
 
-        Some(StorageInfo::new(used_bytes, quota_bytes, data_dir))
+    /// Every service in maintenance mode, with its Retry-After
+    pub fn maintenance_all(&self) -> HashMap<String, u64> {
+        self.maintenance.read().unwrap().clone()
     }
 
-    /// Get instance info and touch activity atomically.
-    /// This prevents race conditions where an instance could be reaped
-    /// between checking if it's running and touching its activity.
-    pub async fn get_and_touch(&self, process_name: &str, id: &str) -> Option<InstanceInfo> {
-        let instance_id = InstanceId::new(process_name, id);
-        let mut instances = self.instances.write().await;
-        if let Some(instance) = instances.get_mut(&instance_id) {
-            instance.touch();
-            Some(instance.info())
-        } else {
-            None
-        }
+    /// A service's custom maintenance page (`maintenance_page`)
+    pub fn maintenance_page(&self, process_name: &str) -> Option<PathBuf> {
+        self.config()
+            .get_service(process_name)
+            .and_then(|p| p.maintenance_page.clone())
     }
 
-    /// Check if a process is configured (can be spawned)
-    pub fn has_process(&self, process_name: &str) -> bool {
-        self.config.get_service(process_name).is_some()
+    /// Health webhook settings, if configured
+    pub fn health_webhook(&self) -> Option<&HealthWebhookConfig> {
+        self.settings.health_webhook.as_ref()
     }
 
-    /// Increment active connection count for an instance. Returns a guard
-    /// that decrements the count when dropped.
-    pub async fn connection_start(&self, process_name: &str, id: &str) -> ConnectionGuard {
-        let instance_id = InstanceId::new(process_name, id);
-        let counter = {
-            let mut conns = self.active_connections.write().await;
-            conns
-                .entry(instance_id)
-                .or_insert_with(|| Arc::new(std::sync::atomic::AtomicU32::new(0)))
-                .clone()
-        };
-        counter.fetch_add(1, std::sync::atomic::Ordering::Relaxed);
-        ConnectionGuard { counter }
+    /// Active config environment (`settings.environment` / TENEMENT_ENV)
+    pub fn environment(&self) -> Option<&str> {
+        self.settings.environment.as_deref()
     }
 
-    /// Get active connection count for an instance
-    pub async fn active_connection_count(&self, process_name: &str, id: &str) -> u32 {
-        let instance_id = InstanceId::new(process_name, id);
-        let conns = self.active_connections.read().await;
-        conns
-            .get(&instance_id)
-            .map(|c| c.load(std::sync::atomic::Ordering::Relaxed))
-            .unwrap_or(0)
+    /// Receive every health state change from now on
+    pub fn subscribe_health(&self) -> broadcast::Receiver<HealthTransition> {
+        self.health_events.subscribe()
     }
 
-    /// Get the request timeout for a process (in seconds)
-    pub fn request_timeout(&self, process_name: &str) -> Duration {
-        let secs = self
-            .config
-            .get_service(process_name)
-            .map(|p| p.request_timeout)
-            .unwrap_or(30);
-        Duration::from_secs(secs)
+    /// Publish a health state change; a no-op when nothing changed or nobody listens
+    fn notify_health(&self, instance: &InstanceId, old: HealthStatus, new: HealthStatus) {
+        if old != new {
+            let _ = self.health_events.send(HealthTransition {
+                instance: instance.clone(),
+                old,
+                new,
+                at: chrono::Utc::now(),
+            });
+            let data = serde_json::json!({ "old_state": old, "new_state": new });
+            let event = Event::for_instance(EventKind::HealthChanged, instance, data);
+            self.emit(event);
+        }
     }
 
-    /// Check health of an instance
-    pub async fn check_health(&self, process_name: &str, id: &str) -> HealthStatus {
-        let instance_id = InstanceId::new(process_name, id);
+    /// Receive every lifecycle event from now on
+    pub fn subscribe_events(&self) -> broadcast::Receiver<Event> {
+        self.events.subscribe()
+    }
 
-        let process_config = match self.config.get_service(process_name) {
-            Some(c) => c,
-            None => return HealthStatus::Unknown,
-        };
+    /// The event bus, for recent events as well as live ones
+    pub fn events(&self) -> &EventBus {
+        &self.events
+    }
 
-        // If no health endpoint configured, assume healthy if socket exists
-        let health_endpoint = match &process_config.health {
-            Some(h) => h,
-            None => {
-                let socket = process_config.socket_path(process_name, id);
-                return if socket.exists() {
-                    HealthStatus::Healthy
-                } else {
-                    HealthStatus::Unhealthy
-                };
-            }
-        };
+    /// Publish a lifecycle event, tagged with the active environment
+    pub fn emit(&self, mut event: Event) {
+        event.env = self.environment().map(str::to_string);
+        self.events.publish(event);
+    }
 
-        // Get socket, vsock port, and TCP port from the running instance
-        let (socket, vsock_port, tcp_port) = {
-            let instances = self.instances.read().await;
-            match instances.get(&instance_id) {
-                Some(instance) => (
-                    instance.handle.socket().clone(),
-                    instance.handle.vsock_port(),
-                    instance.port,
-                ),
-                None => return HealthStatus::Unknown,
-            }
-        };
+    /// Overall deadline for stopping everything on shutdown
+    pub fn shutdown_timeout(&self) -> Duration {
+        Duration::from_secs(self.settings.shutdown_timeout_secs)
+    }
 
-        // Use TCP health check for process/namespace/sandbox runtimes,
-        // fall back to Unix socket for VMs
-        let result = if let Some(port) = tcp_port {
-            self.ping_health_tcp(port, health_endpoint).await
-        } else {
-            self.ping_health_with_vsock(&socket, health_endpoint, vsock_port)
-                .await
-        };
+    /// Stop all instances within `deadline`: drain connections, SIGTERM every
+    /// process group, wait for exits, then force-kill whatever is left. Does
+    /// nothing once instances were handed to a new supervisor. Log sinks then
+    /// send what they have left.
+    pub async fn shutdown(&self, deadline: Duration) -> ShutdownReport {
+        let until = Instant::now() + deadline;
+        let report = self.stop_for_shutdown(deadline).await;
+        if let Some(log_shipper) = &self.log_shipper {
+            let left = until
+                .saturating_duration_since(Instant::now())
+                .max(Duration::from_secs(1));
+            log_shipper.flush(left).await;
+        }
+        report
+    }
 
-        let mut instances = self.instances.write().await;
-        let instance = match instances.get_mut(&instance_id) {
-            Some(i) => i,
-            None => return HealthStatus::Unknown,
+    async fn stop_for_shutdown(&self, deadline: Duration) -> ShutdownReport {
+        let until = Instant::now() + deadline;
+        let mut report = ShutdownReport::default();
+        if self.is_handed_off() {
+            // Its instances belong to the new supervisor now
+            return report;
+        }
+        self.jobs.shutdown().await;
+        // Let deploys in flight finish (a canary mid-way) within half the
+        // deadline; holding the lock keeps new ones from starting
+        let waiting = tokio::time::timeout(deadline / 2, self.deploys.write());
+        let no_deploys = waiting.await;
+        if no_deploys.is_err() {
+            warn!("Stopping with deploys still in progress");
+        }
+        let instance_ids: Vec<InstanceId> = {
+            let instances = self.instances.read().await;
+            instances.keys().cloned().collect()
         };
 
-        instance.last_health_check = Some(Instant::now());
+        if instance_ids.is_empty() {
+            self.wait_for_post_stop_hooks().await;
+            return report;
+        }
 
-        match result {
-            Ok(()) => {
-                instance.consecutive_failures = 0;
-                instance.health_status = HealthStatus::Healthy;
-                HealthStatus::Healthy
+        info!(
+            "Stopping {} instance(s) for shutdown (deadline: {:?})",
+            instance_ids.len(),
+            deadline
+        );
+
+        // Drain connections for all instances at once, capped at the usual 5s and
+        // half the deadline so processes still get time to exit after SIGTERM
+        let drain_until = Instant::now() + (deadline / 2).min(Duration::from_secs(5));
+        while Instant::now() < drain_until {
+            let mut active = 0;
+            for id in &instance_ids {
+                active += self.active_connection_count(&id.process, &id.id).await;
             }
-            Err(e) => {
-                instance.consecutive_failures += 1;
-                warn!(
-                    "Health check failed for {}: {} (failures: {})",
-                    instance_id, e, instance.consecutive_failures
-                );
+            if active == 0 {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
 
-                let status = match instance.consecutive_failures {
-                    1..=2 => HealthStatus::Degraded,
-                    _ => {
-                        let window = Duration::from_secs(self.config.settings.restart_window);
-                        let recent_restarts = instance
-                            .restart_times
-                            .iter()
-                            .filter(|t| t.elapsed() < window)
-                            .count() as u32;
+        // Ask every instance to exit
+        let mut exiting = Vec::new();
+        for id in &instance_ids {
+            if let Some(grace) = self.signal_stop(id).await {
+                exiting.push((id.clone(), until.min(Instant::now() + grace)));
+            }
+        }
 
-                        if recent_restarts >= self.config.settings.max_restarts {
-                            HealthStatus::Failed
-                        } else {
-                            HealthStatus::Unhealthy
+        // Wait for signaled processes to exit, each until its grace period or
+        // the deadline runs out
+        let mut still_running = Vec::new();
+        while !exiting.is_empty() {
+            {
+                let mut instances = self.instances.write().await;
+                let mut running = Vec::new();
+                for (id, kill_at) in exiting {
+                    if let Some(instance) = instances.get_mut(&id) {
+                        if !instance.handle.is_running().await {
+                            continue;
+                        }
+                        match Instant::now() >= kill_at {
+                            true => still_running.push(id),
+                            false => running.push((id, kill_at)),
                         }
                     }
-                };
-                instance.health_status = status;
-                status
+                }
+                exiting = running;
+            }
+            if !exiting.is_empty() {
+                tokio::time::sleep(Duration::from_millis(50)).await;
             }
         }
-    }
 
-    /// Ping a health endpoint via TCP (for process/namespace/sandbox runtimes)
-    async fn ping_health_tcp(&self, port: u16, endpoint: &str) -> Result<()> {
-        use tokio::io::{AsyncReadExt, AsyncWriteExt};
-        use tokio::net::TcpStream;
+        for id in &still_running {
+            warn!("Force-killing {}: still running after its stop signal", id);
+        }
 
-        let addr = format!("127.0.0.1:{}", port);
-        let mut stream = tokio::time::timeout(HEALTH_CHECK_TIMEOUT, TcpStream::connect(&addr))
-            .await
-            .context("TCP connection timeout")?
-            .context("Failed to connect")?;
+        // Stopping for shutdown isn't stopping for good: keep what was running on
+        // record, so the next start brings it back (see `recover_orphans`)
+        let persisted = match &self.state_store {
+            Some(store) => store.list().await.unwrap_or_else(|e| {
+                error!("Failed to read instance state before shutdown: {}", e);
+                Vec::new()
+            }),
+            None => Vec::new(),
+        };
 
-        let request = format!(
-            "GET {} HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
-            endpoint
-        );
-        stream
-            .write_all(request.as_bytes())
-            .await
-            .context("Failed to write request")?;
+        // Clean up everything; remaining processes get SIGKILL here
+        for id in instance_ids {
+            let budget = until
+                .saturating_duration_since(Instant::now())
+                .max(Duration::from_secs(1));
+            match tokio::time::timeout(budget, self.remove_instance(&id)).await {
+                Ok(Ok(())) => {}
+                Ok(Err(e)) => error!("Failed to stop {} during shutdown: {}", id, e),
+                Err(_) => error!("Timed out stopping {} during shutdown", id),
+            }
+            if still_running.contains(&id) {
+                report.force_killed.push(id);
+            } else {
+                report.stopped.push(id);
+            }
+        }
 
-        let mut response = vec![0u8; 1024];
-        let n = tokio::time::timeout(HEALTH_CHECK_TIMEOUT, stream.read(&mut response))
-            .await
-            .context("Read timeout")?
-            .context("Failed to read response")?;
+        if let Some(store) = &self.state_store {
+            for state in &persisted {
+                // Its process is gone, and the pid may go to another one
+                let state = crate::store::InstanceState {
+                    pid: 0,
+                    ..state.clone()
+                };
+                if let Err(e) = store.save(&state).await {
+                    error!("Failed to keep state for {}: {}", state.instance_id, e);
+                }
+            }
+        }
 
-        let response_str = String::from_utf8_lossy(&response[..n]);
-        if response_str.contains("200") {
-            Ok(())
+        self.wait_for_post_stop_hooks().await;
+
+        if report.force_killed.is_empty() {
+            info!("All instances stopped");
         } else {
-            anyhow::bail!("Unhealthy response")
+            let names: Vec<String> = report.force_killed.iter().map(|id| id.to_string()).collect();
+            warn!(
+                "Shutdown complete; force-killed {} instance(s): {}",
+                names.len(),
+                names.join(", ")
+            );
         }
+        report
     }
 
-    /// Ping a health endpoint, optionally using vsock CONNECT protocol
-    ///
-    /// For Firecracker VMs, the vsock socket requires the CONNECT protocol:
-    /// 1. Connect to the Unix socket (exposed by Firecracker)
-    /// 2. Send "CONNECT <port>\n"
-    /// 3. Wait for "OK <port>\n" response
-    /// 4. Socket is now connected to guest app
-    async fn ping_health_with_vsock(
+    /// Wait for running `post_stop` hooks; each is bounded by its own timeout
+    pub async fn wait_for_post_stop_hooks(&self) {
+        self.post_stop.wait_all().await;
+    }
+
+    /// Stop an instance. Waits up to 5 seconds for active connections to drain.
+    pub async fn stop(&self, process_name: &str, id: &str) -> Result<()> {
+        self.stop_with_drain(process_name, id, STOP_DRAIN).await
+    }
+
+    /// Stop an instance, waiting up to `drain` for active connections to finish.
+    /// A replicated instance stops each running replica in turn.
+    pub async fn stop_with_drain(
         &self,
-        socket_path: &PathBuf,
-        endpoint: &str,
-        vsock_port: Option<u32>,
+        process_name: &str,
+        id: &str,
+        drain: Duration,
     ) -> Result<()> {
-        use tokio::io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader};
-        use tokio::net::UnixStream;
-
-        let stream = tokio::time::timeout(HEALTH_CHECK_TIMEOUT, UnixStream::connect(socket_path))
-            .await
-            .context("Connection timeout")?
-            .context("Failed to connect")?;
+        let replicas = self.replica_ids(process_name, id);
+        if replicas.is_empty() {
+            return self.stop_single(process_name, id, drain).await;
+        }
+        let mut stopped = 0;
+        for replica in &replicas {
+            if self.is_running(process_name, replica).await {
+                self.stop_single(process_name, replica, drain).await?;
+                stopped += 1;
+            }
+        }
+        if stopped == 0 {
+            anyhow::bail!("Instance not found: {}", InstanceId::new(process_name, id))
+        }
+        Ok(())
+    }
 
-        let (reader, mut writer) = stream.into_split();
-        let mut reader = BufReader::new(reader);
+    async fn stop_single(&self, process_name: &str, id: &str, drain: Duration) -> Result<()> {
+        let instance_id = InstanceId::new(process_name, id);
 
-        // If vsock port is specified, perform CONNECT handshake
-        if let Some(port) = vsock_port {
-            // Send CONNECT request
-            let connect_cmd = format!("CONNECT {}\n", port);
-            writer
-                .write_all(connect_cmd.as_bytes())
-                .await
-                .context("Failed to send CONNECT")?;
+        // Stopping a scaled-to-zero instance keeps it from being woken again
+        if self.scaled_to_zero.write().await.remove(&instance_id)
+            && !self.is_running(process_name, id).await
+        {
+            info!("Instance {} was scaled to zero; it will no longer be woken", instance_id);
+            return Ok(());
+        }
 
-            // Read response line
-            let mut response_line = String::new();
-            tokio::time::timeout(HEALTH_CHECK_TIMEOUT, reader.read_line(&mut response_line))
+        let pre_stop = {
+            let instances = self.instances.read().await;
+            instances.get(&instance_id).and_then(|i| i.pre_stop.clone())
+        };
+        if let Some(hook) = pre_stop {
+            hook.run(&self.log_buffer)
                 .await
-                .context("CONNECT response timeout")?
-                .context("Failed to read CONNECT response")?;
+                .with_context(|| format!("Not stopping {}", instance_id))?;
+        }
 
-            // Expect "OK <port>\n"
-            let expected = format!("OK {}", port);
-            if !response_line.starts_with(&expected) {
-                anyhow::bail!(
-                    "VSOCK CONNECT failed: expected '{}', got '{}'",
-                    expected,
-                    response_line.trim()
+        // Wait for active connections to drain
+        let active = self.active_connection_count(process_name, id).await;
+        if active > 0 {
+            info!(
+                "Instance {} has {} active connection(s), draining...",
+                instance_id, active
+            );
+            let until = Instant::now() + drain;
+            while Instant::now() < until {
+                if self.active_connection_count(process_name, id).await == 0 {
+                    break;
+                }
+                tokio::time::sleep(Duration::from_millis(100)).await;
+            }
+            let remaining = self.active_connection_count(process_name, id).await;
+            if remaining > 0 {
+                warn!(
+                    "Instance {} still has {} connection(s) after drain timeout, force stopping",
+                    instance_id, remaining
                 );
             }
         }
 
-        // Now send HTTP health check request
-        let request = format!(
-            "GET {} HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
-            endpoint
-        );
-        writer
-            .write_all(request.as_bytes())
-            .await
-            .context("Failed to write request")?;
+        // Give it its grace period to exit on its stop signal before SIGKILL
+        if let Some(grace) = self.signal_stop(&instance_id).await {
+            let until = Instant::now() + grace;
+            loop {
+                let running = {
+                    let mut instances = self.instances.write().await;
+                    match instances.get_mut(&instance_id) {
+                        Some(instance) => instance.handle.is_running().await,
+                        None => false,
+                    }
+                };
+                if !running {
+                    break;
+                }
+                if Instant::now() >= until {
+                    warn!(
+                        "Force-killing {}: still running {:?} after its stop signal",
+                        instance_id, grace
+                    );
+                    break;
+                }
+                tokio::time::sleep(Duration::from_millis(50)).await;
+            }
+        }
 
-        let mut response = vec![0u8; 1024];
-        let n = tokio::time::timeout(HEALTH_CHECK_TIMEOUT, reader.read(&mut response))
-            .await
-            .context("Read timeout")?
-            .context("Failed to read response")?;
+        self.remove_instance(&instance_id).await
+    }
 
-        let response_str = String::from_utf8_lossy(&response[..n]);
-        if response_str.contains("200 OK") {
-            Ok(())
-        } else {
-            anyhow::bail!("Unhealthy response")
+    /// Send an instance its service's stop signal and mark it stopping, so its
+    /// exit isn't taken for a crash. Returns how long it gets to exit before
+    /// SIGKILL, or None when it has no process to signal.
+    async fn signal_stop(&self, instance_id: &InstanceId) -> Option<Duration> {
+        let config = self.config();
+        let (stop, grace) = match config.get_service(&instance_id.process) {
+            Some(service) => (StopSignal::for_service(service), service.stop_timeout()),
+            None => (StopSignal::default(), Duration::from_secs(10)),
+        };
+        let mut instances = self.instances.write().await;
+        let instance = instances.get_mut(instance_id)?;
+        if !instance.handle.terminate(stop) {
+            return None;
         }
+        instance.stopping = true;
+        Some(grace)
     }
 
-    /// Run health checks on all instances and handle unhealthy ones
-    pub async fn run_health_checks(&self) {
-        let instance_ids: Vec<InstanceId> = {
+    /// Stop a service for maintenance: take it out of rotation, let each
+    /// instance's in-flight connections finish, SIGTERM it once it has none,
+    /// and kill whatever is still busy or running at `timeout`. The proxy
+    /// keeps refusing the service's requests, rather than waking it, until
+    /// it's spawned again.
+    pub async fn drain_app(&self, process_name: &str, timeout: Duration) -> Result<DrainReport> {
+        if !self.has_process(process_name) {
+            anyhow::bail!("Unknown service: {}", process_name);
+        }
+        let until = Instant::now() + timeout;
+        self.drained
+            .write()
+            .unwrap()
+            .insert(process_name.to_string());
+        self.scaled_to_zero
+            .write()
+            .await
+            .retain(|id| id.process != process_name);
+
+        let (instance_ids, pre_stop): (Vec<InstanceId>, Vec<BoundHook>) = {
             let instances = self.instances.read().await;
-            instances.keys().cloned().collect()
+            let mine = instances.values().filter(|i| i.id.process == process_name);
+            (
+                mine.clone().map(|i| i.id.clone()).collect(),
+                mine.filter_map(|i| i.pre_stop.clone()).collect(),
+            )
         };
+        info!(
+            "Draining {}: {} instance(s), timeout {:?}",
+            process_name,
+            instance_ids.len(),
+            timeout
+        );
+        for hook in pre_stop {
+            if let Err(e) = hook.run(&self.log_buffer).await {
+                self.drained.write().unwrap().remove(process_name);
+                return Err(e.context(format!("Not draining {}", process_name)));
+            }
+        }
 
-        for instance_id in instance_ids {
-            let status = self
-                .check_health(&instance_id.process, &instance_id.id)
-                .await;
-
-            match status {
-                HealthStatus::Unhealthy => {
-                    info!("Instance {} is unhealthy, restarting", instance_id);
-                    if let Err(e) = self.restart(&instance_id.process, &instance_id.id).await {
-                        error!("Failed to restart {}: {}", instance_id, e);
-                    }
+        // Each instance gets its stop signal as soon as its last connection
+        // ends, then its grace period to exit
+        let mut busy = instance_ids.clone();
+        let mut exiting = Vec::new();
+        let mut overdue = Vec::new();
+        loop {
+            let mut still_busy = Vec::new();
+            for id in busy {
+                if self.active_connection_count(&id.process, &id.id).await > 0 {
+                    still_busy.push(id);
+                    continue;
                 }
-                HealthStatus::Failed => {
-                    error!("Instance {} has failed (too many restarts)", instance_id);
+                if let Some(grace) = self.signal_stop(&id).await {
+                    exiting.push((id, Instant::now() + grace));
                 }
-                _ => {}
             }
+            busy = still_busy;
+            {
+                let mut instances = self.instances.write().await;
+                let mut running = Vec::new();
+                for (id, kill_at) in exiting {
+                    if let Some(instance) = instances.get_mut(&id) {
+                        if !instance.handle.is_running().await {
+                            continue;
+                        }
+                        match Instant::now() >= kill_at {
+                            true => overdue.push(id),
+                            false => running.push((id, kill_at)),
+                        }
+                    }
+                }
+                exiting = running;
+            }
+            if (busy.is_empty() && exiting.is_empty()) || Instant::now() >= until {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
         }
-    }
 
-    /// Start the background health monitor loop
-    pub fn start_monitor(self: Arc<Self>) {
-        let interval = Duration::from_secs(self.config.settings.health_check_interval);
-        let hyp = self.clone();
-        tokio::spawn(async move {
-            info!("Starting health monitor (interval: {:?})", interval);
-            loop {
-                tokio::time::sleep(interval).await;
-                hyp.run_health_checks().await;
-                hyp.reap_idle_instances().await;
-                hyp.check_storage_quotas().await;
+        let mut report = DrainReport::default();
+        for id in &busy {
+            report.cut_connections += self.active_connection_count(&id.process, &id.id).await;
+        }
+        for id in instance_ids {
+            if let Err(e) = self.remove_instance(&id).await {
+                error!("Failed to stop {} while draining: {}", id, e);
             }
-        });
+            let waiting = exiting.iter().any(|(exiting, _)| *exiting == id);
+            if busy.contains(&id) || waiting || overdue.contains(&id) {
+                warn!(
+                    "Force-killed {}: still busy or running after {:?}",
+                    id, timeout
+                );
+                report.force_killed.push(id);
+            } else {
+                report.stopped.push(id);
+            }
+        }
+        info!(
+            "Drained {}: {} stopped, {} force-killed",
+            process_name,
+            report.stopped.len(),
+            report.force_killed.len()
+        );
+        Ok(report)
     }
 
-    /// Update activity timestamp for an instance.
-    /// Call this on real requests (NOT health checks) to prevent auto-stop.
-    pub async fn touch_activity(&self, process_name: &str, id: &str) {
-        let instance_id = InstanceId::new(process_name, id);
-        let mut instances = self.instances.write().await;
-        if let Some(instance) = instances.get_mut(&instance_id) {
-            instance.touch();
+    /// Kill an instance and release everything it holds (port, cgroup, socket, data dir)
+    async fn remove_instance(&self, instance_id: &InstanceId) -> Result<()> {
+        // Clear spawning guard if present (in case spawn failed and left it)
+        {
+            let mut spawning = self.spawning.write().await;
+            spawning.remove(instance_id);
         }
-    }
 
-    /// Set the traffic weight for an instance (0-100).
-    /// Weight 0 means the instance receives no traffic.
-    /// Weight 100 is the default and means full traffic.
-    /// Returns Err if the instance is not found.
-    pub async fn set_weight(&self, process_name: &str, id: &str, weight: u8) -> Result<()> {
-        let instance_id = InstanceId::new(process_name, id);
-        let mut instances = self.instances.write().await;
-        if let Some(instance) = instances.get_mut(&instance_id) {
-            instance.weight = weight.min(100); // Cap at 100
-            info!("Set weight for {} to {}", instance_id, instance.weight);
-            Ok(())
-        } else {
-            anyhow::bail!("Instance not found: {}", instance_id)
+        // Forget its persisted state first, without holding the instances lock
+        // across a call that may go over the network. While it's still
+        // registered, a respawn can't record itself in between and be forgotten.
+        if let Some(ref store) = self.state_store {
+            let registered = self.instances.read().await.contains_key(instance_id);
+            if registered {
+                if let Err(e) = store.remove(&instance_id.to_string()).await {
+                    error!("Failed to remove instance state for {}: {}", instance_id, e);
+                }
+            }
         }
-    }
 
-    /// List all running instances for a specific process.
-    /// Used for weighted load balancing across multiple instances.
-    pub async fn list_by_process(&self, process_name: &str) -> Vec<InstanceInfo> {
-        let instances = self.instances.read().await;
-        instances
-            .values()
-            .filter(|i| i.id.process == process_name)
-            .map(|i| i.info())
-            .collect()
-    }
+        let mut instances = self.instances.write().await;
 
-    /// Select an instance for a process using weighted random selection.
-    /// Returns None if no instances are available or all have weight 0.
-    pub async fn select_weighted(&self, process_name: &str) -> Option<InstanceInfo> {
-        use rand::Rng;
+        if let Some(mut instance) = instances.remove(instance_id) {
+            self.circuit_breakers.clear(instance_id);
+            self.unannounced.lock().unwrap().remove(instance_id);
+            info!(
+                app = %instance_id.process,
+                instance = %instance_id.id,
+                pid = instance.handle.pid(),
+                event = "stop",
+                "Stopping instance {}",
+                instance_id
+            );
 
-        let instances = self.instances.read().await;
-        let candidates: Vec<_> = instances
-            .values()
-            .filter(|i| i.id.process == process_name && i.weight > 0)
-            .collect();
+            instance
+                .handle
+                .kill()
+                .await
+                .with_context(|| format!("Failed to kill process: {}", instance_id))?;
 
-        if candidates.is_empty() {
-            return None;
-        }
+            // Release allocated port back to the pool
+            if let Some(port) = instance.port {
+                self.warm_pool.clear(port);
+                self.port_allocator.release(port).await;
+            }
 
-        // Calculate total weight
-        let total_weight: u32 = candidates.iter().map(|i| i.weight as u32).sum();
-        if total_weight == 0 {
-            return None;
-        }
+            // Clean up cgroup (if one was created)
+            if let Err(e) = self.cgroup_manager.remove_cgroup(&instance_id.to_string()) {
+                warn!("Failed to remove cgroup for {}: {}", instance_id, e);
+            }
+
+            // Clean up socket
+            if instance.socket.exists() {
+                std::fs::remove_file(&instance.socket).ok();
+            }
+
+            // Clean up data directory if storage_persist is false
+            if !instance.storage_persist && instance.data_dir.exists() {
+                if let Err(e) = std::fs::remove_dir_all(&instance.data_dir) {
+                    warn!(
+                        "Failed to remove data directory {:?} for {}: {}",
+                        instance.data_dir, instance_id, e
+                    );
+                } else {
+                    info!(
+                        "Removed data directory {:?} for {}",
+                        instance.data_dir, instance_id
+                    );
+                }
+            }
+
+            // Scratch space never outlives the instance
+            if let Some(tmp_dir) = &instance.tmp_dir {
+                if let Err(e) = std::fs::remove_dir_all(tmp_dir) {
+                    if e.kind() != std::io::ErrorKind::NotFound {
+                        warn!(
+                            "Failed to remove temp directory {:?} for {}: {}",
+                            tmp_dir, instance_id, e
+                        );
+                    }
+                }
+            }
 
-        // Pick a random point in the weight space
-        let mut rng = rand::thread_rng();
-        let point = rng.gen_range(0..total_weight);
+            // Update metrics
+            self.metrics.instances_up.dec();
+            drop(instances);
 
-        // Find the instance at that point
-        let mut cumulative = 0u32;
-        for instance in candidates {
-            cumulative += instance.weight as u32;
-            if point < cumulative {
-                return Some(instance.info());
+            // The process is gone; a no-op if the exit watcher already ran the hook
+            if let Some(hook) = &instance.post_stop {
+                self.post_stop
+                    .fire(hook, StopReason::Stopped, self.log_buffer.clone());
             }
-        }
 
-        // Fallback (shouldn't happen)
-        None
+            Ok(())
+        } else {
+            anyhow::bail!("Instance not found: {}", instance_id)
+        }
     }
 
-    /// Stop idle instances that have exceeded their idle_timeout.
-    /// Called periodically by the health monitor.
-    async fn reap_idle_instances(&self) {
-        let idle_instances: Vec<InstanceId> = {
-            let instances = self.instances.read().await;
-            instances
-                .values()
-                .filter(|i| i.is_idle())
-                .map(|i| i.id.clone())
-                .collect()
-        };
+    /// Restart an instance with exponential backoff
+    pub async fn restart(&self, process_name: &str, id: &str) -> Result<PathBuf> {
+        let instance_id = InstanceId::new(process_name, id);
 
-        for instance_id in idle_instances {
-            // Don't reap instances with active connections
-            let active = self
-                .active_connection_count(&instance_id.process, &instance_id.id)
-                .await;
-            if active > 0 {
-                info!(
-                    "Instance {} is idle but has {} active connection(s), skipping reap",
-                    instance_id, active
-                );
-                continue;
+        // Get restart count from persistent history (survives stop/spawn cycles)
+        let reset = Duration::from_secs(self.settings.backoff_reset_secs);
+        let restarts = {
+            let mut history = self.restart_history.write().await;
+            match history.get_mut(&instance_id) {
+                // Ran long enough since the last restart: start the backoff over
+                Some((count, times)) if times.last().is_some_and(|t| t.elapsed() >= reset) => {
+                    info!(
+                        "{} ran {:?} without restarting; resetting backoff",
+                        instance_id, reset
+                    );
+                    *count = 0;
+                    times.clear();
+                    0
+                }
+                Some((count, _)) => *count,
+                None => 0,
             }
+        };
 
-            let idle_secs = {
-                let instances = self.instances.read().await;
-                instances
-                    .get(&instance_id)
-                    .map(|i| i.last_activity.elapsed().as_secs())
-                    .unwrap_or(0)
-            };
+        // Stop if running
+        let _ = self.stop(process_name, id).await;
 
+        // Calculate and apply exponential backoff delay
+        let backoff_delay = jitter(self.calculate_backoff(restarts));
+        if backoff_delay > Duration::ZERO {
             info!(
-                "Stopping idle instance {} (idle: {}s)",
-                instance_id, idle_secs
+                app = process_name,
+                instance = id,
+                event = "backoff",
+                "Applying backoff delay of {:?} before restarting {} (restart #{})",
+                backoff_delay,
+                instance_id,
+                restarts + 1
             );
+            tokio::time::sleep(backoff_delay).await;
+        }
+
+        // Spawn again
+        let socket = self.spawn(process_name, id).await?;
 
-            if let Err(e) = self.stop(&instance_id.process, &instance_id.id).await {
-                error!("Failed to stop idle instance {}: {}", instance_id, e);
+        // Update persistent restart history, keeping enough to spot a crash loop
+        let window = Duration::from_secs(self.settings.restart_window).max(reset);
+        {
+            let mut history = self.restart_history.write().await;
+            let entry = history
+                .entry(instance_id.clone())
+                .or_insert((0, Vec::new()));
+            entry.0 = restarts + 1;
+            entry.1.push(Instant::now());
+            entry.1.retain(|t| t.elapsed() < window);
+        }
+        if let Some(ref store) = self.state_store {
+            if let Err(e) = store.set_restarts(&instance_id.to_string(), restarts + 1).await {
+                error!("Failed to persist restart count for {}: {}", instance_id, e);
             }
         }
-    }
-
-    /// Check storage quotas for all instances and update metrics.
-    /// Logs warnings at 80% and errors at 100% usage.
-    async fn check_storage_quotas(&self) {
-        let instance_data: Vec<(InstanceId, std::path::PathBuf, Option<u32>)> = {
-            let instances = self.instances.read().await;
-            instances
-                .values()
-                .map(|i| (i.id.clone(), i.data_dir.clone(), i.storage_quota_mb))
-                .collect()
-        };
 
-        for (instance_id, data_dir, quota_mb) in instance_data {
-            let used_bytes = match calculate_dir_size(data_dir.clone()).await {
-                Ok(bytes) => bytes,
-                Err(e) => {
-                    error!("Failed to calculate storage for {}: {}", instance_id, e);
-                    continue;
+        // Also update the instance's restart count for display
+        {
+            let mut instances = self.instances.write().await;
+            if let Some(instance) = instances.get_mut(&instance_id) {
+                instance.restarts = restarts + 1;
+                // Copy restart_times from persistent history
+                let history = self.restart_history.read().await;
+                if let Some((_, times)) = history.get(&instance_id) {
+                    instance.restart_times = times.clone();
                 }
-            };
-
-            // Update cached storage usage on the instance
-            {
-                let mut instances = self.instances.write().await;
-                if let Some(instance) = instances.get_mut(&instance_id) {
-                    instance.storage_used_bytes = used_bytes;
+                if instance.is_crash_looping() {
+                    warn!(
+                        app = process_name,
+                        instance = id,
+                        event = "crash-loop",
+                        "{} is crash-looping (restart #{})",
+                        instance_id,
+                        restarts + 1
+                    );
                 }
             }
+        }
 
-            // Update metrics
-            let mut labels = HashMap::new();
-            labels.insert("process".to_string(), instance_id.process.clone());
-            labels.insert("id".to_string(), instance_id.id.clone());
-            let gauge = self
-                .metrics
-                .instance_storage_bytes
-                .with_labels(&labels)
-                .await;
-            gauge.set(used_bytes);
+        // Update metrics
+        let mut labels = HashMap::new();
+        labels.insert("process".to_string(), process_name.to_string());
+        labels.insert("id".to_string(), id.to_string());
+        let counter = self.metrics.instance_restarts.with_labels(&labels).await;
+        counter.inc();
 
-            // Check quota
-            if let Some(quota_mb) = quota_mb {
-                let quota_bytes = (quota_mb as u64) * 1024 * 1024;
+        Ok(socket)
+    }
 
-                let quota_gauge = self
-                    .metrics
-                    .instance_storage_quota_bytes
-                    .with_labels(&labels)
-                    .await;
-                quota_gauge.set(quota_bytes);
+    /// Calculate exponential backoff delay based on restart count
+    /// Formula: base * 2^(restarts - 1), capped at max
+    fn calculate_backoff(&self, restarts: u32) -> Duration {
+        if restarts == 0 {
+            return Duration::ZERO;
+        }
 
-                if quota_bytes > 0 {
-                    let ratio = used_bytes as f64 / quota_bytes as f64;
-                    let ratio_gauge = self
-                        .metrics
-                        .instance_storage_usage_ratio
-                        .with_labels(&labels)
-                        .await;
-                    ratio_gauge.set((ratio * 10000.0) as u64);
+        let base_ms = self.settings.backoff_base_ms;
+        let max_ms = self.settings.backoff_max_ms;
 
-                    if ratio >= 1.0 {
-                        error!(
-                            "Instance {} storage quota exceeded: {:.1}MB / {:.1}MB ({:.0}%)",
-                            instance_id,
-                            used_bytes as f64 / 1024.0 / 1024.0,
-                            quota_mb as f64,
-                            ratio * 100.0
-                        );
-                    } else if ratio >= 0.8 {
-                        warn!(
-                            "Instance {} storage usage high: {:.1}MB / {:.1}MB ({:.0}%)",
-                            instance_id,
-                            used_bytes as f64 / 1024.0 / 1024.0,
-                            quota_mb as f64,
-                            ratio * 100.0
-                        );
-                    }
-                }
-            }
-        }
-    }
+        // Calculate delay: base * 2^(restarts - 1)
+        // Cap the shift amount to prevent overflow (max 63 bits for u64)
+        let shift = (restarts - 1).min(63);
+        let multiplier = 1u64.checked_shl(shift).unwrap_or(u64::MAX);
+        let delay_ms = base_ms.saturating_mul(multiplier).min(max_ms);
 
-    /// Recover orphaned instances from a previous crash.
-    /// Checks persisted state, kills any still-running orphans, and cleans up.
-    /// Called on startup before spawning configured instances.
-    pub async fn recover_orphans(&self) {
-        let store = match &self.state_store {
-            Some(s) => s,
-            None => return,
-        };
+        Duration::from_millis(delay_ms)
+    }
 
-        let states = match store.list().await {
-            Ok(s) => s,
-            Err(e) => {
-                error!("Failed to read instance state for recovery: {}", e);
-                return;
-            }
-        };
+    /// Check if an instance is running
+    pub async fn is_running(&self, process_name: &str, id: &str) -> bool {
+        let instance_id = InstanceId::new(process_name, id);
+        let instances = self.instances.read().await;
+        instances.contains_key(&instance_id)
+    }
 
-        if states.is_empty() {
-            return;
+    /// Spawn if not already running
+    pub async fn spawn_if_not_running(&self, process_name: &str, id: &str) -> Result<PathBuf> {
+        if self.is_running(process_name, id).await {
+            let config = self.config();
+            let process_config = config.get_service(process_name).context("Unknown process")?;
+            Ok(process_config.socket_path(process_name, id))
+        } else {
+            self.spawn(process_name, id).await
         }
+    }
 
-        info!(
-            "Found {} orphaned instance(s) from previous run",
-            states.len()
-        );
+    /// List all running instances
+    pub async fn list(&self) -> Vec<InstanceInfo> {
+        let instances = self.instances.read().await;
+        instances.values().map(|i| i.info()).collect()
+    }
 
-        for state in &states {
-            // Check if process is still alive
-            #[cfg(unix)]
-            let alive = unsafe { libc::kill(state.pid as i32, 0) } == 0;
-            #[cfg(not(unix))]
-            let alive = false;
+    /// Get info for a specific instance
+    pub async fn get(&self, process_name: &str, id: &str) -> Option<InstanceInfo> {
+        let instance_id = InstanceId::new(process_name, id);
+        let instances = self.instances.read().await;
+        instances.get(&instance_id).map(|i| i.info())
+    }
 
-            if alive {
-                info!(
-                    "Killing orphaned process {} (pid {})",
-                    state.instance_id, state.pid
-                );
-                #[cfg(unix)]
-                unsafe {
-                    libc::kill(state.pid as i32, libc::SIGKILL);
-                }
-            } else {
-                info!(
-                    "Orphaned process {} (pid {}) already exited",
-                    state.instance_id, state.pid
-                );
-            }
+    /// The environment an instance was started with, sensitive values masked
+    pub async fn env(
+        &self,
+        process_name: &str,
+        id: &str,
+    ) -> Option<std::collections::BTreeMap<String, String>> {
+        let instance_id = InstanceId::new(process_name, id);
+        let env = self.instances.read().await.get(&instance_id)?.env.clone();
+        let redactor = self
+            .config()
+            .get_service(process_name)
+            .map(|svc| svc.redactor())
+            .unwrap_or_default();
+        Some(redactor.redact_env(&env))
+    }
 
-            // Note: port allocator is in-memory and starts fresh on each run,
-            // so no port release needed during recovery.
+    /// The environment `id` of `process_name` would start with now, masked
+    /// like [`Hypervisor::env`]: its config, pinned release, env files and
+    /// secrets, and TENEMENT_* metadata. What's only settled at spawn (PORT,
+    /// TMPDIR, volume paths) is left out.
+    pub fn resolved_env(
+        &self,
+        process_name: &str,
+        id: &str,
+    ) -> Result<std::collections::BTreeMap<String, String>> {
+        let instance_id = InstanceId::new(process_name, id);
+        let mut process_config = self
+            .config()
+            .get_service(process_name)
+            .with_context(|| format!("Unknown process: {}", process_name))?
+            .clone();
+        let pin = self.release_pins.read().unwrap().get(&instance_id).cloned();
+        if let Some(pin) = &pin {
+            pin.apply(&mut process_config);
         }
-
-        // Clear all persisted state
-        if let Err(e) = store.clear_all().await {
-            error!("Failed to clear instance state after recovery: {}", e);
+        let data_dir = &self.settings.data_dir;
+        let file_env = env_files::load(&process_config.env_files)
+            .with_context(|| format!("Failed to load env files for {}", instance_id))?;
+        let mut env = process_config.env_interpolated(file_env, process_name, id, data_dir, None);
+        if !process_config.secrets.is_empty() {
+            let values = secrets::read_secrets(&process_config.secrets, data_dir)
+                .with_context(|| format!("Failed to load secrets for {}", instance_id))?;
+            env.extend(values);
         }
-
-        info!("Orphan recovery complete");
+        let socket = process_config.socket_path(process_name, id);
+        env.insert("SOCKET_PATH".to_string(), sockets::address(&socket));
+        let release = pin.and_then(|pin| pin.release);
+        env.extend(metadata_env(&instance_id, release, &socket));
+        Ok(process_config.redactor().redact_env(&env))
     }
 
-    /// Spawn all instances configured in [instances] section.
-    /// Called on server startup to auto-start configured instances.
-    /// Continues spawning even if some fail, logs errors for failures.
-    /// Returns the number of successfully spawned instances.
-    pub async fn spawn_configured_instances(&self) -> (usize, usize) {
-        let instances_to_spawn = self.config.get_instances_to_spawn();
-
-        if instances_to_spawn.is_empty() {
-            return (0, 0);
+    /// What `ten exec` needs to run a command inside an instance: its process,
+    /// the environment it was started with, its service's workdir and user
+    pub async fn exec_target(&self, process_name: &str, id: &str) -> Result<crate::exec::Target> {
+        let instance_id = InstanceId::new(process_name, id);
+        let (pid, runtime, env) = {
+            let instances = self.instances.read().await;
+            let instance = instances
+                .get(&instance_id)
+                .with_context(|| format!("Instance {} not found", instance_id))?;
+            (
+                instance.handle.pid(),
+                instance.runtime_type,
+                instance.env.clone(),
+            )
+        };
+        if !matches!(runtime, RuntimeType::Process | RuntimeType::Namespace) {
+            anyhow::bail!(
+                "{} runs under {} isolation; exec needs process or namespace isolation",
+                instance_id,
+                runtime
+            );
         }
+        let pid = pid.with_context(|| format!("{} has no process to join", instance_id))?;
+        let config = self.config();
+        let process_config = config
+            .get_service(process_name)
+            .with_context(|| format!("Unknown process: {}", process_name))?;
+        let run_as = users::resolve(
+            process_config.user.as_deref(),
+            process_config.group.as_deref(),
+        )
+        .with_context(|| format!("Cannot run as {}'s user", process_name))?;
+        Ok(crate::exec::Target {
+            pid,
+            env,
+            workdir: process_config.workdir.clone(),
+            run_as,
+        })
+    }
 
-        info!(
-            "Auto-spawning {} configured instance(s)",
-            instances_to_spawn.len()
-        );
+    /// Get storage information for a specific instance
+    pub async fn get_storage_info(&self, process_name: &str, id: &str) -> Option<StorageInfo> {
+        let instance_id = InstanceId::new(process_name, id);
+        let (data_dir, quota_mb) = {
+            let instances = self.instances.read().await;
+            instances
+                .get(&instance_id)
+                .map(|i| (i.data_dir.clone(), i.storage_quota_mb))?
+        };
 
-        let mut success_count = 0;
-        let mut fail_count = 0;
+        // Calculate current directory size
+        let used_bytes = calculate_dir_size(data_dir.clone()).await.unwrap_or(0);
 
-        for (service_name, instance_id) in instances_to_spawn {
-            info!("Auto-spawning {}:{}", service_name, instance_id);
+        // Convert quota from MB to bytes
+        let quota_bytes = quota_mb.map(|mb| (mb as u64) * 1024 * 1024);
 
-            match self.spawn(&service_name, &instance_id).await {
-                Ok(socket) => {
-                    info!(
-                        "Successfully spawned {}:{} at {:?}",
-                        service_name, instance_id, socket
-                    );
-                    success_count += 1;
-                }
-                Err(e) => {
-                    error!("Failed to spawn {}:{}: {}", service_name, instance_id, e);
-                    fail_count += 1;
-                }
-            }
-        }
+        Some(StorageInfo::new(used_bytes, quota_bytes, data_dir))
+    }
 
-        if fail_count > 0 {
-            warn!(
-                "Auto-spawn complete: {} succeeded, {} failed",
-                success_count, fail_count
-            );
+    /// Get instance info and touch activity atomically.
+    /// This prevents race conditions where an instance could be reaped
+    /// between checking if it's running and touching its activity.
+    pub async fn get_and_touch(&self, process_name: &str, id: &str) -> Option<InstanceInfo> {
+        let instance_id = InstanceId::new(process_name, id);
+        let mut instances = self.instances.write().await;
+        if let Some(instance) = instances.get_mut(&instance_id) {
+            instance.touch();
+            Some(instance.info())
         } else {
-            info!("Auto-spawn complete: {} instance(s) started", success_count);
+            None
         }
+    }
 
-        (success_count, fail_count)
+    /// Replica IDs instance `id` of `process_name` runs as (see `ProcessConfig::replica_ids`)
+    fn replica_ids(&self, process_name: &str, id: &str) -> Vec<String> {
+        self.config()
+            .get_service(process_name)
+            .map(|config| config.replica_ids(id))
+            .unwrap_or_default()
     }
 
-    /// Spawn instance if not running, and wait for it to be ready.
-    /// Returns the socket path. Use this for wake-on-request.
-    /// Uses the process's configured startup_timeout (default: 10s).
-    pub async fn spawn_and_wait(&self, process_name: &str, id: &str) -> Result<PathBuf> {
-        let instance_id = InstanceId::new(process_name, id);
+    /// Check if a process is configured (can be spawned)
+    pub fn has_process(&self, process_name: &str) -> bool {
+        self.config().get_service(process_name).is_some()
+    }
 
-        // Wake-once pattern: if another request is already waking this instance,
-        // wait for it to finish instead of spawning a duplicate.
-        // Wake-once: if another request is already waking this instance, wait for it.
-        let maybe_notify = {
-            let waking = self.waking.read().await;
-            waking.get(&instance_id).cloned()
+    /// Increment active connection count for an instance. Returns a guard
+    /// that decrements the count when dropped.
+    pub async fn connection_start(&self, process_name: &str, id: &str) -> ConnectionGuard {
+        let instance_id = InstanceId::new(process_name, id);
+        let counter = {
+            let mut conns = self.active_connections.write().await;
+            conns
+                .entry(instance_id)
+                .or_insert_with(|| Arc::new(std::sync::atomic::AtomicU32::new(0)))
+                .clone()
         };
-        if let Some(notify) = maybe_notify {
-            // Register for notification BEFORE checking if spawn is done.
-            // This avoids missing the signal if it fires between our check and await.
-            let notified = notify.notified();
-            info!("Instance {} is already being woken, waiting", instance_id);
-            // Check if instance became available while we were setting up
-            if self.is_running(process_name, id).await {
-                self.touch_activity(process_name, id).await;
-                let info = self
-                    .get(process_name, id)
-                    .await
-                    .ok_or_else(|| anyhow::anyhow!("Instance {} disappeared", instance_id))?;
-                return Ok(info.socket);
-            }
-            notified.await;
-            if let Some(info) = self.get(process_name, id).await {
-                self.touch_activity(process_name, id).await;
-                return Ok(info.socket);
-            }
-            anyhow::bail!("Instance {} failed to wake", instance_id);
-        }
+        counter.fetch_add(1, std::sync::atomic::Ordering::Relaxed);
+        ConnectionGuard { counter }
+    }
 
-        // We're the first to wake this instance. Register a Notify.
-        let notify = Arc::new(tokio::sync::Notify::new());
-        {
-            let mut waking = self.waking.write().await;
-            waking.insert(instance_id.clone(), notify.clone());
-        }
+    /// Get active connection count for an instance
+    pub async fn active_connection_count(&self, process_name: &str, id: &str) -> u32 {
+        let instance_id = InstanceId::new(process_name, id);
+        let conns = self.active_connections.read().await;
+        conns
+            .get(&instance_id)
+            .map(|c| c.load(std::sync::atomic::Ordering::Relaxed))
+            .unwrap_or(0)
+    }
 
-        // Get the startup timeout from process config
-        let timeout_secs = self
-            .config
-            .get_service(process_name)
-            .map(|p| p.startup_timeout)
-            .unwrap_or(10);
+    /// Connections currently being proxied, across all instances
+    pub async fn total_active_connections(&self) -> u32 {
+        let conns = self.active_connections.read().await;
+        conns
+            .values()
+            .map(|c| c.load(std::sync::atomic::Ordering::Relaxed))
+            .sum()
+    }
 
-        // spawn_if_not_running already waits for TCP/socket readiness via spawn()
-        let socket = self.spawn_if_not_running(process_name, id).await?;
+    /// Uptime, active connections, and memory/CPU of every running instance
+    pub async fn instance_samples(&self) -> Vec<InstanceSample> {
+        let instances = self.instances.read().await;
+        let conns = self.active_connections.read().await;
+        let mut samples: Vec<InstanceSample> = instances
+            .values()
+            .map(|instance| {
+                let usage = instance.handle.pid().and_then(crate::metrics::process_usage);
+                let sampled = instance.usage.map(|(_, usage)| usage);
+                InstanceSample {
+                    process: instance.id.process.clone(),
+                    instance: instance.id.to_string(),
+                    uptime_secs: instance.started_at.elapsed().as_secs(),
+                    active_connections: conns
+                        .get(&instance.id)
+                        .map(|c| c.load(std::sync::atomic::Ordering::Relaxed))
+                        .unwrap_or(0),
+                    memory_bytes: usage.map(|u| u.rss_bytes),
+                    cpu_seconds: usage.map(|u| u.cpu_seconds),
+                    cpu_percent: sampled.and_then(|u| u.cpu_percent),
+                    threads: usage.map(|u| u.threads),
+                    open_fds: usage.and_then(|u| u.open_fds),
+                }
+            })
+            .collect();
+        samples.sort_by(|a, b| a.instance.cmp(&b.instance));
+        samples
+    }
 
-        // Get port info to determine readiness check method
-        let port = self.get(process_name, id).await.and_then(|info| info.port);
+    /// Get the request timeout for a process (in seconds)
+    pub fn request_timeout(&self, process_name: &str) -> Duration {
+        let secs = self
+            .config()
+            .get_service(process_name)
+            .map(|p| p.request_timeout)
+            .unwrap_or(30);
+        Duration::from_secs(secs)
+    }
 
-        // Wait for service to be ready (check every 100ms)
-        // Try TCP first if port is available, fall back to socket existence
-        let iterations = (timeout_secs * 10) as usize;
-        let mut ready = false;
-        for _ in 0..iterations {
-            let is_ready = if let Some(port) = port {
-                // TCP mode: try to connect
-                if tokio::net::TcpStream::connect(format!("127.0.0.1:{}", port))
-                    .await
-                    .is_ok()
-                {
-                    true
-                } else {
-                    // Fall back to socket existence check (test stubs may not listen on TCP)
-                    socket.exists()
-                }
-            } else {
-                socket.exists()
-            };
+    /// Keep-alive settings for the proxy's connections to a service's sockets
+    pub fn connection_pool(&self, process_name: &str) -> ConnectionPoolConfig {
+        self.config()
+            .get_service(process_name)
+            .map(|p| p.connection_pool.clone())
+            .unwrap_or_default()
+    }
 
-            if is_ready {
-                self.touch_activity(process_name, id).await;
-                ready = true;
-                break;
-            }
-            tokio::time::sleep(Duration::from_millis(100)).await;
-        }
+    /// How long a process's WebSocket or SSE connections may sit idle (None: no limit)
+    pub fn stream_idle_timeout(&self, process_name: &str) -> Option<Duration> {
+        self.config()
+            .get_service(process_name)
+            .and_then(|p| p.stream_idle_timeout)
+            .map(Duration::from_secs)
+    }
 
-        // Notify all waiters and remove the Notify
-        notify.notify_waiters();
-        {
-            let mut waking = self.waking.write().await;
-            waking.remove(&instance_id);
-        }
+    /// The per-client request limiter for a process (None: unlimited)
+    pub fn rate_limiter(&self, process_name: &str) -> Option<Arc<RequestRateLimiter>> {
+        self.rate_limiters
+            .read()
+            .unwrap()
+            .get(process_name)
+            .cloned()
+    }
 
-        if ready {
-            Ok(socket)
-        } else {
-            anyhow::bail!(
-                "Instance {} failed to start within {} seconds",
-                instance_id,
-                timeout_secs
-            )
-        }
+    /// The response cache for a process (None: responses aren't cached)
+    pub fn response_cache(&self, process_name: &str) -> Option<Arc<ResponseCache>> {
+        self.response_caches
+            .read()
+            .unwrap()
+            .get(process_name)
+            .cloned()
     }
 
-    /// Deploy a new instance version and wait for it to be healthy.
-    /// Used for blue/green and canary deployments.
-    ///
-    /// - Spawns the instance with the given version as the instance ID
-    /// - Sets the initial weight (default 100)
-    /// - Waits for health check to pass (timeout ~30s)
-    /// - Returns error if health check fails within timeout
-    pub async fn deploy_and_wait_healthy(
-        &self,
-        process_name: &str,
-        version: &str,
-        initial_weight: u8,
-        timeout_secs: u64,
-    ) -> Result<PathBuf> {
-        let instance_id = InstanceId::new(process_name, version);
+    /// Who may reach a process through the proxy (None: anyone)
+    pub fn access(&self, process_name: &str) -> Option<AccessConfig> {
+        self.config()
+            .get_service(process_name)
+            .and_then(|p| p.access.clone())
+    }
 
-        // Spawn the instance
-        let socket = self.spawn(process_name, version).await?;
+    /// The credentials in an `access.basic_auth` file
+    pub fn htpasswd(&self, path: &Path) -> Arc<Htpasswd> {
+        self.htpasswd_files
+            .lock()
+            .unwrap()
+            .entry(path.to_path_buf())
+            .or_insert_with(|| Arc::new(Htpasswd::new(path)))
+            .clone()
+    }
 
-        // Set initial weight
-        self.set_weight(process_name, version, initial_weight)
-            .await?;
+    /// The span tracer, when `[settings.tracing]` is set
+    pub fn tracer(&self) -> Option<&Arc<Tracer>> {
+        self.tracer.as_ref()
+    }
 
-        // Wait for health check to pass
-        let check_interval = Duration::from_millis(500);
-        let timeout = Duration::from_secs(timeout_secs);
-        let start = Instant::now();
+    /// This node's cluster, when `[settings.cluster]` is set
+    pub fn cluster(&self) -> Option<&Cluster> {
+        self.cluster.as_ref()
+    }
 
-        while start.elapsed() < timeout {
-            let status = self.check_health(process_name, version).await;
-            match status {
-                HealthStatus::Healthy => {
-                    info!("Instance {} is healthy", instance_id);
-                    return Ok(socket);
-                }
-                HealthStatus::Failed => {
-                    anyhow::bail!("Instance {} health check failed permanently", instance_id);
-                }
-                _ => {
-                    // Unknown, Degraded, or Unhealthy - keep waiting
-                    tokio::time::sleep(check_interval).await;
-                }
+    /// Where a process's proxied requests are logged (None: not logged)
+    pub fn access_log(&self, process_name: &str) -> Option<Arc<AccessLog>> {
+        let logs = self.access_logs.read().unwrap();
+        logs.get(process_name).or_else(|| logs.get("")).cloned()
+    }
+
+    /// The release an instance runs: the app version its deploy pinned, or
+    /// the service's own APP_VERSION
+    pub fn release(&self, process_name: &str, id: &str) -> Option<String> {
+        let instance_id = InstanceId::new(process_name, id);
+        if let Some(pin) = self.release_pins.read().unwrap().get(&instance_id) {
+            if pin.app_version.is_some() {
+                return pin.app_version.clone();
             }
         }
-
-        // Timeout reached - stop the unhealthy instance and return error
-        let _ = self.stop(process_name, version).await;
-        anyhow::bail!(
-            "Instance {} did not become healthy within {} seconds",
-            instance_id,
-            timeout_secs
-        )
+        self.config()
+            .get_service(process_name)
+            .and_then(|p| p.env.get("APP_VERSION").cloned())
     }
 
-    /// Atomically swap traffic weights between two versions.
-    /// Sets `from_version` weight to 0 and `to_version` weight to 100.
-    /// Used for blue/green instant cutover.
-    ///
-    /// Returns error if either version is not running.
-    pub async fn route_swap(
-        &self,
-        process_name: &str,
-        from_version: &str,
-        to_version: &str,
-    ) -> Result<()> {
-        let from_id = InstanceId::new(process_name, from_version);
-        let to_id = InstanceId::new(process_name, to_version);
+    /// Retries allowed for a failed request to a process, and the budget they
+    /// come out of (None: no retries)
+    pub fn retry_policy(&self, process_name: &str) -> Option<(u32, Arc<RetryBudget>)> {
+        let attempts = self.config().get_service(process_name)?.retry?.attempts;
+        let budget = self
+            .retry_budgets
+            .read()
+            .unwrap()
+            .get(process_name)
+            .cloned()?;
+        Some((attempts, budget))
+    }
 
-        // Acquire write lock and update both weights atomically
-        let mut instances = self.instances.write().await;
+    /// Whether an instance's circuit breaker has it out of rotation
+    pub fn is_ejected(&self, process_name: &str, id: &str) -> bool {
+        let instance_id = InstanceId::new(process_name, id);
+        self.circuit_breakers.is_open(&instance_id, Instant::now())
+    }
 
-        // Verify both instances exist
-        if !instances.contains_key(&from_id) {
-            anyhow::bail!("Instance {} not found", from_id);
-        }
-        if !instances.contains_key(&to_id) {
-            anyhow::bail!("Instance {} not found", to_id);
-        }
+    /// Count a proxied request's outcome against the instance's circuit breaker
+    /// (a no-op unless the service sets `circuit_breaker`). Opening and closing
+    /// are logged, written to the instance's log stream, and counted in
+    /// `circuit_breaker_transitions_total`.
+    pub async fn record_upstream_result(&self, process_name: &str, id: &str, success: bool) {
+        let config = self.config();
+        let Some(breaker) = config
+            .get_service(process_name)
+            .and_then(|p| p.circuit_breaker)
+        else {
+            return;
+        };
+        let instance_id = InstanceId::new(process_name, id);
+        let event = self
+            .circuit_breakers
+            .record(&instance_id, success, &breaker, Instant::now());
+        let Some(event) = event else {
+            return;
+        };
 
-        // Atomically update weights
-        if let Some(from_instance) = instances.get_mut(&from_id) {
-            from_instance.weight = 0;
-        }
-        if let Some(to_instance) = instances.get_mut(&to_id) {
-            to_instance.weight = 100;
-        }
+        let message = match event {
+            BreakerEvent::Opened => {
+                warn!(
+                    app = %process_name,
+                    instance = %id,
+                    event = "circuit_open",
+                    "Circuit breaker opened for {}: ejected for {}s",
+                    instance_id,
+                    breaker.cooldown
+                );
+                format!(
+                    "[tenement] circuit breaker opened after {} consecutive failures; \
+                     out of rotation for {}s",
+                    breaker.failures, breaker.cooldown
+                )
+            }
+            BreakerEvent::Closed => {
+                info!(
+                    app = %process_name,
+                    instance = %id,
+                    event = "circuit_closed",
+                    "Circuit breaker closed for {}",
+                    instance_id
+                );
+                "[tenement] circuit breaker closed; back in rotation".to_string()
+            }
+        };
+        self.log_buffer.push_stderr(process_name, id, message).await;
 
-        info!(
-            "Traffic swap complete: {} weight=0, {} weight=100",
-            from_id, to_id
-        );
+        let mut labels = HashMap::new();
+        labels.insert("process".to_string(), process_name.to_string());
+        labels.insert("instance".to_string(), id.to_string());
+        labels.insert("state".to_string(), event.as_str().to_string());
+        self.metrics
+            .circuit_breaker_transitions_total
+            .with_labels(&labels)
+            .await
+            .inc();
+    }
 
-        Ok(())
+    /// What the proxy speaks to a process's instances
+    pub fn backend_protocol(&self, process_name: &str) -> BackendProtocol {
+        self.config()
+            .get_service(process_name)
+            .map(|p| p.protocol)
+            .unwrap_or_default()
     }
-}
 
-#[cfg(test)]
-mod tests {
-    use super::*;
-    use crate::config::ProcessConfig;
-    use std::collections::HashMap;
-    use std::path::Path;
-    use tempfile::TempDir;
+    /// Check health of an instance
+    pub async fn check_health(&self, process_name: &str, id: &str) -> HealthStatus {
+        let instance_id = InstanceId::new(process_name, id);
 
-    // Helper to create a test config with a simple echo server process
-    fn test_config_with_process(name: &str, command: &str, args: Vec<&str>) -> Config {
-        let test_id = format!("{}-{}", std::process::id(), rand::random::<u32>());
-        let mut config = Config::default();
-        config.settings.data_dir = std::env::temp_dir().join(format!("tenement-test-{}", test_id));
+        let config = self.config();
+        let process_config = match config.get_service(process_name) {
+            Some(c) => c,
+            None => return HealthStatus::Unknown,
+        };
 
-        let process = ProcessConfig {
-            command: command.to_string(),
-            args: args.into_iter().map(|s| s.to_string()).collect(),
-            socket: format!("/tmp/tenement-test-{}/{{name}}-{{id}}.sock", test_id),
-            isolation: RuntimeType::Process,
-            health: None,
-            env: HashMap::new(),
-            workdir: None,
-            mounts: Vec::new(),
-            image: None,
-            restart: "on-failure".to_string(),
-            idle_timeout: None,
-            startup_timeout: 5,
-            request_timeout: 30,
-            memory_limit_mb: None,
-            cpu_shares: None,
-            kernel: None,
-            rootfs: None,
-            memory_mb: 256,
-            vcpus: 1,
-            vsock_port: 5000,
-            storage_quota_mb: None,
-            storage_persist: false,
+        let check = &process_config.health_check;
+        let probe = match (check.check_type, &process_config.health, &check.command) {
+            (HealthCheckType::Tcp, _, _) => HealthProbe::Tcp,
+            (HealthCheckType::Exec, _, Some(command)) => HealthProbe::Exec(command),
+            (HealthCheckType::Http, Some(endpoint), _) => HealthProbe::Http(endpoint),
+            // If no health endpoint configured, assume healthy if socket exists
+            _ => {
+                let socket = process_config.socket_path(process_name, id);
+                return if socket_ready(&socket).await {
+                    // Slow starters that missed the spawn readiness window report here
+                    self.record_startup(&instance_id).await;
+                    HealthStatus::Healthy
+                } else {
+                    HealthStatus::Unhealthy
+                };
+            }
         };
 
-        config.service.insert(name.to_string(), process);
-        config
+        // Claim the probe and get socket, vsock port, and TCP port from the running
+        // instance. Only one probe per instance is in flight: overlapping callers (a
+        // monitor tick racing an API check) get the last status instead of probing
+        // again, so one backend state change never counts twice toward a threshold.
+        let (target, _claim) = {
+            let instances = self.instances.read().await;
+            let Some(instance) = instances.get(&instance_id) else {
+                return HealthStatus::Unknown;
+            };
+            match instance.probe_in_flight.claim() {
+                Some(claim) => (ProbeTarget::of(instance), claim),
+                None => return instance.health_status,
+            }
+        };
+
+        let timeout = Duration::from_millis(check.timeout_ms);
+        let result = self
+            .run_probe("health_check", &instance_id, probe, &target, timeout)
+            .await;
+
+        let mut instances = self.instances.write().await;
+        let instance = match instances.get_mut(&instance_id) {
+            // A probe that outlived a restart says nothing about the new process
+            Some(i) if i.started_at == target.started_at => i,
+            _ => return HealthStatus::Unknown,
+        };
+
+        instance.last_health_check = Some(Instant::now());
+        let previous = instance.health_status;
+
+        let thresholds = &process_config.health_check;
+        match result {
+            Ok(()) => {
+                instance.health_passed = true;
+                // After a failure, stay degraded until enough checks pass in a row
+                if instance.consecutive_failures > 0 {
+                    instance.consecutive_successes += 1;
+                    if instance.consecutive_successes < thresholds.recovery_threshold {
+                        instance.health_status = HealthStatus::Degraded;
+                        self.notify_health(&instance_id, previous, HealthStatus::Degraded);
+                        return HealthStatus::Degraded;
+                    }
+                }
+                instance.consecutive_failures = 0;
+                instance.consecutive_successes = 0;
+                instance.health_status = HealthStatus::Healthy;
+                self.notify_health(&instance_id, previous, HealthStatus::Healthy);
+                let first_ready = instance.startup_duration.is_none();
+                drop(instances);
+                if first_ready {
+                    self.record_startup(&instance_id).await;
+                }
+                HealthStatus::Healthy
+            }
+            Err(e) => {
+                instance.consecutive_failures += 1;
+                instance.consecutive_successes = 0;
+                warn!(
+                    "Health check failed for {}: {} (failures: {})",
+                    instance_id, e, instance.consecutive_failures
+                );
+
+                let allowed = thresholds.failures_allowed(instance.health_passed);
+                let status = match instance.consecutive_failures {
+                    n if n < allowed => HealthStatus::Degraded,
+                    _ => {
+                        let window = Duration::from_secs(self.settings.restart_window);
+                        let recent_restarts = instance
+                            .restart_times
+                            .iter()
+                            .filter(|t| t.elapsed() < window)
+                            .count() as u32;
+
+                        if recent_restarts >= self.settings.max_restarts {
+                            HealthStatus::Failed
+                        } else {
+                            HealthStatus::Unhealthy
+                        }
+                    }
+                };
+                instance.health_status = status;
+                self.notify_health(&instance_id, previous, status);
+                status
+            }
+        }
+    }
+
+    /// Run one health or readiness probe against an instance. Each probe is a
+    /// trace of its own, named after `check` ("health_check" or "readiness").
+    async fn run_probe(
+        &self,
+        check: &str,
+        instance_id: &InstanceId,
+        probe: HealthProbe<'_>,
+        target: &ProbeTarget,
+        timeout: Duration,
+    ) -> Result<()> {
+        let span = self.tracer.as_ref().map(|tracer| {
+            let mut span = tracer.start(check, SpanKind::Internal, None);
+            span.set("tenement.app", instance_id.process.as_str());
+            span.set("tenement.instance", instance_id.id.as_str());
+            span.set(&format!("tenement.{}.type", check), probe.name());
+            span
+        });
+        let (socket, tcp_port) = (&target.socket, target.port);
+        let result = match probe {
+            // Use TCP health check for process/namespace/sandbox runtimes,
+            // fall back to Unix socket for VMs
+            HealthProbe::Http(endpoint) => match tcp_port {
+                Some(port) => self.ping_health_tcp(port, endpoint, timeout).await,
+                None => {
+                    self.ping_health_with_vsock(socket, endpoint, target.vsock_port, timeout)
+                        .await
+                }
+            },
+            HealthProbe::Tcp => probe_connect(tcp_port, socket, timeout).await,
+            HealthProbe::Exec(command) => {
+                run_health_command(command, instance_id, tcp_port, socket, timeout).await
+            }
+        };
+        if let Some(span) = span {
+            span.end(&result);
+        }
+        result
+    }
+
+    /// Run an instance's readiness probe. Once `failure_threshold` checks in a
+    /// row fail it's taken out of rotation, and once `success_threshold` pass
+    /// it's put back; the process itself is left alone either way. Returns
+    /// whether it's ready (always true for services without a readiness probe).
+    pub async fn check_readiness(&self, process_name: &str, id: &str) -> bool {
+        let instance_id = InstanceId::new(process_name, id);
+
+        let config = self.config();
+        let Some(process_config) = config.get_service(process_name) else {
+            return true;
+        };
+        let Some(readiness) = &process_config.readiness else {
+            return true;
+        };
+        let path = readiness.path.as_ref().or(process_config.health.as_ref());
+        let probe = match (readiness.check_type, path, &readiness.command) {
+            (HealthCheckType::Tcp, _, _) => HealthProbe::Tcp,
+            (HealthCheckType::Exec, _, Some(command)) => HealthProbe::Exec(command),
+            (HealthCheckType::Http, Some(path), _) => HealthProbe::Http(path),
+            _ => return true,
+        };
+
+        // One probe per instance at a time, as for health checks
+        let (target, _claim) = {
+            let instances = self.instances.read().await;
+            let Some(instance) = instances.get(&instance_id) else {
+                return false;
+            };
+            match instance.readiness.probe_in_flight.claim() {
+                Some(claim) => (ProbeTarget::of(instance), claim),
+                None => return instance.readiness.ready,
+            }
+        };
+
+        let timeout = Duration::from_millis(readiness.timeout_ms);
+        let result = self
+            .run_probe("readiness", &instance_id, probe, &target, timeout)
+            .await;
+
+        let mut instances = self.instances.write().await;
+        let state = match instances.get_mut(&instance_id) {
+            Some(i) if i.started_at == target.started_at => &mut i.readiness,
+            _ => return false,
+        };
+        state.last_check = Some(Instant::now());
+        let was_ready = state.ready;
+        match result {
+            Ok(()) => {
+                state.consecutive_failures = 0;
+                state.consecutive_successes += 1;
+                if state.consecutive_successes >= readiness.success_threshold {
+                    state.ready = true;
+                }
+            }
+            Err(e) => {
+                state.consecutive_successes = 0;
+                state.consecutive_failures += 1;
+                debug!(
+                    "Readiness check failed for {}: {} (failures: {})",
+                    instance_id, e, state.consecutive_failures
+                );
+                if state.consecutive_failures >= readiness.failure_threshold {
+                    state.ready = false;
+                }
+            }
+        }
+        let ready = state.ready;
+        if ready != was_ready {
+            let change = match ready {
+                true => "ready for traffic",
+                false => "not ready, out of rotation",
+            };
+            info!(
+                app = process_name,
+                instance = id,
+                event = "readiness",
+                ready,
+                "Instance {} is {}",
+                instance_id,
+                change
+            );
+        }
+        ready
+    }
+
+    /// Ping a health endpoint via TCP (for process/namespace/sandbox runtimes)
+    async fn ping_health_tcp(&self, port: u16, endpoint: &str, timeout: Duration) -> Result<()> {
+        use tokio::io::{AsyncReadExt, AsyncWriteExt};
+        use tokio::net::TcpStream;
+
+        let addr = format!("127.0.0.1:{}", port);
+        let mut stream = tokio::time::timeout(timeout, TcpStream::connect(&addr))
+            .await
+            .context("TCP connection timeout")?
+            .context("Failed to connect")?;
+
+        let request = format!(
+            "GET {} HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+            endpoint
+        );
+        stream
+            .write_all(request.as_bytes())
+            .await
+            .context("Failed to write request")?;
+
+        let mut response = vec![0u8; 1024];
+        let n = tokio::time::timeout(timeout, stream.read(&mut response))
+            .await
+            .context("Read timeout")?
+            .context("Failed to read response")?;
+
+        let response_str = String::from_utf8_lossy(&response[..n]);
+        if response_str.contains("200") {
+            Ok(())
+        } else {
+            anyhow::bail!("Unhealthy response")
+        }
+    }
+
+    /// Ping a health endpoint, optionally using vsock CONNECT protocol
+    ///
+    /// For Firecracker VMs, the vsock socket requires the CONNECT protocol:
+    /// 1. Connect to the Unix socket (exposed by Firecracker)
+    /// 2. Send "CONNECT <port>\n"
+    /// 3. Wait for "OK <port>\n" response
+    /// 4. Socket is now connected to guest app
+    async fn ping_health_with_vsock(
+        &self,
+        socket_path: &PathBuf,
+        endpoint: &str,
+        vsock_port: Option<u32>,
+        timeout: Duration,
+    ) -> Result<()> {
+        use tokio::io::{AsyncBufReadExt, AsyncReadExt, AsyncWriteExt, BufReader};
+
+        let stream = tokio::time::timeout(timeout, sockets::connect(socket_path))
+            .await
+            .context("Connection timeout")?
+            .context("Failed to connect")?;
+
+        let (reader, mut writer) = tokio::io::split(stream);
+        let mut reader = BufReader::new(reader);
+
+        // If vsock port is specified, perform CONNECT handshake
+        if let Some(port) = vsock_port {
+            // Send CONNECT request
+            let connect_cmd = format!("CONNECT {}\n", port);
+            writer
+                .write_all(connect_cmd.as_bytes())
+                .await
+                .context("Failed to send CONNECT")?;
+
+            // Read response line
+            let mut response_line = String::new();
+            tokio::time::timeout(timeout, reader.read_line(&mut response_line))
+                .await
+                .context("CONNECT response timeout")?
+                .context("Failed to read CONNECT response")?;
+
+            // Expect "OK <port>\n"
+            let expected = format!("OK {}", port);
+            if !response_line.starts_with(&expected) {
+                anyhow::bail!(
+                    "VSOCK CONNECT failed: expected '{}', got '{}'",
+                    expected,
+                    response_line.trim()
+                );
+            }
+        }
+
+        // Now send HTTP health check request
+        let request = format!(
+            "GET {} HTTP/1.1\r\nHost: localhost\r\nConnection: close\r\n\r\n",
+            endpoint
+        );
+        writer
+            .write_all(request.as_bytes())
+            .await
+            .context("Failed to write request")?;
+
+        let mut response = vec![0u8; 1024];
+        let n = tokio::time::timeout(timeout, reader.read(&mut response))
+            .await
+            .context("Read timeout")?
+            .context("Failed to read response")?;
+
+        let response_str = String::from_utf8_lossy(&response[..n]);
+        if response_str.contains("200 OK") {
+            Ok(())
+        } else {
+            anyhow::bail!("Unhealthy response")
+        }
+    }
+
+    /// Run health checks on all instances and handle unhealthy ones
+    pub async fn run_health_checks(self: &Arc<Self>) {
+        let instance_ids: Vec<InstanceId> = {
+            let instances = self.instances.read().await;
+            instances.keys().cloned().collect()
+        };
+        self.check_and_handle(instance_ids).await;
+    }
+
+    /// Run health checks only on instances whose service interval has elapsed
+    async fn run_due_health_checks(self: &Arc<Self>) {
+        let tick = self.monitor_interval();
+        let config = self.config();
+        let instance_ids: Vec<InstanceId> = {
+            let instances = self.instances.read().await;
+            instances
+                .iter()
+                .filter(|(id, instance)| {
+                    let service = config.get_service(&id.process);
+                    // Give slow starters their initial delay to boot before probing
+                    if !boot_delay_left(service, instance.started_at).is_zero() {
+                        return false;
+                    }
+                    let Some(last) = instance.last_health_check else {
+                        return true;
+                    };
+                    let interval = service
+                        .map(|svc| svc.health_interval(&self.settings))
+                        .unwrap_or(tick);
+                    // Half a tick of slack so an interval equal to the tick never skips a round
+                    last.elapsed() + tick / 2 >= interval
+                })
+                .map(|(id, _)| id.clone())
+                .collect()
+        };
+        self.check_and_handle(instance_ids).await;
+    }
+
+    /// Run readiness checks on instances whose readiness interval has elapsed
+    async fn run_due_readiness_checks(&self) {
+        let tick = self.monitor_interval();
+        let config = self.config();
+        let instance_ids: Vec<InstanceId> = {
+            let instances = self.instances.read().await;
+            instances
+                .iter()
+                .filter(|(id, instance)| {
+                    let Some(service) = config.get_service(&id.process) else {
+                        return false;
+                    };
+                    if service.readiness.is_none() {
+                        return false;
+                    }
+                    if !boot_delay_left(Some(service), instance.started_at).is_zero() {
+                        return false;
+                    }
+                    let Some(last) = instance.readiness.last_check else {
+                        return true;
+                    };
+                    last.elapsed() + tick / 2 >= service.readiness_interval(&self.settings)
+                })
+                .map(|(id, _)| id.clone())
+                .collect()
+        };
+        for instance_id in instance_ids {
+            self.check_readiness(&instance_id.process, &instance_id.id)
+                .await;
+        }
+    }
+
+    /// Health-check the given instances, restarting unhealthy ones
+    async fn check_and_handle(self: &Arc<Self>, instance_ids: Vec<InstanceId>) {
+        for instance_id in instance_ids {
+            if self.monitor_restarts.lock().unwrap().contains(&instance_id) {
+                continue;
+            }
+            let status = self
+                .check_health(&instance_id.process, &instance_id.id)
+                .await;
+
+            match status {
+                HealthStatus::Unhealthy => {
+                    info!(
+                        app = %instance_id.process,
+                        instance = %instance_id.id,
+                        event = "unhealthy",
+                        "Instance {} is unhealthy, restarting",
+                        instance_id
+                    );
+                    self.restart_in_background(instance_id);
+                }
+                HealthStatus::Failed => {
+                    error!(
+                        app = %instance_id.process,
+                        instance = %instance_id.id,
+                        event = "failed",
+                        "Instance {} has failed (too many restarts)",
+                        instance_id
+                    );
+                }
+                _ => {}
+            }
+        }
+    }
+
+    /// Restart `instance_id` in a task of its own, so its backoff and
+    /// `pre_start` hook don't hold up the monitor's other checks. Does nothing
+    /// while a restart the monitor started for it is still going.
+    fn restart_in_background(self: &Arc<Self>, instance_id: InstanceId) {
+        let mut restarting = self.monitor_restarts.lock().unwrap();
+        if !restarting.insert(instance_id.clone()) {
+            return;
+        }
+        drop(restarting);
+        let hypervisor = self.clone();
+        tokio::spawn(async move {
+            let (process_name, id) = (&instance_id.process, &instance_id.id);
+            if let Err(e) = hypervisor.restart(process_name, id).await {
+                error!("Failed to restart {}: {}", instance_id, e);
+            }
+            let mut restarting = hypervisor.monitor_restarts.lock().unwrap();
+            restarting.remove(&instance_id);
+        });
+    }
+
+    /// Monitor tick: the shortest health or readiness interval across settings
+    /// and services
+    fn monitor_interval(&self) -> Duration {
+        self.config()
+            .service
+            .values()
+            .flat_map(|svc| {
+                let health = svc.health_interval(&self.settings);
+                let readiness = svc.readiness_interval(&self.settings);
+                std::iter::once(health).chain(svc.readiness.is_some().then_some(readiness))
+            })
+            .chain(std::iter::once(Duration::from_secs(
+                self.settings.health_check_interval,
+            )))
+            .min()
+            .unwrap_or(Duration::from_secs(10))
+            .max(Duration::from_secs(1))
+    }
+
+    /// Start the background health monitor loop, and the resource sampler
+    /// (which also runs the autoscaler on what it reads)
+    pub fn start_monitor(self: Arc<Self>) {
+        let sampler = self.clone();
+        tokio::spawn(async move {
+            let mut ticks = tokio::time::interval(USAGE_SAMPLE_INTERVAL);
+            while !sampler.is_handed_off() {
+                ticks.tick().await;
+                sampler.sample_usage().await;
+                sampler.autoscale().await;
+            }
+        });
+
+        let interval = self.monitor_interval();
+        let hyp = self.clone();
+        tokio::spawn(async move {
+            info!("Starting health monitor (interval: {:?})", interval);
+            loop {
+                tokio::time::sleep(interval).await;
+                if hyp.is_handed_off() {
+                    break;
+                }
+                hyp.check_memory_limits().await;
+                hyp.run_due_health_checks().await;
+                hyp.run_due_readiness_checks().await;
+                hyp.reap_idle_instances().await;
+                hyp.check_storage_quotas().await;
+                hyp.check_secrets().await;
+            }
+        });
+    }
+
+    /// Start the `[jobs]` scheduler, checking for due runs each minute
+    pub fn start_jobs(self: Arc<Self>) {
+        tokio::spawn(async move {
+            let jobs = self.config().jobs.clone();
+            if !jobs.is_empty() {
+                info!("Scheduling {} job(s)", jobs.len());
+            }
+            loop {
+                self.jobs.run_due(&self.config().jobs, chrono::Utc::now());
+                // Wake just after the next minute boundary
+                let into_minute = chrono::Utc::now().timestamp_millis().rem_euclid(60_000);
+                tokio::time::sleep(Duration::from_millis(60_000 - into_minute as u64 + 10)).await;
+            }
+        });
+    }
+
+    /// Each configured job's next run and last result
+    pub fn job_statuses(&self) -> Vec<JobStatus> {
+        self.jobs.statuses(&self.config().jobs)
+    }
+
+    /// Update activity timestamp for an instance.
+    /// Call this on real requests (NOT health checks) to prevent auto-stop.
+    pub async fn touch_activity(&self, process_name: &str, id: &str) {
+        let instance_id = InstanceId::new(process_name, id);
+        let mut instances = self.instances.write().await;
+        if let Some(instance) = instances.get_mut(&instance_id) {
+            instance.touch();
+        }
+    }
+
+    /// Set the traffic weight for an instance (0-100).
+    /// Weight 0 means the instance receives no traffic.
+    /// Weight 100 is the default and means full traffic.
+    /// Returns Err if the instance is not found.
+    pub async fn set_weight(&self, process_name: &str, id: &str, weight: u8) -> Result<()> {
+        let instance_id = InstanceId::new(process_name, id);
+        let weight = weight.min(100); // Cap at 100
+        {
+            let mut instances = self.instances.write().await;
+            let Some(instance) = instances.get_mut(&instance_id) else {
+                anyhow::bail!("Instance not found: {}", instance_id)
+            };
+            instance.weight = weight;
+            info!("Set weight for {} to {}", instance_id, weight);
+        }
+        self.announce_traffic(&instance_id, weight);
+        if let Some(ref store) = self.state_store {
+            if let Err(e) = store.set_weight(&instance_id.to_string(), weight).await {
+                error!("Failed to persist weight for {}: {}", instance_id, e);
+            }
+        }
+        Ok(())
+    }
+
+    /// List all running instances for a specific process.
+    /// Used for weighted load balancing across multiple instances.
+    pub async fn list_by_process(&self, process_name: &str) -> Vec<InstanceInfo> {
+        let instances = self.instances.read().await;
+        instances
+            .values()
+            .filter(|i| i.id.process == process_name)
+            .map(|i| i.info())
+            .collect()
+    }
+
+    /// Select an instance for a process using weighted random selection.
+    /// Unhealthy and failed instances are skipped. Returns None if no instances
+    /// are available or all have weight 0.
+    pub async fn select_weighted(&self, process_name: &str) -> Option<InstanceInfo> {
+        weighted_choice(self.routable(process_name, None).await)
+    }
+
+    /// Select an instance for a process by its `load_balance` strategy.
+    /// Unhealthy, failed, and weight-0 instances are skipped.
+    pub async fn select_instance(&self, process_name: &str) -> Option<InstanceInfo> {
+        let candidates = self.routable(process_name, None).await;
+        self.choose(process_name, process_name, candidates).await
+    }
+
+    /// Like [`select_instance`](Self::select_instance), but never one of the
+    /// instances in `exclude` (used to retry a failed request elsewhere)
+    pub async fn select_instance_except(
+        &self,
+        process_name: &str,
+        exclude: &[String],
+    ) -> Option<InstanceInfo> {
+        let mut candidates = self.routable(process_name, None).await;
+        candidates.retain(|info| !exclude.contains(&info.id.id));
+        self.choose(process_name, process_name, candidates).await
+    }
+
+    /// The instance a request for `process_name:id` should go to. For a
+    /// replicated service that's one of `id`'s live replicas, picked by the
+    /// service's `load_balance` strategy; otherwise (or when none is up) `id`.
+    pub async fn pick_replica(&self, process_name: &str, id: &str) -> String {
+        let replicas = self.replica_ids(process_name, id);
+        if replicas.is_empty() {
+            return id.to_string();
+        }
+        let key = format!("{}:{}", process_name, id);
+        let candidates = self.routable(process_name, Some(&replicas)).await;
+        match self.choose(process_name, &key, candidates).await {
+            Some(info) => info.id.id,
+            None => id.to_string(),
+        }
+    }
+
+    /// Live, ready instances of a process (optionally only those in `ids`),
+    /// sorted by ID so round-robin order is stable, with weights cut back for
+    /// instances still in their slow start. Instances ejected by their
+    /// circuit breaker are left out, unless every candidate is.
+    async fn routable(&self, process_name: &str, ids: Option<&[String]>) -> Vec<InstanceInfo> {
+        let slow_start = self
+            .config()
+            .get_service(process_name)
+            .and_then(|svc| svc.slow_start)
+            .map(Duration::from_secs);
+        let instances = self.instances.read().await;
+        let mut candidates: Vec<InstanceInfo> = instances
+            .values()
+            .filter(|i| i.id.process == process_name && i.weight > 0)
+            .filter(|i| ids.map_or(true, |ids| ids.contains(&i.id.id)))
+            .filter(|i| !i.health_status.is_down() && i.readiness.ready)
+            // Sent its stop signal: it's on its way out
+            .filter(|i| !i.stopping)
+            .map(|i| {
+                let mut info = i.info();
+                if let Some(window) = slow_start {
+                    info.weight = slow_start_weight(i.weight, i.ready_for(), window);
+                }
+                info
+            })
+            .collect();
+        candidates.sort_by(|a, b| a.id.id.cmp(&b.id.id));
+
+        let now = Instant::now();
+        let (closed, ejected): (Vec<_>, Vec<_>) = candidates
+            .into_iter()
+            .partition(|i| !self.circuit_breakers.is_open(&i.id, now));
+        if closed.is_empty() {
+            ejected
+        } else {
+            closed
+        }
+    }
+
+    /// Pick one of `candidates` by the process's strategy. `key` names the
+    /// group for round-robin, so each group takes its own turns.
+    async fn choose(
+        &self,
+        process_name: &str,
+        key: &str,
+        candidates: Vec<InstanceInfo>,
+    ) -> Option<InstanceInfo> {
+        if candidates.is_empty() {
+            return None;
+        }
+        let strategy = self
+            .config()
+            .get_service(process_name)
+            .map(|config| config.load_balance)
+            .unwrap_or_default();
+        match strategy {
+            LoadBalance::Weighted => weighted_choice(candidates),
+            LoadBalance::RoundRobin => {
+                let turn = {
+                    let mut turns = self.round_robin.lock().unwrap();
+                    let turn = turns.entry(key.to_string()).or_insert(0);
+                    let current = *turn;
+                    *turn = turn.wrapping_add(1);
+                    current
+                };
+                let index = turn % candidates.len();
+                candidates.into_iter().nth(index)
+            }
+            LoadBalance::LeastConnections => {
+                let mut best: Option<(u32, InstanceInfo)> = None;
+                for info in candidates {
+                    let active = self.active_connection_count(process_name, &info.id.id).await;
+                    if best.as_ref().map_or(true, |(fewest, _)| active < *fewest) {
+                        best = Some((active, info));
+                    }
+                }
+                best.map(|(_, info)| info)
+            }
+        }
+    }
+
+    /// Stop idle instances that have exceeded their idle_timeout.
+    /// Called periodically by the health monitor.
+    async fn reap_idle_instances(&self) {
+        let idle_instances: Vec<InstanceId> = {
+            let instances = self.instances.read().await;
+            instances
+                .values()
+                .filter(|i| i.is_idle())
+                .map(|i| i.id.clone())
+                .collect()
+        };
+
+        for instance_id in idle_instances {
+            // Don't reap instances with active connections
+            let active = self
+                .active_connection_count(&instance_id.process, &instance_id.id)
+                .await;
+            if active > 0 {
+                info!(
+                    "Instance {} is idle but has {} active connection(s), skipping reap",
+                    instance_id, active
+                );
+                continue;
+            }
+
+            let idle_secs = {
+                let instances = self.instances.read().await;
+                instances
+                    .get(&instance_id)
+                    .map(|i| i.last_activity.elapsed().as_secs())
+                    .unwrap_or(0)
+            };
+
+            info!(
+                app = %instance_id.process,
+                instance = %instance_id.id,
+                event = "idle",
+                "Stopping idle instance {} (idle: {}s)",
+                instance_id,
+                idle_secs
+            );
+
+            match self.stop(&instance_id.process, &instance_id.id).await {
+                Ok(()) => {
+                    self.scaled_to_zero.write().await.insert(instance_id);
+                }
+                Err(e) => error!("Failed to stop idle instance {}: {}", instance_id, e),
+            }
+        }
+    }
+
+    /// An instance of `process_name` that was stopped for being idle, if any —
+    /// the one to wake when a request arrives and nothing is running
+    pub async fn scaled_to_zero_instance(&self, process_name: &str) -> Option<String> {
+        let parked = self.scaled_to_zero.read().await;
+        parked
+            .iter()
+            .filter(|id| id.process == process_name)
+            .map(|id| id.id.clone())
+            .min()
+    }
+
+    /// Detect rotated secrets and apply them to running instances.
+    /// Services with a `reload_signal` get a rewritten secrets file and a signal;
+    /// the rest (or a failed reload) get a health-gated restart.
+    async fn check_secrets(&self) {
+        let candidates: Vec<(InstanceId, Option<u64>, PathBuf, Option<u32>)> = {
+            let instances = self.instances.read().await;
+            instances
+                .values()
+                .filter(|i| i.secrets_fingerprint.is_some())
+                .map(|i| {
+                    (
+                        i.id.clone(),
+                        i.secrets_fingerprint,
+                        i.data_dir.clone(),
+                        i.handle.pid(),
+                    )
+                })
+                .collect()
+        };
+
+        let config = self.config();
+        for (instance_id, current, data_dir, pid) in candidates {
+            let process_config = match config.get_service(&instance_id.process) {
+                Some(c) => c,
+                None => continue,
+            };
+
+            let values = match secrets::read_secrets(
+                &process_config.secrets,
+                &self.settings.data_dir,
+            ) {
+                Ok(values) => values,
+                Err(e) => {
+                    warn!("Failed to re-read secrets for {}: {:#}", instance_id, e);
+                    continue;
+                }
+            };
+            let fingerprint = secrets::fingerprint(&values);
+            if current == Some(fingerprint) {
+                continue;
+            }
+
+            let reloaded = match &process_config.reload_signal {
+                Some(signal) => match signal_secrets_reload(&data_dir, &values, signal, pid) {
+                    Ok(()) => {
+                        info!("Secrets rotated for {} (sent {})", instance_id, signal);
+                        true
+                    }
+                    Err(e) => {
+                        warn!(
+                            "Secret reload failed for {}: {:#}. Falling back to restart.",
+                            instance_id, e
+                        );
+                        false
+                    }
+                },
+                None => false,
+            };
+
+            if reloaded {
+                let mut instances = self.instances.write().await;
+                if let Some(instance) = instances.get_mut(&instance_id) {
+                    instance.secrets_fingerprint = Some(fingerprint);
+                }
+            } else {
+                info!("Secrets changed for {}, restarting", instance_id);
+                let timeout = process_config.startup_timeout;
+                self.restart_planned(&instance_id, timeout, "secret rotation").await;
+            }
+        }
+    }
+
+    /// Restart an instance (for a secret rotation or config change), then wait for it
+    /// to pass a health check. Planned restarts don't count toward crash backoff or
+    /// restart history. Returns whether it came back healthy.
+    async fn restart_planned(
+        &self,
+        instance_id: &InstanceId,
+        timeout_secs: u64,
+        why: &str,
+    ) -> bool {
+        let (process_name, id) = (&instance_id.process, &instance_id.id);
+        let _ = self.stop(process_name, id).await;
+        if let Err(e) = self.spawn(process_name, id).await {
+            error!("Failed to respawn {} after {}: {:#}", instance_id, why, e);
+            return false;
+        }
+
+        let timeout = Duration::from_secs(timeout_secs);
+        let start = Instant::now();
+        while start.elapsed() < timeout {
+            match self.check_health(process_name, id).await {
+                HealthStatus::Healthy => {
+                    info!("Instance {} healthy after {}", instance_id, why);
+                    return true;
+                }
+                HealthStatus::Failed => break,
+                _ => tokio::time::sleep(Duration::from_millis(250)).await,
+            }
+        }
+        error!(
+            "Instance {} not healthy after {}; leaving it to the health monitor",
+            instance_id, why
+        );
+        false
+    }
+
+    /// Restart instances that went over their memory limit. Under a cgroup the
+    /// kernel enforces the limit and its OOM-kill counter is watched; otherwise
+    /// resident memory is compared against it.
+    async fn check_memory_limits(self: &Arc<Self>) {
+        let config = self.config();
+        let candidates: Vec<(InstanceId, u32, Option<u32>, u64)> = {
+            let instances = self.instances.read().await;
+            instances
+                .values()
+                // VM runtimes size the guest from the limit instead
+                .filter(|i| {
+                    matches!(
+                        i.runtime_type,
+                        RuntimeType::Process | RuntimeType::Namespace | RuntimeType::Litebox
+                    )
+                })
+                .filter_map(|i| {
+                    let limit_mb = config.get_service(&i.id.process)?.memory_limit()?;
+                    Some((i.id.clone(), limit_mb, i.handle.pid(), i.oom_kills))
+                })
+                .collect()
+        };
+
+        for (instance_id, limit_mb, pid, seen) in candidates {
+            let detail = match self.cgroup_manager.oom_kills(&instance_id.to_string()) {
+                Some(kills) if kills > seen => format!("{} OOM kill(s)", kills - seen),
+                Some(_) => continue,
+                None => {
+                    let Some(usage) = pid.and_then(crate::metrics::process_usage) else {
+                        continue;
+                    };
+                    let rss = usage.rss_bytes;
+                    if rss <= limit_mb as u64 * 1024 * 1024 {
+                        continue;
+                    }
+                    format!("{:.1}MB resident", rss as f64 / 1024.0 / 1024.0)
+                }
+            };
+            warn!(
+                app = %instance_id.process,
+                instance = %instance_id.id,
+                event = "memory-limit",
+                "Instance {} exceeded its {}MB memory limit ({}), restarting",
+                instance_id,
+                limit_mb,
+                detail
+            );
+            self.restart_in_background(instance_id);
+        }
+    }
+
+    /// The instances with a process ID, by that ID
+    pub async fn instance_pids(&self) -> HashMap<u32, InstanceId> {
+        let instances = self.instances.read().await;
+        instances
+            .values()
+            .filter_map(|i| Some((i.handle.pid()?, i.id.clone())))
+            .collect()
+    }
+
+    /// Read each instance's resource use, working out its CPU percentage from
+    /// the previous reading
+    async fn sample_usage(&self) {
+        let pids: Vec<(InstanceId, u32)> = {
+            let instances = self.instances.read().await;
+            instances
+                .values()
+                .filter_map(|i| Some((i.id.clone(), i.handle.pid()?)))
+                .collect()
+        };
+        let readings: Vec<_> = pids
+            .into_iter()
+            .filter_map(|(id, pid)| Some((id, crate::metrics::process_usage(pid)?)))
+            .collect();
+
+        let now = Instant::now();
+        let mut instances = self.instances.write().await;
+        for (id, usage) in readings {
+            let Some(instance) = instances.get_mut(&id) else {
+                continue;
+            };
+            let usage = match &instance.usage {
+                Some((at, earlier)) => usage.since(earlier, now - *at),
+                None => usage,
+            };
+            instance.usage = Some((now, usage));
+        }
+    }
+
+    /// Move each autoscaled service's replica count toward its target, once
+    /// every `autoscale.interval`, on what was observed over that interval
+    async fn autoscale(&self) {
+        let config = self.config();
+        let requests = self.metrics.requests_total.totals_by("process").await;
+        let now = Instant::now();
+        for (name, service) in &config.service {
+            let Some(autoscale) = &service.autoscale else {
+                continue;
+            };
+            let served = requests.get(name).copied().unwrap_or(0);
+            let latency = self
+                .metrics
+                .request_duration_ms
+                .counts_where("process", name)
+                .await;
+            let window = {
+                let mut windows = self.autoscale_windows.lock().unwrap();
+                let window = windows
+                    .entry(name.clone())
+                    .or_insert_with(|| AutoscaleWindow {
+                        started: now,
+                        requests: served,
+                        latency: latency.clone(),
+                        scaled_at: None,
+                    });
+                if now - window.started < autoscale.interval() {
+                    continue;
+                }
+                let ended = AutoscaleWindow {
+                    started: now,
+                    requests: served,
+                    latency: latency.clone(),
+                    scaled_at: window.scaled_at,
+                };
+                std::mem::replace(window, ended)
+            };
+
+            let (running, connections, cpu) = {
+                let instances = self.instances.read().await;
+                let conns = self.active_connections.read().await;
+                let running: Vec<&Instance> = instances
+                    .values()
+                    .filter(|i| &i.id.process == name)
+                    .collect();
+                let connections: u32 = running
+                    .iter()
+                    .filter_map(|i| conns.get(&i.id))
+                    .map(|c| c.load(std::sync::atomic::Ordering::Relaxed))
+                    .sum();
+                let cpu: Vec<f64> = running
+                    .iter()
+                    .filter_map(|i| i.usage.and_then(|(_, usage)| usage.cpu_percent))
+                    .collect();
+                (running.len(), connections, cpu)
+            };
+            // Nothing running (or all scaled to zero): nothing to size
+            if running == 0 {
+                continue;
+            }
+            let per_replica = |total: f64| total / running as f64;
+            let value = match autoscale.metric {
+                AutoscaleMetric::Rps => {
+                    let elapsed = (now - window.started).as_secs_f64();
+                    let rate = served.saturating_sub(window.requests) as f64 / elapsed;
+                    Some(per_replica(rate))
+                }
+                AutoscaleMetric::Concurrency => Some(per_replica(connections as f64)),
+                AutoscaleMetric::Cpu => {
+                    (!cpu.is_empty()).then(|| cpu.iter().sum::<f64>() / cpu.len() as f64)
+                }
+                AutoscaleMetric::P95LatencyMs => crate::metrics::quantile_between(
+                    &self.metrics.request_duration_ms.bounds(),
+                    &window.latency,
+                    &latency,
+                    0.95,
+                ),
+            };
+            let Some(value) = value else {
+                continue;
+            };
+            let from = service.replicas;
+            let to = autoscale.desired_replicas(from, value);
+            if to == from {
+                continue;
+            }
+            let cooldown = autoscale.cooldown(to > from);
+            if window.scaled_at.is_some_and(|at| now - at < cooldown) {
+                debug!("{}: holding at {} replicas during cooldown", name, from);
+                continue;
+            }
+
+            info!(
+                app = name.as_str(),
+                event = "autoscale",
+                "Scaling {} from {} to {} replicas ({} {:.1}, target {})",
+                name,
+                from,
+                to,
+                autoscale.metric.as_str(),
+                value,
+                autoscale.target
+            );
+            if let Some(window) = self.autoscale_windows.lock().unwrap().get_mut(name) {
+                window.scaled_at = Some(now);
+            }
+            if let Err(e) = self.set_replicas(name, to).await {
+                warn!("Failed to scale {} to {} replicas: {:#}", name, to, e);
+                continue;
+            }
+            let data = serde_json::json!({
+                "from": from,
+                "to": to,
+                "metric": autoscale.metric.as_str(),
+                "value": value,
+                "target": autoscale.target,
+            });
+            self.emit(Event::for_app(EventKind::Scaled, name, data));
+        }
+    }
+
+    /// Run `to` replicas of each running instance of `process_name`: spawn the
+    /// ones it gains, and stop the highest-numbered ones it loses
+    async fn set_replicas(&self, process_name: &str, to: u32) -> Result<()> {
+        // A reload swaps the config too; don't let one undo the other
+        let _reloading = self.reloading.lock().await;
+        let current = self.config();
+        let Some(from) = current.get_service(process_name).map(|svc| svc.replicas) else {
+            anyhow::bail!("Unknown service '{}'", process_name)
+        };
+        let mut config = (*current).clone();
+        if let Some(service) = config.service.get_mut(process_name) {
+            service.replicas = to;
+        }
+        // Swap first, so requests stop going to replicas on their way out
+        *self.config.write().unwrap() = Arc::new(config);
+
+        let running: Vec<InstanceId> = self
+            .instances
+            .read()
+            .await
+            .keys()
+            .filter(|id| id.process == process_name)
+            .cloned()
+            .collect();
+        let groups: std::collections::BTreeSet<String> =
+            running.iter().map(|id| self.listed_id(id)).collect();
+        let mut result = Ok(());
+        for group in &groups {
+            for index in (to..from).rev() {
+                let replica = format!("{}-{}", group, index);
+                if self.is_running(process_name, &replica).await {
+                    let retired = self.retire(process_name, &replica, STOP_DRAIN).await;
+                    if let Err(e) = retired {
+                        result = Err(e);
+                    }
+                }
+            }
+            for index in from..to {
+                let replica = format!("{}-{}", group, index);
+                if let Err(e) = self.spawn(process_name, &replica).await {
+                    result = Err(e);
+                }
+            }
+        }
+        result
+    }
+
+    /// Check storage quotas for all instances and update metrics.
+    /// Logs warnings at 80% and errors at 100% usage.
+    async fn check_storage_quotas(&self) {
+        let instance_data: Vec<(InstanceId, std::path::PathBuf, Option<u32>)> = {
+            let instances = self.instances.read().await;
+            instances
+                .values()
+                .map(|i| (i.id.clone(), i.data_dir.clone(), i.storage_quota_mb))
+                .collect()
+        };
+
+        for (instance_id, data_dir, quota_mb) in instance_data {
+            let used_bytes = match calculate_dir_size(data_dir.clone()).await {
+                Ok(bytes) => bytes,
+                Err(e) => {
+                    error!("Failed to calculate storage for {}: {}", instance_id, e);
+                    continue;
+                }
+            };
+
+            // Update cached storage usage on the instance
+            {
+                let mut instances = self.instances.write().await;
+                if let Some(instance) = instances.get_mut(&instance_id) {
+                    instance.storage_used_bytes = used_bytes;
+                }
+            }
+
+            // Update metrics
+            let mut labels = HashMap::new();
+            labels.insert("process".to_string(), instance_id.process.clone());
+            labels.insert("id".to_string(), instance_id.id.clone());
+            let gauge = self
+                .metrics
+                .instance_storage_bytes
+                .with_labels(&labels)
+                .await;
+            gauge.set(used_bytes);
+
+            // Check quota
+            if let Some(quota_mb) = quota_mb {
+                let quota_bytes = (quota_mb as u64) * 1024 * 1024;
+
+                let quota_gauge = self
+                    .metrics
+                    .instance_storage_quota_bytes
+                    .with_labels(&labels)
+                    .await;
+                quota_gauge.set(quota_bytes);
+
+                if quota_bytes > 0 {
+                    let ratio = used_bytes as f64 / quota_bytes as f64;
+                    let ratio_gauge = self
+                        .metrics
+                        .instance_storage_usage_ratio
+                        .with_labels(&labels)
+                        .await;
+                    ratio_gauge.set((ratio * 10000.0) as u64);
+
+                    if ratio >= 1.0 {
+                        error!(
+                            "Instance {} storage quota exceeded: {:.1}MB / {:.1}MB ({:.0}%)",
+                            instance_id,
+                            used_bytes as f64 / 1024.0 / 1024.0,
+                            quota_mb as f64,
+                            ratio * 100.0
+                        );
+                    } else if ratio >= 0.8 {
+                        warn!(
+                            "Instance {} storage usage high: {:.1}MB / {:.1}MB ({:.0}%)",
+                            instance_id,
+                            used_bytes as f64 / 1024.0 / 1024.0,
+                            quota_mb as f64,
+                            ratio * 100.0
+                        );
+                    }
+                }
+            }
+        }
+    }
+
+    /// Recover the state of a previous run, whether it crashed or shut down.
+    /// Kills any orphaned processes still running, then brings back every
+    /// instance it recorded with the port, weight, restart count and release pin
+    /// it had; instances of services no longer configured stay down. Instances
+    /// handed over on upgrade (see `adopt_on_recovery`) are adopted where they
+    /// run instead. Called on startup before spawning configured instances.
+    /// Returns the instances brought back.
+    pub async fn recover_orphans(&self) -> Vec<InstanceId> {
+        let store = match &self.state_store {
+            Some(s) => s,
+            None => return Vec::new(),
+        };
+
+        match store.pins().await {
+            Ok(pins) => {
+                let mut release_pins = self.release_pins.write().unwrap();
+                for (key, json) in pins {
+                    let parsed = InstanceId::parse(&key).zip(serde_json::from_str(&json).ok());
+                    match parsed {
+                        Some((instance_id, pin)) => {
+                            release_pins.insert(instance_id, pin);
+                        }
+                        None => warn!("Ignoring malformed release pin for {}", key),
+                    }
+                }
+            }
+            Err(e) => error!("Failed to read release pins for recovery: {}", e),
+        }
+
+        match store.ports().await {
+            Ok(ports) => {
+                for (key, port) in ports {
+                    match InstanceId::parse(&key) {
+                        Some(instance_id) => self.keep_port(instance_id, port).await,
+                        None => warn!("Ignoring malformed port assignment for {}", key),
+                    }
+                }
+                self.forget_unconfigured_ports(&self.config()).await;
+            }
+            Err(e) => error!("Failed to read port assignments for recovery: {}", e),
+        }
+
+        let states = match store.list().await {
+            Ok(s) => s,
+            Err(e) => {
+                error!("Failed to read instance state for recovery: {}", e);
+                return Vec::new();
+            }
+        };
+
+        if states.is_empty() {
+            return Vec::new();
+        }
+
+        info!("Found {} instance(s) from previous run", states.len());
+
+        let config = self.config();
+        #[cfg(unix)]
+        let mut handed_over = std::mem::take(&mut *self.adoptable.lock().unwrap());
+        #[cfg(unix)]
+        let mut adopt = HashMap::new();
+        for state in &states {
+            // Check if process is still alive (pid 0: stopped at shutdown)
+            #[cfg(unix)]
+            let alive = state.pid != 0 && unsafe { libc::kill(state.pid as i32, 0) } == 0;
+            #[cfg(not(unix))]
+            let alive = false;
+
+            // Handed over by the supervisor this one replaces: keep it running
+            #[cfg(unix)]
+            if alive && config.get_service(&state.process_name).is_some() {
+                let instance_id = InstanceId::new(&state.process_name, &state.id);
+                if let Some(output) = handed_over.remove(&instance_id) {
+                    adopt.insert(instance_id, output);
+                    continue;
+                }
+            }
+
+            if alive && !is_recorded_process(state) {
+                warn!(
+                    "Not killing pid {}: it can't be confirmed as orphaned {}",
+                    state.pid, state.instance_id
+                );
+            } else if alive {
+                info!(
+                    "Killing orphaned process {} (pid {})",
+                    state.instance_id, state.pid
+                );
+                #[cfg(unix)]
+                unsafe {
+                    libc::kill(state.pid as i32, libc::SIGKILL);
+                }
+            } else {
+                info!(
+                    "Orphaned process {} (pid {}) already exited",
+                    state.instance_id, state.pid
+                );
+            }
+        }
+
+        // Records are rewritten as the instances come back
+        if let Err(e) = store.clear_all().await {
+            error!("Failed to clear instance state after recovery: {}", e);
+        }
+
+        let mut restored = Vec::new();
+        for state in &states {
+            let instance_id = InstanceId::new(&state.process_name, &state.id);
+            if config.get_service(&state.process_name).is_none() {
+                info!("Not restoring {}: its service is no longer configured", instance_id);
+                continue;
+            }
+            #[cfg(unix)]
+            if let Some(output) = adopt.remove(&instance_id) {
+                match self.adopt(state, output).await {
+                    Ok(()) => {
+                        restored.push(instance_id);
+                        continue;
+                    }
+                    Err(e) => {
+                        warn!("Failed to adopt {}, restarting it: {:#}", instance_id, e);
+                        unsafe {
+                            libc::kill(-(state.pid as i32), libc::SIGKILL);
+                        }
+                    }
+                }
+            }
+            // Databases from before port assignments were recorded
+            if let Some(port) = state.port {
+                let known = self
+                    .assigned_ports
+                    .lock()
+                    .unwrap()
+                    .contains_key(&instance_id);
+                if !known {
+                    self.keep_port(instance_id.clone(), port).await;
+                    self.persist_port(&instance_id, Some(port)).await;
+                }
+            }
+            self.restart_history
+                .write()
+                .await
+                .insert(instance_id.clone(), (state.restarts, Vec::new()));
+
+            if let Err(e) = self.spawn(&state.process_name, &state.id).await {
+                warn!("Failed to restore {}: {:#}", instance_id, e);
+                continue;
+            }
+            if state.weight != 100 {
+                self.set_weight(&state.process_name, &state.id, state.weight)
+                    .await
+                    .ok();
+            }
+            restored.push(instance_id);
+        }
+
+        info!(
+            "Recovery complete: restored {} of {} instance(s)",
+            restored.len(),
+            states.len()
+        );
+        restored
+    }
+
+    /// Adopt these instances in `recover_orphans` instead of killing them. Each
+    /// comes with its output pipes (stdout, then stderr), as handed over on
+    /// upgrade by the supervisor this one replaces.
+    #[cfg(unix)]
+    pub fn adopt_on_recovery(&self, outputs: HashMap<InstanceId, Vec<OwnedFd>>) {
+        self.adoptable.lock().unwrap().extend(outputs);
+    }
+
+    /// Take over an instance handed over on upgrade: it keeps running, and is
+    /// logged, watched and routed to as if spawned here
+    #[cfg(unix)]
+    async fn adopt(&self, state: &crate::store::InstanceState, output: Vec<OwnedFd>) -> Result<()> {
+        let (process_name, id) = (state.process_name.as_str(), state.id.as_str());
+        let instance_id = InstanceId::new(process_name, id);
+        let mut process_config = self
+            .config()
+            .get_service(process_name)
+            .with_context(|| format!("Unknown process: {}", process_name))?
+            .clone();
+        let mut release = None;
+        if let Some(pin) = self.release_pins.read().unwrap().get(&instance_id) {
+            pin.apply(&mut process_config);
+            release = pin.release;
+        }
+
+        // Keep a copy of each pipe for the next upgrade
+        let mut pipes = Vec::new();
+        let mut kept = Vec::new();
+        for fd in output {
+            kept.push(fd.try_clone()?);
+            pipes.push(tokio::net::unix::pipe::Receiver::from_owned_fd(fd)?);
+        }
+        if let Some(port) = state.port {
+            if !self.port_allocator.reserve(port).await {
+                anyhow::bail!("Port {} is already in use", port);
+            }
+        }
+        for (pipe, level) in pipes.into_iter().zip([LogLevel::Stdout, LogLevel::Stderr]) {
+            self.capture_output(pipe, level, process_name, id, Some(state.pid));
+        }
+
+        let data_dir = &self.settings.data_dir;
+        let file_env = env_files::load(&process_config.env_files).unwrap_or_default();
+        let mut env =
+            process_config.env_interpolated(file_env, process_name, id, data_dir, state.port);
+        env.insert("SOCKET_PATH".to_string(), state.socket.clone());
+        let socket = Path::new(&state.socket);
+        env.extend(metadata_env(&instance_id, release, socket));
+        if let Some(port) = state.port {
+            env.insert("PORT".to_string(), port.to_string());
+        }
+        let pre_stop = hooks::bind(
+            HookKind::PreStop,
+            &process_config,
+            &instance_id,
+            env.clone(),
+        );
+        let post_stop_hook = process_config.post_stop.as_ref().map(|command| {
+            PostStopHook::new(
+                instance_id.clone(),
+                command.clone(),
+                env.clone(),
+                process_config.workdir.clone(),
+                Duration::from_secs(process_config.post_stop_timeout),
+            )
+        });
+        let secrets_fingerprint = if process_config.secrets.is_empty() {
+            None
+        } else {
+            secrets::read_secrets(&process_config.secrets, data_dir)
+                .ok()
+                .map(|values| secrets::fingerprint(&values))
+        };
+        let tmp_dir = process_config
+            .tmp_dir
+            .then(|| data_dir.join(TMP_DIR_NAME).join(process_name).join(id));
+
+        // Backdated to when it really started, so its uptime carries over
+        let now = Instant::now();
+        let started_at = chrono::DateTime::parse_from_rfc3339(&state.started_at)
+            .ok()
+            .and_then(|t| {
+                (chrono::Utc::now() - t.with_timezone(&chrono::Utc))
+                    .to_std()
+                    .ok()
+            })
+            .and_then(|age| now.checked_sub(age))
+            .unwrap_or(now);
+        let socket = PathBuf::from(&state.socket);
+        let instance = Instance {
+            id: instance_id.clone(),
+            handle: RuntimeHandle::Adopted {
+                pid: state.pid,
+                socket: socket.clone(),
+                runtime: process_config.isolation,
+            },
+            runtime_type: process_config.isolation,
+            socket,
+            port: state.port,
+            started_at,
+            restarts: state.restarts,
+            consecutive_failures: 0,
+            consecutive_successes: 0,
+            probe_in_flight: Default::default(),
+            last_health_check: None,
+            health_passed: true,
+            health_status: HealthStatus::Unknown,
+            // Already serving before the handoff; the next check confirms it
+            readiness: Readiness::new(false),
+            restart_times: Vec::new(),
+            backoff_reset: Duration::from_secs(self.settings.backoff_reset_secs),
+            last_activity: now,
+            idle_timeout: process_config.idle_timeout,
+            storage_quota_mb: process_config.storage_quota_mb,
+            storage_persist: process_config.storage_persist,
+            storage_used_bytes: 0,
+            data_dir: data_dir.join(process_name).join(id),
+            tmp_dir,
+            weight: state.weight,
+            // It became ready under the previous supervisor
+            startup_duration: Some(Duration::ZERO),
+            usage: None,
+            secrets_fingerprint,
+            env,
+            post_stop: post_stop_hook.clone(),
+            pre_stop,
+            stopping: false,
+            oom_kills: self
+                .cgroup_manager
+                .oom_kills(&instance_id.to_string())
+                .unwrap_or(0),
+            // Never handed over; see handoff_outputs
+            egress: None,
+            output: kept,
+        };
+
+        self.instances
+            .write()
+            .await
+            .insert(instance_id.clone(), instance);
+        self.restart_history
+            .write()
+            .await
+            .insert(instance_id.clone(), (state.restarts, Vec::new()));
+        self.metrics.instances_up.inc();
+        if let Some(store) = &self.state_store {
+            if let Err(e) = store.save(state).await {
+                error!(
+                    "Failed to persist instance state for {}: {}",
+                    instance_id, e
+                );
+            }
+        }
+        info!(
+            app = process_name,
+            instance = id,
+            pid = state.pid,
+            event = "adopt",
+            "Adopted instance {} (pid {}) from the previous supervisor",
+            instance_id,
+            state.pid
+        );
+        self.watch_exit(instance_id, state.pid, post_stop_hook);
+        Ok(())
+    }
+
+    /// Output pipes (stdout, then stderr) of each running instance another
+    /// supervisor could take over on upgrade: those tenement runs as a process,
+    /// unless the egress proxy it relies on lives in this one. The descriptors
+    /// stay owned by their instances.
+    #[cfg(unix)]
+    pub async fn handoff_outputs(&self) -> Vec<(InstanceId, Vec<RawFd>)> {
+        let instances = self.instances.read().await;
+        instances
+            .values()
+            .filter(|i| i.handle.pid().is_some() && !i.output.is_empty() && i.egress.is_none())
+            .map(|i| {
+                let fds = i.output.iter().map(|fd| fd.as_raw_fd()).collect();
+                (i.id.clone(), fds)
+            })
+            .collect()
+    }
+
+    /// Hand instances over to the supervisor replacing this one on upgrade. They
+    /// keep running, and serve this process's last requests, but nothing here
+    /// restarts, checks or stops them any more, and nothing new is spawned.
+    /// Instances not handed over (containers, VMs, those with an egress policy)
+    /// are stopped; the new supervisor starts its own.
+    pub async fn hand_off(&self, handed: &[InstanceId]) {
+        self.handed_off.send_replace(true);
+        self.jobs.shutdown().await;
+        let others: Vec<InstanceId> = {
+            let mut instances = self.instances.write().await;
+            let mut others = Vec::new();
+            for (id, instance) in instances.iter_mut() {
+                let Some(pid) = instance.handle.pid().filter(|_| handed.contains(id)) else {
+                    others.push(id.clone());
+                    continue;
+                };
+                let adopted = RuntimeHandle::Adopted {
+                    pid,
+                    socket: instance.socket.clone(),
+                    runtime: instance.runtime_type,
+                };
+                // Dropping the old handle would kill the process
+                std::mem::forget(std::mem::replace(&mut instance.handle, adopted));
+            }
+            others
+        };
+        for id in others {
+            if let Err(e) = self.remove_instance(&id).await {
+                warn!("Failed to stop {} on hand-off: {:#}", id, e);
+            }
+        }
+        info!("Handed {} instance(s) to the new supervisor", handed.len());
+    }
+
+    /// Whether instances were handed to a new supervisor (see `hand_off`)
+    pub fn is_handed_off(&self) -> bool {
+        *self.handed_off.borrow()
+    }
+
+    /// Wait until instances are handed to a new supervisor
+    pub async fn handed_off(&self) {
+        let _ = self.handed_off.subscribe().wait_for(|handed| *handed).await;
+    }
+
+    /// Remove temp directories left behind by instances that aren't running
+    /// (e.g. after tenement itself was killed). Called on startup; returns how many were removed.
+    pub async fn prune_orphaned_tmp_dirs(&self) -> usize {
+        let root = self.settings.data_dir.join(TMP_DIR_NAME);
+        let Ok(processes) = std::fs::read_dir(&root) else {
+            return 0;
+        };
+        let instances = self.instances.read().await;
+        let mut removed = 0;
+        for process in processes.flatten() {
+            let process_name = process.file_name().to_string_lossy().to_string();
+            let Ok(ids) = std::fs::read_dir(process.path()) else {
+                continue;
+            };
+            for entry in ids.flatten() {
+                let id = entry.file_name().to_string_lossy().to_string();
+                if instances.contains_key(&InstanceId::new(&process_name, &id)) {
+                    continue;
+                }
+                match std::fs::remove_dir_all(entry.path()) {
+                    Ok(()) => removed += 1,
+                    Err(e) => warn!("Failed to remove temp directory {:?}: {}", entry.path(), e),
+                }
+            }
+            // Drop the process dir once it's empty (fails harmlessly otherwise)
+            std::fs::remove_dir(process.path()).ok();
+        }
+        removed
+    }
+
+    /// Scan socket directories and prune stale sockets not owned by any configured service.
+    /// Called on startup after orphan recovery. With `dry_run`, only reports.
+    pub fn prune_orphaned_sockets(&self, dry_run: bool) -> crate::sockets::SocketReport {
+        let report = crate::sockets::reconcile_sockets(&self.config(), dry_run);
+        for entry in &report.entries {
+            match entry.state {
+                crate::sockets::SocketState::Dead if entry.pruned => {
+                    info!("Pruned stale socket {}", entry.path.display())
+                }
+                crate::sockets::SocketState::Dead => {
+                    info!("Stale socket {} (dry run, not removed)", entry.path.display())
+                }
+                crate::sockets::SocketState::Live => info!(
+                    "Leaving unowned socket {} (still has a listener)",
+                    entry.path.display()
+                ),
+                _ => {}
+            }
+        }
+        report
+    }
+
+    /// Spawn all instances configured in [instances] section.
+    /// Called on server startup to auto-start configured instances.
+    /// Continues spawning even if some fail, logs errors for failures.
+    /// Returns the number of successfully spawned instances.
+    pub async fn spawn_configured_instances(&self) -> (usize, usize) {
+        let instances_to_spawn = self.config().get_instances_to_spawn();
+
+        if instances_to_spawn.is_empty() {
+            return (0, 0);
+        }
+
+        info!(
+            "Auto-spawning {} configured instance(s)",
+            instances_to_spawn.len()
+        );
+
+        let mut success_count = 0;
+        let mut fail_count = 0;
+
+        for (service_name, instance_id) in instances_to_spawn {
+            info!("Auto-spawning {}:{}", service_name, instance_id);
+
+            match self.spawn(&service_name, &instance_id).await {
+                Ok(socket) => {
+                    info!(
+                        "Successfully spawned {}:{} at {:?}",
+                        service_name, instance_id, socket
+                    );
+                    success_count += 1;
+                }
+                Err(e) => {
+                    error!("Failed to spawn {}:{}: {}", service_name, instance_id, e);
+                    fail_count += 1;
+                }
+            }
+        }
+
+        if fail_count > 0 {
+            warn!(
+                "Auto-spawn complete: {} succeeded, {} failed",
+                success_count, fail_count
+            );
+        } else {
+            info!("Auto-spawn complete: {} instance(s) started", success_count);
+        }
+
+        (success_count, fail_count)
+    }
+
+    /// Apply a new config without restarting the supervisor: stop instances of
+    /// removed services, restart running instances of changed services one at a
+    /// time (each must pass its health check before the next goes), and start
+    /// `[instances]` entries that are new. Unchanged services keep running.
+    ///
+    /// `[settings]` and `[routing]` are kept as they were at startup; changes to
+    /// them are logged and need a restart.
+    pub async fn reload(&self, mut config: Config) -> Result<ReloadReport> {
+        let _reloading = self.reloading.lock().await;
+        let current = self.config();
+        // [settings.cluster] is applied in place; the rest of [settings] isn't
+        let without_cluster = |settings: &Settings| {
+            let mut settings = settings.clone();
+            settings.cluster = None;
+            serde_json::to_value(settings)
+        };
+        if without_cluster(&config.settings)? != without_cluster(&current.settings)? {
+            warn!("[settings] changed; restart tenement to apply them");
+        }
+        if serde_json::to_value(&config.routing)? != serde_json::to_value(&current.routing)? {
+            warn!("[routing] changed; restart tenement to apply it");
+        }
+        let cluster = match (&self.cluster, config.settings.cluster.take()) {
+            (Some(cluster), Some(new)) => match cluster.reconfigure(new.clone()) {
+                Ok(()) => Some(new),
+                Err(e) => {
+                    warn!("{:#}", e);
+                    current.settings.cluster.clone()
+                }
+            },
+            (None, None) => None,
+            _ => {
+                warn!("[settings.cluster] added or removed; restart tenement to apply it");
+                current.settings.cluster.clone()
+            }
+        };
+        let changed = carry_over(&current, &mut config);
+        config.settings.cluster = cluster;
+        let diff = ConfigDiff::between(
+            &current.service_fingerprints(),
+            &config.service_fingerprints(),
+        );
+        let mut report = ReloadReport {
+            diff,
+            ..Default::default()
+        };
+        let previously_listed: std::collections::HashSet<(String, String)> =
+            current.get_instances_to_spawn().into_iter().collect();
+        let listed: std::collections::HashSet<(String, String)> =
+            config.get_instances_to_spawn().into_iter().collect();
+
+        // Swap first, so everything spawned from here on uses the new definitions
+        *self.log_limiters.write().unwrap() = log_limiters_for(&config);
+        *self.rate_limiters.write().unwrap() = rate_limiters_for(&config);
+        let response_caches = response_caches_for(&config, &self.response_caches.read().unwrap());
+        *self.response_caches.write().unwrap() = response_caches;
+        *self.retry_budgets.write().unwrap() = retry_budgets_for(&config);
+        *self.access_logs.write().unwrap() = access_logs_for(&config, &self.settings);
+        self.maintenance
+            .write()
+            .unwrap()
+            .retain(|name, _| config.get_service(name).is_some());
+        self.autoscale_windows.lock().unwrap().retain(|name, _| {
+            config
+                .get_service(name)
+                .is_some_and(|s| s.autoscale.is_some())
+        });
+        let app_limits = app_limits_for(&config, &self.app_limits.read().unwrap());
+        *self.app_limits.write().unwrap() = app_limits;
+        // Editing a service supersedes the release a rollback pinned for it
+        let mut repinned = Vec::new();
+        self.release_pins.write().unwrap().retain(|id, pin| {
+            let kept = config.get_service(&id.process).is_some();
+            if !kept {
+                repinned.push((id.clone(), None));
+            } else if changed.contains(&id.process) {
+                *pin = ReleasePin {
+                    artifact: pin.artifact.take(),
+                    app_version: pin.app_version.take(),
+                    workdir: pin.workdir.take(),
+                    image: pin.image.take(),
+                    preview: pin.preview,
+                    git_sha: pin.git_sha.take(),
+                    release: pin.release,
+                    ..Default::default()
+                };
+                repinned.push((id.clone(), Some(pin.clone())));
+            }
+            kept
+        });
+        for (id, pin) in &repinned {
+            self.persist_pin(id, pin.as_ref()).await;
+        }
+        let config = Arc::new(config);
+        *self.config.write().unwrap() = config.clone();
+        info!(event = "reload", "Config reloaded: {}", report.diff);
+
+        let running: Vec<InstanceId> = self.instances.read().await.keys().cloned().collect();
+        for instance_id in &running {
+            let removed = config.get_service(&instance_id.process).is_none();
+            // Only instances started from [instances] leave when they're dropped from it
+            let key = (instance_id.process.clone(), self.listed_id(instance_id));
+            let unlisted = previously_listed.contains(&key) && !listed.contains(&key);
+            if removed || unlisted {
+                let (process_name, id) = (&instance_id.process, &instance_id.id);
+                match self.retire(process_name, id, STOP_DRAIN).await {
+                    Ok(()) => report.stopped.push(instance_id.clone()),
+                    Err(e) => {
+                        warn!("Failed to stop {} on reload: {:#}", instance_id, e);
+                        report.failed.push(instance_id.clone());
+                    }
+                }
+            }
+        }
+        self.scaled_to_zero
+            .write()
+            .await
+            .retain(|id| config.get_service(&id.process).is_some());
+        self.forget_unconfigured_ports(&config).await;
+
+        for instance_id in &running {
+            if !changed.contains(&instance_id.process) || report.stopped.contains(instance_id) {
+                continue;
+            }
+            let timeout = config
+                .get_service(&instance_id.process)
+                .map_or(10, |svc| svc.startup_timeout);
+            if self.restart_planned(instance_id, timeout, "config reload").await {
+                report.restarted.push(instance_id.clone());
+            } else {
+                report.failed.push(instance_id.clone());
+            }
+        }
+
+        // A changed service may run more replicas now; spawn skips those already up
+        for (process_name, id) in listed.iter().filter(|(p, _)| changed.contains(p)) {
+            if let Err(e) = self.spawn(process_name, id).await {
+                warn!("Failed to spawn {}:{} on reload: {:#}", process_name, id, e);
+            }
+        }
+
+        let mut to_start: Vec<&(String, String)> = listed.difference(&previously_listed).collect();
+        to_start.sort();
+        for (process_name, id) in to_start {
+            let instance_id = InstanceId::new(process_name, id);
+            match self.spawn(process_name, id).await {
+                Ok(_) => report.started.push(instance_id),
+                Err(e) => {
+                    error!("Failed to spawn {} on reload: {:#}", instance_id, e);
+                    report.failed.push(instance_id);
+                }
+            }
+        }
+
+        Ok(report)
+    }
+
+    /// What `reload` would do with `config`, without doing any of it: the
+    /// instances it would stop, restart and start. `failed` is always empty.
+    pub async fn plan_reload(&self, mut config: Config) -> ReloadReport {
+        let current = self.config();
+        let changed = carry_over(&current, &mut config);
+        let diff = ConfigDiff::between(
+            &current.service_fingerprints(),
+            &config.service_fingerprints(),
+        );
+        let mut report = ReloadReport {
+            diff,
+            ..Default::default()
+        };
+        let previously_listed: std::collections::HashSet<(String, String)> =
+            current.get_instances_to_spawn().into_iter().collect();
+        let listed: std::collections::HashSet<(String, String)> =
+            config.get_instances_to_spawn().into_iter().collect();
+
+        let mut running: Vec<InstanceId> = self.instances.read().await.keys().cloned().collect();
+        running.sort_by_key(|id| id.to_string());
+        for instance_id in running {
+            let removed = config.get_service(&instance_id.process).is_none();
+            let key = (instance_id.process.clone(), self.listed_id(&instance_id));
+            let unlisted = previously_listed.contains(&key) && !listed.contains(&key);
+            if removed || unlisted {
+                report.stopped.push(instance_id);
+            } else if changed.contains(&instance_id.process) {
+                report.restarted.push(instance_id);
+            }
+        }
+
+        let mut to_start: Vec<&(String, String)> = listed.difference(&previously_listed).collect();
+        to_start.sort();
+        report.started = to_start
+            .into_iter()
+            .map(|(process_name, id)| InstanceId::new(process_name, id))
+            .collect();
+        report
+    }
+
+    /// Re-read tenement.toml and `reload` it
+    pub async fn reload_from_source(&self) -> Result<ReloadReport> {
+        let config = self.config().reread()?;
+        self.reload(config).await
+    }
+
+    /// The `[instances]` ID an instance was started as: its own, or for a
+    /// replica, the instance it's a replica of
+    fn listed_id(&self, instance_id: &InstanceId) -> String {
+        let config = self.config();
+        match config.get_service(&instance_id.process) {
+            Some(svc) if svc.replica_index(&instance_id.id).is_some() => instance_id
+                .id
+                .rsplit_once('-')
+                .map_or(instance_id.id.clone(), |(listed, _)| listed.to_string()),
+            _ => instance_id.id.clone(),
+        }
+    }
+
+    /// Spawn instance if not running, and wait for it to be ready.
+    /// Returns the socket path. Use this for wake-on-request.
+    /// Uses the process's configured startup_timeout (default: 10s).
+    pub async fn spawn_and_wait(&self, process_name: &str, id: &str) -> Result<PathBuf> {
+        // A replicated instance wakes as a group and answers through its first replica
+        let replicas = self.replica_ids(process_name, id);
+        let id = match replicas.split_first() {
+            Some((first, rest)) => {
+                for replica in rest {
+                    self.spawn_if_not_running(process_name, replica).await?;
+                }
+                first.as_str()
+            }
+            None => id,
+        };
+        let instance_id = InstanceId::new(process_name, id);
+
+        // Wake-once pattern: if another request is already waking this instance,
+        // wait for it to finish instead of spawning a duplicate.
+        // Wake-once: if another request is already waking this instance, wait for it.
+        let maybe_notify = {
+            let waking = self.waking.read().await;
+            waking.get(&instance_id).cloned()
+        };
+        if let Some(notify) = maybe_notify {
+            // Register for notification BEFORE checking if spawn is done.
+            // This avoids missing the signal if it fires between our check and await.
+            let notified = notify.notified();
+            info!("Instance {} is already being woken, waiting", instance_id);
+            // Check if instance became available while we were setting up
+            if self.is_running(process_name, id).await {
+                self.touch_activity(process_name, id).await;
+                let info = self
+                    .get(process_name, id)
+                    .await
+                    .ok_or_else(|| anyhow::anyhow!("Instance {} disappeared", instance_id))?;
+                return Ok(info.socket);
+            }
+            notified.await;
+            if let Some(info) = self.get(process_name, id).await {
+                self.touch_activity(process_name, id).await;
+                return Ok(info.socket);
+            }
+            anyhow::bail!("Instance {} failed to wake", instance_id);
+        }
+
+        // We're the first to wake this instance. Register a Notify.
+        let notify = Arc::new(tokio::sync::Notify::new());
+        {
+            let mut waking = self.waking.write().await;
+            waking.insert(instance_id.clone(), notify.clone());
+        }
+
+        // Get the startup timeout from process config
+        let timeout_secs = self
+            .config()
+            .get_service(process_name)
+            .map(|p| p.startup_timeout)
+            .unwrap_or(10);
+
+        // spawn_if_not_running already waits for TCP/socket readiness via spawn()
+        let socket = self.spawn_if_not_running(process_name, id).await?;
+
+        // Get port info to determine readiness check method
+        let port = self.get(process_name, id).await.and_then(|info| info.port);
+
+        // Wait for service to be ready (check every 100ms)
+        // Try TCP first if port is available, fall back to socket existence
+        let iterations = (timeout_secs * 10) as usize;
+        let mut ready = false;
+        for _ in 0..iterations {
+            let is_ready = if let Some(port) = port {
+                // TCP mode: try to connect
+                if tokio::net::TcpStream::connect(format!("127.0.0.1:{}", port))
+                    .await
+                    .is_ok()
+                {
+                    true
+                } else {
+                    // Fall back to socket existence check (test stubs may not listen on TCP)
+                    socket_ready(&socket).await
+                }
+            } else {
+                socket_ready(&socket).await
+            };
+
+            if is_ready {
+                self.touch_activity(process_name, id).await;
+                ready = true;
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(100)).await;
+        }
+
+        // Hold the request until the service passes its health check, when it
+        // has one, so it isn't replayed against an app that's still booting
+        if ready {
+            let has_probe = self
+                .config()
+                .get_service(process_name)
+                .is_some_and(|process| process.has_health_probe());
+            if has_probe {
+                ready = self
+                    .wait_healthy(process_name, id, Duration::from_secs(timeout_secs))
+                    .await;
+            }
+        }
+
+        // Notify all waiters and remove the Notify
+        notify.notify_waiters();
+        {
+            let mut waking = self.waking.write().await;
+            waking.remove(&instance_id);
+        }
+
+        if ready {
+            Ok(socket)
+        } else {
+            anyhow::bail!(
+                "Instance {} failed to start within {} seconds",
+                instance_id,
+                timeout_secs
+            )
+        }
+    }
+
+    /// Poll an instance's health check until it passes, fails permanently, or
+    /// `timeout` runs out
+    async fn wait_healthy(&self, process_name: &str, id: &str, timeout: Duration) -> bool {
+        let start = Instant::now();
+        while start.elapsed() < timeout {
+            match self.check_health(process_name, id).await {
+                HealthStatus::Healthy => return true,
+                HealthStatus::Failed => return false,
+                _ => tokio::time::sleep(Duration::from_millis(100)).await,
+            }
+        }
+        false
+    }
+
+    /// Run a deploy (or rollback) in a task of its own, so it finishes even if
+    /// the request that started it goes away; shutdown waits for it. Refused
+    /// once shutdown has begun.
+    pub fn spawn_deploy<F>(&self, deploy: F) -> Result<tokio::task::JoinHandle<F::Output>>
+    where
+        F: std::future::Future + Send + 'static,
+        F::Output: Send + 'static,
+    {
+        let held = self
+            .deploys
+            .clone()
+            .try_read_owned()
+            .map_err(|_| anyhow::anyhow!("Shutting down; not starting a deploy"))?;
+        Ok(tokio::spawn(async move {
+            let _held = held;
+            deploy.await
+        }))
+    }
+
+    /// Run `process_name:version` as `pin` says from its next spawn on. Returns
+    /// the pin it replaces.
+    pub async fn pin_release(
+        &self,
+        process_name: &str,
+        version: &str,
+        pin: ReleasePin,
+    ) -> Option<ReleasePin> {
+        let instance_id = InstanceId::new(process_name, version);
+        self.persist_pin(&instance_id, Some(&pin)).await;
+        self.release_pins.write().unwrap().insert(instance_id, pin)
+    }
+
+    /// Undo [`pin_release`](Self::pin_release) after a deploy of the version
+    /// failed: put `previous` back, unless the version is running after all
+    pub async fn restore_pin(
+        &self,
+        process_name: &str,
+        version: &str,
+        previous: Option<ReleasePin>,
+    ) {
+        if self.get(process_name, version).await.is_some() {
+            return;
+        }
+        match previous {
+            Some(pin) => {
+                self.pin_release(process_name, version, pin).await;
+            }
+            None => self.unpin_release(process_name, version).await,
+        }
+    }
+
+    /// Forget a version's pin (and port) once it's gone for good (a torn-down
+    /// preview)
+    pub async fn unpin_release(&self, process_name: &str, version: &str) {
+        let instance_id = InstanceId::new(process_name, version);
+        self.release_pins.write().unwrap().remove(&instance_id);
+        self.persist_pin(&instance_id, None).await;
+        self.forget_port(&instance_id).await;
+    }
+
+    /// Save (or with None, forget) a version's pin in the state store
+    async fn persist_pin(&self, instance_id: &InstanceId, pin: Option<&ReleasePin>) {
+        let Some(store) = &self.state_store else {
+            return;
+        };
+        let key = instance_id.to_string();
+        let result = match pin {
+            Some(pin) => match serde_json::to_string(pin) {
+                Ok(json) => store.save_pin(&key, &json).await,
+                Err(e) => Err(e.into()),
+            },
+            None => store.remove_pin(&key).await,
+        };
+        if let Err(e) = result {
+            error!("Failed to persist release pin for {}: {}", instance_id, e);
+        }
+    }
+
+    /// Allocate `instance_id` a port: the one it was given before if that's
+    /// still free, else a new one that it keeps from then on
+    async fn assign_port(&self, instance_id: &InstanceId) -> Result<u16> {
+        let previous = self
+            .assigned_ports
+            .lock()
+            .unwrap()
+            .get(instance_id)
+            .copied();
+        if let Some(port) = previous {
+            if self.port_allocator.claim(port).await {
+                return Ok(port);
+            }
+            warn!(
+                "Port {} of {} is unavailable, assigning another",
+                port, instance_id
+            );
+        }
+        let port = self
+            .port_allocator
+            .allocate()
+            .await
+            .with_context(|| format!("Failed to allocate port for {}", instance_id))?;
+        self.keep_port(instance_id.clone(), port).await;
+        self.persist_port(instance_id, Some(port)).await;
+        Ok(port)
+    }
+
+    /// Record `port` as `instance_id`'s, in place of any port it had
+    async fn keep_port(&self, instance_id: InstanceId, port: u16) {
+        let released = {
+            let mut assigned = self.assigned_ports.lock().unwrap();
+            let previous = assigned.insert(instance_id, port);
+            // A port another instance took over (once none were free) stays held
+            previous.filter(|old| *old != port && !assigned.values().any(|p| p == old))
+        };
+        if let Some(old) = released {
+            self.port_allocator.unhold(old).await;
+        }
+        self.port_allocator.hold(port).await;
+    }
+
+    /// Forget the ports of instances whose service is no longer configured
+    async fn forget_unconfigured_ports(&self, config: &Config) {
+        let unconfigured: Vec<InstanceId> = self
+            .assigned_ports
+            .lock()
+            .unwrap()
+            .keys()
+            .filter(|id| config.get_service(&id.process).is_none())
+            .cloned()
+            .collect();
+        for instance_id in &unconfigured {
+            self.forget_port(instance_id).await;
+        }
+    }
+
+    /// Give up the port an instance was keeping, once it isn't coming back
+    async fn forget_port(&self, instance_id: &InstanceId) {
+        let released = {
+            let mut assigned = self.assigned_ports.lock().unwrap();
+            let Some(port) = assigned.remove(instance_id) else {
+                return;
+            };
+            // A port another instance took over (once none were free) stays held
+            (!assigned.values().any(|p| *p == port)).then_some(port)
+        };
+        if let Some(port) = released {
+            self.port_allocator.unhold(port).await;
+        }
+        self.persist_port(instance_id, None).await;
+    }
+
+    /// Stop a version that isn't coming back (replaced, rolled back, scaled
+    /// away), and give up its port
+    async fn retire(&self, process_name: &str, id: &str, drain: Duration) -> Result<()> {
+        let result = self.stop_with_drain(process_name, id, drain).await;
+        // A replicated instance's ports are its replicas'
+        let assigned: Vec<InstanceId> = self
+            .assigned_ports
+            .lock()
+            .unwrap()
+            .keys()
+            .filter(|i| i.process == process_name)
+            .cloned()
+            .collect();
+        for instance_id in assigned {
+            if instance_id.id == id || self.listed_id(&instance_id) == id {
+                self.forget_port(&instance_id).await;
+            }
+        }
+        result
+    }
+
+    async fn persist_port(&self, instance_id: &InstanceId, port: Option<u16>) {
+        let Some(store) = &self.state_store else {
+            return;
+        };
+        let key = instance_id.to_string();
+        let result = match port {
+            Some(port) => store.save_port(&key, port).await,
+            None => store.remove_port(&key).await,
+        };
+        if let Err(e) = result {
+            error!("Failed to persist port for {}: {}", instance_id, e);
+        }
+    }
+
+    /// Deploy a new instance version and wait for it to be healthy.
+    /// Used for blue/green and canary deployments.
+    ///
+    /// - Spawns the instance with the given version as the instance ID
+    /// - Sets the initial weight (default 100)
+    /// - Waits for health check to pass (timeout ~30s)
+    /// - Returns error if health check fails within timeout
+    pub async fn deploy_and_wait_healthy(
+        &self,
+        process_name: &str,
+        version: &str,
+        initial_weight: u8,
+        timeout_secs: u64,
+    ) -> Result<PathBuf> {
+        let result = self
+            .deploy_version(process_name, version, initial_weight, timeout_secs, None)
+            .await;
+        if result.is_ok() {
+            let instance = InstanceId::new(process_name, version);
+            if initial_weight == 0 {
+                // A canary or preview isn't deployed until it takes traffic
+                self.unannounced.lock().unwrap().insert(instance);
+            } else {
+                let data = serde_json::json!({ "version": version, "weight": initial_weight });
+                self.emit(Event::for_instance(EventKind::Deployed, &instance, data));
+            }
+            self.post_deploy(process_name, version).await;
+        }
+        result
+    }
+
+    /// `deploy_and_wait_healthy` in a "deploy" span, a child of `parent` when
+    /// it's a step of a replace
+    async fn deploy_version(
+        &self,
+        process_name: &str,
+        version: &str,
+        initial_weight: u8,
+        timeout_secs: u64,
+        parent: Option<TraceContext>,
+    ) -> Result<PathBuf> {
+        let span = self.deploy_span("deploy", process_name, version, parent.as_ref());
+        let result = self
+            .start_version(process_name, version, initial_weight, timeout_secs)
+            .await;
+        if let Some(span) = span {
+            span.end(&result);
+        }
+        result
+    }
+
+    /// Run `hooks.post_deploy` for a version that's now serving. The deploy
+    /// has happened by then, so a failure is only logged.
+    async fn post_deploy(&self, process_name: &str, version: &str) {
+        let hook = self.version_hook(HookKind::PostDeploy, process_name, version);
+        let Some(hook) = hook.await else {
+            return;
+        };
+        if let Err(e) = hook.run(&self.log_buffer).await {
+            let instance_id = InstanceId::new(process_name, version);
+            warn!(
+                "{} deployed, but its post_deploy hook failed: {:#}",
+                instance_id, e
+            );
+        }
+    }
+
+    /// A deploy step's hook, in the environment of the version being deployed
+    async fn version_hook(
+        &self,
+        kind: HookKind,
+        process_name: &str,
+        version: &str,
+    ) -> Option<BoundHook> {
+        let instance_id = InstanceId::new(process_name, version);
+        let mut process_config = self.config().get_service(process_name)?.clone();
+        process_config.hooks.get(kind)?;
+        if let Some(pin) = self.release_pins.read().unwrap().get(&instance_id) {
+            pin.apply(&mut process_config);
+        }
+        let port = self.get(process_name, version).await.and_then(|i| i.port);
+        let data_dir = &self.settings.data_dir;
+        let file_env = env_files::load(&process_config.env_files).unwrap_or_default();
+        let env = process_config.env_interpolated(file_env, process_name, version, data_dir, port);
+        hooks::bind(kind, &process_config, &instance_id, env)
+    }
+
+    /// A span for a deploy step, when tracing is on
+    fn deploy_span(
+        &self,
+        name: &str,
+        process_name: &str,
+        version: &str,
+        parent: Option<&TraceContext>,
+    ) -> Option<Span> {
+        self.tracer.as_ref().map(|tracer| {
+            let mut span = tracer.start(name, SpanKind::Internal, parent);
+            span.set("tenement.app", process_name);
+            span.set("tenement.version", version);
+            span
+        })
+    }
+
+    async fn start_version(
+        &self,
+        process_name: &str,
+        version: &str,
+        initial_weight: u8,
+        timeout_secs: u64,
+    ) -> Result<PathBuf> {
+        let instance_id = InstanceId::new(process_name, version);
+
+        let build = self.version_hook(HookKind::Build, process_name, version);
+        if let Some(hook) = build.await {
+            hook.run(&self.log_buffer)
+                .await
+                .with_context(|| format!("Deploy of {} aborted", instance_id))?;
+        }
+
+        // Spawn the instance
+        let socket = self.spawn(process_name, version).await?;
+
+        // Set initial weight
+        self.set_weight(process_name, version, initial_weight)
+            .await?;
+
+        // Traffic moves over next, and an unready instance would get none of it
+        let timeout = Duration::from_secs(timeout_secs);
+        let start = Instant::now();
+        let serving = self.wait_serving(process_name, version, timeout).await;
+        if serving.is_err() && start.elapsed() >= timeout {
+            // Timed out rather than failed for good: stop the unhealthy instance
+            let _ = self.retire(process_name, version, STOP_DRAIN).await;
+        }
+        serving.map(|()| socket)
+    }
+
+    /// Wait up to `timeout` for an instance to pass its health check, then
+    /// its readiness probe. Probing (and the timeout) starts once the
+    /// service's `initial_delay` has passed.
+    pub async fn wait_serving(
+        &self,
+        process_name: &str,
+        id: &str,
+        timeout: Duration,
+    ) -> Result<()> {
+        let instance_id = InstanceId::new(process_name, id);
+        let check_interval = Duration::from_millis(500);
+        let started_at = {
+            let instances = self.instances.read().await;
+            instances
+                .get(&instance_id)
+                .map(|instance| instance.started_at)
+        };
+        if let Some(started_at) = started_at {
+            let config = self.config();
+            let service = config.get_service(process_name);
+            tokio::time::sleep(boot_delay_left(service, started_at)).await;
+        }
+        let start = Instant::now();
+
+        while start.elapsed() < timeout {
+            let status = self.check_health(process_name, id).await;
+            match status {
+                HealthStatus::Healthy if self.check_readiness(process_name, id).await => {
+                    info!("Instance {} is healthy and ready", instance_id);
+                    return Ok(());
+                }
+                HealthStatus::Failed => {
+                    anyhow::bail!("Instance {} health check failed permanently", instance_id);
+                }
+                _ => {
+                    // Unknown, Degraded, or Unhealthy - keep waiting
+                    tokio::time::sleep(check_interval).await;
+                }
+            }
+        }
+        anyhow::bail!(
+            "Instance {} did not become healthy within {} seconds",
+            instance_id,
+            timeout.as_secs()
+        )
+    }
+
+    /// Restart an instance on purpose and wait up to `timeout` for it to serve
+    /// again ([`wait_serving`](Self::wait_serving)). Unlike a crash restart it
+    /// doesn't count toward backoff.
+    pub async fn restart_serving(
+        &self,
+        process_name: &str,
+        id: &str,
+        timeout: Duration,
+    ) -> Result<()> {
+        let _ = self.stop(process_name, id).await;
+        self.spawn(process_name, id).await?;
+        self.wait_serving(process_name, id, timeout).await
+    }
+
+    /// Replace a running version without dropping requests: start `to_version` on
+    /// its own socket with no traffic, wait for it to pass health checks, swap all
+    /// traffic to it, then drain `from_version` (up to `drain`) and stop it.
+    ///
+    /// The service's `deploy.strategy` changes the last steps: `blue-green` leaves
+    /// `from_version` running with no traffic, and `canary` first sends the new
+    /// version a share of traffic and watches its error rate.
+    ///
+    /// If the new version never becomes healthy (or fails its canary) it is
+    /// stopped and `from_version` keeps serving as before.
+    pub async fn deploy_replace(
+        &self,
+        process_name: &str,
+        from_version: &str,
+        to_version: &str,
+        timeout_secs: u64,
+        drain: Duration,
+    ) -> Result<PathBuf> {
+        let mut span = self.deploy_span("deploy.replace", process_name, to_version, None);
+        if let Some(span) = &mut span {
+            span.set("tenement.replaces", from_version);
+        }
+        let trace = span.as_ref().map(Span::context);
+        let result = self
+            .replace_version(
+                process_name,
+                from_version,
+                to_version,
+                timeout_secs,
+                drain,
+                trace,
+            )
+            .await;
+        if let Some(span) = span {
+            span.end(&result);
+        }
+        if result.is_ok() {
+            let data = serde_json::json!({ "version": to_version, "replaces": from_version });
+            let instance = InstanceId::new(process_name, to_version);
+            self.emit(Event::for_instance(EventKind::Deployed, &instance, data));
+            self.post_deploy(process_name, to_version).await;
+        }
+        result
+    }
+
+    async fn replace_version(
+        &self,
+        process_name: &str,
+        from_version: &str,
+        to_version: &str,
+        timeout_secs: u64,
+        drain: Duration,
+        trace: Option<TraceContext>,
+    ) -> Result<PathBuf> {
+        if from_version == to_version {
+            anyhow::bail!("New version must differ from the running one ({})", from_version);
+        }
+        let from_id = InstanceId::new(process_name, from_version);
+        if !self.instances.read().await.contains_key(&from_id) {
+            anyhow::bail!("Instance {} not found", from_id);
+        }
+
+        let deploy = self
+            .config()
+            .get_service(process_name)
+            .map(|svc| svc.deploy.clone())
+            .unwrap_or_default();
+
+        let socket = match self
+            .deploy_version(process_name, to_version, 0, timeout_secs, trace)
+            .await
+        {
+            Ok(socket) => socket,
+            Err(e) => {
+                warn!("Rolling back {}:{}: {}", process_name, to_version, e);
+                let _ = self.retire(process_name, to_version, STOP_DRAIN).await;
+                return Err(e.context(format!("Rolled back; {} is still serving", from_id)));
+            }
+        };
+
+        if deploy.strategy == DeployStrategy::Canary {
+            let from_weight = self
+                .get(process_name, from_version)
+                .await
+                .map_or(100, |i| i.weight);
+            let canary = self.run_canary(process_name, from_version, to_version, &deploy).await;
+            if let Err(e) = canary {
+                warn!(
+                    app = process_name,
+                    event = "canary-rollback",
+                    "Rolling back canary {}:{}: {}",
+                    process_name,
+                    to_version,
+                    e
+                );
+                self.set_weight(process_name, from_version, from_weight).await.ok();
+                self.set_weight(process_name, to_version, 0).await.ok();
+                let _ = self.retire(process_name, to_version, STOP_DRAIN).await;
+                return Err(e.context(format!("Canary rolled back; {} is serving", from_id)));
+            }
+        }
+
+        if let Err(e) = self.route_swap(process_name, from_version, to_version).await {
+            // The old version went away mid-deploy; the new one takes all traffic
+            warn!("Deploy of {}:{}: {}", process_name, to_version, e);
+            self.set_weight(process_name, to_version, 100).await?;
+            return Ok(socket);
+        }
+
+        if deploy.strategy == DeployStrategy::BlueGreen {
+            info!(
+                "Switched {} to {}:{}; {} keeps running with no traffic",
+                process_name, process_name, to_version, from_id
+            );
+            return Ok(socket);
+        }
+        self.retire(process_name, from_version, drain).await?;
+        info!("Replaced {} with {}:{}", from_id, process_name, to_version);
+        Ok(socket)
+    }
+
+    /// Give `to_version` `canary_percent` of traffic and watch the proxy's
+    /// counts of its requests and 5xx responses for `canary_duration`. Fails as
+    /// soon as its error rate goes over `max_error_rate` (once it has served
+    /// `min_requests`) or it stops or goes down; weights are left to the caller.
+    async fn run_canary(
+        &self,
+        process_name: &str,
+        from_version: &str,
+        to_version: &str,
+        deploy: &DeployConfig,
+    ) -> Result<()> {
+        let percent = deploy.canary_percent.min(100);
+        self.set_weight(process_name, from_version, 100 - percent).await?;
+        self.set_weight(process_name, to_version, percent).await?;
+        info!(
+            app = process_name,
+            event = "canary",
+            "Canary {}:{} takes {}% of traffic for {}s",
+            process_name,
+            to_version,
+            percent,
+            deploy.canary_duration
+        );
+
+        let mut labels = crate::metrics::Labels::new();
+        labels.insert("process".to_string(), process_name.to_string());
+        labels.insert("instance".to_string(), to_version.to_string());
+        let requests = self.metrics.requests_total.with_labels(&labels).await;
+        let errors = self.metrics.request_errors_total.with_labels(&labels).await;
+        // Counters outlive instances; only count what this deploy sees
+        let (requests_before, errors_before) = (requests.get(), errors.get());
+
+        let until = Instant::now() + Duration::from_secs(deploy.canary_duration);
+        loop {
+            let served = requests.get().saturating_sub(requests_before);
+            let failed = errors.get().saturating_sub(errors_before);
+            if served >= deploy.min_requests.max(1)
+                && failed as f64 > deploy.max_error_rate * served as f64
+            {
+                anyhow::bail!(
+                    "error rate {:.1}% over {} requests is above max_error_rate {:.1}%",
+                    failed as f64 * 100.0 / served as f64,
+                    served,
+                    deploy.max_error_rate * 100.0
+                );
+            }
+            match self.get(process_name, to_version).await {
+                None => anyhow::bail!("{}:{} stopped during its canary", process_name, to_version),
+                Some(info) if info.health.is_down() => anyhow::bail!(
+                    "{}:{} went {} during its canary",
+                    process_name,
+                    to_version,
+                    info.health
+                ),
+                Some(_) => {}
+            }
+            let left = until.saturating_duration_since(Instant::now());
+            if left.is_zero() {
+                info!(
+                    app = process_name,
+                    event = "canary-promote",
+                    "Canary {}:{} passed: {} error(s) in {} request(s)",
+                    process_name,
+                    to_version,
+                    failed,
+                    served
+                );
+                return Ok(());
+            }
+            tokio::time::sleep(left.min(CANARY_CHECK_INTERVAL)).await;
+        }
+    }
+
+    /// Atomically swap traffic weights between two versions.
+    /// Sets `from_version` weight to 0 and `to_version` weight to 100.
+    /// Used for blue/green instant cutover.
+    ///
+    /// Returns error if either version is not running.
+    pub async fn route_swap(
+        &self,
+        process_name: &str,
+        from_version: &str,
+        to_version: &str,
+    ) -> Result<()> {
+        let from_id = InstanceId::new(process_name, from_version);
+        let to_id = InstanceId::new(process_name, to_version);
+
+        // Acquire write lock and update both weights atomically
+        let mut instances = self.instances.write().await;
+
+        // Verify both instances exist
+        if !instances.contains_key(&from_id) {
+            anyhow::bail!("Instance {} not found", from_id);
+        }
+        if !instances.contains_key(&to_id) {
+            anyhow::bail!("Instance {} not found", to_id);
+        }
+
+        // Atomically update weights
+        if let Some(from_instance) = instances.get_mut(&from_id) {
+            from_instance.weight = 0;
+        }
+        if let Some(to_instance) = instances.get_mut(&to_id) {
+            to_instance.weight = 100;
+        }
+
+        info!(
+            "Traffic swap complete: {} weight=0, {} weight=100",
+            from_id, to_id
+        );
+        drop(instances);
+        self.announce_traffic(&to_id, 100);
+
+        Ok(())
+    }
+
+    /// Publish the deploy of a version deployed at weight 0, now that it has
+    /// been given `weight`
+    fn announce_traffic(&self, instance_id: &InstanceId, weight: u8) {
+        if weight > 0 && self.unannounced.lock().unwrap().remove(instance_id) {
+            let data = serde_json::json!({ "version": instance_id.id, "weight": weight });
+            self.emit(Event::for_instance(EventKind::Deployed, instance_id, data));
+        }
+    }
+}
+
+/// Random pick in proportion to weight; None if every weight is 0
+fn weighted_choice(candidates: Vec<InstanceInfo>) -> Option<InstanceInfo> {
+    use rand::Rng;
+
+    // Calculate total weight
+    let total_weight: u32 = candidates.iter().map(|i| i.weight as u32).sum();
+    if total_weight == 0 {
+        return None;
+    }
+
+    // Pick a random point in the weight space
+    let mut rng = rand::thread_rng();
+    let point = rng.gen_range(0..total_weight);
+
+    // Find the instance at that point
+    let mut cumulative = 0u32;
+    for instance in candidates {
+        cumulative += instance.weight as u32;
+        if point < cumulative {
+            return Some(instance);
+        }
+    }
+
+    // Fallback (shouldn't happen)
+    None
+}
+
+/// `weight` scaled by how far an instance is into its slow-start `window`,
+/// from when it first reported ready. Never below 1, so a lone new instance
+/// is still picked.
+fn slow_start_weight(weight: u8, ready_for: Option<Duration>, window: Duration) -> u8 {
+    let elapsed = ready_for.unwrap_or_default();
+    if elapsed >= window {
+        return weight;
+    }
+    let share = elapsed.as_secs_f64() / window.as_secs_f64();
+    ((weight as f64 * share) as u8).max(1)
+}
+
+/// What's left of a service's health check `initial_delay` for an instance
+/// started at `started_at`
+fn boot_delay_left(service: Option<&ProcessConfig>, started_at: Instant) -> Duration {
+    let delay = service.and_then(|svc| svc.health_check.initial_delay);
+    Duration::from_secs(delay.unwrap_or(0)).saturating_sub(started_at.elapsed())
+}
+
+/// Take up to a fifth off a backoff delay, so instances that failed together
+/// don't all restart in lockstep
+fn jitter(delay: Duration) -> Duration {
+    use rand::Rng;
+
+    let spread = delay.as_millis() as u64 / 5;
+    if spread == 0 {
+        return delay;
+    }
+    delay - Duration::from_millis(rand::thread_rng().gen_range(0..=spread))
+}
+
+/// What one health check does, resolved from the service config
+enum HealthProbe<'a> {
+    Http(&'a str),
+    Tcp,
+    Exec(&'a str),
+}
+
+impl HealthProbe<'_> {
+    /// The probe's `health_check.type`
+    fn name(&self) -> &'static str {
+        match self {
+            HealthProbe::Http(_) => "http",
+            HealthProbe::Tcp => "tcp",
+            HealthProbe::Exec(_) => "exec",
+        }
+    }
+}
+
+/// Where a probe reaches an instance, copied out of it while the probe runs
+struct ProbeTarget {
+    socket: PathBuf,
+    vsock_port: Option<u32>,
+    port: Option<u16>,
+    /// Identifies the run probed, so a result that outlives a restart is dropped
+    started_at: Instant,
+}
+
+impl ProbeTarget {
+    fn of(instance: &Instance) -> Self {
+        Self {
+            socket: instance.handle.socket().clone(),
+            vsock_port: instance.handle.vsock_port(),
+            port: instance.port,
+            started_at: instance.started_at,
+        }
+    }
+}
+
+/// `type = "tcp"` probe: connect to the instance's port, or its socket if it has none
+async fn probe_connect(port: Option<u16>, socket: &Path, timeout: Duration) -> Result<()> {
+    match port {
+        Some(port) => {
+            let addr = format!("127.0.0.1:{}", port);
+            tokio::time::timeout(timeout, tokio::net::TcpStream::connect(&addr))
+                .await
+                .context("TCP connection timeout")?
+                .context("Failed to connect")?;
+        }
+        None => {
+            tokio::time::timeout(timeout, sockets::connect(socket))
+                .await
+                .context("Connection timeout")?
+                .context("Failed to connect")?;
+        }
+    }
+    Ok(())
+}
+
+/// `type = "exec"` probe: healthy if the command exits 0 within `timeout`
+async fn run_health_command(
+    command: &str,
+    instance_id: &InstanceId,
+    port: Option<u16>,
+    socket: &Path,
+    timeout: Duration,
+) -> Result<()> {
+    let mut cmd = tokio::process::Command::new("sh");
+    cmd.arg("-c")
+        .arg(command)
+        .env("TENEMENT_INSTANCE", instance_id.to_string())
+        .env("SOCKET_PATH", sockets::address(socket))
+        .stdin(std::process::Stdio::null())
+        .stdout(std::process::Stdio::null())
+        .stderr(std::process::Stdio::piped())
+        .kill_on_drop(true);
+    if let Some(port) = port {
+        cmd.env("PORT", port.to_string());
+    }
+
+    let output = tokio::time::timeout(timeout, cmd.output())
+        .await
+        .context("Health command timed out")?
+        .context("Failed to run health command")?;
+    if output.status.success() {
+        return Ok(());
+    }
+    let stderr = String::from_utf8_lossy(&output.stderr);
+    match stderr.lines().rev().find(|line| !line.trim().is_empty()) {
+        Some(line) => anyhow::bail!("Health command {}: {}", output.status, line.trim()),
+        None => anyhow::bail!("Health command {}", output.status),
+    }
+}
+
+/// What `process_name:id` depends on, transitively, each after its own
+/// dependencies, as (service, instance id, edge)
+fn dependency_order(
+    config: &Config,
+    process_name: &str,
+    id: &str,
+    seen: &mut std::collections::HashSet<(String, String)>,
+    order: &mut Vec<(String, String, Dependency)>,
+) {
+    let Some(service) = config.get_service(process_name) else {
+        return;
+    };
+    for (dependency, edge) in &service.depends_on {
+        let dependency_id = edge.id.clone().unwrap_or_else(|| id.to_string());
+        if seen.insert((dependency.clone(), dependency_id.clone())) {
+            dependency_order(config, dependency, &dependency_id, seen, order);
+            order.push((dependency.clone(), dependency_id, edge.clone()));
+        }
+    }
+}
+
+/// The TENEMENT_* variables that tell an instance what it is
+fn metadata_env(
+    instance_id: &InstanceId,
+    release: Option<u32>,
+    socket: &Path,
+) -> Vec<(String, String)> {
+    let socket_dir = socket.parent().unwrap_or(socket);
+    let release = release.map_or_else(|| instance_id.id.clone(), |n| n.to_string());
+    vec![
+        ("TENEMENT_APP".to_string(), instance_id.process.clone()),
+        ("TENEMENT_RELEASE".to_string(), release),
+        ("TENEMENT_INSTANCE".to_string(), instance_id.to_string()),
+        (
+            "TENEMENT_SOCKET_DIR".to_string(),
+            socket_dir.to_string_lossy().to_string(),
+        ),
+    ]
+}
+
+/// Empty (or create) an instance's scratch directory
+fn reset_tmp_dir(path: &std::path::Path) -> Result<()> {
+    match std::fs::remove_dir_all(path) {
+        Ok(()) => {}
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => {}
+        Err(e) => {
+            return Err(e).with_context(|| format!("Failed to clear temp dir: {:?}", path));
+        }
+    }
+    std::fs::create_dir_all(path).with_context(|| format!("Failed to create temp dir: {:?}", path))
+}
+
+/// Whether the live process at a recorded pid is the one recorded, not a later
+/// process given a reused pid: it must have started before the record was made
+fn is_recorded_process(state: &crate::store::InstanceState) -> bool {
+    let recorded = chrono::DateTime::parse_from_rfc3339(&state.started_at);
+    let started = crate::metrics::process_started_at(state.pid);
+    match (recorded, started) {
+        // Start times are whole seconds
+        (Ok(recorded), Some(started)) => started <= recorded + chrono::Duration::seconds(1),
+        _ => false,
+    }
+}
+
+/// Whether an instance's socket is up. On Unix that's the file existing; a
+/// named pipe has no file, so there it means accepting a connection.
+async fn socket_ready(socket: &Path) -> bool {
+    #[cfg(unix)]
+    return socket.exists();
+    #[cfg(not(unix))]
+    return crate::sockets::connect(socket).await.is_ok();
+}
+
+/// Give an instance's new socket the owner and mode its service asks for. An
+/// app running as its own user has the socket restricted to that user first.
+fn secure_socket(
+    socket: &Path,
+    run_as: Option<&users::RunAs>,
+    owner: users::SocketOwner,
+    mode: Option<u32>,
+) -> Result<()> {
+    if let Some(run_as) = run_as {
+        run_as.restrict_socket(socket)?;
+    }
+    owner.apply(socket)?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        if let Some(mode) = mode {
+            std::fs::set_permissions(socket, std::fs::Permissions::from_mode(mode))
+                .with_context(|| format!("Failed to set mode of socket {}", socket.display()))?;
+        }
+    }
+    #[cfg(not(unix))]
+    let _ = mode;
+    Ok(())
+}
+
+/// The mode to give `process_name`'s socket: `unix_socket.mode` if set. A
+/// service other services reach over the mesh gets owner-only when nothing
+/// else was asked for, so local users can't connect around its `uses` check.
+fn socket_mode(
+    config: &Config,
+    process_name: &str,
+    mode: Option<u32>,
+    owner: users::SocketOwner,
+) -> Option<u32> {
+    if mode.is_some() || owner != users::SocketOwner::default() {
+        return mode;
+    }
+    mesh::consumers(config)
+        .contains_key(process_name)
+        .then_some(0o600)
+}
+
+/// Rewrite an instance's secrets file and signal the app to re-read it
+fn signal_secrets_reload(
+    data_dir: &std::path::Path,
+    values: &std::collections::BTreeMap<String, String>,
+    signal: &str,
+    pid: Option<u32>,
+) -> Result<()> {
+    let signal = secrets::parse_signal(signal)?;
+    let pid = pid.context("instance has no process to signal")?;
+    secrets::write_env_file(&data_dir.join(secrets::SECRETS_FILE_NAME), values)?;
+
+    #[cfg(unix)]
+    {
+        if unsafe { libc::kill(pid as i32, signal) } != 0 {
+            return Err(std::io::Error::last_os_error())
+                .with_context(|| format!("Failed to signal pid {}", pid));
+        }
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = (pid, signal);
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::{AutoscaleConfig, CircuitBreakerConfig, SecretSource};
+    use crate::instance::{InstanceStatus, CRASH_LOOP_RESTARTS};
+    use std::collections::HashMap;
+    use std::path::Path;
+    use tempfile::TempDir;
+
+    // Helper to create a test config with a simple echo server process
+    fn test_config_with_process(name: &str, command: &str, args: Vec<&str>) -> Config {
+        let test_id = format!("{}-{}", std::process::id(), rand::random::<u32>());
+        let mut config = Config::default();
+        config.settings.data_dir = std::env::temp_dir().join(format!("tenement-test-{}", test_id));
+
+        let process = ProcessConfig {
+            command: command.to_string(),
+            args: args.into_iter().map(|s| s.to_string()).collect(),
+            socket: format!("/tmp/tenement-test-{}/{{name}}-{{id}}.sock", test_id),
+            unix_socket: Default::default(),
+            connection_pool: Default::default(),
+            isolation: RuntimeType::Process,
+            health: None,
+            env: HashMap::new(),
+            workdir: None,
+            mounts: Vec::new(),
+            image: None,
+            restart: "on-failure".to_string(),
+            idle_timeout: None,
+            startup_timeout: 5,
+            request_timeout: 30,
+            memory_limit_mb: None,
+            cpu_shares: None,
+            kernel: None,
+            rootfs: None,
+            memory_mb: 256,
+            vcpus: 1,
+            vsock_port: 5000,
+            storage_quota_mb: None,
+            storage_persist: false,
+            secrets: HashMap::new(),
+            reload_signal: None,
+            fault: None,
+            concurrency_weight: 1,
+            shell: None,
+            health_check: Default::default(),
+            readiness: None,
+            warm_connections: 0,
+            log_rate_limit: None,
+            tmp_dir: false,
+            required_env: Vec::new(),
+            redact_env: Vec::new(),
+            stop_signal: None,
+            stop_timeout: None,
+            stop_process_group: true,
+            post_stop: None,
+            post_stop_timeout: 10,
+            hooks: Default::default(),
+            domains: Vec::new(),
+            replicas: 1,
+            load_balance: Default::default(),
+            slow_start: None,
+            autoscale: None,
+            access: None,
+            compression: None,
+            cache: None,
+            preview: None,
+            env_files: Vec::new(),
+            log_sinks: Vec::new(),
+            limits: Default::default(),
+            filesystem: Default::default(),
+            egress: None,
+            volumes: Default::default(),
+            listen: None,
+            user: None,
+            group: None,
+            depends_on: Default::default(),
+            stack: None,
+            uses: Vec::new(),
+            middleware: Vec::new(),
+            deploy: Default::default(),
+            git: None,
+            stream_idle_timeout: None,
+            protocol: Default::default(),
+            rate_limit: None,
+            max_concurrency: None,
+            max_queue: None,
+            queue_timeout_ms: None,
+            retry: None,
+            circuit_breaker: None,
+            maintenance_page: None,
+            kind: Default::default(),
+            root: None,
+            spa: false,
+            cache_max_age: 3600,
+            access_log: None,
+        };
+
+        config.service.insert(name.to_string(), process);
+        config
+    }
+
+    // Helper to create a shell script that creates a socket and waits
+    #[allow(dead_code)]
+    fn create_socket_server_script(dir: &Path) -> PathBuf {
+        let script_path = dir.join("server.sh");
+        let script = r#"#!/bin/bash
+SOCKET_PATH="${SOCKET_PATH:-/tmp/test.sock}"
+rm -f "$SOCKET_PATH"
+# Create socket using nc (netcat) - listens and responds
+# Use socat if available, otherwise use a simple approach
+if command -v socat &> /dev/null; then
+    socat UNIX-LISTEN:"$SOCKET_PATH",fork EXEC:"echo HTTP/1.1 200 OK"
+elif command -v nc &> /dev/null; then
+    while true; do
+        echo -e "HTTP/1.1 200 OK\r\n\r\nOK" | nc -lU "$SOCKET_PATH" -q0 2>/dev/null || break
+    done
+else
+    # Fallback: just create the socket file and sleep
+    python3 -c "
+import socket
+import os
+sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
+sock.bind('$SOCKET_PATH')
+sock.listen(1)
+while True:
+    conn, _ = sock.accept()
+    conn.sendall(b'HTTP/1.1 200 OK\r\n\r\nOK')
+    conn.close()
+" 2>/dev/null &
+    sleep infinity
+fi
+"#;
+        std::fs::write(&script_path, script).unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        script_path
+    }
+
+    // Helper to create a simple process that touches a socket file
+    fn create_touch_socket_script(dir: &Path) -> PathBuf {
+        let script_path = dir.join("touch_socket.sh");
+        let script = r#"#!/bin/bash
+SOCKET_PATH="${SOCKET_PATH:-/tmp/test.sock}"
+rm -f "$SOCKET_PATH"
+touch "$SOCKET_PATH"
+sleep 30
+"#;
+        std::fs::write(&script_path, script).unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        script_path
+    }
+
+    // ===================
+    // BACKOFF TESTS
+    // ===================
+
+    #[test]
+    fn test_calculate_backoff() {
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+
+        // Default settings: base=1000ms, max=60000ms
+
+        // 0 restarts = no delay
+        assert_eq!(hypervisor.calculate_backoff(0), Duration::ZERO);
+
+        // 1 restart = 1000ms (1s)
+        assert_eq!(hypervisor.calculate_backoff(1), Duration::from_millis(1000));
+
+        // 2 restarts = 2000ms (2s)
+        assert_eq!(hypervisor.calculate_backoff(2), Duration::from_millis(2000));
+
+        // 3 restarts = 4000ms (4s)
+        assert_eq!(hypervisor.calculate_backoff(3), Duration::from_millis(4000));
+
+        // 4 restarts = 8000ms (8s)
+        assert_eq!(hypervisor.calculate_backoff(4), Duration::from_millis(8000));
+
+        // 5 restarts = 16000ms (16s)
+        assert_eq!(
+            hypervisor.calculate_backoff(5),
+            Duration::from_millis(16000)
+        );
+
+        // 6 restarts = 32000ms (32s)
+        assert_eq!(
+            hypervisor.calculate_backoff(6),
+            Duration::from_millis(32000)
+        );
+
+        // 7 restarts = 64000ms but capped at 60000ms (60s max)
+        assert_eq!(
+            hypervisor.calculate_backoff(7),
+            Duration::from_millis(60000)
+        );
+
+        // Large values stay capped
+        assert_eq!(
+            hypervisor.calculate_backoff(100),
+            Duration::from_millis(60000)
+        );
+    }
+
+    #[test]
+    fn test_calculate_backoff_custom_settings() {
+        let mut config = Config::default();
+        config.settings.backoff_base_ms = 500;
+        config.settings.backoff_max_ms = 5000;
+        let hypervisor = Hypervisor::new(config);
+
+        // 1 restart = 500ms
+        assert_eq!(hypervisor.calculate_backoff(1), Duration::from_millis(500));
+
+        // 2 restarts = 1000ms
+        assert_eq!(hypervisor.calculate_backoff(2), Duration::from_millis(1000));
+
+        // 4 restarts = 4000ms
+        assert_eq!(hypervisor.calculate_backoff(4), Duration::from_millis(4000));
+
+        // 5 restarts = 8000ms but capped at 5000ms
+        assert_eq!(hypervisor.calculate_backoff(5), Duration::from_millis(5000));
+    }
+
+    #[test]
+    fn test_calculate_backoff_overflow_protection() {
+        let mut config = Config::default();
+        config.settings.backoff_base_ms = u64::MAX;
+        config.settings.backoff_max_ms = u64::MAX;
+        let hypervisor = Hypervisor::new(config);
+
+        // Should not panic or overflow, should saturate
+        let result = hypervisor.calculate_backoff(100);
+        assert_eq!(result, Duration::from_millis(u64::MAX));
+    }
+
+    #[test]
+    fn test_calculate_backoff_zero_base() {
+        let mut config = Config::default();
+        config.settings.backoff_base_ms = 0;
+        config.settings.backoff_max_ms = 1000;
+        let hypervisor = Hypervisor::new(config);
+
+        // 0 * 2^n = 0
+        assert_eq!(hypervisor.calculate_backoff(1), Duration::ZERO);
+        assert_eq!(hypervisor.calculate_backoff(5), Duration::ZERO);
+    }
+
+    // ===================
+    // LIFECYCLE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_spawn_process_instance() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("test-api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        let result = hypervisor.spawn("test-api", "instance1").await;
+        assert!(result.is_ok(), "Spawn should succeed: {:?}", result.err());
+
+        // Verify instance is tracked
+        assert!(hypervisor.is_running("test-api", "instance1").await);
+
+        // Clean up
+        hypervisor.stop("test-api", "instance1").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_creates_instance_entry() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        // Initially empty
+        let list = hypervisor.list().await;
+        assert!(list.is_empty());
+
+        // Spawn
+        hypervisor.spawn("api", "user1").await.unwrap();
+
+        // Should appear in list
+        let list = hypervisor.list().await;
+        assert_eq!(list.len(), 1);
+        assert_eq!(list[0].id.process, "api");
+        assert_eq!(list[0].id.id, "user1");
+
+        // Clean up
+        hypervisor.stop("api", "user1").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_returns_socket_path() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("myapp", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        let socket = hypervisor.spawn("myapp", "prod").await.unwrap();
+        assert!(socket.to_string_lossy().contains("myapp"));
+        assert!(socket.to_string_lossy().contains("prod"));
+
+        hypervisor.stop("myapp", "prod").await.ok();
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_spawn_clears_stale_socket_but_not_a_live_one() {
+        use std::os::unix::net::UnixListener;
+
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let mut config = test_config_with_process("myapp", script.to_str().unwrap(), vec![]);
+        let service = config.service.get_mut("myapp").unwrap();
+        service.unix_socket.dir = Some(dir.path().join("sockets").display().to_string());
+        let socket = service.socket_path("myapp", "prod");
+        std::fs::create_dir_all(socket.parent().unwrap()).unwrap();
+        let hypervisor = Hypervisor::new(config);
+
+        // Another process still serves the path: the spawn is refused
+        let live = UnixListener::bind(&socket).unwrap();
+        let err = hypervisor.spawn("myapp", "prod").await.unwrap_err();
+        assert!(format!("{:#}", err).contains("in use"), "{:#}", err);
+        assert!(hypervisor.get("myapp", "prod").await.is_none());
+
+        // Left behind by a crash: removed, and the instance starts
+        drop(live);
+        assert_eq!(hypervisor.spawn("myapp", "prod").await.unwrap(), socket);
+        hypervisor.stop("myapp", "prod").await.ok();
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_secure_socket_sets_owner_and_mode() {
+        use std::os::unix::fs::{MetadataExt, PermissionsExt};
+
+        let dir = TempDir::new().unwrap();
+        let socket = dir.path().join("api.sock");
+        let _listener = std::os::unix::net::UnixListener::bind(&socket).unwrap();
+        let (uid, gid) = unsafe { (libc::geteuid(), libc::getegid()) };
+        let owner = users::SocketOwner {
+            uid: Some(uid),
+            gid: Some(gid),
+        };
+
+        secure_socket(&socket, None, owner, Some(0o640)).unwrap();
+        let metadata = std::fs::metadata(&socket).unwrap();
+        assert_eq!(metadata.permissions().mode() & 0o777, 0o640);
+        assert_eq!((metadata.uid(), metadata.gid()), (uid, gid));
+
+        // Nothing asked for: left as the app created it
+        secure_socket(&socket, None, Default::default(), None).unwrap();
+        let mode = std::fs::metadata(&socket).unwrap().permissions().mode();
+        assert_eq!(mode & 0o777, 0o640);
+    }
+
+    #[test]
+    fn test_socket_mode_is_private_for_used_services() {
+        let config = Config::from_str(
+            r#"
+[service.db]
+command = "./db"
+
+[service.api]
+command = "./api"
+uses = ["db"]
+"#,
+        )
+        .unwrap();
+        let owner = users::SocketOwner::default();
+        assert_eq!(socket_mode(&config, "db", None, owner), Some(0o600));
+        assert_eq!(socket_mode(&config, "api", None, owner), None);
+        // Whatever the config asks for wins
+        assert_eq!(socket_mode(&config, "db", Some(0o660), owner), Some(0o660));
+        let group = users::SocketOwner {
+            uid: None,
+            gid: Some(33),
+        };
+        assert_eq!(socket_mode(&config, "db", None, group), None);
+    }
+
+    #[tokio::test]
+    async fn test_spawn_with_command_string_shell_splits() {
+        // When command is "echo hello world" with no explicit args,
+        // it should be shell-split into command="echo", args=["hello", "world"]
+        let config = test_config_with_process("api", "echo hello world", vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        let result = hypervisor.spawn("api", "test").await;
+        assert!(
+            result.is_ok(),
+            "Shell-split command should spawn: {:?}",
+            result.err()
+        );
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_with_explicit_args_no_split() {
+        // When args are explicitly provided, command should NOT be split
+        let config = test_config_with_process("api", "echo", vec!["hello", "world"]);
+        let hypervisor = Hypervisor::new(config);
+
+        let result = hypervisor.spawn("api", "test").await;
+        assert!(
+            result.is_ok(),
+            "Explicit args should spawn: {:?}",
+            result.err()
+        );
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_with_interpolation_and_shell_split() {
+        // Command with interpolation vars should be interpolated first, then shell-split
+        let config = test_config_with_process("api", "echo --id {id} --name {name}", vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        // Should interpolate to "echo --id user123 --name api" then split into
+        // command="echo", args=["--id", "user123", "--name", "api"]
+        let result = hypervisor.spawn("api", "user123").await;
+        assert!(
+            result.is_ok(),
+            "Interpolated+split command should spawn: {:?}",
+            result.err()
+        );
+
+        hypervisor.stop("api", "user123").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_stop_instance() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        assert!(hypervisor.is_running("api", "test").await);
+
+        let result = hypervisor.stop("api", "test").await;
+        assert!(result.is_ok());
+        assert!(!hypervisor.is_running("api", "test").await);
+    }
+
+    #[tokio::test]
+    async fn test_stop_nonexistent_instance_returns_error() {
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+
+        let result = hypervisor.stop("nonexistent", "id").await;
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("not found"));
+    }
+
+    #[tokio::test]
+    async fn test_list_instances() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        // Spawn multiple instances
+        hypervisor.spawn("api", "user1").await.unwrap();
+        hypervisor.spawn("api", "user2").await.unwrap();
+
+        let list = hypervisor.list().await;
+        assert_eq!(list.len(), 2);
+
+        // Verify both are present
+        let ids: Vec<String> = list.iter().map(|i| i.id.id.clone()).collect();
+        assert!(ids.contains(&"user1".to_string()));
+        assert!(ids.contains(&"user2".to_string()));
+
+        // Clean up
+        hypervisor.stop("api", "user1").await.ok();
+        hypervisor.stop("api", "user2").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_get_instance() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "user1").await.unwrap();
+
+        let info = hypervisor.get("api", "user1").await;
+        assert!(info.is_some());
+        let info = info.unwrap();
+        assert_eq!(info.id.process, "api");
+        assert_eq!(info.id.id, "user1");
+
+        // Non-existent should return None
+        assert!(hypervisor.get("api", "nonexistent").await.is_none());
+
+        hypervisor.stop("api", "user1").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_if_not_running() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        // First call spawns
+        let socket1 = hypervisor
+            .spawn_if_not_running("api", "test")
+            .await
+            .unwrap();
+
+        // Second call returns existing socket without spawning again
+        let socket2 = hypervisor
+            .spawn_if_not_running("api", "test")
+            .await
+            .unwrap();
+        assert_eq!(socket1, socket2);
+
+        // Only one instance in list
+        let list = hypervisor.list().await;
+        assert_eq!(list.len(), 1);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_already_running_returns_socket() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        let socket1 = hypervisor.spawn("api", "test").await.unwrap();
+        let socket2 = hypervisor.spawn("api", "test").await.unwrap();
+
+        // Both return same socket (idempotent)
+        assert_eq!(socket1, socket2);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    // ===================
+    // ERROR PATH TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_spawn_unknown_process_returns_error() {
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+
+        let result = hypervisor.spawn("nonexistent", "id").await;
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("Unknown process"));
+    }
+
+    #[tokio::test]
+    async fn test_spawn_command_not_found() {
+        let config = test_config_with_process("api", "/nonexistent/binary", vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        let result = hypervisor.spawn("api", "test").await;
+        assert!(result.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_has_process() {
+        let config = test_config_with_process("myapi", "sleep", vec!["1"]);
+        let hypervisor = Hypervisor::new(config);
+
+        assert!(hypervisor.has_process("myapi"));
+        assert!(!hypervisor.has_process("unknown"));
+    }
+
+    // ===================
+    // RESTART TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_restart_instance() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        // Use zero backoff for faster tests
+        config.settings.backoff_base_ms = 0;
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Restart
+        let result = hypervisor.restart("api", "test").await;
+        assert!(result.is_ok());
+
+        // Should still be running
+        assert!(hypervisor.is_running("api", "test").await);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_restart_increments_counter() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.settings.backoff_base_ms = 0;
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Check initial restart count
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.restarts, 0);
+
+        // Restart
+        hypervisor.restart("api", "test").await.unwrap();
+
+        // Restart count should be 1
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.restarts, 1);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_repeated_restarts_mark_crash_looping() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.settings.backoff_base_ms = 0;
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        for _ in 0..CRASH_LOOP_RESTARTS - 1 {
+            hypervisor.restart("api", "test").await.unwrap();
+        }
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.status, InstanceStatus::Running);
+
+        hypervisor.restart("api", "test").await.unwrap();
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.status, InstanceStatus::CrashLooping);
+        assert_eq!(info.restarts, CRASH_LOOP_RESTARTS as u32);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_backoff_resets_after_stable_run() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.settings.backoff_base_ms = 0;
+        config.settings.backoff_reset_secs = 1;
+        let hypervisor = Hypervisor::new(config);
+
+        // Five restarts, the last one longer ago than the reset window
+        let id = InstanceId::new("api", "test");
+        let long_ago = Instant::now() - Duration::from_secs(5);
+        hypervisor
+            .restart_history
+            .write()
+            .await
+            .insert(id.clone(), (5, vec![long_ago]));
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        hypervisor.restart("api", "test").await.unwrap();
+
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.restarts, 1);
+        assert_eq!(info.status, InstanceStatus::Running);
+        let history = hypervisor.restart_history.read().await;
+        assert_eq!(history[&id].1.len(), 1);
+        drop(history);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[test]
+    fn test_jitter_stays_within_a_fifth() {
+        let delay = Duration::from_secs(10);
+        for _ in 0..100 {
+            let jittered = jitter(delay);
+            assert!(jittered <= delay);
+            assert!(jittered >= Duration::from_secs(8));
+        }
+        assert_eq!(jitter(Duration::ZERO), Duration::ZERO);
+        assert_eq!(jitter(Duration::from_millis(3)), Duration::from_millis(3));
+    }
+
+    // ===================
+    // ACTIVITY TRACKING TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_touch_activity() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Wait a bit
+        tokio::time::sleep(Duration::from_millis(50)).await;
+
+        // Get idle time before touch
+        let info_before = hypervisor.get("api", "test").await.unwrap();
+        let idle_before = info_before.idle_secs;
+
+        // Touch activity
+        hypervisor.touch_activity("api", "test").await;
+
+        // Idle time should reset (or be very small)
+        let info_after = hypervisor.get("api", "test").await.unwrap();
+        assert!(info_after.idle_secs <= idle_before);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_get_and_touch_running_instance() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Wait a bit so idle time accumulates
+        tokio::time::sleep(Duration::from_millis(50)).await;
+
+        // get_and_touch should return Some and reset activity
+        let info = hypervisor.get_and_touch("api", "test").await;
+        assert!(info.is_some());
+        let info = info.unwrap();
+        assert_eq!(info.id.process, "api");
+        assert_eq!(info.id.id, "test");
+
+        // Idle time should be reset (very small after touch)
+        assert!(info.idle_secs < 1);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_get_and_touch_nonexistent_instance() {
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+
+        // Non-existent instance should return None
+        let info = hypervisor.get_and_touch("api", "nonexistent").await;
+        assert!(info.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_get_and_touch_is_atomic() {
+        // This test verifies get_and_touch provides instance info AND touches activity
+        // in a single operation (vs separate is_running + touch_activity + get calls)
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Wait so idle time > 0
+        tokio::time::sleep(Duration::from_millis(100)).await;
+
+        // Record time before
+        let before_info = hypervisor.get("api", "test").await.unwrap();
+        let idle_before = before_info.idle_secs;
+
+        // Wait a bit more
+        tokio::time::sleep(Duration::from_millis(50)).await;
+
+        // get_and_touch should touch activity
+        let touched_info = hypervisor.get_and_touch("api", "test").await.unwrap();
+
+        // The returned info should have fresh activity timestamp
+        // (idle_secs should be 0 or very small since we just touched)
+        assert!(touched_info.idle_secs <= idle_before);
+
+        // Verify activity was actually touched by checking again
+        let after_info = hypervisor.get("api", "test").await.unwrap();
+        assert!(after_info.idle_secs < 1); // Should be very fresh
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    // ===================
+    // LOG CAPTURE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_spawn_captures_stdout() {
+        let config = test_config_with_process("api", "echo", vec!["hello from stdout"]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Give time for log capture
+        tokio::time::sleep(Duration::from_millis(100)).await;
+
+        // Check log buffer
+        let logs = hypervisor
+            .log_buffer()
+            .query(&crate::logs::LogQuery {
+                process: Some("api".to_string()),
+                ..Default::default()
+            })
+            .await;
+
+        // Should have captured stdout
+        assert!(logs.iter().any(|l| l.message.contains("hello from stdout")));
+    }
+
+    #[tokio::test]
+    async fn test_spawn_writes_service_log_file() {
+        let dir = TempDir::new().unwrap();
+        let script = vec!["-c", "echo out; echo err >&2"];
+        let mut config = test_config_with_process("api", "sh", script);
+        config.settings.log_files = Some(crate::config::LogFilesConfig {
+            dir: Some(dir.path().to_path_buf()),
+            max_size_mb: 10,
+            max_age: None,
+            keep: 5,
+            compress: true,
+        });
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        let path = dir.path().join("api.log");
+        let mut contents = String::new();
+        for _ in 0..50 {
+            contents = std::fs::read_to_string(&path).unwrap_or_default();
+            if contents.lines().count() == 2 {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(20)).await;
+        }
+        assert!(contents.contains(" test stdout out\n"), "{}", contents);
+        assert!(contents.contains(" test stderr err\n"), "{}", contents);
+    }
+
+    #[tokio::test]
+    async fn test_spawn_captures_stderr() {
+        let config = test_config_with_process("api", "sh", vec!["-c", "echo error >&2"]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Give time for log capture
+        tokio::time::sleep(Duration::from_millis(100)).await;
+
+        // Check log buffer
+        let logs = hypervisor
+            .log_buffer()
+            .query(&crate::logs::LogQuery {
+                process: Some("api".to_string()),
+                level: Some(crate::logs::LogLevel::Stderr),
+                ..Default::default()
+            })
+            .await;
+
+        assert!(logs.iter().any(|l| l.message.contains("error")));
+    }
+
+    // ===================
+    // METRICS TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_spawn_increments_metrics() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        let metrics = hypervisor.metrics();
+        let initial = metrics.instances_up.get();
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // instances_up should increment
+        assert_eq!(metrics.instances_up.get(), initial + 1);
+
+        hypervisor.stop("api", "test").await.unwrap();
+
+        // Should decrement back
+        assert_eq!(metrics.instances_up.get(), initial);
+    }
+
+    // Helper to create a process that takes `delay` before listening on $PORT
+    fn create_slow_start_script(dir: &Path, delay: &str) -> PathBuf {
+        let script_path = dir.join("slow_start.sh");
+        let script = format!(
+            r#"#!/bin/bash
+sleep {}
+exec python3 -c "
+import os, socket, time
+sock = socket.socket(socket.AF_INET, socket.SOCK_STREAM)
+sock.setsockopt(socket.SOL_SOCKET, socket.SO_REUSEADDR, 1)
+sock.bind(('127.0.0.1', int(os.environ['PORT'])))
+sock.listen(16)
+time.sleep(30)
+"
+"#,
+            delay
+        );
+        std::fs::write(&script_path, script).unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        script_path
+    }
+
+    #[tokio::test]
+    async fn test_spawn_records_startup_duration() {
+        let dir = TempDir::new().unwrap();
+        let script = create_slow_start_script(dir.path(), "0.2");
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "slow").await.unwrap();
+
+        let info = hypervisor.get("api", "slow").await.unwrap();
+        let startup_ms = info.last_startup_ms.expect("startup duration recorded");
+        assert!(startup_ms >= 200, "expected >= 200ms, got {}ms", startup_ms);
+
+        let mut labels = HashMap::new();
+        labels.insert("process".to_string(), "api".to_string());
+        labels.insert("id".to_string(), "slow".to_string());
+        let histogram = hypervisor
+            .metrics()
+            .instance_startup_duration_ms
+            .with_labels(&labels)
+            .await;
+        assert_eq!(histogram.get_count(), 1);
+        assert!(histogram.get_sum() >= 200.0);
+
+        hypervisor.stop("api", "slow").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_startup_duration_recorded_on_first_healthy_check() {
+        let dir = TempDir::new().unwrap();
+        // Never listens on TCP, so spawn's readiness wait gives up without a duration
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        assert!(hypervisor
+            .get("api", "test")
+            .await
+            .unwrap()
+            .last_startup_ms
+            .is_none());
+
+        assert_eq!(
+            hypervisor.check_health("api", "test").await,
+            HealthStatus::Healthy
+        );
+        let first = hypervisor.get("api", "test").await.unwrap().last_startup_ms;
+        assert!(first.is_some());
+
+        // Later checks don't overwrite the first-ready duration
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        hypervisor.check_health("api", "test").await;
+        let second = hypervisor.get("api", "test").await.unwrap().last_startup_ms;
+        assert_eq!(first, second);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_restart_rerecords_startup_duration() {
+        let dir = TempDir::new().unwrap();
+        let script = create_slow_start_script(dir.path(), "0.1");
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        assert!(hypervisor
+            .get("api", "test")
+            .await
+            .unwrap()
+            .last_startup_ms
+            .is_some());
+
+        hypervisor.restart("api", "test").await.unwrap();
+        assert!(hypervisor
+            .get("api", "test")
+            .await
+            .unwrap()
+            .last_startup_ms
+            .is_some());
+
+        let mut labels = HashMap::new();
+        labels.insert("process".to_string(), "api".to_string());
+        labels.insert("id".to_string(), "test".to_string());
+        let histogram = hypervisor
+            .metrics()
+            .instance_startup_duration_ms
+            .with_labels(&labels)
+            .await;
+        assert_eq!(histogram.get_count(), 2);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    // ===================
+    // HEALTH STATUS TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_check_health_no_endpoint_socket_file() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        // No health endpoint configured, socket is just a file (not real socket)
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Wait for socket file to be created
+        tokio::time::sleep(Duration::from_millis(200)).await;
+
+        let status = hypervisor.check_health("api", "test").await;
+        // File exists but isn't a real socket, so can't connect
+        // The actual status depends on implementation - could be Healthy (file exists)
+        // or Unhealthy (can't connect). Just verify it returns a status.
+        assert!(matches!(
+            status,
+            HealthStatus::Healthy | HealthStatus::Unhealthy
+        ));
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_check_health_unknown_process() {
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+
+        let status = hypervisor.check_health("nonexistent", "id").await;
+        assert_eq!(status, HealthStatus::Unknown);
+    }
+
+    #[tokio::test]
+    async fn test_health_transitions_are_published() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        // Nothing answers /health; prod goes unhealthy after two failures
+        let hypervisor = Hypervisor::new(overlay_health_config(&script, "prod"));
+        let mut events = hypervisor.subscribe_health();
+        hypervisor.spawn("api", "test").await.unwrap();
+        for _ in 0..3 {
+            hypervisor.check_health("api", "test").await;
+        }
+
+        let first = events.try_recv().unwrap();
+        assert_eq!(first.instance, InstanceId::new("api", "test"));
+        assert_eq!((first.old, first.new), (HealthStatus::Unknown, HealthStatus::Degraded));
+        let second = events.try_recv().unwrap();
+        assert_eq!((second.old, second.new), (HealthStatus::Degraded, HealthStatus::Unhealthy));
+        assert!(events.try_recv().is_err(), "an unchanged status publishes nothing");
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_lifecycle_events_are_published() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let hypervisor = Hypervisor::new(overlay_health_config(&script, "prod"));
+        let mut events = hypervisor.subscribe_events();
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        let started = events.try_recv().unwrap();
+        assert_eq!(started.event, EventKind::Started);
+        assert_eq!(started.app.as_deref(), Some("api"));
+        assert_eq!(started.instance.as_deref(), Some("api:test"));
+        assert_eq!(started.env.as_deref(), Some("prod"));
+
+        hypervisor.check_health("api", "test").await;
+        let health = events.try_recv().unwrap();
+        assert_eq!(health.event, EventKind::HealthChanged);
+        assert_eq!(health.data["old_state"], "unknown");
+        assert_eq!(health.data["new_state"], "degraded");
+
+        // Killed behind the hypervisor's back: the exit monitor reports a crash
+        let id = InstanceId::new("api", "test");
+        let pid = instance_pid(&hypervisor, &id).await.unwrap();
+        unsafe {
+            libc::kill(pid as i32, libc::SIGKILL);
+        }
+        let crashed = tokio::time::timeout(Duration::from_secs(5), events.recv())
+            .await
+            .expect("crash reported")
+            .unwrap();
+        assert_eq!(crashed.event, EventKind::Crashed);
+        assert_eq!(crashed.data["pid"], pid);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_check_health_not_running_instance() {
+        let config = test_config_with_process("api", "sleep", vec!["1"]);
+        let hypervisor = Hypervisor::new(config);
+
+        // Clean up any stale socket from previous tests
+        let socket_path = std::path::PathBuf::from("/tmp/api-test.sock");
+        let _ = std::fs::remove_file(&socket_path);
+
+        // Don't spawn, just check health
+        // For a configured process that isn't running, returns Unhealthy
+        let status = hypervisor.check_health("api", "test").await;
+        assert!(matches!(
+            status,
+            HealthStatus::Unknown | HealthStatus::Unhealthy
+        ));
+    }
+
+    // ===================
+    // DATA DIRECTORY TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_spawn_creates_data_directory() {
+        let dir = TempDir::new().unwrap();
+        let data_dir = dir.path().join("tenement-data");
+        let script = create_touch_socket_script(dir.path());
+
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.settings.data_dir = data_dir.clone();
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "user1").await.unwrap();
+
+        // Data directory should be created
+        assert!(data_dir.join("api").join("user1").exists());
+
+        hypervisor.stop("api", "user1").await.ok();
+    }
+
+    // ===================
+    // TEMP DIRECTORY TESTS
+    // ===================
+
+    /// Config whose instances print TMPDIR, write a file into it, then stay up
+    fn tmp_dir_config(data_dir: &Path) -> Config {
+        let mut config = test_config_with_process(
+            "api",
+            "sh",
+            vec!["-c", "echo \"TMPDIR=$TMPDIR\"; touch \"$TMPDIR/scratch\"; sleep 30"],
+        );
+        config.settings.data_dir = data_dir.to_path_buf();
+        config.service.get_mut("api").unwrap().tmp_dir = true;
+        config
+    }
+
+    #[tokio::test]
+    async fn test_tmp_dir_created_injected_and_removed_on_stop() {
+        let dir = TempDir::new().unwrap();
+        let hypervisor = Hypervisor::new(tmp_dir_config(dir.path()));
+        let tmp_dir = dir.path().join(".tmp").join("api").join("user1");
+
+        hypervisor.spawn("api", "user1").await.unwrap();
+        tokio::time::sleep(Duration::from_millis(200)).await;
+
+        assert!(tmp_dir.is_dir());
+        assert!(tmp_dir.join("scratch").exists(), "app should write into TMPDIR");
+        let logs = hypervisor
+            .log_buffer()
+            .query(&crate::logs::LogQuery::default())
+            .await;
+        let expected = format!("TMPDIR={}", tmp_dir.display());
+        assert!(logs.iter().any(|l| l.message == expected));
+
+        hypervisor.stop("api", "user1").await.unwrap();
+        assert!(!tmp_dir.exists());
+    }
+
+    #[tokio::test]
+    async fn test_tmp_dir_emptied_on_spawn() {
+        let dir = TempDir::new().unwrap();
+        let hypervisor = Hypervisor::new(tmp_dir_config(dir.path()));
+
+        // Leftovers from a run that was killed before it could clean up
+        let tmp_dir = dir.path().join(".tmp").join("api").join("user1");
+        std::fs::create_dir_all(&tmp_dir).unwrap();
+        std::fs::write(tmp_dir.join("stale"), "old").unwrap();
+
+        hypervisor.spawn("api", "user1").await.unwrap();
+        assert!(tmp_dir.is_dir());
+        assert!(!tmp_dir.join("stale").exists());
+
+        hypervisor.stop("api", "user1").await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_tmp_dir_removed_when_crashed_instance_restarts() {
+        let dir = TempDir::new().unwrap();
+        let hypervisor = Hypervisor::new(tmp_dir_config(dir.path()));
+        let tmp_dir = dir.path().join(".tmp").join("api").join("user1");
+
+        hypervisor.spawn("api", "user1").await.unwrap();
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        std::fs::write(tmp_dir.join("partial-upload"), "x").unwrap();
+
+        hypervisor.restart("api", "user1").await.unwrap();
+        assert!(tmp_dir.is_dir());
+        assert!(!tmp_dir.join("partial-upload").exists());
+
+        hypervisor.stop("api", "user1").await.unwrap();
+        assert!(!tmp_dir.exists());
+    }
+
+    #[tokio::test]
+    async fn test_prune_orphaned_tmp_dirs_keeps_running_instances() {
+        let dir = TempDir::new().unwrap();
+        let hypervisor = Hypervisor::new(tmp_dir_config(dir.path()));
+        let root = dir.path().join(".tmp");
+        std::fs::create_dir_all(root.join("api").join("ghost")).unwrap();
+        std::fs::create_dir_all(root.join("gone").join("user1")).unwrap();
+
+        hypervisor.spawn("api", "live").await.unwrap();
+        assert_eq!(hypervisor.prune_orphaned_tmp_dirs().await, 2);
+
+        assert!(root.join("api").join("live").is_dir());
+        assert!(!root.join("api").join("ghost").exists());
+        assert!(!root.join("gone").exists());
+
+        hypervisor.stop("api", "live").await.unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_tmp_dir_disabled_by_default() {
+        let dir = TempDir::new().unwrap();
+        let mut config = tmp_dir_config(dir.path());
+        config.service.get_mut("api").unwrap().tmp_dir = false;
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "user1").await.unwrap();
+        assert!(!dir.path().join(".tmp").exists());
+        assert_eq!(hypervisor.prune_orphaned_tmp_dirs().await, 0);
+
+        hypervisor.stop("api", "user1").await.unwrap();
+    }
+
+    // ===================
+    // ENVIRONMENT VARIABLE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_spawn_fails_naming_missing_required_env() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let api = config.service.get_mut("api").unwrap();
+        api.required_env = vec![
+            "DATABASE_URL".to_string(),
+            "TENEMENT_TEST_REQUIRED_UNSET".to_string(),
+        ];
+        api.env.insert("DATABASE_URL".to_string(), "sqlite://db".to_string());
+        let hypervisor = Hypervisor::new(config);
+
+        let err = hypervisor.spawn("api", "test").await.unwrap_err().to_string();
+        assert!(err.contains("missing required env var(s): TENEMENT_TEST_REQUIRED_UNSET"));
+        assert!(!err.contains("DATABASE_URL"));
+        assert!(!hypervisor.is_running("api", "test").await);
+
+        // The failed attempt released its spawning guard, so a retry fails the same way
+        let retry = hypervisor.spawn("api", "test").await.unwrap_err().to_string();
+        assert!(retry.contains("TENEMENT_TEST_REQUIRED_UNSET"));
+    }
+
+    #[tokio::test]
+    async fn test_spawn_with_required_env_present() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let api = config.service.get_mut("api").unwrap();
+        api.required_env = vec!["DATABASE_URL".to_string(), "API_KEY".to_string()];
+        api.env.insert("DATABASE_URL".to_string(), "sqlite://db".to_string());
+        let hypervisor = Hypervisor::new(config);
+
+        // Extra env (like secrets) counts toward required vars
+        let mut extra_env = HashMap::new();
+        extra_env.insert("API_KEY".to_string(), "k".to_string());
+        hypervisor
+            .spawn_with_env("api", "test", extra_env)
+            .await
+            .unwrap();
+        assert!(hypervisor.is_running("api", "test").await);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_layers_env_files_under_inline_env() {
+        let dir = TempDir::new().unwrap();
+        let base = dir.path().join(".env");
+        let local = dir.path().join("local.env");
+        std::fs::write(&base, "DATABASE_URL=sqlite://base\nLEVEL=info\nHOST=db\n").unwrap();
+        std::fs::write(&local, "LEVEL=debug\nURL=postgres://${HOST}/app\n").unwrap();
+
+        let mut config = test_config_with_process(
+            "api",
+            "sh",
+            vec!["-c", "echo \"$DATABASE_URL $LEVEL $URL $GREETING\"; sleep 30"],
+        );
+        let api = config.service.get_mut("api").unwrap();
+        api.env_files = vec![base, local];
+        api.env.insert("DATABASE_URL".to_string(), "sqlite://inline".to_string());
+        api.env.insert("GREETING".to_string(), "hi-${HOST}".to_string());
+        api.required_env = vec!["URL".to_string()];
+        let hypervisor = Hypervisor::new(config);
+
+        // Required vars set only by an env file count
+        hypervisor.spawn("api", "test").await.unwrap();
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        let logs = hypervisor
+            .log_buffer()
+            .query(&crate::logs::LogQuery::default())
+            .await;
+        assert!(
+            logs.iter().any(|l| l.message == "sqlite://inline debug postgres://db/app hi-db"),
+            "logs: {:?}",
+            logs
+        );
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_fails_on_missing_env_file() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        config.service.get_mut("api").unwrap().env_files =
+            vec![PathBuf::from("/nonexistent/tenement.env")];
+        let hypervisor = Hypervisor::new(config);
+
+        let err = format!("{:#}", hypervisor.spawn("api", "test").await.unwrap_err());
+        assert!(err.contains("Failed to load env files for api:test"));
+        assert!(err.contains("/nonexistent/tenement.env"));
+        assert!(!hypervisor.is_running("api", "test").await);
+    }
+
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_spawn_applies_nofile_limit() {
+        let mut config = test_config_with_process(
+            "api",
+            "sh",
+            vec!["-c", "echo \"nofile=$(ulimit -n)\"; sleep 30"],
+        );
+        config.service.get_mut("api").unwrap().limits.nofile = Some(256);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        let logs = hypervisor
+            .log_buffer()
+            .query(&crate::logs::LogQuery::default())
+            .await;
+        assert!(logs.iter().any(|l| l.message == "nofile=256"), "logs: {:?}", logs);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[cfg(target_os = "linux")]
+    #[tokio::test]
+    async fn test_memory_limit_restarts_instance() {
+        // Holds 64MB resident against a 16MB limit
+        let mut config = test_config_with_process(
+            "api",
+            "python3",
+            vec!["-c", "import time\nb = b'x' * (64 * 1024 * 1024)\ntime.sleep(30)"],
+        );
+        config.service.get_mut("api").unwrap().limits.memory = Some(16);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        tokio::time::sleep(Duration::from_millis(500)).await;
+        hypervisor.check_memory_limits().await;
+
+        // The restart runs in the background
+        let mut restarts = 0;
+        for _ in 0..100 {
+            let info = hypervisor.get("api", "test").await;
+            restarts = info.map_or(0, |i| i.restarts);
+            if restarts > 0 {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        assert_eq!(restarts, 1);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_memory_limit_leaves_small_instance_alone() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        config.service.get_mut("api").unwrap().limits.memory = Some(1024);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        hypervisor.check_memory_limits().await;
+        assert_eq!(hypervisor.get("api", "test").await.unwrap().restarts, 0);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_fails_for_unknown_user() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        config.service.get_mut("api").unwrap().user = Some("tenement-no-such-user".into());
+        let hypervisor = Hypervisor::new(config);
+
+        let err = format!("{:#}", hypervisor.spawn("api", "test").await.unwrap_err());
+        assert!(err.contains("Unknown user 'tenement-no-such-user'"), "{}", err);
+        assert!(!hypervisor.is_running("api", "test").await);
+    }
+
+    #[tokio::test]
+    async fn test_spawn_as_own_user() {
+        let (uid, gid) = unsafe { (libc::geteuid(), libc::getegid()) };
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let api = config.service.get_mut("api").unwrap();
+        api.user = Some(uid.to_string());
+        api.group = Some(gid.to_string());
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        assert!(hypervisor.is_running("api", "test").await);
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    #[ignore = "requires root"]
+    async fn test_spawn_drops_to_service_user() {
+        let dir = TempDir::new().unwrap();
+        let mut config = test_config_with_process(
+            "api",
+            "sh",
+            vec!["-c", "touch \"$SOCKET_PATH\"; echo \"uid=$(id -u)\"; sleep 30"],
+        );
+        config.settings.data_dir = dir.path().to_path_buf();
+        config.service.get_mut("api").unwrap().user = Some("nobody".into());
+        let hypervisor = Hypervisor::new(config);
+        let nobody = users::resolve(Some("nobody"), None).unwrap().unwrap();
+
+        hypervisor.spawn("api", "test").await.unwrap();
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        let logs = hypervisor
+            .log_buffer()
+            .query(&crate::logs::LogQuery::default())
+            .await;
+        let expected = format!("uid={}", nobody.uid);
+        assert!(logs.iter().any(|l| l.message == expected), "logs: {:?}", logs);
+
+        use std::os::unix::fs::MetadataExt;
+        let data_dir = std::fs::metadata(dir.path().join("api").join("test")).unwrap();
+        assert_eq!(data_dir.uid(), nobody.uid);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_error_redacts_sensitive_env() {
+        let mut config = test_config_with_process(
+            "api",
+            "/nonexistent/tenement-test-bin",
+            vec!["--token", "tok-live-abc123", "--db", "postgres://app:pw@db/app"],
+        );
+        let api = config.service.get_mut("api").unwrap();
+        api.env.insert("API_TOKEN".to_string(), "tok-live-abc123".to_string());
+        api.env.insert("DATABASE_URL".to_string(), "postgres://app:pw@db/app".to_string());
+        api.redact_env = vec!["DATABASE_URL".to_string()];
+        let hypervisor = Hypervisor::new(config);
+
+        let err = format!("{:#}", hypervisor.spawn("api", "test").await.unwrap_err());
+        assert!(err.contains("Failed to spawn process"));
+        assert!(err.contains("--token [redacted] --db [redacted]"));
+        assert!(!err.contains("tok-live-abc123"));
+        assert!(!err.contains("postgres://app:pw@db/app"));
+    }
+
+    #[tokio::test]
+    async fn test_spawn_with_extra_env() {
+        let config = test_config_with_process("api", "env", vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        let mut extra_env = HashMap::new();
+        extra_env.insert("MY_CUSTOM_VAR".to_string(), "custom_value".to_string());
+
+        hypervisor
+            .spawn_with_env("api", "test", extra_env)
+            .await
+            .unwrap();
+
+        // Give time for process to run
+        tokio::time::sleep(Duration::from_millis(100)).await;
+
+        // Check that env was set (captured in logs)
+        let logs = hypervisor
+            .log_buffer()
+            .query(&crate::logs::LogQuery::default())
+            .await;
+        assert!(logs
+            .iter()
+            .any(|l| l.message.contains("MY_CUSTOM_VAR=custom_value")));
+    }
+
+    #[tokio::test]
+    async fn test_spawn_sets_port_env() {
+        let config = test_config_with_process("api", "env", vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        tokio::time::sleep(Duration::from_millis(100)).await;
+
+        // Process runtime should get a PORT env var with auto-allocated port (30000-40000)
+        let logs = hypervisor
+            .log_buffer()
+            .query(&crate::logs::LogQuery::default())
+            .await;
+        assert!(logs.iter().any(|l| l.message.contains("PORT=3")));
+    }
+
+    // ===================
+    // AUTO-SPAWN TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_spawn_configured_instances_empty() {
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+
+        let (success, failed) = hypervisor.spawn_configured_instances().await;
+
+        assert_eq!(success, 0);
+        assert_eq!(failed, 0);
+        assert!(hypervisor.list().await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_spawn_configured_instances_single() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config
+            .instances
+            .insert("api".to_string(), vec!["prod".to_string()]);
+        let hypervisor = Hypervisor::new(config);
+
+        let (success, failed) = hypervisor.spawn_configured_instances().await;
+
+        assert_eq!(success, 1);
+        assert_eq!(failed, 0);
+        assert!(hypervisor.is_running("api", "prod").await);
+
+        hypervisor.stop("api", "prod").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_configured_instances_multiple() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.instances.insert(
+            "api".to_string(),
+            vec!["prod".to_string(), "staging".to_string()],
+        );
+        let hypervisor = Hypervisor::new(config);
+
+        let (success, failed) = hypervisor.spawn_configured_instances().await;
+
+        assert_eq!(success, 2);
+        assert_eq!(failed, 0);
+        assert!(hypervisor.is_running("api", "prod").await);
+        assert!(hypervisor.is_running("api", "staging").await);
+
+        hypervisor.stop("api", "prod").await.ok();
+        hypervisor.stop("api", "staging").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_spawn_configured_instances_continues_on_failure() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        // Add a second service with an invalid command
+        config.service.insert(
+            "broken".to_string(),
+            ProcessConfig {
+                command: "/nonexistent/binary".to_string(),
+                args: vec![],
+                socket: "/tmp/{name}-{id}.sock".to_string(),
+                unix_socket: Default::default(),
+                connection_pool: Default::default(),
+                isolation: RuntimeType::Process,
+                health: None,
+                env: HashMap::new(),
+                workdir: None,
+                mounts: Vec::new(),
+                image: None,
+                restart: "on-failure".to_string(),
+                idle_timeout: None,
+                startup_timeout: 5,
+                request_timeout: 30,
+                memory_limit_mb: None,
+                cpu_shares: None,
+                kernel: None,
+                rootfs: None,
+                memory_mb: 256,
+                vcpus: 1,
+                vsock_port: 5000,
+                storage_quota_mb: None,
+                storage_persist: false,
+                secrets: HashMap::new(),
+                reload_signal: None,
+                fault: None,
+                concurrency_weight: 1,
+                shell: None,
+                health_check: Default::default(),
+                readiness: None,
+                warm_connections: 0,
+                log_rate_limit: None,
+                tmp_dir: false,
+                required_env: Vec::new(),
+                redact_env: Vec::new(),
+                stop_signal: None,
+                stop_timeout: None,
+                stop_process_group: true,
+                post_stop: None,
+                post_stop_timeout: 10,
+                hooks: Default::default(),
+                domains: Vec::new(),
+                replicas: 1,
+                load_balance: Default::default(),
+                slow_start: None,
+                autoscale: None,
+                access: None,
+                compression: None,
+                cache: None,
+                preview: None,
+                env_files: Vec::new(),
+                log_sinks: Vec::new(),
+                limits: Default::default(),
+                filesystem: Default::default(),
+                egress: None,
+                volumes: Default::default(),
+                listen: None,
+                user: None,
+                group: None,
+                depends_on: Default::default(),
+                stack: None,
+                uses: Vec::new(),
+                middleware: Vec::new(),
+                deploy: Default::default(),
+                git: None,
+                stream_idle_timeout: None,
+                protocol: Default::default(),
+                rate_limit: None,
+                max_concurrency: None,
+                max_queue: None,
+                queue_timeout_ms: None,
+                retry: None,
+                circuit_breaker: None,
+                maintenance_page: None,
+                kind: Default::default(),
+                root: None,
+                spa: false,
+                cache_max_age: 3600,
+                access_log: None,
+            },
+        );
+
+        // Configure both to spawn
+        config
+            .instances
+            .insert("api".to_string(), vec!["prod".to_string()]);
+        config
+            .instances
+            .insert("broken".to_string(), vec!["test".to_string()]);
+
+        let hypervisor = Hypervisor::new(config);
+
+        let (success, failed) = hypervisor.spawn_configured_instances().await;
+
+        // One succeeded, one failed
+        assert_eq!(success, 1);
+        assert_eq!(failed, 1);
+
+        // The good one should still be running
+        assert!(hypervisor.is_running("api", "prod").await);
+        assert!(!hypervisor.is_running("broken", "test").await);
+
+        hypervisor.stop("api", "prod").await.ok();
+    }
+
+    // ===================
+    // WEIGHTED ROUTING TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_set_weight() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Default weight should be 100
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.weight, 100);
+
+        // Set weight to 50
+        hypervisor.set_weight("api", "test", 50).await.unwrap();
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.weight, 50);
+
+        // Set weight to 0
+        hypervisor.set_weight("api", "test", 0).await.unwrap();
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.weight, 0);
+
+        hypervisor.stop("api", "test").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_set_weight_caps_at_100() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "test").await.unwrap();
+
+        // Try to set weight > 100
+        hypervisor.set_weight("api", "test", 150).await.unwrap();
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.weight, 100); // Should be capped at 100
+
+        hypervisor.stop("api", "test").await.ok();
     }
 
-    // Helper to create a shell script that creates a socket and waits
-    #[allow(dead_code)]
-    fn create_socket_server_script(dir: &Path) -> PathBuf {
-        let script_path = dir.join("server.sh");
-        let script = r#"#!/bin/bash
-SOCKET_PATH="${SOCKET_PATH:-/tmp/test.sock}"
-rm -f "$SOCKET_PATH"
-# Create socket using nc (netcat) - listens and responds
-# Use socat if available, otherwise use a simple approach
-if command -v socat &> /dev/null; then
-    socat UNIX-LISTEN:"$SOCKET_PATH",fork EXEC:"echo HTTP/1.1 200 OK"
-elif command -v nc &> /dev/null; then
-    while true; do
-        echo -e "HTTP/1.1 200 OK\r\n\r\nOK" | nc -lU "$SOCKET_PATH" -q0 2>/dev/null || break
-    done
-else
-    # Fallback: just create the socket file and sleep
-    python3 -c "
-import socket
-import os
-sock = socket.socket(socket.AF_UNIX, socket.SOCK_STREAM)
-sock.bind('$SOCKET_PATH')
-sock.listen(1)
-while True:
-    conn, _ = sock.accept()
-    conn.sendall(b'HTTP/1.1 200 OK\r\n\r\nOK')
-    conn.close()
-" 2>/dev/null &
-    sleep infinity
-fi
-"#;
-        std::fs::write(&script_path, script).unwrap();
-        #[cfg(unix)]
+    #[tokio::test]
+    async fn test_set_weight_nonexistent_instance() {
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+
+        let result = hypervisor.set_weight("api", "nonexistent", 50).await;
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("not found"));
+    }
+
+    #[tokio::test]
+    async fn test_list_by_process() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        // Spawn multiple instances
+        hypervisor.spawn("api", "prod").await.unwrap();
+        hypervisor.spawn("api", "staging").await.unwrap();
+
+        let instances = hypervisor.list_by_process("api").await;
+        assert_eq!(instances.len(), 2);
+
+        // Verify both are present
+        let ids: Vec<String> = instances.iter().map(|i| i.id.id.clone()).collect();
+        assert!(ids.contains(&"prod".to_string()));
+        assert!(ids.contains(&"staging".to_string()));
+
+        // Nonexistent process should return empty
+        let empty = hypervisor.list_by_process("nonexistent").await;
+        assert!(empty.is_empty());
+
+        hypervisor.stop("api", "prod").await.ok();
+        hypervisor.stop("api", "staging").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_select_weighted_single_instance() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "prod").await.unwrap();
+
+        // Single instance should always be selected
+        for _ in 0..10 {
+            let selected = hypervisor.select_weighted("api").await;
+            assert!(selected.is_some());
+            assert_eq!(selected.unwrap().id.id, "prod");
+        }
+
+        hypervisor.stop("api", "prod").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_select_weighted_excludes_zero_weight() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
+
+        // Set v1 weight to 0
+        hypervisor.set_weight("api", "v1", 0).await.unwrap();
+
+        // v2 should always be selected since v1 has weight 0
+        for _ in 0..10 {
+            let selected = hypervisor.select_weighted("api").await;
+            assert!(selected.is_some());
+            assert_eq!(selected.unwrap().id.id, "v2");
+        }
+
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_select_weighted_all_zero_weight() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
+
+        // Set both weights to 0
+        hypervisor.set_weight("api", "v1", 0).await.unwrap();
+        hypervisor.set_weight("api", "v2", 0).await.unwrap();
+
+        // No instance should be selected
+        let selected = hypervisor.select_weighted("api").await;
+        assert!(selected.is_none());
+
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_select_weighted_skips_down_instances() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
+
+        for status in [HealthStatus::Unhealthy, HealthStatus::Failed] {
+            hypervisor
+                .instances
+                .write()
+                .await
+                .get_mut(&InstanceId::new("api", "v1"))
+                .unwrap()
+                .health_status = status;
+            for _ in 0..10 {
+                assert_eq!(hypervisor.select_weighted("api").await.unwrap().id.id, "v2");
+            }
+        }
+
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_stopping_instance_gets_no_traffic() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
+
+        let v1 = InstanceId::new("api", "v1");
+        if let Some(instance) = hypervisor.instances.write().await.get_mut(&v1) {
+            instance.stopping = true;
+        }
+        for _ in 0..10 {
+            assert_eq!(hypervisor.select_instance("api").await.unwrap().id.id, "v2");
+        }
+
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_circuit_breaker_ejects_failing_instance() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.service.get_mut("api").unwrap().circuit_breaker = Some(CircuitBreakerConfig {
+            failures: 2,
+            cooldown: 60,
+        });
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
+
+        hypervisor.record_upstream_result("api", "v1", false).await;
+        assert!(!hypervisor.is_ejected("api", "v1"));
+        hypervisor.record_upstream_result("api", "v1", false).await;
+        assert!(hypervisor.is_ejected("api", "v1"));
+        for _ in 0..10 {
+            assert_eq!(hypervisor.select_instance("api").await.unwrap().id.id, "v2");
+        }
+        let retry = hypervisor
+            .select_instance_except("api", &["v2".to_string()])
+            .await;
+        assert!(retry.is_none());
+
+        // With every instance ejected, routing falls back to all of them
+        hypervisor.record_upstream_result("api", "v2", false).await;
+        hypervisor.record_upstream_result("api", "v2", false).await;
+        assert!(hypervisor.select_instance("api").await.is_some());
+
+        let opened = hypervisor
+            .metrics()
+            .circuit_breaker_transitions_total
+            .total()
+            .await;
+        assert_eq!(opened, 2);
+        let query = crate::logs::LogQuery {
+            process: Some("api".to_string()),
+            ..Default::default()
+        };
+        let logs = hypervisor.log_buffer().query(&query).await;
+        assert!(logs
+            .iter()
+            .any(|l| l.message.starts_with("[tenement] circuit breaker opened")));
+
+        // A stopped instance's breaker is forgotten
+        hypervisor.stop("api", "v1").await.ok();
+        assert!(!hypervisor.is_ejected("api", "v1"));
+        hypervisor.stop("api", "v2").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_select_weighted_no_instances() {
+        let config = Config::default();
+        let hypervisor = Hypervisor::new(config);
+
+        // No instances -> None
+        let selected = hypervisor.select_weighted("api").await;
+        assert!(selected.is_none());
+    }
+
+    #[tokio::test]
+    async fn test_select_weighted_distribution() {
+        // Test that weighted selection roughly follows the weights
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
+
+        // Set v1=90, v2=10
+        hypervisor.set_weight("api", "v1", 90).await.unwrap();
+        hypervisor.set_weight("api", "v2", 10).await.unwrap();
+
+        let mut v1_count = 0;
+        let mut v2_count = 0;
+        let iterations = 1000;
+
+        for _ in 0..iterations {
+            if let Some(selected) = hypervisor.select_weighted("api").await {
+                match selected.id.id.as_str() {
+                    "v1" => v1_count += 1,
+                    "v2" => v2_count += 1,
+                    _ => panic!("Unexpected instance"),
+                }
+            }
+        }
+
+        // v1 should get roughly 90% of selections (with some variance)
+        // Allow 15% margin for statistical variance
+        let v1_ratio = v1_count as f64 / iterations as f64;
+        let v2_ratio = v2_count as f64 / iterations as f64;
+        assert!(v1_ratio > 0.75, "v1 ratio {} should be > 0.75", v1_ratio);
+        assert!(v1_ratio < 0.98, "v1 ratio {} should be < 0.98", v1_ratio);
+        assert!(v2_ratio > 0.02, "v2 ratio {} should be > 0.02", v2_ratio);
+
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
+    }
+
+    #[test]
+    fn test_slow_start_weight() {
+        let window = Duration::from_secs(60);
+        let after = |secs| Some(Duration::from_secs(secs));
+        assert_eq!(slow_start_weight(100, None, window), 1);
+        assert_eq!(slow_start_weight(100, after(0), window), 1);
+        assert_eq!(slow_start_weight(100, after(15), window), 25);
+        assert_eq!(slow_start_weight(100, after(60), window), 100);
+        assert_eq!(slow_start_weight(50, after(90), window), 50);
+    }
+
+    #[tokio::test]
+    async fn test_slow_start_sends_a_new_instance_little_traffic() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.service.get_mut("api").unwrap().slow_start = Some(60);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
+
+        // v1 has been up past its window; v2 only just came up
         {
-            use std::os::unix::fs::PermissionsExt;
-            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+            let mut instances = hypervisor.instances.write().await;
+            let v1 = instances.get_mut(&InstanceId::new("api", "v1")).unwrap();
+            v1.started_at -= Duration::from_secs(120);
         }
-        script_path
+        let mut v2_count = 0;
+        for _ in 0..200 {
+            if hypervisor.select_weighted("api").await.unwrap().id.id == "v2" {
+                v2_count += 1;
+            }
+        }
+        assert!(v2_count < 20, "v2 got {} of 200 picks", v2_count);
+        // Its reported weight is untouched
+        assert_eq!(hypervisor.get("api", "v2").await.unwrap().weight, 100);
+
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
     }
 
-    // Helper to create a simple process that touches a socket file
-    fn create_touch_socket_script(dir: &Path) -> PathBuf {
-        let script_path = dir.join("touch_socket.sh");
+    // ===================
+    // REPLICA TESTS
+    // ===================
+
+    /// Script that records its replica env next to its socket, then stays up
+    fn create_replica_script(dir: &Path) -> PathBuf {
+        let script_path = dir.join("replica.sh");
         let script = r#"#!/bin/bash
-SOCKET_PATH="${SOCKET_PATH:-/tmp/test.sock}"
-rm -f "$SOCKET_PATH"
+echo "$TENEMENT_REPLICA/$TENEMENT_REPLICAS" > "$SOCKET_PATH.replica"
 touch "$SOCKET_PATH"
 sleep 30
 "#;
@@ -1759,1291 +8144,2675 @@ sleep 30
         script_path
     }
 
-    // ===================
-    // BACKOFF TESTS
-    // ===================
-
-    #[test]
-    fn test_calculate_backoff() {
-        let config = Config::default();
-        let hypervisor = Hypervisor::new(config);
+    fn replicated_config(script: &Path, replicas: u32, strategy: LoadBalance) -> Config {
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let service = config.service.get_mut("api").unwrap();
+        service.replicas = replicas;
+        service.load_balance = strategy;
+        config
+    }
 
-        // Default settings: base=1000ms, max=60000ms
+    #[tokio::test]
+    async fn test_replicas_spawn_and_stop_together() {
+        let dir = TempDir::new().unwrap();
+        let script = create_replica_script(dir.path());
+        let hypervisor = Hypervisor::new(replicated_config(&script, 3, LoadBalance::Weighted));
 
-        // 0 restarts = no delay
-        assert_eq!(hypervisor.calculate_backoff(0), Duration::ZERO);
+        hypervisor.spawn("api", "prod").await.unwrap();
 
-        // 1 restart = 1000ms (1s)
-        assert_eq!(hypervisor.calculate_backoff(1), Duration::from_millis(1000));
+        let mut ids: Vec<String> = hypervisor.list().await.into_iter().map(|i| i.id.id).collect();
+        ids.sort();
+        assert_eq!(ids, vec!["prod-0", "prod-1", "prod-2"]);
+        let mut sockets = std::collections::HashSet::new();
+        for (index, id) in ids.iter().enumerate() {
+            let socket = hypervisor.get("api", id).await.unwrap().socket;
+            let env_file = PathBuf::from(format!("{}.replica", socket.display()));
+            let mut recorded = String::new();
+            for _ in 0..50 {
+                recorded = std::fs::read_to_string(&env_file).unwrap_or_default();
+                if !recorded.is_empty() {
+                    break;
+                }
+                tokio::time::sleep(Duration::from_millis(100)).await;
+            }
+            assert_eq!(recorded.trim(), format!("{}/3", index));
+            assert!(sockets.insert(socket), "each replica gets its own socket");
+        }
 
-        // 2 restarts = 2000ms (2s)
-        assert_eq!(hypervisor.calculate_backoff(2), Duration::from_millis(2000));
+        hypervisor.stop("api", "prod").await.unwrap();
+        assert!(hypervisor.list().await.is_empty());
+        assert!(hypervisor.stop("api", "prod").await.is_err());
+    }
 
-        // 3 restarts = 4000ms (4s)
-        assert_eq!(hypervisor.calculate_backoff(3), Duration::from_millis(4000));
+    #[tokio::test]
+    async fn test_round_robin_across_live_replicas() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let hypervisor = Hypervisor::new(replicated_config(&script, 3, LoadBalance::RoundRobin));
 
-        // 4 restarts = 8000ms (8s)
-        assert_eq!(hypervisor.calculate_backoff(4), Duration::from_millis(8000));
+        // Nothing running yet: requests go to the instance itself, which wakes it
+        assert_eq!(hypervisor.pick_replica("api", "prod").await, "prod");
 
-        // 5 restarts = 16000ms (16s)
-        assert_eq!(
-            hypervisor.calculate_backoff(5),
-            Duration::from_millis(16000)
-        );
+        hypervisor.spawn("api", "prod").await.unwrap();
+        let mut picks = Vec::new();
+        for _ in 0..6 {
+            picks.push(hypervisor.pick_replica("api", "prod").await);
+        }
+        assert_eq!(picks, ["prod-0", "prod-1", "prod-2", "prod-0", "prod-1", "prod-2"]);
 
-        // 6 restarts = 32000ms (32s)
-        assert_eq!(
-            hypervisor.calculate_backoff(6),
-            Duration::from_millis(32000)
-        );
+        hypervisor
+            .instances
+            .write()
+            .await
+            .get_mut(&InstanceId::new("api", "prod-1"))
+            .unwrap()
+            .health_status = HealthStatus::Unhealthy;
+        for _ in 0..4 {
+            assert_ne!(hypervisor.pick_replica("api", "prod").await, "prod-1");
+        }
 
-        // 7 restarts = 64000ms but capped at 60000ms (60s max)
-        assert_eq!(
-            hypervisor.calculate_backoff(7),
-            Duration::from_millis(60000)
-        );
+        // A replica is addressed directly, like any instance
+        assert_eq!(hypervisor.pick_replica("api", "prod-2").await, "prod-2");
 
-        // Large values stay capped
-        assert_eq!(
-            hypervisor.calculate_backoff(100),
-            Duration::from_millis(60000)
-        );
+        hypervisor.stop("api", "prod").await.ok();
     }
 
-    #[test]
-    fn test_calculate_backoff_custom_settings() {
-        let mut config = Config::default();
-        config.settings.backoff_base_ms = 500;
-        config.settings.backoff_max_ms = 5000;
+    #[tokio::test]
+    async fn test_autoscale_follows_request_rate_with_cooldown() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let mut config = replicated_config(&script, 1, LoadBalance::Weighted);
+        config.service.get_mut("api").unwrap().autoscale = Some(AutoscaleConfig {
+            min: 1,
+            max: 3,
+            metric: AutoscaleMetric::Rps,
+            target: 1.0,
+            interval: Some(10),
+            scale_up_cooldown: Some(0),
+            scale_down_cooldown: Some(15),
+        });
         let hypervisor = Hypervisor::new(config);
+        let mut events = hypervisor.subscribe_events();
+        hypervisor.spawn("api", "prod").await.unwrap();
 
-        // 1 restart = 500ms
-        assert_eq!(hypervisor.calculate_backoff(1), Duration::from_millis(500));
-
-        // 2 restarts = 1000ms
-        assert_eq!(hypervisor.calculate_backoff(2), Duration::from_millis(1000));
+        async fn running(hypervisor: &Hypervisor) -> Vec<String> {
+            let instances = hypervisor.list().await;
+            let mut ids: Vec<String> = instances.into_iter().map(|i| i.id.id).collect();
+            ids.sort();
+            ids
+        }
+        // Pretend the window (and the last change) began `secs` earlier
+        let age = |secs: u64| {
+            for window in hypervisor.autoscale_windows.lock().unwrap().values_mut() {
+                window.started -= Duration::from_secs(secs);
+                if let Some(at) = window.scaled_at.as_mut() {
+                    *at -= Duration::from_secs(secs);
+                }
+            }
+        };
+        assert_eq!(running(&hypervisor).await, ["prod-0"]);
+        hypervisor.autoscale().await;
 
-        // 4 restarts = 4000ms
-        assert_eq!(hypervisor.calculate_backoff(4), Duration::from_millis(4000));
+        // 25 requests in 10s on one replica with a target of 1/s: three replicas
+        let mut labels = crate::metrics::Labels::new();
+        labels.insert("process".to_string(), "api".to_string());
+        labels.insert("instance".to_string(), "prod-0".to_string());
+        let metrics = hypervisor.metrics();
+        metrics.requests_total.with_labels(&labels).await.inc_by(25);
+        age(10);
+        hypervisor.autoscale().await;
+        assert_eq!(running(&hypervisor).await, ["prod-0", "prod-1", "prod-2"]);
+        assert_eq!(hypervisor.config().get_service("api").unwrap().replicas, 3);
+        let scaled = loop {
+            let event = events.recv().await.unwrap();
+            if event.event == EventKind::Scaled {
+                break event;
+            }
+        };
+        assert_eq!(scaled.app.as_deref(), Some("api"));
+        assert_eq!(scaled.data["from"], 1);
+        assert_eq!(scaled.data["to"], 3);
+        assert_eq!(scaled.data["metric"], "rps");
+
+        // Idle, but the scale-down cooldown hasn't passed yet
+        age(10);
+        hypervisor.autoscale().await;
+        assert_eq!(running(&hypervisor).await.len(), 3);
+
+        // Now it has: back to the minimum, dropping the highest replicas
+        age(10);
+        hypervisor.autoscale().await;
+        assert_eq!(running(&hypervisor).await, ["prod-0"]);
+        assert_eq!(hypervisor.pick_replica("api", "prod").await, "prod-0");
 
-        // 5 restarts = 8000ms but capped at 5000ms
-        assert_eq!(hypervisor.calculate_backoff(5), Duration::from_millis(5000));
+        hypervisor.stop("api", "prod").await.ok();
     }
 
-    #[test]
-    fn test_calculate_backoff_overflow_protection() {
-        let mut config = Config::default();
-        config.settings.backoff_base_ms = u64::MAX;
-        config.settings.backoff_max_ms = u64::MAX;
+    #[tokio::test]
+    async fn test_failed_autoscale_emits_no_scaled_event() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let mut config = replicated_config(&script, 1, LoadBalance::Weighted);
+        config.service.get_mut("api").unwrap().autoscale = Some(AutoscaleConfig {
+            min: 1,
+            max: 3,
+            metric: AutoscaleMetric::Rps,
+            target: 1.0,
+            interval: Some(10),
+            scale_up_cooldown: Some(0),
+            scale_down_cooldown: Some(0),
+        });
         let hypervisor = Hypervisor::new(config);
+        let mut events = hypervisor.subscribe_events();
+        hypervisor.spawn("api", "prod").await.unwrap();
+        hypervisor.autoscale().await;
 
-        // Should not panic or overflow, should saturate
-        let result = hypervisor.calculate_backoff(100);
-        assert_eq!(result, Duration::from_millis(u64::MAX));
+        // New replicas can't start without their command
+        std::fs::remove_file(&script).unwrap();
+        let mut labels = crate::metrics::Labels::new();
+        labels.insert("process".to_string(), "api".to_string());
+        labels.insert("instance".to_string(), "prod-0".to_string());
+        let metrics = hypervisor.metrics();
+        metrics.requests_total.with_labels(&labels).await.inc_by(25);
+        for window in hypervisor.autoscale_windows.lock().unwrap().values_mut() {
+            window.started -= Duration::from_secs(10);
+        }
+        hypervisor.autoscale().await;
+
+        while let Ok(event) = events.try_recv() {
+            assert_ne!(event.event, EventKind::Scaled, "{:?}", event);
+        }
+        hypervisor.stop("api", "prod").await.ok();
     }
 
-    #[test]
-    fn test_calculate_backoff_zero_base() {
-        let mut config = Config::default();
-        config.settings.backoff_base_ms = 0;
-        config.settings.backoff_max_ms = 1000;
+    #[tokio::test]
+    async fn test_least_connections_prefers_idle_instance() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let config = replicated_config(&script, 1, LoadBalance::LeastConnections);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
 
-        // 0 * 2^n = 0
-        assert_eq!(hypervisor.calculate_backoff(1), Duration::ZERO);
-        assert_eq!(hypervisor.calculate_backoff(5), Duration::ZERO);
+        let _busy = hypervisor.connection_start("api", "v1").await;
+        for _ in 0..5 {
+            assert_eq!(hypervisor.select_instance("api").await.unwrap().id.id, "v2");
+        }
+
+        let _busier = hypervisor.connection_start("api", "v2").await;
+        let _busiest = hypervisor.connection_start("api", "v2").await;
+        assert_eq!(hypervisor.select_instance("api").await.unwrap().id.id, "v1");
+
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
     }
 
     // ===================
-    // LIFECYCLE TESTS
+    // SCALE-TO-ZERO TESTS
     // ===================
 
     #[tokio::test]
-    async fn test_spawn_process_instance() {
+    async fn test_idle_reap_scales_to_zero_until_woken() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.service.get_mut("api").unwrap().idle_timeout = Some(60);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "prod").await.unwrap();
+        assert_eq!(hypervisor.scaled_to_zero_instance("api").await, None);
 
-        let config = test_config_with_process("test-api", script.to_str().unwrap(), vec![]);
+        async fn make_idle(hypervisor: &Hypervisor) {
+            let mut instances = hypervisor.instances.write().await;
+            let instance = instances.get_mut(&InstanceId::new("api", "prod")).unwrap();
+            instance.last_activity = Instant::now() - Duration::from_secs(120);
+        }
+        make_idle(&hypervisor).await;
+        hypervisor.reap_idle_instances().await;
+        assert!(!hypervisor.is_running("api", "prod").await);
+        assert_eq!(hypervisor.scaled_to_zero_instance("api").await.as_deref(), Some("prod"));
+
+        // The next request wakes it
+        hypervisor.spawn_and_wait("api", "prod").await.unwrap();
+        assert!(hypervisor.is_running("api", "prod").await);
+        assert_eq!(hypervisor.scaled_to_zero_instance("api").await, None);
+
+        // An explicit stop of a scaled-to-zero instance takes it out for good
+        make_idle(&hypervisor).await;
+        hypervisor.reap_idle_instances().await;
+        hypervisor.stop("api", "prod").await.unwrap();
+        assert_eq!(hypervisor.scaled_to_zero_instance("api").await, None);
+        assert!(hypervisor.stop("api", "prod").await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_wake_waits_for_health_check() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("booted");
+        let script = dir.path().join("slow.sh");
+        std::fs::write(
+            &script,
+            format!(
+                "#!/bin/bash\ntouch \"$SOCKET_PATH\"\nsleep 1\ntouch {}\nsleep 30\n",
+                marker.display()
+            ),
+        )
+        .unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.check_type = HealthCheckType::Exec;
+        service.health_check.command = Some(format!("test -f {}", marker.display()));
+        service.health_check.recovery_threshold = 1;
         let hypervisor = Hypervisor::new(config);
 
-        let result = hypervisor.spawn("test-api", "instance1").await;
-        assert!(result.is_ok(), "Spawn should succeed: {:?}", result.err());
+        hypervisor.spawn_and_wait("api", "prod").await.unwrap();
+        assert!(marker.exists(), "wake returned before the health check passed");
 
-        // Verify instance is tracked
-        assert!(hypervisor.is_running("test-api", "instance1").await);
+        hypervisor.stop("api", "prod").await.ok();
+    }
 
-        // Clean up
-        hypervisor.stop("test-api", "instance1").await.ok();
+    // ===================
+    // CONFIG RELOAD TESTS
+    // ===================
+
+    /// `api` and `worker` from one script, each with one configured instance
+    fn reload_config(script: &Path) -> Config {
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let api = config.service["api"].clone();
+        config.service.insert("worker".to_string(), api);
+        config.instances.insert("api".to_string(), vec!["prod".to_string()]);
+        config.instances.insert("worker".to_string(), vec!["bg".to_string()]);
+        config
     }
 
     #[tokio::test]
-    async fn test_spawn_creates_instance_entry() {
+    async fn test_reload_applies_only_the_differences() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
+        let config = reload_config(&script);
+        let hypervisor = Hypervisor::new(config.clone());
+        hypervisor.spawn_configured_instances().await;
+        // Started by hand, not from [instances]: left alone unless its service changes
+        hypervisor.spawn("worker", "adhoc").await.unwrap();
+        let api_prod = InstanceId::new("api", "prod");
+        let worker_adhoc = InstanceId::new("worker", "adhoc");
+        let api_pid = instance_pid(&hypervisor, &api_prod).await;
+        let adhoc_pid = instance_pid(&hypervisor, &worker_adhoc).await;
+
+        // api changes, web is added, worker keeps its definition but loses "bg"
+        let mut updated = config.clone();
+        let api = updated.service.get_mut("api").unwrap();
+        api.env.insert("FEATURE".to_string(), "on".to_string());
+        let web = updated.service["worker"].clone();
+        updated.service.insert("web".to_string(), web);
+        updated.instances.insert("web".to_string(), vec!["main".to_string()]);
+        updated.instances.remove("worker");
+
+        let report = hypervisor.reload(updated).await.unwrap();
+        assert_eq!(report.diff.added, vec!["web"]);
+        assert_eq!(report.diff.changed.len(), 2, "{:?}", report.diff);
+        assert_eq!(report.stopped, vec![InstanceId::new("worker", "bg")]);
+        assert_eq!(report.restarted, vec![api_prod.clone()]);
+        assert_eq!(report.started, vec![InstanceId::new("web", "main")]);
+        assert!(report.failed.is_empty());
+
+        assert!(!hypervisor.is_running("worker", "bg").await);
+        assert!(hypervisor.is_running("worker", "adhoc").await);
+        assert!(hypervisor.is_running("web", "main").await);
+        assert_ne!(instance_pid(&hypervisor, &api_prod).await, api_pid);
+        assert_eq!(instance_pid(&hypervisor, &worker_adhoc).await, adhoc_pid);
+        assert_eq!(hypervisor.config().service["api"].env["FEATURE"], "on");
+
+        // Reloading the same config again changes nothing
+        let report = hypervisor.reload((*hypervisor.config()).clone()).await.unwrap();
+        assert!(report.diff.is_empty());
+        assert!(report.restarted.is_empty() && report.started.is_empty());
+
+        for (process, id) in [("api", "prod"), ("worker", "adhoc"), ("web", "main")] {
+            hypervisor.stop(process, id).await.ok();
+        }
+    }
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        let hypervisor = Hypervisor::new(config);
+    #[tokio::test]
+    async fn test_reload_removed_service_stops_its_instances() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let config = reload_config(&script);
+        let hypervisor = Hypervisor::new(config.clone());
+        hypervisor.spawn_configured_instances().await;
+        hypervisor.spawn("worker", "adhoc").await.unwrap();
+
+        let mut updated = config;
+        updated.service.remove("worker");
+        updated.instances.remove("worker");
+        let report = hypervisor.reload(updated).await.unwrap();
+
+        assert_eq!(report.diff.removed, vec!["worker"]);
+        assert_eq!(report.stopped.len(), 2);
+        assert!(report.restarted.is_empty(), "api didn't change");
+        assert!(!hypervisor.has_process("worker"));
+        assert!(hypervisor.spawn("worker", "adhoc").await.is_err());
+        assert!(hypervisor.is_running("api", "prod").await);
 
-        // Initially empty
-        let list = hypervisor.list().await;
-        assert!(list.is_empty());
+        hypervisor.stop("api", "prod").await.ok();
+    }
 
-        // Spawn
-        hypervisor.spawn("api", "user1").await.unwrap();
+    #[tokio::test]
+    async fn test_reload_keeps_startup_settings() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+        let config = reload_config(&script);
+        let hypervisor = Hypervisor::new(config.clone());
 
-        // Should appear in list
-        let list = hypervisor.list().await;
-        assert_eq!(list.len(), 1);
-        assert_eq!(list[0].id.process, "api");
-        assert_eq!(list[0].id.id, "user1");
+        let mut updated = config.clone();
+        updated.settings.shutdown_timeout_secs += 100;
+        hypervisor.reload(updated).await.unwrap();
+        assert_eq!(
+            hypervisor.config().settings.shutdown_timeout_secs,
+            config.settings.shutdown_timeout_secs
+        );
+        assert_eq!(
+            hypervisor.shutdown_timeout(),
+            Duration::from_secs(config.settings.shutdown_timeout_secs)
+        );
+    }
 
-        // Clean up
-        hypervisor.stop("api", "user1").await.ok();
+    #[tokio::test]
+    async fn test_reload_applies_cluster_peers() {
+        let mut config = Config::default();
+        config.settings.cluster = Some(crate::config::ClusterConfig {
+            node: "a".to_string(),
+            advertise: "10.0.0.1:8080".to_string(),
+            peers: Vec::new(),
+            mode: crate::config::ClusterMode::Active,
+            token_env: "TENEMENT_CLUSTER_TOKEN".to_string(),
+            heartbeat: 1,
+            failure_timeout: 5,
+        });
+        let hypervisor = Hypervisor::new(config.clone());
+
+        let mut updated = config.clone();
+        let cluster = updated.settings.cluster.as_mut().unwrap();
+        cluster.peers.push(crate::config::PeerConfig {
+            node: "b".to_string(),
+            address: "10.0.0.2:8080".to_string(),
+        });
+        hypervisor.reload(updated.clone()).await.unwrap();
+        let peers = hypervisor.cluster().unwrap().peers();
+        assert_eq!(peers.len(), 1);
+        assert_eq!(peers[0].node, "b");
+        let reloaded = hypervisor.config();
+        assert_eq!(reloaded.settings.cluster.as_ref().unwrap().peers.len(), 1);
+
+        // Renaming the node waits for a restart
+        updated.settings.cluster.as_mut().unwrap().node = "z".to_string();
+        hypervisor.reload(updated).await.unwrap();
+        assert_eq!(hypervisor.cluster().unwrap().node(), "a");
+        let reloaded = hypervisor.config();
+        assert_eq!(reloaded.settings.cluster.as_ref().unwrap().node, "a");
     }
 
     #[tokio::test]
-    async fn test_spawn_returns_socket_path() {
+    async fn test_plan_reload_changes_nothing() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
+        let config = reload_config(&script);
+        let hypervisor = Hypervisor::new(config.clone());
+        hypervisor.spawn_configured_instances().await;
+        let api_prod = InstanceId::new("api", "prod");
+        let api_pid = instance_pid(&hypervisor, &api_prod).await;
+
+        let mut updated = config.clone();
+        let api = updated.service.get_mut("api").unwrap();
+        api.env.insert("FEATURE".to_string(), "on".to_string());
+        updated.service.remove("worker");
+        updated.instances.remove("worker");
+        updated.instances.insert(
+            "api".to_string(),
+            vec!["prod".to_string(), "eu".to_string()],
+        );
 
-        let config = test_config_with_process("myapp", script.to_str().unwrap(), vec![]);
-        let hypervisor = Hypervisor::new(config);
+        let plan = hypervisor.plan_reload(updated).await;
+        assert_eq!(plan.diff.removed, vec!["worker"]);
+        assert_eq!(plan.stopped, vec![InstanceId::new("worker", "bg")]);
+        assert_eq!(plan.restarted, vec![api_prod.clone()]);
+        assert_eq!(plan.started, vec![InstanceId::new("api", "eu")]);
 
-        let socket = hypervisor.spawn("myapp", "prod").await.unwrap();
-        assert!(socket.to_string_lossy().contains("myapp"));
-        assert!(socket.to_string_lossy().contains("prod"));
+        assert!(hypervisor.is_running("worker", "bg").await);
+        assert!(!hypervisor.is_running("api", "eu").await);
+        assert_eq!(instance_pid(&hypervisor, &api_prod).await, api_pid);
+        let config = hypervisor.config();
+        assert!(!config.service["api"].env.contains_key("FEATURE"));
 
-        hypervisor.stop("myapp", "prod").await.ok();
+        for (process, id) in [("api", "prod"), ("worker", "bg")] {
+            hypervisor.stop(process, id).await.ok();
+        }
     }
 
+    // ===================
+    // DEPLOY COMMAND TESTS
+    // ===================
+
     #[tokio::test]
-    async fn test_spawn_with_command_string_shell_splits() {
-        // When command is "echo hello world" with no explicit args,
-        // it should be shell-split into command="echo", args=["hello", "world"]
-        let config = test_config_with_process("api", "echo hello world", vec![]);
+    async fn test_deploy_and_wait_healthy_no_health_endpoint() {
+        // When no health endpoint is configured, instance is healthy if socket exists
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        let result = hypervisor.spawn("api", "test").await;
-        assert!(
-            result.is_ok(),
-            "Shell-split command should spawn: {:?}",
-            result.err()
-        );
+        // Deploy v2 with default weight
+        let result = hypervisor
+            .deploy_and_wait_healthy("api", "v2", 100, 5)
+            .await;
+        assert!(result.is_ok(), "Deploy should succeed: {:?}", result.err());
 
-        hypervisor.stop("api", "test").await.ok();
+        // Verify instance is running with correct weight
+        let info = hypervisor.get("api", "v2").await.unwrap();
+        assert_eq!(info.weight, 100);
+
+        hypervisor.stop("api", "v2").await.ok();
     }
 
     #[tokio::test]
-    async fn test_spawn_with_explicit_args_no_split() {
-        // When args are explicitly provided, command should NOT be split
-        let config = test_config_with_process("api", "echo", vec!["hello", "world"]);
+    async fn test_deploy_with_initial_weight() {
+        // Deploy with a low initial weight (canary style)
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        let result = hypervisor.spawn("api", "test").await;
-        assert!(
-            result.is_ok(),
-            "Explicit args should spawn: {:?}",
-            result.err()
-        );
+        // Deploy v2 with 10% weight
+        let result = hypervisor.deploy_and_wait_healthy("api", "v2", 10, 5).await;
+        assert!(result.is_ok());
 
-        hypervisor.stop("api", "test").await.ok();
+        // Verify weight was set
+        let info = hypervisor.get("api", "v2").await.unwrap();
+        assert_eq!(info.weight, 10);
+
+        hypervisor.stop("api", "v2").await.ok();
     }
 
     #[tokio::test]
-    async fn test_spawn_with_interpolation_and_shell_split() {
-        // Command with interpolation vars should be interpolated first, then shell-split
-        let config = test_config_with_process("api", "echo --id {id} --name {name}", vec![]);
+    async fn test_deploy_unknown_process() {
+        let config = Config::default();
         let hypervisor = Hypervisor::new(config);
 
-        // Should interpolate to "echo --id user123 --name api" then split into
-        // command="echo", args=["--id", "user123", "--name", "api"]
-        let result = hypervisor.spawn("api", "user123").await;
-        assert!(
-            result.is_ok(),
-            "Interpolated+split command should spawn: {:?}",
-            result.err()
-        );
-
-        hypervisor.stop("api", "user123").await.ok();
+        let result = hypervisor
+            .deploy_and_wait_healthy("nonexistent", "v1", 100, 5)
+            .await;
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("Unknown process"));
     }
 
+    // ===================
+    // ROUTE SWAP TESTS
+    // ===================
+
     #[tokio::test]
-    async fn test_stop_instance() {
+    async fn test_route_swap() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
 
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        hypervisor.spawn("api", "test").await.unwrap();
-        assert!(hypervisor.is_running("api", "test").await);
+        // Spawn v1 and v2
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
 
-        let result = hypervisor.stop("api", "test").await;
+        // Initially both have weight 100
+        let v1_info = hypervisor.get("api", "v1").await.unwrap();
+        let v2_info = hypervisor.get("api", "v2").await.unwrap();
+        assert_eq!(v1_info.weight, 100);
+        assert_eq!(v2_info.weight, 100);
+
+        // Swap traffic from v1 to v2
+        let result = hypervisor.route_swap("api", "v1", "v2").await;
         assert!(result.is_ok());
-        assert!(!hypervisor.is_running("api", "test").await);
+
+        // Verify weights swapped atomically
+        let v1_info = hypervisor.get("api", "v1").await.unwrap();
+        let v2_info = hypervisor.get("api", "v2").await.unwrap();
+        assert_eq!(v1_info.weight, 0);
+        assert_eq!(v2_info.weight, 100);
+
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
     }
 
     #[tokio::test]
-    async fn test_stop_nonexistent_instance_returns_error() {
-        let config = Config::default();
+    async fn test_route_swap_from_not_found() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
+
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        let result = hypervisor.stop("nonexistent", "id").await;
+        // Only spawn v2
+        hypervisor.spawn("api", "v2").await.unwrap();
+
+        // Try to swap from non-existent v1
+        let result = hypervisor.route_swap("api", "v1", "v2").await;
         assert!(result.is_err());
         assert!(result.unwrap_err().to_string().contains("not found"));
+
+        hypervisor.stop("api", "v2").await.ok();
     }
 
     #[tokio::test]
-    async fn test_list_instances() {
+    async fn test_route_swap_to_not_found() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
 
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        // Spawn multiple instances
-        hypervisor.spawn("api", "user1").await.unwrap();
-        hypervisor.spawn("api", "user2").await.unwrap();
-
-        let list = hypervisor.list().await;
-        assert_eq!(list.len(), 2);
+        // Only spawn v1
+        hypervisor.spawn("api", "v1").await.unwrap();
 
-        // Verify both are present
-        let ids: Vec<String> = list.iter().map(|i| i.id.id.clone()).collect();
-        assert!(ids.contains(&"user1".to_string()));
-        assert!(ids.contains(&"user2".to_string()));
+        // Try to swap to non-existent v2
+        let result = hypervisor.route_swap("api", "v1", "v2").await;
+        assert!(result.is_err());
+        assert!(result.unwrap_err().to_string().contains("not found"));
 
-        // Clean up
-        hypervisor.stop("api", "user1").await.ok();
-        hypervisor.stop("api", "user2").await.ok();
+        hypervisor.stop("api", "v1").await.ok();
     }
 
     #[tokio::test]
-    async fn test_get_instance() {
+    async fn test_route_swap_weighted_routing() {
+        // Verify that after route swap, only the target version receives traffic
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
 
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        hypervisor.spawn("api", "user1").await.unwrap();
+        hypervisor.spawn("api", "v1").await.unwrap();
+        hypervisor.spawn("api", "v2").await.unwrap();
 
-        let info = hypervisor.get("api", "user1").await;
-        assert!(info.is_some());
-        let info = info.unwrap();
-        assert_eq!(info.id.process, "api");
-        assert_eq!(info.id.id, "user1");
+        // Route all traffic from v1 to v2
+        hypervisor.route_swap("api", "v1", "v2").await.unwrap();
 
-        // Non-existent should return None
-        assert!(hypervisor.get("api", "nonexistent").await.is_none());
+        // All weighted selections should now go to v2 (v1 has weight 0)
+        for _ in 0..10 {
+            let selected = hypervisor.select_weighted("api").await;
+            assert!(selected.is_some());
+            assert_eq!(selected.unwrap().id.id, "v2");
+        }
 
-        hypervisor.stop("api", "user1").await.ok();
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
     }
 
     #[tokio::test]
-    async fn test_spawn_if_not_running() {
+    async fn test_blue_green_workflow() {
+        // Full blue/green deployment workflow
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
 
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        // First call spawns
-        let socket1 = hypervisor
-            .spawn_if_not_running("api", "test")
+        // 1. Deploy v1 (blue) initially
+        hypervisor
+            .deploy_and_wait_healthy("api", "v1", 100, 5)
             .await
             .unwrap();
 
-        // Second call returns existing socket without spawning again
-        let socket2 = hypervisor
-            .spawn_if_not_running("api", "test")
+        // 2. Deploy v2 (green) with weight 0 (no traffic yet)
+        hypervisor
+            .deploy_and_wait_healthy("api", "v2", 0, 5)
             .await
             .unwrap();
-        assert_eq!(socket1, socket2);
 
-        // Only one instance in list
-        let list = hypervisor.list().await;
-        assert_eq!(list.len(), 1);
+        // At this point, all traffic goes to v1
+        for _ in 0..5 {
+            let selected = hypervisor.select_weighted("api").await;
+            assert_eq!(selected.unwrap().id.id, "v1");
+        }
 
-        hypervisor.stop("api", "test").await.ok();
+        // 3. Atomic swap: route all traffic from v1 to v2, which only now
+        // counts as deployed
+        let mut events = hypervisor.subscribe_events();
+        hypervisor.route_swap("api", "v1", "v2").await.unwrap();
+        let deployed = events.try_recv().unwrap();
+        assert_eq!(deployed.event, EventKind::Deployed);
+        assert_eq!(deployed.instance.as_deref(), Some("api:v2"));
+
+        // Now all traffic goes to v2
+        for _ in 0..5 {
+            let selected = hypervisor.select_weighted("api").await;
+            assert_eq!(selected.unwrap().id.id, "v2");
+        }
+
+        // 4. Stop old version v1
+        hypervisor.stop("api", "v1").await.unwrap();
+
+        // Only v2 remains
+        let instances = hypervisor.list_by_process("api").await;
+        assert_eq!(instances.len(), 1);
+        assert_eq!(instances[0].id.id, "v2");
+
+        hypervisor.stop("api", "v2").await.ok();
     }
 
     #[tokio::test]
-    async fn test_spawn_already_running_returns_socket() {
+    async fn test_deploy_replace_swaps_and_stops_old() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
-
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
 
-        let socket1 = hypervisor.spawn("api", "test").await.unwrap();
-        let socket2 = hypervisor.spawn("api", "test").await.unwrap();
+        let socket = hypervisor
+            .deploy_replace("api", "v1", "v2", 5, Duration::from_secs(1))
+            .await
+            .unwrap();
 
-        // Both return same socket (idempotent)
-        assert_eq!(socket1, socket2);
+        // v2 got a fresh socket and all the traffic; v1 is gone
+        assert!(socket.to_string_lossy().contains("v2"));
+        let instances = hypervisor.list_by_process("api").await;
+        assert_eq!(instances.len(), 1);
+        assert_eq!(instances[0].id.id, "v2");
+        assert_eq!(instances[0].weight, 100);
 
-        hypervisor.stop("api", "test").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
     }
 
-    // ===================
-    // ERROR PATH TESTS
-    // ===================
+    #[tokio::test]
+    async fn test_deploy_replace_rolls_back_unhealthy_version() {
+        let dir = TempDir::new().unwrap();
+        // Versions with "bad" in their ID die before creating their socket
+        let script = dir.path().join("picky.sh");
+        std::fs::write(
+            &script,
+            "#!/bin/bash
+case \"$SOCKET_PATH\" in *bad*) exit 1;; esac
+\
+             touch \"$SOCKET_PATH\"\nsleep 30\n",
+        )
+        .unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.service.get_mut("api").unwrap().restart = "never".to_string();
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
+
+        let err = hypervisor
+            .deploy_replace("api", "v1", "v2-bad", 2, Duration::from_secs(1))
+            .await
+            .unwrap_err();
+        assert!(format!("{:#}", err).contains("api:v1 is still serving"), "{:#}", err);
+
+        // The old version is untouched and still takes all traffic
+        let instances = hypervisor.list_by_process("api").await;
+        assert_eq!(instances.len(), 1);
+        assert_eq!(instances[0].id.id, "v1");
+        assert_eq!(hypervisor.select_weighted("api").await.unwrap().id.id, "v1");
+
+        hypervisor.stop("api", "v1").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_deploy_replace_requires_running_version() {
+        let hypervisor = Hypervisor::new(test_config_with_process("api", "sleep", vec!["30"]));
+        let err = hypervisor
+            .deploy_replace("api", "v1", "v2", 5, Duration::from_secs(1))
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("not found"));
+        assert!(hypervisor.list_by_process("api").await.is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_release_pin_overrides_definition() {
+        let dir = TempDir::new().unwrap();
+        let out = dir.path().join("out");
+        let script = format!("echo $LEVEL $TENEMENT_ARTIFACT $(pwd) > {}; sleep 30", out.display());
+        let mut config = test_config_with_process("api", "sh", vec!["-c", "sleep 30"]);
+        config.service.get_mut("api").unwrap().env.insert("LEVEL".into(), "info".into());
+        let hypervisor = Hypervisor::new(config.clone());
+
+        let pin = ReleasePin {
+            args: Some(vec!["-c".to_string(), script]),
+            env: Some(HashMap::from([("LEVEL".to_string(), "debug".to_string())])),
+            artifact: Some("/srv/builds/v1".to_string()),
+            workdir: Some(dir.path().display().to_string()),
+            ..Default::default()
+        };
+        hypervisor.pin_release("api", "v1", pin).await;
+        hypervisor.spawn("api", "v1").await.unwrap();
+        let mut written = String::new();
+        for _ in 0..40 {
+            written = std::fs::read_to_string(&out).unwrap_or_default();
+            if !written.is_empty() {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        let workdir = dir.path().canonicalize().unwrap();
+        assert_eq!(written.trim(), format!("debug /srv/builds/v1 {}", workdir.display()));
+        hypervisor.stop("api", "v1").await.ok();
+
+        // Editing the service drops the pinned definition but keeps the artifact and its dir
+        config.service.get_mut("api").unwrap().env.insert("LEVEL".into(), "warn".into());
+        hypervisor.reload(config).await.unwrap();
+        let pins = hypervisor.release_pins.read().unwrap();
+        let pin = pins.get(&InstanceId::new("api", "v1")).unwrap();
+        assert!(pin.args.is_none() && pin.env.is_none());
+        assert_eq!(pin.artifact.as_deref(), Some("/srv/builds/v1"));
+        assert!(pin.workdir.is_some());
+    }
+
+    #[tokio::test]
+    async fn test_missing_release_dir_is_fetched_again() {
+        let dir = TempDir::new().unwrap();
+        let artifact = dir.path().join("api-v1");
+        std::fs::write(&artifact, "#!/bin/sh\n").unwrap();
+        let workdir = dir.path().join("releases").join("v1");
+        let config = test_config_with_process("api", "sleep", vec!["30"]);
+        let hypervisor = Hypervisor::new(config);
+        let pin = ReleasePin {
+            artifact: Some(format!("file://{}", artifact.display())),
+            workdir: Some(workdir.display().to_string()),
+            ..Default::default()
+        };
+        hypervisor.pin_release("api", "v1", pin).await;
+
+        hypervisor.spawn("api", "v1").await.unwrap();
+        assert!(workdir.join("api-v1").exists());
+        hypervisor.stop("api", "v1").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_instance_env_carries_metadata() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let api = config.service.get_mut("api").unwrap();
+        api.env.insert("API_TOKEN".into(), "tok-live-abc123".into());
+        api.env.insert("LEVEL".into(), "info".into());
+        let hypervisor = Hypervisor::new(config);
+        let pin = ReleasePin {
+            git_sha: Some("0a1b2c3d4e5f60718293a4b5c6d7e8f901234567".to_string()),
+            release: Some(7),
+            ..Default::default()
+        };
+        hypervisor.pin_release("api", "0a1b2c3", pin).await;
+        hypervisor.spawn("api", "0a1b2c3").await.unwrap();
+
+        let env = hypervisor.env("api", "0a1b2c3").await.unwrap();
+        let socket = hypervisor.get("api", "0a1b2c3").await.unwrap().socket;
+        assert_eq!(env["TENEMENT_APP"], "api");
+        assert_eq!(env["TENEMENT_RELEASE"], "7");
+        assert_eq!(env["TENEMENT_INSTANCE"], "api:0a1b2c3");
+        assert_eq!(
+            env["TENEMENT_SOCKET_DIR"],
+            socket.parent().unwrap().to_string_lossy()
+        );
+        assert_eq!(
+            env["TENEMENT_GIT_SHA"],
+            "0a1b2c3d4e5f60718293a4b5c6d7e8f901234567"
+        );
+        assert_eq!(env["LEVEL"], "info");
+        assert_eq!(env["API_TOKEN"], crate::redact::REDACTED);
+        assert!(hypervisor.env("api", "missing").await.is_none());
+
+        // One that isn't running resolves from the config
+        let resolved = hypervisor.resolved_env("api", "next").unwrap();
+        assert_eq!(resolved["TENEMENT_RELEASE"], "next");
+        assert_eq!(resolved["TENEMENT_INSTANCE"], "api:next");
+        assert_eq!(resolved["LEVEL"], "info");
+        assert_eq!(resolved["API_TOKEN"], crate::redact::REDACTED);
+        assert!(hypervisor.resolved_env("web", "next").is_err());
+        hypervisor.stop("api", "0a1b2c3").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_access_logs_and_releases() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let mut web = config.service["api"].clone();
+        web.access_log = Some(toml::from_str("output = \"stdout\"").unwrap());
+        config.service.insert("web".to_string(), web);
+        let api = config.service.get_mut("api").unwrap();
+        api.env.insert("APP_VERSION".into(), "v1".into());
+        let hypervisor = Hypervisor::new(config.clone());
+        assert!(hypervisor.access_log("api").is_none());
+        assert!(hypervisor.access_log("web").is_some());
+
+        // [settings.access_log] covers every service without its own (after a restart)
+        config.settings.access_log = Some(toml::from_str("format = \"json\"").unwrap());
+        let hypervisor = Hypervisor::new(config);
+        let api = hypervisor.access_log("api").unwrap();
+        let web = hypervisor.access_log("web").unwrap();
+        assert!(!Arc::ptr_eq(&api, &web));
+
+        assert_eq!(hypervisor.release("api", "prod").as_deref(), Some("v1"));
+        assert_eq!(hypervisor.release("web", "prod"), None);
+        let pin = ReleasePin {
+            app_version: Some("0a1b2c3".to_string()),
+            ..Default::default()
+        };
+        hypervisor.pin_release("api", "v2", pin).await;
+        assert_eq!(hypervisor.release("api", "v2").as_deref(), Some("0a1b2c3"));
+    }
 
     #[tokio::test]
-    async fn test_spawn_unknown_process_returns_error() {
-        let config = Config::default();
+    async fn test_preview_pin_starts_without_traffic() {
+        let config = test_config_with_process("api", "sleep", vec!["30"]);
         let hypervisor = Hypervisor::new(config);
+        let pin = ReleasePin {
+            preview: true,
+            ..Default::default()
+        };
+        hypervisor.pin_release("api", "pr-1", pin).await;
+        hypervisor.spawn("api", "pr-1").await.unwrap();
+        hypervisor.spawn("api", "prod").await.unwrap();
+        assert_eq!(hypervisor.get("api", "pr-1").await.unwrap().weight, 0);
+        assert_eq!(hypervisor.get("api", "prod").await.unwrap().weight, 100);
 
-        let result = hypervisor.spawn("nonexistent", "id").await;
-        assert!(result.is_err());
-        assert!(result.unwrap_err().to_string().contains("Unknown process"));
+        hypervisor.stop("api", "pr-1").await.unwrap();
+        hypervisor.unpin_release("api", "pr-1").await;
+        assert!(hypervisor.release_pins.read().unwrap().is_empty());
+        hypervisor.stop("api", "prod").await.ok();
+    }
+
+    #[test]
+    fn test_release_pin_swaps_container_image() {
+        let config = test_config_with_process("api", "sleep", vec!["30"]);
+        let mut process_config = config.get_service("api").unwrap().clone();
+        process_config.isolation = RuntimeType::Container;
+        process_config.image = Some("registry.local/api:v1".to_string());
+
+        ReleasePin::default().apply(&mut process_config);
+        assert_eq!(process_config.image.as_deref(), Some("registry.local/api:v1"));
+        let pin = ReleasePin {
+            image: Some("registry.local/api:v2".to_string()),
+            ..Default::default()
+        };
+        pin.apply(&mut process_config);
+        assert_eq!(process_config.image.as_deref(), Some("registry.local/api:v2"));
+    }
+
+    /// Service `api` running the touch-socket script with the given deploy strategy
+    fn deploy_strategy_config(dir: &Path, strategy: DeployStrategy) -> Config {
+        let script = create_touch_socket_script(dir);
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let deploy = &mut config.service.get_mut("api").unwrap().deploy;
+        deploy.strategy = strategy;
+        deploy.canary_percent = 25;
+        deploy.canary_duration = 2;
+        deploy.min_requests = 10;
+        config
     }
 
     #[tokio::test]
-    async fn test_spawn_command_not_found() {
-        let config = test_config_with_process("api", "/nonexistent/binary", vec![]);
+    async fn test_deploy_blue_green_keeps_old_version_idle() {
+        let dir = TempDir::new().unwrap();
+        let config = deploy_strategy_config(dir.path(), DeployStrategy::BlueGreen);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "blue").await.unwrap();
 
-        let result = hypervisor.spawn("api", "test").await;
-        assert!(result.is_err());
+        hypervisor
+            .deploy_replace("api", "blue", "green", 5, Duration::from_secs(1))
+            .await
+            .unwrap();
+        assert_eq!(hypervisor.get("api", "blue").await.unwrap().weight, 0);
+        assert_eq!(hypervisor.get("api", "green").await.unwrap().weight, 100);
+
+        // Switching back is just a route swap
+        hypervisor.route_swap("api", "green", "blue").await.unwrap();
+        assert_eq!(hypervisor.select_weighted("api").await.unwrap().id.id, "blue");
+
+        hypervisor.stop("api", "blue").await.ok();
+        hypervisor.stop("api", "green").await.ok();
     }
 
     #[tokio::test]
-    async fn test_has_process() {
-        let config = test_config_with_process("myapi", "sleep", vec!["1"]);
+    async fn test_deploy_canary_promotes_healthy_version() {
+        let dir = TempDir::new().unwrap();
+        let config = deploy_strategy_config(dir.path(), DeployStrategy::Canary);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
 
-        assert!(hypervisor.has_process("myapi"));
-        assert!(!hypervisor.has_process("unknown"));
-    }
+        let deploying = tokio::spawn({
+            let hypervisor = hypervisor.clone();
+            async move {
+                hypervisor
+                    .deploy_replace("api", "v1", "v2", 5, Duration::from_secs(1))
+                    .await
+            }
+        });
+        // During the canary, traffic is split by canary_percent
+        let mut split = None;
+        for _ in 0..40 {
+            let weights = (
+                hypervisor.get("api", "v1").await.map(|i| i.weight),
+                hypervisor.get("api", "v2").await.map(|i| i.weight),
+            );
+            if weights == (Some(75), Some(25)) {
+                split = Some(weights);
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        assert!(split.is_some(), "canary never split traffic");
 
-    // ===================
-    // RESTART TESTS
-    // ===================
+        deploying.await.unwrap().unwrap();
+        let instances = hypervisor.list_by_process("api").await;
+        assert_eq!(instances.len(), 1);
+        assert_eq!((instances[0].id.id.as_str(), instances[0].weight), ("v2", 100));
+        hypervisor.stop("api", "v2").await.ok();
+    }
 
     #[tokio::test]
-    async fn test_restart_instance() {
+    async fn test_deploy_canary_rolls_back_on_errors() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
-
-        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        // Use zero backoff for faster tests
-        config.settings.backoff_base_ms = 0;
+        let config = deploy_strategy_config(dir.path(), DeployStrategy::Canary);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "v1").await.unwrap();
 
-        hypervisor.spawn("api", "test").await.unwrap();
-
-        // Restart
-        let result = hypervisor.restart("api", "test").await;
-        assert!(result.is_ok());
+        let deploying = tokio::spawn({
+            let hypervisor = hypervisor.clone();
+            async move {
+                hypervisor
+                    .deploy_replace("api", "v1", "v2", 5, Duration::from_secs(1))
+                    .await
+            }
+        });
+        while hypervisor.get("api", "v2").await.map(|i| i.weight) != Some(25) {
+            tokio::time::sleep(Duration::from_millis(20)).await;
+        }
+        // What the proxy records for the canary: 4 of 12 requests failed
+        let mut labels = crate::metrics::Labels::new();
+        labels.insert("process".to_string(), "api".to_string());
+        labels.insert("instance".to_string(), "v2".to_string());
+        let metrics = hypervisor.metrics();
+        metrics.requests_total.with_labels(&labels).await.inc_by(12);
+        metrics.request_errors_total.with_labels(&labels).await.inc_by(4);
 
-        // Should still be running
-        assert!(hypervisor.is_running("api", "test").await);
+        let err = deploying.await.unwrap().unwrap_err();
+        let message = format!("{:#}", err);
+        assert!(message.contains("api:v1 is serving"), "{}", message);
+        assert!(message.contains("error rate 33.3% over 12 requests"), "{}", message);
 
-        hypervisor.stop("api", "test").await.ok();
+        let instances = hypervisor.list_by_process("api").await;
+        assert_eq!(instances.len(), 1);
+        assert_eq!((instances[0].id.id.as_str(), instances[0].weight), ("v1", 100));
+        hypervisor.stop("api", "v1").await.ok();
     }
 
     #[tokio::test]
-    async fn test_restart_increments_counter() {
+    async fn test_canary_workflow() {
+        // Full canary deployment workflow
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
 
-        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        config.settings.backoff_base_ms = 0;
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        hypervisor.spawn("api", "test").await.unwrap();
+        // 1. v1 is running with full traffic
+        hypervisor
+            .deploy_and_wait_healthy("api", "v1", 100, 5)
+            .await
+            .unwrap();
 
-        // Check initial restart count
-        let info = hypervisor.get("api", "test").await.unwrap();
-        assert_eq!(info.restarts, 0);
+        // 2. Deploy v2 with 10% traffic (canary)
+        hypervisor
+            .deploy_and_wait_healthy("api", "v2", 10, 5)
+            .await
+            .unwrap();
 
-        // Restart
-        hypervisor.restart("api", "test").await.unwrap();
+        // Traffic split is now roughly 91% v1, 9% v2 (100:10 ratio)
+        let v1_info = hypervisor.get("api", "v1").await.unwrap();
+        let v2_info = hypervisor.get("api", "v2").await.unwrap();
+        assert_eq!(v1_info.weight, 100);
+        assert_eq!(v2_info.weight, 10);
 
-        // Restart count should be 1
-        let info = hypervisor.get("api", "test").await.unwrap();
-        assert_eq!(info.restarts, 1);
+        // 3. Increase v2 weight to 50%
+        hypervisor.set_weight("api", "v2", 50).await.unwrap();
 
-        hypervisor.stop("api", "test").await.ok();
+        // 4. Full rollout: set v1=0, v2=100
+        hypervisor.set_weight("api", "v1", 0).await.unwrap();
+        hypervisor.set_weight("api", "v2", 100).await.unwrap();
+
+        // All traffic now goes to v2
+        for _ in 0..5 {
+            let selected = hypervisor.select_weighted("api").await;
+            assert_eq!(selected.unwrap().id.id, "v2");
+        }
+
+        // 5. Stop v1
+        hypervisor.stop("api", "v1").await.ok();
+        hypervisor.stop("api", "v2").await.ok();
     }
 
     // ===================
-    // ACTIVITY TRACKING TESTS
+    // SECRETS ROTATION TESTS
     // ===================
 
+    // Helper: a process that copies its secrets file to $RELOAD_MARKER on SIGHUP
+    fn create_reload_script(dir: &Path) -> PathBuf {
+        let script_path = dir.join("reload.sh");
+        let script = r#"#!/bin/bash
+trap 'cp "$TENEMENT_SECRETS_FILE" "$RELOAD_MARKER"' HUP
+rm -f "$SOCKET_PATH"
+touch "$SOCKET_PATH"
+while true; do sleep 0.1; done
+"#;
+        std::fs::write(&script_path, script).unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        script_path
+    }
+
+    fn config_with_secret(script: &Path, secret: &Path, reload_signal: Option<&str>) -> Config {
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let process = config.service.get_mut("api").unwrap();
+        process.secrets.insert("API_KEY".to_string(), SecretSource::File(secret.to_path_buf()));
+        process.reload_signal = reload_signal.map(|s| s.to_string());
+        process.env.insert(
+            "RELOAD_MARKER".to_string(),
+            secret.with_extension("reloaded").to_string_lossy().to_string(),
+        );
+        config
+    }
+
+    async fn instance_pid(hypervisor: &Hypervisor, id: &InstanceId) -> Option<u32> {
+        let instances = hypervisor.instances.read().await;
+        instances.get(id).and_then(|i| i.handle.pid())
+    }
+
     #[tokio::test]
-    async fn test_touch_activity() {
+    async fn test_spawn_writes_secrets_file_and_env() {
         let dir = TempDir::new().unwrap();
+        let secret = dir.path().join("api_key");
+        std::fs::write(&secret, "v1\n").unwrap();
         let script = create_touch_socket_script(dir.path());
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let config = config_with_secret(&script, &secret, None);
         let hypervisor = Hypervisor::new(config);
-
         hypervisor.spawn("api", "test").await.unwrap();
 
-        // Wait a bit
-        tokio::time::sleep(Duration::from_millis(50)).await;
-
-        // Get idle time before touch
-        let info_before = hypervisor.get("api", "test").await.unwrap();
-        let idle_before = info_before.idle_secs;
-
-        // Touch activity
-        hypervisor.touch_activity("api", "test").await;
-
-        // Idle time should reset (or be very small)
-        let info_after = hypervisor.get("api", "test").await.unwrap();
-        assert!(info_after.idle_secs <= idle_before);
+        let info = hypervisor.get("api", "test").await.unwrap();
+        let content =
+            std::fs::read_to_string(info.data_dir.join(secrets::SECRETS_FILE_NAME)).unwrap();
+        assert_eq!(content, "API_KEY=v1\n");
 
         hypervisor.stop("api", "test").await.ok();
     }
 
     #[tokio::test]
-    async fn test_get_and_touch_running_instance() {
+    async fn test_spawn_fails_on_missing_secret() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let config = config_with_secret(&script, &dir.path().join("missing"), None);
         let hypervisor = Hypervisor::new(config);
 
-        hypervisor.spawn("api", "test").await.unwrap();
-
-        // Wait a bit so idle time accumulates
-        tokio::time::sleep(Duration::from_millis(50)).await;
+        let err = hypervisor.spawn("api", "test").await.unwrap_err();
+        assert!(format!("{:#}", err).contains("API_KEY"));
+        assert!(!hypervisor.is_running("api", "test").await);
+    }
 
-        // get_and_touch should return Some and reset activity
-        let info = hypervisor.get_and_touch("api", "test").await;
-        assert!(info.is_some());
-        let info = info.unwrap();
-        assert_eq!(info.id.process, "api");
-        assert_eq!(info.id.id, "test");
+    #[tokio::test]
+    async fn test_spawn_injects_stored_secrets() {
+        let dir = TempDir::new().unwrap();
+        let mut store = crate::secret_store::SecretStore::open_or_init(dir.path()).unwrap();
+        store.set("API_KEY", "from-store");
+        store.save().unwrap();
 
-        // Idle time should be reset (very small after touch)
-        assert!(info.idle_secs < 1);
+        let script = create_touch_socket_script(dir.path());
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.settings.data_dir = dir.path().to_path_buf();
+        let api = config.service.get_mut("api").unwrap();
+        api.secrets.insert("API_KEY".to_string(), SecretSource::Store);
+        api.required_env = vec!["API_KEY".to_string()];
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "test").await.unwrap();
 
+        let info = hypervisor.get("api", "test").await.unwrap();
+        let content =
+            std::fs::read_to_string(info.data_dir.join(secrets::SECRETS_FILE_NAME)).unwrap();
+        assert_eq!(content, "API_KEY=from-store\n");
         hypervisor.stop("api", "test").await.ok();
-    }
 
-    #[tokio::test]
-    async fn test_get_and_touch_nonexistent_instance() {
-        let config = Config::default();
+        // A name missing from the store fails the spawn before anything starts
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.settings.data_dir = dir.path().to_path_buf();
+        let api = config.service.get_mut("api").unwrap();
+        api.secrets.insert("DATABASE_URL".to_string(), SecretSource::Store);
         let hypervisor = Hypervisor::new(config);
-
-        // Non-existent instance should return None
-        let info = hypervisor.get_and_touch("api", "nonexistent").await;
-        assert!(info.is_none());
+        let err = format!("{:#}", hypervisor.spawn("api", "test").await.unwrap_err());
+        assert!(err.contains("tenement secrets set DATABASE_URL"));
     }
 
     #[tokio::test]
-    async fn test_get_and_touch_is_atomic() {
-        // This test verifies get_and_touch provides instance info AND touches activity
-        // in a single operation (vs separate is_running + touch_activity + get calls)
+    async fn test_secret_rotation_sends_reload_signal() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
+        let secret = dir.path().join("api_key");
+        std::fs::write(&secret, "v1").unwrap();
+        let script = create_reload_script(dir.path());
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let config = config_with_secret(&script, &secret, Some("SIGHUP"));
         let hypervisor = Hypervisor::new(config);
-
         hypervisor.spawn("api", "test").await.unwrap();
 
-        // Wait so idle time > 0
-        tokio::time::sleep(Duration::from_millis(100)).await;
-
-        // Record time before
-        let before_info = hypervisor.get("api", "test").await.unwrap();
-        let idle_before = before_info.idle_secs;
+        let id = InstanceId::new("api", "test");
+        let pid_before = instance_pid(&hypervisor, &id).await;
 
-        // Wait a bit more
-        tokio::time::sleep(Duration::from_millis(50)).await;
+        // Unchanged secrets: nothing happens
+        hypervisor.check_secrets().await;
+        let marker = secret.with_extension("reloaded");
+        tokio::time::sleep(Duration::from_millis(300)).await;
+        assert!(!marker.exists());
 
-        // get_and_touch should touch activity
-        let touched_info = hypervisor.get_and_touch("api", "test").await.unwrap();
+        std::fs::write(&secret, "v2").unwrap();
+        hypervisor.check_secrets().await;
 
-        // The returned info should have fresh activity timestamp
-        // (idle_secs should be 0 or very small since we just touched)
-        assert!(touched_info.idle_secs <= idle_before);
+        // The app re-read the rewritten secrets file in place
+        let mut reloaded = String::new();
+        for _ in 0..30 {
+            if let Ok(content) = std::fs::read_to_string(&marker) {
+                reloaded = content;
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(100)).await;
+        }
+        assert_eq!(reloaded, "API_KEY=v2\n");
 
-        // Verify activity was actually touched by checking again
-        let after_info = hypervisor.get("api", "test").await.unwrap();
-        assert!(after_info.idle_secs < 1); // Should be very fresh
+        // Same process, no restart
+        assert_eq!(instance_pid(&hypervisor, &id).await, pid_before);
+        assert_eq!(hypervisor.get("api", "test").await.unwrap().restarts, 0);
 
         hypervisor.stop("api", "test").await.ok();
     }
 
-    // ===================
-    // LOG CAPTURE TESTS
-    // ===================
-
     #[tokio::test]
-    async fn test_spawn_captures_stdout() {
-        let config = test_config_with_process("api", "echo", vec!["hello from stdout"]);
-        let hypervisor = Hypervisor::new(config);
+    async fn test_secret_rotation_restarts_without_reload_signal() {
+        let dir = TempDir::new().unwrap();
+        let secret = dir.path().join("api_key");
+        std::fs::write(&secret, "v1").unwrap();
+        let script = create_touch_socket_script(dir.path());
 
+        let config = config_with_secret(&script, &secret, None);
+        let hypervisor = Hypervisor::new(config);
         hypervisor.spawn("api", "test").await.unwrap();
 
-        // Give time for log capture
-        tokio::time::sleep(Duration::from_millis(100)).await;
-
-        // Check log buffer
-        let logs = hypervisor
-            .log_buffer()
-            .query(&crate::logs::LogQuery {
-                process: Some("api".to_string()),
-                ..Default::default()
-            })
-            .await;
-
-        // Should have captured stdout
-        assert!(logs.iter().any(|l| l.message.contains("hello from stdout")));
-    }
+        let id = InstanceId::new("api", "test");
+        let pid_before = instance_pid(&hypervisor, &id).await;
 
-    #[tokio::test]
-    async fn test_spawn_captures_stderr() {
-        let config = test_config_with_process("api", "sh", vec!["-c", "echo error >&2"]);
-        let hypervisor = Hypervisor::new(config);
+        std::fs::write(&secret, "v2").unwrap();
+        hypervisor.check_secrets().await;
 
-        hypervisor.spawn("api", "test").await.unwrap();
+        // New process, healthy, with the new secret
+        let pid_after = instance_pid(&hypervisor, &id).await;
+        assert!(pid_after.is_some());
+        assert_ne!(pid_after, pid_before);
 
-        // Give time for log capture
-        tokio::time::sleep(Duration::from_millis(100)).await;
+        let info = hypervisor.get("api", "test").await.unwrap();
+        assert_eq!(info.health, HealthStatus::Healthy);
+        let content =
+            std::fs::read_to_string(info.data_dir.join(secrets::SECRETS_FILE_NAME)).unwrap();
+        assert_eq!(content, "API_KEY=v2\n");
 
-        // Check log buffer
-        let logs = hypervisor
-            .log_buffer()
-            .query(&crate::logs::LogQuery {
-                process: Some("api".to_string()),
-                level: Some(crate::logs::LogLevel::Stderr),
-                ..Default::default()
-            })
-            .await;
+        // Planned restart doesn't count as a crash restart
+        assert_eq!(info.restarts, 0);
 
-        assert!(logs.iter().any(|l| l.message.contains("error")));
+        hypervisor.stop("api", "test").await.ok();
     }
 
-    // ===================
-    // METRICS TESTS
-    // ===================
-
     #[tokio::test]
-    async fn test_spawn_increments_metrics() {
+    async fn test_secret_rotation_falls_back_to_restart_on_bad_signal() {
         let dir = TempDir::new().unwrap();
+        let secret = dir.path().join("api_key");
+        std::fs::write(&secret, "v1").unwrap();
         let script = create_touch_socket_script(dir.path());
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let config = config_with_secret(&script, &secret, Some("SIGBOGUS"));
         let hypervisor = Hypervisor::new(config);
-
-        let metrics = hypervisor.metrics();
-        let initial = metrics.instances_up.get();
-
         hypervisor.spawn("api", "test").await.unwrap();
 
-        // instances_up should increment
-        assert_eq!(metrics.instances_up.get(), initial + 1);
+        let id = InstanceId::new("api", "test");
+        let pid_before = instance_pid(&hypervisor, &id).await;
 
-        hypervisor.stop("api", "test").await.unwrap();
+        std::fs::write(&secret, "v2").unwrap();
+        hypervisor.check_secrets().await;
 
-        // Should decrement back
-        assert_eq!(metrics.instances_up.get(), initial);
+        assert_ne!(instance_pid(&hypervisor, &id).await, pid_before);
+
+        hypervisor.stop("api", "test").await.ok();
     }
 
     // ===================
-    // HEALTH STATUS TESTS
+    // LOGIN SHELL TESTS
     // ===================
 
-    #[tokio::test]
-    async fn test_check_health_no_endpoint_socket_file() {
-        let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
+    /// Records FROM_PROFILE (set only by ~/.profile) and touches a marker on SIGUSR1
+    #[cfg(unix)]
+    fn create_login_shell_config(dir: &Path, shell: Option<&str>) -> Config {
+        let script_path = dir.join("login_app.sh");
+        let script = r#"#!/bin/bash
+trap 'touch "$SIGNAL_MARKER"' USR1
+printf '%s' "${FROM_PROFILE:-unset}" > "$PROFILE_MARKER"
+rm -f "$SOCKET_PATH"
+touch "$SOCKET_PATH"
+while true; do sleep 0.1; done
+"#;
+        std::fs::write(&script_path, script).unwrap();
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        std::fs::write(dir.join(".profile"), "export FROM_PROFILE=loaded\n").unwrap();
+
+        let mut config = test_config_with_process("api", script_path.to_str().unwrap(), vec![]);
+        let process = config.service.get_mut("api").unwrap();
+        process.shell = shell.map(|s| s.to_string());
+        for (key, value) in [
+            ("HOME", dir.to_path_buf()),
+            ("PROFILE_MARKER", dir.join("profile.out")),
+            ("SIGNAL_MARKER", dir.join("signal.out")),
+        ] {
+            process
+                .env
+                .insert(key.to_string(), value.to_string_lossy().to_string());
+        }
+        config
+    }
 
-        // No health endpoint configured, socket is just a file (not real socket)
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        let hypervisor = Hypervisor::new(config);
+    #[cfg(unix)]
+    async fn wait_for_file(path: &Path) -> bool {
+        for _ in 0..50 {
+            if path.exists() && std::fs::metadata(path).map(|m| m.len()).unwrap_or(0) > 0 {
+                return true;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        path.exists()
+    }
 
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_login_shell_sources_profile() {
+        let dir = TempDir::new().unwrap();
+        let hypervisor = Hypervisor::new(create_login_shell_config(dir.path(), Some("sh")));
         hypervisor.spawn("api", "test").await.unwrap();
 
-        // Wait for socket file to be created
-        tokio::time::sleep(Duration::from_millis(200)).await;
-
-        let status = hypervisor.check_health("api", "test").await;
-        // File exists but isn't a real socket, so can't connect
-        // The actual status depends on implementation - could be Healthy (file exists)
-        // or Unhealthy (can't connect). Just verify it returns a status.
-        assert!(matches!(
-            status,
-            HealthStatus::Healthy | HealthStatus::Unhealthy
-        ));
+        let marker = dir.path().join("profile.out");
+        assert!(wait_for_file(&marker).await);
+        assert_eq!(std::fs::read_to_string(&marker).unwrap(), "loaded");
 
         hypervisor.stop("api", "test").await.ok();
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_check_health_unknown_process() {
-        let config = Config::default();
-        let hypervisor = Hypervisor::new(config);
+    async fn test_direct_exec_skips_profile() {
+        let dir = TempDir::new().unwrap();
+        let hypervisor = Hypervisor::new(create_login_shell_config(dir.path(), None));
+        hypervisor.spawn("api", "test").await.unwrap();
 
-        let status = hypervisor.check_health("nonexistent", "id").await;
-        assert_eq!(status, HealthStatus::Unknown);
+        let marker = dir.path().join("profile.out");
+        assert!(wait_for_file(&marker).await);
+        assert_eq!(std::fs::read_to_string(&marker).unwrap(), "unset");
+
+        hypervisor.stop("api", "test").await.ok();
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_check_health_not_running_instance() {
-        let config = test_config_with_process("api", "sleep", vec!["1"]);
-        let hypervisor = Hypervisor::new(config);
+    async fn test_login_shell_signals_reach_app() {
+        let dir = TempDir::new().unwrap();
+        let hypervisor = Hypervisor::new(create_login_shell_config(dir.path(), Some("sh")));
+        hypervisor.spawn("api", "test").await.unwrap();
+        assert!(wait_for_file(&dir.path().join("profile.out")).await);
 
-        // Clean up any stale socket from previous tests
-        let socket_path = std::path::PathBuf::from("/tmp/api-test.sock");
-        let _ = std::fs::remove_file(&socket_path);
+        // The tracked PID is the app itself, not a wrapping shell
+        let id = InstanceId::new("api", "test");
+        let pid = instance_pid(&hypervisor, &id).await.unwrap();
+        #[cfg(target_os = "linux")]
+        {
+            let cmdline = std::fs::read(format!("/proc/{}/cmdline", pid)).unwrap();
+            assert!(String::from_utf8_lossy(&cmdline).contains("login_app.sh"));
+        }
 
-        // Don't spawn, just check health
-        // For a configured process that isn't running, returns Unhealthy
-        let status = hypervisor.check_health("api", "test").await;
-        assert!(matches!(
-            status,
-            HealthStatus::Unknown | HealthStatus::Unhealthy
-        ));
+        unsafe {
+            libc::kill(pid as i32, libc::SIGUSR1);
+        }
+        let signal_marker = dir.path().join("signal.out");
+        for _ in 0..50 {
+            if signal_marker.exists() {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        assert!(signal_marker.exists(), "SIGUSR1 should reach the app");
+        assert!(hypervisor.is_running("api", "test").await);
+
+        hypervisor.stop("api", "test").await.ok();
     }
 
     // ===================
-    // DATA DIRECTORY TESTS
+    // ENVIRONMENT HEALTH THRESHOLD TESTS
     // ===================
 
+    /// Same service, strict thresholds in prod and lenient ones in dev
+    fn overlay_health_config(script: &Path, env: &str) -> Config {
+        let test_id = format!("{}-{}", std::process::id(), rand::random::<u32>());
+        let content = format!(
+            r#"
+[settings]
+data_dir = "{data_dir}"
+
+[service.api]
+command = "{command}"
+socket = "/tmp/tenement-test-{test_id}/{{name}}-{{id}}.sock"
+isolation = "process"
+health = "/health"
+restart = "never"
+
+[overlay.prod.service.api.health_check]
+interval = 5
+failure_threshold = 2
+
+[overlay.dev.service.api.health_check]
+interval = 60
+failure_threshold = 10
+"#,
+            data_dir = std::env::temp_dir()
+                .join(format!("tenement-test-{}", test_id))
+                .display(),
+            command = script.display(),
+            test_id = test_id,
+        );
+        Config::from_str_for_env(&content, Some(env)).unwrap()
+    }
+
     #[tokio::test]
-    async fn test_spawn_creates_data_directory() {
+    async fn test_failure_threshold_differs_by_environment() {
         let dir = TempDir::new().unwrap();
-        let data_dir = dir.path().join("tenement-data");
         let script = create_touch_socket_script(dir.path());
 
-        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        config.settings.data_dir = data_dir.clone();
-        let hypervisor = Hypervisor::new(config);
+        // Nothing answers /health, so every check fails
+        let prod = Hypervisor::new(overlay_health_config(&script, "prod"));
+        let dev = Hypervisor::new(overlay_health_config(&script, "dev"));
+        prod.spawn("api", "test").await.unwrap();
+        dev.spawn("api", "test").await.unwrap();
 
-        hypervisor.spawn("api", "user1").await.unwrap();
+        assert_eq!(prod.check_health("api", "test").await, HealthStatus::Degraded);
+        assert_eq!(prod.check_health("api", "test").await, HealthStatus::Unhealthy);
 
-        // Data directory should be created
-        assert!(data_dir.join("api").join("user1").exists());
+        assert_eq!(dev.check_health("api", "test").await, HealthStatus::Degraded);
+        assert_eq!(dev.check_health("api", "test").await, HealthStatus::Degraded);
 
-        hypervisor.stop("api", "user1").await.ok();
+        prod.stop("api", "test").await.ok();
+        dev.stop("api", "test").await.ok();
+    }
+
+    #[test]
+    fn test_monitor_interval_uses_shortest_service_interval() {
+        let script = PathBuf::from("/bin/true");
+        let prod = Hypervisor::new(overlay_health_config(&script, "prod"));
+        assert_eq!(prod.monitor_interval(), Duration::from_secs(5));
+
+        // dev's 60s is longer than the 10s global default, which still drives the tick
+        let dev = Hypervisor::new(overlay_health_config(&script, "dev"));
+        assert_eq!(dev.monitor_interval(), Duration::from_secs(10));
     }
 
     // ===================
-    // ENVIRONMENT VARIABLE TESTS
+    // BOUNDED SHUTDOWN TESTS
     // ===================
 
-    #[tokio::test]
-    async fn test_spawn_with_extra_env() {
-        let config = test_config_with_process("api", "env", vec![]);
-        let hypervisor = Hypervisor::new(config);
-
-        let mut extra_env = HashMap::new();
-        extra_env.insert("MY_CUSTOM_VAR".to_string(), "custom_value".to_string());
-
-        hypervisor
-            .spawn_with_env("api", "test", extra_env)
-            .await
-            .unwrap();
-
-        // Give time for process to run
-        tokio::time::sleep(Duration::from_millis(100)).await;
+    /// An app that ignores SIGTERM (and SIGINT) and never exits on its own
+    #[cfg(unix)]
+    fn create_stubborn_script(dir: &Path) -> PathBuf {
+        let script_path = dir.join("stubborn.sh");
+        let script = r#"#!/bin/bash
+trap '' TERM INT
+rm -f "$SOCKET_PATH"
+touch "$SOCKET_PATH"
+while true; do sleep 0.1; done
+"#;
+        std::fs::write(&script_path, script).unwrap();
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        script_path
+    }
 
-        // Check that env was set (captured in logs)
-        let logs = hypervisor
-            .log_buffer()
-            .query(&crate::logs::LogQuery::default())
-            .await;
-        assert!(logs
-            .iter()
-            .any(|l| l.message.contains("MY_CUSTOM_VAR=custom_value")));
+    #[cfg(unix)]
+    fn pid_alive(pid: u32) -> bool {
+        unsafe { libc::kill(pid as i32, 0) == 0 }
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_spawn_sets_port_env() {
-        let config = test_config_with_process("api", "env", vec![]);
+    async fn test_shutdown_force_kills_signal_ignoring_app() {
+        let dir = TempDir::new().unwrap();
+        let script = create_stubborn_script(dir.path());
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "stubborn").await.unwrap();
 
-        hypervisor.spawn("api", "test").await.unwrap();
-
-        tokio::time::sleep(Duration::from_millis(100)).await;
+        let id = InstanceId::new("api", "stubborn");
+        let pid = instance_pid(&hypervisor, &id).await.unwrap();
 
-        // Process runtime should get a PORT env var with auto-allocated port (30000-40000)
-        let logs = hypervisor
-            .log_buffer()
-            .query(&crate::logs::LogQuery::default())
-            .await;
-        assert!(logs.iter().any(|l| l.message.contains("PORT=3")));
+        let start = Instant::now();
+        let report = hypervisor.shutdown(Duration::from_secs(1)).await;
+        let elapsed = start.elapsed();
+
+        assert!(elapsed >= Duration::from_secs(1), "should wait out the deadline");
+        assert!(elapsed < Duration::from_secs(4), "shutdown took {:?}", elapsed);
+        assert_eq!(report.force_killed, vec![id]);
+        assert!(report.stopped.is_empty());
+        assert!(!pid_alive(pid));
+        assert!(hypervisor.list().await.is_empty());
     }
 
-    // ===================
-    // AUTO-SPAWN TESTS
-    // ===================
-
     #[tokio::test]
-    async fn test_spawn_configured_instances_empty() {
-        let config = Config::default();
-        let hypervisor = Hypervisor::new(config);
-
-        let (success, failed) = hypervisor.spawn_configured_instances().await;
+    async fn test_shutdown_waits_for_a_deploy_in_progress() {
+        let hypervisor = Hypervisor::new(Config::default());
+        let (finish, finished) = tokio::sync::oneshot::channel::<()>();
+        let deploy = hypervisor
+            .spawn_deploy(async move { finished.await.is_ok() })
+            .unwrap();
 
-        assert_eq!(success, 0);
-        assert_eq!(failed, 0);
-        assert!(hypervisor.list().await.is_empty());
+        {
+            let shutdown = hypervisor.shutdown(Duration::from_secs(10));
+            tokio::pin!(shutdown);
+            let waited = tokio::time::timeout(Duration::from_millis(100), &mut shutdown).await;
+            assert!(waited.is_err(), "shutdown didn't wait for the deploy");
+            // No new deploys while it waits
+            assert!(hypervisor.spawn_deploy(async {}).is_err());
+            finish.send(()).unwrap();
+            shutdown.await;
+        }
+        assert!(deploy.await.unwrap());
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_spawn_configured_instances_single() {
+    async fn test_shutdown_well_behaved_app_exits_before_deadline() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
-
-        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        config
-            .instances
-            .insert("api".to_string(), vec!["prod".to_string()]);
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "polite").await.unwrap();
 
-        let (success, failed) = hypervisor.spawn_configured_instances().await;
-
-        assert_eq!(success, 1);
-        assert_eq!(failed, 0);
-        assert!(hypervisor.is_running("api", "prod").await);
+        let start = Instant::now();
+        let report = hypervisor.shutdown(Duration::from_secs(10)).await;
 
-        hypervisor.stop("api", "prod").await.ok();
+        assert!(start.elapsed() < Duration::from_secs(5));
+        assert_eq!(report.stopped, vec![InstanceId::new("api", "polite")]);
+        assert!(report.force_killed.is_empty());
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_spawn_configured_instances_multiple() {
+    async fn test_shutdown_mixed_apps_share_one_deadline() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
-
-        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        config.instances.insert(
-            "api".to_string(),
-            vec!["prod".to_string(), "staging".to_string()],
-        );
+        let stubborn = create_stubborn_script(dir.path());
+        let config = test_config_with_process("api", stubborn.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
+        for id in ["a", "b", "c"] {
+            hypervisor.spawn("api", id).await.unwrap();
+        }
+        // A connection that never finishes draining
+        let _stuck = hypervisor.connection_start("api", "a").await;
 
-        let (success, failed) = hypervisor.spawn_configured_instances().await;
+        let start = Instant::now();
+        let report = hypervisor.shutdown(Duration::from_secs(1)).await;
 
-        assert_eq!(success, 2);
-        assert_eq!(failed, 0);
-        assert!(hypervisor.is_running("api", "prod").await);
-        assert!(hypervisor.is_running("api", "staging").await);
+        // Three stubborn apps plus a stuck drain still take about one deadline, not three
+        assert!(start.elapsed() < Duration::from_secs(4), "took {:?}", start.elapsed());
+        assert_eq!(report.force_killed.len(), 3);
+    }
 
-        hypervisor.stop("api", "prod").await.ok();
-        hypervisor.stop("api", "staging").await.ok();
+    // ===================
+    // STOP SIGNAL TESTS
+    // ===================
+
+    /// An app that exits on SIGTERM or SIGQUIT, writing `quit` to `marker` on
+    /// the latter, with a background child that writes `child` there on SIGTERM
+    #[cfg(unix)]
+    fn create_quit_script(dir: &Path, marker: &Path) -> PathBuf {
+        let script_path = dir.join("quit.sh");
+        let script = format!(
+            r#"#!/bin/bash
+MARKER="{}"
+( trap 'echo child > "$MARKER"; exit 0' TERM; while true; do sleep 0.1; done ) &
+trap 'echo quit > "$MARKER"; exit 0' QUIT
+trap 'wait; exit 0' TERM
+rm -f "$SOCKET_PATH"
+touch "$SOCKET_PATH"
+while true; do sleep 0.1; done
+"#,
+            marker.display()
+        );
+        std::fs::write(&script_path, script).unwrap();
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        script_path
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_spawn_configured_instances_continues_on_failure() {
+    async fn test_stop_sends_configured_signal() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
-
+        let marker = dir.path().join("marker");
+        let script = create_quit_script(dir.path(), &marker);
         let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        // Add a second service with an invalid command
-        config.service.insert(
-            "broken".to_string(),
-            ProcessConfig {
-                command: "/nonexistent/binary".to_string(),
-                args: vec![],
-                socket: "/tmp/{name}-{id}.sock".to_string(),
-                isolation: RuntimeType::Process,
-                health: None,
-                env: HashMap::new(),
-                workdir: None,
-                mounts: Vec::new(),
-                image: None,
-                restart: "on-failure".to_string(),
-                idle_timeout: None,
-                startup_timeout: 5,
-                request_timeout: 30,
-                memory_limit_mb: None,
-                cpu_shares: None,
-                kernel: None,
-                rootfs: None,
-                memory_mb: 256,
-                vcpus: 1,
-                vsock_port: 5000,
-                storage_quota_mb: None,
-                storage_persist: false,
-            },
-        );
+        let api = config.service.get_mut("api").unwrap();
+        api.stop_signal = Some("SIGQUIT".to_string());
+        api.stop_process_group = false;
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        // Configure both to spawn
-        config
-            .instances
-            .insert("api".to_string(), vec!["prod".to_string()]);
-        config
-            .instances
-            .insert("broken".to_string(), vec!["test".to_string()]);
+        let start = Instant::now();
+        hypervisor.stop("api", "1").await.unwrap();
+        let elapsed = start.elapsed();
+
+        // Exited on its own within the grace period, and only the main process
+        // was signaled
+        assert!(elapsed < Duration::from_secs(4), "stop took {:?}", elapsed);
+        assert_eq!(std::fs::read_to_string(&marker).unwrap(), "quit\n");
+        assert!(hypervisor.list().await.is_empty());
+    }
 
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_stop_signals_process_group_by_default() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("marker");
+        let script = create_quit_script(dir.path(), &marker);
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        let (success, failed) = hypervisor.spawn_configured_instances().await;
+        hypervisor.stop("api", "1").await.unwrap();
+        assert_eq!(std::fs::read_to_string(&marker).unwrap(), "child\n");
+    }
 
-        // One succeeded, one failed
-        assert_eq!(success, 1);
-        assert_eq!(failed, 1);
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_stop_timeout_bounds_grace_period() {
+        let dir = TempDir::new().unwrap();
+        let script = create_stubborn_script(dir.path());
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.service.get_mut("api").unwrap().stop_timeout = Some(1);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "a").await.unwrap();
+        hypervisor.spawn("api", "b").await.unwrap();
+        let pid = instance_pid(&hypervisor, &InstanceId::new("api", "a"))
+            .await
+            .unwrap();
 
-        // The good one should still be running
-        assert!(hypervisor.is_running("api", "prod").await);
-        assert!(!hypervisor.is_running("broken", "test").await);
+        let start = Instant::now();
+        hypervisor.stop("api", "a").await.unwrap();
+        let elapsed = start.elapsed();
+        assert!(elapsed >= Duration::from_secs(1), "took {:?}", elapsed);
+        assert!(elapsed < Duration::from_secs(4), "stop took {:?}", elapsed);
+        assert!(!pid_alive(pid));
 
-        hypervisor.stop("api", "prod").await.ok();
+        // Shutdown gives it the same grace period, well before its own deadline
+        let start = Instant::now();
+        let report = hypervisor.shutdown(Duration::from_secs(20)).await;
+        let elapsed = start.elapsed();
+        assert!(elapsed < Duration::from_secs(5), "took {:?}", elapsed);
+        assert_eq!(report.force_killed, vec![InstanceId::new("api", "b")]);
     }
 
     // ===================
-    // WEIGHTED ROUTING TESTS
+    // APP DRAIN TESTS
     // ===================
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_set_weight() {
+    async fn test_drain_app_waits_for_connections_then_stops() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
-
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "a").await.unwrap();
+        hypervisor.spawn("api", "b").await.unwrap();
+
+        // a's request finishes a little into the drain
+        let guard = hypervisor.connection_start("api", "a").await;
+        let release = tokio::spawn(async move {
+            tokio::time::sleep(Duration::from_millis(300)).await;
+            drop(guard);
+        });
+        let start = Instant::now();
+        let report = hypervisor
+            .drain_app("api", Duration::from_secs(10))
+            .await
+            .unwrap();
+        let elapsed = start.elapsed();
+        release.await.unwrap();
 
-        hypervisor.spawn("api", "test").await.unwrap();
+        assert!(elapsed >= Duration::from_millis(300));
+        assert!(elapsed < Duration::from_secs(5), "took {:?}", elapsed);
+        let mut stopped = report.stopped.clone();
+        stopped.sort_by_key(|id| id.to_string());
+        assert_eq!(
+            stopped,
+            vec![InstanceId::new("api", "a"), InstanceId::new("api", "b")]
+        );
+        assert!(report.force_killed.is_empty());
+        assert_eq!(report.cut_connections, 0);
+        assert!(hypervisor.list().await.is_empty());
 
-        // Default weight should be 100
-        let info = hypervisor.get("api", "test").await.unwrap();
-        assert_eq!(info.weight, 100);
+        // Out of rotation until started again
+        assert!(hypervisor.is_app_draining("api"));
+        hypervisor.spawn("api", "a").await.unwrap();
+        assert!(!hypervisor.is_app_draining("api"));
+    }
 
-        // Set weight to 50
-        hypervisor.set_weight("api", "test", 50).await.unwrap();
-        let info = hypervisor.get("api", "test").await.unwrap();
-        assert_eq!(info.weight, 50);
+    #[cfg(unix)]
+    #[tokio::test]
+    async fn test_drain_app_force_kills_at_timeout() {
+        let dir = TempDir::new().unwrap();
+        let stubborn = create_stubborn_script(dir.path());
+        let config = test_config_with_process("api", stubborn.to_str().unwrap(), vec![]);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "busy").await.unwrap();
+        hypervisor.spawn("api", "stubborn").await.unwrap();
+        let pid = instance_pid(&hypervisor, &InstanceId::new("api", "stubborn"))
+            .await
+            .unwrap();
+        let _stuck = hypervisor.connection_start("api", "busy").await;
 
-        // Set weight to 0
-        hypervisor.set_weight("api", "test", 0).await.unwrap();
-        let info = hypervisor.get("api", "test").await.unwrap();
-        assert_eq!(info.weight, 0);
+        let start = Instant::now();
+        let report = hypervisor
+            .drain_app("api", Duration::from_secs(1))
+            .await
+            .unwrap();
+        let elapsed = start.elapsed();
 
-        hypervisor.stop("api", "test").await.ok();
+        assert!(elapsed < Duration::from_secs(4), "took {:?}", elapsed);
+        assert_eq!(report.force_killed.len(), 2);
+        assert_eq!(report.cut_connections, 1);
+        assert!(!pid_alive(pid));
+        assert!(hypervisor.list().await.is_empty());
+
+        let err = hypervisor
+            .drain_app("nope", Duration::from_secs(1))
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("Unknown service"), "{}", err);
     }
 
+    // ===================
+    // WARM CONNECTION TESTS
+    // ===================
+
     #[tokio::test]
-    async fn test_set_weight_caps_at_100() {
+    async fn test_ready_instance_gets_warm_connections() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
-
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let script = create_slow_start_script(dir.path(), "0");
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        config.service.get_mut("api").unwrap().warm_connections = 3;
         let hypervisor = Hypervisor::new(config);
 
-        hypervisor.spawn("api", "test").await.unwrap();
+        hypervisor.spawn("api", "warm").await.unwrap();
+        let port = hypervisor.get("api", "warm").await.unwrap().port.unwrap();
+        assert_eq!(hypervisor.warm_pool().idle(port), 3);
 
-        // Try to set weight > 100
-        hypervisor.set_weight("api", "test", 150).await.unwrap();
-        let info = hypervisor.get("api", "test").await.unwrap();
-        assert_eq!(info.weight, 100); // Should be capped at 100
+        // Connections are handed out once each
+        assert!(hypervisor.warm_pool().take(port).is_some());
+        assert_eq!(hypervisor.warm_pool().idle(port), 2);
 
-        hypervisor.stop("api", "test").await.ok();
+        // Stopping the instance drops the rest so a reused port never sees them
+        hypervisor.stop("api", "warm").await.unwrap();
+        assert_eq!(hypervisor.warm_pool().idle(port), 0);
     }
 
     #[tokio::test]
-    async fn test_set_weight_nonexistent_instance() {
-        let config = Config::default();
+    async fn test_no_warm_connections_by_default() {
+        let dir = TempDir::new().unwrap();
+        let script = create_slow_start_script(dir.path(), "0");
+        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
 
-        let result = hypervisor.set_weight("api", "nonexistent", 50).await;
-        assert!(result.is_err());
-        assert!(result.unwrap_err().to_string().contains("not found"));
+        hypervisor.spawn("api", "cold").await.unwrap();
+        let port = hypervisor.get("api", "cold").await.unwrap().port.unwrap();
+        assert_eq!(hypervisor.warm_pool().idle(port), 0);
+
+        hypervisor.stop("api", "cold").await.ok();
+    }
+
+    // ===================
+    // HEALTH PROBE CONCURRENCY TESTS
+    // ===================
+
+    /// HTTP backend on $PORT whose /health takes 200ms, logs each probe to
+    /// `probes.log`, and returns 200 only while `healthy` exists in `dir`
+    fn create_counting_health_script(dir: &Path) -> PathBuf {
+        let script_path = dir.join("counting_health.sh");
+        let script = format!(
+            r#"#!/bin/bash
+exec python3 -c "
+import os, time
+from http.server import BaseHTTPRequestHandler, ThreadingHTTPServer
+class H(BaseHTTPRequestHandler):
+    def do_GET(self):
+        time.sleep(0.2)
+        with open('{dir}/probes.log', 'a') as f:
+            f.write('probe\\n')
+        self.send_response(200 if os.path.exists('{dir}/healthy') else 500)
+        self.send_header('Content-Length', '0')
+        self.end_headers()
+    def log_message(self, *args):
+        pass
+ThreadingHTTPServer(('127.0.0.1', int(os.environ['PORT'])), H).serve_forever()
+"
+"#,
+            dir = dir.display()
+        );
+        std::fs::write(&script_path, script).unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script_path, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
+        script_path
+    }
+
+    fn probe_count(dir: &Path) -> u32 {
+        std::fs::read_to_string(dir.join("probes.log"))
+            .map(|s| s.lines().count() as u32)
+            .unwrap_or(0)
+    }
+
+    /// Fire `n` overlapping health checks at one instance and wait for all of them
+    async fn hammer_health(hypervisor: &Arc<Hypervisor>, n: usize) {
+        let mut checks = Vec::new();
+        for _ in 0..n {
+            let hypervisor = hypervisor.clone();
+            checks.push(tokio::spawn(async move {
+                hypervisor.check_health("api", "probe").await
+            }));
+        }
+        for check in checks {
+            check.await.unwrap();
+        }
+    }
+
+    async fn counters(hypervisor: &Hypervisor) -> (u32, u32, HealthStatus) {
+        let instances = hypervisor.instances.read().await;
+        let instance = &instances[&InstanceId::new("api", "probe")];
+        (
+            instance.consecutive_failures,
+            instance.consecutive_successes,
+            instance.health_status,
+        )
     }
 
     #[tokio::test]
-    async fn test_list_by_process() {
+    async fn test_overlapping_checks_count_once_per_probe() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
+        let script = create_counting_health_script(dir.path());
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health = Some("/health".to_string());
+        service.health_check.failure_threshold = 10;
+        service.health_check.recovery_threshold = 3;
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "probe").await.unwrap();
+
+        // Failing backend: each burst of 20 checks is one probe and one failure
+        for round in 1..=3 {
+            hammer_health(&hypervisor, 20).await;
+            assert_eq!(probe_count(dir.path()), round);
+            let (failures, _, _) = counters(&hypervisor).await;
+            assert_eq!(failures, round, "failures must match probes actually sent");
+        }
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        // Recovering backend: bursts can't rush the recovery threshold
+        std::fs::write(dir.path().join("healthy"), "").unwrap();
+        hammer_health(&hypervisor, 20).await;
+        hammer_health(&hypervisor, 20).await;
+        assert_eq!(probe_count(dir.path()), 5);
+        let (failures, successes, status) = counters(&hypervisor).await;
+        assert_eq!((failures, successes), (3, 2));
+        assert_eq!(status, HealthStatus::Degraded);
+
+        hammer_health(&hypervisor, 20).await;
+        assert_eq!(probe_count(dir.path()), 6);
+        let (failures, successes, status) = counters(&hypervisor).await;
+        assert_eq!((failures, successes), (0, 0));
+        assert_eq!(status, HealthStatus::Healthy);
+
+        // Sequential checks each probe as usual
+        hypervisor.check_health("api", "probe").await;
+        hypervisor.check_health("api", "probe").await;
+        assert_eq!(probe_count(dir.path()), 8);
+
+        hypervisor.stop("api", "probe").await.ok();
+    }
+
+    // ===================
+    // HEALTH PROBE TYPE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_tcp_health_check() {
+        // Listens on $PORT but speaks no HTTP; a connect is all a tcp check needs
+        let listen = "import os, socket, time\n\
+            s = socket.socket()\n\
+            s.bind(('127.0.0.1', int(os.environ['PORT'])))\n\
+            s.listen()\n\
+            time.sleep(30)";
+        let mut config = test_config_with_process("api", "python3", vec!["-c", listen]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.check_type = HealthCheckType::Tcp;
+        service.health_check.timeout_ms = 500;
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        // Spawn multiple instances
-        hypervisor.spawn("api", "prod").await.unwrap();
-        hypervisor.spawn("api", "staging").await.unwrap();
+        let mut status = HealthStatus::Unknown;
+        for _ in 0..20 {
+            status = hypervisor.check_health("api", "1").await;
+            if status == HealthStatus::Healthy {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(100)).await;
+        }
+        assert_eq!(status, HealthStatus::Healthy);
 
-        let instances = hypervisor.list_by_process("api").await;
-        assert_eq!(instances.len(), 2);
+        hypervisor.stop("api", "1").await.ok();
+    }
 
-        // Verify both are present
-        let ids: Vec<String> = instances.iter().map(|i| i.id.id.clone()).collect();
-        assert!(ids.contains(&"prod".to_string()));
-        assert!(ids.contains(&"staging".to_string()));
+    #[tokio::test]
+    async fn test_tcp_health_check_fails_without_listener() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.check_type = HealthCheckType::Tcp;
+        service.health_check.failure_threshold = 1;
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        // Nonexistent process should return empty
-        let empty = hypervisor.list_by_process("nonexistent").await;
-        assert!(empty.is_empty());
+        assert!(hypervisor.check_health("api", "1").await.is_down());
 
-        hypervisor.stop("api", "prod").await.ok();
-        hypervisor.stop("api", "staging").await.ok();
+        hypervisor.stop("api", "1").await.ok();
     }
 
     #[tokio::test]
-    async fn test_select_weighted_single_instance() {
+    async fn test_exec_health_check() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
-
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let marker = dir.path().join("ok");
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.check_type = HealthCheckType::Exec;
+        service.health_check.command = Some(format!(
+            "test -n \"$TENEMENT_INSTANCE\" && test -f {}",
+            marker.display()
+        ));
+        service.health_check.failure_threshold = 2;
+        service.health_check.recovery_threshold = 1;
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        hypervisor.spawn("api", "prod").await.unwrap();
+        assert_eq!(hypervisor.check_health("api", "1").await, HealthStatus::Degraded);
+        assert_eq!(hypervisor.check_health("api", "1").await, HealthStatus::Unhealthy);
 
-        // Single instance should always be selected
-        for _ in 0..10 {
-            let selected = hypervisor.select_weighted("api").await;
-            assert!(selected.is_some());
-            assert_eq!(selected.unwrap().id.id, "prod");
-        }
+        std::fs::write(&marker, "").unwrap();
+        assert_eq!(hypervisor.check_health("api", "1").await, HealthStatus::Healthy);
 
-        hypervisor.stop("api", "prod").await.ok();
+        hypervisor.stop("api", "1").await.ok();
     }
 
     #[tokio::test]
-    async fn test_select_weighted_excludes_zero_weight() {
+    async fn test_readiness_gates_traffic_without_restarting() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
-
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let marker = dir.path().join("ready");
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let service = config.service.get_mut("api").unwrap();
+        service.readiness = Some(crate::config::ReadinessConfig {
+            check_type: HealthCheckType::Exec,
+            path: None,
+            command: Some(format!("test -f {}", marker.display())),
+            timeout_ms: 5000,
+            interval: None,
+            failure_threshold: 2,
+            success_threshold: 1,
+        });
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
+        let instance_id = InstanceId::new("api", "1");
+        let pid = instance_pid(&hypervisor, &instance_id).await;
+
+        // Unready until its probe first passes
+        assert!(!hypervisor.get("api", "1").await.unwrap().ready);
+        assert!(hypervisor.select_instance("api").await.is_none());
+        std::fs::write(&marker, "").unwrap();
+        assert!(hypervisor.check_readiness("api", "1").await);
+        assert!(hypervisor.select_instance("api").await.is_some());
+
+        // Overloaded: out of rotation after two failures, but left running
+        std::fs::remove_file(&marker).unwrap();
+        assert!(hypervisor.check_readiness("api", "1").await);
+        assert!(!hypervisor.check_readiness("api", "1").await);
+        assert!(hypervisor.select_instance("api").await.is_none());
+        assert_eq!(instance_pid(&hypervisor, &instance_id).await, pid);
+        assert_eq!(hypervisor.get("api", "1").await.unwrap().restarts, 0);
+
+        std::fs::write(&marker, "").unwrap();
+        assert!(hypervisor.check_readiness("api", "1").await);
+        assert!(hypervisor.select_instance("api").await.is_some());
+
+        hypervisor.stop("api", "1").await.ok();
+    }
 
-        hypervisor.spawn("api", "v1").await.unwrap();
-        hypervisor.spawn("api", "v2").await.unwrap();
-
-        // Set v1 weight to 0
-        hypervisor.set_weight("api", "v1", 0).await.unwrap();
+    #[tokio::test]
+    async fn test_startup_failure_threshold_applies_until_first_pass() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("ok");
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.check_type = HealthCheckType::Exec;
+        service.health_check.command = Some(format!("test -f {}", marker.display()));
+        service.health_check.failure_threshold = 1;
+        service.health_check.startup_failure_threshold = Some(3);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        // v2 should always be selected since v1 has weight 0
-        for _ in 0..10 {
-            let selected = hypervisor.select_weighted("api").await;
-            assert!(selected.is_some());
-            assert_eq!(selected.unwrap().id.id, "v2");
+        // Still booting: two failures are tolerated
+        for _ in 0..2 {
+            let status = hypervisor.check_health("api", "1").await;
+            assert_eq!(status, HealthStatus::Degraded);
         }
+        std::fs::write(&marker, "").unwrap();
+        let status = hypervisor.check_health("api", "1").await;
+        assert_eq!(status, HealthStatus::Healthy);
 
-        hypervisor.stop("api", "v1").await.ok();
-        hypervisor.stop("api", "v2").await.ok();
+        // Once up, the regular threshold applies
+        std::fs::remove_file(&marker).unwrap();
+        let status = hypervisor.check_health("api", "1").await;
+        assert_eq!(status, HealthStatus::Unhealthy);
+
+        hypervisor.stop("api", "1").await.ok();
     }
 
     #[tokio::test]
-    async fn test_select_weighted_all_zero_weight() {
-        let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
+    async fn test_initial_delay_holds_off_health_checks() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.check_type = HealthCheckType::Exec;
+        service.health_check.command = Some("false".to_string());
+        service.health_check.failure_threshold = 1;
+        service.health_check.initial_delay = Some(3600);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
+        let instance_id = InstanceId::new("api", "1");
+        let pid = instance_pid(&hypervisor, &instance_id).await;
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        hypervisor.run_due_health_checks().await;
+        let info = hypervisor.get("api", "1").await.unwrap();
+        assert_eq!(info.health, HealthStatus::Unknown);
+        assert_eq!(info.restarts, 0);
+        assert_eq!(instance_pid(&hypervisor, &instance_id).await, pid);
+
+        hypervisor.stop("api", "1").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_initial_delay_holds_off_readiness_checks() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.initial_delay = Some(3600);
+        service.readiness = Some(crate::config::ReadinessConfig {
+            check_type: HealthCheckType::Exec,
+            path: None,
+            command: Some("true".to_string()),
+            timeout_ms: 5000,
+            interval: None,
+            failure_threshold: 1,
+            success_threshold: 1,
+        });
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        hypervisor.spawn("api", "v1").await.unwrap();
-        hypervisor.spawn("api", "v2").await.unwrap();
+        hypervisor.run_due_readiness_checks().await;
+        assert!(!hypervisor.get("api", "1").await.unwrap().ready);
 
-        // Set both weights to 0
-        hypervisor.set_weight("api", "v1", 0).await.unwrap();
-        hypervisor.set_weight("api", "v2", 0).await.unwrap();
+        hypervisor.stop("api", "1").await.ok();
+    }
 
-        // No instance should be selected
-        let selected = hypervisor.select_weighted("api").await;
-        assert!(selected.is_none());
+    #[tokio::test]
+    async fn test_wait_serving_waits_out_initial_delay() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.check_type = HealthCheckType::Exec;
+        service.health_check.command = Some("true".to_string());
+        service.health_check.initial_delay = Some(1);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        hypervisor.stop("api", "v1").await.ok();
-        hypervisor.stop("api", "v2").await.ok();
+        // The timeout runs from the end of the delay, not from launch
+        let started = Instant::now();
+        hypervisor
+            .wait_serving("api", "1", Duration::from_millis(500))
+            .await
+            .unwrap();
+        assert!(started.elapsed() >= Duration::from_millis(900));
+
+        hypervisor.stop("api", "1").await.ok();
     }
 
     #[tokio::test]
-    async fn test_select_weighted_no_instances() {
-        let config = Config::default();
+    async fn test_exec_health_check_times_out() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        let service = config.service.get_mut("api").unwrap();
+        service.health_check.check_type = HealthCheckType::Exec;
+        service.health_check.command = Some("sleep 30".to_string());
+        service.health_check.timeout_ms = 100;
+        service.health_check.failure_threshold = 1;
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        // No instances -> None
-        let selected = hypervisor.select_weighted("api").await;
-        assert!(selected.is_none());
+        let started = Instant::now();
+        assert!(hypervisor.check_health("api", "1").await.is_down());
+        assert!(started.elapsed() < Duration::from_secs(5));
+
+        hypervisor.stop("api", "1").await.ok();
     }
 
+    // ===================
+    // INSTANCE SAMPLE TESTS
+    // ===================
+
     #[tokio::test]
-    async fn test_select_weighted_distribution() {
-        // Test that weighted selection roughly follows the weights
-        let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
+    async fn test_instance_samples() {
+        let hypervisor = Hypervisor::new(test_config_with_process("api", "sleep", vec!["30"]));
+        hypervisor.spawn("api", "v1").await.unwrap();
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        let hypervisor = Hypervisor::new(config);
+        let samples = hypervisor.instance_samples().await;
+        assert_eq!(samples.len(), 1);
+        assert_eq!(samples[0].process, "api");
+        assert_eq!(samples[0].instance, "api:v1");
+        assert_eq!(samples[0].active_connections, 0);
+        #[cfg(target_os = "linux")]
+        assert!(samples[0].memory_bytes.unwrap() > 0);
+
+        hypervisor.stop("api", "v1").await.ok();
+        assert!(hypervisor.instance_samples().await.is_empty());
+    }
 
+    #[cfg(target_os = "linux")]
+    #[tokio::test]
+    async fn test_sample_usage_works_out_cpu_percent() {
+        let hypervisor = Hypervisor::new(test_config_with_process("api", "sleep", vec!["30"]));
         hypervisor.spawn("api", "v1").await.unwrap();
-        hypervisor.spawn("api", "v2").await.unwrap();
 
-        // Set v1=90, v2=10
-        hypervisor.set_weight("api", "v1", 90).await.unwrap();
-        hypervisor.set_weight("api", "v2", 10).await.unwrap();
+        // A first reading has nothing to measure CPU use against
+        hypervisor.sample_usage().await;
+        let usage = hypervisor.get("api", "v1").await.unwrap().usage.unwrap();
+        assert!(usage.rss_bytes > 0);
+        assert!(usage.threads >= 1);
+        assert_eq!(usage.cpu_percent, None);
 
-        let mut v1_count = 0;
-        let mut v2_count = 0;
-        let iterations = 1000;
+        tokio::time::sleep(Duration::from_millis(50)).await;
+        hypervisor.sample_usage().await;
+        let usage = hypervisor.get("api", "v1").await.unwrap().usage.unwrap();
+        assert!(usage.cpu_percent.unwrap() >= 0.0);
+        let samples = hypervisor.instance_samples().await;
+        assert_eq!(samples[0].cpu_percent, usage.cpu_percent);
+        assert!(samples[0].threads.is_some());
 
-        for _ in 0..iterations {
-            if let Some(selected) = hypervisor.select_weighted("api").await {
-                match selected.id.id.as_str() {
-                    "v1" => v1_count += 1,
-                    "v2" => v2_count += 1,
-                    _ => panic!("Unexpected instance"),
+        hypervisor.stop("api", "v1").await.ok();
+    }
+
+    // ===================
+    // POST-STOP HOOK TESTS
+    // ===================
+
+    /// Config whose `post_stop` hook appends $TENEMENT_STOP_REASON to `marker`
+    fn post_stop_config(command: &str, args: Vec<&str>, marker: &Path) -> Config {
+        let mut config = test_config_with_process("api", command, args);
+        config.service.get_mut("api").unwrap().post_stop =
+            Some(format!("echo \"$TENEMENT_STOP_REASON\" >> {}", marker.display()));
+        config
+    }
+
+    /// Wait for the hook to have written to `marker`
+    async fn wait_for_marker(marker: &Path) -> String {
+        for _ in 0..100 {
+            if let Ok(contents) = std::fs::read_to_string(marker) {
+                if !contents.is_empty() {
+                    return contents;
                 }
             }
+            tokio::time::sleep(Duration::from_millis(50)).await;
         }
+        panic!("post_stop hook never ran");
+    }
+
+    #[tokio::test]
+    async fn test_post_stop_runs_on_clean_exit() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("post_stop");
+        let hypervisor = Hypervisor::new(post_stop_config("true", vec![], &marker));
+        hypervisor.spawn("api", "1").await.unwrap();
+
+        assert_eq!(wait_for_marker(&marker).await, "exited\n");
+
+        // Stopping the already-exited instance doesn't run it a second time
+        hypervisor.stop("api", "1").await.ok();
+        hypervisor.wait_for_post_stop_hooks().await;
+        assert_eq!(std::fs::read_to_string(&marker).unwrap(), "exited\n");
+    }
+
+    #[tokio::test]
+    async fn test_post_stop_runs_on_crash() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("post_stop");
+        let config = post_stop_config("sh", vec!["-c", "sleep 0.2; exit 3"], &marker);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
+
+        assert_eq!(wait_for_marker(&marker).await, "exited\n");
+        hypervisor.stop("api", "1").await.ok();
+    }
+
+    #[tokio::test]
+    async fn test_post_stop_runs_on_stop() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("post_stop");
+        let hypervisor = Hypervisor::new(post_stop_config("sleep", vec!["30"], &marker));
+        hypervisor.spawn("api", "1").await.unwrap();
 
-        // v1 should get roughly 90% of selections (with some variance)
-        // Allow 15% margin for statistical variance
-        let v1_ratio = v1_count as f64 / iterations as f64;
-        let v2_ratio = v2_count as f64 / iterations as f64;
-        assert!(v1_ratio > 0.75, "v1 ratio {} should be > 0.75", v1_ratio);
-        assert!(v1_ratio < 0.98, "v1 ratio {} should be < 0.98", v1_ratio);
-        assert!(v2_ratio > 0.02, "v2 ratio {} should be > 0.02", v2_ratio);
+        hypervisor.stop("api", "1").await.unwrap();
+        assert_eq!(wait_for_marker(&marker).await, "stopped\n");
+    }
 
-        hypervisor.stop("api", "v1").await.ok();
-        hypervisor.stop("api", "v2").await.ok();
+    #[tokio::test]
+    async fn test_post_stop_runs_after_force_kill() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("post_stop");
+        // Ignores SIGTERM, so shutdown has to SIGKILL it
+        let config = post_stop_config("sh", vec!["-c", "trap '' TERM; sleep 30"], &marker);
+        let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("api", "1").await.unwrap();
+
+        let report = hypervisor.shutdown(Duration::from_millis(500)).await;
+        assert_eq!(report.force_killed, vec![InstanceId::new("api", "1")]);
+        // Shutdown waits for the hook before returning
+        assert_eq!(std::fs::read_to_string(&marker).unwrap(), "stopped\n");
     }
 
     // ===================
-    // DEPLOY COMMAND TESTS
+    // LIFECYCLE HOOK TESTS
     // ===================
 
+    /// Set hooks on `api` from `(kind, command)` pairs
+    fn set_hooks(config: &mut Config, hooks: &[(HookKind, &str)]) {
+        let hooks_config = &mut config.service.get_mut("api").unwrap().hooks;
+        for (kind, command) in hooks {
+            let hook = Some(crate::config::HookConfig {
+                command: command.to_string(),
+                timeout: None,
+                on_failure: None,
+            });
+            match kind {
+                HookKind::Build => hooks_config.build = hook,
+                HookKind::PreStart => hooks_config.pre_start = hook,
+                HookKind::PostDeploy => hooks_config.post_deploy = hook,
+                HookKind::PreStop => hooks_config.pre_stop = hook,
+            }
+        }
+    }
+
     #[tokio::test]
-    async fn test_deploy_and_wait_healthy_no_health_endpoint() {
-        // When no health endpoint is configured, instance is healthy if socket exists
+    async fn test_hooks_run_through_deploy_and_stop() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
-
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let marker = dir.path().join("hooks");
+        let record = format!(
+            "echo \"$TENEMENT_HOOK $TENEMENT_INSTANCE\" >> {}",
+            marker.display()
+        );
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let hooks = HookKind::ALL.map(|kind| (kind, record.as_str()));
+        set_hooks(&mut config, &hooks);
         let hypervisor = Hypervisor::new(config);
 
-        // Deploy v2 with default weight
-        let result = hypervisor
+        hypervisor
             .deploy_and_wait_healthy("api", "v2", 100, 5)
-            .await;
-        assert!(result.is_ok(), "Deploy should succeed: {:?}", result.err());
-
-        // Verify instance is running with correct weight
-        let info = hypervisor.get("api", "v2").await.unwrap();
-        assert_eq!(info.weight, 100);
-
-        hypervisor.stop("api", "v2").await.ok();
+            .await
+            .unwrap();
+        hypervisor.stop("api", "v2").await.unwrap();
+        assert_eq!(
+            std::fs::read_to_string(&marker).unwrap(),
+            "build api:v2\npre_start api:v2\npost_deploy api:v2\npre_stop api:v2\n"
+        );
     }
 
     #[tokio::test]
-    async fn test_deploy_with_initial_weight() {
-        // Deploy with a low initial weight (canary style)
+    async fn test_failed_build_aborts_deploy() {
         let dir = TempDir::new().unwrap();
         let script = create_touch_socket_script(dir.path());
-
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        set_hooks(&mut config, &[(HookKind::Build, "exit 1")]);
         let hypervisor = Hypervisor::new(config);
 
-        // Deploy v2 with 10% weight
-        let result = hypervisor.deploy_and_wait_healthy("api", "v2", 10, 5).await;
-        assert!(result.is_ok());
+        let err = hypervisor
+            .deploy_and_wait_healthy("api", "v2", 100, 5)
+            .await
+            .unwrap_err();
+        let message = format!("{:#}", err);
+        assert!(message.contains("build hook exited"), "{}", message);
+        assert!(hypervisor.get("api", "v2").await.is_none());
+    }
 
-        // Verify weight was set
-        let info = hypervisor.get("api", "v2").await.unwrap();
-        assert_eq!(info.weight, 10);
+    #[tokio::test]
+    async fn test_failed_pre_start_keeps_instance_down() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        set_hooks(&mut config, &[(HookKind::PreStart, "exit 1")]);
+        let hypervisor = Hypervisor::new(config);
 
-        hypervisor.stop("api", "v2").await.ok();
+        assert!(hypervisor.spawn("api", "1").await.is_err());
+        assert!(!hypervisor.is_running("api", "1").await);
+        // Nothing was left marked as spawning
+        assert!(hypervisor.spawn("api", "1").await.is_err());
     }
 
     #[tokio::test]
-    async fn test_deploy_unknown_process() {
-        let config = Config::default();
+    async fn test_failed_pre_stop_still_stops() {
+        let mut config = test_config_with_process("api", "sleep", vec!["30"]);
+        set_hooks(&mut config, &[(HookKind::PreStop, "exit 1")]);
         let hypervisor = Hypervisor::new(config);
 
-        let result = hypervisor
-            .deploy_and_wait_healthy("nonexistent", "v1", 100, 5)
-            .await;
-        assert!(result.is_err());
-        assert!(result.unwrap_err().to_string().contains("Unknown process"));
+        hypervisor.spawn("api", "1").await.unwrap();
+        hypervisor.stop("api", "1").await.unwrap();
+        assert!(!hypervisor.is_running("api", "1").await);
     }
 
     // ===================
-    // ROUTE SWAP TESTS
+    // DEPENDENCY TESTS
     // ===================
 
+    /// `worker` depending on `db`, which is healthy once `marker` exists
+    fn depends_on_config(marker: &Path, condition: DependencyCondition, timeout: u64) -> Config {
+        let mut config = test_config_with_process("db", "sleep", vec!["30"]);
+        let mut worker = config.service["db"].clone();
+        let db = config.service.get_mut("db").unwrap();
+        db.health_check.check_type = HealthCheckType::Exec;
+        db.health_check.command = Some(format!("test -f {}", marker.display()));
+        worker.depends_on.insert(
+            "db".to_string(),
+            Dependency {
+                condition,
+                timeout,
+                id: None,
+            },
+        );
+        config.service.insert("worker".to_string(), worker);
+        config
+    }
+
     #[tokio::test]
-    async fn test_route_swap() {
+    async fn test_depends_on_spawns_dependency_first() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
-
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let marker = dir.path().join("ready");
+        let config = depends_on_config(&marker, DependencyCondition::Started, 5);
         let hypervisor = Hypervisor::new(config);
 
-        // Spawn v1 and v2
-        hypervisor.spawn("api", "v1").await.unwrap();
-        hypervisor.spawn("api", "v2").await.unwrap();
+        hypervisor.spawn("worker", "prod").await.unwrap();
+        assert!(hypervisor.get("db", "prod").await.is_some());
+        assert!(hypervisor.get("worker", "prod").await.is_some());
+        hypervisor.stop("worker", "prod").await.unwrap();
+        hypervisor.stop("db", "prod").await.unwrap();
+    }
 
-        // Initially both have weight 100
-        let v1_info = hypervisor.get("api", "v1").await.unwrap();
-        let v2_info = hypervisor.get("api", "v2").await.unwrap();
-        assert_eq!(v1_info.weight, 100);
-        assert_eq!(v2_info.weight, 100);
+    #[tokio::test]
+    async fn test_depends_on_waits_until_healthy() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("ready");
+        let config = depends_on_config(&marker, DependencyCondition::Healthy, 10);
+        let hypervisor = Hypervisor::new(config);
 
-        // Swap traffic from v1 to v2
-        let result = hypervisor.route_swap("api", "v1", "v2").await;
-        assert!(result.is_ok());
+        let spawning = tokio::spawn({
+            let hypervisor = hypervisor.clone();
+            async move { hypervisor.spawn("worker", "prod").await }
+        });
+        tokio::time::sleep(Duration::from_millis(750)).await;
+        assert!(hypervisor.get("db", "prod").await.is_some());
+        assert!(hypervisor.get("worker", "prod").await.is_none());
+
+        std::fs::write(&marker, "").unwrap();
+        spawning.await.unwrap().unwrap();
+        assert!(hypervisor.get("worker", "prod").await.is_some());
+        hypervisor.stop("worker", "prod").await.unwrap();
+        hypervisor.stop("db", "prod").await.unwrap();
+    }
 
-        // Verify weights swapped atomically
-        let v1_info = hypervisor.get("api", "v1").await.unwrap();
-        let v2_info = hypervisor.get("api", "v2").await.unwrap();
-        assert_eq!(v1_info.weight, 0);
-        assert_eq!(v2_info.weight, 100);
+    #[tokio::test]
+    async fn test_depends_on_timeout_fails_spawn() {
+        let dir = TempDir::new().unwrap();
+        let marker = dir.path().join("never");
+        let config = depends_on_config(&marker, DependencyCondition::Healthy, 1);
+        let hypervisor = Hypervisor::new(config);
 
-        hypervisor.stop("api", "v1").await.ok();
-        hypervisor.stop("api", "v2").await.ok();
+        let err = hypervisor.spawn("worker", "prod").await.unwrap_err();
+        assert!(err.to_string().contains("gave up waiting for db:prod"), "{}", err);
+        assert!(hypervisor.get("worker", "prod").await.is_none());
+        // The dependency stays up for the health monitor to deal with
+        assert!(hypervisor.get("db", "prod").await.is_some());
+        hypervisor.stop("db", "prod").await.unwrap();
     }
 
+    // ===================
+    // LOG RATE LIMIT TESTS
+    // ===================
+
     #[tokio::test]
-    async fn test_route_swap_from_not_found() {
+    async fn test_chatty_app_log_lines_are_rate_limited() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
+        let script = dir.path().join("chatty.sh");
+        std::fs::write(
+            &script,
+            "#!/bin/bash\nfor i in $(seq 1 5000); do echo \"line $i\"; done\nsleep 30\n",
+        )
+        .unwrap();
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            std::fs::set_permissions(&script, std::fs::Permissions::from_mode(0o755)).unwrap();
+        }
 
-        let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        let mut config = test_config_with_process("chatty", script.to_str().unwrap(), vec![]);
+        config.service.get_mut("chatty").unwrap().log_rate_limit = Some(50);
         let hypervisor = Hypervisor::new(config);
+        hypervisor.spawn("chatty", "1").await.ok();
 
-        // Only spawn v2
-        hypervisor.spawn("api", "v2").await.unwrap();
+        // Let the flood finish, then stop so the capture tasks see EOF and flush
+        tokio::time::sleep(Duration::from_secs(1)).await;
+        hypervisor.stop("chatty", "1").await.ok();
+        tokio::time::sleep(Duration::from_millis(200)).await;
+        let query = crate::logs::LogQuery {
+            process: Some("chatty".to_string()),
+            ..Default::default()
+        };
+        let logs = hypervisor.log_buffer().query(&query).await;
 
-        // Try to swap from non-existent v1
-        let result = hypervisor.route_swap("api", "v1", "v2").await;
-        assert!(result.is_err());
-        assert!(result.unwrap_err().to_string().contains("not found"));
+        let kept = logs.iter().filter(|l| l.message.starts_with("line ")).count();
+        assert!(kept >= 50, "burst should be kept, got {}", kept);
+        assert!(kept < 1000, "flood should be limited, got {}", kept);
 
-        hypervisor.stop("api", "v2").await.ok();
+        // Everything that was dropped is accounted for in summaries
+        let dropped: usize = logs
+            .iter()
+            .filter_map(|l| l.message.strip_prefix("[tenement] "))
+            .filter_map(|m| m.split_whitespace().next()?.parse::<usize>().ok())
+            .sum();
+        assert_eq!(kept + dropped, 5000);
     }
 
+    // ===================
+    // STATE RECOVERY TESTS
+    // ===================
+
     #[tokio::test]
-    async fn test_route_swap_to_not_found() {
+    async fn test_restart_restores_ports_weights_and_pins() {
         let dir = TempDir::new().unwrap();
+        let pool = crate::store::init_db(&dir.path().join("state.db")).await.unwrap();
+        let store = Arc::new(crate::store::StateStore::new(pool));
         let script = create_touch_socket_script(dir.path());
-
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        let hypervisor = Hypervisor::new(config);
-
-        // Only spawn v1
-        hypervisor.spawn("api", "v1").await.unwrap();
-
-        // Try to swap to non-existent v2
-        let result = hypervisor.route_swap("api", "v1", "v2").await;
-        assert!(result.is_err());
-        assert!(result.unwrap_err().to_string().contains("not found"));
 
-        hypervisor.stop("api", "v1").await.ok();
+        let first = Hypervisor::with_state_store(config.clone(), store.clone());
+        // Take the first port, so a fresh allocation would hand out a different one
+        first.spawn("api", "scratch").await.unwrap();
+        let pin = ReleasePin {
+            artifact: Some("/srv/builds/v1".to_string()),
+            ..Default::default()
+        };
+        first.pin_release("api", "v1", pin).await;
+        first.spawn("api", "v1").await.unwrap();
+        first.stop("api", "scratch").await.unwrap();
+        first.set_weight("api", "v1", 40).await.unwrap();
+        store.set_restarts("api:v1", 3).await.unwrap();
+        let port = first.get("api", "v1").await.unwrap().port;
+        first.shutdown(Duration::from_secs(2)).await;
+        assert!(first.get("api", "v1").await.is_none());
+
+        let second = Hypervisor::with_state_store(config, store.clone());
+        let restored = second.recover_orphans().await;
+        assert_eq!(restored, vec![InstanceId::new("api", "v1")]);
+        let info = second.get("api", "v1").await.unwrap();
+        assert_eq!(info.port, port);
+        assert_eq!(info.weight, 40);
+        assert_eq!(info.restarts, 3);
+        let pins = second.release_pins.read().unwrap().clone();
+        let pin = pins.get(&InstanceId::new("api", "v1")).unwrap();
+        assert_eq!(pin.artifact.as_deref(), Some("/srv/builds/v1"));
+
+        // A stop is for good: nothing comes back next time
+        second.stop("api", "v1").await.unwrap();
+        assert!(store.list().await.unwrap().is_empty());
     }
 
     #[tokio::test]
-    async fn test_route_swap_weighted_routing() {
-        // Verify that after route swap, only the target version receives traffic
+    async fn test_instances_keep_their_ports_and_skip_bound_ones() {
         let dir = TempDir::new().unwrap();
+        let pool = crate::store::init_db(&dir.path().join("state.db"))
+            .await
+            .unwrap();
+        let store = Arc::new(crate::store::StateStore::new(pool));
         let script = create_touch_socket_script(dir.path());
+        let mut config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
+        // Something else already listens on the first port of the range
+        let taken = std::net::TcpListener::bind("0.0.0.0:0").unwrap();
+        let bound = taken.local_addr().unwrap().port();
+        config.settings.port_range = (bound, bound.saturating_add(3));
+
+        let first = Hypervisor::with_state_store(config.clone(), store.clone());
+        first.spawn("api", "a").await.unwrap();
+        first.spawn("api", "b").await.unwrap();
+        let port_a = first.get("api", "a").await.unwrap().port.unwrap();
+        assert_ne!(port_a, bound);
+        assert_ne!(first.get("api", "b").await.unwrap().port, Some(bound));
+
+        // A stopped instance's port isn't handed to the next one while others are free
+        first.stop("api", "a").await.unwrap();
+        first.spawn("api", "c").await.unwrap();
+        assert_ne!(first.get("api", "c").await.unwrap().port, Some(port_a));
+        first.spawn("api", "a").await.unwrap();
+        assert_eq!(first.get("api", "a").await.unwrap().port, Some(port_a));
+        first.shutdown(Duration::from_secs(2)).await;
+
+        // The assignment is persisted, so it outlasts tenement too, even for an
+        // instance that isn't recovered
+        let ports = store.ports().await.unwrap();
+        assert!(ports.contains(&("api:a".into(), port_a)), "{:?}", ports);
+        store.clear_all().await.unwrap();
+        let second = Hypervisor::with_state_store(config, store.clone());
+        assert!(second.recover_orphans().await.is_empty());
+        second.spawn("api", "c").await.unwrap();
+        second.spawn("api", "a").await.unwrap();
+        assert_eq!(second.get("api", "a").await.unwrap().port, Some(port_a));
+        second.shutdown(Duration::from_secs(2)).await;
+    }
 
+    #[tokio::test]
+    async fn test_retired_versions_give_up_their_ports() {
+        let dir = TempDir::new().unwrap();
+        let script = create_touch_socket_script(dir.path());
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
-
         hypervisor.spawn("api", "v1").await.unwrap();
         hypervisor.spawn("api", "v2").await.unwrap();
+        let assigned = |id: &str| {
+            let ports = hypervisor.assigned_ports.lock().unwrap();
+            ports.contains_key(&InstanceId::new("api", id))
+        };
 
-        // Route all traffic from v1 to v2
-        hypervisor.route_swap("api", "v1", "v2").await.unwrap();
-
-        // All weighted selections should now go to v2 (v1 has weight 0)
-        for _ in 0..10 {
-            let selected = hypervisor.select_weighted("api").await;
-            assert!(selected.is_some());
-            assert_eq!(selected.unwrap().id.id, "v2");
-        }
-
-        hypervisor.stop("api", "v1").await.ok();
-        hypervisor.stop("api", "v2").await.ok();
+        // A stop may be followed by a start; a replaced version is gone
+        hypervisor.stop("api", "v1").await.unwrap();
+        assert!(assigned("v1"));
+        let retired = hypervisor.retire("api", "v2", Duration::ZERO).await;
+        retired.unwrap();
+        assert!(!assigned("v2"));
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_blue_green_workflow() {
-        // Full blue/green deployment workflow
+    async fn test_hand_off_keeps_instances_running_for_the_next_supervisor() {
+        use std::os::fd::BorrowedFd;
+
         let dir = TempDir::new().unwrap();
+        let pool = crate::store::init_db(&dir.path().join("state.db"))
+            .await
+            .unwrap();
+        let store = Arc::new(crate::store::StateStore::new(pool));
         let script = create_touch_socket_script(dir.path());
-
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
-        let hypervisor = Hypervisor::new(config);
 
-        // 1. Deploy v1 (blue) initially
-        hypervisor
-            .deploy_and_wait_healthy("api", "v1", 100, 5)
-            .await
-            .unwrap();
+        let first = Hypervisor::with_state_store(config.clone(), store.clone());
+        first.spawn("api", "v1").await.unwrap();
+        first.set_weight("api", "v1", 40).await.unwrap();
+        let port = first.get("api", "v1").await.unwrap().port;
+        let pid = store.list().await.unwrap()[0].pid;
+        let alive = || unsafe { libc::kill(pid as i32, 0) } == 0;
+
+        let outputs = first.handoff_outputs().await;
+        assert_eq!(outputs.len(), 1);
+        let (id, fds) = &outputs[0];
+        assert_eq!(id, &InstanceId::new("api", "v1"));
+        assert_eq!(fds.len(), 2, "stdout and stderr");
+        // The next supervisor gets its own copies, as an exec'd one would
+        let copies: Vec<OwnedFd> = fds
+            .iter()
+            .map(|fd| {
+                unsafe { BorrowedFd::borrow_raw(*fd) }
+                    .try_clone_to_owned()
+                    .unwrap()
+            })
+            .collect();
 
-        // 2. Deploy v2 (green) with weight 0 (no traffic yet)
-        hypervisor
-            .deploy_and_wait_healthy("api", "v2", 0, 5)
-            .await
-            .unwrap();
+        first.hand_off(&[id.clone()]).await;
+        assert!(first.is_handed_off());
+        assert!(first.spawn("api", "v2").await.is_err());
+        first.shutdown(Duration::from_secs(2)).await;
+        assert!(
+            alive(),
+            "a hand-off leaves instances to the next supervisor"
+        );
 
-        // At this point, all traffic goes to v1
-        for _ in 0..5 {
-            let selected = hypervisor.select_weighted("api").await;
-            assert_eq!(selected.unwrap().id.id, "v1");
-        }
+        let second = Hypervisor::with_state_store(config, store.clone());
+        second.adopt_on_recovery(HashMap::from([(id.clone(), copies)]));
+        let restored = second.recover_orphans().await;
+        assert_eq!(restored, vec![id.clone()]);
+        assert!(alive(), "an adopted instance isn't restarted");
+        let info = second.get("api", "v1").await.unwrap();
+        assert_eq!(info.port, port);
+        assert_eq!(info.weight, 40);
+        assert_eq!(store.list().await.unwrap()[0].pid, pid);
+
+        // The new supervisor stops it like its own (this test process reaps it)
+        second.stop("api", "v1").await.unwrap();
+        let mut status = 0;
+        assert_eq!(
+            unsafe { libc::waitpid(pid as i32, &mut status, 0) },
+            pid as i32
+        );
+        assert!(libc::WIFSIGNALED(status));
+    }
 
-        // 3. Atomic swap: route all traffic from v1 to v2
-        hypervisor.route_swap("api", "v1", "v2").await.unwrap();
+    // ===================
+    // FAULT INJECTION TESTS
+    // ===================
 
-        // Now all traffic goes to v2
-        for _ in 0..5 {
-            let selected = hypervisor.select_weighted("api").await;
-            assert_eq!(selected.unwrap().id.id, "v2");
-        }
+    #[test]
+    fn test_fault_injection_toggles_at_runtime() {
+        let mut config = test_config_with_process("api", "sleep", vec!["60"]);
+        config.service.get_mut("api").unwrap().fault = Some(FaultConfig {
+            delay_ms: 100,
+            delay_percent: 100.0,
+            ..Default::default()
+        });
+        let hypervisor = Hypervisor::new(config);
+        assert!(!hypervisor.fault_injection_enabled());
+        assert!(hypervisor.fault_for("api").is_none());
 
-        // 4. Stop old version v1
-        hypervisor.stop("api", "v1").await.unwrap();
+        hypervisor.set_fault_injection(true);
+        assert_eq!(hypervisor.fault_for("api").unwrap().delay_ms, 100);
 
-        // Only v2 remains
-        let instances = hypervisor.list_by_process("api").await;
-        assert_eq!(instances.len(), 1);
-        assert_eq!(instances[0].id.id, "v2");
+        hypervisor.set_fault_injection(false);
+        assert!(hypervisor.fault_for("api").is_none());
+    }
 
-        hypervisor.stop("api", "v2").await.ok();
+    #[test]
+    fn test_fault_overrides_replace_config() {
+        let mut config = test_config_with_process("api", "sleep", vec!["60"]);
+        config.settings.fault_injection = true;
+        let hypervisor = Hypervisor::new(config);
+        assert!(hypervisor.fault_for("api").is_none());
+        assert!(hypervisor.faults().is_empty());
+
+        let abort = FaultConfig {
+            abort_status: Some(503),
+            abort_percent: 10.0,
+            ..Default::default()
+        };
+        hypervisor.set_fault("api", Some(abort.clone())).unwrap();
+        assert_eq!(hypervisor.fault_for("api"), Some(abort.clone()));
+        let faults = hypervisor.faults();
+        assert_eq!(faults.len(), 1);
+        assert_eq!(faults[0].fault, abort);
+        assert!(faults[0].overridden);
+
+        hypervisor.set_fault("api", None).unwrap();
+        assert!(hypervisor.fault_for("api").is_none());
+
+        assert!(hypervisor.set_fault("missing", Some(abort)).is_err());
+        let invalid = FaultConfig {
+            abort_percent: 10.0,
+            ..Default::default()
+        };
+        let err = hypervisor.set_fault("api", Some(invalid)).unwrap_err();
+        assert!(err.to_string().contains("Service 'api'"), "{}", err);
     }
 
+    #[cfg(unix)]
     #[tokio::test]
-    async fn test_canary_workflow() {
-        // Full canary deployment workflow
+    async fn test_kill_random_instance_kills_a_replica() {
         let dir = TempDir::new().unwrap();
-        let script = create_touch_socket_script(dir.path());
-
+        let script = create_stubborn_script(dir.path());
         let config = test_config_with_process("api", script.to_str().unwrap(), vec![]);
         let hypervisor = Hypervisor::new(config);
-
-        // 1. v1 is running with full traffic
-        hypervisor
-            .deploy_and_wait_healthy("api", "v1", 100, 5)
-            .await
-            .unwrap();
-
-        // 2. Deploy v2 with 10% traffic (canary)
-        hypervisor
-            .deploy_and_wait_healthy("api", "v2", 10, 5)
-            .await
-            .unwrap();
-
-        // Traffic split is now roughly 91% v1, 9% v2 (100:10 ratio)
-        let v1_info = hypervisor.get("api", "v1").await.unwrap();
-        let v2_info = hypervisor.get("api", "v2").await.unwrap();
-        assert_eq!(v1_info.weight, 100);
-        assert_eq!(v2_info.weight, 10);
-
-        // 3. Increase v2 weight to 50%
-        hypervisor.set_weight("api", "v2", 50).await.unwrap();
-
-        // 4. Full rollout: set v1=0, v2=100
-        hypervisor.set_weight("api", "v1", 0).await.unwrap();
-        hypervisor.set_weight("api", "v2", 100).await.unwrap();
-
-        // All traffic now goes to v2
-        for _ in 0..5 {
-            let selected = hypervisor.select_weighted("api").await;
-            assert_eq!(selected.unwrap().id.id, "v2");
+        assert!(hypervisor.kill_random_instance("api").await.is_none());
+
+        hypervisor.spawn("api", "a").await.unwrap();
+        hypervisor.spawn("api", "b").await.unwrap();
+        let pids = hypervisor.instance_pids().await;
+        let killed = hypervisor.kill_random_instance("api").await.unwrap();
+        let pid = *pids.iter().find(|(_, id)| **id == killed).unwrap().0;
+
+        // Killed despite ignoring SIGTERM, and reaped as a crash
+        let deadline = Instant::now() + Duration::from_secs(5);
+        while pid_alive(pid) && Instant::now() < deadline {
+            tokio::time::sleep(Duration::from_millis(50)).await;
         }
-
-        // 5. Stop v1
-        hypervisor.stop("api", "v1").await.ok();
-        hypervisor.stop("api", "v2").await.ok();
+        assert!(!pid_alive(pid));
+        hypervisor.shutdown(Duration::from_secs(2)).await;
     }
 }
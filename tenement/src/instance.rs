@@ -1,8 +1,16 @@
 //! Process instance management
 
+use crate::egress::Netns;
+use crate::hooks::BoundHook;
+use crate::metrics::ProcessUsage;
+use crate::post_stop::PostStopHook;
 use crate::runtime::{RuntimeHandle, RuntimeType};
+use chrono::{DateTime, Utc};
 use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
 use std::path::PathBuf;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::Arc;
 use std::time::Instant;
 
 /// Unique identifier for an instance: "process_name:id"
@@ -47,6 +55,13 @@ pub enum HealthStatus {
     Failed,
 }
 
+impl HealthStatus {
+    /// Past the failure threshold; the proxy stops sending it traffic
+    pub fn is_down(self) -> bool {
+        matches!(self, HealthStatus::Unhealthy | HealthStatus::Failed)
+    }
+}
+
 impl std::fmt::Display for HealthStatus {
     fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
         match self {
@@ -59,6 +74,15 @@ impl std::fmt::Display for HealthStatus {
     }
 }
 
+/// A health state change seen by a health check
+#[derive(Debug, Clone)]
+pub struct HealthTransition {
+    pub instance: InstanceId,
+    pub old: HealthStatus,
+    pub new: HealthStatus,
+    pub at: DateTime<Utc>,
+}
+
 /// Running status of an instance
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
 #[serde(rename_all = "lowercase")]
@@ -69,6 +93,9 @@ pub enum InstanceStatus {
     Stopping,
     /// Instance was auto-stopped due to idle timeout, can be auto-woken on request
     Sleeping,
+    /// Running, but restarted repeatedly within the backoff reset window
+    #[serde(rename = "crash-looping")]
+    CrashLooping,
 }
 
 impl std::fmt::Display for InstanceStatus {
@@ -79,6 +106,7 @@ impl std::fmt::Display for InstanceStatus {
             InstanceStatus::Starting => write!(f, "starting"),
             InstanceStatus::Stopping => write!(f, "stopping"),
             InstanceStatus::Sleeping => write!(f, "sleeping"),
+            InstanceStatus::CrashLooping => write!(f, "crash-looping"),
         }
     }
 }
@@ -95,9 +123,20 @@ pub struct Instance {
     pub started_at: Instant,
     pub restarts: u32,
     pub consecutive_failures: u32,
+    /// Passing checks since the last failure (for the recovery threshold)
+    pub consecutive_successes: u32,
+    /// Held while a health probe runs; concurrent checks don't start another
+    pub probe_in_flight: ProbeSlot,
     pub last_health_check: Option<Instant>,
+    /// Passed a health check since launch; until then the startup failure
+    /// threshold applies
+    pub health_passed: bool,
     pub health_status: HealthStatus,
+    /// Readiness probe state: whether the proxy sends it traffic
+    pub readiness: Readiness,
     pub restart_times: Vec<Instant>,
+    /// Restarts within this long of each other count toward a crash loop
+    pub backoff_reset: Duration,
     /// Last time a real request (not health check) was received.
     /// Used for idle timeout calculation.
     pub last_activity: Instant,
@@ -111,9 +150,38 @@ pub struct Instance {
     pub storage_used_bytes: u64,
     /// Path to the instance's data directory
     pub data_dir: PathBuf,
+    /// Scratch directory exposed as TMPDIR (None = `tmp_dir` not enabled)
+    pub tmp_dir: Option<PathBuf>,
     /// Traffic weight for load balancing (0-100, default 100)
     /// Weight 0 means instance receives no traffic
     pub weight: u8,
+    /// Time from launch to first ready (None until the instance reports ready)
+    pub startup_duration: Option<Duration>,
+    /// Latest resource reading of its process and when it was taken (None
+    /// until the sampler reaches it, or for instances without a PID)
+    pub usage: Option<(Instant, ProcessUsage)>,
+    /// Fingerprint of the secrets this instance was given (None = no secrets)
+    pub secrets_fingerprint: Option<u64>,
+    /// Environment tenement gave it; process and namespace runtimes also
+    /// inherit tenement's own. Rebuilt from its config for an instance adopted
+    /// on upgrade.
+    pub env: HashMap<String, String>,
+    /// Runs once this process has ended (service `post_stop`)
+    pub post_stop: Option<PostStopHook>,
+    /// Runs before tenement stops it (service `hooks.pre_stop`)
+    pub pre_stop: Option<BoundHook>,
+    /// Sent its stop signal, so its exit is expected rather than a crash
+    pub stopping: bool,
+    /// OOM kills already seen in its cgroup; a higher count means the memory
+    /// limit was hit
+    pub oom_kills: u64,
+    /// Network namespace holding it to its egress policy, with the proxy and
+    /// forwards serving it (None = no policy)
+    pub egress: Option<Netns>,
+    /// Copies of the stdout/stderr pipes being read, handed to the next
+    /// supervisor on upgrade (empty when tenement doesn't capture its output)
+    #[cfg(unix)]
+    pub output: Vec<std::os::fd::OwnedFd>,
 }
 
 impl Instance {
@@ -126,6 +194,61 @@ impl Instance {
     pub fn tcp_addr(&self) -> Option<String> {
         self.port.map(|p| format!("127.0.0.1:{}", p))
     }
+
+    /// Time since it first reported ready, if it has
+    pub fn ready_for(&self) -> Option<Duration> {
+        let ready_at = self.started_at + self.startup_duration?;
+        Some(ready_at.elapsed())
+    }
+}
+
+/// One probe of an instance at a time. The claim is released when dropped, so
+/// a caller cancelled mid-probe (a timed-out request) doesn't wedge the slot.
+#[derive(Debug, Default)]
+pub struct ProbeSlot(Arc<AtomicBool>);
+
+impl ProbeSlot {
+    /// Claim the slot, or None if a probe already holds it
+    pub fn claim(&self) -> Option<ProbeClaim> {
+        let taken = self.0.swap(true, Ordering::AcqRel);
+        (!taken).then(|| ProbeClaim(self.0.clone()))
+    }
+}
+
+/// A claimed [`ProbeSlot`], released on drop
+pub struct ProbeClaim(Arc<AtomicBool>);
+
+impl Drop for ProbeClaim {
+    fn drop(&mut self) {
+        self.0.store(false, Ordering::Release);
+    }
+}
+
+/// Result of an instance's readiness probes, kept apart from its health: an
+/// unready instance gets no proxied traffic but is left running
+#[derive(Debug)]
+pub struct Readiness {
+    /// In rotation
+    pub ready: bool,
+    pub consecutive_failures: u32,
+    pub consecutive_successes: u32,
+    /// Held while a readiness probe runs; concurrent checks don't start another
+    pub probe_in_flight: ProbeSlot,
+    pub last_check: Option<Instant>,
+}
+
+impl Readiness {
+    /// Before any check: unready if a readiness probe is configured (`probed`),
+    /// otherwise ready for good
+    pub fn new(probed: bool) -> Self {
+        Self {
+            ready: !probed,
+            consecutive_failures: 0,
+            consecutive_successes: 0,
+            probe_in_flight: ProbeSlot::default(),
+            last_check: None,
+        }
+    }
 }
 
 /// Instance info for display (serializable)
@@ -141,6 +264,9 @@ pub struct InstanceInfo {
     pub uptime_secs: u64,
     pub restarts: u32,
     pub health: HealthStatus,
+    /// Passing its readiness probe (always true without one)
+    #[serde(default = "default_ready")]
+    pub ready: bool,
     pub status: InstanceStatus,
     /// Seconds since last activity (real request, not health check)
     pub idle_secs: u64,
@@ -154,6 +280,16 @@ pub struct InstanceInfo {
     pub data_dir: PathBuf,
     /// Traffic weight for load balancing (0-100)
     pub weight: u8,
+    /// Milliseconds from launch to first ready for the current run
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub last_startup_ms: Option<u64>,
+    /// Memory, CPU, threads and open descriptors of its process, as last sampled
+    #[serde(default, skip_serializing_if = "Option::is_none")]
+    pub usage: Option<ProcessUsage>,
+}
+
+fn default_ready() -> bool {
+    true
 }
 
 impl InstanceInfo {
@@ -179,6 +315,9 @@ impl InstanceInfo {
 
 use std::time::Duration;
 
+/// Restarts within the backoff reset window that make an instance crash-looping
+pub const CRASH_LOOP_RESTARTS: usize = 3;
+
 impl Instance {
     pub fn info(&self) -> InstanceInfo {
         InstanceInfo {
@@ -189,16 +328,33 @@ impl Instance {
             uptime_secs: self.started_at.elapsed().as_secs(),
             restarts: self.restarts,
             health: self.health_status,
-            status: InstanceStatus::Running,
+            ready: self.readiness.ready,
+            status: if self.is_crash_looping() {
+                InstanceStatus::CrashLooping
+            } else {
+                InstanceStatus::Running
+            },
             idle_secs: self.last_activity.elapsed().as_secs(),
             idle_timeout: self.idle_timeout,
             storage_used_bytes: self.storage_used_bytes,
             storage_quota_bytes: self.storage_quota_mb.map(|mb| (mb as u64) * 1024 * 1024),
             data_dir: self.data_dir.clone(),
             weight: self.weight,
+            last_startup_ms: self.startup_duration.map(|d| d.as_millis() as u64),
+            usage: self.usage.map(|(_, usage)| usage),
         }
     }
 
+    /// Restarted at least `CRASH_LOOP_RESTARTS` times within `backoff_reset`
+    pub fn is_crash_looping(&self) -> bool {
+        let recent = self
+            .restart_times
+            .iter()
+            .filter(|t| t.elapsed() < self.backoff_reset)
+            .count();
+        recent >= CRASH_LOOP_RESTARTS
+    }
+
     /// Check if this instance has been idle longer than its timeout.
     ///
     /// Returns false if:
@@ -407,6 +563,7 @@ mod tests {
         assert_eq!(InstanceStatus::Starting.to_string(), "starting");
         assert_eq!(InstanceStatus::Stopping.to_string(), "stopping");
         assert_eq!(InstanceStatus::Sleeping.to_string(), "sleeping");
+        assert_eq!(InstanceStatus::CrashLooping.to_string(), "crash-looping");
     }
 
     #[test]
@@ -470,6 +627,7 @@ mod tests {
             (InstanceStatus::Starting, "\"starting\""),
             (InstanceStatus::Stopping, "\"stopping\""),
             (InstanceStatus::Sleeping, "\"sleeping\""),
+            (InstanceStatus::CrashLooping, "\"crash-looping\""),
         ];
 
         for (status, expected) in variants {
@@ -523,6 +681,7 @@ mod tests {
             uptime_secs: 3600,
             restarts: 2,
             health: HealthStatus::Healthy,
+            ready: true,
             status: InstanceStatus::Running,
             idle_secs: 60,
             idle_timeout: Some(300),
@@ -530,6 +689,8 @@ mod tests {
             storage_quota_bytes: Some(536870912),
             data_dir: PathBuf::from("/data/api/user1"),
             weight: 100,
+            last_startup_ms: None,
+            usage: None,
         };
 
         let json = serde_json::to_string(&info).unwrap();
@@ -560,6 +721,7 @@ mod tests {
             uptime_secs: 100,
             restarts: 0,
             health: HealthStatus::Unknown,
+            ready: true,
             status: InstanceStatus::Starting,
             idle_secs: 0,
             idle_timeout: None,
@@ -567,6 +729,8 @@ mod tests {
             storage_quota_bytes: None,
             data_dir: PathBuf::from("/data/api/user1"),
             weight: 100,
+            last_startup_ms: None,
+            usage: None,
         };
 
         let json = serde_json::to_string(&info).unwrap();
@@ -747,6 +911,7 @@ mod tests {
             uptime_secs: 100,
             restarts: 1,
             health: HealthStatus::Healthy,
+            ready: true,
             status: InstanceStatus::Running,
             idle_secs: 10,
             idle_timeout: Some(300),
@@ -754,6 +919,8 @@ mod tests {
             storage_quota_bytes: Some(2048),
             data_dir: PathBuf::from("/data/api/user1"),
             weight: 100,
+            last_startup_ms: None,
+            usage: None,
         };
 
         let cloned = info.clone();
@@ -776,6 +943,7 @@ mod tests {
             uptime_secs: 100,
             restarts: 0,
             health: HealthStatus::Unknown,
+            ready: true,
             status: InstanceStatus::Running,
             idle_secs: 0,
             idle_timeout: None,
@@ -783,6 +951,8 @@ mod tests {
             storage_quota_bytes: None,
             data_dir: PathBuf::from("/data/api/user1"),
             weight: 100,
+            last_startup_ms: None,
+            usage: None,
         };
 
         let debug = format!("{:?}", info);
@@ -804,6 +974,7 @@ mod tests {
             uptime_secs: 100,
             restarts: 0,
             health: HealthStatus::Healthy,
+            ready: true,
             status: InstanceStatus::Running,
             idle_secs: 0,
             idle_timeout: None,
@@ -811,6 +982,8 @@ mod tests {
             storage_quota_bytes: None,             // No quota
             data_dir: PathBuf::from("/data/api/user1"),
             weight: 100,
+            last_startup_ms: None,
+            usage: None,
         };
 
         assert_eq!(info.storage_used_bytes, 104857600);
@@ -827,6 +1000,7 @@ mod tests {
             uptime_secs: 100,
             restarts: 0,
             health: HealthStatus::Healthy,
+            ready: true,
             status: InstanceStatus::Running,
             idle_secs: 0,
             idle_timeout: None,
@@ -834,6 +1008,8 @@ mod tests {
             storage_quota_bytes: Some(536870912), // 512MB
             data_dir: PathBuf::from("/data/api/user1"),
             weight: 100,
+            last_startup_ms: None,
+            usage: None,
         };
 
         assert_eq!(info.storage_used_bytes, 134217728);
@@ -854,6 +1030,7 @@ mod tests {
             uptime_secs: 100,
             restarts: 0,
             health: HealthStatus::Healthy,
+            ready: true,
             status: InstanceStatus::Running,
             idle_secs: 0,
             idle_timeout: None,
@@ -861,6 +1038,8 @@ mod tests {
             storage_quota_bytes: None,
             data_dir: PathBuf::from("/data/api/user1"),
             weight: 50,
+            last_startup_ms: None,
+            usage: None,
         };
 
         assert_eq!(info.weight, 50);
@@ -876,6 +1055,7 @@ mod tests {
             uptime_secs: 100,
             restarts: 0,
             health: HealthStatus::Healthy,
+            ready: true,
             status: InstanceStatus::Running,
             idle_secs: 0,
             idle_timeout: None,
@@ -883,6 +1063,8 @@ mod tests {
             storage_quota_bytes: None,
             data_dir: PathBuf::from("/data/api/user1"),
             weight: 75,
+            last_startup_ms: None,
+            usage: None,
         };
 
         let json = serde_json::to_string(&info).unwrap();
@@ -891,4 +1073,60 @@ mod tests {
         let deserialized: InstanceInfo = serde_json::from_str(&json).unwrap();
         assert_eq!(deserialized.weight, 75);
     }
+
+    #[test]
+    fn test_instance_info_last_startup_serialization() {
+        let mut info = InstanceInfo {
+            id: InstanceId::new("api", "user1"),
+            runtime: RuntimeType::Process,
+            socket: PathBuf::from("/tmp/test.sock"),
+            port: None,
+            uptime_secs: 100,
+            restarts: 0,
+            health: HealthStatus::Healthy,
+            ready: true,
+            status: InstanceStatus::Running,
+            idle_secs: 0,
+            idle_timeout: None,
+            storage_used_bytes: 0,
+            storage_quota_bytes: None,
+            data_dir: PathBuf::from("/data/api/user1"),
+            weight: 100,
+            last_startup_ms: None,
+            usage: None,
+        };
+
+        // Omitted until the instance has reported ready
+        let json = serde_json::to_string(&info).unwrap();
+        assert!(!json.contains("last_startup_ms"));
+
+        info.last_startup_ms = Some(1250);
+        let json = serde_json::to_string(&info).unwrap();
+        assert!(json.contains("\"last_startup_ms\":1250"));
+
+        let deserialized: InstanceInfo = serde_json::from_str(&json).unwrap();
+        assert_eq!(deserialized.last_startup_ms, Some(1250));
+
+        // Info from before readiness probes existed counts as ready
+        let mut value = serde_json::to_value(&info).unwrap();
+        value.as_object_mut().unwrap().remove("ready");
+        let deserialized: InstanceInfo = serde_json::from_value(value).unwrap();
+        assert!(deserialized.ready);
+    }
+
+    #[test]
+    fn test_probe_slot_is_released_on_drop() {
+        let slot = ProbeSlot::default();
+        let claim = slot.claim().unwrap();
+        assert!(slot.claim().is_none());
+        drop(claim);
+        assert!(slot.claim().is_some());
+    }
+
+    #[test]
+    fn test_readiness_starts_unready_only_when_probed() {
+        assert!(!Readiness::new(true).ready);
+        assert!(Readiness::new(false).ready);
+        assert_eq!(Readiness::new(true).last_check, None);
+    }
 }
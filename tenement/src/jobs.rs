@@ -0,0 +1,539 @@
+//! Scheduled jobs
+//!
+//! `[jobs.<name>]` runs a one-shot shell command on a cron schedule, read in the
+//! job's timezone. Runs are supervised like instances: output goes to the log
+//! buffer under the job's name (`ten logs backup`), a run past its `timeout` is
+//! killed with its process group, and `overlap` decides what happens when a run
+//! comes due while the last is still going. `tenement ps` shows each job's last
+//! and next run.
+
+use crate::config::{JobConfig, OverlapPolicy};
+use crate::logs::{LogBuffer, LogEntry, LogLevel};
+use chrono::{DateTime, Utc};
+use serde::{Deserialize, Serialize};
+use std::collections::{HashMap, VecDeque};
+use std::process::Stdio;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+use tokio::io::{AsyncBufReadExt, AsyncRead, BufReader};
+use tokio::process::Command;
+use tokio::sync::Notify;
+use tokio::task::JoinSet;
+use tracing::{info, warn};
+
+/// Instance id job output is logged under, with the job name as the process
+pub const JOB_LOG_ID: &str = "job";
+
+/// Output lines kept with a job's last run
+const OUTPUT_TAIL_LINES: usize = 20;
+
+/// How a run ended
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize, Deserialize)]
+#[serde(rename_all = "kebab-case")]
+pub enum RunOutcome {
+    Succeeded,
+    Failed,
+    TimedOut,
+    /// Killed by a newer run (`overlap = "replace"`) or by shutdown
+    Cancelled,
+}
+
+impl std::fmt::Display for RunOutcome {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            RunOutcome::Succeeded => write!(f, "succeeded"),
+            RunOutcome::Failed => write!(f, "failed"),
+            RunOutcome::TimedOut => write!(f, "timed-out"),
+            RunOutcome::Cancelled => write!(f, "cancelled"),
+        }
+    }
+}
+
+/// A finished run
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct JobRun {
+    pub started_at: DateTime<Utc>,
+    pub duration_ms: u64,
+    pub outcome: RunOutcome,
+    /// None if it couldn't start or was killed
+    pub exit_code: Option<i32>,
+    /// Last lines of output, stdout and stderr interleaved
+    pub output: Vec<String>,
+}
+
+/// A job as shown by `tenement ps`
+#[derive(Debug, Clone, Serialize, Deserialize)]
+pub struct JobStatus {
+    pub name: String,
+    pub schedule: String,
+    pub timezone: String,
+    pub next_run: Option<DateTime<Utc>>,
+    /// Runs in progress
+    pub running: usize,
+    pub last_run: Option<JobRun>,
+    /// Runs not started because the previous one was still going
+    pub skipped: u64,
+}
+
+#[derive(Default)]
+struct JobState {
+    /// Next due time, and the schedule and timezone it was worked out from
+    next_run: Option<(DateTime<Utc>, String, Option<String>)>,
+    /// Cancel handles of runs in progress, by run number
+    running: Vec<(u64, Arc<Notify>)>,
+    runs_started: u64,
+    last_run: Option<JobRun>,
+    skipped: u64,
+}
+
+/// Starts due jobs and tracks their runs
+pub struct JobScheduler {
+    log_buffer: Arc<LogBuffer>,
+    states: Mutex<HashMap<String, JobState>>,
+    tasks: Mutex<JoinSet<()>>,
+    stopped: AtomicBool,
+}
+
+impl JobScheduler {
+    pub fn new(log_buffer: Arc<LogBuffer>) -> Arc<Self> {
+        Arc::new(Self {
+            log_buffer,
+            states: Mutex::new(HashMap::new()),
+            tasks: Mutex::new(JoinSet::new()),
+            stopped: AtomicBool::new(false),
+        })
+    }
+
+    /// Start every job whose next run is at or before `now`, and work out next
+    /// runs for jobs that are new or whose schedule changed
+    pub fn run_due(self: &Arc<Self>, jobs: &HashMap<String, JobConfig>, now: DateTime<Utc>) {
+        let mut due = Vec::new();
+        {
+            let mut states = self.states.lock().unwrap();
+            states.retain(|name, state| jobs.contains_key(name) || !state.running.is_empty());
+            for (name, job) in jobs {
+                let state = states.entry(name.clone()).or_default();
+                let planned = match &state.next_run {
+                    Some((at, schedule, timezone))
+                        if *schedule == job.schedule && *timezone == job.timezone =>
+                    {
+                        Some(*at)
+                    }
+                    _ => None,
+                };
+                match planned {
+                    Some(at) if at <= now => {
+                        due.push(name.clone());
+                        state.next_run = plan(job, now);
+                    }
+                    Some(_) => {}
+                    None => state.next_run = plan(job, now),
+                }
+            }
+        }
+        for name in due {
+            self.trigger(&name, &jobs[&name]);
+        }
+    }
+
+    /// Start a run now, subject to the job's overlap policy. Returns whether it
+    /// started.
+    pub fn trigger(self: &Arc<Self>, name: &str, job: &JobConfig) -> bool {
+        if self.stopped.load(Ordering::SeqCst) {
+            return false;
+        }
+        let (run, cancel) = {
+            let mut states = self.states.lock().unwrap();
+            let state = states.entry(name.to_string()).or_default();
+            if !state.running.is_empty() {
+                match job.overlap {
+                    OverlapPolicy::Skip => {
+                        state.skipped += 1;
+                        warn!(
+                            job = name,
+                            event = "job-skipped",
+                            "Job {} is still running; skipping this run",
+                            name
+                        );
+                        return false;
+                    }
+                    OverlapPolicy::Replace => {
+                        info!("Job {} is still running; replacing it", name);
+                        for (_, cancel) in &state.running {
+                            cancel.notify_one();
+                        }
+                    }
+                    OverlapPolicy::Allow => {}
+                }
+            }
+            state.runs_started += 1;
+            let cancel = Arc::new(Notify::new());
+            state.running.push((state.runs_started, cancel.clone()));
+            (state.runs_started, cancel)
+        };
+
+        let scheduler = self.clone();
+        let (name, job) = (name.to_string(), job.clone());
+        let mut tasks = self.tasks.lock().unwrap();
+        // Drop finished runs so the set doesn't grow for the life of the daemon
+        while tasks.try_join_next().is_some() {}
+        tasks.spawn(async move {
+            let finished = run_job(&name, &job, &cancel, &scheduler.log_buffer).await;
+            let mut states = scheduler.states.lock().unwrap();
+            if let Some(state) = states.get_mut(&name) {
+                state.running.retain(|(id, _)| *id != run);
+                state.last_run = Some(finished);
+            }
+        });
+        true
+    }
+
+    /// Status of each configured job, sorted by name
+    pub fn statuses(&self, jobs: &HashMap<String, JobConfig>) -> Vec<JobStatus> {
+        let states = self.states.lock().unwrap();
+        let now = Utc::now();
+        let mut statuses: Vec<JobStatus> = jobs
+            .iter()
+            .map(|(name, job)| {
+                let state = states.get(name);
+                let next_run = match state.and_then(|s| s.next_run.as_ref()) {
+                    Some((at, schedule, timezone))
+                        if *schedule == job.schedule && *timezone == job.timezone =>
+                    {
+                        Some(*at)
+                    }
+                    _ => plan(job, now).map(|(at, _, _)| at),
+                };
+                JobStatus {
+                    name: name.clone(),
+                    schedule: job.schedule.clone(),
+                    timezone: job.timezone.clone().unwrap_or_else(|| "UTC".to_string()),
+                    next_run,
+                    running: state.map_or(0, |s| s.running.len()),
+                    last_run: state.and_then(|s| s.last_run.clone()),
+                    skipped: state.map_or(0, |s| s.skipped),
+                }
+            })
+            .collect();
+        statuses.sort_by(|a, b| a.name.cmp(&b.name));
+        statuses
+    }
+
+    /// Stop starting runs, kill the ones in progress, and wait for them to finish
+    pub async fn shutdown(&self) {
+        self.stopped.store(true, Ordering::SeqCst);
+        for state in self.states.lock().unwrap().values() {
+            for (_, cancel) in &state.running {
+                cancel.notify_one();
+            }
+        }
+        self.wait_all().await;
+    }
+
+    /// Wait for runs in progress; each is bounded by its timeout, if it has one
+    pub async fn wait_all(&self) {
+        let mut tasks = std::mem::take(&mut *self.tasks.lock().unwrap());
+        while tasks.join_next().await.is_some() {}
+    }
+}
+
+/// Next run after `now`, tagged with what it was worked out from
+fn plan(job: &JobConfig, now: DateTime<Utc>) -> Option<(DateTime<Utc>, String, Option<String>)> {
+    let parsed = job.parsed_schedule().and_then(|schedule| Ok((schedule, job.tz()?)));
+    let (schedule, tz) = match parsed {
+        Ok(parsed) => parsed,
+        Err(e) => {
+            warn!("Job schedule {:?} is invalid: {:#}", job.schedule, e);
+            return None;
+        }
+    };
+    let at = schedule.next_after(now, &tz)?;
+    Some((at, job.schedule.clone(), job.timezone.clone()))
+}
+
+/// Run the job once, logging its output under the job's name. Killed (with its
+/// process group) at the timeout or when `cancel` is notified.
+pub async fn run_job(
+    name: &str,
+    job: &JobConfig,
+    cancel: &Notify,
+    log_buffer: &LogBuffer,
+) -> JobRun {
+    let started_at = Utc::now();
+    let started = Instant::now();
+    let tail = Mutex::new(VecDeque::new());
+    let finish = |outcome: RunOutcome, exit_code: Option<i32>, tail: &Mutex<VecDeque<String>>| {
+        let run = JobRun {
+            started_at,
+            duration_ms: started.elapsed().as_millis() as u64,
+            outcome,
+            exit_code,
+            output: tail.lock().unwrap().iter().cloned().collect(),
+        };
+        match outcome {
+            RunOutcome::Succeeded => info!(
+                job = name,
+                event = "job-finished",
+                "Job {} succeeded in {}ms",
+                name,
+                run.duration_ms
+            ),
+            _ => warn!(
+                job = name,
+                event = "job-failed",
+                "Job {} {} after {}ms (exit code {:?})",
+                name,
+                outcome,
+                run.duration_ms,
+                exit_code
+            ),
+        }
+        run
+    };
+
+    let mut cmd = Command::new("sh");
+    cmd.arg("-c")
+        .arg(&job.command)
+        .envs(&job.env)
+        .env("TENEMENT_JOB", name)
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true);
+    if let Some(workdir) = &job.workdir {
+        cmd.current_dir(workdir);
+    }
+    // Own process group, so a timeout kills whatever the command started
+    #[cfg(unix)]
+    unsafe {
+        cmd.pre_exec(|| {
+            if libc::setpgid(0, 0) != 0 {
+                return Err(std::io::Error::last_os_error());
+            }
+            Ok(())
+        });
+    }
+
+    info!(job = name, event = "job-start", "Running job {}", name);
+    let mut child = match cmd.spawn() {
+        Ok(child) => child,
+        Err(e) => {
+            let message = format!("failed to start: {}", e);
+            log_buffer.push_stderr(name, JOB_LOG_ID, message.clone()).await;
+            tail.lock().unwrap().push_back(message);
+            return finish(RunOutcome::Failed, None, &tail);
+        }
+    };
+    let pid = child.id();
+    let stdout = forward_lines(child.stdout.take(), name, LogLevel::Stdout, log_buffer, &tail);
+    let stderr = forward_lines(child.stderr.take(), name, LogLevel::Stderr, log_buffer, &tail);
+    let finished = async {
+        tokio::join!(stdout, stderr);
+        child.wait().await
+    };
+    tokio::pin!(finished);
+    let deadline = async {
+        match job.timeout {
+            Some(secs) => tokio::time::sleep(Duration::from_secs(secs)).await,
+            None => std::future::pending().await,
+        }
+    };
+
+    let stopped = tokio::select! {
+        status = &mut finished => Ok(status),
+        _ = deadline => Err(RunOutcome::TimedOut),
+        _ = cancel.notified() => Err(RunOutcome::Cancelled),
+    };
+    match stopped {
+        Ok(Ok(status)) if status.success() => finish(RunOutcome::Succeeded, Some(0), &tail),
+        Ok(Ok(status)) => finish(RunOutcome::Failed, status.code(), &tail),
+        Ok(Err(e)) => {
+            log_buffer.push_stderr(name, JOB_LOG_ID, format!("wait failed: {}", e)).await;
+            finish(RunOutcome::Failed, None, &tail)
+        }
+        Err(outcome) => {
+            #[cfg(unix)]
+            if let Some(pid) = pid {
+                unsafe {
+                    libc::kill(-(pid as i32), libc::SIGKILL);
+                }
+            }
+            // Reap it; the pipes close once the group is gone
+            let _ = finished.await;
+            let message = format!("{} and was killed", outcome);
+            log_buffer.push_stderr(name, JOB_LOG_ID, message).await;
+            finish(outcome, None, &tail)
+        }
+    }
+}
+
+/// Copy a run's output into the log buffer, keeping the last lines for its status
+async fn forward_lines<R: AsyncRead + Unpin>(
+    pipe: Option<R>,
+    name: &str,
+    level: LogLevel,
+    log_buffer: &LogBuffer,
+    tail: &Mutex<VecDeque<String>>,
+) {
+    let Some(pipe) = pipe else {
+        return;
+    };
+    let mut lines = BufReader::new(pipe).lines();
+    while let Ok(Some(line)) = lines.next_line().await {
+        {
+            let mut tail = tail.lock().unwrap();
+            if tail.len() == OUTPUT_TAIL_LINES {
+                tail.pop_front();
+            }
+            tail.push_back(line.clone());
+        }
+        log_buffer.push(LogEntry::new(name, JOB_LOG_ID, level, line)).await;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::logs::LogQuery;
+
+    fn job(schedule: &str, command: &str) -> JobConfig {
+        JobConfig {
+            schedule: schedule.to_string(),
+            command: command.to_string(),
+            timezone: None,
+            overlap: OverlapPolicy::Skip,
+            timeout: None,
+            env: HashMap::from([("TARGET".to_string(), "s3://backups".to_string())]),
+            workdir: None,
+        }
+    }
+
+    fn at(text: &str) -> DateTime<Utc> {
+        DateTime::parse_from_rfc3339(text).unwrap().with_timezone(&Utc)
+    }
+
+    async fn wait_for_last_run(scheduler: &JobScheduler, jobs: &HashMap<String, JobConfig>) {
+        for _ in 0..100 {
+            if scheduler.statuses(jobs).iter().all(|s| s.last_run.is_some() && s.running == 0) {
+                return;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        panic!("job didn't finish");
+    }
+
+    #[tokio::test]
+    async fn test_run_captures_output_and_env() {
+        let log_buffer = LogBuffer::new();
+        let job = job("@daily", "echo \"to $TARGET as $TENEMENT_JOB\"; echo warn >&2; exit 2");
+
+        let run = run_job("backup", &job, &Notify::new(), &log_buffer).await;
+        assert_eq!(run.outcome, RunOutcome::Failed);
+        assert_eq!(run.exit_code, Some(2));
+        assert!(run.output.contains(&"to s3://backups as backup".to_string()));
+        assert!(run.output.contains(&"warn".to_string()));
+
+        let logs = log_buffer.query(&LogQuery::default()).await;
+        assert!(logs
+            .iter()
+            .any(|l| l.process == "backup" && l.instance_id == JOB_LOG_ID && l.message == "warn"));
+    }
+
+    #[tokio::test]
+    async fn test_run_killed_at_timeout() {
+        let log_buffer = LogBuffer::new();
+        let mut job = job("@daily", "sleep 30");
+        job.timeout = Some(1);
+
+        let started = Instant::now();
+        let run = run_job("slow", &job, &Notify::new(), &log_buffer).await;
+        assert_eq!(run.outcome, RunOutcome::TimedOut);
+        assert!(started.elapsed() < Duration::from_secs(5));
+    }
+
+    #[tokio::test]
+    async fn test_output_tail_is_bounded() {
+        let log_buffer = LogBuffer::new();
+        let job = job("@daily", "seq 1 100");
+
+        let run = run_job("count", &job, &Notify::new(), &log_buffer).await;
+        assert_eq!(run.outcome, RunOutcome::Succeeded);
+        assert_eq!(run.output.len(), OUTPUT_TAIL_LINES);
+        assert_eq!(run.output.last().map(String::as_str), Some("100"));
+    }
+
+    #[tokio::test]
+    async fn test_run_due_plans_then_runs() {
+        let scheduler = JobScheduler::new(LogBuffer::new());
+        let jobs = HashMap::from([("tick".to_string(), job("*/5 * * * *", "true"))]);
+
+        // First sight only plans the next run
+        scheduler.run_due(&jobs, at("2026-10-14T09:03:00Z"));
+        let status = &scheduler.statuses(&jobs)[0];
+        assert_eq!(status.next_run, Some(at("2026-10-14T09:05:00Z")));
+        assert!(status.last_run.is_none());
+
+        scheduler.run_due(&jobs, at("2026-10-14T09:04:00Z"));
+        assert_eq!(scheduler.statuses(&jobs)[0].running, 0);
+
+        scheduler.run_due(&jobs, at("2026-10-14T09:05:00Z"));
+        wait_for_last_run(&scheduler, &jobs).await;
+        let status = &scheduler.statuses(&jobs)[0];
+        assert_eq!(status.last_run.as_ref().unwrap().outcome, RunOutcome::Succeeded);
+        assert_eq!(status.next_run, Some(at("2026-10-14T09:10:00Z")));
+    }
+
+    #[tokio::test]
+    async fn test_overlap_skip() {
+        let scheduler = JobScheduler::new(LogBuffer::new());
+        let job = job("@daily", "sleep 30");
+
+        assert!(scheduler.trigger("slow", &job));
+        assert!(!scheduler.trigger("slow", &job));
+        let jobs = HashMap::from([("slow".to_string(), job)]);
+        let status = &scheduler.statuses(&jobs)[0];
+        assert_eq!((status.running, status.skipped), (1, 1));
+
+        scheduler.shutdown().await;
+        let status = &scheduler.statuses(&jobs)[0];
+        assert_eq!(status.last_run.as_ref().unwrap().outcome, RunOutcome::Cancelled);
+    }
+
+    #[tokio::test]
+    async fn test_overlap_replace() {
+        let scheduler = JobScheduler::new(LogBuffer::new());
+        let mut job = job("@daily", "sleep 30");
+        job.overlap = OverlapPolicy::Replace;
+        let jobs = HashMap::from([("slow".to_string(), job.clone())]);
+
+        assert!(scheduler.trigger("slow", &job));
+        assert!(scheduler.trigger("slow", &job));
+        // The first run is killed; the second keeps going
+        for _ in 0..100 {
+            if scheduler.statuses(&jobs)[0].last_run.is_some() {
+                break;
+            }
+            tokio::time::sleep(Duration::from_millis(50)).await;
+        }
+        let status = &scheduler.statuses(&jobs)[0];
+        assert_eq!(status.last_run.as_ref().unwrap().outcome, RunOutcome::Cancelled);
+        assert_eq!(status.running, 1);
+
+        scheduler.shutdown().await;
+        assert!(!scheduler.trigger("slow", &job));
+    }
+
+    #[tokio::test]
+    async fn test_overlap_allow() {
+        let scheduler = JobScheduler::new(LogBuffer::new());
+        let mut job = job("@daily", "sleep 30");
+        job.overlap = OverlapPolicy::Allow;
+        let jobs = HashMap::from([("slow".to_string(), job.clone())]);
+
+        assert!(scheduler.trigger("slow", &job));
+        assert!(scheduler.trigger("slow", &job));
+        assert_eq!(scheduler.statuses(&jobs)[0].running, 2);
+        scheduler.shutdown().await;
+    }
+}
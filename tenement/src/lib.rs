@@ -3,31 +3,75 @@
 //! Spawn and supervise processes with Unix socket communication,
 //! health checks, and automatic restarts.
 
+pub mod access;
+pub mod access_log;
+pub mod alerts;
+pub mod artifact;
 pub mod auth;
+pub mod backup;
+pub mod buildpack;
 pub mod cgroup;
+pub mod check;
+pub mod cluster;
+pub mod concurrency;
 pub mod config;
+pub mod discovery;
+pub mod egress;
+pub mod env_files;
+pub mod events;
+pub mod exec;
+pub mod fault;
+pub mod git_deploy;
+pub mod headers;
+pub mod hooks;
 pub mod hypervisor;
 pub mod instance;
+pub mod jobs;
+pub mod log_files;
+pub mod log_shipping;
 pub mod logs;
+pub mod mesh;
 pub mod metrics;
 pub mod port_allocator;
+pub mod post_stop;
+pub mod rate_limit;
+pub mod redact;
+pub mod response_cache;
+pub mod routing;
 pub mod runtime;
+pub mod schedule;
+pub mod secret_store;
+pub mod secrets;
+pub mod sockets;
+pub mod state_backend;
 pub mod storage;
 pub mod store;
+pub mod streams;
+pub mod task;
+pub mod telemetry;
+pub mod templates;
+pub mod upstream;
+pub mod users;
+pub mod volumes;
+pub mod warm_pool;
 
-pub use auth::{generate_token, hash_token, verify_token, TokenStore};
+pub use auth::{generate_token, hash_token, verify_token, AdminTokens, Scope, TokenStore};
 pub use cgroup::{CgroupManager, ResourceLimits};
 pub use config::{Config, TlsConfig};
-pub use hypervisor::{ConnectionGuard, Hypervisor};
+pub use hypervisor::{ConnectionGuard, DrainReport, Hypervisor, ReloadReport, ShutdownReport};
 pub use instance::{Instance, InstanceId, InstanceStatus};
 pub use logs::{LogBuffer, LogEntry, LogLevel, LogQuery};
 pub use metrics::Metrics;
 pub use port_allocator::PortAllocator;
+pub use routing::{RouteTable, RouteTarget};
 #[cfg(feature = "sandbox")]
 pub use runtime::SandboxRuntime;
 pub use runtime::{ProcessRuntime, Runtime, RuntimeHandle, RuntimeType, SpawnConfig, VmConfig};
+pub use state_backend::{Backends, ReleaseBackend, StateBackend};
 pub use storage::{calculate_dir_size, format_bytes, StorageInfo};
 pub use store::{
-    init_db, ConfigStore, DbPool, DeployLogEntry, DeployLogStore, InstanceState, LogStore,
-    StateStore, TenantToken, TenantTokenStore,
+    init_db, ApiToken, ApiTokenStore, AuditQuery, ConfigStore, DbPool, DeployLogEntry,
+    DeployLogStore, InstanceState, LogStore, Release, ReleaseDefinition, ReleaseStore, StateStore,
+    TenantToken, TenantTokenStore,
 };
+pub use warm_pool::WarmPool;
@@ -0,0 +1,414 @@
+//! Per-service log files
+//!
+//! With `[settings.log_files]`, everything a service's instances write to
+//! stdout and stderr is appended to `{log_dir}/{service}.log`, one line per
+//! entry: `{timestamp} {instance} {stream} {message}`. A file is rotated once it
+//! reaches `max_size_mb` or gets older than `max_age`: it's renamed to
+//! `{service}.{YYYYmmdd-HHMMSS.mmm}.log`, gzipped in the background when
+//! `compress` is on, and all but the newest `keep` rotated files are deleted.
+
+use crate::config::{LogFilesConfig, Settings};
+use crate::logs::LogEntry;
+use anyhow::{Context, Result};
+use std::collections::{HashMap, HashSet};
+use std::fs::{File, OpenOptions};
+use std::io::Write;
+use std::path::{Path, PathBuf};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, SystemTime};
+use tracing::{info, warn};
+
+/// Length of the timestamp in a rotated file's name ("20261014-120000.123")
+const ROTATED_STAMP_LEN: usize = 19;
+
+/// Appends service output to rotated per-service files
+pub struct LogFiles {
+    dir: PathBuf,
+    max_bytes: u64,
+    max_age: Option<Duration>,
+    keep: usize,
+    compress: bool,
+    state: Mutex<State>,
+}
+
+#[derive(Default)]
+struct State {
+    open: HashMap<String, OpenFile>,
+    /// Services whose last write failed, so the failure is logged once
+    failing: HashSet<String>,
+}
+
+struct OpenFile {
+    file: File,
+    size: u64,
+    opened: SystemTime,
+}
+
+impl LogFiles {
+    pub fn new(dir: impl Into<PathBuf>, config: &LogFilesConfig) -> Arc<Self> {
+        Arc::new(Self {
+            dir: dir.into(),
+            max_bytes: config.max_size_mb.saturating_mul(1024 * 1024),
+            max_age: config.max_age.map(Duration::from_secs),
+            keep: config.keep,
+            compress: config.compress,
+            state: Mutex::new(State::default()),
+        })
+    }
+
+    /// Log files for these settings, if `[settings.log_files]` is set
+    pub fn from_settings(settings: &Settings) -> Option<Arc<Self>> {
+        let config = settings.log_files.as_ref()?;
+        Some(Self::new(settings.log_dir()?, config))
+    }
+
+    /// The live log file for a service
+    pub fn path(&self, process: &str) -> PathBuf {
+        self.dir.join(format!("{}.log", process))
+    }
+
+    /// Append an entry to its service's file, rotating first if it's full or old.
+    /// Failures are logged (once until the file works again) rather than returned,
+    /// so a full disk never holds up an app's output.
+    pub fn append(&self, entry: &LogEntry) {
+        self.append_line(&entry.process, &format_line(entry));
+    }
+
+    /// Append a preformatted line (ending in a newline) to `{name}.log`, like `append`
+    pub fn append_line(&self, name: &str, line: &str) {
+        let mut state = self.state.lock().unwrap();
+        match self.write_line(&mut state, name, line) {
+            Ok(()) => {
+                if state.failing.remove(name) {
+                    let path = self.path(name);
+                    info!("Writing {} logs to {:?} again", name, path);
+                }
+            }
+            Err(e) => {
+                state.open.remove(name);
+                if state.failing.insert(name.to_string()) {
+                    warn!("Failed to write {} log file: {:#}", name, e);
+                }
+            }
+        }
+    }
+
+    fn write_line(&self, state: &mut State, process: &str, line: &str) -> Result<()> {
+        if !state.open.contains_key(process) {
+            state.open.insert(process.to_string(), self.open(process)?);
+        }
+        let due = {
+            let open = &state.open[process];
+            let full = open.size + line.len() as u64 > self.max_bytes;
+            open.size > 0 && (full || self.expired(open))
+        };
+        if due {
+            state.open.remove(process);
+            self.rotate(process)?;
+            state.open.insert(process.to_string(), self.open(process)?);
+        }
+
+        let open = state.open.get_mut(process).expect("opened above");
+        open.file.write_all(line.as_bytes())?;
+        open.size += line.len() as u64;
+        Ok(())
+    }
+
+    fn expired(&self, open: &OpenFile) -> bool {
+        self.max_age
+            .is_some_and(|max_age| open.opened.elapsed().unwrap_or_default() >= max_age)
+    }
+
+    fn open(&self, process: &str) -> Result<OpenFile> {
+        std::fs::create_dir_all(&self.dir)
+            .with_context(|| format!("Failed to create log dir {:?}", self.dir))?;
+        let path = self.path(process);
+        let file = OpenOptions::new()
+            .create(true)
+            .append(true)
+            .open(&path)
+            .with_context(|| format!("Failed to open {:?}", path))?;
+        let meta = file.metadata()?;
+        let opened = meta
+            .created()
+            .or_else(|_| meta.modified())
+            .unwrap_or_else(|_| SystemTime::now());
+        Ok(OpenFile {
+            file,
+            size: meta.len(),
+            opened,
+        })
+    }
+
+    /// Move the live file aside, then compress and prune in the background
+    fn rotate(&self, process: &str) -> Result<()> {
+        let stamp = chrono::Utc::now().format("%Y%m%d-%H%M%S%.3f");
+        let mut rotated = self.dir.join(format!("{}.{}.log", process, stamp));
+        let mut n = 1;
+        while rotated.exists() || gz_path(&rotated).exists() {
+            rotated = self.dir.join(format!("{}.{}-{}.log", process, stamp, n));
+            n += 1;
+        }
+        let live = self.path(process);
+        std::fs::rename(&live, &rotated)
+            .with_context(|| format!("Failed to rotate {:?}", live))?;
+
+        let (dir, process, keep, compress) =
+            (self.dir.clone(), process.to_string(), self.keep, self.compress);
+        std::thread::spawn(move || {
+            if compress {
+                if let Err(e) = gzip(&rotated) {
+                    warn!("Failed to compress {:?}: {:#}", rotated, e);
+                }
+            }
+            prune(&dir, &process, keep);
+        });
+        Ok(())
+    }
+}
+
+/// One file line for an entry
+fn format_line(entry: &LogEntry) -> String {
+    let timestamp = chrono::DateTime::from_timestamp_millis(entry.timestamp as i64)
+        .unwrap_or_default()
+        .to_rfc3339_opts(chrono::SecondsFormat::Millis, true);
+    format!("{} {} {} {}\n", timestamp, entry.instance_id, entry.level, entry.message)
+}
+
+fn gz_path(path: &Path) -> PathBuf {
+    let mut name = path.as_os_str().to_owned();
+    name.push(".gz");
+    PathBuf::from(name)
+}
+
+/// Replace `path` with `path.gz`
+fn gzip(path: &Path) -> Result<()> {
+    let target = gz_path(path);
+    let mut input = File::open(path)?;
+    let output = File::create(&target)?;
+    let mut encoder = flate2::write::GzEncoder::new(output, flate2::Compression::default());
+    std::io::copy(&mut input, &mut encoder)?;
+    encoder.finish()?.sync_all()?;
+    std::fs::remove_file(path)?;
+    Ok(())
+}
+
+/// Rotated files for a service, newest first. A plain and gzipped copy of the
+/// same rotation (mid-compression) count once, as the plain file.
+fn rotated_files(dir: &Path, process: &str) -> Vec<PathBuf> {
+    let prefix = format!("{}.", process);
+    let Ok(entries) = std::fs::read_dir(dir) else {
+        return Vec::new();
+    };
+    let mut files: Vec<(String, PathBuf)> = entries
+        .filter_map(|entry| entry.ok())
+        .filter_map(|entry| {
+            let name = entry.file_name().into_string().ok()?;
+            let stem = name.strip_suffix(".gz").unwrap_or(&name);
+            let stamp = stem.strip_prefix(&prefix)?.strip_suffix(".log")?;
+            let is_rotation = stamp.len() >= ROTATED_STAMP_LEN
+                && stamp.chars().all(|c| c.is_ascii_digit() || c == '-' || c == '.');
+            is_rotation.then(|| (stem.to_string(), entry.path()))
+        })
+        .collect();
+    files.sort_by(|a, b| b.0.cmp(&a.0).then_with(|| a.1.cmp(&b.1)));
+    files.dedup_by(|later, earlier| later.0 == earlier.0);
+    files.into_iter().map(|(_, path)| path).collect()
+}
+
+/// Delete all but the newest `keep` rotated files for a service
+fn prune(dir: &Path, process: &str, keep: usize) {
+    for path in rotated_files(dir, process).into_iter().skip(keep) {
+        let _ = std::fs::remove_file(gz_path(&path));
+        if let Err(e) = std::fs::remove_file(&path) {
+            if e.kind() != std::io::ErrorKind::NotFound {
+                warn!("Failed to remove old log file {:?}: {}", path, e);
+            }
+        }
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::logs::LogLevel;
+    use std::io::Read;
+    use tempfile::TempDir;
+
+    fn config(max_size_mb: u64, keep: usize, compress: bool) -> LogFilesConfig {
+        LogFilesConfig {
+            dir: None,
+            max_size_mb,
+            max_age: None,
+            keep,
+            compress,
+        }
+    }
+
+    fn entry(process: &str, message: &str) -> LogEntry {
+        LogEntry::new(process, "prod", LogLevel::Stdout, message.to_string())
+    }
+
+    /// Wait for background pruning to settle on `count` rotated files
+    fn wait_for_rotations(dir: &Path, process: &str, count: usize) -> Vec<PathBuf> {
+        for _ in 0..100 {
+            let files = rotated_files(dir, process);
+            if files.len() == count {
+                return files;
+            }
+            std::thread::sleep(Duration::from_millis(20));
+        }
+        rotated_files(dir, process)
+    }
+
+    // ===================
+    // WRITING
+    // ===================
+
+    #[test]
+    fn test_each_service_gets_its_own_file() {
+        let dir = TempDir::new().unwrap();
+        let files = LogFiles::new(dir.path(), &config(10, 5, false));
+
+        files.append(&entry("api", "hello"));
+        files.append(&LogEntry::new("api", "canary", LogLevel::Stderr, "oops".to_string()));
+        files.append(&entry("web", "started"));
+
+        let api = std::fs::read_to_string(dir.path().join("api.log")).unwrap();
+        let lines: Vec<&str> = api.lines().collect();
+        assert_eq!(lines.len(), 2);
+        assert!(lines[0].ends_with(" prod stdout hello"), "{}", lines[0]);
+        assert!(lines[1].ends_with(" canary stderr oops"), "{}", lines[1]);
+        assert!(lines[0].contains('T') && lines[0].split(' ').next().unwrap().ends_with('Z'));
+        let web = std::fs::read_to_string(dir.path().join("web.log")).unwrap();
+        assert!(web.ends_with(" prod stdout started\n"));
+    }
+
+    #[test]
+    fn test_appends_to_existing_file() {
+        let dir = TempDir::new().unwrap();
+        std::fs::write(dir.path().join("api.log"), "earlier\n").unwrap();
+        let files = LogFiles::new(dir.path(), &config(10, 5, false));
+
+        files.append(&entry("api", "later"));
+
+        let api = std::fs::read_to_string(dir.path().join("api.log")).unwrap();
+        assert!(api.starts_with("earlier\n"));
+        assert!(api.ends_with(" prod stdout later\n"));
+    }
+
+    #[test]
+    fn test_unwritable_dir_does_not_panic() {
+        let dir = TempDir::new().unwrap();
+        let blocker = dir.path().join("not-a-dir");
+        std::fs::write(&blocker, "").unwrap();
+        let files = LogFiles::new(&blocker, &config(10, 5, false));
+
+        files.append(&entry("api", "lost"));
+        files.append(&entry("api", "also lost"));
+        assert!(files.state.lock().unwrap().failing.contains("api"));
+    }
+
+    // ===================
+    // ROTATION
+    // ===================
+
+    #[test]
+    fn test_rotates_by_size_and_prunes() {
+        let dir = TempDir::new().unwrap();
+        let files = LogFiles::new(dir.path(), &config(1, 2, false));
+        let line = "x".repeat(400 * 1024);
+
+        // Each pair of lines overflows 1MB, so rotations happen on lines 3, 5, 7
+        for _ in 0..8 {
+            files.append(&entry("api", &line));
+        }
+
+        let rotated = wait_for_rotations(dir.path(), "api", 2);
+        assert_eq!(rotated.len(), 2, "{:?}", rotated);
+        for path in &rotated {
+            let size = std::fs::metadata(path).unwrap().len();
+            assert!(size <= 1024 * 1024, "{:?} is {} bytes", path, size);
+        }
+        assert!(rotated[0].file_name() > rotated[1].file_name(), "newest first");
+        let live = std::fs::metadata(dir.path().join("api.log")).unwrap().len();
+        assert!(live > 0 && live <= 1024 * 1024);
+    }
+
+    #[test]
+    fn test_rotated_files_are_compressed() {
+        let dir = TempDir::new().unwrap();
+        let files = LogFiles::new(dir.path(), &config(1, 5, true));
+        let line = "y".repeat(600 * 1024);
+
+        files.append(&entry("api", &line));
+        files.append(&entry("api", &line));
+
+        let mut gz = None;
+        for _ in 0..100 {
+            gz = std::fs::read_dir(dir.path())
+                .unwrap()
+                .filter_map(|e| e.ok())
+                .map(|e| e.path())
+                .find(|p| p.to_string_lossy().ends_with(".log.gz"));
+            if gz.as_ref().is_some_and(|gz| !gz.with_extension("").exists()) {
+                break;
+            }
+            std::thread::sleep(Duration::from_millis(20));
+        }
+        let gz = gz.expect("rotated file was compressed");
+        let mut text = String::new();
+        flate2::read::GzDecoder::new(File::open(&gz).unwrap())
+            .read_to_string(&mut text)
+            .unwrap();
+        assert!(text.ends_with(&format!(" prod stdout {}\n", line)));
+        assert!(!gz.with_extension("").exists(), "plain copy removed after compressing");
+    }
+
+    #[test]
+    fn test_rotates_by_age() {
+        let dir = TempDir::new().unwrap();
+        let mut cfg = config(10, 5, false);
+        cfg.max_age = Some(1);
+        let files = LogFiles::new(dir.path(), &cfg);
+
+        files.append(&entry("api", "first"));
+        files.state.lock().unwrap().open.get_mut("api").unwrap().opened =
+            SystemTime::now() - Duration::from_secs(5);
+        files.append(&entry("api", "second"));
+
+        let rotated = wait_for_rotations(dir.path(), "api", 1);
+        assert_eq!(rotated.len(), 1);
+        let old = std::fs::read_to_string(&rotated[0]).unwrap();
+        assert!(old.ends_with(" prod stdout first\n"));
+        let live = std::fs::read_to_string(dir.path().join("api.log")).unwrap();
+        assert!(live.ends_with(" prod stdout second\n") && !live.contains("first"));
+    }
+
+    #[test]
+    fn test_rotated_files_ignore_other_services() {
+        let dir = TempDir::new().unwrap();
+        for name in [
+            "api.log",
+            "api.20261014-120000.000.log",
+            "api.20261014-130000.000.log.gz",
+            "api.20261014-130000.000.log",
+            "api.v2.log",
+            "api-worker.20261014-120000.000.log",
+        ] {
+            std::fs::write(dir.path().join(name), "").unwrap();
+        }
+
+        let names: Vec<String> = rotated_files(dir.path(), "api")
+            .iter()
+            .map(|p| p.file_name().unwrap().to_string_lossy().into_owned())
+            .collect();
+        assert_eq!(names, ["api.20261014-130000.000.log", "api.20261014-120000.000.log"]);
+
+        prune(dir.path(), "api", 1);
+        assert!(!dir.path().join("api.20261014-120000.000.log").exists());
+        assert!(dir.path().join("api.20261014-130000.000.log").exists());
+        assert!(dir.path().join("api.v2.log").exists());
+        assert!(dir.path().join("api-worker.20261014-120000.000.log").exists());
+    }
+}
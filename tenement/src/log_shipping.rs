@@ -0,0 +1,871 @@
+//! Log shipping (`[[settings.log_sinks]]`, `[[service.x.log_sinks]]`)
+//!
+//! Service output is forwarded to remote collectors: a syslog server (RFC 5424
+//! over UDP, or octet-counted over TCP), Grafana Loki's push API, or any HTTP
+//! endpoint taking NDJSON. Sinks in `[settings]` get every service's output;
+//! a service's own get just its.
+//!
+//! Each sink has a queue and a task that sends entries in batches of
+//! `batch_size`, or every `flush_interval`. A batch the collector doesn't take
+//! is written to `{data_dir}/log-sinks/{sink}/` and retried with backoff, and
+//! until the buffer is empty newer batches queue up behind it, so entries
+//! survive collector downtime (and restarts) and arrive in order. The buffer
+//! holds `buffer_mb`; past that the oldest batches are dropped. Apps never wait
+//! on a sink: when its queue is full, entries are dropped and counted. On
+//! shutdown each sink sends (or buffers) what it has queued. Sinks follow the
+//! config read at startup.
+
+use crate::config::{Config, LogSinkConfig, LogSinkKind};
+use crate::logs::{LogEntry, LogLevel};
+use anyhow::{Context, Result};
+use serde_json::{json, Value};
+use std::collections::{BTreeMap, HashMap, VecDeque};
+use std::path::{Path, PathBuf};
+use std::sync::atomic::{AtomicU64, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+use tokio::io::AsyncWriteExt;
+use tokio::sync::{mpsc, watch};
+use tokio::task::JoinHandle;
+use tracing::{info, warn};
+
+/// Directory under the data dir holding each sink's unsent batches
+pub const BUFFER_DIR_NAME: &str = "log-sinks";
+
+/// Entries waiting in a sink's queue; more are dropped
+const QUEUE_CAPACITY: usize = 10_000;
+
+/// Longest wait between retries of a failing sink
+const MAX_BACKOFF: Duration = Duration::from_secs(60);
+
+/// Limit on each request or connection to a collector
+const SEND_TIMEOUT: Duration = Duration::from_secs(10);
+
+/// Syslog facility of every message (1 = user-level)
+const SYSLOG_FACILITY: u8 = 1;
+
+/// Forwards service output to the configured sinks
+pub struct LogShipper {
+    /// Sinks for every service
+    global: Vec<SinkQueue>,
+    /// Sinks of single services, by service
+    services: HashMap<String, Vec<SinkQueue>>,
+    /// Set on shutdown, for the workers to send what they have left
+    closing: watch::Sender<bool>,
+    workers: Mutex<Vec<JoinHandle<()>>>,
+}
+
+/// The sending side of a sink's queue
+struct SinkQueue {
+    queue: mpsc::Sender<LogEntry>,
+    /// Entries dropped on a full queue since the sink last reported it
+    dropped: Arc<AtomicU64>,
+}
+
+impl SinkQueue {
+    fn send(&self, entry: &LogEntry) {
+        if self.queue.try_send(entry.clone()).is_err() {
+            self.dropped.fetch_add(1, Ordering::Relaxed);
+        }
+    }
+}
+
+impl LogShipper {
+    /// Start the sinks in `config`, if it has any. They run on the current
+    /// tokio runtime; without one nothing is shipped.
+    pub fn from_config(config: &Config) -> Option<Arc<Self>> {
+        let per_service = config.service.values().any(|s| !s.log_sinks.is_empty());
+        if config.settings.log_sinks.is_empty() && !per_service {
+            return None;
+        }
+        let Ok(runtime) = tokio::runtime::Handle::try_current() else {
+            warn!("No async runtime for log sinks; service output won't be shipped");
+            return None;
+        };
+        let dir = config.settings.data_dir.join(BUFFER_DIR_NAME);
+        let (closing, closed) = watch::channel(false);
+        let workers = Mutex::new(Vec::new());
+        let start = |sink: &LogSinkConfig, name: String| {
+            let (queue, worker) = start_sink(&runtime, sink, name, &dir, closed.clone());
+            workers.lock().unwrap().push(worker);
+            queue
+        };
+        let global = config
+            .settings
+            .log_sinks
+            .iter()
+            .map(|sink| start(sink, sink.name()))
+            .collect();
+        let services = config
+            .service
+            .iter()
+            .filter(|(_, service)| !service.log_sinks.is_empty())
+            .map(|(service_name, service)| {
+                let sinks = service
+                    .log_sinks
+                    .iter()
+                    .map(|sink| start(sink, format!("{}.{}", service_name, sink.name())))
+                    .collect();
+                (service_name.clone(), sinks)
+            })
+            .collect();
+        Some(Arc::new(Self {
+            global,
+            services,
+            closing,
+            workers,
+        }))
+    }
+
+    /// Queue an entry for every service's sinks and its own. Never waits.
+    pub fn ship(&self, entry: &LogEntry) {
+        let own = self.services.get(&entry.process).into_iter().flatten();
+        for sink in self.global.iter().chain(own) {
+            sink.send(entry);
+        }
+    }
+
+    /// Have every sink send what it has queued, buffering what doesn't go,
+    /// and wait up to `timeout` for them. Nothing is shipped after.
+    pub async fn flush(&self, timeout: Duration) {
+        self.closing.send_replace(true);
+        let workers = std::mem::take(&mut *self.workers.lock().unwrap());
+        let finished = async {
+            for worker in workers {
+                worker.await.ok();
+            }
+        };
+        if tokio::time::timeout(timeout, finished).await.is_err() {
+            warn!("Log sinks didn't finish sending within {:?}", timeout);
+        }
+    }
+}
+
+fn start_sink(
+    runtime: &tokio::runtime::Handle,
+    config: &LogSinkConfig,
+    name: String,
+    dir: &Path,
+    closing: watch::Receiver<bool>,
+) -> (SinkQueue, JoinHandle<()>) {
+    let (queue, entries) = mpsc::channel(QUEUE_CAPACITY);
+    let dropped = Arc::new(AtomicU64::new(0));
+    let buffer_dir = dir.join(&name);
+    let max_bytes = config.buffer_mb.saturating_mul(1024 * 1024);
+    let sink = Sink::new(config);
+    let (batch_size, interval) = (config.batch_size, config.flush_interval());
+    let worker_dropped = dropped.clone();
+    let worker = runtime.spawn(async move {
+        let buffer = match max_bytes {
+            0 => None,
+            _ => open_buffer(&name, buffer_dir, max_bytes).await,
+        };
+        let worker = Worker::new(name, sink, buffer, worker_dropped);
+        worker.run(entries, closing, batch_size, interval).await;
+    });
+    (SinkQueue { queue, dropped }, worker)
+}
+
+/// A sink's disk buffer, opened on a blocking thread; None if it can't be
+async fn open_buffer(name: &str, dir: PathBuf, max_bytes: u64) -> Option<Buffer> {
+    let open = tokio::task::spawn_blocking(move || Buffer::open(dir, max_bytes));
+    let opened = open.await.map_err(anyhow::Error::from);
+    match opened.and_then(|buffer| buffer) {
+        Ok(buffer) => Some(buffer),
+        Err(e) => {
+            warn!("Log sink {} can't buffer on disk: {:#}", name, e);
+            None
+        }
+    }
+}
+
+/// Sends one sink's batches, buffering the ones that fail
+struct Worker {
+    name: String,
+    sink: Sink,
+    /// None when batches that fail are dropped. Only touched off the async
+    /// runtime (see [`Worker::on_disk`]).
+    buffer: Option<Arc<Mutex<Buffer>>>,
+    dropped: Arc<AtomicU64>,
+    /// When buffered batches may next be retried
+    retry_at: Instant,
+    backoff: Duration,
+    failing: bool,
+}
+
+impl Worker {
+    fn new(name: String, sink: Sink, buffer: Option<Buffer>, dropped: Arc<AtomicU64>) -> Self {
+        Self {
+            name,
+            sink,
+            buffer: buffer.map(|buffer| Arc::new(Mutex::new(buffer))),
+            dropped,
+            retry_at: Instant::now(),
+            backoff: Duration::ZERO,
+            failing: false,
+        }
+    }
+
+    /// Batch and send entries until every queue sender is gone or `closing`
+    /// is set, then send what's left
+    async fn run(
+        mut self,
+        mut entries: mpsc::Receiver<LogEntry>,
+        mut closing: watch::Receiver<bool>,
+        batch_size: usize,
+        interval: Duration,
+    ) {
+        let mut batch = Vec::new();
+        let mut tick = tokio::time::interval(interval);
+        loop {
+            let done = tokio::select! {
+                entry = entries.recv() => match entry {
+                    Some(entry) => {
+                        batch.push(entry);
+                        if batch.len() < batch_size {
+                            continue;
+                        }
+                        false
+                    }
+                    None => true,
+                },
+                _ = tick.tick() => false,
+                _ = closing.wait_for(|closing| *closing) => {
+                    entries.close();
+                    while let Ok(entry) = entries.try_recv() {
+                        batch.push(entry);
+                    }
+                    true
+                }
+            };
+            self.retry().await;
+            for chunk in batch.chunks(batch_size.max(1)) {
+                let payload = self.sink.encode(chunk);
+                self.deliver(payload).await;
+            }
+            batch.clear();
+            let dropped = self.dropped.swap(0, Ordering::Relaxed);
+            if dropped > 0 {
+                warn!(
+                    "Log sink {} dropped {} entries: its queue was full",
+                    self.name, dropped
+                );
+            }
+            if done {
+                break;
+            }
+        }
+    }
+
+    /// Send a batch, unless older ones are still waiting; buffer it if it
+    /// isn't sent
+    async fn deliver(&mut self, payload: Vec<u8>) {
+        let waiting = self
+            .buffer
+            .as_ref()
+            .is_some_and(|b| !b.lock().unwrap().is_empty());
+        if !waiting {
+            match self.sink.send(&payload).await {
+                Ok(()) => return self.succeeded(),
+                Err(e) => self.failed(&e),
+            }
+        }
+        match self.on_disk(move |buffer| buffer.push(&payload)).await {
+            None | Some(Ok(0)) => {}
+            Some(Ok(evicted)) => warn!(
+                "Log sink {} buffer is full; dropped its {} oldest batches",
+                self.name, evicted
+            ),
+            Some(Err(e)) => warn!("Log sink {} couldn't buffer a batch: {:#}", self.name, e),
+        }
+    }
+
+    /// Send buffered batches, oldest first, until one fails
+    async fn retry(&mut self) {
+        if Instant::now() < self.retry_at {
+            return;
+        }
+        loop {
+            let payload = match self.on_disk(|buffer| buffer.front()).await.flatten() {
+                None => return,
+                Some(Ok(payload)) => payload,
+                Some(Err(e)) => {
+                    warn!(
+                        "Log sink {} dropped an unreadable batch: {:#}",
+                        self.name, e
+                    );
+                    self.on_disk(Buffer::pop).await;
+                    continue;
+                }
+            };
+            match self.sink.send(&payload).await {
+                Ok(()) => {
+                    self.on_disk(Buffer::pop).await;
+                    self.succeeded();
+                }
+                Err(e) => return self.failed(&e),
+            }
+        }
+    }
+
+    /// Run `f` on the disk buffer on a blocking thread; None without one
+    async fn on_disk<T, F>(&self, f: F) -> Option<T>
+    where
+        T: Send + 'static,
+        F: FnOnce(&mut Buffer) -> T + Send + 'static,
+    {
+        let buffer = self.buffer.clone()?;
+        let task = tokio::task::spawn_blocking(move || f(&mut buffer.lock().unwrap()));
+        match task.await {
+            Ok(result) => Some(result),
+            Err(e) => {
+                warn!("Log sink {} buffer failed: {}", self.name, e);
+                None
+            }
+        }
+    }
+
+    fn succeeded(&mut self) {
+        if std::mem::replace(&mut self.failing, false) {
+            info!("Log sink {} is sending again", self.name);
+        }
+        self.backoff = Duration::ZERO;
+    }
+
+    fn failed(&mut self, e: &anyhow::Error) {
+        if !std::mem::replace(&mut self.failing, true) {
+            warn!("Log sink {} failed to send: {:#}", self.name, e);
+        }
+        self.backoff = (self.backoff * 2).clamp(Duration::from_secs(1), MAX_BACKOFF);
+        self.retry_at = Instant::now() + self.backoff;
+    }
+}
+
+/// Unsent batches on disk, a file each, named by sequence number
+struct Buffer {
+    dir: PathBuf,
+    max_bytes: u64,
+    /// Oldest first, with their sizes
+    files: VecDeque<(PathBuf, u64)>,
+    bytes: u64,
+    next: u64,
+}
+
+impl Buffer {
+    /// The buffer in `dir`, with the batches a previous run left there
+    fn open(dir: PathBuf, max_bytes: u64) -> Result<Self> {
+        std::fs::create_dir_all(&dir)
+            .with_context(|| format!("Failed to create {}", dir.display()))?;
+        let mut found = Vec::new();
+        for entry in std::fs::read_dir(&dir)? {
+            let entry = entry?;
+            let path = entry.path();
+            let seq = path
+                .file_name()
+                .and_then(|name| name.to_str())
+                .and_then(|name| name.strip_suffix(".batch"))
+                .and_then(|seq| seq.parse::<u64>().ok());
+            if let Some(seq) = seq {
+                found.push((seq, path, entry.metadata()?.len()));
+            }
+        }
+        found.sort();
+        let next = found.last().map_or(0, |(seq, _, _)| seq + 1);
+        let bytes = found.iter().map(|(_, _, len)| len).sum();
+        let files = found
+            .into_iter()
+            .map(|(_, path, len)| (path, len))
+            .collect();
+        Ok(Self {
+            dir,
+            max_bytes,
+            files,
+            bytes,
+            next,
+        })
+    }
+
+    fn is_empty(&self) -> bool {
+        self.files.is_empty()
+    }
+
+    /// Add a batch, then drop the oldest until they fit again (keeping this
+    /// one); how many were dropped
+    fn push(&mut self, payload: &[u8]) -> Result<usize> {
+        let path = self.dir.join(format!("{:020}.batch", self.next));
+        let partial = path.with_extension("tmp");
+        std::fs::write(&partial, payload)
+            .with_context(|| format!("Failed to write {}", partial.display()))?;
+        std::fs::rename(&partial, &path)?;
+        self.next += 1;
+        self.files.push_back((path, payload.len() as u64));
+        self.bytes += payload.len() as u64;
+        let mut dropped = 0;
+        while self.bytes > self.max_bytes && self.files.len() > 1 {
+            self.pop();
+            dropped += 1;
+        }
+        Ok(dropped)
+    }
+
+    /// The oldest batch
+    fn front(&self) -> Option<Result<Vec<u8>>> {
+        let (path, _) = self.files.front()?;
+        Some(std::fs::read(path).with_context(|| format!("Failed to read {}", path.display())))
+    }
+
+    /// Remove the oldest batch
+    fn pop(&mut self) {
+        if let Some((path, len)) = self.files.pop_front() {
+            std::fs::remove_file(&path).ok();
+            self.bytes -= len;
+        }
+    }
+}
+
+/// How a sink encodes batches, and where it sends them
+struct Sink {
+    kind: LogSinkKind,
+    labels: BTreeMap<String, String>,
+    hostname: String,
+    target: Target,
+}
+
+enum Target {
+    Udp(String),
+    /// Connected on first use, and again after a failure
+    Tcp {
+        addr: String,
+        conn: Option<tokio::net::TcpStream>,
+    },
+    Http {
+        client: reqwest::Client,
+        url: String,
+        headers: Vec<(String, String)>,
+    },
+}
+
+impl Sink {
+    fn new(config: &LogSinkConfig) -> Self {
+        let http = |url: String| Target::Http {
+            client: reqwest::Client::builder()
+                .timeout(SEND_TIMEOUT)
+                .build()
+                .unwrap_or_default(),
+            url,
+            headers: config
+                .headers
+                .iter()
+                .map(|(name, value)| (name.clone(), value.clone()))
+                .collect(),
+        };
+        let target = match config.kind {
+            LogSinkKind::Syslog => match config.url.split_once("://") {
+                Some(("tcp", addr)) => Target::Tcp {
+                    addr: addr.to_string(),
+                    conn: None,
+                },
+                Some((_, addr)) => Target::Udp(addr.to_string()),
+                None => Target::Udp(config.url.clone()),
+            },
+            LogSinkKind::Loki => http(format!(
+                "{}/loki/api/v1/push",
+                config.url.trim_end_matches('/')
+            )),
+            LogSinkKind::Http => http(config.url.clone()),
+        };
+        Self {
+            kind: config.kind,
+            labels: config.labels.clone(),
+            hostname: hostname(),
+            target,
+        }
+    }
+
+    /// A batch as sent: syslog messages a line each, a Loki push request, or
+    /// NDJSON
+    fn encode(&self, batch: &[LogEntry]) -> Vec<u8> {
+        match self.kind {
+            LogSinkKind::Syslog => batch
+                .iter()
+                .map(|entry| syslog_message(entry, &self.hostname))
+                .collect::<Vec<_>>()
+                .join("\n")
+                .into_bytes(),
+            LogSinkKind::Loki => loki_push(batch, &self.labels).to_string().into_bytes(),
+            LogSinkKind::Http => ndjson(batch, &self.labels).into_bytes(),
+        }
+    }
+
+    async fn send(&mut self, payload: &[u8]) -> Result<()> {
+        let kind = self.kind;
+        match &mut self.target {
+            Target::Udp(addr) => {
+                let target = tokio::net::lookup_host(addr.as_str())
+                    .await?
+                    .next()
+                    .with_context(|| format!("{} didn't resolve", addr))?;
+                let local = match target.is_ipv4() {
+                    true => "0.0.0.0:0",
+                    false => "[::]:0",
+                };
+                let socket = tokio::net::UdpSocket::bind(local).await?;
+                for message in payload.split(|&b| b == b'\n') {
+                    socket.send_to(message, target).await?;
+                }
+            }
+            Target::Tcp { addr, conn } => {
+                let mut framed = Vec::new();
+                for message in payload.split(|&b| b == b'\n') {
+                    framed.extend_from_slice(format!("{} ", message.len()).as_bytes());
+                    framed.extend_from_slice(message);
+                }
+                if conn.is_none() {
+                    let connect = tokio::net::TcpStream::connect(addr.as_str());
+                    let stream = tokio::time::timeout(SEND_TIMEOUT, connect)
+                        .await
+                        .with_context(|| format!("Timed out connecting to {}", addr))?
+                        .with_context(|| format!("Failed to connect to {}", addr))?;
+                    *conn = Some(stream);
+                }
+                let stream = conn.as_mut().expect("connected above");
+                let written = tokio::time::timeout(SEND_TIMEOUT, stream.write_all(&framed)).await;
+                if !matches!(written, Ok(Ok(()))) {
+                    *conn = None;
+                    anyhow::bail!("Failed to write to {}", addr);
+                }
+            }
+            Target::Http {
+                client,
+                url,
+                headers,
+            } => {
+                let content_type = match kind {
+                    LogSinkKind::Loki => "application/json",
+                    _ => "application/x-ndjson",
+                };
+                let mut request = client
+                    .post(url.as_str())
+                    .header("content-type", content_type)
+                    .body(payload.to_vec());
+                for (name, value) in headers.iter() {
+                    request = request.header(name, value);
+                }
+                request.send().await?.error_for_status()?;
+            }
+        }
+        Ok(())
+    }
+}
+
+fn timestamp(entry: &LogEntry) -> String {
+    chrono::DateTime::from_timestamp_millis(entry.timestamp as i64)
+        .unwrap_or_default()
+        .to_rfc3339_opts(chrono::SecondsFormat::Millis, true)
+}
+
+/// An RFC 5424 message: the service as APP-NAME, the instance as PROCID and
+/// the stream as MSGID. Stderr is `err`, stdout `info`.
+fn syslog_message(entry: &LogEntry, hostname: &str) -> String {
+    let severity = match entry.level {
+        LogLevel::Stdout => 6,
+        LogLevel::Stderr => 3,
+    };
+    format!(
+        "<{}>1 {} {} {} {} {} - {}",
+        SYSLOG_FACILITY * 8 + severity,
+        timestamp(entry),
+        hostname,
+        header_field(&entry.process, 48),
+        header_field(&entry.instance_id, 128),
+        entry.level,
+        entry.message
+    )
+}
+
+/// A syslog header field: printable ASCII without spaces, at most `max`
+/// characters, or "-" when that leaves nothing
+fn header_field(value: &str, max: usize) -> String {
+    let field: String = value
+        .chars()
+        .filter(|c| c.is_ascii_graphic())
+        .take(max)
+        .collect();
+    match field.is_empty() {
+        true => "-".to_string(),
+        false => field,
+    }
+}
+
+/// A Loki push request, with a stream per service, instance and output stream
+fn loki_push(batch: &[LogEntry], labels: &BTreeMap<String, String>) -> Value {
+    let mut streams: BTreeMap<(&str, &str, String), Vec<Value>> = BTreeMap::new();
+    for entry in batch {
+        let key = (
+            entry.process.as_str(),
+            entry.instance_id.as_str(),
+            entry.level.to_string(),
+        );
+        let nanos = (entry.timestamp as u128 * 1_000_000).to_string();
+        streams
+            .entry(key)
+            .or_default()
+            .push(json!([nanos, entry.message]));
+    }
+    let streams: Vec<Value> = streams
+        .into_iter()
+        .map(|((app, instance, level), values)| {
+            let mut stream = labels.clone();
+            stream.insert("app".to_string(), app.to_string());
+            stream.insert("instance".to_string(), instance.to_string());
+            stream.insert("stream".to_string(), level);
+            json!({ "stream": stream, "values": values })
+        })
+        .collect();
+    json!({ "streams": streams })
+}
+
+/// A JSON object per line, with the labels as extra fields
+fn ndjson(batch: &[LogEntry], labels: &BTreeMap<String, String>) -> String {
+    let mut out = String::new();
+    for entry in batch {
+        let mut line: serde_json::Map<String, Value> = labels
+            .iter()
+            .map(|(name, value)| (name.clone(), Value::from(value.as_str())))
+            .collect();
+        line.insert("timestamp".to_string(), timestamp(entry).into());
+        line.insert("app".to_string(), entry.process.as_str().into());
+        line.insert("instance".to_string(), entry.instance_id.as_str().into());
+        line.insert("stream".to_string(), entry.level.to_string().into());
+        line.insert("message".to_string(), entry.message.as_str().into());
+        out.push_str(&Value::Object(line).to_string());
+        out.push('\n');
+    }
+    out
+}
+
+/// This machine's name, for syslog's HOSTNAME
+fn hostname() -> String {
+    #[cfg(unix)]
+    {
+        let mut buf = [0u8; 256];
+        if unsafe { libc::gethostname(buf.as_mut_ptr().cast(), buf.len()) } == 0 {
+            let len = buf.iter().position(|&b| b == 0).unwrap_or(buf.len());
+            return header_field(&String::from_utf8_lossy(&buf[..len]), 255);
+        }
+    }
+    let name = std::env::var("COMPUTERNAME").unwrap_or_default();
+    header_field(&name, 255)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn entry(process: &str, instance: &str, level: LogLevel, message: &str) -> LogEntry {
+        LogEntry {
+            timestamp: 1_700_000_000_123,
+            level,
+            process: process.to_string(),
+            instance_id: instance.to_string(),
+            message: message.to_string(),
+        }
+    }
+
+    fn sink(url: &str) -> LogSinkConfig {
+        let kind = match url.split_once("://") {
+            Some(("udp" | "tcp", _)) => "syslog",
+            _ => "http",
+        };
+        toml::from_str(&format!("type = \"{}\"\nurl = \"{}\"\n", kind, url)).unwrap()
+    }
+
+    // ===================
+    // Encoding
+    // ===================
+
+    #[test]
+    fn test_syslog_message() {
+        let message = syslog_message(&entry("api", "prod", LogLevel::Stderr, "boom"), "host1");
+        assert_eq!(
+            message,
+            "<11>1 2023-11-14T22:13:20.123Z host1 api prod stderr - boom"
+        );
+        let message = syslog_message(&entry("my app", "", LogLevel::Stdout, "ok"), "-");
+        assert!(message.starts_with("<14>1 "), "{}", message);
+        assert!(message.ends_with(" - myapp - stdout - ok"), "{}", message);
+    }
+
+    #[test]
+    fn test_loki_push_groups_streams() {
+        let batch = [
+            entry("api", "prod", LogLevel::Stdout, "one"),
+            entry("api", "prod", LogLevel::Stderr, "two"),
+            entry("api", "prod", LogLevel::Stdout, "three"),
+        ];
+        let labels = BTreeMap::from([("env".to_string(), "production".to_string())]);
+        let push = loki_push(&batch, &labels);
+        let streams = push["streams"].as_array().unwrap();
+        assert_eq!(streams.len(), 2);
+        assert_eq!(streams[0]["stream"]["app"], "api");
+        assert_eq!(streams[0]["stream"]["stream"], "stdout");
+        assert_eq!(streams[0]["stream"]["env"], "production");
+        assert_eq!(
+            streams[0]["values"],
+            json!([
+                ["1700000000123000000", "one"],
+                ["1700000000123000000", "three"]
+            ])
+        );
+        assert_eq!(streams[1]["values"][0][1], "two");
+    }
+
+    #[test]
+    fn test_ndjson() {
+        let batch = [
+            entry("api", "prod", LogLevel::Stdout, "hello \"world\""),
+            entry("web", "1", LogLevel::Stderr, "bye"),
+        ];
+        let labels = BTreeMap::from([("region".to_string(), "eu".to_string())]);
+        let body = ndjson(&batch, &labels);
+        let lines: Vec<Value> = body
+            .lines()
+            .map(|line| serde_json::from_str(line).unwrap())
+            .collect();
+        assert_eq!(lines.len(), 2);
+        assert_eq!(lines[0]["message"], "hello \"world\"");
+        assert_eq!(lines[0]["timestamp"], "2023-11-14T22:13:20.123Z");
+        assert_eq!(lines[0]["region"], "eu");
+        assert_eq!(lines[1]["app"], "web");
+        assert_eq!(lines[1]["stream"], "stderr");
+    }
+
+    // ===================
+    // Disk buffer
+    // ===================
+
+    #[test]
+    fn test_buffer_keeps_batches_in_order_and_evicts_oldest() {
+        let dir = tempfile::tempdir().unwrap();
+        let path = dir.path().join("loki");
+        let mut buffer = Buffer::open(path.clone(), 10).unwrap();
+        assert!(buffer.is_empty());
+        assert_eq!(buffer.push(b"aaaa").unwrap(), 0);
+        assert_eq!(buffer.push(b"bbbb").unwrap(), 0);
+        // Past 10 bytes the oldest goes
+        assert_eq!(buffer.push(b"cccc").unwrap(), 1);
+        assert_eq!(buffer.front().unwrap().unwrap(), b"bbbb");
+
+        // A new run picks up where this one left off
+        let mut reopened = Buffer::open(path, 10).unwrap();
+        assert_eq!(reopened.front().unwrap().unwrap(), b"bbbb");
+        reopened.pop();
+        assert_eq!(reopened.front().unwrap().unwrap(), b"cccc");
+        reopened.push(b"dd").unwrap();
+        reopened.pop();
+        assert_eq!(reopened.front().unwrap().unwrap(), b"dd");
+    }
+
+    // ===================
+    // Sending
+    // ===================
+
+    #[tokio::test]
+    async fn test_udp_syslog_sends_a_datagram_per_entry() {
+        let server = tokio::net::UdpSocket::bind("127.0.0.1:0").await.unwrap();
+        let url = format!("udp://{}", server.local_addr().unwrap());
+        let mut sink = Sink::new(&sink(&url));
+        let batch = [
+            entry("api", "prod", LogLevel::Stdout, "first"),
+            entry("api", "prod", LogLevel::Stdout, "second"),
+        ];
+        sink.send(&sink.encode(&batch)).await.unwrap();
+
+        let mut buf = [0u8; 1024];
+        for expected in ["first", "second"] {
+            let (n, _) = server.recv_from(&mut buf).await.unwrap();
+            let message = std::str::from_utf8(&buf[..n]).unwrap();
+            assert!(
+                message.ends_with(&format!(" - {}", expected)),
+                "{}",
+                message
+            );
+        }
+    }
+
+    #[tokio::test]
+    async fn test_failed_batches_are_buffered_and_retried_in_order() {
+        use tokio::io::AsyncReadExt;
+
+        // Nothing listens on the port at first
+        let addr = std::net::TcpListener::bind("127.0.0.1:0")
+            .unwrap()
+            .local_addr()
+            .unwrap();
+        let dir = tempfile::tempdir().unwrap();
+        let buffer = Buffer::open(dir.path().join("syslog"), 1024 * 1024).unwrap();
+        let sink = Sink::new(&sink(&format!("tcp://{}", addr)));
+        let mut worker = Worker::new("syslog".into(), sink, Some(buffer), Arc::default());
+
+        for message in ["one", "two"] {
+            let batch = [entry("api", "prod", LogLevel::Stdout, message)];
+            let payload = worker.sink.encode(&batch);
+            worker.deliver(payload).await;
+        }
+        assert!(worker.failing);
+        let buffer = worker.buffer.clone().unwrap();
+        assert_eq!(buffer.lock().unwrap().files.len(), 2);
+
+        // The collector comes back
+        let listener = tokio::net::TcpListener::bind(addr).await.unwrap();
+        worker.retry_at = Instant::now();
+        worker.retry().await;
+        assert!(!worker.failing);
+        assert!(buffer.lock().unwrap().is_empty());
+
+        let (mut conn, _) = listener.accept().await.unwrap();
+        drop(worker);
+        let mut received = String::new();
+        conn.read_to_string(&mut received).await.unwrap();
+        let one = received.find(" - one").unwrap();
+        let two = received.find(" - two").unwrap();
+        assert!(one < two, "{}", received);
+        // Octet-counted framing
+        assert!(received.split_once(' ').unwrap().0.parse::<usize>().is_ok());
+    }
+
+    #[tokio::test]
+    async fn test_queued_entries_are_sent_on_shutdown() {
+        let server = tokio::net::UdpSocket::bind("127.0.0.1:0").await.unwrap();
+        let url = format!("udp://{}", server.local_addr().unwrap());
+        let worker = Worker::new(
+            "syslog".into(),
+            Sink::new(&sink(&url)),
+            None,
+            Arc::default(),
+        );
+        let (queue, entries) = mpsc::channel(QUEUE_CAPACITY);
+        let (closing, closed) = watch::channel(false);
+        for message in ["one", "two", "three"] {
+            let entry = entry("api", "prod", LogLevel::Stdout, message);
+            queue.send(entry).await.unwrap();
+        }
+
+        // Neither a full batch nor a flush is due before shutdown
+        let run = tokio::spawn(worker.run(entries, closed, 100, Duration::from_secs(3600)));
+        closing.send_replace(true);
+        run.await.unwrap();
+
+        let mut buf = [0u8; 1024];
+        for expected in ["one", "two", "three"] {
+            let (n, _) = server.recv_from(&mut buf).await.unwrap();
+            let message = std::str::from_utf8(&buf[..n]).unwrap();
+            assert!(
+                message.ends_with(&format!(" - {}", expected)),
+                "{}",
+                message
+            );
+        }
+        assert!(queue.is_closed());
+    }
+}
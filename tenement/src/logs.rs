@@ -5,13 +5,16 @@
 
 use serde::Serialize;
 use std::collections::VecDeque;
-use std::sync::Arc;
-use std::time::{SystemTime, UNIX_EPOCH};
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant, SystemTime, UNIX_EPOCH};
 use tokio::sync::{broadcast, RwLock};
 
 /// Default capacity for the ring buffer (per instance)
 const DEFAULT_BUFFER_CAPACITY: usize = 10_000;
 
+/// Minimum time between "lines dropped" summaries for a rate-limited app
+pub const DROP_SUMMARY_INTERVAL: Duration = Duration::from_secs(5);
+
 /// Log level
 #[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
 #[serde(rename_all = "lowercase")]
@@ -30,7 +33,7 @@ impl std::fmt::Display for LogLevel {
 }
 
 /// A single log entry
-#[derive(Debug, Clone, Serialize)]
+#[derive(Debug, Clone, PartialEq, Serialize)]
 pub struct LogEntry {
     /// Unix timestamp in milliseconds
     pub timestamp: u64,
@@ -75,6 +78,40 @@ pub struct LogQuery {
     pub limit: Option<usize>,
     /// Text search (simple substring match)
     pub search: Option<String>,
+    /// Only entries at or after this Unix timestamp (milliseconds)
+    pub since: Option<u64>,
+}
+
+impl LogQuery {
+    /// Whether an entry passes every filter (the limit aside)
+    pub fn matches(&self, entry: &LogEntry) -> bool {
+        if let Some(ref p) = self.process {
+            if &entry.process != p {
+                return false;
+            }
+        }
+        if let Some(ref id) = self.instance_id {
+            if &entry.instance_id != id {
+                return false;
+            }
+        }
+        if let Some(level) = self.level {
+            if entry.level != level {
+                return false;
+            }
+        }
+        if let Some(ref search) = self.search {
+            if !entry.message.contains(search) {
+                return false;
+            }
+        }
+        if let Some(since) = self.since {
+            if entry.timestamp < since {
+                return false;
+            }
+        }
+        true
+    }
 }
 
 /// Ring buffer for log entries
@@ -103,33 +140,7 @@ impl RingBuffer {
         let mut results: Vec<LogEntry> = self
             .entries
             .iter()
-            .filter(|e| {
-                // Filter by process
-                if let Some(ref p) = query.process {
-                    if &e.process != p {
-                        return false;
-                    }
-                }
-                // Filter by instance_id
-                if let Some(ref id) = query.instance_id {
-                    if &e.instance_id != id {
-                        return false;
-                    }
-                }
-                // Filter by level
-                if let Some(level) = query.level {
-                    if e.level != level {
-                        return false;
-                    }
-                }
-                // Filter by search text
-                if let Some(ref search) = query.search {
-                    if !e.message.contains(search) {
-                        return false;
-                    }
-                }
-                true
-            })
+            .filter(|e| query.matches(e))
             .cloned()
             .collect();
 
@@ -148,6 +159,87 @@ impl RingBuffer {
     }
 }
 
+/// Outcome of offering one line to a [`LogRateLimiter`]
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum LogAdmit {
+    /// Keep the line. `dropped` > 0 means a summary of that many dropped lines is due.
+    Keep { dropped: u64 },
+    /// Over the limit; the line is counted and discarded
+    Drop,
+}
+
+/// Per-app log line limit (`log_rate_limit` lines per second, token bucket with a
+/// one-second burst). Shared by all of an app's instances and both streams.
+#[derive(Debug)]
+pub struct LogRateLimiter {
+    rate: u32,
+    state: Mutex<LimiterState>,
+}
+
+#[derive(Debug)]
+struct LimiterState {
+    tokens: f64,
+    last_refill: Instant,
+    dropped: u64,
+    last_summary: Instant,
+}
+
+impl LogRateLimiter {
+    pub fn new(rate: u32) -> Arc<Self> {
+        let rate = rate.max(1);
+        let now = Instant::now();
+        Arc::new(Self {
+            rate,
+            state: Mutex::new(LimiterState {
+                tokens: rate as f64,
+                last_refill: now,
+                dropped: 0,
+                last_summary: now,
+            }),
+        })
+    }
+
+    /// Lines per second allowed
+    pub fn rate(&self) -> u32 {
+        self.rate
+    }
+
+    /// Offer a line now
+    pub fn check(&self) -> LogAdmit {
+        self.check_at(Instant::now())
+    }
+
+    /// Offer a line at a given time (for tests)
+    pub fn check_at(&self, now: Instant) -> LogAdmit {
+        let mut state = self.state.lock().unwrap();
+        let elapsed = now.saturating_duration_since(state.last_refill).as_secs_f64();
+        state.tokens = (state.tokens + elapsed * self.rate as f64).min(self.rate as f64);
+        state.last_refill = now;
+
+        if state.tokens < 1.0 {
+            state.dropped += 1;
+            return LogAdmit::Drop;
+        }
+        state.tokens -= 1.0;
+
+        let due = now.saturating_duration_since(state.last_summary) >= DROP_SUMMARY_INTERVAL;
+        if state.dropped > 0 && due {
+            state.last_summary = now;
+            return LogAdmit::Keep {
+                dropped: std::mem::take(&mut state.dropped),
+            };
+        }
+        LogAdmit::Keep { dropped: 0 }
+    }
+
+    /// Take the count of dropped lines not yet reported (e.g. when a stream ends)
+    pub fn take_dropped(&self) -> u64 {
+        let mut state = self.state.lock().unwrap();
+        state.last_summary = Instant::now();
+        std::mem::take(&mut state.dropped)
+    }
+}
+
 /// Log buffer with broadcast channel for streaming
 pub struct LogBuffer {
     buffer: RwLock<RingBuffer>,
@@ -193,6 +285,45 @@ impl LogBuffer {
         self.push(entry).await;
     }
 
+    /// Push an entry subject to its app's rate limit. Dropped lines are reported
+    /// in a stderr summary entry ahead of the next kept line, at most once per
+    /// [`DROP_SUMMARY_INTERVAL`]. Returns whether the entry was kept.
+    pub async fn push_limited(&self, limiter: &LogRateLimiter, entry: LogEntry) -> bool {
+        match limiter.check() {
+            LogAdmit::Drop => return false,
+            LogAdmit::Keep { dropped: 0 } => {}
+            LogAdmit::Keep { dropped } => {
+                self.push_drop_summary(limiter, &entry.process, &entry.instance_id, dropped).await;
+            }
+        }
+        self.push(entry).await;
+        true
+    }
+
+    /// Report any dropped lines still pending (call when an instance's output ends)
+    pub async fn flush_dropped(&self, limiter: &LogRateLimiter, process: &str, instance_id: &str) {
+        let dropped = limiter.take_dropped();
+        if dropped > 0 {
+            self.push_drop_summary(limiter, process, instance_id, dropped).await;
+        }
+    }
+
+    async fn push_drop_summary(
+        &self,
+        limiter: &LogRateLimiter,
+        process: &str,
+        instance_id: &str,
+        dropped: u64,
+    ) {
+        let message = format!(
+            "[tenement] {} log lines dropped for {} (log_rate_limit = {}/s)",
+            dropped,
+            process,
+            limiter.rate()
+        );
+        self.push_stderr(process, instance_id, message).await;
+    }
+
     /// Query logs with filters
     pub async fn query(&self, query: &LogQuery) -> Vec<LogEntry> {
         let buffer = self.buffer.read().await;
@@ -671,6 +802,30 @@ mod tests {
     // SEARCH TESTS
     // ===================
 
+    #[test]
+    fn test_ring_buffer_query_since() {
+        let mut buffer = RingBuffer::new(10);
+        for (timestamp, message) in [(1_000, "old"), (2_000, "edge"), (3_000, "new")] {
+            let mut entry = LogEntry::new("api", "prod", LogLevel::Stdout, message.to_string());
+            entry.timestamp = timestamp;
+            buffer.push(entry);
+        }
+
+        let query = LogQuery {
+            since: Some(2_000),
+            ..Default::default()
+        };
+        let messages: Vec<String> = buffer.query(&query).into_iter().map(|e| e.message).collect();
+        assert_eq!(messages, ["edge", "new"]);
+
+        let query = LogQuery {
+            since: Some(2_000),
+            limit: Some(1),
+            ..Default::default()
+        };
+        assert_eq!(buffer.query(&query)[0].message, "new");
+    }
+
     #[test]
     fn test_ring_buffer_query_search() {
         let mut buffer = RingBuffer::new(10);
@@ -902,6 +1057,7 @@ mod tests {
             level: Some(LogLevel::Stderr),
             limit: Some(100),
             search: Some("error".to_string()),
+            since: None,
         };
         let cloned = query.clone();
 
@@ -921,4 +1077,85 @@ mod tests {
         let debug = format!("{:?}", query);
         assert!(debug.contains("api"));
     }
+
+    // ===================
+    // RATE LIMIT TESTS
+    // ===================
+
+    #[test]
+    fn test_rate_limiter_burst_then_refill() {
+        let limiter = LogRateLimiter::new(10);
+        let start = Instant::now();
+
+        let kept = (0..100)
+            .filter(|_| limiter.check_at(start) != LogAdmit::Drop)
+            .count();
+        assert_eq!(kept, 10);
+
+        // Half a second refills half the bucket
+        let later = start + Duration::from_millis(500);
+        let kept = (0..100)
+            .filter(|_| limiter.check_at(later) != LogAdmit::Drop)
+            .count();
+        assert_eq!(kept, 5);
+    }
+
+    #[test]
+    fn test_rate_limiter_reports_dropped_once_per_interval() {
+        let limiter = LogRateLimiter::new(10);
+        let start = Instant::now();
+        for _ in 0..50 {
+            limiter.check_at(start);
+        }
+
+        // Kept lines before the summary interval don't carry the count yet
+        let soon = start + Duration::from_secs(1);
+        assert_eq!(limiter.check_at(soon), LogAdmit::Keep { dropped: 0 });
+
+        let due = start + DROP_SUMMARY_INTERVAL;
+        assert_eq!(limiter.check_at(due), LogAdmit::Keep { dropped: 40 });
+        assert_eq!(limiter.check_at(due), LogAdmit::Keep { dropped: 0 });
+        assert_eq!(limiter.take_dropped(), 0);
+    }
+
+    #[tokio::test]
+    async fn test_push_limited_high_rate() {
+        let buffer = LogBuffer::with_capacity(100_000);
+        let limiter = LogRateLimiter::new(100);
+
+        let mut admitted = 0;
+        for i in 0..10_000 {
+            let entry = LogEntry::new("chatty", "1", LogLevel::Stdout, format!("line {}", i));
+            if buffer.push_limited(&limiter, entry).await {
+                admitted += 1;
+            }
+        }
+        buffer.flush_dropped(&limiter, "chatty", "1").await;
+
+        let entries = buffer.query(&LogQuery::default()).await;
+        let kept = entries.iter().filter(|e| e.level == LogLevel::Stdout).count();
+        assert_eq!(admitted, kept, "push_limited reports what it kept");
+        // One second's burst, plus whatever refilled while the loop ran
+        assert!((100..200).contains(&kept), "kept {}", kept);
+
+        let summary = entries.last().unwrap();
+        assert_eq!(summary.level, LogLevel::Stderr);
+        assert_eq!(
+            summary.message,
+            format!(
+                "[tenement] {} log lines dropped for chatty (log_rate_limit = 100/s)",
+                10_000 - kept
+            )
+        );
+    }
+
+    #[tokio::test]
+    async fn test_flush_dropped_noop_when_nothing_dropped() {
+        let buffer = LogBuffer::new();
+        let limiter = LogRateLimiter::new(100);
+        let entry = LogEntry::new("api", "1", LogLevel::Stdout, "hi".to_string());
+        buffer.push_limited(&limiter, entry).await;
+        buffer.flush_dropped(&limiter, "api", "1").await;
+        assert_eq!(buffer.len().await, 1);
+    }
 }
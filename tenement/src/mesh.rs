@@ -0,0 +1,353 @@
+//! App-to-app private networking
+//!
+//! A service lists the services it connects to as `uses = ["db-proxy", "cache"]`.
+//! For each service someone uses, tenement listens on
+//! `{data_dir}/mesh/{service}.sock` and gives its users the path in
+//! `TENEMENT_UPSTREAM_{SERVICE}` (e.g. `TENEMENT_UPSTREAM_CACHE`).
+//!
+//! Each connection's peer credentials name the connecting process. tenement
+//! follows its parents up to an instance it started, and accepts only if that
+//! instance's service declared the use. Accepted connections are spliced byte
+//! for byte to a running instance of the service (picked by its
+//! `load_balance`), so any protocol works. Peer credentials need Linux;
+//! elsewhere no sockets are made. The listeners follow the config read at
+//! startup.
+//!
+//! The check only holds if the used service can't be reached some other way.
+//! Its own socket is made owner-only unless `unix_socket` says otherwise, but
+//! a TCP port on loopback is open to every local user, so a used service
+//! that listens on a port gets a warning at startup.
+
+use anyhow::{Context, Result};
+use std::collections::{BTreeMap, BTreeSet, HashMap};
+use std::path::{Path, PathBuf};
+
+use crate::config::Config;
+use crate::instance::InstanceId;
+
+/// Directory under the data dir holding the private sockets
+pub const MESH_DIR_NAME: &str = "mesh";
+
+/// Parents followed from a connecting process before giving up
+const MAX_ANCESTORS: usize = 64;
+
+/// Where the private socket of `service` lives
+pub fn socket_path(data_dir: &Path, service: &str) -> PathBuf {
+    data_dir
+        .join(MESH_DIR_NAME)
+        .join(format!("{}.sock", service))
+}
+
+/// The variable holding a used service's socket, e.g. "db-proxy" ->
+/// "TENEMENT_UPSTREAM_DB_PROXY"
+pub fn env_var(service: &str) -> String {
+    let name: String = service
+        .chars()
+        .map(|c| match c.is_ascii_alphanumeric() {
+            true => c.to_ascii_uppercase(),
+            false => '_',
+        })
+        .collect();
+    format!("TENEMENT_UPSTREAM_{}", name)
+}
+
+/// The services allowed to connect to each used service
+pub fn consumers(config: &Config) -> BTreeMap<String, BTreeSet<String>> {
+    let mut consumers: BTreeMap<String, BTreeSet<String>> = BTreeMap::new();
+    for (name, service) in &config.service {
+        for used in &service.uses {
+            consumers
+                .entry(used.clone())
+                .or_default()
+                .insert(name.clone());
+        }
+    }
+    consumers
+}
+
+/// The parent of a process, from /proc
+#[cfg(target_os = "linux")]
+pub fn parent_pid(pid: u32) -> Option<u32> {
+    // The command name can contain spaces, so fields are counted after its ')'
+    let stat = std::fs::read_to_string(format!("/proc/{}/stat", pid)).ok()?;
+    let ppid = stat.rsplit_once(')')?.1.split_whitespace().nth(1)?;
+    ppid.parse().ok().filter(|&ppid| ppid != 0)
+}
+
+/// The parent of a process, from /proc
+#[cfg(not(target_os = "linux"))]
+pub fn parent_pid(_pid: u32) -> Option<u32> {
+    None
+}
+
+/// The instance `pid` is, or was started by, following `parent` upwards
+pub fn owning_instance(
+    pid: u32,
+    instances: &HashMap<u32, InstanceId>,
+    parent: impl Fn(u32) -> Option<u32>,
+) -> Option<InstanceId> {
+    let mut pid = pid;
+    for _ in 0..MAX_ANCESTORS {
+        if let Some(id) = instances.get(&pid) {
+            return Some(id.clone());
+        }
+        pid = parent(pid)?;
+    }
+    None
+}
+
+/// Whether a connection from `pid` may reach `service`; the error says why not
+pub fn authorize(
+    service: &str,
+    allowed: &BTreeSet<String>,
+    pid: u32,
+    instances: &HashMap<u32, InstanceId>,
+    parent: impl Fn(u32) -> Option<u32>,
+) -> Result<InstanceId> {
+    let id = owning_instance(pid, instances, parent)
+        .with_context(|| format!("pid {} isn't a tenement instance", pid))?;
+    if !allowed.contains(&id.process) {
+        anyhow::bail!("{} doesn't declare uses = [\"{}\"]", id, service);
+    }
+    Ok(id)
+}
+
+#[cfg(target_os = "linux")]
+pub use listener::spawn_listeners;
+
+/// Without peer credentials there's nothing to enforce with
+#[cfg(not(target_os = "linux"))]
+pub fn spawn_listeners(
+    _hypervisor: std::sync::Arc<crate::Hypervisor>,
+) -> Result<Vec<tokio::task::JoinHandle<()>>> {
+    Ok(Vec::new())
+}
+
+#[cfg(target_os = "linux")]
+mod listener {
+    use super::*;
+    use crate::Hypervisor;
+    use std::os::unix::fs::PermissionsExt;
+    use std::sync::Arc;
+    use tokio::net::{TcpStream, UnixListener, UnixStream};
+
+    /// Listen on the private socket of every used service
+    pub fn spawn_listeners(
+        hypervisor: Arc<Hypervisor>,
+    ) -> Result<Vec<tokio::task::JoinHandle<()>>> {
+        let config = hypervisor.config();
+        let consumers = consumers(&config);
+        if consumers.is_empty() {
+            return Ok(Vec::new());
+        }
+        let dir = config.settings.data_dir.join(MESH_DIR_NAME);
+        std::fs::create_dir_all(&dir)
+            .with_context(|| format!("Failed to create {}", dir.display()))?;
+        std::fs::set_permissions(&dir, std::fs::Permissions::from_mode(0o755))?;
+
+        let mut handles = Vec::new();
+        for (service, allowed) in consumers {
+            let tcp = config
+                .service
+                .get(&service)
+                .is_some_and(|svc| svc.isolation.uses_tcp_port());
+            if tcp {
+                tracing::warn!(
+                    "{} listens on a TCP port any local user can reach; only its \
+                     private socket checks `uses`",
+                    service
+                );
+            }
+            let path = socket_path(&config.settings.data_dir, &service);
+            crate::sockets::clear_stale_socket(&path)?;
+            let listener = UnixListener::bind(&path)
+                .with_context(|| format!("Failed to listen on {}", path.display()))?;
+            // Anyone may connect; peer credentials decide who gets through
+            std::fs::set_permissions(&path, std::fs::Permissions::from_mode(0o666))?;
+            tracing::info!("Private socket for {} at {}", service, path.display());
+            let hypervisor = hypervisor.clone();
+            handles.push(tokio::spawn(async move {
+                accept_loop(hypervisor, service, allowed, listener).await;
+            }));
+        }
+        Ok(handles)
+    }
+
+    async fn accept_loop(
+        hypervisor: Arc<Hypervisor>,
+        service: String,
+        allowed: BTreeSet<String>,
+        listener: UnixListener,
+    ) {
+        let mut backoff = crate::sockets::AcceptBackoff::default();
+        loop {
+            let conn = match listener.accept().await {
+                Ok((conn, _)) => conn,
+                Err(e) => {
+                    tracing::warn!("Private socket for {}: accept failed: {}", service, e);
+                    backoff.failed().await;
+                    continue;
+                }
+            };
+            backoff.succeeded();
+            let (hypervisor, service, allowed) =
+                (hypervisor.clone(), service.clone(), allowed.clone());
+            tokio::spawn(async move {
+                if let Err(e) = handle(&hypervisor, &service, &allowed, conn).await {
+                    tracing::warn!("Private connection to {} refused: {:#}", service, e);
+                }
+            });
+        }
+    }
+
+    /// Check who's connecting, then splice them to an instance of `service`
+    async fn handle(
+        hypervisor: &Hypervisor,
+        service: &str,
+        allowed: &BTreeSet<String>,
+        mut conn: UnixStream,
+    ) -> Result<()> {
+        let pid = conn.peer_cred()?.pid().context("no peer pid")?;
+        let consumer = authorize(
+            service,
+            allowed,
+            pid as u32,
+            &hypervisor.instance_pids().await,
+            parent_pid,
+        )?;
+        let target = hypervisor
+            .select_instance(service)
+            .await
+            .with_context(|| format!("no instance of {} is running", service))?;
+        tracing::debug!("Private connection {} -> {}", consumer, target.id);
+
+        let _guard = hypervisor
+            .connection_start(&target.id.process, &target.id.id)
+            .await;
+        hypervisor
+            .touch_activity(&target.id.process, &target.id.id)
+            .await;
+        // Either side hanging up ends the splice; that's no error
+        match target.port {
+            Some(port) => {
+                let mut upstream = TcpStream::connect(("127.0.0.1", port)).await?;
+                tokio::io::copy_bidirectional(&mut conn, &mut upstream)
+                    .await
+                    .ok();
+            }
+            None => {
+                let mut upstream = UnixStream::connect(&target.socket).await?;
+                tokio::io::copy_bidirectional(&mut conn, &mut upstream)
+                    .await
+                    .ok();
+            }
+        }
+        Ok(())
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn instances() -> HashMap<u32, InstanceId> {
+        let mut instances = HashMap::new();
+        instances.insert(100, InstanceId::new("api", "prod"));
+        instances.insert(200, InstanceId::new("worker", "main"));
+        instances
+    }
+
+    /// 101 and 102 are children of api:prod, 500 of nothing tenement started
+    fn parent(pid: u32) -> Option<u32> {
+        match pid {
+            101 => Some(100),
+            102 => Some(101),
+            100 | 200 | 500 => Some(1),
+            _ => None,
+        }
+    }
+
+    // ===================
+    // Names
+    // ===================
+
+    #[test]
+    fn test_names() {
+        assert_eq!(env_var("cache"), "TENEMENT_UPSTREAM_CACHE");
+        assert_eq!(env_var("db-proxy"), "TENEMENT_UPSTREAM_DB_PROXY");
+        assert_eq!(
+            socket_path(Path::new("/var/lib/tenement"), "cache"),
+            PathBuf::from("/var/lib/tenement/mesh/cache.sock")
+        );
+    }
+
+    #[test]
+    fn test_consumers() {
+        let config = Config::from_str(
+            r#"
+[service.api]
+command = "./api"
+uses = ["cache", "db-proxy"]
+
+[service.worker]
+command = "./worker"
+uses = ["cache"]
+
+[service.cache]
+command = "./cache"
+
+[service.db-proxy]
+command = "./db-proxy"
+"#,
+        )
+        .unwrap();
+        let consumers = consumers(&config);
+        assert_eq!(consumers.len(), 2);
+        let cache: Vec<_> = consumers["cache"].iter().map(String::as_str).collect();
+        assert_eq!(cache, vec!["api", "worker"]);
+        let db: Vec<_> = consumers["db-proxy"].iter().map(String::as_str).collect();
+        assert_eq!(db, vec!["api"]);
+    }
+
+    // ===================
+    // Peer checks
+    // ===================
+
+    #[test]
+    fn test_owning_instance_follows_parents() {
+        let instances = instances();
+        let api = Some(InstanceId::new("api", "prod"));
+        assert_eq!(owning_instance(100, &instances, parent), api);
+        assert_eq!(owning_instance(102, &instances, parent), api);
+        assert_eq!(owning_instance(500, &instances, parent), None);
+        assert_eq!(owning_instance(999, &instances, parent), None);
+        // A loop in the parents ends
+        assert_eq!(owning_instance(7, &instances, |_| Some(7)), None);
+    }
+
+    #[test]
+    fn test_authorize() {
+        let instances = instances();
+        let allowed: BTreeSet<String> = ["api".to_string()].into();
+        let id = authorize("cache", &allowed, 102, &instances, parent).unwrap();
+        assert_eq!(id, InstanceId::new("api", "prod"));
+
+        let err = authorize("cache", &allowed, 200, &instances, parent).unwrap_err();
+        assert!(err.to_string().contains("doesn't declare uses"), "{}", err);
+        let err = authorize("cache", &allowed, 500, &instances, parent).unwrap_err();
+        assert!(
+            err.to_string().contains("isn't a tenement instance"),
+            "{}",
+            err
+        );
+    }
+
+    #[cfg(target_os = "linux")]
+    #[test]
+    fn test_parent_pid() {
+        let me = std::process::id();
+        let parent = parent_pid(me).unwrap();
+        assert_ne!(parent, me);
+        assert_eq!(parent_pid(u32::MAX), None);
+    }
+}
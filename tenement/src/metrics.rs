@@ -2,9 +2,11 @@
 //!
 //! Simple in-memory metrics with Prometheus text format export.
 
-use std::collections::HashMap;
+use serde::{Deserialize, Serialize};
+use std::collections::{BTreeMap, HashMap};
 use std::sync::atomic::{AtomicU64, Ordering};
 use std::sync::Arc;
+use std::time::Duration;
 use tokio::sync::RwLock;
 
 /// A counter metric (monotonically increasing)
@@ -129,6 +131,16 @@ impl Histogram {
     pub fn buckets(&self) -> &[f64] {
         &self.buckets
     }
+
+    /// Observations per bucket, followed by those above every bound
+    pub fn counts(&self) -> Vec<u64> {
+        let mut counts: Vec<u64> = (0..self.buckets.len())
+            .map(|i| self.get_bucket(i))
+            .collect();
+        let bounded: u64 = counts.iter().sum();
+        counts.push(self.get_count().saturating_sub(bounded));
+        counts
+    }
 }
 
 impl Default for Histogram {
@@ -176,6 +188,24 @@ impl LabeledCounter {
         let counters = self.counters.read().await;
         counters.iter().map(|(k, v)| (k.clone(), v.get())).collect()
     }
+
+    /// Sum of all counters
+    pub async fn total(&self) -> u64 {
+        let counters = self.counters.read().await;
+        counters.values().map(|c| c.get()).sum()
+    }
+
+    /// Sum counters grouped by one label's value (e.g. per "process")
+    pub async fn totals_by(&self, label: &str) -> BTreeMap<String, u64> {
+        let counters = self.counters.read().await;
+        let mut totals = BTreeMap::new();
+        for (key, counter) in counters.iter() {
+            if let Some(value) = key_to_labels(key).remove(label) {
+                *totals.entry(value).or_insert(0) += counter.get();
+            }
+        }
+        totals
+    }
 }
 
 /// A labeled gauge (gauge per label combination)
@@ -227,6 +257,8 @@ impl LabeledGauge {
 #[derive(Debug, Default)]
 pub struct LabeledHistogram {
     histograms: RwLock<HashMap<String, Arc<Histogram>>>,
+    /// Custom bucket boundaries (None = default latency buckets)
+    buckets: Option<Vec<f64>>,
 }
 
 impl LabeledHistogram {
@@ -234,6 +266,14 @@ impl LabeledHistogram {
         Self::default()
     }
 
+    /// Create a labeled histogram whose children use custom bucket boundaries
+    pub fn with_buckets(buckets: Vec<f64>) -> Self {
+        Self {
+            histograms: RwLock::new(HashMap::new()),
+            buckets: Some(buckets),
+        }
+    }
+
     pub async fn with_labels(&self, labels: &Labels) -> Arc<Histogram> {
         let key = labels_to_key(labels);
 
@@ -247,7 +287,10 @@ impl LabeledHistogram {
         let mut histograms = self.histograms.write().await;
         histograms
             .entry(key)
-            .or_insert_with(|| Arc::new(Histogram::new()))
+            .or_insert_with(|| match &self.buckets {
+                Some(buckets) => Arc::new(Histogram::with_buckets(buckets.clone())),
+                None => Arc::new(Histogram::new()),
+            })
             .clone()
     }
 
@@ -258,6 +301,54 @@ impl LabeledHistogram {
             .map(|(k, v)| (k.clone(), v.clone()))
             .collect()
     }
+
+    /// Bucket bounds of its histograms
+    pub fn bounds(&self) -> Vec<f64> {
+        match &self.buckets {
+            Some(buckets) => buckets.clone(),
+            None => Histogram::new().buckets().to_vec(),
+        }
+    }
+
+    /// [`Histogram::counts`] summed over every histogram whose `label` is `value`
+    pub async fn counts_where(&self, label: &str, value: &str) -> Vec<u64> {
+        let histograms = self.histograms.read().await;
+        let mut totals = vec![0; self.bounds().len() + 1];
+        for (key, histogram) in histograms.iter() {
+            if key_to_labels(key).get(label).map(String::as_str) != Some(value) {
+                continue;
+            }
+            for (total, n) in totals.iter_mut().zip(histogram.counts()) {
+                *total += n;
+            }
+        }
+        totals
+    }
+}
+
+/// The `q` quantile (0.0-1.0) of what was observed between two `counts`
+/// snapshots, as the bound of the bucket it falls in (the highest bound when
+/// it's above them all). None if nothing was observed in between.
+pub fn quantile_between(bounds: &[f64], before: &[u64], after: &[u64], q: f64) -> Option<f64> {
+    let observed: Vec<u64> = after
+        .iter()
+        .enumerate()
+        .map(|(i, n)| n.saturating_sub(before.get(i).copied().unwrap_or(0)))
+        .collect();
+    let total: u64 = observed.iter().sum();
+    if total == 0 {
+        return None;
+    }
+    let rank = ((q * total as f64).ceil() as u64).max(1);
+    let mut seen = 0;
+    let bucket = observed.iter().position(|n| {
+        seen += n;
+        seen >= rank
+    });
+    bucket
+        .and_then(|i| bounds.get(i))
+        .or(bounds.last())
+        .copied()
 }
 
 /// Convert labels to a stable string key
@@ -272,7 +363,6 @@ fn labels_to_key(labels: &Labels) -> String {
 }
 
 /// Parse a label key back to labels
-#[allow(dead_code)]
 fn key_to_labels(key: &str) -> Labels {
     if key.is_empty() {
         return HashMap::new();
@@ -291,8 +381,27 @@ fn key_to_labels(key: &str) -> Labels {
 pub struct Metrics {
     /// Total HTTP requests
     pub requests_total: LabeledCounter,
+    /// Proxied requests that ended in a 5xx response
+    pub request_errors_total: LabeledCounter,
+    /// Proxied responses by status code
+    pub responses_total: LabeledCounter,
     /// Request duration in milliseconds
     pub request_duration_ms: LabeledHistogram,
+    /// Routed requests that finished but took longer than the route's `slo_target_ms`
+    pub requests_slow_total: LabeledCounter,
+    /// Proxied requests turned away with 429 by a service's `rate_limit`
+    pub requests_rate_limited_total: LabeledCounter,
+    /// Proxied requests retried on another attempt after a 502/503/504
+    pub requests_retried_total: LabeledCounter,
+    /// Proxied GET requests looked up in a service's response cache, by
+    /// result ("hit" or "miss")
+    pub cache_lookups_total: LabeledCounter,
+    /// Circuit breakers opening and closing, by instance
+    pub circuit_breaker_transitions_total: LabeledCounter,
+    /// Finished gRPC calls by service, method and `grpc-status` code
+    pub grpc_requests_total: LabeledCounter,
+    /// gRPC call duration in milliseconds, to the end of the response stream
+    pub grpc_request_duration_ms: LabeledHistogram,
     /// Number of running instances
     pub instances_up: Gauge,
     /// Total instance restarts
@@ -304,18 +413,37 @@ pub struct Metrics {
     /// Storage usage ratio (0-10000, divide by 10000 to get 0.0-1.0)
     /// E.g., 2500 = 0.25 = 25% usage
     pub instance_storage_usage_ratio: LabeledGauge,
+    /// Time from launch to first ready in milliseconds per instance
+    pub instance_startup_duration_ms: LabeledHistogram,
+}
+
+/// Startup duration buckets in milliseconds (apps take far longer to boot than to serve)
+fn startup_buckets() -> Vec<f64> {
+    vec![
+        50.0, 100.0, 250.0, 500.0, 1000.0, 2500.0, 5000.0, 10000.0, 30000.0, 60000.0,
+    ]
 }
 
 impl Metrics {
     pub fn new() -> Arc<Self> {
         Arc::new(Self {
             requests_total: LabeledCounter::new(),
+            request_errors_total: LabeledCounter::new(),
+            responses_total: LabeledCounter::new(),
             request_duration_ms: LabeledHistogram::new(),
+            requests_slow_total: LabeledCounter::new(),
+            requests_rate_limited_total: LabeledCounter::new(),
+            requests_retried_total: LabeledCounter::new(),
+            cache_lookups_total: LabeledCounter::new(),
+            circuit_breaker_transitions_total: LabeledCounter::new(),
+            grpc_requests_total: LabeledCounter::new(),
+            grpc_request_duration_ms: LabeledHistogram::new(),
             instances_up: Gauge::new(),
             instance_restarts: LabeledCounter::new(),
             instance_storage_bytes: LabeledGauge::new(),
             instance_storage_quota_bytes: LabeledGauge::new(),
             instance_storage_usage_ratio: LabeledGauge::new(),
+            instance_startup_duration_ms: LabeledHistogram::with_buckets(startup_buckets()),
         })
     }
 
@@ -337,42 +465,155 @@ impl Metrics {
             }
         }
 
+        // tenement_request_errors_total
+        output.push_str(
+            "\n# HELP tenement_request_errors_total Proxied requests that returned a 5xx status\n",
+        );
+        output.push_str("# TYPE tenement_request_errors_total counter\n");
+        for (labels, value) in self.request_errors_total.all().await {
+            if labels.is_empty() {
+                output.push_str(&format!("tenement_request_errors_total {}\n", value));
+            } else {
+                output.push_str(&format!(
+                    "tenement_request_errors_total{{{}}} {}\n",
+                    labels, value
+                ));
+            }
+        }
+
+        // tenement_responses_total
+        output.push_str("\n# HELP tenement_responses_total Proxied responses by status code\n");
+        output.push_str("# TYPE tenement_responses_total counter\n");
+        for (labels, value) in self.responses_total.all().await {
+            if labels.is_empty() {
+                output.push_str(&format!("tenement_responses_total {}\n", value));
+            } else {
+                output.push_str(&format!(
+                    "tenement_responses_total{{{}}} {}\n",
+                    labels, value
+                ));
+            }
+        }
+
         // tenement_request_duration_ms
         output.push_str("\n# HELP tenement_request_duration_ms Request duration in milliseconds\n");
         output.push_str("# TYPE tenement_request_duration_ms histogram\n");
-        for (labels, histogram) in self.request_duration_ms.all().await {
-            let label_str = if labels.is_empty() {
-                String::new()
+        write_histogram(
+            &mut output,
+            "tenement_request_duration_ms",
+            self.request_duration_ms.all().await,
+        );
+
+        // tenement_requests_slow_total
+        output.push_str(
+            "\n# HELP tenement_requests_slow_total Routed requests over their SLO target\n",
+        );
+        output.push_str("# TYPE tenement_requests_slow_total counter\n");
+        for (labels, value) in self.requests_slow_total.all().await {
+            if labels.is_empty() {
+                output.push_str(&format!("tenement_requests_slow_total {}\n", value));
             } else {
-                format!("{},", labels)
-            };
+                output.push_str(&format!(
+                    "tenement_requests_slow_total{{{}}} {}\n",
+                    labels, value
+                ));
+            }
+        }
 
-            // Bucket counts (cumulative)
-            let mut cumulative = 0u64;
-            for (i, &bound) in histogram.buckets().iter().enumerate() {
-                cumulative += histogram.get_bucket(i);
+        // tenement_requests_rate_limited_total
+        output.push_str(
+            "\n# HELP tenement_requests_rate_limited_total Requests rejected by rate limits\n",
+        );
+        output.push_str("# TYPE tenement_requests_rate_limited_total counter\n");
+        for (labels, value) in self.requests_rate_limited_total.all().await {
+            if labels.is_empty() {
+                output.push_str(&format!("tenement_requests_rate_limited_total {}\n", value));
+            } else {
                 output.push_str(&format!(
-                    "tenement_request_duration_ms_bucket{{{}le=\"{}\"}} {}\n",
-                    label_str, bound, cumulative
+                    "tenement_requests_rate_limited_total{{{}}} {}\n",
+                    labels, value
+                ));
+            }
+        }
+
+        // tenement_requests_retried_total
+        output.push_str(
+            "\n# HELP tenement_requests_retried_total Requests retried after upstream failures\n",
+        );
+        output.push_str("# TYPE tenement_requests_retried_total counter\n");
+        for (labels, value) in self.requests_retried_total.all().await {
+            if labels.is_empty() {
+                output.push_str(&format!("tenement_requests_retried_total {}\n", value));
+            } else {
+                output.push_str(&format!(
+                    "tenement_requests_retried_total{{{}}} {}\n",
+                    labels, value
                 ));
             }
-            output.push_str(&format!(
-                "tenement_request_duration_ms_bucket{{{}le=\"+Inf\"}} {}\n",
-                label_str,
-                histogram.get_count()
-            ));
-            output.push_str(&format!(
-                "tenement_request_duration_ms_sum{{{}}} {}\n",
-                label_str.trim_end_matches(','),
-                histogram.get_sum()
-            ));
-            output.push_str(&format!(
-                "tenement_request_duration_ms_count{{{}}} {}\n",
-                label_str.trim_end_matches(','),
-                histogram.get_count()
-            ));
         }
 
+        // tenement_cache_lookups_total
+        output.push_str(
+            "\n# HELP tenement_cache_lookups_total Requests looked up in response caches\n",
+        );
+        output.push_str("# TYPE tenement_cache_lookups_total counter\n");
+        for (labels, value) in self.cache_lookups_total.all().await {
+            if labels.is_empty() {
+                output.push_str(&format!("tenement_cache_lookups_total {}\n", value));
+            } else {
+                output.push_str(&format!(
+                    "tenement_cache_lookups_total{{{}}} {}\n",
+                    labels, value
+                ));
+            }
+        }
+
+        // tenement_circuit_breaker_transitions_total
+        output.push_str(
+            "\n# HELP tenement_circuit_breaker_transitions_total Circuit breakers opened/closed\n",
+        );
+        output.push_str("# TYPE tenement_circuit_breaker_transitions_total counter\n");
+        for (labels, value) in self.circuit_breaker_transitions_total.all().await {
+            if labels.is_empty() {
+                output.push_str(&format!(
+                    "tenement_circuit_breaker_transitions_total {}\n",
+                    value
+                ));
+            } else {
+                output.push_str(&format!(
+                    "tenement_circuit_breaker_transitions_total{{{}}} {}\n",
+                    labels, value
+                ));
+            }
+        }
+
+        // tenement_grpc_requests_total
+        output.push_str(
+            "\n# HELP tenement_grpc_requests_total Finished gRPC calls by method and status\n",
+        );
+        output.push_str("# TYPE tenement_grpc_requests_total counter\n");
+        for (labels, value) in self.grpc_requests_total.all().await {
+            if labels.is_empty() {
+                output.push_str(&format!("tenement_grpc_requests_total {}\n", value));
+            } else {
+                output.push_str(&format!(
+                    "tenement_grpc_requests_total{{{}}} {}\n",
+                    labels, value
+                ));
+            }
+        }
+
+        // tenement_grpc_request_duration_ms
+        output.push_str(
+            "\n# HELP tenement_grpc_request_duration_ms gRPC call duration in milliseconds\n",
+        );
+        output.push_str("# TYPE tenement_grpc_request_duration_ms histogram\n");
+        write_histogram(
+            &mut output,
+            "tenement_grpc_request_duration_ms",
+            self.grpc_request_duration_ms.all().await,
+        );
+
         // tenement_instances_up
         output.push_str("\n# HELP tenement_instances_up Number of running instances\n");
         output.push_str("# TYPE tenement_instances_up gauge\n");
@@ -448,20 +689,255 @@ impl Metrics {
             }
         }
 
+        // tenement_instance_startup_duration_ms
+        output.push_str(
+            "\n# HELP tenement_instance_startup_duration_ms Time from launch to first ready in milliseconds\n",
+        );
+        output.push_str("# TYPE tenement_instance_startup_duration_ms histogram\n");
+        write_histogram(
+            &mut output,
+            "tenement_instance_startup_duration_ms",
+            self.instance_startup_duration_ms.all().await,
+        );
+
         output
     }
 }
 
+/// Append the bucket/sum/count series for a labeled histogram
+fn write_histogram(output: &mut String, name: &str, histograms: Vec<(String, Arc<Histogram>)>) {
+    for (labels, histogram) in histograms {
+        let label_str = if labels.is_empty() {
+            String::new()
+        } else {
+            format!("{},", labels)
+        };
+
+        // Bucket counts (cumulative)
+        let mut cumulative = 0u64;
+        for (i, &bound) in histogram.buckets().iter().enumerate() {
+            cumulative += histogram.get_bucket(i);
+            output.push_str(&format!(
+                "{}_bucket{{{}le=\"{}\"}} {}\n",
+                name, label_str, bound, cumulative
+            ));
+        }
+        output.push_str(&format!(
+            "{}_bucket{{{}le=\"+Inf\"}} {}\n",
+            name,
+            label_str,
+            histogram.get_count()
+        ));
+        output.push_str(&format!(
+            "{}_sum{{{}}} {}\n",
+            name,
+            label_str.trim_end_matches(','),
+            histogram.get_sum()
+        ));
+        output.push_str(&format!(
+            "{}_count{{{}}} {}\n",
+            name,
+            label_str.trim_end_matches(','),
+            histogram.get_count()
+        ));
+    }
+}
+
+/// Point-in-time readings for one running instance, taken at scrape time
+#[derive(Debug, Clone, PartialEq)]
+pub struct InstanceSample {
+    pub process: String,
+    /// Instance ID ("process:id"), matching the request metrics' `instance` label
+    pub instance: String,
+    pub uptime_secs: u64,
+    pub active_connections: u32,
+    /// Resident memory of the instance's main process (None if unknown)
+    pub memory_bytes: Option<u64>,
+    /// User + system CPU time of the instance's main process (None if unknown)
+    pub cpu_seconds: Option<f64>,
+    /// CPU use over the last sampling interval, in percent of one core
+    pub cpu_percent: Option<f64>,
+    pub threads: Option<u32>,
+    pub open_fds: Option<u32>,
+}
+
+/// Format instance samples as Prometheus gauges and counters
+pub fn format_instance_samples(samples: &[InstanceSample]) -> String {
+    type Reading = fn(&InstanceSample) -> Option<String>;
+    let series: [(&str, &str, &str, Reading); 7] = [
+        (
+            "tenement_instance_uptime_seconds",
+            "gauge",
+            "Seconds since the instance started",
+            |s| Some(s.uptime_secs.to_string()),
+        ),
+        (
+            "tenement_instance_active_connections",
+            "gauge",
+            "Requests currently being proxied to the instance",
+            |s| Some(s.active_connections.to_string()),
+        ),
+        (
+            "tenement_instance_memory_bytes",
+            "gauge",
+            "Resident memory of the instance process in bytes",
+            |s| s.memory_bytes.map(|v| v.to_string()),
+        ),
+        (
+            "tenement_instance_cpu_seconds_total",
+            "counter",
+            "CPU time used by the instance process in seconds",
+            |s| s.cpu_seconds.map(|v| format!("{:.2}", v)),
+        ),
+        (
+            "tenement_instance_cpu_percent",
+            "gauge",
+            "CPU use of the instance process over the last sample, in percent of one core",
+            |s| s.cpu_percent.map(|v| format!("{:.1}", v)),
+        ),
+        (
+            "tenement_instance_threads",
+            "gauge",
+            "Threads in the instance process",
+            |s| s.threads.map(|v| v.to_string()),
+        ),
+        (
+            "tenement_instance_open_fds",
+            "gauge",
+            "File descriptors the instance process has open",
+            |s| s.open_fds.map(|v| v.to_string()),
+        ),
+    ];
+
+    let mut output = String::new();
+    for (name, kind, help, reading) in series {
+        output.push_str(&format!("\n# HELP {} {}\n# TYPE {} {}\n", name, help, name, kind));
+        for sample in samples {
+            if let Some(value) = reading(sample) {
+                output.push_str(&format!(
+                    "{}{{instance=\"{}\",process=\"{}\"}} {}\n",
+                    name, sample.instance, sample.process, value
+                ));
+            }
+        }
+    }
+    output
+}
+
+/// Resource use of one process, as read from /proc
+#[derive(Debug, Clone, Copy, Default, PartialEq, Serialize, Deserialize)]
+pub struct ProcessUsage {
+    /// Resident memory in bytes
+    pub rss_bytes: u64,
+    /// User + system CPU time in seconds
+    pub cpu_seconds: f64,
+    /// CPU use since the previous reading, in percent of one core (None for a
+    /// first reading)
+    #[serde(default)]
+    pub cpu_percent: Option<f64>,
+    pub threads: u32,
+    /// Open file descriptors (None if /proc/<pid>/fd can't be read)
+    #[serde(default)]
+    pub open_fds: Option<u32>,
+}
+
+impl ProcessUsage {
+    /// This reading, with `cpu_percent` worked out from `earlier`, taken
+    /// `elapsed` before it
+    pub fn since(self, earlier: &ProcessUsage, elapsed: Duration) -> Self {
+        let secs = elapsed.as_secs_f64();
+        let used = (self.cpu_seconds - earlier.cpu_seconds).max(0.0);
+        let cpu_percent = (secs > 0.0).then(|| used / secs * 100.0);
+        Self {
+            cpu_percent,
+            ..self
+        }
+    }
+}
+
+/// Resident memory, CPU time, threads and open descriptors of a process, from /proc
+#[cfg(target_os = "linux")]
+pub fn process_usage(pid: u32) -> Option<ProcessUsage> {
+    let statm = std::fs::read_to_string(format!("/proc/{}/statm", pid)).ok()?;
+    let resident_pages: u64 = statm.split_whitespace().nth(1)?.parse().ok()?;
+
+    // The command name can contain spaces, so fields are counted after its ')'
+    let stat = std::fs::read_to_string(format!("/proc/{}/stat", pid)).ok()?;
+    let fields: Vec<&str> = stat.rsplit_once(')')?.1.split_whitespace().collect();
+    let utime: u64 = fields.get(11)?.parse().ok()?;
+    let stime: u64 = fields.get(12)?.parse().ok()?;
+    let threads: u32 = fields.get(17)?.parse().ok()?;
+
+    let page_size = unsafe { libc::sysconf(libc::_SC_PAGESIZE) };
+    let ticks = unsafe { libc::sysconf(libc::_SC_CLK_TCK) };
+    if page_size <= 0 || ticks <= 0 {
+        return None;
+    }
+    let open_fds = std::fs::read_dir(format!("/proc/{}/fd", pid))
+        .ok()
+        .map(|entries| entries.count() as u32);
+    Some(ProcessUsage {
+        rss_bytes: resident_pages * page_size as u64,
+        cpu_seconds: (utime + stime) as f64 / ticks as f64,
+        cpu_percent: None,
+        threads,
+        open_fds,
+    })
+}
+
+/// Resident memory, CPU time, threads and open descriptors of a process, from /proc
+#[cfg(not(target_os = "linux"))]
+pub fn process_usage(_pid: u32) -> Option<ProcessUsage> {
+    None
+}
+
+/// When a process started (to the second), from /proc
+#[cfg(target_os = "linux")]
+pub fn process_started_at(pid: u32) -> Option<chrono::DateTime<chrono::Utc>> {
+    let stat = std::fs::read_to_string(format!("/proc/{}/stat", pid)).ok()?;
+    let fields: Vec<&str> = stat.rsplit_once(')')?.1.split_whitespace().collect();
+    let start_ticks: i64 = fields.get(19)?.parse().ok()?;
+
+    let boot = std::fs::read_to_string("/proc/stat").ok()?;
+    let boot_secs: i64 = boot
+        .lines()
+        .find_map(|line| line.strip_prefix("btime "))?
+        .trim()
+        .parse()
+        .ok()?;
+    let ticks = unsafe { libc::sysconf(libc::_SC_CLK_TCK) };
+    if ticks <= 0 {
+        return None;
+    }
+    chrono::DateTime::from_timestamp(boot_secs + start_ticks / ticks as i64, 0)
+}
+
+/// When a process started (to the second), from /proc
+#[cfg(not(target_os = "linux"))]
+pub fn process_started_at(_pid: u32) -> Option<chrono::DateTime<chrono::Utc>> {
+    None
+}
+
 impl Default for Metrics {
     fn default() -> Self {
         Self {
             requests_total: LabeledCounter::new(),
+            request_errors_total: LabeledCounter::new(),
+            responses_total: LabeledCounter::new(),
             request_duration_ms: LabeledHistogram::new(),
+            requests_slow_total: LabeledCounter::new(),
+            requests_rate_limited_total: LabeledCounter::new(),
+            requests_retried_total: LabeledCounter::new(),
+            cache_lookups_total: LabeledCounter::new(),
+            circuit_breaker_transitions_total: LabeledCounter::new(),
+            grpc_requests_total: LabeledCounter::new(),
+            grpc_request_duration_ms: LabeledHistogram::new(),
             instances_up: Gauge::new(),
             instance_restarts: LabeledCounter::new(),
             instance_storage_bytes: LabeledGauge::new(),
             instance_storage_quota_bytes: LabeledGauge::new(),
             instance_storage_usage_ratio: LabeledGauge::new(),
+            instance_startup_duration_ms: LabeledHistogram::with_buckets(startup_buckets()),
         }
     }
 }
@@ -569,6 +1045,24 @@ mod tests {
         assert_eq!(all.len(), 2);
     }
 
+    #[tokio::test]
+    async fn test_labeled_counter_totals_by() {
+        let labeled = LabeledCounter::new();
+        let traffic = [("api", "prod", 3), ("api", "canary", 2), ("web", "prod", 1)];
+        for (process, instance, n) in traffic {
+            let mut labels = HashMap::new();
+            labels.insert("process".to_string(), process.to_string());
+            labels.insert("instance".to_string(), instance.to_string());
+            labeled.with_labels(&labels).await.inc_by(n);
+        }
+
+        assert_eq!(labeled.total().await, 6);
+        let by_process = labeled.totals_by("process").await;
+        assert_eq!(by_process.get("api"), Some(&5));
+        assert_eq!(by_process.get("web"), Some(&1));
+        assert!(labeled.totals_by("missing").await.is_empty());
+    }
+
     #[tokio::test]
     async fn test_metrics_format_prometheus() {
         let metrics = Metrics::new();
@@ -589,4 +1083,224 @@ mod tests {
         assert!(output.contains("status=\"200\""));
         assert!(output.contains("tenement_instances_up 3"));
     }
+
+    #[tokio::test]
+    async fn test_metrics_format_responses_by_status() {
+        let metrics = Metrics::new();
+        let mut labels = HashMap::new();
+        labels.insert("process".to_string(), "api".to_string());
+        labels.insert("status".to_string(), "404".to_string());
+        metrics.responses_total.with_labels(&labels).await.inc();
+
+        let output = metrics.format_prometheus().await;
+        assert!(output.contains("# TYPE tenement_responses_total counter"));
+        assert!(output.contains("tenement_responses_total{process=\"api\",status=\"404\"} 1"));
+    }
+
+    #[tokio::test]
+    async fn test_metrics_format_grpc_calls() {
+        let metrics = Metrics::new();
+        let mut labels = HashMap::new();
+        labels.insert("process".to_string(), "api".to_string());
+        labels.insert("service".to_string(), "users.Users".to_string());
+        labels.insert("method".to_string(), "Get".to_string());
+        metrics
+            .grpc_request_duration_ms
+            .with_labels(&labels)
+            .await
+            .observe(12.0);
+        labels.insert("code".to_string(), "5".to_string());
+        metrics.grpc_requests_total.with_labels(&labels).await.inc();
+
+        let output = metrics.format_prometheus().await;
+        assert!(output.contains("# TYPE tenement_grpc_requests_total counter"));
+        assert!(output.contains(
+            "tenement_grpc_requests_total{code=\"5\",method=\"Get\",process=\"api\",\
+             service=\"users.Users\"} 1"
+        ));
+        assert!(output.contains("# TYPE tenement_grpc_request_duration_ms histogram"));
+        assert!(output.contains(
+            "tenement_grpc_request_duration_ms_count{method=\"Get\",process=\"api\",\
+             service=\"users.Users\"} 1"
+        ));
+    }
+
+    #[test]
+    fn test_format_instance_samples() {
+        let samples = vec![
+            InstanceSample {
+                process: "api".to_string(),
+                instance: "api:v1".to_string(),
+                uptime_secs: 90,
+                active_connections: 2,
+                memory_bytes: Some(4096),
+                cpu_seconds: Some(1.5),
+                cpu_percent: Some(12.5),
+                threads: Some(4),
+                open_fds: Some(9),
+            },
+            InstanceSample {
+                process: "vm".to_string(),
+                instance: "vm:1".to_string(),
+                uptime_secs: 5,
+                active_connections: 0,
+                memory_bytes: None,
+                cpu_seconds: None,
+                cpu_percent: None,
+                threads: None,
+                open_fds: None,
+            },
+        ];
+
+        let output = format_instance_samples(&samples);
+        assert!(output.contains("# TYPE tenement_instance_uptime_seconds gauge"));
+        assert!(output.contains(
+            "tenement_instance_uptime_seconds{instance=\"api:v1\",process=\"api\"} 90"
+        ));
+        assert!(output.contains(
+            "tenement_instance_active_connections{instance=\"api:v1\",process=\"api\"} 2"
+        ));
+        assert!(output.contains(
+            "tenement_instance_memory_bytes{instance=\"api:v1\",process=\"api\"} 4096"
+        ));
+        assert!(output.contains(
+            "tenement_instance_cpu_seconds_total{instance=\"api:v1\",process=\"api\"} 1.50"
+        ));
+        assert!(output.contains(
+            "tenement_instance_cpu_percent{instance=\"api:v1\",process=\"api\"} 12.5"
+        ));
+        assert!(output.contains(
+            "tenement_instance_threads{instance=\"api:v1\",process=\"api\"} 4"
+        ));
+        assert!(output.contains(
+            "tenement_instance_open_fds{instance=\"api:v1\",process=\"api\"} 9"
+        ));
+        // Unknown readings are left out rather than reported as zero
+        assert!(output.contains("tenement_instance_uptime_seconds{instance=\"vm:1\""));
+        assert!(!output.contains("tenement_instance_memory_bytes{instance=\"vm:1\""));
+    }
+
+    #[cfg(target_os = "linux")]
+    #[test]
+    fn test_process_usage_reads_own_process() {
+        let usage = process_usage(std::process::id()).unwrap();
+        assert!(usage.rss_bytes > 0);
+        assert!(usage.cpu_seconds >= 0.0);
+        assert!(usage.threads >= 1);
+        assert!(usage.open_fds.unwrap() > 0);
+        assert_eq!(usage.cpu_percent, None);
+        assert!(process_usage(u32::MAX).is_none());
+    }
+
+    #[cfg(target_os = "linux")]
+    #[test]
+    fn test_process_started_at_reads_own_process() {
+        let started = process_started_at(std::process::id()).unwrap();
+        assert!(started <= chrono::Utc::now());
+        assert!(process_started_at(u32::MAX).is_none());
+    }
+
+    #[test]
+    fn test_process_usage_cpu_percent_since_earlier_reading() {
+        let earlier = ProcessUsage {
+            cpu_seconds: 10.0,
+            ..Default::default()
+        };
+        let later = ProcessUsage {
+            cpu_seconds: 11.0,
+            ..Default::default()
+        };
+        let usage = later.since(&earlier, Duration::from_secs(4));
+        assert_eq!(usage.cpu_percent, Some(25.0));
+        assert_eq!(later.since(&earlier, Duration::ZERO).cpu_percent, None);
+        // A counter that went backwards (pid reuse) reads as idle, not negative
+        let backwards = earlier.since(&later, Duration::from_secs(1));
+        assert_eq!(backwards.cpu_percent, Some(0.0));
+    }
+
+    #[tokio::test]
+    async fn test_metrics_format_slow_requests() {
+        let metrics = Metrics::new();
+        let mut labels = HashMap::new();
+        labels.insert("route".to_string(), "/api".to_string());
+        metrics.requests_slow_total.with_labels(&labels).await.inc();
+
+        let output = metrics.format_prometheus().await;
+        assert!(output.contains("# TYPE tenement_requests_slow_total counter"));
+        assert!(output.contains("tenement_requests_slow_total{route=\"/api\"} 1"));
+    }
+
+    #[tokio::test]
+    async fn test_labeled_histogram_custom_buckets() {
+        let labeled = LabeledHistogram::with_buckets(vec![100.0, 1000.0]);
+        let mut labels = HashMap::new();
+        labels.insert("process".to_string(), "api".to_string());
+
+        let histogram = labeled.with_labels(&labels).await;
+        histogram.observe(750.0);
+
+        assert_eq!(histogram.buckets(), &[100.0, 1000.0]);
+        assert_eq!(histogram.get_bucket(0), 0);
+        assert_eq!(histogram.get_bucket(1), 1);
+    }
+
+    #[tokio::test]
+    async fn test_quantile_between_snapshots() {
+        let labeled = LabeledHistogram::with_buckets(vec![10.0, 100.0, 1000.0]);
+        let labels = |process: &str, instance: &str| {
+            let mut labels = HashMap::new();
+            labels.insert("process".to_string(), process.to_string());
+            labels.insert("instance".to_string(), instance.to_string());
+            labels
+        };
+        let a = labeled.with_labels(&labels("api", "prod-0")).await;
+        let b = labeled.with_labels(&labels("api", "prod-1")).await;
+        let web = labeled.with_labels(&labels("web", "main")).await;
+        for _ in 0..50 {
+            a.observe(5.0);
+        }
+        let before = labeled.counts_where("process", "api").await;
+        assert_eq!(before, vec![50, 0, 0, 0]);
+
+        // Only what came after `before` counts
+        for _ in 0..18 {
+            a.observe(50.0);
+        }
+        b.observe(500.0);
+        b.observe(5000.0);
+        web.observe(5000.0);
+        let after = labeled.counts_where("process", "api").await;
+        assert_eq!(after, vec![50, 18, 1, 1]);
+        let bounds = labeled.bounds();
+        let quantile = |q| quantile_between(&bounds, &before, &after, q);
+        assert_eq!(quantile(0.5), Some(100.0));
+        assert_eq!(quantile(0.95), Some(1000.0));
+        assert_eq!(quantile(1.0), Some(1000.0));
+        assert_eq!(quantile_between(&bounds, &after, &after, 0.95), None);
+    }
+
+    #[tokio::test]
+    async fn test_metrics_format_startup_duration() {
+        let metrics = Metrics::new();
+
+        let mut labels = HashMap::new();
+        labels.insert("process".to_string(), "api".to_string());
+        labels.insert("id".to_string(), "prod".to_string());
+
+        let histogram = metrics.instance_startup_duration_ms.with_labels(&labels).await;
+        histogram.observe(1200.0);
+
+        let output = metrics.format_prometheus().await;
+
+        assert!(output.contains("# TYPE tenement_instance_startup_duration_ms histogram"));
+        assert!(output.contains(
+            "tenement_instance_startup_duration_ms_bucket{id=\"prod\",process=\"api\",le=\"1000\"} 0"
+        ));
+        assert!(output.contains(
+            "tenement_instance_startup_duration_ms_bucket{id=\"prod\",process=\"api\",le=\"2500\"} 1"
+        ));
+        assert!(output.contains(
+            "tenement_instance_startup_duration_ms_count{id=\"prod\",process=\"api\"} 1"
+        ));
+    }
 }
@@ -1,26 +1,36 @@
 //! Port allocator for auto-assigning TCP ports to instances
 //!
-//! Manages a pool of ports in the range 30000-40000.
-//! Automatically assigns free ports to instances and tracks allocations.
+//! Manages a pool of ports, 30000-40000 unless `[settings] port_range` says
+//! otherwise. Automatically assigns free ports to instances and tracks
+//! allocations, steering clear of ports kept for stopped instances and, when
+//! asked to, of ports something else is already listening on.
 
 use std::collections::HashSet;
 use std::sync::Arc;
 use tokio::sync::RwLock;
 
-/// Port range for auto-allocation
-const PORT_MIN: u16 = 30000;
-const PORT_MAX: u16 = 40000;
+/// Default port range for auto-allocation
+pub const PORT_MIN: u16 = 30000;
+pub const PORT_MAX: u16 = 40000;
 
 /// Port allocator that manages a pool of TCP ports
 ///
-/// Ports are allocated from the range 30000-40000 on a first-available basis.
-/// Released ports are returned to the pool and can be reused.
+/// Ports are allocated from the range (30000-40000 by default) on a
+/// first-available basis. Released ports are returned to the pool and can be
+/// reused. Held ports are only handed out once nothing else is free.
 ///
 /// Thread-safe: uses RwLock for concurrent access.
 #[derive(Debug)]
 pub struct PortAllocator {
+    /// Lowest and highest port handed out
+    min: u16,
+    max: u16,
+    /// Skip ports another process is listening on
+    skip_bound: bool,
     /// Set of currently allocated ports
     allocated: Arc<RwLock<HashSet<u16>>>,
+    /// Ports kept for instances that may come back, avoided while others are free
+    held: Arc<RwLock<HashSet<u16>>>,
     /// Next port to try allocating (optimization to avoid scanning from start)
     next_port: Arc<RwLock<u16>>,
 }
@@ -28,12 +38,27 @@ pub struct PortAllocator {
 impl PortAllocator {
     /// Create a new port allocator
     pub fn new() -> Self {
+        Self::with_range(PORT_MIN, PORT_MAX)
+    }
+
+    /// Create a port allocator for `min..=max`
+    pub fn with_range(min: u16, max: u16) -> Self {
         Self {
+            min,
+            max,
+            skip_bound: false,
             allocated: Arc::new(RwLock::new(HashSet::new())),
-            next_port: Arc::new(RwLock::new(PORT_MIN)),
+            held: Arc::new(RwLock::new(HashSet::new())),
+            next_port: Arc::new(RwLock::new(min)),
         }
     }
 
+    /// Also skip ports something outside tenement is already listening on
+    pub fn skip_bound(mut self) -> Self {
+        self.skip_bound = true;
+        self
+    }
+
     /// Allocate a free port from the pool
     ///
     /// Returns the allocated port number, or an error if no ports are available.
@@ -50,40 +75,84 @@ impl PortAllocator {
     pub async fn allocate(&self) -> anyhow::Result<u16> {
         let mut allocated = self.allocated.write().await;
         let mut next_port = self.next_port.write().await;
+        let held = self.held.read().await;
+
+        // Ports nobody holds first, then held ones rather than failing
+        for skip_held in [true, false] {
+            // Try to find a free port starting from next_port
+            let start_port = *next_port;
+            let mut current_port = start_port;
+
+            loop {
+                if !allocated.contains(&current_port)
+                    && !(skip_held && held.contains(&current_port))
+                    && !self.is_bound(current_port)
+                {
+                    // Found a free port
+                    allocated.insert(current_port);
+                    *next_port = self.after(current_port);
+                    return Ok(current_port);
+                }
 
-        // Try to find a free port starting from next_port
-        let start_port = *next_port;
-        let mut current_port = start_port;
-
-        loop {
-            if !allocated.contains(&current_port) {
-                // Found a free port
-                allocated.insert(current_port);
-                *next_port = if current_port == PORT_MAX {
-                    PORT_MIN
-                } else {
-                    current_port + 1
-                };
-                return Ok(current_port);
-            }
+                // Move to next port, wrapping around
+                current_port = self.after(current_port);
 
-            // Move to next port, wrapping around
-            current_port = if current_port == PORT_MAX {
-                PORT_MIN
-            } else {
-                current_port + 1
-            };
-
-            // If we've wrapped around to the start, no ports available
-            if current_port == start_port {
-                anyhow::bail!(
-                    "No free ports available in range {}-{}. {} ports allocated.",
-                    PORT_MIN,
-                    PORT_MAX,
-                    allocated.len()
-                );
+                // If we've wrapped around to the start, try the next pass
+                if current_port == start_port {
+                    break;
+                }
             }
         }
+
+        anyhow::bail!(
+            "No free ports available in range {}-{}. {} ports allocated.",
+            self.min,
+            self.max,
+            allocated.len()
+        );
+    }
+
+    /// The port to try after `port`, wrapping around
+    fn after(&self, port: u16) -> u16 {
+        if port == self.max {
+            self.min
+        } else {
+            port + 1
+        }
+    }
+
+    /// Whether another process listens on `port` (only checked with `skip_bound`)
+    fn is_bound(&self, port: u16) -> bool {
+        self.skip_bound && std::net::TcpListener::bind(("0.0.0.0", port)).is_err()
+    }
+
+    /// Allocate a specific port, e.g. to give a recovered instance the port it
+    /// had before. Returns false if it's outside the range or already taken.
+    pub async fn reserve(&self, port: u16) -> bool {
+        if !(self.min..=self.max).contains(&port) {
+            return false;
+        }
+        self.allocated.write().await.insert(port)
+    }
+
+    /// Like `reserve`, for an instance about to start on `port`: also fails
+    /// when another process is already listening on it
+    pub async fn claim(&self, port: u16) -> bool {
+        if self.is_bound(port) {
+            return false;
+        }
+        self.reserve(port).await
+    }
+
+    /// Keep `port` for an instance that isn't running: `allocate` hands it
+    /// out only once every other port is taken
+    pub async fn hold(&self, port: u16) {
+        self.held.write().await.insert(port);
+    }
+
+    /// Stop keeping `port`
+    pub async fn unhold(&self, port: u16) {
+        self.held.write().await.remove(&port);
     }
 
     /// Release a port back to the pool
@@ -115,7 +184,7 @@ impl PortAllocator {
 
     /// Get the number of available ports
     pub async fn available_count(&self) -> usize {
-        let total = (PORT_MAX - PORT_MIN + 1) as usize;
+        let total = (self.max - self.min + 1) as usize;
         total - self.allocated_count().await
     }
 
@@ -249,6 +318,19 @@ mod tests {
         assert_eq!(allocator.allocated_count().await, 0);
     }
 
+    #[tokio::test]
+    async fn test_reserve_specific_port() {
+        let allocator = PortAllocator::new();
+        assert!(allocator.reserve(PORT_MIN + 7).await);
+        assert!(!allocator.reserve(PORT_MIN + 7).await, "already taken");
+        assert!(!allocator.reserve(PORT_MIN - 1).await, "outside the range");
+
+        // Allocation skips the reserved port
+        for _ in 0..10 {
+            assert_ne!(allocator.allocate().await.unwrap(), PORT_MIN + 7);
+        }
+    }
+
     #[tokio::test]
     async fn test_wrap_around() {
         let allocator = PortAllocator::new();
@@ -373,4 +455,49 @@ mod tests {
         let allocated = allocator.allocated.read().await;
         assert!(allocated.contains(&PORT_MAX));
     }
+
+    #[tokio::test]
+    async fn test_custom_range() {
+        let allocator = PortAllocator::with_range(5000, 5002);
+        assert_eq!(allocator.available_count().await, 3);
+        assert!(!allocator.reserve(PORT_MIN).await, "outside the range");
+
+        let ports = [
+            allocator.allocate().await.unwrap(),
+            allocator.allocate().await.unwrap(),
+            allocator.allocate().await.unwrap(),
+        ];
+        assert_eq!(ports, [5000, 5001, 5002]);
+        let err = allocator.allocate().await.unwrap_err().to_string();
+        assert!(err.contains("5000-5002"), "{}", err);
+    }
+
+    #[tokio::test]
+    async fn test_held_ports_are_allocated_last() {
+        let allocator = PortAllocator::with_range(5000, 5002);
+        allocator.hold(5000).await;
+        allocator.hold(5001).await;
+
+        assert_eq!(allocator.allocate().await.unwrap(), 5002);
+        // Nothing else is free, so a held port rather than an error
+        assert_eq!(allocator.allocate().await.unwrap(), 5000);
+
+        allocator.release(5000).await;
+        allocator.unhold(5001).await;
+        assert_eq!(allocator.allocate().await.unwrap(), 5001);
+        // The instance a port is held for can still claim it
+        assert!(allocator.claim(5000).await);
+    }
+
+    #[tokio::test]
+    async fn test_skip_bound_avoids_ports_in_use() {
+        let taken = std::net::TcpListener::bind("0.0.0.0:0").unwrap();
+        let port = taken.local_addr().unwrap().port();
+        let allocator = PortAllocator::with_range(port, port.saturating_add(1)).skip_bound();
+
+        assert!(!allocator.claim(port).await, "something listens on it");
+        assert_ne!(allocator.allocate().await.ok(), Some(port));
+        // Without skip_bound only tenement's own allocations count
+        assert!(PortAllocator::with_range(port, port).claim(port).await);
+    }
 }
@@ -0,0 +1,258 @@
+//! Post-stop hooks
+//!
+//! A service's `post_stop` command runs once after each instance's process has
+//! ended, whatever the cause: a clean exit, a crash, `ten stop`, a restart, or a
+//! force-kill at shutdown. Hooks run on the host through `sh -c`, in the
+//! background with their own timeout, and log their output under the instance
+//! (prefixed `post_stop:`). Shutdown waits for running hooks before returning.
+
+use crate::instance::InstanceId;
+use crate::logs::{LogBuffer, LogEntry, LogLevel};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::process::Stdio;
+use std::sync::atomic::{AtomicBool, Ordering};
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::io::{AsyncBufReadExt, AsyncRead, BufReader};
+use tokio::process::Command;
+use tokio::task::JoinSet;
+use tracing::{info, warn};
+
+/// Prefix for hook output lines in the instance's logs
+const LOG_PREFIX: &str = "post_stop: ";
+
+/// Why the hook is running, exported to it as TENEMENT_STOP_REASON
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum StopReason {
+    /// The process ended on its own (clean exit or crash)
+    Exited,
+    /// tenement stopped it (stop, restart, idle timeout, shutdown)
+    Stopped,
+}
+
+impl std::fmt::Display for StopReason {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            StopReason::Exited => write!(f, "exited"),
+            StopReason::Stopped => write!(f, "stopped"),
+        }
+    }
+}
+
+/// Post-stop hook for one running instance
+#[derive(Debug, Clone)]
+pub struct PostStopHook {
+    pub instance: InstanceId,
+    /// Shell command
+    pub command: String,
+    /// The instance's environment (the hook sees what the app saw)
+    pub env: HashMap<String, String>,
+    pub workdir: Option<PathBuf>,
+    pub timeout: Duration,
+    /// Shared by everything that can see the process end, so the hook runs once
+    fired: Arc<AtomicBool>,
+}
+
+impl PostStopHook {
+    pub fn new(
+        instance: InstanceId,
+        command: String,
+        env: HashMap<String, String>,
+        workdir: Option<PathBuf>,
+        timeout: Duration,
+    ) -> Self {
+        Self {
+            instance,
+            command,
+            env,
+            workdir,
+            timeout,
+            fired: Arc::new(AtomicBool::new(false)),
+        }
+    }
+
+    /// Claim the hook for this process; true for the first caller only
+    fn claim(&self) -> bool {
+        !self.fired.swap(true, Ordering::SeqCst)
+    }
+}
+
+/// Hooks running in the background, so shutdown can wait for them
+#[derive(Default)]
+pub struct PostStopRunner {
+    tasks: Mutex<JoinSet<()>>,
+}
+
+impl PostStopRunner {
+    pub fn new() -> Arc<Self> {
+        Arc::new(Self::default())
+    }
+
+    /// Run `hook` in the background, unless it already ran for this process
+    pub fn fire(&self, hook: &PostStopHook, reason: StopReason, log_buffer: Arc<LogBuffer>) {
+        if !hook.claim() {
+            return;
+        }
+        let hook = hook.clone();
+        let mut tasks = self.tasks.lock().unwrap();
+        // Drop finished hooks so the set doesn't grow for the life of the daemon
+        while tasks.try_join_next().is_some() {}
+        tasks.spawn(async move {
+            run_hook(&hook, reason, &log_buffer).await;
+        });
+    }
+
+    /// Wait for every running hook; each is bounded by its own timeout
+    pub async fn wait_all(&self) {
+        let mut tasks = std::mem::take(&mut *self.tasks.lock().unwrap());
+        while tasks.join_next().await.is_some() {}
+    }
+}
+
+/// Run the hook, logging its output as the instance's, and kill it at the timeout.
+/// Returns its exit code (None if it couldn't start, was killed, or timed out).
+pub async fn run_hook(
+    hook: &PostStopHook,
+    reason: StopReason,
+    log_buffer: &LogBuffer,
+) -> Option<i32> {
+    let id = &hook.instance;
+    let mut cmd = Command::new("sh");
+    cmd.arg("-c")
+        .arg(&hook.command)
+        .envs(&hook.env)
+        .env("TENEMENT_INSTANCE", id.to_string())
+        .env("TENEMENT_STOP_REASON", reason.to_string())
+        .stdin(Stdio::null())
+        .stdout(Stdio::piped())
+        .stderr(Stdio::piped())
+        .kill_on_drop(true);
+    if let Some(workdir) = &hook.workdir {
+        cmd.current_dir(workdir);
+    }
+
+    let mut child = match cmd.spawn() {
+        Ok(child) => child,
+        Err(e) => {
+            warn!("post_stop hook for {} failed to start: {}", id, e);
+            let message = format!("{}failed to start: {}", LOG_PREFIX, e);
+            log_buffer.push_stderr(&id.process, &id.id, message).await;
+            return None;
+        }
+    };
+    let stdout = forward_lines(child.stdout.take(), log_buffer, id, LogLevel::Stdout, LOG_PREFIX);
+    let stderr = forward_lines(child.stderr.take(), log_buffer, id, LogLevel::Stderr, LOG_PREFIX);
+
+    let finished = tokio::time::timeout(hook.timeout, async {
+        tokio::join!(stdout, stderr);
+        child.wait().await
+    })
+    .await;
+
+    let (outcome, code) = match finished {
+        Ok(Ok(status)) if status.success() => {
+            info!("post_stop hook for {} finished", id);
+            return Some(0);
+        }
+        Ok(Ok(status)) => (format!("exited with {}", status), status.code()),
+        Ok(Err(e)) => (format!("failed: {}", e), None),
+        Err(_) => {
+            let _ = child.kill().await;
+            (format!("timed out after {:?} and was killed", hook.timeout), None)
+        }
+    };
+    warn!("post_stop hook for {} {}", id, outcome);
+    let message = format!("{}{}", LOG_PREFIX, outcome);
+    log_buffer.push_stderr(&id.process, &id.id, message).await;
+    code
+}
+
+/// Copy a hook's output into the instance's logs, line by line, after `prefix`
+pub(crate) async fn forward_lines<R: AsyncRead + Unpin>(
+    pipe: Option<R>,
+    log_buffer: &LogBuffer,
+    id: &InstanceId,
+    level: LogLevel,
+    prefix: &str,
+) {
+    let Some(pipe) = pipe else {
+        return;
+    };
+    let mut lines = BufReader::new(pipe).lines();
+    while let Ok(Some(line)) = lines.next_line().await {
+        let message = format!("{}{}", prefix, line);
+        log_buffer
+            .push(LogEntry::new(&id.process, &id.id, level, message))
+            .await;
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::logs::LogQuery;
+
+    fn hook(command: &str, timeout: Duration) -> PostStopHook {
+        let env = HashMap::from([("APP_NAME".to_string(), "demo".to_string())]);
+        PostStopHook::new(InstanceId::new("api", "prod"), command.to_string(), env, None, timeout)
+    }
+
+    async fn messages(log_buffer: &LogBuffer) -> Vec<String> {
+        log_buffer
+            .query(&LogQuery::default())
+            .await
+            .into_iter()
+            .map(|entry| entry.message)
+            .collect()
+    }
+
+    #[tokio::test]
+    async fn test_hook_sees_env_and_logs_output() {
+        let log_buffer = LogBuffer::new();
+        let hook = hook(
+            "echo \"$APP_NAME $TENEMENT_INSTANCE $TENEMENT_STOP_REASON\"; echo uh-oh >&2",
+            Duration::from_secs(5),
+        );
+
+        assert_eq!(run_hook(&hook, StopReason::Exited, &log_buffer).await, Some(0));
+        let messages = messages(&log_buffer).await;
+        assert!(messages.contains(&"post_stop: demo api:prod exited".to_string()));
+        assert!(messages.contains(&"post_stop: uh-oh".to_string()));
+    }
+
+    #[tokio::test]
+    async fn test_failing_hook_is_logged() {
+        let log_buffer = LogBuffer::new();
+        let hook = hook("exit 3", Duration::from_secs(5));
+
+        assert_eq!(run_hook(&hook, StopReason::Stopped, &log_buffer).await, Some(3));
+        assert!(messages(&log_buffer).await.iter().any(|m| m.contains("exited with")));
+    }
+
+    #[tokio::test]
+    async fn test_hook_killed_at_timeout() {
+        let log_buffer = LogBuffer::new();
+        let hook = hook("sleep 30", Duration::from_millis(100));
+
+        let started = std::time::Instant::now();
+        assert_eq!(run_hook(&hook, StopReason::Stopped, &log_buffer).await, None);
+        assert!(started.elapsed() < Duration::from_secs(5));
+        assert!(messages(&log_buffer).await.iter().any(|m| m.contains("timed out")));
+    }
+
+    #[tokio::test]
+    async fn test_runner_fires_each_hook_once() {
+        let dir = tempfile::TempDir::new().unwrap();
+        let marker = dir.path().join("ran");
+        let hook = hook(&format!("echo run >> {}", marker.display()), Duration::from_secs(5));
+        let runner = PostStopRunner::new();
+        let log_buffer = LogBuffer::new();
+
+        runner.fire(&hook, StopReason::Exited, log_buffer.clone());
+        runner.fire(&hook, StopReason::Stopped, log_buffer.clone());
+        runner.wait_all().await;
+
+        assert_eq!(std::fs::read_to_string(&marker).unwrap(), "run\n");
+    }
+}
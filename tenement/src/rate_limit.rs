@@ -0,0 +1,127 @@
+//! Per-client request rate limiting (`[service.x.rate_limit]`)
+//!
+//! Each client IP gets a token bucket per app: `requests_per_second` tokens
+//! are added every second, up to `burst`, and every proxied request takes one.
+//! A client with an empty bucket is turned away with 429 until its next token
+//! is due, so one noisy client can't take an app's whole capacity.
+
+use std::collections::HashMap;
+use std::net::IpAddr;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+/// Buckets kept before idle (full) ones are dropped
+const PRUNE_THRESHOLD: usize = 10_000;
+
+/// Token buckets for one app, keyed by client IP
+#[derive(Debug)]
+pub struct RequestRateLimiter {
+    rate: f64,
+    burst: f64,
+    buckets: Mutex<HashMap<IpAddr, Bucket>>,
+}
+
+#[derive(Debug, Clone, Copy)]
+struct Bucket {
+    tokens: f64,
+    last_refill: Instant,
+}
+
+impl RequestRateLimiter {
+    pub fn new(requests_per_second: u32, burst: u32) -> Self {
+        Self {
+            rate: requests_per_second.max(1) as f64,
+            burst: burst.max(1) as f64,
+            buckets: Mutex::new(HashMap::new()),
+        }
+    }
+
+    /// Take a token for a request from `client`, or how long until one is due
+    pub fn check(&self, client: IpAddr) -> Result<(), Duration> {
+        self.check_at(client, Instant::now())
+    }
+
+    /// Take a token at a given time (for tests)
+    pub fn check_at(&self, client: IpAddr, now: Instant) -> Result<(), Duration> {
+        let mut buckets = self.buckets.lock().unwrap();
+        if buckets.len() >= PRUNE_THRESHOLD && !buckets.contains_key(&client) {
+            // A bucket that has refilled is the same as no bucket
+            buckets.retain(|_, bucket| self.refilled(bucket, now) < self.burst);
+        }
+        let bucket = buckets.entry(client).or_insert(Bucket {
+            tokens: self.burst,
+            last_refill: now,
+        });
+        bucket.tokens = self.refilled(bucket, now);
+        bucket.last_refill = now;
+
+        if bucket.tokens < 1.0 {
+            return Err(Duration::from_secs_f64((1.0 - bucket.tokens) / self.rate));
+        }
+        bucket.tokens -= 1.0;
+        Ok(())
+    }
+
+    /// Clients with a bucket (for tests)
+    pub fn clients(&self) -> usize {
+        self.buckets.lock().unwrap().len()
+    }
+
+    fn refilled(&self, bucket: &Bucket, now: Instant) -> f64 {
+        let elapsed = now
+            .saturating_duration_since(bucket.last_refill)
+            .as_secs_f64();
+        (bucket.tokens + elapsed * self.rate).min(self.burst)
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn ip(last: u8) -> IpAddr {
+        IpAddr::from([10, 0, 0, last])
+    }
+
+    #[test]
+    fn test_burst_then_steady_rate() {
+        let limiter = RequestRateLimiter::new(2, 5);
+        let start = Instant::now();
+
+        for _ in 0..5 {
+            assert!(limiter.check_at(ip(1), start).is_ok());
+        }
+        let wait = limiter.check_at(ip(1), start).unwrap_err();
+        assert_eq!(wait, Duration::from_millis(500));
+
+        // Half a second buys one more request at 2/s
+        let later = start + Duration::from_millis(500);
+        assert!(limiter.check_at(ip(1), later).is_ok());
+        assert!(limiter.check_at(ip(1), later).is_err());
+    }
+
+    #[test]
+    fn test_clients_are_limited_separately() {
+        let limiter = RequestRateLimiter::new(1, 1);
+        let now = Instant::now();
+        assert!(limiter.check_at(ip(1), now).is_ok());
+        assert!(limiter.check_at(ip(1), now).is_err());
+        assert!(limiter.check_at(ip(2), now).is_ok());
+    }
+
+    #[test]
+    fn test_idle_clients_are_pruned() {
+        let limiter = RequestRateLimiter::new(10, 10);
+        let start = Instant::now();
+        for n in 0..PRUNE_THRESHOLD {
+            let client = IpAddr::from((n as u32).to_be_bytes());
+            limiter.check_at(client, start).unwrap();
+        }
+        assert_eq!(limiter.clients(), PRUNE_THRESHOLD);
+
+        // Everyone has refilled a second later, so a new client clears them out
+        let later = start + Duration::from_secs(1);
+        limiter.check_at(ip(1), later).unwrap();
+        assert_eq!(limiter.clients(), 1);
+    }
+}
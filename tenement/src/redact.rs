@@ -0,0 +1,208 @@
+//! Masking sensitive app environment values
+//!
+//! Anything that prints an app's environment (debug logs, `ten config`, spawn
+//! errors) goes through a [`Redactor`]. Keys that look like credentials
+//! (`*_TOKEN`, `*_SECRET`, `PASSWORD`, `*_API_KEY`, ...) are always masked;
+//! services can add more names or `*` globs with `redact_env`.
+
+use std::collections::{BTreeMap, HashMap};
+
+/// Replacement shown instead of a sensitive value
+pub const REDACTED: &str = "[redacted]";
+
+/// Key segments (split on `_`, `-`, `.`) that mark a key as sensitive
+const SENSITIVE_SEGMENTS: &[&str] = &[
+    "TOKEN",
+    "SECRET",
+    "PASSWORD",
+    "PASSWD",
+    "PASS",
+    "CREDENTIAL",
+    "CREDENTIALS",
+    "APIKEY",
+];
+
+/// Key suffixes that mark a key as sensitive
+const SENSITIVE_SUFFIXES: &[&str] = &["API_KEY", "ACCESS_KEY", "PRIVATE_KEY", "SIGNING_KEY"];
+
+/// Values shorter than this aren't scrubbed from free text, since replacing
+/// every "1" or "ok" in an error message would make it unreadable
+const MIN_SCRUB_LEN: usize = 4;
+
+/// Decides which env keys are sensitive and masks their values
+#[derive(Debug, Clone, Default)]
+pub struct Redactor {
+    /// Extra names or `*` globs, uppercased (matching is case-insensitive)
+    patterns: Vec<String>,
+}
+
+impl Redactor {
+    /// Auto-detection plus extra names or `*` globs
+    pub fn new<I, S>(patterns: I) -> Self
+    where
+        I: IntoIterator<Item = S>,
+        S: AsRef<str>,
+    {
+        Self {
+            patterns: patterns
+                .into_iter()
+                .map(|p| p.as_ref().to_ascii_uppercase())
+                .collect(),
+        }
+    }
+
+    /// Whether the value of `key` should never be printed
+    pub fn is_sensitive(&self, key: &str) -> bool {
+        let key = key.to_ascii_uppercase();
+        is_auto_sensitive(&key) || self.patterns.iter().any(|p| glob_match(p, &key))
+    }
+
+    /// Copy of `env` with sensitive values masked, sorted for stable output
+    pub fn redact_env(&self, env: &HashMap<String, String>) -> BTreeMap<String, String> {
+        env.iter()
+            .map(|(key, value)| {
+                let value = if self.is_sensitive(key) {
+                    REDACTED.to_string()
+                } else {
+                    value.clone()
+                };
+                (key.clone(), value)
+            })
+            .collect()
+    }
+
+    /// Mask any sensitive value from `env` that appears in `text`
+    /// (error messages, command lines echoed back by a runtime)
+    pub fn redact_text(&self, text: &str, env: &HashMap<String, String>) -> String {
+        let mut values: Vec<&str> = env
+            .iter()
+            .filter(|(key, value)| value.len() >= MIN_SCRUB_LEN && self.is_sensitive(key))
+            .map(|(_, value)| value.as_str())
+            .collect();
+        // Longest first, so a value containing another is masked whole
+        values.sort_by_key(|v| std::cmp::Reverse(v.len()));
+
+        let mut text = text.to_string();
+        for value in values {
+            if text.contains(value) {
+                text = text.replace(value, REDACTED);
+            }
+        }
+        text
+    }
+}
+
+fn is_auto_sensitive(key: &str) -> bool {
+    key.split(['_', '-', '.'])
+        .any(|segment| SENSITIVE_SEGMENTS.contains(&segment))
+        || SENSITIVE_SUFFIXES.iter().any(|suffix| key.ends_with(suffix))
+}
+
+/// Match `key` against a pattern where `*` matches any run of characters
+fn glob_match(pattern: &str, key: &str) -> bool {
+    let mut parts = pattern.split('*');
+    let first = parts.next().unwrap_or("");
+    let Some(mut rest) = key.strip_prefix(first) else {
+        return false;
+    };
+    let parts: Vec<&str> = parts.collect();
+    let Some((last, middle)) = parts.split_last() else {
+        // No `*` at all: exact match
+        return rest.is_empty();
+    };
+    for part in middle {
+        match rest.find(part) {
+            Some(idx) => rest = &rest[idx + part.len()..],
+            None => return false,
+        }
+    }
+    rest.len() >= last.len() && rest.ends_with(last)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn env(pairs: &[(&str, &str)]) -> HashMap<String, String> {
+        pairs
+            .iter()
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect()
+    }
+
+    #[test]
+    fn test_auto_detects_sensitive_keys() {
+        let redactor = Redactor::default();
+        for key in [
+            "GITHUB_TOKEN",
+            "token",
+            "AWS_SECRET_ACCESS_KEY",
+            "CLIENT_SECRET",
+            "PASSWORD",
+            "DB_PASSWORD",
+            "db-password",
+            "STRIPE_API_KEY",
+            "OPENAI_APIKEY",
+            "JWT_SIGNING_KEY",
+            "GOOGLE_CREDENTIALS",
+        ] {
+            assert!(redactor.is_sensitive(key), "{} should be sensitive", key);
+        }
+        for key in ["PORT", "DATABASE_NAME", "TOKENIZER_MODEL", "KEYBOARD", "PATH", "PASSTHROUGH"] {
+            assert!(!redactor.is_sensitive(key), "{} should not be sensitive", key);
+        }
+    }
+
+    #[test]
+    fn test_configured_patterns() {
+        let redactor = Redactor::new(["DATABASE_URL", "sentry_*", "*_DSN"]);
+        assert!(redactor.is_sensitive("DATABASE_URL"));
+        assert!(redactor.is_sensitive("database_url"));
+        assert!(redactor.is_sensitive("SENTRY_ENDPOINT"));
+        assert!(redactor.is_sensitive("ERRORS_DSN"));
+        assert!(!redactor.is_sensitive("DATABASE_URL_READONLY"));
+        assert!(!redactor.is_sensitive("REPLICA_DATABASE_URL"));
+        assert!(!redactor.is_sensitive("PORT"));
+    }
+
+    #[test]
+    fn test_glob_match() {
+        assert!(glob_match("*", "ANYTHING"));
+        assert!(glob_match("A*B*C", "AXXBYYC"));
+        assert!(glob_match("A*A", "AA"));
+        assert!(!glob_match("A*A", "A"));
+        assert!(!glob_match("A*B*C", "AXXCYYB"));
+        assert!(glob_match("EXACT", "EXACT"));
+        assert!(!glob_match("EXACT", "EXACTLY"));
+    }
+
+    #[test]
+    fn test_redact_env_masks_only_sensitive_values() {
+        let redactor = Redactor::new(["DATABASE_URL"]);
+        let redacted = redactor.redact_env(&env(&[
+            ("PORT", "8080"),
+            ("API_TOKEN", "tok-123456"),
+            ("DATABASE_URL", "postgres://u:p@db/app"),
+        ]));
+        assert_eq!(redacted["PORT"], "8080");
+        assert_eq!(redacted["API_TOKEN"], REDACTED);
+        assert_eq!(redacted["DATABASE_URL"], REDACTED);
+        assert!(!format!("{:?}", redacted).contains("tok-123456"));
+    }
+
+    #[test]
+    fn test_redact_text_scrubs_values() {
+        let redactor = Redactor::default();
+        let env = env(&[
+            ("API_TOKEN", "tok-123456"),
+            ("LONG_SECRET", "tok-123456-and-more"),
+            ("SHORT_SECRET", "x"),
+            ("PORT", "8080"),
+        ]);
+        let text = "failed: ./run --token tok-123456 --key tok-123456-and-more on 8080 x";
+        assert_eq!(
+            redactor.redact_text(text, &env),
+            "failed: ./run --token [redacted] --key [redacted] on 8080 x"
+        );
+    }
+}
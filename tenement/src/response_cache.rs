@@ -0,0 +1,380 @@
+//! Cache of proxied GET responses (`[service.<name>.cache]`)
+//!
+//! Keeps responses the app marks as cacheable (`Cache-Control: max-age` or
+//! `s-maxage`, or `default_ttl` when it says nothing) and answers later
+//! requests for the same host and path from the copy until it goes stale,
+//! without reaching an instance. Bodies are held in memory, or in files under
+//! `dir`. When the cache is full the least recently used entries go first.
+
+use crate::config::CacheConfig;
+use serde::{Deserialize, Serialize};
+use std::collections::HashMap;
+use std::path::PathBuf;
+use std::sync::{Arc, Mutex};
+use std::time::{Duration, Instant};
+
+/// File extension of bodies kept on disk
+const ENTRY_EXTENSION: &str = "cache";
+
+/// The directives of a `Cache-Control` header the cache acts on
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct CacheControl {
+    pub no_store: bool,
+    pub no_cache: bool,
+    pub private: bool,
+    pub max_age: Option<u64>,
+    pub s_maxage: Option<u64>,
+}
+
+impl CacheControl {
+    /// Parse a header value; unknown directives are ignored
+    pub fn parse(value: &str) -> Self {
+        let mut control = Self::default();
+        for directive in value.split(',') {
+            let (name, arg) = match directive.split_once('=') {
+                Some((name, arg)) => (name, Some(arg.trim().trim_matches('"'))),
+                None => (directive, None),
+            };
+            let secs = arg.and_then(|a| a.parse().ok());
+            match name.trim().to_ascii_lowercase().as_str() {
+                "no-store" => control.no_store = true,
+                "no-cache" => control.no_cache = true,
+                "private" => control.private = true,
+                "max-age" => control.max_age = secs,
+                "s-maxage" => control.s_maxage = secs,
+                _ => {}
+            }
+        }
+        control
+    }
+}
+
+/// A stored response
+#[derive(Debug, Clone, PartialEq, Eq, Serialize, Deserialize)]
+pub struct CachedResponse {
+    pub status: u16,
+    pub headers: Vec<(String, String)>,
+    #[serde(skip)]
+    pub body: Vec<u8>,
+}
+
+impl CachedResponse {
+    fn size(&self) -> usize {
+        let headers: usize = self.headers.iter().map(|(n, v)| n.len() + v.len()).sum();
+        headers + self.body.len()
+    }
+}
+
+/// A fresh response found in the cache
+#[derive(Debug, Clone)]
+pub struct Hit {
+    pub response: CachedResponse,
+    /// How long ago it was stored (for the `Age` header)
+    pub age: Duration,
+}
+
+struct Slot {
+    /// The response, without its body when that lives on disk
+    response: Arc<CachedResponse>,
+    stored: Instant,
+    ttl: Duration,
+    size: usize,
+    last_used: u64,
+}
+
+#[derive(Default)]
+struct CacheState {
+    entries: HashMap<String, Slot>,
+    bytes: usize,
+    clock: u64,
+}
+
+/// One service's response cache
+pub struct ResponseCache {
+    config: CacheConfig,
+    dir: Option<PathBuf>,
+    state: Mutex<CacheState>,
+}
+
+impl ResponseCache {
+    /// A cache keeping bodies in `dir` if given, otherwise in memory. Entries
+    /// left in `dir` by an earlier run are removed.
+    pub fn new(config: &CacheConfig, dir: Option<PathBuf>) -> Self {
+        if let Some(dir) = &dir {
+            if let Ok(files) = std::fs::read_dir(dir) {
+                for file in files.flatten() {
+                    let path = file.path();
+                    if path.extension().is_some_and(|e| e == ENTRY_EXTENSION) {
+                        let _ = std::fs::remove_file(path);
+                    }
+                }
+            }
+        }
+        Self {
+            config: config.clone(),
+            dir,
+            state: Mutex::new(CacheState::default()),
+        }
+    }
+
+    /// The settings this cache was built from
+    pub fn config(&self) -> &CacheConfig {
+        &self.config
+    }
+
+    /// The key requests for the same resource share
+    pub fn key(host: Option<&str>, path_and_query: &str) -> String {
+        let host = host.unwrap_or("").to_ascii_lowercase();
+        format!("{}{}", host, path_and_query)
+    }
+
+    /// Largest body worth collecting for the cache
+    pub fn max_entry_bytes(&self) -> usize {
+        self.config.max_entry_bytes()
+    }
+
+    /// How long a response may be served from the cache, None when it can't
+    /// be stored at all. `s-maxage` wins over `max-age`; without either the
+    /// service's `default_ttl` applies.
+    pub fn ttl(&self, status: u16, cache_control: Option<&str>) -> Option<Duration> {
+        if !matches!(status, 200 | 203 | 204 | 300 | 301 | 404 | 410) {
+            return None;
+        }
+        let control = cache_control.map(CacheControl::parse).unwrap_or_default();
+        if control.no_store || control.no_cache || control.private {
+            return None;
+        }
+        let secs = control
+            .s_maxage
+            .or(control.max_age)
+            .or(self.config.default_ttl)?;
+        (secs > 0).then(|| Duration::from_secs(secs))
+    }
+
+    /// The stored response for `key`, while it's fresh
+    pub fn get(&self, key: &str) -> Option<Hit> {
+        let mut state = self.state.lock().unwrap();
+        state.clock += 1;
+        let clock = state.clock;
+        let slot = state.entries.get_mut(key)?;
+        let age = slot.stored.elapsed();
+        if age >= slot.ttl {
+            drop(state);
+            self.remove(key);
+            return None;
+        }
+        slot.last_used = clock;
+        let mut response = (*slot.response).clone();
+        drop(state);
+
+        if let Some(path) = self.file_for(key) {
+            match std::fs::read(&path) {
+                Ok(body) => response.body = body,
+                Err(e) => {
+                    tracing::debug!("Dropping cache entry {}: {}", path.display(), e);
+                    self.remove(key);
+                    return None;
+                }
+            }
+        }
+        Some(Hit { response, age })
+    }
+
+    /// Store `response` under `key` for `ttl`, making room by evicting the
+    /// least recently used entries. Responses over `max_entry_size` are skipped.
+    pub fn insert(&self, key: String, mut response: CachedResponse, ttl: Duration) {
+        let size = response.size();
+        let budget = self.config.max_bytes();
+        if response.body.len() > self.max_entry_bytes() || size > budget {
+            return;
+        }
+        if let Some(path) = self.file_for(&key) {
+            let written = path
+                .parent()
+                .map_or(Ok(()), std::fs::create_dir_all)
+                .and_then(|()| std::fs::write(&path, &response.body));
+            if let Err(e) = written {
+                tracing::warn!("Can't write cache entry {}: {}", path.display(), e);
+                return;
+            }
+            response.body = Vec::new();
+        }
+
+        let mut evicted = Vec::new();
+        {
+            let mut state = self.state.lock().unwrap();
+            state.clock += 1;
+            let slot = Slot {
+                response: Arc::new(response),
+                stored: Instant::now(),
+                ttl,
+                size,
+                last_used: state.clock,
+            };
+            if let Some(old) = state.entries.insert(key.clone(), slot) {
+                state.bytes -= old.size;
+            }
+            state.bytes += size;
+            while state.bytes > budget {
+                let oldest = state
+                    .entries
+                    .iter()
+                    .filter(|(k, _)| **k != key)
+                    .min_by_key(|(_, slot)| slot.last_used)
+                    .map(|(k, _)| k.clone());
+                let Some(oldest) = oldest else {
+                    break;
+                };
+                if let Some(slot) = state.entries.remove(&oldest) {
+                    state.bytes -= slot.size;
+                }
+                evicted.push(oldest);
+            }
+        }
+        for key in evicted {
+            if let Some(path) = self.file_for(&key) {
+                let _ = std::fs::remove_file(path);
+            }
+        }
+    }
+
+    /// Forget `key`
+    fn remove(&self, key: &str) {
+        let removed = {
+            let mut state = self.state.lock().unwrap();
+            let removed = state.entries.remove(key);
+            if let Some(slot) = &removed {
+                state.bytes -= slot.size;
+            }
+            removed
+        };
+        if let (Some(_), Some(path)) = (removed, self.file_for(key)) {
+            let _ = std::fs::remove_file(path);
+        }
+    }
+
+    /// Number of entries and their total size in bytes
+    pub fn usage(&self) -> (usize, usize) {
+        let state = self.state.lock().unwrap();
+        (state.entries.len(), state.bytes)
+    }
+
+    /// Where the body for `key` is kept, when bodies go to disk
+    fn file_for(&self, key: &str) -> Option<PathBuf> {
+        let dir = self.dir.as_ref()?;
+        let digest = ring::digest::digest(&ring::digest::SHA256, key.as_bytes());
+        let name: String = digest
+            .as_ref()
+            .iter()
+            .map(|b| format!("{:02x}", b))
+            .collect();
+        Some(dir.join(format!("{}.{}", name, ENTRY_EXTENSION)))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn cache_config(max_size_mb: u32, default_ttl: Option<u64>) -> CacheConfig {
+        CacheConfig {
+            max_size: Some(max_size_mb),
+            max_entry_size: None,
+            dir: None,
+            default_ttl,
+        }
+    }
+
+    fn response(body: &[u8]) -> CachedResponse {
+        CachedResponse {
+            status: 200,
+            headers: vec![("content-type".to_string(), "application/json".to_string())],
+            body: body.to_vec(),
+        }
+    }
+
+    #[test]
+    fn test_cache_control_and_ttl() {
+        let control = CacheControl::parse("public, Max-Age=60, s-maxage=\"300\"");
+        assert_eq!(control.max_age, Some(60));
+        assert_eq!(control.s_maxage, Some(300));
+        assert!(CacheControl::parse("no-store").no_store);
+
+        let cache = ResponseCache::new(&cache_config(1, None), None);
+        let secs = Duration::from_secs;
+        assert_eq!(cache.ttl(200, Some("max-age=60")), Some(secs(60)));
+        assert_eq!(
+            cache.ttl(200, Some("max-age=60, s-maxage=5")),
+            Some(secs(5))
+        );
+        assert_eq!(cache.ttl(200, Some("private, max-age=60")), None);
+        assert_eq!(cache.ttl(200, Some("no-cache")), None);
+        assert_eq!(cache.ttl(200, Some("max-age=0")), None);
+        assert_eq!(cache.ttl(500, Some("max-age=60")), None);
+        // Says nothing: only with a default_ttl
+        assert_eq!(cache.ttl(200, None), None);
+        let defaulted = ResponseCache::new(&cache_config(1, Some(30)), None);
+        assert_eq!(defaulted.ttl(404, None), Some(secs(30)));
+    }
+
+    #[test]
+    fn test_get_expires_and_evicts_least_recently_used() {
+        let cache = ResponseCache::new(&cache_config(1, None), None);
+        let key = ResponseCache::key(Some("API.example.com"), "/users?page=2");
+        assert_eq!(key, "api.example.com/users?page=2");
+
+        cache.insert(key.clone(), response(b"[1,2]"), Duration::from_secs(60));
+        let hit = cache.get(&key).unwrap();
+        assert_eq!(hit.response.body, b"[1,2]");
+        assert!(hit.age < Duration::from_secs(1));
+        assert!(cache.get("api.example.com/users").is_none());
+
+        cache.insert(
+            "stale".to_string(),
+            response(b"old"),
+            Duration::from_millis(1),
+        );
+        std::thread::sleep(Duration::from_millis(5));
+        assert!(cache.get("stale").is_none());
+        assert_eq!(cache.usage().0, 1);
+
+        // Three 400KB bodies don't fit in 1MB: the one not used lately goes
+        let big = vec![b'x'; 400 * 1024];
+        let ttl = Duration::from_secs(60);
+        cache.insert("a".to_string(), response(&big), ttl);
+        cache.insert("b".to_string(), response(&big), ttl);
+        assert!(cache.get("a").is_some());
+        cache.insert("c".to_string(), response(&big), ttl);
+        assert!(cache.get("b").is_none());
+        assert!(cache.get("a").is_some() && cache.get("c").is_some());
+        assert!(cache.usage().1 <= 1024 * 1024);
+
+        // Over max_entry_size (1MB by default): not kept
+        cache.insert("huge".to_string(), response(&vec![0; 2 << 20]), ttl);
+        assert!(cache.get("huge").is_none());
+    }
+
+    #[test]
+    fn test_bodies_on_disk() {
+        let dir = tempfile::TempDir::new().unwrap();
+        std::fs::write(dir.path().join("leftover.cache"), "old").unwrap();
+        std::fs::write(dir.path().join("notes.txt"), "mine").unwrap();
+        let cache = ResponseCache::new(&cache_config(1, None), Some(dir.path().to_path_buf()));
+        assert!(!dir.path().join("leftover.cache").exists());
+        assert!(dir.path().join("notes.txt").exists());
+
+        cache.insert("k".to_string(), response(b"{}"), Duration::from_secs(60));
+        let files = std::fs::read_dir(dir.path()).unwrap().count();
+        assert_eq!(files, 2);
+        assert_eq!(cache.get("k").unwrap().response, response(b"{}"));
+
+        // A body that went missing is a miss, not an empty answer
+        for file in std::fs::read_dir(dir.path()).unwrap().flatten() {
+            if file.path().extension().is_some_and(|e| e == "cache") {
+                std::fs::remove_file(file.path()).unwrap();
+            }
+        }
+        assert!(cache.get("k").is_none());
+        assert_eq!(cache.usage(), (0, 0));
+    }
+}
@@ -0,0 +1,796 @@
+//! Path-prefix routing for static-file and proxied routes
+//!
+//! Precedence is deterministic:
+//! 1. The most specific (longest) matching prefix wins. Prefixes match on
+//!    `/` segment boundaries, so `/docs` matches `/docs/a` but not `/docsy`.
+//! 2. On an identical prefix, a route scoped to the request's host beats one
+//!    that applies to any host, and an explicit route beats the host's
+//!    `[routing.host_default]` catch-all (which acts as a `/` route for that host).
+//! 3. Otherwise the route declared first wins: `[[routing.route]]` entries in
+//!    file order, then `[routing.path]` entries sorted by prefix.
+//!
+//! Identical prefixes with different targets are true ambiguities; they are
+//! reported by [`RouteTable::conflicts`] so config loading can warn about them.
+
+use crate::access::AccessConfig;
+use crate::config::{GzipLevel, MirrorConfig, RoutingConfig};
+use crate::fault::FaultConfig;
+use crate::headers::HeaderRules;
+use std::path::PathBuf;
+use std::time::Duration;
+
+/// Where a matched route sends the request
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub enum RouteTarget {
+    /// Serve files from a directory
+    Static(PathBuf),
+    /// Proxy to a service (weighted across its instances)
+    Service(String),
+}
+
+/// A single path-prefix route
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Route {
+    /// Normalized prefix: leading `/`, no trailing `/` (except the root route)
+    pub prefix: String,
+    pub target: RouteTarget,
+    /// Request header rules applied before proxying
+    pub request_headers: HeaderRules,
+    /// Response header rules applied before answering
+    pub response_headers: HeaderRules,
+    /// Normalized host this route is limited to (None = any host)
+    pub host: Option<String>,
+    /// Per-host catch-all from `[routing.host_default]`; loses to any other
+    /// matching route of the same length
+    pub host_default: bool,
+    /// Response time target; slower requests are reported as slow
+    pub slo_target: Option<Duration>,
+    /// Gzip level for responses on this route (None = no compression)
+    pub gzip_level: Option<GzipLevel>,
+    /// Normalized path that replaces the prefix when proxying (`/` strips it;
+    /// None = forward the path as received)
+    pub rewrite: Option<String>,
+    /// Who may use this route, checked before anything is served
+    pub access: Option<AccessConfig>,
+    /// Service that also gets a copy of some of this route's requests
+    pub mirror: Option<Mirror>,
+    /// Faults injected into this route's requests while fault injection is on
+    pub fault: Option<FaultConfig>,
+}
+
+/// Where, and how often, a route's requests are copied
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Mirror {
+    pub service: String,
+    /// Share of requests copied, in millionths
+    pub per_million: u32,
+}
+
+impl Mirror {
+    fn from_config(config: &MirrorConfig) -> Self {
+        Self {
+            service: config.service.clone(),
+            per_million: (config.percent.clamp(0.0, 100.0) * 10_000.0).round() as u32,
+        }
+    }
+
+    /// Whether to copy the current request
+    pub fn sample(&self) -> bool {
+        use rand::Rng;
+        match self.per_million {
+            0 => false,
+            n if n >= 1_000_000 => true,
+            n => rand::thread_rng().gen_range(0..1_000_000) < n,
+        }
+    }
+}
+
+impl Route {
+    /// The path to proxy a request matched with `rest` to, when this route
+    /// rewrites it
+    pub fn rewrite_path(&self, rest: &str) -> Option<String> {
+        let to = self.rewrite.as_deref()?;
+        Some(match (to, rest) {
+            ("/", "") => "/".to_string(),
+            ("/", rest) => rest.to_string(),
+            (to, rest) => format!("{}{}", to, rest),
+        })
+    }
+}
+
+/// Result of resolving a request path
+#[derive(Debug, PartialEq, Eq)]
+pub struct RouteMatch<'a> {
+    pub route: &'a Route,
+    /// Remainder of the path after the prefix (always starts with `/`, or is empty)
+    pub rest: &'a str,
+}
+
+/// Two routes declared with the same prefix; `shadowed` never matches
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct RouteConflict {
+    pub prefix: String,
+    pub host: Option<String>,
+    pub winner: RouteTarget,
+    pub shadowed: RouteTarget,
+}
+
+/// Ordered route table built from `[routing]`
+#[derive(Debug, Clone, Default)]
+pub struct RouteTable {
+    /// Routes in declaration order (ties resolve to the earliest entry)
+    routes: Vec<Route>,
+}
+
+impl RouteTable {
+    /// Build the route table from routing config
+    pub fn from_config(routing: &RoutingConfig) -> Self {
+        let mut routes = Vec::new();
+
+        for route in &routing.route {
+            let target = match (&route.service, &route.static_dir) {
+                (Some(service), _) => RouteTarget::Service(service.clone()),
+                (None, Some(dir)) => RouteTarget::Static(dir.clone()),
+                // Rejected by Config::from_str; skip if constructed by hand
+                (None, None) => continue,
+            };
+            routes.push(Route {
+                prefix: normalize_prefix(&route.prefix),
+                target,
+                request_headers: route.request_headers.clone(),
+                response_headers: route.response_headers.clone(),
+                host: route.host.as_deref().map(normalize_host),
+                host_default: false,
+                slo_target: route.slo_target_ms.map(Duration::from_millis),
+                gzip_level: route.gzip_level,
+                rewrite: match (&route.rewrite, route.strip_prefix) {
+                    (Some(to), _) => Some(normalize_prefix(to)),
+                    (None, true) => Some("/".to_string()),
+                    (None, false) => None,
+                },
+                access: route.access.clone(),
+                mirror: route.mirror.as_ref().map(Mirror::from_config),
+                fault: route.fault.clone().filter(FaultConfig::is_active),
+            });
+        }
+
+        // Legacy path map has no declaration order, so sort for determinism
+        let mut legacy: Vec<_> = routing.path.iter().collect();
+        legacy.sort_by(|a, b| a.0.cmp(b.0));
+        for (prefix, service) in legacy {
+            routes.push(Route {
+                prefix: normalize_prefix(prefix),
+                target: RouteTarget::Service(service.clone()),
+                request_headers: HeaderRules::default(),
+                response_headers: HeaderRules::default(),
+                host: None,
+                host_default: false,
+                slo_target: None,
+                gzip_level: None,
+                rewrite: None,
+                access: None,
+                mirror: None,
+                fault: None,
+            });
+        }
+
+        let mut host_defaults: Vec<_> = routing.host_default.iter().collect();
+        host_defaults.sort_by(|a, b| a.0.cmp(b.0));
+        for (host, service) in host_defaults {
+            routes.push(Route {
+                prefix: "/".to_string(),
+                target: RouteTarget::Service(service.clone()),
+                request_headers: HeaderRules::default(),
+                response_headers: HeaderRules::default(),
+                host: Some(normalize_host(host)),
+                host_default: true,
+                slo_target: None,
+                gzip_level: None,
+                rewrite: None,
+                access: None,
+                mirror: None,
+                fault: None,
+            });
+        }
+
+        Self { routes }
+    }
+
+    pub fn is_empty(&self) -> bool {
+        self.routes.is_empty()
+    }
+
+    pub fn routes(&self) -> &[Route] {
+        &self.routes
+    }
+
+    /// Find the route for a request path, considering only routes for any host
+    pub fn resolve<'a>(&'a self, path: &'a str) -> Option<RouteMatch<'a>> {
+        self.resolve_for_host(None, path)
+    }
+
+    /// Find the route for a request to `host` (a Host header; port and case are ignored)
+    pub fn resolve_for_host<'a>(
+        &'a self,
+        host: Option<&str>,
+        path: &'a str,
+    ) -> Option<RouteMatch<'a>> {
+        let host = host.map(normalize_host);
+        let mut best: Option<&Route> = None;
+        for route in &self.routes {
+            if route.host.is_some() && route.host != host {
+                continue;
+            }
+            if !prefix_matches(&route.prefix, path) {
+                continue;
+            }
+            // Strictly better rank wins; an equal rank keeps the earlier route
+            if best.map_or(true, |b| rank(route) > rank(b)) {
+                best = Some(route);
+            }
+        }
+
+        best.map(|route| {
+            let rest = if route.prefix == "/" {
+                path
+            } else {
+                &path[route.prefix.len()..]
+            };
+            RouteMatch { route, rest }
+        })
+    }
+
+    /// Routes that share a prefix with an earlier route but point elsewhere
+    pub fn conflicts(&self) -> Vec<RouteConflict> {
+        let mut conflicts = Vec::new();
+        for (i, route) in self.routes.iter().enumerate() {
+            if route.host_default {
+                continue;
+            }
+            if let Some(winner) = self.routes[..i]
+                .iter()
+                .find(|r| r.prefix == route.prefix && r.host == route.host)
+            {
+                if winner.target != route.target {
+                    conflicts.push(RouteConflict {
+                        prefix: route.prefix.clone(),
+                        host: route.host.clone(),
+                        winner: winner.target.clone(),
+                        shadowed: route.target.clone(),
+                    });
+                }
+            }
+        }
+        conflicts
+    }
+}
+
+impl std::fmt::Display for RouteTarget {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            RouteTarget::Static(dir) => write!(f, "static {}", dir.display()),
+            RouteTarget::Service(service) => write!(f, "service '{}'", service),
+        }
+    }
+}
+
+/// Precedence among matching routes: longer prefix, then host-scoped, then explicit
+fn rank(route: &Route) -> (usize, bool, bool) {
+    (route.prefix.len(), route.host.is_some(), !route.host_default)
+}
+
+/// Lowercase a host and drop any port and trailing dot
+fn normalize_host(host: &str) -> String {
+    let host = host.trim();
+    let host = match host.rsplit_once(':') {
+        Some((name, port)) if port.chars().all(|c| c.is_ascii_digit()) => name,
+        _ => host,
+    };
+    host.trim_end_matches('.').to_ascii_lowercase()
+}
+
+/// Normalize a prefix to a leading `/` and no trailing `/`
+fn normalize_prefix(prefix: &str) -> String {
+    let trimmed = prefix.trim().trim_end_matches('/');
+    if trimmed.is_empty() {
+        "/".to_string()
+    } else if trimmed.starts_with('/') {
+        trimmed.to_string()
+    } else {
+        format!("/{}", trimmed)
+    }
+}
+
+/// Check whether a prefix matches a path on a segment boundary
+fn prefix_matches(prefix: &str, path: &str) -> bool {
+    if prefix == "/" {
+        return true;
+    }
+    match path.strip_prefix(prefix) {
+        Some(rest) => rest.is_empty() || rest.starts_with('/'),
+        None => false,
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::config::Config;
+
+    fn table(toml: &str) -> RouteTable {
+        let config = Config::from_str(toml).unwrap();
+        RouteTable::from_config(&config.routing)
+    }
+
+    const OVERLAPPING: &str = r#"
+[service.api]
+command = "./api"
+
+[service.docs-api]
+command = "./docs-api"
+
+[[routing.route]]
+prefix = "/docs"
+static = "./public/docs"
+
+[[routing.route]]
+prefix = "/docs/api"
+service = "docs-api"
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+"#;
+
+    #[test]
+    fn test_normalize_prefix() {
+        assert_eq!(normalize_prefix("/docs/"), "/docs");
+        assert_eq!(normalize_prefix("docs"), "/docs");
+        assert_eq!(normalize_prefix("/"), "/");
+        assert_eq!(normalize_prefix(""), "/");
+    }
+
+    #[test]
+    fn test_rewrite_path() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[service.admin]
+command = "./admin"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+rewrite = "/v2/"
+
+[[routing.route]]
+prefix = "/admin"
+service = "admin"
+strip_prefix = true
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+"#,
+        );
+        let rewritten = |path| {
+            let m = table.resolve(path).unwrap();
+            m.route.rewrite_path(m.rest)
+        };
+        assert_eq!(rewritten("/api/users"), Some("/v2/users".to_string()));
+        assert_eq!(rewritten("/api"), Some("/v2".to_string()));
+        assert_eq!(rewritten("/admin/users"), Some("/users".to_string()));
+        assert_eq!(rewritten("/admin"), Some("/".to_string()));
+        assert_eq!(rewritten("/other"), None);
+    }
+
+    #[test]
+    fn test_prefix_matches_segment_boundary() {
+        assert!(prefix_matches("/docs", "/docs"));
+        assert!(prefix_matches("/docs", "/docs/intro"));
+        assert!(!prefix_matches("/docs", "/docsy"));
+        assert!(prefix_matches("/", "/anything"));
+    }
+
+    #[test]
+    fn test_more_specific_proxied_beats_static() {
+        let table = table(OVERLAPPING);
+        let m = table.resolve("/docs/api/v1/users").unwrap();
+        assert_eq!(m.route.target, RouteTarget::Service("docs-api".to_string()));
+        assert_eq!(m.rest, "/v1/users");
+    }
+
+    #[test]
+    fn test_more_specific_static_beats_proxied() {
+        let table = table(OVERLAPPING);
+        let m = table.resolve("/docs/intro.html").unwrap();
+        assert_eq!(
+            m.route.target,
+            RouteTarget::Static(PathBuf::from("./public/docs"))
+        );
+        assert_eq!(m.rest, "/intro.html");
+    }
+
+    #[test]
+    fn test_root_route_is_fallback() {
+        let table = table(OVERLAPPING);
+        let m = table.resolve("/docsy").unwrap();
+        assert_eq!(m.route.target, RouteTarget::Service("api".to_string()));
+        assert_eq!(m.rest, "/docsy");
+    }
+
+    #[test]
+    fn test_declaration_order_independent_of_specificity() {
+        // Same routes, most general first: specificity still decides
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+
+[[routing.route]]
+prefix = "/static"
+static = "./public"
+"#,
+        );
+        let m = table.resolve("/static/app.js").unwrap();
+        assert_eq!(m.route.target, RouteTarget::Static(PathBuf::from("./public")));
+    }
+
+    #[test]
+    fn test_identical_prefix_first_declared_wins() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/assets"
+static = "./public"
+
+[[routing.route]]
+prefix = "/assets/"
+service = "api"
+"#,
+        );
+        let m = table.resolve("/assets/logo.png").unwrap();
+        assert_eq!(m.route.target, RouteTarget::Static(PathBuf::from("./public")));
+
+        let conflicts = table.conflicts();
+        assert_eq!(conflicts.len(), 1);
+        assert_eq!(conflicts[0].prefix, "/assets");
+        assert_eq!(conflicts[0].shadowed, RouteTarget::Service("api".to_string()));
+    }
+
+    #[test]
+    fn test_explicit_routes_beat_legacy_path_on_tie() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[routing.path]
+"/files" = "api"
+
+[[routing.route]]
+prefix = "/files"
+static = "./files"
+"#,
+        );
+        let m = table.resolve("/files/a.txt").unwrap();
+        assert_eq!(m.route.target, RouteTarget::Static(PathBuf::from("./files")));
+        assert_eq!(table.conflicts().len(), 1);
+    }
+
+    #[test]
+    fn test_no_conflicts_for_distinct_prefixes() {
+        assert!(table(OVERLAPPING).conflicts().is_empty());
+    }
+
+    #[test]
+    fn test_resolve_no_match() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+"#,
+        );
+        assert!(table.resolve("/other").is_none());
+        assert!(RouteTable::default().resolve("/api").is_none());
+    }
+
+    #[test]
+    fn test_route_carries_request_headers() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+
+[routing.route.request_headers]
+accept_encoding = "normalize"
+remove = ["cookie"]
+"#,
+        );
+        let rules = &table.resolve("/api/x").unwrap().route.request_headers;
+        assert_eq!(
+            rules.accept_encoding,
+            Some(crate::headers::AcceptEncodingRule::Normalize)
+        );
+        assert_eq!(rules.remove, vec!["cookie".to_string()]);
+    }
+
+    // ===================
+    // PER-HOST DEFAULT TESTS
+    // ===================
+
+    const HOSTED: &str = r#"
+[service.api]
+command = "./api"
+
+[service.docs]
+command = "./docs"
+
+[service.search]
+command = "./search"
+
+[[routing.route]]
+prefix = "/search"
+host = "docs.example.com"
+service = "search"
+
+[[routing.route]]
+prefix = "/static"
+static = "./public"
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+
+[routing.host_default]
+"docs.example.com" = "docs"
+"#;
+
+    fn target(table: &RouteTable, host: &str, path: &str) -> RouteTarget {
+        table
+            .resolve_for_host(Some(host), path)
+            .unwrap()
+            .route
+            .target
+            .clone()
+    }
+
+    #[test]
+    fn test_host_specific_route_beats_host_default() {
+        let table = table(HOSTED);
+        assert_eq!(
+            target(&table, "docs.example.com", "/search/q"),
+            RouteTarget::Service("search".to_string())
+        );
+    }
+
+    #[test]
+    fn test_host_default_catches_unmatched_paths() {
+        let table = table(HOSTED);
+        let m = table.resolve_for_host(Some("docs.example.com"), "/guide/intro").unwrap();
+        assert_eq!(m.route.target, RouteTarget::Service("docs".to_string()));
+        assert!(m.route.host_default);
+        assert_eq!(m.rest, "/guide/intro");
+    }
+
+    #[test]
+    fn test_longer_any_host_route_beats_host_default() {
+        let table = table(HOSTED);
+        assert_eq!(
+            target(&table, "docs.example.com", "/static/app.css"),
+            RouteTarget::Static(PathBuf::from("./public"))
+        );
+    }
+
+    #[test]
+    fn test_other_hosts_fall_through_to_global_routes() {
+        let table = table(HOSTED);
+        assert_eq!(
+            target(&table, "www.example.com", "/guide/intro"),
+            RouteTarget::Service("api".to_string())
+        );
+        // Host-scoped routes don't leak to other hosts
+        assert_eq!(
+            target(&table, "www.example.com", "/search/q"),
+            RouteTarget::Service("api".to_string())
+        );
+        assert_eq!(
+            table.resolve("/guide").unwrap().route.target,
+            RouteTarget::Service("api".to_string())
+        );
+    }
+
+    #[test]
+    fn test_host_match_ignores_port_and_case() {
+        let table = table(HOSTED);
+        assert_eq!(
+            target(&table, "Docs.Example.com:8080", "/guide"),
+            RouteTarget::Service("docs".to_string())
+        );
+    }
+
+    #[test]
+    fn test_explicit_root_route_for_host_beats_host_default() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[service.docs]
+command = "./docs"
+
+[[routing.route]]
+prefix = "/"
+host = "docs.example.com"
+static = "./docs-site"
+
+[routing.host_default]
+"docs.example.com" = "docs"
+"#,
+        );
+        assert_eq!(
+            target(&table, "docs.example.com", "/anything"),
+            RouteTarget::Static(PathBuf::from("./docs-site"))
+        );
+        // Overriding a host default is intentional, not a conflict
+        assert!(table.conflicts().is_empty());
+    }
+
+    #[test]
+    fn test_same_prefix_on_different_hosts_is_not_a_conflict() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[service.docs]
+command = "./docs"
+
+[[routing.route]]
+prefix = "/v1"
+host = "a.example.com"
+service = "api"
+
+[[routing.route]]
+prefix = "/v1"
+host = "b.example.com"
+service = "docs"
+"#,
+        );
+        assert!(table.conflicts().is_empty());
+        assert!(table.resolve("/v1").is_none());
+        assert_eq!(
+            target(&table, "b.example.com", "/v1/x"),
+            RouteTarget::Service("docs".to_string())
+        );
+    }
+
+    #[test]
+    fn test_route_carries_slo_target() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+slo_target_ms = 300
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+"#,
+        );
+        let slo = |path| table.resolve(path).unwrap().route.slo_target;
+        assert_eq!(slo("/api/x"), Some(Duration::from_millis(300)));
+        assert_eq!(slo("/other"), None);
+    }
+
+    #[test]
+    fn test_route_carries_gzip_level() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+gzip_level = 1
+
+[[routing.route]]
+prefix = "/docs"
+service = "api"
+gzip_level = "default"
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+"#,
+        );
+        let gzip = |path| table.resolve(path).unwrap().route.gzip_level;
+        assert_eq!(gzip("/api/x"), Some(GzipLevel::Level(1)));
+        assert_eq!(gzip("/docs"), Some(GzipLevel::Default));
+        assert_eq!(gzip("/other"), None);
+    }
+
+    #[test]
+    fn test_route_carries_mirror() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[service.api-v2]
+command = "./api-v2"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+mirror = { service = "api-v2", percent = 12.5 }
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+mirror = { service = "api-v2" }
+"#,
+        );
+        let mirror = |path| table.resolve(path).unwrap().route.mirror.clone().unwrap();
+        assert_eq!(mirror("/api/x").service, "api-v2");
+        assert_eq!(mirror("/api/x").per_million, 125_000);
+        assert!(mirror("/other").sample());
+
+        let never = Mirror {
+            service: "api-v2".to_string(),
+            per_million: 0,
+        };
+        assert!(!(0..100).any(|_| never.sample()));
+    }
+
+    #[test]
+    fn test_route_carries_fault() {
+        let table = table(
+            r#"
+[service.api]
+command = "./api"
+
+[[routing.route]]
+prefix = "/api"
+service = "api"
+fault = { abort_status = 503, abort_percent = 50.0 }
+
+[[routing.route]]
+prefix = "/idle"
+service = "api"
+fault = { delay_ms = 100 }
+
+[[routing.route]]
+prefix = "/"
+service = "api"
+"#,
+        );
+        let fault = |path| table.resolve(path).unwrap().route.fault.clone();
+        assert_eq!(fault("/api/x").unwrap().abort_status, Some(503));
+        // A fault that can never fire (no delay_percent) is dropped
+        assert_eq!(fault("/idle"), None);
+        assert_eq!(fault("/other"), None);
+    }
+}
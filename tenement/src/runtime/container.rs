@@ -1,29 +1,49 @@
 //! Shared helpers for runtimes that run OCI containers via docker/containerd
-//! (Quark, gVisor/runsc).
+//! (plain containers, Quark, gVisor/runsc).
 //!
 //! Tenement does NOT hand-roll an OCI bundle for these. A minimal hand-rolled
 //! spec fails on real apps (missing seccomp/caps/masked-paths/standard `/dev`/
 //! networking); docker/containerd generate the complete spec the runtime needs.
-//! We run the app's image with `docker run -d --runtime=<runtime> --network
+//! We run the app's image with `docker run -d [--runtime=<runtime>] --network
 //! host`: the app binds the allocated PORT directly (Tenement proxies to
 //! `127.0.0.1:PORT`) and can reach host-local sidecars (e.g. the DB protocol
 //! sidecar at `127.0.0.1:<pgport>`). The container is owned by the docker
 //! daemon; Tenement tracks it by name and reaps it with `docker rm -f`.
 //!
+//! The CLI is `docker` (talking to the Docker socket, or `DOCKER_HOST`) unless
+//! `TENEMENT_CONTAINER_CLI` names another docker-compatible one, e.g. `nerdctl`
+//! for containerd.
+//!
 //! Per-app network isolation (per-app bridge + sidecar-as-container) is a
 //! hardening follow-up.
 
-/// docker present on PATH (or the usual location)?
+/// Environment variable naming the docker-compatible CLI to drive containers with.
+pub const CLI_ENV: &str = "TENEMENT_CONTAINER_CLI";
+
+/// The container CLI: `TENEMENT_CONTAINER_CLI`, or `docker`
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+pub fn cli() -> String {
+    std::env::var(CLI_ENV)
+        .ok()
+        .filter(|cli| !cli.trim().is_empty())
+        .unwrap_or_else(|| "docker".to_string())
+}
+
+/// The container CLI present on PATH (or the usual location)?
 pub fn docker_available() -> bool {
     #[cfg(target_os = "linux")]
     {
+        let cli = cli();
+        if cli.contains('/') {
+            return std::path::Path::new(&cli).exists();
+        }
         std::env::var("PATH")
             .map(|p| {
                 p.split(':')
-                    .any(|d| std::path::Path::new(d).join("docker").exists())
+                    .any(|d| std::path::Path::new(d).join(&cli).exists())
             })
             .unwrap_or(false)
-            || std::path::Path::new("/usr/bin/docker").exists()
+            || std::path::Path::new("/usr/bin").join(&cli).exists()
     }
     #[cfg(not(target_os = "linux"))]
     {
@@ -33,7 +53,7 @@ pub fn docker_available() -> bool {
 
 #[cfg_attr(not(target_os = "linux"), allow(dead_code))]
 fn docker_run_args(
-    runtime: &str,
+    runtime: Option<&str>,
     name: &str,
     image: &str,
     config: &crate::runtime::SpawnConfig,
@@ -44,10 +64,12 @@ fn docker_run_args(
         "--rm".to_string(),
         "--name".to_string(),
         name.to_string(),
-        format!("--runtime={runtime}"),
-        "--network".to_string(),
-        "host".to_string(),
     ];
+    if let Some(runtime) = runtime {
+        args.push(format!("--runtime={runtime}"));
+    }
+    args.push("--network".to_string());
+    args.push("host".to_string());
 
     if let Some(memory_mb) = config.memory_limit_mb {
         if memory_mb > 0 {
@@ -61,6 +83,21 @@ fn docker_run_args(
         args.push(cpu_shares.clamp(2, 10000).to_string());
     }
 
+    if let Some(cores) = config.cpu_max {
+        args.push("--cpus".to_string());
+        args.push(cores.to_string());
+    }
+
+    if let Some(nofile) = config.nofile {
+        args.push("--ulimit".to_string());
+        args.push(format!("nofile={nofile}:{nofile}"));
+    }
+
+    if let Some(run_as) = config.run_as {
+        args.push("--user".to_string());
+        args.push(run_as.to_string());
+    }
+
     // Neutralize any image ENTRYPOINT (railpack bakes `/bin/bash -c`) so the
     // explicit command runs directly, not as args to the entrypoint.
     // Harmless for entrypoint-less images (e.g. `docker import`ed rootfs).
@@ -102,34 +139,97 @@ fn docker_run_args(
 pub mod linux {
     use crate::runtime::SpawnConfig;
     use anyhow::{bail, Context, Result};
-    use tokio::process::Command;
+    use std::process::Stdio;
+    use tokio::process::{Child, Command};
 
-    /// Run an OCI image via `docker run -d --runtime=<runtime> --network host`.
-    /// Returns the docker container name.
-    pub async fn run(runtime: &str, config: &SpawnConfig) -> Result<String> {
+    /// Run an OCI image via `docker run -d [--runtime=<runtime>] --network host`
+    /// (the daemon's default runtime when `runtime` is None). Returns the docker
+    /// container name.
+    pub async fn run(runtime: Option<&str>, config: &SpawnConfig) -> Result<String> {
+        let isolation = runtime.unwrap_or("container");
         let image = config.image.clone().with_context(|| {
             format!(
-                "isolation `{runtime}` needs an `image` (OCI image ref); Tenement runs it via \
-                 `docker run --runtime={runtime}`. Render `image = \"...\"` in the service config."
+                "isolation `{isolation}` needs an `image` (OCI image ref); Tenement runs it via \
+                 `docker run`. Render `image = \"...\"` in the service config."
             )
         })?;
         let name = format!("ten-{}", uuid::Uuid::new_v4().simple());
 
-        let mut cmd = Command::new("docker");
+        let cli = super::cli();
+        let mut cmd = Command::new(&cli);
         cmd.args(super::docker_run_args(runtime, &name, &image, config));
 
         let out = cmd
             .output()
             .await
-            .with_context(|| format!("invoking `docker run --runtime={runtime}`"))?;
+            .with_context(|| format!("invoking `{cli} run` for isolation `{isolation}`"))?;
         if !out.status.success() {
             bail!(
-                "docker run --runtime={runtime} failed:\n{}",
+                "{cli} run ({isolation}) failed:\n{}",
                 String::from_utf8_lossy(&out.stderr)
             );
         }
         Ok(name)
     }
+
+    /// Pull `image` unless it is already present locally
+    pub async fn pull(image: &str) -> Result<()> {
+        let cli = super::cli();
+        let present = Command::new(&cli)
+            .args(["image", "inspect", image])
+            .stdout(Stdio::null())
+            .stderr(Stdio::null())
+            .status()
+            .await
+            .with_context(|| format!("invoking `{cli} image inspect`"))?;
+        if present.success() {
+            return Ok(());
+        }
+        let out = Command::new(&cli)
+            .args(["pull", image])
+            .output()
+            .await
+            .with_context(|| format!("invoking `{cli} pull`"))?;
+        if !out.status.success() {
+            bail!(
+                "{cli} pull {image} failed:\n{}",
+                String::from_utf8_lossy(&out.stderr)
+            );
+        }
+        Ok(())
+    }
+
+    /// Follow a container's output with `docker logs -f`, so it can be captured
+    /// like a child process's stdout/stderr. Ends when the container does.
+    pub fn follow_logs(name: &str) -> Result<Child> {
+        let cli = super::cli();
+        Command::new(&cli)
+            .args(["logs", "-f", name])
+            .stdin(Stdio::null())
+            .stdout(Stdio::piped())
+            .stderr(Stdio::piped())
+            .kill_on_drop(true)
+            .spawn()
+            .with_context(|| format!("invoking `{cli} logs -f {name}`"))
+    }
+
+    /// Stop and remove a container by name (best effort)
+    pub async fn remove(name: &str) {
+        let _ = Command::new(super::cli())
+            .args(["rm", "-f", name])
+            .output()
+            .await;
+    }
+
+    /// Whether the container is still running
+    pub async fn is_running(name: &str) -> bool {
+        let out = Command::new(super::cli())
+            .args(["inspect", "-f", "{{.State.Running}}", name])
+            .output()
+            .await;
+        matches!(out, Ok(o) if o.status.success()
+            && String::from_utf8_lossy(&o.stdout).trim() == "true")
+    }
 }
 
 #[cfg(test)]
@@ -147,17 +247,48 @@ mod tests {
             image: Some("tinyhost/app:abc".into()),
             memory_limit_mb: Some(256),
             cpu_shares: Some(500),
+            cpu_max: Some(0.5),
+            nofile: Some(1024),
+            run_as: Some(crate::users::RunAs {
+                uid: 1000,
+                gid: 1000,
+            }),
             ..Default::default()
         };
 
-        let args = docker_run_args("quark", "ten-test", "tinyhost/app:abc", &config);
+        let args = docker_run_args(Some("quark"), "ten-test", "tinyhost/app:abc", &config);
         assert!(args
             .windows(2)
             .any(|w| w[0] == "--memory" && w[1] == "256m"));
         assert!(args
             .windows(2)
             .any(|w| w[0] == "--cpu-shares" && w[1] == "500"));
+        assert!(args.windows(2).any(|w| w[0] == "--cpus" && w[1] == "0.5"));
+        assert!(args
+            .windows(2)
+            .any(|w| w[0] == "--ulimit" && w[1] == "nofile=1024:1024"));
+        assert!(args.windows(2).any(|w| w[0] == "--user" && w[1] == "1000:1000"));
         assert!(args.contains(&"--entrypoint".to_string()));
         assert_eq!(args.last(), Some(&"app.py".to_string()));
     }
+
+    #[test]
+    fn docker_args_select_runtime_only_when_given() {
+        let config = SpawnConfig {
+            image: Some("nginx:1.27".into()),
+            ..Default::default()
+        };
+
+        let args = docker_run_args(Some("runsc"), "ten-test", "nginx:1.27", &config);
+        assert!(args.contains(&"--runtime=runsc".to_string()));
+
+        let args = docker_run_args(None, "ten-test", "nginx:1.27", &config);
+        assert!(!args.iter().any(|a| a.starts_with("--runtime")));
+        assert!(args
+            .windows(2)
+            .any(|w| w[0] == "--network" && w[1] == "host"));
+        // No command: the image's own entrypoint runs
+        assert!(!args.contains(&"--entrypoint".to_string()));
+        assert_eq!(args.last(), Some(&"nginx:1.27".to_string()));
+    }
 }
@@ -0,0 +1,413 @@
+//! Filesystem sandbox for the namespace runtime
+//!
+//! Runs in the child, in its private mount namespace, before exec. In order:
+//!
+//! 1. Each kept path (the service's `writable` paths and the instance's own
+//!    directories) is bind-mounted onto itself, so it stays writable on its own
+//!    mount, and opened so it can be found again once covered.
+//! 2. With `read_only`, every other mount is remounted read-only (skipping
+//!    /proc, /sys and /dev).
+//! 3. With `private_tmp`, /tmp and /var/tmp get an empty tmpfs each.
+//! 4. Each hidden path gets an empty tmpfs, read-only once kept paths beneath it
+//!    are bound back in from the descriptors opened in step 1.
+//!
+//! Everything the child needs is built before fork: it may not allocate.
+
+use std::path::PathBuf;
+
+/// `[service.x.filesystem]` for one instance, with its paths resolved
+#[derive(Debug, Clone, Default)]
+pub struct FsSandbox {
+    pub read_only: bool,
+    pub private_tmp: bool,
+    /// Paths that stay writable and visible: the service's `writable` list and
+    /// the instance's data, socket and scratch directories
+    pub keep: Vec<PathBuf>,
+    pub hide: Vec<PathBuf>,
+}
+
+#[cfg(target_os = "linux")]
+pub(crate) use linux::Prepared;
+
+#[cfg(target_os = "linux")]
+mod linux {
+    use super::FsSandbox;
+    use anyhow::{Context, Result};
+    use std::ffi::CString;
+    use std::os::unix::ffi::OsStrExt;
+    use std::path::{Path, PathBuf};
+
+    /// Mount points left as they are under `read_only`
+    const PSEUDO_ROOTS: [&str; 3] = ["/proc", "/sys", "/dev"];
+
+    /// Where private /tmp directories go
+    const TMP_DIRS: [&str; 2] = ["/tmp", "/var/tmp"];
+
+    const TMPFS: &[u8] = b"tmpfs\0";
+    const TMP_MODE: &[u8] = b"mode=1777\0";
+    const HIDE_MODE: &[u8] = b"mode=755\0";
+
+    /// A path kept through the sandbox
+    struct Kept {
+        path: CString,
+        /// Directories to create in the tmpfs covering it, outermost first
+        /// (empty when nothing covers it)
+        create: Vec<CString>,
+    }
+
+    /// An [`FsSandbox`] ready to apply in a forked child
+    pub(crate) struct Prepared {
+        keep: Vec<Kept>,
+        /// Descriptors of `keep`, in order, while the child applies the sandbox
+        fds: Vec<libc::c_int>,
+        /// Mount points to make read-only, with the flags each keeps
+        read_only: Vec<(CString, libc::c_ulong)>,
+        tmp: Vec<CString>,
+        hide: Vec<CString>,
+        /// Where to chdir to afterwards, as the cwd may have been covered
+        workdir: Option<CString>,
+    }
+
+    fn c_path(path: &Path) -> Result<CString> {
+        CString::new(path.as_os_str().as_bytes())
+            .with_context(|| format!("Path {:?} contains a NUL byte", path))
+    }
+
+    impl Prepared {
+        pub(crate) fn new(
+            sandbox: &FsSandbox,
+            socket: &Path,
+            workdir: Option<&Path>,
+        ) -> Result<Self> {
+            let tmp: Vec<PathBuf> = match sandbox.private_tmp {
+                true => TMP_DIRS
+                    .iter()
+                    .map(PathBuf::from)
+                    .filter(|dir| dir.is_dir())
+                    .collect(),
+                false => Vec::new(),
+            };
+            if tmp.iter().any(|dir| socket.parent() == Some(dir)) {
+                anyhow::bail!(
+                    "filesystem.private_tmp hides the socket {}; give the service a socket \
+                     directory of its own, such as /tmp/tenement",
+                    socket.display()
+                );
+            }
+            let hide: Vec<PathBuf> = sandbox
+                .hide
+                .iter()
+                .filter(|path| {
+                    let dir = path.is_dir();
+                    if !dir {
+                        tracing::warn!("Not hiding {}: not a directory", path.display());
+                    }
+                    dir
+                })
+                .cloned()
+                .collect();
+
+            let mut keep = sandbox.keep.clone();
+            keep.sort_by_key(|path| path.components().count());
+            keep.dedup();
+            let mut kept = Vec::new();
+            for path in &keep {
+                if !path.exists() {
+                    anyhow::bail!("Writable path {} doesn't exist", path.display());
+                }
+                let covered_by = tmp
+                    .iter()
+                    .chain(&hide)
+                    .filter(|cover| path.starts_with(cover) && path != *cover)
+                    .max_by_key(|cover| cover.components().count());
+                let create = match covered_by {
+                    Some(cover) => path
+                        .ancestors()
+                        .take_while(|dir| *dir != cover.as_path())
+                        .collect::<Vec<_>>()
+                        .into_iter()
+                        .rev()
+                        .map(c_path)
+                        .collect::<Result<_>>()?,
+                    None => Vec::new(),
+                };
+                kept.push(Kept {
+                    path: c_path(path)?,
+                    create,
+                });
+            }
+
+            let covered = workdir.and_then(|dir| hide.iter().find(|h| dir.starts_with(h)));
+            if let (Some(workdir), Some(hidden)) = (workdir, covered) {
+                if !keep.iter().any(|path| workdir.starts_with(path)) {
+                    anyhow::bail!(
+                        "The workdir {} is under the hidden path {}; add it to \
+                         filesystem.writable",
+                        workdir.display(),
+                        hidden.display()
+                    );
+                }
+            }
+
+            let read_only = match sandbox.read_only {
+                true => {
+                    let mountinfo = std::fs::read_to_string("/proc/self/mountinfo")
+                        .context("Failed to read /proc/self/mountinfo")?;
+                    read_only_mounts(&mountinfo)
+                        .into_iter()
+                        // Under a kept path, the mount is part of its writable bind
+                        .filter(|(point, _)| !keep.iter().any(|path| point.starts_with(path)))
+                        .map(|(path, flags)| Ok((c_path(&path)?, flags)))
+                        .collect::<Result<_>>()?
+                }
+                false => Vec::new(),
+            };
+
+            Ok(Self {
+                fds: Vec::with_capacity(kept.len()),
+                keep: kept,
+                read_only,
+                tmp: tmp.iter().map(|p| c_path(p)).collect::<Result<_>>()?,
+                hide: hide.iter().map(|p| c_path(p)).collect::<Result<_>>()?,
+                workdir: workdir.map(c_path).transpose()?,
+            })
+        }
+
+        /// Set the sandbox up. Only called from `pre_exec`, after `unshare`, so
+        /// it must not allocate.
+        pub(crate) fn apply(&mut self) -> std::io::Result<()> {
+            let result = self.mount_all();
+            for fd in self.fds.drain(..) {
+                unsafe { libc::close(fd) };
+            }
+            result?;
+            if let Some(workdir) = &self.workdir {
+                if unsafe { libc::chdir(workdir.as_ptr()) } != 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+            }
+            Ok(())
+        }
+
+        fn mount_all(&mut self) -> std::io::Result<()> {
+            let none = std::ptr::null();
+            for kept in &self.keep {
+                let flags = libc::MS_BIND | libc::MS_REC;
+                mount(kept.path.as_ptr(), kept.path.as_ptr(), none, flags, none)?;
+                let fd = unsafe { libc::open(kept.path.as_ptr(), libc::O_PATH | libc::O_CLOEXEC) };
+                if fd < 0 {
+                    return Err(std::io::Error::last_os_error());
+                }
+                self.fds.push(fd);
+            }
+            for (path, flags) in &self.read_only {
+                let flags = libc::MS_REMOUNT | libc::MS_BIND | libc::MS_RDONLY | flags;
+                mount(none, path.as_ptr(), none, flags, none)?;
+            }
+
+            let tmpfs = TMPFS.as_ptr().cast();
+            let flags = libc::MS_NOSUID | libc::MS_NODEV;
+            for dir in &self.tmp {
+                mount(tmpfs, dir.as_ptr(), tmpfs, flags, TMP_MODE.as_ptr().cast())?;
+            }
+            let flags = libc::MS_NOSUID | libc::MS_NODEV | libc::MS_NOEXEC;
+            for path in &self.hide {
+                mount(
+                    tmpfs,
+                    path.as_ptr(),
+                    tmpfs,
+                    flags,
+                    HIDE_MODE.as_ptr().cast(),
+                )?;
+            }
+
+            for (kept, fd) in self.keep.iter().zip(&self.fds) {
+                if kept.create.is_empty() {
+                    continue;
+                }
+                for dir in &kept.create {
+                    // Already there when another kept path made it
+                    unsafe { libc::mkdir(dir.as_ptr(), 0o755) };
+                }
+                let mut buf = [0u8; 32];
+                let source = fd_path(*fd, &mut buf);
+                let flags = libc::MS_BIND | libc::MS_REC;
+                mount(source, kept.path.as_ptr(), none, flags, none)?;
+            }
+            let flags = libc::MS_REMOUNT | libc::MS_RDONLY | flags;
+            for path in &self.hide {
+                mount(none, path.as_ptr(), none, flags, none)?;
+            }
+            Ok(())
+        }
+    }
+
+    fn mount(
+        source: *const libc::c_char,
+        target: *const libc::c_char,
+        fstype: *const libc::c_char,
+        flags: libc::c_ulong,
+        data: *const libc::c_char,
+    ) -> std::io::Result<()> {
+        if unsafe { libc::mount(source, target, fstype, flags, data.cast()) } != 0 {
+            return Err(std::io::Error::last_os_error());
+        }
+        Ok(())
+    }
+
+    /// `/proc/self/fd/<fd>` as a C string in `buf`, without allocating
+    fn fd_path(fd: libc::c_int, buf: &mut [u8; 32]) -> *const libc::c_char {
+        const PREFIX: &[u8] = b"/proc/self/fd/";
+        buf[..PREFIX.len()].copy_from_slice(PREFIX);
+        let mut digits = [0u8; 10];
+        let mut n = fd.unsigned_abs();
+        let mut len = 0;
+        loop {
+            digits[len] = b'0' + (n % 10) as u8;
+            len += 1;
+            n /= 10;
+            if n == 0 {
+                break;
+            }
+        }
+        for (i, digit) in digits[..len].iter().rev().enumerate() {
+            buf[PREFIX.len() + i] = *digit;
+        }
+        buf[PREFIX.len() + len] = 0;
+        buf.as_ptr().cast()
+    }
+
+    /// The writable mounts in a mountinfo table that `read_only` remounts,
+    /// with the per-mount flags each should keep
+    fn read_only_mounts(mountinfo: &str) -> Vec<(PathBuf, libc::c_ulong)> {
+        let mut mounts = Vec::new();
+        for line in mountinfo.lines() {
+            let fields: Vec<&str> = line.split(' ').collect();
+            let (Some(point), Some(options)) = (fields.get(4), fields.get(5)) else {
+                continue;
+            };
+            let point = PathBuf::from(unescape(point));
+            let pseudo = PSEUDO_ROOTS.iter().any(|root| point.starts_with(root));
+            if pseudo || options.split(',').any(|o| o == "ro") {
+                continue;
+            }
+            let flags = options
+                .split(',')
+                .map(|option| match option {
+                    "nosuid" => libc::MS_NOSUID,
+                    "nodev" => libc::MS_NODEV,
+                    "noexec" => libc::MS_NOEXEC,
+                    "noatime" => libc::MS_NOATIME,
+                    "nodiratime" => libc::MS_NODIRATIME,
+                    "relatime" => libc::MS_RELATIME,
+                    _ => 0,
+                })
+                .fold(0, |flags, flag| flags | flag);
+            mounts.push((point, flags));
+        }
+        mounts
+    }
+
+    /// Undo mountinfo's octal escapes (`\040` for a space)
+    fn unescape(field: &str) -> String {
+        let bytes = field.as_bytes();
+        let mut out = Vec::with_capacity(bytes.len());
+        let mut i = 0;
+        while i < bytes.len() {
+            let octal = bytes.get(i + 1..i + 4).and_then(|digits| {
+                let digits = std::str::from_utf8(digits).ok()?;
+                u8::from_str_radix(digits, 8).ok()
+            });
+            match (bytes[i], octal) {
+                (b'\\', Some(byte)) => {
+                    out.push(byte);
+                    i += 4;
+                }
+                (byte, _) => {
+                    out.push(byte);
+                    i += 1;
+                }
+            }
+        }
+        String::from_utf8_lossy(&out).into_owned()
+    }
+
+    #[cfg(test)]
+    mod tests {
+        use super::*;
+
+        #[test]
+        fn test_read_only_mounts_from_mountinfo() {
+            let mountinfo = "\
+22 1 8:1 / / rw,relatime shared:1 - ext4 /dev/sda1 rw
+23 22 0:5 / /proc rw,nosuid,nodev,noexec,relatime shared:2 - proc proc rw
+24 22 0:6 / /dev rw,nosuid shared:3 - devtmpfs udev rw
+25 22 8:2 / /srv/my\\040data rw,nosuid,nodev shared:4 - ext4 /dev/sda2 rw
+26 22 8:3 / /boot ro,relatime shared:5 - vfat /dev/sda3 ro
+";
+            let mounts = read_only_mounts(mountinfo);
+            assert_eq!(
+                mounts,
+                vec![
+                    (PathBuf::from("/"), libc::MS_RELATIME),
+                    (
+                        PathBuf::from("/srv/my data"),
+                        libc::MS_NOSUID | libc::MS_NODEV
+                    ),
+                ]
+            );
+        }
+
+        #[test]
+        fn test_fd_path() {
+            let mut buf = [0u8; 32];
+            let path = fd_path(127, &mut buf);
+            let path = unsafe { std::ffi::CStr::from_ptr(path) };
+            assert_eq!(path.to_str().unwrap(), "/proc/self/fd/127");
+            let path = fd_path(0, &mut buf);
+            let path = unsafe { std::ffi::CStr::from_ptr(path) };
+            assert_eq!(path.to_str().unwrap(), "/proc/self/fd/0");
+        }
+
+        #[test]
+        fn test_kept_paths_under_hidden_ones() {
+            let dir = tempfile::TempDir::new().unwrap();
+            let data = dir.path().join("data");
+            let own = data.join("api").join("prod");
+            std::fs::create_dir_all(&own).unwrap();
+            let sandbox = FsSandbox {
+                keep: vec![own.clone(), dir.path().to_path_buf()],
+                hide: vec![data.clone(), dir.path().join("missing")],
+                ..Default::default()
+            };
+            let socket = Path::new("/tmp/tenement/api-prod.sock");
+            let prepared = Prepared::new(&sandbox, socket, None).unwrap();
+            assert_eq!(prepared.hide, vec![c_path(&data).unwrap()]);
+            // Shallowest first; only the covered one is recreated in the tmpfs
+            assert_eq!(prepared.keep[0].path, c_path(dir.path()).unwrap());
+            assert!(prepared.keep[0].create.is_empty());
+            let create: Vec<CString> =
+                vec![c_path(&data.join("api")).unwrap(), c_path(&own).unwrap()];
+            assert_eq!(prepared.keep[1].create, create);
+
+            let sandbox = FsSandbox {
+                keep: vec![dir.path().join("nope")],
+                ..Default::default()
+            };
+            assert!(Prepared::new(&sandbox, socket, None).is_err());
+        }
+
+        #[test]
+        fn test_private_tmp_rejects_socket_in_tmp() {
+            let sandbox = FsSandbox {
+                private_tmp: true,
+                ..Default::default()
+            };
+            let err = Prepared::new(&sandbox, Path::new("/tmp/api.sock"), None)
+                .err()
+                .unwrap();
+            assert!(err.to_string().contains("private_tmp"), "{}", err);
+            assert!(Prepared::new(&sandbox, Path::new("/tmp/tenement/api.sock"), None).is_ok());
+        }
+    }
+}
@@ -148,15 +148,29 @@ impl Runtime for LiteBoxRuntime {
             .stderr(Stdio::piped())
             .kill_on_drop(true);
 
-        // Own process group so killing the runner kills the whole tree.
+        // Own process group so killing the runner kills the whole tree. The
+        // open file limit is inherited by the sandboxed app.
         #[cfg(unix)]
-        unsafe {
-            cmd.pre_exec(|| {
-                if libc::setpgid(0, 0) != 0 {
-                    return Err(std::io::Error::last_os_error());
-                }
-                Ok(())
-            });
+        {
+            let (nofile, run_as) = (config.nofile, config.run_as);
+            if let Some(limit) = nofile {
+                super::check_nofile(limit)?;
+            }
+            unsafe {
+                cmd.pre_exec(move || {
+                    if libc::setpgid(0, 0) != 0 {
+                        return Err(std::io::Error::last_os_error());
+                    }
+                    if let Some(limit) = nofile {
+                        super::set_nofile(limit)?;
+                    }
+                    // Last, while the child can still raise limits
+                    if let Some(run_as) = run_as {
+                        run_as.apply()?;
+                    }
+                    Ok(())
+                });
+            }
         }
 
         let child = cmd.spawn().with_context(|| {
@@ -205,6 +219,12 @@ mod tests {
             image: None,
             memory_limit_mb: None,
             cpu_shares: None,
+            cpu_max: None,
+            nofile: None,
+            run_as: None,
+            filesystem: None,
+            no_new_privileges: false,
+            netns: None,
         }
     }
 
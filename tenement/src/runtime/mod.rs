@@ -1,10 +1,13 @@
 //! Runtime abstraction for process and VM execution
 //!
 //! Provides a trait-based abstraction that allows different runtime backends
-//! (bare processes, Linux namespaces, Firecracker VMs, QEMU, etc.) to be used interchangeably.
+//! (bare processes, Linux namespaces, containers, Firecracker VMs, QEMU, etc.) to be used
+//! interchangeably.
 
+mod fs_sandbox;
 mod litebox;
 mod namespace;
+mod oci;
 mod process;
 
 #[cfg(feature = "firecracker")]
@@ -19,12 +22,13 @@ mod sandbox;
 #[cfg(feature = "quark")]
 mod quark;
 
-// Shared docker/containerd helper for the container runtimes (quark, sandbox).
-#[cfg(any(feature = "quark", feature = "sandbox"))]
+// Shared docker/containerd helper for the container runtimes (container, quark, sandbox).
 mod container;
 
+pub use fs_sandbox::FsSandbox;
 pub use litebox::LiteBoxRuntime;
 pub use namespace::NamespaceRuntime;
+pub use oci::ContainerRuntime;
 pub use process::ProcessRuntime;
 
 #[cfg(feature = "firecracker")]
@@ -39,6 +43,8 @@ pub use sandbox::SandboxRuntime;
 #[cfg(feature = "quark")]
 pub use quark::QuarkRuntime;
 
+use crate::redact::Redactor;
+use crate::users::RunAs;
 use anyhow::Result;
 use async_trait::async_trait;
 use serde::{Deserialize, Serialize};
@@ -61,6 +67,8 @@ pub enum RuntimeType {
     Litebox,
     /// Quark - KVM-backed OCI runtime that boots the bundle rootfs as the guest /
     Quark,
+    /// OCI image run by docker/containerd with the default runtime (runc)
+    Container,
     Firecracker,
     Qemu,
 }
@@ -73,12 +81,20 @@ impl std::fmt::Display for RuntimeType {
             RuntimeType::Sandbox => write!(f, "sandbox"),
             RuntimeType::Litebox => write!(f, "litebox"),
             RuntimeType::Quark => write!(f, "quark"),
+            RuntimeType::Container => write!(f, "container"),
             RuntimeType::Firecracker => write!(f, "firecracker"),
             RuntimeType::Qemu => write!(f, "qemu"),
         }
     }
 }
 
+impl RuntimeType {
+    /// Whether instances listen on a tenement-allocated TCP port (VMs use a socket instead)
+    pub fn uses_tcp_port(&self) -> bool {
+        !matches!(self, RuntimeType::Firecracker | RuntimeType::Qemu)
+    }
+}
+
 impl std::str::FromStr for RuntimeType {
     type Err = anyhow::Error;
 
@@ -89,9 +105,10 @@ impl std::str::FromStr for RuntimeType {
             "sandbox" | "gvisor" => Ok(RuntimeType::Sandbox),
             "litebox" => Ok(RuntimeType::Litebox),
             "quark" => Ok(RuntimeType::Quark),
+            "container" | "docker" | "oci" => Ok(RuntimeType::Container),
             "firecracker" => Ok(RuntimeType::Firecracker),
             "qemu" => Ok(RuntimeType::Qemu),
-            _ => anyhow::bail!("Unknown runtime type: {}. Use 'process', 'namespace', 'sandbox', 'litebox', 'quark', 'firecracker', or 'qemu'", s),
+            _ => anyhow::bail!("Unknown runtime type: {}. Use 'process', 'namespace', 'sandbox', 'litebox', 'quark', 'container', 'firecracker', or 'qemu'", s),
         }
     }
 }
@@ -151,6 +168,25 @@ pub enum RuntimeHandle {
         /// Socket path (unused for TCP routing; kept for the trait)
         socket: PathBuf,
     },
+    /// An OCI container run by docker/containerd with the default runtime.
+    /// Tracked by name like [`RuntimeHandle::Quark`]; `logs` follows its output.
+    Container {
+        /// docker container name
+        name: String,
+        /// Socket path, bind-mounted into the container at the same place
+        socket: PathBuf,
+        /// `docker logs -f`, whose stdout/stderr are the container's
+        logs: Child,
+    },
+    /// A process an earlier tenement started and handed over on upgrade. It
+    /// isn't our child, so it's watched with `kill(pid, 0)` rather than waited on.
+    Adopted {
+        /// Leader of the process's group
+        pid: u32,
+        socket: PathBuf,
+        /// Runtime it was started with
+        runtime: RuntimeType,
+    },
 }
 
 impl RuntimeHandle {
@@ -164,6 +200,8 @@ impl RuntimeHandle {
             RuntimeHandle::Qemu { serial_socket, .. } => serial_socket,
             RuntimeHandle::Sandbox { socket, .. } => socket,
             RuntimeHandle::Quark { socket, .. } => socket,
+            RuntimeHandle::Container { socket, .. } => socket,
+            RuntimeHandle::Adopted { socket, .. } => socket,
         }
     }
 
@@ -175,8 +213,10 @@ impl RuntimeHandle {
             RuntimeHandle::Litebox { .. } => RuntimeType::Litebox,
             RuntimeHandle::Sandbox { .. } => RuntimeType::Sandbox,
             RuntimeHandle::Quark { .. } => RuntimeType::Quark,
+            RuntimeHandle::Container { .. } => RuntimeType::Container,
             RuntimeHandle::Firecracker { .. } => RuntimeType::Firecracker,
             RuntimeHandle::Qemu { .. } => RuntimeType::Qemu,
+            RuntimeHandle::Adopted { runtime, .. } => *runtime,
         }
     }
 
@@ -200,11 +240,35 @@ impl RuntimeHandle {
             | RuntimeHandle::Namespace { child, .. }
             | RuntimeHandle::Litebox { child, .. } => child.id(),
             RuntimeHandle::Qemu { child, .. } => child.id(),
+            RuntimeHandle::Adopted { pid, .. } => Some(*pid),
             // VM/sandbox/container runtimes don't expose a simple PID
             RuntimeHandle::Firecracker { .. }
             | RuntimeHandle::Sandbox { .. }
-            | RuntimeHandle::Quark { .. } => None,
+            | RuntimeHandle::Quark { .. }
+            | RuntimeHandle::Container { .. } => None,
+        }
+    }
+
+    /// Ask the instance to exit with its stop signal. Returns false for runtimes
+    /// without a signalable child (VMs, containers), whose `kill` is already graceful.
+    pub fn terminate(&self, stop: StopSignal) -> bool {
+        let pid = match self {
+            RuntimeHandle::Process { child, .. }
+            | RuntimeHandle::Namespace { child, .. }
+            | RuntimeHandle::Litebox { child, .. } => child.id(),
+            RuntimeHandle::Adopted { pid, .. } => Some(*pid),
+            _ => None,
+        };
+        #[cfg(unix)]
+        if let Some(pid) = pid {
+            let target = if stop.process_group { -(pid as i32) } else { pid as i32 };
+            unsafe {
+                libc::kill(target, stop.signal);
+            }
+            return true;
         }
+        let _ = (pid, stop);
+        false
     }
 
     /// Kill the underlying process/VM
@@ -291,18 +355,30 @@ impl RuntimeHandle {
 
                 Ok(())
             }
+            RuntimeHandle::Adopted { pid, .. } => {
+                // Not ours to reap: its new parent (init) does, so wait for it to go
+                #[cfg(unix)]
+                {
+                    unsafe {
+                        libc::kill(-(*pid as i32), libc::SIGKILL);
+                    }
+                    for _ in 0..50 {
+                        if !pid_alive(*pid) {
+                            break;
+                        }
+                        tokio::time::sleep(std::time::Duration::from_millis(10)).await;
+                    }
+                }
+                #[cfg(not(unix))]
+                let _ = pid;
+                Ok(())
+            }
             RuntimeHandle::Quark { name, socket } | RuntimeHandle::Sandbox { name, socket } => {
                 // Container runtimes (quark, gVisor) run via docker; the
                 // container is owned by the daemon, so stop+remove it by name.
                 #[cfg(target_os = "linux")]
                 {
-                    use tokio::process::Command;
-                    let _ = Command::new("docker")
-                        .arg("rm")
-                        .arg("-f")
-                        .arg(name.as_str())
-                        .output()
-                        .await;
+                    container::linux::remove(name).await;
                     std::fs::remove_file(socket).ok();
                 }
                 #[cfg(not(target_os = "linux"))]
@@ -311,10 +387,26 @@ impl RuntimeHandle {
                 }
                 Ok(())
             }
+            RuntimeHandle::Container { name, socket, logs } => {
+                #[cfg(target_os = "linux")]
+                {
+                    container::linux::remove(name).await;
+                    std::fs::remove_file(socket).ok();
+                }
+                #[cfg(not(target_os = "linux"))]
+                {
+                    let _ = (name, socket);
+                }
+                // The log follower exits with the container; reap it
+                let _ = logs.kill().await;
+                let _ = logs.wait().await;
+                Ok(())
+            }
         }
     }
 
     /// Helper to send quit command via QMP (QEMU Machine Protocol)
+    #[cfg(unix)]
     #[allow(dead_code)]
     async fn qemu_qmp_quit(socket_path: &PathBuf) -> Result<()> {
         use tokio::io::{AsyncBufReadExt, AsyncWriteExt, BufReader};
@@ -377,17 +469,14 @@ impl RuntimeHandle {
                 // try_wait returns Ok(Some(status)) if exited, Ok(None) if still running
                 matches!(child.try_wait(), Ok(None))
             }
-            RuntimeHandle::Quark { name, .. } | RuntimeHandle::Sandbox { name, .. } => {
-                // Container runtimes (quark, gVisor): ask docker.
+            RuntimeHandle::Adopted { pid, .. } => pid_alive(*pid),
+            RuntimeHandle::Quark { name, .. }
+            | RuntimeHandle::Sandbox { name, .. }
+            | RuntimeHandle::Container { name, .. } => {
+                // Container runtimes (container, quark, gVisor): ask docker.
                 #[cfg(target_os = "linux")]
                 {
-                    use tokio::process::Command;
-                    let out = Command::new("docker")
-                        .args(["inspect", "-f", "{{.State.Running}}", name.as_str()])
-                        .output()
-                        .await;
-                    matches!(out, Ok(o) if o.status.success()
-                        && String::from_utf8_lossy(&o.stdout).trim() == "true")
+                    container::linux::is_running(name).await
                 }
                 #[cfg(not(target_os = "linux"))]
                 {
@@ -399,6 +488,80 @@ impl RuntimeHandle {
     }
 }
 
+/// Whether a process with this pid still exists
+pub(crate) fn pid_alive(pid: u32) -> bool {
+    #[cfg(unix)]
+    {
+        unsafe { libc::kill(pid as i32, 0) == 0 }
+    }
+    #[cfg(not(unix))]
+    {
+        let _ = pid;
+        false
+    }
+}
+
+/// How an instance is asked to exit before it's killed: a service's
+/// `stop_signal`, sent to its process group or only its main process
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct StopSignal {
+    pub signal: i32,
+    pub process_group: bool,
+}
+
+impl Default for StopSignal {
+    fn default() -> Self {
+        Self {
+            // SIGTERM is 15 everywhere
+            signal: 15,
+            process_group: true,
+        }
+    }
+}
+
+/// Parse a `stop_signal`: the names reload signals take, plus "SIGKILL" and
+/// "SIGALRM", or a signal number
+#[cfg(unix)]
+pub fn parse_stop_signal(name: &str) -> Result<i32> {
+    let trimmed = name.trim();
+    if let Ok(number) = trimmed.parse::<i32>() {
+        // Signal 0 only checks the process exists
+        if !(1..=64).contains(&number) {
+            anyhow::bail!("Signal number {} is out of range (1-64)", number);
+        }
+        return Ok(number);
+    }
+    let upper = trimmed.to_ascii_uppercase();
+    match upper.strip_prefix("SIG").unwrap_or(&upper) {
+        "KILL" => Ok(libc::SIGKILL),
+        "ALRM" => Ok(libc::SIGALRM),
+        _ => crate::secrets::parse_signal(name).map_err(|_| {
+            anyhow::anyhow!(
+                "Unsupported stop signal '{}'. Use one of: SIGTERM, SIGINT, SIGQUIT, \
+                 SIGHUP, SIGUSR1, SIGUSR2, SIGWINCH, SIGALRM, SIGKILL, or a number",
+                name
+            )
+        }),
+    }
+}
+
+impl StopSignal {
+    /// A service's `stop_signal` and `stop_process_group`
+    pub fn for_service(config: &crate::config::ProcessConfig) -> Self {
+        #[cfg(unix)]
+        let signal = config
+            .stop_signal
+            .as_deref()
+            .and_then(|name| parse_stop_signal(name).ok());
+        #[cfg(not(unix))]
+        let signal = None;
+        Self {
+            signal: signal.unwrap_or(Self::default().signal),
+            process_group: config.stop_process_group,
+        }
+    }
+}
+
 /// A host->guest bind mount (used by OCI runtimes like Quark).
 #[derive(Debug, Clone)]
 pub struct Mount {
@@ -411,7 +574,7 @@ pub struct Mount {
 }
 
 /// Configuration for spawning an instance
-#[derive(Debug, Clone, Default)]
+#[derive(Clone, Default)]
 pub struct SpawnConfig {
     /// Command to run (for process runtime)
     pub command: String,
@@ -432,7 +595,7 @@ pub struct SpawnConfig {
     /// Host->guest bind mounts (Quark): e.g. app data dir -> /data.
     pub mounts: Vec<Mount>,
     /// OCI image reference to run (container runtimes that go through
-    /// docker/containerd, e.g. Quark via `docker run --runtime=quark`).
+    /// docker/containerd, e.g. `container`, or Quark via `docker run --runtime=quark`).
     pub image: Option<String>,
     /// Memory limit in MB for container runtimes. Process-like runtimes use
     /// Tenement's cgroup manager instead.
@@ -440,6 +603,45 @@ pub struct SpawnConfig {
     /// CPU weight/shares for container runtimes. Process-like runtimes use
     /// Tenement's cgroup manager instead.
     pub cpu_shares: Option<u32>,
+    /// CPU cap in cores for container runtimes. Process-like runtimes use
+    /// Tenement's cgroup manager instead.
+    pub cpu_max: Option<f64>,
+    /// Open file limit (RLIMIT_NOFILE) for the spawned process
+    pub nofile: Option<u64>,
+    /// User and group to switch to before exec (None = tenement's own)
+    pub run_as: Option<RunAs>,
+    /// Read-only root, private /tmp and hidden paths (namespace runtime)
+    pub filesystem: Option<FsSandbox>,
+    /// Set no_new_privs before exec (Linux)
+    pub no_new_privileges: bool,
+    /// Network namespace to join before exec, as an open descriptor
+    /// (namespace runtime)
+    pub netns: Option<i32>,
+}
+
+/// Sensitive env values are masked so spawn configs are safe to log
+impl std::fmt::Debug for SpawnConfig {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        f.debug_struct("SpawnConfig")
+            .field("command", &self.command)
+            .field("args", &self.args)
+            .field("env", &Redactor::default().redact_env(&self.env))
+            .field("socket", &self.socket)
+            .field("workdir", &self.workdir)
+            .field("vm_config", &self.vm_config)
+            .field("rootfs", &self.rootfs)
+            .field("mounts", &self.mounts)
+            .field("image", &self.image)
+            .field("memory_limit_mb", &self.memory_limit_mb)
+            .field("cpu_shares", &self.cpu_shares)
+            .field("cpu_max", &self.cpu_max)
+            .field("nofile", &self.nofile)
+            .field("run_as", &self.run_as)
+            .field("filesystem", &self.filesystem)
+            .field("no_new_privileges", &self.no_new_privileges)
+            .field("netns", &self.netns)
+            .finish()
+    }
 }
 
 /// Firecracker VM configuration
@@ -469,6 +671,51 @@ impl Default for VmConfig {
     }
 }
 
+/// Fail before fork when an open file limit can't be granted, rather than with a
+/// bare EPERM from the child
+#[cfg(unix)]
+pub(crate) fn check_nofile(limit: u64) -> Result<()> {
+    let mut current = libc::rlimit {
+        rlim_cur: 0,
+        rlim_max: 0,
+    };
+    if unsafe { libc::getrlimit(libc::RLIMIT_NOFILE, &mut current) } != 0 {
+        return Ok(());
+    }
+    if limit as libc::rlim_t > current.rlim_max && unsafe { libc::geteuid() } != 0 {
+        anyhow::bail!(
+            "limits.nofile {} is above tenement's hard limit of {}; raise it (ulimit -Hn) \
+             or run tenement as root",
+            limit,
+            current.rlim_max
+        );
+    }
+    Ok(())
+}
+
+/// Set RLIMIT_NOFILE in the forked child. Only called from `pre_exec`, so it
+/// must not allocate.
+#[cfg(unix)]
+pub(crate) fn set_nofile(limit: u64) -> std::io::Result<()> {
+    let rlim = libc::rlimit {
+        rlim_cur: limit as libc::rlim_t,
+        rlim_max: limit as libc::rlim_t,
+    };
+    if unsafe { libc::setrlimit(libc::RLIMIT_NOFILE, &rlim) } != 0 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(())
+}
+
+/// Set no_new_privs in the forked child, so exec can't raise privileges
+#[cfg(target_os = "linux")]
+pub(crate) fn set_no_new_privs() -> std::io::Result<()> {
+    if unsafe { libc::prctl(libc::PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0) } != 0 {
+        return Err(std::io::Error::last_os_error());
+    }
+    Ok(())
+}
+
 /// Trait for runtime backends
 ///
 /// Implement this trait to add new runtime types (process, Firecracker, WASM, etc.)
@@ -491,6 +738,33 @@ pub trait Runtime: Send + Sync {
 mod tests {
     use super::*;
 
+    #[cfg(unix)]
+    #[test]
+    fn test_parse_stop_signal() {
+        assert_eq!(parse_stop_signal("SIGQUIT").unwrap(), libc::SIGQUIT);
+        assert_eq!(parse_stop_signal("int").unwrap(), libc::SIGINT);
+        assert_eq!(parse_stop_signal("KILL").unwrap(), libc::SIGKILL);
+        assert_eq!(parse_stop_signal(" 10 ").unwrap(), 10);
+        for bad in ["SIGSTOP", "nope", "0", "65", "-1"] {
+            assert!(parse_stop_signal(bad).is_err(), "{}", bad);
+        }
+    }
+
+    #[test]
+    fn test_stop_signal_for_service() {
+        let config =
+            crate::config::Config::from_str("[service.api]\ncommand = \"./api\"\n").unwrap();
+        let mut api = config.get_service("api").unwrap().clone();
+        assert_eq!(StopSignal::for_service(&api), StopSignal::default());
+        api.stop_process_group = false;
+        assert!(!StopSignal::for_service(&api).process_group);
+        #[cfg(unix)]
+        {
+            api.stop_signal = Some("SIGINT".to_string());
+            assert_eq!(StopSignal::for_service(&api).signal, libc::SIGINT);
+        }
+    }
+
     #[test]
     fn test_runtime_type_default() {
         let rt: RuntimeType = Default::default();
@@ -504,6 +778,7 @@ mod tests {
         assert_eq!(RuntimeType::Sandbox.to_string(), "sandbox");
         assert_eq!(RuntimeType::Litebox.to_string(), "litebox");
         assert_eq!(RuntimeType::Quark.to_string(), "quark");
+        assert_eq!(RuntimeType::Container.to_string(), "container");
         assert_eq!(RuntimeType::Firecracker.to_string(), "firecracker");
         assert_eq!(RuntimeType::Qemu.to_string(), "qemu");
     }
@@ -531,6 +806,14 @@ mod tests {
             RuntimeType::Litebox
         );
         assert_eq!("quark".parse::<RuntimeType>().unwrap(), RuntimeType::Quark);
+        assert_eq!(
+            "container".parse::<RuntimeType>().unwrap(),
+            RuntimeType::Container
+        );
+        assert_eq!(
+            "docker".parse::<RuntimeType>().unwrap(),
+            RuntimeType::Container
+        );
         assert_eq!(
             "firecracker".parse::<RuntimeType>().unwrap(),
             RuntimeType::Firecracker
@@ -600,6 +883,9 @@ mod tests {
 
         let parsed_qemu: RuntimeType = serde_json::from_str("\"qemu\"").unwrap();
         assert_eq!(parsed_qemu, RuntimeType::Qemu);
+
+        let parsed_container: RuntimeType = serde_json::from_str("\"container\"").unwrap();
+        assert_eq!(parsed_container, RuntimeType::Container);
     }
 
     #[test]
@@ -609,4 +895,22 @@ mod tests {
         assert_eq!(config.vcpus, 1);
         assert_eq!(config.vsock_port, 5000);
     }
+
+    #[test]
+    fn test_spawn_config_debug_redacts_env() {
+        let config = SpawnConfig {
+            command: "./app".to_string(),
+            env: HashMap::from([
+                ("API_TOKEN".to_string(), "tok-live-abc123".to_string()),
+                ("DB_PASSWORD".to_string(), "hunter22".to_string()),
+                ("PORT".to_string(), "8080".to_string()),
+            ]),
+            ..Default::default()
+        };
+        let debug = format!("{:?}", config);
+        assert!(!debug.contains("tok-live-abc123"));
+        assert!(!debug.contains("hunter22"));
+        assert!(debug.contains("\"PORT\": \"8080\""));
+        assert!(debug.contains("./app"));
+    }
 }
@@ -95,12 +95,39 @@ mod linux_impl {
             None
         };
 
+        let (nofile, run_as) = (config.nofile, config.run_as);
+        if let Some(limit) = nofile {
+            crate::runtime::check_nofile(limit)?;
+        }
+        let (no_new_privileges, netns) = (config.no_new_privileges, config.netns);
+        let mut sandbox = match &config.filesystem {
+            Some(sandbox) => Some(
+                crate::runtime::fs_sandbox::Prepared::new(
+                    sandbox,
+                    &config.socket,
+                    config.workdir.as_deref(),
+                )
+                .context("Failed to prepare the filesystem sandbox")?,
+            ),
+            None => None,
+        };
+
         unsafe {
             cmd.pre_exec(move || {
                 // Put child in its own process group so we can kill all descendants
                 if libc::setpgid(0, 0) != 0 {
                     return Err(std::io::Error::last_os_error());
                 }
+                if let Some(limit) = nofile {
+                    crate::runtime::set_nofile(limit)?;
+                }
+
+                // Join the network namespace tenement made for its egress policy
+                if let Some(fd) = netns {
+                    if libc::setns(fd, libc::CLONE_NEWNET) != 0 {
+                        return Err(std::io::Error::last_os_error());
+                    }
+                }
 
                 use nix::mount::{mount, MsFlags};
                 use nix::sched::{unshare, CloneFlags};
@@ -159,6 +186,9 @@ mod linux_impl {
                         std::io::Error::other(format!("/proc mount in rootfs failed: {}", e))
                     })?;
                 } else {
+                    if let Some(sandbox) = sandbox.as_mut() {
+                        sandbox.apply()?;
+                    }
                     // Legacy path: no rootfs, mount /proc on host's /proc.
                     // Best-effort; missing CAP_SYS_ADMIN is tolerated here for back-compat.
                     let _ = mount(
@@ -170,6 +200,14 @@ mod linux_impl {
                     );
                 }
 
+                // Drop privileges last: the namespace setup above needs root
+                if let Some(run_as) = run_as {
+                    run_as.apply()?;
+                }
+                if no_new_privileges {
+                    crate::runtime::set_no_new_privs()?;
+                }
+
                 Ok(())
             });
         }
@@ -0,0 +1,123 @@
+//! Container runtime - plain OCI images, via docker/containerd.
+//!
+//! `isolation = "container"` (or `runtime = "container"`) runs the service's
+//! `image` with the daemon's default runtime (runc): Tenement pulls the image
+//! when it isn't present, then starts it with `docker run -d --network host`
+//! (shared logic in [`super::container`]). PORT and SOCKET_PATH are passed in
+//! the environment, and the socket's directory is bind-mounted at the same
+//! path, so the app listens the way a native process would. Output is followed
+//! with `docker logs -f` and captured into the log buffer; the container is
+//! tracked by name and reaped with `docker rm -f` ([`RuntimeHandle::Container`]).
+//!
+//! Linux only; requires docker, or a docker-compatible CLI such as `nerdctl`
+//! set in `TENEMENT_CONTAINER_CLI`.
+
+use super::{Runtime, RuntimeHandle, RuntimeType, SpawnConfig};
+use anyhow::Result;
+use async_trait::async_trait;
+
+/// Runtime that runs OCI images via `docker run` with the default runtime.
+pub struct ContainerRuntime;
+
+impl ContainerRuntime {
+    pub fn new() -> Self {
+        Self
+    }
+}
+
+impl Default for ContainerRuntime {
+    fn default() -> Self {
+        Self::new()
+    }
+}
+
+/// `config` plus a bind mount of the socket's directory, so SOCKET_PATH
+/// resolves to the same file inside the container
+#[cfg_attr(not(target_os = "linux"), allow(dead_code))]
+fn with_socket_dir(config: &SpawnConfig) -> SpawnConfig {
+    let mut config = config.clone();
+    if let Some(dir) = config.socket.parent().filter(|dir| dir.is_absolute()) {
+        if !config.mounts.iter().any(|m| m.destination == dir) {
+            config.mounts.push(super::Mount {
+                source: dir.to_path_buf(),
+                destination: dir.to_path_buf(),
+                readonly: false,
+            });
+        }
+    }
+    config
+}
+
+#[async_trait]
+impl Runtime for ContainerRuntime {
+    async fn spawn(&self, config: &SpawnConfig) -> Result<RuntimeHandle> {
+        #[cfg(target_os = "linux")]
+        {
+            use super::container::linux;
+            if let Some(image) = &config.image {
+                linux::pull(image).await?;
+            }
+            let name = linux::run(None, &with_socket_dir(config)).await?;
+            let logs = match linux::follow_logs(&name) {
+                Ok(logs) => logs,
+                Err(e) => {
+                    linux::remove(&name).await;
+                    return Err(e);
+                }
+            };
+            Ok(RuntimeHandle::Container {
+                name,
+                socket: config.socket.clone(),
+                logs,
+            })
+        }
+        #[cfg(not(target_os = "linux"))]
+        {
+            let _ = config;
+            anyhow::bail!(
+                "Container runtime requires Linux + docker (or a docker-compatible CLI \
+                 in TENEMENT_CONTAINER_CLI). Use isolation = \"process\" for local dev."
+            )
+        }
+    }
+
+    fn runtime_type(&self) -> RuntimeType {
+        RuntimeType::Container
+    }
+
+    fn is_available(&self) -> bool {
+        super::container::docker_available()
+    }
+
+    fn name(&self) -> &'static str {
+        "container"
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::path::PathBuf;
+
+    #[test]
+    fn test_container_runtime_type_and_name() {
+        let rt = ContainerRuntime::new();
+        assert_eq!(rt.runtime_type(), RuntimeType::Container);
+        assert_eq!(rt.name(), "container");
+    }
+
+    #[test]
+    fn test_socket_dir_is_mounted_once() {
+        let config = SpawnConfig {
+            socket: PathBuf::from("/tmp/tenement/api-prod.sock"),
+            ..Default::default()
+        };
+        let config = with_socket_dir(&config);
+        assert_eq!(config.mounts.len(), 1);
+        assert_eq!(config.mounts[0].source, PathBuf::from("/tmp/tenement"));
+        assert_eq!(config.mounts[0].destination, PathBuf::from("/tmp/tenement"));
+        assert!(!config.mounts[0].readonly);
+
+        assert_eq!(with_socket_dir(&config).mounts.len(), 1);
+    }
+}
@@ -40,15 +40,37 @@ impl Runtime for ProcessRuntime {
             .stderr(Stdio::piped())
             .kill_on_drop(true);
 
-        // Put child in its own process group so we can kill all descendants
+        // Put child in its own process group so we can kill all descendants,
+        // apply the open file limit, and switch users
         #[cfg(unix)]
-        unsafe {
-            cmd.pre_exec(|| {
-                if libc::setpgid(0, 0) != 0 {
-                    return Err(std::io::Error::last_os_error());
-                }
-                Ok(())
-            });
+        {
+            let (nofile, run_as) = (config.nofile, config.run_as);
+            if let Some(limit) = nofile {
+                super::check_nofile(limit)?;
+            }
+            let no_new_privileges = config.no_new_privileges;
+            if no_new_privileges && !cfg!(target_os = "linux") {
+                anyhow::bail!("filesystem.no_new_privileges needs Linux");
+            }
+            unsafe {
+                cmd.pre_exec(move || {
+                    if libc::setpgid(0, 0) != 0 {
+                        return Err(std::io::Error::last_os_error());
+                    }
+                    if let Some(limit) = nofile {
+                        super::set_nofile(limit)?;
+                    }
+                    // Last, while the child can still raise limits
+                    if let Some(run_as) = run_as {
+                        run_as.apply()?;
+                    }
+                    #[cfg(target_os = "linux")]
+                    if no_new_privileges {
+                        super::set_no_new_privs()?;
+                    }
+                    Ok(())
+                });
+            }
         }
 
         if let Some(workdir) = &config.workdir {
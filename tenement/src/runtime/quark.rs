@@ -32,7 +32,7 @@ impl Runtime for QuarkRuntime {
     async fn spawn(&self, config: &SpawnConfig) -> Result<RuntimeHandle> {
         #[cfg(target_os = "linux")]
         {
-            let name = super::container::linux::run("quark", config).await?;
+            let name = super::container::linux::run(Some("quark"), config).await?;
             Ok(RuntimeHandle::Quark {
                 name,
                 socket: config.socket.clone(),
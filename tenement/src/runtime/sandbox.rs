@@ -32,7 +32,7 @@ impl Runtime for SandboxRuntime {
     async fn spawn(&self, config: &SpawnConfig) -> Result<RuntimeHandle> {
         #[cfg(target_os = "linux")]
         {
-            let name = super::container::linux::run("runsc", config).await?;
+            let name = super::container::linux::run(Some("runsc"), config).await?;
             Ok(RuntimeHandle::Sandbox {
                 name,
                 socket: config.socket.clone(),
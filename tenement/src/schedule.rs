@@ -0,0 +1,252 @@
+//! Cron schedules for `[jobs]`
+//!
+//! Five fields, `minute hour day-of-month month day-of-week`, each `*`, a value,
+//! a range (`1-5`), a step (`*/15`, `10-50/10`) or a comma list of those. Months
+//! and weekdays also take names (`jan`, `mon`), and Sunday is 0 or 7. As in
+//! Vixie cron, when both day fields are restricted a day matching either runs.
+//! Macros: `@yearly`, `@monthly`, `@weekly`, `@daily` (`@midnight`), `@hourly`.
+
+use anyhow::{Context, Result};
+use chrono::{DateTime, Datelike, Duration, NaiveDate, NaiveDateTime, TimeZone, Timelike, Utc};
+
+const MONTH_NAMES: [&str; 12] = [
+    "jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec",
+];
+const WEEKDAY_NAMES: [&str; 7] = ["sun", "mon", "tue", "wed", "thu", "fri", "sat"];
+
+/// How far ahead to look for the next run before giving up (e.g. "0 0 30 2 *")
+const SEARCH_YEARS: i64 = 5;
+
+/// A parsed cron expression; each field is a bitset of the values it allows
+#[derive(Debug, Clone, PartialEq, Eq)]
+pub struct Schedule {
+    minutes: u64,
+    hours: u64,
+    days: u64,
+    months: u64,
+    /// Sunday = 0
+    weekdays: u64,
+    /// Either day field was written as `*...`, so both must match
+    days_and: bool,
+}
+
+impl Schedule {
+    pub fn parse(expr: &str) -> Result<Self> {
+        let expr = expr.trim();
+        let expanded = match expr {
+            "@yearly" | "@annually" => "0 0 1 1 *",
+            "@monthly" => "0 0 1 * *",
+            "@weekly" => "0 0 * * 0",
+            "@daily" | "@midnight" => "0 0 * * *",
+            "@hourly" => "0 * * * *",
+            _ => expr,
+        };
+        let fields: Vec<&str> = expanded.split_whitespace().collect();
+        if fields.len() != 5 {
+            anyhow::bail!(
+                "cron schedule {:?} needs 5 fields: minute hour day-of-month month day-of-week",
+                expr
+            );
+        }
+        let field = |index: usize, name: &str, min: u32, max: u32, names: &[&str]| {
+            parse_field(fields[index], min, max, names).with_context(|| {
+                format!("invalid {} field {:?} in {:?}", name, fields[index], expr)
+            })
+        };
+
+        let mut weekdays = field(4, "day-of-week", 0, 7, &WEEKDAY_NAMES)?;
+        if weekdays & (1 << 7) != 0 {
+            weekdays = (weekdays & !(1 << 7)) | 1;
+        }
+        Ok(Self {
+            minutes: field(0, "minute", 0, 59, &[])?,
+            hours: field(1, "hour", 0, 23, &[])?,
+            days: field(2, "day-of-month", 1, 31, &[])?,
+            months: field(3, "month", 1, 12, &MONTH_NAMES)?,
+            weekdays,
+            days_and: fields[2].starts_with('*') || fields[4].starts_with('*'),
+        })
+    }
+
+    /// Whether the schedule fires at this wall-clock minute
+    pub fn matches(&self, time: &NaiveDateTime) -> bool {
+        has(self.months, time.month())
+            && self.day_matches(time.date())
+            && has(self.hours, time.hour())
+            && has(self.minutes, time.minute())
+    }
+
+    fn day_matches(&self, date: NaiveDate) -> bool {
+        let day = has(self.days, date.day());
+        let weekday = has(self.weekdays, date.weekday().num_days_from_sunday());
+        if self.days_and {
+            day && weekday
+        } else {
+            day || weekday
+        }
+    }
+
+    /// The first time strictly after `after` that the schedule fires, reading it
+    /// as wall-clock time in `tz`. Minutes skipped by a DST change don't run; a
+    /// minute repeated by one runs the first time. None if it never fires.
+    pub fn next_after<Tz: TimeZone>(&self, after: DateTime<Utc>, tz: &Tz) -> Option<DateTime<Utc>> {
+        let local = after.with_timezone(tz).naive_local();
+        let mut time = local.with_second(0)?.with_nanosecond(0)? + Duration::minutes(1);
+        let limit = time + Duration::days(366 * SEARCH_YEARS);
+        while time < limit {
+            if !has(self.months, time.month()) {
+                let (year, month) = match time.month() {
+                    12 => (time.year() + 1, 1),
+                    month => (time.year(), month + 1),
+                };
+                time = NaiveDate::from_ymd_opt(year, month, 1)?.and_hms_opt(0, 0, 0)?;
+            } else if !self.day_matches(time.date()) {
+                time = time.date().succ_opt()?.and_hms_opt(0, 0, 0)?;
+            } else if !has(self.hours, time.hour()) {
+                time = time.with_minute(0)? + Duration::hours(1);
+            } else if !has(self.minutes, time.minute()) {
+                time += Duration::minutes(1);
+            } else {
+                let fires = tz
+                    .from_local_datetime(&time)
+                    .earliest()
+                    .map(|t| t.with_timezone(&Utc))
+                    .filter(|t| *t > after);
+                if fires.is_some() {
+                    return fires;
+                }
+                time += Duration::minutes(1);
+            }
+        }
+        None
+    }
+}
+
+fn has(bits: u64, value: u32) -> bool {
+    bits & (1 << value) != 0
+}
+
+/// One field as a bitset of allowed values
+fn parse_field(field: &str, min: u32, max: u32, names: &[&str]) -> Result<u64> {
+    let value = |text: &str| -> Result<u32> {
+        let lower = text.to_ascii_lowercase();
+        let value = match names.iter().position(|name| *name == lower) {
+            Some(index) => index as u32 + min,
+            None => text.parse().with_context(|| format!("{:?} is not a number", text))?,
+        };
+        if value < min || value > max {
+            anyhow::bail!("{} is outside {}-{}", value, min, max);
+        }
+        Ok(value)
+    };
+
+    let mut bits = 0u64;
+    for part in field.split(',') {
+        let (range, step) = match part.split_once('/') {
+            Some((range, step)) => {
+                let step: u32 = step
+                    .parse()
+                    .ok()
+                    .filter(|step| *step > 0)
+                    .with_context(|| format!("invalid step {:?}", step))?;
+                (range, Some(step))
+            }
+            None => (part, None),
+        };
+        let (start, end) = match range.split_once('-') {
+            _ if range == "*" => (min, max),
+            Some((start, end)) => (value(start)?, value(end)?),
+            // "5/15" means from 5 to the end, every 15
+            None if step.is_some() => (value(range)?, max),
+            None => {
+                let value = value(range)?;
+                (value, value)
+            }
+        };
+        if start > end {
+            anyhow::bail!("range {}-{} is backwards", start, end);
+        }
+        for value in (start..=end).step_by(step.unwrap_or(1) as usize) {
+            bits |= 1 << value;
+        }
+    }
+    Ok(bits)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn at(text: &str) -> DateTime<Utc> {
+        DateTime::parse_from_rfc3339(text).unwrap().with_timezone(&Utc)
+    }
+
+    fn next(expr: &str, after: &str) -> String {
+        Schedule::parse(expr)
+            .unwrap()
+            .next_after(at(after), &Utc)
+            .unwrap()
+            .to_rfc3339()
+    }
+
+    #[test]
+    fn test_parse_fields() {
+        let schedule = Schedule::parse("*/15 9-17 * * mon-fri").unwrap();
+        let time = |text: &str| at(text).naive_utc();
+        // 2026-10-14 is a Wednesday
+        assert!(schedule.matches(&time("2026-10-14T09:45:00Z")));
+        assert!(!schedule.matches(&time("2026-10-14T09:50:00Z")));
+        assert!(!schedule.matches(&time("2026-10-14T18:00:00Z")));
+        assert!(!schedule.matches(&time("2026-10-17T10:00:00Z")));
+
+        let lists = Schedule::parse("0,30 0 1,15 JAN,jul 7").unwrap();
+        assert!(lists.matches(&time("2026-07-15T00:30:00Z")));
+        // Sunday (7) also matches outside the listed days of the month
+        assert!(lists.matches(&time("2026-07-05T00:00:00Z")));
+        assert!(!lists.matches(&time("2026-08-15T00:00:00Z")));
+    }
+
+    #[test]
+    fn test_parse_rejects_invalid() {
+        for (expr, expected) in [
+            ("* * * *", "needs 5 fields"),
+            ("60 * * * *", "outside 0-59"),
+            ("* * 0 * *", "outside 1-31"),
+            ("*/0 * * * *", "invalid step"),
+            ("10-5 * * * *", "backwards"),
+            ("* * * smarch *", "not a number"),
+        ] {
+            let err = format!("{:#}", Schedule::parse(expr).unwrap_err());
+            assert!(err.contains(expected), "{}: {}", expr, err);
+        }
+    }
+
+    #[test]
+    fn test_next_after() {
+        assert_eq!(next("*/15 * * * *", "2026-10-14T09:07:30Z"), "2026-10-14T09:15:00+00:00");
+        // Strictly after: a run due exactly now is the next one
+        assert_eq!(next("*/15 * * * *", "2026-10-14T09:15:00Z"), "2026-10-14T09:30:00+00:00");
+        assert_eq!(next("@daily", "2026-10-14T09:07:00Z"), "2026-10-15T00:00:00+00:00");
+        assert_eq!(next("@monthly", "2026-12-14T09:07:00Z"), "2027-01-01T00:00:00+00:00");
+        assert_eq!(next("0 12 * * fri", "2026-10-14T09:07:00Z"), "2026-10-16T12:00:00+00:00");
+        assert_eq!(next("0 0 29 2 *", "2026-10-14T09:07:00Z"), "2028-02-29T00:00:00+00:00");
+    }
+
+    #[test]
+    fn test_next_after_never() {
+        let schedule = Schedule::parse("0 0 31 2 *").unwrap();
+        assert_eq!(schedule.next_after(at("2026-10-14T00:00:00Z"), &Utc), None);
+    }
+
+    #[test]
+    fn test_next_after_in_timezone() {
+        let tz: chrono_tz::Tz = "America/New_York".parse().unwrap();
+        let schedule = Schedule::parse("30 2 * * *").unwrap();
+        // 02:30 New York is 06:30 UTC in summer
+        let run = schedule.next_after(at("2026-07-01T00:00:00Z"), &tz).unwrap();
+        assert_eq!(run.to_rfc3339(), "2026-07-01T06:30:00+00:00");
+        // 2027-03-14 has no 02:30 (clocks jump to 03:00), so that day is skipped
+        let run = schedule.next_after(at("2027-03-14T05:00:00Z"), &tz).unwrap();
+        assert_eq!(run.to_rfc3339(), "2027-03-15T06:30:00+00:00");
+    }
+}
@@ -0,0 +1,245 @@
+//! Encrypted secret store
+//!
+//! `tenement secrets set NAME` keeps values in `{data_dir}/secrets.enc`,
+//! encrypted with AES-256-GCM. Services list the names they need
+//! (`secrets = ["DATABASE_URL"]`) and get them as env vars at spawn, so
+//! values never appear in tenement.toml.
+//!
+//! The master key is read from `TENEMENT_MASTER_KEY` (base64, 32 bytes), or
+//! from `{data_dir}/master.key`, which is generated on first `set`.
+
+use aes_gcm::aead::{Aead, KeyInit};
+use aes_gcm::{Aes256Gcm, Key, Nonce};
+use anyhow::{Context, Result};
+use base64::{engine::general_purpose::STANDARD, Engine};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::path::{Path, PathBuf};
+
+/// Encrypted store file, in the data directory
+pub const STORE_FILE_NAME: &str = "secrets.enc";
+
+/// Master key file, used when TENEMENT_MASTER_KEY isn't set
+pub const KEY_FILE_NAME: &str = "master.key";
+
+/// Env var holding the base64 master key
+pub const MASTER_KEY_ENV: &str = "TENEMENT_MASTER_KEY";
+
+const KEY_LEN: usize = 32;
+const NONCE_LEN: usize = 12;
+
+/// On-disk format: a fresh nonce for every write, and the sealed JSON map
+#[derive(Serialize, Deserialize)]
+struct SealedStore {
+    version: u32,
+    nonce: String,
+    ciphertext: String,
+}
+
+/// Decrypted secrets, written back with `save`
+pub struct SecretStore {
+    path: PathBuf,
+    key: [u8; KEY_LEN],
+    values: BTreeMap<String, String>,
+}
+
+impl SecretStore {
+    /// Open the store in `data_dir`. A missing store is empty; a missing key is an
+    /// error, since nothing could have been stored without one.
+    pub fn open(data_dir: &Path) -> Result<Self> {
+        let key = load_key(data_dir, false)?;
+        Self::open_with_key(data_dir, key)
+    }
+
+    /// Open the store for writing, generating the key file if there's no key yet
+    pub fn open_or_init(data_dir: &Path) -> Result<Self> {
+        let key = load_key(data_dir, true)?;
+        Self::open_with_key(data_dir, key)
+    }
+
+    fn open_with_key(data_dir: &Path, key: [u8; KEY_LEN]) -> Result<Self> {
+        let path = data_dir.join(STORE_FILE_NAME);
+        let values = if path.exists() {
+            let content = std::fs::read_to_string(&path)
+                .with_context(|| format!("Failed to read secret store {}", path.display()))?;
+            decrypt(&key, &content)
+                .with_context(|| format!("Failed to decrypt secret store {}", path.display()))?
+        } else {
+            BTreeMap::new()
+        };
+        Ok(Self { path, key, values })
+    }
+
+    pub fn get(&self, name: &str) -> Option<&str> {
+        self.values.get(name).map(String::as_str)
+    }
+
+    pub fn set(&mut self, name: &str, value: &str) {
+        self.values.insert(name.to_string(), value.to_string());
+    }
+
+    /// Remove a secret; false if it wasn't there
+    pub fn remove(&mut self, name: &str) -> bool {
+        self.values.remove(name).is_some()
+    }
+
+    /// Secret names, sorted
+    pub fn names(&self) -> impl Iterator<Item = &str> {
+        self.values.keys().map(String::as_str)
+    }
+
+    /// Encrypt and write the store, readable only by the owner
+    pub fn save(&self) -> Result<()> {
+        let content = encrypt(&self.key, &self.values)?;
+        write_private(&self.path, content.as_bytes())
+    }
+}
+
+fn load_key(data_dir: &Path, create: bool) -> Result<[u8; KEY_LEN]> {
+    if let Ok(encoded) = std::env::var(MASTER_KEY_ENV) {
+        return decode_key(&encoded).with_context(|| format!("Invalid {}", MASTER_KEY_ENV));
+    }
+    let path = data_dir.join(KEY_FILE_NAME);
+    if path.exists() {
+        let encoded = std::fs::read_to_string(&path)
+            .with_context(|| format!("Failed to read master key {}", path.display()))?;
+        return decode_key(&encoded)
+            .with_context(|| format!("Invalid master key {}", path.display()));
+    }
+    if !create {
+        anyhow::bail!(
+            "No master key: set {} or create one with `tenement secrets set`",
+            MASTER_KEY_ENV
+        );
+    }
+    let key: [u8; KEY_LEN] = rand::random();
+    std::fs::create_dir_all(data_dir)
+        .with_context(|| format!("Failed to create data dir {}", data_dir.display()))?;
+    write_private(&path, format!("{}\n", STANDARD.encode(key)).as_bytes())?;
+    Ok(key)
+}
+
+fn decode_key(encoded: &str) -> Result<[u8; KEY_LEN]> {
+    let bytes = STANDARD
+        .decode(encoded.trim())
+        .context("master key is not valid base64")?;
+    bytes
+        .try_into()
+        .map_err(|_| anyhow::anyhow!("master key must be {} bytes", KEY_LEN))
+}
+
+fn encrypt(key: &[u8; KEY_LEN], values: &BTreeMap<String, String>) -> Result<String> {
+    let cipher = Aes256Gcm::new(Key::<Aes256Gcm>::from_slice(key));
+    let nonce: [u8; NONCE_LEN] = rand::random();
+    let plaintext = serde_json::to_vec(values)?;
+    let ciphertext = cipher
+        .encrypt(Nonce::from_slice(&nonce), plaintext.as_slice())
+        .map_err(|_| anyhow::anyhow!("encryption failed"))?;
+    let sealed = SealedStore {
+        version: 1,
+        nonce: STANDARD.encode(nonce),
+        ciphertext: STANDARD.encode(ciphertext),
+    };
+    Ok(serde_json::to_string(&sealed)?)
+}
+
+fn decrypt(key: &[u8; KEY_LEN], content: &str) -> Result<BTreeMap<String, String>> {
+    let sealed: SealedStore = serde_json::from_str(content).context("not a secret store")?;
+    if sealed.version != 1 {
+        anyhow::bail!("unsupported secret store version {}", sealed.version);
+    }
+    let nonce = STANDARD.decode(&sealed.nonce).context("invalid nonce")?;
+    if nonce.len() != NONCE_LEN {
+        anyhow::bail!("invalid nonce");
+    }
+    let ciphertext = STANDARD.decode(&sealed.ciphertext).context("invalid ciphertext")?;
+    let cipher = Aes256Gcm::new(Key::<Aes256Gcm>::from_slice(key));
+    let plaintext = cipher
+        .decrypt(Nonce::from_slice(&nonce), ciphertext.as_slice())
+        .map_err(|_| anyhow::anyhow!("wrong master key or corrupted store"))?;
+    Ok(serde_json::from_slice(&plaintext)?)
+}
+
+/// Write via a temp file and rename, so a crash never leaves a half-written file
+fn write_private(path: &Path, content: &[u8]) -> Result<()> {
+    let tmp = path.with_extension("tmp");
+    std::fs::write(&tmp, content)
+        .with_context(|| format!("Failed to write {}", tmp.display()))?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(&tmp, std::fs::Permissions::from_mode(0o600))
+            .with_context(|| format!("Failed to set permissions on {}", tmp.display()))?;
+    }
+    std::fs::rename(&tmp, path).with_context(|| format!("Failed to write {}", path.display()))?;
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_set_save_and_reopen() {
+        let dir = TempDir::new().unwrap();
+        let mut store = SecretStore::open_or_init(dir.path()).unwrap();
+        store.set("DATABASE_URL", "postgres://user:hunter2@db/app");
+        store.set("API_KEY", "k");
+        store.save().unwrap();
+
+        let store = SecretStore::open(dir.path()).unwrap();
+        assert_eq!(store.get("DATABASE_URL"), Some("postgres://user:hunter2@db/app"));
+        assert_eq!(store.names().collect::<Vec<_>>(), vec!["API_KEY", "DATABASE_URL"]);
+
+        // Nothing is stored in plaintext
+        let raw = std::fs::read_to_string(dir.path().join(STORE_FILE_NAME)).unwrap();
+        assert!(!raw.contains("hunter2"));
+        assert!(!raw.contains("DATABASE_URL"));
+    }
+
+    #[test]
+    fn test_remove() {
+        let dir = TempDir::new().unwrap();
+        let mut store = SecretStore::open_or_init(dir.path()).unwrap();
+        store.set("API_KEY", "k");
+        assert!(store.remove("API_KEY"));
+        assert!(!store.remove("API_KEY"));
+        store.save().unwrap();
+        assert_eq!(SecretStore::open(dir.path()).unwrap().get("API_KEY"), None);
+    }
+
+    #[test]
+    fn test_open_without_key_fails() {
+        let dir = TempDir::new().unwrap();
+        let err = SecretStore::open(dir.path()).err().unwrap();
+        assert!(err.to_string().contains("No master key"));
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_key_and_store_are_private() {
+        use std::os::unix::fs::PermissionsExt;
+        let dir = TempDir::new().unwrap();
+        let mut store = SecretStore::open_or_init(dir.path()).unwrap();
+        store.set("API_KEY", "k");
+        store.save().unwrap();
+        for name in [KEY_FILE_NAME, STORE_FILE_NAME] {
+            let mode = std::fs::metadata(dir.path().join(name)).unwrap().permissions().mode();
+            assert_eq!(mode & 0o777, 0o600, "{}", name);
+        }
+    }
+
+    #[test]
+    fn test_wrong_key_is_rejected() {
+        let dir = TempDir::new().unwrap();
+        let mut store = SecretStore::open_or_init(dir.path()).unwrap();
+        store.set("API_KEY", "k");
+        store.save().unwrap();
+
+        let other: [u8; KEY_LEN] = rand::random();
+        std::fs::write(dir.path().join(KEY_FILE_NAME), STANDARD.encode(other)).unwrap();
+        let err = SecretStore::open(dir.path()).err().unwrap();
+        assert!(format!("{:#}", err).contains("wrong master key"));
+    }
+}
@@ -0,0 +1,213 @@
+//! Secret files for tenement instances
+//!
+//! Services list secrets as `ENV_NAME = "/path/to/secret"`. Contents are injected
+//! as environment variables at spawn and mirrored into an env file in the
+//! instance data directory, so apps that support it can re-read them on a
+//! reload signal instead of being restarted. Services can also list names
+//! (`secrets = ["DATABASE_URL"]`) held in the encrypted [`SecretStore`].
+
+use anyhow::{Context, Result};
+use std::collections::hash_map::DefaultHasher;
+use std::collections::{BTreeMap, HashMap};
+use std::hash::{Hash, Hasher};
+use std::path::Path;
+
+use crate::config::SecretSource;
+use crate::secret_store::SecretStore;
+
+/// Name of the env file written into each instance's data directory
+pub const SECRETS_FILE_NAME: &str = "secrets.env";
+
+/// Env var pointing the app at its secrets file
+pub const SECRETS_FILE_ENV: &str = "TENEMENT_SECRETS_FILE";
+
+/// Read all secrets: files from disk, the rest from the encrypted store in
+/// `data_dir`. Keys are sorted so the fingerprint is stable.
+/// A single trailing newline is stripped from files (most secret files end with one).
+pub fn read_secrets(
+    secrets: &HashMap<String, SecretSource>,
+    data_dir: &Path,
+) -> Result<BTreeMap<String, String>> {
+    let mut store = None;
+    let mut values = BTreeMap::new();
+    for (name, source) in secrets {
+        let value = match source {
+            SecretSource::File(path) => {
+                let content = std::fs::read_to_string(path).with_context(|| {
+                    format!("Failed to read secret {} from {}", name, path.display())
+                })?;
+                let value = content
+                    .strip_suffix('\n')
+                    .map(|v| v.strip_suffix('\r').unwrap_or(v))
+                    .unwrap_or(&content);
+                value.to_string()
+            }
+            SecretSource::Store => {
+                if store.is_none() {
+                    store = Some(SecretStore::open(data_dir).with_context(|| {
+                        format!("Failed to open the secret store for {}", name)
+                    })?);
+                }
+                let value = store.as_ref().and_then(|store| store.get(name));
+                value
+                    .with_context(|| {
+                        format!(
+                            "Secret {} is not in the secret store. \
+                             Set it with `tenement secrets set {}`",
+                            name, name
+                        )
+                    })?
+                    .to_string()
+            }
+        };
+        values.insert(name.clone(), value);
+    }
+    Ok(values)
+}
+
+/// Fingerprint secret values to detect rotation without keeping old values around
+pub fn fingerprint(values: &BTreeMap<String, String>) -> u64 {
+    let mut hasher = DefaultHasher::new();
+    values.hash(&mut hasher);
+    hasher.finish()
+}
+
+/// Write secrets as a shell-quoted `KEY=value` env file, readable only by the owner
+pub fn write_env_file(path: &Path, values: &BTreeMap<String, String>) -> Result<()> {
+    let mut content = String::new();
+    for (name, value) in values {
+        content.push_str(&format!("{}={}\n", name, shell_words::quote(value)));
+    }
+
+    // Write to a temp file and rename so the app never reads a half-written file
+    let tmp = path.with_extension("env.tmp");
+    std::fs::write(&tmp, content)
+        .with_context(|| format!("Failed to write secrets file: {}", tmp.display()))?;
+    #[cfg(unix)]
+    {
+        use std::os::unix::fs::PermissionsExt;
+        std::fs::set_permissions(&tmp, std::fs::Permissions::from_mode(0o600))
+            .with_context(|| format!("Failed to set permissions on {}", tmp.display()))?;
+    }
+    std::fs::rename(&tmp, path)
+        .with_context(|| format!("Failed to write secrets file: {}", path.display()))?;
+    Ok(())
+}
+
+/// Parse a signal name like "SIGHUP", "hup" or "USR1" into its number
+#[cfg(unix)]
+pub fn parse_signal(name: &str) -> Result<i32> {
+    let upper = name.trim().to_ascii_uppercase();
+    let short = upper.strip_prefix("SIG").unwrap_or(&upper);
+    let signal = match short {
+        "HUP" => libc::SIGHUP,
+        "USR1" => libc::SIGUSR1,
+        "USR2" => libc::SIGUSR2,
+        "INT" => libc::SIGINT,
+        "QUIT" => libc::SIGQUIT,
+        "TERM" => libc::SIGTERM,
+        "WINCH" => libc::SIGWINCH,
+        _ => anyhow::bail!(
+            "Unsupported reload signal '{}'. Use one of: SIGHUP, SIGUSR1, SIGUSR2, \
+             SIGINT, SIGQUIT, SIGTERM, SIGWINCH",
+            name
+        ),
+    };
+    Ok(signal)
+}
+
+/// Parse a signal name (signals are only delivered on Unix)
+#[cfg(not(unix))]
+pub fn parse_signal(name: &str) -> Result<i32> {
+    anyhow::bail!("Reload signal '{}' requires a Unix platform", name)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    #[test]
+    fn test_read_secrets_strips_trailing_newline() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("db");
+        std::fs::write(&path, "hunter2\n").unwrap();
+
+        let mut secrets = HashMap::new();
+        secrets.insert("DB_PASSWORD".to_string(), SecretSource::File(path));
+
+        let values = read_secrets(&secrets, dir.path()).unwrap();
+        assert_eq!(values.get("DB_PASSWORD"), Some(&"hunter2".to_string()));
+    }
+
+    #[test]
+    fn test_read_secrets_missing_file() {
+        let mut secrets = HashMap::new();
+        let path = std::path::PathBuf::from("/nonexistent/secret");
+        secrets.insert("API_KEY".to_string(), SecretSource::File(path));
+
+        let err = read_secrets(&secrets, Path::new("/nonexistent")).unwrap_err();
+        assert!(err.to_string().contains("API_KEY"));
+    }
+
+    #[test]
+    fn test_read_secrets_from_store() {
+        let dir = TempDir::new().unwrap();
+        let mut store = SecretStore::open_or_init(dir.path()).unwrap();
+        store.set("DATABASE_URL", "postgres://db/app");
+        store.save().unwrap();
+
+        let mut secrets = HashMap::new();
+        secrets.insert("DATABASE_URL".to_string(), SecretSource::Store);
+        let values = read_secrets(&secrets, dir.path()).unwrap();
+        assert_eq!(values["DATABASE_URL"], "postgres://db/app");
+
+        secrets.insert("API_KEY".to_string(), SecretSource::Store);
+        let err = read_secrets(&secrets, dir.path()).unwrap_err();
+        assert!(err.to_string().contains("tenement secrets set API_KEY"));
+    }
+
+    #[test]
+    fn test_fingerprint_changes_with_values() {
+        let mut a = BTreeMap::new();
+        a.insert("KEY".to_string(), "v1".to_string());
+        let mut b = a.clone();
+        assert_eq!(fingerprint(&a), fingerprint(&b));
+
+        b.insert("KEY".to_string(), "v2".to_string());
+        assert_ne!(fingerprint(&a), fingerprint(&b));
+    }
+
+    #[test]
+    fn test_write_env_file_quotes_values() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join(SECRETS_FILE_NAME);
+
+        let mut values = BTreeMap::new();
+        values.insert("PLAIN".to_string(), "abc".to_string());
+        values.insert("SPACED".to_string(), "a b'c".to_string());
+        write_env_file(&path, &values).unwrap();
+
+        let content = std::fs::read_to_string(&path).unwrap();
+        assert!(content.contains("PLAIN=abc\n"));
+        assert!(content.contains("SPACED='a b'\\''c'\n"));
+        assert!(!path.with_extension("env.tmp").exists());
+
+        #[cfg(unix)]
+        {
+            use std::os::unix::fs::PermissionsExt;
+            let mode = std::fs::metadata(&path).unwrap().permissions().mode();
+            assert_eq!(mode & 0o777, 0o600);
+        }
+    }
+
+    #[cfg(unix)]
+    #[test]
+    fn test_parse_signal() {
+        assert_eq!(parse_signal("SIGHUP").unwrap(), libc::SIGHUP);
+        assert_eq!(parse_signal("hup").unwrap(), libc::SIGHUP);
+        assert_eq!(parse_signal("USR1").unwrap(), libc::SIGUSR1);
+        assert!(parse_signal("SIGKILL").is_err());
+        assert!(parse_signal("bogus").is_err());
+    }
+}
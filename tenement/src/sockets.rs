@@ -0,0 +1,466 @@
+//! Orphaned socket reconciliation
+//!
+//! Crashed apps leave socket files behind. On startup tenement scans the
+//! directories its services' sockets live in and classifies every entry:
+//! sockets matching a configured service are left for that service to reuse,
+//! unowned sockets with a listener are left alone, and unowned sockets with
+//! no listener are pruned. Anything that isn't a socket is never touched.
+//! Before an instance starts, a stale socket at its own path is cleared the
+//! same way, and a live one stops the spawn rather than being replaced.
+//!
+//! Windows has no Unix sockets: an instance's socket path stands for the
+//! named pipe [`address`] gives, which is what its SOCKET_PATH holds and what
+//! [`connect`] opens.
+
+use crate::config::Config;
+use anyhow::Result;
+use serde::Serialize;
+use std::collections::BTreeSet;
+use std::path::{Path, PathBuf};
+
+/// What reconciliation found at a path
+#[derive(Debug, Clone, Copy, PartialEq, Eq, Serialize)]
+#[serde(rename_all = "lowercase")]
+pub enum SocketState {
+    /// Matches a configured service's socket pattern
+    Owned,
+    /// Not owned, but something is still listening
+    Live,
+    /// Not owned and nothing is listening (stale)
+    Dead,
+    /// Not a socket file
+    Unknown,
+}
+
+impl std::fmt::Display for SocketState {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        match self {
+            SocketState::Owned => write!(f, "owned"),
+            SocketState::Live => write!(f, "live"),
+            SocketState::Dead => write!(f, "dead"),
+            SocketState::Unknown => write!(f, "unknown"),
+        }
+    }
+}
+
+/// A single entry found in a socket directory
+#[derive(Debug, Clone, Serialize)]
+pub struct SocketEntry {
+    pub path: PathBuf,
+    pub state: SocketState,
+    /// Owning service, when `state` is `Owned`
+    #[serde(skip_serializing_if = "Option::is_none")]
+    pub service: Option<String>,
+    /// Whether the file was removed (always false on a dry run)
+    pub pruned: bool,
+}
+
+/// Result of a reconciliation pass
+#[derive(Debug, Clone, Default, Serialize)]
+pub struct SocketReport {
+    pub dry_run: bool,
+    pub entries: Vec<SocketEntry>,
+}
+
+impl SocketReport {
+    /// Entries in a given state
+    pub fn with_state(&self, state: SocketState) -> impl Iterator<Item = &SocketEntry> {
+        self.entries.iter().filter(move |e| e.state == state)
+    }
+
+    /// Number of files removed
+    pub fn pruned_count(&self) -> usize {
+        self.entries.iter().filter(|e| e.pruned).count()
+    }
+}
+
+/// Scan socket directories for all configured services and prune dead, unowned sockets.
+/// With `dry_run`, nothing is removed and the report shows what would be.
+pub fn reconcile_sockets(config: &Config, dry_run: bool) -> SocketReport {
+    let mut report = SocketReport {
+        dry_run,
+        entries: Vec::new(),
+    };
+
+    for dir in socket_dirs(config) {
+        let read_dir = match std::fs::read_dir(&dir) {
+            Ok(rd) => rd,
+            // Directory doesn't exist yet (first run) - nothing to reconcile
+            Err(_) => continue,
+        };
+
+        let mut paths: Vec<PathBuf> = read_dir.filter_map(|e| e.ok()).map(|e| e.path()).collect();
+        paths.sort();
+
+        for path in paths {
+            let Some(mut entry) = classify(config, &path) else {
+                continue;
+            };
+            if entry.state == SocketState::Dead && !dry_run {
+                match std::fs::remove_file(&path) {
+                    Ok(()) => entry.pruned = true,
+                    Err(e) => {
+                        tracing::warn!("Failed to prune stale socket {}: {}", path.display(), e)
+                    }
+                }
+            }
+            report.entries.push(entry);
+        }
+    }
+
+    report
+}
+
+/// Make way for an instance's socket at `path`: remove a socket nothing
+/// listens on any more, and refuse to replace one a live process still serves
+pub fn clear_stale_socket(path: &Path) -> Result<()> {
+    let Ok(metadata) = std::fs::symlink_metadata(path) else {
+        return Ok(());
+    };
+    if !is_socket(&metadata) {
+        return Ok(());
+    }
+    if has_listener(path) {
+        anyhow::bail!(
+            "Socket {} is in use by another process; stop it or choose another socket path",
+            path.display()
+        );
+    }
+    match std::fs::remove_file(path) {
+        Ok(()) => {
+            tracing::info!("Removed stale socket {}", path.display());
+            Ok(())
+        }
+        Err(e) if e.kind() == std::io::ErrorKind::NotFound => Ok(()),
+        Err(e) => Err(anyhow::anyhow!(
+            "Failed to remove stale socket {}: {}",
+            path.display(),
+            e
+        )),
+    }
+}
+
+/// A connection to an instance's socket
+#[cfg(unix)]
+pub type LocalStream = tokio::net::UnixStream;
+
+/// A connection to an instance's socket
+#[cfg(windows)]
+pub type LocalStream = tokio::net::windows::named_pipe::NamedPipeClient;
+
+/// What an app listens on for the socket `path`: the path itself, or on
+/// Windows the named pipe standing for it
+#[cfg(not(windows))]
+pub fn address(path: &Path) -> String {
+    path.to_string_lossy().to_string()
+}
+
+/// What an app listens on for the socket `path`: the path itself, or on
+/// Windows the named pipe standing for it
+#[cfg(windows)]
+pub fn address(path: &Path) -> String {
+    let name: String = path
+        .to_string_lossy()
+        .chars()
+        .map(|c| match c {
+            '\\' | '/' | ':' => '-',
+            c => c,
+        })
+        .collect();
+    format!(r"\\.\pipe\tenement-{}", name.trim_start_matches('-'))
+}
+
+/// Connect to the socket at `path`
+#[cfg(unix)]
+pub async fn connect(path: &Path) -> std::io::Result<LocalStream> {
+    tokio::net::UnixStream::connect(path).await
+}
+
+/// Connect to the named pipe standing for the socket at `path`, waiting out
+/// a server busy with another client
+#[cfg(windows)]
+pub async fn connect(path: &Path) -> std::io::Result<LocalStream> {
+    use tokio::net::windows::named_pipe::ClientOptions;
+    const ERROR_PIPE_BUSY: i32 = 231;
+
+    let name = address(path);
+    loop {
+        match ClientOptions::new().open(&name) {
+            Err(e) if e.raw_os_error() == Some(ERROR_PIPE_BUSY) => {}
+            result => return result,
+        }
+        tokio::time::sleep(std::time::Duration::from_millis(20)).await;
+    }
+}
+
+/// Pause after a failed accept (out of descriptors, say) so a listener
+/// doesn't spin: 10ms, doubling up to 1s, back to 10ms once one succeeds
+#[derive(Debug, Default)]
+pub struct AcceptBackoff {
+    failures: u32,
+}
+
+impl AcceptBackoff {
+    /// How long the next failure waits
+    pub fn delay(&self) -> std::time::Duration {
+        let millis = 10u64 << self.failures.min(7);
+        std::time::Duration::from_millis(millis.min(1000))
+    }
+
+    /// Wait out a failed accept
+    pub async fn failed(&mut self) {
+        let delay = self.delay();
+        self.failures = self.failures.saturating_add(1);
+        tokio::time::sleep(delay).await;
+    }
+
+    /// An accept went through
+    pub fn succeeded(&mut self) {
+        self.failures = 0;
+    }
+}
+
+/// Directories that hold sockets for configured services.
+/// Templates whose directory part contains placeholders are skipped.
+fn socket_dirs(config: &Config) -> BTreeSet<PathBuf> {
+    config
+        .service
+        .values()
+        .filter_map(|svc| {
+            Path::new(&svc.socket_template())
+                .parent()
+                .map(Path::to_path_buf)
+        })
+        .filter(|dir| !dir.as_os_str().is_empty() && !dir.to_string_lossy().contains('{'))
+        .collect()
+}
+
+fn classify(config: &Config, path: &Path) -> Option<SocketEntry> {
+    let metadata = std::fs::symlink_metadata(path).ok()?;
+    if metadata.is_dir() {
+        return None;
+    }
+
+    let entry = |state, service| SocketEntry {
+        path: path.to_path_buf(),
+        state,
+        service,
+        pruned: false,
+    };
+
+    if !is_socket(&metadata) {
+        return Some(entry(SocketState::Unknown, None));
+    }
+    if let Some(service) = owning_service(config, path) {
+        return Some(entry(SocketState::Owned, Some(service)));
+    }
+    let state = if has_listener(path) {
+        SocketState::Live
+    } else {
+        SocketState::Dead
+    };
+    Some(entry(state, None))
+}
+
+/// Find the configured service whose socket template matches this path
+fn owning_service(config: &Config, path: &Path) -> Option<String> {
+    let path = path.to_string_lossy();
+    let mut names: Vec<_> = config.service.keys().collect();
+    names.sort();
+    names
+        .into_iter()
+        .find(|name| template_matches(&config.service[*name].socket_template(), name, &path))
+        .cloned()
+}
+
+/// Match a path against a socket template with `{name}` filled in and `{id}` as a wildcard
+fn template_matches(template: &str, name: &str, path: &str) -> bool {
+    let template = template.replace("{name}", name);
+    match template.split_once("{id}") {
+        Some((prefix, suffix)) => path
+            .strip_prefix(prefix)
+            .and_then(|rest| rest.strip_suffix(suffix))
+            .is_some_and(|id| !id.is_empty() && !id.contains('/')),
+        None => template == path,
+    }
+}
+
+#[cfg(unix)]
+fn is_socket(metadata: &std::fs::Metadata) -> bool {
+    use std::os::unix::fs::FileTypeExt;
+    metadata.file_type().is_socket()
+}
+
+#[cfg(not(unix))]
+fn is_socket(_metadata: &std::fs::Metadata) -> bool {
+    false
+}
+
+/// A socket is dead only when connecting is refused; any other error
+/// (e.g. permissions) is treated as live so we never remove a socket in use.
+#[cfg(unix)]
+fn has_listener(path: &Path) -> bool {
+    match std::os::unix::net::UnixStream::connect(path) {
+        Ok(_) => true,
+        Err(e) => !matches!(
+            e.kind(),
+            std::io::ErrorKind::ConnectionRefused | std::io::ErrorKind::NotFound
+        ),
+    }
+}
+
+#[cfg(not(unix))]
+fn has_listener(_path: &Path) -> bool {
+    true
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+    use std::os::unix::net::UnixListener;
+    use tempfile::TempDir;
+
+    fn config_for(dir: &Path) -> Config {
+        Config::from_str(&format!(
+            r#"
+[service.api]
+command = "./api"
+socket = "{}/{{name}}-{{id}}.sock"
+"#,
+            dir.display()
+        ))
+        .unwrap()
+    }
+
+    /// Bind a socket and drop the listener, leaving a stale file behind
+    fn dead_socket(path: &Path) {
+        drop(UnixListener::bind(path).unwrap());
+    }
+
+    #[test]
+    fn test_template_matches() {
+        let t = "/tmp/tenement/{name}-{id}.sock";
+        assert!(template_matches(t, "api", "/tmp/tenement/api-prod.sock"));
+        assert!(!template_matches(t, "api", "/tmp/tenement/web-prod.sock"));
+        assert!(!template_matches(t, "api", "/tmp/tenement/api-.sock"));
+        assert!(!template_matches(t, "api", "/tmp/tenement/api-a/b.sock"));
+        assert!(template_matches("/run/{name}.sock", "api", "/run/api.sock"));
+    }
+
+    #[test]
+    fn test_reconcile_mixed_sockets() {
+        let dir = TempDir::new().unwrap();
+        let config = config_for(dir.path());
+
+        // Live, unowned: something is still listening
+        let live_path = dir.path().join("other-live.sock");
+        let _live = UnixListener::bind(&live_path).unwrap();
+        // Dead, unowned: stale leftover from a crash
+        let dead_path = dir.path().join("other-dead.sock");
+        dead_socket(&dead_path);
+        // Owned by a configured service (even though it's dead)
+        let owned_path = dir.path().join("api-prod.sock");
+        dead_socket(&owned_path);
+        // Not a socket at all
+        let unknown_path = dir.path().join("notes.txt");
+        std::fs::write(&unknown_path, "hi").unwrap();
+
+        let report = reconcile_sockets(&config, false);
+
+        let state_of = |p: &Path| {
+            report
+                .entries
+                .iter()
+                .find(|e| e.path == p)
+                .map(|e| e.state)
+        };
+        assert_eq!(state_of(&live_path), Some(SocketState::Live));
+        assert_eq!(state_of(&dead_path), Some(SocketState::Dead));
+        assert_eq!(state_of(&owned_path), Some(SocketState::Owned));
+        assert_eq!(state_of(&unknown_path), Some(SocketState::Unknown));
+
+        // Only the dead, unowned socket is removed
+        assert_eq!(report.pruned_count(), 1);
+        assert!(!dead_path.exists());
+        assert!(live_path.exists());
+        assert!(owned_path.exists());
+        assert!(unknown_path.exists());
+
+        // Live socket still accepts connections
+        assert!(std::os::unix::net::UnixStream::connect(&live_path).is_ok());
+    }
+
+    #[test]
+    fn test_reconcile_dry_run_removes_nothing() {
+        let dir = TempDir::new().unwrap();
+        let config = config_for(dir.path());
+
+        let dead_path = dir.path().join("other-dead.sock");
+        dead_socket(&dead_path);
+
+        let report = reconcile_sockets(&config, true);
+        assert!(report.dry_run);
+        assert_eq!(report.with_state(SocketState::Dead).count(), 1);
+        assert_eq!(report.pruned_count(), 0);
+        assert!(dead_path.exists());
+    }
+
+    #[test]
+    fn test_reconcile_missing_dir() {
+        let dir = TempDir::new().unwrap();
+        let config = config_for(&dir.path().join("does-not-exist"));
+        let report = reconcile_sockets(&config, false);
+        assert!(report.entries.is_empty());
+    }
+
+    #[test]
+    fn test_clear_stale_socket() {
+        let dir = TempDir::new().unwrap();
+        let dead_path = dir.path().join("api-prod.sock");
+        dead_socket(&dead_path);
+        clear_stale_socket(&dead_path).unwrap();
+        assert!(!dead_path.exists());
+        // Nothing there is fine too
+        clear_stale_socket(&dead_path).unwrap();
+
+        let live_path = dir.path().join("api-live.sock");
+        let _live = UnixListener::bind(&live_path).unwrap();
+        let err = clear_stale_socket(&live_path).unwrap_err();
+        assert!(err.to_string().contains("in use"), "{}", err);
+        assert!(live_path.exists());
+
+        let file_path = dir.path().join("notes.txt");
+        std::fs::write(&file_path, "hi").unwrap();
+        clear_stale_socket(&file_path).unwrap();
+        assert!(file_path.exists());
+    }
+
+    #[test]
+    fn test_owned_socket_reports_service() {
+        let dir = TempDir::new().unwrap();
+        let config = config_for(dir.path());
+        let owned_path = dir.path().join("api-prod.sock");
+        dead_socket(&owned_path);
+
+        let report = reconcile_sockets(&config, false);
+        let entry = report.with_state(SocketState::Owned).next().unwrap();
+        assert_eq!(entry.service.as_deref(), Some("api"));
+    }
+
+    #[tokio::test(start_paused = true)]
+    async fn test_accept_backoff_doubles_and_resets() {
+        use std::time::Duration;
+
+        let mut backoff = AcceptBackoff::default();
+        let mut delays = Vec::new();
+        for _ in 0..9 {
+            delays.push(backoff.delay());
+            backoff.failed().await;
+        }
+        let millis: Vec<u128> = delays.iter().map(Duration::as_millis).collect();
+        assert_eq!(millis, [10, 20, 40, 80, 160, 320, 640, 1000, 1000]);
+
+        backoff.succeeded();
+        assert_eq!(backoff.delay(), Duration::from_millis(10));
+    }
+}
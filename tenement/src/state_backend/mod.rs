@@ -0,0 +1,218 @@
+//! Where instance state and release history are kept
+//!
+//! The supervisor reads and writes both through [`StateBackend`] and
+//! [`ReleaseBackend`]. By default they're tables in tenement.db
+//! ([`StateStore`], [`ReleaseStore`]). With
+//! `state_backend = { url = "s3://bucket/prefix" }` they're JSON objects in a
+//! bucket instead ([`ObjectBackend`]): durable state stays off the host, and a
+//! replacement host pointed at the same prefix picks up the releases, pins and
+//! ports of the one it replaces.
+//!
+//! One supervisor writes to a prefix at a time; two sharing one would race on
+//! release numbers.
+//!
+//! Release artifacts stay where they were published (see [`crate::artifact`]):
+//! a release records its artifact's URL, and a host that finds a pinned
+//! version's release dir missing fetches it from there again. Versions
+//! deployed from a plain path or by `git push` only have files on the host
+//! that ran them.
+
+mod object;
+
+pub use object::{ObjectBackend, ObjectStore, S3Objects};
+
+use crate::config::Config;
+use crate::store::{DbPool, InstanceState, Release, ReleaseDefinition, ReleaseStore, StateStore};
+use anyhow::Result;
+use async_trait::async_trait;
+use std::sync::Arc;
+
+/// Running instances, release pins and port assignments, kept across restarts
+/// for crash recovery
+#[async_trait]
+pub trait StateBackend: Send + Sync {
+    /// Record a running instance
+    async fn save(&self, state: &InstanceState) -> Result<()>;
+
+    /// Record a running instance's new weight
+    async fn set_weight(&self, instance_id: &str, weight: u8) -> Result<()>;
+
+    /// Record a running instance's restart count
+    async fn set_restarts(&self, instance_id: &str, restarts: u32) -> Result<()>;
+
+    /// Remove an instance record (called on stop)
+    async fn remove(&self, instance_id: &str) -> Result<()>;
+
+    /// All recorded instances (called on startup for recovery)
+    async fn list(&self) -> Result<Vec<InstanceState>>;
+
+    /// Record the release a version is pinned to (as JSON)
+    async fn save_pin(&self, instance_id: &str, pin: &str) -> Result<()>;
+
+    /// Forget a version's release pin
+    async fn remove_pin(&self, instance_id: &str) -> Result<()>;
+
+    /// All release pins as (instance id, JSON)
+    async fn pins(&self) -> Result<Vec<(String, String)>>;
+
+    /// Record the port an instance was given, to give it again next time
+    async fn save_port(&self, instance_id: &str, port: u16) -> Result<()>;
+
+    /// Forget an instance's port
+    async fn remove_port(&self, instance_id: &str) -> Result<()>;
+
+    /// All port assignments as (instance id, port)
+    async fn ports(&self) -> Result<Vec<(String, u16)>>;
+
+    /// Remove every instance record (called after recovery)
+    async fn clear_all(&self) -> Result<()>;
+}
+
+/// Numbered releases of each service, for `ten releases` and rollbacks
+#[async_trait]
+pub trait ReleaseBackend: Send + Sync {
+    /// Record a release as the service's next number
+    async fn record(
+        &self,
+        process: &str,
+        version: &str,
+        definition: &ReleaseDefinition,
+        description: &str,
+    ) -> Result<Release>;
+
+    /// A service's releases, newest first
+    async fn list(&self, process: &str) -> Result<Vec<Release>>;
+
+    /// One release of a service by number
+    async fn get(&self, process: &str, number: u32) -> Result<Option<Release>>;
+}
+
+/// The backends `config` asks for; without `settings.state_backend`, tables
+/// in `pool`
+pub struct Backends {
+    pub state: Arc<dyn StateBackend>,
+    pub releases: Arc<dyn ReleaseBackend>,
+}
+
+impl Backends {
+    pub fn open(config: &Config, pool: DbPool) -> Result<Self> {
+        match &config.settings.state_backend {
+            Some(backend) => {
+                let objects: Arc<dyn ObjectStore> = Arc::new(S3Objects::from_env(&backend.url)?);
+                let backend = Arc::new(ObjectBackend::new(objects));
+                Ok(Self {
+                    state: backend.clone(),
+                    releases: backend,
+                })
+            }
+            None => Ok(Self {
+                state: Arc::new(StateStore::new(pool.clone())),
+                releases: Arc::new(ReleaseStore::new(pool)),
+            }),
+        }
+    }
+}
+
+#[async_trait]
+impl StateBackend for StateStore {
+    async fn save(&self, state: &InstanceState) -> Result<()> {
+        StateStore::save(self, state).await
+    }
+
+    async fn set_weight(&self, instance_id: &str, weight: u8) -> Result<()> {
+        StateStore::set_weight(self, instance_id, weight).await
+    }
+
+    async fn set_restarts(&self, instance_id: &str, restarts: u32) -> Result<()> {
+        StateStore::set_restarts(self, instance_id, restarts).await
+    }
+
+    async fn remove(&self, instance_id: &str) -> Result<()> {
+        StateStore::remove(self, instance_id).await
+    }
+
+    async fn list(&self) -> Result<Vec<InstanceState>> {
+        StateStore::list(self).await
+    }
+
+    async fn save_pin(&self, instance_id: &str, pin: &str) -> Result<()> {
+        StateStore::save_pin(self, instance_id, pin).await
+    }
+
+    async fn remove_pin(&self, instance_id: &str) -> Result<()> {
+        StateStore::remove_pin(self, instance_id).await
+    }
+
+    async fn pins(&self) -> Result<Vec<(String, String)>> {
+        StateStore::pins(self).await
+    }
+
+    async fn save_port(&self, instance_id: &str, port: u16) -> Result<()> {
+        StateStore::save_port(self, instance_id, port).await
+    }
+
+    async fn remove_port(&self, instance_id: &str) -> Result<()> {
+        StateStore::remove_port(self, instance_id).await
+    }
+
+    async fn ports(&self) -> Result<Vec<(String, u16)>> {
+        StateStore::ports(self).await
+    }
+
+    async fn clear_all(&self) -> Result<()> {
+        StateStore::clear_all(self).await
+    }
+}
+
+#[async_trait]
+impl ReleaseBackend for ReleaseStore {
+    async fn record(
+        &self,
+        process: &str,
+        version: &str,
+        definition: &ReleaseDefinition,
+        description: &str,
+    ) -> Result<Release> {
+        ReleaseStore::record(self, process, version, definition, description).await
+    }
+
+    async fn list(&self, process: &str) -> Result<Vec<Release>> {
+        ReleaseStore::list(self, process).await
+    }
+
+    async fn get(&self, process: &str, number: u32) -> Result<Option<Release>> {
+        ReleaseStore::get(self, process, number).await
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use crate::store::init_db;
+    use tempfile::TempDir;
+
+    #[tokio::test]
+    async fn test_sqlite_is_the_default() {
+        let dir = TempDir::new().unwrap();
+        let pool = init_db(&dir.path().join("test.db")).await.unwrap();
+        let config = Config::from_str("").unwrap();
+        let backends = Backends::open(&config, pool).unwrap();
+
+        let definition = ReleaseDefinition {
+            command: "./api".to_string(),
+            ..Default::default()
+        };
+        let release = backends
+            .releases
+            .record("api", "v1", &definition, "deploy")
+            .await
+            .unwrap();
+        assert_eq!(release.number, 1);
+        let found = backends.releases.get("api", 1).await.unwrap().unwrap();
+        assert_eq!(found.definition, definition);
+
+        backends.state.save_port("api:v1", 30001).await.unwrap();
+        let ports = backends.state.ports().await.unwrap();
+        assert_eq!(ports, [("api:v1".to_string(), 30001)]);
+    }
+}
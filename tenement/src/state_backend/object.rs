@@ -0,0 +1,478 @@
+//! State and releases as JSON objects in a bucket
+//!
+//! Under the configured prefix:
+//!
+//! - `state/instances/{instance}.json`: one [`InstanceState`] per running instance
+//! - `state/pins/{instance}`: the release pin JSON of a version
+//! - `state/ports/{instance}`: the port an instance was given
+//! - `releases/{service}/{number}.json`: one [`Release`], the number zero-padded
+//!   so keys sort in order
+
+use super::{ReleaseBackend, StateBackend};
+use crate::artifact::{split_s3_url, S3Fetcher};
+use crate::store::{InstanceState, Release, ReleaseDefinition};
+use anyhow::{Context, Result};
+use async_trait::async_trait;
+use std::sync::Arc;
+
+const INSTANCES_DIR: &str = "state/instances/";
+const PINS_DIR: &str = "state/pins/";
+const PORTS_DIR: &str = "state/ports/";
+const RELEASES_DIR: &str = "releases/";
+
+/// Longest one state object request may take; they're all small
+const REQUEST_TIMEOUT: std::time::Duration = std::time::Duration::from_secs(30);
+
+/// A flat key-value store of objects, such as an S3 prefix
+#[async_trait]
+pub trait ObjectStore: Send + Sync {
+    /// The object at `key`, or None if there's none
+    async fn get(&self, key: &str) -> Result<Option<Vec<u8>>>;
+
+    /// Write the object at `key`, replacing any there
+    async fn put(&self, key: &str, body: Vec<u8>) -> Result<()>;
+
+    /// Delete the object at `key`; one that isn't there is already deleted
+    async fn delete(&self, key: &str) -> Result<()>;
+
+    /// Keys of the objects starting with `prefix`
+    async fn list(&self, prefix: &str) -> Result<Vec<String>>;
+}
+
+/// Objects under an s3://bucket/prefix, signed as `S3Fetcher::from_env` says
+pub struct S3Objects {
+    fetcher: S3Fetcher,
+    bucket: String,
+    /// Ends in "/" unless empty
+    prefix: String,
+}
+
+impl S3Objects {
+    pub fn from_env(url: &str) -> Result<Self> {
+        let (bucket, prefix) = split_s3_url(url)?;
+        let prefix = match prefix.trim_matches('/') {
+            "" => String::new(),
+            prefix => format!("{}/", prefix),
+        };
+        Ok(Self {
+            fetcher: S3Fetcher::from_env().with_timeout(REQUEST_TIMEOUT),
+            bucket: bucket.to_string(),
+            prefix,
+        })
+    }
+
+    fn url(&self, key: &str) -> String {
+        format!("s3://{}/{}{}", self.bucket, self.prefix, key)
+    }
+}
+
+#[async_trait]
+impl ObjectStore for S3Objects {
+    async fn get(&self, key: &str) -> Result<Option<Vec<u8>>> {
+        self.fetcher.get(&self.url(key)).await
+    }
+
+    async fn put(&self, key: &str, body: Vec<u8>) -> Result<()> {
+        self.fetcher.put(&self.url(key), body).await
+    }
+
+    async fn delete(&self, key: &str) -> Result<()> {
+        self.fetcher.delete(&self.url(key)).await
+    }
+
+    async fn list(&self, prefix: &str) -> Result<Vec<String>> {
+        let objects = self.fetcher.list(&self.url(prefix)).await?;
+        Ok(objects
+            .into_iter()
+            .filter_map(|(key, _)| key.strip_prefix(&self.prefix).map(str::to_string))
+            .collect())
+    }
+}
+
+/// [`StateBackend`] and [`ReleaseBackend`] kept in an [`ObjectStore`]
+pub struct ObjectBackend {
+    objects: Arc<dyn ObjectStore>,
+    /// Held while an instance record is written, so a read-modify-write of
+    /// one (`update`) can't lose another write
+    instances: tokio::sync::Mutex<()>,
+    /// Held while a release is numbered and recorded, so two don't take the
+    /// same number
+    releases: tokio::sync::Mutex<()>,
+}
+
+impl ObjectBackend {
+    pub fn new(objects: Arc<dyn ObjectStore>) -> Self {
+        Self {
+            objects,
+            instances: tokio::sync::Mutex::new(()),
+            releases: tokio::sync::Mutex::new(()),
+        }
+    }
+
+    async fn instance(&self, instance_id: &str) -> Result<Option<InstanceState>> {
+        let key = format!("{}{}.json", INSTANCES_DIR, instance_id);
+        let Some(body) = self.objects.get(&key).await? else {
+            return Ok(None);
+        };
+        let state = serde_json::from_slice(&body)
+            .with_context(|| format!("Malformed instance state {}", key))?;
+        Ok(Some(state))
+    }
+
+    /// Change a recorded instance; one that isn't recorded is left unrecorded
+    async fn update<F>(&self, instance_id: &str, change: F) -> Result<()>
+    where
+        F: FnOnce(&mut InstanceState) + Send,
+    {
+        let _writing = self.instances.lock().await;
+        if let Some(mut state) = self.instance(instance_id).await? {
+            change(&mut state);
+            self.put_instance(&state).await?;
+        }
+        Ok(())
+    }
+
+    async fn put_instance(&self, state: &InstanceState) -> Result<()> {
+        let key = format!("{}{}.json", INSTANCES_DIR, state.instance_id);
+        self.objects.put(&key, serde_json::to_vec(state)?).await
+    }
+
+    /// Each object under `dir` as (the rest of its key, its contents)
+    async fn entries(&self, dir: &str) -> Result<Vec<(String, Vec<u8>)>> {
+        let mut entries = Vec::new();
+        for key in self.objects.list(dir).await? {
+            // Deleted since it was listed
+            let Some(body) = self.objects.get(&key).await? else {
+                continue;
+            };
+            if let Some(name) = key.strip_prefix(dir) {
+                entries.push((name.to_string(), body));
+            }
+        }
+        Ok(entries)
+    }
+
+    /// Numbers of a service's releases, in no particular order
+    async fn release_numbers(&self, process: &str) -> Result<Vec<u32>> {
+        let dir = format!("{}{}/", RELEASES_DIR, process);
+        let keys = self.objects.list(&dir).await?;
+        Ok(keys
+            .iter()
+            .filter_map(|key| key.strip_prefix(&dir)?.strip_suffix(".json")?.parse().ok())
+            .collect())
+    }
+}
+
+fn release_key(process: &str, number: u32) -> String {
+    format!("{}{}/{:010}.json", RELEASES_DIR, process, number)
+}
+
+#[async_trait]
+impl StateBackend for ObjectBackend {
+    async fn save(&self, state: &InstanceState) -> Result<()> {
+        let _writing = self.instances.lock().await;
+        self.put_instance(state).await
+    }
+
+    async fn set_weight(&self, instance_id: &str, weight: u8) -> Result<()> {
+        self.update(instance_id, |state| state.weight = weight)
+            .await
+    }
+
+    async fn set_restarts(&self, instance_id: &str, restarts: u32) -> Result<()> {
+        self.update(instance_id, |state| state.restarts = restarts)
+            .await
+    }
+
+    async fn remove(&self, instance_id: &str) -> Result<()> {
+        let key = format!("{}{}.json", INSTANCES_DIR, instance_id);
+        let _writing = self.instances.lock().await;
+        self.objects.delete(&key).await
+    }
+
+    async fn list(&self) -> Result<Vec<InstanceState>> {
+        let mut states = Vec::new();
+        for (name, body) in self.entries(INSTANCES_DIR).await? {
+            let state = serde_json::from_slice(&body)
+                .with_context(|| format!("Malformed instance state {}", name))?;
+            states.push(state);
+        }
+        Ok(states)
+    }
+
+    async fn save_pin(&self, instance_id: &str, pin: &str) -> Result<()> {
+        let key = format!("{}{}", PINS_DIR, instance_id);
+        self.objects.put(&key, pin.as_bytes().to_vec()).await
+    }
+
+    async fn remove_pin(&self, instance_id: &str) -> Result<()> {
+        self.objects
+            .delete(&format!("{}{}", PINS_DIR, instance_id))
+            .await
+    }
+
+    async fn pins(&self) -> Result<Vec<(String, String)>> {
+        let mut pins = Vec::new();
+        for (instance_id, body) in self.entries(PINS_DIR).await? {
+            let pin = String::from_utf8(body)
+                .with_context(|| format!("Malformed release pin of {}", instance_id))?;
+            pins.push((instance_id, pin));
+        }
+        Ok(pins)
+    }
+
+    async fn save_port(&self, instance_id: &str, port: u16) -> Result<()> {
+        let key = format!("{}{}", PORTS_DIR, instance_id);
+        self.objects.put(&key, port.to_string().into_bytes()).await
+    }
+
+    async fn remove_port(&self, instance_id: &str) -> Result<()> {
+        self.objects
+            .delete(&format!("{}{}", PORTS_DIR, instance_id))
+            .await
+    }
+
+    async fn ports(&self) -> Result<Vec<(String, u16)>> {
+        let mut ports = Vec::new();
+        for (instance_id, body) in self.entries(PORTS_DIR).await? {
+            let port = String::from_utf8_lossy(&body)
+                .trim()
+                .parse()
+                .with_context(|| format!("Malformed port of {}", instance_id))?;
+            ports.push((instance_id, port));
+        }
+        Ok(ports)
+    }
+
+    async fn clear_all(&self) -> Result<()> {
+        let _writing = self.instances.lock().await;
+        for key in self.objects.list(INSTANCES_DIR).await? {
+            self.objects.delete(&key).await?;
+        }
+        Ok(())
+    }
+}
+
+#[async_trait]
+impl ReleaseBackend for ObjectBackend {
+    async fn record(
+        &self,
+        process: &str,
+        version: &str,
+        definition: &ReleaseDefinition,
+        description: &str,
+    ) -> Result<Release> {
+        let _numbering = self.releases.lock().await;
+        let numbers = self.release_numbers(process).await?;
+        let release = Release {
+            process: process.to_string(),
+            number: numbers.into_iter().max().unwrap_or(0) + 1,
+            version: version.to_string(),
+            definition: definition.clone(),
+            description: description.to_string(),
+            created_at: chrono::Utc::now().to_rfc3339(),
+        };
+        let key = release_key(process, release.number);
+        self.objects
+            .put(&key, serde_json::to_vec(&release)?)
+            .await
+            .with_context(|| format!("Failed to record release of {}", process))?;
+        Ok(release)
+    }
+
+    async fn list(&self, process: &str) -> Result<Vec<Release>> {
+        let mut numbers = self.release_numbers(process).await?;
+        numbers.sort_unstable_by(|a, b| b.cmp(a));
+        let mut releases = Vec::new();
+        for number in numbers {
+            if let Some(release) = ReleaseBackend::get(self, process, number).await? {
+                releases.push(release);
+            }
+        }
+        Ok(releases)
+    }
+
+    async fn get(&self, process: &str, number: u32) -> Result<Option<Release>> {
+        let key = release_key(process, number);
+        let Some(body) = self.objects.get(&key).await? else {
+            return Ok(None);
+        };
+        let release =
+            serde_json::from_slice(&body).with_context(|| format!("Malformed release {}", key))?;
+        Ok(Some(release))
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use std::collections::BTreeMap;
+    use std::sync::Mutex;
+
+    /// Objects in memory, standing in for a bucket
+    #[derive(Default)]
+    struct MemoryObjects(Mutex<BTreeMap<String, Vec<u8>>>);
+
+    #[async_trait]
+    impl ObjectStore for MemoryObjects {
+        async fn get(&self, key: &str) -> Result<Option<Vec<u8>>> {
+            let body = self.0.lock().unwrap().get(key).cloned();
+            // Let other requests in between, as a bucket would
+            tokio::task::yield_now().await;
+            Ok(body)
+        }
+
+        async fn put(&self, key: &str, body: Vec<u8>) -> Result<()> {
+            self.0.lock().unwrap().insert(key.to_string(), body);
+            Ok(())
+        }
+
+        async fn delete(&self, key: &str) -> Result<()> {
+            self.0.lock().unwrap().remove(key);
+            Ok(())
+        }
+
+        async fn list(&self, prefix: &str) -> Result<Vec<String>> {
+            let objects = self.0.lock().unwrap();
+            let keys = objects.keys().filter(|key| key.starts_with(prefix));
+            Ok(keys.cloned().collect())
+        }
+    }
+
+    fn instance(instance_id: &str) -> InstanceState {
+        let (process_name, id) = instance_id.split_once(':').unwrap();
+        InstanceState {
+            instance_id: instance_id.to_string(),
+            process_name: process_name.to_string(),
+            id: id.to_string(),
+            pid: 1234,
+            port: None,
+            socket: format!("/tmp/{}.sock", id),
+            weight: 100,
+            restarts: 0,
+            started_at: "2026-01-01T00:00:00+00:00".to_string(),
+        }
+    }
+
+    #[tokio::test]
+    async fn test_state_round_trip() {
+        let objects = Arc::new(MemoryObjects::default());
+        let backend = ObjectBackend::new(objects.clone());
+        let state: &dyn StateBackend = &backend;
+
+        state.save(&instance("api:v1")).await.unwrap();
+        state.save(&instance("web:prod")).await.unwrap();
+        state.set_weight("api:v1", 25).await.unwrap();
+        state.set_restarts("api:v1", 3).await.unwrap();
+        // Like an UPDATE of no rows
+        state.set_weight("api:gone", 10).await.unwrap();
+        assert!(objects
+            .0
+            .lock()
+            .unwrap()
+            .contains_key("state/instances/api:v1.json"));
+
+        let mut states = state.list().await.unwrap();
+        states.sort_by(|a, b| a.instance_id.cmp(&b.instance_id));
+        assert_eq!(states.len(), 2);
+        assert_eq!((states[0].weight, states[0].restarts), (25, 3));
+        state.remove("web:prod").await.unwrap();
+        assert_eq!(state.list().await.unwrap().len(), 1);
+        state.clear_all().await.unwrap();
+        assert!(state.list().await.unwrap().is_empty());
+
+        state.save_pin("api:v1", "{\"number\":2}").await.unwrap();
+        state.save_port("api:v1", 30001).await.unwrap();
+        let pins = state.pins().await.unwrap();
+        assert_eq!(pins, [("api:v1".to_string(), "{\"number\":2}".to_string())]);
+        assert_eq!(
+            state.ports().await.unwrap(),
+            [("api:v1".to_string(), 30001)]
+        );
+        state.remove_pin("api:v1").await.unwrap();
+        state.remove_port("api:v1").await.unwrap();
+        assert!(state.pins().await.unwrap().is_empty());
+        assert!(state.ports().await.unwrap().is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_concurrent_writes_are_kept() {
+        let objects = Arc::new(MemoryObjects::default());
+        let backend = ObjectBackend::new(objects);
+        backend.save(&instance("api:v1")).await.unwrap();
+
+        let (weight, restarts) = tokio::join!(
+            backend.set_weight("api:v1", 25),
+            backend.set_restarts("api:v1", 3)
+        );
+        weight.unwrap();
+        restarts.unwrap();
+        let states = StateBackend::list(&backend).await.unwrap();
+        assert_eq!((states[0].weight, states[0].restarts), (25, 3));
+
+        let definition = ReleaseDefinition::default();
+        let (first, second) = tokio::join!(
+            backend.record("api", "v1", &definition, "deploy"),
+            backend.record("api", "v2", &definition, "deploy")
+        );
+        let mut numbers = [first.unwrap().number, second.unwrap().number];
+        numbers.sort_unstable();
+        assert_eq!(numbers, [1, 2]);
+    }
+
+    #[tokio::test]
+    async fn test_releases_are_numbered_per_service() {
+        let objects = Arc::new(MemoryObjects::default());
+        let releases: Box<dyn ReleaseBackend> = Box::new(ObjectBackend::new(objects.clone()));
+        let definition = ReleaseDefinition {
+            command: "./api".to_string(),
+            artifact: Some("s3://builds/api-v2.tar.gz".to_string()),
+            ..Default::default()
+        };
+        for version in ["v1", "v2"] {
+            releases
+                .record("api", version, &definition, "deploy")
+                .await
+                .unwrap();
+        }
+        let web = releases
+            .record("web", "v1", &definition, "deploy")
+            .await
+            .unwrap();
+        assert_eq!(web.number, 1);
+
+        let listed = releases.list("api").await.unwrap();
+        let numbers: Vec<u32> = listed.iter().map(|r| r.number).collect();
+        assert_eq!(numbers, [2, 1]);
+        assert_eq!(listed[0].version, "v2");
+        assert!(objects
+            .0
+            .lock()
+            .unwrap()
+            .contains_key("releases/api/0000000002.json"));
+
+        // A new host pointed at the same objects sees the same history
+        let rebuilt = ObjectBackend::new(objects);
+        let release = ReleaseBackend::get(&rebuilt, "api", 1)
+            .await
+            .unwrap()
+            .unwrap();
+        assert_eq!(release.definition, definition);
+        assert!(ReleaseBackend::get(&rebuilt, "api", 3)
+            .await
+            .unwrap()
+            .is_none());
+    }
+
+    #[test]
+    fn test_s3_keys_sit_under_the_prefix() {
+        let objects = S3Objects::from_env("s3://state/tenement/prod/").unwrap();
+        assert_eq!(
+            objects.url("releases/api/1.json"),
+            "s3://state/tenement/prod/releases/api/1.json"
+        );
+        let bare = S3Objects::from_env("s3://state").unwrap();
+        assert_eq!(bare.url(PINS_DIR), "s3://state/state/pins/");
+        assert!(S3Objects::from_env("https://state").is_err());
+    }
+}
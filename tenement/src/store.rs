@@ -1,11 +1,14 @@
 //! SQLite storage for logs and config
 //!
-//! Persists logs with FTS5 full-text search and handles config storage.
+//! Persists logs with FTS5 full-text search and handles config storage,
+//! tenant tokens, the control-plane audit log and release history.
 
+use crate::auth::Scope;
 use crate::logs::{LogEntry, LogLevel, LogQuery};
 use anyhow::{Context, Result};
 use sqlx::sqlite::{SqliteConnectOptions, SqlitePoolOptions};
 use sqlx::{Pool, Row, Sqlite};
+use std::collections::BTreeMap;
 use std::path::Path;
 use std::str::FromStr;
 use std::sync::Arc;
@@ -114,13 +117,32 @@ pub async fn init_db(path: &Path) -> Result<DbPool> {
             id TEXT NOT NULL,
             pid INTEGER NOT NULL,
             port INTEGER,
+            socket TEXT NOT NULL DEFAULT '',
+            weight INTEGER NOT NULL DEFAULT 100,
+            restarts INTEGER NOT NULL DEFAULT 0,
             started_at TEXT NOT NULL
         );
+        CREATE TABLE IF NOT EXISTS release_pins (
+            instance_id TEXT PRIMARY KEY,
+            pin TEXT NOT NULL
+        );
+        CREATE TABLE IF NOT EXISTS port_assignments (
+            instance_id TEXT PRIMARY KEY,
+            port INTEGER NOT NULL
+        );
         "#,
     )
     .execute(&pool)
     .await
     .context("Failed to create instance_state table")?;
+    // Databases from before socket, weight and restarts were recorded
+    for (column, decl) in [
+        ("socket", "TEXT NOT NULL DEFAULT ''"),
+        ("weight", "INTEGER NOT NULL DEFAULT 100"),
+        ("restarts", "INTEGER NOT NULL DEFAULT 0"),
+    ] {
+        add_missing_column(&pool, "instance_state", column, decl).await?;
+    }
 
     // Create tenant tokens table (per-tenant API access)
     sqlx::query(
@@ -141,6 +163,24 @@ pub async fn init_db(path: &Path) -> Result<DbPool> {
     .await
     .context("Failed to create tenant_tokens table")?;
 
+    // Create named API tokens table (scoped admin API access)
+    sqlx::query(
+        r#"
+        CREATE TABLE IF NOT EXISTS api_tokens (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            name TEXT NOT NULL UNIQUE,
+            token_hash TEXT NOT NULL,
+            token_prefix TEXT NOT NULL,
+            scope TEXT NOT NULL,
+            created_at TEXT NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_api_tokens_prefix ON api_tokens(token_prefix);
+        "#,
+    )
+    .execute(&pool)
+    .await
+    .context("Failed to create api_tokens table")?;
+
     // Create deployment audit log table
     sqlx::query(
         r#"
@@ -151,7 +191,8 @@ pub async fn init_db(path: &Path) -> Result<DbPool> {
             process TEXT NOT NULL,
             instance_id TEXT NOT NULL,
             details TEXT,
-            success INTEGER NOT NULL DEFAULT 1
+            success INTEGER NOT NULL DEFAULT 1,
+            actor TEXT
         );
         CREATE INDEX IF NOT EXISTS idx_deploy_log_timestamp ON deploy_log(timestamp DESC);
         "#,
@@ -159,11 +200,116 @@ pub async fn init_db(path: &Path) -> Result<DbPool> {
     .execute(&pool)
     .await
     .context("Failed to create deploy_log table")?;
+    add_missing_column(&pool, "deploy_log", "actor", "TEXT").await?;
+    // Entries moved out of deploy_log by `DeployLogStore::archive`
+    sqlx::query(
+        r#"
+        CREATE TABLE IF NOT EXISTS deploy_log_archive (
+            id INTEGER PRIMARY KEY,
+            timestamp TEXT NOT NULL,
+            action TEXT NOT NULL,
+            process TEXT NOT NULL,
+            instance_id TEXT NOT NULL,
+            details TEXT,
+            success INTEGER NOT NULL DEFAULT 1,
+            actor TEXT
+        );
+        "#,
+    )
+    .execute(&pool)
+    .await
+    .context("Failed to create deploy_log_archive table")?;
+    // The audit log is append-only: rows can't be changed, and only leave
+    // deploy_log once they're in the archive, which keeps them for good
+    sqlx::query("DROP TRIGGER IF EXISTS deploy_log_no_delete")
+        .execute(&pool)
+        .await
+        .context("Failed to protect deploy_log")?;
+    for (trigger, event, table, when) in [
+        ("deploy_log_no_update", "UPDATE", "deploy_log", ""),
+        (
+            "deploy_log_only_archived",
+            "DELETE",
+            "deploy_log",
+            "WHEN NOT EXISTS (SELECT 1 FROM deploy_log_archive a WHERE a.id = OLD.id)",
+        ),
+        (
+            "deploy_log_archive_no_update",
+            "UPDATE",
+            "deploy_log_archive",
+            "",
+        ),
+        (
+            "deploy_log_archive_no_delete",
+            "DELETE",
+            "deploy_log_archive",
+            "",
+        ),
+    ] {
+        sqlx::query(&format!(
+            "CREATE TRIGGER IF NOT EXISTS {} BEFORE {} ON {} {} \
+             BEGIN SELECT RAISE(ABORT, 'the audit log is append-only'); END",
+            trigger, event, table, when
+        ))
+        .execute(&pool)
+        .await
+        .context("Failed to protect deploy_log")?;
+    }
+
+    // Create releases table: one numbered row per deploy of each service
+    sqlx::query(
+        r#"
+        CREATE TABLE IF NOT EXISTS releases (
+            id INTEGER PRIMARY KEY AUTOINCREMENT,
+            process TEXT NOT NULL,
+            number INTEGER NOT NULL,
+            version TEXT NOT NULL,
+            command TEXT NOT NULL,
+            args TEXT NOT NULL,
+            env TEXT NOT NULL,
+            artifact TEXT,
+            app_version TEXT,
+            workdir TEXT,
+            image TEXT,
+            git_sha TEXT,
+            description TEXT NOT NULL,
+            created_at TEXT NOT NULL,
+            UNIQUE(process, number)
+        );
+        "#,
+    )
+    .execute(&pool)
+    .await
+    .context("Failed to create releases table")?;
+    for column in ["app_version", "workdir", "image", "git_sha"] {
+        add_missing_column(&pool, "releases", column, "TEXT").await?;
+    }
 
     info!("Database initialized at {:?}", path);
     Ok(pool)
 }
 
+/// Add a column to a table an older version created without it
+async fn add_missing_column(pool: &DbPool, table: &str, column: &str, decl: &str) -> Result<()> {
+    let columns = sqlx::query(&format!("PRAGMA table_info({})", table))
+        .fetch_all(pool)
+        .await?;
+    if columns
+        .iter()
+        .any(|row| row.get::<String, _>("name") == column)
+    {
+        return Ok(());
+    }
+    sqlx::query(&format!(
+        "ALTER TABLE {} ADD COLUMN {} {}",
+        table, column, decl
+    ))
+    .execute(pool)
+    .await
+    .with_context(|| format!("Failed to add {}.{}", table, column))?;
+    Ok(())
+}
+
 /// Tenant token with scoped access
 #[derive(Debug, Clone)]
 pub struct TenantToken {
@@ -260,8 +406,112 @@ impl TenantTokenStore {
     }
 }
 
-/// Deployment audit log entry
+/// Named API token with a permission scope
 #[derive(Debug, Clone, serde::Serialize)]
+pub struct ApiToken {
+    pub id: i64,
+    pub name: String,
+    pub scope: Scope,
+    pub created_at: String,
+}
+
+/// Store for named, scoped API tokens (`ten tokens create`)
+pub struct ApiTokenStore {
+    pool: DbPool,
+}
+
+impl ApiTokenStore {
+    pub fn new(pool: DbPool) -> Self {
+        Self { pool }
+    }
+
+    /// Generate and store a token called `name`. Returns the plaintext token.
+    pub async fn generate_and_store(&self, name: &str, scope: Scope) -> Result<String> {
+        if name.is_empty() {
+            anyhow::bail!("Token name can't be empty");
+        }
+        if self.get(name).await?.is_some() {
+            anyhow::bail!("A token named '{}' already exists", name);
+        }
+        let token = crate::auth::generate_token();
+        let hash = crate::auth::hash_token(&token)?;
+        let now = chrono::Utc::now().to_rfc3339();
+        sqlx::query(
+            "INSERT INTO api_tokens (name, token_hash, token_prefix, scope, created_at) VALUES (?, ?, ?, ?, ?)",
+        )
+        .bind(name)
+        .bind(&hash)
+        .bind(&token[..8])
+        .bind(scope.as_str())
+        .bind(&now)
+        .execute(&self.pool)
+        .await?;
+        Ok(token)
+    }
+
+    /// Verify a token and return it if valid (prefix lookup, then Argon2)
+    pub async fn verify(&self, token: &str) -> Result<Option<ApiToken>> {
+        if token.len() < 8 {
+            return Ok(None);
+        }
+        let rows = sqlx::query(
+            "SELECT id, name, token_hash, scope, created_at FROM api_tokens WHERE token_prefix = ?",
+        )
+        .bind(&token[..8])
+        .fetch_all(&self.pool)
+        .await?;
+
+        for row in rows {
+            let hash: String = row.get("token_hash");
+            if crate::auth::verify_token(token, &hash) {
+                return Ok(Some(api_token_from_row(&row)?));
+            }
+        }
+        Ok(None)
+    }
+
+    /// A token by name
+    pub async fn get(&self, name: &str) -> Result<Option<ApiToken>> {
+        let row = sqlx::query("SELECT id, name, scope, created_at FROM api_tokens WHERE name = ?")
+            .bind(name)
+            .fetch_optional(&self.pool)
+            .await?;
+        row.as_ref().map(api_token_from_row).transpose()
+    }
+
+    /// All tokens, oldest first
+    pub async fn list(&self) -> Result<Vec<ApiToken>> {
+        let rows = sqlx::query("SELECT id, name, scope, created_at FROM api_tokens ORDER BY id")
+            .fetch_all(&self.pool)
+            .await?;
+        rows.iter().map(api_token_from_row).collect()
+    }
+
+    /// Revoke a token by name. Takes effect on the next request that uses it.
+    pub async fn revoke(&self, name: &str) -> Result<bool> {
+        let result = sqlx::query("DELETE FROM api_tokens WHERE name = ?")
+            .bind(name)
+            .execute(&self.pool)
+            .await?;
+        Ok(result.rows_affected() > 0)
+    }
+}
+
+fn api_token_from_row(row: &sqlx::sqlite::SqliteRow) -> Result<ApiToken> {
+    let name: String = row.get("name");
+    let scope: String = row.get("scope");
+    Ok(ApiToken {
+        id: row.get("id"),
+        scope: scope
+            .parse()
+            .with_context(|| format!("Token '{}' has an invalid scope", name))?,
+        name,
+        created_at: row.get("created_at"),
+    })
+}
+
+/// Audit log entry: one control-plane action, who took it and how it went
+#[derive(Debug, Clone, PartialEq, serde::Serialize, serde::Deserialize)]
 pub struct DeployLogEntry {
     pub id: i64,
     pub timestamp: String,
@@ -270,16 +520,66 @@ pub struct DeployLogEntry {
     pub instance_id: String,
     pub details: Option<String>,
     pub success: bool,
+    /// Who made the change ("token:ci", "tenant:alice", ...), when known
+    pub actor: Option<String>,
 }
 
-/// Store for deployment audit log
+/// Filters for reading the audit log; unset ones match every entry
+#[derive(Debug, Clone, Default, serde::Serialize, serde::Deserialize)]
+pub struct AuditQuery {
+    /// Who took the action, e.g. "token:ci" or "admin"
+    #[serde(default)]
+    pub actor: Option<String>,
+    /// What was done, e.g. "deploy" or "secret-set"
+    #[serde(default)]
+    pub action: Option<String>,
+    /// Service it was done to
+    #[serde(default)]
+    pub process: Option<String>,
+    /// Only entries at or after this time (RFC 3339)
+    #[serde(default)]
+    pub since: Option<String>,
+    /// Only actions that failed
+    #[serde(default)]
+    pub failed: bool,
+    /// Most recent entries to return (default 100)
+    #[serde(default)]
+    pub limit: Option<usize>,
+}
+
+/// Entries new subscribers to the audit log can fall behind by before
+/// they miss some
+const AUDIT_CHANNEL_CAPACITY: usize = 256;
+
+/// Rejected tokens are recorded at most once per this long, with a count of
+/// the ones in between
+const REJECTED_AUDIT_INTERVAL: Duration = Duration::from_secs(60);
+
+/// Store for the control-plane audit log (the `deploy_log` table): deploys,
+/// restarts, reloads, secret and token changes and every mutating API call.
+/// Entries are only ever added, and old ones moved to `deploy_log_archive`.
 pub struct DeployLogStore {
     pool: DbPool,
+    /// Each entry as it is written, for forwarding to log sinks
+    appended: tokio::sync::broadcast::Sender<DeployLogEntry>,
+    /// When a rejected token was last recorded, and how many were rejected
+    /// since without an entry
+    rejected: std::sync::Mutex<(Option<std::time::Instant>, u64)>,
 }
 
 impl DeployLogStore {
     pub fn new(pool: DbPool) -> Self {
-        Self { pool }
+        let (appended, _) = tokio::sync::broadcast::channel(AUDIT_CHANNEL_CAPACITY);
+        Self {
+            pool,
+            appended,
+            rejected: std::sync::Mutex::new((None, 0)),
+        }
+    }
+
+    /// Entries written from now on
+    pub fn subscribe(&self) -> tokio::sync::broadcast::Receiver<DeployLogEntry> {
+        self.appended.subscribe()
     }
 
     /// Log a deployment action
@@ -290,10 +590,24 @@ impl DeployLogStore {
         instance_id: &str,
         details: Option<&str>,
         success: bool,
+    ) -> Result<()> {
+        self.log_as(None, action, process, instance_id, details, success)
+            .await
+    }
+
+    /// Log an action along with who made it
+    pub async fn log_as(
+        &self,
+        actor: Option<&str>,
+        action: &str,
+        process: &str,
+        instance_id: &str,
+        details: Option<&str>,
+        success: bool,
     ) -> Result<()> {
         let now = chrono::Utc::now().to_rfc3339();
-        sqlx::query(
-            "INSERT INTO deploy_log (timestamp, action, process, instance_id, details, success) VALUES (?, ?, ?, ?, ?, ?)",
+        let result = sqlx::query(
+            "INSERT INTO deploy_log (timestamp, action, process, instance_id, details, success, actor) VALUES (?, ?, ?, ?, ?, ?, ?)",
         )
         .bind(&now)
         .bind(action)
@@ -301,35 +615,275 @@ impl DeployLogStore {
         .bind(instance_id)
         .bind(details)
         .bind(success as i64)
+        .bind(actor)
         .execute(&self.pool)
         .await?;
+        // Nobody listening is fine
+        let _ = self.appended.send(DeployLogEntry {
+            id: result.last_insert_rowid(),
+            timestamp: now,
+            action: action.to_string(),
+            process: process.to_string(),
+            instance_id: instance_id.to_string(),
+            details: details.map(str::to_string),
+            success,
+            actor: actor.map(str::to_string),
+        });
         Ok(())
     }
 
+    /// Log a request turned away for its token (`details` says which). One
+    /// entry per [`REJECTED_AUDIT_INTERVAL`] at most, so a client guessing
+    /// tokens can't flood the log; it counts the rejections it stands for.
+    pub async fn log_rejected(&self, details: &str) -> Result<()> {
+        let skipped = {
+            let mut rejected = self.rejected.lock().unwrap();
+            let (last, skipped) = &mut *rejected;
+            if last.is_some_and(|at| at.elapsed() < REJECTED_AUDIT_INTERVAL) {
+                *skipped += 1;
+                return Ok(());
+            }
+            *last = Some(std::time::Instant::now());
+            std::mem::take(skipped)
+        };
+        let details = match skipped {
+            0 => details.to_string(),
+            n => format!("{} (and {} more since the last entry)", details, n),
+        };
+        self.log_as(None, "auth", "", "", Some(&details), false)
+            .await
+    }
+
+    /// Move entries older than `max_age` to `deploy_log_archive`, the only
+    /// way they leave the log. Returns how many were moved.
+    pub async fn archive(&self, max_age: Duration) -> Result<u64> {
+        let cutoff = chrono_cutoff(max_age);
+        let mut tx = self.pool.begin().await?;
+        sqlx::query(
+            "INSERT OR IGNORE INTO deploy_log_archive SELECT id, timestamp, action, process, instance_id, details, success, actor FROM deploy_log WHERE timestamp < ?",
+        )
+        .bind(&cutoff)
+        .execute(&mut *tx)
+        .await?;
+        let moved = sqlx::query("DELETE FROM deploy_log WHERE timestamp < ?")
+            .bind(&cutoff)
+            .execute(&mut *tx)
+            .await?;
+        tx.commit().await?;
+        Ok(moved.rows_affected())
+    }
+
     /// Query recent deploy log entries
     pub async fn recent(&self, limit: usize) -> Result<Vec<DeployLogEntry>> {
         let rows = sqlx::query(
-            "SELECT id, timestamp, action, process, instance_id, details, success FROM deploy_log ORDER BY timestamp DESC LIMIT ?",
+            "SELECT id, timestamp, action, process, instance_id, details, success, actor FROM deploy_log ORDER BY timestamp DESC LIMIT ?",
         )
         .bind(limit as i64)
         .fetch_all(&self.pool)
         .await?;
 
-        Ok(rows
-            .into_iter()
-            .map(|row| DeployLogEntry {
-                id: row.get("id"),
-                timestamp: row.get("timestamp"),
-                action: row.get("action"),
-                process: row.get("process"),
-                instance_id: row.get("instance_id"),
-                details: row.get("details"),
-                success: row.get::<i64, _>("success") != 0,
-            })
-            .collect())
+        Ok(rows.iter().map(deploy_log_entry_from_row).collect())
+    }
+
+    /// Entries matching `query`, newest first
+    pub async fn query(&self, query: &AuditQuery) -> Result<Vec<DeployLogEntry>> {
+        let since = match &query.since {
+            Some(since) => Some(
+                chrono::DateTime::parse_from_rfc3339(since)
+                    .with_context(|| format!("Invalid since time {:?}", since))?
+                    .with_timezone(&chrono::Utc)
+                    .to_rfc3339(),
+            ),
+            None => None,
+        };
+        let mut sql = String::from(
+            "SELECT id, timestamp, action, process, instance_id, details, success, actor FROM deploy_log WHERE 1 = 1",
+        );
+        let filters = [
+            ("actor", &query.actor),
+            ("action", &query.action),
+            ("process", &query.process),
+        ];
+        for (column, value) in &filters {
+            if value.is_some() {
+                sql.push_str(&format!(" AND {} = ?", column));
+            }
+        }
+        if since.is_some() {
+            sql.push_str(" AND timestamp >= ?");
+        }
+        if query.failed {
+            sql.push_str(" AND success = 0");
+        }
+        sql.push_str(" ORDER BY timestamp DESC, id DESC LIMIT ?");
+
+        let mut select = sqlx::query(&sql);
+        for value in filters.iter().filter_map(|(_, value)| value.as_ref()) {
+            select = select.bind(value);
+        }
+        if let Some(since) = &since {
+            select = select.bind(since);
+        }
+        let rows = select
+            .bind(query.limit.unwrap_or(100) as i64)
+            .fetch_all(&self.pool)
+            .await?;
+        Ok(rows.iter().map(deploy_log_entry_from_row).collect())
     }
 }
 
+fn deploy_log_entry_from_row(row: &sqlx::sqlite::SqliteRow) -> DeployLogEntry {
+    DeployLogEntry {
+        id: row.get("id"),
+        timestamp: row.get("timestamp"),
+        action: row.get("action"),
+        process: row.get("process"),
+        instance_id: row.get("instance_id"),
+        details: row.get("details"),
+        success: row.get::<i64, _>("success") != 0,
+        actor: row.get("actor"),
+    }
+}
+
+/// What a release ran: the service's command, args and inline env when it was
+/// deployed, and the artifact it was deployed from (and unpacked into `workdir`)
+#[derive(Debug, Clone, Default, PartialEq, serde::Serialize, serde::Deserialize)]
+pub struct ReleaseDefinition {
+    pub command: String,
+    pub args: Vec<String>,
+    pub env: BTreeMap<String, String>,
+    pub artifact: Option<String>,
+    /// `APP_VERSION` the release ran with (the commit of a `git push` deploy)
+    #[serde(default)]
+    pub app_version: Option<String>,
+    /// Release directory the instance ran in, for fetched and pushed artifacts
+    #[serde(default)]
+    pub workdir: Option<String>,
+    /// OCI image the release ran, for container services
+    #[serde(default)]
+    pub image: Option<String>,
+    /// Commit the release was built from, for `git push` deploys
+    #[serde(default)]
+    pub git_sha: Option<String>,
+}
+
+/// A numbered deploy of a service
+#[derive(Debug, Clone, serde::Serialize, serde::Deserialize)]
+pub struct Release {
+    pub process: String,
+    /// 1, 2, 3... per service
+    pub number: u32,
+    /// Instance id the release ran as
+    pub version: String,
+    #[serde(flatten)]
+    pub definition: ReleaseDefinition,
+    /// "deploy", or "rollback to #N"
+    pub description: String,
+    pub created_at: String,
+}
+
+/// Store for release history
+pub struct ReleaseStore {
+    pool: DbPool,
+}
+
+impl ReleaseStore {
+    pub fn new(pool: DbPool) -> Self {
+        Self { pool }
+    }
+
+    /// Record a release as the service's next number
+    pub async fn record(
+        &self,
+        process: &str,
+        version: &str,
+        definition: &ReleaseDefinition,
+        description: &str,
+    ) -> Result<Release> {
+        let now = chrono::Utc::now().to_rfc3339();
+        let row = sqlx::query(
+            "INSERT INTO releases (process, number, version, command, args, env, artifact, \
+             app_version, workdir, image, git_sha, description, created_at) \
+             VALUES (?, (SELECT COALESCE(MAX(number), 0) + 1 FROM releases WHERE process = ?), \
+             ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?) RETURNING number",
+        )
+        .bind(process)
+        .bind(process)
+        .bind(version)
+        .bind(&definition.command)
+        .bind(serde_json::to_string(&definition.args)?)
+        .bind(serde_json::to_string(&definition.env)?)
+        .bind(&definition.artifact)
+        .bind(&definition.app_version)
+        .bind(&definition.workdir)
+        .bind(&definition.image)
+        .bind(&definition.git_sha)
+        .bind(description)
+        .bind(&now)
+        .fetch_one(&self.pool)
+        .await
+        .with_context(|| format!("Failed to record release of {}", process))?;
+
+        Ok(Release {
+            process: process.to_string(),
+            number: row.get::<i64, _>("number") as u32,
+            version: version.to_string(),
+            definition: definition.clone(),
+            description: description.to_string(),
+            created_at: now,
+        })
+    }
+
+    /// A service's releases, newest first
+    pub async fn list(&self, process: &str) -> Result<Vec<Release>> {
+        let rows = sqlx::query(
+            "SELECT process, number, version, command, args, env, artifact, app_version, \
+             workdir, image, git_sha, description, created_at FROM releases WHERE process = ? \
+             ORDER BY number DESC",
+        )
+        .bind(process)
+        .fetch_all(&self.pool)
+        .await?;
+        rows.iter().map(release_from_row).collect()
+    }
+
+    /// One release of a service by number
+    pub async fn get(&self, process: &str, number: u32) -> Result<Option<Release>> {
+        let row = sqlx::query(
+            "SELECT process, number, version, command, args, env, artifact, app_version, \
+             workdir, image, git_sha, description, created_at FROM releases \
+             WHERE process = ? AND number = ?",
+        )
+        .bind(process)
+        .bind(number as i64)
+        .fetch_optional(&self.pool)
+        .await?;
+        row.as_ref().map(release_from_row).transpose()
+    }
+}
+
+fn release_from_row(row: &sqlx::sqlite::SqliteRow) -> Result<Release> {
+    let args: String = row.get("args");
+    let env: String = row.get("env");
+    Ok(Release {
+        process: row.get("process"),
+        number: row.get::<i64, _>("number") as u32,
+        version: row.get("version"),
+        definition: ReleaseDefinition {
+            command: row.get("command"),
+            args: serde_json::from_str(&args).context("Malformed release args")?,
+            env: serde_json::from_str(&env).context("Malformed release env")?,
+            artifact: row.get("artifact"),
+            app_version: row.get("app_version"),
+            workdir: row.get("workdir"),
+            image: row.get("image"),
+            git_sha: row.get("git_sha"),
+        },
+        description: row.get("description"),
+        created_at: row.get("created_at"),
+    })
+}
+
 /// Log store with batch flushing
 pub struct LogStore {
     pool: DbPool,
@@ -695,13 +1249,18 @@ impl ConfigStore {
 }
 
 /// Persisted instance state for crash recovery
-#[derive(Debug, Clone)]
+#[derive(Debug, Clone, serde::Serialize, serde::Deserialize)]
 pub struct InstanceState {
     pub instance_id: String,
     pub process_name: String,
     pub id: String,
     pub pid: u32,
     pub port: Option<u16>,
+    pub socket: String,
+    /// Share of traffic (0-100)
+    pub weight: u8,
+    /// Restarts so far, for backoff and crash-loop detection
+    pub restarts: u32,
     pub started_at: String,
 }
 
@@ -718,19 +1277,44 @@ impl StateStore {
     /// Record a running instance
     pub async fn save(&self, state: &InstanceState) -> Result<()> {
         sqlx::query(
-            "INSERT OR REPLACE INTO instance_state (instance_id, process_name, id, pid, port, started_at) VALUES (?, ?, ?, ?, ?, ?)",
+            "INSERT OR REPLACE INTO instance_state \
+             (instance_id, process_name, id, pid, port, socket, weight, restarts, started_at) \
+             VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
         )
         .bind(&state.instance_id)
         .bind(&state.process_name)
         .bind(&state.id)
         .bind(state.pid as i64)
         .bind(state.port.map(|p| p as i64))
+        .bind(&state.socket)
+        .bind(state.weight as i64)
+        .bind(state.restarts as i64)
         .bind(&state.started_at)
         .execute(&self.pool)
         .await?;
         Ok(())
     }
 
+    /// Record a running instance's new weight
+    pub async fn set_weight(&self, instance_id: &str, weight: u8) -> Result<()> {
+        sqlx::query("UPDATE instance_state SET weight = ? WHERE instance_id = ?")
+            .bind(weight as i64)
+            .bind(instance_id)
+            .execute(&self.pool)
+            .await?;
+        Ok(())
+    }
+
+    /// Record a running instance's restart count
+    pub async fn set_restarts(&self, instance_id: &str, restarts: u32) -> Result<()> {
+        sqlx::query("UPDATE instance_state SET restarts = ? WHERE instance_id = ?")
+            .bind(restarts as i64)
+            .bind(instance_id)
+            .execute(&self.pool)
+            .await?;
+        Ok(())
+    }
+
     /// Remove an instance record (called on stop)
     pub async fn remove(&self, instance_id: &str) -> Result<()> {
         sqlx::query("DELETE FROM instance_state WHERE instance_id = ?")
@@ -743,7 +1327,8 @@ impl StateStore {
     /// Get all persisted instance states (called on startup for recovery)
     pub async fn list(&self) -> Result<Vec<InstanceState>> {
         let rows = sqlx::query(
-            "SELECT instance_id, process_name, id, pid, port, started_at FROM instance_state",
+            "SELECT instance_id, process_name, id, pid, port, socket, weight, restarts, started_at \
+             FROM instance_state",
         )
         .fetch_all(&self.pool)
         .await?;
@@ -756,11 +1341,74 @@ impl StateStore {
                 id: row.get("id"),
                 pid: row.get::<i64, _>("pid") as u32,
                 port: row.get::<Option<i64>, _>("port").map(|p| p as u16),
+                socket: row.get("socket"),
+                weight: row.get::<i64, _>("weight") as u8,
+                restarts: row.get::<i64, _>("restarts") as u32,
                 started_at: row.get("started_at"),
             })
             .collect())
     }
 
+    /// Record the release a version is pinned to (as JSON)
+    pub async fn save_pin(&self, instance_id: &str, pin: &str) -> Result<()> {
+        sqlx::query("INSERT OR REPLACE INTO release_pins (instance_id, pin) VALUES (?, ?)")
+            .bind(instance_id)
+            .bind(pin)
+            .execute(&self.pool)
+            .await?;
+        Ok(())
+    }
+
+    /// Forget a version's release pin
+    pub async fn remove_pin(&self, instance_id: &str) -> Result<()> {
+        sqlx::query("DELETE FROM release_pins WHERE instance_id = ?")
+            .bind(instance_id)
+            .execute(&self.pool)
+            .await?;
+        Ok(())
+    }
+
+    /// All release pins as (instance id, JSON)
+    pub async fn pins(&self) -> Result<Vec<(String, String)>> {
+        let rows = sqlx::query("SELECT instance_id, pin FROM release_pins")
+            .fetch_all(&self.pool)
+            .await?;
+        Ok(rows
+            .into_iter()
+            .map(|row| (row.get("instance_id"), row.get("pin")))
+            .collect())
+    }
+
+    /// Record the port an instance was given, to give it again next time
+    pub async fn save_port(&self, instance_id: &str, port: u16) -> Result<()> {
+        sqlx::query("INSERT OR REPLACE INTO port_assignments (instance_id, port) VALUES (?, ?)")
+            .bind(instance_id)
+            .bind(port as i64)
+            .execute(&self.pool)
+            .await?;
+        Ok(())
+    }
+
+    /// Forget an instance's port
+    pub async fn remove_port(&self, instance_id: &str) -> Result<()> {
+        sqlx::query("DELETE FROM port_assignments WHERE instance_id = ?")
+            .bind(instance_id)
+            .execute(&self.pool)
+            .await?;
+        Ok(())
+    }
+
+    /// All port assignments as (instance id, port)
+    pub async fn ports(&self) -> Result<Vec<(String, u16)>> {
+        let rows = sqlx::query("SELECT instance_id, port FROM port_assignments")
+            .fetch_all(&self.pool)
+            .await?;
+        Ok(rows
+            .into_iter()
+            .map(|row| (row.get("instance_id"), row.get::<i64, _>("port") as u16))
+            .collect())
+    }
+
     /// Clear all instance state (called after recovery)
     pub async fn clear_all(&self) -> Result<()> {
         sqlx::query("DELETE FROM instance_state")
@@ -1433,6 +2081,310 @@ mod tests {
         assert_eq!(store.get("key").await.unwrap(), Some(special.to_string()));
     }
 
+    // ===================
+    // STATE STORE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_state_store_round_trip() {
+        let (pool, _dir) = create_test_db().await;
+        let store = StateStore::new(pool);
+        store
+            .save(&InstanceState {
+                instance_id: "api:v1".to_string(),
+                process_name: "api".to_string(),
+                id: "v1".to_string(),
+                pid: 4242,
+                port: Some(30001),
+                socket: "/tmp/api-v1.sock".to_string(),
+                weight: 100,
+                restarts: 0,
+                started_at: "2026-10-14T09:00:00+00:00".to_string(),
+            })
+            .await
+            .unwrap();
+        store.set_weight("api:v1", 25).await.unwrap();
+        store.set_restarts("api:v1", 2).await.unwrap();
+
+        let states = store.list().await.unwrap();
+        assert_eq!(states.len(), 1);
+        assert_eq!(states[0].port, Some(30001));
+        assert_eq!(states[0].socket, "/tmp/api-v1.sock");
+        assert_eq!((states[0].weight, states[0].restarts), (25, 2));
+
+        store.save_pin("api:v1", "{}").await.unwrap();
+        assert_eq!(
+            store.pins().await.unwrap(),
+            vec![("api:v1".into(), "{}".into())]
+        );
+        store.remove_pin("api:v1").await.unwrap();
+        assert!(store.pins().await.unwrap().is_empty());
+
+        store.save_port("api:v1", 30001).await.unwrap();
+        store.save_port("api:v1", 30002).await.unwrap();
+        // Ports outlive the instance's state
+        store.clear_all().await.unwrap();
+        assert_eq!(store.ports().await.unwrap(), vec![("api:v1".into(), 30002)]);
+        store.remove_port("api:v1").await.unwrap();
+        assert!(store.ports().await.unwrap().is_empty());
+    }
+
+    #[tokio::test]
+    async fn test_init_db_adds_state_columns_to_old_databases() {
+        let dir = TempDir::new().unwrap();
+        let path = dir.path().join("old.db");
+        let pool = init_db(&path).await.unwrap();
+        // The table as earlier versions created it
+        sqlx::query("DROP TABLE instance_state")
+            .execute(&pool)
+            .await
+            .unwrap();
+        sqlx::query(
+            "CREATE TABLE instance_state (instance_id TEXT PRIMARY KEY, \
+             process_name TEXT NOT NULL, id TEXT NOT NULL, pid INTEGER NOT NULL, \
+             port INTEGER, started_at TEXT NOT NULL)",
+        )
+        .execute(&pool)
+        .await
+        .unwrap();
+        sqlx::query("INSERT INTO instance_state VALUES ('api:v1', 'api', 'v1', 1, NULL, 'then')")
+            .execute(&pool)
+            .await
+            .unwrap();
+        pool.close().await;
+
+        let store = StateStore::new(init_db(&path).await.unwrap());
+        let states = store.list().await.unwrap();
+        assert_eq!(states[0].instance_id, "api:v1");
+        assert_eq!((states[0].weight, states[0].restarts), (100, 0));
+    }
+
+    // ===================
+    // API TOKEN STORE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_api_token_store() {
+        let (pool, _dir) = create_test_db().await;
+        let store = ApiTokenStore::new(pool);
+        let ci = store.generate_and_store("ci", Scope::Deploy).await.unwrap();
+        let viewer = store
+            .generate_and_store("viewer", Scope::Read)
+            .await
+            .unwrap();
+        let err = store
+            .generate_and_store("ci", Scope::Admin)
+            .await
+            .unwrap_err();
+        assert!(err.to_string().contains("already exists"), "{}", err);
+
+        let token = store.verify(&ci).await.unwrap().unwrap();
+        assert_eq!((token.name.as_str(), token.scope), ("ci", Scope::Deploy));
+        assert_eq!(
+            store.verify(&viewer).await.unwrap().unwrap().scope,
+            Scope::Read
+        );
+        assert!(store.verify("not-a-token").await.unwrap().is_none());
+
+        let names: Vec<String> = store
+            .list()
+            .await
+            .unwrap()
+            .into_iter()
+            .map(|t| t.name)
+            .collect();
+        assert_eq!(names, vec!["ci", "viewer"]);
+
+        assert!(store.revoke("ci").await.unwrap());
+        assert!(!store.revoke("ci").await.unwrap());
+        assert!(store.verify(&ci).await.unwrap().is_none());
+    }
+
+    #[tokio::test]
+    async fn test_deploy_log_records_actor() {
+        let (pool, _dir) = create_test_db().await;
+        let log = DeployLogStore::new(pool);
+        log.log("deploy", "api", "v1", None, true).await.unwrap();
+        log.log_as(
+            Some("token:ci"),
+            "api",
+            "",
+            "",
+            Some("POST /api/deploy 200"),
+            true,
+        )
+        .await
+        .unwrap();
+
+        let entries = log.recent(10).await.unwrap();
+        let actors: Vec<Option<&str>> = entries.iter().map(|e| e.actor.as_deref()).collect();
+        assert!(actors.contains(&Some("token:ci")));
+        assert!(actors.contains(&None));
+    }
+
+    #[tokio::test]
+    async fn test_deploy_log_query_filters() {
+        let (pool, _dir) = create_test_db().await;
+        let log = DeployLogStore::new(pool);
+        log.log_as(Some("token:ci"), "deploy", "api", "v1", None, true)
+            .await
+            .unwrap();
+        log.log_as(Some("admin"), "restart", "api", "v1", None, false)
+            .await
+            .unwrap();
+        log.log_as(Some("admin"), "deploy", "web", "v1", None, true)
+            .await
+            .unwrap();
+
+        async fn count(log: &DeployLogStore, query: AuditQuery) -> usize {
+            log.query(&query).await.unwrap().len()
+        }
+        assert_eq!(count(&log, AuditQuery::default()).await, 3);
+        let by_admin = AuditQuery {
+            actor: Some("admin".to_string()),
+            ..Default::default()
+        };
+        assert_eq!(count(&log, by_admin).await, 2);
+        let api_deploys = AuditQuery {
+            action: Some("deploy".to_string()),
+            process: Some("api".to_string()),
+            ..Default::default()
+        };
+        assert_eq!(count(&log, api_deploys).await, 1);
+        let failed = AuditQuery {
+            failed: true,
+            ..Default::default()
+        };
+        assert_eq!(count(&log, failed).await, 1);
+        let limited = AuditQuery {
+            limit: Some(2),
+            ..Default::default()
+        };
+        let newest = log.query(&limited).await.unwrap();
+        assert_eq!(newest.len(), 2);
+        assert_eq!(newest[0].process, "web");
+
+        let future = AuditQuery {
+            since: Some("2999-01-01T00:00:00Z".to_string()),
+            ..Default::default()
+        };
+        assert_eq!(count(&log, future).await, 0);
+        let bad_since = AuditQuery {
+            since: Some("yesterday".to_string()),
+            ..Default::default()
+        };
+        assert!(log.query(&bad_since).await.is_err());
+    }
+
+    #[tokio::test]
+    async fn test_deploy_log_is_append_only() {
+        let (pool, _dir) = create_test_db().await;
+        let log = DeployLogStore::new(pool.clone());
+        let mut appended = log.subscribe();
+        log.log("deploy", "api", "v1", None, true).await.unwrap();
+        assert_eq!(appended.recv().await.unwrap().action, "deploy");
+
+        let update = sqlx::query("UPDATE deploy_log SET success = 0")
+            .execute(&pool)
+            .await;
+        assert!(update.unwrap_err().to_string().contains("append-only"));
+        assert!(sqlx::query("DELETE FROM deploy_log")
+            .execute(&pool)
+            .await
+            .is_err());
+        assert_eq!(log.recent(10).await.unwrap().len(), 1);
+    }
+
+    #[tokio::test]
+    async fn test_deploy_log_archives_old_entries() {
+        let (pool, _dir) = create_test_db().await;
+        let log = DeployLogStore::new(pool.clone());
+        log.log("deploy", "api", "v1", None, true).await.unwrap();
+        assert_eq!(log.archive(Duration::from_secs(3600)).await.unwrap(), 0);
+        assert_eq!(log.archive(Duration::ZERO).await.unwrap(), 1);
+        assert!(log.recent(10).await.unwrap().is_empty());
+
+        let archived = sqlx::query("SELECT action FROM deploy_log_archive")
+            .fetch_all(&pool)
+            .await
+            .unwrap();
+        assert_eq!(archived.len(), 1);
+        assert_eq!(archived[0].get::<String, _>("action"), "deploy");
+        let delete = sqlx::query("DELETE FROM deploy_log_archive")
+            .execute(&pool)
+            .await;
+        assert!(delete.unwrap_err().to_string().contains("append-only"));
+    }
+
+    #[tokio::test]
+    async fn test_rejected_tokens_are_logged_once_per_interval() {
+        let (pool, _dir) = create_test_db().await;
+        let log = DeployLogStore::new(pool);
+        for _ in 0..3 {
+            log.log_rejected("GET /api/instances rejected")
+                .await
+                .unwrap();
+        }
+        assert_eq!(log.recent(10).await.unwrap().len(), 1);
+
+        // The next entry after the interval counts the ones it skipped
+        log.rejected.lock().unwrap().0 = Some(std::time::Instant::now() - REJECTED_AUDIT_INTERVAL);
+        log.log_rejected("POST /api/deploy rejected").await.unwrap();
+        let entries = log.recent(10).await.unwrap();
+        assert_eq!(entries.len(), 2);
+        let details: Vec<_> = entries
+            .iter()
+            .filter_map(|e| e.details.as_deref())
+            .collect();
+        assert!(details.contains(&"POST /api/deploy rejected (and 2 more since the last entry)"));
+    }
+
+    // ===================
+    // RELEASE STORE TESTS
+    // ===================
+
+    #[tokio::test]
+    async fn test_release_store_numbers_per_service() {
+        let (pool, _dir) = create_test_db().await;
+        let store = ReleaseStore::new(pool);
+        let definition = ReleaseDefinition {
+            command: "./api".to_string(),
+            args: vec!["--port".to_string(), "{port}".to_string()],
+            env: BTreeMap::from([("LEVEL".to_string(), "info".to_string())]),
+            artifact: Some("s3://builds/api-1.tar.gz".to_string()),
+            app_version: Some("0a1b2c3".to_string()),
+            workdir: Some("/var/lib/ten/.releases/api/v1".to_string()),
+            image: Some("registry.local/api:v1".to_string()),
+            git_sha: Some("0a1b2c3d4e5f60718293a4b5c6d7e8f901234567".to_string()),
+        };
+
+        let first = store
+            .record("api", "v1", &definition, "deploy")
+            .await
+            .unwrap();
+        let second = store
+            .record("api", "v2", &ReleaseDefinition::default(), "deploy")
+            .await;
+        let other = store
+            .record("web", "v1", &definition, "deploy")
+            .await
+            .unwrap();
+        assert_eq!(first.number, 1);
+        assert_eq!(second.unwrap().number, 2);
+        assert_eq!(other.number, 1, "numbers count per service");
+
+        let listed = store.list("api").await.unwrap();
+        let numbers: Vec<u32> = listed.iter().map(|r| r.number).collect();
+        assert_eq!(numbers, vec![2, 1], "newest first");
+
+        let fetched = store.get("api", 1).await.unwrap().unwrap();
+        assert_eq!(fetched.version, "v1");
+        assert_eq!(fetched.definition, definition);
+        assert_eq!(fetched.created_at, first.created_at);
+        assert!(store.get("api", 3).await.unwrap().is_none());
+        assert!(store.list("worker").await.unwrap().is_empty());
+    }
+
     // ===================
     // TIMESTAMP CONVERSION TESTS
     // ===================
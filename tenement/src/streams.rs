@@ -0,0 +1,378 @@
+//! Raw TCP and UDP forwarding for services that don't speak HTTP
+//!
+//! A service with `protocol = "tcp"` or `"udp"` (a database, a game server, an
+//! SMTP listener) isn't routed. tenement listens on its `listen` port and
+//! forwards each TCP connection byte for byte, or each UDP client's datagrams,
+//! to a running instance picked by the service's `load_balance`: to its PORT,
+//! or for TCP to its socket when it has none. Each UDP client gets a flow of
+//! its own, so replies find their way back.
+//!
+//! `listen.max_connections` caps the connections (UDP: clients) served at
+//! once; more are turned away. `stream_idle_timeout` closes a connection that
+//! goes quiet both ways, and ends a UDP flow (after [`UDP_FLOW_IDLE`] without
+//! it). Nothing new is accepted while tenement drains. The listeners follow
+//! the config read at startup.
+
+use crate::hypervisor::ConnectionGuard;
+use crate::sockets::AcceptBackoff;
+use crate::Hypervisor;
+use anyhow::{Context, Result};
+use std::collections::HashMap;
+use std::net::SocketAddr;
+use std::sync::{Arc, Mutex};
+use std::time::Duration;
+use tokio::io::{AsyncRead, AsyncWrite};
+use tokio::net::{TcpListener, TcpStream, UdpSocket};
+use tokio::sync::{mpsc, Semaphore};
+
+/// How long a UDP flow lasts without traffic when the service sets no
+/// `stream_idle_timeout`
+pub const UDP_FLOW_IDLE: Duration = Duration::from_secs(60);
+
+/// Largest datagram relayed
+const MAX_DATAGRAM: usize = 64 * 1024;
+
+/// The name a service's listener is handed to the next supervisor under
+pub fn listener_name(service: &str) -> String {
+    format!("stream-{}", service)
+}
+
+/// Accept TCP connections for `service` and splice each to an instance
+pub async fn serve_tcp(hypervisor: Arc<Hypervisor>, service: String, listener: TcpListener) {
+    let max = max_connections(&hypervisor, &service);
+    let open = Arc::new(Semaphore::new(max));
+    let mut backoff = AcceptBackoff::default();
+    loop {
+        let (conn, peer) = match listener.accept().await {
+            Ok(accepted) => accepted,
+            Err(e) => {
+                tracing::warn!("{} (tcp): accept failed: {}", service, e);
+                backoff.failed().await;
+                continue;
+            }
+        };
+        backoff.succeeded();
+        if hypervisor.is_draining() {
+            continue;
+        }
+        let Ok(permit) = open.clone().try_acquire_owned() else {
+            tracing::warn!(
+                "{} (tcp): turning {} away, {} connections already open",
+                service,
+                peer,
+                max
+            );
+            continue;
+        };
+        let (hypervisor, service) = (hypervisor.clone(), service.clone());
+        tokio::spawn(async move {
+            let _permit = permit;
+            if let Err(e) = splice_tcp(&hypervisor, &service, conn).await {
+                tracing::debug!("{} (tcp): connection from {} ended: {:#}", service, peer, e);
+            }
+        });
+    }
+}
+
+/// Connect `conn` to an instance of `service` and copy until either side is done
+async fn splice_tcp(hypervisor: &Hypervisor, service: &str, mut conn: TcpStream) -> Result<()> {
+    let target = hypervisor
+        .select_instance(service)
+        .await
+        .with_context(|| format!("no instance of {} is running", service))?;
+    let _guard = hypervisor
+        .connection_start(&target.id.process, &target.id.id)
+        .await;
+    hypervisor
+        .touch_activity(&target.id.process, &target.id.id)
+        .await;
+    let idle = hypervisor.stream_idle_timeout(service);
+    match target.port {
+        Some(port) => {
+            let mut upstream = TcpStream::connect(("127.0.0.1", port)).await?;
+            copy_bidirectional_idle(&mut conn, &mut upstream, idle).await?;
+        }
+        None => {
+            let mut upstream = crate::sockets::connect(&target.socket).await?;
+            copy_bidirectional_idle(&mut conn, &mut upstream, idle).await?;
+        }
+    }
+    Ok(())
+}
+
+/// Datagrams from each UDP client, queued for the task relaying its flow
+type Flows = Arc<Mutex<HashMap<SocketAddr, mpsc::Sender<Vec<u8>>>>>;
+
+/// Datagrams queued for a flow that's opening or busy; more are dropped
+const FLOW_QUEUE: usize = 64;
+
+/// Relay datagrams between clients on `socket` and instances of `service`
+///
+/// A new client's flow is opened by a task of its own, so a slow instance
+/// holds up only the clients it serves.
+pub async fn serve_udp(hypervisor: Arc<Hypervisor>, service: String, socket: UdpSocket) {
+    let max = max_connections(&hypervisor, &service);
+    let socket = Arc::new(socket);
+    let flows: Flows = Arc::default();
+    let mut buf = vec![0u8; MAX_DATAGRAM];
+    let mut backoff = AcceptBackoff::default();
+    loop {
+        let (len, client) = match socket.recv_from(&mut buf).await {
+            Ok(received) => received,
+            Err(e) => {
+                tracing::debug!("{} (udp): receive failed: {}", service, e);
+                backoff.failed().await;
+                continue;
+            }
+        };
+        backoff.succeeded();
+        let existing = flows.lock().unwrap().get(&client).cloned();
+        let datagrams = match existing {
+            Some(datagrams) => datagrams,
+            None => {
+                if hypervisor.is_draining() {
+                    continue;
+                }
+                if flows.lock().unwrap().len() >= max {
+                    tracing::warn!(
+                        "{} (udp): dropping datagram from {}, {} clients already served",
+                        service,
+                        client,
+                        max
+                    );
+                    continue;
+                }
+                // Counted against `max` while it opens
+                let (sender, receiver) = mpsc::channel(FLOW_QUEUE);
+                flows.lock().unwrap().insert(client, sender.clone());
+                let (hypervisor, service) = (hypervisor.clone(), service.clone());
+                let (socket, flows) = (socket.clone(), flows.clone());
+                tokio::spawn(async move {
+                    let flow = run_flow(&hypervisor, &service, socket, client, receiver);
+                    if let Err(e) = flow.await {
+                        tracing::debug!("{} (udp): flow for {} ended: {:#}", service, client, e);
+                    }
+                    flows.lock().unwrap().remove(&client);
+                });
+                sender
+            }
+        };
+        if datagrams.try_send(buf[..len].to_vec()).is_err() {
+            tracing::debug!(
+                "{} (udp): dropping datagram from {}, its flow is behind",
+                service,
+                client
+            );
+        }
+    }
+}
+
+/// Open a flow for `client` to an instance of `service` and relay it until
+/// it goes quiet
+async fn run_flow(
+    hypervisor: &Hypervisor,
+    service: &str,
+    socket: Arc<UdpSocket>,
+    client: SocketAddr,
+    datagrams: mpsc::Receiver<Vec<u8>>,
+) -> Result<()> {
+    let (upstream, guard) = open_flow(hypervisor, service).await?;
+    let idle = hypervisor
+        .stream_idle_timeout(service)
+        .unwrap_or(UDP_FLOW_IDLE);
+    relay_flow(socket, client, upstream, datagrams, idle, guard).await?;
+    Ok(())
+}
+
+/// A socket connected to an instance of `service`
+async fn open_flow(hypervisor: &Hypervisor, service: &str) -> Result<(UdpSocket, ConnectionGuard)> {
+    let target = hypervisor
+        .select_instance(service)
+        .await
+        .with_context(|| format!("no instance of {} is running", service))?;
+    let port = target
+        .port
+        .with_context(|| format!("{} has no PORT to send datagrams to", target.id))?;
+    let upstream = UdpSocket::bind(("127.0.0.1", 0)).await?;
+    upstream.connect(("127.0.0.1", port)).await?;
+    let guard = hypervisor
+        .connection_start(&target.id.process, &target.id.id)
+        .await;
+    hypervisor
+        .touch_activity(&target.id.process, &target.id.id)
+        .await;
+    Ok((upstream, guard))
+}
+
+/// Forward `client`'s datagrams to `upstream` and its replies back on `socket`
+/// until neither has sent anything for `idle`, holding `guard` until then
+async fn relay_flow<G>(
+    socket: Arc<UdpSocket>,
+    client: SocketAddr,
+    upstream: UdpSocket,
+    mut datagrams: mpsc::Receiver<Vec<u8>>,
+    idle: Duration,
+    guard: G,
+) -> std::io::Result<()> {
+    let _guard = guard;
+    let mut buf = vec![0u8; MAX_DATAGRAM];
+    loop {
+        tokio::select! {
+            datagram = datagrams.recv() => {
+                let Some(datagram) = datagram else {
+                    return Ok(());
+                };
+                upstream.send(&datagram).await?;
+            }
+            // Fails once nothing listens on the instance's port any more
+            len = upstream.recv(&mut buf) => {
+                socket.send_to(&buf[..len?], client).await.ok();
+            }
+            _ = tokio::time::sleep(idle) => return Ok(()),
+        }
+    }
+}
+
+fn max_connections(hypervisor: &Hypervisor, service: &str) -> usize {
+    hypervisor
+        .config()
+        .get_service(service)
+        .and_then(|svc| svc.listen.as_ref())
+        .map_or(1, |listen| listen.max_connections)
+}
+
+/// Copy between `a` and `b` in both directions until both have closed. Fails
+/// with `TimedOut` when neither sends anything for `idle`.
+pub async fn copy_bidirectional_idle<A, B>(
+    a: &mut A,
+    b: &mut B,
+    idle: Option<Duration>,
+) -> std::io::Result<()>
+where
+    A: AsyncRead + AsyncWrite + Unpin,
+    B: AsyncRead + AsyncWrite + Unpin,
+{
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    let mut a_buf = vec![0u8; 16 * 1024];
+    let mut b_buf = vec![0u8; 16 * 1024];
+    let (mut a_open, mut b_open) = (true, true);
+    while a_open || b_open {
+        let idle_for = async {
+            match idle {
+                Some(idle) => tokio::time::sleep(idle).await,
+                None => std::future::pending().await,
+            }
+        };
+        tokio::select! {
+            n = a.read(&mut a_buf), if a_open => match n? {
+                0 => {
+                    a_open = false;
+                    b.shutdown().await?;
+                }
+                n => b.write_all(&a_buf[..n]).await?,
+            },
+            n = b.read(&mut b_buf), if b_open => match n? {
+                0 => {
+                    b_open = false;
+                    a.shutdown().await?;
+                }
+                n => a.write_all(&b_buf[..n]).await?,
+            },
+            _ = idle_for => {
+                return Err(std::io::Error::new(
+                    std::io::ErrorKind::TimedOut,
+                    "no traffic within stream_idle_timeout",
+                ));
+            }
+        }
+    }
+    Ok(())
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::io::{AsyncReadExt, AsyncWriteExt};
+
+    // ===================
+    // Copying
+    // ===================
+
+    #[tokio::test]
+    async fn test_copy_both_ways_until_closed() {
+        let (mut client, mut a) = tokio::io::duplex(1024);
+        let (mut b, mut instance) = tokio::io::duplex(1024);
+        let copy = tokio::spawn(async move { copy_bidirectional_idle(&mut a, &mut b, None).await });
+
+        client.write_all(b"PING").await.unwrap();
+        let mut buf = [0u8; 4];
+        instance.read_exact(&mut buf).await.unwrap();
+        assert_eq!(&buf, b"PING");
+        instance.write_all(b"PONG").await.unwrap();
+        client.read_exact(&mut buf).await.unwrap();
+        assert_eq!(&buf, b"PONG");
+
+        drop(client);
+        drop(instance);
+        copy.await.unwrap().unwrap();
+    }
+
+    #[tokio::test]
+    async fn test_copy_times_out_when_quiet() {
+        let (_client, mut a) = tokio::io::duplex(1024);
+        let (mut b, _instance) = tokio::io::duplex(1024);
+        let idle = Some(Duration::from_millis(50));
+        let err = copy_bidirectional_idle(&mut a, &mut b, idle)
+            .await
+            .unwrap_err();
+        assert_eq!(err.kind(), std::io::ErrorKind::TimedOut);
+    }
+
+    // ===================
+    // Flows
+    // ===================
+
+    #[tokio::test]
+    async fn test_udp_flow_relays_both_ways_until_idle() {
+        let public = Arc::new(UdpSocket::bind("127.0.0.1:0").await.unwrap());
+        let client = UdpSocket::bind("127.0.0.1:0").await.unwrap();
+        let instance = UdpSocket::bind("127.0.0.1:0").await.unwrap();
+        let upstream = UdpSocket::bind("127.0.0.1:0").await.unwrap();
+        upstream
+            .connect(instance.local_addr().unwrap())
+            .await
+            .unwrap();
+        let (datagrams, receiver) = mpsc::channel(FLOW_QUEUE);
+        let guard = Arc::new(());
+        let client_addr = client.local_addr().unwrap();
+        let idle = Duration::from_millis(100);
+        let relay = tokio::spawn(relay_flow(
+            public,
+            client_addr,
+            upstream,
+            receiver,
+            idle,
+            guard.clone(),
+        ));
+
+        // Queued before the relay runs, as while a flow opens
+        datagrams.send(b"join".to_vec()).await.unwrap();
+        let mut buf = [0u8; 16];
+        let (len, from) = instance.recv_from(&mut buf).await.unwrap();
+        assert_eq!(&buf[..len], b"join");
+        instance.send_to(b"welcome", from).await.unwrap();
+        let len = client.recv(&mut buf).await.unwrap();
+        assert_eq!(&buf[..len], b"welcome");
+
+        // Quiet for `idle`: the flow ends and lets go of its connection
+        relay.await.unwrap().unwrap();
+        assert!(datagrams.is_closed());
+        assert_eq!(Arc::strong_count(&guard), 1);
+    }
+
+    #[test]
+    fn test_listener_name() {
+        assert_eq!(listener_name("db"), "stream-db");
+    }
+}
@@ -0,0 +1,155 @@
+//! One-off commands in a service's environment
+//!
+//! `tenement run api:prod -- ./migrate up` runs a command the way the service
+//! would run: same env files, inline env and secrets, working directory, login
+//! shell and user. It runs in the foreground on the host, outside the
+//! supervisor, so it suits migrations and maintenance scripts. Without an id
+//! (`tenement run api -- ...`), `{id}` in the service's templates is "run".
+
+use crate::config::Config;
+use crate::{env_files, secrets, users};
+use anyhow::{Context, Result};
+use std::process::Command;
+
+/// Instance id used when `tenement run` is given only a service name
+pub const DEFAULT_TASK_ID: &str = "run";
+
+/// Build the command for `argv`, run as the `process_name:id` instance would be
+pub fn command(config: &Config, process_name: &str, id: &str, argv: &[String]) -> Result<Command> {
+    let process_config = config
+        .get_service(process_name)
+        .with_context(|| format!("Unknown process: {}", process_name))?;
+    let (program, args) = argv.split_first().context("No command given to run")?;
+    if process_config.rootfs.is_some() || process_config.image.is_some() {
+        anyhow::bail!(
+            "Service '{}' runs in its own filesystem; \
+             `tenement run` only runs commands on the host",
+            process_name
+        );
+    }
+
+    let data_dir = &config.settings.data_dir;
+    let instance_data_dir = data_dir.join(process_name).join(id);
+    std::fs::create_dir_all(&instance_data_dir)
+        .with_context(|| format!("Failed to create data dir: {:?}", instance_data_dir))?;
+
+    let file_env = env_files::load(&process_config.env_files)
+        .with_context(|| format!("Failed to load env files for {}", process_name))?;
+    let mut env = process_config.env_interpolated(file_env, process_name, id, data_dir, None);
+    if !process_config.secrets.is_empty() {
+        let values = secrets::read_secrets(&process_config.secrets, data_dir)
+            .with_context(|| format!("Failed to load secrets for {}", process_name))?;
+        env.extend(values);
+    }
+    let missing = process_config.missing_required_env(&env, true);
+    if !missing.is_empty() {
+        anyhow::bail!(
+            "Service '{}' is missing required env var(s): {}",
+            process_name,
+            missing.join(", ")
+        );
+    }
+    let run_as = users::resolve(process_config.user.as_deref(), process_config.group.as_deref())
+        .with_context(|| format!("Cannot run as {}'s user", process_name))?;
+
+    let (program, args) = process_config.launch_command(program.clone(), args.to_vec());
+    let mut cmd = Command::new(program);
+    cmd.args(args).envs(env);
+    if let Some(workdir) = &process_config.workdir {
+        cmd.current_dir(workdir);
+    }
+    #[cfg(unix)]
+    if let Some(run_as) = run_as {
+        use std::os::unix::process::CommandExt;
+        run_as.chown(&instance_data_dir)?;
+        // SAFETY: apply only makes async-signal-safe syscalls
+        unsafe {
+            cmd.pre_exec(move || run_as.apply());
+        }
+    }
+    Ok(cmd)
+}
+
+/// Exit code to finish with when the command ended with `status`: its own
+/// code, or 128 + the signal that killed it, as shells report it
+pub fn exit_code(status: std::process::ExitStatus) -> i32 {
+    #[cfg(unix)]
+    {
+        use std::os::unix::process::ExitStatusExt;
+        if let Some(signal) = status.signal() {
+            return 128 + signal;
+        }
+    }
+    status.code().unwrap_or(1)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn config(dir: &TempDir, service: &str) -> Config {
+        let toml = format!(
+            "[settings]\ndata_dir = \"{}\"\n\n[service.api]\ncommand = \"./api\"\n{}",
+            dir.path().display(),
+            service
+        );
+        Config::from_str(&toml).unwrap()
+    }
+
+    fn run(config: &Config, id: &str, script: &str) -> (i32, String) {
+        let argv = ["sh".to_string(), "-c".to_string(), script.to_string()];
+        let output = command(config, "api", id, &argv).unwrap().output().unwrap();
+        (exit_code(output.status), String::from_utf8_lossy(&output.stdout).trim().to_string())
+    }
+
+    #[test]
+    fn test_runs_with_service_env_and_workdir() {
+        let dir = TempDir::new().unwrap();
+        let env_file = dir.path().join(".env");
+        std::fs::write(&env_file, "LEVEL=info\nHOST=db.internal\n").unwrap();
+        let config = config(
+            &dir,
+            &format!(
+                "env_files = [\"{}\"]\nworkdir = \"{}\"\n\
+                 [service.api.env]\nLEVEL = \"debug\"\nDATABASE = \"{{data_dir}}/{{id}}.db\"\n",
+                env_file.display(),
+                dir.path().display()
+            ),
+        );
+
+        let (code, out) = run(&config, "prod", "echo $LEVEL $HOST; pwd");
+        assert_eq!(code, 0);
+        let expected = format!("debug db.internal\n{}", dir.path().display());
+        assert_eq!(out, expected);
+
+        let (_, out) = run(&config, "prod", "echo $DATABASE");
+        assert!(out.ends_with("prod.db"), "{}", out);
+        assert!(dir.path().join("api").join("prod").is_dir());
+    }
+
+    #[test]
+    fn test_exit_code_propagates() {
+        let dir = TempDir::new().unwrap();
+        let config = config(&dir, "");
+        assert_eq!(run(&config, DEFAULT_TASK_ID, "exit 3").0, 3);
+        #[cfg(unix)]
+        assert_eq!(run(&config, DEFAULT_TASK_ID, "kill -9 $$").0, 128 + 9);
+    }
+
+    #[test]
+    fn test_rejects_what_cannot_run() {
+        let dir = TempDir::new().unwrap();
+        let argv = vec!["true".to_string()];
+
+        let config = config(&dir, "required_env = [\"TENEMENT_TEST_SURELY_UNSET\"]\n");
+        let err = command(&config, "api", "prod", &argv).unwrap_err();
+        assert!(err.to_string().contains("TENEMENT_TEST_SURELY_UNSET"), "{}", err);
+
+        let err = command(&config, "worker", "prod", &argv).unwrap_err();
+        assert!(err.to_string().contains("Unknown process"), "{}", err);
+
+        let err = command(&config, "api", "prod", &[]).unwrap_err();
+        assert!(err.to_string().contains("No command"), "{}", err);
+    }
+}
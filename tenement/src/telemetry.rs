@@ -0,0 +1,478 @@
+//! OpenTelemetry tracing (`[settings.tracing]`)
+//!
+//! Spans follow W3C Trace Context: a request that arrives with a `traceparent`
+//! continues the caller's trace, and the proxy sends its own `traceparent` to
+//! the backend so the app's spans hang off tenement's. Finished spans are
+//! batched and POSTed as OTLP/JSON to `{endpoint}/v1/traces`. Export is best
+//! effort: when the collector is slow or down, spans are dropped rather than
+//! queued without limit.
+
+use crate::config::TracingConfig;
+use std::fmt::Write as _;
+use std::sync::Arc;
+use std::time::{Duration, SystemTime, UNIX_EPOCH};
+use tokio::sync::mpsc;
+use tracing::{info, warn};
+
+/// Finished spans waiting for export; more are dropped
+const QUEUE_CAPACITY: usize = 2048;
+
+/// Spans per export request
+const MAX_BATCH: usize = 512;
+
+/// How long a span waits for a batch to fill
+const EXPORT_INTERVAL: Duration = Duration::from_secs(5);
+
+/// The header that carries trace context
+pub const TRACEPARENT: &str = "traceparent";
+
+/// The identity of a span, as propagated in `traceparent`
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct TraceContext {
+    pub trace_id: [u8; 16],
+    pub span_id: [u8; 8],
+    pub sampled: bool,
+}
+
+impl TraceContext {
+    /// Parse a `traceparent` header ("00-{trace id}-{span id}-{flags}")
+    pub fn parse(traceparent: &str) -> Option<Self> {
+        let mut parts = traceparent.trim().split('-');
+        let version = parts.next()?;
+        let trace_id = parts.next()?;
+        let span_id = parts.next()?;
+        let flags = parts.next()?;
+        // Later versions may add fields, but version 00 has exactly four
+        from_hex::<1>(version)?;
+        if version == "ff" || (version == "00" && parts.next().is_some()) {
+            return None;
+        }
+        let context = Self {
+            trace_id: from_hex(trace_id)?,
+            span_id: from_hex(span_id)?,
+            sampled: from_hex::<1>(flags)?[0] & 1 == 1,
+        };
+        let valid = context.trace_id != [0; 16] && context.span_id != [0; 8];
+        valid.then_some(context)
+    }
+
+    /// The `traceparent` header for this span
+    pub fn traceparent(&self) -> String {
+        format!(
+            "00-{}-{}-{}",
+            to_hex(&self.trace_id),
+            to_hex(&self.span_id),
+            if self.sampled { "01" } else { "00" }
+        )
+    }
+}
+
+/// What a span measures, as OTLP numbers it
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub enum SpanKind {
+    /// Work inside tenement (routing, a health check, a deploy)
+    #[default]
+    Internal = 1,
+    /// A request tenement received
+    Server = 2,
+    /// A request tenement sent (to a backend)
+    Client = 3,
+}
+
+/// A span attribute value
+#[derive(Debug, Clone, PartialEq)]
+pub enum AttributeValue {
+    String(String),
+    Int(i64),
+    Bool(bool),
+}
+
+impl From<&str> for AttributeValue {
+    fn from(value: &str) -> Self {
+        AttributeValue::String(value.to_string())
+    }
+}
+
+impl From<String> for AttributeValue {
+    fn from(value: String) -> Self {
+        AttributeValue::String(value)
+    }
+}
+
+impl From<i64> for AttributeValue {
+    fn from(value: i64) -> Self {
+        AttributeValue::Int(value)
+    }
+}
+
+impl From<u16> for AttributeValue {
+    fn from(value: u16) -> Self {
+        AttributeValue::Int(value.into())
+    }
+}
+
+impl From<bool> for AttributeValue {
+    fn from(value: bool) -> Self {
+        AttributeValue::Bool(value)
+    }
+}
+
+/// A finished span
+#[derive(Debug, Clone, Default)]
+struct SpanData {
+    name: String,
+    kind: SpanKind,
+    context: TraceContext,
+    parent_span_id: Option<[u8; 8]>,
+    start_unix_nanos: u64,
+    end_unix_nanos: u64,
+    attributes: Vec<(String, AttributeValue)>,
+    error: Option<String>,
+}
+
+/// Starts spans and exports them in the background
+pub struct Tracer {
+    sample_ratio: f64,
+    queue: mpsc::Sender<SpanData>,
+}
+
+impl Tracer {
+    /// A tracer exporting to `config.endpoint`. The exporter runs on the current
+    /// tokio runtime; without one, spans are started but never exported.
+    pub fn new(config: &TracingConfig) -> Arc<Self> {
+        let (queue, spans) = mpsc::channel(QUEUE_CAPACITY);
+        match tokio::runtime::Handle::try_current() {
+            Ok(runtime) => {
+                runtime.spawn(export_loop(config.clone(), spans));
+            }
+            Err(_) => warn!("No async runtime for the trace exporter; spans won't be exported"),
+        }
+        Arc::new(Self {
+            sample_ratio: config.sample_ratio,
+            queue,
+        })
+    }
+
+    /// Start a span, as a child of `parent` or the root of a new trace. Root
+    /// spans are sampled at `sample_ratio`; children follow their parent.
+    pub fn start(&self, name: &str, kind: SpanKind, parent: Option<&TraceContext>) -> Span {
+        let context = TraceContext {
+            trace_id: parent.map_or_else(random_id, |p| p.trace_id),
+            span_id: random_id(),
+            sampled: parent
+                .map_or_else(|| rand::random::<f64>() < self.sample_ratio, |p| p.sampled),
+        };
+        Span {
+            data: SpanData {
+                name: name.to_string(),
+                kind,
+                context,
+                parent_span_id: parent.map(|p| p.span_id),
+                start_unix_nanos: unix_nanos(),
+                end_unix_nanos: 0,
+                attributes: Vec::new(),
+                error: None,
+            },
+            queue: context.sampled.then(|| self.queue.clone()),
+        }
+    }
+}
+
+/// A span in progress. It ends, and is queued for export, when dropped.
+pub struct Span {
+    data: SpanData,
+    /// None when the span isn't sampled
+    queue: Option<mpsc::Sender<SpanData>>,
+}
+
+impl Span {
+    /// This span's identity, for child spans and `traceparent`
+    pub fn context(&self) -> TraceContext {
+        self.data.context
+    }
+
+    pub fn set(&mut self, key: &str, value: impl Into<AttributeValue>) {
+        if self.queue.is_some() {
+            self.data.attributes.push((key.to_string(), value.into()));
+        }
+    }
+
+    /// Mark the span as failed
+    pub fn fail(&mut self, message: impl Into<String>) {
+        self.data.error = Some(message.into());
+    }
+
+    /// End the span, as failed if `result` is an error
+    pub fn end<T>(mut self, result: &anyhow::Result<T>) {
+        if let Err(e) = result {
+            self.fail(format!("{:#}", e));
+        }
+    }
+}
+
+impl Drop for Span {
+    fn drop(&mut self) {
+        let Some(queue) = self.queue.take() else {
+            return;
+        };
+        self.data.end_unix_nanos = unix_nanos();
+        // A full queue means the collector is behind; this span is dropped
+        let _ = queue.try_send(std::mem::take(&mut self.data));
+    }
+}
+
+/// Send spans to the collector in batches until every tracer is gone
+async fn export_loop(config: TracingConfig, mut spans: mpsc::Receiver<SpanData>) {
+    let client = reqwest::Client::builder()
+        .timeout(Duration::from_secs(10))
+        .build()
+        .unwrap_or_default();
+    let url = format!("{}/v1/traces", config.endpoint.trim_end_matches('/'));
+    let mut failing = false;
+    let mut batch = Vec::new();
+    let mut tick = tokio::time::interval(EXPORT_INTERVAL);
+    loop {
+        let done = tokio::select! {
+            span = spans.recv() => match span {
+                Some(span) => {
+                    batch.push(span);
+                    if batch.len() < MAX_BATCH {
+                        continue;
+                    }
+                    false
+                }
+                None => true,
+            },
+            _ = tick.tick() => false,
+        };
+        if !batch.is_empty() {
+            let body = otlp_json(&config.service_name, &batch);
+            batch.clear();
+            let mut request = client
+                .post(&url)
+                .header("content-type", "application/json")
+                .body(body.to_string());
+            for (name, value) in &config.headers {
+                request = request.header(name, value);
+            }
+            let result = match request.send().await {
+                Ok(response) => response.error_for_status().map(|_| ()),
+                Err(e) => Err(e),
+            };
+            match result {
+                Ok(()) => {
+                    if std::mem::replace(&mut failing, false) {
+                        info!("Exporting traces to {} again", url);
+                    }
+                }
+                Err(e) => {
+                    if !std::mem::replace(&mut failing, true) {
+                        warn!("Failed to export traces to {}: {}", url, e);
+                    }
+                }
+            }
+        }
+        if done {
+            break;
+        }
+    }
+}
+
+/// An OTLP/JSON `ExportTraceServiceRequest` for a batch of spans
+fn otlp_json(service_name: &str, spans: &[SpanData]) -> serde_json::Value {
+    let spans: Vec<serde_json::Value> = spans
+        .iter()
+        .map(|span| {
+            let mut json = serde_json::json!({
+                "traceId": to_hex(&span.context.trace_id),
+                "spanId": to_hex(&span.context.span_id),
+                "name": span.name,
+                "kind": span.kind as u8,
+                "startTimeUnixNano": span.start_unix_nanos.to_string(),
+                "endTimeUnixNano": span.end_unix_nanos.to_string(),
+                "attributes": span
+                    .attributes
+                    .iter()
+                    .map(|(key, value)| attribute(key, value))
+                    .collect::<Vec<_>>(),
+                "status": match &span.error {
+                    Some(message) => serde_json::json!({"code": 2, "message": message}),
+                    None => serde_json::json!({}),
+                },
+            });
+            if let Some(parent) = &span.parent_span_id {
+                json["parentSpanId"] = to_hex(parent).into();
+            }
+            json
+        })
+        .collect();
+    let service_name = AttributeValue::from(service_name);
+    serde_json::json!({
+        "resourceSpans": [{
+            "resource": {"attributes": [attribute("service.name", &service_name)]},
+            "scopeSpans": [{
+                "scope": {"name": "tenement", "version": env!("CARGO_PKG_VERSION")},
+                "spans": spans,
+            }],
+        }],
+    })
+}
+
+fn attribute(key: &str, value: &AttributeValue) -> serde_json::Value {
+    let value = match value {
+        AttributeValue::String(s) => serde_json::json!({"stringValue": s}),
+        // OTLP/JSON carries 64-bit integers as strings
+        AttributeValue::Int(n) => serde_json::json!({"intValue": n.to_string()}),
+        AttributeValue::Bool(b) => serde_json::json!({"boolValue": b}),
+    };
+    serde_json::json!({"key": key, "value": value})
+}
+
+fn unix_nanos() -> u64 {
+    SystemTime::now()
+        .duration_since(UNIX_EPOCH)
+        .map_or(0, |d| d.as_nanos() as u64)
+}
+
+/// A random, non-zero id
+fn random_id<const N: usize>() -> [u8; N] {
+    loop {
+        let id: [u8; N] = std::array::from_fn(|_| rand::random());
+        if id != [0; N] {
+            return id;
+        }
+    }
+}
+
+fn to_hex(bytes: &[u8]) -> String {
+    bytes.iter().fold(String::new(), |mut hex, b| {
+        let _ = write!(hex, "{:02x}", b);
+        hex
+    })
+}
+
+/// Lowercase hex of exactly N bytes
+fn from_hex<const N: usize>(hex: &str) -> Option<[u8; N]> {
+    if hex.len() != N * 2 || !hex.bytes().all(|b| matches!(b, b'0'..=b'9' | b'a'..=b'f')) {
+        return None;
+    }
+    let mut bytes = [0; N];
+    for (i, byte) in bytes.iter_mut().enumerate() {
+        *byte = u8::from_str_radix(&hex[i * 2..i * 2 + 2], 16).ok()?;
+    }
+    Some(bytes)
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    const EXAMPLE: &str = "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01";
+
+    fn test_tracer(sample_ratio: f64) -> (Tracer, mpsc::Receiver<SpanData>) {
+        let (queue, spans) = mpsc::channel(16);
+        (
+            Tracer {
+                sample_ratio,
+                queue,
+            },
+            spans,
+        )
+    }
+
+    #[test]
+    fn test_traceparent_round_trip() {
+        let context = TraceContext::parse(EXAMPLE).unwrap();
+        assert_eq!(
+            to_hex(&context.trace_id),
+            "0af7651916cd43dd8448eb211c80319c"
+        );
+        assert_eq!(to_hex(&context.span_id), "b7ad6b7169203331");
+        assert!(context.sampled);
+        assert_eq!(context.traceparent(), EXAMPLE);
+
+        let unsampled = TraceContext::parse(&EXAMPLE.replace("-01", "-00")).unwrap();
+        assert!(!unsampled.sampled);
+
+        for invalid in [
+            "",
+            "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331",
+            "ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+            "00-00000000000000000000000000000000-b7ad6b7169203331-01",
+            "00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+            "00-0AF7651916CD43DD8448EB211C80319C-b7ad6b7169203331-01",
+            "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01-extra",
+        ] {
+            assert!(TraceContext::parse(invalid).is_none(), "{}", invalid);
+        }
+        // A later version may carry more fields
+        assert!(TraceContext::parse(&format!("01{}-extra", &EXAMPLE[2..])).is_some());
+    }
+
+    #[test]
+    fn test_children_continue_the_trace() {
+        let (tracer, mut spans) = test_tracer(1.0);
+        let parent = TraceContext::parse(EXAMPLE).unwrap();
+        let mut span = tracer.start("proxy", SpanKind::Server, Some(&parent));
+        span.set("http.response.status_code", 502u16);
+        span.fail("bad gateway");
+        let context = span.context();
+        assert_eq!(context.trace_id, parent.trace_id);
+        assert_ne!(context.span_id, parent.span_id);
+        drop(span);
+
+        let data = spans.try_recv().unwrap();
+        assert_eq!(data.parent_span_id, Some(parent.span_id));
+        assert!(data.end_unix_nanos >= data.start_unix_nanos);
+        assert_eq!(data.attributes[0].1, AttributeValue::Int(502));
+
+        // The caller decided not to sample, so nothing is exported
+        let unsampled = TraceContext {
+            sampled: false,
+            ..parent
+        };
+        let child = tracer.start("proxy", SpanKind::Server, Some(&unsampled));
+        assert!(!child.context().sampled);
+        drop(child);
+        assert!(spans.try_recv().is_err());
+
+        // New traces are sampled at the configured ratio
+        let (never, mut spans) = test_tracer(0.0);
+        let root = never.start("health_check", SpanKind::Internal, None);
+        assert!(!root.context().sampled);
+        drop(root);
+        assert!(spans.try_recv().is_err());
+    }
+
+    #[test]
+    fn test_otlp_json() {
+        let (tracer, mut spans) = test_tracer(1.0);
+        let root = tracer.start("deploy", SpanKind::Internal, None);
+        let mut child = tracer.start("upstream", SpanKind::Client, Some(&root.context()));
+        child.set("tenement.app", "api");
+        child.set("retry", true);
+        child.fail("timed out");
+        drop(child);
+        drop(root);
+        let batch = vec![spans.try_recv().unwrap(), spans.try_recv().unwrap()];
+
+        let json = otlp_json("tenement", &batch);
+        let resource = &json["resourceSpans"][0];
+        assert_eq!(
+            resource["resource"]["attributes"][0]["value"]["stringValue"],
+            "tenement"
+        );
+        let exported = &resource["scopeSpans"][0]["spans"];
+        let (child, root) = (&exported[0], &exported[1]);
+        assert_eq!(child["name"], "upstream");
+        assert_eq!(child["kind"], 3);
+        assert_eq!(child["traceId"], root["traceId"]);
+        assert_eq!(child["parentSpanId"], root["spanId"]);
+        assert!(root.get("parentSpanId").is_none());
+        assert_eq!(child["traceId"].as_str().unwrap().len(), 32);
+        assert_eq!(child["attributes"][0]["key"], "tenement.app");
+        assert_eq!(child["attributes"][1]["value"]["boolValue"], true);
+        assert_eq!(child["status"]["code"], 2);
+        assert_eq!(root["status"], serde_json::json!({}));
+    }
+}
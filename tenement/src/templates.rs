@@ -0,0 +1,339 @@
+//! Service templates and config variables
+//!
+//! Both are resolved in tenement.toml before it's read as a [`Config`], after
+//! the environment's overlays are merged in (so an overlay can change them too):
+//!
+//! ```toml
+//! [vars]
+//! domain = "example.com"
+//! replicas = 2
+//!
+//! [template.web]
+//! health = "/health"
+//! replicas = "{{ replicas }}"
+//! env = { BASE_URL = "https://{{ domain }}" }
+//!
+//! [service.api]
+//! extends = "web"
+//! command = "./api"
+//! ```
+//!
+//! A service's `extends` names one template or a list of them, merged in order
+//! under the service's own keys; templates can extend other templates. Merging
+//! is the same as an overlay's: tables key by key, anything else replaced.
+//!
+//! `{{ name }}` in any string is replaced with `[vars].name`. A string that is
+//! nothing but one reference takes the variable's type, as `replicas` above.
+//! Double braces around anything that isn't a variable are left as they are,
+//! so values that already had them (a Go template in an env var) still load.
+//!
+//! [`Config`]: crate::config::Config
+
+use anyhow::Result;
+use toml::value::Table;
+use toml::Value;
+
+/// Replace each service's `extends` with the templates it names, and drop
+/// the `[template]` table
+pub fn expand_templates(root: &mut Value) -> Result<()> {
+    let Some(root) = root.as_table_mut() else {
+        return Ok(());
+    };
+    let templates = match root.remove("template") {
+        Some(Value::Table(templates)) => templates,
+        Some(_) => anyhow::bail!("[template] must be a table of templates"),
+        None => Table::new(),
+    };
+    let Some(Value::Table(services)) = root.get_mut("service") else {
+        return Ok(());
+    };
+    for (name, service) in services.iter_mut() {
+        let Some(table) = service.as_table_mut() else {
+            continue;
+        };
+        let Some(extends) = table.remove("extends") else {
+            continue;
+        };
+        let place = format!("Service '{}'", name);
+        let mut merged = Value::Table(Table::new());
+        for parent in template_names(&extends, &place)? {
+            let template = resolve(&parent, &templates, &mut vec![], &place)?;
+            crate::config::merge_toml(&mut merged, template);
+        }
+        crate::config::merge_toml(&mut merged, service.clone());
+        *service = merged;
+    }
+    Ok(())
+}
+
+/// The template names an `extends` value lists
+fn template_names(extends: &Value, place: &str) -> Result<Vec<String>> {
+    let names = match extends {
+        Value::String(name) => vec![name.clone()],
+        Value::Array(names) => names
+            .iter()
+            .map(|name| name.as_str().map(str::to_string))
+            .collect::<Option<Vec<_>>>()
+            .unwrap_or_default(),
+        _ => Vec::new(),
+    };
+    if names.is_empty() {
+        anyhow::bail!(
+            "{} `extends` must be a template name or a list of them",
+            place
+        );
+    }
+    Ok(names)
+}
+
+/// Template `name` with the templates it extends merged under it
+fn resolve(name: &str, templates: &Table, stack: &mut Vec<String>, place: &str) -> Result<Value> {
+    let Some(template) = templates.get(name) else {
+        anyhow::bail!("{} extends undefined template '{}'", place, name);
+    };
+    if stack.iter().any(|seen| seen == name) {
+        anyhow::bail!(
+            "Templates extend each other in a cycle: {} -> {}",
+            stack.join(" -> "),
+            name
+        );
+    }
+    let mut template = template.clone();
+    let Some(table) = template.as_table_mut() else {
+        anyhow::bail!("Template '{}' must be a table", name);
+    };
+    let Some(extends) = table.remove("extends") else {
+        return Ok(template);
+    };
+    stack.push(name.to_string());
+    let place = format!("Template '{}'", name);
+    let mut merged = Value::Table(Table::new());
+    for parent in template_names(&extends, &place)? {
+        crate::config::merge_toml(&mut merged, resolve(&parent, templates, stack, &place)?);
+    }
+    stack.pop();
+    crate::config::merge_toml(&mut merged, template);
+    Ok(merged)
+}
+
+/// Replace `{{ name }}` references with `[vars]`, and drop the `[vars]` table
+pub fn substitute_vars(root: &mut Value) -> Result<()> {
+    let vars = match root.as_table_mut().and_then(|t| t.remove("vars")) {
+        Some(Value::Table(vars)) => vars,
+        Some(_) => anyhow::bail!("[vars] must be a table of variables"),
+        None => Table::new(),
+    };
+    substitute(root, &vars, "")
+}
+
+fn substitute(value: &mut Value, vars: &Table, path: &str) -> Result<()> {
+    match value {
+        Value::String(s) => {
+            if let Some(replaced) = interpolate(s, vars, path)? {
+                *value = replaced;
+            }
+        }
+        Value::Array(items) => {
+            for (index, item) in items.iter_mut().enumerate() {
+                substitute(item, vars, &format!("{}[{}]", path, index))?;
+            }
+        }
+        Value::Table(table) => {
+            for (key, item) in table.iter_mut() {
+                let path = match path {
+                    "" => key.clone(),
+                    _ => format!("{}.{}", path, key),
+                };
+                substitute(item, vars, &path)?;
+            }
+        }
+        _ => {}
+    }
+    Ok(())
+}
+
+/// `s` with its references replaced, or None if it has none
+fn interpolate(s: &str, vars: &Table, path: &str) -> Result<Option<Value>> {
+    let references = references(s, vars);
+    if references.is_empty() {
+        return Ok(None);
+    }
+    if let [(0, end, value)] = references.as_slice() {
+        if *end == s.len() {
+            return Ok(Some((*value).clone()));
+        }
+    }
+    let mut out = String::new();
+    let mut rest = 0;
+    for (start, end, value) in references {
+        out.push_str(&s[rest..start]);
+        match value {
+            Value::String(value) => out.push_str(value),
+            Value::Table(_) | Value::Array(_) => anyhow::bail!(
+                "{} uses variable '{}' inside a string, but it isn't a single value",
+                path,
+                s[start + 2..end - 2].trim()
+            ),
+            value => out.push_str(&value.to_string()),
+        }
+        rest = end;
+    }
+    out.push_str(&s[rest..]);
+    Ok(Some(Value::String(out)))
+}
+
+/// The `{{ name }}` references to `vars` in `s`: (start, end, value).
+/// Anything else in double braces is left as it is.
+fn references<'a>(s: &str, vars: &'a Table) -> Vec<(usize, usize, &'a Value)> {
+    let mut found = Vec::new();
+    let mut from = 0;
+    while let Some(open) = s[from..].find("{{").map(|i| from + i) {
+        let Some(close) = s[open..].find("}}").map(|i| open + i) else {
+            break;
+        };
+        match vars.get(s[open + 2..close].trim()) {
+            Some(value) => {
+                found.push((open, close + 2, value));
+                from = close + 2;
+            }
+            None => from = open + 2,
+        }
+    }
+    found
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn expanded(content: &str) -> Result<Value> {
+        let mut root: Value = toml::from_str(content)?;
+        expand_templates(&mut root)?;
+        substitute_vars(&mut root)?;
+        Ok(root)
+    }
+
+    // ===================
+    // Templates
+    // ===================
+
+    #[test]
+    fn test_extends_merges_templates_in_order() {
+        let root = expanded(
+            r#"
+[template.base]
+health = "/health"
+env = { LOG = "info", REGION = "us" }
+
+[template.web]
+extends = "base"
+idle_timeout = 300
+env = { PORT_NAME = "http" }
+
+[template.eu]
+env = { REGION = "eu" }
+
+[service.api]
+extends = ["web", "eu"]
+command = "./api"
+env = { LOG = "debug" }
+"#,
+        )
+        .unwrap();
+        let api = &root["service"]["api"];
+        assert_eq!(api["health"].as_str(), Some("/health"));
+        assert_eq!(api["idle_timeout"].as_integer(), Some(300));
+        assert_eq!(api["env"]["REGION"].as_str(), Some("eu"));
+        assert_eq!(api["env"]["LOG"].as_str(), Some("debug"));
+        assert_eq!(api["env"]["PORT_NAME"].as_str(), Some("http"));
+        assert!(api.get("extends").is_none());
+        assert!(root.get("template").is_none());
+    }
+
+    #[test]
+    fn test_template_errors() {
+        let err = expanded("[service.api]\nextends = \"nope\"\n").unwrap_err();
+        assert_eq!(
+            err.to_string(),
+            "Service 'api' extends undefined template 'nope'"
+        );
+
+        let cycle = r#"
+[template.a]
+extends = "b"
+
+[template.b]
+extends = "a"
+
+[service.api]
+extends = "a"
+"#;
+        let err = expanded(cycle).unwrap_err().to_string();
+        assert!(err.contains("cycle: a -> b -> a"), "{}", err);
+
+        let err = expanded("[service.api]\nextends = 3\n").unwrap_err();
+        assert!(err.to_string().contains("must be a template name"));
+    }
+
+    // ===================
+    // Variables
+    // ===================
+
+    #[test]
+    fn test_vars_are_substituted() {
+        let root = expanded(
+            r#"
+[vars]
+domain = "example.com"
+replicas = 3
+tags = ["a", "b"]
+
+[service.api]
+command = "./api --host {{domain}}"
+replicas = "{{ replicas }}"
+env = { URL = "https://{{ domain }}:{{ replicas }}/", FORMAT = "{{.ID}}" }
+args = "{{ tags }}"
+"#,
+        )
+        .unwrap();
+        let api = &root["service"]["api"];
+        assert_eq!(api["command"].as_str(), Some("./api --host example.com"));
+        assert_eq!(api["replicas"].as_integer(), Some(3));
+        assert_eq!(api["env"]["URL"].as_str(), Some("https://example.com:3/"));
+        // Not a variable reference
+        assert_eq!(api["env"]["FORMAT"].as_str(), Some("{{.ID}}"));
+        assert_eq!(api["args"].as_array().unwrap().len(), 2);
+        assert!(root.get("vars").is_none());
+    }
+
+    #[test]
+    fn test_unknown_names_are_left_alone() {
+        // Configs from before [vars] may hold double braces of their own
+        let root = expanded(
+            r#"
+[vars]
+domain = "example.com"
+
+[service.api]
+command = "./api --host {{ domain }}"
+env = { GREETING = "{{ name }} at {{ domain }}", ONLY = "{{ name }}" }
+"#,
+        )
+        .unwrap();
+        let api = &root["service"]["api"];
+        let env = &api["env"];
+        assert_eq!(env["GREETING"].as_str(), Some("{{ name }} at example.com"));
+        assert_eq!(env["ONLY"].as_str(), Some("{{ name }}"));
+
+        let root = expanded("[service.api]\ncommand = \"./{{ missing }}\"\n").unwrap();
+        let command = &root["service"]["api"]["command"];
+        assert_eq!(command.as_str(), Some("./{{ missing }}"));
+    }
+
+    #[test]
+    fn test_misused_vars() {
+        let content = "[vars]\ntags = [\"a\"]\n[service.api]\ncommand = \"./api {{ tags }}\"\n";
+        let err = expanded(content).unwrap_err();
+        assert!(err.to_string().contains("isn't a single value"));
+    }
+}
@@ -0,0 +1,227 @@
+//! Retry budgets and circuit breakers for proxied requests
+//!
+//! A service with `[service.x.retry]` has a [`RetryBudget`]: every proxied
+//! request earns `budget_percent / 100` of a retry, and a retry spends a whole
+//! one, so retries stay a bounded share of traffic even when every request
+//! fails. A service with `[service.x.circuit_breaker]` has each instance's
+//! consecutive failures counted in [`CircuitBreakers`]; enough of them eject
+//! the instance from routing until its cooldown is up.
+
+use crate::config::CircuitBreakerConfig;
+use crate::instance::InstanceId;
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+
+/// Retries a quiet service can save up for a burst of failures
+const MAX_RETRY_TOKENS: f64 = 10.0;
+
+/// Retry allowance for one service
+#[derive(Debug)]
+pub struct RetryBudget {
+    ratio: f64,
+    tokens: Mutex<f64>,
+}
+
+impl RetryBudget {
+    pub fn new(budget_percent: f64) -> Self {
+        Self {
+            ratio: budget_percent.clamp(0.0, 100.0) / 100.0,
+            tokens: Mutex::new(MAX_RETRY_TOKENS),
+        }
+    }
+
+    /// Credit the budget for a proxied request
+    pub fn deposit(&self) {
+        let mut tokens = self.tokens.lock().unwrap();
+        *tokens = (*tokens + self.ratio).min(MAX_RETRY_TOKENS);
+    }
+
+    /// Spend a retry, if the budget has one
+    pub fn withdraw(&self) -> bool {
+        let mut tokens = self.tokens.lock().unwrap();
+        if *tokens < 1.0 {
+            return false;
+        }
+        *tokens -= 1.0;
+        true
+    }
+}
+
+/// A breaker changing state
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub enum BreakerEvent {
+    /// The instance was ejected
+    Opened,
+    /// The instance is back in rotation
+    Closed,
+}
+
+impl BreakerEvent {
+    pub fn as_str(&self) -> &'static str {
+        match self {
+            BreakerEvent::Opened => "open",
+            BreakerEvent::Closed => "closed",
+        }
+    }
+}
+
+#[derive(Debug, Default)]
+struct Breaker {
+    failures: u32,
+    /// Set once the breaker has opened. Past this time the breaker is
+    /// half-open: the instance takes requests again, and the next result
+    /// closes or re-opens it.
+    open_until: Option<Instant>,
+}
+
+/// Per-instance breakers. Only instances with recent failures have an entry.
+#[derive(Debug, Default)]
+pub struct CircuitBreakers {
+    breakers: Mutex<HashMap<InstanceId, Breaker>>,
+}
+
+impl CircuitBreakers {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Whether `id` is ejected from routing at `now`
+    pub fn is_open(&self, id: &InstanceId, now: Instant) -> bool {
+        self.breakers
+            .lock()
+            .unwrap()
+            .get(id)
+            .and_then(|breaker| breaker.open_until)
+            .is_some_and(|until| now < until)
+    }
+
+    /// Record a proxied request's outcome, returning the breaker's change of state
+    pub fn record(
+        &self,
+        id: &InstanceId,
+        success: bool,
+        config: &CircuitBreakerConfig,
+        now: Instant,
+    ) -> Option<BreakerEvent> {
+        let mut breakers = self.breakers.lock().unwrap();
+        if success {
+            let breaker = breakers.remove(id)?;
+            return breaker.open_until.map(|_| BreakerEvent::Closed);
+        }
+
+        let breaker = breakers.entry(id.clone()).or_default();
+        breaker.failures = breaker.failures.saturating_add(1);
+        let reopen = match breaker.open_until {
+            // Requests that were in flight when it opened
+            Some(until) if now < until => false,
+            // The half-open trial failed
+            Some(_) => true,
+            None => breaker.failures >= config.failures,
+        };
+        if !reopen {
+            return None;
+        }
+        breaker.open_until = Some(now + Duration::from_secs(config.cooldown));
+        Some(BreakerEvent::Opened)
+    }
+
+    /// Forget an instance (it stopped, so its replacement starts with a clean slate)
+    pub fn clear(&self, id: &InstanceId) {
+        self.breakers.lock().unwrap().remove(id);
+    }
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+
+    fn breaker_config() -> CircuitBreakerConfig {
+        CircuitBreakerConfig {
+            failures: 3,
+            cooldown: 30,
+        }
+    }
+
+    #[test]
+    fn test_retry_budget_is_a_share_of_requests() {
+        let budget = RetryBudget::new(20.0);
+        let saved = (0..100).filter(|_| budget.withdraw()).count();
+        assert_eq!(saved, MAX_RETRY_TOKENS as usize);
+
+        // Once spent, it takes five requests to earn a retry at 20%
+        for _ in 0..4 {
+            budget.deposit();
+        }
+        assert!(!budget.withdraw());
+        budget.deposit();
+        assert!(budget.withdraw());
+
+        let zero = RetryBudget::new(0.0);
+        for _ in 0..10 {
+            zero.withdraw();
+        }
+        for _ in 0..1000 {
+            zero.deposit();
+        }
+        assert!(!zero.withdraw());
+    }
+
+    #[test]
+    fn test_breaker_opens_after_consecutive_failures() {
+        let breakers = CircuitBreakers::new();
+        let config = breaker_config();
+        let id = InstanceId::new("api", "1");
+        let now = Instant::now();
+
+        assert_eq!(breakers.record(&id, false, &config, now), None);
+        assert_eq!(breakers.record(&id, false, &config, now), None);
+        // A success resets the count
+        assert_eq!(breakers.record(&id, true, &config, now), None);
+        assert_eq!(breakers.record(&id, false, &config, now), None);
+        assert_eq!(breakers.record(&id, false, &config, now), None);
+        assert!(!breakers.is_open(&id, now));
+        assert_eq!(
+            breakers.record(&id, false, &config, now),
+            Some(BreakerEvent::Opened)
+        );
+        assert!(breakers.is_open(&id, now));
+        assert!(!breakers.is_open(&InstanceId::new("api", "2"), now));
+
+        // Stragglers from before it opened don't extend the cooldown
+        assert_eq!(breakers.record(&id, false, &config, now), None);
+        let later = now + Duration::from_secs(30);
+        assert!(!breakers.is_open(&id, later));
+    }
+
+    #[test]
+    fn test_half_open_trial_closes_or_reopens() {
+        let breakers = CircuitBreakers::new();
+        let config = breaker_config();
+        let id = InstanceId::new("api", "1");
+        let now = Instant::now();
+        for _ in 0..3 {
+            breakers.record(&id, false, &config, now);
+        }
+
+        // A failed trial ejects it for another cooldown
+        let trial = now + Duration::from_secs(31);
+        assert_eq!(
+            breakers.record(&id, false, &config, trial),
+            Some(BreakerEvent::Opened)
+        );
+        assert!(breakers.is_open(&id, trial + Duration::from_secs(29)));
+
+        // A successful one puts it back
+        let trial = trial + Duration::from_secs(31);
+        assert_eq!(
+            breakers.record(&id, true, &config, trial),
+            Some(BreakerEvent::Closed)
+        );
+        assert!(!breakers.is_open(&id, trial));
+        assert_eq!(breakers.record(&id, false, &config, trial), None);
+
+        breakers.clear(&id);
+        assert!(!breakers.is_open(&id, trial));
+    }
+}
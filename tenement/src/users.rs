@@ -0,0 +1,336 @@
+//! Running services as dedicated Unix users
+//!
+//! `user = "app"` (and optionally `group = "app"`) makes each child drop to
+//! that user before it execs. Tenement has to run as root to switch users; it
+//! chowns the instance's directories to the user first, and tightens the
+//! socket to that user once the app creates it. `[service.x.unix_socket]`
+//! `owner`/`group` give the socket to other ids instead.
+
+use anyhow::Result;
+use std::path::Path;
+
+/// Ids a child switches to before exec
+#[derive(Debug, Clone, Copy, PartialEq, Eq)]
+pub struct RunAs {
+    pub uid: u32,
+    pub gid: u32,
+}
+
+/// Resolve `user`/`group` (names or numeric ids) to the ids to switch to.
+/// The group defaults to the user's primary group. None means there's nothing
+/// to switch: neither is set, or tenement already runs as them.
+#[cfg(unix)]
+pub fn resolve(user: Option<&str>, group: Option<&str>) -> Result<Option<RunAs>> {
+    use anyhow::Context;
+
+    if user.is_none() && group.is_none() {
+        return Ok(None);
+    }
+    let (euid, egid) = unsafe { (libc::geteuid(), libc::getegid()) };
+    let (uid, primary_gid) = match user {
+        Some(user) => match lookup_user(user)? {
+            Some((uid, gid)) => (uid, Some(gid)),
+            // A bare uid without a passwd entry (common in containers)
+            None => match user.parse::<u32>() {
+                Ok(uid) => (uid, None),
+                Err(_) => anyhow::bail!("Unknown user '{}'", user),
+            },
+        },
+        None => (euid, Some(egid)),
+    };
+    let gid = match group {
+        Some(group) => group_id(group)?,
+        None => primary_gid
+            .with_context(|| format!("User {} has no passwd entry; set `group` too", uid))?,
+    };
+
+    let run_as = RunAs { uid, gid };
+    if euid == 0 {
+        return Ok(Some(run_as));
+    }
+    if uid == euid && gid == egid {
+        return Ok(None);
+    }
+    anyhow::bail!(
+        "Running as uid {} / gid {} requires tenement to run as root (it runs as uid {})",
+        uid,
+        gid,
+        euid
+    )
+}
+
+#[cfg(not(unix))]
+pub fn resolve(user: Option<&str>, group: Option<&str>) -> Result<Option<RunAs>> {
+    if user.is_some() || group.is_some() {
+        anyhow::bail!("`user` and `group` are only supported on Unix");
+    }
+    Ok(None)
+}
+
+/// Ids to give an instance's socket to (`unix_socket.owner`/`group`); a None
+/// id is left as the app created it
+#[derive(Debug, Clone, Copy, Default, PartialEq, Eq)]
+pub struct SocketOwner {
+    pub uid: Option<u32>,
+    pub gid: Option<u32>,
+}
+
+/// Resolve `unix_socket.owner`/`group` (names or numeric ids)
+#[cfg(unix)]
+pub fn resolve_socket_owner(owner: Option<&str>, group: Option<&str>) -> Result<SocketOwner> {
+    let uid = match owner {
+        Some(owner) => match lookup_user(owner)? {
+            Some((uid, _)) => Some(uid),
+            None => Some(
+                owner
+                    .parse::<u32>()
+                    .map_err(|_| anyhow::anyhow!("Unknown user '{}'", owner))?,
+            ),
+        },
+        None => None,
+    };
+    let gid = group.map(group_id).transpose()?;
+    Ok(SocketOwner { uid, gid })
+}
+
+#[cfg(not(unix))]
+pub fn resolve_socket_owner(owner: Option<&str>, group: Option<&str>) -> Result<SocketOwner> {
+    if owner.is_some() || group.is_some() {
+        anyhow::bail!("`unix_socket.owner` and `group` are only supported on Unix");
+    }
+    Ok(SocketOwner::default())
+}
+
+impl SocketOwner {
+    /// Chown `socket` to these ids
+    #[cfg(unix)]
+    pub fn apply(&self, socket: &Path) -> Result<()> {
+        use anyhow::Context;
+        if self.uid.is_none() && self.gid.is_none() {
+            return Ok(());
+        }
+        std::os::unix::fs::chown(socket, self.uid, self.gid)
+            .with_context(|| format!("Failed to chown socket {}", socket.display()))
+    }
+}
+
+#[cfg(not(unix))]
+impl SocketOwner {
+    /// Sockets are named pipes here, and they have no owner to change
+    pub fn apply(&self, _: &Path) -> Result<()> {
+        Ok(())
+    }
+}
+
+impl RunAs {
+    /// Switch the forked child to these ids. Only called from `pre_exec`, so it
+    /// must not allocate. Supplementary groups are dropped first, while the
+    /// child is still root.
+    #[cfg(unix)]
+    pub fn apply(&self) -> std::io::Result<()> {
+        let groups = [self.gid as libc::gid_t];
+        unsafe {
+            if libc::setgroups(1, groups.as_ptr()) != 0
+                || libc::setgid(self.gid) != 0
+                || libc::setuid(self.uid) != 0
+            {
+                return Err(std::io::Error::last_os_error());
+            }
+        }
+        Ok(())
+    }
+
+    /// Give `path` to this user
+    #[cfg(unix)]
+    pub fn chown(&self, path: &Path) -> Result<()> {
+        use anyhow::Context;
+        std::os::unix::fs::chown(path, Some(self.uid), Some(self.gid))
+            .with_context(|| format!("Failed to chown {} to {}", path.display(), self))
+    }
+
+    /// Let the user create its socket in a directory it doesn't own. Like /tmp,
+    /// the sticky bit stops users removing each other's sockets; unlike /tmp,
+    /// others can't list the directory.
+    #[cfg(unix)]
+    pub fn open_socket_dir(&self, dir: &Path) -> Result<()> {
+        use anyhow::Context;
+        use std::os::unix::fs::{MetadataExt, PermissionsExt};
+        let metadata = std::fs::metadata(dir)
+            .with_context(|| format!("Failed to read socket dir {}", dir.display()))?;
+        if metadata.uid() == self.uid || metadata.mode() & 0o003 == 0o003 {
+            return Ok(());
+        }
+        std::fs::set_permissions(dir, std::fs::Permissions::from_mode(0o1733))
+            .with_context(|| format!("Failed to open socket dir {}", dir.display()))
+    }
+
+    /// Restrict the app's socket to its user and group (tenement connects as root)
+    #[cfg(unix)]
+    pub fn restrict_socket(&self, socket: &Path) -> Result<()> {
+        use anyhow::Context;
+        use std::os::unix::fs::PermissionsExt;
+        self.chown(socket)?;
+        std::fs::set_permissions(socket, std::fs::Permissions::from_mode(0o660))
+            .with_context(|| format!("Failed to restrict socket {}", socket.display()))
+    }
+}
+
+// `resolve` never returns a RunAs off Unix; these keep callers building
+#[cfg(not(unix))]
+impl RunAs {
+    pub fn chown(&self, _: &Path) -> Result<()> {
+        anyhow::bail!("`user` and `group` are only supported on Unix")
+    }
+
+    pub fn open_socket_dir(&self, _: &Path) -> Result<()> {
+        anyhow::bail!("`user` and `group` are only supported on Unix")
+    }
+
+    pub fn restrict_socket(&self, _: &Path) -> Result<()> {
+        anyhow::bail!("`user` and `group` are only supported on Unix")
+    }
+}
+
+impl std::fmt::Display for RunAs {
+    fn fmt(&self, f: &mut std::fmt::Formatter<'_>) -> std::fmt::Result {
+        write!(f, "{}:{}", self.uid, self.gid)
+    }
+}
+
+/// uid and primary gid for a user name or uid, from the passwd database
+#[cfg(unix)]
+fn lookup_user(user: &str) -> Result<Option<(u32, u32)>> {
+    let mut entry: libc::passwd = unsafe { std::mem::zeroed() };
+    let mut buf = vec![0 as libc::c_char; 16 * 1024];
+    let mut found: *mut libc::passwd = std::ptr::null_mut();
+    let rc = match user.parse::<u32>() {
+        Ok(uid) => unsafe {
+            libc::getpwuid_r(uid, &mut entry, buf.as_mut_ptr(), buf.len(), &mut found)
+        },
+        Err(_) => {
+            let name = std::ffi::CString::new(user)
+                .map_err(|_| anyhow::anyhow!("Invalid user name {:?}", user))?;
+            unsafe {
+                libc::getpwnam_r(name.as_ptr(), &mut entry, buf.as_mut_ptr(), buf.len(), &mut found)
+            }
+        }
+    };
+    if rc != 0 {
+        anyhow::bail!(
+            "Failed to look up user '{}': {}",
+            user,
+            std::io::Error::from_raw_os_error(rc)
+        );
+    }
+    Ok((!found.is_null()).then_some((entry.pw_uid, entry.pw_gid)))
+}
+
+/// gid for a group name, or a bare gid without a group entry
+#[cfg(unix)]
+fn group_id(group: &str) -> Result<u32> {
+    match lookup_group(group)? {
+        Some(gid) => Ok(gid),
+        None => group
+            .parse::<u32>()
+            .map_err(|_| anyhow::anyhow!("Unknown group '{}'", group)),
+    }
+}
+
+/// gid for a group name or gid, from the group database
+#[cfg(unix)]
+fn lookup_group(group: &str) -> Result<Option<u32>> {
+    let mut entry: libc::group = unsafe { std::mem::zeroed() };
+    let mut buf = vec![0 as libc::c_char; 16 * 1024];
+    let mut found: *mut libc::group = std::ptr::null_mut();
+    let rc = match group.parse::<u32>() {
+        Ok(gid) => unsafe {
+            libc::getgrgid_r(gid, &mut entry, buf.as_mut_ptr(), buf.len(), &mut found)
+        },
+        Err(_) => {
+            let name = std::ffi::CString::new(group)
+                .map_err(|_| anyhow::anyhow!("Invalid group name {:?}", group))?;
+            unsafe {
+                libc::getgrnam_r(name.as_ptr(), &mut entry, buf.as_mut_ptr(), buf.len(), &mut found)
+            }
+        }
+    };
+    if rc != 0 {
+        anyhow::bail!(
+            "Failed to look up group '{}': {}",
+            group,
+            std::io::Error::from_raw_os_error(rc)
+        );
+    }
+    Ok((!found.is_null()).then_some(entry.gr_gid))
+}
+
+#[cfg(all(test, unix))]
+mod tests {
+    use super::*;
+
+    fn is_root() -> bool {
+        unsafe { libc::geteuid() == 0 }
+    }
+
+    #[test]
+    fn test_resolve_nothing_set() {
+        assert_eq!(resolve(None, None).unwrap(), None);
+    }
+
+    #[test]
+    fn test_resolve_unknown_names() {
+        let err = resolve(Some("tenement-no-such-user"), None).unwrap_err();
+        assert!(err.to_string().contains("Unknown user"), "{}", err);
+        let err = resolve(None, Some("tenement-no-such-group")).unwrap_err();
+        assert!(err.to_string().contains("Unknown group"), "{}", err);
+    }
+
+    #[test]
+    fn test_resolve_current_user() {
+        let (uid, gid) = unsafe { (libc::geteuid(), libc::getegid()) };
+        let resolved = resolve(Some(&uid.to_string()), Some(&gid.to_string())).unwrap();
+        if is_root() {
+            assert_eq!(resolved, Some(RunAs { uid, gid }));
+        } else {
+            // Already running as them: nothing to switch
+            assert_eq!(resolved, None);
+        }
+    }
+
+    #[test]
+    fn test_resolve_numeric_uid_without_passwd_entry() {
+        let err = resolve(Some("4000000001"), None).unwrap_err();
+        assert!(err.to_string().contains("set `group` too"), "{}", err);
+    }
+
+    #[test]
+    fn test_resolve_socket_owner() {
+        let (uid, gid) = unsafe { (libc::geteuid(), libc::getegid()) };
+        assert_eq!(
+            resolve_socket_owner(None, None).unwrap(),
+            SocketOwner::default()
+        );
+        let owner = resolve_socket_owner(Some(&uid.to_string()), Some(&gid.to_string())).unwrap();
+        assert_eq!(
+            owner,
+            SocketOwner {
+                uid: Some(uid),
+                gid: Some(gid)
+            }
+        );
+        // Unlike `user`, a socket owner needs no passwd entry or root to resolve
+        let bare = resolve_socket_owner(Some("4000000001"), None).unwrap();
+        assert_eq!(bare.uid, Some(4000000001));
+        let err = resolve_socket_owner(None, Some("tenement-no-such-group")).unwrap_err();
+        assert!(err.to_string().contains("Unknown group"), "{}", err);
+    }
+
+    #[test]
+    fn test_switching_users_requires_root() {
+        if is_root() {
+            return;
+        }
+        let err = resolve(Some("0"), None).unwrap_err();
+        assert!(err.to_string().contains("requires tenement to run as root"), "{}", err);
+    }
+}
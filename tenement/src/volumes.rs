@@ -0,0 +1,307 @@
+//! Persistent per-service volumes
+//!
+//! `[service.api.volumes]` names data directories a service keeps for good.
+//! Each is {data_dir}/.volumes/{service}/{name}, created (and given to the
+//! service's `user`) before an instance starts, shared by all of the service's
+//! instances and passed to them in VOLUME_<NAME>. They live apart from instance
+//! data dirs, scratch dirs and {data_dir}/.releases, so removing an instance,
+//! pruning or shipping a new release never touches them.
+//!
+//! `ten volume backup api uploads` snapshots one as a .tar.gz; `ten volume
+//! restore` swaps its contents for a snapshot's.
+
+use crate::config::{Config, VolumeConfig};
+use crate::users::RunAs;
+use anyhow::{Context, Result};
+use serde::{Deserialize, Serialize};
+use std::collections::BTreeMap;
+use std::io::{Read, Write};
+use std::path::{Path, PathBuf};
+
+/// Volumes live at {data_dir}/.volumes/{service}/{name}
+pub const VOLUMES_DIR_NAME: &str = ".volumes";
+
+/// Where a service's volume lives
+pub fn volume_dir(data_dir: &Path, service: &str, name: &str) -> PathBuf {
+    data_dir.join(VOLUMES_DIR_NAME).join(service).join(name)
+}
+
+/// Default env var for a volume: VOLUME_UPLOADS for `uploads`
+pub fn env_var(name: &str) -> String {
+    format!("VOLUME_{}", name.to_ascii_uppercase().replace('-', "_"))
+}
+
+/// Create whichever of a service's volumes don't exist yet and give them to
+/// `run_as`; returns their dirs by name
+pub fn prepare(
+    data_dir: &Path,
+    service: &str,
+    volumes: &BTreeMap<String, VolumeConfig>,
+    run_as: Option<&RunAs>,
+) -> Result<Vec<(String, PathBuf)>> {
+    let mut dirs = Vec::new();
+    for name in volumes.keys() {
+        let dir = volume_dir(data_dir, service, name);
+        std::fs::create_dir_all(&dir)
+            .with_context(|| format!("Failed to create volume {}", dir.display()))?;
+        if let Some(run_as) = run_as {
+            run_as.chown(&dir)?;
+        }
+        dirs.push((name.clone(), dir));
+    }
+    Ok(dirs)
+}
+
+/// A volume as `ten volume ls` shows it
+#[derive(Debug, Clone, PartialEq, Serialize, Deserialize)]
+pub struct Volume {
+    pub service: String,
+    pub name: String,
+    pub path: PathBuf,
+    /// Size of its contents, 0 if it hasn't been created yet
+    pub bytes: u64,
+    /// Whether tenement.toml still declares it; others were left behind by a
+    /// removed service or volume, and are kept until deleted by hand
+    pub configured: bool,
+}
+
+/// The volumes tenement.toml declares, plus any left on disk that it no
+/// longer does, by service then name
+pub fn list(config: &Config) -> Result<Vec<Volume>> {
+    let data_dir = &config.settings.data_dir;
+    let mut found: BTreeMap<(String, String), bool> = BTreeMap::new();
+    for (service, service_config) in &config.service {
+        for name in service_config.volumes.keys() {
+            found.insert((service.clone(), name.clone()), true);
+        }
+    }
+    if let Ok(services) = std::fs::read_dir(data_dir.join(VOLUMES_DIR_NAME)) {
+        for service in services.flatten().filter(|entry| entry.path().is_dir()) {
+            let service_name = service.file_name().to_string_lossy().to_string();
+            for entry in std::fs::read_dir(service.path())?.flatten() {
+                let name = entry.file_name().to_string_lossy().to_string();
+                // Skip restores in progress (.name.restore, .name.old)
+                if name.starts_with('.') || !entry.path().is_dir() {
+                    continue;
+                }
+                found.entry((service_name.clone(), name)).or_insert(false);
+            }
+        }
+    }
+    let mut volumes = Vec::new();
+    for ((service, name), configured) in found {
+        let path = volume_dir(data_dir, &service, &name);
+        let bytes = crate::storage::calculate_dir_size_sync(&path)?;
+        volumes.push(Volume {
+            service,
+            name,
+            path,
+            bytes,
+            configured,
+        });
+    }
+    Ok(volumes)
+}
+
+/// Write `dir`'s contents to `out` as a .tar.gz. Symlinks are archived as
+/// links, not followed.
+pub fn backup<W: Write>(dir: &Path, out: W) -> Result<W> {
+    if !dir.is_dir() {
+        anyhow::bail!("Volume {} doesn't exist", dir.display());
+    }
+    let gz = flate2::write::GzEncoder::new(out, flate2::Compression::default());
+    let mut builder = tar::Builder::new(gz);
+    builder.follow_symlinks(false);
+    builder
+        .append_dir_all(".", dir)
+        .with_context(|| format!("Failed to archive {}", dir.display()))?;
+    let out = builder.into_inner()?.finish()?;
+    Ok(out)
+}
+
+/// Replace `dir`'s contents with a .tar.gz made by [`backup`], and give them
+/// to `run_as`. The snapshot is unpacked next to `dir` first, so a bad archive
+/// leaves the volume as it was. Stop the service's instances first: ones still
+/// running keep the old directory open.
+pub fn restore<R: Read>(dir: &Path, archive: R, run_as: Option<&RunAs>) -> Result<()> {
+    let (staging, _) = aside(dir)?;
+    if staging.exists() {
+        std::fs::remove_dir_all(&staging)?;
+    }
+    std::fs::create_dir_all(&staging)?;
+
+    let mut tar = tar::Archive::new(flate2::read::GzDecoder::new(archive));
+    tar.set_preserve_permissions(true);
+    // Archive::unpack skips entries that would land outside `staging`
+    let restored = tar
+        .unpack(&staging)
+        .context("Failed to unpack volume snapshot")
+        .and_then(|()| replace(dir, &staging, run_as));
+    if let Err(e) = restored {
+        std::fs::remove_dir_all(&staging).ok();
+        return Err(e);
+    }
+    Ok(())
+}
+
+/// Swap `dir` for the directory `from` (on the same filesystem), first giving
+/// everything in it to `run_as`
+pub fn replace(dir: &Path, from: &Path, run_as: Option<&RunAs>) -> Result<()> {
+    if let Some(run_as) = run_as {
+        chown_all(run_as, from)?;
+    }
+    let (_, old) = aside(dir)?;
+    if old.exists() {
+        std::fs::remove_dir_all(&old)?;
+    }
+    if let Some(parent) = dir.parent() {
+        std::fs::create_dir_all(parent)?;
+    }
+    if dir.exists() {
+        std::fs::rename(dir, &old)
+            .with_context(|| format!("Failed to move {} aside", dir.display()))?;
+    }
+    std::fs::rename(from, dir)
+        .with_context(|| format!("Failed to move snapshot into {}", dir.display()))?;
+    if old.exists() {
+        std::fs::remove_dir_all(&old)?;
+    }
+    Ok(())
+}
+
+/// Where a volume is unpacked to before it replaces `dir`, and where the old
+/// contents go meanwhile: .{name}.restore and .{name}.old beside it
+fn aside(dir: &Path) -> Result<(PathBuf, PathBuf)> {
+    let (Some(parent), Some(name)) = (dir.parent(), dir.file_name()) else {
+        anyhow::bail!("Invalid volume path {}", dir.display());
+    };
+    let name = name.to_string_lossy();
+    Ok((
+        parent.join(format!(".{}.restore", name)),
+        parent.join(format!(".{}.old", name)),
+    ))
+}
+
+/// Chown `path` and everything under it, without following symlinks
+#[cfg(unix)]
+fn chown_all(run_as: &RunAs, path: &Path) -> Result<()> {
+    std::os::unix::fs::lchown(path, Some(run_as.uid), Some(run_as.gid))
+        .with_context(|| format!("Failed to chown {} to {}", path.display(), run_as))?;
+    if std::fs::symlink_metadata(path)?.is_dir() {
+        for entry in std::fs::read_dir(path)? {
+            chown_all(run_as, &entry?.path())?;
+        }
+    }
+    Ok(())
+}
+
+#[cfg(not(unix))]
+fn chown_all(_: &RunAs, _: &Path) -> Result<()> {
+    anyhow::bail!("`user` and `group` are only supported on Unix")
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tempfile::TempDir;
+
+    fn config(data_dir: &Path) -> Config {
+        let content = format!(
+            "[settings]\ndata_dir = {:?}\n\n\
+             [service.api]\ncommand = \"./api\"\n\
+             volumes = {{ uploads = {{}}, db = {{ env = \"DB_DIR\" }} }}\n",
+            data_dir
+        );
+        Config::from_str(&content).unwrap()
+    }
+
+    // ===================
+    // Layout
+    // ===================
+
+    #[test]
+    fn test_volume_dir_and_env_var() {
+        assert_eq!(
+            volume_dir(Path::new("/var/lib/ten"), "api", "uploads"),
+            PathBuf::from("/var/lib/ten/.volumes/api/uploads")
+        );
+        assert_eq!(env_var("user-files"), "VOLUME_USER_FILES");
+    }
+
+    #[test]
+    fn test_prepare_and_list() {
+        let dir = TempDir::new().unwrap();
+        let config = config(dir.path());
+        let api = config.get_service("api").unwrap();
+        assert_eq!(api.volumes["db"].env_var("db"), "DB_DIR");
+        assert_eq!(api.volumes["uploads"].env_var("uploads"), "VOLUME_UPLOADS");
+
+        let dirs = prepare(dir.path(), "api", &api.volumes, None).unwrap();
+        assert_eq!(dirs.len(), 2);
+        std::fs::write(dirs[1].1.join("a.jpg"), b"12345").unwrap();
+        // Left behind by a service that's gone
+        std::fs::create_dir_all(volume_dir(dir.path(), "old", "data")).unwrap();
+
+        let volumes = list(&config).unwrap();
+        let summary: Vec<_> = volumes
+            .iter()
+            .map(|v| (v.service.as_str(), v.name.as_str(), v.bytes, v.configured))
+            .collect();
+        assert_eq!(
+            summary,
+            vec![
+                ("api", "db", 0, true),
+                ("api", "uploads", 5, true),
+                ("old", "data", 0, false),
+            ]
+        );
+
+        // Preparing again keeps what's there
+        prepare(dir.path(), "api", &api.volumes, None).unwrap();
+        assert!(dirs[1].1.join("a.jpg").exists());
+    }
+
+    // ===================
+    // Snapshots
+    // ===================
+
+    #[test]
+    fn test_backup_and_restore() {
+        let dir = TempDir::new().unwrap();
+        let volume = volume_dir(dir.path(), "api", "uploads");
+        std::fs::create_dir_all(volume.join("photos")).unwrap();
+        std::fs::write(volume.join("photos/a.jpg"), b"first").unwrap();
+
+        let snapshot = backup(&volume, Vec::new()).unwrap();
+
+        std::fs::write(volume.join("photos/a.jpg"), b"changed").unwrap();
+        std::fs::write(volume.join("new.txt"), b"added later").unwrap();
+        restore(&volume, &snapshot[..], None).unwrap();
+
+        assert_eq!(
+            std::fs::read(volume.join("photos/a.jpg")).unwrap(),
+            b"first"
+        );
+        assert!(!volume.join("new.txt").exists());
+        let parent = volume.parent().unwrap();
+        assert_eq!(std::fs::read_dir(parent).unwrap().count(), 1);
+    }
+
+    #[test]
+    fn test_bad_snapshot_leaves_volume_alone() {
+        let dir = TempDir::new().unwrap();
+        let volume = volume_dir(dir.path(), "api", "uploads");
+        std::fs::create_dir_all(&volume).unwrap();
+        std::fs::write(volume.join("keep.txt"), b"data").unwrap();
+
+        assert!(restore(&volume, &b"not a tarball"[..], None).is_err());
+        assert_eq!(std::fs::read(volume.join("keep.txt")).unwrap(), b"data");
+        assert_eq!(
+            std::fs::read_dir(volume.parent().unwrap()).unwrap().count(),
+            1
+        );
+
+        let missing = volume_dir(dir.path(), "api", "missing");
+        assert!(backup(&missing, Vec::new()).is_err());
+    }
+}
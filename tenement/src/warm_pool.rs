@@ -0,0 +1,166 @@
+//! Pre-opened idle connections to TCP backends
+//!
+//! A service with `warm_connections = N` gets N connections opened as soon
+//! as an instance passes its readiness probe (the probe's own connection is
+//! kept as the first one). The proxy's HTTP client takes from this pool
+//! before dialing, so the first requests after a deploy or wake don't pay for
+//! connection setup. Connections that the backend closed, or that sat idle
+//! longer than the client's own pool would keep them, are discarded on take.
+
+use std::collections::HashMap;
+use std::sync::Mutex;
+use std::time::{Duration, Instant};
+use tokio::net::TcpStream;
+
+/// Idle connections older than this are dropped instead of handed out
+/// (matches hyper's default pool idle timeout)
+pub const MAX_IDLE: Duration = Duration::from_secs(90);
+
+const CONNECT_TIMEOUT: Duration = Duration::from_secs(1);
+
+#[derive(Debug)]
+struct WarmConnection {
+    stream: TcpStream,
+    opened_at: Instant,
+}
+
+/// Idle backend connections, keyed by local TCP port
+#[derive(Debug, Default)]
+pub struct WarmPool {
+    idle: Mutex<HashMap<u16, Vec<WarmConnection>>>,
+}
+
+impl WarmPool {
+    pub fn new() -> Self {
+        Self::default()
+    }
+
+    /// Add an already-open connection (e.g. the readiness probe's)
+    pub fn put(&self, port: u16, stream: TcpStream) {
+        self.idle
+            .lock()
+            .unwrap()
+            .entry(port)
+            .or_default()
+            .push(WarmConnection {
+                stream,
+                opened_at: Instant::now(),
+            });
+    }
+
+    /// Open connections until `count` are idle for a port.
+    /// Returns how many are idle afterwards (fewer if connects failed).
+    pub async fn fill(&self, port: u16, count: usize) -> usize {
+        let addr = format!("127.0.0.1:{}", port);
+        while self.idle(port) < count {
+            match tokio::time::timeout(CONNECT_TIMEOUT, TcpStream::connect(&addr)).await {
+                Ok(Ok(stream)) => self.put(port, stream),
+                Ok(Err(e)) => {
+                    tracing::debug!("Warm connection to {} failed: {}", addr, e);
+                    break;
+                }
+                Err(_) => {
+                    tracing::debug!("Warm connection to {} timed out", addr);
+                    break;
+                }
+            }
+        }
+        self.idle(port)
+    }
+
+    /// Take an idle connection that's still open, discarding stale ones
+    pub fn take(&self, port: u16) -> Option<TcpStream> {
+        let mut idle = self.idle.lock().unwrap();
+        let conns = idle.get_mut(&port)?;
+        let mut found = None;
+        while let Some(conn) = conns.pop() {
+            if conn.opened_at.elapsed() < MAX_IDLE && is_open(&conn.stream) {
+                found = Some(conn.stream);
+                break;
+            }
+        }
+        if conns.is_empty() {
+            idle.remove(&port);
+        }
+        found
+    }
+
+    /// Number of idle connections held for a port
+    pub fn idle(&self, port: u16) -> usize {
+        self.idle.lock().unwrap().get(&port).map_or(0, Vec::len)
+    }
+
+    /// Drop all idle connections for a port (its instance went away)
+    pub fn clear(&self, port: u16) {
+        self.idle.lock().unwrap().remove(&port);
+    }
+}
+
+/// An idle connection is usable only if the peer hasn't closed it or sent anything
+fn is_open(stream: &TcpStream) -> bool {
+    let mut buf = [0u8; 1];
+    matches!(
+        stream.try_read(&mut buf),
+        Err(e) if e.kind() == std::io::ErrorKind::WouldBlock
+    )
+}
+
+#[cfg(test)]
+mod tests {
+    use super::*;
+    use tokio::net::TcpListener;
+
+    async fn listener() -> (TcpListener, u16) {
+        let listener = TcpListener::bind("127.0.0.1:0").await.unwrap();
+        let port = listener.local_addr().unwrap().port();
+        (listener, port)
+    }
+
+    #[tokio::test]
+    async fn test_fill_opens_requested_connections() {
+        let (_listener, port) = listener().await;
+        let pool = WarmPool::new();
+
+        assert_eq!(pool.fill(port, 3).await, 3);
+        assert_eq!(pool.idle(port), 3);
+
+        // Filling again only tops up
+        pool.take(port).unwrap();
+        assert_eq!(pool.fill(port, 3).await, 3);
+    }
+
+    #[tokio::test]
+    async fn test_fill_stops_when_backend_refuses() {
+        let (listener, port) = listener().await;
+        drop(listener);
+        let pool = WarmPool::new();
+        assert_eq!(pool.fill(port, 3).await, 0);
+        assert!(pool.take(port).is_none());
+    }
+
+    #[tokio::test]
+    async fn test_take_skips_closed_connections() {
+        let (listener, port) = listener().await;
+        let pool = WarmPool::new();
+        pool.fill(port, 2).await;
+
+        // Backend accepts and immediately closes both connections
+        for _ in 0..2 {
+            let (conn, _) = listener.accept().await.unwrap();
+            drop(conn);
+        }
+        tokio::time::sleep(Duration::from_millis(50)).await;
+
+        assert!(pool.take(port).is_none());
+        assert_eq!(pool.idle(port), 0);
+    }
+
+    #[tokio::test]
+    async fn test_clear() {
+        let (_listener, port) = listener().await;
+        let pool = WarmPool::new();
+        pool.fill(port, 2).await;
+        pool.clear(port);
+        assert_eq!(pool.idle(port), 0);
+    }
+}
@@ -25,6 +25,8 @@ pub fn test_config_with_process(name: &str, command: &str, args: Vec<&str>) -> C
         command: command.to_string(),
         args: args.into_iter().map(|s| s.to_string()).collect(),
         socket: format!("/tmp/tenement-test-{}/{{name}}-{{id}}.sock", test_id),
+        unix_socket: Default::default(),
+        connection_pool: Default::default(),
         isolation: RuntimeType::Process,
         health: None,
         env: HashMap::new(),
@@ -44,6 +46,62 @@ pub fn test_config_with_process(name: &str, command: &str, args: Vec<&str>) -> C
         vsock_port: 5000,
         storage_quota_mb: None,
         storage_persist: false,
+        secrets: HashMap::new(),
+        reload_signal: None,
+        fault: None,
+        concurrency_weight: 1,
+        shell: None,
+        health_check: Default::default(),
+        readiness: None,
+        warm_connections: 0,
+        log_rate_limit: None,
+        tmp_dir: false,
+        required_env: Vec::new(),
+        redact_env: Vec::new(),
+        post_stop: None,
+        post_stop_timeout: 10,
+        stop_signal: None,
+        stop_timeout: None,
+        stop_process_group: true,
+        hooks: Default::default(),
+        domains: Vec::new(),
+        replicas: 1,
+        load_balance: Default::default(),
+        slow_start: None,
+        autoscale: None,
+        access: None,
+        compression: None,
+        cache: None,
+        preview: None,
+        env_files: Vec::new(),
+        log_sinks: Vec::new(),
+        limits: Default::default(),
+        filesystem: Default::default(),
+        egress: None,
+        volumes: Default::default(),
+        listen: None,
+        user: None,
+        group: None,
+        depends_on: Default::default(),
+        stack: None,
+        uses: Vec::new(),
+        middleware: Vec::new(),
+        deploy: Default::default(),
+        git: None,
+        stream_idle_timeout: None,
+        protocol: Default::default(),
+        rate_limit: None,
+        max_concurrency: None,
+        max_queue: None,
+        queue_timeout_ms: None,
+        retry: None,
+        circuit_breaker: None,
+        maintenance_page: None,
+        kind: Default::default(),
+        root: None,
+        spa: false,
+        cache_max_age: 3600,
+        access_log: None,
     };
 
     config.service.insert(name.to_string(), process);
@@ -157,6 +157,7 @@ async fn test_stress_concurrent_log_entries() {
         level: None,
         search: None,
         limit: None,
+        since: None,
     };
     let logs = log_buffer.query(&query).await;
 
@@ -195,6 +196,7 @@ async fn test_stress_log_buffer_capacity() {
         level: None,
         search: None,
         limit: None,
+        since: None,
     };
     let logs = log_buffer.query(&query).await;
 
@@ -328,6 +330,7 @@ async fn test_stress_broadcast_slow_subscriber() {
         level: None,
         search: None,
         limit: Some(100),
+        since: None,
     };
     let logs = log_buffer.query(&query).await;
     assert!(!logs.is_empty(), "Logs should have been stored");
@@ -368,6 +371,7 @@ async fn test_stress_multiple_subscribers() {
         level: None,
         search: None,
         limit: None,
+        since: None,
     };
     let logs = log_buffer.query(&query).await;
     assert_eq!(